@@ -2,11 +2,12 @@ package agent
 
 import (
 	"context"
+	"io"
+	"sync/atomic"
 	"time"
 
 	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
-	"github.com/mackerelio/mackerel-agent/mackerel"
 	"github.com/mackerelio/mackerel-agent/metadata"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	mkr "github.com/mackerelio/mackerel-client-go"
@@ -14,26 +15,72 @@ import (
 
 // Agent is the root of metrics collectors
 type Agent struct {
+	// heartbeats is the first for the 64-bit alignment of atomic on 386
+	heartbeats uint64
+
 	MetricsGenerators  []metrics.Generator
 	PluginGenerators   []metrics.PluginGenerator
 	Checkers           []*checks.Checker
 	MetadataGenerators []*metadata.Generator
+
+	// MetricsConcurrency is the number of the plugin generators executed concurrently.
+	// DefaultMetricsConcurrency is used if it is zero.
+	MetricsConcurrency int
+	// MetricNameCollision is how to treat the metric names generated by more
+	// than one of the generators. The last one wins if it is empty.
+	MetricNameCollision config.MetricNameCollision
 }
 
 // MetricsResult XXX
 type MetricsResult struct {
 	Created time.Time
 	Values  []*metrics.ValuesCustomIdentifier
+	// Elapsed is the wall time to collect the values.
+	Elapsed time.Duration
+	// Errors are the errors of the generators which failed.
+	Errors []error `json:"-"`
+}
+
+// Close releases the resources of the generators implementing io.Closer,
+// such as the performance counter queries on Windows.
+func (agent *Agent) Close() {
+	generators := make([]metrics.Generator, 0, len(agent.MetricsGenerators)+len(agent.PluginGenerators))
+	generators = append(generators, agent.MetricsGenerators...)
+	for _, g := range agent.PluginGenerators {
+		generators = append(generators, g)
+	}
+	for _, g := range generators {
+		if c, ok := g.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				logger.Warningf("Failed to close the generator %T: %s", g, err)
+			}
+		}
+	}
 }
 
 // CollectMetrics collects metrics with generators.
 func (agent *Agent) CollectMetrics(collectedTime time.Time) *MetricsResult {
+	return agent.collectMetrics(collectedTime, false, config.PostMetricsInterval)
+}
+
+// collectMetrics collects metrics with generators.
+// If splay is true, the generators implementing metrics.Splayer are delayed,
+// though the values are still created at collectedTime.
+// It warns if collecting the values takes longer than interval.
+func (agent *Agent) collectMetrics(collectedTime time.Time, splay bool, interval time.Duration) *MetricsResult {
 	generators := agent.MetricsGenerators
 	for _, g := range agent.PluginGenerators {
 		generators = append(generators, g)
 	}
-	values := generateValues(generators)
-	return &MetricsResult{Created: collectedTime, Values: values}
+	startedAt := time.Now()
+	values, errs := generateValues(generators, splay, agent.MetricsConcurrency, agent.MetricNameCollision)
+	elapsed := time.Now().Sub(startedAt)
+	if elapsed > interval {
+		logger.Warningf("Collecting the metrics took %s, which exceeds the interval %s. Please consider increasing metrics_concurrency or fixing the slow plugins", elapsed, interval)
+	} else {
+		logger.Debugf("Collected the metrics of %d generators in %s", len(generators), elapsed)
+	}
+	return &MetricsResult{Created: collectedTime, Values: values, Elapsed: elapsed, Errors: errs}
 }
 
 // Watch XXX
@@ -46,8 +93,9 @@ func (agent *Agent) Watch(ctx context.Context) chan *MetricsResult {
 	go func() {
 		t := time.NewTicker(1 * time.Second)
 
-		last := time.Now()
-		ticker <- last // sends tick once at first
+		s := newScheduler(interval, newSystemClock())
+		ticker <- s.lastWall // sends tick once at first
+		atomic.AddUint64(&agent.heartbeats, 1)
 
 		for {
 			select {
@@ -55,17 +103,15 @@ func (agent *Agent) Watch(ctx context.Context) chan *MetricsResult {
 				close(ticker)
 				t.Stop()
 				return
-			case t := <-t.C:
-				// Fire an event at 0 second per minute.
-				// Because ticks may not be accurate,
-				// fire an event if t - last is more than 1 minute
-				if t.Second()%int(interval.Seconds()) == 0 || t.After(last.Add(interval)) {
+			case <-t.C:
+				if at, ok := s.tick(); ok {
 					// Non-blocking send of time.
 					// If `collectMetrics` runs with max concurrency, we drop ticks.
 					// Because the time is used as agent.MetricsResult.Created.
 					select {
-					case ticker <- t:
-						last = t
+					case ticker <- at:
+						s.fired()
+						atomic.AddUint64(&agent.heartbeats, 1)
 					default:
 					}
 				}
@@ -83,7 +129,7 @@ func (agent *Agent) Watch(ctx context.Context) chan *MetricsResult {
 			ti := tickedTime
 			sem <- struct{}{}
 			go func() {
-				metricsResult <- agent.CollectMetrics(ti)
+				metricsResult <- agent.collectMetrics(ti, true, interval)
 				<-sem
 			}()
 		}
@@ -92,6 +138,12 @@ func (agent *Agent) Watch(ctx context.Context) chan *MetricsResult {
 	return metricsResult
 }
 
+// Heartbeats returns the number of the collections started by the loop of
+// Watch, which stops increasing when the loop is stuck.
+func (agent *Agent) Heartbeats() uint64 {
+	return atomic.LoadUint64(&agent.heartbeats)
+}
+
 // CollectGraphDefsOfPlugins collects GraphDefs of Plugins
 func (agent *Agent) CollectGraphDefsOfPlugins() []*mkr.GraphDefsParam {
 	payloads := []*mkr.GraphDefsParam{}
@@ -108,15 +160,3 @@ func (agent *Agent) CollectGraphDefsOfPlugins() []*mkr.GraphDefsParam {
 
 	return payloads
 }
-
-// InitPluginGenerators XXX
-func (agent *Agent) InitPluginGenerators(api *mackerel.API) {
-	payloads := agent.CollectGraphDefsOfPlugins()
-
-	if len(payloads) > 0 {
-		err := api.CreateGraphDefs(payloads)
-		if err != nil {
-			logger.Errorf("Failed to create graphdefs: %s", err)
-		}
-	}
-}
@@ -101,3 +101,22 @@ func TestAgent_Watch(t *testing.T) {
 		}
 	}
 }
+
+type closingGenerator struct {
+	fakeGenerator
+	closed bool
+}
+
+func (g *closingGenerator) Close() error {
+	g.closed = true
+	return nil
+}
+
+func TestAgent_Close(t *testing.T) {
+	g := &closingGenerator{}
+	ag := &Agent{MetricsGenerators: []metrics.Generator{&fakeGenerator{}, g}}
+	ag.Close()
+	if !g.closed {
+		t.Error("the generators implementing io.Closer should be closed")
+	}
+}
@@ -1,67 +1,311 @@
 package agent
 
 import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/cpuquota"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
-var logger = logging.GetLogger("agent")
-
-func generateValues(generators []metrics.Generator) []*metrics.ValuesCustomIdentifier {
-	processed := make(chan *metrics.ValuesCustomIdentifier)
-	finish := make(chan struct{})
-	result := make(chan []*metrics.ValuesCustomIdentifier)
-
-	go func() {
-		allValues := []*metrics.ValuesCustomIdentifier{}
-		for {
-			select {
-			case values := <-processed:
-				allValues = metrics.MergeValuesCustomIdentifiers(allValues, values)
-			case <-finish:
-				result <- allValues
+var logger = logformat.GetLogger("agent")
+
+const (
+	minDefaultMetricsConcurrency = 4
+	maxDefaultMetricsConcurrency = 8
+)
+
+// DefaultMetricsConcurrency returns the default number of the plugin generators
+// executed concurrently. The plugins mostly wait for the commands, so at least
+// 4 of them run concurrently on the hosts of a few CPUs, but the number is
+// capped by the CPU quota of the cgroup if it is limited.
+func DefaultMetricsConcurrency() int {
+	n := runtime.NumCPU()
+	if _, limited := cpuquota.CPUs(); limited {
+		n = cpuquota.Cap(n)
+	} else if n < minDefaultMetricsConcurrency {
+		n = minDefaultMetricsConcurrency
+	}
+	if n > maxDefaultMetricsConcurrency {
+		return maxDefaultMetricsConcurrency
+	}
+	return n
+}
+
+// DefaultChecksConcurrency returns the number of the checkers executed
+// concurrently, which is the CPU quota of the cgroup rounded up. It returns
+// zero, which does not limit the checkers, if the cgroup is not limited.
+func DefaultChecksConcurrency() int {
+	if _, limited := cpuquota.CPUs(); !limited {
+		return 0
+	}
+	return cpuquota.Cap(runtime.NumCPU())
+}
+
+var generateDurations = struct {
+	sync.Mutex
+	durations map[string]time.Duration
+}{durations: make(map[string]time.Duration)}
+
+// GenerateDurations returns the last durations of Generate() of the plugin
+// generators keyed by their names.
+func GenerateDurations() map[string]time.Duration {
+	generateDurations.Lock()
+	defer generateDurations.Unlock()
+	durations := make(map[string]time.Duration, len(generateDurations.durations))
+	for k, v := range generateDurations.durations {
+		durations[k] = v
+	}
+	return durations
+}
+
+func recordGenerateDuration(g metrics.Generator, d time.Duration) {
+	generateDurations.Lock()
+	defer generateDurations.Unlock()
+	generateDurations.durations[generatorName(g)] = d
+}
+
+// generateValues runs the generators concurrently, and at most concurrency of them
+// are the plugin generators, which execute the commands. The built-in generators
+// are not limited since some of them sleep for the interval to calculate the rates.
+// The values are merged in order of generators regardless of when they finish,
+// and the errors of the generators which failed are returned with them.
+// The generators reading the same files share them by a snapshot of the cycle.
+func generateValues(generators []metrics.Generator, splay bool, concurrency int, collision config.MetricNameCollision) ([]*metrics.ValuesCustomIdentifier, []error) {
+	if concurrency <= 0 {
+		concurrency = DefaultMetricsConcurrency()
+	}
+	snapshot := metrics.NewSnapshot()
+	sem := make(chan struct{}, concurrency)
+	processed := make([][]*metrics.ValuesCustomIdentifier, len(generators))
+	errs := make([]error, len(generators))
+
+	var wg sync.WaitGroup
+	for i, g := range generators {
+		wg.Add(1)
+		go func(i int, g metrics.Generator) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Errorf("Panic: generating value in %T (skip this metric): %s", g, r)
+					errs[i] = fmt.Errorf("%s: panic: %v", generatorName(g), r)
+				}
+				wg.Done()
+			}()
+
+			var delay time.Duration
+			if s, ok := g.(metrics.Splayer); ok && splay {
+				delay = s.Splay()
+				time.Sleep(delay)
+			}
+
+			// the worker is acquired after the splay not to keep the others waiting
+			pluginGenerator, isPlugin := g.(metrics.PluginGenerator)
+			if isPlugin {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
+
+			startedAt := time.Now()
+			var values metrics.Values
+			var hosts map[string]metrics.Values
+			var err error
+			if sg, ok := g.(metrics.SnapshotGenerator); ok {
+				values, err = sg.GenerateSnapshot(snapshot)
+			} else if cg, ok := g.(metrics.CustomIdentifiersGenerator); ok {
+				values, hosts, err = cg.GenerateCustomIdentifiers()
+			} else {
+				values, err = g.Generate()
+			}
+			elapsed := time.Now().Sub(startedAt)
+			if isPlugin {
+				recordGenerateDuration(g, elapsed)
+			}
+			if seconds := (elapsed / time.Second); seconds > 120 {
+				logger.Warningf("%T.Generate() take a long time (%d seconds)", g, seconds)
+			}
+			if delay > 0 && delay+elapsed > config.PostMetricsInterval {
+				logger.Warningf("%v overlaps the next collection (splay %s + elapsed %s)", g, delay, elapsed)
+			}
+			if err == metrics.ErrPluginThrottled {
+				logger.Debugf("%v is skipped: %s", g, err)
+				return
+			}
+			// the values of the plugin exiting with non-zero are still posted,
+			// while it is reported as a failure
+			if _, ok := err.(*metrics.PluginExitError); ok {
+				logger.Debugf("%v %s", g, err)
+				errs[i] = fmt.Errorf("%s: %s", generatorName(g), err)
+				err = nil
+			}
+			if err != nil {
+				logger.Errorf("Failed to generate value in %T (skip this metric): %s", g, err.Error())
+				errs[i] = fmt.Errorf("%s: %s", generatorName(g), err)
 				return
 			}
+			var customIdentifier *string
+			if isPlugin {
+				customIdentifier = pluginGenerator.CustomIdentifier()
+			}
+			processed[i] = []*metrics.ValuesCustomIdentifier{{
+				Values:           values,
+				CustomIdentifier: customIdentifier,
+			}}
+			ids := make([]string, 0, len(hosts))
+			for id := range hosts {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				id := id
+				processed[i] = append(processed[i], &metrics.ValuesCustomIdentifier{Values: hosts[id], CustomIdentifier: &id})
+			}
+		}(i, g)
+	}
+	wg.Wait()
+
+	allValues := mergeValues(generators, processed, collision)
+	var allErrs []error
+	for _, err := range errs {
+		if err != nil {
+			allErrs = append(allErrs, err)
 		}
-	}()
-
-	go func() {
-		var wg sync.WaitGroup
-		for _, g := range generators {
-			wg.Add(1)
-			go func(g metrics.Generator) {
-				defer func() {
-					if r := recover(); r != nil {
-						logger.Errorf("Panic: generating value in %T (skip this metric): %s", g, r)
-					}
-					wg.Done()
-				}()
+	}
+	return allValues, allErrs
+}
 
-				startedAt := time.Now()
-				values, err := g.Generate()
-				if seconds := (time.Now().Sub(startedAt) / time.Second); seconds > 120 {
-					logger.Warningf("%T.Generate() take a long time (%d seconds)", g, seconds)
+// nameCollision is the metric names generated by both of the generators.
+type nameCollision struct {
+	first, second int
+}
+
+// mergeValues merges the values of the generators by the custom identifiers
+// in order of generators. The names generated by more than one of them are
+// resolved by collision, and logged by the pairs of the generators.
+func mergeValues(generators []metrics.Generator, processed [][]*metrics.ValuesCustomIdentifier, collision config.MetricNameCollision) []*metrics.ValuesCustomIdentifier {
+	allValues := []*metrics.ValuesCustomIdentifier{}
+	// sources are the indexes of the generators of the names in allValues
+	var sources []map[string]int
+	var collisions map[nameCollision][]string
+	for i, vs := range processed {
+		for _, v := range vs {
+			k := indexOfCustomIdentifier(allValues, v.CustomIdentifier)
+			if k < 0 {
+				allValues = append(allValues, v)
+				src := make(map[string]int, len(v.Values))
+				for name := range v.Values {
+					src[name] = i
 				}
-				if err != nil {
-					logger.Errorf("Failed to generate value in %T (skip this metric): %s", g, err.Error())
-					return
+				sources = append(sources, src)
+				continue
+			}
+			merged, src := allValues[k].Values, sources[k]
+			for name, value := range v.Values {
+				j, ok := src[name]
+				if !ok {
+					merged[name] = value
+					src[name] = i
+					continue
 				}
-				var customIdentifier *string
-				if pluginGenerator, ok := g.(metrics.PluginGenerator); ok {
-					customIdentifier = pluginGenerator.CustomIdentifier()
+				if collisions == nil {
+					collisions = make(map[nameCollision][]string)
 				}
-				processed <- &metrics.ValuesCustomIdentifier{
-					Values:           values,
-					CustomIdentifier: customIdentifier,
+				c := nameCollision{j, i}
+				collisions[c] = append(collisions[c], name)
+				switch collision {
+				case config.MetricNameCollisionFirstWins:
+				case config.MetricNameCollisionPrefixPlugin:
+					// the first one wins if the other is not a metrics plugin
+					if g, ok := generators[i].(metrics.NamedGenerator); ok {
+						renamed := "custom." + g.PluginName() + "." + strings.TrimPrefix(name, "custom.")
+						if _, ok := src[renamed]; !ok {
+							merged[renamed] = value
+							src[renamed] = i
+						}
+					}
+				default:
+					merged[name] = value
+					src[name] = i
 				}
-			}(g)
+			}
 		}
-		wg.Wait()
-		finish <- struct{}{} // processed all jobs
-	}()
+	}
+	logNameCollisions(generators, collisions, collision)
+	recordMetricSources(generators, sources)
+	return allValues
+}
+
+var metricSources = struct {
+	sync.Mutex
+	ids map[string]string
+}{}
+
+// recordMetricSources records the IDs of the metrics plugins of the names, by
+// the indexes of the generators of the names.
+func recordMetricSources(generators []metrics.Generator, sources []map[string]int) {
+	ids := make(map[string]string)
+	for _, src := range sources {
+		for name, i := range src {
+			if g, ok := generators[i].(metrics.NamedGenerator); ok {
+				ids[name] = "metrics." + g.PluginName()
+			}
+		}
+	}
+	metricSources.Lock()
+	defer metricSources.Unlock()
+	metricSources.ids = ids
+}
+
+// MetricSource returns the ID of the metrics plugin, such as "metrics.foo",
+// which generated the metric name in the last collection, or "" if it is not
+// generated by a metrics plugin.
+func MetricSource(name string) string {
+	metricSources.Lock()
+	defer metricSources.Unlock()
+	return metricSources.ids[name]
+}
+
+func indexOfCustomIdentifier(values []*metrics.ValuesCustomIdentifier, customIdentifier *string) int {
+	for i, v := range values {
+		if v.CustomIdentifier == customIdentifier ||
+			(v.CustomIdentifier != nil && customIdentifier != nil && *v.CustomIdentifier == *customIdentifier) {
+			return i
+		}
+	}
+	return -1
+}
+
+// logNameCollisions logs the collisions in the stable order and messages,
+// which are logged once an hour by the deduplication of the logs.
+func logNameCollisions(generators []metrics.Generator, collisions map[nameCollision][]string, collision config.MetricNameCollision) {
+	if len(collisions) == 0 {
+		return
+	}
+	keys := make([]nameCollision, 0, len(collisions))
+	for c := range collisions {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].first != keys[j].first {
+			return keys[i].first < keys[j].first
+		}
+		return keys[i].second < keys[j].second
+	})
+	for _, c := range keys {
+		names := collisions[c]
+		sort.Strings(names)
+		logger.Errorf("%d metric names are generated by both %s and %s, such as %q (metric_name_collision = %q)", len(names), generatorName(generators[c.first]), generatorName(generators[c.second]), names[0], collision)
+	}
+}
 
-	return <-result
+func generatorName(g metrics.Generator) string {
+	if s, ok := g.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", g)
 }
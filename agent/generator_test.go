@@ -1,9 +1,15 @@
 package agent
 
 import (
+	"fmt"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
 type testGenerator struct{}
@@ -24,9 +30,260 @@ func TestGenerateValues(t *testing.T) {
 	tg := &testGenerator{}
 	tpg := &testPanicGenerator{}
 	generators := []metrics.Generator{tg, tpg}
-	values := generateValues(generators)
+	values, errs := generateValues(generators, false, 0, "")
 
 	if len(values) != 1 {
 		t.Errorf("Num of results should be 1, but %d", len(values))
 	}
+	if len(errs) != 1 {
+		t.Errorf("the panic should be returned as an error, but %v", errs)
+	}
+}
+
+type testSplayGenerator struct {
+	testGenerator
+	generatedAt time.Time
+}
+
+func (g *testSplayGenerator) Splay() time.Duration {
+	return 100 * time.Millisecond
+}
+
+func (g *testSplayGenerator) Generate() (metrics.Values, error) {
+	g.generatedAt = time.Now()
+	return g.testGenerator.Generate()
+}
+
+func TestGenerateValues_Splay(t *testing.T) {
+	g := &testSplayGenerator{}
+	generators := []metrics.Generator{g}
+
+	startedAt := time.Now()
+	generateValues(generators, false, 0, "")
+	if d := g.generatedAt.Sub(startedAt); d >= 100*time.Millisecond {
+		t.Errorf("generator should not be delayed without splay, but delayed %s", d)
+	}
+
+	startedAt = time.Now()
+	generateValues(generators, true, 0, "")
+	if d := g.generatedAt.Sub(startedAt); d < 100*time.Millisecond {
+		t.Errorf("generator should be delayed by its splay, but delayed %s", d)
+	}
+}
+
+type testSlowPluginGenerator struct {
+	mu                *sync.Mutex
+	running, maxCount *int
+	name              string
+	customIdentifier  *string
+}
+
+func (g *testSlowPluginGenerator) Generate() (metrics.Values, error) {
+	g.mu.Lock()
+	*g.running++
+	if *g.running > *g.maxCount {
+		*g.maxCount = *g.running
+	}
+	g.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	g.mu.Lock()
+	*g.running--
+	g.mu.Unlock()
+	return metrics.Values{g.name: 1}, nil
+}
+
+func (g *testSlowPluginGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	return nil, nil
+}
+
+func (g *testSlowPluginGenerator) CustomIdentifier() *string {
+	return g.customIdentifier
+}
+
+func TestGenerateValues_Concurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, maxCount int
+	other := "other.example.com"
+	var generators []metrics.Generator
+	for i := 0; i < 6; i++ {
+		g := &testSlowPluginGenerator{mu: &mu, running: &running, maxCount: &maxCount, name: fmt.Sprintf("custom.foo.%d", i)}
+		if i%2 == 1 {
+			g.customIdentifier = &other
+		}
+		generators = append(generators, g)
+	}
+
+	startedAt := time.Now()
+	values, _ := generateValues(generators, false, 2, "")
+	if maxCount != 2 {
+		t.Errorf("the plugins should be executed 2 at a time but %d", maxCount)
+	}
+	if d := time.Since(startedAt); d < 150*time.Millisecond {
+		t.Errorf("the plugins should be executed in 3 rounds but took %s", d)
+	}
+	if len(values) != 2 || values[0].CustomIdentifier != nil || *values[1].CustomIdentifier != other {
+		t.Errorf("the values should be ordered by the generators: %v", values)
+	}
+	if len(values[0].Values) != 3 || len(values[1].Values) != 3 {
+		t.Errorf("the values should be merged by the custom identifiers: %v %v", values[0].Values, values[1].Values)
+	}
+	if d := GenerateDurations()["*agent.testSlowPluginGenerator"]; d < 50*time.Millisecond {
+		t.Errorf("the duration of the plugins should be recorded but %s", d)
+	}
+}
+
+func TestDefaultMetricsConcurrency(t *testing.T) {
+	if n := DefaultMetricsConcurrency(); n < 4 || n > 8 {
+		t.Errorf("the default concurrency should be between 4 and 8 regardless of the CPUs but got %d", n)
+	}
+}
+
+type testSnapshotGenerator struct {
+	mu        *sync.Mutex
+	snapshots *[]*metrics.Snapshot
+}
+
+func (g *testSnapshotGenerator) Generate() (metrics.Values, error) {
+	return g.GenerateSnapshot(metrics.NewSnapshot())
+}
+
+func (g *testSnapshotGenerator) GenerateSnapshot(s *metrics.Snapshot) (metrics.Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.snapshots = append(*g.snapshots, s)
+	return metrics.Values{"test.snapshot": 1}, nil
+}
+
+func TestGenerateValues_Snapshot(t *testing.T) {
+	var mu sync.Mutex
+	var snapshots []*metrics.Snapshot
+	g := &testSnapshotGenerator{mu: &mu, snapshots: &snapshots}
+	generators := []metrics.Generator{g, g, &testGenerator{}}
+	for i := 0; i < 2; i++ {
+		if _, errs := generateValues(generators, false, 0, ""); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+	}
+	if len(snapshots) != 4 || snapshots[0] == nil {
+		t.Fatalf("the generators should be called with the snapshot: %v", snapshots)
+	}
+	if snapshots[0] != snapshots[1] || snapshots[2] != snapshots[3] {
+		t.Errorf("the snapshot should be shared in the cycle: %v", snapshots)
+	}
+	if snapshots[0] == snapshots[2] {
+		t.Errorf("the snapshot should be created for each cycle: %v", snapshots)
+	}
+}
+
+type testNamedGenerator struct {
+	name   string
+	values metrics.Values
+}
+
+func (g *testNamedGenerator) Generate() (metrics.Values, error) {
+	values := make(metrics.Values, len(g.values))
+	for k, v := range g.values {
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (g *testNamedGenerator) PluginName() string {
+	return g.name
+}
+
+func TestGenerateValues_NameCollision(t *testing.T) {
+	generators := []metrics.Generator{
+		&testGenerator{},
+		&testNamedGenerator{name: "foo", values: metrics.Values{"test": 1, "custom.app.requests": 2, "custom.foo.only": 3}},
+		&testNamedGenerator{name: "bar", values: metrics.Values{"custom.app.requests": 4, "custom.bar.only": 5}},
+	}
+	tests := []struct {
+		collision config.MetricNameCollision
+		expect    metrics.Values
+	}{
+		{
+			collision: config.MetricNameCollisionFirstWins,
+			expect:    metrics.Values{"test": 10, "custom.app.requests": 2, "custom.foo.only": 3, "custom.bar.only": 5},
+		},
+		{
+			collision: config.MetricNameCollisionLastWins,
+			expect:    metrics.Values{"test": 1, "custom.app.requests": 4, "custom.foo.only": 3, "custom.bar.only": 5},
+		},
+		{
+			collision: config.MetricNameCollisionPrefixPlugin,
+			expect: metrics.Values{
+				"test": 10, "custom.foo.test": 1,
+				"custom.app.requests": 2, "custom.bar.app.requests": 4,
+				"custom.foo.only": 3, "custom.bar.only": 5,
+			},
+		},
+	}
+	for _, tc := range tests {
+		// the detection is reset per cycle
+		for i := 0; i < 2; i++ {
+			values, _ := generateValues(generators, false, 0, tc.collision)
+			if len(values) != 1 || !reflect.DeepEqual(values[0].Values, tc.expect) {
+				t.Errorf("%s: the values should be %v but got %v", tc.collision, tc.expect, values[0].Values)
+			}
+		}
+	}
+	for name, id := range map[string]string{"custom.bar.app.requests": "metrics.bar", "custom.foo.only": "metrics.foo", "test": ""} {
+		if got := MetricSource(name); got != id {
+			t.Errorf("the source of %s should be %q but %q", name, id, got)
+		}
+	}
+}
+
+type testCustomIdentifiersGenerator struct {
+	testNamedGenerator
+	hosts map[string]metrics.Values
+}
+
+func (g *testCustomIdentifiersGenerator) GenerateCustomIdentifiers() (metrics.Values, map[string]metrics.Values, error) {
+	values, err := g.Generate()
+	return values, g.hosts, err
+}
+
+func TestGenerateValues_CustomIdentifiers(t *testing.T) {
+	generators := []metrics.Generator{
+		&testGenerator{},
+		&testCustomIdentifiersGenerator{
+			testNamedGenerator: testNamedGenerator{name: "foo", values: metrics.Values{"custom.foo.a": 1}},
+			hosts: map[string]metrics.Values{
+				"db2.example.com": {"custom.foo.a": 3},
+				"db1.example.com": {"custom.foo.a": 2},
+			},
+		},
+		&testCustomIdentifiersGenerator{
+			testNamedGenerator: testNamedGenerator{name: "bar", values: metrics.Values{"custom.bar.a": 4}},
+			hosts:              map[string]metrics.Values{"db1.example.com": {"custom.bar.a": 5}},
+		},
+	}
+	values, errs := generateValues(generators, false, 0, "")
+	if len(errs) != 0 {
+		t.Fatalf("should not raise errors: %v", errs)
+	}
+	customIdentifier := func(v *metrics.ValuesCustomIdentifier) string {
+		if v.CustomIdentifier == nil {
+			return ""
+		}
+		return *v.CustomIdentifier
+	}
+	expect := []struct {
+		customIdentifier string
+		values           metrics.Values
+	}{
+		{"", metrics.Values{"test": 10, "custom.foo.a": 1, "custom.bar.a": 4}},
+		{"db1.example.com", metrics.Values{"custom.foo.a": 2, "custom.bar.a": 5}},
+		{"db2.example.com", metrics.Values{"custom.foo.a": 3}},
+	}
+	if len(values) != len(expect) {
+		t.Fatalf("the values should be grouped by %d hosts but %d", len(expect), len(values))
+	}
+	for i, e := range expect {
+		if got := customIdentifier(values[i]); got != e.customIdentifier || !reflect.DeepEqual(values[i].Values, e.values) {
+			t.Errorf("the values of %q should be %v but got %q: %v", e.customIdentifier, e.values, got, values[i].Values)
+		}
+	}
 }
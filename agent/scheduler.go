@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// suspendThreshold is the gap between the ticks of the scheduler beyond which
+// the host is regarded as suspended, such as a laptop sleeping or a VM paused
+// for the live migration.
+const suspendThreshold = 30 * time.Second
+
+// clock reads the wall clock and the monotonic clock, which is replaced in the
+// tests to simulate the suspends. The monotonic clock stops while the host is
+// suspended on Linux and darwin, and the wall clock jumps on resume.
+type clock interface {
+	// Now returns the wall clock without the monotonic clock reading.
+	Now() time.Time
+	// Monotonic returns the monotonic clock since an arbitrary point.
+	Monotonic() time.Duration
+}
+
+type systemClock struct {
+	start time.Time
+}
+
+func newSystemClock() *systemClock {
+	return &systemClock{start: time.Now()}
+}
+
+func (c *systemClock) Now() time.Time {
+	return time.Now().Round(0)
+}
+
+func (c *systemClock) Monotonic() time.Duration {
+	return time.Since(c.start)
+}
+
+// scheduler decides the collections of the metrics by the ticks every second,
+// which are at 0 second per interval by the wall clock.
+type scheduler struct {
+	interval time.Duration
+	clock    clock
+
+	lastWall  time.Time
+	lastMono  time.Duration
+	firedMono time.Duration
+}
+
+// newScheduler returns the scheduler started at the first collection.
+func newScheduler(interval time.Duration, c clock) *scheduler {
+	s := &scheduler{interval: interval, clock: c}
+	s.lastWall, s.lastMono = c.Now(), c.Monotonic()
+	s.firedMono = s.lastMono
+	return s
+}
+
+// tick returns the time of the tick, and whether the metrics should be
+// collected at it. The collections missed by a gap of the ticks, such as by a
+// suspend, are skipped instead of replayed, and the gap is noted for the
+// generators to re-baseline the counters.
+func (s *scheduler) tick() (time.Time, bool) {
+	wall, mono := s.clock.Now(), s.clock.Monotonic()
+	gap := s.gap(wall, mono)
+	s.lastWall, s.lastMono = wall, mono
+	if gap > 0 {
+		logger.Warningf("Detected the suspend of the host or the jump of the clock for %s, and skipped the collections of the metrics missed in it", gap.Round(time.Second))
+		metrics.NoteClockGap()
+		s.firedMono = mono
+		return wall, false
+	}
+	// Fire an event at 0 second per minute.
+	// Because ticks may not be accurate,
+	// fire an event if it is more than the interval since the last one.
+	return wall, wall.Second()%int(s.interval.Seconds()) == 0 || mono-s.firedMono > s.interval
+}
+
+// fired records that the metrics are collected at the last tick, which is not
+// if the collections are running with the max concurrency.
+func (s *scheduler) fired() {
+	s.firedMono = s.lastMono
+}
+
+// gap returns the gap since the last tick beyond suspendThreshold, or zero.
+// The wall clock jumps and the monotonic clock does not advance across a
+// suspend, and both of them advance across a pause of the VM.
+func (s *scheduler) gap(wall time.Time, mono time.Duration) time.Duration {
+	monoElapsed := mono - s.lastMono
+	gap := wall.Sub(s.lastWall) - monoElapsed
+	if gap < 0 {
+		// the wall clock went backwards
+		gap = -gap
+	}
+	if monoElapsed > gap {
+		gap = monoElapsed
+	}
+	if gap < suspendThreshold {
+		return 0
+	}
+	return gap
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+type fakeClock struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.wall
+}
+
+func (c *fakeClock) Monotonic() time.Duration {
+	return c.mono
+}
+
+// advance advances the wall clock by wall and the monotonic clock by mono.
+func (c *fakeClock) advance(wall, mono time.Duration) {
+	c.wall, c.mono = c.wall.Add(wall), c.mono+mono
+}
+
+func TestScheduler(t *testing.T) {
+	c := &fakeClock{wall: time.Date(2020, 1, 1, 12, 0, 30, 0, time.UTC)}
+	s := newScheduler(time.Minute, c)
+	var fired []time.Time
+	tick := func() {
+		if at, ok := s.tick(); ok {
+			fired = append(fired, at)
+			s.fired()
+		}
+	}
+	for i := 0; i < 89; i++ {
+		c.advance(time.Second, time.Second)
+		tick()
+	}
+	if len(fired) != 1 || fired[0] != time.Date(2020, 1, 1, 12, 1, 0, 0, time.UTC) {
+		t.Fatalf("the metrics should be collected at 0 second: %v", fired)
+	}
+
+	// suspended for 2 hours at 12:01:59
+	fired = nil
+	before := metrics.NewCounterSample(map[string]float64{"a": 1}, c.wall)
+	c.advance(2*time.Hour, time.Second)
+	tick()
+	if len(fired) != 0 {
+		t.Errorf("the missed collections should be skipped: %v", fired)
+	}
+	if deltas, err := metrics.CounterDeltas(before, metrics.NewCounterSample(map[string]float64{"a": 2}, c.wall), config.CounterWrapDrop); err == nil {
+		t.Errorf("the counters should be re-baselined after the suspend: %v", deltas)
+	}
+	for i := 0; i < 60; i++ {
+		c.advance(time.Second, time.Second)
+		tick()
+	}
+	if len(fired) != 1 || fired[0] != time.Date(2020, 1, 1, 14, 2, 0, 0, time.UTC) {
+		t.Errorf("the metrics should be collected at the next 0 second after the suspend: %v", fired)
+	}
+
+	// the VM is paused, where both of the clocks advance
+	fired = nil
+	c.advance(10*time.Minute, 10*time.Minute)
+	tick()
+	if len(fired) != 0 {
+		t.Errorf("the missed collections should be skipped after the pause: %v", fired)
+	}
+
+	// the ticks are delayed within the threshold
+	c.wall = time.Date(2020, 1, 1, 15, 0, 10, 0, time.UTC)
+	s = newScheduler(time.Minute, c)
+	fired = nil
+	for i := 0; i < 4; i++ {
+		c.advance(20*time.Second, 20*time.Second)
+		tick()
+	}
+	if len(fired) != 1 || fired[0] != time.Date(2020, 1, 1, 15, 1, 30, 0, time.UTC) {
+		t.Errorf("the metrics should be collected after the interval without the tick at 0 second: %v", fired)
+	}
+}
@@ -0,0 +1,226 @@
+package checks
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func (c *Checker) checkCert() (Status, string) {
+	conf := c.Config.Cert
+	target := conf.Path
+	var certs []*x509.Certificate
+	var err error
+	if conf.Path != "" {
+		certs, err = readCertificates(conf.Path)
+	} else {
+		target = conf.Address()
+		certs, err = fetchCertificates(conf)
+	}
+	if err != nil {
+		return StatusCritical, fmt.Sprintf("failed to get the certificate of %s: %s", target, err)
+	}
+	return verifyCertificates(conf, certs, time.Now())
+}
+
+// verifyCertificates verifies the first of certs at now, and the others are
+// the intermediates.
+func verifyCertificates(conf *config.CertCheck, certs []*x509.Certificate, now time.Time) (Status, string) {
+	leaf := certs[0]
+	summary := fmt.Sprintf("subject %q, issuer %q, expires at %s", leaf.Subject.String(), leaf.Issuer.String(), leaf.NotAfter.UTC().Format(time.RFC3339))
+	if isSelfSigned(leaf) {
+		summary += " (self-signed)"
+	}
+	if now.Before(leaf.NotBefore) {
+		return StatusCritical, fmt.Sprintf("not valid until %s: %s", leaf.NotBefore.UTC().Format(time.RFC3339), summary)
+	}
+	left := leaf.NotAfter.Sub(now)
+	if left <= 0 {
+		return StatusCritical, fmt.Sprintf("expired %d days ago: %s", int(-left/(24*time.Hour)), summary)
+	}
+	if conf.VerifyChain {
+		if err := verifyChain(conf, certs, now); err != nil {
+			return StatusCritical, fmt.Sprintf("failed to verify the chain: %s: %s", err, summary)
+		}
+	}
+	if conf.VerifyHostname {
+		if err := leaf.VerifyHostname(conf.ServerName); err != nil {
+			return StatusCritical, fmt.Sprintf("failed to verify the name: %s: %s", err, summary)
+		}
+	}
+	days := int(left / (24 * time.Hour))
+	message := fmt.Sprintf("expires in %d days: %s", days, summary)
+	switch {
+	case days < conf.CriticalDays:
+		return StatusCritical, message
+	case days < conf.WarningDays:
+		return StatusWarning, message
+	default:
+		return StatusOK, message
+	}
+}
+
+// isSelfSigned reports whether cert is signed by itself, which may not be a CA.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return cert.Subject.String() == cert.Issuer.String() &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+func verifyChain(conf *config.CertCheck, certs []*x509.Certificate, now time.Time) error {
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if conf.CAFile != "" {
+		roots, err := readCertificates(conf.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca_file: %s", err)
+		}
+		opts.Roots = x509.NewCertPool()
+		for _, cert := range roots {
+			opts.Roots.AddCert(cert)
+		}
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// readCertificates reads the certificates in the PEM file.
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return certs, nil
+}
+
+// fetchCertificates connects to the target, and returns the certificates
+// served without the verification, which is done by verifyCertificates. The
+// whole of the connection and the handshake is bounded by the timeout.
+func fetchCertificates(conf *config.CertCheck) ([]*x509.Certificate, error) {
+	conn, err := net.DialTimeout("tcp", conf.Address(), conf.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(conf.Timeout)); err != nil {
+		return nil, err
+	}
+	if conf.StartTLS != config.StartTLSNone {
+		if err := startTLS(conn, conf.StartTLS); err != nil {
+			return nil, fmt.Errorf("STARTTLS of %s failed: %s", conf.StartTLS, err)
+		}
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates are served")
+	}
+	return certs, nil
+}
+
+// startTLS requests the upgrade to TLS by the protocol. The server sends
+// nothing after the response until the handshake, so the buffer is dropped.
+func startTLS(conn net.Conn, protocol string) error {
+	tp := textproto.NewConn(conn)
+	switch protocol {
+	case config.StartTLSSMTP:
+		if _, _, err := tp.ReadResponse(220); err != nil {
+			return err
+		}
+		if err := tp.PrintfLine("EHLO mackerel-agent"); err != nil {
+			return err
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			return err
+		}
+		if err := tp.PrintfLine("STARTTLS"); err != nil {
+			return err
+		}
+		_, _, err := tp.ReadResponse(220)
+		return err
+	case config.StartTLSFTP:
+		if _, _, err := tp.ReadResponse(220); err != nil {
+			return err
+		}
+		if err := tp.PrintfLine("AUTH TLS"); err != nil {
+			return err
+		}
+		_, _, err := tp.ReadResponse(234)
+		return err
+	case config.StartTLSIMAP:
+		if err := expectLine(tp.R, "* OK"); err != nil {
+			return err
+		}
+		if err := tp.PrintfLine("a001 STARTTLS"); err != nil {
+			return err
+		}
+		return expectLine(tp.R, "a001 OK")
+	case config.StartTLSPOP3:
+		if err := expectLine(tp.R, "+OK"); err != nil {
+			return err
+		}
+		if err := tp.PrintfLine("STLS"); err != nil {
+			return err
+		}
+		return expectLine(tp.R, "+OK")
+	default:
+		return fmt.Errorf("unknown protocol")
+	}
+}
+
+// expectLine reads the lines up to the one of the status of IMAP or POP3,
+// skipping the untagged responses of IMAP, and expects it to start with prefix.
+func expectLine(r *bufio.Reader, prefix string) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, prefix) {
+			return nil
+		}
+		if strings.HasPrefix(line, "* ") && !strings.HasPrefix(prefix, "* ") {
+			continue
+		}
+		return fmt.Errorf("unexpected response: %q", line)
+	}
+}
@@ -0,0 +1,246 @@
+package checks
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates the certificate of cn signed by parent, or self-signed
+// if parent is nil. The certificate of the name starting with "Test " is a CA.
+func newTestCert(t *testing.T, cn string, notBefore, notAfter time.Time, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if strings.HasPrefix(cn, "Test ") {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		tmpl.DNSNames = []string{cn}
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func writePEM(t *testing.T, dir, name string, certs ...*testCert) string {
+	t.Helper()
+	var b []byte
+	for _, c := range certs {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})...)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestVerifyCertificates(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	ca := newTestCert(t, "Test CA", now.Add(-day), now.Add(3650*day), nil)
+	valid := newTestCert(t, "app.example.com", now.Add(-day), now.Add(100*day+time.Hour), ca)
+	soon := newTestCert(t, "app.example.com", now.Add(-day), now.Add(20*day+time.Hour), ca)
+	critical := newTestCert(t, "app.example.com", now.Add(-day), now.Add(3*day+time.Hour), ca)
+	expired := newTestCert(t, "app.example.com", now.Add(-10*day), now.Add(-2*day), ca)
+	notYet := newTestCert(t, "app.example.com", now.Add(day), now.Add(100*day+time.Hour), ca)
+	selfSigned := newTestCert(t, "app.example.com", now.Add(-day), now.Add(100*day+time.Hour), nil)
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := writePEM(t, dir, "ca.pem", ca)
+
+	conf := func(verifyChain bool) *config.CertCheck {
+		c := &config.CertCheck{ServerName: "app.example.com", WarningDays: 30, CriticalDays: 14, VerifyChain: verifyChain, VerifyHostname: true}
+		if verifyChain {
+			c.CAFile = caFile
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		conf    *config.CertCheck
+		cert    *testCert
+		status  Status
+		message string
+	}{
+		{"valid", conf(true), valid, StatusOK, "expires in 100 days"},
+		{"warning", conf(true), soon, StatusWarning, "expires in 20 days"},
+		{"critical", conf(true), critical, StatusCritical, "expires in 3 days"},
+		{"expired", conf(false), expired, StatusCritical, "expired 2 days ago"},
+		{"not yet valid", conf(false), notYet, StatusCritical, "not valid until " + notYet.cert.NotBefore.UTC().Format(time.RFC3339)},
+		{"self-signed", conf(true), selfSigned, StatusCritical, "failed to verify the chain"},
+		{"self-signed without verify_chain", conf(false), selfSigned, StatusOK, "(self-signed)"},
+		{"unknown authority", &config.CertCheck{WarningDays: 30, CriticalDays: 14, VerifyChain: true}, valid, StatusCritical, "failed to verify the chain"},
+	}
+	mismatch := conf(true)
+	mismatch.ServerName = "db.example.com"
+	tests = append(tests, struct {
+		name    string
+		conf    *config.CertCheck
+		cert    *testCert
+		status  Status
+		message string
+	}{"name mismatch", mismatch, valid, StatusCritical, "failed to verify the name"})
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, message := verifyCertificates(tc.conf, []*x509.Certificate{tc.cert.cert}, now)
+			if status != tc.status || !strings.Contains(message, tc.message) {
+				t.Errorf("the certificate should be %s with %q but %s: %s", tc.status, tc.message, status, message)
+			}
+			expiry := tc.cert.cert.NotAfter.UTC().Format(time.RFC3339)
+			if !strings.Contains(message, `subject "CN=app.example.com"`) || !strings.Contains(message, "expires at "+expiry) {
+				t.Errorf("the message should contain the subject and the expiry: %s", message)
+			}
+		})
+	}
+
+	// the file with the intermediates
+	inter := newTestCert(t, "Test Intermediate", now.Add(-day), now.Add(3650*day), ca)
+	leaf := newTestCert(t, "app.example.com", now.Add(-day), now.Add(100*day+time.Hour), inter)
+	c := &Checker{Config: &config.CheckPlugin{Type: config.CheckTypeCert, Cert: &config.CertCheck{
+		Path:         writePEM(t, dir, "chain.pem", leaf, inter),
+		WarningDays:  30,
+		CriticalDays: 14,
+		VerifyChain:  true,
+		CAFile:       caFile,
+	}}}
+	if r := c.Check(); r.Status != StatusOK || !strings.Contains(r.Message, `issuer "CN=Test Intermediate"`) {
+		t.Errorf("the chain in the file should be verified: %s: %s", r.Status, r.Message)
+	}
+	c.Config.Cert.Path = filepath.Join(dir, "missing.pem")
+	if r := c.Check(); r.Status != StatusCritical {
+		t.Errorf("the missing file should be critical: %s: %s", r.Status, r.Message)
+	}
+}
+
+func TestChecker_CheckCert_Network(t *testing.T) {
+	now := time.Now()
+	cert := newTestCert(t, "localhost", now.Add(-time.Hour), now.Add(10*24*time.Hour), nil)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}}}
+
+	// the server of SMTP, which greets and upgrades to TLS by STARTTLS
+	smtp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smtp.Close()
+	go func() {
+		for {
+			conn, err := smtp.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("220 localhost ESMTP\r\n"))
+				r.ReadString('\n')
+				conn.Write([]byte("250-localhost\r\n250 STARTTLS\r\n"))
+				r.ReadString('\n')
+				conn.Write([]byte("220 ready\r\n"))
+				tls.Server(conn, tlsConfig).Handshake()
+			}(conn)
+		}
+	}()
+	plain, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	go func() {
+		for {
+			conn, err := plain.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}(conn)
+		}
+	}()
+	// the dead endpoint accepting nothing
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	check := func(addr, startTLS string) *config.CertCheck {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		return &config.CertCheck{Host: host, Port: p, ServerName: "localhost", StartTLS: startTLS,
+			WarningDays: 30, CriticalDays: 3, VerifyHostname: true, Timeout: time.Second}
+	}
+	tests := []struct {
+		name    string
+		conf    *config.CertCheck
+		status  Status
+		message string
+	}{
+		{"tls", check(plain.Addr().String(), ""), StatusWarning, "expires in 9 days"},
+		{"starttls", check(smtp.Addr().String(), config.StartTLSSMTP), StatusWarning, "(self-signed)"},
+		{"dead", check(dead.Addr().String(), ""), StatusCritical, "failed to get the certificate of " + dead.Addr().String()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Checker{Name: tc.name, Config: &config.CheckPlugin{Type: config.CheckTypeCert, Cert: tc.conf}}
+			start := time.Now()
+			r := c.Check()
+			if r.Status != tc.status || !strings.Contains(r.Message, tc.message) {
+				t.Errorf("the check should be %s with %q but %s: %s", tc.status, tc.message, r.Status, r.Message)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("the check should be bounded by the timeout but took %s", elapsed)
+			}
+		})
+	}
+}
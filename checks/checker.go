@@ -2,13 +2,16 @@ package checks
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/pluginstderr"
 )
 
-var logger = logging.GetLogger("checks")
+var logger = logformat.GetLogger("checks")
 
 // Status is a status that is produced by periodical checking.
 // It is currently compatible with Nagios.
@@ -24,8 +27,6 @@ const (
 	StatusUnknown   Status = "UNKNOWN"
 )
 
-const defaultCheckInterval = 1 * time.Minute
-
 var exitCodeToStatus = map[int]Status{
 	0: StatusOK,
 	1: StatusWarning,
@@ -39,6 +40,21 @@ var exitCodeToStatus = map[int]Status{
 type Checker struct {
 	Name   string
 	Config *config.CheckPlugin
+	// StateDir is the directory where the built-in checks save their states.
+	StateDir string
+
+	actionTriggeredAt []time.Time
+	eventLogBookmark  string
+	logState          *logCheckState
+	readOnlyState     *readOnlyState
+
+	perfdataMu       sync.Mutex
+	perfdataValues   map[string]float64
+	perfdataCounters map[string]perfdataCounter
+
+	// lastReport is the last report of the command, which is reported again
+	// while the executions are backed off by Config.Breaker.
+	lastReport *Report
 }
 
 // Report is what Checker produces by invoking its command.
@@ -50,32 +66,45 @@ type Report struct {
 	NotificationInterval *int32
 	MaxCheckAttempts     *int32
 	CustomIdentfier      *string
+	MaxOutputBytes       *int32
 }
 
 func (c *Checker) String() string {
-	return fmt.Sprintf("checker %q command=[%s]", c.Name, c.Config.Command)
+	return fmt.Sprintf("checker %q command=[%s]", c.Name, c.Config.Command.CommandString())
 }
 
 // Check invokes the command and transforms its result to a Report.
 func (c *Checker) Check() *Report {
 	now := time.Now()
-	message, stderr, exitCode, err := c.Config.Command.Run()
-	if stderr != "" {
-		logger.Warningf("Checker %q output stderr: %s", c.Name, stderr)
-	}
 
-	status := StatusUnknown
-	if err != nil {
-		message = err.Error()
-	} else {
-		if s, ok := exitCodeToStatus[exitCode]; ok {
-			status = s
+	var status Status
+	var message string
+	switch c.Config.Type {
+	case config.CheckTypeEventLog:
+		status, message = c.checkEventLog()
+	case config.CheckTypeHTTP:
+		status, message = c.checkHTTP()
+	case config.CheckTypeTCP:
+		status, message = c.checkTCP()
+	case config.CheckTypeFile:
+		status, message = c.checkFile()
+	case config.CheckTypeLog:
+		status, message = c.checkLog()
+	case config.CheckTypeCert:
+		status, message = c.checkCert()
+	case config.CheckTypeReadOnly:
+		status, message = c.checkReadOnly()
+	default:
+		if c.lastReport != nil && !c.Config.Breaker.Allow(now) {
+			logger.Debugf("Checker %q is backed off by the consecutive failures, which reports the last status %s", c.Name, c.lastReport.Status)
+			r := *c.lastReport
+			r.OccurredAt = now
+			return &r
 		}
-
-		logger.Debugf("Checker %q status=%s message=%q", c.Name, status, message)
+		status, message = c.checkCommand()
 	}
 
-	return &Report{
+	r := &Report{
 		Name:                 c.Name,
 		Status:               status,
 		Message:              message,
@@ -83,19 +112,107 @@ func (c *Checker) Check() *Report {
 		NotificationInterval: c.Config.NotificationInterval,
 		MaxCheckAttempts:     c.Config.MaxCheckAttempts,
 		CustomIdentfier:      c.Config.CustomIdentifier,
+		MaxOutputBytes:       c.Config.MaxOutputBytes,
 	}
+	if c.Config.Breaker != nil {
+		last := *r
+		c.lastReport = &last
+	}
+	return r
+}
+
+// Suppress rewrites the report in the suppression window of the checker into
+// OK with the original status in the message, and returns the end of the
+// window, or the zero time if the report is not suppressed.
+func (c *Checker) Suppress(r *Report) time.Time {
+	until := c.Config.SuppressedUntil(r.OccurredAt)
+	if until.IsZero() || r.Status == StatusOK {
+		return until
+	}
+	r.Message = strings.TrimSpace(fmt.Sprintf("(suppressed: original status %s) %s", r.Status, r.Message))
+	r.Status = StatusOK
+	return until
+}
+
+func (c *Checker) checkCommand() (Status, string) {
+	message, stderr, exitCode, err := c.Config.Command.Run()
+	pluginstderr.Log(logger, (*logformat.Logger).Warningf, "checks."+c.Name, stderr)
+	// the exit statuses are the results of the check, which are not failures
+	c.Config.Breaker.Record(err != nil, time.Now())
+
+	status := StatusUnknown
+	if err != nil {
+		message = err.Error()
+	} else {
+		if s, ok := exitCodeToStatus[exitCode]; ok {
+			status = s
+		}
+		switch c.Config.Format {
+		case config.CheckFormatJSON:
+			status, message = c.checkJSONOutput(message)
+		case config.CheckFormatNagios:
+			var perfdata string
+			message, perfdata = parseNagiosOutput(message)
+			if c.Config.ReportPerfdata {
+				c.recordPerfdata(perfdata, time.Now())
+			}
+		}
+
+		logger.Debugf("Checker %q status=%s message=%q", c.Name, status, message)
+	}
+	return status, message
 }
 
 // Interval is the interval where the command is invoked.
 func (c *Checker) Interval() time.Duration {
-	if c.Config.CheckInterval != nil {
-		interval := time.Duration(*c.Config.CheckInterval) * time.Minute
-		if interval < 1*time.Minute {
-			interval = 1 * time.Minute
-		} else if interval > 60*time.Minute {
-			interval = 60 * time.Minute
+	return c.Config.Interval()
+}
+
+// TriggerAction invokes the action command of the checker in background
+// when the status has changed from previous to current.
+// The command is not invoked if it has already been triggered
+// Config.Action.MaxTriggerPerHour times within the last hour.
+func (c *Checker) TriggerAction(previous, current Status) {
+	action := c.Config.Action
+	if action == nil || previous == current {
+		return
+	}
+	if !c.allowAction(time.Now(), action.MaxTriggerPerHour) {
+		logger.Warningf("Checker %q action is suppressed: it has already been triggered %d times within the last hour", c.Name, action.MaxTriggerPerHour)
+		return
+	}
+
+	env := []string{
+		fmt.Sprintf("MACKEREL_CHECK_NAME=%s", c.Name),
+		fmt.Sprintf("MACKEREL_STATUS=%s", current),
+		fmt.Sprintf("MACKEREL_PREVIOUS_STATUS=%s", previous),
+	}
+	go func() {
+		logger.Debugf("Checker %q action: %q env: %+v", c.Name, action.CommandString(), env)
+		stdout, stderr, exitCode, err := action.RunWithEnv(env)
+		if err != nil {
+			logger.WithFields(logformat.Fields{"plugin": c.Name, logformat.PluginOutput: stderr}).Warningf("Checker %q action failed: %s stdout: %q stderr: %q exitCode: %d", c.Name, err, stdout, stderr, exitCode)
+		} else if stderr != "" || exitCode != 0 {
+			logger.WithFields(logformat.Fields{"plugin": c.Name, logformat.PluginOutput: stderr}).Warningf("Checker %q action stdout: %q stderr: %q exitCode: %d", c.Name, stdout, stderr, exitCode)
+		} else {
+			logger.Infof("Checker %q action stdout: %q exitCode: %d", c.Name, stdout, exitCode)
 		}
-		return interval
+	}()
+}
+
+// allowAction records the invocation at now and reports whether the action
+// may be invoked, keeping the invocations within the last hour up to max.
+func (c *Checker) allowAction(now time.Time, max int) bool {
+	recent := c.actionTriggeredAt[:0]
+	for _, t := range c.actionTriggeredAt {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	c.actionTriggeredAt = recent
+	if max > 0 && len(recent) >= max {
+		return false
 	}
-	return defaultCheckInterval
+	c.actionTriggeredAt = append(c.actionTriggeredAt, now)
+	return true
 }
@@ -1,7 +1,13 @@
 package checks
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/config"
 )
@@ -39,3 +45,103 @@ func TestChecker_Check(t *testing.T) {
 		}
 	}
 }
+
+func TestChecker_Suppress(t *testing.T) {
+	always, err := config.ParseSuppressWindow("00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Checker{Config: &config.CheckPlugin{Suppress: []*config.SuppressWindow{always}}}
+	now := time.Now()
+
+	r := &Report{Status: StatusCritical, Message: "the disk latency is 300ms", OccurredAt: now}
+	if until := c.Suppress(r); !until.After(now) {
+		t.Errorf("the report should be suppressed: %s", until)
+	}
+	if r.Status != StatusOK || r.Message != "(suppressed: original status CRITICAL) the disk latency is 300ms" {
+		t.Errorf("the report should be OK with the original status: %+v", r)
+	}
+
+	r = &Report{Status: StatusOK, Message: "OK", OccurredAt: now}
+	c.Suppress(r)
+	if r.Status != StatusOK || r.Message != "OK" {
+		t.Errorf("the OK report should not be changed: %+v", r)
+	}
+
+	c = Checker{Config: &config.CheckPlugin{}}
+	r = &Report{Status: StatusWarning, Message: "slow", OccurredAt: now}
+	if until := c.Suppress(r); !until.IsZero() || r.Status != StatusWarning {
+		t.Errorf("the report without the windows should not be suppressed: %+v", r)
+	}
+}
+
+func TestChecker_allowAction(t *testing.T) {
+	c := Checker{}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !c.allowAction(now.Add(time.Duration(i)*time.Minute), 3) {
+			t.Errorf("action #%d should be allowed", i)
+		}
+	}
+	if c.allowAction(now.Add(10*time.Minute), 3) {
+		t.Error("action should be suppressed after triggered 3 times within an hour")
+	}
+	if !c.allowAction(now.Add(61*time.Minute), 3) {
+		t.Error("action should be allowed after an hour passed")
+	}
+
+	unlimited := Checker{}
+	for i := 0; i < 100; i++ {
+		if !unlimited.allowAction(now, 0) {
+			t.Fatal("action should always be allowed when max is zero")
+		}
+	}
+}
+
+func TestChecker_TriggerAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the action of the test is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "mackerel-agent-action")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "env")
+	c := Checker{
+		Name: "nginx_process",
+		Config: &config.CheckPlugin{
+			Action: &config.CheckAction{
+				Command: config.Command{
+					Cmd: `echo "$MACKEREL_CHECK_NAME $MACKEREL_PREVIOUS_STATUS $MACKEREL_STATUS" >> ` + out,
+				},
+				MaxTriggerPerHour: config.DefaultActionMaxTriggerPerHour,
+			},
+		},
+	}
+
+	readActions := func(n int) string {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			b, _ := ioutil.ReadFile(out)
+			if strings.Count(string(b), "\n") >= n || time.Now().After(deadline) {
+				return string(b)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// not triggered without the transition
+	c.TriggerAction(StatusOK, StatusOK)
+	c.TriggerAction(StatusCritical, StatusCritical)
+	c.TriggerAction(StatusOK, StatusCritical)
+	if got, expect := readActions(1), "nginx_process OK CRITICAL\n"; got != expect {
+		t.Errorf("the action should be triggered only by the transition with the environments %q but got %q", expect, got)
+	}
+
+	c.TriggerAction(StatusCritical, StatusOK)
+	if got, expect := readActions(2), "nginx_process OK CRITICAL\nnginx_process CRITICAL OK\n"; got != expect {
+		t.Errorf("the action should be triggered by the transition to OK %q but got %q", expect, got)
+	}
+}
@@ -3,11 +3,15 @@
 package checks
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/mackerelio/mackerel-agent/cmdutil"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/pluginbreaker"
 )
 
 func TestChecker_CheckTimeout(t *testing.T) {
@@ -32,3 +36,65 @@ func TestChecker_CheckTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestChecker_CheckJSON(t *testing.T) {
+	checker := Checker{
+		Config: &config.CheckPlugin{
+			Command: config.Command{Cmd: `echo '{"status":"CRITICAL","message":"disk full"}'; exit 0`},
+			Format:  config.CheckFormatJSON,
+		},
+	}
+	report := checker.Check()
+	if report.Status != StatusCritical || report.Message != "disk full" {
+		t.Errorf("the status and the message should be the ones of the JSON: %v, %q", report.Status, report.Message)
+	}
+}
+
+func TestChecker_CheckBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "check.sh")
+	checker := Checker{
+		Name: "breaker",
+		Config: &config.CheckPlugin{
+			Command: config.Command{Args: []string{file}},
+			Breaker: pluginbreaker.New("checks.breaker", 1, time.Minute, time.Hour),
+		},
+	}
+	first := checker.Check()
+	if first.Status != StatusUnknown {
+		t.Fatalf("the missing command should be UNKNOWN: %v", first.Status)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("#!/bin/sh\necho ok\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	report := checker.Check()
+	if report.Status != StatusUnknown || report.Message != first.Message || report.OccurredAt.Before(first.OccurredAt) {
+		t.Errorf("the last report should be reported while backed off: %v, %q", report.Status, report.Message)
+	}
+
+	pluginbreaker.Reset()
+	if report := checker.Check(); report.Status != StatusOK || report.Message != "ok\n" {
+		t.Errorf("the command should be run after the reset: %v, %q", report.Status, report.Message)
+	}
+}
+
+func TestChecker_CheckNagios(t *testing.T) {
+	checker := Checker{
+		Config: &config.CheckPlugin{
+			Command: config.Command{Cmd: `printf 'DISK WARNING - free space: / 10%% | /=90%%;80;90\n/boot 50%%\n'; exit 1`},
+			Format:  config.CheckFormatNagios,
+		},
+	}
+	report := checker.Check()
+	if report.Status != StatusWarning {
+		t.Errorf("status should be WARNING: %v", report.Status)
+	}
+	if report.Message != "DISK WARNING - free space: / 10%\n/boot 50%" {
+		t.Errorf("wrong message: %q", report.Message)
+	}
+}
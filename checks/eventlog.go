@@ -0,0 +1,137 @@
+package checks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// eventLogRecord is an event matched by the built-in eventlog check.
+type eventLogRecord struct {
+	Source      string
+	EventID     int
+	Level       int
+	Message     string
+	TimeCreated time.Time
+}
+
+const (
+	eventLogMessagesMax      = 5   // the number of the messages of recent events in a report
+	eventLogMessageLengthMax = 200 // the characters of each message in a report
+)
+
+// eventLogQuery builds the XPath query to select the events of conf.
+// If lookback is positive, only the events created within lookback are selected.
+func eventLogQuery(conf *config.EventLogCheck, lookback time.Duration) string {
+	var conds []string
+
+	levels := make([]string, 0, conf.MaxLevel)
+	for l := config.EventLevelCritical; l <= conf.MaxLevel; l++ {
+		levels = append(levels, fmt.Sprintf("Level=%d", l))
+	}
+	conds = append(conds, "("+strings.Join(levels, " or ")+")")
+
+	if len(conf.EventIDs) > 0 {
+		ids := make([]string, 0, len(conf.EventIDs))
+		for _, id := range conf.EventIDs {
+			ids = append(ids, fmt.Sprintf("EventID=%d", id))
+		}
+		conds = append(conds, "("+strings.Join(ids, " or ")+")")
+	}
+
+	if lookback > 0 {
+		conds = append(conds, fmt.Sprintf("TimeCreated[timediff(@SystemTime) <= %d]", lookback/time.Millisecond))
+	}
+	return "*[System[" + strings.Join(conds, " and ") + "]]"
+}
+
+// summarizeEventLog determines the status and the message from the matched
+// records, which are sorted in chronological order.
+func summarizeEventLog(conf *config.EventLogCheck, records []eventLogRecord) (Status, string) {
+	if len(records) == 0 {
+		return StatusOK, fmt.Sprintf("no events matched in %s", conf.LogName)
+	}
+
+	status := StatusWarning
+	for _, r := range records {
+		if r.Level == config.EventLevelCritical || r.Level == config.EventLevelError {
+			status = StatusCritical
+			break
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d events matched in %s", len(records), conf.LogName)
+	recent := records
+	if len(recent) > eventLogMessagesMax {
+		recent = recent[len(recent)-eventLogMessagesMax:]
+	}
+	for _, r := range recent {
+		msg := strings.Join(strings.Fields(r.Message), " ")
+		if runes := []rune(msg); len(runes) > eventLogMessageLengthMax {
+			msg = string(runes[:eventLogMessageLengthMax]) + "..."
+		}
+		fmt.Fprintf(&b, "\n[%s] %s (EventID %d): %s", r.TimeCreated.Format(time.RFC3339), r.Source, r.EventID, msg)
+	}
+	return status, b.String()
+}
+
+// eventLogBookmarkFile returns the file to save the bookmark of the check,
+// so that the events are not reported twice across restarts of the agent.
+func (c *Checker) eventLogBookmarkFile() string {
+	if c.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.StateDir, "checks", "eventlog-"+util.SanitizeMetricKey(c.Name)+".xml")
+}
+
+func (c *Checker) loadEventLogBookmark() string {
+	if c.eventLogBookmark != "" {
+		return c.eventLogBookmark
+	}
+	file := c.eventLogBookmarkFile()
+	if file == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Checker %q failed to load the bookmark: %s", c.Name, err)
+		}
+		return ""
+	}
+	c.eventLogBookmark = string(data)
+	return c.eventLogBookmark
+}
+
+func (c *Checker) saveEventLogBookmark(bookmark string) {
+	c.eventLogBookmark = bookmark
+	file := c.eventLogBookmarkFile()
+	if file == "" {
+		return
+	}
+	if err := util.WriteFileAtomically(file, []byte(bookmark), 0644); err != nil {
+		logger.Warningf("Checker %q failed to save the bookmark: %s", c.Name, err)
+	}
+}
+
+// matchSource reports whether source matches any of patterns, or patterns
+// are empty.
+func matchSource(patterns []*regexp.Regexp, source string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p.MatchString(source) {
+			return true
+		}
+	}
+	return false
+}
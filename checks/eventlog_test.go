@@ -0,0 +1,120 @@
+package checks
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestEventLogQuery(t *testing.T) {
+	tests := []struct {
+		conf     config.EventLogCheck
+		lookback time.Duration
+		expected string
+	}{
+		{
+			conf:     config.EventLogCheck{MaxLevel: config.EventLevelError},
+			expected: "*[System[(Level=1 or Level=2)]]",
+		},
+		{
+			conf:     config.EventLogCheck{MaxLevel: config.EventLevelWarning, EventIDs: []int32{1000, 1001}},
+			lookback: time.Minute,
+			expected: "*[System[(Level=1 or Level=2 or Level=3) and (EventID=1000 or EventID=1001) and TimeCreated[timediff(@SystemTime) <= 60000]]]",
+		},
+	}
+	for _, tc := range tests {
+		if got := eventLogQuery(&tc.conf, tc.lookback); got != tc.expected {
+			t.Errorf("eventLogQuery(%+v, %s) = %q; want %q", tc.conf, tc.lookback, got, tc.expected)
+		}
+	}
+}
+
+func TestSummarizeEventLog(t *testing.T) {
+	conf := &config.EventLogCheck{LogName: "System"}
+
+	status, message := summarizeEventLog(conf, nil)
+	if status != StatusOK {
+		t.Errorf("status should be OK without events but %s", status)
+	}
+	if message != "no events matched in System" {
+		t.Errorf("unexpected message: %q", message)
+	}
+
+	var records []eventLogRecord
+	for i := 0; i < 7; i++ {
+		records = append(records, eventLogRecord{
+			Source:      "Service Control Manager",
+			EventID:     7000 + i,
+			Level:       config.EventLevelWarning,
+			Message:     "the service\r\nfailed " + strings.Repeat("x", 300),
+			TimeCreated: time.Date(2019, 9, 1, 0, 0, i, 0, time.UTC),
+		})
+	}
+	status, message = summarizeEventLog(conf, records)
+	if status != StatusWarning {
+		t.Errorf("status should be WARNING with warning events but %s", status)
+	}
+	lines := strings.Split(message, "\n")
+	if lines[0] != "7 events matched in System" {
+		t.Errorf("unexpected summary: %q", lines[0])
+	}
+	if len(lines) != 1+eventLogMessagesMax {
+		t.Errorf("message should contain %d recent events but %d", eventLogMessagesMax, len(lines)-1)
+	}
+	if !strings.Contains(lines[1], "(EventID 7002): the service failed xxx") {
+		t.Errorf("message should contain the recent events: %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[1], "...") {
+		t.Errorf("long message should be truncated: %q", lines[1])
+	}
+
+	records[3].Level = config.EventLevelError
+	if status, _ := summarizeEventLog(conf, records); status != StatusCritical {
+		t.Errorf("status should be CRITICAL with error events but %s", status)
+	}
+}
+
+func TestChecker_EventLogBookmark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Checker{Name: "eventlog/system", StateDir: dir}
+	if b := c.loadEventLogBookmark(); b != "" {
+		t.Errorf("bookmark should be empty at first: %q", b)
+	}
+	c.saveEventLogBookmark("<BookmarkList/>")
+
+	c2 := &Checker{Name: "eventlog/system", StateDir: dir}
+	if b := c2.loadEventLogBookmark(); b != "<BookmarkList/>" {
+		t.Errorf("bookmark should be restored from the state directory: %q", b)
+	}
+}
+
+func TestMatchSource(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile("^Service"), regexp.MustCompile("^Disk$")}
+	tests := []struct {
+		source string
+		expect bool
+	}{
+		{"Service Control Manager", true},
+		{"Disk", true},
+		{"DiskDiagnostic", false},
+		{"Application Error", false},
+	}
+	for _, tt := range tests {
+		if got := matchSource(patterns, tt.source); got != tt.expect {
+			t.Errorf("matchSource(%q) should be %t but got %t", tt.source, tt.expect, got)
+		}
+	}
+	if !matchSource(nil, "Application Error") {
+		t.Error("matchSource should match any source without the patterns")
+	}
+}
@@ -0,0 +1,9 @@
+// +build !windows
+
+package checks
+
+import "github.com/mackerelio/mackerel-agent/config"
+
+func (c *Checker) checkEventLog() (Status, string) {
+	return StatusUnknown, "the check type " + config.CheckTypeEventLog + " is supported only on Windows"
+}
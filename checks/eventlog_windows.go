@@ -0,0 +1,254 @@
+// +build windows
+
+package checks
+
+import (
+	"encoding/xml"
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ref. https://docs.microsoft.com/en-us/windows/win32/api/winevt/
+var (
+	modwevtapi = syscall.NewLazyDLL("wevtapi.dll")
+
+	procEvtQuery                 = modwevtapi.NewProc("EvtQuery")
+	procEvtSeek                  = modwevtapi.NewProc("EvtSeek")
+	procEvtNext                  = modwevtapi.NewProc("EvtNext")
+	procEvtRender                = modwevtapi.NewProc("EvtRender")
+	procEvtCreateBookmark        = modwevtapi.NewProc("EvtCreateBookmark")
+	procEvtUpdateBookmark        = modwevtapi.NewProc("EvtUpdateBookmark")
+	procEvtOpenPublisherMetadata = modwevtapi.NewProc("EvtOpenPublisherMetadata")
+	procEvtFormatMessage         = modwevtapi.NewProc("EvtFormatMessage")
+	procEvtClose                 = modwevtapi.NewProc("EvtClose")
+)
+
+const (
+	evtQueryChannelPath       = 0x1
+	evtQueryForwardDirection  = 0x100
+	evtSeekRelativeToBookmark = 0x4
+	evtSeekStrict             = 0x10000
+	evtRenderEventXML         = 1
+	evtRenderBookmark         = 2
+	evtFormatMessageEvent     = 1
+
+	errorInsufficientBuffer = 122
+	errorNoMoreItems        = 259
+
+	eventLogBatchSize = 16
+)
+
+type evtHandle uintptr
+
+func evtClose(h evtHandle) {
+	if h != 0 {
+		procEvtClose.Call(uintptr(h))
+	}
+}
+
+func evtQuery(path, query string) (evtHandle, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	q, err := syscall.UTF16PtrFromString(query)
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := procEvtQuery.Call(0, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(q)), evtQueryChannelPath|evtQueryForwardDirection)
+	if r == 0 {
+		return 0, err
+	}
+	return evtHandle(r), nil
+}
+
+func evtCreateBookmark(bookmarkXML string) (evtHandle, error) {
+	var p *uint16
+	if bookmarkXML != "" {
+		var err error
+		p, err = syscall.UTF16PtrFromString(bookmarkXML)
+		if err != nil {
+			return 0, err
+		}
+	}
+	r, _, err := procEvtCreateBookmark.Call(uintptr(unsafe.Pointer(p)))
+	if r == 0 {
+		return 0, err
+	}
+	return evtHandle(r), nil
+}
+
+// evtSeekNext moves the cursor of the result set to the event next to the bookmark.
+func evtSeekNext(results, bookmark evtHandle) error {
+	r, _, err := procEvtSeek.Call(uintptr(results), 1, uintptr(bookmark), 0, evtSeekRelativeToBookmark|evtSeekStrict)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// evtNext returns the next events in the result set. It returns no events at the end.
+func evtNext(results evtHandle) ([]evtHandle, error) {
+	events := make([]evtHandle, eventLogBatchSize)
+	var returned uint32
+	r, _, err := procEvtNext.Call(uintptr(results), eventLogBatchSize, uintptr(unsafe.Pointer(&events[0])), 0, 0, uintptr(unsafe.Pointer(&returned)))
+	if r == 0 {
+		if errno, ok := err.(syscall.Errno); ok && errno == errorNoMoreItems {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return events[:returned], nil
+}
+
+// evtRender renders the event or the bookmark as XML.
+func evtRender(h evtHandle, flags uint32) (string, error) {
+	var used, count uint32
+	buf := make([]uint16, 1024)
+	for {
+		r, _, err := procEvtRender.Call(0, uintptr(h), uintptr(flags), uintptr(len(buf)*2), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&count)))
+		if r != 0 {
+			return syscall.UTF16ToString(buf), nil
+		}
+		if errno, ok := err.(syscall.Errno); !ok || errno != errorInsufficientBuffer {
+			return "", err
+		}
+		buf = make([]uint16, used/2+1)
+	}
+}
+
+// evtFormatMessage returns the message of the event formatted by its publisher.
+func evtFormatMessage(source string, event evtHandle) (string, error) {
+	s, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return "", err
+	}
+	pub, _, err := procEvtOpenPublisherMetadata.Call(0, uintptr(unsafe.Pointer(s)), 0, 0, 0)
+	if pub == 0 {
+		return "", err
+	}
+	defer evtClose(evtHandle(pub))
+
+	var used uint32
+	buf := make([]uint16, 1024)
+	for {
+		r, _, err := procEvtFormatMessage.Call(pub, uintptr(event), 0, 0, 0, evtFormatMessageEvent, uintptr(len(buf)), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)))
+		if r != 0 {
+			return syscall.UTF16ToString(buf), nil
+		}
+		if errno, ok := err.(syscall.Errno); !ok || errno != errorInsufficientBuffer {
+			return "", err
+		}
+		buf = make([]uint16, used+1)
+	}
+}
+
+// eventXML is the part of the XML representation of an event used by the check.
+type eventXML struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID     int `xml:"EventID"`
+		Level       int `xml:"Level"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+	} `xml:"System"`
+}
+
+func (c *Checker) checkEventLog() (Status, string) {
+	conf := c.Config.EventLog
+
+	bookmark, err := evtCreateBookmark(c.loadEventLogBookmark())
+	if err != nil {
+		logger.Warningf("Checker %q found an invalid bookmark, ignored: %s", c.Name, err)
+		bookmark, err = evtCreateBookmark("")
+		if err != nil {
+			return StatusUnknown, fmt.Sprintf("failed to create a bookmark: %s", err)
+		}
+	}
+	defer evtClose(bookmark)
+
+	results, err := c.queryEventLog(bookmark)
+	if err != nil {
+		return StatusUnknown, fmt.Sprintf("failed to query the event log %s: %s", conf.LogName, err)
+	}
+	defer evtClose(results)
+
+	var records []eventLogRecord
+	for {
+		events, err := evtNext(results)
+		if err != nil {
+			return StatusUnknown, fmt.Sprintf("failed to read the event log %s: %s", conf.LogName, err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if r, ok := c.readEvent(event); ok {
+				records = append(records, r)
+			}
+			procEvtUpdateBookmark.Call(uintptr(bookmark), uintptr(event))
+			evtClose(event)
+		}
+	}
+
+	if b, err := evtRender(bookmark, evtRenderBookmark); err == nil {
+		c.saveEventLogBookmark(b)
+	} else {
+		logger.Warningf("Checker %q failed to render the bookmark: %s", c.Name, err)
+	}
+	return summarizeEventLog(conf, records)
+}
+
+// queryEventLog queries the events after the bookmark. If the bookmark
+// is empty or the bookmarked event has already been cleared from the log,
+// the events within the check interval are queried instead.
+func (c *Checker) queryEventLog(bookmark evtHandle) (evtHandle, error) {
+	conf := c.Config.EventLog
+	if c.loadEventLogBookmark() != "" {
+		results, err := evtQuery(conf.LogName, eventLogQuery(conf, 0))
+		if err != nil {
+			return 0, err
+		}
+		if err := evtSeekNext(results, bookmark); err == nil {
+			return results, nil
+		}
+		logger.Infof("Checker %q could not find the bookmarked event, look back the events within the interval", c.Name)
+		evtClose(results)
+	}
+	return evtQuery(conf.LogName, eventLogQuery(conf, c.Interval()))
+}
+
+// readEvent converts the event to eventLogRecord if it matches the source pattern.
+func (c *Checker) readEvent(event evtHandle) (eventLogRecord, bool) {
+	s, err := evtRender(event, evtRenderEventXML)
+	if err != nil {
+		logger.Warningf("Checker %q failed to render an event: %s", c.Name, err)
+		return eventLogRecord{}, false
+	}
+	var e eventXML
+	if err := xml.Unmarshal([]byte(s), &e); err != nil {
+		logger.Warningf("Checker %q failed to parse an event: %s", c.Name, err)
+		return eventLogRecord{}, false
+	}
+	source := e.System.Provider.Name
+	if !matchSource(c.Config.EventLog.SourcePatterns, source) {
+		return eventLogRecord{}, false
+	}
+	message, err := evtFormatMessage(source, event)
+	if err != nil {
+		logger.Debugf("Checker %q failed to format the message of an event: %s", c.Name, err)
+	}
+	createdAt, _ := time.Parse(time.RFC3339Nano, e.System.TimeCreated.SystemTime)
+	return eventLogRecord{
+		Source:      source,
+		EventID:     e.System.EventID,
+		Level:       e.System.Level,
+		Message:     message,
+		TimeCreated: createdAt.Local(),
+	}, true
+}
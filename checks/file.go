@@ -0,0 +1,102 @@
+package checks
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (c *Checker) checkFile() (Status, string) {
+	conf := c.Config.File
+
+	newest, err := newestFile(conf.Path)
+	if err != nil {
+		if os.IsPermission(err) {
+			return StatusUnknown, fmt.Sprintf("%s: permission denied: %s", conf.Path, err)
+		}
+		return StatusUnknown, fmt.Sprintf("failed to check %s: %s", conf.Path, err)
+	}
+
+	if newest == nil {
+		if conf.MustExist {
+			return StatusCritical, fmt.Sprintf("%s: missing", conf.Path)
+		}
+		return StatusOK, fmt.Sprintf("%s: not found", conf.Path)
+	}
+	if conf.MustNotExist {
+		return StatusCritical, fmt.Sprintf("%s: exists", newest.path)
+	}
+
+	age := time.Now().Sub(newest.ModTime()).Truncate(time.Second)
+	if age < 0 {
+		age = 0
+	}
+	if conf.MaxAge > 0 && age > conf.MaxAge {
+		return StatusCritical, fmt.Sprintf("%s: too old by %.0fs (modified %.0fs ago, max_age %s)",
+			newest.path, (age - conf.MaxAge).Seconds(), age.Seconds(), conf.MaxAge)
+	}
+	if conf.MinSize > 0 && newest.Size() < conf.MinSize {
+		return StatusCritical, fmt.Sprintf("%s: too small (%d bytes, min_size %d bytes)",
+			newest.path, newest.Size(), conf.MinSize)
+	}
+	return StatusOK, fmt.Sprintf("%s: %d bytes, modified %.0fs ago", newest.path, newest.Size(), age.Seconds())
+}
+
+type matchedFile struct {
+	os.FileInfo
+	path string
+}
+
+// newestFile returns the most recently modified file matching the pattern,
+// or nil if there are no matching files.
+//
+// filepath.Glob ignores the directories which cannot be read, so the
+// permission errors are detected by reading the parent directory of
+// the pattern when nothing matches.
+func newestFile(pattern string) (*matchedFile, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var newest *matchedFile
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) { // removed after globbing or a dangling symlink
+				continue
+			}
+			return nil, err
+		}
+		if newest == nil || fi.ModTime().After(newest.ModTime()) {
+			newest = &matchedFile{FileInfo: fi, path: path}
+		}
+	}
+	if newest == nil {
+		if err := checkReadableDir(filepath.Dir(pattern)); err != nil {
+			return nil, err
+		}
+	}
+	return newest, nil
+}
+
+func checkReadableDir(dir string) error {
+	if strings.ContainsAny(dir, `*?[`) {
+		// the pattern of the directory can match unreadable ones, which cannot be distinguished
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package checks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestChecker_CheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-check-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	files := []struct {
+		name    string
+		content string
+		modTime time.Time
+	}{
+		{"old.log", "old content", now.Add(-time.Hour)},
+		{"new.log", "new", now.Add(-time.Minute)},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		check   config.FileCheck
+		want    Status
+		message string
+	}{
+		{"exists", config.FileCheck{Path: filepath.Join(dir, "old.log"), MustExist: true}, StatusOK, "old.log"},
+		{"missing", config.FileCheck{Path: filepath.Join(dir, "missing.log"), MustExist: true}, StatusCritical, "missing"},
+		{"missing dir", config.FileCheck{Path: filepath.Join(dir, "missing", "*.log"), MustExist: true}, StatusCritical, "missing"},
+		{"not required", config.FileCheck{Path: filepath.Join(dir, "missing.log")}, StatusOK, "not found"},
+		{"must not exist", config.FileCheck{Path: filepath.Join(dir, "*.log"), MustNotExist: true}, StatusCritical, "exists"},
+		{"must not exist and missing", config.FileCheck{Path: filepath.Join(dir, "*.pid"), MustNotExist: true}, StatusOK, "not found"},
+		{"too old", config.FileCheck{Path: filepath.Join(dir, "old.log"), MustExist: true, MaxAge: 10 * time.Minute}, StatusCritical, "too old by 3000s"},
+		{"newest match", config.FileCheck{Path: filepath.Join(dir, "*.log"), MustExist: true, MaxAge: 10 * time.Minute}, StatusOK, "new.log"},
+		{"too small", config.FileCheck{Path: filepath.Join(dir, "*.log"), MustExist: true, MinSize: 10}, StatusCritical, "too small (3 bytes"},
+		{"large enough", config.FileCheck{Path: filepath.Join(dir, "old.log"), MustExist: true, MinSize: 10}, StatusOK, "11 bytes"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			check := tc.check
+			c := &Checker{
+				Name:   tc.name,
+				Config: &config.CheckPlugin{Type: config.CheckTypeFile, File: &check},
+			}
+			report := c.Check()
+			if report.Status != tc.want {
+				t.Errorf("status should be %s but %s: %s", tc.want, report.Status, report.Message)
+			}
+			if !strings.Contains(report.Message, tc.message) {
+				t.Errorf("message should contain %q: %s", tc.message, report.Message)
+			}
+		})
+	}
+}
+
+func TestChecker_CheckFile_PermissionDenied(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions cannot be denied")
+	}
+	dir, err := ioutil.TempDir("", "mackerel-agent-check-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+
+	c := &Checker{
+		Name: "file",
+		Config: &config.CheckPlugin{
+			Type: config.CheckTypeFile,
+			File: &config.FileCheck{Path: filepath.Join(dir, "*.log"), MustExist: true},
+		},
+	}
+	report := c.Check()
+	if report.Status != StatusUnknown {
+		t.Errorf("status should be UNKNOWN but %s: %s", report.Status, report.Message)
+	}
+}
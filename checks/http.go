@@ -0,0 +1,62 @@
+package checks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// httpCheckBodyLimit is the maximum bytes of the response body to match.
+const httpCheckBodyLimit = 1024 * 1024
+
+func (c *Checker) checkHTTP() (Status, string) {
+	conf := c.Config.HTTP
+	client := &http.Client{
+		Timeout: conf.Timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify},
+			DisableKeepAlives: true,
+		},
+	}
+	if !conf.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	req, err := http.NewRequest(conf.Method, conf.URL, nil)
+	if err != nil {
+		return StatusUnknown, err.Error()
+	}
+
+	startedAt := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return StatusCritical, fmt.Sprintf("%s %s failed: %s", conf.Method, conf.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpCheckBodyLimit))
+	latency := time.Now().Sub(startedAt)
+	if err != nil {
+		return StatusCritical, fmt.Sprintf("%s %s failed to read the response: %s", conf.Method, conf.URL, err)
+	}
+
+	summary := fmt.Sprintf("%s %s: %s - %.3f seconds", conf.Method, conf.URL, resp.Status, latency.Seconds())
+	if conf.ExpectedStatus != 0 {
+		if resp.StatusCode != conf.ExpectedStatus {
+			return StatusCritical, fmt.Sprintf("%s (expected status %d)", summary, conf.ExpectedStatus)
+		}
+	} else if resp.StatusCode >= 400 {
+		return StatusCritical, summary
+	}
+	if conf.BodyMatch != nil && !conf.BodyMatch.Match(body) {
+		return StatusCritical, fmt.Sprintf("%s (the response body does not match %q)", summary, conf.BodyMatch)
+	}
+	if conf.WarningLatency > 0 && latency > conf.WarningLatency {
+		return StatusWarning, fmt.Sprintf("%s (slower than %s)", summary, conf.WarningLatency)
+	}
+	return StatusOK, summary
+}
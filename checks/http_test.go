@@ -0,0 +1,71 @@
+package checks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestChecker_CheckHTTP(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("status: ok"))
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ok", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/redirect", http.RedirectHandler("/health", http.StatusFound))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(mux)
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name  string
+		check config.HTTPCheck
+		want  Status
+	}{
+		{"ok", config.HTTPCheck{URL: ts.URL + "/health"}, StatusOK},
+		{"body matched", config.HTTPCheck{URL: ts.URL + "/health", BodyMatch: regexp.MustCompile("ok")}, StatusOK},
+		{"body unmatched", config.HTTPCheck{URL: ts.URL + "/health", BodyMatch: regexp.MustCompile("ng")}, StatusCritical},
+		{"server error", config.HTTPCheck{URL: ts.URL + "/error"}, StatusCritical},
+		{"expected status", config.HTTPCheck{URL: ts.URL + "/error", ExpectedStatus: 503}, StatusOK},
+		{"unexpected status", config.HTTPCheck{URL: ts.URL + "/health", ExpectedStatus: 201}, StatusCritical},
+		{"follow redirects", config.HTTPCheck{URL: ts.URL + "/redirect", FollowRedirects: true, ExpectedStatus: 200}, StatusOK},
+		{"not follow redirects", config.HTTPCheck{URL: ts.URL + "/redirect", ExpectedStatus: 302}, StatusOK},
+		{"slow", config.HTTPCheck{URL: ts.URL + "/slow", WarningLatency: 100 * time.Millisecond}, StatusWarning},
+		{"timeout", config.HTTPCheck{URL: ts.URL + "/slow", Timeout: 100 * time.Millisecond}, StatusCritical},
+		{"tls verification", config.HTTPCheck{URL: tlsServer.URL + "/health"}, StatusCritical},
+		{"tls insecure", config.HTTPCheck{URL: tlsServer.URL + "/health", InsecureSkipVerify: true}, StatusOK},
+		{"connection refused", config.HTTPCheck{URL: "http://127.0.0.1:1/"}, StatusCritical},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			check := tc.check
+			check.Method = "GET"
+			if check.Timeout == 0 {
+				check.Timeout = 3 * time.Second
+			}
+			c := &Checker{
+				Name:   tc.name,
+				Config: &config.CheckPlugin{Type: config.CheckTypeHTTP, HTTP: &check},
+			}
+			report := c.Check()
+			if report.Status != tc.want {
+				t.Errorf("status should be %s but %s: %s", tc.want, report.Status, report.Message)
+			}
+			if !strings.Contains(report.Message, check.URL) {
+				t.Errorf("message should contain the url: %s", report.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package checks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonResult is the output of the check plugins of format = "json".
+//
+//	{"status":"CRITICAL","message":"1 of 20 mount points is not writable",
+//	 "items":[{"name":"/data","status":"CRITICAL","message":"read-only"},{"name":"/","status":"OK"}]}
+type jsonResult struct {
+	Status  Status     `json:"status"`
+	Message string     `json:"message"`
+	Items   []jsonItem `json:"items"`
+}
+
+// jsonItem is an item verified by the check, whose message is optional.
+type jsonItem struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+}
+
+func validStatus(s Status) bool {
+	switch s {
+	case StatusOK, StatusWarning, StatusCritical, StatusUnknown:
+		return true
+	}
+	return false
+}
+
+// parseJSONResult parses the output of the check plugins of format = "json".
+// It returns the error if the output is not a valid result.
+func parseJSONResult(output string) (*jsonResult, error) {
+	var r jsonResult
+	if err := json.Unmarshal([]byte(output), &r); err != nil {
+		return nil, err
+	}
+	if !validStatus(r.Status) {
+		return nil, fmt.Errorf("invalid status %q", r.Status)
+	}
+	for i, item := range r.Items {
+		if item.Name == "" {
+			return nil, fmt.Errorf("no name of the item %d", i)
+		}
+		if !validStatus(item.Status) {
+			return nil, fmt.Errorf("invalid status %q of the item %q", item.Status, item.Name)
+		}
+	}
+	return &r, nil
+}
+
+// reportMessage returns the message followed by the items which are not OK,
+// such as "/data: CRITICAL read-only".
+func (r *jsonResult) reportMessage() string {
+	lines := []string{r.Message}
+	for _, item := range r.Items {
+		if item.Status == StatusOK {
+			continue
+		}
+		lines = append(lines, strings.TrimSpace(fmt.Sprintf("%s: %s %s", item.Name, item.Status, item.Message)))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// checkJSONOutput returns the status and the message of the output of
+// format = "json", which is the plain message of UNKNOWN if it is invalid.
+func (c *Checker) checkJSONOutput(output string) (Status, string) {
+	r, err := parseJSONResult(output)
+	if err != nil {
+		logger.Warningf("Checker %q output an invalid JSON result (reported as UNKNOWN): %s", c.Name, err)
+		return StatusUnknown, output
+	}
+	if c.Config.ReportItemsAsMetrics {
+		c.recordItems(r.Items)
+	}
+	return r.Status, r.reportMessage()
+}
+
+// recordItems records the items to be taken by TakePerfdata, whose values are
+// 1 for OK and 0 for the others, named custom.check.<name>.items.<item name>.
+func (c *Checker) recordItems(items []jsonItem) {
+	c.perfdataMu.Lock()
+	defer c.perfdataMu.Unlock()
+	prefix := "custom.check." + invalidLabelChars.ReplaceAllString(c.Name, "_") + ".items."
+	values := make(map[string]float64, len(items))
+	for _, item := range items {
+		var v float64
+		if item.Status == StatusOK {
+			v = 1
+		}
+		values[prefix+invalidLabelChars.ReplaceAllString(item.Name, "_")] = v
+	}
+	c.perfdataValues = values
+}
@@ -0,0 +1,53 @@
+package checks
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestParseJSONResult(t *testing.T) {
+	r, err := parseJSONResult(`{"status":"CRITICAL","message":"1 of 3 mount points failed","items":[{"name":"/","status":"OK"},{"name":"/data","status":"CRITICAL","message":"read-only"},{"name":"/var","status":"WARNING"}]}`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if r.Status != StatusCritical || len(r.Items) != 3 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if msg := r.reportMessage(); msg != "1 of 3 mount points failed\n/data: CRITICAL read-only\n/var: WARNING" {
+		t.Errorf("the items not OK should be appended: %q", msg)
+	}
+
+	for _, output := range []string{
+		`DISK OK`,
+		`{"message":"no status"}`,
+		`{"status":"FATAL"}`,
+		`{"status":"OK","items":[{"status":"OK"}]}`,
+		`{"status":"OK","items":[{"name":"/","status":"ok"}]}`,
+	} {
+		if _, err := parseJSONResult(output); err == nil {
+			t.Errorf("should raise error: %s", output)
+		}
+	}
+}
+
+func TestChecker_CheckJSONOutput(t *testing.T) {
+	c := &Checker{Name: "mounts", Config: &config.CheckPlugin{Format: config.CheckFormatJSON, ReportItemsAsMetrics: true}}
+	status, message := c.checkJSONOutput(`{"status":"WARNING","message":"slow","items":[{"name":"/","status":"OK"},{"name":"/data","status":"WARNING"}]}`)
+	if status != StatusWarning || message != "slow\n/data: WARNING" {
+		t.Errorf("unexpected report: %s, %q", status, message)
+	}
+	expected := map[string]float64{"custom.check.mounts.items._": 1, "custom.check.mounts.items._data": 0}
+	if values := c.TakePerfdata(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("the items should be the metrics: %v", values)
+	}
+
+	status, message = c.checkJSONOutput("not json\n")
+	if status != StatusUnknown || message != "not json\n" {
+		t.Errorf("the invalid output should be UNKNOWN with the output: %s, %q", status, message)
+	}
+	if values := c.TakePerfdata(); len(values) != 0 {
+		t.Errorf("no metrics should be reported by the invalid output: %v", values)
+	}
+}
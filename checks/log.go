@@ -0,0 +1,296 @@
+package checks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+const (
+	logMatchedLinesMax = 10  // the number of the matched lines in a report
+	logLineLengthMax   = 200 // the characters of each line in a report
+)
+
+// logFileState is the position of a file read by the log check. ID identifies
+// the file across the renames, such as the device and the inode.
+type logFileState struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// logCheckState is the positions of the files by the paths, which is saved
+// so that each line is evaluated exactly once across restarts of the agent.
+type logCheckState struct {
+	Files map[string]logFileState `json:"files"`
+}
+
+type logMatches struct {
+	critical int
+	warning  int
+	lines    []string
+}
+
+func (m *logMatches) match(conf *config.LogCheck, path string, line []byte) {
+	if conf.ExcludePattern != nil && conf.ExcludePattern.Match(line) {
+		return
+	}
+	switch {
+	case conf.CriticalPattern != nil && conf.CriticalPattern.Match(line):
+		m.critical++
+	case conf.WarningPattern != nil && conf.WarningPattern.Match(line):
+		m.warning++
+	default:
+		return
+	}
+	if len(m.lines) < logMatchedLinesMax {
+		l := strings.TrimSpace(string(line))
+		if runes := []rune(l); len(runes) > logLineLengthMax {
+			l = string(runes[:logLineLengthMax]) + "..."
+		}
+		m.lines = append(m.lines, path+": "+l)
+	}
+}
+
+func (c *Checker) checkLog() (Status, string) {
+	conf := c.Config.Log
+
+	paths, err := filepath.Glob(conf.File)
+	if err != nil {
+		return StatusUnknown, fmt.Sprintf("failed to check %s: %s", conf.File, err)
+	}
+	sort.Strings(paths)
+
+	prev, first := c.loadLogState()
+	state := &logCheckState{Files: make(map[string]logFileState)}
+	m := &logMatches{}
+	matched := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		matched[path] = true
+	}
+	var errs []string
+	for _, path := range paths {
+		fs, err := readLogFile(conf, path, prev, first, matched, m)
+		if err != nil {
+			if os.IsNotExist(err) { // removed after globbing
+				continue
+			}
+			errs = append(errs, err.Error())
+			// the lines are read again after recovering
+			if s, ok := prev.Files[path]; ok {
+				state.Files[path] = s
+			}
+			continue
+		}
+		state.Files[path] = fs
+	}
+	c.saveLogState(state)
+
+	if len(errs) > 0 {
+		return StatusUnknown, fmt.Sprintf("failed to read %s: %s", conf.File, strings.Join(errs, "; "))
+	}
+	if len(state.Files) == 0 {
+		return Status(conf.MissingFileStatus), fmt.Sprintf("%s: not found", conf.File)
+	}
+	return summarizeLog(conf, m)
+}
+
+func summarizeLog(conf *config.LogCheck, m *logMatches) (Status, string) {
+	var status Status
+	switch {
+	case m.critical > 0:
+		status = StatusCritical
+	case m.warning > 0:
+		status = StatusWarning
+	default:
+		return StatusOK, fmt.Sprintf("no lines matched in %s", conf.File)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d critical and %d warning lines matched in %s", m.critical, m.warning, conf.File)
+	for _, l := range m.lines {
+		b.WriteString("\n" + l)
+	}
+	if n := m.critical + m.warning - len(m.lines); n > 0 {
+		fmt.Fprintf(&b, "\n... and %d more lines", n)
+	}
+	return status, b.String()
+}
+
+// readLogFile matches the lines appended to the file at path since the
+// position in prev, and returns the new position. The files are read from
+// the end at the first run, not to report the lines written before.
+//
+// If the file at path is replaced, such as by the log rotation, the rest of
+// the old file is read if it is found by the ID next to path unless it is
+// matched as well, and the new one is read from the beginning. The file is
+// read from the beginning also if it is truncated.
+func readLogFile(conf *config.LogCheck, path string, prev *logCheckState, first bool, matched map[string]bool, m *logMatches) (logFileState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return logFileState{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return logFileState{}, err
+	}
+	id, err := fileID(f, fi)
+	if err != nil {
+		return logFileState{}, err
+	}
+
+	var offset int64
+	s, ok := prev.Files[path]
+	switch {
+	case ok && s.ID == id:
+		offset = s.Offset
+		if fi.Size() < offset { // truncated
+			offset = 0
+		}
+	case ok:
+		readRotatedLogFile(conf, path, s, matched, m)
+	case first:
+		offset = fi.Size()
+	default:
+		// renamed from a file read before, or created after the first run
+		for _, s := range prev.Files {
+			if s.ID == id && s.Offset <= fi.Size() {
+				offset = s.Offset
+				break
+			}
+		}
+	}
+	offset, err = readLogLines(conf, path, f, offset, m)
+	if err != nil {
+		return logFileState{}, err
+	}
+	return logFileState{ID: id, Offset: offset}, nil
+}
+
+// readRotatedLogFile reads the rest of the file renamed from path, such as
+// path.1 and path-20240102, which is identified by s.ID. The matched files
+// are read by their own positions.
+func readRotatedLogFile(conf *config.LogCheck, path string, s logFileState, matched map[string]bool, m *logMatches) {
+	candidates, err := filepath.Glob(globEscape(path) + "?*")
+	if err != nil {
+		return
+	}
+	for _, rotated := range candidates {
+		if matched[rotated] {
+			continue
+		}
+		f, err := os.Open(rotated)
+		if err != nil {
+			continue
+		}
+		fi, err := f.Stat()
+		if err == nil && fi.Mode().IsRegular() {
+			if id, err := fileID(f, fi); err == nil && id == s.ID && s.Offset <= fi.Size() {
+				if _, err := readLogLines(conf, rotated, f, s.Offset, m); err != nil {
+					logger.Warningf("Failed to read the rotated log file %s: %s", rotated, err)
+				}
+				f.Close()
+				return
+			}
+		}
+		f.Close()
+	}
+}
+
+// globEscape escapes the meta characters of filepath.Match in path, which
+// cannot be escaped on Windows.
+func globEscape(path string) string {
+	if filepath.Separator == '\\' {
+		return path
+	}
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// readLogLines matches the lines of f from offset, and returns the offset of
+// the end of the last complete line. The incomplete last line is read again
+// after it is completed.
+func readLogLines(conf *config.LogCheck, path string, f *os.File, offset int64, m *logMatches) (int64, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(line))
+		m.match(conf, path, bytes.TrimRight(line, "\r\n"))
+	}
+}
+
+// logStateFile returns the file to save the positions of the files read by
+// the check.
+func (c *Checker) logStateFile() string {
+	if c.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.StateDir, "checks", "log-"+util.SanitizeMetricKey(c.Name)+".json")
+}
+
+// loadLogState returns the positions of the files, and whether it is the
+// first run of the check.
+func (c *Checker) loadLogState() (*logCheckState, bool) {
+	if c.logState != nil {
+		return c.logState, false
+	}
+	empty := &logCheckState{Files: make(map[string]logFileState)}
+	file := c.logStateFile()
+	if file == "" {
+		return empty, true
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Checker %q failed to load the positions of the log files: %s", c.Name, err)
+		}
+		return empty, true
+	}
+	var state logCheckState
+	if err := json.Unmarshal(data, &state); err != nil || state.Files == nil {
+		logger.Warningf("Checker %q failed to load the positions of the log files: %s", c.Name, file)
+		return empty, true
+	}
+	return &state, false
+}
+
+func (c *Checker) saveLogState(state *logCheckState) {
+	c.logState = state
+	file := c.logStateFile()
+	if file == "" {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		logger.Warningf("Checker %q failed to save the positions of the log files: %s", c.Name, err)
+		return
+	}
+	// renamed not to lose the positions by the partial writes
+	if err := util.WriteFileAtomically(file, data, 0644); err != nil {
+		logger.Warningf("Checker %q failed to save the positions of the log files: %s", c.Name, err)
+	}
+}
@@ -0,0 +1,154 @@
+package checks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func appendFile(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecker_CheckLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-check-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "app.log")
+	appendFile(t, logFile, "ERROR written before the first run\n")
+
+	conf := &config.CheckPlugin{
+		Type: config.CheckTypeLog,
+		Log: &config.LogCheck{
+			File:              logFile,
+			WarningPattern:    regexp.MustCompile(`WARN`),
+			CriticalPattern:   regexp.MustCompile(`ERROR`),
+			ExcludePattern:    regexp.MustCompile(`ignored`),
+			MissingFileStatus: config.MissingFileStatusUnknown,
+		},
+	}
+	newChecker := func() *Checker {
+		return &Checker{Name: "app-log", Config: conf, StateDir: dir}
+	}
+	c := newChecker()
+	check := func(t *testing.T, c *Checker, status Status, message string) {
+		t.Helper()
+		report := c.Check()
+		if report.Status != status {
+			t.Errorf("status should be %s but %s: %s", status, report.Status, report.Message)
+		}
+		if !strings.Contains(report.Message, message) {
+			t.Errorf("message should contain %q but %q", message, report.Message)
+		}
+	}
+
+	t.Run("first run", func(t *testing.T) {
+		check(t, c, StatusOK, "no lines matched")
+	})
+	t.Run("appended", func(t *testing.T) {
+		appendFile(t, logFile, "INFO ok\nWARN slow\nERROR ignored\nERROR failed\nWARN incomple")
+		check(t, c, StatusCritical, "1 critical and 1 warning lines matched")
+		check(t, c, StatusOK, "no lines matched")
+	})
+	t.Run("completed line", func(t *testing.T) {
+		appendFile(t, logFile, "te\n")
+		check(t, c, StatusWarning, logFile+": WARN incomplete")
+	})
+	t.Run("restarted", func(t *testing.T) {
+		appendFile(t, logFile, "ERROR while restarting\n")
+		c = newChecker()
+		check(t, c, StatusCritical, "ERROR while restarting")
+		check(t, c, StatusOK, "no lines matched")
+	})
+	t.Run("truncated", func(t *testing.T) {
+		if err := ioutil.WriteFile(logFile, []byte("WARN truncated\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		check(t, c, StatusWarning, "WARN truncated")
+	})
+	t.Run("rotated", func(t *testing.T) {
+		appendFile(t, logFile, "ERROR before rotation\n")
+		if err := os.Rename(logFile, logFile+".1"); err != nil {
+			t.Fatal(err)
+		}
+		appendFile(t, logFile, "WARN after rotation\n")
+		check(t, c, StatusCritical, "1 critical and 1 warning lines matched")
+		check(t, c, StatusOK, "no lines matched")
+	})
+	t.Run("capped", func(t *testing.T) {
+		for i := 0; i < logMatchedLinesMax+2; i++ {
+			appendFile(t, logFile, fmt.Sprintf("WARN %d\n", i))
+		}
+		check(t, c, StatusWarning, "\n... and 2 more lines")
+	})
+	t.Run("missing", func(t *testing.T) {
+		if err := os.Remove(logFile); err != nil {
+			t.Fatal(err)
+		}
+		check(t, c, StatusUnknown, "not found")
+		conf.Log.MissingFileStatus = config.MissingFileStatusOK
+		check(t, c, StatusOK, "not found")
+	})
+	t.Run("created", func(t *testing.T) {
+		// created after the first run, so read from the beginning
+		appendFile(t, logFile, "ERROR created\n")
+		check(t, c, StatusCritical, "ERROR created")
+	})
+}
+
+func TestChecker_CheckLogGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-check-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Checker{
+		Name: "app-logs",
+		Config: &config.CheckPlugin{
+			Type: config.CheckTypeLog,
+			Log: &config.LogCheck{
+				File:              filepath.Join(dir, "*.log*"),
+				CriticalPattern:   regexp.MustCompile(`ERROR`),
+				MissingFileStatus: config.MissingFileStatusUnknown,
+			},
+		},
+		StateDir: dir,
+	}
+	logFile := filepath.Join(dir, "app.log")
+	appendFile(t, logFile, "")
+	if report := c.Check(); report.Status != StatusOK {
+		t.Fatalf("status should be OK but %s: %s", report.Status, report.Message)
+	}
+
+	// the rotated one is matched, and read only once
+	appendFile(t, logFile, "ERROR before rotation\n")
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, logFile, "ERROR after rotation\n")
+	report := c.Check()
+	if report.Status != StatusCritical || !strings.Contains(report.Message, "2 critical and 0 warning lines matched") {
+		t.Errorf("both the lines should be matched once: %s %s", report.Status, report.Message)
+	}
+	if report := c.Check(); report.Status != StatusOK {
+		t.Errorf("status should be OK but %s: %s", report.Status, report.Message)
+	}
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package checks
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID identifies the file by the device and the inode.
+func fileID(f *os.File, fi os.FileInfo) (string, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("failed to get the inode of %s", f.Name())
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino), nil
+}
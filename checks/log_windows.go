@@ -0,0 +1,18 @@
+// +build windows
+
+package checks
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID identifies the file by the volume serial number and the file index.
+func fileID(f *os.File, fi os.FileInfo) (string, error) {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", info.VolumeSerialNumber, uint64(info.FileIndexHigh)<<32|uint64(info.FileIndexLow)), nil
+}
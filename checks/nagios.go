@@ -0,0 +1,41 @@
+package checks
+
+import (
+	"strings"
+)
+
+// parseNagiosOutput splits the output of the Nagios plugins into the message
+// and the performance data. The output is the first line of the text and the
+// performance data separated by "|", followed by the long text whose line
+// with "|" starts the rest of the performance data.
+//
+//	TEXT OUTPUT | PERFDATA
+//	LONG TEXT LINE 1
+//	LONG TEXT LINE 2 | PERFDATA LINE 2
+//	PERFDATA LINE 3
+func parseNagiosOutput(output string) (string, string) {
+	lines := strings.Split(strings.TrimRight(output, "\r\n"), "\n")
+	var texts, perfdata []string
+	inPerfdata := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if inPerfdata {
+			perfdata = append(perfdata, strings.TrimSpace(line))
+			continue
+		}
+		if i := strings.IndexByte(line, '|'); i >= 0 {
+			perfdata = append(perfdata, strings.TrimSpace(line[i+1:]))
+			line = strings.TrimRight(line[:i], " \t")
+			// the performance data of the first line is followed by the long text
+			inPerfdata = len(texts) > 0
+		}
+		texts = append(texts, line)
+	}
+	var ps []string
+	for _, p := range perfdata {
+		if p != "" {
+			ps = append(ps, p)
+		}
+	}
+	return strings.TrimRight(strings.Join(texts, "\n"), "\n"), strings.Join(ps, " ")
+}
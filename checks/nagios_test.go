@@ -0,0 +1,30 @@
+package checks
+
+import "testing"
+
+func TestParseNagiosOutput(t *testing.T) {
+	testCases := []struct {
+		output   string
+		message  string
+		perfdata string
+	}{
+		{"OK\n", "OK", ""},
+		{"DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n", "DISK OK - free space: / 3326 MB (56%);", "/=2643MB;5948;5958;0;5968"},
+		{
+			"DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);\n/boot 68 MB (69%);\n/home 69357 MB (27%);\n/var/log 819 MB (84%); | /boot=68MB;88;93;0;98\n/home=69357MB;253404;253409;0;253414\n/var/log=818MB;970;975;0;980\n",
+			"DISK OK - free space: / 3326 MB (56%);\n/ 15272 MB (77%);\n/boot 68 MB (69%);\n/home 69357 MB (27%);\n/var/log 819 MB (84%);",
+			"/=2643MB;5948;5958;0;5968 /boot=68MB;88;93;0;98 /home=69357MB;253404;253409;0;253414 /var/log=818MB;970;975;0;980",
+		},
+		{"WARNING - load\r\nline 2\r\n", "WARNING - load\nline 2", ""},
+		{"CRITICAL|time=1s\n\nskipped empty line\n", "CRITICAL\n\nskipped empty line", "time=1s"},
+	}
+	for _, tc := range testCases {
+		message, perfdata := parseNagiosOutput(tc.output)
+		if message != tc.message {
+			t.Errorf("the message of %q should be %q but %q", tc.output, tc.message, message)
+		}
+		if perfdata != tc.perfdata {
+			t.Errorf("the perfdata of %q should be %q but %q", tc.output, tc.perfdata, perfdata)
+		}
+	}
+}
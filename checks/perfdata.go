@@ -0,0 +1,150 @@
+package checks
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// perfdata is a label of the performance data of the Nagios plugins.
+type perfdata struct {
+	label string
+	value float64
+	// counter is true for the unit "c", whose rate per second is reported.
+	counter bool
+}
+
+type perfdataCounter struct {
+	value float64
+	time  time.Time
+}
+
+var (
+	perfdataValuePattern = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)([a-zA-Z%]*)$`)
+	invalidLabelChars    = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// perfdataScales converts the values of the units to the seconds and the bytes.
+var perfdataScales = map[string]float64{
+	"":   1,
+	"%":  1,
+	"s":  1,
+	"ms": 1e-3,
+	"us": 1e-6,
+	"B":  1,
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+	"TB": 1024 * 1024 * 1024 * 1024,
+	"c":  1,
+}
+
+// parsePerfdata parses the performance data of the form
+// 'label'=value[UOM];[warn];[crit];[min];[max] separated by spaces.
+// The malformed labels are ignored.
+func parsePerfdata(s string) []perfdata {
+	var results []perfdata
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var label string
+		if s[0] == '\'' {
+			// '' is a quote in the quoted label
+			var b strings.Builder
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // the closing quote
+			}
+			label, s = b.String(), s[i:]
+		} else {
+			i := strings.IndexAny(s, "= ")
+			if i < 0 {
+				i = len(s)
+			}
+			label, s = s[:i], s[i:]
+		}
+		var field string
+		if i := strings.IndexByte(s, ' '); i >= 0 {
+			field, s = s[:i], s[i:]
+		} else {
+			field, s = s, ""
+		}
+		p, err := parsePerfdataField(label, field)
+		if err != "" {
+			logger.Debugf("Ignore the malformed perfdata %q: %s", label+field, err)
+			continue
+		}
+		results = append(results, *p)
+	}
+	return results
+}
+
+func parsePerfdataField(label, field string) (*perfdata, string) {
+	if label == "" {
+		return nil, "no label"
+	}
+	if !strings.HasPrefix(field, "=") {
+		return nil, "no value"
+	}
+	value := strings.SplitN(field[1:], ";", 2)[0]
+	m := perfdataValuePattern.FindStringSubmatch(value)
+	if m == nil {
+		return nil, "invalid value"
+	}
+	scale, ok := perfdataScales[m[2]]
+	if !ok {
+		return nil, "unknown unit"
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return nil, "invalid value"
+	}
+	return &perfdata{label: label, value: v * scale, counter: m[2] == "c"}, ""
+}
+
+// recordPerfdata records the performance data checked at now to be taken
+// by TakePerfdata.
+func (c *Checker) recordPerfdata(s string, now time.Time) {
+	c.perfdataMu.Lock()
+	defer c.perfdataMu.Unlock()
+	if c.perfdataCounters == nil {
+		c.perfdataCounters = make(map[string]perfdataCounter)
+	}
+	prefix := "custom.check." + invalidLabelChars.ReplaceAllString(c.Name, "_") + "."
+	values := make(map[string]float64)
+	for _, p := range parsePerfdata(s) {
+		name := prefix + invalidLabelChars.ReplaceAllString(p.label, "_")
+		if !p.counter {
+			values[name] = p.value
+			continue
+		}
+		prev, ok := c.perfdataCounters[name]
+		c.perfdataCounters[name] = perfdataCounter{p.value, now}
+		// skip the first values and the counters which are reset
+		if !ok || p.value < prev.value || !now.After(prev.time) {
+			continue
+		}
+		values[name] = (p.value - prev.value) / now.Sub(prev.time).Seconds()
+	}
+	c.perfdataValues = values
+}
+
+// TakePerfdata returns the metrics of the performance data, or of the items of
+// the JSON result, of the last check once, named custom.check.<name>.<label>.
+func (c *Checker) TakePerfdata() map[string]float64 {
+	c.perfdataMu.Lock()
+	defer c.perfdataMu.Unlock()
+	values := c.perfdataValues
+	c.perfdataValues = nil
+	return values
+}
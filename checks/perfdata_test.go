@@ -0,0 +1,55 @@
+package checks
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePerfdata(t *testing.T) {
+	testCases := []struct {
+		perfdata string
+		expected []perfdata
+	}{
+		{"", nil},
+		{"time=0.5s;1;2;0 size=1.5KB;;;", []perfdata{{"time", 0.5, false}, {"size", 1536, false}}},
+		{"'/var log'=50%;80;90 'it''s'=250ms", []perfdata{{"/var log", 50, false}, {"it's", 0.25, false}}},
+		{"requests=100c latency=1us load=-1.5e1", []perfdata{{"requests", 100, true}, {"latency", 1e-6, false}, {"load", -15, false}}},
+		{"novalue undetermined=U unknown=1furlong =1 'unterminated=1 ok=1", []perfdata{}},
+		{"bad=x good=2MB", []perfdata{{"good", 2 * 1024 * 1024, false}}},
+	}
+	for _, tc := range testCases {
+		got := parsePerfdata(tc.perfdata)
+		if len(got) == 0 && len(tc.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%q should be parsed to %+v but %+v", tc.perfdata, tc.expected, got)
+		}
+	}
+}
+
+func TestChecker_RecordPerfdata(t *testing.T) {
+	c := &Checker{Name: "disk usage"}
+	now := time.Now()
+	c.recordPerfdata("'/boot'=50% requests=100c", now)
+	values := c.TakePerfdata()
+	if len(values) != 1 || values["custom.check.disk_usage._boot"] != 50 {
+		t.Errorf("unexpected values: %v", values)
+	}
+	if values := c.TakePerfdata(); len(values) != 0 {
+		t.Errorf("the values should be taken once: %v", values)
+	}
+
+	c.recordPerfdata("'/boot'=60% requests=700c", now.Add(60*time.Second))
+	values = c.TakePerfdata()
+	if len(values) != 2 || values["custom.check.disk_usage._boot"] != 60 || values["custom.check.disk_usage.requests"] != 10 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	// The counter is reset.
+	c.recordPerfdata("requests=10c", now.Add(120*time.Second))
+	if values := c.TakePerfdata(); len(values) != 0 {
+		t.Errorf("the rate should not be generated when the counter is reset: %v", values)
+	}
+}
@@ -0,0 +1,248 @@
+package checks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// readOnlyState is the baseline of the read-only check, which is saved in
+// StateDir not to take the filesystems remounted while the agent is stopped as
+// the baseline. The baseline is taken again when the host is rebooted, so
+// that the filesystems mounted read-only from the boot are not reported.
+type readOnlyState struct {
+	BootID string                      `json:"bootId"`
+	Mounts map[string]readOnlyBaseline `json:"mounts"`
+}
+
+type readOnlyBaseline struct {
+	ReadOnly bool  `json:"readOnly"`
+	Errors   int64 `json:"errors"`
+}
+
+type mountEntry struct {
+	device   string
+	point    string
+	fstype   string
+	readOnly bool
+}
+
+func (c *Checker) checkReadOnly() (Status, string) {
+	return c.checkReadOnlyIn("/")
+}
+
+// checkReadOnlyIn checks the filesystems by the files under root, which is "/"
+// except the tests. The filesystem is CRITICAL if it is read-only but was
+// writable at the baseline, or the errors recorded by the kernel increased.
+func (c *Checker) checkReadOnlyIn(root string) (Status, string) {
+	conf := c.Config.ReadOnly
+	mounts, err := readMountEntries(filepath.Join(root, "proc", "mounts"))
+	if err != nil {
+		return StatusUnknown, fmt.Sprintf("failed to read the mounts: %s", err)
+	}
+	bootID := readBootID(root)
+	state := c.loadReadOnlyState()
+	if state != nil && state.BootID != bootID {
+		logger.Infof("Checker %q takes the baseline of the filesystems again since the host is rebooted", c.Name)
+		state = nil
+	}
+	if state == nil {
+		state = &readOnlyState{BootID: bootID, Mounts: make(map[string]readOnlyBaseline)}
+	}
+
+	var problems []string
+	baselines := make(map[string]readOnlyBaseline)
+	for _, m := range mounts {
+		if !matchReadOnlyCheck(conf, m) {
+			continue
+		}
+		count, hasErrors := readErrorsCount(root, m.device)
+		b, ok := state.Mounts[m.point]
+		if !ok {
+			b = readOnlyBaseline{ReadOnly: m.readOnly, Errors: count}
+		}
+		if !m.readOnly {
+			b.ReadOnly = false
+		}
+		// the errors are cleared by fsck
+		if count < b.Errors {
+			b.Errors = count
+		}
+		if m.readOnly && !b.ReadOnly {
+			problems = append(problems, fmt.Sprintf("%s (%s, %s) is remounted read-only", m.point, m.device, m.fstype))
+		}
+		if hasErrors && count > b.Errors {
+			problems = append(problems, fmt.Sprintf("%s (%s, %s) has %d errors recorded by the kernel, %d at the baseline", m.point, m.device, m.fstype, count, b.Errors))
+		}
+		baselines[m.point] = b
+	}
+	state.Mounts = baselines
+	c.saveReadOnlyState(state)
+
+	if len(problems) > 0 {
+		return StatusCritical, strings.Join(problems, "\n")
+	}
+	return StatusOK, fmt.Sprintf("%d filesystems are not remounted read-only", len(baselines))
+}
+
+func matchReadOnlyCheck(conf *config.ReadOnlyCheck, m mountEntry) bool {
+	if conf.DevicePattern != nil && !conf.DevicePattern.MatchString(m.device) {
+		return false
+	}
+	if conf.IncludePattern != nil && !conf.IncludePattern.MatchString(m.point) {
+		return false
+	}
+	if conf.ExcludePattern != nil && conf.ExcludePattern.MatchString(m.point) {
+		return false
+	}
+	return true
+}
+
+// readMountEntries reads /proc/mounts, whose lines are "device point type
+// options dump pass". The last one of the same mount point is returned, which
+// is the one visible.
+func readMountEntries(file string) ([]mountEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make(map[string]mountEntry)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		m := mountEntry{
+			device: unescapeMountField(fields[0]),
+			point:  unescapeMountField(fields[1]),
+			fstype: fields[2],
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			if opt == "ro" {
+				m.readOnly = true
+			}
+		}
+		entries[m.point] = m
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	points := make([]string, 0, len(entries))
+	for p := range entries {
+		points = append(points, p)
+	}
+	sort.Strings(points)
+	mounts := make([]mountEntry, len(points))
+	for i, p := range points {
+		mounts[i] = entries[p]
+	}
+	return mounts, nil
+}
+
+// unescapeMountField decodes the octal escapes of /proc/mounts, such as "\040"
+// for a space.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func readBootID(root string) string {
+	b, err := ioutil.ReadFile(filepath.Join(root, "proc", "sys", "kernel", "random", "boot_id"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// readErrorsCount reads errors_count of the device in /sys/fs, such as
+// /sys/fs/ext4/sda1/errors_count, and returns false if it is not available.
+func readErrorsCount(root, device string) (int64, bool) {
+	name := filepath.Base(device)
+	if p, err := filepath.EvalSymlinks(filepath.Join(root, device)); err == nil {
+		// such as /dev/mapper/vg-root to /dev/dm-0
+		name = filepath.Base(p)
+	}
+	files, _ := filepath.Glob(filepath.Join(root, "sys", "fs", "*", name, "errors_count"))
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func (c *Checker) readOnlyStateFile() string {
+	if c.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.StateDir, "checks", "readonly-"+util.SanitizeMetricKey(c.Name)+".json")
+}
+
+// loadReadOnlyState returns the baseline, or nil if it is not taken yet.
+func (c *Checker) loadReadOnlyState() *readOnlyState {
+	if c.readOnlyState != nil {
+		return c.readOnlyState
+	}
+	file := c.readOnlyStateFile()
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Checker %q failed to load the baseline of the filesystems: %s", c.Name, err)
+		}
+		return nil
+	}
+	var state readOnlyState
+	if err := json.Unmarshal(data, &state); err != nil || state.Mounts == nil {
+		logger.Warningf("Checker %q failed to load the baseline of the filesystems: %s", c.Name, file)
+		return nil
+	}
+	return &state
+}
+
+func (c *Checker) saveReadOnlyState(state *readOnlyState) {
+	c.readOnlyState = state
+	file := c.readOnlyStateFile()
+	if file == "" {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		logger.Warningf("Checker %q failed to save the baseline of the filesystems: %s", c.Name, err)
+		return
+	}
+	// renamed not to lose the baseline by the partial writes
+	if err := util.WriteFileAtomically(file, data, 0644); err != nil {
+		logger.Warningf("Checker %q failed to save the baseline of the filesystems: %s", c.Name, err)
+	}
+}
@@ -0,0 +1,110 @@
+package checks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestChecker_CheckReadOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, content string) {
+		t.Helper()
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mounts := func(data, srv string) {
+		write("proc/mounts", `/dev/sda1 / ext4 rw,relatime,errors=remount-ro 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /run tmpfs ro,nosuid,nodev 0 0
+/dev/sdb1 /var/lib/my\040data ext4 `+data+`,relatime 0 0
+/dev/sdc1 /srv xfs `+srv+`,relatime 0 0
+/dev/loop0 /snap/core/1 squashfs ro,nodev,relatime 0 0
+`)
+	}
+	write("proc/sys/kernel/random/boot_id", "boot-1\n")
+	write("sys/fs/ext4/sdb1/errors_count", "0\n")
+	mounts("rw", "ro")
+
+	stateDir := filepath.Join(root, "state")
+	newChecker := func() *Checker {
+		return &Checker{Name: "readonly", StateDir: stateDir, Config: &config.CheckPlugin{
+			Type:     config.CheckTypeReadOnly,
+			ReadOnly: &config.ReadOnlyCheck{DevicePattern: regexp.MustCompile(`^/dev/`), ExcludePattern: regexp.MustCompile(`^/snap/`)},
+		}}
+	}
+	c := newChecker()
+	if status, message := c.checkReadOnlyIn(root); status != StatusOK || message != "3 filesystems are not remounted read-only" {
+		t.Errorf("the baseline should be OK: %s: %s", status, message)
+	}
+
+	// /srv is read-only from the baseline
+	mounts("ro", "ro")
+	status, message := c.checkReadOnlyIn(root)
+	if status != StatusCritical || message != "/var/lib/my data (/dev/sdb1, ext4) is remounted read-only" {
+		t.Errorf("the remount should be CRITICAL: %s: %s", status, message)
+	}
+
+	// the baseline is persisted across the restarts
+	write("sys/fs/ext4/sdb1/errors_count", "2\n")
+	c = newChecker()
+	status, message = c.checkReadOnlyIn(root)
+	if status != StatusCritical || !strings.Contains(message, "is remounted read-only") || !strings.Contains(message, "has 2 errors recorded by the kernel, 0 at the baseline") {
+		t.Errorf("the remount should be CRITICAL after the restart: %s: %s", status, message)
+	}
+
+	// remounted writable, and the errors are cleared by fsck
+	mounts("rw", "ro")
+	write("sys/fs/ext4/sdb1/errors_count", "0\n")
+	if status, message := c.checkReadOnlyIn(root); status != StatusOK {
+		t.Errorf("the filesystems should be OK after remounted: %s: %s", status, message)
+	}
+
+	// the baseline is taken again after the reboot
+	mounts("ro", "ro")
+	write("proc/sys/kernel/random/boot_id", "boot-2\n")
+	c = newChecker()
+	if status, message := c.checkReadOnlyIn(root); status != StatusOK {
+		t.Errorf("the filesystems read-only from the boot should be OK: %s: %s", status, message)
+	}
+
+	// the corrupt baseline is taken again
+	write("state/checks/readonly-readonly.json", "{")
+	c = newChecker()
+	if status, message := c.checkReadOnlyIn(root); status != StatusOK {
+		t.Errorf("the corrupt baseline should be taken again: %s: %s", status, message)
+	}
+
+	os.Remove(filepath.Join(root, "proc/mounts"))
+	if status, _ := c.checkReadOnlyIn(root); status != StatusUnknown {
+		t.Errorf("the missing mounts should be UNKNOWN: %s", status)
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	tests := map[string]string{
+		`/mnt/a\040b`:  "/mnt/a b",
+		`/mnt/a\134b`:  `/mnt/a\b`,
+		`/mnt/plain`:   "/mnt/plain",
+		`/mnt/short\0`: `/mnt/short\0`,
+	}
+	for s, expected := range tests {
+		if got := unescapeMountField(s); got != expected {
+			t.Errorf("unescapeMountField(%q) should be %q but got %q", s, expected, got)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package checks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+func (c *Checker) checkTCP() (Status, string) {
+	conf := c.Config.TCP
+	addr := conf.Address()
+	dialer := &net.Dialer{Timeout: conf.Timeout}
+
+	startedAt := time.Now()
+	var conn net.Conn
+	var err error
+	if conf.TLS {
+		serverName := conf.ServerName
+		if serverName == "" {
+			serverName = conf.Host
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	latency := time.Now().Sub(startedAt)
+	if err != nil {
+		return StatusCritical, fmt.Sprintf("failed to connect to %s: %s", addr, err)
+	}
+	conn.Close()
+
+	summary := fmt.Sprintf("connected to %s - %.3f seconds", addr, latency.Seconds())
+	if conf.WarningLatency > 0 && latency > conf.WarningLatency {
+		return StatusWarning, fmt.Sprintf("%s (slower than %s)", summary, conf.WarningLatency)
+	}
+	return StatusOK, summary
+}
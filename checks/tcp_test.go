@@ -0,0 +1,87 @@
+package checks
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func newTCPCheck(t *testing.T, addr string) config.TCPCheck {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.TCPCheck{Host: host, Port: p, Timeout: 3 * time.Second}
+}
+
+func TestChecker_CheckTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tlsServer := httptest.NewTLSServer(nil)
+	defer tlsServer.Close()
+	u, _ := url.Parse(tlsServer.URL)
+
+	refused := newTCPCheck(t, addr)
+	plain := newTCPCheck(t, u.Host)
+	verified := newTCPCheck(t, u.Host)
+	verified.TLS = true
+	insecure := verified
+	insecure.InsecureSkipVerify = true
+
+	tests := []struct {
+		name  string
+		check config.TCPCheck
+		want  Status
+	}{
+		{"connected", plain, StatusOK},
+		{"refused", refused, StatusCritical},
+		{"tls verification", verified, StatusCritical},
+		{"tls insecure", insecure, StatusOK},
+	}
+
+	if ln6, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		defer ln6.Close()
+		go func() {
+			for {
+				conn, err := ln6.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		tests = append(tests, struct {
+			name  string
+			check config.TCPCheck
+			want  Status
+		}{"ipv6", newTCPCheck(t, ln6.Addr().String()), StatusOK})
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			check := tc.check
+			c := &Checker{
+				Name:   tc.name,
+				Config: &config.CheckPlugin{Type: config.CheckTypeTCP, TCP: &check},
+			}
+			report := c.Check()
+			if report.Status != tc.want {
+				t.Errorf("status should be %s but %s: %s", tc.want, report.Status, report.Message)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
@@ -11,10 +13,10 @@ import (
 	"time"
 
 	"github.com/Songmu/timeout"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 )
 
-var logger = logging.GetLogger("cmdutil")
+var logger = logformat.GetLogger("cmdutil")
 
 // defaultTimeoutDuration is the duration after which a command execution will be timeout.
 // timeoutKillAfter is option of `RunCommand()` set waiting limit to `kill -kill` after
@@ -32,11 +34,51 @@ func init() {
 	}
 }
 
+// The default limits of the outputs, which bound the memory used by the
+// commands writing too much by mistake.
+const (
+	DefaultMaxStdoutBytes = 4 * 1024 * 1024
+	DefaultMaxStderrBytes = 64 * 1024
+)
+
 // CommandOption carries a timeout duration.
 type CommandOption struct {
 	User            string
 	Env             []string
+	Dir             string
 	TimeoutDuration time.Duration
+	// MaxStdoutBytes is the limit of stdout. The command writing more is
+	// terminated with *OutputLimitError.
+	MaxStdoutBytes int64
+	// MaxStderrBytes is the limit of stderr, beyond which stderr is truncated.
+	MaxStderrBytes int64
+	// Stdout receives stdout as it is written instead of the returned stdout,
+	// so that the whole output is not buffered.
+	Stdout io.Writer
+}
+
+// MaxStdout returns the limit of stdout.
+func (opt CommandOption) MaxStdout() int64 {
+	if opt.MaxStdoutBytes != 0 {
+		return opt.MaxStdoutBytes
+	}
+	return DefaultMaxStdoutBytes
+}
+
+// MaxStderr returns the limit of stderr.
+func (opt CommandOption) MaxStderr() int64 {
+	if opt.MaxStderrBytes != 0 {
+		return opt.MaxStderrBytes
+	}
+	return DefaultMaxStderrBytes
+}
+
+// Timeout returns the duration after which the command execution will be timeout.
+func (opt CommandOption) Timeout() time.Duration {
+	if opt.TimeoutDuration != 0 {
+		return opt.TimeoutDuration
+	}
+	return defaultTimeoutDuration
 }
 
 // RunCommand runs command (in two string) and returns stdout, stderr strings and its exit code.
@@ -59,6 +101,68 @@ func RunCommandContext(ctx context.Context, command string, opt CommandOption) (
 
 var errTimedOut = errors.New("command timed out")
 
+// IsTimedOut reports whether err is the error of the command which timed out.
+func IsTimedOut(err error) bool {
+	return err == errTimedOut
+}
+
+// OutputLimitError is the error of the command whose stdout exceeds the limit.
+type OutputLimitError struct {
+	Limit int64
+}
+
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("command terminated since stdout exceeds the limit of %d bytes", e.Limit)
+}
+
+// stderrTruncated is appended to stderr exceeding the limit.
+const stderrTruncated = "\n... (truncated)"
+
+// limitWriter writes to w up to limit bytes. If truncate is true, the rest
+// is discarded. Otherwise it fails with *OutputLimitError, and the command
+// is canceled by cancel.
+type limitWriter struct {
+	w        io.Writer
+	limit    int64
+	truncate bool
+	cancel   func()
+
+	n         int64
+	truncated bool
+	err       error
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.err != nil {
+		return 0, lw.err
+	}
+	if lw.truncated {
+		return len(p), nil
+	}
+	if rest := lw.limit - lw.n; int64(len(p)) > rest {
+		if !lw.truncate {
+			lw.err = &OutputLimitError{Limit: lw.limit}
+			lw.cancel()
+			return 0, lw.err
+		}
+		lw.truncated = true
+		if _, err := lw.w.Write(p[:rest]); err != nil {
+			lw.err = err
+			lw.cancel()
+			return 0, err
+		}
+		lw.n += rest
+		return len(p), nil
+	}
+	n, err := lw.w.Write(p)
+	lw.n += int64(n)
+	if err != nil {
+		lw.err = err
+		lw.cancel()
+	}
+	return n, err
+}
+
 // RunCommandArgs run the command
 func RunCommandArgs(cmdArgs []string, opt CommandOption) (stdout, stderr string, exitCode int, err error) {
 	return RunCommandArgsContext(context.Background(), cmdArgs, opt)
@@ -76,22 +180,40 @@ func RunCommandArgsContext(ctx context.Context, cmdArgs []string, opt CommandOpt
 	}
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Env = append(os.Environ(), opt.Env...)
+	cmd.Dir = opt.Dir
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	outbuf := &bytes.Buffer{}
 	errbuf := &bytes.Buffer{}
-	cmd.Stdout = outbuf
-	cmd.Stderr = errbuf
+	var out io.Writer = outbuf
+	if opt.Stdout != nil && streamsStdout {
+		out = opt.Stdout
+	}
+	outw := &limitWriter{w: out, limit: opt.MaxStdout(), cancel: cancel}
+	errw := &limitWriter{w: errbuf, limit: opt.MaxStderr(), truncate: true, cancel: cancel}
+	cmd.Stdout = outw
+	cmd.Stderr = errw
 	tio := &timeout.Timeout{
 		Cmd:       cmd,
-		Duration:  defaultTimeoutDuration,
+		Duration:  opt.Timeout(),
 		KillAfter: timeoutKillAfter,
 	}
-	if opt.TimeoutDuration != 0 {
-		tio.Duration = opt.TimeoutDuration
-	}
 	exitStatus, err := tio.RunContext(ctx)
 	stdout = decodeBytes(outbuf)
 	stderr = decodeBytes(errbuf)
+	if errw.truncated {
+		stderr += stderrTruncated
+	}
+	if opt.Stdout != nil {
+		if !streamsStdout && stdout != "" {
+			io.WriteString(opt.Stdout, stdout)
+		}
+		stdout = ""
+	}
 	exitCode = -1
+	if err == nil && outw.err != nil {
+		err = outw.err
+	}
 	if err == nil && exitStatus.IsTimedOut() && (runtime.GOOS == "windows" || exitStatus.Signaled) {
 		err = errTimedOut
 		exitCode = exitStatus.GetChildExitCode()
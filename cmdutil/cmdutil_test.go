@@ -3,6 +3,7 @@ package cmdutil
 import (
 	"fmt"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
@@ -69,6 +70,23 @@ func TestRunCommand(t *testing.T) {
 			},
 			Stdout: "mackerel-agent",
 		},
+		{
+			Name: "withDir",
+			Command: func() string {
+				if runtime.GOOS == "windows" {
+					return "cd"
+				}
+				return "pwd"
+			}(),
+			CommandOption: CommandOption{
+				TimeoutDuration: testCmdOpt.TimeoutDuration,
+				Dir:             "testdata",
+			},
+			Stdout: func() string {
+				dir, _ := filepath.Abs("testdata")
+				return dir
+			}(),
+		},
 	}
 
 	for _, tc := range testCases {
@@ -91,3 +109,58 @@ func TestRunCommand(t *testing.T) {
 		})
 	}
 }
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestRunCommandArgs_OutputLimit(t *testing.T) {
+	opt := CommandOption{TimeoutDuration: 10 * time.Second, MaxStdoutBytes: 1024 * 1024, MaxStderrBytes: 4096}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	stdout, _, _, err := RunCommandArgs([]string{stubcmd, "-stdout-bytes=268435456"}, opt)
+	runtime.ReadMemStats(&after)
+	if _, ok := err.(*OutputLimitError); !ok {
+		t.Errorf("the error should be *OutputLimitError: %v", err)
+	}
+	if int64(len(stdout)) > opt.MaxStdoutBytes {
+		t.Errorf("stdout should be limited to %d bytes but got %d bytes", opt.MaxStdoutBytes, len(stdout))
+	}
+	// the output is not buffered beyond the limit
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 32*1024*1024 {
+		t.Errorf("too much memory is allocated: %d bytes", alloc)
+	}
+
+	// stdout is written to the writer
+	w := &countWriter{}
+	opt.Stdout = w
+	stdout, _, _, err = RunCommandArgs([]string{stubcmd, "-stdout-bytes=268435456"}, opt)
+	if _, ok := err.(*OutputLimitError); !ok {
+		t.Errorf("the error should be *OutputLimitError: %v", err)
+	}
+	if stdout != "" || w.n > opt.MaxStdoutBytes {
+		t.Errorf("stdout should be written to the writer up to the limit: %d bytes", w.n)
+	}
+
+	// the output within the limit
+	w.n = 0
+	if _, _, _, err := RunCommandArgs([]string{stubcmd, "-stdout-bytes=10000"}, opt); err != nil || w.n != 10000 {
+		t.Errorf("the whole output should be written: %d bytes, %v", w.n, err)
+	}
+
+	// stderr is truncated
+	opt.Stdout = nil
+	_, stderr, exitCode, err := RunCommandArgs([]string{stubcmd, "-stderr-bytes=1048576", "-exit=2"}, opt)
+	if err != nil || exitCode != 2 {
+		t.Errorf("the command should not be terminated by stderr: %d, %v", exitCode, err)
+	}
+	if !strings.HasSuffix(stderr, stderrTruncated) || int64(len(stderr)) != opt.MaxStderrBytes+int64(len(stderrTruncated)) {
+		t.Errorf("stderr should be truncated: %d bytes", len(stderr))
+	}
+}
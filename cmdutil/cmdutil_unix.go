@@ -9,3 +9,6 @@ import (
 func decodeBytes(b *bytes.Buffer) string {
 	return b.String()
 }
+
+// streamsStdout is true if stdout is written to CommandOption.Stdout as it is.
+const streamsStdout = true
@@ -30,3 +30,7 @@ func decodeBytes(b *bytes.Buffer) string {
 	}
 	return string(bb)
 }
+
+// streamsStdout is false since stdout may be UTF-16, which is detected by the
+// whole output. Stdout is buffered up to the limit and decoded, then written.
+const streamsStdout = false
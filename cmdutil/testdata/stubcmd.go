@@ -22,6 +22,8 @@ func main() {
 		exit     = flag.Int("exit", 0, "exit status")
 		trapExit = flag.Int("trap-exit", 0, "exit status when trapping signal")
 		sleep    = flag.Duration("sleep", 0, "sleep seconds")
+		outBytes = flag.Int("stdout-bytes", 0, "bytes written to stdout")
+		errBytes = flag.Int("stderr-bytes", 0, "bytes written to stderr")
 	)
 	flag.Parse()
 
@@ -49,5 +51,20 @@ func main() {
 	if *sleep > 0 {
 		time.Sleep(*sleep)
 	}
+	writeBytes(os.Stderr, *errBytes)
+	writeBytes(os.Stdout, *outBytes)
 	os.Exit(*exit)
 }
+
+// writeBytes writes n bytes of lines to w, and exits if w is closed.
+func writeBytes(w *os.File, n int) {
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for ; n > 0; n -= len(line) {
+		if n < len(line) {
+			line = line[:n]
+		}
+		if _, err := w.Write(line); err != nil {
+			os.Exit(1)
+		}
+	}
+}
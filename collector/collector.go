@@ -0,0 +1,256 @@
+// Package collector provides the system metric generators and the host spec
+// generators of the agent for the other binaries embedding them. The agent
+// itself collects by the same generators in the collection loop.
+//
+// The generators do not read the configuration files. Their logs are written
+// by the loggers of logformat to stderr, which are sent to the
+// Logger given to SetLogger instead.
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/spec"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// DefaultInterval is the default interval of the metrics of the deltas, such
+// as the CPU usage and the disk I/O, during which Generate blocks.
+const DefaultInterval = 60 * time.Second
+
+// Generator generates the metric values, such as "loadavg5".
+type Generator interface {
+	Generate(ctx context.Context) (metrics.Values, error)
+}
+
+// SpecGenerator generates a host spec, such as mkr.CPU and []mkr.Interface.
+type SpecGenerator interface {
+	Generate(ctx context.Context) (interface{}, error)
+}
+
+// Options are the options of the system metric generators as the ones of the
+// configuration file. The zero value is the default of the agent.
+type Options struct {
+	// Interval is DefaultInterval if 0.
+	Interval time.Duration
+	// CounterWrap is config.CounterWrapAuto if "".
+	CounterWrap config.CounterWrap
+	// IgnoreFilesystems are the devices of the filesystems not collected.
+	IgnoreFilesystems *regexp.Regexp
+	// UseMountpoint names the filesystems and the disks by the mount points.
+	UseMountpoint bool
+	// WindowsCPUBackend is config.WindowsCPUBackendAuto if "".
+	WindowsCPUBackend config.WindowsCPUBackend
+	// WindowsServices are the patterns of the names of the services whose
+	// states are collected on Windows, which are not collected if nil.
+	WindowsServices *WindowsServices
+}
+
+// WindowsServices are the patterns of the names of the Windows services. All
+// the services are matched by the nil patterns.
+type WindowsServices struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+func (opts Options) interval() time.Duration {
+	if opts.Interval <= 0 {
+		return DefaultInterval
+	}
+	return opts.Interval
+}
+
+func (opts Options) counterWrap() config.CounterWrap {
+	if opts.CounterWrap == "" {
+		return config.CounterWrapAuto
+	}
+	return opts.CounterWrap
+}
+
+// SystemMetricGenerators returns the generators of the system metrics of this
+// platform, which the agent runs in the collection loop. The generators not
+// available on the host are skipped. MetricGenerators returns the same ones
+// with the contexts.
+func SystemMetricGenerators(opts Options) []metrics.Generator {
+	return systemMetricGenerators(opts)
+}
+
+// SystemSpecGenerators returns the generators of the host specs of this
+// platform except the filesystems and the interfaces, which are collected at
+// every update of the host.
+func SystemSpecGenerators() []spec.Generator {
+	return systemSpecGenerators()
+}
+
+// FilesystemSpecGenerator returns the generator of the filesystems of the
+// host, which takes longer than the others.
+func FilesystemSpecGenerator() spec.Generator {
+	return filesystemSpecGenerator()
+}
+
+// InterfaceSpecGenerator returns the generator of the network interfaces.
+func InterfaceSpecGenerator() spec.InterfaceGenerator {
+	return interfaceSpecGenerator()
+}
+
+// MetricGenerators returns the generators of SystemMetricGenerators.
+func MetricGenerators(opts Options) []Generator {
+	gs := SystemMetricGenerators(opts)
+	generators := make([]Generator, len(gs))
+	for i, g := range gs {
+		generators[i] = NewGenerator(g)
+	}
+	return generators
+}
+
+// SpecGenerators returns the generators of SystemSpecGenerators,
+// FilesystemSpecGenerator and InterfaceSpecGenerator.
+func SpecGenerators() []SpecGenerator {
+	var generators []SpecGenerator
+	for _, g := range append(SystemSpecGenerators(), FilesystemSpecGenerator()) {
+		generators = append(generators, NewSpecGenerator(g))
+	}
+	return append(generators, &interfaceGenerator{g: InterfaceSpecGenerator()})
+}
+
+// ErrBusy is returned by Generate while the previous call of the generator,
+// whose context was done, is still running. The generators are not safe to be
+// called concurrently, so the calls are skipped until it returns.
+var ErrBusy = errors.New("the previous generation is still running")
+
+// NewGenerator returns the Generator of g. Generate returns ctx.Err() when ctx
+// is done before g returns, whose result is discarded, and ErrBusy until g
+// returns then. It also implements io.Closer if g does.
+func NewGenerator(g metrics.Generator) Generator {
+	return &generator{g: g}
+}
+
+type generator struct {
+	g metrics.Generator
+	s serial
+}
+
+func (g *generator) Generate(ctx context.Context) (metrics.Values, error) {
+	v, err := g.s.run(ctx, func() (interface{}, error) {
+		return g.g.Generate()
+	})
+	values, _ := v.(metrics.Values)
+	return values, err
+}
+
+func (g *generator) Close() error {
+	if c, ok := g.g.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewSpecGenerator returns the SpecGenerator of g, whose Generate behaves as the
+// one of NewGenerator.
+func NewSpecGenerator(g spec.Generator) SpecGenerator {
+	return &specGenerator{g: g}
+}
+
+type specGenerator struct {
+	g spec.Generator
+	s serial
+}
+
+func (g *specGenerator) Generate(ctx context.Context) (interface{}, error) {
+	return g.s.run(ctx, g.g.Generate)
+}
+
+type interfaceGenerator struct {
+	g spec.InterfaceGenerator
+	s serial
+}
+
+func (g *interfaceGenerator) Generate(ctx context.Context) (interface{}, error) {
+	v, err := g.s.run(ctx, func() (interface{}, error) {
+		return g.g.Generate()
+	})
+	interfaces, _ := v.([]mkr.Interface)
+	return interfaces, err
+}
+
+type result struct {
+	value interface{}
+	err   error
+}
+
+// serial runs the functions of a generator one at a time.
+type serial struct {
+	mu      sync.Mutex
+	running bool
+}
+
+// run runs f, and returns ctx.Err() if ctx is done before f returns. It
+// returns ErrBusy without running f while the previous f is running.
+func (s *serial) run(ctx context.Context, f func() (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return nil, ErrBusy
+	}
+	s.running = true
+	s.mu.Unlock()
+	done := make(chan result, 1)
+	go func() {
+		v, err := f()
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+		done <- result{value: v, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Logger receives the logs of the generators, whose level is such as "WARNING"
+// and whose component is the tag of the logger, such as "metrics.disk".
+type Logger interface {
+	Log(level, component, message string)
+}
+
+// SetLogger sends the logs of the generators, and all the other logs of the
+// agent's packages, to l instead of stderr. The logs are discarded if l is nil.
+// The levels of the logs are filtered by logformat.SetLevels.
+func SetLogger(l Logger) {
+	if l == nil {
+		logformat.SetOutput(ioutil.Discard)
+		return
+	}
+	logformat.SetOutput(&logWriter{l: l})
+}
+
+// logWriter parses each log written by log.Logger at once.
+type logWriter struct {
+	l Logger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	if level, component, message, ok := logformat.Parse(line); ok {
+		w.l.Log(level, component, message)
+	} else {
+		w.l.Log("", "", line)
+	}
+	return len(p), nil
+}
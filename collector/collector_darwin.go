@@ -0,0 +1,35 @@
+package collector
+
+import (
+	"github.com/mackerelio/mackerel-agent/metrics"
+	metricsDarwin "github.com/mackerelio/mackerel-agent/metrics/darwin"
+	"github.com/mackerelio/mackerel-agent/spec"
+	specDarwin "github.com/mackerelio/mackerel-agent/spec/darwin"
+)
+
+func systemSpecGenerators() []spec.Generator {
+	return []spec.Generator{
+		&specDarwin.KernelGenerator{},
+		&specDarwin.HardwareGenerator{},
+		&specDarwin.MemoryGenerator{},
+		&specDarwin.CPUGenerator{},
+	}
+}
+
+func filesystemSpecGenerator() spec.Generator {
+	return &spec.FilesystemGenerator{}
+}
+
+func interfaceSpecGenerator() spec.InterfaceGenerator {
+	return &specDarwin.InterfaceGenerator{}
+}
+
+func systemMetricGenerators(opts Options) []metrics.Generator {
+	return []metrics.Generator{
+		&metrics.LoadavgGenerator{},
+		&metricsDarwin.CPUUsageGenerator{},
+		&metricsDarwin.MemoryGenerator{},
+		&metrics.FilesystemGenerator{IgnoreRegexp: opts.IgnoreFilesystems, UseMountpoint: opts.UseMountpoint},
+		&metrics.InterfaceGenerator{Interval: opts.interval(), CounterWrap: opts.counterWrap()},
+	}
+}
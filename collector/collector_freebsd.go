@@ -0,0 +1,36 @@
+package collector
+
+import (
+	"github.com/mackerelio/mackerel-agent/metrics"
+	metricsFreebsd "github.com/mackerelio/mackerel-agent/metrics/freebsd"
+	"github.com/mackerelio/mackerel-agent/spec"
+	specFreebsd "github.com/mackerelio/mackerel-agent/spec/freebsd"
+)
+
+func systemSpecGenerators() []spec.Generator {
+	return []spec.Generator{
+		&specFreebsd.KernelGenerator{},
+		&specFreebsd.MemoryGenerator{},
+		&specFreebsd.CPUGenerator{},
+	}
+}
+
+func filesystemSpecGenerator() spec.Generator {
+	return &spec.FilesystemGenerator{}
+}
+
+func interfaceSpecGenerator() spec.InterfaceGenerator {
+	return &specFreebsd.InterfaceGenerator{}
+}
+
+func systemMetricGenerators(opts Options) []metrics.Generator {
+	interval, counterWrap := opts.interval(), opts.counterWrap()
+	return []metrics.Generator{
+		&metrics.LoadavgGenerator{},
+		&metricsFreebsd.CPUUsageGenerator{},
+		&metrics.FilesystemGenerator{IgnoreRegexp: opts.IgnoreFilesystems, UseMountpoint: opts.UseMountpoint},
+		&metricsFreebsd.MemoryGenerator{},
+		&metrics.InterfaceGenerator{Interval: interval, CounterWrap: counterWrap},
+		&metricsFreebsd.DiskGenerator{Interval: interval, UseMountpoint: opts.UseMountpoint, CounterWrap: counterWrap},
+	}
+}
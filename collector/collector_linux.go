@@ -0,0 +1,38 @@
+package collector
+
+import (
+	"github.com/mackerelio/mackerel-agent/metrics"
+	metricsLinux "github.com/mackerelio/mackerel-agent/metrics/linux"
+	"github.com/mackerelio/mackerel-agent/spec"
+	specLinux "github.com/mackerelio/mackerel-agent/spec/linux"
+)
+
+func systemSpecGenerators() []spec.Generator {
+	return []spec.Generator{
+		&specLinux.KernelGenerator{},
+		&specLinux.HardwareGenerator{},
+		&specLinux.CPUGenerator{},
+		&specLinux.MemoryGenerator{},
+		&specLinux.BlockDeviceGenerator{},
+	}
+}
+
+func filesystemSpecGenerator() spec.Generator {
+	return &spec.FilesystemGenerator{}
+}
+
+func interfaceSpecGenerator() spec.InterfaceGenerator {
+	return &specLinux.InterfaceGenerator{}
+}
+
+func systemMetricGenerators(opts Options) []metrics.Generator {
+	interval, counterWrap := opts.interval(), opts.counterWrap()
+	return []metrics.Generator{
+		&metrics.LoadavgGenerator{},
+		&metricsLinux.CPUUsageGenerator{Interval: interval},
+		&metricsLinux.MemoryGenerator{},
+		&metrics.InterfaceGenerator{Interval: interval, CounterWrap: counterWrap},
+		&metricsLinux.DiskGenerator{Interval: interval, UseMountpoint: opts.UseMountpoint, CounterWrap: counterWrap},
+		&metrics.FilesystemGenerator{IgnoreRegexp: opts.IgnoreFilesystems, UseMountpoint: opts.UseMountpoint},
+	}
+}
@@ -0,0 +1,36 @@
+package collector
+
+import (
+	"github.com/mackerelio/mackerel-agent/metrics"
+	metricsNetbsd "github.com/mackerelio/mackerel-agent/metrics/netbsd"
+	"github.com/mackerelio/mackerel-agent/spec"
+	specNetbsd "github.com/mackerelio/mackerel-agent/spec/netbsd"
+)
+
+func systemSpecGenerators() []spec.Generator {
+	return []spec.Generator{
+		&specNetbsd.KernelGenerator{},
+		&specNetbsd.MemoryGenerator{},
+		&specNetbsd.CPUGenerator{},
+	}
+}
+
+func filesystemSpecGenerator() spec.Generator {
+	return &spec.FilesystemGenerator{}
+}
+
+func interfaceSpecGenerator() spec.InterfaceGenerator {
+	return &specNetbsd.InterfaceGenerator{}
+}
+
+func systemMetricGenerators(opts Options) []metrics.Generator {
+	interval, counterWrap := opts.interval(), opts.counterWrap()
+	return []metrics.Generator{
+		&metrics.LoadavgGenerator{},
+		&metricsNetbsd.CPUUsageGenerator{},
+		&metrics.FilesystemGenerator{IgnoreRegexp: opts.IgnoreFilesystems, UseMountpoint: opts.UseMountpoint},
+		&metricsNetbsd.MemoryGenerator{},
+		&metrics.InterfaceGenerator{Interval: interval, CounterWrap: counterWrap},
+		&metricsNetbsd.DiskGenerator{Interval: interval, UseMountpoint: opts.UseMountpoint, CounterWrap: counterWrap},
+	}
+}
@@ -0,0 +1,107 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+type blockingGenerator struct {
+	release chan struct{}
+	closed  bool
+}
+
+func (g *blockingGenerator) Generate() (metrics.Values, error) {
+	<-g.release
+	return metrics.Values{"foo": 1}, nil
+}
+
+func (g *blockingGenerator) Close() error {
+	g.closed = true
+	return nil
+}
+
+func TestNewGenerator(t *testing.T) {
+	bg := &blockingGenerator{release: make(chan struct{})}
+	g := NewGenerator(bg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.Generate(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Generate should return the error of the context: %v", err)
+	}
+	if _, err := g.Generate(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Generate should not run with the context done: %v", err)
+	}
+	if _, err := g.Generate(context.Background()); err != ErrBusy {
+		t.Errorf("Generate should not run while the previous one is running: %v", err)
+	}
+
+	close(bg.release)
+	values, err := g.Generate(context.Background())
+	for i := 0; err == ErrBusy && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		values, err = g.Generate(context.Background())
+	}
+	if err != nil || values["foo"] != 1 {
+		t.Errorf("Generate should return the values: %v, %v", values, err)
+	}
+
+	if err := g.(io.Closer).Close(); err != nil || !bg.closed {
+		t.Errorf("Close should close the generator: %v", err)
+	}
+}
+
+type failingSpecGenerator struct{}
+
+func (failingSpecGenerator) Generate() (interface{}, error) {
+	return nil, errors.New("failed")
+}
+
+func TestNewSpecGenerator(t *testing.T) {
+	_, err := NewSpecGenerator(failingSpecGenerator{}).Generate(context.Background())
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("Generate should return the error of the generator: %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var opts Options
+	if opts.interval() != DefaultInterval || opts.counterWrap() != config.CounterWrapAuto {
+		t.Errorf("the zero options should be the defaults of the agent: %s, %s", opts.interval(), opts.counterWrap())
+	}
+	opts = Options{Interval: time.Second, CounterWrap: config.CounterWrapDrop}
+	if opts.interval() != time.Second || opts.counterWrap() != config.CounterWrapDrop {
+		t.Errorf("the options should be kept: %s, %s", opts.interval(), opts.counterWrap())
+	}
+	if len(MetricGenerators(opts)) != len(SystemMetricGenerators(opts)) {
+		t.Errorf("MetricGenerators should be the ones of SystemMetricGenerators")
+	}
+}
+
+type recordingLogger struct {
+	logs [][3]string
+}
+
+func (l *recordingLogger) Log(level, component, message string) {
+	l.logs = append(l.logs, [3]string{level, component, message})
+}
+
+func TestSetLogger(t *testing.T) {
+	l := &recordingLogger{}
+	SetLogger(l)
+	defer logformat.SetOutput(os.Stderr)
+
+	logformat.GetLogger("metrics.disk").Warningf("dropped %d values", 2)
+	logformat.GetLogger("metrics.disk").Debugf("not logged by default")
+	if len(l.logs) != 1 || l.logs[0] != [3]string{"WARNING", "metrics.disk", "dropped 2 values"} {
+		t.Errorf("the logs should be sent to the logger: %q", l.logs)
+	}
+}
@@ -1,28 +1,31 @@
-package command
+package collector
 
 import (
-	"github.com/mackerelio/mackerel-agent/config"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	metricsWindows "github.com/mackerelio/mackerel-agent/metrics/windows"
 	"github.com/mackerelio/mackerel-agent/spec"
 	specWindows "github.com/mackerelio/mackerel-agent/spec/windows"
 )
 
-func specGenerators() []spec.Generator {
+func systemSpecGenerators() []spec.Generator {
 	return []spec.Generator{
 		&specWindows.KernelGenerator{},
+		&specWindows.HardwareGenerator{},
 		&specWindows.CPUGenerator{},
 		&specWindows.MemoryGenerator{},
 		&specWindows.BlockDeviceGenerator{},
-		&specWindows.FilesystemGenerator{},
 	}
 }
 
-func interfaceGenerator() spec.InterfaceGenerator {
+func filesystemSpecGenerator() spec.Generator {
+	return &specWindows.FilesystemGenerator{}
+}
+
+func interfaceSpecGenerator() spec.InterfaceGenerator {
 	return &specWindows.InterfaceGenerator{}
 }
 
-func metricsGenerators(conf *config.Config) []metrics.Generator {
+func systemMetricGenerators(opts Options) []metrics.Generator {
 	var g metrics.Generator
 	var err error
 
@@ -30,21 +33,26 @@ func metricsGenerators(conf *config.Config) []metrics.Generator {
 	if g, err = metricsWindows.NewProcessorQueueLengthGenerator(); err == nil {
 		generators = append(generators, g)
 	}
-	if g, err = metricsWindows.NewCPUUsageGenerator(); err == nil {
+	if g, err = metricsWindows.NewCPUUsageGenerator(opts.WindowsCPUBackend); err == nil {
 		generators = append(generators, g)
 	}
 	if g, err = metricsWindows.NewMemoryGenerator(); err == nil {
 		generators = append(generators, g)
 	}
-	if g, err = metricsWindows.NewFilesystemGenerator(conf.Filesystems.Ignore.Regexp); err == nil {
+	if g, err = metricsWindows.NewFilesystemGenerator(opts.IgnoreFilesystems); err == nil {
 		generators = append(generators, g)
 	}
-	if g, err = metricsWindows.NewInterfaceGenerator(metricsInterval); err == nil {
+	if g, err = metricsWindows.NewInterfaceGenerator(opts.interval()); err == nil {
 		generators = append(generators, g)
 	}
-	if g, err = metricsWindows.NewDiskGenerator(metricsInterval); err == nil {
+	if g, err = metricsWindows.NewDiskGenerator(opts.interval()); err == nil {
 		generators = append(generators, g)
 	}
+	if s := opts.WindowsServices; s != nil {
+		if g, err = metricsWindows.NewServicesGenerator(s.Include, s.Exclude); err == nil {
+			generators = append(generators, g)
+		}
+	}
 
 	return generators
 }
@@ -0,0 +1,57 @@
+package command
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// alertFlusher flushes the pending metrics when the checks transition to
+// WARNING or CRITICAL by flush_metrics_on_alert. The flushes are debounced so
+// that a burst of the alerts posts the metrics at most once in the interval.
+type alertFlusher struct {
+	interval time.Duration
+	// flush signals the metrics loop, and returns false if it is rate limited.
+	flush func() bool
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newAlertFlusher(app *App) *alertFlusher {
+	return &alertFlusher{
+		interval: config.PostMetricsInterval,
+		flush: func() bool {
+			// the metrics are retried by Retry-After and the maintenance backoff
+			if app.API.RetryAfter() > 0 || app.API.InMaintenance() {
+				return false
+			}
+			select {
+			case app.flushMetricsCh <- struct{}{}:
+			default:
+			}
+			return true
+		},
+	}
+}
+
+// alert flushes the metrics if the check transitioned to status, and reports
+// whether they are flushed. It is nil-safe.
+func (f *alertFlusher) alert(name string, status checks.Status, now time.Time) bool {
+	if f == nil || (status != checks.StatusWarning && status != checks.StatusCritical) {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.last.IsZero() && now.Sub(f.last) < f.interval {
+		return false
+	}
+	if !f.flush() {
+		return false
+	}
+	f.last = now
+	logger.Debugf("checker %q: transitioned to %s, flushing the pending metrics", name, status)
+	return true
+}
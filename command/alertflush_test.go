@@ -0,0 +1,51 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+)
+
+func TestAlertFlusher(t *testing.T) {
+	flushes := 0
+	limited := false
+	f := &alertFlusher{
+		interval: time.Minute,
+		flush: func() bool {
+			if limited {
+				return false
+			}
+			flushes++
+			return true
+		},
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if f.alert("check-ok", checks.StatusOK, now) || f.alert("check-unknown", checks.StatusUnknown, now) {
+		t.Errorf("the metrics should not be flushed by OK and UNKNOWN")
+	}
+	if !f.alert("check-a", checks.StatusCritical, now) {
+		t.Errorf("the metrics should be flushed by CRITICAL")
+	}
+	// a burst of the alerts
+	if f.alert("check-b", checks.StatusWarning, now.Add(time.Second)) || f.alert("check-c", checks.StatusCritical, now.Add(59*time.Second)) {
+		t.Errorf("the metrics should be flushed at most once in the interval")
+	}
+	limited = true
+	if f.alert("check-a", checks.StatusCritical, now.Add(time.Minute)) {
+		t.Errorf("the metrics should not be flushed while rate limited")
+	}
+	limited = false
+	if !f.alert("check-b", checks.StatusWarning, now.Add(time.Minute+time.Second)) {
+		t.Errorf("the metrics should be flushed after the interval")
+	}
+	if flushes != 2 {
+		t.Errorf("the metrics should be flushed twice but %d times", flushes)
+	}
+
+	var disabled *alertFlusher
+	if disabled.alert("check-a", checks.StatusCritical, now) {
+		t.Errorf("the metrics should not be flushed when disabled")
+	}
+}
@@ -0,0 +1,191 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/supervisor"
+	"github.com/mackerelio/mackerel-agent/util"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// lifecycleEvent is the event of the agent posted as the graph annotation.
+type lifecycleEvent string
+
+const (
+	lifecycleStart   lifecycleEvent = "started"
+	lifecycleRestart lifecycleEvent = "restarted"
+	lifecycleReload  lifecycleEvent = "reloaded"
+	lifecycleStop    lifecycleEvent = "stopped"
+)
+
+var lifecycleReasons = map[lifecycleEvent]string{
+	lifecycleStart:   "started",
+	lifecycleRestart: "restarted by the supervisor after exiting unexpectedly",
+	lifecycleReload:  "restarted by the supervisor to reload the configuration",
+	lifecycleStop:    "stopped gracefully",
+}
+
+// lifecycleStopTimeout is the maximum delay of the shutdown by the annotation.
+const lifecycleStopTimeout = 10 * time.Second
+
+// lifecycleReloadWindow is the maximum interval between the stop of the agent
+// and the start of the next one reloading the configuration, whose annotations
+// are merged into one.
+const lifecycleReloadWindow = time.Minute
+
+// lifecycleState is persisted across the restarts to limit the annotations of
+// the agent restarted repeatedly.
+type lifecycleState struct {
+	PostedAt []time.Time `json:"postedAt"`
+	// LastStop is the annotation of the previous agent stopped, which is
+	// updated to the reload by the next agent started by the supervisor.
+	LastStop *lifecycleStopState `json:"lastStop,omitempty"`
+}
+
+type lifecycleStopState struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+}
+
+// lifecycleAnnotator posts the graph annotations of the starts, the stops and
+// the reloads of the agent, up to conf.MaxPerHour in an hour.
+type lifecycleAnnotator struct {
+	mu   sync.Mutex
+	conf *config.LifecycleAnnotation
+	file string
+	api  *mackerel.API
+	meta *AgentMeta
+}
+
+func lifecycleStateFile(conf *config.Config) string {
+	return filepath.Join(conf.Root, "lifecycle-annotations.json")
+}
+
+func newLifecycleAnnotator(conf *config.Config, api *mackerel.API, ameta *AgentMeta) *lifecycleAnnotator {
+	return &lifecycleAnnotator{
+		conf: conf.LifecycleAnnotation,
+		file: lifecycleStateFile(conf),
+		api:  api,
+		meta: ameta,
+	}
+}
+
+// startEvent returns the event of this agent started, which is told by the
+// supervisor if it is started again.
+func startEvent() lifecycleEvent {
+	switch os.Getenv(supervisor.StartReasonEnv) {
+	case supervisor.StartReasonReload:
+		return lifecycleReload
+	case supervisor.StartReasonRestart:
+		return lifecycleRestart
+	}
+	return lifecycleStart
+}
+
+// annotate posts the annotation of event on the host. The stop of the previous
+// agent reloading the configuration is updated to the reload, which is not
+// counted again.
+func (a *lifecycleAnnotator) annotate(event lifecycleEvent, hostName, hostID string, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := a.load(now)
+	version := a.meta.Version
+	if a.meta.Revision != "" {
+		version += " (rev " + a.meta.Revision + ")"
+	}
+	annotation := &mkr.GraphAnnotation{
+		Title:       fmt.Sprintf("mackerel-agent %s on %s", event, hostName),
+		Description: fmt.Sprintf("mackerel-agent %s on the host %s (%s) was %s.", version, hostName, hostID, lifecycleReasons[event]),
+		From:        now.Unix(),
+		To:          now.Unix(),
+		Service:     a.conf.Service,
+		Roles:       a.conf.Roles,
+	}
+	lastStop := st.LastStop
+	st.LastStop = nil
+	if event == lifecycleReload && lastStop != nil && now.Sub(lastStop.At) < lifecycleReloadWindow {
+		annotation.From = lastStop.At.Unix()
+		a.save(st)
+		_, err := a.api.UpdateGraphAnnotation(lastStop.ID, annotation)
+		return err
+	}
+	if len(st.PostedAt) >= a.conf.MaxPerHour {
+		a.save(st)
+		return fmt.Errorf("%d annotations have been posted in the last hour (lifecycle_annotation.max_per_hour = %d)", len(st.PostedAt), a.conf.MaxPerHour)
+	}
+	// counted before posting, since the agent may crash while posting
+	st.PostedAt = append(st.PostedAt, now)
+	a.save(st)
+	posted, err := a.api.CreateGraphAnnotation(annotation)
+	if err != nil {
+		return err
+	}
+	if event == lifecycleStop && posted.ID != "" {
+		st.LastStop = &lifecycleStopState{ID: posted.ID, At: now}
+		a.save(st)
+	}
+	return nil
+}
+
+// load reads the state of the annotations posted in the last hour.
+func (a *lifecycleAnnotator) load(now time.Time) *lifecycleState {
+	var st lifecycleState
+	b, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read the state of the annotations: %s", err)
+		}
+		return &st
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		logger.Warningf("Failed to read the state of the annotations: %s", err)
+		return &lifecycleState{}
+	}
+	recent := st.PostedAt[:0]
+	for _, t := range st.PostedAt {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	st.PostedAt = recent
+	return &st
+}
+
+func (a *lifecycleAnnotator) save(st *lifecycleState) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		logger.Warningf("Failed to save the state of the annotations: %s", err)
+		return
+	}
+	if err := util.WriteFileAtomically(a.file, append(b, '\n'), 0644); err != nil {
+		logger.Warningf("Failed to save the state of the annotations: %s", err)
+	}
+}
+
+// annotateLifecycle posts the annotation of event in the background, and
+// returns the channel closed when it is done. The failures are only logged
+// not to affect the main loop.
+func (app *App) annotateLifecycle(event lifecycleEvent) <-chan struct{} {
+	done := make(chan struct{})
+	if app.annotator == nil {
+		close(done)
+		return done
+	}
+	hostName, hostID := app.Host.Name, app.Host.ID
+	go func() {
+		defer close(done)
+		if err := app.annotator.annotate(event, hostName, hostID, time.Now()); err != nil {
+			logger.Warningf("Failed to post the annotation of the agent %s: %s", event, err)
+		}
+	}()
+	return done
+}
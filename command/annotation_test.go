@@ -0,0 +1,112 @@
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/supervisor"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestLifecycleAnnotator(t *testing.T) {
+	type request struct {
+		method, path string
+		annotation   mkr.GraphAnnotation
+	}
+	var requests []request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var a mkr.GraphAnnotation
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			t.Errorf("the annotation should be JSON: %s", err)
+		}
+		requests = append(requests, request{req.Method, req.URL.Path, a})
+		a.ID = "anno1"
+		json.NewEncoder(w).Encode(a)
+	}))
+	defer ts.Close()
+
+	root, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	conf := &config.Config{
+		Root:                root,
+		LifecycleAnnotation: &config.LifecycleAnnotation{Service: "web", Roles: []string{"app"}, MaxPerHour: 3},
+	}
+	api, err := prepareAPI(conf, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ameta := &AgentMeta{Version: "0.1.2", Revision: "abcdef"}
+	now := time.Date(2026, 10, 14, 14, 2, 0, 0, time.UTC)
+
+	a := newLifecycleAnnotator(conf, api, ameta)
+	if err := a.annotate(lifecycleStart, "app01", "xyzabc12345", now); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].method != "POST" || requests[0].path != "/api/v0/graph-annotations" {
+		t.Fatalf("the annotation should be posted: %+v", requests)
+	}
+	got := requests[0].annotation
+	if got.Title != "mackerel-agent started on app01" || got.Service != "web" || len(got.Roles) != 1 || got.Roles[0] != "app" || got.From != now.Unix() || got.To != now.Unix() {
+		t.Errorf("unexpected annotation: %+v", got)
+	}
+	if !strings.Contains(got.Description, "0.1.2 (rev abcdef)") || !strings.Contains(got.Description, "xyzabc12345") {
+		t.Errorf("the description should have the version and the host: %q", got.Description)
+	}
+
+	// the stop and the reload of the next agent are merged
+	stopped := now.Add(time.Minute)
+	if err := a.annotate(lifecycleStop, "app01", "xyzabc12345", stopped); err != nil {
+		t.Fatal(err)
+	}
+	a = newLifecycleAnnotator(conf, api, ameta)
+	if err := a.annotate(lifecycleReload, "app01", "xyzabc12345", stopped.Add(3*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 || requests[2].method != "PUT" || requests[2].path != "/api/v0/graph-annotations/anno1" {
+		t.Fatalf("the annotation of the stop should be updated: %+v", requests)
+	}
+	if got := requests[2].annotation; got.Title != "mackerel-agent reloaded on app01" || got.From != stopped.Unix() || got.To != stopped.Unix()+3 {
+		t.Errorf("unexpected annotation: %+v", got)
+	}
+
+	// the third annotation in the hour
+	if err := a.annotate(lifecycleRestart, "app01", "xyzabc12345", now.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.annotate(lifecycleRestart, "app01", "xyzabc12345", now.Add(20*time.Minute)); err == nil {
+		t.Error("the annotations more than max_per_hour should not be posted")
+	}
+	if len(requests) != 4 {
+		t.Errorf("the annotations more than max_per_hour should not be posted: %+v", requests)
+	}
+	if err := a.annotate(lifecycleRestart, "app01", "xyzabc12345", now.Add(61*time.Minute)); err != nil {
+		t.Errorf("the annotation should be posted after the hour: %s", err)
+	}
+	if len(requests) != 5 || requests[4].method != "POST" {
+		t.Errorf("the annotation should be posted after the hour: %+v", requests)
+	}
+}
+
+func TestStartEvent(t *testing.T) {
+	defer os.Unsetenv(supervisor.StartReasonEnv)
+	for env, expect := range map[string]lifecycleEvent{
+		"":                            lifecycleStart,
+		supervisor.StartReasonReload:  lifecycleReload,
+		supervisor.StartReasonRestart: lifecycleRestart,
+	} {
+		os.Setenv(supervisor.StartReasonEnv, env)
+		if got := startEvent(); got != expect {
+			t.Errorf("the event should be %q for %q but got %q", expect, env, got)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// The actions at exit given by the command line option -at-exit.
+const (
+	// AtExitRetire is to retire the host whenever the agent exits by a signal.
+	AtExitRetire = "retire"
+	// AtExitRetireOnShutdown is to retire the host only when the system is shutting down.
+	AtExitRetireOnShutdown = "retire-on-shutdown"
+)
+
+var defaultAutoRetirementTimeout = 10 * time.Second
+
+var autoRetirementRetryPolicy = &mackerel.RetryPolicy{
+	InitialInterval: 1 * time.Second,
+	MaxInterval:     3 * time.Second,
+}
+
+// AutoRetirementTimeout returns the maximum duration to retire the host at exit.
+func AutoRetirementTimeout(conf *config.Config) time.Duration {
+	if conf.AutoRetirement.Timeout != nil {
+		return conf.AutoRetirement.Timeout.Duration
+	}
+	return defaultAutoRetirementTimeout
+}
+
+// for testing
+var systemShuttingDown = isSystemShuttingDown
+
+func shouldAutoRetire(conf *config.Config) bool {
+	if !conf.AutoRetirement.Enable {
+		return false
+	}
+	switch conf.AtExit {
+	case AtExitRetire:
+		return true
+	case AtExitRetireOnShutdown:
+		if systemShuttingDown() {
+			return true
+		}
+		logger.Infof("Not retiring the host since the system is not shutting down")
+	}
+	return false
+}
+
+// autoRetire retires the host and removes the host ID file within AutoRetirementTimeout.
+func autoRetire(app *App) error {
+	timeout := AutoRetirementTimeout(app.Config)
+	logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Infof("Retiring this host (hostID: %s) at exit, up to %s", app.Host.ID, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.API.Retry(ctx, autoRetirementRetryPolicy, "RetireHost", func() error {
+			return app.API.RetireHost(app.Host.ID)
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("timed out in %s", timeout)
+	}
+	logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Infof("This host (hostID: %s) has been retired.", app.Host.ID)
+	if err := app.Config.DeleteSavedHostID(); err != nil {
+		logger.Warningf("Failed to remove HostID file: %s", err)
+	}
+	return nil
+}
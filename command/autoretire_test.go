@@ -0,0 +1,66 @@
+package command
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestShouldAutoRetire(t *testing.T) {
+	origShuttingDown := systemShuttingDown
+	defer func() { systemShuttingDown = origShuttingDown }()
+
+	tests := []struct {
+		name         string
+		enable       bool
+		atExit       string
+		shuttingDown bool
+		expected     bool
+	}{
+		{name: "disabled", enable: false, atExit: AtExitRetire, expected: false},
+		{name: "no trigger", enable: true, atExit: "", shuttingDown: true, expected: false},
+		{name: "retire", enable: true, atExit: AtExitRetire, expected: true},
+		{name: "restart", enable: true, atExit: AtExitRetireOnShutdown, shuttingDown: false, expected: false},
+		{name: "shutdown", enable: true, atExit: AtExitRetireOnShutdown, shuttingDown: true, expected: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			systemShuttingDown = func() bool { return tc.shuttingDown }
+			conf := &config.Config{AutoRetirement: config.AutoRetirement{Enable: tc.enable}, AtExit: tc.atExit}
+			if got := shouldAutoRetire(conf); got != tc.expected {
+				t.Errorf("shouldAutoRetire should be %t but got %t", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAutoRetire(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	retired := false
+	mockHandlers["POST /api/v0/hosts/xyzabc12345/retire"] = func(req *http.Request) (int, jsonObject) {
+		retired = true
+		return 200, jsonObject{"success": true}
+	}
+	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.SaveHostID("xyzabc12345"); err != nil {
+		t.Fatal(err)
+	}
+	app := &App{Config: &conf, API: api, Host: &mkr.Host{ID: "xyzabc12345"}}
+	if err := autoRetire(app); err != nil {
+		t.Fatal(err)
+	}
+	if !retired {
+		t.Error("the host should be retired")
+	}
+	if _, err := conf.LoadHostID(); err == nil {
+		t.Error("the host ID file should be removed")
+	}
+}
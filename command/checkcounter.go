@@ -0,0 +1,106 @@
+package command
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+)
+
+// checkCounter counts the executions of the checks scheduled, executed and
+// reported, which are posted as the self metrics. The scheduled ones are
+// counted from the schedules recorded by the checkers, not by the checkers
+// themselves, so that the stuck checkers are reflected as executed < scheduled.
+// The methods do nothing if it is nil.
+type checkCounter struct {
+	mu        sync.Mutex
+	schedules map[*checks.Checker]checkSchedule
+	// scheduled are the executions due by the schedules replaced since the
+	// last period taken.
+	scheduled int
+	executed  int
+	reported  int
+	// countedAt is the end of the last period taken.
+	countedAt time.Time
+}
+
+// checkSchedule is the next execution of a checker, which is repeated by the
+// interval until it is executed.
+type checkSchedule struct {
+	next     time.Time
+	interval time.Duration
+}
+
+func newCheckCounter(now time.Time) *checkCounter {
+	return &checkCounter{schedules: make(map[*checks.Checker]checkSchedule), countedAt: now}
+}
+
+// schedule records the next execution of checker, which replaces the previous
+// one whose executions due before next are counted.
+func (c *checkCounter) schedule(checker *checks.Checker, next time.Time, interval time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.schedules[checker]; ok {
+		c.scheduled += prev.dueBetween(c.countedAt, next.Add(-time.Nanosecond))
+	}
+	c.schedules[checker] = checkSchedule{next: next, interval: interval}
+}
+
+func (c *checkCounter) countExecuted() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.executed++
+}
+
+func (c *checkCounter) countReported(n int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reported += n
+}
+
+// take returns the numbers of the executions scheduled until now, executed
+// and reported since the last call.
+func (c *checkCounter) take(now time.Time) (scheduled, executed, reported int) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	scheduled = c.scheduled
+	for _, s := range c.schedules {
+		scheduled += s.dueBetween(c.countedAt, now)
+	}
+	executed, reported = c.executed, c.reported
+	c.scheduled, c.executed, c.reported = 0, 0, 0
+	if now.After(c.countedAt) {
+		c.countedAt = now
+	}
+	return scheduled, executed, reported
+}
+
+// dueBetween returns the number of the executions due in (from, to], which
+// are the next one and the following ones by the interval.
+func (s checkSchedule) dueBetween(from, to time.Time) int {
+	if s.next.After(to) || s.interval <= 0 {
+		return 0
+	}
+	// the last due at or before to, and the first one after from
+	last := int(to.Sub(s.next) / s.interval)
+	first := 0
+	if !s.next.After(from) {
+		first = int(from.Sub(s.next)/s.interval) + 1
+	}
+	if last < first {
+		return 0
+	}
+	return last - first + 1
+}
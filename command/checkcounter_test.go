@@ -0,0 +1,42 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+)
+
+func TestCheckCounter(t *testing.T) {
+	base := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	c := newCheckCounter(base)
+	working, stuck := &checks.Checker{Name: "working"}, &checks.Checker{Name: "stuck"}
+	c.schedule(working, base.Add(10*time.Second), time.Minute)
+	c.schedule(stuck, base.Add(20*time.Second), time.Minute)
+
+	// both executed once
+	c.countExecuted()
+	c.schedule(working, base.Add(70*time.Second), time.Minute)
+	c.countExecuted()
+	c.countReported(2)
+	if s, e, r := c.take(base.Add(time.Minute)); s != 2 || e != 2 || r != 2 {
+		t.Errorf("the counts should be 2, 2, 2 but got %d, %d, %d", s, e, r)
+	}
+
+	// the stuck one is not executed after 20s
+	c.countExecuted()
+	c.schedule(working, base.Add(130*time.Second), time.Minute)
+	if s, e, r := c.take(base.Add(2 * time.Minute)); s != 2 || e != 1 || r != 0 {
+		t.Errorf("the counts should be 2, 1, 0 but got %d, %d, %d", s, e, r)
+	}
+	// the executions missed for 3 minutes
+	if s, e, _ := c.take(base.Add(5 * time.Minute)); s != 6 || e != 0 {
+		t.Errorf("the counts should be 6, 0 but got %d, %d", s, e)
+	}
+
+	var nilCounter *checkCounter
+	nilCounter.countExecuted()
+	if s, e, r := nilCounter.take(base); s != 0 || e != 0 || r != 0 {
+		t.Errorf("nil should count nothing")
+	}
+}
@@ -0,0 +1,159 @@
+package command
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+var defaultCheckReportResendInterval = 30 * time.Minute
+
+// CheckReportResendInterval returns the interval to resend the unchanged check reports.
+// Zero means to post all the reports.
+func CheckReportResendInterval(conf *config.Config) time.Duration {
+	if conf.CheckReportResendInterval != nil {
+		return conf.CheckReportResendInterval.Duration
+	}
+	return defaultCheckReportResendInterval
+}
+
+// checkReportCache skips posting the check reports whose status and message
+// are same as the last ones, except that they are resent every interval so
+// that Mackerel knows the checks are alive. A nil cache skips nothing.
+type checkReportCache struct {
+	interval time.Duration
+	// file persists last across the restarts unless empty.
+	file string
+
+	mu   sync.Mutex
+	last map[string]*lastCheckReport
+}
+
+type lastCheckReport struct {
+	status      checks.Status
+	messageHash string
+	// count is the number of the reports posted since the status or the message changed.
+	count  int32
+	sentAt time.Time
+	// failures is the number of the consecutive reports not OK posted, which
+	// continues across the changes of the status and the message.
+	failures int32
+}
+
+func hashMessage(message string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(message)))
+}
+
+func newCheckReportCache(interval time.Duration) *checkReportCache {
+	if interval <= 0 {
+		return nil
+	}
+	return &checkReportCache{interval: interval, last: make(map[string]*lastCheckReport)}
+}
+
+// filter returns the reports to be posted. The same reports are posted as many
+// times as max_check_attempts, since Mackerel counts them to raise the alerts,
+// but not after as many consecutive failures have been posted, such as when
+// the message of the failing check changes.
+// The reports are not recorded until they are given to record on being posted.
+func (c *checkReportCache) filter(reports []*checks.Report, now time.Time) []*checks.Report {
+	if c == nil {
+		return reports
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// pending is the states of the checks reported more than once in reports.
+	pending := make(map[string]*lastCheckReport)
+	filtered := make([]*checks.Report, 0, len(reports))
+	for _, r := range reports {
+		l, ok := pending[r.Name]
+		if !ok {
+			l = c.last[r.Name]
+		}
+		l, post := c.next(l, r, now)
+		if !post {
+			continue
+		}
+		pending[r.Name] = l
+		filtered = append(filtered, r)
+	}
+	if skipped := len(reports) - len(filtered); skipped > 0 {
+		logger.Debugf("Skipped posting %d unchanged check reports", skipped)
+	}
+	return filtered
+}
+
+// record records the reports posted at now, and saves the states.
+func (c *checkReportCache) record(reports []*checks.Report, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for _, r := range reports {
+		if l, post := c.next(c.last[r.Name], r, now); post {
+			c.last[r.Name] = l
+		}
+	}
+	c.mu.Unlock()
+	c.save(now)
+}
+
+// next returns whether r is to be posted at now given the last state l, which
+// may be nil, and the state after r is posted.
+func (c *checkReportCache) next(l *lastCheckReport, r *checks.Report, now time.Time) (*lastCheckReport, bool) {
+	attempts := int32(1)
+	if r.MaxCheckAttempts != nil && *r.MaxCheckAttempts > 1 {
+		attempts = *r.MaxCheckAttempts
+	}
+	hash := hashMessage(r.Message)
+	var failures int32
+	if r.Status != checks.StatusOK {
+		failures = 1
+		if l != nil {
+			failures = l.failures + 1
+		}
+	}
+	switch {
+	case l == nil || l.status != r.Status:
+		return &lastCheckReport{status: r.Status, messageHash: hash, count: 1, sentAt: now, failures: failures}, true
+	case now.Sub(l.sentAt) < c.interval && l.failures >= attempts:
+		// the message of the failing check may change on every run, such as
+		// the one containing the measured value
+		return l, false
+	case l.messageHash != hash:
+		return &lastCheckReport{status: r.Status, messageHash: hash, count: 1, sentAt: now, failures: failures}, true
+	case now.Sub(l.sentAt) >= c.interval:
+		n := *l
+		n.count++
+		n.sentAt = now
+		n.failures = failures
+		return &n, true
+	case l.count >= attempts:
+		return l, false
+	}
+	n := *l
+	n.count++
+	n.failures = failures
+	return &n, true
+}
+
+// reset makes all the next reports posted.
+func (c *checkReportCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = make(map[string]*lastCheckReport)
+}
+
+// ResetCheckReports makes the next check reports posted even if they are unchanged,
+// on reloading the configuration which may change the check monitors.
+func (app *App) ResetCheckReports() {
+	app.checkReports.reset()
+}
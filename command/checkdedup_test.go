@@ -0,0 +1,151 @@
+package command
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+)
+
+func TestCheckReportCache_Filter(t *testing.T) {
+	c := newCheckReportCache(30 * time.Minute)
+	now := time.Now()
+	report := func(name string, status checks.Status, message string) *checks.Report {
+		return &checks.Report{Name: name, Status: status, Message: message}
+	}
+	attempts := int32(2)
+	retried := report("retried", checks.StatusCritical, "down")
+	retried.MaxCheckAttempts = &attempts
+
+	steps := []struct {
+		name     string
+		after    time.Duration
+		reports  []*checks.Report
+		expected []string
+	}{
+		{name: "first", reports: []*checks.Report{report("a", checks.StatusOK, "ok"), retried}, expected: []string{"a", "retried"}},
+		{name: "unchanged", after: time.Minute, reports: []*checks.Report{report("a", checks.StatusOK, "ok"), retried}, expected: []string{"retried"}},
+		{name: "max_check_attempts", after: time.Minute, reports: []*checks.Report{retried}, expected: []string{}},
+		{name: "message changed", after: time.Minute, reports: []*checks.Report{report("a", checks.StatusOK, "fine")}, expected: []string{"a"}},
+		{name: "transition", after: time.Minute, reports: []*checks.Report{report("a", checks.StatusCritical, "fine")}, expected: []string{"a"}},
+		{name: "failing message changed", after: time.Minute, reports: []*checks.Report{report("a", checks.StatusCritical, "ng")}, expected: []string{}},
+		{name: "resend", after: 30 * time.Minute, reports: []*checks.Report{report("a", checks.StatusCritical, "ng"), retried}, expected: []string{"a", "retried"}},
+	}
+	for _, s := range steps {
+		now = now.Add(s.after)
+		var got []string
+		posted := c.filter(s.reports, now)
+		for _, r := range posted {
+			got = append(got, r.Name)
+		}
+		c.record(posted, now)
+		if len(got) != len(s.expected) {
+			t.Errorf("%s: the posted reports should be %v but got %v", s.name, s.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != s.expected[i] {
+				t.Errorf("%s: the posted reports should be %v but got %v", s.name, s.expected, got)
+			}
+		}
+	}
+
+	unposted := []*checks.Report{report("a", checks.StatusWarning, "ng")}
+	for i := 0; i < 2; i++ {
+		if got := c.filter(unposted, now); len(got) != 1 {
+			t.Errorf("the reports should be posted until they are recorded: %v", got)
+		}
+	}
+
+	c.reset()
+	if got := c.filter([]*checks.Report{report("a", checks.StatusCritical, "ng")}, now); len(got) != 1 {
+		t.Errorf("the reports should be posted after reset: %v", got)
+	}
+}
+
+func TestCheckReportCache_FilterConsecutiveFailures(t *testing.T) {
+	c := newCheckReportCache(30 * time.Minute)
+	now := time.Now()
+	attempts := int32(3)
+	report := func(status checks.Status, message string) []*checks.Report {
+		return []*checks.Report{{Name: "a", Status: status, Message: message, MaxCheckAttempts: &attempts}}
+	}
+	post := func(reports []*checks.Report) int {
+		now = now.Add(time.Minute)
+		posted := c.filter(reports, now)
+		c.record(posted, now)
+		return len(posted)
+	}
+
+	for i := 0; i < 3; i++ {
+		if n := post(report(checks.StatusCritical, "down")); n != 1 {
+			t.Errorf("the report should be posted as many times as max_check_attempts: %d", i)
+		}
+	}
+	if n := post(report(checks.StatusCritical, "still down")); n != 0 {
+		t.Errorf("the changed report should not be posted after max_check_attempts consecutive failures: %d", c.last["a"].failures)
+	}
+	if n := post(report(checks.StatusWarning, "slow")); n != 1 || c.last["a"].failures != 4 {
+		t.Error("the report of the changed status should be posted and counted as the consecutive failure")
+	}
+	if n := post(report(checks.StatusOK, "ok")); n != 1 || c.last["a"].failures != 0 {
+		t.Error("the OK report should reset the consecutive failures")
+	}
+	for i := 0; i < 3; i++ {
+		if n := post(report(checks.StatusWarning, "slow")); n != 1 {
+			t.Errorf("the report should be posted as many times as max_check_attempts after OK: %d", i)
+		}
+	}
+}
+
+func TestCheckReportCache_FilterChangingMessages(t *testing.T) {
+	c := newCheckReportCache(30 * time.Minute)
+	now := time.Now()
+	attempts := int32(3)
+	posted := 0
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Minute)
+		reports := []*checks.Report{{
+			Name:             "a",
+			Status:           checks.StatusCritical,
+			Message:          fmt.Sprintf("the response took %d ms", 1000+i),
+			MaxCheckAttempts: &attempts,
+		}}
+		got := c.filter(reports, now)
+		c.record(got, now)
+		posted += len(got)
+	}
+	if posted != 3 {
+		t.Errorf("the failing reports should be posted as many times as max_check_attempts even if the messages change: %d", posted)
+	}
+
+	now = now.Add(30 * time.Minute)
+	reports := []*checks.Report{{Name: "a", Status: checks.StatusCritical, Message: "the response took 2000 ms", MaxCheckAttempts: &attempts}}
+	if got := c.filter(reports, now); len(got) != 1 {
+		t.Errorf("the failing report should be resent after the interval: %v", got)
+	}
+}
+
+func TestCheckReportCache_FilterDuplicates(t *testing.T) {
+	c := newCheckReportCache(30 * time.Minute)
+	reports := []*checks.Report{
+		{Name: "a", Status: checks.StatusOK, Message: "ok"},
+		{Name: "a", Status: checks.StatusOK, Message: "ok"},
+	}
+	if got := c.filter(reports, time.Now()); len(got) != 1 {
+		t.Errorf("the unchanged report should be posted once in a batch: %v", got)
+	}
+}
+
+func TestCheckReportCache_Disabled(t *testing.T) {
+	c := newCheckReportCache(0)
+	reports := []*checks.Report{{Name: "a", Status: checks.StatusOK}}
+	for i := 0; i < 2; i++ {
+		if got := c.filter(reports, time.Now()); len(got) != 1 {
+			t.Errorf("all the reports should be posted: %v", got)
+		}
+		c.record(reports, time.Now())
+	}
+	c.reset()
+}
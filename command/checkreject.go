@@ -0,0 +1,53 @@
+package command
+
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// rejectedMessageExcerpt is the maximum characters of the message of a check
+// report rejected by the API to be logged.
+const rejectedMessageExcerpt = 100
+
+// bisectCheckReports reports the halves of the reports rejected by the
+// validation of the API by err, so that the valid reports in them are
+// reported, and drops the reports rejected by themselves. The requests are
+// limited by budget, beyond which the rest are dropped.
+func bisectCheckReports(ctx context.Context, app *App, hostID string, reports []*checks.Report, err error, budget *int) {
+	switch len(reports) {
+	case 0:
+		return
+	case 1:
+		r := reports[0]
+		logger.Errorf("The check report of %q (%s, %d bytes of the message %q) is rejected by the API and dropped: %s",
+			r.Name, r.Status, len(r.Message), util.TruncateString(r.Message, rejectedMessageExcerpt), err)
+		pluginstats.RecordRejected("checks." + r.Name)
+		return
+	}
+	if *budget < 2 {
+		logger.Errorf("Gave up bisecting %d check reports rejected by the API: %s", len(reports), err)
+		return
+	}
+	*budget -= 2
+	mid := len(reports) / 2
+	for _, half := range [][]*checks.Report{reports[:mid], reports[mid:]} {
+		err := app.API.Retry(ctx, reportCheckRetryPolicy, "ReportCheckMonitors", func() error {
+			return app.API.ReportCheckMonitors(hostID, half)
+		})
+		switch {
+		case err == nil:
+			app.status.posted(statusKindChecks)
+			app.checkCounter.countReported(len(half))
+			app.checkReports.record(half, time.Now())
+		case mackerel.IsValidationError(err):
+			bisectCheckReports(ctx, app, hostID, half, err, budget)
+		default:
+			logger.Errorf("ReportCheckMonitors: %s", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestBisectCheckReports(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+	var reported []string
+	mockHandlers["POST /api/v0/monitoring/checks/report"] = func(req *http.Request) (int, jsonObject) {
+		var r io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gz
+		}
+		var payload struct {
+			Reports []struct{ Name string }
+		}
+		if err := json.NewDecoder(r).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		for _, report := range payload.Reports {
+			if report.Name == "bad" {
+				return http.StatusBadRequest, jsonObject{"error": jsonObject{"message": "invalid message"}}
+			}
+		}
+		for _, report := range payload.Reports {
+			reported = append(reported, report.Name)
+		}
+		return http.StatusOK, jsonObject{"success": true}
+	}
+	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{Config: &conf, API: api, Host: &mkr.Host{ID: "xyzabc12345"}, AgentMeta: &AgentMeta{}}
+
+	var reports []*checks.Report
+	for _, name := range []string{"foo", "bar", "bad", "baz", "qux"} {
+		reports = append(reports, &checks.Report{Name: name, Status: checks.StatusOK})
+	}
+	reportCheckMonitors(context.Background(), app, "", reports)
+	if len(reported) != 4 {
+		t.Errorf("the valid reports should be reported: %v", reported)
+	}
+	if s := pluginstats.All()["checks.bad"]; s.Rejected != 1 {
+		t.Errorf("the rejected report should be counted: %+v", s)
+	}
+}
@@ -0,0 +1,126 @@
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+var defaultCheckStateMaxAge = 24 * time.Hour
+
+// CheckStateMaxAge returns the maximum age of the persisted states of the
+// check reports. Zero means not to persist them.
+func CheckStateMaxAge(conf *config.Config) time.Duration {
+	if conf.CheckStateMaxAge != nil {
+		return conf.CheckStateMaxAge.Duration
+	}
+	return defaultCheckStateMaxAge
+}
+
+// checkStateFile returns the file of the states of the check reports, or ""
+// not to persist them.
+func checkStateFile(conf *config.Config) string {
+	if conf.Root == "" || CheckStateMaxAge(conf) <= 0 {
+		return ""
+	}
+	return filepath.Join(conf.Root, "checks", "state.json")
+}
+
+const checkStateVersion = 1
+
+// checkState is the content of the file of the states of the check reports,
+// keyed by the names of the checks. The messages are kept as the hashes, since
+// they may contain anything the checks print.
+type checkState struct {
+	Version   int                         `json:"version"`
+	WrittenAt time.Time                   `json:"writtenAt"`
+	Checks    map[string]*checkStateEntry `json:"checks"`
+}
+
+type checkStateEntry struct {
+	Status      checks.Status `json:"status"`
+	MessageHash string        `json:"messageHash"`
+	Count       int32         `json:"count"`
+	Failures    int32         `json:"consecutiveFailures"`
+	ReportedAt  time.Time     `json:"reportedAt"`
+}
+
+// restore loads the states of the checks in names from file written within
+// maxAge, and makes save write them to file. The corrupt or stale file is
+// discarded, so that the reports are posted as on the first start.
+func (c *checkReportCache) restore(file string, maxAge time.Duration, names map[string]bool, now time.Time) {
+	if c == nil || file == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file = file
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read the states of the checks: %s", err)
+		}
+		return
+	}
+	var st checkState
+	if err := json.Unmarshal(b, &st); err != nil || st.Version != checkStateVersion || st.Checks == nil {
+		logger.Warningf("Discarded the corrupt states of the checks in %s", file)
+		return
+	}
+	if age := now.Sub(st.WrittenAt); age > maxAge || age < 0 {
+		logger.Infof("Discarded the states of the checks written at %s, older than %s", st.WrittenAt.Format(time.RFC3339), maxAge)
+		return
+	}
+	for name, e := range st.Checks {
+		if e == nil || !names[name] {
+			continue
+		}
+		c.last[name] = &lastCheckReport{
+			status:      e.Status,
+			messageHash: e.MessageHash,
+			count:       e.Count,
+			sentAt:      e.ReportedAt,
+			failures:    e.Failures,
+		}
+	}
+	logger.Infof("Restored the states of %d checks written at %s", len(c.last), st.WrittenAt.Format(time.RFC3339))
+}
+
+// save writes the states of the checks to the file given by restore.
+func (c *checkReportCache) save(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	file := c.file
+	st := checkState{Version: checkStateVersion, WrittenAt: now, Checks: make(map[string]*checkStateEntry, len(c.last))}
+	for name, l := range c.last {
+		st.Checks[name] = &checkStateEntry{
+			Status:      l.status,
+			MessageHash: l.messageHash,
+			Count:       l.count,
+			Failures:    l.failures,
+			ReportedAt:  l.sentAt,
+		}
+	}
+	c.mu.Unlock()
+	if file == "" {
+		return
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		logger.Warningf("Failed to save the states of the checks: %s", err)
+		return
+	}
+	if err := util.WriteFileAtomically(file, append(b, '\n'), 0644); err != nil {
+		logger.Warningf("Failed to save the states of the checks: %s", err)
+	}
+}
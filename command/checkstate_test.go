@@ -0,0 +1,102 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestCheckReportCache_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-checkstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := checkStateFile(&config.Config{Root: dir})
+	names := map[string]bool{"a": true, "b": true}
+	now := time.Now()
+	reports := func() []*checks.Report {
+		return []*checks.Report{
+			{Name: "a", Status: checks.StatusCritical, Message: "secret message"},
+			{Name: "b", Status: checks.StatusOK, Message: "ok"},
+			{Name: "removed", Status: checks.StatusOK, Message: "ok"},
+		}
+	}
+
+	c := newCheckReportCache(30 * time.Minute)
+	c.restore(file, time.Hour, names, now)
+	c.record(c.filter(reports(), now), now)
+	c.record(c.filter(reports(), now.Add(time.Minute)), now.Add(time.Minute))
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret message") {
+		t.Errorf("the messages should be saved as the hashes: %s", b)
+	}
+
+	// restarted
+	c = newCheckReportCache(30 * time.Minute)
+	c.restore(file, time.Hour, names, now.Add(2*time.Minute))
+	if _, ok := c.last["removed"]; ok {
+		t.Error("the states of the removed checks should be discarded")
+	}
+	if l := c.last["a"]; l == nil || l.failures != 1 || l.count != 1 {
+		t.Errorf("the state should be restored: %+v", l)
+	}
+	if got := c.filter(reports()[:2], now.Add(2*time.Minute)); len(got) != 0 {
+		t.Errorf("the unchanged reports should not be posted after the restart: %v", got)
+	}
+	changed := reports()[:1]
+	changed[0].Status = checks.StatusWarning
+	if got := c.filter(changed, now.Add(2*time.Minute)); len(got) != 1 {
+		t.Errorf("the changed report should be posted: %v", got)
+	}
+	c.record(changed, now.Add(2*time.Minute))
+	if l := c.last["a"]; l.failures != 2 {
+		t.Errorf("the consecutive failures should be counted across the restart: %d", l.failures)
+	}
+
+	// stale
+	c = newCheckReportCache(30 * time.Minute)
+	c.restore(file, time.Hour, names, now.Add(2*time.Hour))
+	if len(c.last) != 0 {
+		t.Errorf("the stale states should be discarded: %v", c.last)
+	}
+
+	// corrupt
+	if err := ioutil.WriteFile(file, []byte(`{"version": 1, "checks": {"a": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = newCheckReportCache(30 * time.Minute)
+	c.restore(file, time.Hour, names, now)
+	if len(c.last) != 0 {
+		t.Errorf("the corrupt states should be discarded: %v", c.last)
+	}
+	if got := c.filter(reports(), now); len(got) != 3 {
+		t.Errorf("all the reports should be posted after discarding the states: %v", got)
+	}
+}
+
+func TestCheckStateFile(t *testing.T) {
+	zero := config.Duration{}
+	tests := []struct {
+		conf     *config.Config
+		expected string
+	}{
+		{&config.Config{Root: "/var/lib/mackerel-agent"}, filepath.Join("/var/lib/mackerel-agent", "checks", "state.json")},
+		{&config.Config{Root: "/var/lib/mackerel-agent", CheckStateMaxAge: &zero}, ""},
+		{&config.Config{}, ""},
+	}
+	for _, tc := range tests {
+		if got := checkStateFile(tc.conf); got != tc.expected {
+			t.Errorf("checkStateFile should be %q but got %q", tc.expected, got)
+		}
+	}
+}
@@ -3,56 +3,110 @@ package command
 import (
 	"context"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/Songmu/retry"
-	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/mackerel-agent/agent"
 	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/collector"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/exitcode"
+	"github.com/mackerelio/mackerel-agent/fluentd"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/mackerel"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/otlp"
+	"github.com/mackerelio/mackerel-agent/sdnotify"
 	"github.com/mackerelio/mackerel-agent/spec"
+	"github.com/mackerelio/mackerel-agent/spool"
 	mkr "github.com/mackerelio/mackerel-client-go"
+	"github.com/pkg/errors"
 )
 
-var logger = logging.GetLogger("command")
+var logger = logformat.GetLogger("command")
 var metricsInterval = 60 * time.Second
 
-var retryNum uint = 20
-var retryInterval = 3 * time.Second
+// The policies of retrying the API requests.
+var (
+	hostRetryPolicy = &mackerel.RetryPolicy{
+		InitialInterval: 1 * time.Second,
+		MaxInterval:     15 * time.Second,
+		MaxElapsedTime:  1 * time.Minute,
+	}
+	// The host may be registered even if CreateHost fails, so it is searched
+	// before the retries. The whole retries should end within TimeoutStartSec
+	// of systemd.
+	registerHostRetryPolicy = &mackerel.RetryPolicy{
+		InitialInterval: 2 * time.Second,
+		MaxInterval:     30 * time.Second,
+		MaxElapsedTime:  150 * time.Second,
+	}
+	customIdentifierRetryPolicy = &mackerel.RetryPolicy{
+		InitialInterval: 1 * time.Second,
+		MaxInterval:     4 * time.Second,
+		MaxElapsedTime:  6 * time.Second,
+	}
+	// The metric values are kept in the queue while retrying
+	postMetricsRetryPolicy = &mackerel.RetryPolicy{
+		InitialInterval: 30 * time.Second,
+		MaxInterval:     10 * time.Minute,
+	}
+	// The check reports are kept in the channel while retrying
+	reportCheckRetryPolicy = &mackerel.RetryPolicy{
+		InitialInterval: 10 * time.Second,
+		MaxInterval:     5 * time.Minute,
+	}
+)
 
 var (
 	postMetricsDequeueDelaySeconds = 30     // Check the metric values queue for every 30 seconds
-	postMetricsRetryDelaySeconds   = 60     // Wait for one minute before retrying metric value posts
 	postMetricsRetryMax            = 60     // Retry up to 60 times (30s * 60 = 30min)
 	postMetricsBufferSize          = 6 * 60 // Keep metric values of 6 hours in the queue
+	// postMetricsTerminatingRetryDelay is the minimum interval of retrying the
+	// failed posts in the shutdown flush, whose retry intervals are jittered.
+	postMetricsTerminatingRetryDelay = 1 * time.Second
 
-	reportCheckDelaySeconds      = 1      // Wait for a second before reporting the next check
-	reportCheckDelaySecondsMax   = 30     // Wait 30 seconds before reporting the next check when many reports in queue
-	reportCheckRetryDelaySeconds = 30     // Wait 30 seconds before retrying report the next check
-	reportCheckBufferSize        = 6 * 60 // Keep check reports of 6 hours in the queue
+	reportCheckDelaySeconds    = 1      // Wait for a second before reporting the next check
+	reportCheckDelaySecondsMax = 30     // Wait 30 seconds before reporting the next check when many reports in queue
+	reportCheckBufferSize      = 6 * 60 // Keep check reports of 6 hours in the queue
 )
 
 // AgentMeta contains meta information about mackerel-agent
 type AgentMeta struct {
 	Version  string
 	Revision string
+	// WrapperVersion is the version of the Windows service wrapper which
+	// launched the agent, or empty.
+	WrapperVersion string
 }
 
 // prepareHost collects specs of the host and sends them to Mackerel server.
 // A unique host-id is returned by the server if one is not specified.
 func prepareHost(conf *config.Config, ameta *AgentMeta, api *mackerel.API) (*mkr.Host, error) {
-	doRetry := func(f func() error) {
-		retry.Retry(retryNum, retryInterval, f)
+	return prepareHostWith(conf, ameta, api, nil)
+}
+
+// prepareHostWith prepares the host. If specs is not nil, the host already
+// registered is prepared without waiting for the expensive specs longer than
+// cloud_detection_timeout, which are cached by specs for the next update.
+// The new host waits for them, whose custom identifier finds the host
+// registered before.
+func prepareHostWith(conf *config.Config, ameta *AgentMeta, api *mackerel.API, specs *hostSpecsCache) (*mkr.Host, error) {
+	ctx := context.Background()
+	doRetry := func(name string, f func() error) {
+		api.Retry(ctx, hostRetryPolicy, name, f)
 	}
 
-	filterErrorForRetry := func(err error) error {
+	logErrorForRetry := func(err error) error {
 		if err != nil {
 			msg := err.Error()
 
@@ -63,27 +117,84 @@ func prepareHost(conf *config.Config, ameta *AgentMeta, api *mackerel.API) (*mkr
 				logger.Warningf("%s", msg)
 			}
 		}
-		if mackerel.IsClientError(err) {
-			// don't retry when client error (APIKey error etc.) occurred
-			return nil
-		}
 		return err
 	}
 
-	hostParam, lastErr := collectHostParam(conf, ameta)
+	hostID, idErr := conf.LoadHostID()
+	var hostParam *mackerel.CreateHostParam
+	var lastErr error
+	// cloudCollected is false if the custom identifier is not known yet
+	cloudCollected := true
+	// the custom identifier of the cloud platform is needed to identify the host
+	waitCloud := conf.IdentifiesByCustomIdentifier() && conf.CustomIdentifier == "" && conf.CustomIdentifierCommand == nil
+	if specs != nil && idErr == nil && !waitCloud {
+		var exp *expensiveSpecs
+		exp, cloudCollected = specs.collectWithin(conf, cloudDetectionTimeout(conf))
+		hostParam, lastErr = collectHostParamWith(conf, ameta, exp)
+	} else {
+		hostParam, lastErr = collectHostParam(conf, ameta)
+	}
 	if lastErr != nil {
 		return nil, fmt.Errorf("error while collecting host specs: %s", lastErr.Error())
 	}
 
-	var result *mkr.Host
-	if hostID, err := conf.LoadHostID(); err != nil { // create
+	var identified *mkr.Host
+	if conf.IdentifiesByCustomIdentifier() {
+		if hostParam.CustomIdentifier == "" {
+			return nil, registrationError(fmt.Errorf("host_identity is %q, but the custom identifier of this host is not given by custom_identifier, custom_identifier_command or the cloud platform", config.HostIdentityCustomIdentifier), nil)
+		}
+		api.Retry(ctx, customIdentifierRetryPolicy, "FindHostByCustomIdentifier", func() error {
+			identified, lastErr = api.FindHostByCustomIdentifier(hostParam.CustomIdentifier)
+			if _, ok := lastErr.(*mackerel.InfoError); ok {
+				// not found
+				return nil
+			}
+			return logErrorForRetry(lastErr)
+		})
+		if _, ok := lastErr.(*mackerel.InfoError); !ok && lastErr != nil {
+			return nil, registrationError(fmt.Errorf("failed to find the host of the custom identifier %q: %s", hostParam.CustomIdentifier, lastErr.Error()), lastErr)
+		}
+		if identified == nil && idErr == nil {
+			logger.Errorf("No host has the custom identifier %q, so the host %s of the host ID file is NOT used and this host is registered as a new host (The host ID file may be copied from the golden image)", hostParam.CustomIdentifier, hostID)
+			idErr = fmt.Errorf("no host has the custom identifier %q", hostParam.CustomIdentifier)
+		}
+	}
 
-		if hostParam.CustomIdentifier != "" {
-			retry.Retry(3, 2*time.Second, func() error {
+	var result *mkr.Host
+	created, adopted := false, false
+	if identified != nil { // identified by the custom identifier
+		if idErr == nil && hostID != identified.ID {
+			logger.Errorf("The host %s of the host ID file mismatches the host %s of the custom identifier %q, so this host is identified as %s (The host ID file may be copied from the golden image)", hostID, identified.ID, hostParam.CustomIdentifier, identified.ID)
+		}
+		adopted = idErr != nil || hostID != identified.ID
+		result, hostID = identified, identified.ID
+	} else if idErr != nil { // create
+		created = true
+
+		// the host of the custom identifier is already searched for if identified by it
+		if hostParam.CustomIdentifier != "" && !conf.IdentifiesByCustomIdentifier() {
+			api.Retry(ctx, customIdentifierRetryPolicy, "FindHostByCustomIdentifier", func() error {
 				result, lastErr = api.FindHostByCustomIdentifier(hostParam.CustomIdentifier)
-				return filterErrorForRetry(lastErr)
+				return logErrorForRetry(lastErr)
+			})
+			if result != nil {
+				hostID = result.ID
+			}
+		}
+
+		marker := loadRegistrationMarker(conf)
+		if result == nil && marker != nil {
+			// the last run was stopped while registering this host
+			logger.Infof("Searching for the host registered by the last run of the agent...")
+			doRetry("FindHostsByName", func() error {
+				result, lastErr = findRegisteredHost(api, marker)
+				return logErrorForRetry(lastErr)
 			})
+			if lastErr != nil {
+				return nil, registrationError(fmt.Errorf("failed to search for the host registered by the last run: %s", lastErr.Error()), lastErr)
+			}
 			if result != nil {
+				logger.Infof("Found the host %s registered by the last run", result.ID)
 				hostID = result.ID
 			}
 		}
@@ -91,50 +202,80 @@ func prepareHost(conf *config.Config, ameta *AgentMeta, api *mackerel.API) (*mkr
 		if result == nil {
 			logger.Debugf("Registering new host on mackerel...")
 
-			doRetry(func() error {
+			// the earliest start is kept for the hosts registered by the last runs
+			startedAt := time.Now().Unix()
+			if marker != nil && marker.StartedAt < startedAt {
+				startedAt = marker.StartedAt
+			}
+			marker = &registrationMarker{Name: hostParam.Name, CustomIdentifier: hostParam.CustomIdentifier, StartedAt: startedAt}
+			if err := saveRegistrationMarker(conf, marker); err != nil {
+				logger.Warningf("Failed to save %s: %s", registrationMarkerFile(conf), err)
+			}
+
+			attempt := 0
+			api.Retry(ctx, registerHostRetryPolicy, "CreateHost", func() error {
+				attempt++
+				if attempt > 1 {
+					// the failed attempt may have registered the host
+					result, lastErr = findRegisteredHost(api, marker)
+					if lastErr != nil {
+						return logErrorForRetry(lastErr)
+					}
+					if result != nil {
+						hostID = result.ID
+						return nil
+					}
+				}
 				hostID, lastErr = api.CreateHost(hostParam)
-				return filterErrorForRetry(lastErr)
+				return logErrorForRetry(lastErr)
 			})
 
 			if lastErr != nil {
-				return nil, fmt.Errorf("failed to register this host: %s", lastErr.Error())
+				return nil, registrationError(fmt.Errorf("failed to register this host: %s", lastErr.Error()), lastErr)
 			}
+		}
 
-			doRetry(func() error {
+		if result == nil {
+			doRetry("FindHost", func() error {
 				result, lastErr = api.FindHost(hostID)
-				return filterErrorForRetry(lastErr)
+				return logErrorForRetry(lastErr)
 			})
 			if lastErr != nil {
-				return nil, fmt.Errorf("failed to find this host on mackerel: %s", lastErr.Error())
+				return nil, registrationError(fmt.Errorf("failed to find this host on mackerel: %s", lastErr.Error()), lastErr)
 			}
 		}
 	} else { // check the hostID is valid or not
-		doRetry(func() error {
+		doRetry("FindHost", func() error {
 			result, lastErr = api.FindHost(hostID)
-			return filterErrorForRetry(lastErr)
+			return logErrorForRetry(lastErr)
 		})
 		if lastErr != nil {
 			if fsStorage, ok := conf.HostIDStorage.(*config.FileSystemHostIDStorage); ok {
-				return nil, fmt.Errorf("failed to find this host on mackerel (You may want to delete file \"%s\" to register this host to an another organization): %s", fsStorage.HostIDFile(), lastErr.Error())
+				return nil, registrationError(fmt.Errorf("failed to find this host on mackerel (You may want to delete file \"%s\" to register this host to an another organization): %s", fsStorage.HostIDFile(), lastErr.Error()), lastErr)
 			}
-			return nil, fmt.Errorf("failed to find this host on mackerel: %s", lastErr.Error())
+			return nil, registrationError(fmt.Errorf("failed to find this host on mackerel: %s", lastErr.Error()), lastErr)
 		}
-		if result.CustomIdentifier != "" && result.CustomIdentifier != hostParam.CustomIdentifier {
+		if cloudCollected && result.CustomIdentifier != "" && result.CustomIdentifier != hostParam.CustomIdentifier {
 			if fsStorage, ok := conf.HostIDStorage.(*config.FileSystemHostIDStorage); ok {
-				return nil, fmt.Errorf("custom identifiers mismatch: this host = \"%s\", the host whose id is \"%s\" on mackerel.io = \"%s\" (File \"%s\" may be copied from another host. Try deleting it and restarting agent)", hostParam.CustomIdentifier, hostID, result.CustomIdentifier, fsStorage.HostIDFile())
+				return nil, registrationError(fmt.Errorf("custom identifiers mismatch: this host = \"%s\", the host whose id is \"%s\" on mackerel.io = \"%s\" (File \"%s\" may be copied from another host. Try deleting it and restarting agent)", hostParam.CustomIdentifier, hostID, result.CustomIdentifier, fsStorage.HostIDFile()), nil)
+			}
+			return nil, registrationError(fmt.Errorf("custom identifiers mismatch: this host = \"%s\", the host whose id is \"%s\" on mackerel.io = \"%s\" (Host ID file may be copied from another host. Try deleting it and restarting agent)", hostParam.CustomIdentifier, hostID, result.CustomIdentifier), nil)
+		}
+		if conf.StrictHostnameChange {
+			if last := loadLastHostname(conf); last != "" && last != hostParam.Name {
+				return nil, registrationError(fmt.Errorf("the hostname has changed from \"%s\" to \"%s\" (strict_hostname_change is enabled. Delete file \"%s\" to update the host \"%s\" with the new hostname, or retire the host and delete the host ID file to register as a new host)", last, hostParam.Name, lastHostnameFile(conf), hostID), nil)
 			}
-			return nil, fmt.Errorf("custom identifiers mismatch: this host = \"%s\", the host whose id is \"%s\" on mackerel.io = \"%s\" (Host ID file may be copied from another host. Try deleting it and restarting agent)", hostParam.CustomIdentifier, hostID, result.CustomIdentifier)
 		}
 	}
 
 	hostSt := conf.HostStatus.OnStart
 	if hostSt != "" && hostSt != result.Status {
-		doRetry(func() error {
+		doRetry("UpdateHostStatus", func() error {
 			lastErr = api.UpdateHostStatus(result.ID, hostSt)
-			return filterErrorForRetry(lastErr)
+			return logErrorForRetry(lastErr)
 		})
 		if lastErr != nil {
-			return nil, fmt.Errorf("failed to set default host status: %s, %s", hostSt, lastErr.Error())
+			return nil, registrationError(fmt.Errorf("failed to set default host status: %s, %s", hostSt, lastErr.Error()), lastErr)
 		}
 	}
 
@@ -142,10 +283,27 @@ func prepareHost(conf *config.Config, ameta *AgentMeta, api *mackerel.API) (*mkr
 	if lastErr != nil {
 		return nil, fmt.Errorf("failed to save host ID: %s", lastErr.Error())
 	}
+	if created {
+		removeRegistrationMarker(conf)
+	}
+	if created || adopted {
+		if err := saveLastHostname(conf, hostParam.Name); err != nil {
+			logger.Warningf("Failed to save the hostname: %s", err)
+		}
+	}
 
 	return result, nil
 }
 
+// registrationError annotates err with the exit code of the failure to register
+// or find the host, caused by apiErr of the API if any.
+func registrationError(err, apiErr error) error {
+	if mackerel.IsAuthError(apiErr) {
+		return exitcode.WithCode(err, exitcode.AuthError)
+	}
+	return exitcode.WithCode(err, exitcode.HostRegistrationFailure)
+}
+
 // prepareCustomIdentiferHosts collects the host information based on the
 // configuration of the custom_identifier fields.
 func prepareCustomIdentiferHosts(conf *config.Config, api *mackerel.API) map[string]*mkr.Host {
@@ -169,6 +327,32 @@ func delayByHost(host *mkr.Host) int {
 	return int(s[len(s)-1]) % int(config.PostMetricsInterval.Seconds())
 }
 
+// scheduleFraction returns the fraction in [0, 1) stable for the host, which
+// spreads the updates of the host specs and the runs of the metadata plugins
+// of the hosts across their intervals. The metrics are posted by delayByHost.
+func scheduleFraction(host *mkr.Host) float64 {
+	s := sha1.Sum([]byte(host.ID))
+	return float64(binary.BigEndian.Uint64(s[:8])>>11) / (1 << 53)
+}
+
+// scheduleOffset returns the offset of the host in interval.
+func scheduleOffset(host *mkr.Host, interval time.Duration) time.Duration {
+	return time.Duration(scheduleFraction(host) * float64(interval))
+}
+
+// untilSlot returns the duration from now to the next time which is offset
+// past a multiple of interval since the Unix epoch, and at least min later.
+func untilSlot(now time.Time, interval, offset, min time.Duration) time.Duration {
+	d := (offset - time.Duration(now.UnixNano()%int64(interval))) % interval
+	if d < 0 {
+		d += interval
+	}
+	for d < min {
+		d += interval
+	}
+	return d
+}
+
 // App contains objects for running main loop of mackerel-agent
 type App struct {
 	Agent                 *agent.Agent
@@ -177,6 +361,36 @@ type App struct {
 	API                   *mackerel.API
 	CustomIdentifierHosts map[string]*mkr.Host
 	AgentMeta             *AgentMeta
+	Spool                 *spool.Spool
+
+	// customIdentifiers finds the hosts of the custom identifiers in the
+	// outputs of the plugins, which are not in CustomIdentifierHosts.
+	customIdentifiers *customIdentifierResolver
+
+	spoolReplayCh chan struct{}
+	// flushMetricsCh and flushChecksCh are signaled to post the pending ones immediately.
+	flushMetricsCh chan struct{}
+	flushChecksCh  chan struct{}
+	// checksIdleCh is signaled when the checkers loop has reported the
+	// drained check reports and waits for the next ones.
+	checksIdleCh chan struct{}
+	// resetMetadataCh is signaled to put the metadata at the next post even
+	// if they are unchanged.
+	resetMetadataCh chan struct{}
+	status          *statusRecorder
+	checkReports    *checkReportCache
+	secondary       *secondary
+	otlp            *otlp.Exporter
+	fluentd         *fluentd.Forwarder
+	hostSpecs       hostSpecsCache
+	// reportingChecks is the number of the check reports being reported.
+	reportingChecks int32
+	// checkCounter counts the executions of the checks for the self metrics.
+	checkCounter *checkCounter
+	// instance detects another agent posting as the same host.
+	instance *instanceGuard
+	// annotator posts the annotations of the starts and the stops of the agent.
+	annotator *lifecycleAnnotator
 }
 
 type postValue struct {
@@ -205,17 +419,68 @@ func loop(app *App, termCh chan struct{}) error {
 	// Periodically update host specs.
 	go updateHostSpecsLoop(ctx, app)
 
+	if app.Spool != nil {
+		app.spoolReplayCh = make(chan struct{}, 1)
+		go runSpoolLoop(ctx, app)
+	}
+
+	app.flushMetricsCh = make(chan struct{}, 1)
+	app.flushChecksCh = make(chan struct{}, 1)
+	app.checksIdleCh = make(chan struct{}, 1)
+	app.resetMetadataCh = make(chan struct{}, 1)
+
+	// Stop collecting the metrics on shutdown, while the pending ones are flushed.
+	collectCtx, stopCollecting := context.WithCancel(ctx)
+	defer stopCollecting()
 	postQueue := make(chan *postValue, postMetricsBufferSize)
-	go enqueueLoop(ctx, app, postQueue)
+	go enqueueLoop(collectCtx, app, postQueue)
+	if app.Config.HTTPPush != nil {
+		go runHTTPPushServer(ctx, app, postQueue)
+	}
+	if app.Config.Debug != nil && app.Config.Debug.Listen != "" {
+		go runDebugServer(ctx, app)
+	}
+	app.status.setRunning(true)
+	defer app.status.setRunning(false)
+	if app.Config.Health != nil {
+		go runHealthServer(ctx, app)
+	}
+	app.status.setBuffer(statusKindMetrics, func() int { return len(postQueue) })
+	if app.Config.StatusFile != "" && app.status != nil {
+		go runStatusFileLoop(ctx, app)
+	}
+
+	go runControlServer(ctx, app)
+	go app.secondary.run(ctx)
+	if app.otlp != nil {
+		go app.otlp.Run(ctx)
+	}
+	if app.fluentd != nil {
+		go app.fluentd.Run(ctx)
+	}
+	go postServiceMetricsLoop(ctx, app, serviceMetricsGenerators(app.Config))
+
+	// the host is registered and the servers are listening
+	notifySystemd(sdnotify.Ready, sdnotify.Status("running, waiting for the first post of the metrics"))
+	watchdogC, stopWatchdog := watchdogTicker()
+	defer stopWatchdog()
 
 	postDelaySeconds := delayByHost(app.Host)
+	logger.Infof("The metrics are posted at %d seconds past the minute, and the host specs are updated at %s past the hour (the metadata plugins are run at %.1f%% of their intervals) by the offsets of the host",
+		postDelaySeconds, scheduleOffset(app.Host, specsUpdateInterval).Truncate(time.Second), scheduleFraction(app.Host)*100)
 	initialDelay := postDelaySeconds / 2
 	logger.Debugf("wait %d seconds before initial posting.", initialDelay)
 	select {
 	case <-termCh:
+		notifySystemd(sdnotify.Stopping)
 		return nil
 	case <-time.After(time.Duration(initialDelay) * time.Second):
-		app.Agent.InitPluginGenerators(app.API)
+		// the graph definitions of the built-in metrics are posted separately not
+		// to fail the ones of the plugins together
+		createGraphDefs(app, metrics.SystemGraphDefs())
+		payloads := app.Agent.CollectGraphDefsOfPlugins()
+		createGraphDefs(app, payloads)
+		app.secondary.mirrorGraphDefs(payloads)
 	}
 
 	termMetricsCh := make(chan struct{})
@@ -235,6 +500,7 @@ func loop(app *App, termCh chan struct{}) error {
 	// fan-out termCh
 	go func() {
 		for range termCh {
+			notifySystemd(sdnotify.Stopping)
 			termMetricsCh <- struct{}{}
 			if termCheckerCh != nil {
 				termCheckerCh <- struct{}{}
@@ -245,8 +511,17 @@ func loop(app *App, termCh chan struct{}) error {
 		}
 	}()
 
+	// The check reports are given up on the flush deadline.
+	checkCtx, cancelChecks := context.WithCancel(ctx)
+	defer cancelChecks()
+	checkersDone := make(chan struct{})
 	if hasChecks {
-		go runCheckersLoop(ctx, app, termCheckerCh)
+		go func() {
+			runCheckersLoop(checkCtx, app, termCheckerCh)
+			close(checkersDone)
+		}()
+	} else {
+		close(checkersDone)
 	}
 
 	if hasMetadataPlugins {
@@ -254,15 +529,63 @@ func loop(app *App, termCh chan struct{}) error {
 	}
 
 	lState := loopStateFirst
+	postFailures := 0
+	// flushing is true while the pending metrics are posted by a flush.
+	flushing := false
+	flushTimeout := ShutdownFlushTimeout(app.Config)
+	var flushDeadline <-chan struct{}
+	var terminatingAt time.Time
+	startTerminating := func() {
+		lState = loopStateTerminating
+		stopCollecting()
+		deadline := make(chan struct{})
+		time.AfterFunc(flushTimeout, func() { close(deadline) })
+		flushDeadline = deadline
+		terminatingAt = time.Now()
+		logger.Infof("Flushing the pending metrics (%d posts) and check reports up to %s", len(postQueue), flushTimeout)
+	}
+	// finishTerminating waits for the check reports to be flushed.
+	finishTerminating := func() error {
+		select {
+		case <-checkersDone:
+			logger.Infof("Flushed the pending metrics and check reports in %s", time.Since(terminatingAt).Round(time.Millisecond))
+		case <-flushDeadline:
+			giveUpFlushing(app, nil, postQueue)
+			cancelChecks()
+			waitCheckersLoop(checkersDone)
+		}
+		return nil
+	}
+	// terminate starts terminating by the instruction, and returns true if the
+	// loop should return immediately.
+	terminate := func() (bool, error) {
+		if lState == loopStateTerminating {
+			return true, fmt.Errorf("received terminate instruction again. force return")
+		}
+		if flushTimeout <= 0 {
+			return true, nil
+		}
+		startTerminating()
+		return false, nil
+	}
+
 	for {
 		select {
 		case <-termMetricsCh:
-			if lState == loopStateTerminating {
-				return fmt.Errorf("received terminate instruction again. force return")
+			if stop, err := terminate(); stop {
+				return err
 			}
-			lState = loopStateTerminating
 			if len(postQueue) <= 0 {
-				return nil
+				return finishTerminating()
+			}
+		case <-flushDeadline:
+			return finishTerminating()
+		case <-watchdogC:
+			notifySystemd(sdnotify.Watchdog)
+		case <-app.flushMetricsCh:
+			// the failed metrics may be being queued again to retry
+			if postFailures > 0 {
+				flushing = true
 			}
 		case v := <-postQueue:
 			origPostValues := [](*postValue){v}
@@ -273,18 +596,25 @@ func loop(app *App, termCh chan struct{}) error {
 				origPostValues = append(origPostValues, nextValues)
 			}
 
-			delaySeconds := 0
+			var delay time.Duration
 			switch lState {
 			case loopStateFirst: // request immediately to create graph defs of host
 				// nop
 			case loopStateQueued:
-				delaySeconds = postMetricsDequeueDelaySeconds
+				delay = time.Duration(postMetricsDequeueDelaySeconds) * time.Second
 			case loopStateHadError:
-				// TODO: better interval calculation. exponential backoff or so.
-				delaySeconds = postMetricsRetryDelaySeconds
+				delay = app.API.RetryInterval(postMetricsRetryPolicy, postFailures)
+				logger.Debugf("Posting metrics failed %d times in a row.", postFailures)
 			case loopStateTerminating:
-				// dequeue and post every one second when terminating.
-				delaySeconds = 1
+				// post the pending metrics immediately when terminating, but
+				// back off after the failures not to flood the API until the
+				// flush deadline.
+				if postFailures > 0 {
+					delay = app.API.RetryInterval(postMetricsRetryPolicy, postFailures)
+					if delay < postMetricsTerminatingRetryDelay {
+						delay = postMetricsTerminatingRetryDelay
+					}
+				}
 			default:
 				// Sending data at every 0 second from all hosts causes request flooding.
 				// To prevent flooding, this loop sleeps for some seconds
@@ -292,7 +622,7 @@ func loop(app *App, termCh chan struct{}) error {
 				// The sleep second is up to 60s (to be exact up to `config.Postmetricsinterval.Seconds()`.
 				elapsedSeconds := int(time.Now().Unix() % int64(config.PostMetricsInterval.Seconds()))
 				if postDelaySeconds > elapsedSeconds {
-					delaySeconds = postDelaySeconds - elapsedSeconds
+					delay = time.Duration(postDelaySeconds-elapsedSeconds) * time.Second
 				}
 			}
 
@@ -305,30 +635,86 @@ func loop(app *App, termCh chan struct{}) error {
 				}
 			}
 
-			logger.Debugf("Sleep %d seconds before posting.", delaySeconds)
+			if flushing {
+				delay = 0
+			}
+			// the probe is done as soon as the maintenance ends by the other requests
+			var maintenanceEnded <-chan struct{}
+			if app.API.InMaintenance() {
+				maintenanceEnded = app.API.MaintenanceEnded()
+			}
+			logger.Debugf("Sleep %s before posting.", delay)
+			timer := time.NewTimer(delay)
+		Sleep:
 			select {
-			case <-time.After(time.Duration(delaySeconds) * time.Second):
+			case <-timer.C:
 				// nop
+			case <-maintenanceEnded:
+				if !waitCheckReportsFlushed(app, checkReportsFirstTimeout, termMetricsCh) {
+					if stop, err := terminate(); stop {
+						return err
+					}
+				}
+			case <-watchdogC:
+				notifySystemd(sdnotify.Watchdog)
+				goto Sleep
+			case <-app.flushMetricsCh:
+				logger.Debugf("Flushing the pending metrics.")
+				flushing = true
 			case <-termMetricsCh:
-				if lState == loopStateTerminating {
-					return fmt.Errorf("received terminate instruction again. force return")
+				if stop, err := terminate(); stop {
+					return err
 				}
-				lState = loopStateTerminating
+			case <-flushDeadline:
+				giveUpFlushing(app, origPostValues, postQueue)
+				return finishTerminating()
 			}
+			timer.Stop()
 
-			var postValues []*mkr.HostMetricValue
-			for _, v := range origPostValues {
-				postValues = append(postValues, v.values...)
+			mirrored := app.secondary.firstAttempts(origPostValues)
+			chunks := splitPostValues(origPostValues, postMetricsLimits(app.Config))
+			if len(chunks) > 1 {
+				logger.Debugf("Posting metrics in %d requests.", len(chunks))
 			}
-			err := app.API.PostHostMetricValues(postValues)
+			pending, err := postChunks(app.API, chunks)
+			// the secondary never delays posting to the primary
+			go app.secondary.mirrorMetrics(mirrored)
 			if err != nil {
-				logger.Warningf("Failed to post metrics value (will retry): %s", err.Error())
+				inMaintenance := app.API.InMaintenance()
+				if inMaintenance {
+					// the maintenance backoff is logged at its start and end
+					logger.Debugf("Failed to post metrics value under maintenance (will retry): %s", err.Error())
+				} else {
+					logger.Warningf("Failed to post metrics value (will retry): %s", err.Error())
+				}
+				app.status.postFailed(statusKindMetrics)
+				postFailures++
+				notifySystemd(sdnotify.Status(app.systemdStatus(postFailures)))
+				flushing = false
 				if lState != loopStateTerminating {
 					lState = loopStateHadError
 				}
+				if app.Spool != nil {
+					for len(pending) > 0 {
+						if spoolErr := spoolMetrics(app.Spool, pending[0].values); spoolErr != nil {
+							logger.Errorf("Failed to spool metrics value (will retry in memory): %s", spoolErr.Error())
+							break
+						}
+						pending = pending[1:]
+					}
+					if len(pending) == 0 {
+						if lState == loopStateTerminating && len(postQueue) <= 0 {
+							return finishTerminating()
+						}
+						continue
+					}
+				}
 				go func() {
-					for _, v := range origPostValues {
-						v.retryCnt++
+					for _, v := range pending {
+						// the values are not invalid because of the maintenance
+						if !inMaintenance {
+							v.retryCnt++
+						}
 						// It is difficult to distinguish the error is server error or data error.
 						// So, if retryCnt exceeded the configured limit, postValue is considered invalid and abandoned.
 						if v.retryCnt > postMetricsRetryMax {
@@ -346,22 +732,165 @@ func loop(app *App, termCh chan struct{}) error {
 				continue
 			}
 			logger.Debugf("Posting metrics succeeded.")
+			app.status.posted(statusKindMetrics)
+			postFailures = 0
+			notifySystemd(sdnotify.Status(app.systemdStatus(postFailures)))
+			if len(postQueue) <= 0 {
+				flushing = false
+			}
+			triggerSpoolReplay(app)
 
+			if lState == loopStateTerminating {
+				n := 0
+				for _, v := range origPostValues {
+					n += len(v.values)
+				}
+				// launchd and systemd kill the agent not finished in time
+				logger.Infof("Flushed %d metric values, %d posts remaining, %s left", n, len(postQueue), (flushTimeout - time.Since(terminatingAt)).Round(time.Millisecond))
+			}
 			if lState == loopStateTerminating && len(postQueue) <= 0 {
-				return nil
+				return finishTerminating()
 			}
 		}
 	}
 }
 
+// checkReportsFirstTimeout is the maximum duration for the metrics to wait
+// for the check reports to be flushed after the maintenance.
+var checkReportsFirstTimeout = 30 * time.Second
+
+// waitCheckReportsFlushed waits for the pending check reports to be reported
+// up to timeout, so that the check reports are flushed first after the
+// maintenance, which are more urgent than the metrics. It returns false if
+// termCh is received while waiting.
+func waitCheckReportsFlushed(app *App, timeout time.Duration, termCh <-chan struct{}) bool {
+	select {
+	case app.flushChecksCh <- struct{}{}:
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	// the pending reports are checked whenever the checkers loop gets idle
+	for app.status.bufferSizes()[statusKindChecks] > 0 {
+		select {
+		case <-app.checksIdleCh:
+		case <-termCh:
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+	return true
+}
+
+// ShutdownFlushTimeout returns the maximum duration to flush the pending metrics
+// and check reports on shutdown.
+func ShutdownFlushTimeout(conf *config.Config) time.Duration {
+	if conf.ShutdownFlushTimeout != nil {
+		return conf.ShutdownFlushTimeout.Duration
+	}
+	return defaultShutdownFlushTimeout
+}
+
+var (
+	defaultShutdownFlushTimeout = 10 * time.Second
+	// Wait for the check reports being spooled or abandoned after the flush deadline.
+	checkersLoopGracePeriod = 1 * time.Second
+)
+
+// giveUpFlushing stores the pending metric values in the spool if it is enabled,
+// or abandons them.
+func giveUpFlushing(app *App, pending []*postValue, postQueue chan *postValue) {
+DrainPostQueue:
+	for {
+		select {
+		case v := <-postQueue:
+			pending = append(pending, v)
+		default:
+			break DrainPostQueue
+		}
+	}
+	var values []*mkr.HostMetricValue
+	for _, v := range pending {
+		values = append(values, v.values...)
+	}
+	if len(values) == 0 {
+		return
+	}
+	if app.Spool != nil {
+		err := spoolMetrics(app.Spool, values)
+		if err == nil {
+			logger.Infof("Timed out flushing the metrics, spooled %d metric values.", len(values))
+			return
+		}
+		logger.Errorf("Failed to spool metrics value: %s", err)
+	}
+	logger.Warningf("Timed out flushing the metrics, abandoned %d metric values.", len(values))
+}
+
+func waitCheckersLoop(checkersDone <-chan struct{}) {
+	select {
+	case <-checkersDone:
+	case <-time.After(checkersLoopGracePeriod):
+		logger.Warningf("Timed out flushing the check reports.")
+	}
+}
+
+// When the addresses of the interfaces have changed, the host specs are updated
+// after they are not changed for specsUpdateDebounce, and at most once in specsUpdateMinInterval.
+// Even if they keep changing, the host specs are updated in specsUpdateMaxDelay.
+var (
+	specsUpdateDebounce    = 10 * time.Second
+	specsUpdateMinInterval = 1 * time.Minute
+	specsUpdateMaxDelay    = 5 * time.Minute
+)
+
 func updateHostSpecsLoop(ctx context.Context, app *App) {
+	addressChanged := spec.WatchAddressChanges(ctx)
+	offset := scheduleOffset(app.Host, specsUpdateInterval)
 	for {
 		app.UpdateHostSpecs()
+		app.verifyInstance(ctx)
+		updatedAt := time.Now()
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(specsUpdateInterval):
+		case <-time.After(untilSlot(updatedAt, specsUpdateInterval, offset, specsUpdateMinInterval)):
 			// nop
+		case <-addressChanged:
+			logger.Debugf("The addresses of the interfaces have changed, updating host specs...")
+			notBefore := updatedAt.Add(specsUpdateMinInterval)
+			if !waitForQuiet(ctx, addressChanged, specsUpdateDebounce, notBefore, time.Now().Add(specsUpdateMaxDelay)) {
+				return
+			}
+		}
+	}
+}
+
+// waitForQuiet waits until ch does not receive for d and notBefore has passed,
+// or deadline has passed. It returns false if ctx is done.
+func waitForQuiet(ctx context.Context, ch <-chan struct{}, d time.Duration, notBefore, deadline time.Time) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	deadlineTimer := time.NewTimer(time.Until(deadline))
+	defer deadlineTimer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadlineTimer.C:
+			return true
+		case <-ch:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(d)
+		case <-timer.C:
+			if wait := time.Until(notBefore); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			return true
 		}
 	}
 }
@@ -374,15 +903,35 @@ func enqueueLoop(ctx context.Context, app *App, postQueue chan *postValue) {
 			return
 		case result := <-metricsResult:
 			created := result.Created.Unix()
-			var creatingValues []*mkr.HostMetricValue
+			if app.Config.AdjustClockSkew {
+				if skew, ok := mackerel.ClockSkew(); ok {
+					created = result.Created.Add(skew).Unix()
+				}
+			}
+			var n int
+			for _, values := range result.Values {
+				n += len(values.Values)
+			}
+			creatingValues := newHostMetricValues(n)
+			var exports []*otlp.Metrics
+			var forwards []*fluentd.Metrics
+			// the values of the unknown hosts are dropped, not to be posted to this host
+			unresolved := make(map[string]int)
 			for _, values := range result.Values {
-				hostID := app.Host.ID
+				hostID, hostName := app.Host.ID, app.Host.Name
 				if values.CustomIdentifier != nil {
-					if host, ok := app.CustomIdentifierHosts[*values.CustomIdentifier]; ok {
-						hostID = host.ID
-					} else {
+					host := app.customIdentifierHost(*values.CustomIdentifier)
+					if host == nil {
+						unresolved[*values.CustomIdentifier] += len(values.Values)
 						continue
 					}
+					hostID, hostName = host.ID, host.Name
+				}
+				if app.otlp != nil {
+					exports = append(exports, &otlp.Metrics{HostName: hostName, HostID: hostID, Time: time.Unix(created, 0), Values: values.Values})
+				}
+				if app.fluentd != nil {
+					forwards = append(forwards, &fluentd.Metrics{HostName: hostName, HostID: hostID, Time: time.Unix(created, 0), Values: values.Values})
 				}
 				for name, value := range values.Values {
 					if math.IsNaN(value) || math.IsInf(value, 0) {
@@ -390,36 +939,100 @@ func enqueueLoop(ctx context.Context, app *App, postQueue chan *postValue) {
 						continue
 					}
 
-					creatingValues = append(
-						creatingValues,
-						&mkr.HostMetricValue{
-							HostID: hostID,
-							MetricValue: &mkr.MetricValue{
-								Name:  name,
-								Time:  created,
-								Value: value,
-							},
-						},
-					)
+					creatingValues.add(hostID, name, created, value)
 				}
 			}
+			logUnresolvedCustomIdentifiers(unresolved)
+			if app.otlp != nil {
+				app.otlp.Export(exports)
+			}
+			if app.fluentd != nil {
+				app.fluentd.Forward(forwards)
+			}
+			if app.postingStopped() {
+				logger.Debugf("The metrics are not posted since another agent is posting as this host")
+				continue
+			}
 			logger.Debugf("Enqueuing task to post metrics.")
-			postQueue <- newPostValue(creatingValues)
+			postQueue <- newPostValue(creatingValues.values)
 		}
 	}
 }
 
-func runChecker(ctx context.Context, checker *checks.Checker, checkReportCh chan *checks.Report, reportImmediateCh chan struct{}) {
+// hostMetricValues builds the metric values of a collection, which are
+// allocated at once instead of each of them.
+type hostMetricValues struct {
+	values       []*mkr.HostMetricValue
+	hostValues   []mkr.HostMetricValue
+	metricValues []mkr.MetricValue
+}
+
+// newHostMetricValues allocates n metric values. The values are nil if n is zero.
+func newHostMetricValues(n int) *hostMetricValues {
+	if n == 0 {
+		return &hostMetricValues{}
+	}
+	return &hostMetricValues{
+		values:       make([]*mkr.HostMetricValue, 0, n),
+		hostValues:   make([]mkr.HostMetricValue, 0, n),
+		metricValues: make([]mkr.MetricValue, 0, n),
+	}
+}
+
+func (b *hostMetricValues) add(hostID, name string, t int64, value float64) {
+	if len(b.hostValues) == cap(b.hostValues) {
+		// never reallocate the values, which the pointers refer to
+		b.values = append(b.values, &mkr.HostMetricValue{
+			HostID:      hostID,
+			MetricValue: &mkr.MetricValue{Name: name, Time: t, Value: value},
+		})
+		return
+	}
+	b.metricValues = append(b.metricValues, mkr.MetricValue{Name: name, Time: t, Value: value})
+	b.hostValues = append(b.hostValues, mkr.HostMetricValue{
+		HostID:      hostID,
+		MetricValue: &b.metricValues[len(b.metricValues)-1],
+	})
+	b.values = append(b.values, &b.hostValues[len(b.hostValues)-1])
+}
+
+// checksSemaphore limits the checkers executed concurrently. The nil one does
+// not limit them.
+type checksSemaphore chan struct{}
+
+func newChecksSemaphore(n int) checksSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(checksSemaphore, n)
+}
+
+func (s checksSemaphore) check(checker *checks.Checker) *checks.Report {
+	if s != nil {
+		s <- struct{}{}
+		defer func() { <-s }()
+	}
+	return checker.Check()
+}
+
+func runChecker(ctx context.Context, checker *checks.Checker, checkReportCh chan *checks.Report, reportImmediateCh chan struct{}, alerts *alertFlusher, counter *checkCounter, sem checksSemaphore) {
 	lastStatus := checks.StatusUndefined
 	lastMessage := ""
 	interval := checker.Interval()
-	nextInterval := time.Duration(0)
-	nextTime := time.Now()
+	// Delay the first check by the splay, then the checks are spread across
+	// the interval since the following checks keep the same phase.
+	nextInterval := checker.Config.Splay
+	nextTime := time.Now().Add(nextInterval)
+	counter.schedule(checker, nextTime, interval)
+
+	suppressed := false
 
 	for {
 		select {
 		case <-time.After(nextInterval):
-			report := checker.Check()
+			report := sem.check(checker)
+			counter.countExecuted()
+			until := checker.Suppress(report)
 			logger.Debugf("checker %q: report=%v", checker.Name, report)
 
 			// It is possible that `now` is much bigger than `nextTime` because of
@@ -427,22 +1040,29 @@ func runChecker(ctx context.Context, checker *checks.Checker, checkReportCh chan
 			now := time.Now()
 			nextInterval = interval - (now.Sub(nextTime) % interval)
 			nextTime = now.Add(nextInterval)
+			// Check again at the end of the suppression window to report the true status.
+			if !until.IsZero() && until.Before(nextTime) {
+				nextTime = until
+				nextInterval = until.Sub(now)
+			}
+			counter.schedule(checker, nextTime, interval)
+			resumed := suppressed && until.IsZero()
+			suppressed = !until.IsZero()
+			if suppressed && checker.Config.SuppressMode == config.SuppressModeSkip {
+				logger.Debugf("checker %q: the report is suppressed until %s", checker.Name, until)
+				continue
+			}
 
-			if checker.Config.Action != nil {
-				env := []string{fmt.Sprintf("MACKEREL_STATUS=%s", report.Status), fmt.Sprintf("MACKEREL_PREVIOUS_STATUS=%s", lastStatus)}
-				go func() {
-					logger.Debugf("Checker %q action: %q env: %+v", checker.Name, checker.Config.Action.CommandString(), env)
-					stdout, stderr, exitCode, _ := checker.Config.Action.RunWithEnv(env)
-
-					if stderr != "" {
-						logger.Warningf("Checker %q action stdout: %q stderr: %q exitCode: %d", checker.Name, stdout, stderr, exitCode)
-					} else {
-						logger.Debugf("Checker %q action stdout: %q exitCode: %d", checker.Name, stdout, exitCode)
-					}
-				}()
+			// The action is triggered only when the status has changed,
+			// except the first OK report, as same as the immediate reporting below.
+			// The suppressed reports do not trigger the action.
+			statusChanged := report.Status != lastStatus && !(report.Status == checks.StatusOK && lastStatus == checks.StatusUndefined)
+			if statusChanged && !suppressed {
+				checker.TriggerAction(lastStatus, report.Status)
+				alerts.alert(checker.Name, report.Status, now)
 			}
 
-			if report.Status == checks.StatusOK && report.Status == lastStatus && report.Message == lastMessage {
+			if report.Status == checks.StatusOK && report.Status == lastStatus && report.Message == lastMessage && !resumed {
 				// Do not report if nothing has changed
 				continue
 			}
@@ -455,8 +1075,9 @@ func runChecker(ctx context.Context, checker *checks.Checker, checkReportCh chan
 			checkReportCh <- report
 
 			// If status has changed, send it immediately
-			// but if the status was OK and it's first invocation of a check, do not
-			if report.Status != lastStatus && !(report.Status == checks.StatusOK && lastStatus == checks.StatusUndefined) {
+			// but if the status was OK and it's first invocation of a check, do not.
+			// The first report after the suppression window is also sent immediately.
+			if statusChanged || resumed {
 				logger.Debugf("checker %q: status has changed %v -> %v: send it immediately", checker.Name, lastStatus, report.Status)
 				reportImmediateCh <- struct{}{}
 			}
@@ -476,13 +1097,26 @@ func runCheckersLoop(ctx context.Context, app *App, termCheckerCh <-chan struct{
 	// Do not block checking.
 	checkReportCh := make(chan *checks.Report, reportCheckBufferSize*len(app.Agent.Checkers))
 	reportImmediateCh := make(chan struct{}, reportCheckBufferSize*len(app.Agent.Checkers))
+	// the reports being reported are counted not to be overtaken by the metrics
+	app.status.setBuffer(statusKindChecks, func() int {
+		return len(checkReportCh) + int(atomic.LoadInt32(&app.reportingChecks))
+	})
 
+	var alerts *alertFlusher
+	if app.Config.FlushMetricsOnAlert {
+		alerts = newAlertFlusher(app)
+	}
+	sem := newChecksSemaphore(agent.DefaultChecksConcurrency())
 	for _, checker := range app.Agent.Checkers {
-		go runChecker(ctx, checker, checkReportCh, reportImmediateCh)
+		go runChecker(ctx, checker, checkReportCh, reportImmediateCh, alerts, app.checkCounter, sem)
 	}
 
 	exit := false
 	for !exit {
+		select {
+		case app.checksIdleCh <- struct{}{}:
+		default:
+		}
 		select {
 		case <-time.After(1 * time.Minute):
 		case <-termCheckerCh:
@@ -490,6 +1124,8 @@ func runCheckersLoop(ctx context.Context, app *App, termCheckerCh <-chan struct{
 			exit = true
 		case <-reportImmediateCh:
 			logger.Debugf("received 'immediate' chan")
+		case <-app.flushChecksCh:
+			logger.Debugf("received 'flush' chan")
 		}
 
 		reports := []*checks.Report{}
@@ -504,6 +1140,10 @@ func runCheckersLoop(ctx context.Context, app *App, termCheckerCh <-chan struct{
 			}
 		}
 
+		if len(reports) == 0 || app.postingStopped() {
+			continue
+		}
+		reports = app.checkReports.filter(reports, time.Now())
 		if len(reports) == 0 {
 			continue
 		}
@@ -531,18 +1171,20 @@ func runCheckersLoop(ctx context.Context, app *App, termCheckerCh <-chan struct{
 			}
 			reportsByCustomIdentifier[customIdentifier] = append(reportsByCustomIdentifier[customIdentifier], report)
 			if len(reportsByCustomIdentifier[customIdentifier]) >= checkReportMaxSize {
-				reportCheckMonitors(app, customIdentifier, reportsByCustomIdentifier[customIdentifier])
+				reportCheckMonitors(ctx, app, customIdentifier, reportsByCustomIdentifier[customIdentifier])
 				delete(reportsByCustomIdentifier, customIdentifier)
-				time.Sleep(time.Duration(reportCheckDelay) * time.Second)
+				if !exit {
+					time.Sleep(time.Duration(reportCheckDelay) * time.Second)
+				}
 			}
 		}
 		for customIdentifier, partialReports := range reportsByCustomIdentifier {
-			reportCheckMonitors(app, customIdentifier, partialReports)
+			reportCheckMonitors(ctx, app, customIdentifier, partialReports)
 		}
 	}
 }
 
-func reportCheckMonitors(app *App, customIdentifier string, reports []*checks.Report) {
+func reportCheckMonitors(ctx context.Context, app *App, customIdentifier string, reports []*checks.Report) {
 	hostID := app.Host.ID
 	if customIdentifier != "" {
 		if host, ok := app.CustomIdentifierHosts[customIdentifier]; ok {
@@ -551,55 +1193,59 @@ func reportCheckMonitors(app *App, customIdentifier string, reports []*checks.Re
 			return
 		}
 	}
-	for {
+	defer app.secondary.mirrorReports(hostID, reports)
+	if app.Spool != nil {
+		reportCheckMonitorsWithSpool(ctx, app, hostID, reports)
+		return
+	}
+	atomic.AddInt32(&app.reportingChecks, int32(len(reports)))
+	defer atomic.AddInt32(&app.reportingChecks, -int32(len(reports)))
+	// retry until report succeeds or ctx is done on shutdown
+	err := app.API.Retry(ctx, reportCheckRetryPolicy, "ReportCheckMonitors", func() error {
 		err := app.API.ReportCheckMonitors(hostID, reports)
-		if err == nil {
-			break
-		}
-
-		logger.Errorf("ReportCheckMonitors: %s", err)
-
-		if mackerel.IsClientError(err) {
-			break
+		if err != nil {
+			if app.API.InMaintenance() {
+				logger.Debugf("ReportCheckMonitors under maintenance: %s", err)
+			} else {
+				logger.Errorf("ReportCheckMonitors: %s", err)
+			}
+			return err
 		}
-
-		logger.Debugf("ReportCheckMonitors: Sleep %d seconds before reporting", reportCheckRetryDelaySeconds)
-
-		// retry until report succeeds
-		time.Sleep(time.Duration(reportCheckRetryDelaySeconds) * time.Second)
+		app.status.posted(statusKindChecks)
+		app.checkCounter.countReported(len(reports))
+		app.checkReports.record(reports, time.Now())
+		return nil
+	})
+	if mackerel.IsValidationError(err) {
+		budget := maxBisectRequests
+		bisectCheckReports(ctx, app, hostID, reports, err, &budget)
 	}
 }
 
 // collectHostParam collects host specs (correspond to "name", "meta", "interfaces" and "customIdentifier" fields in API v0)
-func collectHostParam(conf *config.Config, ameta *AgentMeta) (*mkr.CreateHostParam, error) {
+func collectHostParam(conf *config.Config, ameta *AgentMeta) (*mackerel.CreateHostParam, error) {
+	return collectHostParamWith(conf, ameta, collectExpensiveSpecs(conf))
+}
+
+// collectHostParamWith collects the host specs except the expensive ones,
+// which are given by exp.
+func collectHostParamWith(conf *config.Config, ameta *AgentMeta, exp *expensiveSpecs) (*mackerel.CreateHostParam, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("failed to obtain hostname: %s", err.Error())
 	}
 
-	specGens := specGenerators()
-	cGen := spec.SuggestCloudGenerator(conf)
-	if cGen != nil {
-		specGens = append(specGens, cGen)
-	}
-	meta := spec.Collect(specGens)
-
-	var customIdentifier string
-	if cGen != nil {
-		customIdentifier, err = cGen.SuggestCustomIdentifier()
-		if err != nil {
-			logger.Warningf("Error while suggesting custom identifier. err: %s", err.Error())
-		}
-	}
+	meta := spec.Collect(append(collector.SystemSpecGenerators(), spec.NewKubernetesGenerator(conf.Kubernetes)))
+	meta.Filesystem = exp.filesystem
+	meta.Cloud = exp.cloud
 
-	interfaces, err := interfaceGenerator().Generate()
+	interfaces, err := collector.InterfaceSpecGenerator().Generate()
 	if err != nil {
 		return nil, fmt.Errorf("failed to collect interfaces: %s", err.Error())
 	}
+	interfaces = spec.FilterInterfaces(interfaces, conf.Interfaces)
 
-	meta.AgentVersion = ameta.Version
-	meta.AgentRevision = ameta.Revision
-	meta.AgentName = buildUA(ameta.Version, ameta.Revision)
+	setAgentMeta(&meta, conf, ameta)
 
 	checks := make([]mkr.CheckConfig, 0, len(conf.CheckPlugins))
 	for name, checkPlugin := range conf.CheckPlugins {
@@ -614,8 +1260,21 @@ func collectHostParam(conf *config.Config, ameta *AgentMeta) (*mkr.CreateHostPar
 			})
 	}
 
-	return &mkr.CreateHostParam{
-		Name:             hostname,
+	customIdentifier := exp.customIdentifier
+	if conf.IdentifiesByCustomIdentifier() {
+		// the given custom identifier is preferred to the one of the cloud platform
+		id, err := conf.HostCustomIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			customIdentifier = id
+		}
+	}
+	customIdentifier = conf.InstanceCustomIdentifier(customIdentifier)
+
+	return &mackerel.CreateHostParam{
+		Name:             conf.InstanceName(hostname),
 		Meta:             meta,
 		Interfaces:       interfaces,
 		RoleFullnames:    conf.Roles,
@@ -626,25 +1285,125 @@ func collectHostParam(conf *config.Config, ameta *AgentMeta) (*mkr.CreateHostPar
 }
 
 // UpdateHostSpecs updates the host information that is already registered on Mackerel.
+// The expensive specs are reused until HostSpecsExpensiveInterval passes, and
+// the host is not updated if the specs are unchanged since the last update.
 func (app *App) UpdateHostSpecs() {
+	app.updateHostSpecs(false)
+}
+
+// RefreshHostSpecs collects all the host specs and updates the host even if
+// they are unchanged.
+func (app *App) RefreshHostSpecs() {
+	app.updateHostSpecs(true)
+}
+
+func (app *App) updateHostSpecs(force bool) {
+	app.hostSpecs.mu.Lock()
+	defer app.hostSpecs.mu.Unlock()
+	if app.postingStopped() {
+		logger.Debugf("The host specs are not updated since another agent is posting as this host")
+		return
+	}
 	logger.Debugf("Updating host specs...")
 
-	hostParam, err := collectHostParam(app.Config, app.AgentMeta)
+	hostParam, err := collectHostParamWith(app.Config, app.AgentMeta, app.hostSpecs.expensive(app.Config, force, time.Now()))
 	if err != nil {
 		logger.Errorf("While collecting host specs: %s", err)
 		return
 	}
 
-	_, err = app.API.UpdateHost(app.Host.ID, (*mkr.UpdateHostParam)(hostParam))
+	last := loadLastHostname(app.Config)
+	if last != "" && last != hostParam.Name {
+		if app.Config.StrictHostnameChange {
+			logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Errorf("The hostname has changed from %q to %q, but the host %s is updated with the old hostname since strict_hostname_change is enabled. The agent will refuse to start next time.", last, hostParam.Name, app.Host.ID)
+			hostParam.Name = last
+		} else {
+			logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Warningf("The hostname has changed from %q to %q. Updating the host %s with the new hostname.", last, hostParam.Name, app.Host.ID)
+		}
+	}
+
+	// the custom identifier is checked here if it was not known at startup
+	if app.Host.CustomIdentifier != "" && hostParam.CustomIdentifier != "" && app.Host.CustomIdentifier != hostParam.CustomIdentifier {
+		logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Errorf("Custom identifiers mismatch: this host = %q, the host %s on mackerel.io = %q. The host specs are not updated (Host ID file may be copied from another host. Try deleting it and restarting agent)", hostParam.CustomIdentifier, app.Host.ID, app.Host.CustomIdentifier)
+		return
+	}
+	hash := hashHostParam(hostParam)
+	if !force && hash != "" && hash == app.hostSpecs.postedHash {
+		logger.Debugf("The host specs are unchanged. Skipping the update")
+		return
+	}
+	_, err = app.API.UpdateHost(app.Host.ID, (*mackerel.UpdateHostParam)(hostParam))
 	if err != nil {
 		logger.Errorf("Error while updating host specs: %s", err)
-	} else {
-		logger.Debugf("Host specs sent.")
+		return
+	}
+	logger.Debugf("Host specs sent.")
+	app.hostSpecs.postedHash = hash
+	app.status.posted(statusKindHostSpecs)
+	if hostParam.Name != last {
+		if err := saveLastHostname(app.Config, hostParam.Name); err != nil {
+			logger.Warningf("Failed to save the hostname: %s", err)
+		}
 	}
 }
 
 func buildUA(ver, rev string) string {
-	return fmt.Sprintf("mackerel-agent/%s (Revision %s)", ver, rev)
+	return fmt.Sprintf("%s/%s (Revision %s)", config.AgentName(), ver, rev)
+}
+
+// setAgentMeta sets the fields of the host meta identifying the agent.
+func setAgentMeta(meta *spec.HostMeta, conf *config.Config, ameta *AgentMeta) {
+	meta.AgentVersion = ameta.Version
+	meta.AgentRevision = ameta.Revision
+	meta.AgentName = buildUA(ameta.Version, ameta.Revision)
+	meta.AgentCustomizations = strings.Join(AgentCustomizations(conf), ",")
+	meta.AgentWrapperVersion = ameta.WrapperVersion
+}
+
+// AgentIdentity returns the fields of the host meta identifying the agent as
+// "<key>: <value>", exactly as they are posted.
+func AgentIdentity(conf *config.Config, ameta *AgentMeta) []string {
+	var meta spec.HostMeta
+	setAgentMeta(&meta, conf, ameta)
+	fields := []string{
+		"agent-name: " + meta.AgentName,
+		"agent-version: " + meta.AgentVersion,
+		"agent-revision: " + meta.AgentRevision,
+	}
+	if meta.AgentCustomizations != "" {
+		fields = append(fields, "agent-customizations: "+meta.AgentCustomizations)
+	}
+	if meta.AgentWrapperVersion != "" {
+		fields = append(fields, "agent-wrapper-version: "+meta.AgentWrapperVersion)
+	}
+	return fields
+}
+
+// AgentCustomizations returns the optional features enabled by the
+// configuration, such as "statsd" and "otlp".
+func AgentCustomizations(conf *config.Config) []string {
+	var features []string
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"secondary", conf.Secondary != nil},
+		{"statsd", conf.Statsd != nil},
+		{"ipmi", conf.IPMI != nil},
+		{"otlp", conf.OTLP != nil},
+		{"fluentd", conf.Fluentd != nil},
+		{"http_push", conf.HTTPPush != nil},
+		{"prometheus", len(conf.PrometheusPlugins) > 0},
+		{"snmp", len(conf.SNMPPlugins) > 0},
+		{"windows_perfcounter", len(conf.WindowsPerfCounterPlugins) > 0},
+		{"health", conf.Health != nil},
+		{"debug", conf.Debug != nil},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
 }
 
 // NewMackerelClient returns Mackerel API client for mackerel-agent
@@ -660,27 +1419,161 @@ func NewMackerelClient(apibase, apikey, ver, rev string, verbose bool) (*mackere
 	return api, nil
 }
 
+// SetHTTPHeaders appends user_agent_suffix to the User-Agent of api, and adds
+// http_headers to its requests.
+func SetHTTPHeaders(api *mackerel.API, conf *config.Config) {
+	if conf.UserAgentSuffix != "" {
+		api.UserAgent += " " + conf.UserAgentSuffix
+	}
+	if api.AdditionalHeaders == nil {
+		api.AdditionalHeaders = make(http.Header)
+	}
+	for name, value := range conf.HTTPHeaders {
+		api.AdditionalHeaders.Set(name, value)
+	}
+}
+
 // Prepare sets up API and registers the host data to the Mackerel server.
 // Use returned values to call Run().
 func Prepare(conf *config.Config, ameta *AgentMeta) (*App, error) {
-	api, err := NewMackerelClient(conf.Apibase, conf.Apikey, ameta.Version, ameta.Revision, conf.Verbose)
+	logProxy(conf)
+	api, err := prepareAPI(conf, conf.Apibase, conf.Apikey, ameta)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare an api: %s", err.Error())
+		return nil, err
 	}
 
-	host, err := prepareHost(conf, ameta, api)
+	// the expensive specs given up at startup are cached by the app
+	app := &App{Config: conf, API: api, AgentMeta: ameta}
+	app.Host, err = prepareHostWith(conf, ameta, api, &app.hostSpecs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare host: %s", err.Error())
+		return nil, errors.Wrap(err, "failed to prepare host")
 	}
 
-	return &App{
-		Agent:                 NewAgent(conf),
-		Config:                conf,
-		Host:                  host,
-		API:                   api,
-		CustomIdentifierHosts: prepareCustomIdentiferHosts(conf, api),
-		AgentMeta:             ameta,
-	}, nil
+	sp, err := newSpool(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare the spool: %s", err.Error())
+	}
+
+	// the detection is opt-in, which writes the host metadata
+	if conf.DuplicateInstance == config.DuplicateInstanceWarn || conf.DuplicateInstance == config.DuplicateInstanceStop {
+		app.instance, err = newInstanceGuard(time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate the token of the instance: %s", err.Error())
+		}
+	}
+
+	status := newStatusRecorder()
+	ag := NewAgent(conf)
+	if !conf.DisableSelfMetrics {
+		self := &metrics.SelfGenerator{Buffers: status.bufferSizes, PluginDurations: conf.PluginDurationMetrics}
+		if app.instance != nil {
+			self.InstanceConflict = app.instance.conflicted
+		}
+		self.LoopHeartbeats = ag.Heartbeats
+		if len(ag.Checkers) > 0 {
+			app.checkCounter = newCheckCounter(time.Now())
+			self.CheckCounts = func() (int, int, int) {
+				return app.checkCounter.take(time.Now())
+			}
+		}
+		ag.PluginGenerators = append(ag.PluginGenerators, self)
+	}
+	// The statsd listener is not included in NewAgent, not to listen on once.
+	if conf.Statsd != nil {
+		ag.PluginGenerators = append(ag.PluginGenerators, metrics.NewStatsdGenerator(conf.Statsd))
+	}
+
+	app.Agent = ag
+	app.CustomIdentifierHosts = prepareCustomIdentiferHosts(conf, api)
+	app.customIdentifiers = newCustomIdentifierResolver(api.FindHostByCustomIdentifier)
+	app.Spool = sp
+	app.status = status
+	app.checkReports = newCheckReportCache(CheckReportResendInterval(conf))
+	checkNames := make(map[string]bool, len(conf.CheckPlugins))
+	for name := range conf.CheckPlugins {
+		checkNames[name] = true
+	}
+	app.checkReports.restore(checkStateFile(conf), CheckStateMaxAge(conf), checkNames, time.Now())
+	if conf.Secondary != nil {
+		app.secondary, err = newSecondary(app)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.OTLP != nil {
+		app.otlp, err = otlp.NewExporter(conf.OTLP, ameta.Version, ConfigDialContext(conf))
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare the otlp exporter: %s", err.Error())
+		}
+	}
+	if conf.Fluentd != nil {
+		app.fluentd = fluentd.NewForwarder(conf.Fluentd)
+	}
+	if conf.LifecycleAnnotation != nil {
+		app.annotator = newLifecycleAnnotator(conf, api, ameta)
+	}
+	return app, nil
+}
+
+// logProxy logs the proxy of the apibase, which may be resolved by the system
+// settings.
+func logProxy(conf *config.Config) {
+	req, err := http.NewRequest("GET", conf.Apibase, nil)
+	if err != nil {
+		return
+	}
+	proxy, err := ConfigProxy(conf)(req)
+	switch {
+	case err != nil:
+		logger.Warningf("the proxy of %s is invalid: %s", conf.Apibase, err)
+	case proxy != nil:
+		logger.Infof("connecting to %s via the proxy %s://%s", conf.Apibase, proxy.Scheme, proxy.Host)
+	case conf.Proxy == config.ProxySystem:
+		logger.Infof("connecting to %s directly by the system proxy settings", conf.Apibase)
+	}
+}
+
+// prepareAPI creates the client of apibase with the options of the requests.
+func prepareAPI(conf *config.Config, apibase, apikey string, ameta *AgentMeta) (*mackerel.API, error) {
+	api, err := NewMackerelClient(apibase, apikey, ameta.Version, ameta.Revision, conf.Verbose)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare an api: %s", err.Error())
+	}
+	SetHTTPHeaders(api, conf)
+	if !conf.DisableCompression {
+		threshold := mackerel.DefaultCompressionThreshold
+		if conf.CompressionThreshold != nil {
+			threshold = *conf.CompressionThreshold
+		}
+		api.EnableCompression(threshold)
+	}
+	if conf.RateLimit > 0 {
+		burst := mackerel.DefaultRateLimitBurst
+		if conf.RateLimitBurst != nil {
+			burst = *conf.RateLimitBurst
+		}
+		api.EnableRateLimit(conf.RateLimit, burst)
+	}
+	if conf.Debug != nil && conf.Debug.HTTPTrace {
+		api.EnableHTTPTrace(conf.Debug.HTTPTraceBodySize)
+	}
+	if t := conf.APITimeouts; t != nil {
+		// zero means the default
+		duration := func(d *config.Duration) time.Duration {
+			if d == nil {
+				return 0
+			}
+			return d.Duration
+		}
+		api.SetRequestTimeouts(mackerel.RequestTimeouts{
+			Checks:    duration(t.Checks),
+			Metrics:   duration(t.Metrics),
+			Metadata:  duration(t.Metadata),
+			HostSpecs: duration(t.HostSpecs),
+			Others:    duration(t.Others),
+		})
+	}
+	return api, nil
 }
 
 // RunOnce collects specs and metrics, then output them to stdout.
@@ -702,7 +1595,7 @@ func RunOnce(conf *config.Config, ameta *AgentMeta) error {
 	return nil
 }
 
-func runOncePayload(conf *config.Config, ameta *AgentMeta) ([]*mkr.GraphDefsParam, *mkr.CreateHostParam, *agent.MetricsResult, error) {
+func runOncePayload(conf *config.Config, ameta *AgentMeta) ([]*mkr.GraphDefsParam, *mackerel.CreateHostParam, *agent.MetricsResult, error) {
 	hostParam, err := collectHostParam(conf, ameta)
 	if err != nil {
 		logger.Errorf("While collecting host specs: %s", err)
@@ -722,19 +1615,37 @@ func runOncePayload(conf *config.Config, ameta *AgentMeta) ([]*mkr.GraphDefsPara
 
 // NewAgent creates a new instance of agent.Agent from its configuration conf.
 func NewAgent(conf *config.Config) *agent.Agent {
+	checkers := createCheckers(conf)
 	return &agent.Agent{
-		MetricsGenerators:  prepareGenerators(conf),
-		PluginGenerators:   pluginGenerators(conf),
-		Checkers:           createCheckers(conf),
-		MetadataGenerators: metadataGenerators(conf),
+		MetricsGenerators:   prepareGenerators(conf),
+		PluginGenerators:    append(pluginGenerators(conf), perfdataGenerators(checkers)...),
+		Checkers:            checkers,
+		MetadataGenerators:  metadataGenerators(conf),
+		MetricsConcurrency:  conf.MetricsConcurrency,
+		MetricNameCollision: conf.MetricNameCollision,
 	}
 }
 
 // Run starts the main metric collecting logic and this function will never return.
 func Run(app *App, termCh chan struct{}) error {
-	logger.Infof("Start: apibase = %s, hostName = %s, hostID = %s", app.Config.Apibase, app.Host.Name, app.Host.ID)
+	logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Infof("Start: apibase = %s, hostName = %s, hostID = %s", app.Config.Apibase, app.Host.Name, app.Host.ID)
 
+	app.annotateLifecycle(startEvent())
 	err := loop(app, termCh)
+	app.Agent.Close()
+	if err == nil {
+		select {
+		case <-app.annotateLifecycle(lifecycleStop):
+		case <-time.After(lifecycleStopTimeout):
+			logger.Warningf("Timed out to post the annotation of the agent stopped")
+		}
+	}
+	if err == nil && shouldAutoRetire(app.Config) {
+		if e := autoRetire(app); e != nil {
+			logger.Errorf("Failed to retire the host at exit: %s", e)
+		}
+		return nil
+	}
 	if err == nil && app.Config.HostStatus.OnStop != "" {
 		// TODO error handling. support retire(?)
 		e := app.API.UpdateHostStatus(app.Host.ID, app.Config.HostStatus.OnStop)
@@ -750,8 +1661,9 @@ func createCheckers(conf *config.Config) []*checks.Checker {
 
 	for name, pluginConfig := range conf.CheckPlugins {
 		checker := &checks.Checker{
-			Name:   name,
-			Config: pluginConfig,
+			Name:     name,
+			Config:   pluginConfig,
+			StateDir: conf.Root,
 		}
 		logger.Debugf("Checker created: %v", checker)
 		checkers = append(checkers, checker)
@@ -761,13 +1673,82 @@ func createCheckers(conf *config.Config) []*checks.Checker {
 }
 
 func prepareGenerators(conf *config.Config) []metrics.Generator {
-	return metricsGenerators(conf)
+	return collector.SystemMetricGenerators(collectorOptions(conf))
+}
+
+// collectorOptions are the options of the system metric generators by conf.
+func collectorOptions(conf *config.Config) collector.Options {
+	opts := collector.Options{
+		Interval:          metricsInterval,
+		CounterWrap:       conf.CounterWrap,
+		IgnoreFilesystems: conf.Filesystems.Ignore.Regexp,
+		UseMountpoint:     conf.Filesystems.UseMountpoint,
+		WindowsCPUBackend: conf.WindowsCPUBackend,
+	}
+	if pconf := windowsServicesMetadata(conf); pconf != nil {
+		opts.WindowsServices = &collector.WindowsServices{Include: pconf.IncludePattern, Exclude: pconf.ExcludePattern}
+	}
+	return opts
+}
+
+// windowsServicesMetadata returns the first metadata plugin of type
+// windows_services by the names, whose patterns the metric follows.
+func windowsServicesMetadata(conf *config.Config) *config.MetadataPlugin {
+	var names []string
+	for name, pconf := range conf.MetadataPlugins {
+		if pconf.Type == config.MetadataTypeWindowsServices {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return conf.MetadataPlugins[names[0]]
 }
 
 func pluginGenerators(conf *config.Config) []metrics.PluginGenerator {
 	generators := []metrics.PluginGenerator{}
-	for _, pluginConfig := range conf.MetricPlugins {
-		generators = append(generators, metrics.NewPluginGenerator(pluginConfig))
+	// in order of the names, by which the collisions of the metric names are resolved
+	names := make([]string, 0, len(conf.MetricPlugins))
+	for name := range conf.MetricPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pluginConfig := conf.MetricPlugins[name]
+		// the service metrics are posted by postServiceMetricsLoop
+		if pluginConfig.Service == "" {
+			generators = append(generators, metrics.NewPluginGenerator(pluginConfig, conf.Root))
+		}
+	}
+	names = names[:0]
+	for name := range conf.PrometheusPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		generators = append(generators, metrics.NewPrometheusGenerator(conf.PrometheusPlugins[name]))
+	}
+	names = names[:0]
+	for name := range conf.SNMPPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snmpConfig := conf.SNMPPlugins[name]
+		// the service metrics are posted by postServiceMetricsLoop
+		if snmpConfig.Service == "" {
+			generators = append(generators, metrics.NewSNMPGenerator(snmpConfig))
+		}
+	}
+	generators = append(generators, perfCounterGenerators(conf)...)
+	if conf.IPMI != nil {
+		var sdrCache string
+		if conf.Root != "" {
+			sdrCache = filepath.Join(conf.Root, "ipmi.sdr")
+		}
+		generators = append(generators, metrics.NewIPMIGenerator(conf.IPMI, sdrCache))
 	}
 
 	if conf.Diagnostic {
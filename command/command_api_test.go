@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
 )
 
 func TestAPIRequestHeader(t *testing.T) {
@@ -39,3 +41,32 @@ func TestAPIRequestHeader(t *testing.T) {
 	}
 	api.FindHost("dummy-id")
 }
+
+func TestAPIRequestHeader_HTTPHeaders(t *testing.T) {
+	ver := "1.0.0"
+	rev := "1234beaf"
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if h, ua := req.Header.Get("User-Agent"), buildUA(ver, rev)+" deploy/blue"; h != ua {
+			t.Errorf("User-Agent shoud be '%s' but %s", ua, h)
+		}
+		if h := req.Header.Get("X-Team"); h != "infra" {
+			t.Errorf("X-Team shoud be infra but %s", h)
+		}
+		if h := req.Header.Get("X-Agent-Version"); h != ver {
+			t.Errorf("X-Agent-Version shoud be %s but %s", ver, h)
+		}
+	}))
+	defer ts.Close()
+
+	conf := &config.Config{
+		Apibase:         ts.URL,
+		Apikey:          "dummy-apikey",
+		UserAgentSuffix: "deploy/blue",
+		HTTPHeaders:     map[string]string{"X-Team": "infra"},
+	}
+	api, err := prepareAPI(conf, conf.Apibase, conf.Apikey, &AgentMeta{Version: ver, Revision: rev})
+	if err != nil {
+		t.Fatalf("something went wrong while creating new mackerel client: %+v", err)
+	}
+	api.FindHost("dummy-id")
+}
@@ -1,23 +1,28 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/mackerel-agent/agent"
 	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/mackerel"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/spec"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -45,13 +50,57 @@ func TestDelayByHost(t *testing.T) {
 	}
 }
 
+func TestScheduleOffset(t *testing.T) {
+	host1 := &mkr.Host{ID: "246PUVUngPo"}
+	host2 := &mkr.Host{ID: "21GZjCE5Etb"}
+	interval := time.Hour
+
+	offset1 := scheduleOffset(host1, interval)
+	if !(0 <= offset1 && offset1 < interval) {
+		t.Errorf("offset should be between 0 and %s but %s", interval, offset1)
+	}
+	if offset := scheduleOffset(&mkr.Host{ID: "246PUVUngPo", Name: "renamed"}, interval); offset != offset1 {
+		t.Errorf("offset should be stable by the host ID but %s and %s", offset1, offset)
+	}
+	if scheduleOffset(host2, interval) == offset1 {
+		t.Error("offsets should be different")
+	}
+}
+
+func TestUntilSlot(t *testing.T) {
+	base := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now    time.Time
+		offset time.Duration
+		min    time.Duration
+		expect time.Duration
+	}{
+		{base, 15 * time.Minute, 0, 15 * time.Minute},
+		{base.Add(10 * time.Minute), 15 * time.Minute, 0, 5 * time.Minute},
+		{base.Add(20 * time.Minute), 15 * time.Minute, 0, 55 * time.Minute},
+		{base.Add(15 * time.Minute), 15 * time.Minute, 0, 0},
+		{base.Add(14 * time.Minute), 15 * time.Minute, time.Minute, time.Minute},
+		{base.Add(14*time.Minute + 30*time.Second), 15 * time.Minute, time.Minute, 60*time.Minute + 30*time.Second},
+	}
+	for _, tc := range tests {
+		if d := untilSlot(tc.now, time.Hour, tc.offset, tc.min); d != tc.expect {
+			t.Errorf("untilSlot(%s, %s, min %s) should be %s but %s", tc.now.Format("15:04:05"), tc.offset, tc.min, tc.expect, d)
+		}
+	}
+}
+
 type jsonObject map[string]interface{}
 
 // newMockAPIServer makes a dummy root directry, a mock API server, a conf.Config to using them
 // and returns the Config, mock handlers map, the server and cleanup function which should be called finally.
 // The mock handlers map is "<method> <path>"-to-jsonObject-generator map.
 func newMockAPIServer(t *testing.T) (config.Config, map[string]func(*http.Request) (int, jsonObject), *httptest.Server, func()) {
-	mockHandlers := map[string]func(*http.Request) (int, jsonObject){}
+	mockHandlers := map[string]func(*http.Request) (int, jsonObject){
+		// the graph definitions of the built-in metrics are posted by every loop
+		"POST /api/v0/graph-defs/create": func(req *http.Request) (int, jsonObject) {
+			return 200, jsonObject{"success": true}
+		},
+	}
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		key := req.Method + " " + req.URL.Path
@@ -139,10 +188,10 @@ func TestPrepareWithCreateWithFail(t *testing.T) {
 		}
 	}
 
-	origRetryNum := retryNum
-	retryNum = 1
+	origPolicy := hostRetryPolicy
+	hostRetryPolicy = &mackerel.RetryPolicy{MaxElapsedTime: 1 * time.Millisecond}
 	defer func() {
-		retryNum = origRetryNum
+		hostRetryPolicy = origPolicy
 	}()
 
 	_, err := Prepare(&conf, &AgentMeta{})
@@ -152,6 +201,156 @@ func TestPrepareWithCreateWithFail(t *testing.T) {
 	}
 }
 
+func TestPrepareWithCreate_registeredByLastRun(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	hostname, _ := os.Hostname()
+	startedAt := time.Now().Add(-time.Hour).Unix()
+	saveRegistrationMarker(&conf, &registrationMarker{Name: hostname, StartedAt: startedAt})
+
+	mockHandlers["GET /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+		if name := req.URL.Query().Get("name"); name != hostname {
+			t.Errorf("the hosts should be searched by the hostname: %s", name)
+		}
+		return 200, jsonObject{
+			"hosts": []mkr.Host{
+				// registered before the last run
+				{ID: "xxxOLD", Name: hostname, Status: "working", CreatedAt: int32(startedAt - 3600)},
+				// duplicate hosts registered by the retries of the last run
+				{ID: "xxxDUP", Name: hostname, Status: "working", CreatedAt: int32(startedAt + 60)},
+				{ID: "xxxREG", Name: hostname, Status: "working", CreatedAt: int32(startedAt + 10)},
+				// another host of the same hostname
+				{ID: "xxxANOTHER", Name: hostname, Status: "working", CustomIdentifier: "i-another", CreatedAt: int32(startedAt + 5)},
+			},
+		}
+	}
+	mockHandlers["POST /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+		t.Error("the host should not be registered again")
+		return 200, jsonObject{"id": "xxxNEW"}
+	}
+
+	c, err := Prepare(&conf, &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host.ID != "xxxREG" {
+		t.Errorf("the oldest host registered by the last run should be used: %s", c.Host.ID)
+	}
+	if id, _ := conf.LoadHostID(); id != "xxxREG" {
+		t.Errorf("the host ID should be saved: %s", id)
+	}
+	if loadRegistrationMarker(&conf) != nil {
+		t.Errorf("the registration marker should be removed")
+	}
+}
+
+func TestPrepareWithCreate_retryRegisteredHost(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	origPolicy := registerHostRetryPolicy
+	registerHostRetryPolicy = &mackerel.RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond}
+	defer func() {
+		registerHostRetryPolicy = origPolicy
+	}()
+
+	hostname, _ := os.Hostname()
+	var registered []mkr.Host
+	mockHandlers["POST /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+		if loadRegistrationMarker(&conf) == nil {
+			t.Error("the registration marker should be saved before the registration")
+		}
+		if len(registered) > 0 {
+			t.Error("the host should not be registered again")
+		}
+		// registered, but the response is lost
+		registered = append(registered, mkr.Host{ID: "xxxREG", Name: hostname, Status: "working", CreatedAt: int32(time.Now().Unix())})
+		return 504, jsonObject{"error": jsonObject{"message": "Gateway Timeout"}}
+	}
+	mockHandlers["GET /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{"hosts": registered}
+	}
+
+	c, err := Prepare(&conf, &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host.ID != "xxxREG" {
+		t.Errorf("the registered host should be used: %s", c.Host.ID)
+	}
+	if loadRegistrationMarker(&conf) != nil {
+		t.Errorf("the registration marker should be removed")
+	}
+}
+
+func TestPrepareWithHostIdentity(t *testing.T) {
+	t.Run("adopt", func(t *testing.T) {
+		conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+		defer deferFunc()
+		conf.HostIdentity = config.HostIdentityCustomIdentifier
+		conf.CustomIdentifier = "golden-001"
+		// copied from the golden image
+		conf.SaveHostID("xxxTEMPLATE")
+
+		mockHandlers["GET /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+			if id := req.URL.Query().Get("customIdentifier"); id != "golden-001" {
+				t.Errorf("the host should be searched for by the custom identifier: %s", id)
+			}
+			return 200, jsonObject{
+				"hosts": []mkr.Host{{ID: "xxxCLONE", Name: "clone.example.com", Status: "working", CustomIdentifier: "golden-001"}},
+			}
+		}
+
+		c, err := Prepare(&conf, &AgentMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Host.ID != "xxxCLONE" {
+			t.Errorf("the host of the custom identifier should be used: %s", c.Host.ID)
+		}
+		if id, _ := conf.LoadHostID(); id != "xxxCLONE" {
+			t.Errorf("the host ID file should be rewritten: %s", id)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+		defer deferFunc()
+		conf.HostIdentity = config.HostIdentityCustomIdentifier
+		conf.CustomIdentifier = "golden-002"
+		conf.SaveHostID("xxxTEMPLATE")
+
+		mockHandlers["GET /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+			return 200, jsonObject{"hosts": []mkr.Host{}}
+		}
+		mockHandlers["POST /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+			var param mackerel.CreateHostParam
+			json.NewDecoder(req.Body).Decode(&param)
+			if param.CustomIdentifier != "golden-002" {
+				t.Errorf("the host should be registered with the custom identifier: %q", param.CustomIdentifier)
+			}
+			return 200, jsonObject{"id": "xxxNEW"}
+		}
+		mockHandlers["GET /api/v0/hosts/xxxNEW"] = func(req *http.Request) (int, jsonObject) {
+			return 200, jsonObject{
+				"host": mkr.Host{ID: "xxxNEW", Name: "clone.example.com", Status: "working", CustomIdentifier: "golden-002"},
+			}
+		}
+
+		c, err := Prepare(&conf, &AgentMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Host.ID != "xxxNEW" {
+			t.Errorf("the new host should be registered: %s", c.Host.ID)
+		}
+		if id, _ := conf.LoadHostID(); id != "xxxNEW" {
+			t.Errorf("the host ID file should be rewritten: %s", id)
+		}
+	})
+}
+
 func TestPrepareWithUpdate(t *testing.T) {
 	conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
 	defer deferFunc()
@@ -193,6 +392,164 @@ func TestPrepareWithUpdate(t *testing.T) {
 	}
 }
 
+func TestPrepareWithSlowCloudDetection(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+	conf.SaveHostID("xxx12345678901")
+	conf.CloudDetectionTimeout = &config.Duration{Duration: 10 * time.Millisecond}
+
+	mockHandlers["GET /api/v0/hosts/xxx12345678901"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{
+			"host": mkr.Host{ID: "xxx12345678901", Name: "host.example.com", CustomIdentifier: "i-0123456789"},
+		}
+	}
+	var sent mackerel.UpdateHostParam
+	mockHandlers["PUT /api/v0/hosts/xxx12345678901"] = func(req *http.Request) (int, jsonObject) {
+		json.NewDecoder(req.Body).Decode(&sent)
+		return 200, jsonObject{"id": "xxx12345678901"}
+	}
+	detected := make(chan struct{})
+	origCollect := collectExpensiveSpecs
+	collectExpensiveSpecs = func(conf *config.Config) *expensiveSpecs {
+		<-detected
+		return &expensiveSpecs{cloud: &mkr.Cloud{Provider: "ec2"}, customIdentifier: "i-0123456789"}
+	}
+	defer func() { collectExpensiveSpecs = origCollect }()
+
+	app, err := Prepare(&conf, &AgentMeta{})
+	if err != nil {
+		t.Fatalf("the host should be prepared without the cloud metadata: %s", err)
+	}
+	if app.Host.ID != "xxx12345678901" {
+		t.Errorf("unexpected host: %+v", app.Host)
+	}
+
+	// the host is updated with the metadata detected later
+	close(detected)
+	app.UpdateHostSpecs()
+	if sent.Meta.Cloud == nil || sent.Meta.Cloud.Provider != "ec2" || sent.CustomIdentifier != "i-0123456789" {
+		t.Errorf("the host should be updated with the cloud metadata: %+v", sent)
+	}
+}
+
+func TestPrepareWithStrictHostnameChange(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+	conf.SaveHostID("xxx12345678901")
+	conf.StrictHostnameChange = true
+
+	mockHandlers["GET /api/v0/hosts/xxx12345678901"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{
+			"host": mkr.Host{ID: "xxx12345678901", Name: "old-name", Type: "unknown", Status: "working"},
+		}
+	}
+
+	saveLastHostname(&conf, "old-name")
+	if _, err := Prepare(&conf, &AgentMeta{}); err == nil || !strings.Contains(err.Error(), "the hostname has changed") {
+		t.Errorf("Prepare should refuse to start when the hostname has changed but got %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	saveLastHostname(&conf, hostname)
+	if _, err := Prepare(&conf, &AgentMeta{}); err != nil {
+		t.Errorf("Prepare should not raise error when the hostname has not changed: %s", err)
+	}
+}
+
+func TestUpdateHostSpecs_HostnameChanged(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name         string
+		strict       bool
+		expectedName string
+	}{
+		{name: "update", strict: false, expectedName: hostname},
+		{name: "strict", strict: true, expectedName: "old-name"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+			defer deferFunc()
+			conf.StrictHostnameChange = tc.strict
+
+			var sentName string
+			mockHandlers["PUT /api/v0/hosts/xxx12345678901"] = func(req *http.Request) (int, jsonObject) {
+				var param mackerel.UpdateHostParam
+				json.NewDecoder(req.Body).Decode(&param)
+				sentName = param.Name
+				return 200, jsonObject{"id": "xxx12345678901"}
+			}
+			api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := &App{
+				Config:    &conf,
+				API:       api,
+				Host:      &mkr.Host{ID: "xxx12345678901"},
+				AgentMeta: &AgentMeta{},
+			}
+
+			saveLastHostname(&conf, "old-name")
+			app.UpdateHostSpecs()
+			if sentName != tc.expectedName {
+				t.Errorf("the host should be updated with %q but got %q", tc.expectedName, sentName)
+			}
+			if last := loadLastHostname(&conf); last != tc.expectedName {
+				t.Errorf("the last hostname should be %q but got %q", tc.expectedName, last)
+			}
+		})
+	}
+}
+
+func TestUpdateHostSpecs_Unchanged(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	var updated int
+	mockHandlers["PUT /api/v0/hosts/xxx12345678901"] = func(req *http.Request) (int, jsonObject) {
+		updated++
+		return 200, jsonObject{"id": "xxx12345678901"}
+	}
+	var collected int
+	origCollect := collectExpensiveSpecs
+	collectExpensiveSpecs = func(conf *config.Config) *expensiveSpecs {
+		collected++
+		return &expensiveSpecs{filesystem: mkr.FileSystem{"/dev/sda1": map[string]interface{}{"mount": "/"}}}
+	}
+	defer func() { collectExpensiveSpecs = origCollect }()
+
+	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		Config:    &conf,
+		API:       api,
+		Host:      &mkr.Host{ID: "xxx12345678901"},
+		AgentMeta: &AgentMeta{},
+	}
+	hostname, _ := os.Hostname()
+	saveLastHostname(&conf, hostname)
+
+	app.UpdateHostSpecs()
+	app.UpdateHostSpecs()
+	if updated != 1 || collected != 1 {
+		t.Errorf("the unchanged specs should not be updated: updated %d times, collected %d times", updated, collected)
+	}
+	app.RefreshHostSpecs()
+	if updated != 2 || collected != 2 {
+		t.Errorf("the specs should be refreshed: updated %d times, collected %d times", updated, collected)
+	}
+
+	// the expensive specs are collected again after the interval
+	app.hostSpecs.collectedAt = app.hostSpecs.collectedAt.Add(-defaultHostSpecsExpensiveInterval)
+	app.UpdateHostSpecs()
+	if updated != 2 || collected != 3 {
+		t.Errorf("the expensive specs should be collected again: updated %d times, collected %d times", updated, collected)
+	}
+}
+
 func TestCollectHostParam(t *testing.T) {
 	conf := config.Config{}
 	hostParam, err := collectHostParam(&conf, &AgentMeta{})
@@ -222,6 +579,48 @@ func TestCollectHostParam(t *testing.T) {
 	}
 }
 
+func TestCollectHostParam_instance(t *testing.T) {
+	conf := config.Config{InstanceSuffix: "pg-main"}
+	hostParam, err := collectHostParam(&conf, &AgentMeta{})
+	if err != nil {
+		t.Fatalf("collectHostParam should not fail: %s", err)
+	}
+	hostname, _ := os.Hostname()
+	if expect := hostname + "-pg-main"; hostParam.Name != expect {
+		t.Errorf("the hostname of the instance should be %q but got %q", expect, hostParam.Name)
+	}
+}
+
+func TestCollectHostParamWithAgentMeta(t *testing.T) {
+	conf := config.Config{
+		Statsd: &config.Statsd{Listen: "127.0.0.1:8125"},
+		OTLP:   &config.OTLP{Endpoint: "http://localhost:4318"},
+	}
+	ameta := &AgentMeta{Version: "0.63.0-fork.1", Revision: "abc123", WrapperVersion: "0.63.0"}
+	hostParam, err := collectHostParam(&conf, ameta)
+	if err != nil {
+		t.Fatalf("collectHostParam should not fail: %s", err)
+	}
+	meta := hostParam.Meta
+	if meta.AgentName != "mackerel-agent/0.63.0-fork.1 (Revision abc123)" || meta.AgentVersion != "0.63.0-fork.1" || meta.AgentRevision != "abc123" {
+		t.Errorf("the version should be posted: %+v", meta.HostMeta)
+	}
+	if meta.AgentCustomizations != "statsd,otlp" || meta.AgentWrapperVersion != "0.63.0" {
+		t.Errorf("the customizations and the wrapper version should be posted: %q, %q", meta.AgentCustomizations, meta.AgentWrapperVersion)
+	}
+
+	expect := []string{
+		"agent-name: " + meta.AgentName,
+		"agent-version: " + meta.AgentVersion,
+		"agent-revision: " + meta.AgentRevision,
+		"agent-customizations: " + meta.AgentCustomizations,
+		"agent-wrapper-version: " + meta.AgentWrapperVersion,
+	}
+	if got := AgentIdentity(&conf, ameta); !reflect.DeepEqual(got, expect) {
+		t.Errorf("AgentIdentity should be %q but got %q", expect, got)
+	}
+}
+
 func TestCollectHostParamWithChecks(t *testing.T) {
 	customIdentifier := "app.example.com"
 	conf := config.Config{
@@ -268,7 +667,7 @@ func (b byTime) Less(i, j int) bool { return b[i].Time < b[j].Time }
 
 func TestLoop(t *testing.T) {
 	if testing.Verbose() {
-		logging.SetLogLevel(logging.DEBUG)
+		logformat.SetLevels("debug", nil)
 	}
 
 	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
@@ -283,11 +682,15 @@ func TestLoop(t *testing.T) {
 
 		postMetricsDequeueDelaySeconds =
 			int(float64(postMetricsDequeueDelaySeconds) * ratio)
-		postMetricsRetryDelaySeconds =
-			int(float64(postMetricsRetryDelaySeconds) * ratio)
+		originalPolicy := postMetricsRetryPolicy
+		postMetricsRetryPolicy = &mackerel.RetryPolicy{
+			InitialInterval: time.Duration(float64(postMetricsRetryPolicy.InitialInterval) * ratio),
+			MaxInterval:     time.Duration(float64(postMetricsRetryPolicy.MaxInterval) * ratio),
+		}
 
 		defer func() {
 			config.PostMetricsInterval = originalPostMetricsInterval
+			postMetricsRetryPolicy = originalPolicy
 		}()
 	}
 
@@ -395,7 +798,7 @@ func TestLoop(t *testing.T) {
 
 func TestReportCheckMonitors(t *testing.T) {
 	if testing.Verbose() {
-		logging.SetLogLevel(logging.DEBUG)
+		logformat.SetLevels("debug", nil)
 	}
 
 	cases := []struct {
@@ -404,6 +807,7 @@ func TestReportCheckMonitors(t *testing.T) {
 	}{
 		{http.StatusOK, false},
 		{http.StatusBadRequest, false},
+		{http.StatusTooManyRequests, true},
 		{http.StatusInternalServerError, true},
 	}
 
@@ -412,7 +816,7 @@ func TestReportCheckMonitors(t *testing.T) {
 		defer deferFunc()
 
 		if testing.Short() {
-			reportCheckRetryDelaySeconds = 1
+			reportCheckRetryPolicy = &mackerel.RetryPolicy{InitialInterval: 1 * time.Second, MaxInterval: 1 * time.Second}
 		}
 
 		postCount := 0
@@ -445,10 +849,10 @@ func TestReportCheckMonitors(t *testing.T) {
 		}
 
 		go func() {
-			reportCheckMonitors(app, "", []*checks.Report{})
+			reportCheckMonitors(context.Background(), app, "", []*checks.Report{})
 		}()
 
-		time.Sleep(time.Duration(reportCheckRetryDelaySeconds) * 3 * time.Second)
+		time.Sleep(reportCheckRetryPolicy.InitialInterval * 3)
 
 		mu.Lock()
 		defer mu.Unlock()
@@ -463,3 +867,171 @@ func TestReportCheckMonitors(t *testing.T) {
 		}
 	}
 }
+
+func TestWaitCheckReportsFlushed(t *testing.T) {
+	app := &App{status: newStatusRecorder(), flushChecksCh: make(chan struct{}, 1), checksIdleCh: make(chan struct{}, 1)}
+	var pending int32 = 2
+	app.status.setBuffer(statusKindChecks, func() int { return int(atomic.LoadInt32(&pending)) })
+	go func() {
+		<-app.flushChecksCh
+		atomic.StoreInt32(&pending, 0)
+		app.checksIdleCh <- struct{}{}
+	}()
+	start := time.Now()
+	if !waitCheckReportsFlushed(app, 10*time.Second, nil) {
+		t.Errorf("the metrics should not be terminated")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the metrics should wait only until the check reports are flushed, but waited %s", elapsed)
+	}
+
+	atomic.StoreInt32(&pending, 1)
+	start = time.Now()
+	waitCheckReportsFlushed(app, 200*time.Millisecond, nil)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("the metrics should wait for the check reports up to the timeout, but waited %s", elapsed)
+	}
+
+	termCh := make(chan struct{}, 1)
+	termCh <- struct{}{}
+	start = time.Now()
+	if waitCheckReportsFlushed(app, 10*time.Second, termCh) {
+		t.Errorf("the metrics should be terminated while waiting")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the metrics should stop waiting on the termination, but waited %s", elapsed)
+	}
+}
+
+func TestWaitForQuiet(t *testing.T) {
+	ctx := context.Background()
+	ch := make(chan struct{}, 1)
+	go func() {
+		// flapping for 50ms
+		for i := 0; i < 5; i++ {
+			ch <- struct{}{}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	if !waitForQuiet(ctx, ch, 30*time.Millisecond, start, start.Add(time.Minute)) {
+		t.Fatal("waitForQuiet should return true")
+	}
+	if d := time.Since(start); d < 70*time.Millisecond {
+		t.Errorf("waitForQuiet should wait until ch is quiet, but returned in %s", d)
+	}
+
+	start = time.Now()
+	waitForQuiet(ctx, ch, 10*time.Millisecond, start.Add(50*time.Millisecond), start.Add(time.Minute))
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("waitForQuiet should wait until notBefore, but returned in %s", d)
+	}
+
+	start = time.Now()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case ch <- struct{}{}:
+			case <-stop:
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	waitForQuiet(ctx, ch, 20*time.Millisecond, start, start.Add(50*time.Millisecond))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waitForQuiet should return at deadline, but returned in %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if waitForQuiet(ctx, ch, time.Minute, start, start.Add(time.Minute)) {
+		t.Error("waitForQuiet should return false if ctx is done")
+	}
+}
+
+func TestHostMetricValues(t *testing.T) {
+	if b := newHostMetricValues(0); b.values != nil {
+		t.Errorf("the values should be nil without any values: %#v", b.values)
+	}
+
+	b := newHostMetricValues(2)
+	b.add("host1", "custom.foo", 1397031808, 1.0)
+	b.add("host1", "custom.bar", 1397031808, 2.0)
+	b.add("host2", "custom.baz", 1397031808, 3.0)
+	expect := []*mkr.HostMetricValue{
+		{HostID: "host1", MetricValue: &mkr.MetricValue{Name: "custom.foo", Time: 1397031808, Value: 1.0}},
+		{HostID: "host1", MetricValue: &mkr.MetricValue{Name: "custom.bar", Time: 1397031808, Value: 2.0}},
+		{HostID: "host2", MetricValue: &mkr.MetricValue{Name: "custom.baz", Time: 1397031808, Value: 3.0}},
+	}
+	if !reflect.DeepEqual(b.values, expect) {
+		t.Errorf("the values should be %v but got %v", expect, b.values)
+	}
+}
+
+func BenchmarkHostMetricValues(b *testing.B) {
+	names := make([]string, 4000)
+	for i := range names {
+		names[i] = fmt.Sprintf("custom.plugin%d.metric%d", i/100, i%100)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values := newHostMetricValues(len(names))
+		for j, name := range names {
+			values.add("xyzabc12345", name, 1397031808, float64(j))
+		}
+	}
+}
+
+func TestHashHostParam(t *testing.T) {
+	param := func(free, used string) *mackerel.CreateHostParam {
+		var meta spec.HostMeta
+		meta.Memory = mkr.Memory{"total": "8000kB", "free": free}
+		meta.CPU = mkr.CPU{{"model_name": "Xeon", "mhz": free}}
+		meta.Filesystem = mkr.FileSystem{"/dev/sda1": map[string]interface{}{"mount": "/", "kb_used": used}}
+		return &mackerel.CreateHostParam{Name: "host", Meta: meta}
+	}
+	if hashHostParam(param("100kB", "1")) != hashHostParam(param("200kB", "2")) {
+		t.Error("the volatile specs should not change the hash")
+	}
+	changed := param("100kB", "1")
+	changed.Meta.Memory["total"] = "16000kB"
+	if hashHostParam(param("100kB", "1")) == hashHostParam(changed) {
+		t.Error("the changed specs should change the hash")
+	}
+}
+
+func TestPluginGenerators_PrometheusCollision(t *testing.T) {
+	newExporter := func(value int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "# TYPE up gauge\nup %d\n", value)
+		}))
+	}
+	first, last := newExporter(1), newExporter(2)
+	defer first.Close()
+	defer last.Close()
+	conf := &config.Config{
+		PrometheusPlugins: map[string]*config.PrometheusPlugin{
+			"b": {URL: last.URL, MetricPrefix: "app", Timeout: time.Second},
+			"a": {URL: first.URL, MetricPrefix: "app", Timeout: time.Second},
+		},
+	}
+
+	for collision, expected := range map[config.MetricNameCollision]float64{
+		config.MetricNameCollisionFirstWins: 1,
+		config.MetricNameCollisionLastWins:  2,
+	} {
+		// the order of the sources should not depend on the iteration of the map
+		for i := 0; i < 10; i++ {
+			ag := &agent.Agent{PluginGenerators: pluginGenerators(conf), MetricNameCollision: collision}
+			result := ag.CollectMetrics(time.Now())
+			if len(result.Values) != 1 || result.Values[0].Values["custom.app.up"] != expected {
+				t.Fatalf("%s: the value of the source in order of the names should be posted: %v", collision, result.Values)
+			}
+		}
+	}
+}
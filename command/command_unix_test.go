@@ -3,11 +3,18 @@
 package command
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/mackerelio/mackerel-agent/checks"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -101,3 +108,142 @@ func TestRunOncePayload(t *testing.T) {
 	}
 
 }
+
+func TestRunOnceJSON(t *testing.T) {
+	origMetricsInterval := metricsInterval
+	metricsInterval = 1 * time.Second
+	defer func() {
+		metricsInterval = origMetricsInterval
+	}()
+
+	conf := &config.Config{
+		MetricPlugins: map[string]*config.MetricPlugin{
+			"metric1": {
+				Command: config.Command{Cmd: "echo 'foo.bar\t1\t1577836800'"},
+			},
+		},
+		CheckPlugins: map[string]*config.CheckPlugin{
+			"check1": {
+				Command: config.Command{Cmd: "echo ok"},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := RunOnceJSON(conf, &AgentMeta{}, &buf); err != nil {
+		t.Errorf("RunOnceJSON() should be nomal exit: %s", err)
+	}
+	var result OnceResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("the output should be a JSON document: %s", err)
+	}
+	if result.Host == nil || result.Host.Name == "" {
+		t.Errorf("hostname should be set")
+	}
+	if v, ok := result.Metrics["custom.foo.bar"]; !ok || v != 1 {
+		t.Errorf("the metric values should be keyed by the names: %v", result.Metrics)
+	}
+	if len(result.Checks) != 1 || result.Checks[0].Name != "check1" || result.Checks[0].Status != checks.StatusOK {
+		t.Errorf("unexpected check results: %v", result.Checks)
+	}
+
+	conf.MetricPlugins["metric2"] = &config.MetricPlugin{Command: config.Command{Args: []string{"./no-such-plugin"}}}
+	buf.Reset()
+	if err := RunOnceJSON(conf, &AgentMeta{}, &buf); err == nil {
+		t.Error("RunOnceJSON() should return an error if a plugin failed")
+	}
+	result = OnceResult{}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("the output should be a JSON document: %s", err)
+	}
+	if len(result.Errors) != 1 {
+		t.Errorf("the failed plugin should be reported: %v", result.Errors)
+	}
+
+	// the plugin exiting with non-zero fails even with the values
+	delete(conf.MetricPlugins, "metric2")
+	conf.MetricPlugins["metric3"] = &config.MetricPlugin{Command: config.Command{Cmd: "echo 'baz\t2\t1577836800'; exit 2"}}
+	buf.Reset()
+	if err := RunOnceJSON(conf, &AgentMeta{}, &buf); err == nil {
+		t.Error("RunOnceJSON() should return an error if a plugin exited with non-zero")
+	}
+	result = OnceResult{}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("the output should be a JSON document: %s", err)
+	}
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "exited with 2") {
+		t.Errorf("the plugin exiting with non-zero should be reported: %v", result.Errors)
+	}
+	if v, ok := result.Metrics["custom.baz"]; !ok || v != 2 {
+		t.Errorf("the values of the plugin exiting with non-zero should be kept: %v", result.Metrics)
+	}
+}
+
+func TestServiceMetricsGenerators_plugin(t *testing.T) {
+	conf := &config.Config{
+		MetricPlugins: map[string]*config.MetricPlugin{
+			"broker": {
+				Command:      config.Command{Cmd: "echo 'depth\t12\t1577836800'"},
+				Service:      "MyService",
+				MetricPrefix: "queue",
+			},
+			"host": {
+				Command: config.Command{Cmd: "echo 'load\t1\t1577836800'"},
+			},
+		},
+	}
+	if n := len(pluginGenerators(conf)); n != 1 {
+		t.Errorf("the service metrics plugin should not generate the host metrics, but %d generators", n)
+	}
+	generators := serviceMetricsGenerators(conf)
+	if len(generators) != 1 || generators[0].service != "MyService" {
+		t.Fatalf("unexpected service metrics generators: %v", generators)
+	}
+
+	confAPI, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+	var posted []*mkr.MetricValue
+	mockHandlers["POST /api/v0/services/MyService/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		json.NewDecoder(req.Body).Decode(&posted)
+		return 200, jsonObject{"success": true}
+	}
+	api, err := mackerel.NewAPI(ts.URL, "apikey", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	postServiceMetrics(&App{API: api, Config: &confAPI}, generators, newServiceMetricsBuffer(), now)
+	expect := []*mkr.MetricValue{{Name: "queue.depth", Time: now.Unix(), Value: 12.0}}
+	if !reflect.DeepEqual(posted, expect) {
+		t.Errorf("the values should be posted as the service metrics named by the prefix: %+v", posted)
+	}
+}
+
+func TestChecksSemaphore(t *testing.T) {
+	if newChecksSemaphore(0) != nil {
+		t.Error("zero should not limit the checkers")
+	}
+	run := func(sem checksSemaphore) time.Duration {
+		var wg sync.WaitGroup
+		start := time.Now()
+		for _, name := range []string{"sleep1", "sleep2"} {
+			c := &checks.Checker{Name: name, Config: &config.CheckPlugin{
+				Command: config.Command{Cmd: "sleep 0.5"},
+			}}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if report := sem.check(c); report.Status != checks.StatusOK {
+					t.Errorf("the check should be OK but %v: %s", report.Status, report.Message)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+	if d := run(newChecksSemaphore(1)); d < time.Second {
+		t.Errorf("the checkers should be executed one by one but they took %s", d)
+	}
+	if d := run(nil); d >= time.Second {
+		t.Errorf("the checkers should be executed concurrently but they took %s", d)
+	}
+}
@@ -0,0 +1,228 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// runControlServer serves the status of the agent and the control commands on
+// the control socket until ctx is done. The commands are authenticated by the
+// permission of the directory of the socket.
+func runControlServer(ctx context.Context, app *App) {
+	path := ControlSocketFile(app.Config)
+	l, activated := activateControlSocket(app.Config)
+	if !activated {
+		var err error
+		l, err = listenControlSocket(path)
+		if err != nil {
+			logger.Warningf("Failed to listen on the control socket %s: %s", path, err)
+			return
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.Status())
+	})
+	mux.HandleFunc("/control/", func(w http.ResponseWriter, req *http.Request) {
+		status, res := app.handleControl(req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		logger.Warningf("Failed to serve on the control socket %s: %s", path, err)
+	}
+}
+
+// activateControlSocket returns the control socket received from launchd by
+// control_launchd_socket, and whether it is received. The socket is created
+// by the agent if it is not.
+func activateControlSocket(conf *config.Config) (net.Listener, bool) {
+	name := conf.ControlLaunchdSocket
+	if name == "" {
+		return nil, false
+	}
+	l, err := activateLaunchdSocket(name)
+	if err != nil {
+		logger.Warningf("Failed to activate the control socket %q by launchd (creating it instead): %s", name, err)
+		return nil, false
+	}
+	if addr := l.Addr().String(); addr != ControlSocketFile(conf) {
+		logger.Warningf("The control socket %q activated by launchd is %s, where the commands of the agent do not connect to", name, addr)
+	}
+	logger.Infof("Activated the control socket %q by launchd", name)
+	return l, true
+}
+
+func controlClient(conf *config.Config) *http.Client {
+	path := ControlSocketFile(conf)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialControlSocket(ctx, path)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+// FetchStatus fetches the status of the running agent from the control socket.
+func FetchStatus(conf *config.Config) (*Status, error) {
+	resp, err := controlClient(conf).Get("http://mackerel-agent/status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the agent (is the agent running?): %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the status: %s", resp.Status)
+	}
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// The verbs of the control commands.
+const (
+	// ControlReload resets the check reports and updates the host specs
+	// collected again as SIGHUP does, and reloads the configuration in the
+	// supervise mode.
+	ControlReload = "reload"
+	// ControlFlush posts the pending metrics and check reports immediately.
+	ControlFlush = "flush"
+	// ControlHostStatus updates the status of the host, given by the argument.
+	ControlHostStatus = "host-status"
+)
+
+// ControlRequest is the request of a control command, POST /control/<verb>.
+type ControlRequest struct {
+	Args []string `json:"args"`
+}
+
+// ControlResponse is the result of a control command.
+type ControlResponse struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SendControl sends the control command of verb to the running agent.
+// The error is returned only if the command is not delivered, and the
+// failure of the command is reported by the response.
+func SendControl(conf *config.Config, verb string, args []string) (*ControlResponse, error) {
+	b, err := json.Marshal(&ControlRequest{Args: args})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := controlClient(conf).Post("http://mackerel-agent/control/"+verb, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the agent (is the agent running?): %s", err)
+	}
+	defer resp.Body.Close()
+	var res ControlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to read the response (%s): %s", resp.Status, err)
+	}
+	return &res, nil
+}
+
+// The statuses of the hosts which can be set by ControlHostStatus.
+var controlHostStatuses = []string{"working", "standby", "maintenance", "poweroff"}
+
+func isControlHostStatus(s string) bool {
+	for _, st := range controlHostStatuses {
+		if s == st {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) handleControl(req *http.Request) (int, *ControlResponse) {
+	if req.Method != "POST" {
+		return http.StatusMethodNotAllowed, &ControlResponse{Error: "only POST is allowed"}
+	}
+	var creq ControlRequest
+	if err := json.NewDecoder(req.Body).Decode(&creq); err != nil {
+		return http.StatusBadRequest, &ControlResponse{Error: fmt.Sprintf("invalid request: %s", err)}
+	}
+	verb := strings.TrimPrefix(req.URL.Path, "/control/")
+	var message string
+	var err error
+	switch verb {
+	case ControlReload:
+		if len(creq.Args) != 0 {
+			return http.StatusBadRequest, &ControlResponse{Error: "reload takes no arguments"}
+		}
+		message, err = app.reload()
+	case ControlFlush:
+		if len(creq.Args) != 0 {
+			return http.StatusBadRequest, &ControlResponse{Error: "flush takes no arguments"}
+		}
+		message = app.flush()
+	case ControlHostStatus:
+		if len(creq.Args) != 1 || !isControlHostStatus(creq.Args[0]) {
+			return http.StatusBadRequest, &ControlResponse{Error: "host-status takes one of " + strings.Join(controlHostStatuses, ", ")}
+		}
+		if err = app.API.UpdateHostStatus(app.Host.ID, creq.Args[0]); err == nil {
+			message = fmt.Sprintf("the status of the host %s is updated to %s", app.Host.ID, creq.Args[0])
+		}
+	default:
+		return http.StatusNotFound, &ControlResponse{Error: fmt.Sprintf("unknown command: %q", verb)}
+	}
+	if err != nil {
+		logger.Warningf("Failed to %s by the control command: %s", verb, err)
+		return http.StatusInternalServerError, &ControlResponse{Error: err.Error()}
+	}
+	logger.Infof("Control command %s: %s", verb, message)
+	return http.StatusOK, &ControlResponse{OK: true, Message: message}
+}
+
+// reload resets the check reports, the metadata posted and the hosts of the
+// custom identifiers, and refreshes the host specs. The configuration is
+// reloaded by the supervisor, which restarts the agent.
+func (app *App) reload() (string, error) {
+	app.ResetCheckReports()
+	app.ResetMetadata()
+	app.customIdentifiers.reset()
+	app.RefreshHostSpecs()
+	if !app.Config.Supervised {
+		return "the check reports, the metadata posted and the hosts of the custom identifiers are reset and the host specs are updated (the configuration is reloaded only in the supervise mode)", nil
+	}
+	if err := signalSupervisor(); err != nil {
+		return "", fmt.Errorf("failed to signal the supervisor: %s", err)
+	}
+	return "the supervisor is reloading the configuration", nil
+}
+
+// flush posts the pending metrics and check reports without waiting for the delays.
+func (app *App) flush() string {
+	for _, ch := range []chan struct{}{app.flushMetricsCh, app.flushChecksCh} {
+		if ch == nil {
+			continue
+		}
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	triggerSpoolReplay(app)
+	sizes := app.status.bufferSizes()
+	return fmt.Sprintf("flushing %d pending collections of the metrics and %d check reports", sizes[statusKindMetrics], sizes[statusKindChecks])
+}
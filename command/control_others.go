@@ -0,0 +1,61 @@
+// +build !windows
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// ControlSocketFile returns the Unix domain socket where the running agent serves its status.
+// It is located in a directory accessible only by root.
+func ControlSocketFile(conf *config.Config) string {
+	return filepath.Join(conf.Root, "control", "mackerel-agent.sock")
+}
+
+func listenControlSocket(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := restrictAccess(dir); err != nil {
+		return nil, err
+	}
+	// remove the socket left by the agent which was not terminated gracefully,
+	// but not the one of the agent still running
+	if conn, err := net.DialTimeout("unix", path, controlDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another agent is listening on it")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// controlDialTimeout is the time to wait for the agent listening on the
+// control socket found at the start.
+const controlDialTimeout = time.Second
+
+func dialControlSocket(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
+
+// restrictAccess makes dir accessible only by the owner, that is root.
+func restrictAccess(dir string) error {
+	return os.Chmod(dir, 0700)
+}
+
+// signalSupervisor sends SIGHUP to the supervisor, the parent process, to
+// reload the configuration.
+func signalSupervisor() error {
+	return syscall.Kill(os.Getppid(), syscall.SIGHUP)
+}
@@ -0,0 +1,342 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/pluginbreaker"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	"github.com/mackerelio/mackerel-agent/pluginstderr"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestControlServer_Status(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	app := &App{
+		Config: &config.Config{
+			Root:          root,
+			MetricPlugins: map[string]*config.MetricPlugin{"foo": {}, "bar": {}},
+			CheckPlugins:  map[string]*config.CheckPlugin{"baz": {}},
+		},
+		Host:      &mkr.Host{ID: "xyzabc12345"},
+		AgentMeta: &AgentMeta{Version: "0.1.0"},
+		status:    newStatusRecorder(),
+	}
+	app.status.posted(statusKindMetrics)
+	app.status.setBuffer(statusKindMetrics, func() int { return 3 })
+	pluginstderr.Log(logformat.GetLogger("test"), func(*logformat.Logger, string, ...interface{}) {}, "checks.baz", "baz failed\n")
+	pluginstats.Record("checks.baz", 1200*time.Millisecond, 2, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runControlServer(ctx, app)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var st *Status
+	for i := 0; i < 50; i++ {
+		if st, err = FetchStatus(app.Config); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("FetchStatus should not raise error: %s", err)
+	}
+	if st.HostID != "xyzabc12345" || st.Version != "0.1.0" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if _, ok := st.LastPostedAt[statusKindMetrics]; !ok {
+		t.Errorf("the last post of metrics should be reported: %+v", st.LastPostedAt)
+	}
+	if _, ok := st.LastPostedAt[statusKindChecks]; ok {
+		t.Errorf("the checks should not be reported since they are never posted: %+v", st.LastPostedAt)
+	}
+	if st.Buffers[statusKindMetrics] != 3 {
+		t.Errorf("the size of the metrics buffer should be 3 but got %+v", st.Buffers)
+	}
+	if st.Plugins["metrics"] != 2 || st.Plugins["checks"] != 1 || st.Plugins["metadata"] != 0 {
+		t.Errorf("unexpected plugin counts: %+v", st.Plugins)
+	}
+	if st.PluginStderr["checks.baz"].Stderr != "baz failed" {
+		t.Errorf("the last stderr of the plugin should be reported: %+v", st.PluginStderr)
+	}
+	if s := st.PluginStats["checks.baz"]; s.Executions != 1 || s.LastDurationMs != 1200 || s.LastExitCode != 2 {
+		t.Errorf("the executions of the plugin should be reported: %+v", st.PluginStats)
+	}
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filepath.Dir(ControlSocketFile(app.Config)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0700 {
+			t.Errorf("the control directory should be accessible only by the owner but got %s", perm)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := st.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Host ID:    xyzabc12345", "checks:    never", "metrics:   3", `checks.baz (`, `): "baz failed"`, "checks.baz: 1 runs, 0 failures (0 timeouts), 0 empty, 0 rejected, 0 slow, last 1200ms", "root:          " + root} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("the status should contain %q but got:\n%s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	st.DisabledPlugins = []string{"plugin.checks.foo"}
+	if err := st.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Disabled plugins:\n  plugin.checks.foo\n") {
+		t.Errorf("the status should contain the disabled plugins but got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	st.PluginBreakers = map[string]pluginbreaker.State{
+		"metrics.foo": {Failures: 5, Open: true, BackoffSeconds: 240, NextRunAt: time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	if err := st.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Plugin circuit breakers:\n  metrics.foo: open by 5 consecutive failures, backed off for 4m0s until 2019-09-01T12:00:00Z\n") {
+		t.Errorf("the status should contain the breakers but got:\n%s", buf.String())
+	}
+}
+
+// startControlledAgent runs the main loop of an agent in-process, whose first
+// post of the metrics is tried immediately.
+func startControlledAgent(t *testing.T, conf *config.Config, host *mkr.Host) func() {
+	t.Helper()
+	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		Agent:        &agent.Agent{MetricsGenerators: []metrics.Generator{&counterGenerator{}}},
+		Config:       conf,
+		API:          api,
+		Host:         host,
+		AgentMeta:    &AgentMeta{},
+		status:       newStatusRecorder(),
+		checkReports: newCheckReportCache(0),
+	}
+	termCh := make(chan struct{})
+	exitCh := make(chan error)
+	go func() {
+		exitCh <- loop(app, termCh)
+	}()
+	return func() {
+		termCh <- struct{}{}
+		if err := <-exitCh; err != nil {
+			t.Errorf("the loop should exit without error: %s", err)
+		}
+	}
+}
+
+// undelayedHost returns a host whose first post of the metrics is not delayed.
+func undelayedHost() *mkr.Host {
+	host := &mkr.Host{ID: "xyzabc12345"}
+	for i := 0; delayByHost(host) > 1; i++ {
+		host.ID = fmt.Sprintf("xyzabc%05d", i)
+	}
+	return host
+}
+
+func sendControl(t *testing.T, conf *config.Config, verb string, args ...string) *ControlResponse {
+	t.Helper()
+	var res *ControlResponse
+	var err error
+	for i := 0; i < 50; i++ {
+		if res, err = SendControl(conf, verb, args); err == nil {
+			return res
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("SendControl(%s) should not raise error: %s", verb, err)
+	return nil
+}
+
+func TestControlServer_Flush(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	originalPolicy := postMetricsRetryPolicy
+	postMetricsRetryPolicy = &mackerel.RetryPolicy{InitialInterval: time.Hour, MaxInterval: time.Hour}
+	defer func() { postMetricsRetryPolicy = originalPolicy }()
+
+	posted := make(chan int, 10)
+	var mu sync.Mutex
+	posts := 0
+	mockHandlers["POST /api/v0/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		mu.Lock()
+		defer mu.Unlock()
+		posts++
+		posted <- posts
+		if posts == 1 {
+			// the next post is delayed by the retry policy
+			return http.StatusServiceUnavailable, jsonObject{}
+		}
+		return http.StatusOK, jsonObject{"success": true}
+	}
+
+	host := undelayedHost()
+	mockHandlers["PUT /api/v0/hosts/"+host.ID] = func(req *http.Request) (int, jsonObject) {
+		return http.StatusOK, jsonObject{"result": "OK"}
+	}
+	stop := startControlledAgent(t, &conf, host)
+	defer stop()
+
+	select {
+	case <-posted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the metrics should be posted")
+	}
+	res := sendControl(t, &conf, ControlFlush)
+	if !res.OK || !strings.HasPrefix(res.Message, "flushing ") {
+		t.Errorf("flush should succeed: %+v", res)
+	}
+	select {
+	case n := <-posted:
+		if n != 2 {
+			t.Errorf("the metrics should be posted again but %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the pending metrics should be posted by flush")
+	}
+}
+
+func TestControlServer_ReloadAndHostStatus(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	var mu sync.Mutex
+	var statuses []string
+	mockHandlers["POST /api/v0/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		return http.StatusOK, jsonObject{"success": true}
+	}
+	host := undelayedHost()
+	specsUpdated := make(chan struct{}, 10)
+	mockHandlers["PUT /api/v0/hosts/"+host.ID] = func(req *http.Request) (int, jsonObject) {
+		specsUpdated <- struct{}{}
+		return http.StatusOK, jsonObject{"result": "OK"}
+	}
+	mockHandlers["POST /api/v0/hosts/"+host.ID+"/status"] = func(req *http.Request) (int, jsonObject) {
+		var body struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = append(statuses, body.Status)
+		return http.StatusOK, jsonObject{"success": true}
+	}
+	stop := startControlledAgent(t, &conf, host)
+	defer stop()
+
+	// the host specs are updated at the start
+	select {
+	case <-specsUpdated:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the host specs should be updated at the start")
+	}
+	if res := sendControl(t, &conf, ControlReload); !res.OK || !strings.Contains(res.Message, "only in the supervise mode") {
+		t.Errorf("reload should succeed: %+v", res)
+	}
+	if res := sendControl(t, &conf, ControlHostStatus, "standby"); !res.OK {
+		t.Errorf("host-status should succeed: %+v", res)
+	}
+	for _, tc := range []struct {
+		verb string
+		args []string
+	}{
+		{ControlHostStatus, []string{"retired"}},
+		{ControlHostStatus, nil},
+		{ControlReload, []string{"now"}},
+		{"restart", nil},
+	} {
+		if res := sendControl(t, &conf, tc.verb, tc.args...); res.OK || res.Error == "" {
+			t.Errorf("%s %v should fail: %+v", tc.verb, tc.args, res)
+		}
+	}
+
+	select {
+	case <-specsUpdated:
+	default:
+		t.Error("the host specs should be updated by reload")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(statuses) != 1 || statuses[0] != "standby" {
+		t.Errorf("the host status should be updated to standby: %v", statuses)
+	}
+}
+
+func TestListenControlSocket(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := ControlSocketFile(&config.Config{Root: root})
+
+	// the stale socket left by the agent killed, while the named pipe on
+	// Windows is removed with the process
+	if runtime.GOOS != "windows" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := listenControlSocket(path)
+	if err != nil {
+		t.Fatalf("the stale socket should be removed: %s", err)
+	}
+	defer l.Close()
+
+	if l2, err := listenControlSocket(path); err == nil {
+		l2.Close()
+		t.Errorf("the socket of the running agent should not be removed")
+	}
+	if runtime.GOOS != "windows" {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("the socket of the running agent should be kept: %s", err)
+		}
+	}
+}
+
+func TestActivateControlSocket_notConfigured(t *testing.T) {
+	if l, ok := activateControlSocket(&config.Config{}); ok || l != nil {
+		t.Errorf("the control socket should not be activated without control_launchd_socket")
+	}
+}
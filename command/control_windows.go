@@ -0,0 +1,102 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/supervisor"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32 = windows.NewLazySystemDLL("advapi32.dll")
+
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = advapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	sddlRevision1 = 1
+
+	// full access for SYSTEM and Administrators only
+	controlPipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+	eventModifyState = 0x0002
+)
+
+// ControlSocketFile returns the named pipe where the running agent serves its status.
+// It is accessible only by SYSTEM and Administrators, and named after the root
+// directory not to conflict with the agents of the other roots.
+func ControlSocketFile(conf *config.Config) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(conf.Root)))
+	return fmt.Sprintf(`\\.\pipe\mackerel-agent-%08x`, h.Sum32())
+}
+
+func listenControlSocket(path string) (net.Listener, error) {
+	sddl, err := syscall.UTF16PtrFromString(controlPipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	var sd uintptr
+	r1, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(
+		uintptr(unsafe.Pointer(sddl)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r1 == 0 {
+		return nil, err
+	}
+	// the descriptor is referred by the instances of the pipe created while listening
+	sa := &windows.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	l, err := listenPipe(path, sa)
+	if err != nil {
+		windows.LocalFree(windows.Handle(sd))
+		if err == windows.ERROR_ACCESS_DENIED {
+			return nil, fmt.Errorf("another agent is listening on it")
+		}
+		return nil, err
+	}
+	return &controlPipeListener{pipeListener: l, sd: sd}, nil
+}
+
+// controlPipeListener frees the security descriptor of the pipe on Close.
+type controlPipeListener struct {
+	*pipeListener
+	sd uintptr
+}
+
+func (l *controlPipeListener) Close() error {
+	err := l.pipeListener.Close()
+	if err == nil {
+		windows.LocalFree(windows.Handle(l.sd))
+	}
+	return err
+}
+
+func dialControlSocket(ctx context.Context, path string) (net.Conn, error) {
+	return dialPipe(ctx, path)
+}
+
+// signalSupervisor sets the event of the supervisor, whose name is passed by
+// the environment variable, to reload the configuration.
+func signalSupervisor() error {
+	name := os.Getenv(supervisor.ReloadEventEnv)
+	if name == "" {
+		return fmt.Errorf("%s is not set", supervisor.ReloadEventEnv)
+	}
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	ev, err := windows.OpenEvent(eventModifyState, false, p)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(ev)
+	return windows.SetEvent(ev)
+}
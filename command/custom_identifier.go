@@ -0,0 +1,117 @@
+package command
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// The durations to cache the hosts of the custom identifiers in the outputs
+// of the plugins, and the identifiers of no hosts.
+var (
+	customIdentifierHostTTL     = 1 * time.Hour
+	customIdentifierNotFoundTTL = 10 * time.Minute
+)
+
+// customIdentifierResolver finds the hosts of the custom identifiers, which
+// are given by "customIdentifier" of the records of the metrics plugins, and
+// caches them. The cache is reset by the reload.
+type customIdentifierResolver struct {
+	find func(customIdentifier string) (*mkr.Host, error)
+
+	mu    sync.Mutex
+	cache map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	host      *mkr.Host // nil if not found
+	expiresAt time.Time
+}
+
+func newCustomIdentifierResolver(find func(string) (*mkr.Host, error)) *customIdentifierResolver {
+	return &customIdentifierResolver{find: find, cache: make(map[string]*resolvedHost)}
+}
+
+// resolve returns the host of customIdentifier, or nil if it is not found. The
+// identifier of no host is logged once in customIdentifierNotFoundTTL, while
+// the other failures, such as the timeouts, are retried at the next call.
+func (r *customIdentifierResolver) resolve(customIdentifier string) *mkr.Host {
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	r.mu.Lock()
+	c, ok := r.cache[customIdentifier]
+	r.mu.Unlock()
+	if ok && now.Before(c.expiresAt) {
+		return c.host
+	}
+
+	// the lock is not held while requesting the API
+	host, err := r.find(customIdentifier)
+	if err != nil {
+		if !isHostNotFound(err) {
+			logger.Warningf("Failed to find the host of the custom identifier %q in the output of the plugins (the values are dropped in this cycle): %s", customIdentifier, err)
+			return nil
+		}
+		logger.Warningf("Failed to find the host of the custom identifier %q in the output of the plugins (the values are dropped for %s): %s", customIdentifier, customIdentifierNotFoundTTL, err)
+		r.store(customIdentifier, &resolvedHost{expiresAt: now.Add(customIdentifierNotFoundTTL)})
+		return nil
+	}
+	r.store(customIdentifier, &resolvedHost{host: host, expiresAt: now.Add(customIdentifierHostTTL)})
+	return host
+}
+
+func (r *customIdentifierResolver) store(customIdentifier string, c *resolvedHost) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[customIdentifier] = c
+}
+
+// isHostNotFound returns true if err tells that no host has the custom
+// identifier, which is cached not to request the API every cycle.
+func isHostNotFound(err error) bool {
+	if _, ok := err.(*mackerel.InfoError); ok {
+		return true
+	}
+	return mackerel.IsNotFound(err)
+}
+
+func (r *customIdentifierResolver) reset() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[string]*resolvedHost)
+}
+
+// customIdentifierHost returns the host of customIdentifier of the config, or
+// the one found by the resolver. It returns nil if the host is not found,
+// whose values should never be posted to this host.
+func (app *App) customIdentifierHost(customIdentifier string) *mkr.Host {
+	if host, ok := app.CustomIdentifierHosts[customIdentifier]; ok {
+		return host
+	}
+	return app.customIdentifiers.resolve(customIdentifier)
+}
+
+// logUnresolvedCustomIdentifiers logs the numbers of the values dropped by the
+// custom identifiers of no hosts in a collection.
+func logUnresolvedCustomIdentifiers(unresolved map[string]int) {
+	if len(unresolved) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(unresolved))
+	var n int
+	for id, c := range unresolved {
+		ids = append(ids, id)
+		n += c
+	}
+	sort.Strings(ids)
+	logger.Warningf("Dropped %d values of %d custom identifiers of no hosts: %s", n, len(ids), strings.Join(ids, ", "))
+}
@@ -0,0 +1,84 @@
+package command
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestCustomIdentifierResolver(t *testing.T) {
+	calls := make(map[string]int)
+	r := newCustomIdentifierResolver(func(customIdentifier string) (*mkr.Host, error) {
+		calls[customIdentifier]++
+		switch customIdentifier {
+		case "db1.example.com":
+			return &mkr.Host{ID: "db1"}, nil
+		case "timeout.example.com":
+			return nil, fmt.Errorf("timeout")
+		case "gone.example.com":
+			return nil, &mkr.APIError{StatusCode: 404}
+		}
+		return nil, &mackerel.InfoError{Message: "no host"}
+	})
+	for i := 0; i < 2; i++ {
+		if host := r.resolve("db1.example.com"); host == nil || host.ID != "db1" {
+			t.Errorf("the host should be found: %v", host)
+		}
+		for _, id := range []string{"unknown.example.com", "gone.example.com", "timeout.example.com"} {
+			if host := r.resolve(id); host != nil {
+				t.Errorf("the host of %s should not be found: %v", id, host)
+			}
+		}
+	}
+	if calls["db1.example.com"] != 1 || calls["unknown.example.com"] != 1 || calls["gone.example.com"] != 1 {
+		t.Errorf("the hosts and the identifiers of no hosts should be cached: %v", calls)
+	}
+	if calls["timeout.example.com"] != 2 {
+		t.Errorf("the other failures should not be cached: %v", calls)
+	}
+
+	// the failure expires earlier than the host
+	for _, c := range r.cache {
+		if c.host == nil {
+			c.expiresAt = time.Now().Add(-time.Second)
+		}
+	}
+	r.resolve("db1.example.com")
+	r.resolve("unknown.example.com")
+	if calls["db1.example.com"] != 1 || calls["unknown.example.com"] != 2 {
+		t.Errorf("the expired failure should be retried: %v", calls)
+	}
+
+	r.reset()
+	r.resolve("db1.example.com")
+	if calls["db1.example.com"] != 2 {
+		t.Errorf("the cache should be reset: %v", calls)
+	}
+
+	var nilResolver *customIdentifierResolver
+	if host := nilResolver.resolve("db1.example.com"); host != nil {
+		t.Errorf("the nil resolver should find no hosts: %v", host)
+	}
+	nilResolver.reset()
+}
+
+func TestAppCustomIdentifierHost(t *testing.T) {
+	app := &App{
+		CustomIdentifierHosts: map[string]*mkr.Host{"web1.example.com": {ID: "web1"}},
+		customIdentifiers: newCustomIdentifierResolver(func(customIdentifier string) (*mkr.Host, error) {
+			if customIdentifier == "web1.example.com" {
+				t.Errorf("the configured custom identifiers should not be found by the API")
+			}
+			return nil, fmt.Errorf("no host")
+		}),
+	}
+	if host := app.customIdentifierHost("web1.example.com"); host == nil || host.ID != "web1" {
+		t.Errorf("the host of the config should be returned: %v", host)
+	}
+	if host := app.customIdentifierHost("db1.example.com"); host != nil {
+		t.Errorf("the unknown host should be nil, not this host: %v", host)
+	}
+}
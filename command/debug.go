@@ -0,0 +1,68 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// runDebugServer serves the debug endpoint until ctx is done.
+func runDebugServer(ctx context.Context, app *App) {
+	conf := app.Config.Debug
+	e := &localHTTP{
+		name:    "debug",
+		listen:  conf.Listen,
+		auth:    conf.Auth,
+		tls:     conf.TLS,
+		handler: newDebugHandler(app),
+	}
+	e.serve(ctx)
+}
+
+// newDebugHandler serves net/http/pprof on /debug/pprof/ and expvar on
+// /debug/vars, on its own mux rather than http.DefaultServeMux.
+func newDebugHandler(app *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		expvar.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+		})
+		b, _ := json.Marshal(newDebugVars(app))
+		fmt.Fprintf(w, "%q: %s\n}\n", "agent", b)
+	})
+	return mux
+}
+
+// debugVars are the internal counters of the agent served with the variables of expvar.
+type debugVars struct {
+	Buffers               map[string]int     `json:"buffers"`
+	APIRequests           map[string]uint64  `json:"apiRequests"`
+	APIRetries            uint64             `json:"apiRetries"`
+	PluginDurationSeconds map[string]float64 `json:"pluginDurationSeconds"`
+}
+
+func newDebugVars(app *App) *debugVars {
+	vars := &debugVars{
+		Buffers:               app.status.bufferSizes(),
+		APIRequests:           mackerel.RequestCounts(),
+		APIRetries:            mackerel.RetryCount(),
+		PluginDurationSeconds: make(map[string]float64),
+	}
+	for name, d := range agent.GenerateDurations() {
+		vars.PluginDurationSeconds[name] = d.Seconds()
+	}
+	return vars
+}
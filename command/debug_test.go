@@ -0,0 +1,84 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestDebugHandler(t *testing.T) {
+	app := &App{Config: &config.Config{}, status: newStatusRecorder()}
+	app.status.setBuffer(statusKindMetrics, func() int { return 3 })
+	ts := httptest.NewServer(newDebugHandler(app))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		MemStats map[string]interface{} `json:"memstats"`
+		Agent    debugVars              `json:"agent"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("the variables should be JSON: %s", err)
+	}
+	if vars.MemStats == nil {
+		t.Error("the variables of expvar should be served")
+	}
+	if vars.Agent.Buffers[statusKindMetrics] != 3 || vars.Agent.APIRequests == nil || vars.Agent.PluginDurationSeconds == nil {
+		t.Errorf("unexpected variables of the agent: %+v", vars.Agent)
+	}
+
+	resp, err = http.Get(ts.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("the profile should be served but %d", resp.StatusCode)
+	}
+}
+
+func TestRunDebugServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+
+	app := &App{Config: &config.Config{Debug: &config.Debug{Listen: listen}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runDebugServer(ctx, app)
+		close(done)
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + listen + "/debug/pprof/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("the debug endpoint should be served: %s", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the debug endpoint should be shut down with the context")
+	}
+}
@@ -0,0 +1,585 @@
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/collector"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+// The results of the probes of Diagnose.
+const (
+	DiagnosePass = "pass"
+	DiagnoseFail = "fail"
+	DiagnoseSkip = "skip"
+)
+
+// the defaults of DiagnoseOptions
+const (
+	defaultDiagnoseLogLines = 200
+	defaultDiagnoseTimeout  = 30 * time.Second
+)
+
+// DiagnoseOptions is the options of Diagnose.
+type DiagnoseOptions struct {
+	// Output is the tar.gz file to write the bundle. The files of the bundle
+	// are written to w of Diagnose instead if it is empty.
+	Output string
+	// LogLines is the number of the last lines of the log file in the bundle.
+	LogLines int
+	// Timeout limits each of the probes.
+	Timeout time.Duration
+	// ConfigError is the error of loading the configuration, which is
+	// reported instead of aborting the diagnosis.
+	ConfigError error
+}
+
+// DiagnoseProbe is the result of a probe of Diagnose.
+type DiagnoseProbe struct {
+	Name    string        `json:"name"`
+	Result  string        `json:"result"`
+	Message string        `json:"message"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+type diagnoseFile struct {
+	name string
+	data []byte
+}
+
+// skippedError is returned by the probes which are not performed.
+type skippedError string
+
+func (e skippedError) Error() string {
+	return string(e)
+}
+
+type diagnosis struct {
+	conf    *config.Config
+	ameta   *AgentMeta
+	opts    DiagnoseOptions
+	secrets []string
+
+	probes []*DiagnoseProbe
+	files  []diagnoseFile
+}
+
+// Diagnose collects the information for the support: the configuration, the
+// version, the OS, the last lines of the log file, the connectivity to the
+// API and a collection by once, and writes them as the tar.gz bundle to
+// opts.Output or as the text to w. The secrets are redacted and each of the
+// probes is limited by opts.Timeout. The summary of the probes is written to w
+// at the end, and an error is returned if any of them failed.
+func Diagnose(conf *config.Config, ameta *AgentMeta, opts DiagnoseOptions, w io.Writer) error {
+	if opts.LogLines <= 0 {
+		opts.LogLines = defaultDiagnoseLogLines
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultDiagnoseTimeout
+	}
+	d := &diagnosis{conf: conf, ameta: ameta, opts: opts}
+	d.secrets = diagnoseSecrets(conf)
+
+	d.run("version", d.probeVersion)
+	d.run("config", d.probeConfig)
+	d.run("os", d.probeOS)
+	d.run("log", d.probeLog)
+	d.run("agent", d.probeAgent)
+	connectivity := d.run("connectivity", d.probeConnectivity)
+	apikey := d.runAfter(connectivity, "apikey", d.probeAPIKey)
+	d.runAfter(apikey, "host", d.probeHost)
+	d.run("once", d.probeOnce)
+
+	var summary bytes.Buffer
+	failed := d.writeSummary(&summary)
+	d.files = append(d.files, diagnoseFile{name: "summary.txt", data: summary.Bytes()})
+
+	if opts.Output == "" {
+		for _, f := range d.files[:len(d.files)-1] {
+			fmt.Fprintf(w, "==> %s <==\n%s\n", f.name, bytes.TrimRight(f.data, "\n"))
+		}
+		fmt.Fprintln(w)
+	} else if err := d.writeBundle(opts.Output); err != nil {
+		return err
+	}
+	w.Write(summary.Bytes())
+	if opts.Output != "" {
+		fmt.Fprintf(w, "\nThe bundle is written to %s\n", opts.Output)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d probes failed", failed)
+	}
+	return nil
+}
+
+type probeFunc func(ctx context.Context) (string, []diagnoseFile, error)
+
+// run runs the probe within the timeout. The files of the probe timed out are
+// discarded.
+func (d *diagnosis) run(name string, f probeFunc) *DiagnoseProbe {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+
+	type result struct {
+		msg   string
+		files []diagnoseFile
+		err   error
+	}
+	ch := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		defer func() {
+			// a broken probe does not stop the others
+			if r := recover(); r != nil {
+				ch <- result{err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+		msg, files, err := f(ctx)
+		ch <- result{msg, files, err}
+	}()
+
+	p := &DiagnoseProbe{Name: name}
+	select {
+	case r := <-ch:
+		p.Message = r.msg
+		switch err := r.err.(type) {
+		case nil:
+			p.Result = DiagnosePass
+		case skippedError:
+			p.Result = DiagnoseSkip
+			p.Message = err.Error()
+		default:
+			p.Result = DiagnoseFail
+			p.Message = err.Error()
+		}
+		for _, file := range r.files {
+			file.data = []byte(d.redact(string(file.data)))
+			d.files = append(d.files, file)
+		}
+	case <-ctx.Done():
+		p.Result = DiagnoseFail
+		p.Message = fmt.Sprintf("timed out after %s", d.opts.Timeout)
+	}
+	p.Elapsed = time.Since(start)
+	p.Message = d.redact(p.Message)
+	d.probes = append(d.probes, p)
+	return p
+}
+
+// runAfter runs the probe only if the probe it depends on passed.
+func (d *diagnosis) runAfter(dep *DiagnoseProbe, name string, f probeFunc) *DiagnoseProbe {
+	if dep.Result == DiagnosePass {
+		return d.run(name, f)
+	}
+	p := &DiagnoseProbe{
+		Name:    name,
+		Result:  DiagnoseSkip,
+		Message: fmt.Sprintf("skipped since the %s probe did not pass", dep.Name),
+	}
+	d.probes = append(d.probes, p)
+	return p
+}
+
+// writeSummary writes the table of the probes and returns the number of the failures.
+func (d *diagnosis) writeSummary(w io.Writer) int {
+	var failed int
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROBE\tRESULT\tELAPSED\tMESSAGE")
+	for _, p := range d.probes {
+		if p.Result == DiagnoseFail {
+			failed++
+		}
+		msg := strings.Replace(p.Message, "\n", " ", -1)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Name, strings.ToUpper(p.Result), p.Elapsed.Round(time.Millisecond), msg)
+	}
+	tw.Flush()
+	return failed
+}
+
+func (d *diagnosis) writeBundle(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	dir := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".gz"), ".tar")
+	now := time.Now()
+	for _, df := range d.files {
+		h := &tar.Header{
+			Name:    dir + "/" + df.name,
+			Mode:    0600,
+			Size:    int64(len(df.data)),
+			ModTime: now,
+		}
+		if err = tw.WriteHeader(h); err != nil {
+			break
+		}
+		if _, err = tw.Write(df.data); err != nil {
+			break
+		}
+	}
+	for _, c := range []io.Closer{tw, gw, f} {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (d *diagnosis) probeVersion(ctx context.Context) (string, []diagnoseFile, error) {
+	s := fmt.Sprintf("mackerel-agent version %s (rev %s) [%s %s %s]",
+		d.ameta.Version, d.ameta.Revision, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	return s, []diagnoseFile{{name: "version.txt", data: []byte(s + "\n")}}, nil
+}
+
+func (d *diagnosis) probeConfig(ctx context.Context) (string, []diagnoseFile, error) {
+	data, err := redactConfig(d.conf)
+	if err != nil {
+		return "", nil, err
+	}
+	files := []diagnoseFile{{name: "config.json", data: data}}
+	if d.opts.ConfigError != nil {
+		return "", files, d.opts.ConfigError
+	}
+	if err := d.conf.VerifyCommands(); err != nil {
+		return "", files, err
+	}
+	return d.conf.Conffile, files, nil
+}
+
+func (d *diagnosis) probeOS(ctx context.Context) (string, []diagnoseFile, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", nil, err
+	}
+	meta := spec.Collect(collector.SystemSpecGenerators())
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"hostname": hostname,
+		"os":       runtime.GOOS,
+		"arch":     runtime.GOARCH,
+		"kernel":   meta.Kernel,
+		"cpu":      len(meta.CPU),
+		"memory":   meta.Memory,
+	}, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	msg := runtime.GOOS
+	if release, ok := meta.Kernel["release"]; ok {
+		msg += " " + release
+	}
+	return msg, []diagnoseFile{{name: "os.json", data: data}}, nil
+}
+
+// the maximum size of the log file read to find the last lines
+const maxDiagnoseLogBytes = 1 << 20
+
+func (d *diagnosis) probeLog(ctx context.Context) (string, []diagnoseFile, error) {
+	if d.conf.LogFile == "" {
+		return "", nil, skippedError("log_file is not configured")
+	}
+	f, err := os.Open(d.conf.LogFile)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.Size() > maxDiagnoseLogBytes {
+		if _, err := f.Seek(-maxDiagnoseLogBytes, io.SeekEnd); err != nil {
+			return "", nil, err
+		}
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if fi.Size() > maxDiagnoseLogBytes && len(lines) > 1 {
+		// the first line may be cut in the middle
+		lines = lines[1:]
+	}
+	if len(lines) > d.opts.LogLines {
+		lines = lines[len(lines)-d.opts.LogLines:]
+	}
+	msg := fmt.Sprintf("the last %d lines of %s", len(lines), d.conf.LogFile)
+	return msg, []diagnoseFile{{name: "log.txt", data: []byte(strings.Join(lines, "\n") + "\n")}}, nil
+}
+
+func (d *diagnosis) probeAgent(ctx context.Context) (string, []diagnoseFile, error) {
+	st, err := FetchStatus(d.conf)
+	if err != nil {
+		return "", nil, skippedError(fmt.Sprintf("the running agent is not found: %s", err))
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	msg := fmt.Sprintf("running for %s", time.Duration(st.UptimeSeconds)*time.Second)
+	return msg, []diagnoseFile{{name: "status.json", data: data}}, nil
+}
+
+func (d *diagnosis) probeConnectivity(ctx context.Context) (string, []diagnoseFile, error) {
+	u, err := url.Parse(d.conf.Apibase)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Hostname() == "" {
+		return "", nil, fmt.Errorf("the apibase is invalid: %q", d.conf.Apibase)
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(d.conf.Apibase, "/")+"/", nil)
+	if err != nil {
+		return "", nil, err
+	}
+	proxy := ConfigProxy(d.conf)
+	// the proxy resolves the host instead
+	if p, err := proxy(req); err == nil && p == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			return "", nil, fmt.Errorf("failed to resolve %s: %s", u.Hostname(), err)
+		}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: proxy, DialContext: ConfigDialContext(d.conf)},
+		// the response itself is the proof of the connectivity
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+	resp.Body.Close()
+	return fmt.Sprintf("%s responded %s in %s", d.conf.Apibase, resp.Status, time.Since(start).Round(time.Millisecond)), nil, nil
+}
+
+func (d *diagnosis) newAPI() (*mackerel.API, error) {
+	api, err := NewMackerelClient(d.conf.Apibase, d.conf.Apikey, d.ameta.Version, d.ameta.Revision, false)
+	if err != nil {
+		return nil, err
+	}
+	SetHTTPHeaders(api, d.conf)
+	return api, nil
+}
+
+func (d *diagnosis) probeAPIKey(ctx context.Context) (string, []diagnoseFile, error) {
+	if d.conf.Apikey == "" {
+		return "", nil, skippedError("the API key is not configured")
+	}
+	api, err := d.newAPI()
+	if err != nil {
+		return "", nil, err
+	}
+	org, err := api.GetOrg()
+	if err != nil {
+		if mackerel.IsAuthError(err) {
+			return "", nil, fmt.Errorf("the API key is rejected: %s", err)
+		}
+		return "", nil, err
+	}
+	return fmt.Sprintf("the organization is %s", org.Name), nil, nil
+}
+
+func (d *diagnosis) probeHost(ctx context.Context) (string, []diagnoseFile, error) {
+	hostID, err := d.conf.LoadHostID()
+	if err != nil {
+		return "", nil, skippedError(fmt.Sprintf("the host is not registered yet: %s", err))
+	}
+	api, err := d.newAPI()
+	if err != nil {
+		return "", nil, err
+	}
+	host, err := api.FindHost(hostID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find the host %s: %s", hostID, err)
+	}
+	return fmt.Sprintf("the host %s (%s) is %s", host.ID, host.Name, host.Status), nil, nil
+}
+
+func (d *diagnosis) probeOnce(ctx context.Context) (string, []diagnoseFile, error) {
+	var buf bytes.Buffer
+	err := RunOnceJSON(d.conf, d.ameta, &buf)
+	files := []diagnoseFile{{name: "once.json", data: buf.Bytes()}}
+	if err != nil {
+		return "", files, err
+	}
+	return "collected the host specs, the metrics and the checks", files, nil
+}
+
+const redacted = "[REDACTED]"
+
+// diagnoseSecrets returns the secrets in the configuration which are
+// redacted wherever they appear.
+func diagnoseSecrets(conf *config.Config) []string {
+	var secrets []string
+	add := func(s string) {
+		if len(s) >= 4 {
+			secrets = append(secrets, s)
+		}
+	}
+	add(conf.Apikey)
+	if conf.Secondary != nil {
+		add(conf.Secondary.Apikey)
+	}
+	if u, err := url.Parse(conf.HTTPProxy); err == nil && u.User != nil {
+		p, _ := u.User.Password()
+		add(p)
+	}
+	for _, auth := range listenerAuths(conf) {
+		add(auth.BearerToken)
+		add(auth.Password)
+	}
+	return secrets
+}
+
+var (
+	secretKeyPattern = regexp.MustCompile(`(?i)apikey|api_key|password|passphrase|passwd|secret|token|community|credential|authorization|headers`)
+
+	urlUserinfoPattern = regexp.MustCompile(`(\w+://[^/\s:@]+:)[^/\s@]+@`)
+	secretArgPattern   = regexp.MustCompile(`(?i)((?:^|[\s"'{,])-{0,2}[\w.-]*(?:apikey|api[_-]key|password|passwd|secret|token|community)[\w.-]*["']?\s*[=:]\s*["']?|(?:^|\s)-{1,2}[\w-]*(?:apikey|api-key|password|passwd|secret|token)[\w-]*\s+)[^\s"',}]+`)
+)
+
+// redact replaces the secrets of the configuration, the passwords in the URLs
+// and the values of the secret-like options in s.
+func (d *diagnosis) redact(s string) string {
+	for _, secret := range d.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return redactString(s)
+}
+
+func redactString(s string) string {
+	s = urlUserinfoPattern.ReplaceAllString(s, "${1}"+redacted+"@")
+	return secretArgPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactConfig returns the configuration as JSON, whose values of the
+// secret-like keys and the environments of the commands are redacted.
+func redactConfig(conf *config.Config) ([]byte, error) {
+	return json.MarshalIndent(redactValue("", reflect.ValueOf(conf)), "", "  ")
+}
+
+// redactValue converts v to the value to be marshaled. The structs are
+// converted to the maps of the exported fields, and the types with String,
+// such as *regexp.Regexp and config.Duration, to the strings.
+func redactValue(key string, v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer, reflect.Invalid:
+		return nil
+	}
+	if v.CanInterface() {
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			str, ok := stringOf(s)
+			if !ok {
+				return nil
+			}
+			return redactLeaf(key, str)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return redactValue(key, v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				m[f.Name] = redactValue(f.Name, v.Field(i))
+			}
+		}
+		return m
+	case reflect.Map:
+		m := make(map[string]interface{})
+		for _, k := range v.MapKeys() {
+			ks := fmt.Sprint(k.Interface())
+			m[ks] = redactValue(ks, v.MapIndex(k))
+		}
+		return redactLeaf(key, m)
+	case reflect.Slice, reflect.Array:
+		a := make([]interface{}, v.Len())
+		var secretOpt bool
+		for i := range a {
+			e := redactValue(key, v.Index(i))
+			if s, ok := e.(string); ok {
+				switch {
+				case key == "Env":
+					// the values of the environments may be any secrets
+					if i := strings.Index(s, "="); i >= 0 {
+						e = s[:i+1] + redacted
+					}
+				case key == "Args" && secretOpt:
+					// such as ["--password", "secret"]
+					e = redacted
+				}
+				secretOpt = strings.HasPrefix(s, "-") && !strings.Contains(s, "=") && secretKeyPattern.MatchString(s)
+			}
+			a[i] = e
+		}
+		return a
+	case reflect.String:
+		return redactLeaf(key, v.String())
+	}
+	if v.CanInterface() {
+		return redactLeaf(key, v.Interface())
+	}
+	return nil
+}
+
+// stringOf returns false if String panics, as config.Regexpwrapper does
+// without the regexp.
+func stringOf(s fmt.Stringer) (str string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return s.String(), true
+}
+
+// redactLeaf redacts v if key is secret-like. The zero values are left to
+// show that they are not configured.
+func redactLeaf(key string, v interface{}) interface{} {
+	if secretKeyPattern.MatchString(key) && !isZero(v) {
+		return redacted
+	}
+	if s, ok := v.(string); ok {
+		return redactString(s)
+	}
+	return v
+}
+
+// isZero reports whether v is nil or the zero value of its type.
+func isZero(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	return reflect.DeepEqual(v, reflect.Zero(rv.Type()).Interface())
+}
@@ -0,0 +1,272 @@
+package command
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// doctorTimeout limits the whole steps of DoctorAPI.
+var doctorTimeout = 30 * time.Second
+
+// DoctorResult is the result of DoctorAPI.
+type DoctorResult struct {
+	Apibase string        `json:"apibase"`
+	Proxy   string        `json:"proxy,omitempty"`
+	Steps   []*DoctorStep `json:"steps"`
+}
+
+// DoctorStep is a step of DoctorAPI, whose Result is DiagnosePass,
+// DiagnoseFail or DiagnoseSkip.
+type DoctorStep struct {
+	Name      string  `json:"name"`
+	Result    string  `json:"result"`
+	Message   string  `json:"message"`
+	LatencyMs float64 `json:"latencyMs"`
+	// TLSVersion and Certificates are the negotiated version and the subjects
+	// of the certificate chain of the tls step.
+	TLSVersion   string   `json:"tlsVersion,omitempty"`
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+// Failed returns the first failed step, or nil if none of them failed.
+func (r *DoctorResult) Failed() *DoctorStep {
+	for _, s := range r.Steps {
+		if s.Result == DiagnoseFail {
+			return s
+		}
+	}
+	return nil
+}
+
+// DoctorAPI checks the connectivity to the API with the API key via the
+// proxy of the configuration by the steps: resolving the host, connecting to
+// it, the TLS handshake and an authenticated API call which changes nothing.
+// The steps after the first failure are skipped.
+func DoctorAPI(conf *config.Config) *DoctorResult {
+	return doctorAPI(conf, nil)
+}
+
+func doctorAPI(conf *config.Config, tlsConfig *tls.Config) *DoctorResult {
+	result := &DoctorResult{Apibase: conf.Apibase}
+	steps := map[string]*DoctorStep{}
+	for _, name := range []string{"dns", "connect", "tls", "api"} {
+		steps[name] = &DoctorStep{Name: name, Result: DiagnoseSkip}
+		result.Steps = append(result.Steps, steps[name])
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(conf.Apibase, "/")+"/api/v0/org", nil)
+	if err != nil {
+		steps["dns"].fail(err.Error())
+		return result
+	}
+	req.Header.Set("X-Api-Key", conf.Apikey)
+	proxy := ConfigProxy(conf)
+	proxyURL, err := proxy(req)
+	if err != nil {
+		steps["dns"].fail(fmt.Sprintf("invalid proxy: %s", err))
+		return result
+	}
+	if proxyURL != nil {
+		result.Proxy = redactString(proxyURL.String())
+	}
+	if req.URL.Scheme != "https" {
+		steps["tls"].Message = "the apibase is not https"
+	}
+
+	var (
+		mu                            sync.Mutex
+		dnsStart, connStart, tlsStart time.Time
+		wroteAt                       time.Time
+		connErr                       error
+	)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			s := steps["dns"]
+			s.LatencyMs = millis(time.Since(dnsStart))
+			if info.Err != nil {
+				s.fail(info.Err.Error())
+				return
+			}
+			addrs := make([]string, len(info.Addrs))
+			for i, a := range info.Addrs {
+				addrs[i] = a.String()
+			}
+			s.pass(strings.Join(addrs, ", "))
+		},
+		ConnectStart: func(_, _ string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if connStart.IsZero() {
+				connStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			steps["connect"].LatencyMs = millis(time.Since(connStart))
+			// one of the addresses may fail and the other succeed
+			if err != nil {
+				connErr = err
+				return
+			}
+			steps["connect"].pass(addr)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			s := steps["tls"]
+			s.LatencyMs = millis(time.Since(tlsStart))
+			if err != nil {
+				s.fail(err.Error())
+				return
+			}
+			s.TLSVersion = tlsVersionName(state.Version)
+			for _, c := range state.PeerCertificates {
+				s.Certificates = append(s.Certificates, c.Subject.String())
+			}
+			s.pass(fmt.Sprintf("%s with %s", s.TLSVersion, state.ServerName))
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wroteAt = time.Now()
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             proxy,
+			DialContext:       ConfigDialContext(conf),
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if net.ParseIP(hostOf(req.URL, proxyURL)) != nil && steps["dns"].Result == DiagnoseSkip {
+		steps["dns"].Message = "the address is not resolved"
+	}
+	if err != nil {
+		// the error is reported at the first step which did not pass
+		for _, s := range result.Steps {
+			if s.Result == DiagnoseFail {
+				return result
+			}
+			if s.Result == DiagnoseSkip && s.Message == "" {
+				if s.Name == "connect" && connErr != nil {
+					err = connErr
+				}
+				s.fail(err.Error())
+				return result
+			}
+		}
+		steps["api"].fail(err.Error())
+		return result
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	s := steps["api"]
+	s.LatencyMs = millis(time.Since(wroteAt))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var org struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(body, &org)
+		s.pass(fmt.Sprintf("the API key is valid for the organization %q", org.Name))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		s.fail(fmt.Sprintf("the API key is rejected: %s", resp.Status))
+	default:
+		s.fail(fmt.Sprintf("unexpected response: %s", resp.Status))
+	}
+	return result
+}
+
+func (s *DoctorStep) pass(msg string) {
+	s.Result = DiagnosePass
+	s.Message = msg
+}
+
+func (s *DoctorStep) fail(msg string) {
+	s.Result = DiagnoseFail
+	s.Message = redactString(msg)
+}
+
+// hostOf returns the host to be connected to, which is the proxy if any.
+func hostOf(u, proxy *url.URL) string {
+	if proxy != nil {
+		return proxy.Hostname()
+	}
+	return u.Hostname()
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// WriteText writes the result in the human readable format.
+func (r *DoctorResult) WriteText(w io.Writer) error {
+	proxy := r.Proxy
+	if proxy == "" {
+		proxy = "none"
+	}
+	fmt.Fprintf(w, "Apibase: %s\nProxy:   %s\n\n", r.Apibase, proxy)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tRESULT\tLATENCY\tMESSAGE")
+	for _, s := range r.Steps {
+		latency := "-"
+		if s.LatencyMs > 0 {
+			latency = fmt.Sprintf("%.1fms", s.LatencyMs)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, strings.ToUpper(s.Result), latency, s.Message)
+		for _, c := range s.Certificates {
+			fmt.Fprintf(tw, "\t\t\t  %s\n", c)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,79 @@
+package command
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestDoctorAPI(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v0/org" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Header.Get("X-Api-Key") != "valid-apikey" {
+			http.Error(w, `{"error":{"message":"Authentication failed. Please try with valid Api Key."}}`, http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"name":"example"}`))
+	}))
+	defer ts.Close()
+	tlsConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	result := doctorAPI(&config.Config{Apibase: ts.URL, Apikey: "valid-apikey"}, tlsConfig)
+	if s := result.Failed(); s != nil {
+		t.Fatalf("any steps should not fail: %+v", s)
+	}
+	expect := map[string]string{"dns": DiagnoseSkip, "connect": DiagnosePass, "tls": DiagnosePass, "api": DiagnosePass}
+	for _, s := range result.Steps {
+		if s.Result != expect[s.Name] {
+			t.Errorf("the result of %s should be %s: %+v", s.Name, expect[s.Name], s)
+		}
+	}
+	if s := result.Steps[2]; s.TLSVersion == "" || len(s.Certificates) == 0 {
+		t.Errorf("the TLS version and the certificates should be reported: %+v", s)
+	}
+	if s := result.Steps[3]; !strings.Contains(s.Message, `"example"`) {
+		t.Errorf("the organization should be reported: %+v", s)
+	}
+	var out bytes.Buffer
+	if err := result.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "api      PASS") {
+		t.Errorf("the result should be written: %s", out.String())
+	}
+
+	result = doctorAPI(&config.Config{Apibase: ts.URL, Apikey: "invalid-apikey"}, tlsConfig)
+	if s := result.Failed(); s == nil || s.Name != "api" || !strings.Contains(s.Message, "rejected") {
+		t.Errorf("the invalid API key should be rejected: %+v", s)
+	}
+
+	// the certificate of the server is not trusted without tlsConfig
+	result = doctorAPI(&config.Config{Apibase: ts.URL, Apikey: "valid-apikey"}, nil)
+	if s := result.Failed(); s == nil || s.Name != "tls" {
+		t.Errorf("the tls step should fail: %+v", s)
+	}
+	if s := result.Steps[3]; s.Result != DiagnoseSkip {
+		t.Errorf("the steps after the failure should be skipped: %+v", s)
+	}
+}
+
+func TestDoctorAPI_connectFailure(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	apibase := ts.URL
+	ts.Close()
+
+	result := doctorAPI(&config.Config{Apibase: apibase, Apikey: "valid-apikey"}, nil)
+	if s := result.Failed(); s == nil || s.Name != "connect" {
+		t.Errorf("the connect step should fail: %+v", s)
+	}
+	if s := result.Steps[2]; s.Result != DiagnoseSkip || s.Message != "the apibase is not https" {
+		t.Errorf("the tls step should be skipped: %+v", s)
+	}
+}
@@ -0,0 +1,96 @@
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// graphDefsFile keeps the digests of the graph definitions of the plugins
+// posted to Mackerel, not to post the unchanged ones on every start.
+func graphDefsFile(conf *config.Config) string {
+	return filepath.Join(conf.Root, "graphdefs.json")
+}
+
+type graphDefsDigests struct {
+	// Destination is the digest of the apibase and the apikey, which
+	// invalidates the digests of the graph definitions when they change.
+	Destination string `json:"destination"`
+	// GraphDefs are the digests of the graph definitions keyed by the names.
+	GraphDefs map[string]string `json:"graphDefs"`
+}
+
+func digest(v interface{}) string {
+	b, _ := json.Marshal(v)
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+func loadGraphDefsDigests(conf *config.Config) *graphDefsDigests {
+	digests := &graphDefsDigests{
+		Destination: digest([]string{conf.Apibase, conf.Apikey}),
+		GraphDefs:   make(map[string]string),
+	}
+	content, err := ioutil.ReadFile(graphDefsFile(conf))
+	if err != nil {
+		return digests
+	}
+	var saved graphDefsDigests
+	if err := json.Unmarshal(content, &saved); err != nil {
+		logger.Warningf("Failed to load the digests of the graph definitions: %s", err)
+		return digests
+	}
+	if saved.Destination == digests.Destination && saved.GraphDefs != nil {
+		digests.GraphDefs = saved.GraphDefs
+	}
+	return digests
+}
+
+// changed returns the graph definitions whose digests differ from the saved ones.
+func (d *graphDefsDigests) changed(payloads []*mkr.GraphDefsParam) []*mkr.GraphDefsParam {
+	var results []*mkr.GraphDefsParam
+	for _, p := range payloads {
+		if d.GraphDefs[p.Name] != digest(p) {
+			results = append(results, p)
+		}
+	}
+	return results
+}
+
+func (d *graphDefsDigests) save(conf *config.Config, payloads []*mkr.GraphDefsParam) error {
+	for _, p := range payloads {
+		d.GraphDefs[p.Name] = digest(p)
+	}
+	content, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomically(graphDefsFile(conf), content, 0644)
+}
+
+// createGraphDefs posts the graph definitions of the plugins or the built-in
+// metrics which have changed since the last post, or all of them with
+// -force-graphdef.
+func createGraphDefs(app *App, payloads []*mkr.GraphDefsParam) {
+	digests := loadGraphDefsDigests(app.Config)
+	if !app.Config.ForceGraphDefs {
+		payloads = digests.changed(payloads)
+	}
+	if len(payloads) == 0 {
+		logger.Debugf("The graph definitions are not changed.")
+		return
+	}
+	if err := app.API.CreateGraphDefs(payloads); err != nil {
+		logger.Errorf("Failed to create graphdefs: %s", err)
+		return
+	}
+	if err := digests.save(app.Config, payloads); err != nil {
+		logger.Warningf("Failed to save the digests of the graph definitions: %s", err)
+	}
+}
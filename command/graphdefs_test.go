@@ -0,0 +1,58 @@
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestCreateGraphDefs(t *testing.T) {
+	conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	var posted []int
+	mockHandlers["POST /api/v0/graph-defs/create"] = func(req *http.Request) (int, jsonObject) {
+		var payloads []*mkr.GraphDefsParam
+		json.NewDecoder(req.Body).Decode(&payloads)
+		posted = append(posted, len(payloads))
+		return 200, jsonObject{"success": true}
+	}
+
+	conf.Apikey = "apikey"
+	api, err := mackerel.NewAPI(ts.URL, conf.Apikey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{API: api, Config: &conf}
+	payloads := func(unit string) []*mkr.GraphDefsParam {
+		return []*mkr.GraphDefsParam{
+			{Name: "custom.a", Unit: unit, Metrics: []*mkr.GraphDefsMetric{{Name: "custom.a.x"}}},
+			{Name: "custom.b", Unit: "integer", Metrics: []*mkr.GraphDefsMetric{{Name: "custom.b.y"}}},
+		}
+	}
+
+	createGraphDefs(app, payloads("float"))
+	createGraphDefs(app, payloads("float"))
+	createGraphDefs(app, payloads("percentage"))
+
+	conf.ForceGraphDefs = true
+	createGraphDefs(app, payloads("percentage"))
+	conf.ForceGraphDefs = false
+
+	// The digests are invalidated by the other apikey.
+	conf.Apikey = "another"
+	createGraphDefs(app, payloads("percentage"))
+
+	expected := []int{2, 1, 2, 2}
+	if len(posted) != len(expected) {
+		t.Fatalf("the graph definitions should be posted as %v but %v", expected, posted)
+	}
+	for i := range expected {
+		if posted[i] != expected[i] {
+			t.Errorf("the graph definitions should be posted as %v but %v", expected, posted)
+		}
+	}
+}
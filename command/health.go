@@ -0,0 +1,135 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// defaultHealthMaxPostAge is the default maximum age of the last successful
+// post of the metrics to be ready.
+const defaultHealthMaxPostAge = 5 * time.Minute
+
+// healthMaxPostAge returns the maximum age of the last successful post of the
+// metrics to answer /readyz with 200.
+func healthMaxPostAge(conf *config.Config) time.Duration {
+	if conf != nil && conf.Health != nil && conf.Health.MaxPostAge != nil {
+		return conf.Health.MaxPostAge.Duration
+	}
+	return defaultHealthMaxPostAge
+}
+
+// runHealthServer serves the health endpoint until ctx is done.
+func runHealthServer(ctx context.Context, app *App) {
+	conf := app.Config.Health
+	e := &localHTTP{
+		name:    "health",
+		listen:  conf.Listen,
+		auth:    conf.Auth,
+		tls:     conf.TLS,
+		handler: newHealthHandler(app),
+	}
+	e.serve(ctx)
+}
+
+type healthResponse struct {
+	Status        string     `json:"status"`
+	Reason        string     `json:"reason,omitempty"`
+	HostID        string     `json:"hostId,omitempty"`
+	UptimeSeconds int64      `json:"uptimeSeconds"`
+	LastPostedAt  *time.Time `json:"lastPostedAt,omitempty"`
+	LastFailedAt  *time.Time `json:"lastFailedAt,omitempty"`
+}
+
+// newHealthHandler serves GET /healthz, which is 200 while the main loop is
+// running, and GET /readyz, which is 200 while the last post of the metrics
+// within max_post_age succeeded. Neither of them request the API.
+func newHealthHandler(app *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		if !allowHealthMethod(w, req) {
+			return
+		}
+		res, running := app.healthResponse()
+		if !running {
+			res.Status = "unavailable"
+			res.Reason = "the main loop is not running"
+			writeHealthResponse(w, http.StatusServiceUnavailable, res)
+			return
+		}
+		res.Status = "ok"
+		writeHealthResponse(w, http.StatusOK, res)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if !allowHealthMethod(w, req) {
+			return
+		}
+		res, running := app.healthResponse()
+		if reason := readinessFailure(res, running, app.Config != nil, healthMaxPostAge(app.Config), time.Now()); reason != "" {
+			res.Status = "not ready"
+			res.Reason = reason
+			writeHealthResponse(w, http.StatusServiceUnavailable, res)
+			return
+		}
+		res.Status = "ready"
+		writeHealthResponse(w, http.StatusOK, res)
+	})
+	return mux
+}
+
+// healthResponse returns the details of the health, and whether the main loop is running.
+func (app *App) healthResponse() (*healthResponse, bool) {
+	res := &healthResponse{}
+	if app.Host != nil {
+		res.HostID = app.Host.ID
+	}
+	r := app.status
+	if r == nil {
+		return res, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res.UptimeSeconds = int64(time.Since(r.startedAt) / time.Second)
+	if t, ok := r.lastPostedAt[statusKindMetrics]; ok {
+		res.LastPostedAt = &t
+	}
+	if t, ok := r.lastFailedAt[statusKindMetrics]; ok {
+		res.LastFailedAt = &t
+	}
+	return res, r.running
+}
+
+// readinessFailure returns the reason why the agent is not ready, or "" if it is ready.
+func readinessFailure(res *healthResponse, running, configLoaded bool, maxPostAge time.Duration, now time.Time) string {
+	switch {
+	case !running:
+		return "the main loop is not running"
+	case !configLoaded || res.HostID == "":
+		return "the configuration is not loaded"
+	case res.LastPostedAt == nil:
+		return "the metrics have not been posted yet"
+	case res.LastFailedAt != nil && res.LastFailedAt.After(*res.LastPostedAt):
+		return "the last post of the metrics failed"
+	case now.Sub(*res.LastPostedAt) > maxPostAge:
+		return "the metrics have not been posted in " + maxPostAge.String()
+	}
+	return ""
+}
+
+func allowHealthMethod(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, res *healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,86 @@
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestHealthHandler(t *testing.T) {
+	app := &App{Config: &config.Config{}, Host: &mkr.Host{ID: "xyzabc12345"}, status: newStatusRecorder()}
+	ts := httptest.NewServer(newHealthHandler(app))
+	defer ts.Close()
+
+	get := func(path string) (int, *healthResponse) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res healthResponse
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("the response of %s should be JSON: %s", path, err)
+		}
+		return resp.StatusCode, &res
+	}
+
+	if code, res := get("/healthz"); code != http.StatusServiceUnavailable || res.Status != "unavailable" {
+		t.Errorf("/healthz should be unavailable before the main loop runs: %d %+v", code, res)
+	}
+	app.status.setRunning(true)
+	if code, res := get("/healthz"); code != http.StatusOK || res.Status != "ok" || res.HostID != "xyzabc12345" {
+		t.Errorf("/healthz should be ok while the main loop runs: %d %+v", code, res)
+	}
+	if code, res := get("/readyz"); code != http.StatusServiceUnavailable || res.Reason != "the metrics have not been posted yet" {
+		t.Errorf("/readyz should not be ready before posting: %d %+v", code, res)
+	}
+	app.status.posted(statusKindMetrics)
+	if code, res := get("/readyz"); code != http.StatusOK || res.Status != "ready" || res.LastPostedAt == nil {
+		t.Errorf("/readyz should be ready after posting: %d %+v", code, res)
+	}
+	time.Sleep(10 * time.Millisecond)
+	app.status.postFailed(statusKindMetrics)
+	if code, res := get("/readyz"); code != http.StatusServiceUnavailable || res.Reason != "the last post of the metrics failed" {
+		t.Errorf("/readyz should not be ready after the failure: %d %+v", code, res)
+	}
+
+	resp, err := http.Post(ts.URL+"/healthz", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /healthz should not be allowed but %d", resp.StatusCode)
+	}
+}
+
+func TestReadinessFailure(t *testing.T) {
+	now := time.Now()
+	posted := now.Add(-2 * time.Minute)
+	old := now.Add(-10 * time.Minute)
+	testCases := []struct {
+		res          healthResponse
+		running      bool
+		configLoaded bool
+		ready        bool
+	}{
+		{healthResponse{HostID: "a", LastPostedAt: &posted}, true, true, true},
+		{healthResponse{HostID: "a", LastPostedAt: &posted, LastFailedAt: &old}, true, true, true},
+		{healthResponse{HostID: "a", LastPostedAt: &posted}, false, true, false},
+		{healthResponse{HostID: "a", LastPostedAt: &posted}, true, false, false},
+		{healthResponse{LastPostedAt: &posted}, true, true, false},
+		{healthResponse{HostID: "a", LastPostedAt: &old}, true, true, false},
+	}
+	for _, tc := range testCases {
+		reason := readinessFailure(&tc.res, tc.running, tc.configLoaded, defaultHealthMaxPostAge, now)
+		if tc.ready != (reason == "") {
+			t.Errorf("readiness of %+v (running: %t, configLoaded: %t) should be %t but %q", tc.res, tc.running, tc.configLoaded, tc.ready, reason)
+		}
+	}
+}
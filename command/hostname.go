@@ -0,0 +1,28 @@
+package command
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// lastHostnameFile is the file to store the hostname which the host was
+// registered or updated with, in order to detect that the host is renamed.
+func lastHostnameFile(conf *config.Config) string {
+	return filepath.Join(conf.Root, "hostname")
+}
+
+func loadLastHostname(conf *config.Config) string {
+	content, err := ioutil.ReadFile(lastHostnameFile(conf))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(content), "\r\n")
+}
+
+func saveLastHostname(conf *config.Config, hostname string) error {
+	return util.WriteFileAtomically(lastHostnameFile(conf), []byte(hostname), 0644)
+}
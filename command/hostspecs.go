@@ -0,0 +1,163 @@
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/collector"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/spec"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var (
+	defaultHostSpecsExpensiveInterval = 6 * time.Hour
+	defaultCloudDetectionTimeout      = 3 * time.Second
+)
+
+// hostSpecsExpensiveInterval returns the interval to collect the expensive host specs.
+func hostSpecsExpensiveInterval(conf *config.Config) time.Duration {
+	if conf.HostSpecsExpensiveInterval != nil {
+		return conf.HostSpecsExpensiveInterval.Duration
+	}
+	return defaultHostSpecsExpensiveInterval
+}
+
+// cloudDetectionTimeout returns the maximum duration to wait for the cloud metadata at startup.
+func cloudDetectionTimeout(conf *config.Config) time.Duration {
+	if conf.CloudDetectionTimeout != nil {
+		return conf.CloudDetectionTimeout.Duration
+	}
+	return defaultCloudDetectionTimeout
+}
+
+// expensiveSpecs are the host specs which take time to collect, such as the
+// filesystems of the hosts mounting thousands of them, and the cloud
+// metadata fetched from the metadata endpoint.
+type expensiveSpecs struct {
+	filesystem       mkr.FileSystem
+	cloud            *mkr.Cloud
+	customIdentifier string
+}
+
+// collectExpensiveSpecs is replaced in the tests.
+var collectExpensiveSpecs = func(conf *config.Config) *expensiveSpecs {
+	gens := []spec.Generator{collector.FilesystemSpecGenerator()}
+	cGen := spec.SuggestCloudGenerator(conf)
+	if cGen != nil {
+		gens = append(gens, cGen)
+	}
+	meta := spec.Collect(gens)
+	exp := &expensiveSpecs{filesystem: meta.Filesystem, cloud: meta.Cloud}
+	if cGen != nil {
+		var err error
+		exp.customIdentifier, err = cGen.SuggestCustomIdentifier()
+		if err != nil {
+			logger.Warningf("Error while suggesting custom identifier. err: %s", err.Error())
+		}
+	}
+	return exp
+}
+
+// hostSpecsCache keeps the expensive specs and the hash of the specs last
+// updated. The mutex serializes the updates of the host specs.
+type hostSpecsCache struct {
+	mu          sync.Mutex
+	last        *expensiveSpecs
+	collectedAt time.Time
+	postedHash  string
+	// pending receives the specs given up by collectWithin, which are taken
+	// by the next update.
+	pending <-chan *expensiveSpecs
+}
+
+// collectWithin collects the expensive specs, but gives up them if they are
+// not collected in timeout, such as on the hosts where the metadata endpoints
+// do not respond. It reports whether the specs are collected. The collection
+// continues in the background, to be reused by the next update.
+func (c *hostSpecsCache) collectWithin(conf *config.Config, timeout time.Duration) (*expensiveSpecs, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan *expensiveSpecs, 1)
+	go func() {
+		ch <- collectExpensiveSpecs(conf)
+	}()
+	select {
+	case exp := <-ch:
+		c.last, c.collectedAt = exp, time.Now()
+		return exp, true
+	case <-time.After(timeout):
+		logger.Infof("The filesystems and the cloud metadata are not collected in %s. They are updated later", timeout)
+		c.pending = ch
+		return &expensiveSpecs{}, false
+	}
+}
+
+// expensive returns the expensive specs, which are collected again if the
+// interval has passed or force is true.
+func (c *hostSpecsCache) expensive(conf *config.Config, force bool, now time.Time) *expensiveSpecs {
+	if c.pending != nil {
+		// the specs in progress are fresh enough even if forced
+		c.last, c.collectedAt = <-c.pending, now
+		c.pending = nil
+		return c.last
+	}
+	if force || c.last == nil || now.Sub(c.collectedAt) >= hostSpecsExpensiveInterval(conf) {
+		c.last = collectExpensiveSpecs(conf)
+		c.collectedAt = now
+	} else {
+		logger.Debugf("Reusing the filesystems and the cloud metadata collected at %s", c.collectedAt.Format(time.RFC3339))
+	}
+	return c.last
+}
+
+var volatileFilesystemSpecs = map[string]bool{"kb_used": true, "kb_available": true, "percent_used": true}
+
+// hashHostParam returns the hash of the specs to detect the changes. The
+// values which change all the time, such as the free memory, the current
+// clock of the CPUs and the usage of the filesystems, are excluded. The empty string is returned if it fails,
+// which is never regarded as unchanged.
+func hashHostParam(param *mackerel.CreateHostParam) string {
+	p := *param
+	p.Meta.Memory = make(mkr.Memory)
+	for k, v := range param.Meta.Memory {
+		if strings.HasSuffix(k, "total") {
+			p.Meta.Memory[k] = v
+		}
+	}
+	p.Meta.CPU = make(mkr.CPU, len(param.Meta.CPU))
+	for i, c := range param.Meta.CPU {
+		p.Meta.CPU[i] = make(map[string]interface{}, len(c))
+		for k, v := range c {
+			if k != "mhz" {
+				p.Meta.CPU[i][k] = v
+			}
+		}
+	}
+	p.Meta.Filesystem = make(mkr.FileSystem, len(param.Meta.Filesystem))
+	for name, v := range param.Meta.Filesystem {
+		fs, ok := v.(map[string]interface{})
+		if !ok {
+			p.Meta.Filesystem[name] = v
+			continue
+		}
+		stable := make(map[string]interface{}, len(fs))
+		for k, v := range fs {
+			if !volatileFilesystemSpecs[k] {
+				stable[k] = v
+			}
+		}
+		p.Meta.Filesystem[name] = stable
+	}
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
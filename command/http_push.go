@@ -0,0 +1,113 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	// httpPushBodyLimit is the maximum bytes of a request to the push endpoint.
+	httpPushBodyLimit = 1024 * 1024
+	// the range of the time of the pushed metrics
+	httpPushMaxPast   = 24 * time.Hour
+	httpPushMaxFuture = 10 * time.Minute
+)
+
+var httpPushNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// runHTTPPushServer serves the push endpoint, which enqueues the metrics to postQueue.
+func runHTTPPushServer(ctx context.Context, app *App, postQueue chan<- *postValue) {
+	conf := app.Config.HTTPPush
+	e := &localHTTP{
+		name:    "push",
+		listen:  conf.Listen,
+		auth:    conf.Auth,
+		tls:     conf.TLS,
+		handler: newHTTPPushHandler(app, postQueue),
+	}
+	e.serve(ctx)
+}
+
+type pushedMetric struct {
+	Name  string   `json:"name"`
+	Value *float64 `json:"value"`
+	Time  int64    `json:"time"`
+}
+
+func newHTTPPushHandler(app *App, postQueue chan<- *postValue) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeHTTPPushError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+			return
+		}
+		var pushed []*pushedMetric
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, httpPushBodyLimit)).Decode(&pushed); err != nil {
+			writeHTTPPushError(w, http.StatusBadRequest, fmt.Sprintf("invalid metrics: %s", err))
+			return
+		}
+		values, err := convertPushedMetrics(app.Host.ID, pushed, time.Now())
+		if err != nil {
+			writeHTTPPushError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(values) > 0 {
+			select {
+			case postQueue <- newPostValue(values):
+			default:
+				writeHTTPPushError(w, http.StatusServiceUnavailable, "the queue of the metrics is full")
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int{"accepted": len(values)})
+	})
+	return mux
+}
+
+func writeHTTPPushError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// convertPushedMetrics validates the metrics and converts them to the custom
+// metrics of the host. The metrics without the time are of now.
+func convertPushedMetrics(hostID string, pushed []*pushedMetric, now time.Time) ([]*mkr.HostMetricValue, error) {
+	const prefix = "custom."
+	values := make([]*mkr.HostMetricValue, 0, len(pushed))
+	for i, m := range pushed {
+		if m == nil {
+			return nil, fmt.Errorf("metrics[%d]: null", i)
+		}
+		name := strings.TrimPrefix(m.Name, prefix)
+		if !httpPushNamePattern.MatchString(name) || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+			return nil, fmt.Errorf("metrics[%d]: invalid name %q", i, m.Name)
+		}
+		if m.Value == nil || math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return nil, fmt.Errorf("metrics[%d]: %s has no valid value", i, m.Name)
+		}
+		t := m.Time
+		if t == 0 {
+			t = now.Unix()
+		}
+		if t < now.Add(-httpPushMaxPast).Unix() || t > now.Add(httpPushMaxFuture).Unix() {
+			return nil, fmt.Errorf("metrics[%d]: the time of %s is out of range", i, m.Name)
+		}
+		values = append(values, &mkr.HostMetricValue{
+			HostID:      hostID,
+			MetricValue: &mkr.MetricValue{Name: prefix + name, Time: t, Value: *m.Value},
+		})
+	}
+	return values, nil
+}
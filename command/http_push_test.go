@@ -0,0 +1,61 @@
+package command
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestHTTPPushHandler(t *testing.T) {
+	app := &App{Config: &config.Config{}, Host: &mkr.Host{ID: "xyzabc12345"}}
+	postQueue := make(chan *postValue, 1)
+	ts := httptest.NewServer(newHTTPPushHandler(app, postQueue))
+	defer ts.Close()
+
+	now := time.Now().Unix()
+	testCases := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", `{"name": "a"}`, http.StatusBadRequest},
+		{"POST", `[{"name": "job..duration", "value": 1}]`, http.StatusBadRequest},
+		{"POST", `[{"name": "job duration", "value": 1}]`, http.StatusBadRequest},
+		{"POST", `[{"name": "job.duration"}]`, http.StatusBadRequest},
+		{"POST", `[{"name": "job.duration", "value": 1, "time": 1000}]`, http.StatusBadRequest},
+		{"POST", `[{"name": "job.duration", "value": 1, "time": 99999999999}]`, http.StatusBadRequest},
+		{"POST", `[{"name": "job.duration", "value": 1}, {"name": "x", "value": "` + strings.Repeat("a", httpPushBodyLimit) + `"}]`, http.StatusBadRequest},
+		{"POST", `[{"name": "job.duration", "value": 1.5}, {"name": "custom.job.count", "value": 3, "time": ` + strconv.FormatInt(now-60, 10) + `}]`, http.StatusAccepted},
+		// the queue is full
+		{"POST", `[{"name": "job.duration", "value": 1.5}]`, http.StatusServiceUnavailable},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest(tc.method, ts.URL+"/metrics", strings.NewReader(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s should respond %d but %d", tc.method, tc.body, tc.status, resp.StatusCode)
+		}
+	}
+
+	v := <-postQueue
+	if len(v.values) != 2 {
+		t.Fatalf("unexpected values: %+v", v.values)
+	}
+	if v.values[0].HostID != "xyzabc12345" || v.values[0].Name != "custom.job.duration" || v.values[0].Value != 1.5 || v.values[0].Time < now {
+		t.Errorf("unexpected value: %+v", v.values[0].MetricValue)
+	}
+	if v.values[1].Name != "custom.job.count" || v.values[1].Time != now-60 {
+		t.Errorf("unexpected value: %+v", v.values[1].MetricValue)
+	}
+}
@@ -0,0 +1,108 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// InspectPlugin runs the metrics plugin of name once as the agent does, and
+// writes the graph definitions, the values and the warnings parsed from the
+// output to w without posting them. It returns an error if the command failed,
+// or if the graph definitions or the lines of the output can not be parsed.
+func InspectPlugin(conf *config.Config, name string, w io.Writer) error {
+	name = strings.TrimPrefix(name, "metrics.")
+	pconf, ok := conf.MetricPlugins[name]
+	if !ok {
+		for _, p := range conf.DisabledPlugins() {
+			if p == "plugin.metrics."+name {
+				return fmt.Errorf("the plugin %s is disabled by enabled = false", p)
+			}
+		}
+		return fmt.Errorf("no such metrics plugin: [plugin.metrics.%s]", name)
+	}
+	result, err := metrics.InspectPlugin(pconf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "plugin: metrics.%s\n", name)
+	fmt.Fprintf(w, "command: %s\n", pconf.Command.CommandString())
+	fmt.Fprintf(w, "protocol: %s\n", result.Protocol)
+	if pconf.Service != "" {
+		fmt.Fprintf(w, "service: %s\n", pconf.Service)
+	}
+
+	fmt.Fprintln(w, "\ngraph definitions:")
+	switch {
+	case result.GraphDefsError != nil:
+		fmt.Fprintf(w, "  (invalid: %s)\n", result.GraphDefsError)
+	case len(result.GraphDefs) == 0:
+		fmt.Fprintln(w, "  (none)")
+	}
+	sort.Slice(result.GraphDefs, func(i, j int) bool {
+		return result.GraphDefs[i].Name < result.GraphDefs[j].Name
+	})
+	for _, g := range result.GraphDefs {
+		fmt.Fprintf(w, "  %s: label %q, unit %s\n", g.Name, g.DisplayName, g.Unit)
+		for _, m := range g.Metrics {
+			stacked := ""
+			if m.IsStacked {
+				stacked = ", stacked"
+			}
+			fmt.Fprintf(w, "    %s: label %q%s\n", m.Name, m.DisplayName, stacked)
+		}
+	}
+
+	fmt.Fprintln(w, "\nmetric values:")
+	writeInspectedValues(w, result.Values)
+	identifiers := make([]string, 0, len(result.CustomIdentifierValues))
+	for id := range result.CustomIdentifierValues {
+		identifiers = append(identifiers, id)
+	}
+	sort.Strings(identifiers)
+	for _, id := range identifiers {
+		fmt.Fprintf(w, "\nmetric values of the custom identifier %s:\n", id)
+		writeInspectedValues(w, result.CustomIdentifierValues[id])
+	}
+
+	if len(result.Warnings) > 0 {
+		fmt.Fprintln(w, "\nwarnings:")
+		for _, s := range result.Warnings {
+			fmt.Fprintf(w, "  %s\n", s)
+		}
+	}
+	if s := strings.TrimSpace(result.Stderr); s != "" {
+		fmt.Fprintln(w, "\nstderr:")
+		for _, line := range strings.Split(s, "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+
+	switch {
+	case result.GraphDefsError != nil:
+		return fmt.Errorf("failed to parse the graph definitions of the plugin %s", name)
+	case result.Ignored > 0:
+		return fmt.Errorf("failed to parse %d lines of the output of the plugin %s", result.Ignored, name)
+	}
+	return nil
+}
+
+func writeInspectedValues(w io.Writer, values metrics.Values) {
+	if len(values) == 0 {
+		fmt.Fprintln(w, "  (none)")
+		return
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%v\n", name, values[name])
+	}
+}
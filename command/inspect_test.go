@@ -0,0 +1,47 @@
+package command
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestInspectPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command depends on sh")
+	}
+	command := func(script string) *config.MetricPlugin {
+		return &config.MetricPlugin{Command: config.Command{Args: []string{"sh", "-c", script}}}
+	}
+	conf := &config.Config{MetricPlugins: map[string]*config.MetricPlugin{
+		"valid":   command(`now=$(date +%s); printf "foo.b\t2\t$now\nfoo.a\t1\t$now\n"`),
+		"invalid": command(`now=$(date +%s); printf "foo.a\t1\t$now\nfoo.b\n"`),
+	}}
+	for name, p := range conf.MetricPlugins {
+		p.Name = name
+	}
+
+	var buf bytes.Buffer
+	if err := InspectPlugin(conf, "valid", &buf); err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "custom.foo.a\t1\n  custom.foo.b\t2\n") {
+		t.Errorf("the values should be printed by the names: %s", out)
+	}
+
+	buf.Reset()
+	if err := InspectPlugin(conf, "invalid", &buf); err == nil {
+		t.Error("the output which failed to parse should raise error")
+	}
+	if out := buf.String(); !strings.Contains(out, "ignored 1 lines") {
+		t.Errorf("the warnings should be printed: %s", out)
+	}
+
+	if err := InspectPlugin(conf, "missing", &buf); err == nil {
+		t.Error("the missing plugin should raise error")
+	}
+}
@@ -0,0 +1,183 @@
+package command
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+)
+
+// instanceNamespace is the namespace of the host metadata storing the token of
+// the agent posting as the host.
+const instanceNamespace = "mackerel-agent"
+
+// instanceCheckName is the name of the check report of the duplicate agents.
+const instanceCheckName = "mackerel-agent-instance"
+
+// instanceStaleIntervals is the number of the intervals of the host specs
+// after which the token not refreshed is stale, that is, the agent which
+// stored it has stopped posting as the host.
+const instanceStaleIntervals = 3
+
+type instanceMetadata struct {
+	Token       string `json:"instanceToken"`
+	Hostname    string `json:"hostname,omitempty"`
+	StartedAt   int64  `json:"startedAt"`
+	HeartbeatAt int64  `json:"heartbeatAt"`
+}
+
+func (m *instanceMetadata) stale(now time.Time) bool {
+	return now.Sub(time.Unix(m.HeartbeatAt, 0)) > instanceStaleIntervals*specsUpdateInterval
+}
+
+// instanceGuard detects another agent posting as the same host, such as on the
+// cloned virtual machine sharing the host ID file, which the pidfile cannot.
+// The random token generated at startup is stored in the host metadata by the
+// first agent, which refreshes the heartbeat of the token every cycle. The
+// other agents never overwrite the token while it is not stale, and are in
+// conflict once they find the heartbeat refreshed, not to confuse the token
+// left by the last run of this agent with another agent. The conflict is
+// resolved when the token gets stale, and the token of this instance is
+// stored instead. The failures of the metadata API are retried on the next
+// cycle.
+type instanceGuard struct {
+	self    instanceMetadata
+	claimed bool
+	// seen is the token of another agent found on the last cycle.
+	seen *instanceMetadata
+
+	// mu guards other, which is read on every post. The other fields are
+	// accessed only by verify, which is not called concurrently.
+	mu sync.Mutex
+	// other is the metadata of the agent refreshing the token.
+	other *instanceMetadata
+}
+
+func newInstanceGuard(now time.Time) (*instanceGuard, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &instanceGuard{self: instanceMetadata{
+		Token:     hex.EncodeToString(b),
+		Hostname:  hostname,
+		StartedAt: now.Unix(),
+	}}, nil
+}
+
+// conflicted returns true if another agent is refreshing its token.
+func (g *instanceGuard) conflicted() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.other != nil
+}
+
+// verify stores the token of this instance, or refreshes its heartbeat, unless
+// the token of another agent is stored and not stale.
+// It returns true when the conflict is detected or resolved.
+// The requests to the metadata API are made without holding mu, not to block
+// the posts asking whether they are stopped.
+func (g *instanceGuard) verify(api *mackerel.API, hostID string, now time.Time) bool {
+	resp, err := api.GetHostMetaData(hostID, instanceNamespace)
+	if err != nil && !mackerel.IsNotFound(err) {
+		logger.Warningf("Failed to verify the token of the agent instance (will retry): %s", err)
+		return false
+	}
+	if err == nil {
+		var stored instanceMetadata
+		if b, err := json.Marshal(resp.HostMetaData); err == nil {
+			json.Unmarshal(b, &stored)
+		}
+		if stored.Token != g.self.Token && !stored.stale(now) {
+			g.claimed = false
+			seen := g.seen
+			g.seen = &stored
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.other != nil || seen != nil && seen.Token == stored.Token && seen.HeartbeatAt != stored.HeartbeatAt {
+				detected := g.other == nil
+				g.other = &stored
+				return detected
+			}
+			return false
+		}
+	} else if g.claimed {
+		// the metadata was deleted, which is stored again
+		logger.Infof("The token of the agent instance is not found in the host metadata. Storing it again")
+	}
+	self := g.self
+	self.HeartbeatAt = now.Unix()
+	if err := api.PutHostMetaData(hostID, instanceNamespace, self); err != nil {
+		logger.Warningf("Failed to store the token of the agent instance (will retry): %s", err)
+		return false
+	}
+	g.claimed = true
+	g.seen = nil
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	resolved := g.other != nil
+	g.other = nil
+	return resolved
+}
+
+func (g *instanceGuard) conflictMessage(hostID string) string {
+	g.mu.Lock()
+	other := g.other
+	g.mu.Unlock()
+	startedAt := "unknown"
+	if other.StartedAt > 0 {
+		startedAt = time.Unix(other.StartedAt, 0).Format(time.RFC3339)
+	}
+	return fmt.Sprintf("Another agent on %q, started at %s, is posting as the host %s of this agent on %q. The host ID file may be copied from another host, such as by cloning the virtual machine. Delete the host ID file on either of them and restart the agent", other.Hostname, startedAt, hostID, g.self.Hostname)
+}
+
+// verifyInstance verifies the token of the instance, and logs and reports the
+// conflict when it is detected or resolved.
+func (app *App) verifyInstance(ctx context.Context) {
+	if app.instance == nil || !app.instance.verify(app.API, app.Host.ID, time.Now()) {
+		return
+	}
+	if !app.instance.conflicted() {
+		message := fmt.Sprintf("No other agent is posting as the host %s now", app.Host.ID)
+		logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Infof("%s", message)
+		// The reports of the checks may have been overwritten by the other, or
+		// not posted while posting is stopped, so the next ones are all posted.
+		app.checkReports.reset()
+		reportCheckMonitors(ctx, app, "", []*checks.Report{{
+			Name:       instanceCheckName,
+			Status:     checks.StatusOK,
+			Message:    message,
+			OccurredAt: time.Now(),
+		}})
+		return
+	}
+	message := app.instance.conflictMessage(app.Host.ID)
+	if app.Config.DuplicateInstance == config.DuplicateInstanceStop {
+		message += ". Stopped posting the metrics, the check reports and the host specs since duplicate_instance = \"stop\""
+	}
+	logger.WithFields(logformat.Fields{"host_id": app.Host.ID}).Errorf("%s", message)
+	reportCheckMonitors(ctx, app, "", []*checks.Report{{
+		Name:       instanceCheckName,
+		Status:     checks.StatusCritical,
+		Message:    message,
+		OccurredAt: time.Now(),
+	}})
+}
+
+// postingStopped returns true if the posts are stopped by the duplicate agent.
+func (app *App) postingStopped() bool {
+	return app.Config.DuplicateInstance == config.DuplicateInstanceStop && app.instance.conflicted()
+}
@@ -0,0 +1,323 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// newInstanceMetadataServer serves the host metadata of the token. The GETs
+// wait for each other while *barrier is more than one, not to be followed by
+// the PUTs until all of them have been served.
+func newInstanceMetadataServer(mu *sync.Mutex, stored *[]byte, failures *int, barrier *int) *httptest.Server {
+	var waiting int
+	var released chan struct{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v0/hosts/abcde/metadata/mackerel-agent" {
+			http.NotFound(w, req)
+			return
+		}
+		mu.Lock()
+		if req.Method == http.MethodGet && *barrier > 1 {
+			if waiting == 0 {
+				released = make(chan struct{})
+			}
+			waiting++
+			ch := released
+			if waiting == *barrier {
+				waiting = 0
+				close(ch)
+			}
+			mu.Unlock()
+			<-ch
+			mu.Lock()
+		}
+		defer mu.Unlock()
+		if *failures > 0 {
+			*failures--
+			http.Error(w, `{"error":{"message":"bad request"}}`, http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			*stored, _ = ioutil.ReadAll(req.Body)
+			w.Write([]byte(`{"success":true}`))
+		case http.MethodGet:
+			if *stored == nil {
+				http.Error(w, `{"error":{"message":"Metadata not found"}}`, http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write(*stored)
+		}
+	}))
+}
+
+func storedInstanceToken(mu *sync.Mutex, stored []byte) string {
+	mu.Lock()
+	defer mu.Unlock()
+	var m instanceMetadata
+	json.Unmarshal(stored, &m)
+	return m.Token
+}
+
+func TestInstanceGuard(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		stored   []byte
+		failures int
+		barrier  int
+	)
+	ts := newInstanceMetadataServer(&mu, &stored, &failures, &barrier)
+	defer ts.Close()
+	api, err := prepareAPI(&config.Config{}, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the heartbeats are stored in seconds
+	now := time.Now().Truncate(time.Second)
+	g, err := newInstanceGuard(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures = 1
+	if g.verify(api, "abcde", now) || g.claimed {
+		t.Fatal("the failure of the metadata API should be retried")
+	}
+	if g.verify(api, "abcde", now) || !g.claimed {
+		t.Fatal("the token should be stored")
+	}
+	failures = 1
+	now = now.Add(specsUpdateInterval)
+	if g.verify(api, "abcde", now) || g.conflicted() {
+		t.Error("the failure of the metadata API should not be the conflict")
+	}
+	if g.verify(api, "abcde", now) || g.conflicted() {
+		t.Error("the token stored by this instance should be verified")
+	}
+
+	// deleted
+	mu.Lock()
+	stored = nil
+	mu.Unlock()
+	if g.verify(api, "abcde", now) || storedInstanceToken(&mu, stored) != g.self.Token {
+		t.Error("the deleted token should be stored again")
+	}
+
+	// another instance starts with the same host ID
+	other, err := newInstanceGuard(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.self.Hostname = "cloned"
+	if other.verify(api, "abcde", now) || other.claimed || other.conflicted() {
+		t.Error("the instance started later should not overwrite the token")
+	}
+	if storedInstanceToken(&mu, stored) != g.self.Token {
+		t.Error("the token of the first instance should be kept")
+	}
+	// the token is not refreshed yet, which may be left by the last run
+	if other.verify(api, "abcde", now) || other.conflicted() {
+		t.Error("the token not refreshed should not be the conflict")
+	}
+	now = now.Add(specsUpdateInterval)
+	if g.verify(api, "abcde", now) || g.conflicted() {
+		t.Error("the first instance should not be in conflict")
+	}
+	if !other.verify(api, "abcde", now) || !other.conflicted() {
+		t.Fatal("the refreshed token of the other should be the conflict")
+	}
+	if other.other.Token != g.self.Token {
+		t.Errorf("the first instance should be recorded: %+v", other.other)
+	}
+	for i := 0; i < 3; i++ {
+		now = now.Add(specsUpdateInterval)
+		if g.verify(api, "abcde", now) || g.conflicted() {
+			t.Error("the first instance should keep the token")
+		}
+		if other.verify(api, "abcde", now) || !other.conflicted() {
+			t.Error("the conflict should be detected only once")
+		}
+	}
+
+	// the first instance stops posting as the host
+	now = now.Add(instanceStaleIntervals * specsUpdateInterval)
+	if other.verify(api, "abcde", now) || !other.conflicted() {
+		t.Error("the conflict should not be resolved until the token gets stale")
+	}
+	now = now.Add(time.Second)
+	if !other.verify(api, "abcde", now) || other.conflicted() {
+		t.Error("the conflict should be resolved when the token gets stale")
+	}
+	if storedInstanceToken(&mu, stored) != other.self.Token {
+		t.Errorf("the token of the other instance should be stored: %s", stored)
+	}
+	if other.verify(api, "abcde", now) || other.conflicted() {
+		t.Error("the conflict should be resolved only once")
+	}
+}
+
+func TestInstanceGuard_ConflictedWhileVerifying(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			close(entered)
+			<-release
+			http.Error(w, `{"error":{"message":"Metadata not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer ts.Close()
+	api, err := prepareAPI(&config.Config{}, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newInstanceGuard(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.verify(api, "abcde", time.Now())
+	}()
+	<-entered
+	conflicted := make(chan bool)
+	go func() {
+		conflicted <- g.conflicted()
+	}()
+	select {
+	case <-conflicted:
+	case <-time.After(5 * time.Second):
+		t.Error("conflicted should not wait for the requests to the metadata API")
+	}
+	close(release)
+	<-done
+	if !g.claimed {
+		t.Error("the token should be stored after the request")
+	}
+}
+
+func TestInstanceGuard_concurrent(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		stored   []byte
+		failures int
+		barrier  = 2
+	)
+	ts := newInstanceMetadataServer(&mu, &stored, &failures, &barrier)
+	defer ts.Close()
+	api, err := prepareAPI(&config.Config{}, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var guards [2]*instanceGuard
+	for i := range guards {
+		if guards[i], err = newInstanceGuard(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both of the instances GET the metadata before either of them PUTs it,
+	// such as the clones verifying it in the same slot of the host ID.
+	cycle := func() (changed [2]bool) {
+		var wg sync.WaitGroup
+		for i, g := range guards {
+			wg.Add(1)
+			go func(i int, g *instanceGuard) {
+				defer wg.Done()
+				changed[i] = g.verify(api, "abcde", now)
+			}(i, g)
+		}
+		wg.Wait()
+		return changed
+	}
+
+	cycle()
+	owner := storedInstanceToken(&mu, stored)
+	detected := 0
+	for i := 0; i < 10; i++ {
+		now = now.Add(specsUpdateInterval)
+		changed := cycle()
+		if token := storedInstanceToken(&mu, stored); token != owner {
+			t.Fatalf("the token should not be overwritten: %s -> %s", owner, token)
+		}
+		for j, g := range guards {
+			if g.self.Token == owner {
+				if changed[j] || g.conflicted() {
+					t.Errorf("the instance storing the token should not be in conflict on the cycle %d", i)
+				}
+				continue
+			}
+			if changed[j] {
+				detected++
+			}
+			if i > 0 && !g.conflicted() {
+				t.Errorf("the other instance should be in conflict on the cycle %d", i)
+			}
+		}
+	}
+	if detected != 1 {
+		t.Errorf("the conflict should be detected once but %d", detected)
+	}
+}
+
+func TestVerifyInstance_ResetsCheckReports(t *testing.T) {
+	g, err := newInstanceGuard(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := json.Marshal(g.self)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v0/hosts/abcde/metadata/mackerel-agent":
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write(stored)
+		case "/api/v0/monitoring/checks/report":
+			w.Write([]byte(`{"success":true}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	api, err := prepareAPI(&config.Config{}, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the other instance has stopped refreshing the token
+	g.claimed = true
+	g.other = &instanceMetadata{Hostname: "cloned"}
+	app := &App{
+		Config:       &config.Config{DuplicateInstance: config.DuplicateInstanceStop},
+		Host:         &mkr.Host{ID: "abcde"},
+		API:          api,
+		instance:     g,
+		checkReports: newCheckReportCache(30 * time.Minute),
+	}
+	now := time.Now()
+	reports := []*checks.Report{{Name: "a", Status: checks.StatusCritical, Message: "down"}}
+	app.checkReports.record(reports, now)
+
+	app.verifyInstance(context.Background())
+	if app.postingStopped() {
+		t.Fatal("posting should be resumed")
+	}
+	if got := app.checkReports.filter(reports, now); len(got) != 1 {
+		t.Errorf("the unchanged reports should be posted after the conflict is resolved: %v", got)
+	}
+}
@@ -0,0 +1,42 @@
+// +build darwin,cgo
+
+package command
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// activateLaunchdSocket checks in the socket of the Sockets entry name of the
+// launchd job by launch_activate_socket(3), which should be a listener.
+func activateLaunchdSocket(name string) (net.Listener, error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var fds *C.int
+	var cnt C.size_t
+	if errno := C.launch_activate_socket(cname, &fds, &cnt); errno != 0 {
+		return nil, syscall.Errno(errno)
+	}
+	defer C.free(unsafe.Pointer(fds))
+	n := int(cnt)
+	if n == 0 {
+		return nil, fmt.Errorf("no sockets")
+	}
+	files := (*[1 << 16]C.int)(unsafe.Pointer(fds))[:n:n]
+	// the sockets other than the first are not used, such as of IPv4 and IPv6
+	for _, fd := range files[1:] {
+		syscall.Close(int(fd))
+	}
+	f := os.NewFile(uintptr(files[0]), name)
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,14 @@
+// +build !darwin !cgo
+
+package command
+
+import (
+	"fmt"
+	"net"
+)
+
+// activateLaunchdSocket returns the error since the socket activation of
+// launchd is supported only on macOS built with cgo.
+func activateLaunchdSocket(name string) (net.Listener, error) {
+	return nil, fmt.Errorf("the socket activation of launchd is not supported by this build")
+}
@@ -0,0 +1,146 @@
+package command
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// localHTTP is the local HTTP endpoint of the agent, such as the health
+// endpoint, which is protected by Auth and TLS if they are configured.
+type localHTTP struct {
+	name    string
+	listen  string
+	auth    *config.ListenerAuth
+	tls     *config.ListenerTLS
+	handler http.Handler
+}
+
+// serve serves the endpoint until ctx is done.
+func (e *localHTTP) serve(ctx context.Context) {
+	l, err := e.listenLocal()
+	if err != nil {
+		logger.Errorf("Failed to listen the %s endpoint on %s: %s", e.name, e.listen, err)
+		return
+	}
+	logger.Infof("Listening the %s endpoint on %s", e.name, e.listen)
+	srv := &http.Server{Handler: withListenerAuth(e.auth, e.handler)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Failed to serve the %s endpoint on %s: %s", e.name, e.listen, err)
+	}
+}
+
+// listenLocal listens on the address of the endpoint, over TLS if configured.
+func (e *localHTTP) listenLocal() (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if e.tls != nil {
+		var err error
+		tlsConfig, err = newListenerTLSConfig(e.tls)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("tcp", e.listen)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+func newListenerTLSConfig(conf *config.ListenerTLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates are found in %s", conf.ClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// listenerAuths returns the authentications of the local HTTP endpoints.
+func listenerAuths(conf *config.Config) []*config.ListenerAuth {
+	var auths []*config.ListenerAuth
+	if conf.Health != nil && conf.Health.Auth != nil {
+		auths = append(auths, conf.Health.Auth)
+	}
+	if conf.HTTPPush != nil && conf.HTTPPush.Auth != nil {
+		auths = append(auths, conf.HTTPPush.Auth)
+	}
+	if conf.Debug != nil && conf.Debug.Auth != nil {
+		auths = append(auths, conf.Debug.Auth)
+	}
+	return auths
+}
+
+// withListenerAuth requires the requests to h to be authenticated by auth. The
+// others are answered with 401 without the reason.
+func withListenerAuth(auth *config.ListenerAuth, h http.Handler) http.Handler {
+	if auth == nil {
+		return h
+	}
+	challenge := `Basic realm="mackerel-agent"`
+	if auth.BearerToken != "" {
+		challenge = `Bearer realm="mackerel-agent"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !authenticated(auth, req) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func authenticated(auth *config.ListenerAuth, req *http.Request) bool {
+	if auth.BearerToken != "" {
+		const prefix = "Bearer "
+		s := req.Header.Get("Authorization")
+		if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+			return false
+		}
+		return secureEqual(s[len(prefix):], auth.BearerToken)
+	}
+	username, password, ok := req.BasicAuth()
+	// compare both of them regardless of the username
+	u := secureEqual(username, auth.Username)
+	p := secureEqual(password, auth.Password)
+	return ok && u && p
+}
+
+// secureEqual compares the digests of the strings not to reveal the lengths
+// and the common prefixes by the time.
+func secureEqual(s, t string) bool {
+	a := sha256.Sum256([]byte(s))
+	b := sha256.Sum256([]byte(t))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
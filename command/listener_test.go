@@ -0,0 +1,186 @@
+package command
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestWithListenerAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	testCases := []struct {
+		name      string
+		auth      *config.ListenerAuth
+		setup     func(req *http.Request)
+		status    int
+		challenge string
+	}{
+		{"no auth", nil, func(req *http.Request) {}, http.StatusOK, ""},
+		{"bearer", &config.ListenerAuth{BearerToken: "s3cr3t"}, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+		}, http.StatusOK, ""},
+		{"bearer in lower case", &config.ListenerAuth{BearerToken: "s3cr3t"}, func(req *http.Request) {
+			req.Header.Set("Authorization", "bearer s3cr3t")
+		}, http.StatusOK, ""},
+		{"wrong bearer", &config.ListenerAuth{BearerToken: "s3cr3t"}, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer s3cr3")
+		}, http.StatusUnauthorized, `Bearer realm="mackerel-agent"`},
+		{"missing bearer", &config.ListenerAuth{BearerToken: "s3cr3t"}, func(req *http.Request) {}, http.StatusUnauthorized, `Bearer realm="mackerel-agent"`},
+		{"basic instead of bearer", &config.ListenerAuth{BearerToken: "s3cr3t"}, func(req *http.Request) {
+			req.SetBasicAuth("s3cr3t", "s3cr3t")
+		}, http.StatusUnauthorized, `Bearer realm="mackerel-agent"`},
+		{"basic", &config.ListenerAuth{Username: "admin", Password: "pass"}, func(req *http.Request) {
+			req.SetBasicAuth("admin", "pass")
+		}, http.StatusOK, ""},
+		{"wrong password", &config.ListenerAuth{Username: "admin", Password: "pass"}, func(req *http.Request) {
+			req.SetBasicAuth("admin", "passwd")
+		}, http.StatusUnauthorized, `Basic realm="mackerel-agent"`},
+		{"wrong username", &config.ListenerAuth{Username: "admin", Password: "pass"}, func(req *http.Request) {
+			req.SetBasicAuth("root", "pass")
+		}, http.StatusUnauthorized, `Basic realm="mackerel-agent"`},
+		{"missing basic", &config.ListenerAuth{Username: "admin", Password: "pass"}, func(req *http.Request) {}, http.StatusUnauthorized, `Basic realm="mackerel-agent"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/healthz", nil)
+			tc.setup(req)
+			w := httptest.NewRecorder()
+			withListenerAuth(tc.auth, ok).ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("status should be %d but got %d", tc.status, w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tc.challenge {
+				t.Errorf("WWW-Authenticate should be %q but got %q", tc.challenge, got)
+			}
+			if tc.status == http.StatusUnauthorized && w.Body.String() != "Unauthorized\n" {
+				t.Errorf("the body of 401 should not have the details: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+// writeTestCert writes the PEM files of the certificate and the key of cn
+// signed by parent, or self-signed CA if parent is nil.
+func writeTestCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, cn+".crt")
+	keyFile := filepath.Join(dir, cn+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestLocalHTTP_mutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey, caFile, _ := writeTestCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeTestCert(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeTestCert(t, dir, "client", ca, caKey)
+	other, otherKey, _, _ := writeTestCert(t, dir, "other-ca", nil, nil)
+	_, _, otherCert, otherClientKey := writeTestCert(t, dir, "other", other, otherKey)
+
+	e := &localHTTP{
+		name:   "test",
+		listen: "127.0.0.1:0",
+		tls:    &config.ListenerTLS{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: caFile},
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	l, err := e.listenLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: e.handler}
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certFile, keyFile string) error {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(clientCert, clientKey); err != nil {
+		t.Errorf("the client certificate signed by the CA should be accepted: %s", err)
+	}
+	if err := get("", ""); err == nil {
+		t.Error("the client without the certificate should be rejected")
+	}
+	if err := get(otherCert, otherClientKey); err == nil {
+		t.Error("the client certificate signed by the other CA should be rejected")
+	}
+
+	e.tls = &config.ListenerTLS{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: serverKey}
+	if _, err := e.listenLocal(); err == nil {
+		t.Error("the client CA file without the certificates should be an error")
+	}
+}
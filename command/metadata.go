@@ -2,14 +2,20 @@ package command
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/mackerelio/golib/pluginutil"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/mackerel"
 	"github.com/mackerelio/mackerel-agent/metadata"
+	"github.com/mackerelio/mackerel-agent/pluginstderr"
+	"github.com/mackerelio/mackerel-agent/util"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -54,12 +60,184 @@ type metadataResult struct {
 	namespace string
 	metadata  interface{}
 	createdAt time.Time
+	// maxTotalBytes is the maximum size of the metadata split into the chunks.
+	maxTotalBytes int
+}
+
+// encodeMetadata serializes the metadata and validates the size of it, which
+// is up to maxTotalBytes if it is positive instead of the limit of a namespace.
+func encodeMetadata(namespace string, v interface{}, maxTotalBytes int) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the metadata for namespace %q to json: %v", namespace, err)
+	}
+	if maxTotalBytes > 0 {
+		if len(data) > maxTotalBytes {
+			return nil, fmt.Errorf("metadata for namespace %q is %dKB, max_total_bytes is %dKB", namespace, (len(data)+1023)/1024, maxTotalBytes/1024)
+		}
+		return data, nil
+	}
+	if len(data) > metadata.SizeLimit {
+		return nil, fmt.Errorf("metadata for namespace %q is %dKB, limit is %dKB", namespace, (len(data)+1023)/1024, metadata.SizeLimit/1024)
+	}
+	return data, nil
+}
+
+func hashMetadata(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// metadataAPI is the API to put the metadata, which is *mackerel.API.
+type metadataAPI interface {
+	PutHostMetaData(hostID, namespace string, metadata mkr.HostMetaData) error
+	DeleteHostMetaData(hostID, namespace string) error
+	GetHostMetaDataNameSpaces(hostID string) ([]string, error)
+}
+
+// metadataPoster puts the metadata of the results, which are split into the
+// chunks beyond the limit of a namespace with max_total_bytes.
+type metadataPoster struct {
+	api    metadataAPI
+	hostID string
+	// The hashes of the payloads posted successfully, keyed by namespace
+	// including the ones of the chunks. They are kept only in memory, so the
+	// payloads are posted once again when the agent restarts (including
+	// reloading the configuration by the supervisor), and they are cleared by
+	// ResetMetadata on SIGHUP and the reload control command.
+	hashes map[string]string
+	// chunks are the numbers of the chunks posted of the namespaces, and
+	// listed are the namespaces whose chunks posted before the start have
+	// been looked up by the API.
+	chunks map[string]int
+	listed map[string]bool
+}
+
+func newMetadataPoster(api metadataAPI, hostID string) *metadataPoster {
+	return &metadataPoster{
+		api:    api,
+		hostID: hostID,
+		hashes: make(map[string]string),
+		chunks: make(map[string]int),
+		listed: make(map[string]bool),
+	}
+}
+
+// post puts the metadata of result unless it is not changed since the last
+// post, and returns whether any payload is put. The chunks put successfully
+// are not put again by the retry after an error.
+func (p *metadataPoster) post(result *metadataResult) (bool, error) {
+	data, err := encodeMetadata(result.namespace, result.metadata, result.maxTotalBytes)
+	if err != nil {
+		return false, err
+	}
+	if len(data) <= metadata.SizeLimit {
+		posted, err := p.put(result.namespace, result.metadata, data)
+		if err != nil {
+			return posted, err
+		}
+		if result.maxTotalBytes > 0 || p.chunks[result.namespace] > 0 {
+			p.deleteChunks(result.namespace, 0)
+		}
+		return posted, nil
+	}
+
+	// the strings are sanitized before split as the ones put by the API
+	data, err = json.Marshal(util.SanitizeValue(result.metadata, true, 0))
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal the metadata for namespace %q to json: %v", result.namespace, err)
+	}
+	chunks, index := metadata.Split(result.namespace, data)
+	var posted bool
+	for _, c := range chunks {
+		data, err := json.Marshal(c.Metadata)
+		if err != nil {
+			return posted, err
+		}
+		ok, err := p.put(c.Namespace, c.Metadata, data)
+		posted = posted || ok
+		if err != nil {
+			return posted, err
+		}
+	}
+	// the index is put after the chunks not to refer to the missing ones
+	data, err = json.Marshal(index)
+	if err != nil {
+		return posted, err
+	}
+	ok, err := p.put(result.namespace, index, data)
+	posted = posted || ok
+	if err != nil {
+		return posted, err
+	}
+	if posted {
+		logger.Debugf("metadata %q is split into %d chunks of %d bytes", result.namespace, len(chunks), index.Size)
+	}
+	p.deleteChunks(result.namespace, len(chunks))
+	return posted, nil
+}
+
+// reset forgets the hashes of the payloads posted, so that the next post puts
+// them even if they are unchanged.
+func (p *metadataPoster) reset() {
+	p.hashes = make(map[string]string)
+}
+
+// put puts the payload of data to namespace unless its hash is not changed.
+func (p *metadataPoster) put(namespace string, v interface{}, data []byte) (bool, error) {
+	hash := hashMetadata(data)
+	if p.hashes[namespace] == hash {
+		logger.Debugf("metadata %q is not changed since the last post, skipped", namespace)
+		return false, nil
+	}
+	if err := p.api.PutHostMetaData(p.hostID, namespace, v); err != nil {
+		if !mackerel.IsServerError(err) {
+			delete(p.hashes, namespace)
+		}
+		return false, err
+	}
+	p.hashes[namespace] = hash
+	return true, nil
+}
+
+// deleteChunks deletes the chunks of namespace from the n-th, which are left
+// by the larger metadata. The chunks posted before the start are looked up
+// once by the API.
+func (p *metadataPoster) deleteChunks(namespace string, n int) {
+	stale := make(map[int]bool)
+	for i := n; i < p.chunks[namespace]; i++ {
+		stale[i] = true
+	}
+	if !p.listed[namespace] {
+		namespaces, err := p.api.GetHostMetaDataNameSpaces(p.hostID)
+		if err != nil {
+			logger.Warningf("failed to look up the chunks of metadata %q: %v", namespace, err)
+		} else {
+			p.listed[namespace] = true
+			for _, ns := range namespaces {
+				if i, ok := metadata.ChunkNumber(namespace, ns); ok && i >= n {
+					stale[i] = true
+				}
+			}
+		}
+	}
+	p.chunks[namespace] = n
+	for i := range stale {
+		ns := metadata.ChunkNamespace(namespace, i)
+		if err := p.api.DeleteHostMetaData(p.hostID, ns); err != nil && !mackerel.IsNotFound(err) {
+			logger.Warningf("failed to delete metadata %q: %v", ns, err)
+			// deleted again by the next post
+			p.listed[namespace] = false
+			continue
+		}
+		delete(p.hashes, ns)
+	}
 }
 
 func runMetadataLoop(ctx context.Context, app *App, termMetadataCh <-chan struct{}) {
 	resultCh := make(chan *metadataResult)
+	poster := newMetadataPoster(app.API, app.Host.ID)
 	for _, g := range app.Agent.MetadataGenerators {
-		go runEachMetadataLoop(ctx, g, resultCh)
+		go runEachMetadataLoop(ctx, g, scheduleOffset(app.Host, g.Interval()), resultCh)
 	}
 
 	exit := false
@@ -71,6 +249,13 @@ func runMetadataLoop(ctx context.Context, app *App, termMetadataCh <-chan struct
 			exit = true
 		}
 
+		select {
+		case <-app.resetMetadataCh:
+			logger.Debugf("the hashes of the metadata posted are cleared, and the metadata are put again")
+			poster.reset()
+		default:
+		}
+
 		results := make(map[string]*metadataResult)
 	ConsumeResults:
 		for {
@@ -90,11 +275,12 @@ func runMetadataLoop(ctx context.Context, app *App, termMetadataCh <-chan struct
 		}
 
 		for _, result := range results {
-			err := app.API.PutHostMetaData(app.Host.ID, result.namespace, result.metadata)
+			posted, err := poster.post(result)
 			// retry on 5XX errors
 			if mackerel.IsServerError(err) {
 				e := err.(*mkr.APIError)
-				logger.Errorf("put metadata %q failed: status %s", result.namespace, e.StatusCode)
+				logger.Errorf("put metadata %q failed: status %d", result.namespace, e.StatusCode)
+				result := result
 				go func() {
 					resultCh <- result
 				}()
@@ -105,11 +291,23 @@ func runMetadataLoop(ctx context.Context, app *App, termMetadataCh <-chan struct
 				clearMetadataCache(app.Agent.MetadataGenerators, result.namespace)
 				continue
 			}
+			if posted {
+				app.status.posted(statusKindMetadata)
+			}
 		}
 		results = nil
 	}
 }
 
+// ResetMetadata makes the next metadata put even if they are unchanged, on
+// reloading the configuration.
+func (app *App) ResetMetadata() {
+	select {
+	case app.resetMetadataCh <- struct{}{}:
+	default:
+	}
+}
+
 func clearMetadataCache(generators []*metadata.Generator, namespace string) {
 	for _, g := range generators {
 		if g.Name == namespace {
@@ -119,41 +317,66 @@ func clearMetadataCache(generators []*metadata.Generator, namespace string) {
 	}
 }
 
-func runEachMetadataLoop(ctx context.Context, g *metadata.Generator, resultCh chan<- *metadataResult) {
+// metadataFailureThreshold is the number of consecutive failures of a metadata plugin
+// after which the failures are logged at error level.
+const metadataFailureThreshold = 3
+
+// runEachMetadataLoop runs the metadata plugin at offset past the multiples of
+// its interval, so that the hosts started together do not post at once. The
+// first run after the start is not aligned.
+func runEachMetadataLoop(ctx context.Context, g *metadata.Generator, offset time.Duration, resultCh chan<- *metadataResult) {
 	interval := g.Interval()
 	nextInterval := 10 * time.Second
-	nextTime := time.Now()
+
+	// skip the execution on start up if the interval has not elapsed since the last execution
+	if lastExecutedAt := g.LastExecutedAt(); !lastExecutedAt.IsZero() {
+		if d := interval - time.Since(lastExecutedAt); d > nextInterval {
+			logger.Debugf("metadata plugin %q: executed at %s, the next execution is in %s", g.Name, lastExecutedAt, d)
+			nextInterval = d
+		}
+	}
 
 	for {
 		select {
 		case <-time.After(nextInterval):
-			metadata, err := g.Fetch()
+			data, err := g.Fetch()
 
-			// case for laptop sleep mode (now >> nextTime + interval)
+			// the slot is found by the wall clock, also after the laptop sleeps
 			now := time.Now()
-			nextInterval = interval - (now.Sub(nextTime) % interval)
-			nextTime = now.Add(nextInterval)
+			nextInterval = untilSlot(now, interval, offset, interval/2)
 
+			if err == metadata.ErrNoMetadata {
+				continue
+			}
 			if err != nil {
-				logger.Warningf("metadata plugin %q: %s", g.Name, err.Error())
+				if n := g.ConsecutiveFailures(); n >= metadataFailureThreshold {
+					fields := logformat.Fields{"plugin": g.Name, logformat.PluginOutput: pluginstderr.Tail(g.LastStderr())}
+					logger.WithFields(fields).Errorf("metadata plugin %q has failed %d times in a row: %s, stderr: %q", g.Name, n, err.Error(), pluginstderr.Tail(g.LastStderr()))
+				} else {
+					logger.WithFields(logformat.Fields{"plugin": g.Name}).Warningf("metadata plugin %q: %s", g.Name, err.Error())
+				}
 				continue
 			}
+			if err := g.SaveExecutedAt(now); err != nil {
+				logger.Warningf("metadata plugin %q: failed to save the execution time: %s", g.Name, err.Error())
+			}
 
-			if !g.IsChanged(metadata) {
+			if !g.IsChanged(data) {
 				logger.Debugf("metadata plugin %q: metadata does not change", g.Name)
 				continue
 			}
 
-			if err := g.Save(metadata); err != nil {
+			if err := g.Save(data); err != nil {
 				logger.Warningf("metadata plugin %q: %s", g.Name, err.Error())
 				continue
 			}
 
 			logger.Debugf("metadata plugin %q: generated metadata (and saved cache to file: %s)", g.Name, g.Cachefile)
 			resultCh <- &metadataResult{
-				namespace: g.Name,
-				metadata:  metadata,
-				createdAt: time.Now(),
+				namespace:     g.Name,
+				metadata:      data,
+				createdAt:     time.Now(),
+				maxTotalBytes: g.Config.MaxTotalBytes,
 			}
 
 		case <-ctx.Done():
@@ -0,0 +1,194 @@
+package command
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/metadata"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	data, err := encodeMetadata("example", map[string]interface{}{"foo": []int{1, 2}}, 0)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if string(data) != `{"foo":[1,2]}` {
+		t.Errorf("unexpected payload: %s", string(data))
+	}
+
+	_, err = encodeMetadata("large", strings.Repeat("a", 120*1024), 0)
+	if err == nil {
+		t.Fatal("should raise error when the metadata exceeds the size limit")
+	}
+	if expected := `metadata for namespace "large" is 121KB, limit is 100KB`; err.Error() != expected {
+		t.Errorf("error should be %q but got %q", expected, err.Error())
+	}
+
+	if _, err := encodeMetadata("large", strings.Repeat("a", 120*1024), 200*1024); err != nil {
+		t.Errorf("should not raise error within max_total_bytes: %v", err)
+	}
+	_, err = encodeMetadata("large", strings.Repeat("a", 120*1024), 110*1024)
+	if expected := `metadata for namespace "large" is 121KB, max_total_bytes is 110KB`; err == nil || err.Error() != expected {
+		t.Errorf("error should be %q but got %v", expected, err)
+	}
+}
+
+func TestHashMetadata(t *testing.T) {
+	if hashMetadata([]byte(`{"a":1}`)) != hashMetadata([]byte(`{"a":1}`)) {
+		t.Error("hashes of the same payload should be equal")
+	}
+	if hashMetadata([]byte(`{"a":1}`)) == hashMetadata([]byte(`{"a":2}`)) {
+		t.Error("hashes of different payloads should not be equal")
+	}
+}
+
+type fakeMetadataAPI struct {
+	metadata map[string]interface{}
+	puts     []string
+	deletes  []string
+	// failAt fails the put of the namespace once.
+	failAt string
+}
+
+func (api *fakeMetadataAPI) PutHostMetaData(hostID, namespace string, v mkr.HostMetaData) error {
+	if namespace == api.failAt {
+		api.failAt = ""
+		return &mkr.APIError{StatusCode: 503, Message: "unavailable"}
+	}
+	api.puts = append(api.puts, namespace)
+	api.metadata[namespace] = v
+	return nil
+}
+
+func (api *fakeMetadataAPI) DeleteHostMetaData(hostID, namespace string) error {
+	if _, ok := api.metadata[namespace]; !ok {
+		return &mkr.APIError{StatusCode: 404, Message: "not found"}
+	}
+	api.deletes = append(api.deletes, namespace)
+	delete(api.metadata, namespace)
+	return nil
+}
+
+func (api *fakeMetadataAPI) GetHostMetaDataNameSpaces(hostID string) ([]string, error) {
+	var namespaces []string
+	for ns := range api.metadata {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+func (api *fakeMetadataAPI) restore(t *testing.T, namespace string) string {
+	t.Helper()
+	index, ok := api.metadata[namespace].(metadata.ChunkIndex)
+	if !ok {
+		t.Fatalf("the index should be put: %#v", api.metadata[namespace])
+	}
+	var data string
+	for _, ns := range index.Chunks {
+		data += api.metadata[ns].(metadata.ChunkData).Data
+	}
+	if len(data) != index.Size || hashMetadata([]byte(data)) != index.SHA256 {
+		t.Errorf("the chunks should be restored by the index: %+v", index)
+	}
+	return data
+}
+
+func inventory(n int, version string) map[string]interface{} {
+	packages := make([]interface{}, n)
+	for i := range packages {
+		packages[i] = map[string]interface{}{"name": "package" + strings.Repeat("x", i%10), "version": version}
+	}
+	return map[string]interface{}{"packages": packages}
+}
+
+func TestMetadataPoster(t *testing.T) {
+	api := &fakeMetadataAPI{metadata: map[string]interface{}{
+		"inventory.9": metadata.ChunkData{Index: 9},
+		"other.1":     metadata.ChunkData{Index: 1},
+	}}
+	p := newMetadataPoster(api, "host1")
+
+	large := inventory(8000, "1.0")
+	posted, err := p.post(&metadataResult{namespace: "inventory", metadata: large, maxTotalBytes: 1024 * 1024})
+	if err != nil || !posted {
+		t.Fatalf("should post the metadata: %v", err)
+	}
+	expected, _ := json.Marshal(large)
+	if data := api.restore(t, "inventory"); data != string(expected) {
+		t.Errorf("the chunks should be the metadata")
+	}
+	chunks := len(api.metadata["inventory"].(metadata.ChunkIndex).Chunks)
+	if chunks < 4 || api.puts[chunks] != "inventory" {
+		t.Errorf("the index should be put after the chunks: %q", api.puts)
+	}
+	if !reflect.DeepEqual(api.deletes, []string{"inventory.9"}) {
+		t.Errorf("the chunks left before the start should be deleted: %q", api.deletes)
+	}
+
+	// the values of the metadata are the same sizes, so only the last
+	// chunks and the index are changed
+	api.puts = nil
+	changed := inventory(8000, "1.0")
+	changed["packages"].([]interface{})[7999] = map[string]interface{}{"name": "package" + strings.Repeat("x", 9), "version": "2.0"}
+	if _, err := p.post(&metadataResult{namespace: "inventory", metadata: changed, maxTotalBytes: 1024 * 1024}); err != nil {
+		t.Fatalf("should post the metadata: %v", err)
+	}
+	if !reflect.DeepEqual(api.puts, []string{metadata.ChunkNamespace("inventory", chunks-1), "inventory"}) {
+		t.Errorf("only the chunk changed should be put: %q", api.puts)
+	}
+
+	// resumed by the retry after the server error
+	api.puts = nil
+	larger := inventory(16000, "3.0")
+	api.failAt = "inventory.2"
+	if _, err := p.post(&metadataResult{namespace: "inventory", metadata: larger, maxTotalBytes: 1024 * 1024}); err == nil {
+		t.Fatal("should raise the error of the API")
+	}
+	if !reflect.DeepEqual(api.puts, []string{"inventory.0", "inventory.1"}) {
+		t.Errorf("the chunks should be put until the error: %q", api.puts)
+	}
+	api.puts = nil
+	if _, err := p.post(&metadataResult{namespace: "inventory", metadata: larger, maxTotalBytes: 1024 * 1024}); err != nil {
+		t.Fatalf("should post the metadata: %v", err)
+	}
+	if api.puts[0] != "inventory.2" {
+		t.Errorf("the chunks put successfully should not be put again: %q", api.puts)
+	}
+	largerChunks := len(api.metadata["inventory"].(metadata.ChunkIndex).Chunks)
+
+	// shrunk into a namespace
+	api.deletes = nil
+	if _, err := p.post(&metadataResult{namespace: "inventory", metadata: inventory(10, "3.0"), maxTotalBytes: 1024 * 1024}); err != nil {
+		t.Fatalf("should post the metadata: %v", err)
+	}
+	if len(api.deletes) != largerChunks {
+		t.Errorf("all the chunks should be deleted: %q", api.deletes)
+	}
+	for ns := range api.metadata {
+		if _, ok := metadata.ChunkNumber("inventory", ns); ok {
+			t.Errorf("the chunk should be deleted: %s", ns)
+		}
+	}
+	if _, ok := api.metadata["other.1"]; !ok {
+		t.Error("the metadata of the other namespaces should not be deleted")
+	}
+
+	// put again after reset even if unchanged
+	if posted, err := p.post(&metadataResult{namespace: "inventory", metadata: inventory(10, "3.0")}); err != nil || posted {
+		t.Errorf("the metadata unchanged should not be put: %t, %v", posted, err)
+	}
+	p.reset()
+	if posted, err := p.post(&metadataResult{namespace: "inventory", metadata: inventory(10, "3.0")}); err != nil || !posted {
+		t.Errorf("the metadata should be put after reset: %t, %v", posted, err)
+	}
+
+	_, err = p.post(&metadataResult{namespace: "inventory", metadata: inventory(80000, "3.0"), maxTotalBytes: 1024 * 1024})
+	if err == nil || !strings.Contains(err.Error(), "max_total_bytes is 1024KB") {
+		t.Errorf("should raise error beyond max_total_bytes: %v", err)
+	}
+}
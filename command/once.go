@@ -0,0 +1,104 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// OnceResult is the result of RunOnceJSON.
+type OnceResult struct {
+	Host      *mackerel.CreateHostParam `json:"host"`
+	GraphDefs []*mkr.GraphDefsParam     `json:"graphDefs"`
+	// Metrics are the metric values of the host keyed by the names.
+	Metrics map[string]float64 `json:"metrics"`
+	// CustomIdentifierMetrics are the metric values of the plugins with custom_identifier.
+	CustomIdentifierMetrics map[string]map[string]float64 `json:"customIdentifierMetrics,omitempty"`
+	Checks                  []*OnceCheckResult            `json:"checks"`
+	// Errors are the messages of the plugins which failed or timed out.
+	Errors []string `json:"errors"`
+}
+
+// OnceCheckResult is the result of a check plugin.
+type OnceCheckResult struct {
+	Name    string        `json:"name"`
+	Status  checks.Status `json:"status"`
+	Message string        `json:"message"`
+}
+
+// RunOnceJSON runs a collection cycle of the metrics and the checks without posting,
+// and writes the result to w as a JSON document. It returns an error if any of
+// the plugins failed, including the check plugins which reported UNKNOWN, as the
+// agent does when the check commands can not be executed or time out.
+func RunOnceJSON(conf *config.Config, ameta *AgentMeta, w io.Writer) error {
+	graphdefs, hostSpec, metrics, err := runOncePayload(conf, ameta)
+	if err != nil {
+		return err
+	}
+
+	result := &OnceResult{
+		Host:      hostSpec,
+		GraphDefs: graphdefs,
+		Metrics:   make(map[string]float64),
+		Checks:    runChecksOnce(createCheckers(conf)),
+		Errors:    []string{},
+	}
+	for _, v := range metrics.Values {
+		if v.CustomIdentifier == nil {
+			for name, value := range v.Values {
+				result.Metrics[name] = value
+			}
+			continue
+		}
+		if result.CustomIdentifierMetrics == nil {
+			result.CustomIdentifierMetrics = make(map[string]map[string]float64)
+		}
+		result.CustomIdentifierMetrics[*v.CustomIdentifier] = v.Values
+	}
+	for _, err := range metrics.Errors {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	for _, c := range result.Checks {
+		if c.Status == checks.StatusUnknown {
+			result.Errors = append(result.Errors, fmt.Sprintf("checker %q: %s", c.Name, c.Message))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%d plugins failed", len(result.Errors))
+	}
+	return nil
+}
+
+// runChecksOnce runs the checkers concurrently and returns the results in order of the names.
+func runChecksOnce(checkers []*checks.Checker) []*OnceCheckResult {
+	results := make([]*OnceCheckResult, len(checkers))
+	sem := newChecksSemaphore(agent.DefaultChecksConcurrency())
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(i int, c *checks.Checker) {
+			defer wg.Done()
+			report := sem.check(c)
+			results[i] = &OnceCheckResult{Name: report.Name, Status: report.Status, Message: report.Message}
+		}(i, c)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
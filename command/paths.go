@@ -0,0 +1,121 @@
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/orphan"
+)
+
+// StatePaths returns the locations of the state files of the agent, which are
+// under the root directory unless they are configured individually. The ones
+// disabled, such as the spool without spool_dir, are omitted.
+func StatePaths(conf *config.Config) map[string]string {
+	paths := map[string]string{
+		"root":          conf.Root,
+		"controlSocket": ControlSocketFile(conf),
+		"checkStates":   filepath.Join(conf.Root, "checks"),
+		"metricStates":  filepath.Join(conf.Root, "metrics"),
+		"plugins":       DefaultPluginsDir(conf),
+		"agentProcess":  orphan.StatePath(conf.Root),
+	}
+	for name, path := range map[string]string{
+		"pidfile":    conf.Pidfile,
+		"idFile":     conf.HostIDFile(),
+		"spool":      conf.SpoolDir,
+		"statusFile": conf.StatusFile,
+	} {
+		if path != "" {
+			paths[name] = path
+		}
+	}
+	if conf.LifecycleAnnotation != nil {
+		paths["annotations"] = lifecycleStateFile(conf)
+	}
+	return paths
+}
+
+// FormatPaths formats the paths of StatePaths in order of the names.
+func FormatPaths(paths map[string]string) []string {
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %-14s %s", name+":", paths[name]))
+	}
+	return lines
+}
+
+// statePathDirs are the state paths of StatePaths which are the directories,
+// and the others are the files. The plugins are written only by the install.
+var statePathDirs = map[string]bool{
+	"root":         true,
+	"checkStates":  true,
+	"metricStates": true,
+	"spool":        true,
+}
+
+// VerifyStatePaths verifies that the agent can write the state files of
+// StatePaths, such as on the read-only root filesystem, and returns the error
+// listing all the paths which are not writable.
+func VerifyStatePaths(conf *config.Config) error {
+	paths := StatePaths(conf)
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		if name != "plugins" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var problems []string
+	results := make(map[string]error)
+	for _, name := range names {
+		dir := paths[name]
+		if !statePathDirs[name] {
+			dir = filepath.Dir(dir)
+		}
+		err, ok := results[dir]
+		if !ok {
+			err = verifyWritableDir(dir)
+			results[dir] = err
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("  %s: %s", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the state paths are not writable, configure root or the paths individually:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// verifyWritableDir creates and removes a temporary file in dir, or in its
+// nearest ancestor if dir does not exist yet, which is created by the agent.
+func verifyWritableDir(dir string) error {
+	for d := dir; ; d = filepath.Dir(d) {
+		fi, err := os.Stat(d)
+		if os.IsNotExist(err) && filepath.Dir(d) != d {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", d)
+		}
+		f, err := ioutil.TempFile(d, ".mackerel-agent-write-test")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,124 @@
+package command
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestStatePaths(t *testing.T) {
+	root := filepath.Join("test", "agent")
+	conf := &config.Config{Root: root, Pidfile: filepath.Join(root, "pid"), SpoolDir: filepath.Join("test", "spool")}
+	paths := StatePaths(conf)
+	for name, expect := range map[string]string{
+		"root":         root,
+		"pidfile":      filepath.Join(root, "pid"),
+		"idFile":       filepath.Join(root, "id"),
+		"plugins":      filepath.Join(root, "plugins"),
+		"spool":        filepath.Join("test", "spool"),
+		"agentProcess": filepath.Join(root, "agent-process.json"),
+	} {
+		if paths[name] != expect {
+			t.Errorf("%s should be %q but got %q", name, expect, paths[name])
+		}
+	}
+	if _, ok := paths["statusFile"]; ok {
+		t.Errorf("the status file should be omitted since it is disabled: %v", paths)
+	}
+}
+
+func TestVerifyStatePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the directories not created yet are verified by their ancestors
+	root := filepath.Join(dir, "state", "agent")
+	conf := &config.Config{Root: root, Pidfile: filepath.Join(root, "pid"), StatusFile: filepath.Join(dir, "status", "status.json")}
+	if err := VerifyStatePaths(conf); err != nil {
+		t.Errorf("the state paths should be writable: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("nothing should be left by the verification: %v", files)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf = &config.Config{Root: dir, Pidfile: filepath.Join(file, "pid"), SpoolDir: filepath.Join(file, "spool")}
+	err = VerifyStatePaths(conf)
+	if err == nil {
+		t.Fatal("the paths under the file should not be writable")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "  pidfile: "+file+" is not a directory") || !strings.HasPrefix(lines[2], "  spool: ") {
+		t.Errorf("all the paths not writable should be listed: %s", err)
+	}
+
+	// the pidfile disabled is not verified
+	conf.Pidfile, conf.SpoolDir = "", ""
+	if err := VerifyStatePaths(conf); err != nil {
+		t.Errorf("the pidfile disabled should not be verified: %s", err)
+	}
+}
+
+// TestLoop_readOnlyWorkingDirectory runs the agent as in the container with the
+// read-only root filesystem, whose state files are written only under the root.
+func TestLoop_readOnlyWorkingDirectory(t *testing.T) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+	conf.Pidfile = ""
+
+	wd, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wd)
+	if err := os.Chmod(wd, 0555); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(orig)
+
+	if err := VerifyStatePaths(&conf); err != nil {
+		t.Fatalf("the root should be writable: %s", err)
+	}
+	posted := make(chan struct{}, 10)
+	mockHandlers["POST /api/v0/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		posted <- struct{}{}
+		return http.StatusOK, jsonObject{"success": true}
+	}
+	host := undelayedHost()
+	mockHandlers["PUT /api/v0/hosts/"+host.ID] = func(req *http.Request) (int, jsonObject) {
+		return http.StatusOK, jsonObject{"result": "OK"}
+	}
+	stop := startControlledAgent(t, &conf, host)
+	select {
+	case <-posted:
+	case <-time.After(10 * time.Second):
+		t.Error("the metrics should be posted")
+	}
+	stop()
+
+	if files, _ := ioutil.ReadDir(wd); len(files) != 0 {
+		t.Errorf("nothing should be written to the working directory: %v", files)
+	}
+	if files, _ := ioutil.ReadDir(conf.Root); len(files) == 0 {
+		t.Errorf("the state files should be written under the root")
+	}
+}
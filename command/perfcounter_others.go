@@ -0,0 +1,17 @@
+// +build !windows
+
+package command
+
+import (
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+// perfCounterGenerators warns [plugin.windows_perfcounter.NAME] since the
+// performance counters are available only on Windows.
+func perfCounterGenerators(conf *config.Config) []metrics.PluginGenerator {
+	for name := range conf.WindowsPerfCounterPlugins {
+		logger.Warningf("plugin.windows_perfcounter.%s is ignored since it is supported only on Windows", name)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// +build windows
+
+package command
+
+import (
+	"sort"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	metricsWindows "github.com/mackerelio/mackerel-agent/metrics/windows"
+)
+
+// perfCounterGenerators creates the generators of [plugin.windows_perfcounter.NAME].
+func perfCounterGenerators(conf *config.Config) []metrics.PluginGenerator {
+	var generators []metrics.PluginGenerator
+	// in order of the names, by which the collisions of the metric names are resolved
+	names := make([]string, 0, len(conf.WindowsPerfCounterPlugins))
+	for name := range conf.WindowsPerfCounterPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g, err := metricsWindows.NewPerfCounterGenerator(conf.WindowsPerfCounterPlugins[name])
+		if err != nil {
+			logger.Errorf("Failed to create plugin.windows_perfcounter.%s: %s", name, err)
+			continue
+		}
+		generators = append(generators, g)
+	}
+	return generators
+}
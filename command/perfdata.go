@@ -0,0 +1,41 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// perfdataGenerator generates the metrics of the performance data, or of the
+// items of the JSON results, reported by the checker since the last generation.
+type perfdataGenerator struct {
+	checker *checks.Checker
+}
+
+func perfdataGenerators(checkers []*checks.Checker) []metrics.PluginGenerator {
+	var generators []metrics.PluginGenerator
+	for _, checker := range checkers {
+		if checker.Config.ReportPerfdata || checker.Config.ReportItemsAsMetrics {
+			generators = append(generators, &perfdataGenerator{checker})
+		}
+	}
+	return generators
+}
+
+func (g *perfdataGenerator) String() string {
+	return fmt.Sprintf("perfdata of checker %q", g.checker.Name)
+}
+
+func (g *perfdataGenerator) Generate() (metrics.Values, error) {
+	return metrics.Values(g.checker.TakePerfdata()), nil
+}
+
+func (g *perfdataGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	return nil, nil
+}
+
+func (g *perfdataGenerator) CustomIdentifier() *string {
+	return g.checker.Config.CustomIdentifier
+}
@@ -0,0 +1,364 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32 = windows.NewLazySystemDLL("kernel32.dll")
+
+	procCreateNamedPipeW = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe = kernel32.NewProc("ConnectNamedPipe")
+)
+
+const (
+	pipeAccessDuplex        = 0x00000003
+	pipeRejectRemoteClients = 0x00000008
+	pipeUnlimitedInstances  = 255
+	pipeBufferSize          = 4096
+)
+
+var errPipeClosed = errors.New("use of closed named pipe")
+
+// pipeAddr is the address of the named pipe, such as \\.\pipe\name.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+// pipeOp is the overlapped operation in progress on the handle, which is
+// canceled by the deadline or the close.
+type pipeOp struct {
+	ov       *windows.Overlapped
+	deadline time.Time
+	timer    *time.Timer
+	timedOut bool
+}
+
+// start issues the operation by call if the deadline has not been exceeded.
+// It must be called with the lock of the handle held.
+func (op *pipeOp) start(call func(*windows.Overlapped) error) (*windows.Overlapped, error) {
+	if !op.deadline.IsZero() && !time.Now().Before(op.deadline) {
+		return nil, pipeTimeoutError{}
+	}
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	ov := &windows.Overlapped{HEvent: ev}
+	if err := call(ov); err != nil && err != windows.ERROR_IO_PENDING {
+		windows.CloseHandle(ev)
+		return nil, err
+	}
+	op.ov = ov
+	op.timedOut = false
+	return ov, nil
+}
+
+// finish returns whether the operation is canceled by the deadline.
+// It must be called with the lock of the handle held.
+func (op *pipeOp) finish() bool {
+	windows.CloseHandle(op.ov.HEvent)
+	op.ov = nil
+	return op.timedOut
+}
+
+// cancel cancels the operation in progress, if any.
+// It must be called with the lock of the handle held.
+func (op *pipeOp) cancel(h windows.Handle) {
+	if op.ov != nil {
+		windows.CancelIoEx(h, op.ov)
+	}
+}
+
+// pipeConn is the connection over the named pipe opened for the overlapped I/O.
+type pipeConn struct {
+	h    windows.Handle
+	addr pipeAddr
+
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+	read    pipeOp
+	write   pipeOp
+}
+
+func (c *pipeConn) do(op *pipeOp, call func(*windows.Overlapped) error) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, errPipeClosed
+	}
+	ov, err := op.start(call)
+	if err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	c.pending.Add(1)
+	c.mu.Unlock()
+	defer c.pending.Done()
+
+	var n uint32
+	err = windows.GetOverlappedResult(c.h, ov, &n, true)
+
+	c.mu.Lock()
+	timedOut := op.finish()
+	closed := c.closed
+	c.mu.Unlock()
+	if err == windows.ERROR_OPERATION_ABORTED {
+		if closed {
+			return int(n), errPipeClosed
+		}
+		if timedOut {
+			return int(n), pipeTimeoutError{}
+		}
+	}
+	return int(n), err
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := c.do(&c.read, func(ov *windows.Overlapped) error {
+		return windows.ReadFile(c.h, b, nil, ov)
+	})
+	if err == windows.ERROR_BROKEN_PIPE {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.do(&c.write, func(ov *windows.Overlapped) error {
+		return windows.WriteFile(c.h, b, nil, ov)
+	})
+}
+
+// Close cancels the operations in progress and closes the handle after they return.
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errPipeClosed
+	}
+	c.closed = true
+	for _, op := range []*pipeOp{&c.read, &c.write} {
+		if op.timer != nil {
+			op.timer.Stop()
+		}
+		op.cancel(c.h)
+	}
+	c.mu.Unlock()
+	c.pending.Wait()
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline(&c.read, t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline(&c.write, t)
+}
+
+// setDeadline cancels the operation in progress when t comes, which net/http
+// relies on to abort the background read of the connection.
+func (c *pipeConn) setDeadline(op *pipeOp, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errPipeClosed
+	}
+	if op.timer != nil {
+		op.timer.Stop()
+		op.timer = nil
+	}
+	op.deadline = t
+	if t.IsZero() {
+		return nil
+	}
+	op.timer = time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if op.ov != nil && !op.deadline.IsZero() && !time.Now().Before(op.deadline) {
+			op.timedOut = true
+			op.cancel(c.h)
+		}
+	})
+	return nil
+}
+
+// pipeListener accepts the connections to the named pipe, creating the
+// instance of the pipe for each of them.
+type pipeListener struct {
+	addr pipeAddr
+	sa   *windows.SecurityAttributes
+
+	mu      sync.Mutex
+	closed  bool
+	next    windows.Handle
+	waiting windows.Handle
+	accept  pipeOp
+	pending sync.WaitGroup
+}
+
+// listenPipe creates the first instance of the named pipe, which fails if
+// another process has created the pipe of the same name.
+func listenPipe(path string, sa *windows.SecurityAttributes) (*pipeListener, error) {
+	l := &pipeListener{addr: pipeAddr(path), sa: sa, waiting: windows.InvalidHandle}
+	h, err := l.createPipe(true)
+	if err != nil {
+		return nil, err
+	}
+	l.next = h
+	return l, nil
+}
+
+func (l *pipeListener) createPipe(first bool) (windows.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(string(l.addr))
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	mode := uint32(pipeAccessDuplex | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		mode |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	r1, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(name)), uintptr(mode), pipeRejectRemoteClients, pipeUnlimitedInstances,
+		pipeBufferSize, pipeBufferSize, 0, uintptr(unsafe.Pointer(l.sa)))
+	if windows.Handle(r1) == windows.InvalidHandle {
+		return windows.InvalidHandle, err
+	}
+	return windows.Handle(r1), nil
+}
+
+func connectPipe(h windows.Handle, ov *windows.Overlapped) error {
+	r1, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(ov)))
+	if r1 != 0 {
+		return nil
+	}
+	if err == windows.ERROR_PIPE_CONNECTED {
+		// the client has connected after the pipe is created
+		windows.SetEvent(ov.HEvent)
+		return nil
+	}
+	return err
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, errPipeClosed
+	}
+	h := l.next
+	l.next = windows.InvalidHandle
+	if h == windows.InvalidHandle {
+		var err error
+		if h, err = l.createPipe(false); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+	ov, err := l.accept.start(func(ov *windows.Overlapped) error {
+		return connectPipe(h, ov)
+	})
+	if err != nil {
+		l.mu.Unlock()
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	l.waiting = h
+	l.pending.Add(1)
+	l.mu.Unlock()
+	defer l.pending.Done()
+
+	var n uint32
+	err = windows.GetOverlappedResult(h, ov, &n, true)
+
+	l.mu.Lock()
+	l.accept.finish()
+	l.waiting = windows.InvalidHandle
+	closed := l.closed
+	l.mu.Unlock()
+	if err != nil {
+		windows.CloseHandle(h)
+		if closed && err == windows.ERROR_OPERATION_ABORTED {
+			return nil, errPipeClosed
+		}
+		return nil, err
+	}
+	return &pipeConn{h: h, addr: l.addr}, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return errPipeClosed
+	}
+	l.closed = true
+	if l.next != windows.InvalidHandle {
+		windows.CloseHandle(l.next)
+		l.next = windows.InvalidHandle
+	}
+	l.accept.cancel(l.waiting)
+	l.mu.Unlock()
+	l.pending.Wait()
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeBusyRetryInterval is the interval to retry opening the named pipe while
+// all the instances of it are busy.
+const pipeBusyRetryInterval = 10 * time.Millisecond
+
+// dialPipe opens the named pipe created by listenPipe until ctx is done.
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+			windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return &pipeConn{h: h, addr: pipeAddr(path)}, nil
+		}
+		if err != windows.ERROR_PIPE_BUSY {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(path), Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pipeBusyRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testPipePath(t *testing.T) string {
+	return fmt.Sprintf(`\\.\pipe\mackerel-agent-test-%d-%s`, os.Getpid(), t.Name())
+}
+
+// echoPipe writes back the message read from the connection.
+func echoPipe(conn net.Conn) error {
+	defer conn.Close()
+	buf := make([]byte, pipeBufferSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf[:n])
+	return err
+}
+
+func dialEcho(path, message string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialPipe(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func TestPipe_RoundTrip(t *testing.T) {
+	path := testPipePath(t)
+	l, err := listenPipe(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := listenPipe(path, nil); err == nil {
+		t.Error("the pipe of the same name should not be created twice")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- echoPipe(conn)
+	}()
+	got, err := dialEcho(path, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "status" {
+		t.Errorf("the message should be echoed but got %q", got)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("the server should not fail: %s", err)
+	}
+}
+
+func TestPipe_ConcurrentConnections(t *testing.T) {
+	path := testPipePath(t)
+	l, err := listenPipe(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go echoPipe(conn)
+		}
+	}()
+
+	const clients = 10
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			message := fmt.Sprintf("client %d", i)
+			got, err := dialEcho(path, message)
+			if err != nil {
+				t.Errorf("%s: %s", message, err)
+				return
+			}
+			if got != message {
+				t.Errorf("the message should be %q but got %q", message, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPipe_CloseDuringAccept(t *testing.T) {
+	l, err := listenPipe(testPipePath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errCh <- err
+	}()
+	// wait for Accept to wait for the client
+	time.Sleep(100 * time.Millisecond)
+
+	if err := l.Close(); err != nil {
+		t.Errorf("Close should not fail: %s", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != errPipeClosed {
+			t.Errorf("the pending Accept should return errPipeClosed but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending Accept should return by Close")
+	}
+	if _, err := l.Accept(); err != errPipeClosed {
+		t.Errorf("Accept after Close should return errPipeClosed but got %v", err)
+	}
+}
+
+func TestPipe_ReadDeadline(t *testing.T) {
+	path := testPipePath(t)
+	l, err := listenPipe(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept but never write
+		if conn, err := l.Accept(); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialPipe(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("the pending Read should time out but got %v", err)
+	}
+}
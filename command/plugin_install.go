@@ -0,0 +1,404 @@
+package command
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/sysproxy"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// githubAPIBase is replaced in the tests.
+var githubAPIBase = "https://api.github.com"
+
+// the limits of the size of the downloaded files and the extracted executables
+const (
+	maxPluginDownloadBytes   = 100 << 20
+	maxPluginExecutableBytes = 256 << 20
+)
+
+// PluginInstallOptions is the options of InstallPlugin.
+type PluginInstallOptions struct {
+	// Target is owner/repo[@version] of the GitHub repository,
+	// or the URL of the archive.
+	Target string
+	// Dir is the directory to install the executables into.
+	// DefaultPluginsDir is used if it is empty.
+	Dir       string
+	Overwrite bool
+}
+
+// DefaultPluginsDir returns the directory where the plugins are installed by default.
+func DefaultPluginsDir(conf *config.Config) string {
+	return filepath.Join(conf.Root, "plugins")
+}
+
+var githubTargetPattern = regexp.MustCompile(`^([\w.-]+)/([\w.-]+)(?:@(.+))?$`)
+
+// InstallPlugin downloads the archive of the plugin for the current OS and
+// architecture from the GitHub releases or the URL, and unpacks the
+// executables in it into the directory. The archive is verified by the
+// checksum file of the release if it exists. The lines of the configuration
+// to execute the installed executables are written to w.
+func InstallPlugin(conf *config.Config, opts PluginInstallOptions, w io.Writer) error {
+	dir := opts.Dir
+	if dir == "" {
+		dir = DefaultPluginsDir(conf)
+	}
+	client := pluginInstallClient(conf)
+
+	var archiveURL, checksumURL string
+	if strings.Contains(opts.Target, "://") {
+		archiveURL = opts.Target
+	} else {
+		m := githubTargetPattern.FindStringSubmatch(opts.Target)
+		if m == nil {
+			return fmt.Errorf("the plugin should be owner/repo[@version] or the URL of the archive, but %q", opts.Target)
+		}
+		release, err := fetchGitHubRelease(client, m[1], m[2], m[3])
+		if err != nil {
+			return err
+		}
+		archive, checksum := selectReleaseAssets(release.Assets, runtime.GOOS, runtime.GOARCH)
+		if archive == nil {
+			return fmt.Errorf("no archive for %s/%s is found in the release %s of %s/%s", runtime.GOOS, runtime.GOARCH, release.TagName, m[1], m[2])
+		}
+		archiveURL = archive.BrowserDownloadURL
+		if checksum != nil {
+			checksumURL = checksum.BrowserDownloadURL
+		}
+	}
+
+	data, err := downloadPluginFile(client, archiveURL)
+	if err != nil {
+		return err
+	}
+	name := archiveName(archiveURL)
+	if checksumURL != "" {
+		sums, err := downloadPluginFile(client, checksumURL)
+		if err != nil {
+			return err
+		}
+		if err := verifyChecksum(data, name, sums); err != nil {
+			return err
+		}
+	}
+	executables, err := extractExecutables(name, data)
+	if err != nil {
+		return err
+	}
+	if len(executables) == 0 {
+		return fmt.Errorf("no executables are found in %s", name)
+	}
+
+	names := make([]string, 0, len(executables))
+	for n := range executables {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if !opts.Overwrite {
+		for _, n := range names {
+			if _, err := os.Stat(filepath.Join(dir, n)); err == nil {
+				return fmt.Errorf("%s already exists (use -overwrite to replace it)", filepath.Join(dir, n))
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, n := range names {
+		file := filepath.Join(dir, n)
+		if err := writeExecutable(file, executables[n]); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "command = %q\n", file)
+	}
+	return nil
+}
+
+// pluginInstallClient creates the client which sends the requests via
+// http_proxy of the configuration, or the proxy of the environment.
+func pluginInstallClient(conf *config.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{Proxy: ConfigProxy(conf), DialContext: ConfigDialContext(conf)},
+		Timeout:   5 * time.Minute,
+	}
+}
+
+// ConfigProxy returns the proxy function of http.Transport which selects
+// http_proxy of the configuration, the proxy of the environment, or the proxy
+// of the system settings with proxy = "system", in this order.
+func ConfigProxy(conf *config.Config) func(*http.Request) (*url.URL, error) {
+	if conf.HTTPProxy != "" {
+		return func(*http.Request) (*url.URL, error) {
+			return url.Parse(conf.HTTPProxy)
+		}
+	}
+	if conf.Proxy == config.ProxySystem && !hasProxyEnv() {
+		return systemProxy().Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// ConfigDialContext returns the DialContext of http.Transport which connects
+// from bind_address of the configuration, or nil to connect by default. The
+// connections fail if the address is no longer assigned, not to go out from
+// the other interfaces.
+func ConfigDialContext(conf *config.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	ip, err := config.ResolveBindAddress(conf.BindAddress)
+	if err != nil {
+		return func(context.Context, string, string) (net.Conn, error) {
+			return nil, err
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+	return mackerel.Dialer(ip).DialContext
+}
+
+func hasProxyEnv() bool {
+	for _, key := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if os.Getenv(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	systemProxyOnce     sync.Once
+	systemProxyResolver *sysproxy.Resolver
+)
+
+// systemProxy returns the resolver shared by the clients, not to resolve the
+// proxies for each of them.
+func systemProxy() *sysproxy.Resolver {
+	systemProxyOnce.Do(func() {
+		systemProxyResolver = sysproxy.NewResolver(sysproxy.DefaultRefreshInterval)
+	})
+	return systemProxyResolver
+}
+
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Assets  []githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// fetchGitHubRelease fetches the release of the version, or the latest release
+// if the version is empty.
+func fetchGitHubRelease(client *http.Client, owner, repo, version string) (*githubRelease, error) {
+	u := githubAPIBase + "/repos/" + owner + "/" + repo + "/releases/latest"
+	if version != "" {
+		u = githubAPIBase + "/repos/" + owner + "/" + repo + "/releases/tags/" + url.PathEscape(version)
+	}
+	data, err := downloadPluginFile(client, u)
+	if err != nil {
+		return nil, err
+	}
+	var release githubRelease
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("failed to parse the release of %s/%s: %s", owner, repo, err)
+	}
+	return &release, nil
+}
+
+var archArchiveAliases = map[string][]string{
+	"amd64": {"x86_64"},
+	"386":   {"i386", "x86"},
+	"arm64": {"aarch64"},
+}
+
+// selectReleaseAssets returns the archive for goos and goarch, and the checksum
+// file. The names of the archives are split by the separators to find goos and
+// goarch, such as mackerel-plugin-foo_linux_amd64.zip.
+func selectReleaseAssets(assets []githubAsset, goos, goarch string) (archive, checksum *githubAsset) {
+	for i, a := range assets {
+		name := strings.ToLower(a.Name)
+		if strings.Contains(name, "checksums") || strings.Contains(name, "sha256sums") {
+			if checksum == nil {
+				checksum = &assets[i]
+			}
+			continue
+		}
+		if archive != nil || !isPluginArchive(name) {
+			continue
+		}
+		// the adjacent pairs are also the tokens to find x86_64
+		tokens := make(map[string]bool)
+		fields := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' })
+		for i, f := range fields {
+			tokens[f] = true
+			if i > 0 {
+				tokens[fields[i-1]+"_"+f] = true
+			}
+		}
+		if !tokens[goos] {
+			continue
+		}
+		for _, arch := range append([]string{goarch}, archArchiveAliases[goarch]...) {
+			if tokens[arch] {
+				archive = &assets[i]
+				break
+			}
+		}
+	}
+	return archive, checksum
+}
+
+func isPluginArchive(name string) bool {
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+func archiveName(archiveURL string) string {
+	if u, err := url.Parse(archiveURL); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(archiveURL)
+}
+
+func downloadPluginFile(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", u, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPluginDownloadBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %s", u, err)
+	}
+	if len(data) > maxPluginDownloadBytes {
+		return nil, fmt.Errorf("failed to download %s: larger than %d bytes", u, maxPluginDownloadBytes)
+	}
+	return data, nil
+}
+
+// verifyChecksum verifies data by the SHA-256 checksum of name in sums,
+// whose lines are the checksums and the names as sha256sum outputs.
+func verifyChecksum(data []byte, name string, sums []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(sums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != name {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("the checksum of %s does not match: %s expected but %x", name, fields[0], sum)
+		}
+		return nil
+	}
+	return fmt.Errorf("the checksum of %s is not found in the checksum file", name)
+}
+
+// extractExecutables returns the executables in the archive by the base names.
+// The directories in the archive are ignored.
+func extractExecutables(name string, data []byte) (map[string][]byte, error) {
+	executables := make(map[string][]byte)
+	add := func(file string, mode os.FileMode, r io.Reader) error {
+		base := path.Base(strings.Replace(file, `\`, "/", -1))
+		if !isExecutable(base, mode) {
+			return nil
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r, maxPluginExecutableBytes+1))
+		if err != nil {
+			return err
+		}
+		if len(b) > maxPluginExecutableBytes {
+			return fmt.Errorf("%s in %s is larger than %d bytes", file, name, maxPluginExecutableBytes)
+		}
+		executables[base] = b
+		return nil
+	}
+
+	switch lower := strings.ToLower(name); {
+	case strings.HasSuffix(lower, ".zip"):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			err = add(f.Name, f.Mode(), r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		tr := tar.NewReader(gr)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+				continue
+			}
+			if err := add(h.Name, h.FileInfo().Mode(), tr); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown archive format: %s", name)
+	}
+	return executables, nil
+}
+
+func isExecutable(name string, mode os.FileMode) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Ext(name), ".exe")
+	}
+	return mode&0111 != 0
+}
+
+// writeExecutable writes the executable to the temporary file and renames it,
+// not to leave the broken executable.
+func writeExecutable(file string, data []byte) error {
+	return util.WriteFileAtomically(file, data, 0755)
+}
@@ -0,0 +1,144 @@
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func newTarGz(t *testing.T, files map[string]int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, mode := range files {
+		content := "#!/bin/sh\necho " + name + "\n"
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestInstallPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the executables are found by the modes")
+	}
+	name := fmt.Sprintf("mackerel-plugin-foo_%s_%s.tar.gz", runtime.GOOS, runtime.GOARCH)
+	archive := newTarGz(t, map[string]int64{
+		"mackerel-plugin-foo_x/mackerel-plugin-foo": 0755,
+		"mackerel-plugin-foo_x/README.md":           0644,
+	})
+	sum := sha256.Sum256(archive)
+	checksums := fmt.Sprintf("%x  %s\n", sum, name)
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/repos/mackerelio/mackerel-plugin-foo/releases/tags/v1.0.0":
+			fmt.Fprintf(w, `{"tag_name": "v1.0.0", "assets": [
+				{"name": "mackerel-plugin-foo_windows_amd64.zip", "browser_download_url": "%[1]s/windows.zip"},
+				{"name": "%[2]s", "browser_download_url": "%[1]s/download/%[2]s"},
+				{"name": "checksums.txt", "browser_download_url": "%[1]s/download/checksums.txt"}
+			]}`, ts.URL, name)
+		case "/download/" + name:
+			w.Write(archive)
+		case "/download/checksums.txt":
+			w.Write([]byte(checksums))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	defer func(base string) { githubAPIBase = base }(githubAPIBase)
+	githubAPIBase = ts.URL
+
+	root, err := ioutil.TempDir("", "mackerel-agent-plugin-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	conf := &config.Config{Root: root}
+	opts := PluginInstallOptions{Target: "mackerelio/mackerel-plugin-foo@v1.0.0"}
+
+	var out bytes.Buffer
+	if err := InstallPlugin(conf, opts, &out); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	file := filepath.Join(root, "plugins", "mackerel-plugin-foo")
+	if got, expect := out.String(), fmt.Sprintf("command = %q\n", file); got != expect {
+		t.Errorf("the configuration should be %q but got %q", expect, got)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode()&0111 == 0 {
+		t.Errorf("the executable should be installed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "plugins", "README.md")); !os.IsNotExist(err) {
+		t.Errorf("the files except for the executables should not be installed: %v", err)
+	}
+
+	err = InstallPlugin(conf, opts, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("the installed executable should not be overwritten: %v", err)
+	}
+	opts.Overwrite = true
+	if err := InstallPlugin(conf, opts, ioutil.Discard); err != nil {
+		t.Errorf("the installed executable should be overwritten: %s", err)
+	}
+
+	checksums = strings.Repeat("0", 64) + "  " + name + "\n"
+	opts.Dir = filepath.Join(root, "other")
+	err = InstallPlugin(conf, opts, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("the archive should be verified by the checksum: %v", err)
+	}
+	if _, err := os.Stat(opts.Dir); !os.IsNotExist(err) {
+		t.Errorf("nothing should be installed: %v", err)
+	}
+}
+
+func TestSelectReleaseAssets(t *testing.T) {
+	assets := []githubAsset{
+		{Name: "mackerel-plugin-foo_linux_arm64.zip"},
+		{Name: "mackerel-plugin-foo_linux_arm.zip"},
+		{Name: "mackerel-plugin-foo_0.1.0_checksums.txt"},
+		{Name: "mackerel-plugin-foo_Linux_x86_64.tar.gz"},
+		{Name: "mackerel-plugin-foo_linux_amd64.deb"},
+	}
+	tests := []struct {
+		goos, goarch string
+		expect       string
+	}{
+		{"linux", "arm", "mackerel-plugin-foo_linux_arm.zip"},
+		{"linux", "arm64", "mackerel-plugin-foo_linux_arm64.zip"},
+		{"linux", "amd64", "mackerel-plugin-foo_Linux_x86_64.tar.gz"},
+		{"darwin", "amd64", ""},
+	}
+	for _, tc := range tests {
+		archive, checksum := selectReleaseAssets(assets, tc.goos, tc.goarch)
+		var got string
+		if archive != nil {
+			got = archive.Name
+		}
+		if got != tc.expect {
+			t.Errorf("the archive for %s/%s should be %q but got %q", tc.goos, tc.goarch, tc.expect, got)
+		}
+		if checksum == nil || checksum.Name != "mackerel-plugin-foo_0.1.0_checksums.txt" {
+			t.Errorf("the checksum file should be found: %+v", checksum)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package command
+
+import (
+	"encoding/json"
+
+	"github.com/mackerelio/mackerel-agent/agent"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// The default limits of the metric values posted by a request, which are
+// below the limit of the payload of the API with enough margin.
+const (
+	defaultPostMetricsMaxValues = 10000
+	defaultPostMetricsMaxBytes  = 1024 * 1024
+)
+
+// postLimits are the maximum number of the metric values and the maximum size
+// of the serialized body of a request posting them.
+type postLimits struct {
+	maxValues int
+	maxBytes  int
+}
+
+func postMetricsLimits(conf *config.Config) postLimits {
+	l := postLimits{maxValues: defaultPostMetricsMaxValues, maxBytes: defaultPostMetricsMaxBytes}
+	if conf.PostMetricsMaxValues != nil {
+		l.maxValues = *conf.PostMetricsMaxValues
+	}
+	if conf.PostMetricsMaxBytes != nil {
+		l.maxBytes = *conf.PostMetricsMaxBytes
+	}
+	return l
+}
+
+// splitPostValues splits each of the values into the chunks within l, which
+// are posted and retried independently. The chunks of a value keep its retry
+// count, so that the values retried are not merged with the fresh ones. A
+// value larger than l.maxBytes by itself is posted alone.
+func splitPostValues(values []*postValue, l postLimits) []*postValue {
+	var chunks []*postValue
+	for _, v := range values {
+		var (
+			chunk *postValue
+			size  int
+		)
+		for _, mv := range v.values {
+			n := 1 // the comma or the bracket
+			if b, err := json.Marshal(mv); err == nil {
+				n += len(b)
+			}
+			if chunk != nil && (len(chunk.values) >= l.maxValues || size+n > l.maxBytes) {
+				chunk = nil
+			}
+			if chunk == nil {
+				chunk = &postValue{retryCnt: v.retryCnt}
+				chunks = append(chunks, chunk)
+				size = 1 // the closing bracket
+			}
+			chunk.values = append(chunk.values, mv)
+			size += n
+		}
+	}
+	return chunks
+}
+
+// maxBisectRequests is the maximum number of the requests to bisect the metric
+// values or the check reports rejected by the validation of the API in a post,
+// so that the API is not flooded when all of them are rejected.
+const maxBisectRequests = 32
+
+// postChunks posts the chunks in order, and returns the ones not posted with
+// the last error. The chunks rejected by the API are dropped to post the rest,
+// since they would be rejected again by the retries, but the other errors,
+// such as the network errors and the maintenance, stop posting since the rest
+// would fail in the same way. The chunks rejected by the validation are
+// bisected to post the valid values in them, and the values rejected by
+// themselves are dropped.
+func postChunks(api *mackerel.API, chunks []*postValue) ([]*postValue, error) {
+	p := &chunkPoster{api: api, budget: maxBisectRequests}
+	for i, c := range chunks {
+		if !p.post(c) {
+			return append(p.pending, chunks[i+1:]...), p.err
+		}
+	}
+	return p.pending, p.err
+}
+
+// chunkPoster posts the chunks, and keeps the ones not posted.
+type chunkPoster struct {
+	api     *mackerel.API
+	budget  int
+	pending []*postValue
+	err     error
+}
+
+// post posts c, and returns false if the rest should not be posted.
+func (p *chunkPoster) post(c *postValue) bool {
+	err := p.api.PostHostMetricValues(c.values)
+	switch {
+	case err == nil:
+		return true
+	case !isRejectedChunk(err):
+		p.pending, p.err = append(p.pending, c), err
+		return false
+	case len(c.values) == 1 && mackerel.IsValidationError(err):
+		rejectValue(c.values[0], err)
+		return true
+	case !mackerel.IsValidationError(err) || p.budget < 2:
+		rejectChunk(c, err)
+		return true
+	}
+	p.budget -= 2
+	mid := len(c.values) / 2
+	halves := []*postValue{
+		{values: c.values[:mid], retryCnt: c.retryCnt},
+		{values: c.values[mid:], retryCnt: c.retryCnt},
+	}
+	for i, h := range halves {
+		if !p.post(h) {
+			p.pending = append(p.pending, halves[i+1:]...)
+			return false
+		}
+	}
+	return true
+}
+
+// rejectValue logs the value rejected by the API by itself, and counts it by
+// the metrics plugin which generated it.
+func rejectValue(v *mkr.HostMetricValue, err error) {
+	id := agent.MetricSource(v.Name)
+	source := id
+	if source == "" {
+		source = "the agent"
+	}
+	logger.Errorf("The metric value %q = %v at %d of %s is rejected by the API and dropped: %s", v.Name, v.Value, v.Time, source, err)
+	if id != "" {
+		pluginstats.RecordRejected(id)
+	}
+}
+
+// rejectChunk logs the chunk rejected by the API, which is not bisected, and
+// counts the values in it by the metrics plugins which generated them.
+func rejectChunk(c *postValue, err error) {
+	logger.Errorf("%d metric values are rejected by the API and dropped: %s", len(c.values), err)
+	for _, v := range c.values {
+		if id := agent.MetricSource(v.Name); id != "" {
+			pluginstats.RecordRejected(id)
+		}
+	}
+}
+
+// isRejectedChunk returns true if the chunk itself is rejected by the API,
+// which is not related to the other chunks.
+func isRejectedChunk(err error) bool {
+	return mackerel.IsClientError(err) && !mackerel.IsAuthError(err) && !mackerel.IsRetryable(err)
+}
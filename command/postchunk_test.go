@@ -0,0 +1,205 @@
+package command
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func syntheticPostValues(sizes ...int) []*postValue {
+	var values []*postValue
+	n := 0
+	for i, size := range sizes {
+		v := &postValue{retryCnt: i}
+		for j := 0; j < size; j++ {
+			v.values = append(v.values, &mkr.HostMetricValue{
+				HostID:      "host",
+				MetricValue: &mkr.MetricValue{Name: fmt.Sprintf("custom.plugin%d.metric%d", n%97, n), Time: 1397031808, Value: float64(n)},
+			})
+			n++
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestSplitPostValues(t *testing.T) {
+	values := syntheticPostValues(30000, 20000)
+	l := postLimits{maxValues: 8000, maxBytes: 256 * 1024}
+
+	chunks := splitPostValues(values, l)
+	seen := make(map[string]bool)
+	var names []string
+	for _, c := range chunks {
+		if len(c.values) > l.maxValues {
+			t.Errorf("the chunk should be within %d values: %d", l.maxValues, len(c.values))
+		}
+		b, err := json.Marshal(c.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > l.maxBytes {
+			t.Errorf("the chunk should be within %d bytes: %d", l.maxBytes, len(b))
+		}
+		for _, v := range c.values {
+			if seen[v.Name] {
+				t.Errorf("the value should not be duplicated: %s", v.Name)
+			}
+			seen[v.Name] = true
+			names = append(names, v.Name)
+		}
+	}
+	if len(names) != 50000 {
+		t.Fatalf("all the values should be in the chunks: %d", len(names))
+	}
+	i := 0
+	for _, v := range values {
+		for _, mv := range v.values {
+			if names[i] != mv.Name {
+				t.Fatalf("the values should be in order: %s, %s", names[i], mv.Name)
+			}
+			i++
+		}
+	}
+	retryCnts := make(map[string]int)
+	for _, v := range values {
+		for _, mv := range v.values {
+			retryCnts[mv.Name] = v.retryCnt
+		}
+	}
+	for _, c := range chunks {
+		for _, v := range c.values {
+			if retryCnts[v.Name] != c.retryCnt {
+				t.Fatalf("the chunk should have the retry count of the values in it: %d, %d", c.retryCnt, retryCnts[v.Name])
+			}
+		}
+	}
+	if merged := splitPostValues(syntheticPostValues(1, 1), l); len(merged) != 2 {
+		t.Errorf("the values of the different retry counts should not be merged: %d chunks", len(merged))
+	}
+
+	large := syntheticPostValues(2)
+	large[0].values[0].Name = string(make([]byte, 100))
+	if chunks := splitPostValues(large, postLimits{maxValues: 10, maxBytes: 50}); len(chunks) != 2 {
+		t.Errorf("the value larger than the limit should be posted alone: %d chunks", len(chunks))
+	}
+}
+
+func TestPostChunks(t *testing.T) {
+	var posted []string
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gz
+		}
+		var values []*mkr.HostMetricValue
+		if err := json.NewDecoder(r).Decode(&values); err != nil {
+			t.Fatal(err)
+		}
+		if values[0].Name == "custom.plugin1.metric1" {
+			http.Error(w, `{"error":{"message":"rejected"}}`, status)
+			return
+		}
+		for _, v := range values {
+			posted = append(posted, v.Name)
+		}
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer ts.Close()
+	api, err := prepareAPI(&config.Config{}, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := splitPostValues(syntheticPostValues(3), postLimits{maxValues: 1, maxBytes: 1024 * 1024})
+	pending, err := postChunks(api, chunks)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("the rejected chunk should be dropped: %v, %v", pending, err)
+	}
+	if len(posted) != 2 {
+		t.Errorf("the chunks after the rejected one should be posted: %v", posted)
+	}
+
+	posted = nil
+	status = http.StatusForbidden
+	pending, err = postChunks(api, chunks)
+	if err == nil || len(pending) != 2 {
+		t.Errorf("the chunks should not be posted after the API key is rejected: %v, %v", pending, err)
+	}
+	if len(posted) != 1 {
+		t.Errorf("the chunk before the failure should be posted: %v", posted)
+	}
+}
+
+func TestPostChunks_bisect(t *testing.T) {
+	var posted []string
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		var r io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gz
+		}
+		var values []*mkr.HostMetricValue
+		if err := json.NewDecoder(r).Decode(&values); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range values {
+			if v.Name == "custom.plugin3.metric3" || v.Name == "custom.plugin6.metric6" || strings.HasPrefix(v.Name, "custom.plugin1.") {
+				http.Error(w, `{"error":{"message":"invalid metric name"}}`, http.StatusBadRequest)
+				return
+			}
+		}
+		for _, v := range values {
+			posted = append(posted, v.Name)
+		}
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer ts.Close()
+	api, err := prepareAPI(&config.Config{}, ts.URL, "apikey", &AgentMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := postChunks(api, syntheticPostValues(10))
+	if err != nil || len(pending) != 0 {
+		t.Errorf("the rejected values should be dropped: %v, %v", pending, err)
+	}
+	if len(posted) != 7 {
+		t.Errorf("the valid values should be posted: %v", posted)
+	}
+
+	// all the values are rejected
+	posted, requests = nil, 0
+	values := syntheticPostValues(97 * 100)[0].values
+	var rejected []*mkr.HostMetricValue
+	for _, v := range values {
+		if strings.HasPrefix(v.Name, "custom.plugin1.") {
+			rejected = append(rejected, v)
+		}
+	}
+	pending, err = postChunks(api, []*postValue{{values: rejected}})
+	if err != nil || len(pending) != 0 {
+		t.Errorf("the values should be dropped after the bisection gives up: %v, %v", pending, err)
+	}
+	if requests > maxBisectRequests+1 || len(posted) != 0 {
+		t.Errorf("the bisection should be limited: %d requests", requests)
+	}
+}
@@ -0,0 +1,95 @@
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/util"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// registrationMarkerFile is the file which marks that the registration of the
+// new host is in flight. The host may be registered even if the request
+// failed, so the agent restarted while the file exists searches for the host
+// registered by the last run instead of registering another one.
+func registrationMarkerFile(conf *config.Config) string {
+	return filepath.Join(conf.Root, "registering")
+}
+
+type registrationMarker struct {
+	Name             string `json:"name"`
+	CustomIdentifier string `json:"customIdentifier,omitempty"`
+	// StartedAt is when the first registration started in unix time.
+	StartedAt int64 `json:"startedAt"`
+}
+
+func loadRegistrationMarker(conf *config.Config) *registrationMarker {
+	content, err := ioutil.ReadFile(registrationMarkerFile(conf))
+	if err != nil {
+		return nil
+	}
+	var m registrationMarker
+	if err := json.Unmarshal(content, &m); err != nil {
+		logger.Warningf("Failed to read %s: %s", registrationMarkerFile(conf), err)
+		return nil
+	}
+	return &m
+}
+
+func saveRegistrationMarker(conf *config.Config, m *registrationMarker) error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomically(registrationMarkerFile(conf), content, 0644)
+}
+
+func removeRegistrationMarker(conf *config.Config) {
+	if err := os.Remove(registrationMarkerFile(conf)); err != nil && !os.IsNotExist(err) {
+		logger.Warningf("Failed to remove %s: %s", registrationMarkerFile(conf), err)
+	}
+}
+
+// registrationClockSkew is the allowance of the difference between the clocks
+// of the host and Mackerel in comparing the registered time of the hosts.
+const registrationClockSkew = 5 * time.Minute
+
+// findRegisteredHost returns the host which is registered by the registration
+// of the marker but whose ID is not saved, by the custom identifier or the
+// name registered since the marker. The hosts of the other custom identifiers
+// are not the ones. If there are duplicate hosts, the oldest one is returned.
+func findRegisteredHost(api *mackerel.API, m *registrationMarker) (*mkr.Host, error) {
+	hosts, err := api.FindHostsByName(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Unix(m.StartedAt, 0).Add(-registrationClockSkew).Unix()
+	var candidates []*mkr.Host
+	for _, h := range hosts {
+		if int64(h.CreatedAt) < since || h.CustomIdentifier != m.CustomIdentifier {
+			continue
+		}
+		candidates = append(candidates, h)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].CreatedAt < candidates[j].CreatedAt
+	})
+	if len(candidates) > 1 {
+		ids := make([]string, 0, len(candidates)-1)
+		for _, h := range candidates[1:] {
+			ids = append(ids, h.ID)
+		}
+		logger.Warningf("The duplicate hosts %s were registered for this host besides %s, which may be retired", strings.Join(ids, ", "), candidates[0].ID)
+	}
+	return candidates[0], nil
+}
@@ -0,0 +1,134 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/exitcode"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var retireRetryPolicy = &mackerel.RetryPolicy{
+	InitialInterval: 1 * time.Second,
+	MaxInterval:     10 * time.Second,
+	MaxElapsedTime:  1 * time.Minute,
+}
+
+// RetireOptions are the options of the retire subcommand.
+type RetireOptions struct {
+	// Force is to retire the host without prompting, and to succeed if the
+	// host is already retired.
+	Force bool
+	// DryRun is to print the host to retire without retiring it.
+	DryRun bool
+	// OnlyIfStatus are the statuses of the host allowed to be retired, such as
+	// poweroff and standby. The host of any status is retired if empty.
+	OnlyIfStatus []string
+}
+
+func (opts RetireOptions) allows(status string) bool {
+	for _, st := range opts.OnlyIfStatus {
+		if st == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHostStatuses parses the comma separated statuses of the hosts.
+func ParseHostStatuses(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var statuses []string
+	for _, st := range strings.Split(s, ",") {
+		st = strings.TrimSpace(st)
+		if !isControlHostStatus(st) {
+			return nil, fmt.Errorf("invalid host status %q (should be one of %s)", st, strings.Join(controlHostStatuses, ", "))
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+// Retire retires the host of the host ID file and removes the file. The
+// host already retired is an error of exitcode.HostNotFound unless forced.
+// confirm asks whether to retire the host unless forced, and the dry run
+// writes the host to w.
+func Retire(conf *config.Config, api *mackerel.API, opts RetireOptions, confirm func(string) bool, w io.Writer) error {
+	hostID, err := conf.LoadHostID()
+	if err != nil {
+		return retiredAlready(conf, opts, "", errors.New("the host ID file is not found or empty"))
+	}
+
+	ctx := context.Background()
+	var host *mkr.Host
+	err = api.Retry(ctx, retireRetryPolicy, "FindHost", func() error {
+		host, err = api.FindHost(hostID)
+		return err
+	})
+	switch {
+	case mackerel.IsNotFound(err):
+		return retiredAlready(conf, opts, hostID, fmt.Errorf("the host %s is not found on Mackerel", hostID))
+	case err != nil:
+		return retireError(fmt.Errorf("failed to find the host %s: %s", hostID, err), err)
+	case host.IsRetired:
+		return retiredAlready(conf, opts, hostID, fmt.Errorf("the host %s is already retired", hostID))
+	}
+	if len(opts.OnlyIfStatus) > 0 && !opts.allows(host.Status) {
+		return exitcode.WithCode(fmt.Errorf("the host %s is not retired since its status is %s, not %s", hostID, host.Status, strings.Join(opts.OnlyIfStatus, " or ")), exitcode.PreconditionFailed)
+	}
+	if opts.DryRun {
+		_, err := fmt.Fprintf(w, "The host %s (name: %s, status: %s) would be retired\n", hostID, host.Name, host.Status)
+		return err
+	}
+	if !opts.Force && !confirm(fmt.Sprintf("retire this host? (hostID: %s, name: %s, status: %s)", hostID, host.Name, host.Status)) {
+		return exitcode.WithCode(errors.New("retirement is canceled"), exitcode.Canceled)
+	}
+
+	err = api.Retry(ctx, retireRetryPolicy, "RetireHost", func() error {
+		return api.RetireHost(hostID)
+	})
+	if mackerel.IsNotFound(err) {
+		// retired by another in the meantime
+		return retiredAlready(conf, opts, hostID, fmt.Errorf("the host %s is already retired", hostID))
+	}
+	if err != nil {
+		return retireError(fmt.Errorf("failed to retire the host: %s", err), err)
+	}
+	logger.WithFields(logformat.Fields{"host_id": hostID}).Infof("This host (hostID: %s) has been retired.", hostID)
+	// just to try to remove hostID file.
+	if err := conf.DeleteSavedHostID(); err != nil {
+		logger.Warningf("Failed to remove HostID file: %s", err)
+	}
+	return nil
+}
+
+// retiredAlready succeeds with the forced options, removing the host ID file
+// of the retired host if any. Otherwise it returns err with exitcode.HostNotFound.
+func retiredAlready(conf *config.Config, opts RetireOptions, hostID string, err error) error {
+	if !opts.Force {
+		return exitcode.WithCode(fmt.Errorf("%s (this host may be already retired)", err), exitcode.HostNotFound)
+	}
+	logger.Infof("Nothing to retire: %s", err)
+	if hostID != "" && !opts.DryRun {
+		if err := conf.DeleteSavedHostID(); err != nil {
+			logger.Warningf("Failed to remove HostID file: %s", err)
+		}
+	}
+	return nil
+}
+
+func retireError(err, apiErr error) error {
+	if mackerel.IsAuthError(apiErr) {
+		return exitcode.WithCode(err, exitcode.AuthError)
+	}
+	return exitcode.WithCode(err, exitcode.Error)
+}
@@ -0,0 +1,114 @@
+package command
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/exitcode"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestRetire(t *testing.T) {
+	origPolicy := retireRetryPolicy
+	retireRetryPolicy = &mackerel.RetryPolicy{MaxElapsedTime: time.Millisecond}
+	defer func() {
+		retireRetryPolicy = origPolicy
+	}()
+
+	testCases := []struct {
+		name     string
+		noIDFile bool
+		// host is nil for 404
+		host     *mkr.Host
+		opts     RetireOptions
+		confirm  bool
+		code     int
+		retired  bool
+		idFile   bool
+		contains string
+	}{
+		{name: "retire", host: &mkr.Host{Status: "working"}, confirm: true, code: exitcode.OK, retired: true},
+		{name: "forced", host: &mkr.Host{Status: "working"}, opts: RetireOptions{Force: true}, code: exitcode.OK, retired: true},
+		{name: "canceled", host: &mkr.Host{Status: "working"}, code: exitcode.Canceled, idFile: true},
+		{name: "dry run", host: &mkr.Host{Name: "host1", Status: "standby"}, opts: RetireOptions{DryRun: true}, code: exitcode.OK, idFile: true, contains: "xxx12345678 (name: host1, status: standby) would be retired"},
+		{name: "status matched", host: &mkr.Host{Status: "poweroff"}, opts: RetireOptions{Force: true, OnlyIfStatus: []string{"poweroff", "standby"}}, code: exitcode.OK, retired: true},
+		{name: "status unmatched", host: &mkr.Host{Status: "working"}, opts: RetireOptions{Force: true, OnlyIfStatus: []string{"poweroff", "standby"}}, code: exitcode.PreconditionFailed, idFile: true},
+		{name: "dry run of status unmatched", host: &mkr.Host{Status: "working"}, opts: RetireOptions{DryRun: true, OnlyIfStatus: []string{"poweroff"}}, code: exitcode.PreconditionFailed, idFile: true},
+		{name: "no id file", noIDFile: true, code: exitcode.HostNotFound},
+		{name: "no id file forced", noIDFile: true, opts: RetireOptions{Force: true}, code: exitcode.OK},
+		{name: "retired", host: &mkr.Host{Status: "working", IsRetired: true}, code: exitcode.HostNotFound, idFile: true},
+		{name: "retired forced", host: &mkr.Host{Status: "working", IsRetired: true}, opts: RetireOptions{Force: true}, code: exitcode.OK},
+		{name: "not found", code: exitcode.HostNotFound, idFile: true},
+		{name: "not found forced", opts: RetireOptions{Force: true}, code: exitcode.OK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+			defer deferFunc()
+			if !tc.noIDFile {
+				conf.SaveHostID("xxx12345678")
+			}
+			mockHandlers["GET /api/v0/hosts/xxx12345678"] = func(req *http.Request) (int, jsonObject) {
+				if tc.host == nil {
+					return 404, jsonObject{"error": jsonObject{"message": "Host Not Found"}}
+				}
+				h := *tc.host
+				h.ID = "xxx12345678"
+				return 200, jsonObject{"host": h}
+			}
+			var retired bool
+			mockHandlers["POST /api/v0/hosts/xxx12345678/retire"] = func(req *http.Request) (int, jsonObject) {
+				retired = true
+				return 200, jsonObject{"success": true}
+			}
+			api, _ := mackerel.NewAPI(ts.URL, "apikey", false)
+
+			var out bytes.Buffer
+			err := Retire(&conf, api, tc.opts, func(string) bool { return tc.confirm }, &out)
+			if code := exitcode.Of(err); code != tc.code {
+				t.Errorf("the exit code should be %d but %d: %v", tc.code, code, err)
+			}
+			if retired != tc.retired {
+				t.Errorf("the host should be retired: %t", tc.retired)
+			}
+			if _, err := conf.LoadHostID(); (err == nil) != tc.idFile {
+				t.Errorf("the host ID file should be kept: %t", tc.idFile)
+			}
+			if !strings.Contains(out.String(), tc.contains) {
+				t.Errorf("the output should contain %q: %q", tc.contains, out.String())
+			}
+		})
+	}
+}
+
+func TestRetire_authError(t *testing.T) {
+	conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+	conf.SaveHostID("xxx12345678")
+	mockHandlers["GET /api/v0/hosts/xxx12345678"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{"host": mkr.Host{ID: "xxx12345678", Status: "working"}}
+	}
+	mockHandlers["POST /api/v0/hosts/xxx12345678/retire"] = func(req *http.Request) (int, jsonObject) {
+		return 403, jsonObject{"error": jsonObject{"message": "Permission denied"}}
+	}
+	api, _ := mackerel.NewAPI(ts.URL, "apikey", false)
+
+	err := Retire(&conf, api, RetireOptions{Force: true}, nil, &bytes.Buffer{})
+	if code := exitcode.Of(err); code != exitcode.AuthError {
+		t.Errorf("the exit code should be %d but %d: %v", exitcode.AuthError, code, err)
+	}
+}
+
+func TestParseHostStatuses(t *testing.T) {
+	statuses, err := ParseHostStatuses("poweroff, standby")
+	if err != nil || len(statuses) != 2 || statuses[0] != "poweroff" || statuses[1] != "standby" {
+		t.Errorf("the statuses should be parsed: %v, %v", statuses, err)
+	}
+	if _, err := ParseHostStatuses("poweroff,retired"); err == nil {
+		t.Errorf("the invalid status should raise error")
+	}
+}
@@ -0,0 +1,37 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/sdnotify"
+)
+
+// notifySystemd notifies systemd of the states if the service is of Type=notify.
+func notifySystemd(states ...string) {
+	if err := sdnotify.Notify(states...); err != nil {
+		logger.Debugf("Failed to notify systemd: %s", err)
+	}
+}
+
+// systemdStatus returns the status shown by systemctl status, with the result
+// of the last post of the metrics and the numbers of the pending payloads.
+func (app *App) systemdStatus(postFailures int) string {
+	sizes := app.status.bufferSizes()
+	pending := fmt.Sprintf("%d pending collections of the metrics and %d check reports", sizes[statusKindMetrics], sizes[statusKindChecks])
+	if postFailures > 0 {
+		return fmt.Sprintf("failed to post the metrics %d times in a row, %s", postFailures, pending)
+	}
+	return fmt.Sprintf("posted the metrics at %s, %s", time.Now().Format("15:04:05"), pending)
+}
+
+// watchdogTicker returns the channel to send sdnotify.Watchdog in the half of
+// WatchdogSec, or nil if the watchdog is not enabled.
+func watchdogTicker() (<-chan time.Time, func()) {
+	d := sdnotify.WatchdogInterval()
+	if d <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(d / 2)
+	return t.C, t.Stop
+}
@@ -0,0 +1,233 @@
+package command
+
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/exitcode"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+	"github.com/pkg/errors"
+)
+
+// secondary mirrors the metric values and the check reports to the secondary
+// destination configured by [secondary], after they are posted to the primary.
+// It has its own queues and retries, so that the failures of the secondary
+// never block posting to the primary. The messages with the mirroring are
+// sent without blocking, and dropped when the queues are full.
+type secondary struct {
+	app  *App
+	conf *config.Config
+	api  *mackerel.API
+
+	// hostIDs maps the ids of the hosts on the primary to those on the secondary.
+	hostIDs map[string]string
+
+	graphDefsQueue chan []*mkr.GraphDefsParam
+	metricsQueue   chan *postValue
+	reportsQueue   chan *secondaryReports
+}
+
+type secondaryReports struct {
+	hostID  string
+	reports []*checks.Report
+}
+
+func newSecondary(app *App) (*secondary, error) {
+	conf := *app.Config
+	conf.Apibase = app.Config.Secondary.Apibase
+	conf.Apikey = app.Config.Secondary.Apikey
+	conf.HostIDStorage = &config.FileSystemHostIDStorage{Root: app.Config.Root, File: app.Config.IDFile, Suffix: config.SecondaryIDFileSuffix}
+	api, err := prepareAPI(&conf, conf.Apibase, conf.Apikey, app.AgentMeta)
+	if err != nil {
+		return nil, errors.Wrap(err, "secondary")
+	}
+	return &secondary{
+		app:            app,
+		conf:           &conf,
+		api:            api,
+		graphDefsQueue: make(chan []*mkr.GraphDefsParam, 1),
+		metricsQueue:   make(chan *postValue, postMetricsBufferSize),
+		reportsQueue:   make(chan *secondaryReports, reportCheckBufferSize),
+	}, nil
+}
+
+// run registers the host to the secondary, retrying in the background while
+// the mirrored messages are queued, then posts them until ctx is done.
+func (s *secondary) run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	host, err := s.prepareHost(ctx)
+	if err != nil {
+		logger.Errorf("Stopped mirroring to the secondary %s: %s", s.conf.Apibase, err)
+		return
+	}
+	s.hostIDs = map[string]string{s.app.Host.ID: host.ID}
+	for customIdentifier, h := range prepareCustomIdentiferHosts(s.conf, s.api) {
+		if primary, ok := s.app.CustomIdentifierHosts[customIdentifier]; ok {
+			s.hostIDs[primary.ID] = h.ID
+		}
+	}
+	logger.WithFields(logformat.Fields{"host_id": host.ID}).Infof("Mirroring to the secondary: apibase = %s, hostID = %s", s.conf.Apibase, host.ID)
+
+	go s.reportChecksLoop(ctx)
+	s.postMetricsLoop(ctx)
+}
+
+// prepareHost retries registering the host unless the API key is rejected.
+func (s *secondary) prepareHost(ctx context.Context) (*mkr.Host, error) {
+	for attempt := 1; ; attempt++ {
+		host, err := prepareHost(s.conf, s.app.AgentMeta, s.api)
+		if err == nil {
+			return host, nil
+		}
+		if exitcode.Of(err) == exitcode.AuthError {
+			return nil, err
+		}
+		d := s.api.RetryInterval(postMetricsRetryPolicy, attempt)
+		logger.Warningf("Failed to prepare the host on the secondary %s (will retry in %s): %s", s.conf.Apibase, d, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+	}
+}
+
+func (s *secondary) mirrorGraphDefs(payloads []*mkr.GraphDefsParam) {
+	if s == nil || len(payloads) == 0 {
+		return
+	}
+	select {
+	case s.graphDefsQueue <- payloads:
+	default:
+	}
+}
+
+// firstAttempts returns the values posted for the first time, which are
+// mirrored after posting them to the primary. The retried values have been
+// mirrored on the first attempt.
+func (s *secondary) firstAttempts(values []*postValue) []*postValue {
+	if s == nil {
+		return nil
+	}
+	var results []*postValue
+	for _, v := range values {
+		if v.retryCnt == 0 {
+			results = append(results, v)
+		}
+	}
+	return results
+}
+
+// mirrorMetrics queues values returned by firstAttempts to the secondary.
+func (s *secondary) mirrorMetrics(values []*postValue) {
+	if s == nil {
+		return
+	}
+	for _, v := range values {
+		for _, c := range splitPostValues([]*postValue{v}, postMetricsLimits(s.conf)) {
+			select {
+			case s.metricsQueue <- newPostValue(c.values):
+			default:
+				logger.Warningf("The queue of the secondary is full. %d metric values are not mirrored.", len(c.values))
+			}
+		}
+	}
+}
+
+func (s *secondary) mirrorReports(hostID string, reports []*checks.Report) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.reportsQueue <- &secondaryReports{hostID, reports}:
+	default:
+		logger.Warningf("The queue of the secondary is full. %d check reports are not mirrored.", len(reports))
+	}
+}
+
+// hostMetricValues replaces the host ids of values with those on the secondary.
+func (s *secondary) hostMetricValues(values []*mkr.HostMetricValue) []*mkr.HostMetricValue {
+	results := make([]*mkr.HostMetricValue, 0, len(values))
+	for _, v := range values {
+		if hostID, ok := s.hostIDs[v.HostID]; ok {
+			results = append(results, &mkr.HostMetricValue{HostID: hostID, MetricValue: v.MetricValue})
+		}
+	}
+	return results
+}
+
+func (s *secondary) postMetricsLoop(ctx context.Context) {
+	failures := 0
+	for {
+		var delay time.Duration
+		select {
+		case <-ctx.Done():
+			if n := len(s.metricsQueue); n > 0 {
+				logger.Warningf("Gave up mirroring %d pending metrics to the secondary", n)
+			}
+			return
+		case payloads := <-s.graphDefsQueue:
+			if err := s.api.CreateGraphDefs(payloads); err != nil {
+				logger.Errorf("Failed to create graphdefs on the secondary: %s", err)
+			}
+			continue
+		case v := <-s.metricsQueue:
+			values := s.hostMetricValues(v.values)
+			if len(values) == 0 {
+				continue
+			}
+			err := s.api.PostHostMetricValues(values)
+			if err == nil {
+				logger.Debugf("Posting metrics to the secondary succeeded.")
+				failures = 0
+				continue
+			}
+			logger.Warningf("Failed to post metrics value to the secondary (will retry): %s", err.Error())
+			failures++
+			v.retryCnt++
+			if v.retryCnt > postMetricsRetryMax {
+				logger.Errorf("Post values may be invalid and abandoned on the secondary: %d metric values", len(values))
+			} else {
+				select {
+				case s.metricsQueue <- v:
+				default:
+					logger.Warningf("The queue of the secondary is full. %d metric values are not mirrored.", len(values))
+				}
+			}
+			delay = s.api.RetryInterval(postMetricsRetryPolicy, failures)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *secondary) reportChecksLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-s.reportsQueue:
+			hostID, ok := s.hostIDs[r.hostID]
+			if !ok {
+				continue
+			}
+			// retry until report succeeds or ctx is done on shutdown
+			s.api.Retry(ctx, reportCheckRetryPolicy, "ReportCheckMonitors to the secondary", func() error {
+				err := s.api.ReportCheckMonitors(hostID, r.reports)
+				if err != nil {
+					logger.Errorf("ReportCheckMonitors to the secondary: %s", err)
+				}
+				return err
+			})
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestSecondary(t *testing.T) {
+	conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	originalPolicy := postMetricsRetryPolicy
+	postMetricsRetryPolicy = &mackerel.RetryPolicy{InitialInterval: 10 * time.Millisecond}
+	defer func() { postMetricsRetryPolicy = originalPolicy }()
+
+	mockHandlers["POST /api/v0/hosts"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{"id": "secondary123"}
+	}
+	mockHandlers["GET /api/v0/hosts/secondary123"] = func(req *http.Request) (int, jsonObject) {
+		return 200, jsonObject{"host": mkr.Host{ID: "secondary123", Name: "host.example.com", Status: "working"}}
+	}
+
+	var mu sync.Mutex
+	failures := 0
+	posted := make(chan []mkr.HostMetricValue, 1)
+	mockHandlers["POST /api/v0/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures == 0 {
+			failures++
+			return 503, jsonObject{}
+		}
+		var payload []mkr.HostMetricValue
+		json.NewDecoder(req.Body).Decode(&payload)
+		posted <- payload
+		return 200, jsonObject{"success": true}
+	}
+	reported := make(chan string, 1)
+	mockHandlers["POST /api/v0/monitoring/checks/report"] = func(req *http.Request) (int, jsonObject) {
+		var payload struct {
+			Reports []struct {
+				Source struct {
+					HostID string `json:"hostId"`
+				} `json:"source"`
+			} `json:"reports"`
+		}
+		json.NewDecoder(req.Body).Decode(&payload)
+		reported <- payload.Reports[0].Source.HostID
+		return 200, jsonObject{"success": true}
+	}
+
+	conf.Secondary = &config.Secondary{Apikey: "secondary-apikey", Apibase: ts.URL}
+	conf.Apibase = "http://primary.invalid"
+	app := &App{
+		Config:                &conf,
+		Host:                  &mkr.Host{ID: "primary123"},
+		CustomIdentifierHosts: map[string]*mkr.Host{},
+		AgentMeta:             &AgentMeta{},
+	}
+	s, err := newSecondary(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	value := func(v float64) []*mkr.HostMetricValue {
+		return []*mkr.HostMetricValue{{HostID: "primary123", MetricValue: &mkr.MetricValue{Name: "test", Time: 1, Value: v}}}
+	}
+	s.mirrorMetrics(s.firstAttempts([]*postValue{newPostValue(value(1)), {values: value(2), retryCnt: 1}}))
+	s.mirrorReports("primary123", []*checks.Report{{Name: "check", Status: checks.StatusCritical}})
+
+	select {
+	case payload := <-posted:
+		if len(payload) != 1 || payload[0].HostID != "secondary123" || payload[0].Value.(float64) != 1 {
+			t.Errorf("the values should be posted with the host id on the secondary after the retry: %+v", payload)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the values should be posted to the secondary")
+	}
+	select {
+	case hostID := <-reported:
+		if hostID != "secondary123" {
+			t.Errorf("the reports should be posted with the host id on the secondary: %s", hostID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the reports should be posted to the secondary")
+	}
+
+	id, err := s.conf.LoadHostID()
+	if err != nil || id != "secondary123" {
+		t.Errorf("the host id on the secondary should be saved: %s, %v", id, err)
+	}
+	if _, err := conf.LoadHostID(); err == nil {
+		t.Errorf("the host id of the primary should not be saved")
+	}
+}
@@ -0,0 +1,180 @@
+package command
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// serviceMetricsGenerator generates the service metrics of the service.
+type serviceMetricsGenerator struct {
+	service string
+	metrics.Generator
+}
+
+func serviceMetricsGenerators(conf *config.Config) []*serviceMetricsGenerator {
+	var generators []*serviceMetricsGenerator
+	for _, pluginConfig := range conf.MetricPlugins {
+		if pluginConfig.Service != "" {
+			generators = append(generators, &serviceMetricsGenerator{pluginConfig.Service, metrics.NewPluginGenerator(pluginConfig, conf.Root)})
+		}
+	}
+	for _, snmpConfig := range conf.SNMPPlugins {
+		if snmpConfig.Service != "" {
+			generators = append(generators, &serviceMetricsGenerator{snmpConfig.Service, metrics.NewSNMPGenerator(snmpConfig)})
+		}
+	}
+	return generators
+}
+
+var (
+	serviceMetricsBufferSize = 6 * 60 // Keep the service metrics of 6 hours for each service
+	serviceMetricsBulkMax    = 10     // Post up to 10 collections at once while retrying
+)
+
+// serviceMetricsBuffer keeps the collections of the service metrics failed
+// to be posted by the services, which are retried in the next minutes.
+type serviceMetricsBuffer struct {
+	mu      sync.Mutex
+	pending map[string][][]*mkr.MetricValue
+}
+
+func newServiceMetricsBuffer() *serviceMetricsBuffer {
+	return &serviceMetricsBuffer{pending: make(map[string][][]*mkr.MetricValue)}
+}
+
+// add adds the collection of the service, dropping the oldest one beyond
+// serviceMetricsBufferSize.
+func (b *serviceMetricsBuffer) add(service string, values []*mkr.MetricValue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending := append(b.pending[service], values)
+	if len(pending) > serviceMetricsBufferSize {
+		logger.Warningf("Dropped the oldest service metrics of %s since %d collections are pending", service, len(pending)-1)
+		pending = pending[1:]
+	}
+	b.pending[service] = pending
+}
+
+// take returns the oldest collections of the service up to serviceMetricsBulkMax.
+func (b *serviceMetricsBuffer) take(service string) (n int, values []*mkr.MetricValue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending := b.pending[service]
+	n = len(pending)
+	if n > serviceMetricsBulkMax {
+		n = serviceMetricsBulkMax
+	}
+	for _, v := range pending[:n] {
+		values = append(values, v...)
+	}
+	return n, values
+}
+
+// remove removes the oldest n collections of the service.
+func (b *serviceMetricsBuffer) remove(service string, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if pending := b.pending[service][n:]; len(pending) > 0 {
+		b.pending[service] = pending
+	} else {
+		delete(b.pending, service)
+	}
+}
+
+func (b *serviceMetricsBuffer) services() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	services := make([]string, 0, len(b.pending))
+	for service := range b.pending {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// len returns the number of the pending collections of all the services.
+func (b *serviceMetricsBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, pending := range b.pending {
+		n += len(pending)
+	}
+	return n
+}
+
+// postServiceMetricsLoop generates and posts the service metrics every
+// minute, independently of the host metrics.
+func postServiceMetricsLoop(ctx context.Context, app *App, generators []*serviceMetricsGenerator) {
+	if len(generators) == 0 {
+		return
+	}
+	buf := newServiceMetricsBuffer()
+	app.status.setBuffer("serviceMetrics", buf.len)
+	ticker := time.NewTicker(config.PostMetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			postServiceMetrics(app, generators, buf, time.Now())
+		}
+	}
+}
+
+// postServiceMetrics posts the service metrics generated at now with the
+// pending ones in buf. The values failed to be posted by the retryable
+// errors, such as the network errors and HTTP 5xx, are kept in buf for the
+// next time, and the others, such as the unknown services, are dropped.
+func postServiceMetrics(app *App, generators []*serviceMetricsGenerator, buf *serviceMetricsBuffer, now time.Time) {
+	results := make([]metrics.Values, len(generators))
+	var wg sync.WaitGroup
+	for i, g := range generators {
+		wg.Add(1)
+		go func(i int, g *serviceMetricsGenerator) {
+			defer wg.Done()
+			values, err := g.Generate()
+			if _, exited := err.(*metrics.PluginExitError); err != nil && !exited {
+				logger.Errorf("Failed to generate the service metrics of %s: %s", g.service, err)
+				return
+			}
+			results[i] = values
+		}(i, g)
+	}
+	wg.Wait()
+
+	values := make(map[string][]*mkr.MetricValue)
+	for i, g := range generators {
+		for name, value := range results[i] {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			values[g.service] = append(values[g.service], &mkr.MetricValue{Name: name, Time: now.Unix(), Value: value})
+		}
+	}
+	for service, v := range values {
+		buf.add(service, v)
+	}
+	for _, service := range buf.services() {
+		n, v := buf.take(service)
+		err := app.API.PostServiceMetricValues(service, v)
+		switch {
+		case err == nil:
+			buf.remove(service, n)
+		case mackerel.IsRetryable(err):
+			logger.Warningf("Failed to post the service metrics of %s, so retrying in the next minute: %s", service, err)
+		default:
+			logger.Errorf("Failed to post the service metrics of %s (dropped): %s", service, err)
+			buf.remove(service, n)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+type valuesGenerator metrics.Values
+
+func (g valuesGenerator) Generate() (metrics.Values, error) {
+	return metrics.Values(g), nil
+}
+
+func TestPostServiceMetrics(t *testing.T) {
+	conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	posted := make(map[string][]*mkr.MetricValue)
+	for _, service := range []string{"network", "storage"} {
+		service := service
+		mockHandlers["POST /api/v0/services/"+service+"/tsdb"] = func(req *http.Request) (int, jsonObject) {
+			var values []*mkr.MetricValue
+			json.NewDecoder(req.Body).Decode(&values)
+			posted[service] = append(posted[service], values...)
+			return 200, jsonObject{"success": true}
+		}
+	}
+
+	api, err := mackerel.NewAPI(ts.URL, "apikey", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{API: api, Config: &conf}
+	now := time.Unix(1500000000, 0)
+	postServiceMetrics(app, []*serviceMetricsGenerator{
+		{"network", valuesGenerator{"core.in": 1}},
+		{"network", valuesGenerator{"edge.in": 2}},
+		{"storage", valuesGenerator{"nas.used": 3}},
+	}, newServiceMetricsBuffer(), now)
+
+	if len(posted["network"]) != 2 || len(posted["storage"]) != 1 {
+		t.Fatalf("unexpected service metrics: %v", posted)
+	}
+	for _, v := range posted["storage"] {
+		if v.Name != "nas.used" || v.Value != 3.0 || v.Time != now.Unix() {
+			t.Errorf("unexpected service metric: %+v", v)
+		}
+	}
+}
+
+func TestPostServiceMetrics_retry(t *testing.T) {
+	conf, mockHandlers, ts, deferFunc := newMockAPIServer(t)
+	defer deferFunc()
+
+	statuses := map[string][]int{"broker": {500, 200}, "unknown": {404, 200}}
+	posted := make(map[string][][]*mkr.MetricValue)
+	for service := range statuses {
+		service := service
+		mockHandlers["POST /api/v0/services/"+service+"/tsdb"] = func(req *http.Request) (int, jsonObject) {
+			var values []*mkr.MetricValue
+			json.NewDecoder(req.Body).Decode(&values)
+			posted[service] = append(posted[service], values)
+			status := statuses[service][0]
+			statuses[service] = statuses[service][1:]
+			if status != 200 {
+				return status, jsonObject{"error": "failed"}
+			}
+			return 200, jsonObject{"success": true}
+		}
+	}
+
+	api, err := mackerel.NewAPI(ts.URL, "apikey", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{API: api, Config: &conf}
+	generators := []*serviceMetricsGenerator{
+		{"broker", valuesGenerator{"queue.depth": 1}},
+		{"unknown", valuesGenerator{"queue.depth": 2}},
+	}
+	buf := newServiceMetricsBuffer()
+	now := time.Unix(1500000000, 0)
+	postServiceMetrics(app, generators, buf, now)
+	if n := buf.len(); n != 1 {
+		t.Errorf("the values failed by HTTP 500 should be kept, but %d collections are pending", n)
+	}
+	postServiceMetrics(app, generators, buf, now.Add(time.Minute))
+	if n := buf.len(); n != 0 {
+		t.Errorf("the retried values should be removed, but %d collections are pending", n)
+	}
+
+	if len(posted["broker"]) != 2 || len(posted["broker"][1]) != 2 {
+		t.Fatalf("the failed values should be posted with the next ones: %v", posted["broker"])
+	}
+	for i, v := range posted["broker"][1] {
+		if v.Name != "queue.depth" || v.Time != now.Add(time.Duration(i)*time.Minute).Unix() {
+			t.Errorf("unexpected service metric: %+v", v)
+		}
+	}
+	if len(posted["unknown"]) != 2 || len(posted["unknown"][1]) != 1 {
+		t.Errorf("the values failed by HTTP 404 should be dropped: %v", posted["unknown"])
+	}
+}
+
+func TestServiceMetricsBuffer(t *testing.T) {
+	origBufferSize, origBulkMax := serviceMetricsBufferSize, serviceMetricsBulkMax
+	serviceMetricsBufferSize, serviceMetricsBulkMax = 3, 2
+	defer func() {
+		serviceMetricsBufferSize, serviceMetricsBulkMax = origBufferSize, origBulkMax
+	}()
+
+	buf := newServiceMetricsBuffer()
+	for i := 0; i < 4; i++ {
+		buf.add("broker", []*mkr.MetricValue{{Name: "queue.depth", Time: int64(i)}})
+	}
+	if n := buf.len(); n != 3 {
+		t.Errorf("the oldest collection should be dropped, but %d collections are pending", n)
+	}
+	n, values := buf.take("broker")
+	if n != 2 || len(values) != 2 || values[0].Time != 1 || values[1].Time != 2 {
+		t.Errorf("the oldest collections should be taken up to the bulk max: %d, %v", n, values)
+	}
+	buf.remove("broker", n)
+	buf.remove("broker", 1)
+	if services := buf.services(); len(services) != 0 {
+		t.Errorf("the services without the pending values should be removed: %v", services)
+	}
+}
@@ -0,0 +1,13 @@
+package command
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// isSystemShuttingDown returns whether systemd is stopping the system.
+func isSystemShuttingDown() bool {
+	// is-system-running exits with non-zero unless the system is running
+	out, _ := exec.Command("systemctl", "is-system-running").Output()
+	return strings.TrimSpace(string(out)) == "stopping"
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package command
+
+// isSystemShuttingDown is supported only on systemd.
+func isSystemShuttingDown() bool {
+	return false
+}
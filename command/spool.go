@@ -0,0 +1,171 @@
+package command
+
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/spool"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	spoolKindMetrics = "metrics"
+	spoolKindChecks  = "checks"
+)
+
+// Wait for a second before posting the next spool file not to flood the API after an outage.
+var spoolReplayDelay = 1 * time.Second
+
+type spooledCheckReports struct {
+	HostID  string           `json:"hostId"`
+	Reports []*checks.Report `json:"reports"`
+}
+
+func newSpool(conf *config.Config) (*spool.Spool, error) {
+	if conf.SpoolDir == "" {
+		return nil, nil
+	}
+	maxAge := spool.DefaultMaxAge
+	if conf.SpoolMaxAge != nil {
+		maxAge = conf.SpoolMaxAge.Duration
+	}
+	var maxBytes int64 = spool.DefaultMaxBytes
+	if conf.SpoolMaxBytes != nil {
+		maxBytes = *conf.SpoolMaxBytes
+	}
+	return spool.New(conf.SpoolDir, maxAge, maxBytes)
+}
+
+// spoolMetrics stores the values in the spool, splitting them if they are too large for a file.
+func spoolMetrics(s *spool.Spool, values []*mkr.HostMetricValue) error {
+	err := s.Put(spoolKindMetrics, values)
+	if err == spool.ErrTooLarge && len(values) > 1 {
+		if err := spoolMetrics(s, values[:len(values)/2]); err != nil {
+			return err
+		}
+		return spoolMetrics(s, values[len(values)/2:])
+	}
+	return err
+}
+
+// reportCheckMonitorsWithSpool reports the check reports, or stores them in the spool
+// if it fails. The reports are stored also if there are older reports in the spool,
+// so that they are reported in the order they occurred, or ctx is done on shutdown.
+func reportCheckMonitorsWithSpool(ctx context.Context, app *App, hostID string, reports []*checks.Report) {
+	entries, err := app.Spool.Entries(spoolKindChecks)
+	if err != nil {
+		logger.Warningf("Failed to list the spool files: %s", err)
+	}
+	if len(entries) == 0 && ctx.Err() == nil {
+		err := app.API.ReportCheckMonitors(hostID, reports)
+		if err == nil {
+			app.status.posted(statusKindChecks)
+			app.checkCounter.countReported(len(reports))
+			app.checkReports.record(reports, time.Now())
+			triggerSpoolReplay(app)
+			return
+		}
+		logger.Errorf("ReportCheckMonitors: %s", err)
+		if mackerel.IsValidationError(err) {
+			budget := maxBisectRequests
+			bisectCheckReports(ctx, app, hostID, reports, err, &budget)
+			return
+		}
+		if !mackerel.IsRetryable(err) {
+			return
+		}
+	}
+	if err := app.Spool.Put(spoolKindChecks, &spooledCheckReports{HostID: hostID, Reports: reports}); err != nil {
+		logger.Errorf("Failed to spool the check reports, abandoned: %s", err)
+		return
+	}
+	// The spooled reports are recorded as posted, since they are posted on
+	// replaying the spool.
+	app.checkReports.record(reports, time.Now())
+	if len(entries) > 0 {
+		triggerSpoolReplay(app)
+	}
+}
+
+// triggerSpoolReplay requests to replay the spool, since the API seems to be available.
+func triggerSpoolReplay(app *App) {
+	select {
+	case app.spoolReplayCh <- struct{}{}:
+	default:
+	}
+}
+
+// runSpoolLoop replays the spool on start up and whenever triggerSpoolReplay is called.
+func runSpoolLoop(ctx context.Context, app *App) {
+	for {
+		if err := app.Spool.Prune(); err != nil {
+			logger.Warningf("Failed to prune the spool: %s", err)
+		}
+		replaySpool(ctx, app, spoolKindMetrics)
+		replaySpool(ctx, app, spoolKindChecks)
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.spoolReplayCh:
+		}
+	}
+}
+
+// replaySpool posts the spool files of the kind in the order they were stored, and
+// removes them after they are posted. It stops at the first retryable failure.
+// The other errors mean the payloads are invalid and never accepted.
+func replaySpool(ctx context.Context, app *App, kind string) {
+	entries, err := app.Spool.Entries(kind)
+	if err != nil {
+		logger.Warningf("Failed to list the spool files: %s", err)
+		return
+	}
+	for i, e := range entries {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(spoolReplayDelay):
+			}
+		}
+		err := postSpoolEntry(app, e)
+		if err == spool.ErrCorrupt {
+			continue
+		}
+		if mackerel.IsRetryable(err) {
+			logger.Warningf("Failed to post the spool file %s (will retry): %s", e.Name, err)
+			return
+		}
+		if err != nil {
+			logger.Errorf("The spool file %s may be invalid and abandoned: %s", e.Name, err)
+		} else {
+			logger.Debugf("Posting the spool file %s succeeded.", e.Name)
+			app.status.posted(kind)
+		}
+		if err := app.Spool.Remove(e); err != nil {
+			logger.Errorf("Failed to remove the spool file %s: %s", e.Name, err)
+			return
+		}
+	}
+}
+
+func postSpoolEntry(app *App, e spool.Entry) error {
+	switch e.Kind {
+	case spoolKindMetrics:
+		var values []*mkr.HostMetricValue
+		if err := app.Spool.Load(e, &values); err != nil {
+			return err
+		}
+		return app.API.PostHostMetricValues(values)
+	case spoolKindChecks:
+		var r spooledCheckReports
+		if err := app.Spool.Load(e, &r); err != nil {
+			return err
+		}
+		return app.API.ReportCheckMonitors(r.HostID, r.Reports)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/spool"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func newTestSpoolApp(t *testing.T) (*App, map[string]func(*http.Request) (int, jsonObject), func()) {
+	conf, mockHandlers, _, deferFunc := newMockAPIServer(t)
+	api, err := mackerel.NewAPI(conf.Apibase, conf.Apikey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := spool.New(filepath.Join(conf.Root, "spool"), spool.DefaultMaxAge, spool.DefaultMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origDelay := spoolReplayDelay
+	spoolReplayDelay = 0
+	app := &App{
+		Config:        &conf,
+		API:           api,
+		Host:          &mkr.Host{ID: "xyzabc12345"},
+		AgentMeta:     &AgentMeta{},
+		Spool:         s,
+		spoolReplayCh: make(chan struct{}, 1),
+	}
+	return app, mockHandlers, func() {
+		spoolReplayDelay = origDelay
+		deferFunc()
+	}
+}
+
+func metricValues(values ...float64) []*mkr.HostMetricValue {
+	var results []*mkr.HostMetricValue
+	for _, v := range values {
+		results = append(results, &mkr.HostMetricValue{
+			HostID:      "xyzabc12345",
+			MetricValue: &mkr.MetricValue{Name: "custom.foo", Time: int64(v), Value: v},
+		})
+	}
+	return results
+}
+
+func TestReplaySpool_Metrics(t *testing.T) {
+	app, mockHandlers, deferFunc := newTestSpoolApp(t)
+	defer deferFunc()
+
+	var mu sync.Mutex
+	var received []float64
+	failOn := 3.0
+	mockHandlers["POST /api/v0/tsdb"] = func(req *http.Request) (int, jsonObject) {
+		var payload []mkr.HostMetricValue
+		json.NewDecoder(req.Body).Decode(&payload)
+		mu.Lock()
+		defer mu.Unlock()
+		if payload[0].Value.(float64) == failOn {
+			return 503, jsonObject{}
+		}
+		for _, p := range payload {
+			received = append(received, p.Value.(float64))
+		}
+		if payload[0].Value.(float64) == 4 {
+			return 400, jsonObject{}
+		}
+		return 200, jsonObject{"success": true}
+	}
+
+	for _, v := range []float64{1, 2, 3, 4, 5} {
+		if err := spoolMetrics(app.Spool, metricValues(v, v+0.5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a corrupt file is skipped
+	entries, _ := app.Spool.Entries(spoolKindMetrics)
+	ioutil.WriteFile(filepath.Join(app.Spool.Dir, entries[1].Name), []byte(`[{"hostId": `), 0600)
+
+	replaySpool(context.Background(), app, spoolKindMetrics)
+	if expected := []float64{1, 1.5}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("the replay should stop at the server error: %v", received)
+	}
+
+	failOn = 0
+	replaySpool(context.Background(), app, spoolKindMetrics)
+	// the client error is not retried
+	if expected := []float64{1, 1.5, 3, 3.5, 4, 4.5, 5, 5.5}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("the spool should be replayed in order without duplicates: %v", received)
+	}
+	if entries, _ := app.Spool.Entries(spoolKindMetrics); len(entries) != 0 {
+		t.Errorf("the spool should be empty but got %v", entries)
+	}
+}
+
+func TestSpoolMetrics_Split(t *testing.T) {
+	app, _, deferFunc := newTestSpoolApp(t)
+	defer deferFunc()
+
+	values := make([]float64, 20000)
+	for i := range values {
+		values[i] = float64(i)
+	}
+	if err := spoolMetrics(app.Spool, metricValues(values...)); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := app.Spool.Entries(spoolKindMetrics)
+	if len(entries) < 2 {
+		t.Fatalf("the values should be split but got %d files", len(entries))
+	}
+	var n int
+	for _, e := range entries {
+		var v []*mkr.HostMetricValue
+		if err := app.Spool.Load(e, &v); err != nil {
+			t.Fatal(err)
+		}
+		if v[0].Value.(float64) != float64(n) {
+			t.Errorf("the values should be split in order: %v", v[0].Value)
+		}
+		n += len(v)
+	}
+	if n != len(values) {
+		t.Errorf("the number of the values should be %d but got %d", len(values), n)
+	}
+}
+
+func TestReportCheckMonitorsWithSpool(t *testing.T) {
+	app, mockHandlers, deferFunc := newTestSpoolApp(t)
+	defer deferFunc()
+
+	var mu sync.Mutex
+	var received []string
+	status := 503
+	mockHandlers["POST /api/v0/monitoring/checks/report"] = func(req *http.Request) (int, jsonObject) {
+		var payload mkr.CheckReports
+		json.NewDecoder(req.Body).Decode(&payload)
+		mu.Lock()
+		defer mu.Unlock()
+		if status != 200 {
+			return status, jsonObject{}
+		}
+		for _, r := range payload.Reports {
+			received = append(received, r.Message)
+		}
+		return 200, jsonObject{}
+	}
+	report := func(msg string) []*checks.Report {
+		return []*checks.Report{{Name: "check", Status: checks.StatusCritical, Message: msg, OccurredAt: time.Now()}}
+	}
+
+	reportCheckMonitorsWithSpool(context.Background(), app, app.Host.ID, report("1"))
+	status = 200
+	// spooled since the older report is in the spool
+	reportCheckMonitorsWithSpool(context.Background(), app, app.Host.ID, report("2"))
+	if len(received) != 0 {
+		t.Errorf("the report should not overtake the spooled one: %v", received)
+	}
+	select {
+	case <-app.spoolReplayCh:
+	default:
+		t.Error("the replay should be triggered")
+	}
+	replaySpool(context.Background(), app, spoolKindChecks)
+	reportCheckMonitorsWithSpool(context.Background(), app, app.Host.ID, report("3"))
+	if expected := []string{"1", "2", "3"}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("the reports should be posted in order: %v", received)
+	}
+
+	// the client errors are not spooled
+	status = 400
+	reportCheckMonitorsWithSpool(context.Background(), app, app.Host.ID, report("4"))
+	if entries, _ := app.Spool.Entries(spoolKindChecks); len(entries) != 0 {
+		t.Errorf("the spool should be empty but got %v", entries)
+	}
+}
+
+func TestGiveUpFlushing(t *testing.T) {
+	app, _, deferFunc := newTestSpoolApp(t)
+	defer deferFunc()
+
+	postQueue := make(chan *postValue, 3)
+	postQueue <- newPostValue(metricValues(2))
+	postQueue <- newPostValue(metricValues(3, 4))
+	giveUpFlushing(app, []*postValue{newPostValue(metricValues(1))}, postQueue)
+
+	if len(postQueue) != 0 {
+		t.Errorf("the queue should be drained but %d values are left", len(postQueue))
+	}
+	entries, err := app.Spool.Entries(spoolKindMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("the pending values should be spooled in a file but got %v", entries)
+	}
+	var values []*mkr.HostMetricValue
+	if err := app.Spool.Load(entries[0], &values); err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for _, v := range values {
+		got = append(got, v.Value.(float64))
+	}
+	if expected := []float64{1, 2, 3, 4}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("the spooled values should be %v but got %v", expected, got)
+	}
+}
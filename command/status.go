@@ -0,0 +1,268 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/pluginbreaker"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	"github.com/mackerelio/mackerel-agent/pluginstderr"
+)
+
+// The kinds of the payloads posted to Mackerel, which are reported by the status.
+const (
+	statusKindMetrics   = "metrics"
+	statusKindChecks    = "checks"
+	statusKindMetadata  = "metadata"
+	statusKindHostSpecs = "hostSpecs"
+)
+
+// Status is the status of the running agent served on the control socket.
+type Status struct {
+	HostID        string               `json:"hostId"`
+	Version       string               `json:"version"`
+	StartedAt     time.Time            `json:"startedAt"`
+	UptimeSeconds int64                `json:"uptimeSeconds"`
+	LastPostedAt  map[string]time.Time `json:"lastPostedAt"`
+	Buffers       map[string]int       `json:"buffers"`
+	Plugins       map[string]int       `json:"plugins"`
+	// DisabledPlugins are the sections of the plugins disabled by enabled = false.
+	DisabledPlugins []string `json:"disabledPlugins,omitempty"`
+	// Paths are the locations of the state files, see StatePaths.
+	Paths map[string]string `json:"paths"`
+	// PluginStderr is the last stderr of the plugins, such as "checks.foo".
+	PluginStderr map[string]pluginstderr.Snippet `json:"pluginStderr,omitempty"`
+	// PluginStats are the statistics of the executions of the plugins.
+	PluginStats map[string]pluginstats.Stats `json:"pluginStats,omitempty"`
+	// PluginBreakers are the states of the breakers of the plugins failing
+	// consecutively.
+	PluginBreakers map[string]pluginbreaker.State `json:"pluginBreakers,omitempty"`
+}
+
+// WriteText writes the status in the human readable format.
+func (st *Status) WriteText(w io.Writer) error {
+	lines := []string{
+		fmt.Sprintf("Host ID:    %s", st.HostID),
+		fmt.Sprintf("Version:    %s", st.Version),
+		fmt.Sprintf("Started at: %s (up %s)", st.StartedAt.Format(time.RFC3339), time.Duration(st.UptimeSeconds)*time.Second),
+		"Last posted at:",
+	}
+	for _, kind := range []string{statusKindMetrics, statusKindChecks, statusKindMetadata, statusKindHostSpecs} {
+		postedAt := "never"
+		if t, ok := st.LastPostedAt[kind]; ok {
+			postedAt = t.Format(time.RFC3339)
+		}
+		lines = append(lines, fmt.Sprintf("  %-10s %s", kind+":", postedAt))
+	}
+	lines = append(lines, "Buffers:")
+	lines = append(lines, formatCounts(st.Buffers)...)
+	lines = append(lines, "Plugins:")
+	lines = append(lines, formatCounts(st.Plugins)...)
+	if len(st.DisabledPlugins) > 0 {
+		lines = append(lines, "Disabled plugins:")
+		for _, section := range st.DisabledPlugins {
+			lines = append(lines, "  "+section)
+		}
+	}
+	lines = append(lines, "Paths:")
+	lines = append(lines, FormatPaths(st.Paths)...)
+	if len(st.PluginStderr) > 0 {
+		lines = append(lines, "Last stderr of plugins:")
+		ids := make([]string, 0, len(st.PluginStderr))
+		for id := range st.PluginStderr {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := st.PluginStderr[id]
+			lines = append(lines, fmt.Sprintf("  %s (%s): %q", id, s.At.Format(time.RFC3339), s.Stderr))
+		}
+	}
+	if len(st.PluginStats) > 0 {
+		lines = append(lines, "Plugin executions:")
+		ids := make([]string, 0, len(st.PluginStats))
+		for id := range st.PluginStats {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := st.PluginStats[id]
+			lines = append(lines, fmt.Sprintf("  %s: %d runs, %d failures (%d timeouts), %d empty, %d rejected, %d slow, last %.0fms (max %.0fms) exited with %d at %s",
+				id, s.Executions, s.Failures, s.Timeouts, s.Empty, s.Rejected, s.Slow, s.LastDurationMs, s.MaxDurationMs, s.LastExitCode, s.LastRunAt.Format(time.RFC3339)))
+		}
+	}
+	if len(st.PluginBreakers) > 0 {
+		lines = append(lines, "Plugin circuit breakers:")
+		ids := make([]string, 0, len(st.PluginBreakers))
+		for id := range st.PluginBreakers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := st.PluginBreakers[id]
+			if s.Open {
+				lines = append(lines, fmt.Sprintf("  %s: open by %d consecutive failures, backed off for %s until %s",
+					id, s.Failures, time.Duration(s.BackoffSeconds)*time.Second, s.NextRunAt.Format(time.RFC3339)))
+			} else {
+				lines = append(lines, fmt.Sprintf("  %s: closed with %d consecutive failures", id, s.Failures))
+			}
+		}
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatCounts(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("  %-10s %d", k+":", counts[k]))
+	}
+	return lines
+}
+
+// statusRecorder records the status of the running agent.
+// The methods do nothing on nil, for the App which is not prepared by Prepare.
+type statusRecorder struct {
+	mu           sync.Mutex
+	startedAt    time.Time
+	lastPostedAt map[string]time.Time
+	lastFailedAt map[string]time.Time
+	buffers      map[string]func() int
+	running      bool
+	// cycled is signaled when the metrics are posted or failed to be posted.
+	cycled chan struct{}
+}
+
+func newStatusRecorder() *statusRecorder {
+	return &statusRecorder{
+		startedAt:    time.Now(),
+		lastPostedAt: make(map[string]time.Time),
+		lastFailedAt: make(map[string]time.Time),
+		buffers:      make(map[string]func() int),
+		cycled:       make(chan struct{}, 1),
+	}
+}
+
+// setRunning records whether the main loop is running.
+func (r *statusRecorder) setRunning(running bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = running
+}
+
+// postFailed records that the payload of the kind is failed to be posted.
+func (r *statusRecorder) postFailed(kind string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastFailedAt[kind] = time.Now()
+	r.endCycle(kind)
+}
+
+// posted records that the payload of the kind is posted successfully.
+func (r *statusRecorder) posted(kind string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastPostedAt[kind] = time.Now()
+	r.endCycle(kind)
+}
+
+func (r *statusRecorder) endCycle(kind string) {
+	if kind != statusKindMetrics {
+		return
+	}
+	select {
+	case r.cycled <- struct{}{}:
+	default:
+	}
+}
+
+// setBuffer registers the function to get the number of the pending payloads in the buffer.
+func (r *statusRecorder) setBuffer(name string, size func() int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buffers[name] = size
+}
+
+// bufferSizes returns the numbers of the pending payloads in the buffers.
+func (r *statusRecorder) bufferSizes() map[string]int {
+	sizes := make(map[string]int)
+	if r == nil {
+		return sizes
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, size := range r.buffers {
+		sizes[name] = size()
+	}
+	return sizes
+}
+
+// Status returns the status of the running agent.
+func (app *App) Status() *Status {
+	st := &Status{
+		LastPostedAt: make(map[string]time.Time),
+		Buffers:      app.status.bufferSizes(),
+		Plugins: map[string]int{
+			"metrics":  len(app.Config.MetricPlugins),
+			"checks":   len(app.Config.CheckPlugins),
+			"metadata": len(app.Config.MetadataPlugins),
+		},
+		DisabledPlugins: app.Config.DisabledPlugins(),
+		Paths:           StatePaths(app.Config),
+		PluginStderr:    pluginstderr.Last(),
+		PluginStats:     pluginstats.All(),
+		PluginBreakers:  pluginbreaker.All(),
+	}
+	if app.Host != nil {
+		st.HostID = app.Host.ID
+	}
+	if app.AgentMeta != nil {
+		st.Version = app.AgentMeta.Version
+	}
+	if r := app.status; r != nil {
+		r.mu.Lock()
+		st.StartedAt = r.startedAt
+		st.UptimeSeconds = int64(time.Since(r.startedAt) / time.Second)
+		for kind, t := range r.lastPostedAt {
+			st.LastPostedAt[kind] = t
+		}
+		r.mu.Unlock()
+	}
+	if app.Spool != nil {
+		var n int
+		for _, kind := range []string{spoolKindMetrics, spoolKindChecks} {
+			entries, err := app.Spool.Entries(kind)
+			if err != nil {
+				logger.Warningf("Failed to list the spool files: %s", err)
+				continue
+			}
+			n += len(entries)
+		}
+		st.Buffers["spoolFiles"] = n
+	}
+	return st
+}
@@ -0,0 +1,65 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// statusFile is the content of status_file.
+type statusFile struct {
+	*Status
+	LastFailedAt map[string]time.Time `json:"lastFailedAt"`
+	WrittenAt    time.Time            `json:"writtenAt"`
+}
+
+// runStatusFileLoop writes the status to status_file after every post of the
+// metrics, and on shutdown.
+func runStatusFileLoop(ctx context.Context, app *App) {
+	write := func() {
+		if err := writeStatusFile(app, time.Now()); err != nil {
+			logger.Warningf("Failed to write the status file: %s", err)
+		}
+	}
+	write()
+	for {
+		select {
+		case <-ctx.Done():
+			write()
+			return
+		case <-app.status.cycled:
+			write()
+		}
+	}
+}
+
+func writeStatusFile(app *App, now time.Time) error {
+	st := &statusFile{
+		Status:       app.Status(),
+		LastFailedAt: make(map[string]time.Time),
+		WrittenAt:    now,
+	}
+	// the last stderr of the plugins is left out since it may contain anything
+	// the plugins print
+	st.PluginStderr = nil
+	if r := app.status; r != nil {
+		r.mu.Lock()
+		for kind, t := range r.lastFailedAt {
+			st.LastFailedAt[kind] = t
+		}
+		r.mu.Unlock()
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the status contains no API key, but it is guarded in case of the
+	// fields added later
+	if apikey := app.Config.Apikey; apikey != "" {
+		b = bytes.Replace(b, []byte(apikey), []byte(redacted), -1)
+	}
+	return util.WriteFileAtomically(app.Config.StatusFile, append(b, '\n'), app.Config.StatusFilePerm)
+}
@@ -0,0 +1,99 @@
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestWriteStatusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "run", "status.json")
+	app := &App{
+		Config: &config.Config{
+			Apikey:         "secret-apikey",
+			StatusFile:     file,
+			StatusFilePerm: 0640,
+		},
+		Host:      &mkr.Host{ID: "xyzabc12345"},
+		AgentMeta: &AgentMeta{Version: "0.1.0"},
+		status:    newStatusRecorder(),
+	}
+	app.status.setBuffer(statusKindChecks, func() int { return 3 })
+	app.status.posted(statusKindMetrics)
+	app.status.postFailed(statusKindChecks)
+
+	now := time.Now()
+	if err := writeStatusFile(app, now); err != nil {
+		t.Fatalf("writeStatusFile should not raise error: %s", err)
+	}
+	// the status file is replaced
+	if err := writeStatusFile(app, now); err != nil {
+		t.Fatalf("writeStatusFile should not raise error: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret-apikey") {
+		t.Errorf("the status file should not contain the API key: %s", b)
+	}
+	var st struct {
+		HostID       string               `json:"hostId"`
+		Version      string               `json:"version"`
+		LastPostedAt map[string]time.Time `json:"lastPostedAt"`
+		LastFailedAt map[string]time.Time `json:"lastFailedAt"`
+		Buffers      map[string]int       `json:"buffers"`
+		WrittenAt    time.Time            `json:"writtenAt"`
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatalf("the status file should be JSON: %s", err)
+	}
+	if st.HostID != "xyzabc12345" || st.Version != "0.1.0" {
+		t.Errorf("unexpected host ID and version: %+v", st)
+	}
+	if _, ok := st.LastPostedAt[statusKindMetrics]; !ok {
+		t.Errorf("the last post of the metrics should be written: %+v", st.LastPostedAt)
+	}
+	if _, ok := st.LastFailedAt[statusKindChecks]; !ok {
+		t.Errorf("the last failure of the checks should be written: %+v", st.LastFailedAt)
+	}
+	if st.Buffers[statusKindChecks] != 3 {
+		t.Errorf("the buffer of the checks should be 3 but got %d", st.Buffers[statusKindChecks])
+	}
+	if !st.WrittenAt.Equal(now) {
+		t.Errorf("writtenAt should be %s but got %s", now, st.WrittenAt)
+	}
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0640 {
+			t.Errorf("the permission of the status file should be 0640 but got %o", perm)
+		}
+	}
+	// the temporary files are removed
+	files, err := ioutil.ReadDir(filepath.Dir(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("only the status file should be left: %v", files)
+	}
+}
@@ -3,16 +3,16 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
-	"time"
 
 	"github.com/Songmu/prompter"
-	"github.com/Songmu/retry"
 	"github.com/mackerelio/mackerel-agent/command"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/exitcode"
 	"github.com/mackerelio/mackerel-agent/pidfile"
 	"github.com/mackerelio/mackerel-agent/supervisor"
 )
@@ -26,7 +26,7 @@ main process of mackerel-agent
 func doMain(fs *flag.FlagSet, argv []string) error {
 	conf, err := resolveConfig(fs, argv)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %s", err)
+		return exitcode.WithCode(fmt.Errorf("failed to load config: %s", err), exitcode.ConfigError)
 	}
 	return start(conf, make(chan struct{}))
 }
@@ -59,37 +59,58 @@ func doInit(fs *flag.FlagSet, argv []string) error {
 
 	supervise -conf mackerel-agent.conf ...
 
-run as supervisor mode enabling configuration reloading and crash recovery
+run as supervisor mode enabling configuration reloading and crash recovery.
+The restarts of the crashed agent are limited by [supervisor] of the config.
 */
 func doSupervise(fs *flag.FlagSet, argv []string) error {
-	if runtime.GOOS == "windows" {
-		return fmt.Errorf("supervise mode is not supported on windows")
-	}
 	copiedArgv := make([]string, len(argv))
 	copy(copiedArgv, argv)
 	conf, err := resolveConfig(fs, argv)
 	if err != nil {
-		return err
+		return exitcode.WithCode(err, exitcode.ConfigError)
+	}
+	setLogLevel(conf.Silent, conf.Verbose, conf.LogLevels)
+	setLogFormat(conf.LogFormat, conf.DisableLogDedup)
+	defer setLogOutput(conf)()
+	if err := verifyConfigPermissions(conf); err != nil {
+		return exitcode.WithCode(err, exitcode.ConfigError)
+	}
+	if err := conf.CreateRoot(); err != nil {
+		return fmt.Errorf("failed to create the root directory: %s", err)
 	}
-	setLogLevel(conf.Silent, conf.Verbose)
 	err = pidfile.Create(conf.Pidfile)
 	if err != nil {
-		return err
+		return pidfileError(err)
 	}
 	defer pidfile.Remove(conf.Pidfile)
 
-	return supervisor.Supervise(os.Args[0], copiedArgv, nil)
+	return supervisor.SuperviseWithOptions(os.Args[0], copiedArgv, nil, supervisorOptions(conf))
 }
 
 /* +command version - display version of mackerel-agent
 
-	version
+	version [-conf <file>]
 
-display the version of mackerel-agent
+display the version of mackerel-agent, and the fields of the host meta
+identifying the agent exactly as they are posted, whose customizations are
+the optional features enabled by the config file.
 */
-func doVersion(_ *flag.FlagSet, _ []string) error {
-	fmt.Printf("mackerel-agent version %s (rev %s) [%s %s %s] \n",
-		version, gitcommit, runtime.GOOS, runtime.GOARCH, runtime.Version())
+func doVersion(fs *flag.FlagSet, argv []string) error {
+	conffile := fs.String("conf", config.DefaultConfig.Conffile, "Config file path")
+	fs.Parse(argv)
+	conf, err := config.LoadConfig(*conffile)
+	if err != nil {
+		// the customizations are unknown without the config file
+		if _, serr := os.Stat(*conffile); serr == nil {
+			logger.Warningf("failed to load config: %s", err)
+		}
+		conf = &config.Config{}
+	}
+	fmt.Printf("%s version %s (rev %s) [%s %s %s] \n",
+		config.AgentName(), version, gitcommit, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	for _, f := range command.AgentIdentity(conf, agentMeta()) {
+		fmt.Println(f)
+	}
 	return nil
 }
 
@@ -97,12 +118,36 @@ func doVersion(_ *flag.FlagSet, _ []string) error {
 
 	configtest
 
-do configtest
+do configtest, and print the locations of the state files resolved by the
+root directory, the plugins disabled by enabled = false and the ones renamed
+by on_duplicate = "suffix".
 */
 func doConfigtest(fs *flag.FlagSet, argv []string) error {
 	conf, err := resolveConfig(fs, argv)
 	if err != nil {
-		return fmt.Errorf("failed to test config: %s", err)
+		return exitcode.WithCode(fmt.Errorf("failed to test config: %s", err), exitcode.ConfigError)
+	}
+	if err := conf.VerifyCommands(); err != nil {
+		return exitcode.WithCode(fmt.Errorf("failed to test config: %s", err), exitcode.ConfigError)
+	}
+	if err := verifyConfigPermissions(conf); err != nil {
+		return exitcode.WithCode(fmt.Errorf("failed to test config: %s", err), exitcode.ConfigError)
+	}
+	fmt.Fprintln(os.Stderr, "Paths:")
+	for _, l := range command.FormatPaths(command.StatePaths(conf)) {
+		fmt.Fprintln(os.Stderr, l)
+	}
+	if disabled := conf.DisabledPlugins(); len(disabled) > 0 {
+		fmt.Fprintln(os.Stderr, "Disabled plugins:")
+		for _, section := range disabled {
+			fmt.Fprintln(os.Stderr, "  "+section)
+		}
+	}
+	if duplicates := conf.DuplicatePlugins(); len(duplicates) > 0 {
+		fmt.Fprintln(os.Stderr, "Duplicate plugins:")
+		for _, d := range duplicates {
+			fmt.Fprintln(os.Stderr, "  "+d.String())
+		}
 	}
 	fmt.Fprintf(os.Stderr, "%s Syntax OK\n", conf.Conffile)
 	return nil
@@ -110,60 +155,206 @@ func doConfigtest(fs *flag.FlagSet, argv []string) error {
 
 /* +command retire - retire the host
 
-	retire [-force]
+	retire [-force] [-dry-run] [-only-if-status=poweroff,standby]
 
-retire the host
+retire the host. -force retires without prompting and succeeds if the host is
+already retired. -dry-run prints the host which would be retired. The host is
+retired only if its status is one of -only-if-status.
 */
 func doRetire(fs *flag.FlagSet, argv []string) error {
-	conf, force, err := resolveConfigForRetire(fs, argv)
+	conf, opts, err := resolveConfigForRetire(fs, argv)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %s", err)
+		return exitcode.WithCode(fmt.Errorf("failed to load config: %s", err), exitcode.ConfigError)
 	}
 
-	hostID, err := conf.LoadHostID()
+	api, err := command.NewMackerelClient(conf.Apibase, conf.Apikey, version, gitcommit, conf.Verbose)
 	if err != nil {
-		return fmt.Errorf("hostID file is not found or empty")
+		return fmt.Errorf("faild to create api client: %s", err)
 	}
+	command.SetHTTPHeaders(api, conf)
+	confirm := func(q string) bool {
+		return prompter.YN(q, false)
+	}
+	return command.Retire(conf, api, opts, confirm, os.Stdout)
+}
 
-	api, err := command.NewMackerelClient(conf.Apibase, conf.Apikey, version, gitcommit, conf.Verbose)
+/* +command status - show the status of the running agent
+
+	status [-json]
+
+show the host ID, the uptime, the times of the last successful posts,
+the sizes of the buffers and the numbers of the plugins of the running agent,
+and the plugins disabled by enabled = false.
+*/
+func doStatus(fs *flag.FlagSet, argv []string) error {
+	conf, asJSON, err := resolveConfigForStatus(fs, argv)
 	if err != nil {
-		return fmt.Errorf("faild to create api client: %s", err)
+		return exitcode.WithCode(fmt.Errorf("failed to load config: %s", err), exitcode.ConfigError)
+	}
+	st, err := command.FetchStatus(conf)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
 	}
+	return st.WriteText(os.Stdout)
+}
+
+/* +command ctl - control the running agent
+
+	ctl reload|flush|host-status <status>
 
-	if !force && !prompter.YN(fmt.Sprintf("retire this host? (hostID: %s)", hostID), false) {
-		return fmt.Errorf("retirement is canceled")
+send the command to the running agent by the control socket.
+reload resets the check reports and updates the host specs collected
+again, and reloads the configuration in the supervise mode. flush posts the pending metrics
+and check reports immediately. host-status updates the status of the host
+to working, standby, maintenance or poweroff.
+*/
+func doCtl(fs *flag.FlagSet, argv []string) error {
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		return exitcode.WithCode(fmt.Errorf("failed to load config: %s", err), exitcode.ConfigError)
+	}
+	args := fs.Args()
+	if len(args) == 0 {
+		return exitcode.WithCode(fmt.Errorf("the command is required: reload, flush or host-status"), exitcode.ConfigError)
 	}
+	res, err := command.SendControl(conf, args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("failed to %s: %s", args[0], res.Error)
+	}
+	fmt.Println(res.Message)
+	return nil
+}
+
+/* +command plugin - manage the plugins
 
-	err = retry.Retry(10, 3*time.Second, func() error {
-		return api.RetireHost(hostID)
-	})
+	plugin install [-overwrite] [-plugins-dir <dir>] <owner/repo[@version]|url>
+
+install the plugin from the GitHub releases of owner/repo, or the archive of
+the url. The archive for the OS and the architecture is downloaded from the
+release of the version, or the latest release, and verified by the checksum
+file of the release if it exists. The executables in the archive are installed
+into the plugins directory under the root directory by default, and the lines
+of the configuration to execute them are printed.
+*/
+func doPlugin(fs *flag.FlagSet, argv []string) error {
+	if len(argv) == 0 || argv[0] != "install" {
+		return exitcode.WithCode(fmt.Errorf("the command is required: install"), exitcode.ConfigError)
+	}
+	conf, opts, err := resolveConfigForPluginInstall(fs, argv[1:])
 	if err != nil {
-		return fmt.Errorf("faild to retire the host: %s", err)
+		return exitcode.WithCode(err, exitcode.ConfigError)
 	}
-	logger.Infof("This host (hostID: %s) has been retired.", hostID)
-	// just to try to remove hostID file.
-	err = conf.DeleteSavedHostID()
+	return command.InstallPlugin(conf, opts, os.Stdout)
+}
+
+/* +command diagnose - collect the information for the support
+
+	diagnose [-stdout] [-output <file>] [-log-lines <n>] [-timeout <duration>]
+
+collect the configuration, the version, the OS, the last lines of the log file,
+the connectivity to the API, the validity of the API key, the registered host
+and a collection by once into a tar.gz bundle, or print them with -stdout.
+The API key and the other secrets are redacted, and each of the probes is
+limited by -timeout. The probes which cannot be performed, such as the ones
+requiring the valid API key, are skipped. The summary of the probes is printed
+at the end, and it exits with an error if any of them failed.
+*/
+func doDiagnose(fs *flag.FlagSet, argv []string) error {
+	conf, opts, err := resolveConfigForDiagnose(fs, argv)
 	if err != nil {
-		logger.Warningf("Failed to remove HostID file: %s", err)
+		return exitcode.WithCode(err, exitcode.ConfigError)
+	}
+	ameta := agentMeta()
+	return command.Diagnose(conf, ameta, opts, os.Stdout)
+}
+
+/* +command doctor - check the connectivity to the API
+
+	doctor api [-json]
+
+check the connectivity to the API with the proxy of the configuration by the
+steps: resolving the host of the apibase (or the proxy), connecting to it, the
+TLS handshake reporting the negotiated version and the subjects of the
+certificate chain, and an authenticated API call which validates the API key.
+The result and the latency of each step are printed, or output as a JSON
+document with -json. The steps after the first failure are skipped, and it
+exits with an error if any of them failed.
+*/
+func doDoctor(fs *flag.FlagSet, argv []string) error {
+	if len(argv) == 0 || argv[0] != "api" {
+		return exitcode.WithCode(fmt.Errorf("the command is required: api"), exitcode.ConfigError)
+	}
+	conf, asJSON, err := resolveConfigForDoctor(fs, argv[1:])
+	if err != nil {
+		return exitcode.WithCode(err, exitcode.ConfigError)
+	}
+	result := command.DoctorAPI(conf)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+	} else {
+		err = result.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+	if s := result.Failed(); s != nil {
+		return fmt.Errorf("the %s step failed: %s", s.Name, s.Message)
 	}
 	return nil
 }
 
+/* +command inspect-plugin - run a metrics plugin and print the parsed output
+
+	inspect-plugin -plugin NAME [-conf <file>]
+
+run the metrics plugin of [plugin.metrics.NAME] once in the same way as the
+agent, with the environment, the timeout and the protocol detection, and print
+the graph definitions, the metric values and the warnings parsed from the
+output, such as the invalid metric names and the timestamps. Nothing is posted
+to Mackerel. It exits with an error if the plugin failed, or the graph
+definitions or any line of the output cannot be parsed.
+*/
+func doInspectPlugin(fs *flag.FlagSet, argv []string) error {
+	conf, name, err := resolveConfigForInspectPlugin(fs, argv)
+	if err != nil {
+		return exitcode.WithCode(err, exitcode.ConfigError)
+	}
+	return command.InspectPlugin(conf, name, os.Stdout)
+}
+
 /* +command once - output onetime
 
-	once
+	once [-format json]
 
 output metrics and meta data of the host one time.
 These data are only displayed and not posted to Mackerel.
+With -format json, the host specs, the graph definitions, the metric values
+and the check results are output as a JSON document, and it exits with an error
+if any of the plugins failed.
 */
 func doOnce(fs *flag.FlagSet, argv []string) error {
-	conf, err := resolveConfig(fs, argv)
+	conf, format, err := resolveConfigForOnce(fs, argv)
 	if err != nil {
 		logger.Warningf("failed to load config (but `once` must not required conf): %s", err)
 		conf = &config.Config{}
 	}
-	return command.RunOnce(conf, &command.AgentMeta{
-		Version:  version,
-		Revision: gitcommit,
-	})
+	ameta := agentMeta()
+	switch format {
+	case "":
+		return command.RunOnce(conf, ameta)
+	case "json":
+		return command.RunOnceJSON(conf, ameta, os.Stdout)
+	default:
+		return exitcode.WithCode(fmt.Errorf("unknown format: %s", format), exitcode.ConfigError)
+	}
 }
@@ -28,7 +28,7 @@ func init() {
 			Name:   "supervise",
 			Action: doSupervise,
 			Short:  "supervisor mode",
-			Long:   "supervise -conf mackerel-agent.conf ...\n\nrun as supervisor mode enabling configuration reloading and crash recovery",
+			Long:   "supervise -conf mackerel-agent.conf ...\n\nrun as supervisor mode enabling configuration reloading and crash recovery.\nThe restarts of the crashed agent are limited by [supervisor] of the config.",
 		},
 	)
 
@@ -37,7 +37,7 @@ func init() {
 			Name:   "version",
 			Action: doVersion,
 			Short:  "display version of mackerel-agent",
-			Long:   "version\n\ndisplay the version of mackerel-agent",
+			Long:   "version [-conf <file>]\n\ndisplay the version of mackerel-agent, and the fields of the host meta\nidentifying the agent exactly as they are posted, whose customizations are\nthe optional features enabled by the config file.",
 		},
 	)
 
@@ -46,7 +46,7 @@ func init() {
 			Name:   "configtest",
 			Action: doConfigtest,
 			Short:  "configtest",
-			Long:   "configtest\n\ndo configtest",
+			Long:   "configtest\n\ndo configtest, and print the locations of the state files resolved by the\nroot directory, the plugins disabled by enabled = false and the ones renamed\nby on_duplicate = \"suffix\".",
 		},
 	)
 
@@ -55,7 +55,61 @@ func init() {
 			Name:   "retire",
 			Action: doRetire,
 			Short:  "retire the host",
-			Long:   "retire [-force]\n\nretire the host",
+			Long:   "retire [-force] [-dry-run] [-only-if-status=poweroff,standby]\n\nretire the host. -force retires without prompting and succeeds if the host is\nalready retired. -dry-run prints the host which would be retired. The host is\nretired only if its status is one of -only-if-status.",
+		},
+	)
+
+	cli.Use(
+		&cli.Command{
+			Name:   "status",
+			Action: doStatus,
+			Short:  "show the status of the running agent",
+			Long:   "status [-json]\n\nshow the host ID, the uptime, the times of the last successful posts,\nthe sizes of the buffers and the numbers of the plugins of the running agent,\nand the plugins disabled by enabled = false.",
+		},
+	)
+
+	cli.Use(
+		&cli.Command{
+			Name:   "ctl",
+			Action: doCtl,
+			Short:  "control the running agent",
+			Long:   "ctl reload|flush|host-status <status>\n\nsend the command to the running agent by the control socket.\nreload resets the check reports and updates the host specs collected\nagain, and reloads the configuration in the supervise mode. flush posts the pending metrics\nand check reports immediately. host-status updates the status of the host\nto working, standby, maintenance or poweroff.",
+		},
+	)
+
+	cli.Use(
+		&cli.Command{
+			Name:   "plugin",
+			Action: doPlugin,
+			Short:  "manage the plugins",
+			Long:   "plugin install [-overwrite] [-plugins-dir <dir>] <owner/repo[@version]|url>\n\ninstall the plugin from the GitHub releases of owner/repo, or the archive of\nthe url. The archive for the OS and the architecture is downloaded from the\nrelease of the version, or the latest release, and verified by the checksum\nfile of the release if it exists. The executables in the archive are installed\ninto the plugins directory under the root directory by default, and the lines\nof the configuration to execute them are printed.",
+		},
+	)
+
+	cli.Use(
+		&cli.Command{
+			Name:   "diagnose",
+			Action: doDiagnose,
+			Short:  "collect the information for the support",
+			Long:   "diagnose [-stdout] [-output <file>] [-log-lines <n>] [-timeout <duration>]\n\ncollect the configuration, the version, the OS, the last lines of the log file,\nthe connectivity to the API, the validity of the API key, the registered host\nand a collection by once into a tar.gz bundle, or print them with -stdout.\nThe API key and the other secrets are redacted, and each of the probes is\nlimited by -timeout. The probes which cannot be performed, such as the ones\nrequiring the valid API key, are skipped. The summary of the probes is printed\nat the end, and it exits with an error if any of them failed.",
+		},
+	)
+
+	cli.Use(
+		&cli.Command{
+			Name:   "doctor",
+			Action: doDoctor,
+			Short:  "check the connectivity to the API",
+			Long:   "doctor api [-json]\n\ncheck the connectivity to the API with the proxy of the configuration by the\nsteps: resolving the host of the apibase (or the proxy), connecting to it, the\nTLS handshake reporting the negotiated version and the subjects of the\ncertificate chain, and an authenticated API call which validates the API key.\nThe result and the latency of each step are printed, or output as a JSON\ndocument with -json. The steps after the first failure are skipped, and it\nexits with an error if any of them failed.",
+		},
+	)
+
+	cli.Use(
+		&cli.Command{
+			Name:   "inspect-plugin",
+			Action: doInspectPlugin,
+			Short:  "run a metrics plugin and print the parsed output",
+			Long:   "inspect-plugin -plugin NAME [-conf <file>]\n\nrun the metrics plugin of [plugin.metrics.NAME] once in the same way as the\nagent, with the environment, the timeout and the protocol detection, and print\nthe graph definitions, the metric values and the warnings parsed from the\noutput, such as the invalid metric names and the timestamps. Nothing is posted\nto Mackerel. It exits with an error if the plugin failed, or the graph\ndefinitions or any line of the output cannot be parsed.",
 		},
 	)
 
@@ -64,7 +118,7 @@ func init() {
 			Name:   "once",
 			Action: doOnce,
 			Short:  "output onetime",
-			Long:   "once\n\noutput metrics and meta data of the host one time.\nThese data are only displayed and not posted to Mackerel.",
+			Long:   "once [-format json]\n\noutput metrics and meta data of the host one time.\nThese data are only displayed and not posted to Mackerel.\nWith -format json, the host specs, the graph definitions, the metric values\nand the check results are output as a JSON document, and it exits with an error\nif any of the plugins failed.",
 		},
 	)
 }
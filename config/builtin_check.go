@@ -0,0 +1,499 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of check plugins, which are specified by `type` in the configuration.
+// CheckTypeCommand (the default) runs the command of the plugin
+// and the others are the built-in checks implemented in the agent.
+const (
+	CheckTypeCommand  = ""
+	CheckTypeEventLog = "eventlog"
+	CheckTypeHTTP     = "http"
+	CheckTypeTCP      = "tcp"
+	CheckTypeFile     = "file"
+	CheckTypeLog      = "log"
+	CheckTypeCert     = "cert"
+	CheckTypeReadOnly = "readonly"
+)
+
+func (pconf *PluginConfig) buildBuiltinCheck(plugin *CheckPlugin) (err error) {
+	switch pconf.Type {
+	case CheckTypeCommand:
+		return nil
+	case CheckTypeEventLog:
+		plugin.EventLog, err = pconf.buildEventLogCheck()
+		return err
+	case CheckTypeHTTP:
+		plugin.HTTP, err = pconf.buildHTTPCheck()
+		return err
+	case CheckTypeTCP:
+		plugin.TCP, err = pconf.buildTCPCheck()
+		return err
+	case CheckTypeFile:
+		plugin.File, err = pconf.buildFileCheck()
+		return err
+	case CheckTypeLog:
+		plugin.Log, err = pconf.buildLogCheck()
+		return err
+	case CheckTypeCert:
+		plugin.Cert, err = pconf.buildCertCheck()
+		return err
+	case CheckTypeReadOnly:
+		plugin.ReadOnly, err = pconf.buildReadOnlyCheck()
+		return err
+	default:
+		return fmt.Errorf("unknown check type: %q", pconf.Type)
+	}
+}
+
+// Levels of the Windows event log
+const (
+	EventLevelCritical    = 1
+	EventLevelError       = 2
+	EventLevelWarning     = 3
+	EventLevelInformation = 4
+)
+
+var eventLevels = map[string]int{
+	"critical":    EventLevelCritical,
+	"error":       EventLevelError,
+	"warning":     EventLevelWarning,
+	"information": EventLevelInformation,
+}
+
+// EventLogCheck represents the configuration of the built-in check
+// which monitors the Windows event log.
+// The events of MaxLevel or severer levels are matched, whose sources match
+// any of SourcePatterns if any.
+type EventLogCheck struct {
+	LogName        string
+	SourcePatterns []*regexp.Regexp
+	EventIDs       []int32
+	MaxLevel       int
+}
+
+func (pconf *PluginConfig) buildEventLogCheck() (*EventLogCheck, error) {
+	if runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("the check type %q is supported only on Windows", CheckTypeEventLog)
+	}
+	check := &EventLogCheck{
+		LogName:  pconf.LogName,
+		EventIDs: pconf.EventIDs,
+		MaxLevel: EventLevelError,
+	}
+	if check.LogName == "" {
+		check.LogName = "Application"
+	}
+	for _, pattern := range pconf.SourcePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		check.SourcePatterns = append(check.SourcePatterns, re)
+	}
+	if pconf.Level != "" {
+		level, ok := eventLevels[strings.ToLower(pconf.Level)]
+		if !ok {
+			return nil, fmt.Errorf("level should be one of critical, error, warning or information, but %q", pconf.Level)
+		}
+		check.MaxLevel = level
+	}
+	return check, nil
+}
+
+const defaultBuiltinCheckTimeout = 10 * time.Second
+
+// HTTPCheck represents the configuration of the built-in check
+// which requests to URL and verifies the response.
+// If ExpectedStatus is zero, any status less than 400 is accepted.
+type HTTPCheck struct {
+	URL                string
+	Method             string
+	ExpectedStatus     int
+	BodyMatch          *regexp.Regexp
+	FollowRedirects    bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+	WarningLatency     time.Duration
+}
+
+func (pconf *PluginConfig) buildHTTPCheck() (*HTTPCheck, error) {
+	if pconf.URL == nil {
+		return nil, fmt.Errorf("url is required for the check type %q", CheckTypeHTTP)
+	}
+	u, err := url.Parse(*pconf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url should start with http:// or https://, but %q", *pconf.URL)
+	}
+	check := &HTTPCheck{
+		URL:                *pconf.URL,
+		Method:             strings.ToUpper(pconf.Method),
+		FollowRedirects:    true,
+		InsecureSkipVerify: pconf.InsecureSkipVerify,
+	}
+	if check.Method == "" {
+		check.Method = "GET"
+	}
+	if pconf.ExpectedStatus != nil {
+		if *pconf.ExpectedStatus < 100 || *pconf.ExpectedStatus > 599 {
+			return nil, fmt.Errorf("expected_status should be a HTTP status code, but %d", *pconf.ExpectedStatus)
+		}
+		check.ExpectedStatus = *pconf.ExpectedStatus
+	}
+	if pconf.BodyMatch != nil {
+		check.BodyMatch, err = regexp.Compile(*pconf.BodyMatch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pconf.FollowRedirects != nil {
+		check.FollowRedirects = *pconf.FollowRedirects
+	}
+	check.Timeout, check.WarningLatency, err = pconf.builtinCheckTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// TCPCheck represents the configuration of the built-in check
+// which connects to Host:Port (optionally with TLS).
+type TCPCheck struct {
+	Host               string
+	Port               int
+	TLS                bool
+	ServerName         string
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+	WarningLatency     time.Duration
+}
+
+// Address returns the address to connect, which is valid also for IPv6 literals.
+func (c *TCPCheck) Address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (pconf *PluginConfig) buildTCPCheck() (*TCPCheck, error) {
+	if pconf.Port <= 0 || pconf.Port > 65535 {
+		return nil, fmt.Errorf("port should be in the range of 1 to 65535, but %d", pconf.Port)
+	}
+	check := &TCPCheck{
+		// accept IPv6 literals in brackets as well
+		Host:               strings.TrimSuffix(strings.TrimPrefix(pconf.Host, "["), "]"),
+		Port:               pconf.Port,
+		TLS:                pconf.TLS,
+		ServerName:         pconf.ServerName,
+		InsecureSkipVerify: pconf.InsecureSkipVerify,
+	}
+	if check.Host == "" {
+		check.Host = "localhost"
+	}
+	var err error
+	check.Timeout, check.WarningLatency, err = pconf.builtinCheckTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+func (pconf *PluginConfig) builtinCheckTimeouts() (timeout, warningLatency time.Duration, err error) {
+	timeout = defaultBuiltinCheckTimeout
+	if pconf.Timeout != nil {
+		if pconf.Timeout.Duration <= 0 {
+			return 0, 0, fmt.Errorf("timeout should be positive, but %s", pconf.Timeout.Duration)
+		}
+		timeout = pconf.Timeout.Duration
+	}
+	if pconf.WarningLatency != nil {
+		warningLatency = pconf.WarningLatency.Duration
+		if warningLatency <= 0 || warningLatency >= timeout {
+			return 0, 0, fmt.Errorf("warning_latency should be positive and less than timeout (%s), but %s", timeout, warningLatency)
+		}
+	}
+	return timeout, warningLatency, nil
+}
+
+// FileCheck represents the configuration of the built-in check
+// which verifies the existence, the age and the size of files.
+// Path may be a glob pattern and the newest matching file is verified.
+// MaxAge and MinSize are not verified if they are zero.
+type FileCheck struct {
+	Path         string
+	MaxAge       time.Duration
+	MinSize      int64
+	MustExist    bool
+	MustNotExist bool
+}
+
+func (pconf *PluginConfig) buildFileCheck() (*FileCheck, error) {
+	if pconf.Path == "" {
+		return nil, fmt.Errorf("path is required for the check type %q", CheckTypeFile)
+	}
+	if _, err := filepath.Match(pconf.Path, ""); err != nil {
+		return nil, fmt.Errorf("invalid path pattern %q: %s", pconf.Path, err)
+	}
+	check := &FileCheck{
+		Path:         pconf.Path,
+		MustExist:    !pconf.MustNotExist,
+		MustNotExist: pconf.MustNotExist,
+	}
+	if pconf.MustExist != nil {
+		if *pconf.MustExist && pconf.MustNotExist {
+			return nil, fmt.Errorf("must_exist and must_not_exist cannot be specified at the same time")
+		}
+		check.MustExist = *pconf.MustExist
+	}
+	if pconf.MaxAge != nil {
+		if pconf.MaxAge.Duration <= 0 {
+			return nil, fmt.Errorf("max_age should be positive, but %s", pconf.MaxAge.Duration)
+		}
+		check.MaxAge = pconf.MaxAge.Duration
+	}
+	if pconf.MinSize != nil {
+		if *pconf.MinSize < 0 {
+			return nil, fmt.Errorf("min_size should not be negative, but %d", *pconf.MinSize)
+		}
+		check.MinSize = *pconf.MinSize
+	}
+	if check.MustNotExist && (check.MaxAge > 0 || check.MinSize > 0) {
+		return nil, fmt.Errorf("max_age and min_size cannot be specified with must_not_exist")
+	}
+	return check, nil
+}
+
+// The statuses of the log check when no files match File.
+const (
+	MissingFileStatusOK      = "OK"
+	MissingFileStatusUnknown = "UNKNOWN"
+)
+
+// LogCheck represents the configuration of the built-in check
+// which reads the lines appended to files and matches them by the patterns.
+// File may be a glob pattern and all the matching files are read.
+// The lines matching ExcludePattern are ignored, and WarningPattern or
+// CriticalPattern may be nil.
+type LogCheck struct {
+	File              string
+	WarningPattern    *regexp.Regexp
+	CriticalPattern   *regexp.Regexp
+	ExcludePattern    *regexp.Regexp
+	MissingFileStatus string
+}
+
+func (pconf *PluginConfig) buildLogCheck() (*LogCheck, error) {
+	if pconf.File == "" {
+		return nil, fmt.Errorf("file is required for the check type %q", CheckTypeLog)
+	}
+	if _, err := filepath.Match(pconf.File, ""); err != nil {
+		return nil, fmt.Errorf("invalid file pattern %q: %s", pconf.File, err)
+	}
+	if pconf.WarningPattern == nil && pconf.CriticalPattern == nil {
+		return nil, fmt.Errorf("warning_pattern or critical_pattern is required for the check type %q", CheckTypeLog)
+	}
+	check := &LogCheck{
+		File:              pconf.File,
+		MissingFileStatus: MissingFileStatusUnknown,
+	}
+	for _, p := range []struct {
+		name    string
+		pattern *string
+		re      **regexp.Regexp
+	}{
+		{"warning_pattern", pconf.WarningPattern, &check.WarningPattern},
+		{"critical_pattern", pconf.CriticalPattern, &check.CriticalPattern},
+		{"exclude_pattern", pconf.ExcludePattern, &check.ExcludePattern},
+	} {
+		if p.pattern == nil {
+			continue
+		}
+		re, err := regexp.Compile(*p.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", p.name, err)
+		}
+		*p.re = re
+	}
+	switch strings.ToUpper(pconf.MissingFileStatus) {
+	case "":
+	case MissingFileStatusOK, MissingFileStatusUnknown:
+		check.MissingFileStatus = strings.ToUpper(pconf.MissingFileStatus)
+	default:
+		return nil, fmt.Errorf("missing_file_status should be %q or %q, but %q", MissingFileStatusOK, MissingFileStatusUnknown, pconf.MissingFileStatus)
+	}
+	return check, nil
+}
+
+// The protocols to upgrade the connections to TLS by STARTTLS.
+const (
+	StartTLSNone = ""
+	StartTLSSMTP = "smtp"
+	StartTLSIMAP = "imap"
+	StartTLSPOP3 = "pop3"
+	StartTLSFTP  = "ftp"
+)
+
+var startTLSPorts = map[string]int{
+	StartTLSNone: 443,
+	StartTLSSMTP: 25,
+	StartTLSIMAP: 143,
+	StartTLSPOP3: 110,
+	StartTLSFTP:  21,
+}
+
+// The defaults of the certificate checks. The timeout is shorter than the
+// other checks, so that the dead endpoint is reported soon.
+const (
+	defaultCertWarningDays  = 30
+	defaultCertCriticalDays = 14
+	defaultCertCheckTimeout = 5 * time.Second
+)
+
+// CertCheck represents the configuration of the built-in check which verifies
+// the expiry of the certificate served at Host:Port, or in the PEM file of
+// Path. The first certificate is checked, and the others are the
+// intermediates. The chain is verified by the roots of the system or CAFile
+// unless VerifyChain is false, and the name of the network target is verified
+// by ServerName unless VerifyHostname is false.
+type CertCheck struct {
+	Host           string
+	Port           int
+	ServerName     string
+	StartTLS       string
+	Path           string
+	WarningDays    int
+	CriticalDays   int
+	VerifyChain    bool
+	VerifyHostname bool
+	CAFile         string
+	Timeout        time.Duration
+}
+
+// Address returns the address to connect, which is valid also for IPv6 literals.
+func (c *CertCheck) Address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (pconf *PluginConfig) buildCertCheck() (*CertCheck, error) {
+	check := &CertCheck{
+		Path:           pconf.Path,
+		WarningDays:    defaultCertWarningDays,
+		CriticalDays:   defaultCertCriticalDays,
+		VerifyChain:    true,
+		VerifyHostname: pconf.Path == "",
+		Timeout:        defaultCertCheckTimeout,
+	}
+	if check.Path != "" {
+		if pconf.Host != "" || pconf.Port != 0 || pconf.ServerName != "" || pconf.StartTLS != "" {
+			return nil, fmt.Errorf("host, port, server_name and starttls cannot be specified with path")
+		}
+	} else {
+		port, ok := startTLSPorts[strings.ToLower(pconf.StartTLS)]
+		if !ok {
+			return nil, fmt.Errorf("starttls should be one of smtp, imap, pop3 or ftp, but %q", pconf.StartTLS)
+		}
+		check.StartTLS = strings.ToLower(pconf.StartTLS)
+		check.Port = pconf.Port
+		if check.Port == 0 {
+			check.Port = port
+		}
+		if check.Port < 0 || check.Port > 65535 {
+			return nil, fmt.Errorf("port should be in the range of 1 to 65535, but %d", pconf.Port)
+		}
+		check.Host = strings.TrimSuffix(strings.TrimPrefix(pconf.Host, "["), "]")
+		if check.Host == "" {
+			check.Host = "localhost"
+		}
+		check.ServerName = pconf.ServerName
+		if check.ServerName == "" {
+			check.ServerName = check.Host
+		}
+	}
+	if pconf.WarningDays != nil {
+		check.WarningDays = *pconf.WarningDays
+	}
+	if pconf.CriticalDays != nil {
+		check.CriticalDays = *pconf.CriticalDays
+	}
+	if check.CriticalDays < 0 || check.WarningDays < check.CriticalDays {
+		return nil, fmt.Errorf("warning_days should not be less than critical_days, and critical_days should not be negative, but %d and %d", check.WarningDays, check.CriticalDays)
+	}
+	if pconf.VerifyChain != nil {
+		check.VerifyChain = *pconf.VerifyChain
+	}
+	if pconf.VerifyHostname != nil {
+		if *pconf.VerifyHostname && check.Path != "" {
+			return nil, fmt.Errorf("verify_hostname is available only for the network targets")
+		}
+		check.VerifyHostname = *pconf.VerifyHostname
+	}
+	if pconf.CAFile != nil {
+		if !check.VerifyChain {
+			return nil, fmt.Errorf("ca_file requires verify_chain")
+		}
+		check.CAFile = *pconf.CAFile
+	}
+	if pconf.Timeout != nil {
+		if pconf.Timeout.Duration <= 0 {
+			return nil, fmt.Errorf("timeout should be positive, but %s", pconf.Timeout.Duration)
+		}
+		check.Timeout = pconf.Timeout.Duration
+	}
+	return check, nil
+}
+
+// defaultReadOnlyDevicePattern matches the real block devices, not to check
+// the pseudo filesystems such as tmpfs and proc.
+const defaultReadOnlyDevicePattern = `^/dev/`
+
+// ReadOnlyCheck represents the configuration of the built-in check which
+// reports the filesystems remounted read-only, such as by the disk errors,
+// and the errors recorded by the kernel. The filesystems of the devices
+// matching DevicePattern on the mount points matching IncludePattern and not
+// ExcludePattern are checked. IncludePattern and ExcludePattern may be nil.
+type ReadOnlyCheck struct {
+	DevicePattern  *regexp.Regexp
+	IncludePattern *regexp.Regexp
+	ExcludePattern *regexp.Regexp
+}
+
+func (pconf *PluginConfig) buildReadOnlyCheck() (*ReadOnlyCheck, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("the check type %q is supported only on Linux", CheckTypeReadOnly)
+	}
+	devicePattern := defaultReadOnlyDevicePattern
+	if pconf.DevicePattern != nil {
+		devicePattern = *pconf.DevicePattern
+	}
+	check := &ReadOnlyCheck{}
+	for _, p := range []struct {
+		name    string
+		pattern *string
+		re      **regexp.Regexp
+	}{
+		{"device_pattern", &devicePattern, &check.DevicePattern},
+		{"include_pattern", pconf.IncludePattern, &check.IncludePattern},
+		{"exclude_pattern", pconf.ExcludePattern, &check.ExcludePattern},
+	} {
+		if p.pattern == nil {
+			continue
+		}
+		re, err := regexp.Compile(*p.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", p.name, err)
+		}
+		*p.re = re
+	}
+	return check, nil
+}
@@ -2,21 +2,32 @@ package config
 
 import (
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
-	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/mackerel-agent/cmdutil"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/pluginbreaker"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	"github.com/mackerelio/mackerel-agent/util"
 	"github.com/pkg/errors"
 )
 
-var configLogger = logging.GetLogger("config")
+var configLogger = logformat.GetLogger("config")
 
 // `apibase` and `agentName` are set from build flags
 var apibase string
@@ -30,7 +41,9 @@ func getApibase() string {
 
 var agentName string
 
-func getAgentName() string {
+// AgentName returns the name of the agent given at build time, which is also
+// the name of the default config file and the directories.
+func AgentName() string {
 	if agentName != "" {
 		return agentName
 	}
@@ -50,6 +63,7 @@ const (
 	CloudPlatformEC2
 	CloudPlatformGCE
 	CloudPlatformAzureVM
+	CloudPlatformECS
 )
 
 func (c CloudPlatform) String() string {
@@ -64,6 +78,8 @@ func (c CloudPlatform) String() string {
 		return "gce"
 	case CloudPlatformAzureVM:
 		return "azurevm"
+	case CloudPlatformECS:
+		return "ecs"
 	}
 	return ""
 }
@@ -86,6 +102,9 @@ func (c *CloudPlatform) UnmarshalText(text []byte) error {
 	case "azurevm":
 		*c = CloudPlatformAzureVM
 		return nil
+	case "ecs":
+		*c = CloudPlatformECS
+		return nil
 	default:
 		*c = CloudPlatformNone // Avoid panic
 		return fmt.Errorf("failed to parse")
@@ -94,9 +113,12 @@ func (c *CloudPlatform) UnmarshalText(text []byte) error {
 
 // Config represents mackerel-agent's configuration file.
 type Config struct {
-	Apibase       string
-	Apikey        string
-	Root          string
+	Apibase string
+	Apikey  string
+	Root    string
+	// Pidfile is "pid" under Root by default, and is not created if it is
+	// configured to "", such as in the containers whose supervisor owns the
+	// lifecycle of the agent.
 	Pidfile       string
 	Conffile      string
 	Roles         []string
@@ -106,9 +128,231 @@ type Config struct {
 	DisplayName   string        `toml:"display_name"`
 	HostStatus    HostStatus    `toml:"host_status"`
 	Filesystems   Filesystems   `toml:"filesystems"`
+	Interfaces    Interfaces    `toml:"interfaces"`
 	HTTPProxy     string        `toml:"http_proxy"`
 	CloudPlatform CloudPlatform `toml:"cloud_platform"`
 
+	IDFile    string `toml:"id_file"`
+	LogFormat string `toml:"log_format"`
+
+	// HostIdentity is HostIdentityCustomIdentifier to identify the host by the
+	// custom identifier instead of the host ID file, such as on the hosts cloned
+	// from the golden images. The custom identifier is CustomIdentifier, the
+	// output of CustomIdentifierCommand or the one of the cloud platform.
+	HostIdentity            string      `toml:"host_identity"`
+	CustomIdentifier        string      `toml:"custom_identifier"`
+	CustomIdentifierCommand interface{} `toml:"custom_identifier_command"`
+	// StrictHostnameChange is to refuse to start when the hostname has changed,
+	// for those who treat renaming hosts as re-provisioning them.
+	StrictHostnameChange bool `toml:"strict_hostname_change"`
+	// DuplicateInstance is how to treat another agent posting as the same
+	// host, which is detected by the token of the instance in the host metadata.
+	// It is "ignore" by default not to write the host metadata.
+	DuplicateInstance DuplicateInstance `toml:"duplicate_instance"`
+	// Proxy = ProxySystem resolves the proxy by the system settings on Windows
+	// unless http_proxy or the proxy environment variables are set.
+	Proxy string `toml:"proxy"`
+	// BindAddress is the source address, or the network interface, of the
+	// requests to Mackerel and the other outbound HTTP requests except the
+	// ones to the metadata services of the cloud platforms.
+	BindAddress string `toml:"bind_address"`
+
+	// DisableCompression is to disable compressing the request bodies to Mackerel,
+	// for the proxies which do not handle them correctly.
+	DisableCompression bool `toml:"disable_compression"`
+	// CompressionThreshold is the minimum size of the request bodies to be compressed in bytes.
+	CompressionThreshold *int `toml:"compression_threshold"`
+	// RateLimit is the maximum number of the requests to Mackerel per second,
+	// not to exceed the rate limit of the server on recovering from outages.
+	// Zero means no limit.
+	RateLimit float64 `toml:"rate_limit"`
+	// RateLimitBurst is the number of the requests sent at once within RateLimit.
+	RateLimitBurst *int `toml:"rate_limit_burst"`
+	// PostMetricsMaxValues and PostMetricsMaxBytes limit the number of the
+	// metric values and the size of the request body in bytes of a post, over
+	// which the values are split into multiple requests.
+	PostMetricsMaxValues *int `toml:"post_metrics_max_values"`
+	PostMetricsMaxBytes  *int `toml:"post_metrics_max_bytes"`
+	// APITimeouts are the deadlines of the requests to Mackerel by the payloads,
+	// so that a slow request of the metadata does not delay the check reports.
+	APITimeouts *APITimeouts `toml:"api_timeouts"`
+	// UserAgentSuffix is appended to the User-Agent of the requests to Mackerel,
+	// such as the name of the deployment to be identified by the proxies.
+	UserAgentSuffix string `toml:"user_agent_suffix"`
+	// HTTPHeaders are added to all the requests to Mackerel, such as the
+	// credentials of the proxy. The values expand the environment variables.
+	HTTPHeaders map[string]string `toml:"http_headers"`
+	// DisableSelfMetrics is to disable posting the metrics about the agent itself,
+	// such as the memory usage, the buffer occupancy and the latency of the posts.
+	DisableSelfMetrics bool `toml:"disable_self_metrics"`
+	// PluginDurationMetrics is to post the last durations of the plugins as
+	// the self metrics, custom.agent.plugin.<kind>_<name>.duration_ms.
+	PluginDurationMetrics bool `toml:"plugin_duration_metrics"`
+	// AdjustClockSkew is to adjust the timestamps of the metric values by the
+	// difference of the local clock from Mackerel, measured by the API responses.
+	AdjustClockSkew bool `toml:"adjust_clock_skew"`
+	// CloudDetectionTimeout is the maximum duration to wait for the cloud
+	// metadata at startup. The host is updated with the metadata collected later.
+	CloudDetectionTimeout *Duration `toml:"cloud_detection_timeout"`
+
+	// ECSServiceIdentifier is whether to identify the host on ECS by the cluster
+	// and the service, or the family of the task not run by a service.
+	ECSServiceIdentifier bool       `toml:"ecs_service_identifier"`
+	Kubernetes           Kubernetes `toml:"kubernetes"`
+	Cloud                Cloud      `toml:"cloud"`
+
+	// SpoolDir is the directory to store the metrics and the check reports which
+	// could not be posted, so that they are posted after the agent restarts.
+	SpoolDir      string    `toml:"spool_dir"`
+	SpoolMaxAge   *Duration `toml:"spool_max_age"`
+	SpoolMaxBytes *int64    `toml:"spool_max_bytes"`
+
+	// LogFile is the file to write the logs instead of stderr, which is rotated
+	// by LogMaxSize in bytes or LogRotateInterval. LogMaxFiles rotated files are
+	// kept, compressed with LogCompress.
+	LogFile           string    `toml:"log_file"`
+	LogMaxSize        *int64    `toml:"log_max_size"`
+	LogMaxFiles       *int      `toml:"log_max_files"`
+	LogRotateInterval *Duration `toml:"log_rotate_interval"`
+	LogCompress       bool      `toml:"log_compress"`
+	// LogOutput is LogOutputSyslog to send the logs to syslog with SyslogFacility,
+	// to the remote syslog of SyslogAddress such as "udp://192.0.2.1:514" if any,
+	// or LogOutputEventLog to write them to the event log.
+	LogOutput      string `toml:"log_output"`
+	SyslogFacility string `toml:"syslog_facility"`
+	SyslogAddress  string `toml:"syslog_address"`
+
+	// DisableLogDedup is to log all the identical warnings and errors, which are
+	// logged once an hour with the number of the repeats by default.
+	DisableLogDedup bool `toml:"disable_log_dedup"`
+
+	// LogLevels override the level of the logs by the components in
+	// LogComponents, such as { spec = "debug" }. Verbose sets all of them to debug.
+	LogLevels map[string]string `toml:"log_levels"`
+
+	// AutoRetirement is to retire the host at exit, for the hosts which are
+	// thrown away on termination such as the auto-scaled instances.
+	AutoRetirement AutoRetirement `toml:"autoretirement"`
+
+	// Supervisor limits the restarts of the crashed agent in the supervise mode.
+	Supervisor Supervisor `toml:"supervisor"`
+
+	// Secondary is the destination to which the metric values and the check
+	// reports are mirrored, such as another organization while migrating.
+	Secondary *Secondary `toml:"secondary"`
+
+	// Statsd is the statsd listener whose metrics are posted as custom.statsd.*.
+	Statsd *Statsd `toml:"statsd"`
+
+	// IPMI is the sensors of the BMC posted as custom.ipmi.*.
+	IPMI *IPMI `toml:"ipmi"`
+
+	// OTLP is the OpenTelemetry collector to which the metrics are exported.
+	OTLP *OTLP `toml:"otlp"`
+
+	// Fluentd is the endpoint of the forward protocol to which the metrics are forwarded.
+	Fluentd *Fluentd `toml:"fluentd"`
+
+	// HTTPPush is the local endpoint to which the custom metrics are pushed.
+	HTTPPush *HTTPPush `toml:"http_push"`
+
+	// Debug is the local endpoint serving the profiles and the internal counters.
+	Debug *Debug `toml:"debug"`
+
+	// Health is the local endpoint answering the liveness and the readiness probes.
+	Health *Health `toml:"health"`
+
+	// LifecycleAnnotation posts the graph annotations when the agent starts,
+	// stops and reloads the configuration.
+	LifecycleAnnotation *LifecycleAnnotation `toml:"lifecycle_annotation"`
+
+	// CheckReportResendInterval is the interval to post the check reports whose
+	// status and message are unchanged. Zero means to post all the reports.
+	CheckReportResendInterval *Duration `toml:"check_report_resend_interval"`
+	// CheckStateMaxAge is the maximum age of the states of the check reports
+	// persisted across the restarts, beyond which they are discarded. Zero means
+	// not to persist them, which are not kept without CheckReportResendInterval.
+	CheckStateMaxAge *Duration `toml:"check_state_max_age"`
+
+	// CheckSuppress and CheckSuppressMode are the windows to suppress the
+	// reports of all the checks, such as the batch windows, and the mode of them.
+	CheckSuppress     []string `toml:"check_suppress"`
+	CheckSuppressMode string   `toml:"check_suppress_mode"`
+
+	// PluginMaxStdoutBytes and PluginMaxStderrBytes limit the outputs of the
+	// plugins per execution. The plugin writing more to stdout is terminated,
+	// and stderr beyond the limit is truncated.
+	PluginMaxStdoutBytes *int64 `toml:"plugin_max_stdout_bytes"`
+	PluginMaxStderrBytes *int64 `toml:"plugin_max_stderr_bytes"`
+
+	// PluginSlowRatio is the ratio of the duration of a plugin execution to the
+	// interval of the plugin beyond which the execution is warned as slow.
+	// Zero means never warned.
+	PluginSlowRatio *float64 `toml:"plugin_slow_ratio"`
+
+	// PluginCircuitBreakerThreshold is the number of the consecutive failures
+	// of a metrics or check plugin after which its executions are backed off,
+	// doubling up to PluginCircuitBreakerMaxInterval. Zero means never backed off.
+	PluginCircuitBreakerThreshold   *int32    `toml:"plugin_circuit_breaker_threshold"`
+	PluginCircuitBreakerMaxInterval *Duration `toml:"plugin_circuit_breaker_max_interval"`
+
+	// HostSpecsExpensiveInterval is the interval to collect the expensive host
+	// specs, the filesystems and the cloud metadata, which are reused by the
+	// hourly updates in between. Zero means to collect them every time.
+	HostSpecsExpensiveInterval *Duration `toml:"host_specs_expensive_interval"`
+
+	// ShutdownFlushTimeout is the maximum duration to post the pending metrics and
+	// check reports on shutdown. Zero means to exit without flushing them.
+	ShutdownFlushTimeout *Duration `toml:"shutdown_flush_timeout"`
+
+	// ControlLaunchdSocket is the name of the Sockets entry of the launchd job
+	// on macOS whose socket is received as the control socket by the socket
+	// activation, instead of creating it. The socket is created if it is not
+	// activated, such as by the released binaries cross-compiled without cgo,
+	// which do not support the socket activation.
+	ControlLaunchdSocket string `toml:"control_launchd_socket"`
+
+	// FlushMetricsOnAlert is to post the pending metrics immediately when a
+	// check transitions to WARNING or CRITICAL, at most once a minute.
+	FlushMetricsOnAlert bool `toml:"flush_metrics_on_alert"`
+
+	// MetricsConcurrency is the number of the metrics plugins executed concurrently.
+	// Zero means the default, the number of CPUs between 4 and 8, or the CPU
+	// quota of the cgroup rounded up to at most 8 if it is limited.
+	MetricsConcurrency int `toml:"metrics_concurrency"`
+
+	// MetricNameCollision is how to treat the metric names generated by more
+	// than one generator or plugin in a collection.
+	MetricNameCollision MetricNameCollision `toml:"metric_name_collision"`
+
+	// CounterWrap is how to treat the counters of the interfaces and the disks
+	// smaller than the previous values in the deltas.
+	CounterWrap CounterWrap `toml:"counter_wrap"`
+
+	// WindowsCPUBackend is how to collect the CPU usage on Windows.
+	WindowsCPUBackend WindowsCPUBackend `toml:"windows_cpu_backend"`
+
+	// OrphanPlugins is how to treat the plugin processes left by the previous
+	// agent, which are found at startup.
+	OrphanPlugins OrphanPlugins `toml:"orphan_plugins"`
+
+	// OnDuplicate is how to treat the plugins of the same section defined
+	// differently in the configuration file and the included files.
+	OnDuplicate OnDuplicate `toml:"on_duplicate"`
+
+	// StatusFile is the file the status of the agent, the last posts and the
+	// buffers, is written to after every post of the metrics for the external
+	// monitoring. StatusFileMode is the permission of it in octal ("0644").
+	StatusFile     string `toml:"status_file"`
+	StatusFileMode string `toml:"status_file_mode"`
+	// StatusFilePerm is parsed from StatusFileMode.
+	StatusFilePerm os.FileMode `toml:"-"`
+
+	// SecureConfig is to refuse to start when the configuration files containing
+	// the secrets, the API key and the passwords, are readable by the others.
+	// They are only warned by default.
+	SecureConfig bool `toml:"secure_config"`
+
 	// This Plugin field is used to decode the toml file. After reading the
 	// configuration from file, this field is set to nil.
 	// Please consider using MetricPlugins and CheckPlugins.
@@ -117,33 +361,178 @@ type Config struct {
 	Include string
 
 	// Cannot exist in configuration files
+	// AtExit is the action at exit given by the command line option.
+	AtExit string
+	// ForceGraphDefs is to post the graph definitions of the plugins even if
+	// they are not changed, given by the command line option.
+	ForceGraphDefs bool
+	// Supervised is true if the agent runs as the child process of the supervise mode.
+	Supervised bool
+	// InstanceSuffix is the suffix of the instance of the agent registered as
+	// a host of its own, given by the command line option.
+	InstanceSuffix string
+	// instanceCustomIdentifier is true if the custom identifier is suffixed
+	// by InstanceSuffix, which is not configured for the instance.
+	instanceCustomIdentifier bool
+	// overridingPlugins is true while the config file of the instance is
+	// loaded, whose plugins are not the duplicates.
+	overridingPlugins bool
+	// customIdentifierCmd is parsed from CustomIdentifierCommand.
+	customIdentifierCmd *Command
+	// SecretFiles are the loaded configuration files and env_file of the
+	// plugins containing the secrets.
+	SecretFiles     []string
 	HostIDStorage   HostIDStorage
 	MetricPlugins   map[string]*MetricPlugin
 	CheckPlugins    map[string]*CheckPlugin
 	MetadataPlugins map[string]*MetadataPlugin
+	// PrometheusPlugins are the Prometheus exporters configured by [plugin.prometheus.NAME].
+	PrometheusPlugins map[string]*PrometheusPlugin
+	// SNMPPlugins are the SNMP agents configured by [plugin.snmp.NAME].
+	SNMPPlugins map[string]*SNMPPlugin
+	// WindowsPerfCounterPlugins are the performance counters configured by [plugin.windows_perfcounter.NAME].
+	WindowsPerfCounterPlugins map[string]*WindowsPerfCounterPlugin
+	// disabledPlugins are the sections of the plugins disabled by enabled = false,
+	// such as "plugin.checks.foo", which are excluded from the plugins above.
+	disabledPlugins map[string]bool
+	// pluginDefinitions are the last definitions of the sections of the
+	// plugins, and duplicatePlugins are the ones defined differently.
+	pluginDefinitions map[string]pluginDefinition
+	duplicatePlugins  []PluginDuplicate
+	// pidfileDisabled is true if pidfile is configured to "".
+	pidfileDisabled bool
 }
 
 // PluginConfig represents a plugin configuration.
 type PluginConfig struct {
 	CommandConfig
-	NotificationInterval  *int32        `toml:"notification_interval"`
-	CheckInterval         *int32        `toml:"check_interval"`
-	ExecutionInterval     *int32        `toml:"execution_interval"`
-	MaxCheckAttempts      *int32        `toml:"max_check_attempts"`
-	CustomIdentifier      *string       `toml:"custom_identifier"`
-	PreventAlertAutoClose bool          `toml:"prevent_alert_auto_close"`
-	IncludePattern        *string       `toml:"include_pattern"`
-	ExcludePattern        *string       `toml:"exclude_pattern"`
-	Action                CommandConfig `toml:"action"`
-	Memo                  string        `toml:"memo"`
+	// Enabled = false keeps the section validated but does not run the plugin.
+	Enabled               *bool        `toml:"enabled"`
+	NotificationInterval  *int32       `toml:"notification_interval"`
+	CheckInterval         *int32       `toml:"check_interval"`
+	ExecutionInterval     *int32       `toml:"execution_interval"`
+	MaxCheckAttempts      *int32       `toml:"max_check_attempts"`
+	CustomIdentifier      *string      `toml:"custom_identifier"`
+	PreventAlertAutoClose bool         `toml:"prevent_alert_auto_close"`
+	IncludePattern        *string      `toml:"include_pattern"`
+	ExcludePattern        *string      `toml:"exclude_pattern"`
+	Action                ActionConfig `toml:"action"`
+	Memo                  string       `toml:"memo"`
+	MaxOutputBytes        *int32       `toml:"max_output_bytes"`
+	SplaySeconds          *int32       `toml:"splay_seconds"`
+	// for metrics plugins collected more frequently than PostMetricsInterval
+	IntervalSeconds *int32 `toml:"interval_seconds"`
+	Aggregation     string `toml:"aggregation"`
+	// for metrics plugins, the protocol of the output
+	Protocol string `toml:"protocol"`
+	// for metrics plugins, how to treat the metric names with the invalid
+	// characters and the maximum number of the names in an output
+	InvalidMetricNames string `toml:"invalid_metric_names"`
+	MaxMetricNames     *int32 `toml:"max_metric_names"`
+	// for metrics plugins, the maximum difference of the timestamps in the
+	// output from the collection time
+	TimestampWindow *Duration `toml:"timestamp_window"`
+	// for metrics plugins, how to treat the executions without the values
+	OnEmpty     string `toml:"on_empty"`
+	EmptyCycles *int32 `toml:"empty_cycles"`
+	// for metadata plugins, the maximum size of the metadata split into the
+	// namespaces of the chunks beyond the limit of a namespace
+	MaxTotalBytes *int32 `toml:"max_total_bytes"`
+	// for check plugins of format = "nagios"
+	ReportPerfdata bool `toml:"report_perfdata"`
+	// for check plugins of format = "json"
+	ReportItemsAsMetrics bool `toml:"report_items_as_metrics"`
+	// for check plugins, the windows to suppress the reports, which override
+	// check_suppress of the global configuration
+	Suppress     []string `toml:"suppress"`
+	SuppressMode string   `toml:"suppress_mode"`
+
+	// for built-in check plugins
+	Type           string   `toml:"type"`
+	LogName        string   `toml:"log_name"`
+	SourcePatterns []string `toml:"source_patterns"`
+	EventIDs       []int32  `toml:"event_ids"`
+	Level          string   `toml:"level"`
+
+	URL                *string   `toml:"url"`
+	Method             string    `toml:"method"`
+	ExpectedStatus     *int      `toml:"expected_status"`
+	BodyMatch          *string   `toml:"body_match"`
+	FollowRedirects    *bool     `toml:"follow_redirects"`
+	Host               string    `toml:"host"`
+	Port               int       `toml:"port"`
+	TLS                bool      `toml:"tls"`
+	ServerName         string    `toml:"server_name"`
+	InsecureSkipVerify bool      `toml:"insecure_skip_verify"`
+	Timeout            *Duration `toml:"timeout"`
+	WarningLatency     *Duration `toml:"warning_latency"`
+
+	// for the certificate checks, the network target is given by Host,
+	// Port and ServerName unless Path is given
+	StartTLS       string  `toml:"starttls"`
+	WarningDays    *int    `toml:"warning_days"`
+	CriticalDays   *int    `toml:"critical_days"`
+	VerifyChain    *bool   `toml:"verify_chain"`
+	VerifyHostname *bool   `toml:"verify_hostname"`
+	CAFile         *string `toml:"ca_file"`
+
+	Path         string    `toml:"path"`
+	MaxAge       *Duration `toml:"max_age"`
+	MinSize      *int64    `toml:"min_size"`
+	MustExist    *bool     `toml:"must_exist"`
+	MustNotExist bool      `toml:"must_not_exist"`
+
+	// for the log checks with File and ExcludePattern
+	WarningPattern    *string `toml:"warning_pattern"`
+	CriticalPattern   *string `toml:"critical_pattern"`
+	MissingFileStatus string  `toml:"missing_file_status"`
+
+	// for the read-only checks with IncludePattern and ExcludePattern
+	DevicePattern *string `toml:"device_pattern"`
+
+	// for Prometheus exporters, and the metrics plugins and the SNMP agents
+	// posting the service metrics
+	MetricPrefix  string `toml:"metric_prefix"`
+	LabelTemplate string `toml:"label_template"`
+
+	// for SNMP agents
+	Target       string           `toml:"target"`
+	Version      string           `toml:"version"`
+	Community    string           `toml:"community"`
+	SecName      string           `toml:"sec_name"`
+	AuthProtocol string           `toml:"auth_protocol"`
+	AuthPassword string           `toml:"auth_password"`
+	PrivProtocol string           `toml:"priv_protocol"`
+	PrivPassword string           `toml:"priv_password"`
+	OIDs         []*SNMPOIDConfig `toml:"oids"`
+	// Service is also for the metrics plugins.
+	Service string `toml:"service"`
+
+	// for Windows performance counters
+	Counters         []string `toml:"counters"`
+	InstanceWildcard bool     `toml:"instance_wildcard"`
+
+	// for built-in metadata plugins, and the built-in log checks
+	File   string `toml:"file"`
+	Format string `toml:"format"`
+}
+
+// ActionConfig represents an action command configuration of a check plugin.
+type ActionConfig struct {
+	CommandConfig
+	MaxTriggerPerHour *int32 `toml:"max_trigger_per_hour"`
 }
 
 // CommandConfig represents an executable command configuration.
 type CommandConfig struct {
-	Raw            interface{} `toml:"command"`
-	User           string      `toml:"user"`
-	Env            Env         `toml:"env"`
-	TimeoutSeconds int64       `toml:"timeout_seconds"`
+	Raw  interface{} `toml:"command"`
+	User string      `toml:"user"`
+	Env  Env         `toml:"env"`
+	// EnvFile is the file of the environments as KEY=VALUE lines, such as the
+	// credentials readable only by root, which are overridden by Env.
+	EnvFile        string `toml:"env_file"`
+	Cwd            string `toml:"cwd"`
+	TimeoutSeconds int64  `toml:"timeout_seconds"`
 }
 
 // Env represents environments.
@@ -165,32 +554,109 @@ func (e Env) ConvertToStrings() ([]string, error) {
 	return env, nil
 }
 
+// readEnvFile reads the environments from file, which consists of KEY=VALUE
+// lines, the empty lines and the comments beginning with "#". The errors do
+// not contain the lines, which may be the secrets.
+func readEnvFile(file string) (Env, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env_file: %s", err)
+	}
+	env := make(Env)
+	for i, line := range strings.Split(string(b), "\n") {
+		// the files may be edited on Windows
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		k := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || k == "" {
+			return nil, fmt.Errorf("failed to parse env_file %s: line %d is not KEY=VALUE", file, i+1)
+		}
+		env[k] = strings.TrimSpace(kv[1])
+	}
+	return env, nil
+}
+
 // Command represents an executable command.
 type Command struct {
 	cmdutil.CommandOption
 	Cmd  string
 	Args []string
+	// ID is the plugin of the command in the statistics of the executions,
+	// such as "checks.foo". The executions without it are not recorded.
+	ID string
+	// SlowThreshold is the duration of the execution beyond which it is warned
+	// as slow. Zero means never warned.
+	SlowThreshold time.Duration
 }
 
 // Run the Command.
 func (cmd *Command) Run() (stdout, stderr string, exitCode int, err error) {
-	if len(cmd.Args) > 0 {
-		return cmdutil.RunCommandArgs(cmd.Args, cmd.CommandOption)
-	}
-	return cmdutil.RunCommand(cmd.Cmd, cmd.CommandOption)
+	return cmd.exec(cmd.CommandOption)
 }
 
 // RunWithEnv runs the Command with Environment.
 func (cmd *Command) RunWithEnv(env []string) (stdout, stderr string, exitCode int, err error) {
-	opt := cmdutil.CommandOption{
-		TimeoutDuration: cmd.TimeoutDuration,
-		User:            cmd.User,
-		Env:             append(cmd.Env, env...),
+	return cmd.run(env, nil)
+}
+
+// StreamWithEnv runs the Command with Environment, writing stdout to w as it
+// is written by the command.
+func (cmd *Command) StreamWithEnv(env []string, w io.Writer) (stderr string, exitCode int, err error) {
+	_, stderr, exitCode, err = cmd.run(env, w)
+	return stderr, exitCode, err
+}
+
+func (cmd *Command) run(env []string, w io.Writer) (stdout, stderr string, exitCode int, err error) {
+	opt := cmd.CommandOption
+	// Copy cmd.Env not to share the underlying array between invocations.
+	opt.Env = make([]string, 0, len(cmd.Env)+len(env))
+	opt.Env = append(append(opt.Env, cmd.Env...), env...)
+	opt.Stdout = w
+	return cmd.exec(opt)
+}
+
+func (cmd *Command) exec(opt cmdutil.CommandOption) (stdout, stderr string, exitCode int, err error) {
+	start := time.Now()
+	if len(cmd.Args) > 0 {
+		stdout, stderr, exitCode, err = cmdutil.RunCommandArgs(cmd.Args, opt)
+	} else {
+		stdout, stderr, exitCode, err = cmdutil.RunCommand(cmd.Cmd, opt)
+	}
+	if cmd.ID != "" {
+		pluginstats.Record(cmd.ID, time.Since(start), exitCode, err, cmd.SlowThreshold)
 	}
+	return stdout, stderr, exitCode, err
+}
+
+// Verify checks that the executable of the command exists, and that the
+// interpreter of the script given by the shebang exists. The command given as
+// a string is run by the shell, which is verified only if its first word is a
+// path such as "/usr/local/bin/plugin --verbose".
+func (cmd *Command) Verify() error {
+	var name string
 	if len(cmd.Args) > 0 {
-		return cmdutil.RunCommandArgs(cmd.Args, opt)
+		name = cmd.Args[0]
+	} else if fields := strings.Fields(cmd.Cmd); len(fields) > 0 && strings.ContainsAny(fields[0], `/\`) && !strings.ContainsAny(fields[0], "\"'`$~=;&|<>(){}*?") {
+		name = fields[0]
+	} else {
+		return nil
+	}
+	file := name
+	// the relative paths such as "./plugin" are resolved in the working directory
+	if cmd.Dir != "" && !filepath.IsAbs(file) && strings.ContainsAny(file, `/\`) {
+		file = filepath.Join(cmd.Dir, file)
 	}
-	return cmdutil.RunCommand(cmd.Cmd, opt)
+	path, err := exec.LookPath(file)
+	if err != nil {
+		return fmt.Errorf("command %q is not executable: %s", name, err)
+	}
+	if err := verifyInterpreter(path); err != nil {
+		return fmt.Errorf("command %q is not executable: %s", name, err)
+	}
+	return nil
 }
 
 // CommandString returns the command string for log messages
@@ -204,13 +670,190 @@ func (cmd *Command) CommandString() string {
 // MetricPlugin represents the configuration of a metric plugin
 // The User option is ignored on Windows
 type MetricPlugin struct {
+	// Name is the name of the plugin, that is, foo of [plugin.metrics.foo].
+	Name             string
 	Command          Command
 	CustomIdentifier *string
 	IncludePattern   *regexp.Regexp
 	ExcludePattern   *regexp.Regexp
+	Splay            time.Duration
+	// Interval is the interval to collect the samples which are aggregated
+	// in PostMetricsInterval. Zero means to be collected once in it.
+	Interval    time.Duration
+	Aggregation Aggregation
+	// Protocol is the format of the output. PluginProtocolAuto detects it by the first line.
+	Protocol PluginProtocol
+	// InvalidMetricNames is how to treat the metric names with the characters
+	// other than alphanumerics, '.', '-' and '_'.
+	InvalidMetricNames InvalidMetricNames
+	// MaxMetricNames is the maximum number of the distinct metric names in an
+	// output, beyond which the values are dropped. Zero means no limit.
+	MaxMetricNames int
+	// TimestampWindow is the maximum difference of the timestamps in an
+	// output from the collection time, beyond which the values are dropped.
+	// Zero means the timestamps are not checked.
+	TimestampWindow time.Duration
+	// Service is the name of the service to post the values as the service
+	// metrics, named <MetricPrefix>.<name> or <name> without MetricPrefix,
+	// instead of the custom metrics of the host.
+	Service      string
+	MetricPrefix string
+	// OnEmpty is how to treat the executions which succeed without the values,
+	// and EmptyCycles is the number of the consecutive ones to warn.
+	OnEmpty     OnEmpty
+	EmptyCycles int
+	// Breaker backs off the executions failing consecutively by
+	// plugin_circuit_breaker_threshold, which is nil if disabled.
+	Breaker *pluginbreaker.Breaker
 }
 
-func (pconf *PluginConfig) buildMetricPlugin() (*MetricPlugin, error) {
+// OnEmpty is how to treat the executions of a metrics plugin which succeed
+// without the values.
+type OnEmpty string
+
+// The treatments of the executions without the values.
+const (
+	// OnEmptyIgnore posts nothing.
+	OnEmptyIgnore OnEmpty = "ignore"
+	// OnEmptyWarn logs and counts the failures every EmptyCycles consecutive
+	// executions without the values.
+	OnEmptyWarn OnEmpty = "warn"
+	// OnEmptyZero posts 0 for the names of the last output with the values.
+	OnEmptyZero OnEmpty = "zero"
+)
+
+// DefaultEmptyCycles is the default number of the consecutive executions of a
+// metrics plugin without the values to warn by on_empty = "warn".
+const DefaultEmptyCycles = 3
+
+// InvalidMetricNames is how to treat the invalid metric names of a metrics plugin.
+type InvalidMetricNames string
+
+// The treatments of the invalid metric names.
+const (
+	// InvalidMetricNamesReplace replaces the invalid characters with '_'.
+	InvalidMetricNamesReplace InvalidMetricNames = "replace"
+	// InvalidMetricNamesReject drops the values of the invalid names.
+	InvalidMetricNamesReject InvalidMetricNames = "reject"
+)
+
+// MetricNameCollision is how to treat the metric names generated by more than
+// one generator or plugin in a collection. The built-in generators precede
+// the plugins, which are in order of their names.
+type MetricNameCollision string
+
+// The treatments of the metric names collided.
+const (
+	// MetricNameCollisionFirstWins keeps the value of the first one.
+	MetricNameCollisionFirstWins MetricNameCollision = "first_wins"
+	// MetricNameCollisionLastWins keeps the value of the last one.
+	MetricNameCollisionLastWins MetricNameCollision = "last_wins"
+	// MetricNameCollisionPrefixPlugin renames the values of the metrics plugins
+	// after the first one to custom.<plugin name>.<name without custom.>.
+	MetricNameCollisionPrefixPlugin MetricNameCollision = "prefix_plugin"
+)
+
+// CounterWrap is how to treat the cumulative counters, such as the bytes of
+// the interfaces, decreased in the deltas.
+type CounterWrap string
+
+// The treatments of the counters decreased.
+const (
+	// CounterWrapAuto assumes that the counter of 32 or 64 bits, guessed by the
+	// previous value, wrapped around if the previous value was near the
+	// maximum, and skips the counter in the cycle otherwise.
+	CounterWrapAuto CounterWrap = "auto"
+	// CounterWrapDrop always skips the counter in the cycle.
+	CounterWrapDrop CounterWrap = "drop"
+)
+
+// WindowsCPUBackend is the source of the CPU usage on Windows.
+type WindowsCPUBackend string
+
+// The sources of the CPU usage on Windows.
+const (
+	// WindowsCPUBackendAuto uses the performance counters, and falls back to
+	// GetSystemTimes if they are not available, such as with the corrupted
+	// registry of the performance counters.
+	WindowsCPUBackendAuto WindowsCPUBackend = "auto"
+	// WindowsCPUBackendPDH always uses the performance counters.
+	WindowsCPUBackendPDH WindowsCPUBackend = "pdh"
+	// WindowsCPUBackendSystemTimes always uses GetSystemTimes.
+	WindowsCPUBackendSystemTimes WindowsCPUBackend = "system_times"
+)
+
+// DuplicateInstance is how to treat another agent posting as the same host,
+// such as on the cloned virtual machine sharing the host ID file.
+type DuplicateInstance string
+
+// The treatments of the duplicate agents.
+const (
+	// DuplicateInstanceWarn logs the error, and posts the self metric and the
+	// check report of the conflict.
+	DuplicateInstanceWarn DuplicateInstance = "warn"
+	// DuplicateInstanceStop also stops posting the metrics, the check reports
+	// and the host specs not to mix them with the other agent.
+	DuplicateInstanceStop DuplicateInstance = "stop"
+	// DuplicateInstanceIgnore never stores the token of the instance.
+	DuplicateInstanceIgnore DuplicateInstance = "ignore"
+)
+
+// OrphanPlugins is how to treat the processes of the plugins surviving the
+// previous agent, such as after a crash.
+type OrphanPlugins string
+
+// The treatments of the orphaned plugin processes.
+const (
+	// OrphanPluginsWarn only logs the processes.
+	OrphanPluginsWarn OrphanPlugins = "warn"
+	// OrphanPluginsTerminate logs and terminates the processes with their
+	// process groups.
+	OrphanPluginsTerminate OrphanPlugins = "terminate"
+)
+
+// DefaultMaxMetricNames is the default maximum number of the distinct metric
+// names in an output of a metrics plugin.
+const DefaultMaxMetricNames = 3000
+
+// DefaultTimestampWindow is the default maximum difference of the timestamps
+// in an output of a metrics plugin from the collection time.
+const DefaultTimestampWindow = time.Hour
+
+// DefaultStatusFilePerm is the default permission of the status file, which
+// is readable by the monitoring agents running as the other users.
+const DefaultStatusFilePerm os.FileMode = 0644
+
+// minPostMetricsMaxBytes is the minimum of post_metrics_max_bytes, which
+// leaves the room for a metric value with a long name.
+const minPostMetricsMaxBytes = 4 * 1024
+
+// PluginProtocol is the format of the output of a metrics plugin.
+type PluginProtocol string
+
+// The protocols of the metrics plugins.
+const (
+	// PluginProtocolAuto is the text protocol unless the output starts with
+	// the headline of the JSON lines protocol.
+	PluginProtocolAuto PluginProtocol = ""
+	// PluginProtocolText is the lines of "name\tvalue\ttimestamp".
+	PluginProtocolText PluginProtocol = "text"
+	// PluginProtocolJSONL is the lines of JSON objects such as
+	// {"name":"name","value":1.2,"time":1690000000}.
+	PluginProtocolJSONL PluginProtocol = "jsonl"
+)
+
+// Aggregation is the method to aggregate the samples of a metrics plugin.
+type Aggregation string
+
+// The methods of the aggregation.
+const (
+	// AggregationGauge aggregates the values to the average.
+	AggregationGauge Aggregation = "gauge"
+	// AggregationCounter aggregates the values, which are the increments in the intervals, to the sum.
+	AggregationCounter Aggregation = "counter"
+)
+
+func (pconf *PluginConfig) buildMetricPlugin(name string) (*MetricPlugin, error) {
 	cmd, err := pconf.CommandConfig.parse()
 	if err != nil {
 		return nil, err
@@ -236,14 +879,130 @@ func (pconf *PluginConfig) buildMetricPlugin() (*MetricPlugin, error) {
 		}
 	}
 
+	splay, err := pconf.splay("metrics."+name, PostMetricsInterval, cmd.Timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	var interval time.Duration
+	if pconf.IntervalSeconds != nil {
+		interval = time.Duration(*pconf.IntervalSeconds) * time.Second
+		if interval <= 0 || interval >= PostMetricsInterval {
+			return nil, fmt.Errorf("interval_seconds should be positive and less than %d", int(PostMetricsInterval.Seconds()))
+		}
+	}
+	aggregation := Aggregation(pconf.Aggregation)
+	switch aggregation {
+	case "":
+		aggregation = AggregationGauge
+	case AggregationGauge, AggregationCounter:
+	default:
+		return nil, fmt.Errorf("aggregation should be %q or %q but got %q", AggregationGauge, AggregationCounter, pconf.Aggregation)
+	}
+	protocol := PluginProtocol(pconf.Protocol)
+	switch protocol {
+	case PluginProtocolAuto, PluginProtocolText, PluginProtocolJSONL:
+	default:
+		return nil, fmt.Errorf("protocol should be %q or %q but got %q", PluginProtocolText, PluginProtocolJSONL, pconf.Protocol)
+	}
+	invalidNames := InvalidMetricNames(pconf.InvalidMetricNames)
+	switch invalidNames {
+	case "":
+		invalidNames = InvalidMetricNamesReplace
+	case InvalidMetricNamesReplace, InvalidMetricNamesReject:
+	default:
+		return nil, fmt.Errorf("invalid_metric_names should be %q or %q but got %q", InvalidMetricNamesReplace, InvalidMetricNamesReject, pconf.InvalidMetricNames)
+	}
+	maxNames := DefaultMaxMetricNames
+	if pconf.MaxMetricNames != nil {
+		if *pconf.MaxMetricNames <= 0 {
+			return nil, fmt.Errorf("max_metric_names should be positive, but %d", *pconf.MaxMetricNames)
+		}
+		maxNames = int(*pconf.MaxMetricNames)
+	}
+	timestampWindow := DefaultTimestampWindow
+	if pconf.TimestampWindow != nil {
+		if pconf.TimestampWindow.Duration < 0 {
+			return nil, fmt.Errorf("timestamp_window should not be negative, but %s", pconf.TimestampWindow.Duration)
+		}
+		timestampWindow = pconf.TimestampWindow.Duration
+	}
+	onEmpty := OnEmpty(pconf.OnEmpty)
+	switch onEmpty {
+	case "":
+		onEmpty = OnEmptyIgnore
+	case OnEmptyIgnore, OnEmptyWarn, OnEmptyZero:
+	default:
+		return nil, fmt.Errorf("on_empty should be %q, %q or %q but got %q", OnEmptyIgnore, OnEmptyWarn, OnEmptyZero, pconf.OnEmpty)
+	}
+	emptyCycles := DefaultEmptyCycles
+	if pconf.EmptyCycles != nil {
+		if onEmpty != OnEmptyWarn {
+			return nil, fmt.Errorf("empty_cycles should be specified with on_empty = %q", OnEmptyWarn)
+		}
+		if *pconf.EmptyCycles <= 0 {
+			return nil, fmt.Errorf("empty_cycles should be positive, but %d", *pconf.EmptyCycles)
+		}
+		emptyCycles = int(*pconf.EmptyCycles)
+	}
+	if pconf.Service != "" {
+		if pconf.CustomIdentifier != nil {
+			return nil, fmt.Errorf("service and custom_identifier should not be specified together")
+		}
+		// the service metrics are posted every minute without the delays
+		if splay > 0 {
+			return nil, fmt.Errorf("splay_seconds should not be specified with service")
+		}
+	} else if pconf.MetricPrefix != "" {
+		return nil, fmt.Errorf("metric_prefix should be specified with service")
+	}
+
 	return &MetricPlugin{
-		Command:          *cmd,
-		CustomIdentifier: pconf.CustomIdentifier,
-		IncludePattern:   includePattern,
-		ExcludePattern:   excludePattern,
+		Name:               name,
+		Command:            *cmd,
+		CustomIdentifier:   pconf.CustomIdentifier,
+		IncludePattern:     includePattern,
+		ExcludePattern:     excludePattern,
+		Splay:              splay,
+		Interval:           interval,
+		Aggregation:        aggregation,
+		Protocol:           protocol,
+		InvalidMetricNames: invalidNames,
+		MaxMetricNames:     maxNames,
+		TimestampWindow:    timestampWindow,
+		Service:            pconf.Service,
+		MetricPrefix:       strings.TrimSuffix(pconf.MetricPrefix, "."),
+		OnEmpty:            onEmpty,
+		EmptyCycles:        emptyCycles,
 	}, nil
 }
 
+// splay returns the delay of the execution of the plugin within its interval.
+// The delay is in [0, splay_seconds) and deterministic by the hostname and
+// the plugin key, so the executions of the same plugin are spread across
+// the hosts but stable on each host.
+//
+// The command is killed after its timeout elapsed since the delayed start,
+// so the execution may continue until the next cycle if the sum of the splay
+// and the timeout exceeds the interval. We warn the case here because such
+// overlapping executions are not detected otherwise.
+func (pconf *PluginConfig) splay(key string, interval, timeout time.Duration) (time.Duration, error) {
+	if pconf.SplaySeconds == nil || *pconf.SplaySeconds == 0 {
+		return 0, nil
+	}
+	window := time.Duration(*pconf.SplaySeconds) * time.Second
+	if window < 0 || window >= interval {
+		return 0, fmt.Errorf("splay_seconds should be in the range of 0 to %d, but %d", int(interval.Seconds())-1, *pconf.SplaySeconds)
+	}
+	if window+timeout >= interval {
+		configLogger.Warningf("'plugin.%s': the sum of splay_seconds (%s) and timeout (%s) exceeds the interval (%s), so the execution may overlap the next one", key, window, timeout, interval)
+	}
+	hostname, _ := os.Hostname()
+	h := fnv.New32a()
+	io.WriteString(h, hostname+"\x00"+key)
+	return time.Duration(h.Sum32()%uint32(window.Seconds())) * time.Second, nil
+}
+
 // CheckPlugin represents the configuration of a check plugin
 // The User option is ignored on Windows
 type CheckPlugin struct {
@@ -253,8 +1012,226 @@ type CheckPlugin struct {
 	CheckInterval         *int32
 	MaxCheckAttempts      *int32
 	PreventAlertAutoClose bool
-	Action                *Command
+	Action                *CheckAction
 	Memo                  string
+	MaxOutputBytes        *int32
+	Splay                 time.Duration
+	// Format is the format of the output of the command.
+	Format string
+	// ReportPerfdata reports the performance data of CheckFormatNagios as the metrics.
+	ReportPerfdata bool
+	// ReportItemsAsMetrics reports the statuses of the items of CheckFormatJSON
+	// as the metrics, 1 for OK and 0 for the others.
+	ReportItemsAsMetrics bool
+	// Suppress are the windows where the reports are suppressed by SuppressMode.
+	Suppress     []*SuppressWindow
+	SuppressMode string
+	// Breaker backs off the executions of the command failing consecutively
+	// by plugin_circuit_breaker_threshold, which is nil if disabled.
+	Breaker *pluginbreaker.Breaker
+
+	// Type is the type of built-in check, or CheckTypeCommand.
+	Type     string
+	EventLog *EventLogCheck
+	HTTP     *HTTPCheck
+	TCP      *TCPCheck
+	File     *FileCheck
+	Log      *LogCheck
+	Cert     *CertCheck
+	ReadOnly *ReadOnlyCheck
+}
+
+// ResolveBindAddress returns the IP address of bind_address, which is an IP
+// address assigned to the host or the name of a network interface. The address
+// of the interface is the first IPv4 one, or the first global IPv6 one if it
+// has no IPv4 addresses. It returns nil for the empty bind_address.
+func ResolveBindAddress(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the addresses of the host for bind_address: %s", err)
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("bind_address %s is not assigned to any network interfaces of the host", s)
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("bind_address should be an IP address or the name of a network interface, but %q: %s", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of %s for bind_address: %s", s, err)
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if v4 := n.IP.To4(); v4 != nil {
+			return v4, nil
+		}
+		if v6 == nil && n.IP.IsGlobalUnicast() {
+			v6 = n.IP
+		}
+	}
+	if v6 == nil {
+		return nil, fmt.Errorf("the network interface %s of bind_address has no addresses", s)
+	}
+	return v6, nil
+}
+
+// ProxySystem is the proxy resolved by the system settings, such as the PAC
+// files and the WinHTTP settings of Windows.
+const ProxySystem = "system"
+
+// Formats of the logs of the agent. In LogFormatJSON, each log is a JSON object
+// in a line. The Windows service relies on the levels of LogFormatText.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogComponents are the components of log_levels, which are the prefixes of
+// the tags of the loggers.
+var LogComponents = []string{"api", "spec", "metrics", "checks", "config", "command"}
+
+// LogLevels are the levels of log_levels.
+var LogLevels = []string{"trace", "debug", "info", "warning", "error", "critical"}
+
+func (conf *Config) validateLogLevels() error {
+	for c, lv := range conf.LogLevels {
+		if !containsString(LogComponents, c) {
+			return fmt.Errorf("unknown component of log_levels: %q (should be one of %s)", c, strings.Join(LogComponents, ", "))
+		}
+		if !containsString(LogLevels, strings.ToLower(lv)) {
+			return fmt.Errorf("unknown level of log_levels.%s: %q (should be one of %s)", c, lv, strings.Join(LogLevels, ", "))
+		}
+	}
+	return nil
+}
+
+// Outputs of the logs instead of stderr. LogOutputSyslog is not supported on
+// Windows, and LogOutputEventLog is supported only on Windows.
+const (
+	LogOutputSyslog   = "syslog"
+	LogOutputEventLog = "eventlog"
+)
+
+// DefaultSyslogFacility is the facility of the logs sent to syslog.
+const DefaultSyslogFacility = "daemon"
+
+// SyslogFacilities are the names of syslog_facility.
+var SyslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// SyslogNetwork returns the network and the address of syslog_address, which
+// is "" for the local syslog.
+func (conf *Config) SyslogNetwork() (string, string, error) {
+	if conf.SyslogAddress == "" {
+		return "", "", nil
+	}
+	u, err := url.Parse(conf.SyslogAddress)
+	if err != nil {
+		return "", "", err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return "", "", fmt.Errorf("syslog_address should be udp://host:port or tcp://host:port, but %q", conf.SyslogAddress)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+func (conf *Config) validateLogOutput() error {
+	if conf.LogOutput != LogOutputSyslog && (conf.SyslogFacility != "" || conf.SyslogAddress != "") {
+		return fmt.Errorf("syslog_facility and syslog_address require log_output = %q", LogOutputSyslog)
+	}
+	switch conf.LogOutput {
+	case "":
+		return nil
+	case LogOutputSyslog:
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("log_output = %q is not supported on windows", LogOutputSyslog)
+		}
+	case LogOutputEventLog:
+		if runtime.GOOS != "windows" {
+			return fmt.Errorf("log_output = %q is supported only on windows", LogOutputEventLog)
+		}
+	default:
+		return fmt.Errorf("log_output should be %q or %q, but %q", LogOutputSyslog, LogOutputEventLog, conf.LogOutput)
+	}
+	if conf.LogFile != "" {
+		return fmt.Errorf("log_file can not be used with log_output = %q", conf.LogOutput)
+	}
+	if conf.LogOutput != LogOutputSyslog {
+		return nil
+	}
+	if conf.SyslogFacility == "" {
+		conf.SyslogFacility = DefaultSyslogFacility
+	}
+	if !containsString(SyslogFacilities, conf.SyslogFacility) {
+		return fmt.Errorf("unknown syslog_facility: %q", conf.SyslogFacility)
+	}
+	_, _, err := conf.SyslogNetwork()
+	return err
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats of the output of the check plugins. In CheckFormatNagios, the
+// performance data after "|" is stripped from the message. In CheckFormatJSON,
+// the status and the message are the ones of the JSON object of the output
+// instead of the exit code.
+const (
+	CheckFormatDefault = ""
+	CheckFormatNagios  = "nagios"
+	CheckFormatJSON    = "json"
+)
+
+const defaultCheckInterval = 1 * time.Minute
+
+// checkInterval converts check_interval in minutes to the interval,
+// which is rounded between 1 and 60 minutes.
+func checkInterval(minutes *int32) time.Duration {
+	if minutes == nil {
+		return defaultCheckInterval
+	}
+	interval := time.Duration(*minutes) * time.Minute
+	if interval < 1*time.Minute {
+		interval = 1 * time.Minute
+	} else if interval > 60*time.Minute {
+		interval = 60 * time.Minute
+	}
+	return interval
+}
+
+// Interval is the interval where the command is invoked.
+func (pconf *CheckPlugin) Interval() time.Duration {
+	return checkInterval(pconf.CheckInterval)
+}
+
+// CheckAction represents the action command of a check plugin,
+// which is invoked when the status of the check changes.
+// MaxTriggerPerHour limits the number of invocations in the last hour
+// (zero means unlimited), which is DefaultActionMaxTriggerPerHour by default.
+type CheckAction struct {
+	Command
+	MaxTriggerPerHour int
 }
 
 func (pconf *PluginConfig) buildCheckPlugin(name string) (*CheckPlugin, error) {
@@ -263,7 +1240,11 @@ func (pconf *PluginConfig) buildCheckPlugin(name string) (*CheckPlugin, error) {
 		return nil, err
 	}
 	if cmd == nil {
-		return nil, fmt.Errorf("failed to parse plugin command. A configuration value of `command` should be string or string slice, but %T", pconf.Raw)
+		if pconf.Type == CheckTypeCommand {
+			return nil, fmt.Errorf("failed to parse plugin command. A configuration value of `command` should be string or string slice, but %T", pconf.Raw)
+		}
+		// built-in checks don't need any commands
+		cmd = &Command{}
 	}
 
 	action, err := pconf.Action.parse()
@@ -285,6 +1266,15 @@ func (pconf *PluginConfig) buildCheckPlugin(name string) (*CheckPlugin, error) {
 		pconf.Memo = pconf.Memo[:n]
 	}
 
+	if pconf.MaxOutputBytes != nil && *pconf.MaxOutputBytes <= 0 {
+		return nil, fmt.Errorf("max_output_bytes should be positive, but %d", *pconf.MaxOutputBytes)
+	}
+
+	splay, err := pconf.splay("checks."+name, checkInterval(pconf.CheckInterval), cmd.Timeout())
+	if err != nil {
+		return nil, err
+	}
+
 	plugin := CheckPlugin{
 		Command:               *cmd,
 		CustomIdentifier:      pconf.CustomIdentifier,
@@ -294,6 +1284,37 @@ func (pconf *PluginConfig) buildCheckPlugin(name string) (*CheckPlugin, error) {
 		PreventAlertAutoClose: pconf.PreventAlertAutoClose,
 		Action:                action,
 		Memo:                  pconf.Memo,
+		MaxOutputBytes:        pconf.MaxOutputBytes,
+		Splay:                 splay,
+		Format:                pconf.Format,
+		ReportPerfdata:        pconf.ReportPerfdata,
+		ReportItemsAsMetrics:  pconf.ReportItemsAsMetrics,
+		Type:                  pconf.Type,
+	}
+	switch plugin.Format {
+	case CheckFormatDefault:
+	case CheckFormatNagios, CheckFormatJSON:
+		if plugin.Type != CheckTypeCommand {
+			return nil, fmt.Errorf("format is available only for the commands")
+		}
+	default:
+		return nil, fmt.Errorf("format should be %q or %q, but %q", CheckFormatNagios, CheckFormatJSON, plugin.Format)
+	}
+	if plugin.ReportPerfdata && plugin.Format != CheckFormatNagios {
+		return nil, fmt.Errorf("report_perfdata requires format = %q", CheckFormatNagios)
+	}
+	if plugin.ReportItemsAsMetrics && plugin.Format != CheckFormatJSON {
+		return nil, fmt.Errorf("report_items_as_metrics requires format = %q", CheckFormatJSON)
+	}
+	if plugin.Suppress, err = buildSuppressWindows(pconf.Suppress); err != nil {
+		return nil, err
+	}
+	if err := validateSuppressMode(pconf.SuppressMode); err != nil {
+		return nil, err
+	}
+	plugin.SuppressMode = pconf.SuppressMode
+	if err := pconf.buildBuiltinCheck(&plugin); err != nil {
+		return nil, err
 	}
 	if plugin.MaxCheckAttempts != nil && *plugin.MaxCheckAttempts > 1 && plugin.PreventAlertAutoClose {
 		*plugin.MaxCheckAttempts = 1
@@ -307,6 +1328,71 @@ func (pconf *PluginConfig) buildCheckPlugin(name string) (*CheckPlugin, error) {
 type MetadataPlugin struct {
 	Command           Command
 	ExecutionInterval *int32
+
+	// Type is the type of built-in metadata, or MetadataTypeCommand.
+	Type string
+	// File and Format are the path and the format of the file of MetadataTypeFile.
+	File   string
+	Format string
+	// IncludePattern and ExcludePattern filter the names of the services of MetadataTypeWindowsServices.
+	IncludePattern *regexp.Regexp
+	ExcludePattern *regexp.Regexp
+	// MaxTotalBytes is the maximum size of the metadata, which is split into
+	// the chunks beyond the limit of a namespace. Zero means it is not split.
+	MaxTotalBytes int
+}
+
+const defaultMetadataExecutionInterval = 10 * time.Minute
+
+// Interval is the interval where the metadata is generated, which is at least
+// 10 minutes.
+func (pconf *MetadataPlugin) Interval() time.Duration {
+	if pconf.ExecutionInterval == nil {
+		return defaultMetadataExecutionInterval
+	}
+	interval := time.Duration(*pconf.ExecutionInterval) * time.Minute
+	if interval < defaultMetadataExecutionInterval {
+		return defaultMetadataExecutionInterval
+	}
+	return interval
+}
+
+// Types of metadata plugins, which are specified by `type` in the configuration.
+// MetadataTypeCommand (the default) runs the command of the plugin
+// and the others are the built-in metadata collected by the agent.
+const (
+	MetadataTypeCommand  = ""
+	MetadataTypePackages = "packages"
+	MetadataTypeFile     = "file"
+	// MetadataTypeWindowsServices also makes the agent post the number of
+	// the automatic services which are not running.
+	MetadataTypeWindowsServices = "windows_services"
+)
+
+// Formats of the file of MetadataTypeFile
+const (
+	MetadataFormatText = "text"
+	MetadataFormatJSON = "json"
+)
+
+// DefaultActionMaxTriggerPerHour is the default limit of the invocations of
+// the action of a check in the last hour, so that a flapping check does not
+// restart the service every interval.
+const DefaultActionMaxTriggerPerHour = 6
+
+func (ac ActionConfig) parse() (*CheckAction, error) {
+	cmd, err := ac.CommandConfig.parse()
+	if err != nil || cmd == nil {
+		return nil, err
+	}
+	action := CheckAction{Command: *cmd, MaxTriggerPerHour: DefaultActionMaxTriggerPerHour}
+	if ac.MaxTriggerPerHour != nil {
+		if *ac.MaxTriggerPerHour < 0 {
+			return nil, fmt.Errorf("max_trigger_per_hour of the action should be zero or positive, but %d", *ac.MaxTriggerPerHour)
+		}
+		action.MaxTriggerPerHour = int(*ac.MaxTriggerPerHour)
+	}
+	return &action, nil
 }
 
 func (pconf *PluginConfig) buildMetadataPlugin() (*MetadataPlugin, error) {
@@ -314,13 +1400,77 @@ func (pconf *PluginConfig) buildMetadataPlugin() (*MetadataPlugin, error) {
 	if err != nil {
 		return nil, err
 	}
-	if cmd == nil {
-		return nil, fmt.Errorf("failed to parse plugin command. A configuration value of `command` should be string or string slice, but %T", pconf.Raw)
+	typ, format := pconf.Type, pconf.Format
+	var includePattern, excludePattern *regexp.Regexp
+	if typ == MetadataTypeCommand && pconf.File != "" {
+		typ = MetadataTypeFile
+	}
+	switch typ {
+	case MetadataTypeCommand:
+		if cmd == nil {
+			return nil, fmt.Errorf("failed to parse plugin command. A configuration value of `command` should be string or string slice, but %T", pconf.Raw)
+		}
+	case MetadataTypePackages:
+		if cmd != nil {
+			return nil, fmt.Errorf("command cannot be specified for the metadata type %q", typ)
+		}
+		cmd = &Command{}
+	case MetadataTypeFile:
+		if cmd != nil {
+			return nil, fmt.Errorf("command cannot be specified for the metadata type %q", typ)
+		}
+		if pconf.File == "" {
+			return nil, fmt.Errorf("file is required for the metadata type %q", typ)
+		}
+		cmd = &Command{}
+		if format == "" {
+			format = MetadataFormatText
+		}
+		if format != MetadataFormatText && format != MetadataFormatJSON {
+			return nil, fmt.Errorf("format should be %q or %q, but %q", MetadataFormatText, MetadataFormatJSON, format)
+		}
+	case MetadataTypeWindowsServices:
+		if runtime.GOOS != "windows" {
+			return nil, fmt.Errorf("the metadata type %q is supported only on Windows", typ)
+		}
+		if cmd != nil {
+			return nil, fmt.Errorf("command cannot be specified for the metadata type %q", typ)
+		}
+		cmd = &Command{}
+		if pconf.IncludePattern != nil {
+			if includePattern, err = regexp.Compile(*pconf.IncludePattern); err != nil {
+				return nil, err
+			}
+		}
+		if pconf.ExcludePattern != nil {
+			if excludePattern, err = regexp.Compile(*pconf.ExcludePattern); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown metadata type: %q", pconf.Type)
+	}
+
+	if pconf.ExecutionInterval != nil && *pconf.ExecutionInterval <= 0 {
+		return nil, fmt.Errorf("execution_interval should be positive (in minutes), but %d", *pconf.ExecutionInterval)
+	}
+	var maxTotalBytes int
+	if pconf.MaxTotalBytes != nil {
+		if *pconf.MaxTotalBytes <= 0 {
+			return nil, fmt.Errorf("max_total_bytes should be positive, but %d", *pconf.MaxTotalBytes)
+		}
+		maxTotalBytes = int(*pconf.MaxTotalBytes)
 	}
 
 	return &MetadataPlugin{
 		Command:           *cmd,
 		ExecutionInterval: pconf.ExecutionInterval,
+		Type:              typ,
+		File:              pconf.File,
+		Format:            format,
+		IncludePattern:    includePattern,
+		ExcludePattern:    excludePattern,
+		MaxTotalBytes:     maxTotalBytes,
 	}, nil
 }
 
@@ -351,10 +1501,30 @@ func (cc CommandConfig) parse() (cmd *Command, err error) {
 		return nil, fmt.Errorf(errFmt, cc.Raw)
 	}
 	cmd.User = cc.User
-	cmd.Env, err = cc.Env.ConvertToStrings()
+	env := cc.Env
+	if cc.EnvFile != "" {
+		env, err = readEnvFile(cc.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range cc.Env {
+			env[k] = v
+		}
+	}
+	cmd.Env, err = env.ConvertToStrings()
 	if err != nil {
 		return nil, err
 	}
+	if cc.Cwd != "" {
+		fi, err := os.Stat(cc.Cwd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the working directory %q: %s", cc.Cwd, err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("the working directory %q is not a directory", cc.Cwd)
+		}
+		cmd.Dir = cc.Cwd
+	}
 	cmd.TimeoutDuration = time.Duration(cc.TimeoutSeconds * int64(time.Second))
 	return cmd, nil
 }
@@ -368,23 +1538,601 @@ type HostStatus struct {
 	OnStop  string `toml:"on_stop"`
 }
 
-// Filesystems configure filesystem related settings
-type Filesystems struct {
-	Ignore        Regexpwrapper `toml:"ignore"`
-	UseMountpoint bool          `toml:"use_mountpoint"`
+// AutoRetirement configures retiring the host at exit. The host is retired only
+// when the trigger is given by the command line option -at-exit, so that the
+// host is not retired by the ordinary restarts.
+type AutoRetirement struct {
+	Enable bool `toml:"enable"`
+	// Timeout is the maximum duration to retire the host.
+	Timeout *Duration `toml:"timeout"`
 }
 
-// Regexpwrapper is a wrapper type for marshalling string
-type Regexpwrapper struct {
-	*regexp.Regexp
+// Supervisor configures the restarts of the agent crashed in the supervise
+// mode. The supervisor gives up restarting the agent crashed more than
+// MaxRestarts times in RestartInterval, and the restarts are delayed by
+// RestartBackoff doubled by each restart up to MaxRestartBackoff.
+type Supervisor struct {
+	MaxRestarts       *int32    `toml:"max_restarts"`
+	RestartInterval   *Duration `toml:"restart_interval"`
+	RestartBackoff    *Duration `toml:"restart_backoff"`
+	MaxRestartBackoff *Duration `toml:"max_restart_backoff"`
 }
 
-// UnmarshalText for compiling regexp string while loading toml
-func (r *Regexpwrapper) UnmarshalText(text []byte) error {
-	var err error
-	r.Regexp, err = regexp.Compile(string(text))
-	return err
-}
+func (s *Supervisor) validate() error {
+	if s.MaxRestarts != nil && *s.MaxRestarts <= 0 {
+		return fmt.Errorf("supervisor.max_restarts should be positive")
+	}
+	for name, d := range map[string]*Duration{
+		"restart_interval":    s.RestartInterval,
+		"restart_backoff":     s.RestartBackoff,
+		"max_restart_backoff": s.MaxRestartBackoff,
+	} {
+		if d != nil && d.Duration <= 0 {
+			return fmt.Errorf("supervisor.%s should be positive", name)
+		}
+	}
+	return nil
+}
+
+// Secondary configures the secondary destination of the posts. The host is
+// registered to it separately, and its host id is saved in the id file with
+// the suffix SecondaryIDFileSuffix.
+type Secondary struct {
+	Apikey  string `toml:"apikey"`
+	Apibase string `toml:"apibase"`
+}
+
+// SecondaryIDFileSuffix is the suffix of the id file of the host on the secondary.
+const SecondaryIDFileSuffix = ".secondary"
+
+// Statsd configures the statsd listener on UDP Listen, and on TCP ListenTCP
+// if specified. The counters, the gauges and the timers are aggregated in
+// PostMetricsInterval, with the Percentiles of the timers.
+// The metrics of the new names over MaxNames are dropped, and the gauges not
+// updated in GaugeTTL are dropped. Zero GaugeTTL keeps the gauges forever.
+type Statsd struct {
+	Listen      string    `toml:"listen"`
+	ListenTCP   string    `toml:"listen_tcp"`
+	Percentiles []float64 `toml:"percentiles"`
+	MaxNames    int       `toml:"max_names"`
+	GaugeTTL    *Duration `toml:"gauge_ttl"`
+}
+
+// The default values of Statsd.
+var (
+	DefaultStatsdPercentiles = []float64{50, 90, 99}
+	DefaultStatsdMaxNames    = 1000
+	DefaultStatsdGaugeTTL    = 10 * time.Minute
+)
+
+func (c *Statsd) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("statsd.listen should be specified")
+	}
+	if c.Percentiles == nil {
+		c.Percentiles = DefaultStatsdPercentiles
+	}
+	for _, p := range c.Percentiles {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("statsd.percentiles should be between 0 and 100, but %v", p)
+		}
+	}
+	if c.MaxNames < 0 {
+		return fmt.Errorf("statsd.max_names should not be negative")
+	}
+	if c.MaxNames == 0 {
+		c.MaxNames = DefaultStatsdMaxNames
+	}
+	if c.GaugeTTL == nil {
+		c.GaugeTTL = &Duration{DefaultStatsdGaugeTTL}
+	}
+	if c.GaugeTTL.Duration < 0 {
+		return fmt.Errorf("statsd.gauge_ttl should not be negative, but %s", c.GaugeTTL.Duration)
+	}
+	return nil
+}
+
+// OTLP configures exporting the metrics to an OpenTelemetry collector,
+// independently of posting them to Mackerel. The metrics whose names match
+// SumPattern are exported as the delta sums, and the others as the gauges.
+type OTLP struct {
+	Endpoint string `toml:"endpoint"`
+	// Protocol is OTLPProtocolHTTP, the OTLP/HTTP with the JSON encoding.
+	// The OTLP/gRPC is not supported, which requires HTTP/2 without TLS for
+	// the local collectors. They listen to the OTLP/HTTP on 4318 by default.
+	Protocol           string            `toml:"protocol"`
+	Headers            map[string]string `toml:"headers"`
+	CAFile             string            `toml:"ca_file"`
+	CertFile           string            `toml:"cert_file"`
+	KeyFile            string            `toml:"key_file"`
+	InsecureSkipVerify bool              `toml:"insecure_skip_verify"`
+	SumPattern         string            `toml:"sum_pattern"`
+	// QueueSize is the number of the collections kept while the collector is unavailable.
+	QueueSize int `toml:"queue_size"`
+}
+
+// OTLPProtocolHTTP is the protocol of OTLP supported by the agent.
+const OTLPProtocolHTTP = "http"
+
+// DefaultOTLPQueueSize keeps the metrics of an hour.
+const DefaultOTLPQueueSize = 60
+
+func (c *OTLP) validate() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("otlp.endpoint should be specified")
+	}
+	switch c.Protocol {
+	case "", OTLPProtocolHTTP:
+		c.Protocol = OTLPProtocolHTTP
+	case "grpc":
+		return fmt.Errorf("otlp.protocol %q is not supported, use %q with the OTLP/HTTP endpoint of the collector (localhost:4318 by default)", c.Protocol, OTLPProtocolHTTP)
+	default:
+		return fmt.Errorf("otlp.protocol %q is unknown", c.Protocol)
+	}
+	endpoint := c.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("otlp.endpoint is invalid: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("otlp.endpoint should be an http or https URL: %s", c.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	c.Endpoint = u.String()
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("otlp.cert_file and otlp.key_file should be specified together")
+	}
+	if _, err := regexp.Compile(c.SumPattern); err != nil {
+		return fmt.Errorf("otlp.sum_pattern is invalid: %v", err)
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("otlp.queue_size should not be negative")
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = DefaultOTLPQueueSize
+	}
+	return nil
+}
+
+// Fluentd configures forwarding the metrics to fluentd or Fluent Bit by the
+// forward protocol with the tags of <Tag>.<metric family>.
+type Fluentd struct {
+	Host string `toml:"host"`
+	Port int    `toml:"port"`
+	Tag  string `toml:"tag"`
+	// QueueSize is the number of the collections kept while forwarding.
+	QueueSize int `toml:"queue_size"`
+}
+
+// The default values of Fluentd.
+const (
+	DefaultFluentdHost      = "127.0.0.1"
+	DefaultFluentdPort      = 24224
+	DefaultFluentdTag       = "mackerel"
+	DefaultFluentdQueueSize = 10
+)
+
+func (c *Fluentd) validate() error {
+	if c.Host == "" {
+		c.Host = DefaultFluentdHost
+	}
+	if c.Port == 0 {
+		c.Port = DefaultFluentdPort
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("fluentd.port should be a port number, but %d", c.Port)
+	}
+	if c.Tag == "" {
+		c.Tag = DefaultFluentdTag
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("fluentd.queue_size should not be negative")
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = DefaultFluentdQueueSize
+	}
+	return nil
+}
+
+// HTTPPush configures the HTTP endpoint accepting the custom metrics by
+// POST /metrics, which are posted with the metrics of the host.
+type HTTPPush struct {
+	Listen string `toml:"listen"`
+	// AllowRemote allows to listen on the addresses other than loopback.
+	AllowRemote bool `toml:"allow_remote"`
+	// Auth and TLS protect the endpoint listening beyond loopback.
+	Auth *ListenerAuth `toml:"auth"`
+	TLS  *ListenerTLS  `toml:"tls"`
+}
+
+func (c *HTTPPush) validate() error {
+	if err := validateListen("http_push", c.Listen, c.AllowRemote); err != nil {
+		return err
+	}
+	return validateListenerSecurity("http_push", c.Auth, c.TLS)
+}
+
+// Debug configures the HTTP endpoint serving net/http/pprof and expvar
+// to diagnose the running agent.
+type Debug struct {
+	Listen string `toml:"listen"`
+	// AllowRemote allows to listen on the addresses other than loopback.
+	AllowRemote bool `toml:"allow_remote"`
+	// Auth and TLS protect the endpoint listening beyond loopback.
+	Auth *ListenerAuth `toml:"auth"`
+	TLS  *ListenerTLS  `toml:"tls"`
+
+	// HTTPTrace logs the requests to the API and their responses, whose API
+	// keys are redacted. The endpoint is not required to trace them.
+	HTTPTrace bool `toml:"http_trace"`
+	// HTTPTraceBodySize is the maximum size of the bodies logged by HTTPTrace.
+	// The bodies are not logged by default.
+	HTTPTraceBodySize int `toml:"http_trace_body_size"`
+}
+
+func (c *Debug) validate() error {
+	if c.HTTPTraceBodySize < 0 {
+		return fmt.Errorf("debug.http_trace_body_size should be positive, but %d", c.HTTPTraceBodySize)
+	}
+	if err := validateListenerSecurity("debug", c.Auth, c.TLS); err != nil {
+		return err
+	}
+	if c.Listen == "" && c.HTTPTrace {
+		return nil
+	}
+	return validateListen("debug", c.Listen, c.AllowRemote)
+}
+
+// APITimeouts are the deadlines of the requests to Mackerel by the payloads,
+// which are 30 seconds by default.
+type APITimeouts struct {
+	Checks    *Duration `toml:"checks"`
+	Metrics   *Duration `toml:"metrics"`
+	Metadata  *Duration `toml:"metadata"`
+	HostSpecs *Duration `toml:"host_specs"`
+	Others    *Duration `toml:"others"`
+}
+
+func (c *APITimeouts) validate() error {
+	for _, t := range []struct {
+		name string
+		d    *Duration
+	}{
+		{"checks", c.Checks},
+		{"metrics", c.Metrics},
+		{"metadata", c.Metadata},
+		{"host_specs", c.HostSpecs},
+		{"others", c.Others},
+	} {
+		if t.d != nil && t.d.Duration <= 0 {
+			return fmt.Errorf("api_timeouts.%s should be positive, but %s", t.name, t.d.Duration)
+		}
+	}
+	return nil
+}
+
+// Health configures the HTTP endpoint answering GET /healthz while the agent
+// is running, and GET /readyz while the metrics are posted successfully.
+type Health struct {
+	Listen string `toml:"listen"`
+	// AllowRemote allows to listen on the addresses other than loopback.
+	AllowRemote bool `toml:"allow_remote"`
+	// Auth and TLS protect the endpoint listening beyond loopback.
+	Auth *ListenerAuth `toml:"auth"`
+	TLS  *ListenerTLS  `toml:"tls"`
+	// MaxPostAge is the maximum age of the last successful post of the metrics
+	// to be ready.
+	MaxPostAge *Duration `toml:"max_post_age"`
+}
+
+func (c *Health) validate() error {
+	if err := validateListen("health", c.Listen, c.AllowRemote); err != nil {
+		return err
+	}
+	if err := validateListenerSecurity("health", c.Auth, c.TLS); err != nil {
+		return err
+	}
+	if c.MaxPostAge != nil && c.MaxPostAge.Duration < PostMetricsInterval {
+		return fmt.Errorf("health.max_post_age should be %d seconds at least, but %s", int(PostMetricsInterval.Seconds()), c.MaxPostAge.Duration)
+	}
+	return nil
+}
+
+// validateListen validates the address of the section to listen on, which
+// should be loopback unless allowRemote is true.
+func validateListen(section, listen string, allowRemote bool) error {
+	if listen == "" {
+		return fmt.Errorf("%s.listen is required", section)
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("%s.listen should be host:port, but %q", section, listen)
+	}
+	if allowRemote {
+		return nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s.listen should be a loopback address without allow_remote, but %q", section, listen)
+	}
+	return nil
+}
+
+// LifecycleAnnotation configures the graph annotations of the service and the
+// roles posted when the agent starts, stops and reloads the configuration, to
+// correlate the changes of the graphs with them.
+type LifecycleAnnotation struct {
+	Service string   `toml:"service"`
+	Roles   []string `toml:"roles"`
+	// MaxPerHour limits the annotations posted by the agent in an hour, not to
+	// flood the graphs by the agent restarted repeatedly.
+	MaxPerHour int `toml:"max_per_hour"`
+}
+
+// DefaultLifecycleAnnotationMaxPerHour allows a few restarts and reloads in an hour.
+const DefaultLifecycleAnnotationMaxPerHour = 6
+
+func (c *LifecycleAnnotation) validate() error {
+	if c.Service == "" {
+		return fmt.Errorf("lifecycle_annotation.service is required")
+	}
+	for _, role := range c.Roles {
+		if role == "" || strings.Contains(role, ":") {
+			return fmt.Errorf("lifecycle_annotation.roles should be the names of the roles of the service, but %q", role)
+		}
+	}
+	if c.MaxPerHour < 0 {
+		return fmt.Errorf("lifecycle_annotation.max_per_hour should not be negative")
+	}
+	if c.MaxPerHour == 0 {
+		c.MaxPerHour = DefaultLifecycleAnnotationMaxPerHour
+	}
+	return nil
+}
+
+// ListenerAuth authenticates the requests to a local HTTP endpoint by either
+// the static bearer token or the credentials of the basic authentication.
+type ListenerAuth struct {
+	BearerToken string `toml:"bearer_token"`
+	Username    string `toml:"username"`
+	Password    string `toml:"password"`
+}
+
+// ListenerTLS serves a local HTTP endpoint over TLS. The clients are required
+// to present the certificates signed by ClientCAFile if it is specified.
+type ListenerTLS struct {
+	CertFile     string `toml:"cert_file"`
+	KeyFile      string `toml:"key_file"`
+	ClientCAFile string `toml:"client_ca_file"`
+}
+
+// validateListenerSecurity validates the authentication and the TLS of the
+// local HTTP endpoint of the section.
+func validateListenerSecurity(section string, auth *ListenerAuth, tls *ListenerTLS) error {
+	if auth != nil {
+		basic := auth.Username != "" || auth.Password != ""
+		switch {
+		case auth.BearerToken != "" && basic:
+			return fmt.Errorf("%s.auth should have either bearer_token or username and password", section)
+		case auth.BearerToken == "" && !basic:
+			return fmt.Errorf("%s.auth should have bearer_token or username and password", section)
+		case basic && (auth.Username == "" || auth.Password == ""):
+			return fmt.Errorf("%s.auth.username and %s.auth.password should be specified together", section, section)
+		case basic && strings.Contains(auth.Username, ":"):
+			return fmt.Errorf("%s.auth.username should not contain a colon", section)
+		}
+	}
+	if tls != nil {
+		if tls.CertFile == "" || tls.KeyFile == "" {
+			return fmt.Errorf("%s.tls.cert_file and %s.tls.key_file are required", section, section)
+		}
+	}
+	return nil
+}
+
+// Kubernetes configure the names of the environment variables
+// which are set by the Downward API of Kubernetes
+type Kubernetes struct {
+	NodeNameEnv     string `toml:"node_name_env"`
+	PodNameEnv      string `toml:"pod_name_env"`
+	PodNamespaceEnv string `toml:"pod_namespace_env"`
+}
+
+// CloudProviderEC2Compatible is the provider of the metadata services
+// which are compatible with the instance metadata service of EC2.
+const CloudProviderEC2Compatible = "ec2-compatible"
+
+// Cloud configure the metadata service of the cloud platform which is
+// not detected automatically, such as a private cloud.
+type Cloud struct {
+	// MetadataEndpoint is the base URL of the metadata service, e.g. "http://10.0.0.1:8080".
+	MetadataEndpoint string            `toml:"metadata_endpoint"`
+	Provider         string            `toml:"provider"`
+	Timeout          *Duration         `toml:"timeout"`
+	Headers          map[string]string `toml:"headers"`
+}
+
+func (c *Cloud) validate() error {
+	if c.MetadataEndpoint == "" {
+		if c.Provider != "" {
+			return fmt.Errorf("cloud.provider is specified without cloud.metadata_endpoint")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.MetadataEndpoint)
+	if err != nil {
+		return fmt.Errorf("cloud.metadata_endpoint is invalid: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("cloud.metadata_endpoint should be an http or https URL: %s", c.MetadataEndpoint)
+	}
+	switch c.Provider {
+	case "":
+		c.Provider = CloudProviderEC2Compatible
+	case CloudProviderEC2Compatible:
+	default:
+		return fmt.Errorf("cloud.provider %q is not supported", c.Provider)
+	}
+	if c.Timeout != nil && c.Timeout.Duration <= 0 {
+		return fmt.Errorf("cloud.timeout should be positive")
+	}
+	return nil
+}
+
+// Filesystems configure filesystem related settings
+type Filesystems struct {
+	Ignore        Regexpwrapper `toml:"ignore"`
+	UseMountpoint bool          `toml:"use_mountpoint"`
+}
+
+// Interfaces configure network interface related settings
+type Interfaces struct {
+	Ignore           Regexpwrapper `toml:"ignore"`
+	IncludeLinkLocal bool          `toml:"include_link_local"`
+}
+
+// Duration is a wrapper type for marshalling string like "3s" to time.Duration
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText for parsing duration string while loading toml
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// Regexpwrapper is a wrapper type for marshalling string
+type Regexpwrapper struct {
+	*regexp.Regexp
+}
+
+// UnmarshalText for compiling regexp string while loading toml
+func (r *Regexpwrapper) UnmarshalText(text []byte) error {
+	var err error
+	r.Regexp, err = regexp.Compile(string(text))
+	return err
+}
+
+// VerifyCommands verifies the commands of the plugins and the check actions
+// by Command.Verify. The error lists the failed plugins, such as "plugin.metrics.foo".
+func (conf *Config) VerifyCommands() error {
+	problems := conf.CommandProblems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, ", "))
+}
+
+// CommandProblems returns the problems of the commands of the plugins found by
+// Verify in order, such as "plugin.metrics.foo: command ... is not executable".
+func (conf *Config) CommandProblems() []string {
+	var problems []string
+	conf.eachCommand(func(name string, cmd *Command) {
+		if err := cmd.Verify(); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+	})
+	sort.Strings(problems)
+	return problems
+}
+
+// PluginCommandLines returns the command lines of the plugins run as the user
+// of the agent, which are sorted and unique.
+func (conf *Config) PluginCommandLines() []string {
+	seen := make(map[string]bool)
+	var lines []string
+	conf.eachCommand(func(_ string, cmd *Command) {
+		line := cmd.CommandString()
+		if cmd.User != "" || line == "" || seen[line] {
+			return
+		}
+		seen[line] = true
+		lines = append(lines, line)
+	})
+	sort.Strings(lines)
+	return lines
+}
+
+// eachCommand calls f with the commands of the plugins and their names.
+func (conf *Config) eachCommand(f func(name string, cmd *Command)) {
+	for name, pconf := range conf.MetricPlugins {
+		f("plugin.metrics."+name, &pconf.Command)
+	}
+	for name, cconf := range conf.CheckPlugins {
+		f("plugin.checks."+name, &cconf.Command)
+		if cconf.Action != nil {
+			f("plugin.checks."+name+".action", &cconf.Action.Command)
+		}
+	}
+	for name, mconf := range conf.MetadataPlugins {
+		f("plugin.metadata."+name, &mconf.Command)
+	}
+}
+
+const defaultPluginSlowRatio = 0.8
+
+// setPluginStats sets the IDs of the plugins to the commands to record the
+// statistics of the executions, and the thresholds of the slow executions by
+// plugin_slow_ratio of the intervals. The actions are not recorded.
+func (conf *Config) setPluginStats() {
+	ratio := defaultPluginSlowRatio
+	if conf.PluginSlowRatio != nil {
+		ratio = *conf.PluginSlowRatio
+	}
+	threshold := func(interval time.Duration) time.Duration {
+		return time.Duration(float64(interval) * ratio)
+	}
+	for name, pconf := range conf.MetricPlugins {
+		interval := pconf.Interval
+		if interval <= 0 {
+			interval = PostMetricsInterval
+		}
+		pconf.Command.ID, pconf.Command.SlowThreshold = "metrics."+name, threshold(interval)
+	}
+	for name, cconf := range conf.CheckPlugins {
+		cconf.Command.ID, cconf.Command.SlowThreshold = "checks."+name, threshold(cconf.Interval())
+	}
+	for name, mconf := range conf.MetadataPlugins {
+		mconf.Command.ID, mconf.Command.SlowThreshold = "metadata."+name, threshold(mconf.Interval())
+	}
+}
+
+// DefaultPluginCircuitBreakerMaxInterval is the default maximum backoff of
+// the plugins failing consecutively.
+const DefaultPluginCircuitBreakerMaxInterval = 15 * time.Minute
+
+// setPluginBreakers sets the breakers of the metrics and check plugins by
+// plugin_circuit_breaker_threshold. The built-in checks and the metadata
+// plugins, run hourly by default, are not backed off.
+func (conf *Config) setPluginBreakers() {
+	if conf.PluginCircuitBreakerThreshold == nil || *conf.PluginCircuitBreakerThreshold <= 0 {
+		return
+	}
+	threshold := int(*conf.PluginCircuitBreakerThreshold)
+	maxInterval := DefaultPluginCircuitBreakerMaxInterval
+	if conf.PluginCircuitBreakerMaxInterval != nil {
+		maxInterval = conf.PluginCircuitBreakerMaxInterval.Duration
+	}
+	for name, pconf := range conf.MetricPlugins {
+		interval := pconf.Interval
+		if interval <= 0 {
+			interval = PostMetricsInterval
+		}
+		pconf.Breaker = pluginbreaker.New("metrics."+name, threshold, interval, maxInterval)
+	}
+	for name, cconf := range conf.CheckPlugins {
+		if cconf.Type != CheckTypeCommand {
+			continue
+		}
+		cconf.Breaker = pluginbreaker.New("checks."+name, threshold, cconf.Interval(), maxInterval)
+	}
+}
 
 // ListCustomIdentifiers returns a list of customIdentifiers.
 func (conf *Config) ListCustomIdentifiers() []string {
@@ -399,6 +2147,21 @@ func (conf *Config) ListCustomIdentifiers() []string {
 			customIdentifiers = append(customIdentifiers, *cconf.CustomIdentifier)
 		}
 	}
+	for _, pconf := range conf.PrometheusPlugins {
+		if pconf.CustomIdentifier != nil && index(customIdentifiers, *pconf.CustomIdentifier) == -1 {
+			customIdentifiers = append(customIdentifiers, *pconf.CustomIdentifier)
+		}
+	}
+	for _, pconf := range conf.SNMPPlugins {
+		if pconf.CustomIdentifier != nil && index(customIdentifiers, *pconf.CustomIdentifier) == -1 {
+			customIdentifiers = append(customIdentifiers, *pconf.CustomIdentifier)
+		}
+	}
+	for _, pconf := range conf.WindowsPerfCounterPlugins {
+		if pconf.CustomIdentifier != nil && index(customIdentifiers, *pconf.CustomIdentifier) == -1 {
+			customIdentifiers = append(customIdentifiers, *pconf.CustomIdentifier)
+		}
+	}
 	return customIdentifiers
 }
 
@@ -413,20 +2176,262 @@ func index(xs []string, y string) int {
 
 // LoadConfig loads a Config from a file.
 func LoadConfig(conffile string) (*Config, error) {
+	return LoadInstanceConfig(conffile, "")
+}
+
+// LoadInstanceConfig loads a Config from a file for the instance of suffix,
+// whose overrides are loaded from InstanceConfigFile. The agent is not an
+// instance if suffix is "".
+func LoadInstanceConfig(conffile, suffix string) (*Config, error) {
 	config, err := loadConfigFile(conffile)
 	if err != nil {
 		return nil, err
 	}
+	if r := os.Getenv(RootEnv); r != "" {
+		config.Root = r
+	}
+	if f := os.Getenv(IDFileEnv); f != "" {
+		config.IDFile = f
+	}
+	if suffix != "" {
+		if err := config.setInstance(conffile, suffix); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Cloud.validate(); err != nil {
+		return nil, err
+	}
+	switch config.LogFormat {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("log_format should be %q or %q, but %q", LogFormatText, LogFormatJSON, config.LogFormat)
+	}
+	if err := config.validateLogOutput(); err != nil {
+		return nil, err
+	}
+	switch config.Proxy {
+	case "":
+	case ProxySystem:
+		if runtime.GOOS != "windows" {
+			return nil, fmt.Errorf("proxy = %q is supported only on Windows", ProxySystem)
+		}
+	default:
+		return nil, fmt.Errorf("proxy should be %q, but %q", ProxySystem, config.Proxy)
+	}
+	if _, err := ResolveBindAddress(config.BindAddress); err != nil {
+		return nil, err
+	}
+	if err := config.validateLogLevels(); err != nil {
+		return nil, err
+	}
+	if err := config.buildHostIdentity(); err != nil {
+		return nil, err
+	}
+	if config.LogMaxSize != nil && *config.LogMaxSize <= 0 {
+		return nil, fmt.Errorf("log_max_size should be positive")
+	}
+	if config.LogMaxFiles != nil && *config.LogMaxFiles <= 0 {
+		return nil, fmt.Errorf("log_max_files should be positive")
+	}
+	if config.LogRotateInterval != nil && config.LogRotateInterval.Duration <= 0 {
+		return nil, fmt.Errorf("log_rotate_interval should be positive")
+	}
+	if config.SpoolMaxAge != nil && config.SpoolMaxAge.Duration <= 0 {
+		return nil, fmt.Errorf("spool_max_age should be positive")
+	}
+	if config.SpoolMaxBytes != nil && *config.SpoolMaxBytes <= 0 {
+		return nil, fmt.Errorf("spool_max_bytes should be positive")
+	}
+	if config.ShutdownFlushTimeout != nil && config.ShutdownFlushTimeout.Duration < 0 {
+		return nil, fmt.Errorf("shutdown_flush_timeout should not be negative")
+	}
+	if config.AutoRetirement.Timeout != nil && config.AutoRetirement.Timeout.Duration <= 0 {
+		return nil, fmt.Errorf("autoretirement.timeout should be positive")
+	}
+	if err := config.Supervisor.validate(); err != nil {
+		return nil, err
+	}
+	if config.HTTPPush != nil {
+		if err := config.HTTPPush.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.APITimeouts != nil {
+		if err := config.APITimeouts.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Debug != nil {
+		if err := config.Debug.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Health != nil {
+		if err := config.Health.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.LifecycleAnnotation != nil {
+		if err := config.LifecycleAnnotation.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Fluentd != nil {
+		if err := config.Fluentd.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.OTLP != nil {
+		if err := config.OTLP.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Statsd != nil {
+		if err := config.Statsd.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.IPMI != nil {
+		if err := config.IPMI.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Secondary != nil && config.Secondary.Apikey == "" {
+		return nil, fmt.Errorf("secondary.apikey should be specified")
+	}
+	if err := config.applyCheckSuppress(); err != nil {
+		return nil, err
+	}
+	if config.CheckReportResendInterval != nil && config.CheckReportResendInterval.Duration < 0 {
+		return nil, fmt.Errorf("check_report_resend_interval should not be negative")
+	}
+	if config.CheckStateMaxAge != nil && config.CheckStateMaxAge.Duration < 0 {
+		return nil, fmt.Errorf("check_state_max_age should not be negative")
+	}
+	if config.PluginMaxStdoutBytes != nil && *config.PluginMaxStdoutBytes <= 0 {
+		return nil, fmt.Errorf("plugin_max_stdout_bytes should be positive")
+	}
+	if config.PluginMaxStderrBytes != nil && *config.PluginMaxStderrBytes <= 0 {
+		return nil, fmt.Errorf("plugin_max_stderr_bytes should be positive")
+	}
+	config.eachCommand(func(_ string, cmd *Command) {
+		if config.PluginMaxStdoutBytes != nil {
+			cmd.MaxStdoutBytes = *config.PluginMaxStdoutBytes
+		}
+		if config.PluginMaxStderrBytes != nil {
+			cmd.MaxStderrBytes = *config.PluginMaxStderrBytes
+		}
+	})
+	if config.PluginSlowRatio != nil && *config.PluginSlowRatio < 0 {
+		return nil, fmt.Errorf("plugin_slow_ratio should not be negative")
+	}
+	config.setPluginStats()
+	if config.PluginCircuitBreakerThreshold != nil && *config.PluginCircuitBreakerThreshold < 0 {
+		return nil, fmt.Errorf("plugin_circuit_breaker_threshold should not be negative")
+	}
+	if config.PluginCircuitBreakerMaxInterval != nil && config.PluginCircuitBreakerMaxInterval.Duration <= 0 {
+		return nil, fmt.Errorf("plugin_circuit_breaker_max_interval should be positive")
+	}
+	config.setPluginBreakers()
+	if config.CloudDetectionTimeout != nil && config.CloudDetectionTimeout.Duration <= 0 {
+		return nil, fmt.Errorf("cloud_detection_timeout should be positive")
+	}
+	if config.HostSpecsExpensiveInterval != nil && config.HostSpecsExpensiveInterval.Duration < 0 {
+		return nil, fmt.Errorf("host_specs_expensive_interval should not be negative")
+	}
+	if config.MetricsConcurrency < 0 {
+		return nil, fmt.Errorf("metrics_concurrency should not be negative")
+	}
+	switch config.MetricNameCollision {
+	case "":
+		config.MetricNameCollision = MetricNameCollisionLastWins
+	case MetricNameCollisionFirstWins, MetricNameCollisionLastWins, MetricNameCollisionPrefixPlugin:
+	default:
+		return nil, fmt.Errorf("metric_name_collision should be %q, %q or %q but got %q", MetricNameCollisionFirstWins, MetricNameCollisionLastWins, MetricNameCollisionPrefixPlugin, config.MetricNameCollision)
+	}
+	switch config.CounterWrap {
+	case "":
+		config.CounterWrap = CounterWrapAuto
+	case CounterWrapAuto, CounterWrapDrop:
+	default:
+		return nil, fmt.Errorf("counter_wrap should be %q or %q but got %q", CounterWrapAuto, CounterWrapDrop, config.CounterWrap)
+	}
+	switch config.WindowsCPUBackend {
+	case "":
+		config.WindowsCPUBackend = WindowsCPUBackendAuto
+	case WindowsCPUBackendAuto:
+	case WindowsCPUBackendPDH, WindowsCPUBackendSystemTimes:
+		if runtime.GOOS != "windows" {
+			return nil, fmt.Errorf("windows_cpu_backend = %q is supported only on windows", config.WindowsCPUBackend)
+		}
+	default:
+		return nil, fmt.Errorf("windows_cpu_backend should be %q, %q or %q but got %q", WindowsCPUBackendAuto, WindowsCPUBackendPDH, WindowsCPUBackendSystemTimes, config.WindowsCPUBackend)
+	}
+	switch config.DuplicateInstance {
+	case "":
+		config.DuplicateInstance = DuplicateInstanceIgnore
+	case DuplicateInstanceWarn, DuplicateInstanceStop, DuplicateInstanceIgnore:
+	default:
+		return nil, fmt.Errorf("duplicate_instance should be %q, %q or %q but got %q", DuplicateInstanceWarn, DuplicateInstanceStop, DuplicateInstanceIgnore, config.DuplicateInstance)
+	}
+	switch config.OrphanPlugins {
+	case "":
+		config.OrphanPlugins = OrphanPluginsWarn
+	case OrphanPluginsWarn, OrphanPluginsTerminate:
+	default:
+		return nil, fmt.Errorf("orphan_plugins should be %q or %q but got %q", OrphanPluginsWarn, OrphanPluginsTerminate, config.OrphanPlugins)
+	}
+	switch config.OnDuplicate {
+	case "":
+		config.OnDuplicate = OnDuplicateError
+		fallthrough
+	case OnDuplicateError:
+		if len(config.duplicatePlugins) > 0 {
+			return nil, config.duplicatePluginsError()
+		}
+	case OnDuplicateSuffix:
+	default:
+		return nil, fmt.Errorf("on_duplicate should be %q or %q but got %q", OnDuplicateError, OnDuplicateSuffix, config.OnDuplicate)
+	}
+	config.StatusFilePerm = DefaultStatusFilePerm
+	if config.StatusFileMode != "" {
+		perm, err := strconv.ParseUint(config.StatusFileMode, 8, 32)
+		if err != nil || perm > 0777 {
+			return nil, fmt.Errorf("status_file_mode should be the permission in octal such as \"0644\" but got %q", config.StatusFileMode)
+		}
+		config.StatusFilePerm = os.FileMode(perm)
+	}
+	if config.RateLimit < 0 {
+		return nil, fmt.Errorf("rate_limit should not be negative")
+	}
+	if config.RateLimitBurst != nil && *config.RateLimitBurst <= 0 {
+		return nil, fmt.Errorf("rate_limit_burst should be positive")
+	}
+	if config.PostMetricsMaxValues != nil && *config.PostMetricsMaxValues <= 0 {
+		return nil, fmt.Errorf("post_metrics_max_values should be positive")
+	}
+	if config.PostMetricsMaxBytes != nil && *config.PostMetricsMaxBytes < minPostMetricsMaxBytes {
+		return nil, fmt.Errorf("post_metrics_max_bytes should be %d at least", minPostMetricsMaxBytes)
+	}
+	if config.CompressionThreshold != nil && *config.CompressionThreshold < 0 {
+		return nil, fmt.Errorf("compression_threshold should not be negative")
+	}
+	if err := config.expandHTTPHeaders(); err != nil {
+		return nil, err
+	}
 
 	// set default values if config does not have values
 	if config.Apibase == "" {
 		config.Apibase = DefaultConfig.Apibase
 	}
+	if config.Secondary != nil && config.Secondary.Apibase == "" {
+		config.Secondary.Apibase = config.Apibase
+	}
 	if config.Root == "" {
 		config.Root = DefaultConfig.Root
 	}
-	if config.Pidfile == "" {
-		config.Pidfile = DefaultConfig.Pidfile
+	if config.Pidfile == "" && !config.pidfileDisabled {
+		config.Pidfile = config.rootPidfile()
 	}
 	if config.Verbose == false {
 		config.Verbose = DefaultConfig.Verbose
@@ -438,50 +2443,137 @@ func LoadConfig(conffile string) (*Config, error) {
 	return config, err
 }
 
-func (conf *Config) setEachPlugins() error {
+func (conf *Config) setEachPlugins(file string) error {
+	conf.addEnvFiles()
+	conf.resolveDuplicatePlugins(file)
 	if pconfs, ok := conf.Plugin["metrics"]; ok {
-		var err error
 		for name, pconf := range pconfs {
-			conf.MetricPlugins[name], err = pconf.buildMetricPlugin()
+			p, err := pconf.buildMetricPlugin(name)
 			if err != nil {
 				return errors.Wrap(err, "plugin.metrics."+name)
 			}
+			if conf.pluginEnabled("metrics", name, pconf) {
+				conf.MetricPlugins[name] = p
+			} else {
+				delete(conf.MetricPlugins, name)
+			}
 		}
 	}
 	if pconfs, ok := conf.Plugin["checks"]; ok {
-		var err error
 		for name, pconf := range pconfs {
-			conf.CheckPlugins[name], err = pconf.buildCheckPlugin(name)
+			p, err := pconf.buildCheckPlugin(name)
 			if err != nil {
 				return errors.Wrap(err, "plugin.checks."+name)
 			}
+			if conf.pluginEnabled("checks", name, pconf) {
+				conf.CheckPlugins[name] = p
+			} else {
+				delete(conf.CheckPlugins, name)
+			}
 		}
 	}
 	if pconfs, ok := conf.Plugin["metadata"]; ok {
-		var err error
 		for name, pconf := range pconfs {
-			conf.MetadataPlugins[name], err = pconf.buildMetadataPlugin()
+			p, err := pconf.buildMetadataPlugin()
 			if err != nil {
 				return errors.Wrap(err, "plugin.metadata."+name)
 			}
+			if conf.pluginEnabled("metadata", name, pconf) {
+				conf.MetadataPlugins[name] = p
+			} else {
+				delete(conf.MetadataPlugins, name)
+			}
+		}
+	}
+	if pconfs, ok := conf.Plugin["prometheus"]; ok {
+		for name, pconf := range pconfs {
+			p, err := pconf.buildPrometheusPlugin(name)
+			if err != nil {
+				return errors.Wrap(err, "plugin.prometheus."+name)
+			}
+			if conf.pluginEnabled("prometheus", name, pconf) {
+				conf.PrometheusPlugins[name] = p
+			} else {
+				delete(conf.PrometheusPlugins, name)
+			}
+		}
+	}
+	if pconfs, ok := conf.Plugin["snmp"]; ok {
+		for name, pconf := range pconfs {
+			p, err := pconf.buildSNMPPlugin(name)
+			if err != nil {
+				return errors.Wrap(err, "plugin.snmp."+name)
+			}
+			if conf.pluginEnabled("snmp", name, pconf) {
+				conf.SNMPPlugins[name] = p
+			} else {
+				delete(conf.SNMPPlugins, name)
+			}
+		}
+	}
+	if pconfs, ok := conf.Plugin["windows_perfcounter"]; ok {
+		for name, pconf := range pconfs {
+			p, err := pconf.buildWindowsPerfCounterPlugin(name)
+			if err != nil {
+				return errors.Wrap(err, "plugin.windows_perfcounter."+name)
+			}
+			if conf.pluginEnabled("windows_perfcounter", name, pconf) {
+				conf.WindowsPerfCounterPlugins[name] = p
+			} else {
+				delete(conf.WindowsPerfCounterPlugins, name)
+			}
 		}
 	}
 	// Make Plugins empty because we should not use this later.
-	// Use MetricPlugins, CheckPlugins and MetadataPlugins.
+	// Use MetricPlugins, CheckPlugins, MetadataPlugins, PrometheusPlugins,
+	// SNMPPlugins and WindowsPerfCounterPlugins.
 	conf.Plugin = nil
 	return nil
 }
 
+// pluginEnabled records the plugin of the section disabled by enabled = false,
+// which may be enabled again by the section of the same name in the included
+// files, and reports whether the plugin is enabled.
+func (conf *Config) pluginEnabled(kind, name string, pconf *PluginConfig) bool {
+	section := "plugin." + kind + "." + name
+	if pconf.Enabled == nil || *pconf.Enabled {
+		delete(conf.disabledPlugins, section)
+		return true
+	}
+	if conf.disabledPlugins == nil {
+		conf.disabledPlugins = make(map[string]bool)
+	}
+	conf.disabledPlugins[section] = true
+	return false
+}
+
+// DisabledPlugins returns the sorted sections of the plugins disabled by
+// enabled = false, such as "plugin.checks.foo".
+func (conf *Config) DisabledPlugins() []string {
+	sections := make([]string, 0, len(conf.disabledPlugins))
+	for section := range conf.disabledPlugins {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	return sections
+}
+
 func loadConfigFile(file string) (*Config, error) {
 	config := &Config{}
-	if _, err := toml.DecodeFile(file, config); err != nil {
+	meta, err := toml.DecodeFile(file, config)
+	if err != nil {
 		return config, err
 	}
+	config.addSecretFile(file, meta)
+	config.setPidfileDisabled(meta)
 
 	config.MetricPlugins = make(map[string]*MetricPlugin)
 	config.CheckPlugins = make(map[string]*CheckPlugin)
 	config.MetadataPlugins = make(map[string]*MetadataPlugin)
-	if err := config.setEachPlugins(); err != nil {
+	config.PrometheusPlugins = make(map[string]*PrometheusPlugin)
+	config.SNMPPlugins = make(map[string]*SNMPPlugin)
+	config.WindowsPerfCounterPlugins = make(map[string]*WindowsPerfCounterPlugin)
+	if err := config.setEachPlugins(file); err != nil {
 		return nil, err
 	}
 
@@ -501,35 +2593,98 @@ func includeConfigFile(config *Config, include string) error {
 	}
 
 	for _, file := range files {
-		// Save current "roles" value and reset it
-		// because toml.DecodeFile()-ing on a fulfilled struct
-		// produces bizarre array values.
-		rolesSaved := config.Roles
-		config.Roles = nil
-
-		meta, err := toml.DecodeFile(file, &config)
-		if err != nil {
-			return fmt.Errorf("while loading included config file %s: %s", file, err)
+		if _, err := includeFile(config, file); err != nil {
+			return err
 		}
+	}
 
-		// If included config does not have "roles" key,
-		// use the previous roles configuration value.
-		if meta.IsDefined("roles") == false {
-			config.Roles = rolesSaved
-		}
+	return nil
+}
 
-		// Add new plugin or overwrite a plugin with the same plugin name.
-		if err := config.setEachPlugins(); err != nil {
-			return err
-		}
+// includeFile loads file over config, and returns the keys defined in it.
+func includeFile(config *Config, file string) (toml.MetaData, error) {
+	// Save current "roles" value and reset it
+	// because toml.DecodeFile()-ing on a fulfilled struct
+	// produces bizarre array values.
+	rolesSaved := config.Roles
+	config.Roles = nil
+
+	meta, err := toml.DecodeFile(file, &config)
+	if err != nil {
+		return meta, fmt.Errorf("while loading included config file %s: %s", file, err)
+	}
+
+	config.addSecretFile(file, meta)
+	config.setPidfileDisabled(meta)
+
+	// If included config does not have "roles" key,
+	// use the previous roles configuration value.
+	if meta.IsDefined("roles") == false {
+		config.Roles = rolesSaved
+	}
+
+	// Add new plugin, or overwrite or rename a plugin with the same plugin name.
+	if err := config.setEachPlugins(file); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+// setPidfileDisabled records whether pidfile is configured to "", which is
+// distinguished from the one not configured.
+func (conf *Config) setPidfileDisabled(meta toml.MetaData) {
+	if meta.IsDefined("pidfile") {
+		conf.pidfileDisabled = conf.Pidfile == ""
 	}
+}
+
+// SetRoot sets the root directory of the state files, and moves the pidfile
+// under it unless the pidfile is configured individually.
+func (conf *Config) SetRoot(root string) {
+	derived := conf.Pidfile == conf.rootPidfile()
+	conf.Root = root
+	if derived {
+		conf.Pidfile = conf.rootPidfile()
+	}
+	if _, ok := conf.HostIDStorage.(*FileSystemHostIDStorage); ok {
+		// created by the previous root
+		conf.HostIDStorage = nil
+	}
+}
 
+// rootPidfile is the default pidfile, which is "pid" under the root directory
+// unless the root directory is the default one.
+func (conf *Config) rootPidfile() string {
+	if conf.Root == DefaultConfig.Root {
+		return DefaultConfig.Pidfile
+	}
+	return filepath.Join(conf.Root, "pid")
+}
+
+// CreateRoot creates the root directory, and warns if it is writable by the
+// others, who can replace the state files and the plugins installed under it.
+func (conf *Config) CreateRoot() error {
+	if err := os.MkdirAll(conf.Root, 0755); err != nil {
+		return err
+	}
+	if err := checkRootPermission(conf.Root); err != nil {
+		configLogger.Warningf("INSECURE ROOT DIRECTORY: %s %s. Restrict the permission not to replace the state files", conf.Root, err)
+	}
 	return nil
 }
 
+// HostIDFile returns the location of the host ID file, or "" if the host ID
+// is not stored in a file.
+func (conf *Config) HostIDFile() string {
+	if s, ok := conf.hostIDStorage().(*FileSystemHostIDStorage); ok {
+		return s.HostIDFile()
+	}
+	return ""
+}
+
 func (conf *Config) hostIDStorage() HostIDStorage {
 	if conf.HostIDStorage == nil {
-		conf.HostIDStorage = &FileSystemHostIDStorage{Root: conf.Root}
+		conf.HostIDStorage = &FileSystemHostIDStorage{Root: conf.Root, File: conf.IDFile}
 	}
 	return conf.HostIDStorage
 }
@@ -539,6 +2694,15 @@ func (conf *Config) LoadHostID() (string, error) {
 	return conf.hostIDStorage().LoadHostID()
 }
 
+// LockHostID locks the host ID file not to be shared by the agents until the
+// returned function is called. The other storages than the files are not locked.
+func (conf *Config) LockHostID() (func(), error) {
+	if s, ok := conf.hostIDStorage().(*FileSystemHostIDStorage); ok {
+		return s.Lock()
+	}
+	return func() {}, nil
+}
+
 // SaveHostID saves the host id, which may be restored by LoadHostID.
 func (conf *Config) SaveHostID(id string) error {
 	return conf.hostIDStorage().SaveHostID(id)
@@ -558,22 +2722,78 @@ type HostIDStorage interface {
 	DeleteSavedHostID() error
 }
 
+// RootEnv is the environment variable to override root, the directory of the
+// state files.
+const RootEnv = "MACKEREL_AGENT_ROOT"
+
+// IDFileEnv is the environment variable to override id_file, the location of
+// the host ID file instead of "id" under the root directory.
+const IDFileEnv = "MACKEREL_AGENT_ID_FILE"
+
+// WrapperVersionEnv is the environment variable by which the service wrapper
+// of Windows tells its version to the agent launched by it.
+const WrapperVersionEnv = "MACKEREL_AGENT_WRAPPER_VERSION"
+
 // FileSystemHostIDStorage is the default HostIDStorage
 // which saves/loads the host id using an id file on the local filesystem.
 // The file will be located at /var/lib/mackerel-agent/id by default on linux.
 type FileSystemHostIDStorage struct {
 	Root string
+	// File is the location of the id file configured by id_file, instead of
+	// the one under Root.
+	File string
+	// Suffix is appended to the name of the id file, such as SecondaryIDFileSuffix.
+	Suffix string
 }
 
 const idFileName = "id"
 
 // HostIDFile is the location of the host id file.
 func (s FileSystemHostIDStorage) HostIDFile() string {
-	return filepath.Join(s.Root, idFileName)
+	if s.File != "" {
+		return s.File + s.Suffix
+	}
+	return s.defaultHostIDFile()
+}
+
+func (s FileSystemHostIDStorage) defaultHostIDFile() string {
+	return filepath.Join(s.Root, idFileName+s.Suffix)
+}
+
+// migrate moves the id file under Root to File, which is configured after
+// the host has been registered.
+func (s FileSystemHostIDStorage) migrate() error {
+	file, old := s.HostIDFile(), s.defaultHostIDFile()
+	if s.File == "" || s.Root == "" || file == old {
+		return nil
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		return nil
+	}
+	content, err := ioutil.ReadFile(old)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// written atomically, since the truncated one would skip the migration
+	if err := util.WriteFileAtomically(file, content, 0644); err != nil {
+		return err
+	}
+	configLogger.Infof("Migrated the host ID file from %s to %s (id_file)", old, file)
+	// the old one is left on the read-only filesystem
+	if err := os.Remove(old); err != nil {
+		configLogger.Warningf("Failed to remove the old host ID file %s: %s", old, err)
+	}
+	return nil
 }
 
 // LoadHostID loads the current host ID from the mackerel-agent's id file.
 func (s FileSystemHostIDStorage) LoadHostID() (string, error) {
+	if err := s.migrate(); err != nil {
+		configLogger.Warningf("Failed to migrate the host ID file to %s: %s", s.HostIDFile(), err)
+	}
 	content, err := ioutil.ReadFile(s.HostIDFile())
 	if err != nil {
 		return "", err
@@ -585,28 +2805,39 @@ func (s FileSystemHostIDStorage) LoadHostID() (string, error) {
 	return hostID, nil
 }
 
-// SaveHostID saves the host ID to the mackerel-agent's id file.
+// SaveHostID saves the host ID to the mackerel-agent's id file. It is written
+// to the temporary file in the same directory and renamed, so that the id file
+// is never left partially written.
 func (s FileSystemHostIDStorage) SaveHostID(id string) error {
-	err := os.MkdirAll(s.Root, 0755)
-	if err != nil {
-		return err
-	}
-
-	file, err := os.Create(s.HostIDFile())
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	_, err = file.Write([]byte(id))
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return util.WriteFileAtomically(s.HostIDFile(), []byte(id), 0644)
 }
 
 // DeleteSavedHostID deletes the mackerel-agent's id file.
 func (s FileSystemHostIDStorage) DeleteSavedHostID() error {
 	return os.Remove(s.HostIDFile())
 }
+
+// Lock takes the advisory lock of the id file, so that the agents sharing it
+// by mistake do not post as the same host, until the returned function is
+// called. The lock is taken on the file of HostIDFile with ".lock", since the
+// id file does not exist until the host is registered.
+func (s FileSystemHostIDStorage) Lock() (func(), error) {
+	file := s.HostIDFile() + ".lock"
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock the host ID file %s: %s", file, err)
+	}
+	if !locked {
+		f.Close()
+		return nil, fmt.Errorf("the host ID file %s is used by another mackerel-agent, which posts as the same host (configure id_file or root for each agent)", s.HostIDFile())
+	}
+	return func() { f.Close() }, nil
+}
@@ -6,11 +6,11 @@ import (
 )
 
 func init() {
-	mackerelRoot := filepath.Join(os.Getenv("HOME"), "Library", getAgentName())
+	mackerelRoot := filepath.Join(os.Getenv("HOME"), "Library", AgentName())
 	DefaultConfig = &Config{
 		Apibase:  getApibase(),
 		Root:     mackerelRoot,
 		Pidfile:  filepath.Join(mackerelRoot, "pid"),
-		Conffile: filepath.Join(mackerelRoot, getAgentName()+".conf"),
+		Conffile: filepath.Join(mackerelRoot, AgentName()+".conf"),
 	}
 }
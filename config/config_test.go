@@ -3,13 +3,18 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/mackerelio/mackerel-agent/cmdutil"
 )
 
 var sampleConfig = `
@@ -41,7 +46,7 @@ user = "xyz"
 notification_interval = 60
 max_check_attempts = 3
 timeout_seconds = 60
-action = { command = "cardiac_massage", user = "doctor" }
+action = { command = "cardiac_massage", user = "doctor", max_trigger_per_hour = 3 }
 
 [plugin.checks.heartbeat2]
 command = "heartbeat.sh"
@@ -50,6 +55,7 @@ action = { command = "cardiac_massage", user = "doctor", env = { "NAME_1" = "VAL
 
 [plugin.checks.heartbeat3]
 command = "heartbeat.sh"
+max_output_bytes = 512
 
 [plugin.checks.heartbeat4]
 command = "heartbeat.sh"
@@ -162,6 +168,30 @@ func TestLoadConfigWithMountPoint(t *testing.T) {
 	}
 }
 
+func TestLoadConfigWithInterfaces(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[interfaces]
+ignore = "^(docker|veth)"
+include_link_local = true
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if !config.Interfaces.Ignore.MatchString("veth1234") || config.Interfaces.Ignore.MatchString("eth0") {
+		t.Errorf("unexpected ignore pattern: %s", config.Interfaces.Ignore)
+	}
+	if !config.Interfaces.IncludeLinkLocal {
+		t.Error("include_link_local should be true")
+	}
+}
+
 var sampleConfigWithInvalidIgnoreRegexp = `
 apikey = "abcde"
 display_name = "fghij"
@@ -235,6 +265,52 @@ func TestLoadConfigWithInvalidCheckCommand(t *testing.T) {
 	}
 }
 
+var sampleConfigWithInvalidCheckAction = `
+apikey = "abcde"
+
+[plugin.checks.heartbeat]
+command = "heartbeat.sh"
+action = { command = "cardiac_massage", max_trigger_per_hour = -1 }
+`
+
+func TestLoadConfigWithInvalidCheckAction(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(sampleConfigWithInvalidCheckAction)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = LoadConfig(tmpFile.Name())
+	if err == nil {
+		t.Fatalf("should raise error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "plugin.checks.heartbeat") {
+		t.Errorf("should raise error containing checks key: %v", err)
+	}
+}
+
+func TestLoadConfigWithInvalidCheckMaxOutputBytes(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.output]
+command = "output.sh"
+max_output_bytes = 0
+`)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = LoadConfig(tmpFile.Name())
+	if err == nil {
+		t.Fatalf("should raise error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "plugin.checks.output") {
+		t.Errorf("should raise error containing checks key: %v", err)
+	}
+}
+
 var sampleConfigWithTooLargeCheckMemo = `
 apikey = "abcde"
 
@@ -321,6 +397,7 @@ var LoadConfigWithCloudPlatformTests = []struct {
 	{"ec2", CloudPlatformEC2},
 	{"gce", CloudPlatformGCE},
 	{"azurevm", CloudPlatformAzureVM},
+	{"ecs", CloudPlatformECS},
 }
 
 func TestLoadConfigWithCloudPlatform(t *testing.T) {
@@ -361,522 +438,3997 @@ func TestLoadConfigWithInvalidCloudPlatform(t *testing.T) {
 	}
 }
 
-func TestLoadConfigFile(t *testing.T) {
-	tmpFile, err := newTempFileWithContent(sampleConfig)
+func TestLoadConfigWithCloudMetadataEndpoint(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[cloud]
+metadata_endpoint = "http://10.0.0.1:8080"
+timeout = "500ms"
+[cloud.headers]
+X-Tenant = "tenant-1"
+`)
 	if err != nil {
-		t.Errorf("should not raise error: %v", err)
+		t.Fatalf("should not raise error: %v", err)
 	}
 	defer os.Remove(tmpFile.Name())
 
-	config, err := loadConfigFile(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
 	if err != nil {
-		t.Errorf("should not raise error: %v", err)
+		t.Fatalf("should not raise error: %v", err)
 	}
-
-	if config.Apikey != "abcde" {
-		t.Error("Apikey should be abcde")
+	if config.Cloud.MetadataEndpoint != "http://10.0.0.1:8080" {
+		t.Errorf("unexpected metadata_endpoint: %s", config.Cloud.MetadataEndpoint)
 	}
-
-	if config.DisplayName != "fghij" {
-		t.Error("DisplayName should be fghij")
+	if config.Cloud.Provider != CloudProviderEC2Compatible {
+		t.Errorf("provider should be %s by default, but %s", CloudProviderEC2Compatible, config.Cloud.Provider)
+	}
+	if config.Cloud.Timeout == nil || config.Cloud.Timeout.Duration != 500*time.Millisecond {
+		t.Errorf("unexpected timeout: %v", config.Cloud.Timeout)
 	}
+	if config.Cloud.Headers["X-Tenant"] != "tenant-1" {
+		t.Errorf("unexpected headers: %v", config.Cloud.Headers)
+	}
+}
 
-	if config.Diagnostic != true {
-		t.Error("Diagnostic should be true")
+func TestLoadConfigWithInvalidCloud(t *testing.T) {
+	tests := []string{
+		`provider = "ec2-compatible"`,
+		`metadata_endpoint = "10.0.0.1:8080"`,
+		`metadata_endpoint = "file:///tmp/meta"`,
+		`metadata_endpoint = "http://10.0.0.1:8080"
+provider = "openstack"`,
+		`metadata_endpoint = "http://10.0.0.1:8080"
+timeout = "0s"`,
 	}
+	for _, content := range tests {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[cloud]\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
 
-	if config.MetricPlugins == nil {
-		t.Error("plugin should have metrics")
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", content)
+		}
 	}
-	pluginConf := config.MetricPlugins["mysql"]
-	if pluginConf.Command.Cmd != "ruby /path/to/your/plugin/mysql.rb" {
-		t.Errorf("plugin conf command should be 'ruby /path/to/your/plugin/mysql.rb' but %v", pluginConf.Command.Cmd)
+}
+
+func TestLoadConfigWithSpool(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+spool_dir = "/var/lib/mackerel-agent/spool"
+spool_max_age = "6h"
+spool_max_bytes = 1048576
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if pluginConf.Command.User != "mysql" {
-		t.Error("plugin user_name should be 'mysql'")
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if *pluginConf.CustomIdentifier != "app1.example.com" {
-		t.Errorf("plugin custom_identifier should be 'app1.example.com' but got %v", *pluginConf.CustomIdentifier)
+	if config.SpoolDir != "/var/lib/mackerel-agent/spool" {
+		t.Errorf("unexpected spool_dir: %s", config.SpoolDir)
 	}
-	if pluginConf.Command.TimeoutDuration != 60*time.Second {
-		t.Error("plugin timeout_seconds should be 60s")
+	if config.SpoolMaxAge == nil || config.SpoolMaxAge.Duration != 6*time.Hour {
+		t.Errorf("unexpected spool_max_age: %v", config.SpoolMaxAge)
 	}
-	customIdentifiers := config.ListCustomIdentifiers()
-	if len(customIdentifiers) != 2 {
-		t.Errorf("config should have 2 custom_identifier")
+	if config.SpoolMaxBytes == nil || *config.SpoolMaxBytes != 1048576 {
+		t.Errorf("unexpected spool_max_bytes: %v", config.SpoolMaxBytes)
 	}
-	// In fact they should be [app1, app2], but we don't mind their order here
-	if customIdentifiers[0] != "app1.example.com" && customIdentifiers[1] != "app1.example.com" {
-		t.Errorf("custom_identifier should include 'app1.example.com'")
+
+	for _, content := range []string{`spool_max_age = "0s"`, `spool_max_bytes = -1`} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", content)
+		}
 	}
-	if customIdentifiers[0] != "app2.example.com" && customIdentifiers[1] != "app2.example.com" {
-		t.Errorf("custom_identifier should include 'app2.example.com'")
+}
+
+func TestLoadConfigWithShutdownFlushTimeout(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+shutdown_flush_timeout = "0s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if pluginConf.IncludePattern != nil {
-		t.Errorf("plugin include_pattern should be nil but got %v", pluginConf.IncludePattern)
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if pluginConf.ExcludePattern != nil {
-		t.Errorf("plugin exclude_pattern should be nil but got %v", pluginConf.ExcludePattern)
+	if config.ShutdownFlushTimeout == nil || config.ShutdownFlushTimeout.Duration != 0 {
+		t.Errorf("unexpected shutdown_flush_timeout: %v", config.ShutdownFlushTimeout)
 	}
 
-	pluginConf2 := config.MetricPlugins["mysql2"]
-	if pluginConf2.IncludePattern.String() != regexp.MustCompile(`^mysql\.innodb\..+`).String() {
-		t.Errorf("unexpected include_pattern: %v", pluginConf2.IncludePattern)
+	tmpFile, err = newTempFileWithContent(`
+apikey = "abcde"
+shutdown_flush_timeout = "-1s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if pluginConf2.ExcludePattern.String() != regexp.MustCompile(`^mysql\.innodb\.ignore`).String() {
-		t.Errorf("unexpected exclude_pattern: %v", pluginConf2.ExcludePattern)
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the negative shutdown_flush_timeout")
 	}
+}
 
-	pluginConf3 := config.MetricPlugins["mysql3"]
-	if pluginConf3.Command.Env == nil {
-		t.Error("config should have env")
+func TestLoadConfigWithAutoRetirement(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[autoretirement]
+enable = true
+timeout = "5s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if len(pluginConf3.Command.Env) != 2 {
-		t.Errorf("env should have 2 keys: %v", pluginConf3.Command.Env)
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if !expectContainsString(pluginConf3.Command.Env, "MYSQL_USERNAME=USERNAME") {
-		t.Errorf("Command.Env should contain 'MYSQL_USERNAME=USERNAME'")
+	if !config.AutoRetirement.Enable {
+		t.Error("autoretirement.enable should be true")
 	}
-	if !expectContainsString(pluginConf3.Command.Env, "MYSQL_PASSWORD=PASSWORD") {
-		t.Errorf("Command.Env should contain 'MYSQL_PASSWORD=PASSWORD'")
+	if config.AutoRetirement.Timeout == nil || config.AutoRetirement.Timeout.Duration != 5*time.Second {
+		t.Errorf("unexpected autoretirement.timeout: %v", config.AutoRetirement.Timeout)
 	}
+}
 
-	if config.CheckPlugins == nil {
-		t.Error("plugin should have checks")
+func TestLoadConfigWithSecretFiles(t *testing.T) {
+	included, err := newTempFileWithContent(`
+[plugin.metrics.mysql]
+command = "mackerel-plugin-mysql"
+env = { MYSQL_PASSWORD = "password1" }
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	checks := config.CheckPlugins["heartbeat"]
-	if checks.Command.Cmd != "heartbeat.sh" {
-		t.Error("check command should be 'heartbeat.sh'")
+	defer os.Remove(included.Name())
+	tmpFile, err := newTempFileWithContent(`
+secure_config = true
+include = "` + filepath.ToSlash(included.Name()) + `"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if checks.Command.User != "xyz" {
-		t.Error("check user_name should be 'xyz'")
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if checks.Command.TimeoutDuration != 60*time.Second {
-		t.Error("check timeout_seconds should be 60s")
+	if !config.SecureConfig {
+		t.Error("secure_config should be true")
 	}
-	if *checks.NotificationInterval != 60 {
-		t.Error("notification_interval should be 60")
+	if !reflect.DeepEqual(config.SecretFiles, []string{included.Name()}) {
+		t.Errorf("only the included file should contain the secrets: %v", config.SecretFiles)
 	}
-	if *checks.MaxCheckAttempts != 3 {
-		t.Error("max_check_attempts should be 3")
+	if runtime.GOOS == "windows" {
+		return
 	}
-	if checks.Action.Cmd != "cardiac_massage" {
-		t.Error("action.command should be 'cardiac_massage'")
+	os.Chmod(included.Name(), 0644)
+	if problems := config.InsecureSecretFiles(); len(problems) != 1 || !strings.Contains(problems[0], "mode 0644") {
+		t.Errorf("the file readable by the others should be insecure: %v", problems)
 	}
-	if checks.Action.User != "doctor" {
-		t.Error("action.user should be 'doctor'")
+	os.Chmod(included.Name(), 0600)
+	if problems := config.InsecureSecretFiles(); len(problems) != 0 {
+		t.Errorf("the file readable by the owner should not be insecure: %v", problems)
 	}
-	if expected := ""; checks.Memo != expected {
-		t.Errorf("memo should be %q but got %q", expected, checks.Memo)
+}
+
+func TestLoadConfigWithSupervisor(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[supervisor]
+max_restarts = 3
+restart_interval = "5m"
+restart_backoff = "2s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
+	defer os.Remove(tmpFile.Name())
 
-	checks2 := config.CheckPlugins["heartbeat2"]
-	if checks2.Command.Env == nil {
-		t.Error("config should have env of check plugin")
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if len(checks2.Command.Env) != 1 {
-		t.Errorf("env of check plugin should have a key: %v", checks2.Command.Env)
+	s := config.Supervisor
+	if s.MaxRestarts == nil || *s.MaxRestarts != 3 || s.RestartInterval == nil || s.RestartInterval.Duration != 5*time.Minute ||
+		s.RestartBackoff == nil || s.RestartBackoff.Duration != 2*time.Second || s.MaxRestartBackoff != nil {
+		t.Errorf("unexpected supervisor: %+v", s)
 	}
-	if !expectContainsString(checks2.Command.Env, "ES_HOSTS=10.45.3.2:9220,10.45.3.1:9230") {
-		t.Errorf("Command.Env should contain 'ES_HOSTS=10.45.3.2:9220,10.45.3.1:9230'")
+
+	for _, conf := range []string{"max_restarts = 0", `restart_interval = "-1s"`, `max_restart_backoff = "0s"`} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[supervisor]\n" + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", conf)
+		}
 	}
-	if checks2.Action.Env == nil {
-		t.Error("config should have action.env of check plugin")
+}
+
+func TestLoadConfigWithPluginProtocol(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.jsonl]
+command = "jsonl.sh"
+protocol = "jsonl"
+
+[plugin.metrics.auto]
+command = "auto.sh"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if len(checks2.Action.Env) != 3 {
-		t.Errorf("action.env of check plugin should have 3 keys: %v", checks2.Action.Env)
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if !expectContainsString(checks2.Action.Env, "NAME_1=VALUE_1") {
-		t.Errorf("Command.Env should contain 'NAME_1=VALUE_1'")
+	if p := config.MetricPlugins["jsonl"].Protocol; p != PluginProtocolJSONL {
+		t.Errorf("unexpected protocol: %q", p)
 	}
-	if !expectContainsString(checks2.Action.Env, "NAME_2=VALUE_2") {
-		t.Errorf("Command.Env should contain 'NAME_2=VALUE_2'")
+	if p := config.MetricPlugins["auto"].Protocol; p != PluginProtocolAuto {
+		t.Errorf("unexpected protocol: %q", p)
 	}
 
-	checks3 := config.CheckPlugins["heartbeat3"]
-	if checks3.Action != nil {
-		t.Error("config should not have action of check plugin")
+	tmpFile2, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.invalid]
+command = "invalid.sh"
+protocol = "xml"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if checks3.CustomIdentifier != nil {
-		t.Error("config should not have customIdentifier")
+	defer os.Remove(tmpFile2.Name())
+	if _, err := LoadConfig(tmpFile2.Name()); err == nil {
+		t.Error("should raise error for the unknown protocol")
 	}
+}
 
-	checks4 := config.CheckPlugins["heartbeat4"]
-	if checks4.CustomIdentifier == nil || *checks4.CustomIdentifier != "app2.example.com" {
-		t.Error("config should have customIdentifier 'app2.example.com'")
+func TestLoadConfigWithMetricNames(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.strict]
+command = "strict.sh"
+invalid_metric_names = "reject"
+max_metric_names = 100
+
+[plugin.metrics.default]
+command = "default.sh"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
+	defer os.Remove(tmpFile.Name())
 
-	if config.MetadataPlugins == nil {
-		t.Error("config should have metadata plugin list")
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	metadataPlugin := config.MetadataPlugins["hostinfo"]
-	if metadataPlugin.Command.Cmd != "hostinfo.sh" {
-		t.Errorf("command of metadata plugin should be 'hostinfo.sh' but got '%v'", metadataPlugin.Command.Cmd)
+	if p := config.MetricPlugins["strict"]; p.InvalidMetricNames != InvalidMetricNamesReject || p.MaxMetricNames != 100 {
+		t.Errorf("unexpected metric names: %q, %d", p.InvalidMetricNames, p.MaxMetricNames)
 	}
-	if metadataPlugin.Command.User != "zzz" {
-		t.Errorf("user of metadata plugin should be 'zzz' but got '%v'", metadataPlugin.Command.User)
+	if p := config.MetricPlugins["default"]; p.InvalidMetricNames != InvalidMetricNamesReplace || p.MaxMetricNames != DefaultMaxMetricNames {
+		t.Errorf("unexpected metric names: %q, %d", p.InvalidMetricNames, p.MaxMetricNames)
 	}
-	if *metadataPlugin.ExecutionInterval != 60 {
-		t.Errorf("execution interval of metadata plugin should be 60 but got '%v'", *metadataPlugin.ExecutionInterval)
+
+	for _, conf := range []string{`invalid_metric_names = "ignore"`, "max_metric_names = 0"} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[plugin.metrics.foo]\ncommand = \"foo.sh\"\n" + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", conf)
+		}
 	}
-	if metadataPlugin.Command.TimeoutDuration != 60*time.Second {
-		t.Errorf("timeout duration of metadata plugin should be 60s, but got '%v'",
-			metadataPlugin.Command.TimeoutDuration)
+}
+
+func TestLoadConfigWithTimestampWindow(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.batch]
+command = "batch.sh"
+timestamp_window = "6h"
+
+[plugin.metrics.unchecked]
+command = "unchecked.sh"
+timestamp_window = "0s"
+
+[plugin.metrics.default]
+command = "default.sh"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
+	defer os.Remove(tmpFile.Name())
 
-	metadataPlugin2 := config.MetadataPlugins["hostinfo2"]
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	for name, expect := range map[string]time.Duration{"batch": 6 * time.Hour, "unchecked": 0, "default": DefaultTimestampWindow} {
+		if w := config.MetricPlugins[name].TimestampWindow; w != expect {
+			t.Errorf("timestamp_window of %s should be %s but got %s", name, expect, w)
+		}
+	}
+
+	tmpFile2, err := newTempFileWithContent("apikey = \"abcde\"\n[plugin.metrics.foo]\ncommand = \"foo.sh\"\ntimestamp_window = \"-1h\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile2.Name())
+	if _, err := LoadConfig(tmpFile2.Name()); err == nil {
+		t.Error("should raise error for the negative timestamp_window")
+	}
+}
+
+func TestLoadConfigWithOnEmpty(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.warn]
+command = "warn.sh"
+on_empty = "warn"
+empty_cycles = 5
+
+[plugin.metrics.zero]
+command = "zero.sh"
+on_empty = "zero"
+
+[plugin.metrics.default]
+command = "default.sh"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	for name, expect := range map[string]MetricPlugin{
+		"warn":    {OnEmpty: OnEmptyWarn, EmptyCycles: 5},
+		"zero":    {OnEmpty: OnEmptyZero, EmptyCycles: DefaultEmptyCycles},
+		"default": {OnEmpty: OnEmptyIgnore, EmptyCycles: DefaultEmptyCycles},
+	} {
+		if p := config.MetricPlugins[name]; p.OnEmpty != expect.OnEmpty || p.EmptyCycles != expect.EmptyCycles {
+			t.Errorf("on_empty of %s should be %q (%d) but got %q (%d)", name, expect.OnEmpty, expect.EmptyCycles, p.OnEmpty, p.EmptyCycles)
+		}
+	}
+
+	for _, conf := range []string{`on_empty = "skip"`, "on_empty = \"warn\"\nempty_cycles = 0", "empty_cycles = 3"} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[plugin.metrics.foo]\ncommand = \"foo.sh\"\n" + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", conf)
+		}
+	}
+}
+
+func TestLoadConfigWithServiceMetricPlugin(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.broker]
+command = "broker.sh"
+service = "MyService"
+metric_prefix = "queue."
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if p := config.MetricPlugins["broker"]; p.Service != "MyService" || p.MetricPrefix != "queue" {
+		t.Errorf("unexpected service metrics plugin: %q, %q", p.Service, p.MetricPrefix)
+	}
+
+	for _, conf := range []string{
+		"service = \"MyService\"\ncustom_identifier = \"broker.example.com\"",
+		"service = \"MyService\"\nsplay_seconds = 10",
+		"metric_prefix = \"queue\"",
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[plugin.metrics.foo]\ncommand = \"foo.sh\"\n" + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", conf)
+		}
+	}
+}
+
+func TestLoadConfigWithPrometheus(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.prometheus.node]
+url = "http://localhost:9100/metrics"
+include_pattern = '^node\.node_load'
+
+[plugin.prometheus.app]
+url = "http://localhost:8080/metrics"
+metric_prefix = "myapp"
+label_template = "{{.code}}"
+timeout = "5s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	node := config.PrometheusPlugins["node"]
+	if node == nil || node.URL != "http://localhost:9100/metrics" || node.MetricPrefix != "node" || node.LabelTemplate != nil || node.Timeout != 10*time.Second {
+		t.Errorf("unexpected plugin.prometheus.node: %+v", node)
+	}
+	if node != nil && (node.IncludePattern == nil || !node.IncludePattern.MatchString("node.node_load1")) {
+		t.Errorf("unexpected include_pattern: %v", node.IncludePattern)
+	}
+	app := config.PrometheusPlugins["app"]
+	if app == nil || app.MetricPrefix != "myapp" || app.LabelTemplate == nil || app.Timeout != 5*time.Second {
+		t.Errorf("unexpected plugin.prometheus.app: %+v", app)
+	}
+
+	for _, c := range []string{"", `url = "ftp://localhost/metrics"`, `url = "http://localhost/metrics"
+label_template = "{{.code"`, `url = "http://localhost/metrics"
+timeout = "60s"`} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[plugin.prometheus.invalid]
+` + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithSNMP(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.snmp.core]
+target = "192.0.2.1"
+service = "network"
+oids = [
+  { oid = "1.3.6.1.2.1.2.2.1.10.1", name = "if1.in_bits", type = "counter", scale = 8 },
+  { oid = ".1.3.6.1.4.1.2021.10.1.3.1", name = "load1" },
+]
+
+[plugin.snmp.edge]
+target = "192.0.2.2:1161"
+version = "3"
+sec_name = "mackerel"
+auth_protocol = "sha"
+auth_password = "authpassword"
+priv_protocol = "aes"
+priv_password = "privpassword"
+metric_prefix = "switch.edge"
+custom_identifier = "edge.example.com"
+timeout = "2s"
+[[plugin.snmp.edge.oids]]
+oid = "1.3.6.1.2.1.31.1.1.1.6.1"
+name = "if1.in_octets"
+type = "counter"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	core := config.SNMPPlugins["core"]
+	if core == nil || core.Target != "192.0.2.1:161" || core.Version != "2c" || core.Community != "public" || core.MetricPrefix != "core" || core.Service != "network" || core.Timeout != 5*time.Second {
+		t.Fatalf("unexpected plugin.snmp.core: %+v", core)
+	}
+	expected := []SNMPOID{
+		{OID: "1.3.6.1.2.1.2.2.1.10.1", Name: "if1.in_bits", Type: SNMPOIDCounter, Scale: 8},
+		{OID: ".1.3.6.1.4.1.2021.10.1.3.1", Name: "load1", Type: SNMPOIDGauge, Scale: 1},
+	}
+	if len(core.OIDs) != len(expected) {
+		t.Fatalf("unexpected oids: %+v", core.OIDs)
+	}
+	for i, oid := range core.OIDs {
+		if *oid != expected[i] {
+			t.Errorf("oid should be %+v but %+v", expected[i], oid)
+		}
+	}
+	edge := config.SNMPPlugins["edge"]
+	if edge == nil || edge.Target != "192.0.2.2:1161" || edge.AuthProtocol != "SHA" || edge.PrivProtocol != "AES" || edge.MetricPrefix != "switch.edge" || edge.Timeout != 2*time.Second || len(edge.OIDs) != 1 {
+		t.Errorf("unexpected plugin.snmp.edge: %+v", edge)
+	}
+	if ids := config.ListCustomIdentifiers(); len(ids) != 1 || ids[0] != "edge.example.com" {
+		t.Errorf("unexpected custom identifiers: %v", ids)
+	}
+
+	oids := `
+oids = [{ oid = "1.3.6.1.2.1.1.3.0", name = "uptime" }]`
+	for _, c := range []string{
+		oids,
+		`target = "192.0.2.1"`,
+		`target = "192.0.2.1"
+oids = [{ oid = "1.3.6.a", name = "uptime" }]`,
+		`target = "192.0.2.1"
+oids = [{ oid = "1.3.6.1.2.1.1.3.0", name = "up time" }]`,
+		`target = "192.0.2.1"
+oids = [{ oid = "1.3.6.1.2.1.1.3.0", name = "uptime", type = "rate" }]`,
+		`target = "192.0.2.1"
+version = "2"` + oids,
+		`target = "192.0.2.1"
+version = "3"` + oids,
+		`target = "192.0.2.1"
+version = "3"
+sec_name = "mackerel"
+auth_protocol = "sha"
+auth_password = "short"` + oids,
+		`target = "192.0.2.1"
+version = "3"
+sec_name = "mackerel"
+priv_protocol = "des"
+priv_password = "privpassword"` + oids,
+		`target = "192.0.2.1"
+service = "network"
+custom_identifier = "a"` + oids,
+		`target = "192.0.2.1"
+timeout = "60s"` + oids,
+	} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[plugin.snmp.invalid]
+` + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithWindowsPerfCounter(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.windows_perfcounter.sql]
+counters = [
+  '\SQLServer:Buffer Manager\Page life expectancy',
+  '\Process(sqlservr*)\% Processor Time',
+  '\238(_Total)\6',
+]
+instance_wildcard = true
+custom_identifier = "db.example.com"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	sql := config.WindowsPerfCounterPlugins["sql"]
+	if sql == nil || sql.MetricPrefix != "sql" || !sql.InstanceWildcard || len(sql.Counters) != 3 {
+		t.Fatalf("unexpected plugin.windows_perfcounter.sql: %+v", sql)
+	}
+	expected := []struct {
+		counter WindowsPerfCounter
+		name    string
+	}{
+		{WindowsPerfCounter{`\SQLServer:Buffer Manager\Page life expectancy`, "SQLServer:Buffer Manager", "", "Page life expectancy"}, "sql.SQLServer_Buffer_Manager.Page_life_expectancy"},
+		{WindowsPerfCounter{`\Process(sqlservr*)\% Processor Time`, "Process", "sqlservr*", "% Processor Time"}, "sql.Process.sqlservr_1.Processor_Time"},
+		{WindowsPerfCounter{`\238(_Total)\6`, "238", "_Total", "6"}, "sql.238._Total.6"},
+	}
+	for i, c := range sql.Counters {
+		if *c != expected[i].counter {
+			t.Errorf("counter should be %+v but %+v", expected[i].counter, c)
+		}
+		if name := c.MetricName(sql.MetricPrefix, "sqlservr#1"); name != expected[i].name {
+			t.Errorf("metric name should be %q but %q", expected[i].name, name)
+		}
+	}
+	if ids := config.ListCustomIdentifiers(); len(ids) != 1 || ids[0] != "db.example.com" {
+		t.Errorf("unexpected custom identifiers: %v", ids)
+	}
+
+	for _, c := range []string{
+		`metric_prefix = "a"`,
+		`counters = ['System\Processor Queue Length']`,
+		`counters = ['\\server\System\Processor Queue Length']`,
+		`counters = ['\System\']`,
+		`counters = ['\Process()\% Processor Time']`,
+		`counters = ['\Process(*\% Processor Time']`,
+		`counters = ['\*\% Processor Time']`,
+		`counters = ['\Process(*)\% Processor Time']`,
+		`counters = ['\Memory\% Committed Bytes In Use', '\Memory\Committed Bytes In Use']`,
+	} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[plugin.windows_perfcounter.invalid]
+` + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithOTLP(t *testing.T) {
+	testCases := []struct {
+		conf     string
+		endpoint string
+	}{
+		{`endpoint = "localhost:4318"`, "http://localhost:4318/v1/metrics"},
+		{`endpoint = "https://otel.example.com/otlp/v1/metrics"
+protocol = "http"`, "https://otel.example.com/otlp/v1/metrics"},
+		{`endpoint = "localhost:4317"
+protocol = "grpc"`, ""},
+		{`endpoint = "ftp://localhost:4318"`, ""},
+		{`endpoint = "localhost:4318"
+cert_file = "cert.pem"`, ""},
+		{`endpoint = "localhost:4318"
+sum_pattern = "("`, ""},
+		{`protocol = "http"`, ""},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[otlp]
+` + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if tc.endpoint == "" {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if config.OTLP.Endpoint != tc.endpoint || config.OTLP.Protocol != OTLPProtocolHTTP || config.OTLP.QueueSize != DefaultOTLPQueueSize {
+			t.Errorf("unexpected otlp: %+v", config.OTLP)
+		}
+	}
+}
+
+func TestLoadConfigWithHTTPPush(t *testing.T) {
+	testCases := []struct {
+		conf string
+		ok   bool
+	}{
+		{`listen = "127.0.0.1:24224"`, true},
+		{`listen = "[::1]:24224"`, true},
+		{`listen = "localhost:24224"`, true},
+		{`listen = "0.0.0.0:24224"
+allow_remote = true`, true},
+		{`listen = "0.0.0.0:24224"`, false},
+		{`listen = ":24224"`, false},
+		{`listen = "192.0.2.1:24224"`, false},
+		{`listen = "127.0.0.1"`, false},
+		{`allow_remote = true`, false},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[http_push]\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		_, err = LoadConfig(tmpFile.Name())
+		if tc.ok && err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("should raise error for %q", tc.conf)
+		}
+	}
+}
+
+func TestLoadConfigWithDebug(t *testing.T) {
+	testCases := []struct {
+		conf string
+		ok   bool
+	}{
+		{`listen = "127.0.0.1:6060"`, true},
+		{`listen = "0.0.0.0:6060"
+allow_remote = true`, true},
+		{`listen = "0.0.0.0:6060"`, false},
+		{`listen = "6060"`, false},
+		{``, false},
+		{`http_trace = true`, true},
+		{`http_trace = true
+http_trace_body_size = 1024`, true},
+		{`http_trace = true
+http_trace_body_size = -1`, false},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[debug]\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if tc.ok && (err != nil || config.Debug == nil) {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("should raise error for %q", tc.conf)
+		}
+	}
+}
+
+func TestLoadConfigWithHealth(t *testing.T) {
+	testCases := []struct {
+		conf       string
+		ok         bool
+		maxPostAge time.Duration
+	}{
+		{`listen = "127.0.0.1:8081"`, true, 0},
+		{`listen = "127.0.0.1:8081"
+max_post_age = "10m"`, true, 10 * time.Minute},
+		{`listen = "0.0.0.0:8081"`, false, 0},
+		{`listen = "127.0.0.1:8081"
+max_post_age = "30s"`, false, 0},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[health]\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if tc.maxPostAge == 0 && config.Health.MaxPostAge != nil {
+			t.Errorf("max_post_age should be nil but %v", config.Health.MaxPostAge)
+		}
+		if tc.maxPostAge != 0 && (config.Health.MaxPostAge == nil || config.Health.MaxPostAge.Duration != tc.maxPostAge) {
+			t.Errorf("max_post_age should be %s but %v", tc.maxPostAge, config.Health.MaxPostAge)
+		}
+	}
+}
+
+func TestLoadConfigWithListenerSecurity(t *testing.T) {
+	testCases := []struct {
+		conf string
+		ok   bool
+	}{
+		{`[health.auth]
+bearer_token = "s3cr3t"`, true},
+		{`[health.auth]
+username = "admin"
+password = "pass"`, true},
+		{`[health.auth]
+bearer_token = "s3cr3t"
+username = "admin"
+password = "pass"`, false},
+		{`[health.auth]
+username = "admin"`, false},
+		{`[health.auth]
+username = "ad:min"
+password = "pass"`, false},
+		{`[health.auth]`, false},
+		{`[health.tls]
+cert_file = "/etc/mackerel-agent/server.crt"
+key_file = "/etc/mackerel-agent/server.key"
+client_ca_file = "/etc/mackerel-agent/ca.crt"`, true},
+		{`[health.tls]
+cert_file = "/etc/mackerel-agent/server.crt"`, false},
+		{`[health.tls]
+client_ca_file = "/etc/mackerel-agent/ca.crt"`, false},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[health]\nlisten = \"127.0.0.1:8081\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		_, err = LoadConfig(tmpFile.Name())
+		if tc.ok && err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("should raise error for %q", tc.conf)
+		}
+	}
+
+	tmpFile, err := newTempFileWithContent(`apikey = "abcde"
+[http_push]
+listen = "0.0.0.0:24224"
+allow_remote = true
+[http_push.auth]
+bearer_token = "push-token"
+[debug]
+listen = "127.0.0.1:6060"
+[debug.auth]
+username = "admin"
+password = "pass"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.HTTPPush.Auth == nil || config.HTTPPush.Auth.BearerToken != "push-token" {
+		t.Errorf("http_push.auth should be loaded: %+v", config.HTTPPush.Auth)
+	}
+	if config.Debug.Auth == nil || config.Debug.Auth.Username != "admin" || config.Debug.Auth.Password != "pass" {
+		t.Errorf("debug.auth should be loaded: %+v", config.Debug.Auth)
+	}
+}
+
+func TestLoadConfigWithLifecycleAnnotation(t *testing.T) {
+	testCases := []struct {
+		conf       string
+		ok         bool
+		maxPerHour int
+	}{
+		{`service = "web"`, true, DefaultLifecycleAnnotationMaxPerHour},
+		{`service = "web"
+roles = ["app", "db"]
+max_per_hour = 2`, true, 2},
+		{`roles = ["app"]`, false, 0},
+		{`service = "web"
+roles = ["web:app"]`, false, 0},
+		{`service = "web"
+max_per_hour = -1`, false, 0},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[lifecycle_annotation]\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if config.LifecycleAnnotation.MaxPerHour != tc.maxPerHour {
+			t.Errorf("max_per_hour should be %d but got %d", tc.maxPerHour, config.LifecycleAnnotation.MaxPerHour)
+		}
+	}
+}
+
+func TestLoadConfigWithFluentd(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[fluentd]
+port = 24225
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expected := Fluentd{Host: DefaultFluentdHost, Port: 24225, Tag: DefaultFluentdTag, QueueSize: DefaultFluentdQueueSize}
+	if *config.Fluentd != expected {
+		t.Errorf("unexpected fluentd: %+v", config.Fluentd)
+	}
+
+	for _, c := range []string{"port = 65536", "queue_size = -1"} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[fluentd]\n" + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithStatsd(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[statsd]
+listen = "127.0.0.1:8125"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.Statsd == nil || config.Statsd.Listen != "127.0.0.1:8125" || config.Statsd.ListenTCP != "" {
+		t.Fatalf("unexpected statsd: %+v", config.Statsd)
+	}
+	if !reflect.DeepEqual(config.Statsd.Percentiles, DefaultStatsdPercentiles) || config.Statsd.MaxNames != DefaultStatsdMaxNames || config.Statsd.GaugeTTL.Duration != DefaultStatsdGaugeTTL {
+		t.Errorf("the default values should be set: %+v", config.Statsd)
+	}
+
+	for _, c := range []string{`listen_tcp = "127.0.0.1:8125"`, `listen = "127.0.0.1:8125"
+percentiles = [0.0]`, `listen = "127.0.0.1:8125"
+max_names = -1`, `listen = "127.0.0.1:8125"
+gauge_ttl = "-1m"`} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[statsd]
+` + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithIPMI(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[ipmi]
+options = ["-I", "open"]
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.IPMI == nil || !reflect.DeepEqual(config.IPMI.Options, []string{"-I", "open"}) {
+		t.Fatalf("unexpected ipmi: %+v", config.IPMI)
+	}
+	if config.IPMI.Command != DefaultIPMICommand || config.IPMI.Mode != IPMIModeSensor ||
+		config.IPMI.Interval.Duration != DefaultIPMIInterval || config.IPMI.Timeout.Duration != DefaultIPMITimeout {
+		t.Errorf("the default values should be set: %+v", config.IPMI)
+	}
+
+	for _, c := range []string{`mode = "elist"`, `interval = "30s"`, `timeout = "0s"`, `timeout = "2m"`} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[ipmi]
+` + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithSecondary(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[secondary]
+apikey = "fghij"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.Secondary == nil || config.Secondary.Apikey != "fghij" {
+		t.Fatalf("unexpected secondary: %+v", config.Secondary)
+	}
+	if config.Secondary.Apibase != config.Apibase {
+		t.Errorf("secondary.apibase should default to apibase: %s", config.Secondary.Apibase)
+	}
+
+	tmpFile2, err := newTempFileWithContent(`
+apikey = "abcde"
+[secondary]
+apibase = "https://secondary.example.com"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile2.Name())
+	if _, err := LoadConfig(tmpFile2.Name()); err == nil {
+		t.Error("should raise error without secondary.apikey")
+	}
+}
+
+func TestFileSystemHostIDStorage_Suffix(t *testing.T) {
+	s := FileSystemHostIDStorage{Root: "/tmp/mackerel-agent", Suffix: SecondaryIDFileSuffix}
+	if f := s.HostIDFile(); f != filepath.Join("/tmp/mackerel-agent", "id.secondary") {
+		t.Errorf("unexpected id file: %s", f)
+	}
+}
+
+func TestLoadConfigWithCheckReportResendInterval(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+check_report_resend_interval = "10m"
+check_state_max_age = "6h"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.CheckReportResendInterval == nil || config.CheckReportResendInterval.Duration != 10*time.Minute {
+		t.Errorf("unexpected check_report_resend_interval: %v", config.CheckReportResendInterval)
+	}
+	if config.CheckStateMaxAge == nil || config.CheckStateMaxAge.Duration != 6*time.Hour {
+		t.Errorf("unexpected check_state_max_age: %v", config.CheckStateMaxAge)
+	}
+}
+
+func TestLoadConfigWithPluginMaxOutputBytes(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+plugin_max_stdout_bytes = 1048576
+plugin_max_stderr_bytes = 1024
+
+[plugin.metrics.foo]
+command = "foo"
+
+[plugin.checks.bar]
+command = "bar"
+action = { command = "baz" }
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	for _, cmd := range []Command{config.MetricPlugins["foo"].Command, config.CheckPlugins["bar"].Command, config.CheckPlugins["bar"].Action.Command} {
+		if cmd.MaxStdoutBytes != 1048576 || cmd.MaxStderrBytes != 1024 {
+			t.Errorf("the limits should be set to %q: %d, %d", cmd.CommandString(), cmd.MaxStdoutBytes, cmd.MaxStderrBytes)
+		}
+	}
+
+	invalid, err := newTempFileWithContent(`
+apikey = "abcde"
+plugin_max_stdout_bytes = 0
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(invalid.Name())
+	if _, err := LoadConfig(invalid.Name()); err == nil {
+		t.Error("plugin_max_stdout_bytes should be positive")
+	}
+}
+
+func TestLoadConfigWithCloudDetectionTimeout(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+cloud_detection_timeout = "1s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.CloudDetectionTimeout == nil || config.CloudDetectionTimeout.Duration != time.Second {
+		t.Errorf("unexpected cloud_detection_timeout: %v", config.CloudDetectionTimeout)
+	}
+
+	invalid, err := newTempFileWithContent(`
+apikey = "abcde"
+cloud_detection_timeout = "0s"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(invalid.Name())
+	if _, err := LoadConfig(invalid.Name()); err == nil {
+		t.Error("cloud_detection_timeout should be positive")
+	}
+}
+
+func TestLoadConfigWithHostSpecsExpensiveInterval(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+host_specs_expensive_interval = "12h"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.HostSpecsExpensiveInterval == nil || config.HostSpecsExpensiveInterval.Duration != 12*time.Hour {
+		t.Errorf("unexpected host_specs_expensive_interval: %v", config.HostSpecsExpensiveInterval)
+	}
+
+	invalid, err := newTempFileWithContent(`
+apikey = "abcde"
+host_specs_expensive_interval = "-1h"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(invalid.Name())
+	if _, err := LoadConfig(invalid.Name()); err == nil {
+		t.Error("the negative host_specs_expensive_interval should be an error")
+	}
+}
+
+func TestLoadConfigWithMetricsConcurrency(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+metrics_concurrency = 4
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.MetricsConcurrency != 4 {
+		t.Errorf("unexpected metrics_concurrency: %v", config.MetricsConcurrency)
+	}
+
+	tmpFile, err = newTempFileWithContent(`
+apikey = "abcde"
+metrics_concurrency = -1
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the negative metrics_concurrency")
+	}
+}
+
+func TestLoadConfigWithMetricNameCollision(t *testing.T) {
+	for content, expect := range map[string]MetricNameCollision{
+		"": MetricNameCollisionLastWins,
+		`metric_name_collision = "prefix_plugin"`: MetricNameCollisionPrefixPlugin,
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if config.MetricNameCollision != expect {
+			t.Errorf("metric_name_collision should be %q but got %q", expect, config.MetricNameCollision)
+		}
+	}
+
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\nmetric_name_collision = \"ignore\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the unknown metric_name_collision")
+	}
+}
+
+func TestLoadConfigWithCounterWrap(t *testing.T) {
+	for content, expect := range map[string]CounterWrap{
+		"":                      CounterWrapAuto,
+		`counter_wrap = "drop"`: CounterWrapDrop,
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if config.CounterWrap != expect {
+			t.Errorf("counter_wrap should be %q but got %q", expect, config.CounterWrap)
+		}
+	}
+
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\ncounter_wrap = \"32bit\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the unknown counter_wrap")
+	}
+}
+
+func TestLoadConfigWithWindowsCPUBackend(t *testing.T) {
+	testCases := []struct {
+		conf   string
+		ok     bool
+		expect WindowsCPUBackend
+	}{
+		{``, true, WindowsCPUBackendAuto},
+		{`windows_cpu_backend = "auto"`, true, WindowsCPUBackendAuto},
+		{`windows_cpu_backend = "pdh"`, runtime.GOOS == "windows", WindowsCPUBackendPDH},
+		{`windows_cpu_backend = "system_times"`, runtime.GOOS == "windows", WindowsCPUBackendSystemTimes},
+		{`windows_cpu_backend = "wmi"`, false, ""},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if config.WindowsCPUBackend != tc.expect {
+			t.Errorf("windows_cpu_backend should be %q but got %q", tc.expect, config.WindowsCPUBackend)
+		}
+	}
+}
+
+func TestResolveBindAddress(t *testing.T) {
+	if ip, err := ResolveBindAddress(""); err != nil || ip != nil {
+		t.Errorf("the empty bind_address should be nil: %v, %v", ip, err)
+	}
+	if ip, err := ResolveBindAddress("127.0.0.1"); err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("the loopback address should be resolved: %v, %v", ip, err)
+	}
+	for _, s := range []string{"192.0.2.123", "127.0.0.1:8080", "no-such-interface0"} {
+		if _, err := ResolveBindAddress(s); err == nil {
+			t.Errorf("should raise error for %q", s)
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		ip, err := ResolveBindAddress(iface.Name)
+		if err != nil {
+			t.Errorf("the loopback interface %s should be resolved: %s", iface.Name, err)
+		} else if !ip.IsLoopback() {
+			t.Errorf("the address of %s should be loopback but got %s", iface.Name, ip)
+		}
+		break
+	}
+
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\nbind_address = \"192.0.2.123\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil || !strings.Contains(err.Error(), "not assigned") {
+		t.Errorf("should raise error for the address not assigned: %v", err)
+	}
+}
+
+func TestLoadConfigWithDuplicateInstance(t *testing.T) {
+	for content, expect := range map[string]DuplicateInstance{
+		"":                              DuplicateInstanceIgnore,
+		`duplicate_instance = "warn"`:   DuplicateInstanceWarn,
+		`duplicate_instance = "stop"`:   DuplicateInstanceStop,
+		`duplicate_instance = "ignore"`: DuplicateInstanceIgnore,
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if config.DuplicateInstance != expect {
+			t.Errorf("duplicate_instance should be %q but got %q", expect, config.DuplicateInstance)
+		}
+	}
+
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\nduplicate_instance = \"terminate\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the unknown duplicate_instance")
+	}
+}
+
+func TestLoadConfigWithOrphanPlugins(t *testing.T) {
+	for content, expect := range map[string]OrphanPlugins{
+		"":                             OrphanPluginsWarn,
+		`orphan_plugins = "terminate"`: OrphanPluginsTerminate,
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if config.OrphanPlugins != expect {
+			t.Errorf("orphan_plugins should be %q but got %q", expect, config.OrphanPlugins)
+		}
+	}
+
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\norphan_plugins = \"kill\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the unknown orphan_plugins")
+	}
+}
+
+func TestPluginCommandLines(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`apikey = "abcde"
+[plugin.metrics.foo]
+command = "foo --bar"
+[plugin.metrics.foo2]
+command = "foo --bar"
+[plugin.checks.baz]
+command = ["/usr/bin/baz", "-x"]
+[plugin.metadata.qux]
+command = "qux"
+user = "nobody"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expect := []string{"/usr/bin/baz -x", "foo --bar"}
+	if lines := config.PluginCommandLines(); !reflect.DeepEqual(lines, expect) {
+		t.Errorf("the command lines run as the agent should be %v but got %v", expect, lines)
+	}
+}
+
+func TestLoadConfigWithStatusFile(t *testing.T) {
+	for content, expect := range map[string]os.FileMode{
+		`status_file = "/var/run/mackerel-agent/status.json"`:                                DefaultStatusFilePerm,
+		"status_file = \"/var/run/mackerel-agent/status.json\"\nstatus_file_mode = \"0600\"": 0600,
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		config, err := LoadConfig(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		if config.StatusFile != "/var/run/mackerel-agent/status.json" {
+			t.Errorf("unexpected status_file: %q", config.StatusFile)
+		}
+		if config.StatusFilePerm != expect {
+			t.Errorf("the permission of the status file should be %o but got %o", expect, config.StatusFilePerm)
+		}
+	}
+
+	for _, mode := range []string{"rw-r--r--", "0999", "01777"} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\nstatus_file_mode = \"" + mode + "\"\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for status_file_mode %q", mode)
+		}
+	}
+}
+
+func TestLoadConfigWithAPITimeouts(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[api_timeouts]
+checks = "10s"
+metadata = "1m"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if c := config.APITimeouts; c == nil || c.Checks.Duration != 10*time.Second || c.Metadata.Duration != time.Minute || c.Metrics != nil {
+		t.Errorf("unexpected api_timeouts: %+v", c)
+	}
+
+	tmpFile, err = newTempFileWithContent("apikey = \"abcde\"\n[api_timeouts]\nhost_specs = \"0s\"\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the zero timeout")
+	}
+}
+
+func TestLoadConfigWithCompression(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+disable_compression = true
+compression_threshold = 8192
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if !config.DisableCompression {
+		t.Error("disable_compression should be true")
+	}
+	if config.CompressionThreshold == nil || *config.CompressionThreshold != 8192 {
+		t.Errorf("unexpected compression_threshold: %v", config.CompressionThreshold)
+	}
+}
+
+func TestLoadConfigWithRateLimit(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+rate_limit = 0.5
+rate_limit_burst = 3
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.RateLimit != 0.5 {
+		t.Errorf("unexpected rate_limit: %v", config.RateLimit)
+	}
+	if config.RateLimitBurst == nil || *config.RateLimitBurst != 3 {
+		t.Errorf("unexpected rate_limit_burst: %v", config.RateLimitBurst)
+	}
+
+	tmpFile, err = newTempFileWithContent(`
+apikey = "abcde"
+rate_limit = 1
+rate_limit_burst = 0
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("should raise error for the zero rate_limit_burst")
+	}
+}
+
+func TestLoadConfigWithDisableSelfMetrics(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+disable_self_metrics = true
+adjust_clock_skew = true
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if !config.DisableSelfMetrics {
+		t.Error("disable_self_metrics should be true")
+	}
+	if !config.AdjustClockSkew {
+		t.Error("adjust_clock_skew should be true")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(sampleConfig)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := loadConfigFile(tmpFile.Name())
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+
+	if config.Apikey != "abcde" {
+		t.Error("Apikey should be abcde")
+	}
+
+	if config.DisplayName != "fghij" {
+		t.Error("DisplayName should be fghij")
+	}
+
+	if config.Diagnostic != true {
+		t.Error("Diagnostic should be true")
+	}
+
+	if config.MetricPlugins == nil {
+		t.Error("plugin should have metrics")
+	}
+	pluginConf := config.MetricPlugins["mysql"]
+	if pluginConf.Command.Cmd != "ruby /path/to/your/plugin/mysql.rb" {
+		t.Errorf("plugin conf command should be 'ruby /path/to/your/plugin/mysql.rb' but %v", pluginConf.Command.Cmd)
+	}
+	if pluginConf.Command.User != "mysql" {
+		t.Error("plugin user_name should be 'mysql'")
+	}
+	if *pluginConf.CustomIdentifier != "app1.example.com" {
+		t.Errorf("plugin custom_identifier should be 'app1.example.com' but got %v", *pluginConf.CustomIdentifier)
+	}
+	if pluginConf.Command.TimeoutDuration != 60*time.Second {
+		t.Error("plugin timeout_seconds should be 60s")
+	}
+	customIdentifiers := config.ListCustomIdentifiers()
+	if len(customIdentifiers) != 2 {
+		t.Errorf("config should have 2 custom_identifier")
+	}
+	// In fact they should be [app1, app2], but we don't mind their order here
+	if customIdentifiers[0] != "app1.example.com" && customIdentifiers[1] != "app1.example.com" {
+		t.Errorf("custom_identifier should include 'app1.example.com'")
+	}
+	if customIdentifiers[0] != "app2.example.com" && customIdentifiers[1] != "app2.example.com" {
+		t.Errorf("custom_identifier should include 'app2.example.com'")
+	}
+	if pluginConf.IncludePattern != nil {
+		t.Errorf("plugin include_pattern should be nil but got %v", pluginConf.IncludePattern)
+	}
+	if pluginConf.ExcludePattern != nil {
+		t.Errorf("plugin exclude_pattern should be nil but got %v", pluginConf.ExcludePattern)
+	}
+
+	pluginConf2 := config.MetricPlugins["mysql2"]
+	if pluginConf2.IncludePattern.String() != regexp.MustCompile(`^mysql\.innodb\..+`).String() {
+		t.Errorf("unexpected include_pattern: %v", pluginConf2.IncludePattern)
+	}
+	if pluginConf2.ExcludePattern.String() != regexp.MustCompile(`^mysql\.innodb\.ignore`).String() {
+		t.Errorf("unexpected exclude_pattern: %v", pluginConf2.ExcludePattern)
+	}
+
+	pluginConf3 := config.MetricPlugins["mysql3"]
+	if pluginConf3.Command.Env == nil {
+		t.Error("config should have env")
+	}
+	if len(pluginConf3.Command.Env) != 2 {
+		t.Errorf("env should have 2 keys: %v", pluginConf3.Command.Env)
+	}
+	if !expectContainsString(pluginConf3.Command.Env, "MYSQL_USERNAME=USERNAME") {
+		t.Errorf("Command.Env should contain 'MYSQL_USERNAME=USERNAME'")
+	}
+	if !expectContainsString(pluginConf3.Command.Env, "MYSQL_PASSWORD=PASSWORD") {
+		t.Errorf("Command.Env should contain 'MYSQL_PASSWORD=PASSWORD'")
+	}
+
+	if config.CheckPlugins == nil {
+		t.Error("plugin should have checks")
+	}
+	checks := config.CheckPlugins["heartbeat"]
+	if checks.Command.Cmd != "heartbeat.sh" {
+		t.Error("check command should be 'heartbeat.sh'")
+	}
+	if checks.Command.User != "xyz" {
+		t.Error("check user_name should be 'xyz'")
+	}
+	if checks.Command.TimeoutDuration != 60*time.Second {
+		t.Error("check timeout_seconds should be 60s")
+	}
+	if *checks.NotificationInterval != 60 {
+		t.Error("notification_interval should be 60")
+	}
+	if *checks.MaxCheckAttempts != 3 {
+		t.Error("max_check_attempts should be 3")
+	}
+	if checks.Action.Cmd != "cardiac_massage" {
+		t.Error("action.command should be 'cardiac_massage'")
+	}
+	if checks.Action.User != "doctor" {
+		t.Error("action.user should be 'doctor'")
+	}
+	if checks.Action.MaxTriggerPerHour != 3 {
+		t.Error("action.max_trigger_per_hour should be 3")
+	}
+	if expected := ""; checks.Memo != expected {
+		t.Errorf("memo should be %q but got %q", expected, checks.Memo)
+	}
+
+	checks2 := config.CheckPlugins["heartbeat2"]
+	if checks2.Command.Env == nil {
+		t.Error("config should have env of check plugin")
+	}
+	if len(checks2.Command.Env) != 1 {
+		t.Errorf("env of check plugin should have a key: %v", checks2.Command.Env)
+	}
+	if !expectContainsString(checks2.Command.Env, "ES_HOSTS=10.45.3.2:9220,10.45.3.1:9230") {
+		t.Errorf("Command.Env should contain 'ES_HOSTS=10.45.3.2:9220,10.45.3.1:9230'")
+	}
+	if checks2.Action.Env == nil {
+		t.Error("config should have action.env of check plugin")
+	}
+	if len(checks2.Action.Env) != 3 {
+		t.Errorf("action.env of check plugin should have 3 keys: %v", checks2.Action.Env)
+	}
+	if !expectContainsString(checks2.Action.Env, "NAME_1=VALUE_1") {
+		t.Errorf("Command.Env should contain 'NAME_1=VALUE_1'")
+	}
+	if checks2.Action.MaxTriggerPerHour != DefaultActionMaxTriggerPerHour {
+		t.Errorf("action.max_trigger_per_hour should be %d by default but %d", DefaultActionMaxTriggerPerHour, checks2.Action.MaxTriggerPerHour)
+	}
+	if !expectContainsString(checks2.Action.Env, "NAME_2=VALUE_2") {
+		t.Errorf("Command.Env should contain 'NAME_2=VALUE_2'")
+	}
+
+	checks3 := config.CheckPlugins["heartbeat3"]
+	if checks3.Action != nil {
+		t.Error("config should not have action of check plugin")
+	}
+	if checks3.MaxOutputBytes == nil || *checks3.MaxOutputBytes != 512 {
+		t.Error("max_output_bytes should be 512")
+	}
+	if checks.MaxOutputBytes != nil {
+		t.Error("max_output_bytes should be nil by default")
+	}
+	if checks3.CustomIdentifier != nil {
+		t.Error("config should not have customIdentifier")
+	}
+
+	checks4 := config.CheckPlugins["heartbeat4"]
+	if checks4.CustomIdentifier == nil || *checks4.CustomIdentifier != "app2.example.com" {
+		t.Error("config should have customIdentifier 'app2.example.com'")
+	}
+
+	if config.MetadataPlugins == nil {
+		t.Error("config should have metadata plugin list")
+	}
+	metadataPlugin := config.MetadataPlugins["hostinfo"]
+	if metadataPlugin.Command.Cmd != "hostinfo.sh" {
+		t.Errorf("command of metadata plugin should be 'hostinfo.sh' but got '%v'", metadataPlugin.Command.Cmd)
+	}
+	if metadataPlugin.Command.User != "zzz" {
+		t.Errorf("user of metadata plugin should be 'zzz' but got '%v'", metadataPlugin.Command.User)
+	}
+	if *metadataPlugin.ExecutionInterval != 60 {
+		t.Errorf("execution interval of metadata plugin should be 60 but got '%v'", *metadataPlugin.ExecutionInterval)
+	}
+	if metadataPlugin.Command.TimeoutDuration != 60*time.Second {
+		t.Errorf("timeout duration of metadata plugin should be 60s, but got '%v'",
+			metadataPlugin.Command.TimeoutDuration)
+	}
+
+	metadataPlugin2 := config.MetadataPlugins["hostinfo2"]
 	if metadataPlugin2.Command.Env == nil {
 		t.Error("config should have env of metadata plugin")
 	}
-	if len(metadataPlugin2.Command.Env) != 1 {
-		t.Errorf("env of metadata plugin should have a key: %v", metadataPlugin2.Command.Env)
+	if len(metadataPlugin2.Command.Env) != 1 {
+		t.Errorf("env of metadata plugin should have a key: %v", metadataPlugin2.Command.Env)
+	}
+	if !expectContainsString(metadataPlugin2.Command.Env, "NAME_1=VALUE_1") {
+		t.Errorf("Command.Env should contain 'NAME_1=VALUE_1'")
+	}
+
+	if config.Plugin != nil {
+		t.Error("plugin config should be set nil, use MetricPlugins, CheckPlugins and MetadataPlugins instead")
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func assert(t *testing.T, ok bool, msg string) {
+	if !ok {
+		t.Error(msg)
+	}
+}
+
+var tomlQuotedReplacer = strings.NewReplacer(
+	"\t", "\\t",
+	"\n", "\\n",
+	"\r", "\\r",
+	"\"", "\\\"",
+	"\\", "\\\\",
+)
+
+func TestLoadConfigFileInclude(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	includedFile, err := os.Create(filepath.Join(configDir, "sub1.conf"))
+	assertNoError(t, err)
+
+	configContent := fmt.Sprintf(`
+apikey = "abcde"
+pidfile = "/path/to/pidfile"
+root = "/var/lib/mackerel-agent"
+verbose = false
+
+roles = [ "roles", "to be overwritten" ]
+
+include = "%s/*.conf"
+
+[plugin.metrics.foo1]
+command = "foo1"
+
+[plugin.metrics.bar]
+command = "this will be overwritten"
+`, tomlQuotedReplacer.Replace(configDir))
+
+	configFile, err := newTempFileWithContent(configContent)
+	assertNoError(t, err)
+	defer os.Remove(configFile.Name())
+
+	includedContent := `
+roles = [ "Service:role" ]
+
+[plugin.metrics.foo2]
+command = "foo2"
+
+[plugin.metrics.bar]
+command = "bar"
+`
+
+	_, err = includedFile.WriteString(includedContent)
+	assertNoError(t, err)
+	includedFile.Close()
+
+	config, err := loadConfigFile(configFile.Name())
+	assertNoError(t, err)
+
+	assert(t, config.Apikey == "abcde", "apikey should be kept as it is when not configured in the included file")
+	assert(t, config.Pidfile == "/path/to/pidfile", "pidfile should be kept as it is when not configured in the included file")
+	assert(t, config.Root == "/var/lib/mackerel-agent", "root should be kept as it is when not configured in the included file")
+	assert(t, config.Verbose == false, "verbose should be kept as it is when not configured in the included file")
+	assert(t, len(config.Roles) == 1, "roles should be overwritten")
+	assert(t, config.Roles[0] == "Service:role", "roles should be overwritten")
+	assert(t, config.MetricPlugins["foo1"].Command.Cmd == "foo1", "plugin.metrics.foo1 should exist")
+	assert(t, config.MetricPlugins["foo2"].Command.Cmd == "foo2", "plugin.metrics.foo2 should exist")
+	assert(t, config.MetricPlugins["bar"].Command.Cmd == "bar", "plugin.metrics.bar should be overwritten")
+	assert(t, len(config.DuplicatePlugins()) == 1 && config.DuplicatePlugins()[0].Section == "plugin.metrics.bar", "plugin.metrics.bar should be detected as duplicate")
+}
+
+func TestLoadInstanceConfig(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	conffile := filepath.Join(configDir, "mackerel-agent.conf")
+	assertNoError(t, ioutil.WriteFile(conffile, []byte(`
+apikey = "abcde"
+root = "/var/lib/mackerel-agent"
+pidfile = "/var/run/mackerel-agent.pid"
+display_name = "db01"
+
+[plugin.metrics.postgres]
+command = "mackerel-plugin-postgres -port 5432"
+`), 0600))
+
+	config, err := LoadInstanceConfig(conffile, "pg-main")
+	assertNoError(t, err)
+	assert(t, config.InstanceSuffix == "pg-main", "the instance suffix should be set")
+	assert(t, config.Root == filepath.Clean("/var/lib/mackerel-agent-pg-main"), "root should be suffixed")
+	assert(t, config.Pidfile == filepath.Clean("/var/run/mackerel-agent-pg-main.pid"), "pidfile should be suffixed")
+	assert(t, config.DisplayName == "db01-pg-main", "display_name should be suffixed")
+	assert(t, config.InstanceName("db01") == "db01-pg-main", "the hostname should be suffixed")
+	assert(t, config.InstanceCustomIdentifier("i-0123") == "i-0123-pg-main", "the custom identifier should be suffixed")
+
+	instanceFile := InstanceConfigFile(conffile, "pg-replica")
+	assert(t, instanceFile == filepath.Join(configDir, "mackerel-agent.pg-replica.conf"), "unexpected config file of the instance: "+instanceFile)
+	assertNoError(t, ioutil.WriteFile(instanceFile, []byte(`
+display_name = "db01 replica"
+host_identity = "custom_identifier"
+custom_identifier = "db01-replica"
+
+[plugin.metrics.postgres]
+command = "mackerel-plugin-postgres -port 5433"
+`), 0600))
+	config, err = LoadInstanceConfig(conffile, "pg-replica")
+	assertNoError(t, err)
+	assert(t, config.Root == filepath.Clean("/var/lib/mackerel-agent-pg-replica"), "root should be suffixed")
+	assert(t, config.DisplayName == "db01 replica", "display_name of the instance should not be suffixed")
+	assert(t, config.InstanceCustomIdentifier("db01-replica") == "db01-replica", "custom_identifier of the instance should not be suffixed")
+	assert(t, config.MetricPlugins["postgres"].Command.Cmd == "mackerel-plugin-postgres -port 5433", "the plugin should be overridden by the instance")
+
+	config, err = LoadConfig(conffile)
+	assertNoError(t, err)
+	assert(t, config.Root == "/var/lib/mackerel-agent" && config.InstanceName("db01") == "db01", "the agent should not be an instance without the suffix")
+
+	_, err = LoadInstanceConfig(conffile, "../pg")
+	assert(t, err != nil, "the invalid instance suffix should be an error")
+}
+
+func TestLoadConfigWithDuplicatePlugins(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	writeFile := func(name, content string) string {
+		file := filepath.Join(configDir, name)
+		assertNoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+		return file
+	}
+	app1 := writeFile("app1.conf", `
+[plugin.checks.same]
+command = "same"
+
+[plugin.checks.bar]
+command = "bar1"
+`)
+	app2 := writeFile("app2.conf", `
+[plugin.checks.disabled]
+command = "disabled"
+
+[plugin.checks."bar"]
+command = "bar2"
+
+[plugin.metrics.bar]
+command = "bar"
+`)
+
+	main := func(onDuplicate string) string {
+		return writeFile("main.toml", fmt.Sprintf(`
+apikey = "abcde"
+include = "%s/*.conf"
+%s
+
+[plugin.checks.same]
+command = "same"
+
+[plugin.checks.disabled]
+command = "other"
+enabled = false
+
+[plugin.checks.bar]
+command = "bar"
+`, tomlQuotedReplacer.Replace(configDir), onDuplicate))
+	}
+
+	_, err = LoadConfig(main(""))
+	if err == nil {
+		t.Fatal("the duplicate plugins should be an error by default")
+	}
+	mainFile := filepath.Join(configDir, "main.toml")
+	for _, s := range []string{
+		"plugin.checks.bar: " + mainFile + ":13 and " + app1 + ":5\n",
+		"plugin.checks.bar: " + app1 + ":5 and " + app2 + ":5",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("the error should contain %q but got: %s", s, err)
+		}
+	}
+	if strings.Contains(err.Error(), "same") || strings.Contains(err.Error(), "disabled") || strings.Contains(err.Error(), "metrics") {
+		t.Errorf("the identical, the disabled and the other kinds of plugins should not be duplicate: %s", err)
+	}
+
+	config, err := LoadConfig(main(`on_duplicate = "suffix"`))
+	assertNoError(t, err)
+	expected := map[string]string{"same": "same", "disabled": "disabled", "bar": "bar", "bar_app1": "bar1", "bar_app2": "bar2"}
+	if len(config.CheckPlugins) != len(expected) {
+		t.Errorf("the check plugins should be %v but got %v", expected, config.CheckPlugins)
+	}
+	for name, cmd := range expected {
+		if p, ok := config.CheckPlugins[name]; !ok || p.Command.Cmd != cmd {
+			t.Errorf("plugin.checks.%s should be %q but got %+v", name, cmd, p)
+		}
+	}
+	duplicates := config.DuplicatePlugins()
+	if len(duplicates) != 2 {
+		t.Fatalf("the duplicate plugins should be listed: %v", duplicates)
+	}
+	if d := duplicates[1]; d.Renamed != "plugin.checks.bar_app2" || d.First != (PluginSource{File: mainFile, Line: 13}) || d.Second != (PluginSource{File: app2, Line: 5}) {
+		t.Errorf("the duplicate plugin should be renamed with the locations: %v", d)
+	}
+
+	_, err = LoadConfig(main(`on_duplicate = "rename"`))
+	if err == nil || !strings.Contains(err.Error(), "on_duplicate should be") {
+		t.Errorf("the invalid on_duplicate should be an error: %v", err)
+	}
+}
+
+func TestLoadConfigWithHTTPHeaders(t *testing.T) {
+	os.Setenv("MACKEREL_AGENT_TEST_PROXY_TOKEN", "s3cr3t")
+	defer os.Unsetenv("MACKEREL_AGENT_TEST_PROXY_TOKEN")
+
+	configFile, err := newTempFileWithContent(`
+apikey = "abcde"
+user_agent_suffix = "deploy/${MACKEREL_AGENT_TEST_PROXY_TOKEN}"
+
+[http_headers]
+x-proxy-authorization = "Bearer ${MACKEREL_AGENT_TEST_PROXY_TOKEN}"
+X-Team = "infra"
+`)
+	assertNoError(t, err)
+	defer os.Remove(configFile.Name())
+
+	config, err := LoadConfig(configFile.Name())
+	assertNoError(t, err)
+	if config.UserAgentSuffix != "deploy/s3cr3t" {
+		t.Errorf("user_agent_suffix should be expanded: %q", config.UserAgentSuffix)
+	}
+	expected := map[string]string{"X-Proxy-Authorization": "Bearer s3cr3t", "X-Team": "infra"}
+	if !reflect.DeepEqual(config.HTTPHeaders, expected) {
+		t.Errorf("http_headers should be canonicalized and expanded: %v", config.HTTPHeaders)
+	}
+
+	tests := []struct {
+		headers string
+		message string
+	}{
+		{`X-API-KEY = "foo"`, "should not override X-Api-Key"},
+		{`content-type = "text/plain"`, "should not override Content-Type"},
+		{`Content-Encoding = "identity"`, "should not override Content-Encoding"},
+		{`User-Agent = "foo"`, "use user_agent_suffix"},
+		{`"X Team" = "foo"`, "invalid header name"},
+		{`"X-Team:" = "foo"`, "invalid header name"},
+		{`X-Team = "foo\r\nX-Evil: bar"`, "should not contain newlines"},
+		{"X-Team = \"foo\"\nx-team = \"bar\"", "duplicated"},
+	}
+	for _, tc := range tests {
+		configFile, err := newTempFileWithContent("apikey = \"abcde\"\n[http_headers]\n" + tc.headers + "\n")
+		assertNoError(t, err)
+		defer os.Remove(configFile.Name())
+		_, err = LoadConfig(configFile.Name())
+		if err == nil || !strings.Contains(err.Error(), tc.message) {
+			t.Errorf("%s should be invalid with %q: %v", tc.headers, tc.message, err)
+		}
+	}
+}
+
+func TestLoadConfigWithPostMetricsLimits(t *testing.T) {
+	configFile, err := newTempFileWithContent(`
+apikey = "abcde"
+post_metrics_max_values = 5000
+post_metrics_max_bytes = 524288
+`)
+	assertNoError(t, err)
+	defer os.Remove(configFile.Name())
+
+	config, err := LoadConfig(configFile.Name())
+	assertNoError(t, err)
+	if config.PostMetricsMaxValues == nil || *config.PostMetricsMaxValues != 5000 {
+		t.Errorf("post_metrics_max_values should be 5000: %v", config.PostMetricsMaxValues)
+	}
+	if config.PostMetricsMaxBytes == nil || *config.PostMetricsMaxBytes != 524288 {
+		t.Errorf("post_metrics_max_bytes should be 524288: %v", config.PostMetricsMaxBytes)
+	}
+
+	for _, content := range []string{"post_metrics_max_values = 0", "post_metrics_max_bytes = 1024"} {
+		configFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + content + "\n")
+		assertNoError(t, err)
+		defer os.Remove(configFile.Name())
+		if _, err := LoadConfig(configFile.Name()); err == nil {
+			t.Errorf("%s should be invalid", content)
+		}
+	}
+}
+
+func TestLoadConfigWithDisabledPlugins(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	configFile, err := newTempFileWithContent(fmt.Sprintf(`
+apikey = "abcde"
+include = "%s/*.conf"
+
+[plugin.metrics.foo]
+command = "foo"
+enabled = false
+
+[plugin.metrics.bar]
+command = "bar"
+enabled = true
+
+[plugin.checks.baz]
+command = "baz"
+enabled = false
+
+[plugin.checks.qux]
+command = "qux"
+enabled = false
+`, tomlQuotedReplacer.Replace(configDir)))
+	assertNoError(t, err)
+	defer os.Remove(configFile.Name())
+
+	// the included file enables qux again
+	err = ioutil.WriteFile(filepath.Join(configDir, "sub.conf"), []byte(`
+[plugin.checks.qux]
+command = "qux"
+`), 0644)
+	assertNoError(t, err)
+
+	config, err := LoadConfig(configFile.Name())
+	assertNoError(t, err)
+	if _, ok := config.MetricPlugins["foo"]; ok {
+		t.Error("plugin.metrics.foo should be disabled")
+	}
+	if _, ok := config.MetricPlugins["bar"]; !ok {
+		t.Error("plugin.metrics.bar should be enabled")
+	}
+	if _, ok := config.CheckPlugins["baz"]; ok {
+		t.Error("plugin.checks.baz should be disabled")
+	}
+	if _, ok := config.CheckPlugins["qux"]; !ok {
+		t.Error("plugin.checks.qux should be enabled by the included file")
+	}
+	expect := []string{"plugin.checks.baz", "plugin.metrics.foo"}
+	if !reflect.DeepEqual(config.DisabledPlugins(), expect) {
+		t.Errorf("the disabled plugins should be %v but got %v", expect, config.DisabledPlugins())
+	}
+
+	// the disabled section is still validated
+	invalidFile, err := newTempFileWithContent(`
+apikey = "abcde"
+[plugin.checks.invalid]
+command = "invalid"
+enabled = false
+max_output_bytes = 0
+`)
+	assertNoError(t, err)
+	defer os.Remove(invalidFile.Name())
+	if _, err := LoadConfig(invalidFile.Name()); err == nil {
+		t.Error("should raise error for the invalid section even if it is disabled")
+	}
+}
+
+func TestLoadConfigFileIncludeOverwritten(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "mackerel-config-test")
+	assertNoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	includedFile, err := os.Create(filepath.Join(configDir, "sub2.conf"))
+	assertNoError(t, err)
+
+	configContent := fmt.Sprintf(`
+apikey = "abcde"
+pidfile = "/path/to/pidfile"
+root = "/var/lib/mackerel-agent"
+verbose = false
+
+include = "%s/*.conf"
+`, tomlQuotedReplacer.Replace(configDir))
+
+	configFile, err := newTempFileWithContent(configContent)
+	assertNoError(t, err)
+	defer os.Remove(configFile.Name())
+
+	includedContent := `
+apikey = "new-api-key"
+pidfile = "/path/to/pidfile2"
+root = "/tmp"
+verbose = true
+`
+
+	_, err = includedFile.WriteString(includedContent)
+	assertNoError(t, err)
+	includedFile.Close()
+
+	config, err := loadConfigFile(configFile.Name())
+	assertNoError(t, err)
+
+	assert(t, config.Apikey == "new-api-key", "apikey should be overwritten")
+	assert(t, config.Pidfile == "/path/to/pidfile2", "pidfile should be overwritten")
+	assert(t, config.Root == "/tmp", "root should be overwritten")
+	assert(t, config.Verbose == true, "verbose should be overwritten")
+}
+
+func TestFileSystemHostIDStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := FileSystemHostIDStorage{Root: root}
+	err = s.SaveHostID("test-host-id")
+	assertNoError(t, err)
+
+	hostID, err := s.LoadHostID()
+	assertNoError(t, err)
+	assert(t, hostID == "test-host-id", "SaveHostID and LoadHostID should preserve the host id")
+	files, err := ioutil.ReadDir(root)
+	assertNoError(t, err)
+	assert(t, len(files) == 1, "SaveHostID should not leave the temporary file")
+
+	err = s.DeleteSavedHostID()
+	assertNoError(t, err)
+
+	_, err = s.LoadHostID()
+	assert(t, err != nil, "LoadHostID after DeleteSavedHostID must fail")
+
+	// Write an empty id to simulate a case that could not save id properly
+	err = s.SaveHostID("")
+	assertNoError(t, err)
+
+	_, err = s.LoadHostID()
+	assert(t, err != nil, "LoadHostID from empty HostID file must fail")
+}
+
+func TestFileSystemHostIDStorage_File(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	old := FileSystemHostIDStorage{Root: root}
+	assertNoError(t, old.SaveHostID("old-host-id"))
+
+	file := filepath.Join(root, "state", "host", "id")
+	s := FileSystemHostIDStorage{Root: root, File: file}
+	hostID, err := s.LoadHostID()
+	assertNoError(t, err)
+	assert(t, hostID == "old-host-id", "the id file under the root should be migrated")
+	_, err = os.Stat(old.HostIDFile())
+	assert(t, os.IsNotExist(err), "the old id file should be removed")
+
+	assertNoError(t, s.SaveHostID("new-host-id"))
+	content, err := ioutil.ReadFile(file)
+	assertNoError(t, err)
+	assert(t, string(content) == "new-host-id", "the id should be saved to the file")
+
+	secondary := FileSystemHostIDStorage{Root: root, File: file, Suffix: SecondaryIDFileSuffix}
+	assert(t, secondary.HostIDFile() == file+SecondaryIDFileSuffix, "the suffix should be appended to the file")
+}
+
+func TestFileSystemHostIDStorage_Lock(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := FileSystemHostIDStorage{Root: root, File: filepath.Join(root, "shared", "id")}
+	unlock, err := s.Lock()
+	assertNoError(t, err)
+	_, err = s.Lock()
+	if err == nil || !strings.Contains(err.Error(), "used by another mackerel-agent") {
+		t.Errorf("the locked id file should not be locked again: %v", err)
+	}
+	unlock()
+	unlock, err = s.Lock()
+	assertNoError(t, err)
+	unlock()
+}
+
+func TestLoadConfigWithIDFile(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+id_file = "/var/lib/mackerel-agent/host/id"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	assertNoError(t, err)
+	assert(t, config.IDFile == "/var/lib/mackerel-agent/host/id", "id_file should be loaded")
+
+	defer os.Unsetenv(IDFileEnv)
+	os.Setenv(IDFileEnv, "/run/mackerel-agent/id")
+	config, err = LoadConfig(tmpFile.Name())
+	assertNoError(t, err)
+	assert(t, config.IDFile == "/run/mackerel-agent/id", "id_file should be overridden by the environment variable")
+}
+
+func TestLoadConfigWithRoot(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`apikey = "abcde"`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	assertNoError(t, err)
+	assert(t, config.Root == DefaultConfig.Root, "root should be the default")
+	assert(t, config.Pidfile == DefaultConfig.Pidfile, "pidfile should be the default")
+
+	defer os.Unsetenv(RootEnv)
+	os.Setenv(RootEnv, filepath.Join("test", "agent1"))
+	config, err = LoadConfig(tmpFile.Name())
+	assertNoError(t, err)
+	assert(t, config.Root == filepath.Join("test", "agent1"), "root should be overridden by the environment variable")
+	assert(t, config.Pidfile == filepath.Join("test", "agent1", "pid"), "pidfile should be under the root")
+	assert(t, config.HostIDFile() == filepath.Join("test", "agent1", "id"), "id file should be under the root")
+
+	// by -root
+	config.SetRoot(filepath.Join("test", "agent2"))
+	assert(t, config.Pidfile == filepath.Join("test", "agent2", "pid"), "pidfile should be moved to the new root")
+	assert(t, config.HostIDFile() == filepath.Join("test", "agent2", "id"), "id file should be moved to the new root")
+	config.Pidfile = filepath.Join("test", "agent.pid")
+	config.SetRoot(filepath.Join("test", "agent3"))
+	assert(t, config.Pidfile == filepath.Join("test", "agent.pid"), "pidfile configured individually should not be moved")
+
+	tmpFile, err = newTempFileWithContent("apikey = \"abcde\"\npidfile = \"\"")
+	assertNoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	config, err = LoadConfig(tmpFile.Name())
+	assertNoError(t, err)
+	assert(t, config.Pidfile == "", "pidfile should be disabled by \"\" even under the root by the environment variable")
+	config.SetRoot(filepath.Join("test", "agent4"))
+	assert(t, config.Pidfile == "", "pidfile disabled should not be moved to the new root")
+}
+
+func TestConfig_HostIDStorage(t *testing.T) {
+	conf := Config{
+		Root: "test-root",
+	}
+
+	storage, ok := conf.hostIDStorage().(*FileSystemHostIDStorage)
+	assert(t, ok, "Default hostIDStorage must be *FileSystemHostIDStorage")
+	assert(t, storage.Root == "test-root", "FileSystemHostIDStorage must have the same Root of Config")
+}
+
+func TestLoadConfigWithSilent(t *testing.T) {
+	conff, err := newTempFileWithContent(`
+apikey = "abcde"
+silent = true
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer os.Remove(conff.Name())
+
+	config, err := loadConfigFile(conff.Name())
+	assertNoError(t, err)
+
+	if !config.Silent {
+		t.Error("silent should be ture")
+	}
+}
+
+func TestLoadConfig_WithCommandArgs(t *testing.T) {
+	conff, err := newTempFileWithContent(`
+apikey = "abcde"
+[plugin.metrics.hoge]
+command = ["perl", "-E", "say 'Hello'"]
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer os.Remove(conff.Name())
+
+	config, err := loadConfigFile(conff.Name())
+	assertNoError(t, err)
+
+	expected := []string{"perl", "-E", "say 'Hello'"}
+	p := config.MetricPlugins["hoge"]
+	output := p.Command.Args
+
+	if !reflect.DeepEqual(expected, output) {
+		t.Errorf("command args not expected: %+v", output)
+	}
+
+	if p.Command.Cmd != "" {
+		t.Errorf("p.Command should be empty but: %s", p.Command.Cmd)
+	}
+}
+
+func TestEnv_ConvertToStrings(t *testing.T) {
+	cases := []struct {
+		env         Env
+		expected    []string
+		expectError bool
+	}{
+		{Env{}, []string{}, false},
+		{Env{"KEY": "VALUE"}, []string{"KEY=VALUE"}, false},
+		{Env{"KEY1": "VALUE1", "KEY2": "VALUE2", "KEY3": "VALUE3"}, []string{"KEY1=VALUE1", "KEY2=VALUE2", "KEY3=VALUE3"}, false},
+		{Env{"KEY1": "VALUE1 VALUE2 VALUE3", "KEY2": "VALUE4 VALUE5 VALUE6"}, []string{"KEY1=VALUE1 VALUE2 VALUE3", "KEY2=VALUE4 VALUE5 VALUE6"}, false},
+		{Env{"KEY": ""}, []string{"KEY="}, false},
+		{Env{"   KEY   ": "   VALUE   "}, []string{"KEY=   VALUE   "}, false},
+		{Env{"": ""}, []string{}, false},
+		{Env{"KEY=KEY": "VALUE"}, nil, true},
+	}
+
+	for _, c := range cases {
+		got, err := c.env.ConvertToStrings()
+		if err != nil && c.expectError == false {
+			t.Errorf("should raise error: %v", c.env)
+		}
+		if len(got) != len(c.expected) {
+			t.Errorf("env strings should contains %d keys but: %d", len(c.expected), len(got))
+		}
+		for _, v := range got {
+			if !expectContainsString(c.expected, v) {
+				t.Errorf("env strings not expected %+v", got)
+			}
+		}
+	}
+}
+
+func TestCommandRunWithEnv(t *testing.T) {
+	tmpf, err := newTempFileWithContent(`
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Print(os.Getenv("SAMPLE_KEY1"), os.Getenv("SAMPLE_KEY2"))
+}`)
+	if err != nil {
+		os.Remove(tmpf.Name())
+		t.Fatalf("should not raise error: %s", err)
+	}
+
+	gof := tmpf.Name() + ".go"
+
+	err = os.Rename(tmpf.Name(), gof)
+
+	if err != nil {
+		os.Remove(tmpf.Name())
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer os.Remove(gof)
+
+	conf := fmt.Sprintf(`
+apikey = "abcde"
+
+[plugin.metrics.sample]
+command = ["go", "run", '%s']
+env = { "SAMPLE_KEY1" = " foo bar ", "SAMPLE_KEY2" = " baz qux " }
+`, gof)
+
+	cases := []struct {
+		env      []string
+		expected string
+	}{
+		{nil, " foo bar  baz qux "},
+		{[]string{"SAMPLE_KEY1=v1 v2", "SAMPLE_KEY2= v3 v4"}, "v1 v2 v3 v4"},
+	}
+
+	for _, c := range cases {
+		var stdout, stderr string
+		var exitCode int
+		var err error
+
+		conff, err := newTempFileWithContent(conf)
+
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		defer os.Remove(conff.Name())
+
+		config, err := loadConfigFile(conff.Name())
+		assertNoError(t, err)
+
+		p := config.MetricPlugins["sample"]
+
+		if c.env != nil {
+			stdout, stderr, exitCode, err = p.Command.RunWithEnv(c.env)
+		} else {
+			stdout, stderr, exitCode, err = p.Command.Run()
+		}
+
+		if stdout != c.expected {
+			t.Errorf("stdout not expected: %+v", stdout)
+		}
+
+		if stderr != "" {
+			t.Errorf("stderr not expected: %+v", stderr)
+		}
+
+		if exitCode != 0 {
+			t.Errorf("exitCode not expected: %+v", exitCode)
+		}
+
+		if err != nil {
+			t.Errorf("err not expected: %+v", err)
+		}
+	}
+}
+
+func TestLoadConfigWithCheckCwd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := fmt.Sprintf(`
+apikey = "abcde"
+
+[plugin.checks.nagios1]
+command = "check_something"
+cwd = '%s'
+env = { "NAGIOS_USER" = "user1" }
+
+[plugin.checks.nagios2]
+command = "check_something"
+env = { "NAGIOS_PASSWORD" = "password2" }
+`, dir)
+	tmpFile, err := newTempFileWithContent(conf)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	check1 := config.CheckPlugins["nagios1"]
+	if check1.Command.Dir != dir {
+		t.Errorf("cwd of check plugin should be %q but got %q", dir, check1.Command.Dir)
+	}
+	if !reflect.DeepEqual(check1.Command.Env, []string{"NAGIOS_USER=user1"}) {
+		t.Errorf("env of check plugin should not contain others: %v", check1.Command.Env)
+	}
+	check2 := config.CheckPlugins["nagios2"]
+	if check2.Command.Dir != "" {
+		t.Errorf("cwd of check plugin should be empty but got %q", check2.Command.Dir)
+	}
+	if !reflect.DeepEqual(check2.Command.Env, []string{"NAGIOS_PASSWORD=password2"}) {
+		t.Errorf("env of check plugin should not contain others: %v", check2.Command.Env)
+	}
+
+	tmpFile2, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.nagios]
+command = "check_something"
+cwd = "/path/to/not/exist"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile2.Name())
+
+	_, err = LoadConfig(tmpFile2.Name())
+	if err == nil {
+		t.Fatal("should raise error when the working directory does not exist")
+	}
+	if !strings.Contains(err.Error(), "plugin.checks.nagios") {
+		t.Errorf("should raise error containing checks key: %v", err)
+	}
+}
+
+func TestLoadConfigWithEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "mysql.env")
+	content := "# the credentials of MySQL\r\nMYSQL_USER=monitor\r\n\r\nMYSQL_PWD = p@ss=word\r\n"
+	if err := ioutil.WriteFile(envFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpFile, err := newTempFileWithContent(fmt.Sprintf(`
+apikey = "abcde"
+
+[plugin.metrics.mysql]
+command = "mackerel-plugin-mysql"
+env_file = '%s'
+env = { "MYSQL_USER" = "root" }
+`, envFile))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	env := config.MetricPlugins["mysql"].Command.Env
+	sort.Strings(env)
+	if expect := []string{"MYSQL_PWD=p@ss=word", "MYSQL_USER=root"}; !reflect.DeepEqual(env, expect) {
+		t.Errorf("env should be %v but got %v", expect, env)
+	}
+	if !containsString(config.SecretFiles, envFile) {
+		t.Errorf("env_file should be checked as the secret file: %v", config.SecretFiles)
+	}
+
+	for _, c := range []struct {
+		content string
+		expect  string
+	}{
+		{"", "no such file"},
+		{"MYSQL_USER=monitor\nsecret-value\n", "line 2 is not KEY=VALUE"},
+	} {
+		file := envFile + ".invalid"
+		if c.content != "" {
+			if err := ioutil.WriteFile(file, []byte(c.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tmpFile, err := newTempFileWithContent(fmt.Sprintf(`
+apikey = "abcde"
+
+[plugin.checks.mysql]
+command = "check-mysql"
+env_file = '%s'
+`, file))
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		_, err = LoadConfig(tmpFile.Name())
+		if err == nil || !strings.Contains(err.Error(), c.expect) || !strings.Contains(err.Error(), file) {
+			t.Errorf("should raise error containing the path and %q: %v", c.expect, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "secret-value") {
+			t.Errorf("the error should not contain the values: %v", err)
+		}
+	}
+}
+
+func TestLoadConfigWithSplay(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.splayed]
+command = "splayed.sh"
+splay_seconds = 30
+
+[plugin.metrics.nosplay]
+command = "nosplay.sh"
+
+[plugin.checks.splayed]
+command = "splayed.sh"
+check_interval = 5
+splay_seconds = 240
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if splay := config.MetricPlugins["splayed"].Splay; splay < 0 || splay >= 30*time.Second {
+		t.Errorf("splay should be in [0s, 30s) but got %s", splay)
+	}
+	if splay := config.MetricPlugins["nosplay"].Splay; splay != 0 {
+		t.Errorf("splay should be 0 by default but got %s", splay)
+	}
+	if splay := config.CheckPlugins["splayed"].Splay; splay < 0 || splay >= 240*time.Second {
+		t.Errorf("splay should be in [0s, 240s) but got %s", splay)
+	}
+
+	// the splay is deterministic
+	config2, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.MetricPlugins["splayed"].Splay != config2.MetricPlugins["splayed"].Splay {
+		t.Errorf("splay should be stable: %s, %s", config.MetricPlugins["splayed"].Splay, config2.MetricPlugins["splayed"].Splay)
+	}
+
+	tmpFile2, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.splayed]
+command = "splayed.sh"
+splay_seconds = 60
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile2.Name())
+
+	_, err = LoadConfig(tmpFile2.Name())
+	if err == nil {
+		t.Fatal("should raise error when splay_seconds is not less than the interval")
+	}
+}
+
+func TestLoadConfigWithIntervalSeconds(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.sampled]
+command = "sampled.sh"
+interval_seconds = 10
+aggregation = "counter"
+
+[plugin.metrics.default]
+command = "default.sh"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if p := config.MetricPlugins["sampled"]; p.Interval != 10*time.Second || p.Aggregation != AggregationCounter {
+		t.Errorf("unexpected interval and aggregation: %s, %s", p.Interval, p.Aggregation)
+	}
+	if p := config.MetricPlugins["default"]; p.Interval != 0 || p.Aggregation != AggregationGauge {
+		t.Errorf("unexpected interval and aggregation: %s, %s", p.Interval, p.Aggregation)
+	}
+
+	for _, c := range []string{"interval_seconds = 60", `interval_seconds = 10
+aggregation = "sum"`} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metrics.sampled]
+command = "sampled.sh"
+` + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.eventlog]
+type = "eventlog"
+log_name = "System"
+source_patterns = ["^Service", "^Disk$"]
+event_ids = [7000, 7001]
+level = "warning"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if runtime.GOOS != "windows" {
+		if err == nil {
+			t.Fatal("should raise error on non-Windows platforms")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	check := config.CheckPlugins["eventlog"]
+	if check.Type != CheckTypeEventLog {
+		t.Errorf("type should be %q but %q", CheckTypeEventLog, check.Type)
+	}
+	expected := &EventLogCheck{
+		LogName:        "System",
+		SourcePatterns: []*regexp.Regexp{regexp.MustCompile("^Service"), regexp.MustCompile("^Disk$")},
+		EventIDs:       []int32{7000, 7001},
+		MaxLevel:       EventLevelWarning,
+	}
+	if !reflect.DeepEqual(check.EventLog, expected) {
+		t.Errorf("eventlog should be %+v but %+v", expected, check.EventLog)
+	}
+}
+
+func TestLoadConfigWithCheckFormat(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.disk]
+command = "check_disk -w 20% -c 10%"
+format = "nagios"
+report_perfdata = true
+
+[plugin.checks.mounts]
+command = "check_mounts"
+format = "json"
+report_items_as_metrics = true
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if format := config.CheckPlugins["disk"].Format; format != CheckFormatNagios {
+		t.Errorf("format should be %q but %q", CheckFormatNagios, format)
+	}
+	if !config.CheckPlugins["disk"].ReportPerfdata {
+		t.Error("report_perfdata should be true")
+	}
+	if p := config.CheckPlugins["mounts"]; p.Format != CheckFormatJSON || !p.ReportItemsAsMetrics {
+		t.Errorf("unexpected format: %q, %t", p.Format, p.ReportItemsAsMetrics)
+	}
+
+	for _, c := range []string{
+		`command = "check_disk"
+format = "sensu"`,
+		`command = "check_disk"
+report_perfdata = true`,
+		`command = "check_disk"
+format = "nagios"
+report_items_as_metrics = true`,
+		`type = "tcp"
+host = "localhost"
+port = 22
+format = "nagios"`,
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n[plugin.checks.invalid]\n" + c + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", c)
+		}
+	}
+}
+
+func TestLoadConfigWithUnknownCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.unknown]
+type = "unknown"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = LoadConfig(tmpFile.Name())
+	if err == nil {
+		t.Fatal("should raise error with unknown check type")
+	}
+	if !strings.Contains(err.Error(), "unknown check type") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadConfigWithHTTPAndTCPCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.web]
+type = "http"
+url = "https://example.com/health"
+method = "HEAD"
+expected_status = 204
+body_match = "ok"
+follow_redirects = false
+timeout = "5s"
+warning_latency = "1s"
+
+[plugin.checks.db]
+type = "tcp"
+host = "[::1]"
+port = 5432
+tls = true
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+
+	web := config.CheckPlugins["web"]
+	expectedHTTP := &HTTPCheck{
+		URL:            "https://example.com/health",
+		Method:         "HEAD",
+		ExpectedStatus: 204,
+		BodyMatch:      regexp.MustCompile("ok"),
+		Timeout:        5 * time.Second,
+		WarningLatency: time.Second,
+	}
+	if !reflect.DeepEqual(web.HTTP, expectedHTTP) {
+		t.Errorf("http should be %+v but %+v", expectedHTTP, web.HTTP)
+	}
+
+	db := config.CheckPlugins["db"]
+	expectedTCP := &TCPCheck{
+		Host:    "::1",
+		Port:    5432,
+		TLS:     true,
+		Timeout: defaultBuiltinCheckTimeout,
+	}
+	if !reflect.DeepEqual(db.TCP, expectedTCP) {
+		t.Errorf("tcp should be %+v but %+v", expectedTCP, db.TCP)
+	}
+	if addr := db.TCP.Address(); addr != "[::1]:5432" {
+		t.Errorf("address should be [::1]:5432 but %s", addr)
+	}
+}
+
+func TestLoadConfigWithInvalidHTTPAndTCPCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"no url", `type = "http"`},
+		{"invalid scheme", `type = "http"
+url = "ftp://example.com/"`},
+		{"invalid status", `type = "http"
+url = "http://example.com/"
+expected_status = 1000`},
+		{"invalid latency", `type = "http"
+url = "http://example.com/"
+timeout = "1s"
+warning_latency = "2s"`},
+		{"no port", `type = "tcp"`},
+		{"invalid port", `type = "tcp"
+port = 70000`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.invalid]
+` + tc.conf + "\n")
+			if err != nil {
+				t.Fatalf("should not raise error: %v", err)
+			}
+			defer os.Remove(tmpFile.Name())
+
+			if _, err := LoadConfig(tmpFile.Name()); err == nil {
+				t.Error("should raise error")
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithCertCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.web]
+type = "cert"
+
+[plugin.checks.mail]
+type = "cert"
+host = "mail.example.com"
+starttls = "SMTP"
+server_name = "smtp.example.com"
+warning_days = 20
+critical_days = 7
+timeout = "2s"
+
+[plugin.checks.file]
+type = "cert"
+path = "/etc/ssl/certs/app.pem"
+verify_chain = false
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	for name, expect := range map[string]*CertCheck{
+		"web": {
+			Host: "localhost", Port: 443, ServerName: "localhost",
+			WarningDays: defaultCertWarningDays, CriticalDays: defaultCertCriticalDays,
+			VerifyChain: true, VerifyHostname: true, Timeout: defaultCertCheckTimeout,
+		},
+		"mail": {
+			Host: "mail.example.com", Port: 25, ServerName: "smtp.example.com", StartTLS: StartTLSSMTP,
+			WarningDays: 20, CriticalDays: 7, VerifyChain: true, VerifyHostname: true, Timeout: 2 * time.Second,
+		},
+		"file": {
+			Path:        "/etc/ssl/certs/app.pem",
+			WarningDays: defaultCertWarningDays, CriticalDays: defaultCertCriticalDays, Timeout: defaultCertCheckTimeout,
+		},
+	} {
+		if got := config.CheckPlugins[name].Cert; !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s should be %+v but %+v", name, expect, got)
+		}
+	}
+}
+
+func TestLoadConfigWithInvalidCertCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"unknown starttls", `starttls = "ldap"`},
+		{"invalid port", `port = 70000`},
+		{"path with host", `path = "/etc/ssl/certs/app.pem"
+host = "localhost"`},
+		{"warning less than critical", `warning_days = 7
+critical_days = 14`},
+		{"negative critical", `critical_days = -1`},
+		{"hostname of the file", `path = "/etc/ssl/certs/app.pem"
+verify_hostname = true`},
+		{"ca_file without verify_chain", `verify_chain = false
+ca_file = "/etc/ssl/ca.pem"`},
+		{"invalid timeout", `timeout = "0s"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.invalid]
+type = "cert"
+` + tc.conf + "\n")
+			if err != nil {
+				t.Fatalf("should not raise error: %v", err)
+			}
+			defer os.Remove(tmpFile.Name())
+
+			if _, err := LoadConfig(tmpFile.Name()); err == nil {
+				t.Error("should raise error")
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithReadOnlyCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.readonly]
+type = "readonly"
+
+[plugin.checks.data]
+type = "readonly"
+device_pattern = "^/dev/(sd|nvme)"
+include_pattern = "^/data"
+exclude_pattern = "^/data/tmp"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	config, err := LoadConfig(tmpFile.Name())
+	if runtime.GOOS != "linux" {
+		if err == nil {
+			t.Fatal("should raise error on non-Linux platforms")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if !expectContainsString(metadataPlugin2.Command.Env, "NAME_1=VALUE_1") {
-		t.Errorf("Command.Env should contain 'NAME_1=VALUE_1'")
+	for name, expect := range map[string]*ReadOnlyCheck{
+		"readonly": {DevicePattern: regexp.MustCompile(defaultReadOnlyDevicePattern)},
+		"data": {
+			DevicePattern:  regexp.MustCompile("^/dev/(sd|nvme)"),
+			IncludePattern: regexp.MustCompile("^/data"),
+			ExcludePattern: regexp.MustCompile("^/data/tmp"),
+		},
+	} {
+		if got := config.CheckPlugins[name].ReadOnly; !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s should be %+v but %+v", name, expect, got)
+		}
 	}
 
-	if config.Plugin != nil {
-		t.Error("plugin config should be set nil, use MetricPlugins, CheckPlugins and MetadataPlugins instead")
+	tmpFile, err = newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.invalid]
+type = "readonly"
+device_pattern = "("
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Error("the invalid device_pattern should raise error")
 	}
 }
 
-func assertNoError(t *testing.T, err error) {
+func TestLoadConfigWithFileCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.checks.heartbeat]
+type = "file"
+path = "/var/run/cron/*.heartbeat"
+max_age = "10m"
+min_size = 1
+
+[plugin.checks.lock]
+type = "file"
+path = "/var/run/batch.lock"
+must_not_exist = true
+`)
 	if err != nil {
-		t.Error(err)
+		t.Fatalf("should not raise error: %v", err)
 	}
-}
+	defer os.Remove(tmpFile.Name())
 
-func assert(t *testing.T, ok bool, msg string) {
-	if !ok {
-		t.Error(msg)
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expected := map[string]*FileCheck{
+		"heartbeat": {Path: "/var/run/cron/*.heartbeat", MaxAge: 10 * time.Minute, MinSize: 1, MustExist: true},
+		"lock":      {Path: "/var/run/batch.lock", MustNotExist: true},
+	}
+	for name, e := range expected {
+		if check := config.CheckPlugins[name]; !reflect.DeepEqual(check.File, e) {
+			t.Errorf("%s should be %+v but %+v", name, e, check.File)
+		}
 	}
 }
 
-var tomlQuotedReplacer = strings.NewReplacer(
-	"\t", "\\t",
-	"\n", "\\n",
-	"\r", "\\r",
-	"\"", "\\\"",
-	"\\", "\\\\",
-)
+func TestLoadConfigWithInvalidFileCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"no path", `type = "file"`},
+		{"invalid pattern", `type = "file"
+path = "/tmp/[a"`},
+		{"conflict", `type = "file"
+path = "/tmp/a"
+must_exist = true
+must_not_exist = true`},
+		{"max_age with must_not_exist", `type = "file"
+path = "/tmp/a"
+max_age = "1m"
+must_not_exist = true`},
+		{"negative min_size", `type = "file"
+path = "/tmp/a"
+min_size = -1`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
 
-func TestLoadConfigFileInclude(t *testing.T) {
-	configDir, err := ioutil.TempDir("", "mackerel-config-test")
-	assertNoError(t, err)
-	defer os.RemoveAll(configDir)
+[plugin.checks.invalid]
+` + tc.conf + "\n")
+			if err != nil {
+				t.Fatalf("should not raise error: %v", err)
+			}
+			defer os.Remove(tmpFile.Name())
 
-	includedFile, err := os.Create(filepath.Join(configDir, "sub1.conf"))
-	assertNoError(t, err)
+			if _, err := LoadConfig(tmpFile.Name()); err == nil {
+				t.Error("should raise error")
+			}
+		})
+	}
+}
 
-	configContent := fmt.Sprintf(`
+func TestLoadConfigWithLogCheckType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
 apikey = "abcde"
-pidfile = "/path/to/pidfile"
-root = "/var/lib/mackerel-agent"
-verbose = false
 
-roles = [ "roles", "to be overwritten" ]
+[plugin.checks.app-log]
+type = "log"
+file = "/var/log/app/*.log"
+warning_pattern = "WARN"
+critical_pattern = "ERROR|FATAL"
+exclude_pattern = "health"
+missing_file_status = "ok"
+
+[plugin.checks.error-log]
+type = "log"
+file = "/var/log/app/error.log"
+critical_pattern = "."
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
 
-include = "%s/*.conf"
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expected := map[string]*LogCheck{
+		"app-log": {
+			File:              "/var/log/app/*.log",
+			WarningPattern:    regexp.MustCompile("WARN"),
+			CriticalPattern:   regexp.MustCompile("ERROR|FATAL"),
+			ExcludePattern:    regexp.MustCompile("health"),
+			MissingFileStatus: MissingFileStatusOK,
+		},
+		"error-log": {
+			File:              "/var/log/app/error.log",
+			CriticalPattern:   regexp.MustCompile("."),
+			MissingFileStatus: MissingFileStatusUnknown,
+		},
+	}
+	for name, e := range expected {
+		if check := config.CheckPlugins[name]; !reflect.DeepEqual(check.Log, e) {
+			t.Errorf("%s should be %+v but %+v", name, e, check.Log)
+		}
+	}
+}
 
-[plugin.metrics.foo1]
-command = "foo1"
+func TestLoadConfigWithInvalidLogCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"no file", `type = "log"
+critical_pattern = "ERROR"`},
+		{"no pattern", `type = "log"
+file = "/tmp/a.log"`},
+		{"invalid pattern", `type = "log"
+file = "/tmp/a.log"
+warning_pattern = "(WARN"`},
+		{"invalid missing_file_status", `type = "log"
+file = "/tmp/a.log"
+critical_pattern = "ERROR"
+missing_file_status = "critical"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
 
-[plugin.metrics.bar]
-command = "this will be overwritten"
-`, tomlQuotedReplacer.Replace(configDir))
+[plugin.checks.invalid]
+` + tc.conf + "\n")
+			if err != nil {
+				t.Fatalf("should not raise error: %v", err)
+			}
+			defer os.Remove(tmpFile.Name())
 
-	configFile, err := newTempFileWithContent(configContent)
-	assertNoError(t, err)
-	defer os.Remove(configFile.Name())
+			if _, err := LoadConfig(tmpFile.Name()); err == nil {
+				t.Error("should raise error")
+			}
+		})
+	}
+}
 
-	includedContent := `
-roles = [ "Service:role" ]
+func TestLoadConfigWithInvalidExecutionInterval(t *testing.T) {
+	for _, interval := range []string{"0", "-1"} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
 
-[plugin.metrics.foo2]
-command = "foo2"
+[plugin.metadata.inventory]
+command = "inventory"
+execution_interval = ` + interval + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
 
-[plugin.metrics.bar]
-command = "bar"
-`
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error when execution_interval is %s", interval)
+		}
+	}
+}
 
-	_, err = includedFile.WriteString(includedContent)
-	assertNoError(t, err)
-	includedFile.Close()
+func TestLoadConfigWithMetadataType(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
 
-	config, err := loadConfigFile(configFile.Name())
-	assertNoError(t, err)
+[plugin.metadata.packages]
+type = "packages"
 
-	assert(t, config.Apikey == "abcde", "apikey should be kept as it is when not configured in the included file")
-	assert(t, config.Pidfile == "/path/to/pidfile", "pidfile should be kept as it is when not configured in the included file")
-	assert(t, config.Root == "/var/lib/mackerel-agent", "root should be kept as it is when not configured in the included file")
-	assert(t, config.Verbose == false, "verbose should be kept as it is when not configured in the included file")
-	assert(t, len(config.Roles) == 1, "roles should be overwritten")
-	assert(t, config.Roles[0] == "Service:role", "roles should be overwritten")
-	assert(t, config.MetricPlugins["foo1"].Command.Cmd == "foo1", "plugin.metrics.foo1 should exist")
-	assert(t, config.MetricPlugins["foo2"].Command.Cmd == "foo2", "plugin.metrics.foo2 should exist")
-	assert(t, config.MetricPlugins["bar"].Command.Cmd == "bar", "plugin.metrics.bar should be overwritten")
-}
+[plugin.metadata.revision]
+file = "/var/app/REVISION"
 
-func TestLoadConfigFileIncludeOverwritten(t *testing.T) {
-	configDir, err := ioutil.TempDir("", "mackerel-config-test")
-	assertNoError(t, err)
-	defer os.RemoveAll(configDir)
+[plugin.metadata.release]
+file = "/var/app/release.json"
+format = "json"
+max_total_bytes = 409600
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
 
-	includedFile, err := os.Create(filepath.Join(configDir, "sub2.conf"))
-	assertNoError(t, err)
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if typ := config.MetadataPlugins["packages"].Type; typ != MetadataTypePackages {
+		t.Errorf("type should be %q but %q", MetadataTypePackages, typ)
+	}
+	revision := config.MetadataPlugins["revision"]
+	if revision.Type != MetadataTypeFile || revision.File != "/var/app/REVISION" || revision.Format != MetadataFormatText {
+		t.Errorf("unexpected file metadata: %+v", revision)
+	}
+	release := config.MetadataPlugins["release"]
+	if release.Type != MetadataTypeFile || release.File != "/var/app/release.json" || release.Format != MetadataFormatJSON || release.MaxTotalBytes != 409600 {
+		t.Errorf("unexpected file metadata: %+v", release)
+	}
+	if n := revision.MaxTotalBytes; n != 0 {
+		t.Errorf("max_total_bytes should be 0 by default but %d", n)
+	}
 
-	configContent := fmt.Sprintf(`
+	for _, conf := range []string{`type = "unknown"`, `type = "packages"
+command = "echo {}"`, `type = "file"`, `file = "/var/app/REVISION"
+format = "yaml"`, `file = "/var/app/REVISION"
+command = "cat /var/app/REVISION"`, `type = "packages"
+max_total_bytes = 0`} {
+		tmpFile, err := newTempFileWithContent(`
 apikey = "abcde"
-pidfile = "/path/to/pidfile"
-root = "/var/lib/mackerel-agent"
-verbose = false
 
-include = "%s/*.conf"
-`, tomlQuotedReplacer.Replace(configDir))
+[plugin.metadata.invalid]
+` + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
 
-	configFile, err := newTempFileWithContent(configContent)
-	assertNoError(t, err)
-	defer os.Remove(configFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", conf)
+		}
+	}
+}
 
-	includedContent := `
-apikey = "new-api-key"
-pidfile = "/path/to/pidfile2"
-root = "/tmp"
-verbose = true
-`
+func TestLoadConfigWithWindowsServicesMetadata(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
 
-	_, err = includedFile.WriteString(includedContent)
-	assertNoError(t, err)
-	includedFile.Close()
+[plugin.metadata.windows_services]
+type = "windows_services"
+exclude_pattern = "^(gupdate|sppsvc)$"
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
 
-	config, err := loadConfigFile(configFile.Name())
-	assertNoError(t, err)
+	config, err := LoadConfig(tmpFile.Name())
+	if runtime.GOOS != "windows" {
+		if err == nil {
+			t.Errorf("should raise error on %s", runtime.GOOS)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	services := config.MetadataPlugins["windows_services"]
+	if services.Type != MetadataTypeWindowsServices || services.IncludePattern != nil || !services.ExcludePattern.MatchString("sppsvc") {
+		t.Errorf("unexpected windows_services metadata: %+v", services)
+	}
 
-	assert(t, config.Apikey == "new-api-key", "apikey should be overwritten")
-	assert(t, config.Pidfile == "/path/to/pidfile2", "pidfile should be overwritten")
-	assert(t, config.Root == "/tmp", "root should be overwritten")
-	assert(t, config.Verbose == true, "verbose should be overwritten")
+	for _, conf := range []string{`include_pattern = "("`, `command = "sc query"`} {
+		tmpFile, err := newTempFileWithContent(`
+apikey = "abcde"
+
+[plugin.metadata.invalid]
+type = "windows_services"
+` + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error: %s", conf)
+		}
+	}
 }
 
-func TestFileSystemHostIDStorage(t *testing.T) {
-	root, err := ioutil.TempDir("", "mackerel-agent-test")
-	if err != nil {
-		t.Fatal(err)
+func TestCommandRunWithEnv_NotLeaked(t *testing.T) {
+	env := make([]string, 1, 10) // leave capacity to detect sharing of the array
+	env[0] = "SAMPLE_KEY0=v0"
+	cmd := Command{
+		CommandOption: cmdutil.CommandOption{Env: env},
+		Cmd:           "echo $SAMPLE_KEY1$SAMPLE_KEY2",
+	}
+	if runtime.GOOS == "windows" {
+		cmd.Cmd = "echo %SAMPLE_KEY1%%SAMPLE_KEY2%"
 	}
-	defer os.RemoveAll(root)
 
-	s := FileSystemHostIDStorage{Root: root}
-	err = s.SaveHostID("test-host-id")
-	assertNoError(t, err)
+	cmd.RunWithEnv([]string{"SAMPLE_KEY1=v1"})
+	cmd.RunWithEnv([]string{"SAMPLE_KEY2=v2"})
+	if !reflect.DeepEqual(cmd.Env, []string{"SAMPLE_KEY0=v0"}) {
+		t.Errorf("env should not be modified: %v", cmd.Env)
+	}
+	if leaked := env[:2][1]; leaked != "" {
+		t.Errorf("env should not be shared between invocations: %q", leaked)
+	}
+}
 
-	hostID, err := s.LoadHostID()
-	assertNoError(t, err)
-	assert(t, hostID == "test-host-id", "SaveHostID and LoadHostID should preserve the host id")
+func newTempFileWithContent(content string) (*os.File, error) {
+	tmpf, err := ioutil.TempFile("", "mackerel-config-test")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmpf.WriteString(content); err != nil {
+		os.Remove(tmpf.Name())
+		return nil, err
+	}
+	tmpf.Sync()
+	tmpf.Close()
+	return tmpf, nil
+}
 
-	err = s.DeleteSavedHostID()
-	assertNoError(t, err)
+func expectContainsString(slice []string, contains string) bool {
+	for _, v := range slice {
+		if v == contains {
+			return true
+		}
+	}
+	return false
+}
 
-	_, err = s.LoadHostID()
-	assert(t, err != nil, "LoadHostID after DeleteSavedHostID must fail")
+func TestLoadConfigWithLogFormat(t *testing.T) {
+	testCases := []struct {
+		conf   string
+		ok     bool
+		format string
+	}{
+		{``, true, ""},
+		{`log_format = "text"`, true, LogFormatText},
+		{`log_format = "json"`, true, LogFormatJSON},
+		{`log_format = "ltsv"`, false, ""},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if config.LogFormat != tc.format {
+			t.Errorf("log_format should be %q but %q", tc.format, config.LogFormat)
+		}
+	}
+}
 
-	// Write an empty id to simulate a case that could not save id properly
-	err = s.SaveHostID("")
-	assertNoError(t, err)
+func TestLoadConfigWithLogFile(t *testing.T) {
+	testCases := []struct {
+		conf string
+		ok   bool
+	}{
+		{`log_file = "/var/log/mackerel-agent.log"`, true},
+		{`log_file = "/var/log/mackerel-agent.log"
+log_max_size = 1048576
+log_max_files = 3
+log_rotate_interval = "24h"
+log_compress = true`, true},
+		{`log_max_size = 0`, false},
+		{`log_max_files = -1`, false},
+		{`log_rotate_interval = "0s"`, false},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if config.LogFile != "/var/log/mackerel-agent.log" {
+			t.Errorf("log_file should be loaded: %q", config.LogFile)
+		}
+		if config.LogMaxSize != nil && (*config.LogMaxSize != 1048576 || *config.LogMaxFiles != 3 ||
+			config.LogRotateInterval.Duration != 24*time.Hour || !config.LogCompress) {
+			t.Errorf("the rotation should be loaded: %+v", config)
+		}
+	}
+}
 
-	_, err = s.LoadHostID()
-	assert(t, err != nil, "LoadHostID from empty HostID file must fail")
+func TestLoadConfigWithSyslog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("syslog is not supported on windows")
+	}
+	testCases := []struct {
+		conf     string
+		ok       bool
+		facility string
+		network  string
+		raddr    string
+	}{
+		{`log_output = "syslog"`, true, "daemon", "", ""},
+		{`log_output = "syslog"
+syslog_facility = "local0"
+syslog_address = "udp://192.0.2.1:514"`, true, "local0", "udp", "192.0.2.1:514"},
+		{`log_output = "syslog"
+syslog_address = "tcp://syslog.example.com:514"`, true, "daemon", "tcp", "syslog.example.com:514"},
+		{`log_output = "syslog"
+syslog_facility = "local8"`, false, "", "", ""},
+		{`log_output = "syslog"
+syslog_address = "http://192.0.2.1:514"`, false, "", "", ""},
+		{`log_output = "syslog"
+log_file = "/var/log/mackerel-agent.log"`, false, "", "", ""},
+		{`log_output = "journald"`, false, "", "", ""},
+		{`syslog_facility = "local0"`, false, "", "", ""},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if config.SyslogFacility != tc.facility {
+			t.Errorf("syslog_facility should be %q but %q", tc.facility, config.SyslogFacility)
+		}
+		network, raddr, err := config.SyslogNetwork()
+		if err != nil || network != tc.network || raddr != tc.raddr {
+			t.Errorf("syslog_address should be %s %s but %s %s (%v)", tc.network, tc.raddr, network, raddr, err)
+		}
+	}
 }
 
-func TestConfig_HostIDStorage(t *testing.T) {
-	conf := Config{
-		Root: "test-root",
+func TestLoadConfigWithProxy(t *testing.T) {
+	testCases := []struct {
+		conf string
+		ok   bool
+	}{
+		{``, true},
+		{`proxy = "system"`, runtime.GOOS == "windows"},
+		{`proxy = "pac"`, false},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		_, err = LoadConfig(tmpFile.Name())
+		if tc.ok && err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("should raise error for %q", tc.conf)
+		}
 	}
+}
 
-	storage, ok := conf.hostIDStorage().(*FileSystemHostIDStorage)
-	assert(t, ok, "Default hostIDStorage must be *FileSystemHostIDStorage")
-	assert(t, storage.Root == "test-root", "FileSystemHostIDStorage must have the same Root of Config")
+func TestLoadConfigWithHostIdentity(t *testing.T) {
+	testCases := []struct {
+		conf   string
+		ok     bool
+		expect string
+	}{
+		{``, true, ""},
+		{`host_identity = "id_file"`, true, ""},
+		{`host_identity = "custom_identifier"`, true, ""},
+		{"host_identity = \"custom_identifier\"\ncustom_identifier = \"golden-001\"", true, "golden-001"},
+		{"host_identity = \"custom_identifier\"\ncustom_identifier_command = \"echo golden-002\"", true, "golden-002"},
+		{"host_identity = \"custom_identifier\"\ncustom_identifier = \"golden\"\ncustom_identifier_command = \"echo golden\"", false, ""},
+		{`custom_identifier = "golden"`, false, ""},
+		{`host_identity = "hostname"`, false, ""},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		id, err := config.HostCustomIdentifier()
+		if err != nil || id != tc.expect {
+			t.Errorf("the custom identifier of %q should be %q but got %q: %v", tc.conf, tc.expect, id, err)
+		}
+	}
 }
 
-func TestLoadConfigWithSilent(t *testing.T) {
-	conff, err := newTempFileWithContent(`
-apikey = "abcde"
-silent = true
+func TestLoadConfigWithPluginSlowRatio(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`apikey = "abcde"
+plugin_slow_ratio = 0.5
+
+[plugin.metrics.foo]
+command = "foo"
+interval_seconds = 10
+
+[plugin.checks.bar]
+command = "bar"
+check_interval = 2
+
+[plugin.metadata.baz]
+command = "baz"
 `)
 	if err != nil {
-		t.Fatalf("should not raise error: %s", err)
+		t.Fatalf("should not raise error: %v", err)
 	}
-	defer os.Remove(conff.Name())
-
-	config, err := loadConfigFile(conff.Name())
-	assertNoError(t, err)
-
-	if !config.Silent {
-		t.Error("silent should be ture")
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expect := map[string]struct {
+		cmd       Command
+		id        string
+		threshold time.Duration
+	}{
+		"metrics":  {config.MetricPlugins["foo"].Command, "metrics.foo", 5 * time.Second},
+		"checks":   {config.CheckPlugins["bar"].Command, "checks.bar", time.Minute},
+		"metadata": {config.MetadataPlugins["baz"].Command, "metadata.baz", 5 * time.Minute},
+	}
+	for kind, e := range expect {
+		if e.cmd.ID != e.id || e.cmd.SlowThreshold != e.threshold {
+			t.Errorf("the %s plugin should be recorded as %s slower than %s: %s, %s", kind, e.id, e.threshold, e.cmd.ID, e.cmd.SlowThreshold)
+		}
 	}
-}
 
-func TestLoadConfig_WithCommandArgs(t *testing.T) {
-	conff, err := newTempFileWithContent(`
-apikey = "abcde"
-[plugin.metrics.hoge]
-command = ["perl", "-E", "say 'Hello'"]
-`)
+	tmpFile, err = newTempFileWithContent("apikey = \"abcde\"\nplugin_slow_ratio = -1\n")
 	if err != nil {
-		t.Fatalf("should not raise error: %s", err)
+		t.Fatalf("should not raise error: %v", err)
 	}
-	defer os.Remove(conff.Name())
+	defer os.Remove(tmpFile.Name())
+	if _, err := LoadConfig(tmpFile.Name()); err == nil {
+		t.Errorf("the negative plugin_slow_ratio should raise error")
+	}
+}
 
-	config, err := loadConfigFile(conff.Name())
-	assertNoError(t, err)
+func TestLoadConfigWithPluginCircuitBreaker(t *testing.T) {
+	tmpFile, err := newTempFileWithContent(`apikey = "abcde"
+plugin_circuit_breaker_threshold = 3
+plugin_circuit_breaker_max_interval = "10m"
 
-	expected := []string{"perl", "-E", "say 'Hello'"}
-	p := config.MetricPlugins["hoge"]
-	output := p.Command.Args
+[plugin.metrics.foo]
+command = "foo"
 
-	if !reflect.DeepEqual(expected, output) {
-		t.Errorf("command args not expected: %+v", output)
+[plugin.checks.bar]
+command = "bar"
+
+[plugin.checks.baz]
+type = "tcp"
+host = "localhost"
+port = 80
+`)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if config.MetricPlugins["foo"].Breaker == nil || config.CheckPlugins["bar"].Breaker == nil {
+		t.Errorf("the plugins should have the breakers")
+	}
+	if config.CheckPlugins["baz"].Breaker != nil {
+		t.Errorf("the built-in checks should not have the breakers")
 	}
 
-	if p.Command.Cmd != "" {
-		t.Errorf("p.Command should be empty but: %s", p.Command.Cmd)
+	for _, content := range []string{
+		"apikey = \"abcde\"\nplugin_circuit_breaker_threshold = -1\n",
+		"apikey = \"abcde\"\nplugin_circuit_breaker_max_interval = \"0s\"\n",
+	} {
+		tmpFile, err := newTempFileWithContent(content)
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", content)
+		}
 	}
 }
 
-func TestEnv_ConvertToStrings(t *testing.T) {
-	cases := []struct {
-		env         Env
-		expected    []string
-		expectError bool
+func TestSuppressWindow(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	testCases := []struct {
+		window string
+		t      time.Time
+		end    time.Time
 	}{
-		{Env{}, []string{}, false},
-		{Env{"KEY": "VALUE"}, []string{"KEY=VALUE"}, false},
-		{Env{"KEY1": "VALUE1", "KEY2": "VALUE2", "KEY3": "VALUE3"}, []string{"KEY1=VALUE1", "KEY2=VALUE2", "KEY3=VALUE3"}, false},
-		{Env{"KEY1": "VALUE1 VALUE2 VALUE3", "KEY2": "VALUE4 VALUE5 VALUE6"}, []string{"KEY1=VALUE1 VALUE2 VALUE3", "KEY2=VALUE4 VALUE5 VALUE6"}, false},
-		{Env{"KEY": ""}, []string{"KEY="}, false},
-		{Env{"   KEY   ": "   VALUE   "}, []string{"KEY=   VALUE   "}, false},
-		{Env{"": ""}, []string{}, false},
-		{Env{"KEY=KEY": "VALUE"}, nil, true},
+		{"Mon-Fri 01:00-03:00 Asia/Tokyo", at("2021-03-08T01:30:00+09:00"), at("2021-03-08T03:00:00+09:00")},
+		// Monday in Tokyo is Sunday in UTC
+		{"Mon-Fri 01:00-03:00 Asia/Tokyo", at("2021-03-07T16:30:00Z"), at("2021-03-07T18:00:00Z")},
+		{"Mon-Fri 01:00-03:00 Asia/Tokyo", at("2021-03-07T01:30:00+09:00"), time.Time{}},
+		{"Mon-Fri 01:00-03:00 Asia/Tokyo", at("2021-03-08T03:00:00+09:00"), time.Time{}},
+		{"Mon-Fri 01:00-03:00 Asia/Tokyo", at("2021-03-08T01:00:00+09:00"), at("2021-03-08T03:00:00+09:00")},
+		// across the midnight, the day is the one where it starts
+		{"Fri 22:00-02:00 Asia/Tokyo", at("2021-03-12T23:00:00+09:00"), at("2021-03-13T02:00:00+09:00")},
+		{"Fri 22:00-02:00 Asia/Tokyo", at("2021-03-13T01:59:00+09:00"), at("2021-03-13T02:00:00+09:00")},
+		{"Fri 22:00-02:00 Asia/Tokyo", at("2021-03-13T22:30:00+09:00"), time.Time{}},
+		{"Fri 22:00-02:00 Asia/Tokyo", at("2021-03-12T01:00:00+09:00"), time.Time{}},
+		{"Sat,Sun 00:00-24:00 UTC", at("2021-03-14T23:59:00Z"), at("2021-03-15T00:00:00Z")},
+		{"Fri-Mon 12:00-13:00 UTC", at("2021-03-15T12:30:00Z"), at("2021-03-15T13:00:00Z")},
+		{"Fri-Mon 12:00-13:00 UTC", at("2021-03-16T12:30:00Z"), time.Time{}},
+		{"23:00-01:00 UTC", at("2021-03-16T00:30:00Z"), at("2021-03-16T01:00:00Z")},
+		// the window across the start of the daylight saving time is 2 hours
+		{"Sun 01:00-04:00 America/New_York", at("2021-03-14T06:30:00Z"), at("2021-03-14T08:00:00Z")},
+		{"Sun 01:00-04:00 America/New_York", at("2021-03-14T08:30:00Z"), time.Time{}},
+		// and the one across the end of it is 4 hours
+		{"Sun 01:00-04:00 America/New_York", at("2021-11-07T08:30:00Z"), at("2021-11-07T09:00:00Z")},
+		{"Sun 01:00-04:00 America/New_York", at("2021-11-07T04:30:00Z"), time.Time{}},
 	}
-
-	for _, c := range cases {
-		got, err := c.env.ConvertToStrings()
-		if err != nil && c.expectError == false {
-			t.Errorf("should raise error: %v", c.env)
+	for _, tc := range testCases {
+		w, err := ParseSuppressWindow(tc.window)
+		if err != nil {
+			t.Errorf("should not raise error for %q: %s", tc.window, err)
+			continue
 		}
-		if len(got) != len(c.expected) {
-			t.Errorf("env strings should contains %d keys but: %d", len(c.expected), len(got))
+		if end := w.End(tc.t); !end.Equal(tc.end) {
+			t.Errorf("the end of %q at %s should be %s but got %s", tc.window, tc.t, tc.end, end)
 		}
-		for _, v := range got {
-			if !expectContainsString(c.expected, v) {
-				t.Errorf("env strings not expected %+v", got)
-			}
+	}
+
+	for _, window := range []string{"", "Mon", "Mon 01:00", "Mon 01:00-01:00", "Mon 24:00-01:00", "Mon 01:00-24:01",
+		"Mon 1:0-2:00", "Mon-Tue-Wed 01:00-02:00", "Monday 01:00-02:00", "Mon 01:00-02:00 Asia/Nowhere", "Mon 01:00-02:00 UTC extra"} {
+		if _, err := ParseSuppressWindow(window); err == nil {
+			t.Errorf("should raise error for %q", window)
 		}
 	}
 }
 
-func TestCommandRunWithEnv(t *testing.T) {
-	tmpf, err := newTempFileWithContent(`
-package main
+func TestLoadConfigWithCheckSuppress(t *testing.T) {
+	conf := `apikey = "abcde"
+check_suppress = ["Mon-Fri 01:00-03:00 Asia/Tokyo"]
+check_suppress_mode = "skip"
 
-import (
-	"fmt"
-	"os"
-)
+[plugin.checks.global]
+command = "check-disk"
 
-func main() {
-	fmt.Print(os.Getenv("SAMPLE_KEY1"), os.Getenv("SAMPLE_KEY2"))
-}`)
+[plugin.checks.own]
+command = "check-disk-latency"
+suppress = ["Sat,Sun 00:00-24:00"]
+suppress_mode = "ok"
+
+[plugin.checks.none]
+command = "check-ping"
+suppress = []
+`
+	tmpFile, err := newTempFileWithContent(conf)
 	if err != nil {
-		os.Remove(tmpf.Name())
-		t.Fatalf("should not raise error: %s", err)
+		t.Fatalf("should not raise error: %v", err)
 	}
-
-	gof := tmpf.Name() + ".go"
-
-	err = os.Rename(tmpf.Name(), gof)
-
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
 	if err != nil {
-		os.Remove(tmpf.Name())
-		t.Fatalf("should not raise error: %s", err)
+		t.Fatalf("should not raise error: %v", err)
 	}
-	defer os.Remove(gof)
-
-	conf := fmt.Sprintf(`
-apikey = "abcde"
-
-[plugin.metrics.sample]
-command = ["go", "run", '%s']
-env = { "SAMPLE_KEY1" = " foo bar ", "SAMPLE_KEY2" = " baz qux " }
-`, gof)
-
-	cases := []struct {
-		env      []string
-		expected string
+	testCases := []struct {
+		name    string
+		windows []string
+		mode    string
 	}{
-		{nil, " foo bar  baz qux "},
-		{[]string{"SAMPLE_KEY1=v1 v2", "SAMPLE_KEY2= v3 v4"}, "v1 v2 v3 v4"},
+		{"global", []string{"Mon-Fri 01:00-03:00 Asia/Tokyo"}, SuppressModeSkip},
+		{"own", []string{"Sat,Sun 00:00-24:00"}, SuppressModeOK},
+		{"none", []string{}, SuppressModeSkip},
 	}
-
-	for _, c := range cases {
-		var stdout, stderr string
-		var exitCode int
-		var err error
-
-		conff, err := newTempFileWithContent(conf)
-
-		if err != nil {
-			t.Fatalf("should not raise error: %s", err)
+	for _, tc := range testCases {
+		p := config.CheckPlugins[tc.name]
+		windows := []string{}
+		for _, w := range p.Suppress {
+			windows = append(windows, w.String())
 		}
-		defer os.Remove(conff.Name())
-
-		config, err := loadConfigFile(conff.Name())
-		assertNoError(t, err)
-
-		p := config.MetricPlugins["sample"]
-
-		if c.env != nil {
-			stdout, stderr, exitCode, err = p.Command.RunWithEnv(c.env)
-		} else {
-			stdout, stderr, exitCode, err = p.Command.Run()
+		if !reflect.DeepEqual(windows, tc.windows) || p.SuppressMode != tc.mode {
+			t.Errorf("the suppression of %s should be %v (%s) but got %v (%s)", tc.name, tc.windows, tc.mode, windows, p.SuppressMode)
 		}
+	}
 
-		if stdout != c.expected {
-			t.Errorf("stdout not expected: %+v", stdout)
+	for _, conf := range []string{
+		`check_suppress = ["Mon"]`,
+		`check_suppress_mode = "warning"`,
+		"[plugin.checks.foo]\ncommand = \"check-foo\"\nsuppress = [\"noon\"]",
+		"[plugin.checks.foo]\ncommand = \"check-foo\"\nsuppress_mode = \"drop\"",
+	} {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
 		}
-
-		if stderr != "" {
-			t.Errorf("stderr not expected: %+v", stderr)
+		defer os.Remove(tmpFile.Name())
+		if _, err := LoadConfig(tmpFile.Name()); err == nil {
+			t.Errorf("should raise error for %q", conf)
 		}
+	}
+}
 
-		if exitCode != 0 {
-			t.Errorf("exitCode not expected: %+v", exitCode)
+func TestLoadConfigWithLogLevels(t *testing.T) {
+	testCases := []struct {
+		conf string
+		ok   bool
+	}{
+		{`log_levels = { api = "debug", metrics = "warning" }`, true},
+		{`[log_levels]
+spec = "DEBUG"`, true},
+		{`log_levels = { plugin = "debug" }`, false},
+		{`log_levels = { api = "verbose" }`, false},
+	}
+	for _, tc := range testCases {
+		tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\n" + tc.conf + "\n")
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		config, err := LoadConfig(tmpFile.Name())
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.conf)
+			}
+			continue
 		}
-
 		if err != nil {
-			t.Errorf("err not expected: %+v", err)
+			t.Errorf("should not raise error for %q: %v", tc.conf, err)
+			continue
+		}
+		if len(config.LogLevels) == 0 {
+			t.Errorf("log_levels should be loaded for %q", tc.conf)
 		}
 	}
 }
 
-func newTempFileWithContent(content string) (*os.File, error) {
-	tmpf, err := ioutil.TempFile("", "mackerel-config-test")
+func TestLoadConfigWithEventLog(t *testing.T) {
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\nlog_output = \"eventlog\"\n")
 	if err != nil {
-		return nil, err
+		t.Fatalf("should not raise error: %v", err)
 	}
-	if _, err := tmpf.WriteString(content); err != nil {
-		os.Remove(tmpf.Name())
-		return nil, err
+	defer os.Remove(tmpFile.Name())
+	_, err = LoadConfig(tmpFile.Name())
+	if runtime.GOOS == "windows" && err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if runtime.GOOS != "windows" && err == nil {
+		t.Error("log_output = \"eventlog\" should raise error except on windows")
 	}
-	tmpf.Sync()
-	tmpf.Close()
-	return tmpf, nil
 }
 
-func expectContainsString(slice []string, contains string) bool {
-	for _, v := range slice {
-		if v == contains {
-			return true
+func TestLoadConfigWithDisableLogDedup(t *testing.T) {
+	tmpFile, err := newTempFileWithContent("apikey = \"abcde\"\ndisable_log_dedup = true\n")
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if !config.DisableLogDedup {
+		t.Error("disable_log_dedup should be true")
+	}
+}
+
+func TestConfig_VerifyCommands(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, name := filepath.Split(exe)
+	conf := &Config{
+		MetricPlugins: map[string]*MetricPlugin{
+			"array":    {Command: Command{Args: []string{exe, "-test.run", "none"}}},
+			"relative": {Command: Command{Args: []string{"." + string(filepath.Separator) + name}, CommandOption: cmdutil.CommandOption{Dir: dir}}},
+			// the commands given as strings are not verified since they are run by the shell
+			"string": {Command: Command{Cmd: "no-such-plugin --verbose"}},
+		},
+		CheckPlugins: map[string]*CheckPlugin{
+			"missing": {Command: Command{Args: []string{"no-such-plugin"}}},
+			"action": {
+				Command: Command{Args: []string{exe}},
+				Action:  &CheckAction{Command: Command{Args: []string{filepath.Join(dir, "no-such-action")}}},
+			},
+		},
+	}
+	err = conf.VerifyCommands()
+	if err == nil {
+		t.Fatal("VerifyCommands should raise error for the missing commands")
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, `plugin.checks.action.action: command "`) || !strings.Contains(msg, `, plugin.checks.missing: command "no-such-plugin" is not executable`) {
+		t.Errorf("the error should list the missing commands: %s", msg)
+	}
+	if strings.Contains(msg, "plugin.metrics.") {
+		t.Errorf("the existing commands should not be reported: %s", msg)
+	}
+
+	delete(conf.CheckPlugins, "missing")
+	delete(conf.CheckPlugins, "action")
+	if err := conf.VerifyCommands(); err != nil {
+		t.Errorf("VerifyCommands should not raise error: %s", err)
+	}
+}
+
+func TestCommand_VerifyInterpreter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the shebangs are not used on Windows")
+	}
+	dir, err := ioutil.TempDir("", "mackerel-agent-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := func(name, content string, perm os.FileMode) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), perm); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		name   string
+		cmd    Command
+		expect string // "" if verified
+	}{
+		{"shell", Command{Args: []string{script("shell.sh", "#!/bin/sh\necho ok\n", 0755)}}, ""},
+		{"env", Command{Args: []string{script("env.sh", "#!/usr/bin/env -S sh -e\necho ok\n", 0755)}}, ""},
+		{"no shebang", Command{Args: []string{script("plain.sh", "echo ok\n", 0755)}}, ""},
+		{"interpreter removed", Command{Args: []string{script("py2.py", "#!/no/such/python2\n", 0755)}}, "the interpreter /no/such/python2 is not found"},
+		{"interpreter not in PATH", Command{Args: []string{script("env-py2.py", "#!/usr/bin/env no-such-python2\n", 0755)}}, "the interpreter no-such-python2 is not found in PATH"},
+		{"not executable", Command{Args: []string{script("noexec.sh", "#!/bin/sh\n", 0644)}}, "is not executable"},
+		{"string with path", Command{Cmd: filepath.Join(dir, "py2.py") + " --verbose"}, "the interpreter /no/such/python2 is not found"},
+		{"string by shell", Command{Cmd: "cd " + dir + " && ./py2.py"}, ""},
+	}
+	for _, tc := range tests {
+		err := tc.cmd.Verify()
+		if tc.expect == "" {
+			if err != nil {
+				t.Errorf("%s: should not raise error: %s", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expect) {
+			t.Errorf("%s: the error should contain %q but got %v", tc.name, tc.expect, err)
 		}
 	}
-	return false
 }
@@ -5,7 +5,7 @@ package config
 import "fmt"
 
 func init() {
-	agentName := getAgentName()
+	agentName := AgentName()
 	DefaultConfig = &Config{
 		Apibase:  getApibase(),
 		Root:     fmt.Sprintf("/var/lib/%s", agentName),
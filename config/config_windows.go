@@ -12,7 +12,7 @@ func init() {
 		log.Fatal(err)
 	}
 	execDir := filepath.Dir(path)
-	agentName := getAgentName()
+	agentName := AgentName()
 	DefaultConfig = &Config{
 		Apibase:  getApibase(),
 		Root:     execDir,
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The ways to identify the host at startup.
+const (
+	// HostIdentityIDFile identifies the host by the host ID file.
+	HostIdentityIDFile = "id_file"
+	// HostIdentityCustomIdentifier identifies the host by the custom identifier,
+	// which is preferred to the host ID file.
+	HostIdentityCustomIdentifier = "custom_identifier"
+)
+
+const defaultCustomIdentifierCommandTimeout = 30 * time.Second
+
+func (conf *Config) buildHostIdentity() error {
+	switch conf.HostIdentity {
+	case "", HostIdentityIDFile:
+		if conf.CustomIdentifier != "" || conf.CustomIdentifierCommand != nil {
+			return fmt.Errorf("custom_identifier and custom_identifier_command require host_identity = %q", HostIdentityCustomIdentifier)
+		}
+		return nil
+	case HostIdentityCustomIdentifier:
+	default:
+		return fmt.Errorf("host_identity should be %q or %q, but %q", HostIdentityIDFile, HostIdentityCustomIdentifier, conf.HostIdentity)
+	}
+	if conf.CustomIdentifier != "" && conf.CustomIdentifierCommand != nil {
+		return errors.New("custom_identifier and custom_identifier_command should not be specified together")
+	}
+	cmd, err := CommandConfig{Raw: conf.CustomIdentifierCommand}.parse()
+	if err != nil {
+		return fmt.Errorf("custom_identifier_command: %s", err)
+	}
+	if cmd != nil {
+		cmd.TimeoutDuration = defaultCustomIdentifierCommandTimeout
+	}
+	conf.customIdentifierCmd = cmd
+	return nil
+}
+
+// IdentifiesByCustomIdentifier reports whether the host is identified by the
+// custom identifier.
+func (conf *Config) IdentifiesByCustomIdentifier() bool {
+	return conf.HostIdentity == HostIdentityCustomIdentifier
+}
+
+// HostCustomIdentifier returns the custom identifier of the host given by
+// custom_identifier or custom_identifier_command, or the empty string if
+// neither of them is specified.
+func (conf *Config) HostCustomIdentifier() (string, error) {
+	if conf.customIdentifierCmd == nil {
+		return conf.CustomIdentifier, nil
+	}
+	stdout, stderr, exitCode, err := conf.customIdentifierCmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("custom_identifier_command failed: %s", err)
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("custom_identifier_command exited with %d: %s", exitCode, strings.TrimSpace(stderr))
+	}
+	id := strings.TrimSpace(stdout)
+	if id == "" {
+		return "", errors.New("custom_identifier_command printed nothing")
+	}
+	return id, nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// reservedHTTPHeaders are set by the agent for the requests to Mackerel, which
+// http_headers cannot override.
+var reservedHTTPHeaders = []string{"X-Api-Key", "Content-Type", "Content-Encoding", "User-Agent"}
+
+// expandHTTPHeaders expands the environment variables in user_agent_suffix and
+// the values of http_headers, and validates them.
+func (conf *Config) expandHTTPHeaders() error {
+	conf.UserAgentSuffix = strings.TrimSpace(os.ExpandEnv(conf.UserAgentSuffix))
+	if strings.ContainsAny(conf.UserAgentSuffix, "\r\n") {
+		return fmt.Errorf("user_agent_suffix should not contain newlines")
+	}
+	if len(conf.HTTPHeaders) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(conf.HTTPHeaders))
+	for name, value := range conf.HTTPHeaders {
+		if !isHTTPHeaderName(name) {
+			return fmt.Errorf("invalid header name in http_headers: %q", name)
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		for _, r := range reservedHTTPHeaders {
+			if key == r {
+				if r == "User-Agent" {
+					return fmt.Errorf("http_headers should not override %s, use user_agent_suffix instead", r)
+				}
+				return fmt.Errorf("http_headers should not override %s", r)
+			}
+		}
+		if _, ok := headers[key]; ok {
+			return fmt.Errorf("the header %s is duplicated in http_headers", key)
+		}
+		value = os.ExpandEnv(value)
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("the value of %s in http_headers should not contain newlines", key)
+		}
+		headers[key] = value
+	}
+	conf.HTTPHeaders = headers
+	return nil
+}
+
+// isHTTPHeaderName reports whether name consists of the token characters of RFC 7230.
+func isHTTPHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
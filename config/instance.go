@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var instanceSuffixPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// InstanceConfigFile returns the config file of the instance of suffix, which
+// is loaded over conffile and its includes, such as mackerel-agent.pg-main.conf
+// next to mackerel-agent.conf.
+func InstanceConfigFile(conffile, suffix string) string {
+	ext := filepath.Ext(conffile)
+	return strings.TrimSuffix(conffile, ext) + "." + suffix + ext
+}
+
+// setInstance loads the config file of the instance of suffix, and appends the
+// suffix to the root directory (such as /var/lib/mackerel-agent-pg-main), the
+// pidfile, the id file, the display name and the custom identifier which are
+// not configured for the instance, so that the instances are registered as the
+// hosts of their own.
+func (conf *Config) setInstance(conffile, suffix string) error {
+	if !instanceSuffixPattern.MatchString(suffix) {
+		return fmt.Errorf("the instance suffix should consist of alphabets, numbers, hyphens and underscores, and start with an alphabet or a number, but %q", suffix)
+	}
+	conf.InstanceSuffix = suffix
+	defined := func(string) bool { return false }
+	file := InstanceConfigFile(conffile, suffix)
+	if _, err := os.Stat(file); err == nil {
+		conf.overridingPlugins = true
+		meta, err := includeFile(conf, file)
+		conf.overridingPlugins = false
+		if err != nil {
+			return err
+		}
+		defined = func(key string) bool { return meta.IsDefined(key) }
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if !defined("root") {
+		if conf.Root == "" {
+			conf.Root = DefaultConfig.Root
+		}
+		conf.Root = filepath.Clean(conf.Root) + "-" + suffix
+	}
+	if !defined("pidfile") && conf.Pidfile != "" {
+		conf.Pidfile = instanceFile(conf.Pidfile, suffix)
+	}
+	if !defined("id_file") && conf.IDFile != "" {
+		conf.IDFile = instanceFile(conf.IDFile, suffix)
+	}
+	if !defined("display_name") && conf.DisplayName != "" {
+		conf.DisplayName = conf.InstanceName(conf.DisplayName)
+	}
+	conf.instanceCustomIdentifier = !defined("custom_identifier") && !defined("custom_identifier_command")
+	return nil
+}
+
+// instanceFile appends suffix to the name of file before the extension, such
+// as /var/run/mackerel-agent-pg-main.pid.
+func instanceFile(file, suffix string) string {
+	file = filepath.Clean(file)
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + suffix + ext
+}
+
+// InstanceName appends the instance suffix to name, such as the hostname, or
+// returns name if the agent is not an instance.
+func (conf *Config) InstanceName(name string) string {
+	if conf.InstanceSuffix == "" || name == "" {
+		return name
+	}
+	return name + "-" + conf.InstanceSuffix
+}
+
+// InstanceCustomIdentifier appends the instance suffix to the custom
+// identifier of the host, unless it is configured for the instance. Otherwise
+// the instances would be identified as the same host by the cloud platform.
+func (conf *Config) InstanceCustomIdentifier(id string) string {
+	if !conf.instanceCustomIdentifier {
+		return id
+	}
+	return conf.InstanceName(id)
+}
@@ -0,0 +1,67 @@
+// +build !windows
+
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// verifyInterpreter checks that the interpreter given by the shebang of the
+// script exists, such as python2 removed by the upgrade of the OS. The command
+// run by "/usr/bin/env" is looked up in PATH of the agent.
+func verifyInterpreter(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the kernel reads the shebang up to 256 bytes
+	line, _ := bufio.NewReaderSize(f, 256).ReadSlice('\n')
+	if !bytes.HasPrefix(line, []byte("#!")) {
+		// the binaries, or the scripts run by the shell
+		return nil
+	}
+	fields := strings.Fields(string(line[2:]))
+	if len(fields) == 0 {
+		return fmt.Errorf("the shebang of %s has no interpreter", path)
+	}
+	interpreter := fields[0]
+	if _, err := exec.LookPath(interpreter); err != nil {
+		return fmt.Errorf("the interpreter %s is not found: %s", interpreter, err)
+	}
+	if filepath.Base(interpreter) != "env" {
+		return nil
+	}
+	if name := envCommand(fields[1:]); name != "" {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("the interpreter %s is not found in PATH: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// envCommand returns the command run by env(1) with args, skipping the
+// options and the variables. The argument of "-S" is split.
+func envCommand(args []string) string {
+	for _, arg := range args {
+		switch {
+		case arg == "-S" || arg == "--split-string":
+			continue
+		case strings.HasPrefix(arg, "-S"):
+			if fields := strings.Fields(arg[2:]); len(fields) > 0 {
+				return fields[0]
+			}
+			continue
+		case strings.HasPrefix(arg, "-") || strings.Contains(arg, "="):
+			continue
+		}
+		return arg
+	}
+	return ""
+}
@@ -0,0 +1,7 @@
+package config
+
+// verifyInterpreter does nothing on Windows, where the scripts are run by the
+// associations of their extensions instead of the shebangs.
+func verifyInterpreter(path string) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// The modes of reading the sensors by ipmitool.
+const (
+	// IPMIModeSensor runs `ipmitool sensor`, which reads the precise values.
+	IPMIModeSensor = "sensor"
+	// IPMIModeSDR runs `ipmitool sdr elist`, which is faster but reads the rounded values.
+	IPMIModeSDR = "sdr"
+)
+
+// IPMI configures the sensors of the BMC read by ipmitool, such as the fans,
+// the temperatures and the power supplies, which are posted as the custom
+// metrics named custom.ipmi.<kind>.<sensor name>.
+type IPMI struct {
+	// Command is the path of ipmitool.
+	Command string `toml:"command"`
+	// Options are the options before the subcommands, such as
+	// ["-I", "lanplus", "-H", "bmc.example.com", "-U", "monitor", "-f", "/etc/ipmi.password"].
+	Options  []string  `toml:"options"`
+	Mode     string    `toml:"mode"`
+	Interval *Duration `toml:"interval"`
+	Timeout  *Duration `toml:"timeout"`
+}
+
+// The default values of IPMI.
+const (
+	DefaultIPMICommand  = "ipmitool"
+	DefaultIPMIInterval = 5 * time.Minute
+	DefaultIPMITimeout  = 30 * time.Second
+)
+
+func (c *IPMI) validate() error {
+	if c.Command == "" {
+		c.Command = DefaultIPMICommand
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = IPMIModeSensor
+	case IPMIModeSensor, IPMIModeSDR:
+	default:
+		return fmt.Errorf("ipmi.mode should be %q or %q, but %q", IPMIModeSensor, IPMIModeSDR, c.Mode)
+	}
+	if c.Interval == nil {
+		c.Interval = &Duration{DefaultIPMIInterval}
+	} else if c.Interval.Duration < PostMetricsInterval {
+		return fmt.Errorf("ipmi.interval should be %s or longer, but %s", PostMetricsInterval, c.Interval.Duration)
+	}
+	if c.Timeout == nil {
+		c.Timeout = &Duration{DefaultIPMITimeout}
+	} else if c.Timeout.Duration <= 0 || c.Timeout.Duration >= PostMetricsInterval {
+		return fmt.Errorf("ipmi.timeout should be positive and less than %s, but %s", PostMetricsInterval, c.Timeout.Duration)
+	}
+	return nil
+}
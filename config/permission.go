@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// addSecretFile adds file to SecretFiles if it has the API key or the passwords.
+func (conf *Config) addSecretFile(file string, meta toml.MetaData) {
+	for _, key := range meta.Keys() {
+		name := strings.ToLower(key[len(key)-1])
+		if name == "apikey" || strings.Contains(name, "password") {
+			conf.SecretFiles = append(conf.SecretFiles, file)
+			return
+		}
+	}
+}
+
+// addEnvFiles adds env_file of the plugins and the actions to SecretFiles.
+func (conf *Config) addEnvFiles() {
+	for _, pconfs := range conf.Plugin {
+		for _, pconf := range pconfs {
+			for _, file := range []string{pconf.EnvFile, pconf.Action.EnvFile} {
+				if file != "" && !containsString(conf.SecretFiles, file) {
+					conf.SecretFiles = append(conf.SecretFiles, file)
+				}
+			}
+		}
+	}
+}
+
+// InsecureSecretFiles returns the problems of the permissions of SecretFiles,
+// which are readable by the others than the owner and the administrators.
+func (conf *Config) InsecureSecretFiles() []string {
+	var problems []string
+	for _, file := range conf.SecretFiles {
+		if err := checkSecretFilePermission(file); err != nil {
+			problems = append(problems, fmt.Sprintf("%s contains the secrets but %s", file, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,39 @@
+// +build !windows
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkRootPermission reports the directory writable by the group or the others.
+func checkRootPermission(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if mode := fi.Mode().Perm(); mode&0022 != 0 {
+		return fmt.Errorf("is writable by the group or the others (mode %#o)", mode)
+	}
+	return nil
+}
+
+// checkSecretFilePermission reports the file readable by the group or the
+// others, or owned by the user other than root and the agent.
+func checkSecretFilePermission(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if mode := fi.Mode().Perm(); mode&0044 != 0 {
+		return fmt.Errorf("is readable by the group or the others (mode %#o)", mode)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if uid := int(st.Uid); uid != 0 && uid != os.Geteuid() {
+			return fmt.Errorf("is owned by the other user (uid %d)", uid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32                 = windows.NewLazySystemDLL("advapi32.dll")
+	procGetNamedSecurityInfo = advapi32.NewProc("GetNamedSecurityInfoW")
+	procGetAce               = advapi32.NewProc("GetAce")
+)
+
+const (
+	seFileObject            = 1
+	daclSecurityInformation = 0x4
+
+	accessAllowedAceType = 0x0
+	inheritOnlyAce       = 0x8
+
+	fileReadData = 0x1
+	genericRead  = 0x80000000
+	genericAll   = 0x10000000
+)
+
+type acl struct {
+	AclRevision byte
+	Sbz1        byte
+	AclSize     uint16
+	AceCount    uint16
+	Sbz2        uint16
+}
+
+type accessAllowedAce struct {
+	AceType  byte
+	AceFlags byte
+	AceSize  uint16
+	Mask     uint32
+	SidStart uint32
+}
+
+// the principals allowed to read the secrets: SYSTEM, LOCAL SERVICE, NETWORK
+// SERVICE, CREATOR OWNER, Administrators and the service SIDs (NT SERVICE\*)
+var secretFileReaders = []string{"S-1-5-18", "S-1-5-19", "S-1-5-20", "S-1-3-0", "S-1-5-32-544"}
+
+const serviceSIDPrefix = "S-1-5-80-"
+
+// checkRootPermission does not check the directory on Windows, whose ACL is
+// inherited from the installation directory by default.
+func checkRootPermission(dir string) error {
+	return nil
+}
+
+// checkSecretFilePermission reports the file whose DACL allows the principals
+// other than the administrators and the service accounts to read it.
+func checkSecretFilePermission(file string) error {
+	name, err := syscall.UTF16PtrFromString(file)
+	if err != nil {
+		return err
+	}
+	var (
+		dacl *acl
+		sd   windows.Handle
+	)
+	r, _, _ := procGetNamedSecurityInfo.Call(uintptr(unsafe.Pointer(name)), seFileObject, daclSecurityInformation,
+		0, 0, uintptr(unsafe.Pointer(&dacl)), 0, uintptr(unsafe.Pointer(&sd)))
+	if r != 0 {
+		return fmt.Errorf("cannot be checked: %s", syscall.Errno(r))
+	}
+	defer windows.LocalFree(sd)
+	if dacl == nil {
+		return fmt.Errorf("has no DACL and is readable by everyone")
+	}
+
+	var readers []string
+	for i := 0; i < int(dacl.AceCount); i++ {
+		var ace *accessAllowedAce
+		if r, _, _ := procGetAce.Call(uintptr(unsafe.Pointer(dacl)), uintptr(i), uintptr(unsafe.Pointer(&ace))); r == 0 {
+			continue
+		}
+		if ace.AceType != accessAllowedAceType || ace.AceFlags&inheritOnlyAce != 0 {
+			continue
+		}
+		if ace.Mask&(fileReadData|genericRead|genericAll) == 0 {
+			continue
+		}
+		sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart))
+		s, err := sid.String()
+		if err != nil || isSecretFileReader(s) {
+			continue
+		}
+		if account, domain, _, err := sid.LookupAccount(""); err == nil {
+			s = domain + `\` + account
+		}
+		readers = append(readers, s)
+	}
+	if len(readers) > 0 {
+		return fmt.Errorf("is readable by %s", strings.Join(readers, ", "))
+	}
+	return nil
+}
+
+func isSecretFileReader(sid string) bool {
+	for _, s := range secretFileReaders {
+		if sid == s {
+			return true
+		}
+	}
+	return strings.HasPrefix(sid, serviceSIDPrefix)
+}
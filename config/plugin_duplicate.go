@@ -0,0 +1,191 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// OnDuplicate is how to treat the plugins of the same section defined
+// differently in more than one configuration file.
+type OnDuplicate string
+
+// The treatments of the duplicate plugin definitions.
+const (
+	// OnDuplicateError fails to load the configuration.
+	OnDuplicateError OnDuplicate = "error"
+	// OnDuplicateSuffix renames the later definition by appending the name of
+	// its file, such as "foo_app1" for [plugin.checks.foo] in app1.conf.
+	OnDuplicateSuffix OnDuplicate = "suffix"
+)
+
+// PluginSource is the location of the section of a plugin. Line is 0 if the
+// section header is not found, such as for the inline tables.
+type PluginSource struct {
+	File string
+	Line int
+}
+
+func (s PluginSource) String() string {
+	if s.Line <= 0 {
+		return s.File
+	}
+	return s.File + ":" + strconv.Itoa(s.Line)
+}
+
+// PluginDuplicate is the section of a plugin defined differently in two files.
+// Renamed is the section the later one is renamed to by on_duplicate = "suffix".
+type PluginDuplicate struct {
+	Section string
+	First   PluginSource
+	Second  PluginSource
+	Renamed string
+}
+
+func (d PluginDuplicate) String() string {
+	s := fmt.Sprintf("%s: %s and %s", d.Section, d.First, d.Second)
+	if d.Renamed != "" {
+		s += " (renamed to " + d.Renamed + ")"
+	}
+	return s
+}
+
+// pluginDefinition is the last definition of the section of a plugin.
+type pluginDefinition struct {
+	source PluginSource
+	pconf  *PluginConfig
+}
+
+// pluginConflicts reports whether the definitions of the same section are
+// duplicate. The identical definitions are aggregated into one, and the ones
+// disabled by enabled = false are overridden as before.
+func pluginConflicts(prev, pconf *PluginConfig) bool {
+	if !prev.enabled() || !pconf.enabled() {
+		return false
+	}
+	return !reflect.DeepEqual(prev, pconf)
+}
+
+func (pconf *PluginConfig) enabled() bool {
+	return pconf.Enabled == nil || *pconf.Enabled
+}
+
+// resolveDuplicatePlugins records the sections of the plugins decoded from
+// file, and the ones already defined differently by the previous files. The
+// later ones are renamed with on_duplicate = "suffix", and otherwise they
+// overwrite the previous ones, which fails in LoadConfig.
+func (conf *Config) resolveDuplicatePlugins(file string) {
+	var lines map[string]int
+	renames := make(map[string]string)
+	for kind, pconfs := range conf.Plugin {
+		for name, pconf := range pconfs {
+			if pconf == nil {
+				continue
+			}
+			if lines == nil {
+				lines = pluginSectionLines(file)
+			}
+			section := "plugin." + kind + "." + name
+			source := PluginSource{File: file, Line: lines[section]}
+			prev, ok := conf.pluginDefinitions[section]
+			if ok && reflect.DeepEqual(prev.pconf, pconf) {
+				configLogger.Debugf("'%s' in %s is identical to the one in %s", section, source, prev.source)
+				continue
+			}
+			if conf.pluginDefinitions == nil {
+				conf.pluginDefinitions = make(map[string]pluginDefinition)
+			}
+			// the config file of the instance overrides the plugins
+			if !ok || conf.overridingPlugins || !pluginConflicts(prev.pconf, pconf) {
+				conf.pluginDefinitions[section] = pluginDefinition{source: source, pconf: pconf}
+				continue
+			}
+			d := PluginDuplicate{Section: section, First: prev.source, Second: source}
+			if conf.OnDuplicate == OnDuplicateSuffix {
+				renamed := conf.suffixedPluginName(kind, name, file)
+				renames[kind+"."+name] = renamed
+				d.Renamed = "plugin." + kind + "." + renamed
+				conf.pluginDefinitions[d.Renamed] = pluginDefinition{source: source, pconf: pconf}
+				configLogger.Warningf("'%s' in %s is renamed to '%s' since it is defined differently in %s", section, source, d.Renamed, prev.source)
+			} else {
+				conf.pluginDefinitions[section] = pluginDefinition{source: source, pconf: pconf}
+			}
+			conf.duplicatePlugins = append(conf.duplicatePlugins, d)
+		}
+	}
+	for key, renamed := range renames {
+		i := strings.Index(key, ".")
+		kind, name := key[:i], key[i+1:]
+		conf.Plugin[kind][renamed] = conf.Plugin[kind][name]
+		delete(conf.Plugin[kind], name)
+	}
+}
+
+var pluginNameReplacer = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// suffixedPluginName appends the base name of file without the extension to
+// name, and a number if the name is still used.
+func (conf *Config) suffixedPluginName(kind, name, file string) string {
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	renamed := name + "_" + pluginNameReplacer.ReplaceAllString(base, "_")
+	candidate := renamed
+	for i := 2; ; i++ {
+		_, defined := conf.pluginDefinitions["plugin."+kind+"."+candidate]
+		if _, decoded := conf.Plugin[kind][candidate]; !defined && !decoded {
+			return candidate
+		}
+		candidate = renamed + "_" + strconv.Itoa(i)
+	}
+}
+
+// DuplicatePlugins returns the sections of the plugins defined differently in
+// more than one file in the order they are found.
+func (conf *Config) DuplicatePlugins() []PluginDuplicate {
+	return conf.duplicatePlugins
+}
+
+func (conf *Config) duplicatePluginsError() error {
+	ds := make([]string, len(conf.duplicatePlugins))
+	for i, d := range conf.duplicatePlugins {
+		ds[i] = "  " + d.String()
+	}
+	return fmt.Errorf("the plugins are defined differently in more than one file, rename them or set on_duplicate = %q:\n%s", OnDuplicateSuffix, strings.Join(ds, "\n"))
+}
+
+var pluginSectionPattern = regexp.MustCompile(`^\s*\[\s*plugin\s*\.\s*("[^"]*"|[A-Za-z0-9_-]+)\s*\.\s*("[^"]*"|[A-Za-z0-9_-]+)\s*\]`)
+
+// pluginSectionLines returns the line numbers of the section headers of the
+// plugins in file, such as [plugin.checks.foo], since the decoder does not
+// tell them.
+func pluginSectionLines(file string) map[string]int {
+	lines := make(map[string]int)
+	f, err := os.Open(file)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		m := pluginSectionPattern.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		section := "plugin." + unquoteKey(m[1]) + "." + unquoteKey(m[2])
+		if _, ok := lines[section]; !ok {
+			lines[section] = n
+		}
+	}
+	return lines
+}
+
+func unquoteKey(key string) string {
+	if s, err := strconv.Unquote(key); err == nil {
+		return s
+	}
+	return key
+}
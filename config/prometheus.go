@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"text/template"
+	"time"
+)
+
+// PrometheusPlugin represents the configuration of a Prometheus exporter,
+// whose metrics in the text exposition format are posted as the custom metrics
+// named custom.<MetricPrefix>.<metric name>.<label suffix>.
+type PrometheusPlugin struct {
+	URL          string
+	MetricPrefix string
+	// LabelTemplate renders the labels of a series into the suffix of the
+	// metric name. If nil, the values of the labels are joined by dots in
+	// order of the label names.
+	LabelTemplate *template.Template
+	// IncludePattern and ExcludePattern are matched against the metric names
+	// without "custom.", to reduce the number of the metrics.
+	IncludePattern   *regexp.Regexp
+	ExcludePattern   *regexp.Regexp
+	CustomIdentifier *string
+	Timeout          time.Duration
+}
+
+const defaultPrometheusTimeout = 10 * time.Second
+
+func (pconf *PluginConfig) buildPrometheusPlugin(name string) (*PrometheusPlugin, error) {
+	if pconf.URL == nil {
+		return nil, fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(*pconf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url should start with http:// or https://, but %q", *pconf.URL)
+	}
+	plugin := &PrometheusPlugin{
+		URL:              *pconf.URL,
+		MetricPrefix:     pconf.MetricPrefix,
+		CustomIdentifier: pconf.CustomIdentifier,
+		Timeout:          defaultPrometheusTimeout,
+	}
+	if plugin.MetricPrefix == "" {
+		plugin.MetricPrefix = name
+	}
+	if pconf.LabelTemplate != "" {
+		plugin.LabelTemplate, err = template.New(name).Option("missingkey=zero").Parse(pconf.LabelTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pconf.IncludePattern != nil {
+		plugin.IncludePattern, err = regexp.Compile(*pconf.IncludePattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pconf.ExcludePattern != nil {
+		plugin.ExcludePattern, err = regexp.Compile(*pconf.ExcludePattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pconf.Timeout != nil {
+		if pconf.Timeout.Duration <= 0 || pconf.Timeout.Duration >= PostMetricsInterval {
+			return nil, fmt.Errorf("timeout should be positive and less than %d seconds, but %s", int(PostMetricsInterval.Seconds()), pconf.Timeout.Duration)
+		}
+		plugin.Timeout = pconf.Timeout.Duration
+	}
+	return plugin, nil
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SNMPPlugin represents the configuration of an SNMP agent polled by GET
+// requests, whose variables are posted as the custom metrics named
+// custom.<MetricPrefix>.<name>, or as the service metrics named
+// <MetricPrefix>.<name> if Service is set.
+type SNMPPlugin struct {
+	// Target is host:port of the agent.
+	Target    string
+	Version   string
+	Community string
+	// the security parameters of SNMP v3
+	SecName      string
+	AuthProtocol string
+	AuthPassword string
+	PrivProtocol string
+	PrivPassword string
+
+	MetricPrefix     string
+	OIDs             []*SNMPOID
+	Service          string
+	CustomIdentifier *string
+	Timeout          time.Duration
+}
+
+// SNMPOIDConfig represents a variable of [plugin.snmp.NAME] in the configuration files.
+type SNMPOIDConfig struct {
+	OID  string `toml:"oid"`
+	Name string `toml:"name"`
+	Type string `toml:"type"`
+	// Scale multiplies the values, such as 8 for the octets to the bits.
+	Scale *SNMPScale `toml:"scale"`
+}
+
+// SNMPScale is the scale of a variable, which accepts the integers as well as the floats.
+type SNMPScale float64
+
+// UnmarshalTOML for parsing the scale while loading toml
+func (s *SNMPScale) UnmarshalTOML(v interface{}) error {
+	switch x := v.(type) {
+	case int64:
+		*s = SNMPScale(x)
+	case float64:
+		*s = SNMPScale(x)
+	default:
+		return fmt.Errorf("scale should be a number, but %v", v)
+	}
+	return nil
+}
+
+// SNMPOID is a variable of an SNMP agent posted as the metric Name.
+type SNMPOID struct {
+	OID   string
+	Name  string
+	Type  SNMPOIDType
+	Scale float64
+}
+
+// SNMPOIDType is the type of the variable.
+type SNMPOIDType string
+
+// The types of the variables. The counters are posted as the rates per second.
+const (
+	SNMPOIDGauge   SNMPOIDType = "gauge"
+	SNMPOIDCounter SNMPOIDType = "counter"
+)
+
+const (
+	defaultSNMPPort    = "161"
+	defaultSNMPTimeout = 5 * time.Second
+)
+
+var (
+	snmpOIDPattern        = regexp.MustCompile(`^\.?[0-2](\.[0-9]+)+$`)
+	snmpMetricNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+func (pconf *PluginConfig) buildSNMPPlugin(name string) (*SNMPPlugin, error) {
+	if pconf.Target == "" {
+		return nil, fmt.Errorf("target is required")
+	}
+	plugin := &SNMPPlugin{
+		Target:           pconf.Target,
+		Version:          pconf.Version,
+		Community:        pconf.Community,
+		SecName:          pconf.SecName,
+		AuthProtocol:     strings.ToUpper(pconf.AuthProtocol),
+		AuthPassword:     pconf.AuthPassword,
+		PrivProtocol:     strings.ToUpper(pconf.PrivProtocol),
+		PrivPassword:     pconf.PrivPassword,
+		MetricPrefix:     pconf.MetricPrefix,
+		Service:          pconf.Service,
+		CustomIdentifier: pconf.CustomIdentifier,
+		Timeout:          defaultSNMPTimeout,
+	}
+	if _, _, err := net.SplitHostPort(plugin.Target); err != nil {
+		plugin.Target = net.JoinHostPort(plugin.Target, defaultSNMPPort)
+	}
+	if plugin.MetricPrefix == "" {
+		plugin.MetricPrefix = name
+	}
+	if plugin.Service != "" && plugin.CustomIdentifier != nil {
+		return nil, fmt.Errorf("service and custom_identifier should not be specified together")
+	}
+	switch plugin.Version {
+	case "":
+		plugin.Version = "2c"
+		fallthrough
+	case "1", "2c":
+		if plugin.Community == "" {
+			plugin.Community = "public"
+		}
+	case "3":
+		if err := plugin.validateUSM(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("version should be 1, 2c or 3, but %q", plugin.Version)
+	}
+	if len(pconf.OIDs) == 0 {
+		return nil, fmt.Errorf("oids are required")
+	}
+	for _, o := range pconf.OIDs {
+		if !snmpOIDPattern.MatchString(o.OID) {
+			return nil, fmt.Errorf("invalid oid: %q", o.OID)
+		}
+		if !snmpMetricNamePattern.MatchString(o.Name) {
+			return nil, fmt.Errorf("invalid name of %s: %q", o.OID, o.Name)
+		}
+		oid := &SNMPOID{OID: o.OID, Name: o.Name, Type: SNMPOIDType(o.Type), Scale: 1}
+		switch oid.Type {
+		case "":
+			oid.Type = SNMPOIDGauge
+		case SNMPOIDGauge, SNMPOIDCounter:
+		default:
+			return nil, fmt.Errorf("type of %s should be gauge or counter, but %q", o.OID, o.Type)
+		}
+		if o.Scale != nil {
+			oid.Scale = float64(*o.Scale)
+		}
+		plugin.OIDs = append(plugin.OIDs, oid)
+	}
+	if pconf.Timeout != nil {
+		if pconf.Timeout.Duration <= 0 || pconf.Timeout.Duration >= PostMetricsInterval {
+			return nil, fmt.Errorf("timeout should be positive and less than %d seconds, but %s", int(PostMetricsInterval.Seconds()), pconf.Timeout.Duration)
+		}
+		plugin.Timeout = pconf.Timeout.Duration
+	}
+	return plugin, nil
+}
+
+// validateUSM validates the security parameters of SNMP v3.
+func (plugin *SNMPPlugin) validateUSM() error {
+	if plugin.SecName == "" {
+		return fmt.Errorf("sec_name is required for the version 3")
+	}
+	switch plugin.AuthProtocol {
+	case "":
+		if plugin.PrivProtocol != "" {
+			return fmt.Errorf("priv_protocol requires auth_protocol")
+		}
+		return nil
+	case "MD5", "SHA":
+	default:
+		return fmt.Errorf("auth_protocol should be MD5 or SHA, but %q", plugin.AuthProtocol)
+	}
+	// RFC 3414 requires the passwords of 8 characters at least.
+	if len(plugin.AuthPassword) < 8 {
+		return fmt.Errorf("auth_password should be 8 characters at least")
+	}
+	switch plugin.PrivProtocol {
+	case "":
+		return nil
+	case "DES", "AES":
+	default:
+		return fmt.Errorf("priv_protocol should be DES or AES, but %q", plugin.PrivProtocol)
+	}
+	if len(plugin.PrivPassword) < 8 {
+		return fmt.Errorf("priv_password should be 8 characters at least")
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The modes of the check reports in the suppression windows.
+const (
+	// SuppressModeOK reports OK with the original status in the message.
+	SuppressModeOK = "ok"
+	// SuppressModeSkip reports nothing.
+	SuppressModeSkip = "skip"
+)
+
+// SuppressWindow is the weekly window to suppress the check reports, such as
+// "Mon-Fri 01:00-03:00 Asia/Tokyo". The window whose end is before the start
+// ends on the next day, and the days are the ones where it starts.
+type SuppressWindow struct {
+	raw  string
+	days [7]bool
+	// start and end are the minutes since the midnight of the start day
+	start, end int
+	loc        *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseSuppressWindow parses "[<days>] <HH:MM>-<HH:MM> [<timezone>]", whose
+// days are the comma separated weekdays or the ranges of them, or "*". The
+// days default to every day and the timezone defaults to the local time.
+func ParseSuppressWindow(s string) (*SuppressWindow, error) {
+	fields := strings.Fields(s)
+	w := &SuppressWindow{raw: s, loc: time.Local}
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		if err := w.parseDays(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid suppression window %q: %s", s, err)
+		}
+		fields = fields[1:]
+	} else {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid suppression window %q: should be \"[<days>] <HH:MM>-<HH:MM> [<timezone>]\"", s)
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid suppression window %q: the times should be <HH:MM>-<HH:MM>", s)
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil || w.start == 24*60 {
+		return nil, fmt.Errorf("invalid suppression window %q: invalid start %q", s, times[0])
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return nil, fmt.Errorf("invalid suppression window %q: invalid end %q", s, times[1])
+	}
+	switch {
+	case w.end == w.start:
+		return nil, fmt.Errorf("invalid suppression window %q: the start and the end are same (00:00-24:00 is the whole day)", s)
+	case w.end < w.start:
+		w.end += 24 * 60
+	}
+	if len(fields) == 2 {
+		if w.loc, err = time.LoadLocation(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid suppression window %q: %s", s, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *SuppressWindow) parseDays(s string) error {
+	if s == "*" {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+		return nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		names := strings.Split(r, "-")
+		if len(names) > 2 {
+			return fmt.Errorf("invalid days %q", r)
+		}
+		var days []time.Weekday
+		for _, n := range names {
+			d, ok := weekdayNames[strings.ToLower(n)]
+			if !ok {
+				return fmt.Errorf("unknown day %q (should be one of Sun, Mon, Tue, Wed, Thu, Fri and Sat)", n)
+			}
+			days = append(days, d)
+		}
+		// the range may wrap around the week, such as Fri-Mon
+		for d := days[0]; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == days[len(days)-1] {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses HH:MM up to 24:00 into the minutes.
+func parseClock(s string) (int, error) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 || len(hm[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m >= 60 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// End returns the end of the window containing t, or the zero time if t is
+// out of the window. The times are in the timezone of the window, so the
+// windows across the transitions of the daylight saving time are shorter or
+// longer than the others.
+func (w *SuppressWindow) End(t time.Time) time.Time {
+	lt := t.In(w.loc)
+	y, m, d := lt.Date()
+	// the window started on the previous day may contain t
+	for _, day := range []int{d, d - 1} {
+		midnight := time.Date(y, m, day, 0, 0, 0, 0, w.loc)
+		if !w.days[midnight.Weekday()] {
+			continue
+		}
+		start := time.Date(y, m, day, 0, w.start, 0, 0, w.loc)
+		end := time.Date(y, m, day, 0, w.end, 0, 0, w.loc)
+		if !t.Before(start) && t.Before(end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
+
+func (w *SuppressWindow) String() string {
+	return w.raw
+}
+
+func buildSuppressWindows(windows []string) ([]*SuppressWindow, error) {
+	if windows == nil {
+		return nil, nil
+	}
+	// the empty windows override check_suppress
+	ws := make([]*SuppressWindow, 0, len(windows))
+	for _, s := range windows {
+		w, err := ParseSuppressWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+func validateSuppressMode(mode string) error {
+	switch mode {
+	case "", SuppressModeOK, SuppressModeSkip:
+		return nil
+	}
+	return fmt.Errorf("suppress_mode should be %q or %q, but %q", SuppressModeOK, SuppressModeSkip, mode)
+}
+
+// applyCheckSuppress sets check_suppress and check_suppress_mode to the checks
+// without their own ones, and the default mode.
+func (conf *Config) applyCheckSuppress() error {
+	windows, err := buildSuppressWindows(conf.CheckSuppress)
+	if err != nil {
+		return fmt.Errorf("check_suppress: %s", err)
+	}
+	if err := validateSuppressMode(conf.CheckSuppressMode); err != nil {
+		return fmt.Errorf("check_%s", err)
+	}
+	mode := conf.CheckSuppressMode
+	if mode == "" {
+		mode = SuppressModeOK
+	}
+	for _, p := range conf.CheckPlugins {
+		if p.Suppress == nil {
+			p.Suppress = windows
+		}
+		if p.SuppressMode == "" {
+			p.SuppressMode = mode
+		}
+	}
+	return nil
+}
+
+// SuppressedUntil returns the end of the suppression window containing t, or
+// the zero time if the reports at t are not suppressed.
+func (pconf *CheckPlugin) SuppressedUntil(t time.Time) time.Time {
+	var until time.Time
+	for _, w := range pconf.Suppress {
+		if end := w.End(t); end.After(until) {
+			until = end
+		}
+	}
+	return until
+}
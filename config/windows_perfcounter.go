@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WindowsPerfCounterPlugin represents the configuration of the performance
+// counters of Windows collected by PDH, which are posted as the custom
+// metrics named custom.<MetricPrefix>.<object>[.<instance>].<counter>.
+type WindowsPerfCounterPlugin struct {
+	Counters     []*WindowsPerfCounter
+	MetricPrefix string
+	// InstanceWildcard allows the wildcard instances such as \Process(*)\...,
+	// which are posted as a metric for each instance.
+	InstanceWildcard bool
+	CustomIdentifier *string
+}
+
+// WindowsPerfCounter is a counter path, \object(instance)\counter.
+// Object and Counter may be the index numbers of the names, to configure
+// the counters regardless of the language of Windows.
+type WindowsPerfCounter struct {
+	Path     string
+	Object   string
+	Instance string
+	Counter  string
+}
+
+// IsWildcard reports whether the instance of the counter contains the wildcard.
+func (c *WindowsPerfCounter) IsWildcard() bool {
+	return strings.Contains(c.Instance, "*")
+}
+
+// MetricName returns the metric name of the counter without "custom.".
+// instance is the name of an instance expanded from the wildcard.
+func (c *WindowsPerfCounter) MetricName(prefix, instance string) string {
+	if !c.IsWildcard() {
+		instance = c.Instance
+	}
+	names := []string{prefix, sanitizePerfCounterName(c.Object)}
+	if instance != "" {
+		names = append(names, sanitizePerfCounterName(instance))
+	}
+	return strings.Join(append(names, sanitizePerfCounterName(c.Counter)), ".")
+}
+
+// sanitizePerfCounterName replaces the characters not allowed in the metric
+// names, such as "% Processor Time", with "_". The leading and the trailing
+// ones are removed.
+func sanitizePerfCounterName(s string) string {
+	var b strings.Builder
+	pending := false
+	for _, r := range s {
+		if ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || r == '-' || r == '_' {
+			if pending && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			pending = false
+			b.WriteRune(r)
+			continue
+		}
+		pending = true
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// parsePerfCounterPath parses the counter path. The counters of the remote
+// computers, \\computer\object\counter, are not supported.
+func parsePerfCounterPath(path string) (*WindowsPerfCounter, error) {
+	if !strings.HasPrefix(path, `\`) || strings.HasPrefix(path, `\\`) {
+		return nil, fmt.Errorf(`counter path should be \object(instance)\counter, but %q`, path)
+	}
+	i := strings.LastIndex(path, `\`)
+	object, counter := path[1:i], path[i+1:]
+	if i == 0 || counter == "" {
+		return nil, fmt.Errorf(`counter path should be \object(instance)\counter, but %q`, path)
+	}
+	c := &WindowsPerfCounter{Path: path, Object: object, Counter: counter}
+	// the instance names may contain the parentheses, such as "Intel(R) ..."
+	if j := strings.Index(object, "("); j >= 0 {
+		if !strings.HasSuffix(object, ")") {
+			return nil, fmt.Errorf("invalid instance of the counter path: %q", path)
+		}
+		c.Object, c.Instance = object[:j], object[j+1:len(object)-1]
+		if c.Instance == "" {
+			return nil, fmt.Errorf("invalid instance of the counter path: %q", path)
+		}
+	}
+	if c.Object == "" || strings.Contains(c.Object, "*") || strings.Contains(c.Counter, "*") {
+		return nil, fmt.Errorf("only the instance of the counter path may be the wildcard: %q", path)
+	}
+	return c, nil
+}
+
+func (pconf *PluginConfig) buildWindowsPerfCounterPlugin(name string) (*WindowsPerfCounterPlugin, error) {
+	if len(pconf.Counters) == 0 {
+		return nil, fmt.Errorf("counters are required")
+	}
+	plugin := &WindowsPerfCounterPlugin{
+		MetricPrefix:     pconf.MetricPrefix,
+		InstanceWildcard: pconf.InstanceWildcard,
+		CustomIdentifier: pconf.CustomIdentifier,
+	}
+	if plugin.MetricPrefix == "" {
+		plugin.MetricPrefix = name
+	}
+	names := make(map[string]string)
+	for _, path := range pconf.Counters {
+		c, err := parsePerfCounterPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if c.IsWildcard() && !plugin.InstanceWildcard {
+			return nil, fmt.Errorf("the wildcard instance of %q requires instance_wildcard = true", path)
+		}
+		if !c.IsWildcard() {
+			n := c.MetricName(plugin.MetricPrefix, "")
+			if p, ok := names[n]; ok {
+				return nil, fmt.Errorf("the metric names of %q and %q are the same: %s", p, path, n)
+			}
+			names[n] = path
+		}
+		plugin.Counters = append(plugin.Counters, c)
+	}
+	return plugin, nil
+}
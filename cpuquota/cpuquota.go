@@ -0,0 +1,234 @@
+// Package cpuquota detects the CPU quota of the cgroup of the agent, such as
+// the limit of the container, on Linux without the external dependencies.
+// The quota is detected from the cgroup v1 (cpu.cfs_quota_us) and v2
+// (cpu.max), including the ones of the ancestors.
+package cpuquota
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	once    sync.Once
+	cpus    float64
+	limited bool
+)
+
+// CPUs returns the number of the CPUs allowed by the quota, such as 0.5, and
+// false if the cgroup of the agent is not limited. It is detected once.
+func CPUs() (float64, bool) {
+	once.Do(func() {
+		cpus, limited = detect()
+	})
+	return cpus, limited
+}
+
+// Cap caps n by the quota, which is rounded up to at least one CPU. It returns
+// n as is if the cgroup is not limited.
+func Cap(n int) int {
+	c, ok := CPUs()
+	if !ok {
+		return n
+	}
+	if m := int(math.Ceil(c)); m < n {
+		return m
+	}
+	return n
+}
+
+type cgroupPath struct {
+	controllers []string // empty for v2
+	path        string
+}
+
+type mount struct {
+	root   string
+	point  string
+	fstype string
+	opts   []string
+}
+
+// detectIn detects the quota of the cgroup of the process by the files under
+// root, which is "/" except the tests.
+func detectIn(root string) (float64, bool) {
+	cgroups, err := readCgroups(filepath.Join(root, "proc/self/cgroup"))
+	if err != nil {
+		return 0, false
+	}
+	mounts, err := readMounts(filepath.Join(root, "proc/self/mountinfo"))
+	if err != nil {
+		return 0, false
+	}
+	var ok bool
+	min := math.Inf(1)
+	for _, m := range mounts {
+		var c float64
+		var found bool
+		switch {
+		case m.fstype == "cgroup2":
+			if p, exists := cgroupOf(cgroups, ""); exists {
+				c, found = walk(root, m, p, readCPUMax)
+			}
+		case m.fstype == "cgroup" && hasString(m.opts, "cpu"):
+			if p, exists := cgroupOf(cgroups, "cpu"); exists {
+				c, found = walk(root, m, p, readCFSQuota)
+			}
+		}
+		if found && c < min {
+			min, ok = c, true
+		}
+	}
+	return min, ok
+}
+
+// cgroupOf returns the path of the cgroup of the controller, or the one of v2
+// if controller is empty.
+func cgroupOf(cgroups []cgroupPath, controller string) (string, bool) {
+	for _, c := range cgroups {
+		if controller == "" && len(c.controllers) == 0 || controller != "" && hasString(c.controllers, controller) {
+			return c.path, true
+		}
+	}
+	return "", false
+}
+
+// walk returns the minimum quota of the cgroup of path in the mount and its
+// ancestors up to the mount point.
+func walk(root string, m mount, path string, read func(dir string) (float64, bool)) (float64, bool) {
+	rel := path
+	if m.root != "/" {
+		if !strings.HasPrefix(path, m.root) {
+			return 0, false
+		}
+		rel = strings.TrimPrefix(path, m.root)
+	}
+	point := filepath.Join(root, m.point)
+	dir := filepath.Join(point, rel)
+	var ok bool
+	min := math.Inf(1)
+	for {
+		if c, found := read(dir); found && c < min {
+			min, ok = c, true
+		}
+		if dir == point || !strings.HasPrefix(dir, point) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return min, ok
+}
+
+// readCPUMax reads cpu.max of v2, such as "50000 100000" or "max 100000".
+func readCPUMax(dir string) (float64, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cpu.max"))
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	return quota(fields[0], fields[1])
+}
+
+// readCFSQuota reads cpu.cfs_quota_us of v1, which is -1 if not limited.
+func readCFSQuota(dir string) (float64, bool) {
+	q, err := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	p, err := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return quota(strings.TrimSpace(string(q)), strings.TrimSpace(string(p)))
+}
+
+func quota(q, p string) (float64, bool) {
+	quota, err := strconv.ParseInt(q, 10, 64)
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := strconv.ParseInt(p, 10, 64)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+	return float64(quota) / float64(period), true
+}
+
+// readCgroups reads /proc/self/cgroup, whose lines are
+// "hierarchy-ID:controller-list:cgroup-path".
+func readCgroups(file string) ([]cgroupPath, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cgroups []cgroupPath
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		c := cgroupPath{path: fields[2]}
+		if fields[1] != "" {
+			c.controllers = strings.Split(fields[1], ",")
+		}
+		cgroups = append(cgroups, c)
+	}
+	return cgroups, scanner.Err()
+}
+
+// readMounts reads the cgroup filesystems in /proc/self/mountinfo, whose
+// lines are "ID parent major:minor root point options [optional...] - type
+// source super-options".
+func readMounts(file string) ([]mount, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+3 >= len(fields) {
+			continue
+		}
+		fstype := fields[sep+1]
+		if fstype != "cgroup" && fstype != "cgroup2" {
+			continue
+		}
+		mounts = append(mounts, mount{
+			root:   fields[3],
+			point:  fields[4],
+			fstype: fstype,
+			opts:   strings.Split(fields[sep+3], ","),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+func hasString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
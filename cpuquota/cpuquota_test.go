@@ -0,0 +1,127 @@
+package cpuquota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDetectIn(t *testing.T) {
+	const (
+		v2Mount = "30 23 0:26 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,nsdelegate\n"
+		v1Mount = "31 23 0:27 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid shared:9 - cgroup cgroup rw,cpu,cpuacct\n" +
+			"32 23 0:28 / /sys/fs/cgroup/memory rw,nosuid shared:10 - cgroup cgroup rw,memory\n"
+	)
+	tests := []struct {
+		name   string
+		files  map[string]string
+		cpus   float64
+		limits bool
+	}{
+		{
+			name: "v2 in the container",
+			files: map[string]string{
+				"proc/self/cgroup":      "0::/\n",
+				"proc/self/mountinfo":   v2Mount,
+				"sys/fs/cgroup/cpu.max": "50000 100000\n",
+			},
+			cpus: 0.5, limits: true,
+		},
+		{
+			name: "v2 of the ancestor",
+			files: map[string]string{
+				"proc/self/cgroup":    "0::/system.slice/mackerel-agent.service\n",
+				"proc/self/mountinfo": v2Mount,
+				"sys/fs/cgroup/system.slice/mackerel-agent.service/cpu.max": "max 100000\n",
+				"sys/fs/cgroup/system.slice/cpu.max":                        "200000 100000\n",
+			},
+			cpus: 2, limits: true,
+		},
+		{
+			name: "v2 without the limit",
+			files: map[string]string{
+				"proc/self/cgroup":      "0::/\n",
+				"proc/self/mountinfo":   v2Mount,
+				"sys/fs/cgroup/cpu.max": "max 100000\n",
+			},
+		},
+		{
+			name: "v1 of the host mounted",
+			files: map[string]string{
+				"proc/self/cgroup":                            "4:cpu,cpuacct:/docker/abc\n5:memory:/docker/abc\n",
+				"proc/self/mountinfo":                         "31 23 0:27 /docker/abc /sys/fs/cgroup/cpu,cpuacct rw,nosuid - cgroup cgroup rw,cpu,cpuacct\n",
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  "150000\n",
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+			},
+			cpus: 1.5, limits: true,
+		},
+		{
+			name: "v1 without the limit",
+			files: map[string]string{
+				"proc/self/cgroup":                            "4:cpu,cpuacct:/\n5:memory:/\n",
+				"proc/self/mountinfo":                         v1Mount,
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  "-1\n",
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+			},
+		},
+		{
+			name: "no cgroups",
+			files: map[string]string{
+				"proc/self/cgroup":    "",
+				"proc/self/mountinfo": "22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "cpuquota")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			writeFiles(t, root, tc.files)
+
+			cpus, ok := detectIn(root)
+			if ok != tc.limits || ok && cpus != tc.cpus {
+				t.Errorf("the quota should be %v (%t) but %v (%t)", tc.cpus, tc.limits, cpus, ok)
+			}
+		})
+	}
+
+	if _, ok := detectIn(filepath.Join(os.TempDir(), "cpuquota-not-found")); ok {
+		t.Error("the quota should not be detected without /proc")
+	}
+}
+
+func TestCap(t *testing.T) {
+	defer func(c float64, l bool) { cpus, limited = c, l }(CPUs())
+	cpus, limited = 0.5, true
+	if n := Cap(64); n != 1 {
+		t.Errorf("0.5 CPUs should cap the concurrency to 1 but %d", n)
+	}
+	cpus = 2.5
+	if n := Cap(64); n != 3 {
+		t.Errorf("2.5 CPUs should cap the concurrency to 3 but %d", n)
+	}
+	if n := Cap(2); n != 2 {
+		t.Errorf("the smaller number should be kept but %d", n)
+	}
+	limited = false
+	if n := Cap(64); n != 64 {
+		t.Errorf("the number should be kept without the limit but %d", n)
+	}
+}
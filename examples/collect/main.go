@@ -0,0 +1,53 @@
+// +build example
+
+// This example collects the system metrics and the host specs by the
+// generators of the agent into a plain map, which is run by
+//
+//	go run -tags example ./examples/collect
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/collector"
+)
+
+type stderrLogger struct{}
+
+func (stderrLogger) Log(level, component, message string) {
+	fmt.Fprintf(os.Stderr, "[%s] %s: %s\n", level, component, message)
+}
+
+func main() {
+	collector.SetLogger(stderrLogger{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	values := make(map[string]float64)
+	for _, g := range collector.MetricGenerators(collector.Options{Interval: 3 * time.Second}) {
+		vs, err := g.Generate(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%T: %s\n", g, err)
+			continue
+		}
+		for name, v := range vs {
+			values[name] = v
+		}
+	}
+
+	var specs []interface{}
+	for _, g := range collector.SpecGenerators() {
+		if v, err := g.Generate(ctx); err == nil {
+			specs = append(specs, v)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{"metrics": values, "specs": specs})
+}
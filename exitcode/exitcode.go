@@ -0,0 +1,69 @@
+// Package exitcode defines the exit codes of mackerel-agent, so that the
+// wrapper scripts and the service managers can tell the causes of the failures.
+package exitcode
+
+// The exit codes of mackerel-agent.
+const (
+	// OK is the exit code on success.
+	OK = 0
+	// Error is the exit code on the failures not classified below.
+	Error = 1
+	// ConfigError is the exit code on the errors of the config file or the command line options.
+	ConfigError = 2
+	// AuthError is the exit code when the API key is rejected by Mackerel.
+	AuthError = 3
+	// PidfileConflict is the exit code when another mackerel-agent is running.
+	PidfileConflict = 4
+	// HostRegistrationFailure is the exit code when the host could not be registered or found on Mackerel.
+	HostRegistrationFailure = 5
+	// HostNotFound is the exit code when the host to retire is not found, such as the one already retired.
+	HostNotFound = 6
+	// PreconditionFailed is the exit code when the host does not satisfy the condition to retire it.
+	PreconditionFailed = 7
+	// Canceled is the exit code when the operation is canceled at the prompt.
+	Canceled = 8
+	// EventLogUnavailable is the service-specific exit code of the Windows
+	// service wrapper when the event log cannot be opened.
+	EventLogUnavailable = 9
+)
+
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// Cause implements the causer interface of github.com/pkg/errors.
+func (e *exitError) Cause() error {
+	return e.err
+}
+
+// WithCode annotates err with the exit code. It returns nil if err is nil.
+func WithCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{err: err, code: code}
+}
+
+// Of returns the exit code annotated to err or its causes.
+// It returns Error if not annotated, and OK if err is nil.
+func Of(err error) int {
+	if err == nil {
+		return OK
+	}
+	for err != nil {
+		if e, ok := err.(*exitError); ok {
+			return e.code
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return Error
+}
@@ -0,0 +1,38 @@
+package exitcode
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "nil", err: nil, code: OK},
+		{name: "not annotated", err: fmt.Errorf("some error"), code: Error},
+		{name: "annotated", err: WithCode(fmt.Errorf("invalid config"), ConfigError), code: ConfigError},
+		{name: "wrapped", err: errors.Wrap(WithCode(fmt.Errorf("401"), AuthError), "failed to prepare host"), code: AuthError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := Of(tc.err); code != tc.code {
+				t.Errorf("the exit code should be %d but got %d", tc.code, code)
+			}
+		})
+	}
+}
+
+func TestWithCode(t *testing.T) {
+	if err := WithCode(nil, ConfigError); err != nil {
+		t.Errorf("nil should not be annotated: %v", err)
+	}
+	err := WithCode(fmt.Errorf("pidfile found"), PidfileConflict)
+	if err.Error() != "pidfile found" {
+		t.Errorf("the message should not be changed: %s", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Package fluentd forwards the metrics to fluentd or Fluent Bit by the forward
+// protocol. The delivery is best-effort: the metrics are dropped when the
+// queue is full or the endpoint is unavailable.
+package fluentd
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var logger = logformat.GetLogger("fluentd")
+
+var timeout = 5 * time.Second
+
+// Metrics are the metric values of a host collected at Time.
+type Metrics struct {
+	HostName string
+	HostID   string
+	Time     time.Time
+	Values   map[string]float64
+}
+
+// Forwarder forwards the metrics to the endpoint.
+type Forwarder struct {
+	addr  string
+	tag   string
+	queue chan []*Metrics
+	conn  net.Conn
+}
+
+// NewForwarder creates a forwarder of conf.
+func NewForwarder(conf *config.Fluentd) *Forwarder {
+	return &Forwarder{
+		addr:  net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
+		tag:   conf.Tag,
+		queue: make(chan []*Metrics, conf.QueueSize),
+	}
+}
+
+// Forward queues the metrics without blocking. They are dropped if the queue is full.
+func (f *Forwarder) Forward(metrics []*Metrics) {
+	select {
+	case f.queue <- metrics:
+	default:
+		logger.Warningf("The queue of the forwarding to %s is full. The metrics are dropped.", f.addr)
+	}
+}
+
+// Run forwards the queued metrics until ctx is done.
+func (f *Forwarder) Run(ctx context.Context) {
+	defer func() {
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metrics := <-f.queue:
+			if err := f.send(encode(f.tag, metrics)); err != nil {
+				logger.Warningf("Failed to forward metrics to %s (dropped): %s", f.addr, err)
+			}
+		}
+	}
+}
+
+func (f *Forwarder) send(msg []byte) error {
+	if f.conn == nil {
+		conn, err := net.DialTimeout("tcp", f.addr, timeout)
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := f.conn.Write(msg); err != nil {
+		// reconnect at the next time
+		f.conn.Close()
+		f.conn = nil
+		return err
+	}
+	return nil
+}
+
+// family returns the family of the metric, which is the first segment of
+// the name or the first two segments of the custom metrics.
+func family(name string) string {
+	n := 1
+	if strings.HasPrefix(name, "custom.") {
+		n = 2
+	}
+	parts := strings.SplitN(name, ".", n+1)
+	if len(parts) > n {
+		parts = parts[:n]
+	}
+	return strings.Join(parts, ".")
+}
+
+type entry struct {
+	time  int64
+	host  *Metrics
+	name  string
+	value float64
+}
+
+// encode encodes the metrics to the messages of the forward mode, which are
+// [tag, [[time, record], ...]] for each tag of <tag>.<family>.
+func encode(tag string, metrics []*Metrics) []byte {
+	entries := make(map[string][]*entry)
+	for _, m := range metrics {
+		for name, value := range m.Values {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			t := tag + "." + family(name)
+			entries[t] = append(entries[t], &entry{m.Time.Unix(), m, name, value})
+		}
+	}
+	tags := make([]string, 0, len(entries))
+	for t := range entries {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+
+	e := &encoder{}
+	for _, t := range tags {
+		es := entries[t]
+		sort.Slice(es, func(i, j int) bool {
+			return es[i].name < es[j].name
+		})
+		e.arrayHeader(2)
+		e.string(t)
+		e.arrayHeader(len(es))
+		for _, en := range es {
+			e.arrayHeader(2)
+			e.uint(uint64(en.time))
+			e.mapHeader(4)
+			e.string("host")
+			e.string(en.host.HostName)
+			e.string("host_id")
+			e.string(en.host.HostID)
+			e.string("name")
+			e.string(en.name)
+			e.string("value")
+			e.float(en.value)
+		}
+	}
+	return e.buf
+}
@@ -0,0 +1,130 @@
+package fluentd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestEncoder(t *testing.T) {
+	testCases := []struct {
+		encode   func(e *encoder)
+		expected []byte
+	}{
+		{func(e *encoder) { e.arrayHeader(2) }, []byte{0x92}},
+		{func(e *encoder) { e.arrayHeader(16) }, []byte{0xdc, 0x00, 0x10}},
+		{func(e *encoder) { e.arrayHeader(70000) }, []byte{0xdd, 0x00, 0x01, 0x11, 0x70}},
+		{func(e *encoder) { e.mapHeader(4) }, []byte{0x84}},
+		{func(e *encoder) { e.string("ab") }, []byte{0xa2, 'a', 'b'}},
+		{func(e *encoder) { e.uint(1) }, []byte{0x01}},
+		{func(e *encoder) { e.uint(1500000000) }, []byte{0xce, 0x59, 0x68, 0x2f, 0x00}},
+		{func(e *encoder) { e.float(1.5) }, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+	}
+	for i, tc := range testCases {
+		e := &encoder{}
+		tc.encode(e)
+		if !bytes.Equal(e.buf, tc.expected) {
+			t.Errorf("%d: should be encoded to %x but %x", i, tc.expected, e.buf)
+		}
+	}
+
+	e := &encoder{}
+	e.string(strings.Repeat("a", 40))
+	if !bytes.Equal(e.buf[:2], []byte{0xd9, 40}) || len(e.buf) != 42 {
+		t.Errorf("unexpected str8: %x", e.buf)
+	}
+	e = &encoder{}
+	e.string(strings.Repeat("a", 300))
+	if !bytes.Equal(e.buf[:3], []byte{0xda, 0x01, 0x2c}) || len(e.buf) != 303 {
+		t.Errorf("unexpected str16: %x", e.buf[:3])
+	}
+}
+
+func TestFamily(t *testing.T) {
+	testCases := map[string]string{
+		"loadavg5":                "loadavg5",
+		"cpu.user.percentage":     "cpu",
+		"custom.mysql.cmd.select": "custom.mysql",
+		"custom.statsd":           "custom.statsd",
+	}
+	for name, expected := range testCases {
+		if f := family(name); f != expected {
+			t.Errorf("the family of %s should be %s but %s", name, expected, f)
+		}
+	}
+}
+
+func expectedMessage() []byte {
+	e := &encoder{}
+	e.arrayHeader(2)
+	e.string("mackerel.loadavg5")
+	e.arrayHeader(1)
+	e.arrayHeader(2)
+	e.uint(1500000000)
+	e.mapHeader(4)
+	for _, s := range []string{"host", "app01", "host_id", "abc", "name", "loadavg5", "value"} {
+		e.string(s)
+	}
+	e.float(1.5)
+	return e.buf
+}
+
+func testMetrics() []*Metrics {
+	return []*Metrics{{
+		HostName: "app01",
+		HostID:   "abc",
+		Time:     time.Unix(1500000000, 0),
+		Values:   map[string]float64{"loadavg5": 1.5, "custom.a.b": math.NaN()},
+	}}
+}
+
+func TestEncode(t *testing.T) {
+	if got, expected := encode("mackerel", testMetrics()), expectedMessage(); !bytes.Equal(got, expected) {
+		t.Errorf("unexpected message:\n%x\n%x", got, expected)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(expectedMessage()))
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			received <- buf
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	f := NewForwarder(&config.Fluentd{Host: "127.0.0.1", Port: addr.Port, Tag: "mackerel", QueueSize: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.Forward(testMetrics())
+	// The queue is full and the metrics are dropped without blocking.
+	f.Forward(testMetrics())
+	go f.Run(ctx)
+
+	select {
+	case msg := <-received:
+		if !bytes.Equal(msg, expectedMessage()) {
+			t.Errorf("unexpected message: %x", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the metrics should be forwarded")
+	}
+}
@@ -0,0 +1,59 @@
+package fluentd
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// encoder encodes the subset of MessagePack used by the forward protocol.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) header(n int, fix, b16, b32 byte, fixMax int) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, b16, 0, 0)
+		binary.BigEndian.PutUint16(e.buf[len(e.buf)-2:], uint16(n))
+	default:
+		e.buf = append(e.buf, b32, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], uint32(n))
+	}
+}
+
+func (e *encoder) arrayHeader(n int) {
+	e.header(n, 0x90, 0xdc, 0xdd, 15)
+}
+
+func (e *encoder) mapHeader(n int) {
+	e.header(n, 0x80, 0xde, 0xdf, 15)
+}
+
+func (e *encoder) string(s string) {
+	if n := len(s); n > 31 && n <= math.MaxUint8 {
+		e.buf = append(e.buf, 0xd9, byte(n))
+	} else {
+		e.header(n, 0xa0, 0xda, 0xdb, 31)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) uint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.buf = append(e.buf, byte(v))
+	case v <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], uint32(v))
+	default:
+		e.buf = append(e.buf, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], v)
+	}
+}
+
+func (e *encoder) float(v float64) {
+	e.buf = append(e.buf, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], math.Float64bits(v))
+}
@@ -0,0 +1,75 @@
+// +build windows
+
+package logeventlog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// EventID is the event ID of the logs, which is the same as the one of the
+// logs forwarded by the wrapper.
+const EventID = 1
+
+const sourceKeyName = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+
+type eventLogger interface {
+	Info(eid uint32, msg string) error
+	Warning(eid uint32, msg string) error
+	Error(eid uint32, msg string) error
+	Close() error
+}
+
+// Writer writes the logs to the event log with the types by their levels.
+type Writer struct {
+	mu   sync.Mutex
+	elog eventLogger
+}
+
+// Open opens the event log of source, which has to be registered by the installer.
+func Open(source string) (*Writer, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, sourceKeyName+source, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("the event source %q is not registered: %s", source, err)
+	}
+	k.Close()
+	elog, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{elog: elog}, nil
+}
+
+// Write writes each log in p to the event log.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, msg := range logformat.Split(string(p)) {
+		if err := w.report(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *Writer) report(msg string) error {
+	switch logformat.Level(msg) {
+	case "TRACE", "DEBUG", "INFO":
+		return w.elog.Info(EventID, msg)
+	case "WARNING", "ERROR":
+		return w.elog.Warning(EventID, msg)
+	default:
+		return w.elog.Error(EventID, msg)
+	}
+}
+
+// Close closes the event log.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.elog.Close()
+}
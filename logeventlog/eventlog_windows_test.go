@@ -0,0 +1,53 @@
+// +build windows
+
+package logeventlog
+
+import (
+	"reflect"
+	"testing"
+)
+
+type item struct {
+	typ string
+	eid uint32
+	msg string
+}
+
+type testLogger struct {
+	items []item
+}
+
+func (l *testLogger) Info(eid uint32, msg string) error {
+	l.items = append(l.items, item{"info", eid, msg})
+	return nil
+}
+
+func (l *testLogger) Warning(eid uint32, msg string) error {
+	l.items = append(l.items, item{"warning", eid, msg})
+	return nil
+}
+
+func (l *testLogger) Error(eid uint32, msg string) error {
+	l.items = append(l.items, item{"error", eid, msg})
+	return nil
+}
+
+func (l *testLogger) Close() error {
+	return nil
+}
+
+func TestWriter(t *testing.T) {
+	l := &testLogger{}
+	w := &Writer{elog: l}
+	w.Write([]byte("2019/09/01 12:34:56 DEBUG <command> debug\n"))
+	w.Write([]byte("2019/09/01 12:34:56 WARNING <checks> stderr: a\nb\n"))
+	w.Write([]byte("2019/09/01 12:34:56 CRITICAL <main> stopped\npanic: something\n"))
+	expect := []item{
+		{"info", EventID, "2019/09/01 12:34:56 DEBUG <command> debug"},
+		{"warning", EventID, "2019/09/01 12:34:56 WARNING <checks> stderr: a\nb"},
+		{"error", EventID, "2019/09/01 12:34:56 CRITICAL <main> stopped\npanic: something"},
+	}
+	if !reflect.DeepEqual(l.items, expect) {
+		t.Errorf("the logs should be written by the levels:\n%+v\nbut\n%+v", expect, l.items)
+	}
+}
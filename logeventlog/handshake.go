@@ -0,0 +1,42 @@
+// Package logeventlog writes the logs of the agent to the Windows event log.
+package logeventlog
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// HandshakeEnv is set by the Windows service wrapper, which forwards the stderr
+// of the agent to the event log. When the agent writes the logs to the event
+// log by itself, it writes HandshakeLine to stderr so that the wrapper stops
+// forwarding the logs in stderr.
+const HandshakeEnv = "MACKEREL_AGENT_EVENTLOG_HANDSHAKE"
+
+// HandshakeLine is the line written to stderr by Handshake.
+const HandshakeLine = "mackerel-agent: writing the logs to the event log"
+
+// Handshake tells the wrapper that the logs are written to the event log, if
+// the agent is run by the wrapper.
+func Handshake(w io.Writer) error {
+	if os.Getenv(HandshakeEnv) == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(w, HandshakeLine)
+	return err
+}
+
+// StartedLine is the line written to stderr by Started at each start of the
+// agent, including the restarts by the supervisor, by which the wrapper counts
+// the restarts.
+const StartedLine = "mackerel-agent: started"
+
+// Started tells the wrapper that the agent has started, if the agent is run by
+// the wrapper.
+func Started(w io.Writer) error {
+	if os.Getenv(HandshakeEnv) == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(w, StartedLine)
+	return err
+}
@@ -0,0 +1,49 @@
+package logeventlog
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	defer os.Unsetenv(HandshakeEnv)
+
+	var buf bytes.Buffer
+	os.Unsetenv(HandshakeEnv)
+	if err := Handshake(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("the handshake should not be written without the wrapper: %q", buf.String())
+	}
+
+	os.Setenv(HandshakeEnv, "1")
+	if err := Handshake(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != HandshakeLine+"\n" {
+		t.Errorf("the handshake should be written for the wrapper: %q", got)
+	}
+}
+
+func TestStarted(t *testing.T) {
+	defer os.Unsetenv(HandshakeEnv)
+
+	var buf bytes.Buffer
+	os.Unsetenv(HandshakeEnv)
+	if err := Started(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("the start should not be written without the wrapper: %q", buf.String())
+	}
+
+	os.Setenv(HandshakeEnv, "1")
+	if err := Started(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != StartedLine+"\n" {
+		t.Errorf("the start should be written for the wrapper: %q", got)
+	}
+}
@@ -0,0 +1,227 @@
+// Package logfile writes the logs to a file rotated by its size or by time.
+package logfile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of Options.
+const (
+	DefaultMaxSize  = 10 * 1024 * 1024
+	DefaultMaxFiles = 5
+)
+
+// Options configure the rotation of File.
+type Options struct {
+	// MaxSize is the size in bytes to rotate the file exceeding it.
+	MaxSize int64
+	// MaxFiles is the number of the rotated files kept, path.1 to path.<MaxFiles>.
+	MaxFiles int
+	// Interval is to rotate the file when the last write was in the previous
+	// interval, such as 24 hours. The intervals are aligned on the zero time
+	// in UTC. Zero means no rotation by time.
+	Interval time.Duration
+	// Compress compresses the rotated files as path.<N>.gz.
+	Compress bool
+}
+
+// File is a log file, which is safe for the concurrent writes.
+type File struct {
+	path string
+	opts Options
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	lastWrite time.Time
+	closed    bool
+	// compressing is the compression of the rotated file in the background.
+	compressing sync.WaitGroup
+}
+
+// now is replaced in the tests.
+var now = time.Now
+
+// Open opens the log file at path to append the logs.
+func Open(path string, opts Options) (*File, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = DefaultMaxFiles
+	}
+	f := &File{path: path, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	f.lastWrite = fi.ModTime()
+	if f.size == 0 {
+		f.lastWrite = now()
+	}
+	return nil
+}
+
+// Write writes p to the file, after rotating the file if needed. When the file
+// can not be written, p is written to stderr.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := now()
+	if f.file != nil && f.shouldRotate(t, len(p)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate the log file %s: %s\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		if f.closed {
+			return os.Stderr.Write(p)
+		}
+		if err := f.open(); err != nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	f.lastWrite = t
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write the log file %s: %s\n", f.path, err)
+		m, err := os.Stderr.Write(p[n:])
+		return n + m, err
+	}
+	return n, nil
+}
+
+func (f *File) shouldRotate(t time.Time, n int) bool {
+	if f.size > 0 && f.size+int64(n) > f.opts.MaxSize {
+		return true
+	}
+	d := f.opts.Interval
+	return d > 0 && f.size > 0 && !t.Truncate(d).Equal(f.lastWrite.Truncate(d))
+}
+
+// rotate renames path.<N> to path.<N+1> and path to path.1, and opens path.
+// The files beyond MaxFiles are removed. path.1 is compressed in the
+// background not to block the writes, which is waited at the next rotation.
+func (f *File) rotate() error {
+	f.compressing.Wait()
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	for i := f.opts.MaxFiles; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			name := f.rotatedName(i) + ext
+			if _, err := os.Stat(name); err != nil {
+				continue
+			}
+			var err error
+			if i == f.opts.MaxFiles {
+				err = os.Remove(name)
+			} else {
+				err = os.Rename(name, f.rotatedName(i+1)+ext)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	name := f.rotatedName(1)
+	if err := os.Rename(f.path, name); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.opts.Compress {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			if err := compress(name); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress the log file %s: %s\n", name, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (f *File) rotatedName(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// compress compresses name to name.gz and removes name.
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(dst)
+	if _, err := io.Copy(w, src); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := w.Close(); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+// Reopen closes and opens the file, for the file moved by logrotate.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close closes the file, after the rotated file is compressed.
+func (f *File) Close() error {
+	defer f.compressing.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,196 @@
+package logfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func readGzipFile(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFile_RotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-logfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.log")
+
+	f, err := Open(path, Options{MaxSize: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, s := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, path); got != "line4\n" {
+		t.Errorf("the log file should be rotated: %q", got)
+	}
+	if got := readFile(t, path+".1"); got != "line3\n" {
+		t.Errorf("the rotated file should be kept: %q", got)
+	}
+	if got := readFile(t, path+".2"); got != "line2\n" {
+		t.Errorf("the rotated file should be kept: %q", got)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("the rotated files beyond MaxFiles should be removed: %v", err)
+	}
+}
+
+func TestFile_RotateByInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-logfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.log")
+
+	current := time.Date(2019, 9, 1, 23, 59, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	f, err := Open(path, Options{Interval: 24 * time.Hour, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("day1\n"))
+	current = current.Add(30 * time.Second)
+	f.Write([]byte("day1 again\n"))
+	current = current.Add(time.Minute)
+	f.Write([]byte("day2\n"))
+	f.compressing.Wait()
+
+	if got := readFile(t, path); got != "day2\n" {
+		t.Errorf("the log file should be rotated: %q", got)
+	}
+	if got := readGzipFile(t, path+".1.gz"); got != "day1\nday1 again\n" {
+		t.Errorf("the rotated file should be compressed: %q", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("the rotated file should be removed after compressed: %v", err)
+	}
+
+	current = current.Add(24 * time.Hour)
+	f.Write([]byte("day3\n"))
+	f.compressing.Wait()
+	if got := readGzipFile(t, path+".2.gz"); got != "day1\nday1 again\n" {
+		t.Errorf("the compressed file should be rotated: %q", got)
+	}
+	if got := readGzipFile(t, path+".1.gz"); got != "day2\n" {
+		t.Errorf("the rotated file should be compressed: %q", got)
+	}
+}
+
+func TestFile_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-logfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.log")
+
+	f, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("before\n"))
+	// logrotate moves the file and sends SIGHUP
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+	if got := readFile(t, path+".moved"); got != "before\n" {
+		t.Errorf("the moved file should not be written after reopened: %q", got)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Errorf("the file should be created by reopen: %q", got)
+	}
+}
+
+func TestFile_ConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-logfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.log")
+
+	f, err := Open(path, Options{MaxSize: 1000, MaxFiles: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	line := strings.Repeat("x", 99) + "\n"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				f.Write([]byte(line))
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all bytes.Buffer
+	for _, name := range files {
+		s := readFile(t, name)
+		if len(s) > 1000 {
+			t.Errorf("%s should not exceed MaxSize: %d", name, len(s))
+		}
+		all.WriteString(s)
+	}
+	if all.String() != strings.Repeat(line, 500) {
+		t.Errorf("the lines should not be lost or interleaved: %d bytes", all.Len())
+	}
+}
+
+func TestOpen_Error(t *testing.T) {
+	if _, err := Open(filepath.Join("testdata", "not-exist", "agent.log"), Options{}); err == nil {
+		t.Error("Open should raise error if the directory does not exist")
+	}
+}
@@ -0,0 +1,134 @@
+package logformat
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// dedupWindow is the window where the identical logs are logged only once.
+const dedupWindow = time.Hour
+
+// dedupMaxEntries limits the number of the logs tracked at once.
+const dedupMaxEntries = 1000
+
+// dedupMinLevel is the lowest level of the logs deduplicated.
+var dedupMinLevel = levelRanks["WARNING"]
+
+// durationRe matches the durations in the messages, such as "1m30.5s", which
+// are ignored to compare the messages.
+var durationRe = regexp.MustCompile(`\b\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h)(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))*\b`)
+
+var dedupEnabled bool
+
+// SetDedup enables the deduplication of the logs of warning or higher levels.
+// The identical logs of a component within an hour are logged once, and
+// summarized when the hour passes or the component logs another message.
+func SetDedup(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	dedupEnabled = on
+	apply()
+}
+
+type dedupEntry struct {
+	// header is the level and the tag of the log, such as "ERROR <command> ".
+	header string
+	// message is the last one of the identical messages.
+	message string
+	since   time.Time
+	count   int
+}
+
+// dedupWriter suppresses the logs identical to the ones written in dedupWindow.
+type dedupWriter struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	// last is the key of the last log by the tag.
+	last map[string]string
+}
+
+func newDedupWriter(w io.Writer) *dedupWriter {
+	return &dedupWriter{w: w, entries: make(map[string]*dedupEntry), last: make(map[string]string)}
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t := now()
+	if err := w.summarizeExpired(t); err != nil {
+		return 0, err
+	}
+	m := logRe.FindSubmatchIndex(p)
+	if m == nil || levelRanks[string(p[m[4]:m[5]])] < dedupMinLevel {
+		return w.w.Write(p)
+	}
+	tag := string(p[m[6]:m[7]])
+	header := string(p[m[4]:m[1]])
+	message := string(p[m[1]:])
+	key := header + durationRe.ReplaceAllString(message, "")
+
+	if last, ok := w.last[tag]; ok && last != key {
+		if err := w.summarize(last, t); err != nil {
+			return 0, err
+		}
+	}
+	w.last[tag] = key
+	if e, ok := w.entries[key]; ok {
+		e.count++
+		e.message = message
+		return len(p), nil
+	}
+	if len(w.entries) < dedupMaxEntries {
+		w.entries[key] = &dedupEntry{header: header, message: message, since: t}
+	}
+	return w.w.Write(p)
+}
+
+// summarizeExpired summarizes the logs whose windows are closed.
+func (w *dedupWriter) summarizeExpired(t time.Time) error {
+	for key, e := range w.entries {
+		if t.Sub(e.since) >= dedupWindow {
+			if err := w.summarize(key, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// summarize writes the number of the suppressed logs of key if any, and stops
+// tracking it.
+func (w *dedupWriter) summarize(key string, t time.Time) error {
+	e, ok := w.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(w.entries, key)
+	if e.count == 0 {
+		return nil
+	}
+	d := t.Sub(e.since)
+	period := "hour"
+	if d < dedupWindow {
+		period = d.Round(time.Second).String()
+	}
+	// the fields of the message are carried over to the summary
+	fields, message := "", e.message
+	if len(message) > 0 && message[0] == fieldsMarker[0] {
+		for i := 1; i < len(message); i++ {
+			if message[i] == fieldsMarker[0] {
+				fields, message = message[:i+1], message[i+1:]
+				break
+			}
+		}
+	}
+	summary := fmt.Sprintf("%s %s%sprevious message repeated %d times in the last %s: %s",
+		t.Format("2006/01/02 15:04:05"), e.header, fields, e.count, period, message)
+	_, err := io.WriteString(w.w, summary)
+	return err
+}
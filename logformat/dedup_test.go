@@ -0,0 +1,99 @@
+package logformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupWriter(t *testing.T) {
+	current := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	var buf bytes.Buffer
+	w := newDedupWriter(&buf)
+	write := func(s string) {
+		t.Helper()
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 60; i++ {
+		write("2019/09/01 12:00:00 ERROR <metrics.plugin> Failed to execute command foo (took " + time.Duration(i+1).String() + ")\n")
+		write("2019/09/01 12:00:00 INFO <command> posted\n")
+		current = current.Add(time.Minute)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 61 {
+		t.Fatalf("the identical errors should be suppressed: %d lines\n%s", len(lines), buf.String())
+	}
+	write("2019/09/01 13:00:00 INFO <command> posted\n")
+	expect := "2019/09/01 13:00:00 ERROR <metrics.plugin> previous message repeated 59 times in the last hour: Failed to execute command foo (took 60ns)\n" +
+		"2019/09/01 13:00:00 INFO <command> posted\n"
+	if got := buf.String(); !strings.HasSuffix(got, expect) {
+		t.Errorf("the summary should be written when the window closes:\n%s", got)
+	}
+
+	// the summary is written when the message changes
+	buf.Reset()
+	write("2019/09/01 13:00:00 WARNING <checks> Checker \"foo\" output stderr: a\n")
+	current = current.Add(time.Minute)
+	write("2019/09/01 13:01:00 WARNING <checks> Checker \"foo\" output stderr: a\n")
+	current = current.Add(time.Minute)
+	write("2019/09/01 13:02:00 WARNING <checks> Checker \"foo\" output stderr: b\n")
+	expect = "2019/09/01 13:00:00 WARNING <checks> Checker \"foo\" output stderr: a\n" +
+		"2019/09/01 13:02:00 WARNING <checks> previous message repeated 1 times in the last 2m0s: Checker \"foo\" output stderr: a\n" +
+		"2019/09/01 13:02:00 WARNING <checks> Checker \"foo\" output stderr: b\n"
+	if got := buf.String(); got != expect {
+		t.Errorf("the summary should be written when the message changes:\n%s", got)
+	}
+
+	// the lower levels are not suppressed
+	buf.Reset()
+	write("2019/09/01 13:02:00 INFO <command> posted\n")
+	write("2019/09/01 13:02:00 INFO <command> posted\n")
+	if got := buf.String(); strings.Count(got, "posted") != 2 {
+		t.Errorf("the info logs should not be suppressed:\n%s", got)
+	}
+}
+
+func TestSetDedup_JSON(t *testing.T) {
+	current := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetJSON(true)
+	SetDedup(true)
+	defer func() {
+		now = time.Now
+		SetDedup(false)
+		SetJSON(false)
+		SetOutput(os.Stderr)
+	}()
+
+	for i := 0; i < 3; i++ {
+		lgr.Print("ERROR <command> " + Fields{"plugin": "foo"}.prefix() + "plugin failed\n")
+	}
+	current = current.Add(time.Hour)
+	lgr.Print("INFO <command> posted\n")
+
+	var logs []map[string]string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var v map[string]string
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("%q should be JSON: %s", line, err)
+		}
+		logs = append(logs, v)
+	}
+	if len(logs) != 3 {
+		t.Fatalf("the identical errors should be suppressed: %q", buf.String())
+	}
+	if logs[1]["message"] != "previous message repeated 2 times in the last hour: plugin failed" || logs[1]["plugin"] != "foo" || logs[1]["level"] != "ERROR" {
+		t.Errorf("the summary should carry the fields: %+v", logs[1])
+	}
+}
@@ -0,0 +1,292 @@
+// Package logformat provides the loggers of the agent, and formats the logs
+// as one JSON object per line, for the log pipelines which parse the logs.
+package logformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PluginOutput is the key of Fields for the output of a plugin, such as its
+// stderr. In the JSON format, the output in the message, quoted or at the end,
+// is replaced with "[plugin_output]".
+const PluginOutput = "plugin_output"
+
+// fieldsMarker encloses the fields in the messages. It never appears in the
+// fields encoded in JSON.
+const fieldsMarker = "\x00"
+
+var enabled int32
+
+var (
+	mu     sync.Mutex
+	output io.Writer = os.Stderr
+	// levels are the ranks of the levels by the components, and "" for the others.
+	levels map[string]int
+)
+
+// now is replaced in the tests.
+var now = time.Now
+
+// SetJSON switches the format of the logs to JSON, or back to the text format.
+func SetJSON(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if on {
+		atomic.StoreInt32(&enabled, 1)
+	} else {
+		atomic.StoreInt32(&enabled, 0)
+	}
+	apply()
+}
+
+// SetOutput sets the destination of the logs, which is os.Stderr by default.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+	apply()
+}
+
+// Output returns the destination of the logs, to which the logs already
+// formatted, such as the logs of the child processes, are written as they are.
+func Output() io.Writer {
+	mu.Lock()
+	defer mu.Unlock()
+	return output
+}
+
+// Reopen reopens the destination of the logs if it is a file which can be
+// reopened, for the file moved by logrotate.
+func Reopen() error {
+	if r, ok := Output().(interface{ Reopen() error }); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// levelRanks are the ranks of the levels of the loggers.
+var levelRanks = map[string]int{
+	"TRACE":    1,
+	"DEBUG":    2,
+	"INFO":     3,
+	"WARNING":  4,
+	"ERROR":    5,
+	"CRITICAL": 6,
+}
+
+// SetLevels sets the level of the logs, such as "DEBUG", to defaultLevel and
+// the levels of the components to componentLevels. The components are the
+// first elements of the tags of the loggers, such as "metrics" of
+// "metrics.plugin". The unknown levels are ignored.
+func SetLevels(defaultLevel string, componentLevels map[string]string) {
+	mu.Lock()
+	defer mu.Unlock()
+	def, ok := levelRanks[strings.ToUpper(defaultLevel)]
+	if !ok {
+		def = levelRanks["INFO"]
+	}
+	levels = map[string]int{"": def}
+	lowest := def
+	for c, lv := range componentLevels {
+		if r, ok := levelRanks[strings.ToUpper(lv)]; ok {
+			levels[c] = r
+			if r < lowest {
+				lowest = r
+			}
+		}
+	}
+	// the loggers pass the logs of the lowest level, and the others are
+	// filtered by levelWriter. The callers are logged with DEBUG.
+	atomic.StoreInt32(&lowestRank, int32(lowest))
+	if lowest <= levelRanks["DEBUG"] {
+		lgr.SetFlags(log.LstdFlags | log.Lshortfile)
+	} else {
+		lgr.SetFlags(log.LstdFlags)
+	}
+	if len(levels) == 1 {
+		levels = nil
+	}
+	apply()
+}
+
+func apply() {
+	var w = output
+	if IsJSON() {
+		w = &jsonWriter{w: w}
+	}
+	if dedupEnabled {
+		w = newDedupWriter(w)
+	}
+	if levels != nil {
+		w = &levelWriter{w: w, levels: levels}
+	}
+	lgr.SetOutput(w)
+}
+
+// levelWriter drops the logs below the levels of their components.
+type levelWriter struct {
+	w      io.Writer
+	levels map[string]int
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if m := logRe.FindSubmatch(p); m != nil {
+		component := string(m[3])
+		if i := strings.IndexByte(component, '.'); i >= 0 {
+			component = component[:i]
+		}
+		r, ok := w.levels[component]
+		if !ok {
+			r = w.levels[""]
+		}
+		if levelRanks[string(m[2])] < r {
+			return len(p), nil
+		}
+	}
+	return w.w.Write(p)
+}
+
+// IsJSON reports whether the logs are formatted in JSON.
+func IsJSON() bool {
+	return atomic.LoadInt32(&enabled) != 0
+}
+
+// Fields are the contextual fields of a log, such as the name of a plugin,
+// which are given by Logger.WithFields.
+type Fields map[string]string
+
+// logRe matches the header of the logs of Logger, which is
+// "2006/01/02 15:04:05 [file.go:123: ]LEVEL <tag> ".
+var logRe = regexp.MustCompile(`^(?:\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} )?(?:(\S+\.go:\d+): )?([A-Z]+) <([^>]*)> `)
+
+// Level returns the level of a log in the text or the JSON format, such as
+// "INFO", or "" if line is not a log.
+func Level(line string) string {
+	if strings.HasPrefix(line, "{") {
+		var v struct {
+			Level string `json:"level"`
+		}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			return ""
+		}
+		return v.Level
+	}
+	if m := logRe.FindStringSubmatch(line); m != nil {
+		return m[2]
+	}
+	return ""
+}
+
+// Parse returns the level, the component and the message of a log in the text
+// format, such as "INFO", "metrics.disk" and the rest of the log. ok is false
+// if line is not a log.
+func Parse(line string) (level, component, message string, ok bool) {
+	m := logRe.FindStringSubmatchIndex(line)
+	if m == nil {
+		return "", "", "", false
+	}
+	return line[m[4]:m[5]], line[m[6]:m[7]], line[m[1]:], true
+}
+
+// Split splits s into the logs, such as the logs of the child processes copied
+// at once. The lines without the levels are continued from the previous log.
+func Split(s string) []string {
+	var logs []string
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		if len(logs) == 0 || Level(line) != "" {
+			logs = append(logs, line)
+			continue
+		}
+		logs[len(logs)-1] += "\n" + line
+	}
+	return logs
+}
+
+// reservedKeys are not overwritten by Fields.
+var reservedKeys = map[string]bool{
+	"timestamp": true, "level": true, "component": true, "message": true, "caller": true,
+}
+
+// jsonWriter converts each log written by log.Logger, which is written at once,
+// to a JSON object.
+type jsonWriter struct {
+	w io.Writer
+}
+
+func (w *jsonWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(formatJSON(string(p), now())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func formatJSON(line string, t time.Time) []byte {
+	line = strings.TrimSuffix(line, "\n")
+	var caller, level, component string
+	if m := logRe.FindStringSubmatchIndex(line); m != nil {
+		if m[2] >= 0 {
+			caller = line[m[2]:m[3]]
+		}
+		level, component = line[m[4]:m[5]], line[m[6]:m[7]]
+		line = line[m[1]:]
+	}
+	var fields Fields
+	if strings.HasPrefix(line, fieldsMarker) {
+		if i := strings.Index(line[1:], fieldsMarker); i >= 0 {
+			if err := json.Unmarshal([]byte(line[1:i+1]), &fields); err == nil {
+				line = line[i+2:]
+			}
+		}
+	}
+	if out := fields[PluginOutput]; out != "" {
+		// the output is either quoted or at the end of the message
+		line = strings.Replace(line, strconv.Quote(out), "["+PluginOutput+"]", -1)
+		if strings.HasSuffix(line, out) {
+			line = strings.TrimSuffix(line, out) + "[" + PluginOutput + "]"
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	writeField(&b, "timestamp", t.Format(time.RFC3339Nano))
+	writeField(&b, "level", level)
+	writeField(&b, "component", component)
+	writeField(&b, "message", line)
+	if caller != "" {
+		writeField(&b, "caller", caller)
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if !reservedKeys[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeField(&b, k, fields[k])
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func writeField(b *bytes.Buffer, key, value string) {
+	if b.Len() > 1 {
+		b.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	b.Write(k)
+	b.WriteByte(':')
+	b.Write(v)
+}
@@ -0,0 +1,159 @@
+package logformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatJSON(t *testing.T) {
+	ts := time.Date(2019, 9, 1, 12, 34, 56, 0, time.UTC)
+	tests := []struct {
+		name   string
+		line   string
+		expect string
+	}{
+		{
+			name:   "text",
+			line:   "2019/09/01 12:34:56 INFO <command> Start: apibase = https://api.mackerelio.com\n",
+			expect: `{"timestamp":"2019-09-01T12:34:56Z","level":"INFO","component":"command","message":"Start: apibase = https://api.mackerelio.com"}` + "\n",
+		},
+		{
+			name:   "caller",
+			line:   "2019/09/01 12:34:56 command.go:123: DEBUG <command> wait 10 seconds\n",
+			expect: `{"timestamp":"2019-09-01T12:34:56Z","level":"DEBUG","component":"command","message":"wait 10 seconds","caller":"command.go:123"}` + "\n",
+		},
+		{
+			name:   "fields",
+			line:   "2019/09/01 12:34:56 INFO <command> \x00{\"host_id\":\"abc\",\"level\":\"x\"}\x00Start\n",
+			expect: `{"timestamp":"2019-09-01T12:34:56Z","level":"INFO","component":"command","message":"Start","host_id":"abc"}` + "\n",
+		},
+		{
+			name:   "quoted plugin output",
+			line:   "2019/09/01 12:34:56 INFO <metrics.plugin> \x00{\"command\":\"foo\",\"plugin_output\":\"a\\nb\"}\x00command foo outputted to STDERR: \"a\\nb\"\n",
+			expect: `{"timestamp":"2019-09-01T12:34:56Z","level":"INFO","component":"metrics.plugin","message":"command foo outputted to STDERR: [plugin_output]","command":"foo","plugin_output":"a\nb"}` + "\n",
+		},
+		{
+			name:   "multiline plugin output",
+			line:   "2019/09/01 12:34:56 WARNING <checks> \x00{\"plugin\":\"foo\",\"plugin_output\":\"a\\nb\\n\"}\x00Checker \"foo\" output stderr: a\nb\n\n",
+			expect: `{"timestamp":"2019-09-01T12:34:56Z","level":"WARNING","component":"checks","message":"Checker \"foo\" output stderr: [plugin_output]","plugin":"foo","plugin_output":"a\nb\n"}` + "\n",
+		},
+		{
+			name:   "unknown",
+			line:   "panic: something\n",
+			expect: `{"timestamp":"2019-09-01T12:34:56Z","level":"","component":"","message":"panic: something"}` + "\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(formatJSON(tc.line, ts))
+			if got != tc.expect {
+				t.Errorf("formatJSON(%q) should be\n%s\nbut got\n%s", tc.line, tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestSetJSON(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetJSON(true)
+	defer SetOutput(os.Stderr)
+
+	logger := GetLogger("test")
+	logger.WithFields(Fields{"plugin": "100%"}).Warningf("plugin %q failed: %d%%", "100%", 3)
+	var v map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatalf("the log should be a JSON object: %s: %q", err, buf.String())
+	}
+	if v["level"] != "WARNING" || v["component"] != "test" || v["message"] != `plugin "100%" failed: 3%` || v["plugin"] != "100%" {
+		t.Errorf("unexpected log: %+v", v)
+	}
+
+	buf.Reset()
+	SetJSON(false)
+	logger.WithFields(Fields{"plugin": "foo"}).Warningf("plugin %q failed", "foo")
+	if got := buf.String(); !bytes.HasSuffix(buf.Bytes(), []byte(" WARNING <test> plugin \"foo\" failed\n")) {
+		t.Errorf("the text format should not be changed: %q", got)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		line  string
+		level string
+	}{
+		{"2019/09/01 12:34:56 INFO <command> Start", "INFO"},
+		{"2019/09/01 12:34:56 command.go:123: DEBUG <command> wait", "DEBUG"},
+		{`{"timestamp":"2019-09-01T12:34:56Z","level":"WARNING","component":"checks","message":"x"}`, "WARNING"},
+		{"panic: something", ""},
+		{"{not json", ""},
+	}
+	for _, tc := range tests {
+		if got := Level(tc.line); got != tc.level {
+			t.Errorf("Level(%q) should be %q but got %q", tc.line, tc.level, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	level, component, message, ok := Parse("2019/09/01 12:34:56 disk.go:12: WARNING <metrics.disk> dropped <sda>")
+	if !ok || level != "WARNING" || component != "metrics.disk" || message != "dropped <sda>" {
+		t.Errorf("the log should be parsed: %q %q %q %v", level, component, message, ok)
+	}
+	if _, _, _, ok := Parse("panic: something"); ok {
+		t.Errorf("the line without the level should not be a log")
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevels("info", map[string]string{"spec": "debug", "metrics": "warning"})
+	defer func() {
+		SetLevels("info", nil)
+		SetOutput(os.Stderr)
+	}()
+
+	GetLogger("spec.cpu").Debugf("spec debug")
+	GetLogger("metrics.plugin").Infof("metrics info")
+	GetLogger("metrics.plugin").Warningf("metrics warning")
+	GetLogger("command").Debugf("command debug")
+	GetLogger("command").Infof("command info")
+
+	got := buf.String()
+	for _, s := range []string{"DEBUG <spec.cpu> spec debug", "WARNING <metrics.plugin> metrics warning", "INFO <command> command info"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("%q should be logged: %q", s, got)
+		}
+	}
+	for _, s := range []string{"metrics info", "command debug"} {
+		if strings.Contains(got, s) {
+			t.Errorf("%q should not be logged: %q", s, got)
+		}
+	}
+
+	buf.Reset()
+	SetLevels("error", nil)
+	GetLogger("spec.cpu").Warningf("spec warning")
+	GetLogger("command").Errorf("command error")
+	if got := buf.String(); strings.Contains(got, "spec warning") || !strings.Contains(got, "command error") {
+		t.Errorf("the logs should be filtered by the default level: %q", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	s := "2019/09/01 12:34:56 INFO <command> first\n2019/09/01 12:34:56 WARNING <checks> stderr: a\nb\n{\"level\":\"INFO\",\"message\":\"x\"}\n"
+	expect := []string{
+		"2019/09/01 12:34:56 INFO <command> first",
+		"2019/09/01 12:34:56 WARNING <checks> stderr: a\nb",
+		`{"level":"INFO","message":"x"}`,
+	}
+	if got := Split(s); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Split(%q) should be %q but got %q", s, expect, got)
+	}
+}
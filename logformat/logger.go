@@ -0,0 +1,98 @@
+package logformat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// lgr is the logger which all the loggers write to, whose output is replaced
+// by SetOutput, SetJSON and SetLevels.
+var lgr = log.New(os.Stderr, "", log.LstdFlags)
+
+// lowestRank is the rank of the lowest level logged by any component, which
+// is INFO by default. The others are filtered by levelWriter.
+var lowestRank = int32(levelRanks["INFO"])
+
+// Logger is the logger of a component, such as "metrics.plugin", which writes
+// the logs as "LEVEL <component> message" in the text format as the one of
+// golib/logging does. The logs have the fields given by WithFields.
+type Logger struct {
+	tag    string
+	fields Fields
+}
+
+// GetLogger returns the logger of the component tag.
+func GetLogger(tag string) *Logger {
+	return &Logger{tag: tag}
+}
+
+// WithFields returns the logger which attaches fields to the logs in addition
+// to the ones of l. The fields are omitted in the text format, so that the text
+// logs are not changed.
+//
+//	logger.WithFields(logformat.Fields{"plugin": name}).Warningf("plugin %q failed", name)
+func (l *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{tag: l.tag, fields: merged}
+}
+
+func (l *Logger) log(level string, format string, args ...interface{}) {
+	if int32(levelRanks[level]) < atomic.LoadInt32(&lowestRank) {
+		return
+	}
+	// caller -> Infof() -> log()
+	const depth = 3
+	lgr.Output(depth, level+" <"+l.tag+"> "+l.fields.prefix()+fmt.Sprintf(format, args...))
+}
+
+// Criticalf logs at the CRITICAL level.
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	l.log("CRITICAL", format, args...)
+}
+
+// Errorf logs at the ERROR level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log("ERROR", format, args...)
+}
+
+// Warningf logs at the WARNING level.
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log("WARNING", format, args...)
+}
+
+// Infof logs at the INFO level.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log("INFO", format, args...)
+}
+
+// Debugf logs at the DEBUG level.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log("DEBUG", format, args...)
+}
+
+// Tracef logs at the TRACE level, for the details of debugging.
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.log("TRACE", format, args...)
+}
+
+// prefix returns the fields enclosed by fieldsMarker at the head of the
+// message, which are parsed by jsonWriter. It is "" in the text format.
+func (f Fields) prefix() string {
+	if !IsJSON() || len(f) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(map[string]string(f))
+	if err != nil {
+		return ""
+	}
+	return fieldsMarker + string(b) + fieldsMarker
+}
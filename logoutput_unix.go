@@ -0,0 +1,35 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logsyslog"
+)
+
+// openSyslog opens syslog of the configuration, tagged with the program name.
+func openSyslog(conf *config.Config) (io.WriteCloser, error) {
+	network, raddr, err := conf.SyslogNetwork()
+	if err != nil {
+		return nil, err
+	}
+	facility := conf.SyslogFacility
+	if facility == "" {
+		facility = config.DefaultSyslogFacility
+	}
+	w, err := logsyslog.New(network, raddr, facility, filepath.Base(os.Args[0]))
+	if w == nil {
+		return nil, err
+	}
+	return w, err
+}
+
+// openEventLog fails because the event log is supported only on windows.
+func openEventLog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("the event log is supported only on windows")
+}
@@ -0,0 +1,34 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logeventlog"
+)
+
+// eventSource is the event source registered by the installer.
+const eventSource = "mackerel-agent"
+
+// openSyslog fails because syslog is not supported on windows.
+func openSyslog(conf *config.Config) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on windows")
+}
+
+// openEventLog opens the event log, and tells the service wrapper to stop
+// forwarding the logs in stderr.
+func openEventLog() (io.WriteCloser, error) {
+	w, err := logeventlog.Open(eventSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := logeventlog.Handshake(os.Stderr); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
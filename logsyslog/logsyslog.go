@@ -0,0 +1,166 @@
+// +build !windows
+
+// Package logsyslog sends the logs of the agent to syslog.
+package logsyslog
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// severities map the levels of the logs to the severities of syslog.
+var severities = map[string]syslog.Priority{
+	"TRACE":    syslog.LOG_DEBUG,
+	"DEBUG":    syslog.LOG_DEBUG,
+	"INFO":     syslog.LOG_INFO,
+	"WARNING":  syslog.LOG_WARNING,
+	"ERROR":    syslog.LOG_ERR,
+	"CRITICAL": syslog.LOG_CRIT,
+}
+
+// The interval of the reconnection is doubled up to maxRetryInterval.
+var (
+	minRetryInterval = time.Second
+	maxRetryInterval = 5 * time.Minute
+)
+
+// The variables are replaced in the tests.
+var (
+	dial             = syslog.Dial
+	now              = time.Now
+	stderr io.Writer = os.Stderr
+)
+
+// timestampRe matches the timestamp of the text logs, which syslog adds.
+var timestampRe = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} `)
+
+// Writer writes the logs to syslog. While syslog is unavailable, the logs are
+// written to stderr and the connection is retried with backoff.
+type Writer struct {
+	network, raddr string
+	facility       syslog.Priority
+	tag            string
+
+	mu            sync.Mutex
+	w             *syslog.Writer
+	retryAt       time.Time
+	retryInterval time.Duration
+	closed        bool
+}
+
+// New creates a Writer to the syslog of network and raddr with the facility
+// name, such as "daemon". The empty network means the local syslog. When the
+// connection fails, the error is returned with the Writer which reconnects.
+func New(network, raddr, facility, tag string) (*Writer, error) {
+	f, ok := facilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility: %q", facility)
+	}
+	w := &Writer{network: network, raddr: raddr, facility: f, tag: tag}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w, w.connect(now())
+}
+
+// connect connects to syslog, and schedules the next try on failure.
+func (w *Writer) connect(t time.Time) error {
+	sw, err := dial(w.network, w.raddr, w.facility|syslog.LOG_INFO, w.tag)
+	if err != nil {
+		if w.retryInterval == 0 {
+			w.retryInterval = minRetryInterval
+		} else if w.retryInterval *= 2; w.retryInterval > maxRetryInterval {
+			w.retryInterval = maxRetryInterval
+		}
+		w.retryAt = t.Add(w.retryInterval)
+		return err
+	}
+	w.w, w.retryInterval = sw, 0
+	return nil
+}
+
+// Write sends each log in p to syslog with the severity of its level. p may
+// contain the logs of the child processes, which are split by their headers.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t := now()
+	if w.w == nil && !w.closed && !t.Before(w.retryAt) {
+		if err := w.connect(t); err != nil {
+			fmt.Fprintf(stderr, "failed to connect to syslog (retry in %s): %s\n", w.retryInterval, err)
+		} else {
+			fmt.Fprintf(stderr, "connected to syslog\n")
+		}
+	}
+	if w.w == nil {
+		return stderr.Write(p)
+	}
+	for _, msg := range logformat.Split(string(p)) {
+		if err := w.send(msg); err != nil {
+			fmt.Fprintf(stderr, "failed to write to syslog: %s\n", err)
+			w.w.Close()
+			w.w = nil
+			w.retryAt = t
+			return stderr.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (w *Writer) send(msg string) error {
+	m := timestampRe.ReplaceAllString(msg, "")
+	switch severities[logformat.Level(msg)] {
+	case syslog.LOG_DEBUG:
+		return w.w.Debug(m)
+	case syslog.LOG_WARNING:
+		return w.w.Warning(m)
+	case syslog.LOG_ERR:
+		return w.w.Err(m)
+	case syslog.LOG_CRIT:
+		return w.w.Crit(m)
+	default:
+		return w.w.Info(m)
+	}
+}
+
+// Close closes the connection to syslog.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.w == nil {
+		return nil
+	}
+	err := w.w.Close()
+	w.w = nil
+	return err
+}
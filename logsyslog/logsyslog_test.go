@@ -0,0 +1,128 @@
+// +build !windows
+
+package logsyslog
+
+import (
+	"bytes"
+	"errors"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenUDP(t *testing.T) (*net.UDPConn, func() string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() string {
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("syslog should receive a message: %s", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestWriter(t *testing.T) {
+	conn, read := listenUDP(t)
+	defer conn.Close()
+
+	w, err := New("udp", conn.LocalAddr().String(), "local3", "mackerel-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tests := []struct {
+		log      string
+		priority string
+		message  string
+	}{
+		{"2019/09/01 12:34:56 INFO <command> Start\n", "<158>", "INFO <command> Start"},
+		{"2019/09/01 12:34:56 command.go:12: DEBUG <command> wait\n", "<159>", "command.go:12: DEBUG <command> wait"},
+		{"2019/09/01 12:34:56 WARNING <checks> stderr: a\nb\n", "<156>", "WARNING <checks> stderr: a\nb"},
+		{"2019/09/01 12:34:56 ERROR <command> failed\n", "<155>", "ERROR <command> failed"},
+		{"2019/09/01 12:34:56 CRITICAL <main> stopped\n", "<154>", "CRITICAL <main> stopped"},
+		{`{"timestamp":"2019-09-01T12:34:56Z","level":"WARNING","component":"checks","message":"x"}` + "\n", "<156>", `{"timestamp":"2019-09-01T12:34:56Z","level":"WARNING","component":"checks","message":"x"}`},
+	}
+	for _, tc := range tests {
+		if _, err := w.Write([]byte(tc.log)); err != nil {
+			t.Fatal(err)
+		}
+		got := read()
+		if !strings.HasPrefix(got, tc.priority) {
+			t.Errorf("the priority of %q should be %s: %q", tc.log, tc.priority, got)
+		}
+		if !strings.Contains(got, " mackerel-agent[") || !strings.HasSuffix(strings.TrimSuffix(got, "\n"), "]: "+tc.message) {
+			t.Errorf("the message of %q should be tagged %q: %q", tc.log, tc.message, got)
+		}
+	}
+
+	// the logs of the child processes are copied at once
+	w.Write([]byte("2019/09/01 12:34:56 INFO <command> first\n2019/09/01 12:34:56 ERROR <command> second\n"))
+	if got := read(); !strings.HasPrefix(got, "<158>") || !strings.HasSuffix(got, "first\n") {
+		t.Errorf("the first log should be sent: %q", got)
+	}
+	if got := read(); !strings.HasPrefix(got, "<155>") || !strings.HasSuffix(got, "second\n") {
+		t.Errorf("the second log should be sent: %q", got)
+	}
+}
+
+func TestWriter_Reconnect(t *testing.T) {
+	var buf bytes.Buffer
+	stderr = &buf
+	current := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	available := false
+	dial = func(network, raddr string, priority syslog.Priority, tag string) (*syslog.Writer, error) {
+		if !available {
+			return nil, errors.New("connection refused")
+		}
+		return syslog.Dial(network, raddr, priority, tag)
+	}
+	defer func() {
+		stderr, now, dial = os.Stderr, time.Now, syslog.Dial
+	}()
+
+	conn, read := listenUDP(t)
+	defer conn.Close()
+
+	w, err := New("udp", conn.LocalAddr().String(), "daemon", "mackerel-agent")
+	if err == nil {
+		t.Fatal("New should raise error if syslog is unavailable")
+	}
+	defer w.Close()
+
+	// the logs are written to stderr until reconnected
+	w.Write([]byte("2019/09/01 12:00:00 INFO <command> first\n"))
+	if !strings.Contains(buf.String(), "first") {
+		t.Errorf("the log should be written to stderr: %q", buf.String())
+	}
+	current = current.Add(time.Second)
+	w.Write([]byte("2019/09/01 12:00:01 INFO <command> second\n"))
+	if w.retryInterval != 2*time.Second {
+		t.Errorf("the retry interval should be doubled: %s", w.retryInterval)
+	}
+
+	available = true
+	current = current.Add(time.Second)
+	w.Write([]byte("2019/09/01 12:00:02 INFO <command> third\n"))
+	if !strings.Contains(buf.String(), "third") {
+		t.Errorf("the log should be written to stderr before the retry: %q", buf.String())
+	}
+	current = current.Add(time.Second)
+	w.Write([]byte("2019/09/01 12:00:03 INFO <command> fourth\n"))
+	if got := read(); !strings.HasSuffix(got, "fourth\n") {
+		t.Errorf("the log should be sent after reconnected: %q", got)
+	}
+	if strings.Contains(buf.String(), "fourth") {
+		t.Errorf("the log should not be written to stderr after reconnected: %q", buf.String())
+	}
+}
@@ -3,15 +3,18 @@ package mackerel
 import (
 	"fmt"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
-var logger = logging.GetLogger("api")
+var logger = logformat.GetLogger("api")
 
 // API is the main interface of Mackerel API.
 type API struct {
 	*mkr.Client
+
+	retryAfter *retryAfterTransport
+	request    *requestTransport
 }
 
 // IsClientError returns true if err is HTTP 4xx.
@@ -23,6 +26,24 @@ func IsClientError(err error) bool {
 	return 400 <= e.StatusCode && e.StatusCode < 500
 }
 
+// IsAuthError returns true if err is HTTP 401 or 403, which means the API key is rejected.
+func IsAuthError(err error) bool {
+	e, ok := err.(*mkr.APIError)
+	if !ok {
+		return false
+	}
+	return e.StatusCode == 401 || e.StatusCode == 403
+}
+
+// IsNotFound returns true if err is HTTP 404.
+func IsNotFound(err error) bool {
+	e, ok := err.(*mkr.APIError)
+	if !ok {
+		return false
+	}
+	return e.StatusCode == 404
+}
+
 // IsServerError returns true if err is HTTP 5xx.
 func IsServerError(err error) bool {
 	e, ok := err.(*mkr.APIError)
@@ -54,7 +75,12 @@ func NewAPI(rawurl string, apiKey string, verbose bool) (*API, error) {
 		return nil, err
 	}
 	c.PrioritizedLogger = logger
-	return &API{Client: c}, nil
+	ra := &retryAfterTransport{base: &connTraceTransport{base: transport}}
+	rt := &requestTransport{base: ra}
+	c.HTTPClient.Transport = rt
+	// the deadlines are given by requestTransport
+	c.HTTPClient.Timeout = 0
+	return &API{Client: c, retryAfter: ra, request: rt}, nil
 }
 
 // FindHostByCustomIdentifier find the host by the custom identifier
@@ -72,3 +98,12 @@ func (api *API) FindHostByCustomIdentifier(customIdentifier string) (*mkr.Host,
 	}
 	return hosts[0], nil
 }
+
+// FindHostsByName finds the hosts of the name which are not retired.
+func (api *API) FindHostsByName(name string) ([]*mkr.Host, error) {
+	param := mkr.FindHostsParam{
+		Name:     name,
+		Statuses: []string{"working", "standby", "maintenance", "poweroff"},
+	}
+	return api.Client.FindHosts(&param)
+}
@@ -1,7 +1,11 @@
 package mackerel
 
 import (
+	"fmt"
+	"unicode/utf8"
+
 	"github.com/mackerelio/mackerel-agent/checks"
+	"github.com/mackerelio/mackerel-agent/util"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -16,16 +20,15 @@ func (api *API) ReportCheckMonitors(hostID string, reports []*checks.Report) err
 	payload := &mkr.CheckReports{
 		Reports: make([]*mkr.CheckReport, len(reports)),
 	}
-	const messageLengthLimit = 1024
 	for i, report := range reports {
-		msg := report.Message
-		runes := []rune(msg)
-		if len(runes) > messageLengthLimit {
-			msg = string(runes[0:messageLengthLimit])
+		maxBytes := 0
+		if report.MaxOutputBytes != nil {
+			maxBytes = int(*report.MaxOutputBytes)
 		}
+		msg := truncateMessage(util.SanitizeString(report.Message, true), maxBytes)
 		payload.Reports[i] = &mkr.CheckReport{
 			Source:               mkr.NewCheckSourceHost(hostID),
-			Name:                 report.Name,
+			Name:                 util.SanitizeString(report.Name, false),
 			Status:               mkr.CheckStatus(report.Status),
 			Message:              msg,
 			OccurredAt:           report.OccurredAt.Unix(),
@@ -54,3 +57,55 @@ func normalize(p *int32, min int32) uint {
 		return uint(*p)
 	}
 }
+
+// messageLengthLimit is the maximum number of characters of a check message
+// accepted by Mackerel's Check API.
+const messageLengthLimit = 1024
+
+// truncateMessage shortens msg to at most maxBytes bytes (no limit if
+// maxBytes <= 0) and messageLengthLimit characters.
+// The head and the tail of msg are kept and the middle is replaced with
+// a marker, since the useful lines are often output at the end.
+func truncateMessage(msg string, maxBytes int) string {
+	if maxBytes <= 0 || maxBytes > len(msg) {
+		maxBytes = len(msg)
+	}
+	s := truncateMiddle(msg, maxBytes)
+	for n := utf8.RuneCountInString(s); n > messageLengthLimit; n = utf8.RuneCountInString(s) {
+		maxBytes = len(s) - (n - messageLengthLimit)
+		s = truncateMiddle(msg, maxBytes)
+	}
+	return s
+}
+
+func truncatedMarker(n int) string {
+	return fmt.Sprintf("\n... (truncated %d bytes) ...\n", n)
+}
+
+// truncateMiddle returns s as is if len(s) <= maxBytes,
+// otherwise the head and the tail of s joined with a marker within maxBytes.
+func truncateMiddle(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	// len(s) is the upper bound of the number of truncated bytes,
+	// so the actual marker never becomes longer than this.
+	avail := maxBytes - len(truncatedMarker(len(s)))
+	if avail <= 0 {
+		return s[:runeStart(s, maxBytes)]
+	}
+	head := runeStart(s, avail/2)
+	tail := len(s) - (avail - avail/2)
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+	return s[:head] + truncatedMarker(tail-head) + s[tail:]
+}
+
+// runeStart returns the largest index <= i which starts a rune in s.
+func runeStart(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
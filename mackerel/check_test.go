@@ -7,8 +7,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mackerelio/mackerel-agent/checks"
 )
@@ -175,3 +177,79 @@ func TestReportCheckMonitorsCompat(t *testing.T) {
 		})
 	}
 }
+
+func TestReportCheckMonitors_Sanitized(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		res.Header()["Content-Type"] = []string{"application/json"}
+		fmt.Fprint(res, `{"result":"OK"}`)
+	}))
+	defer ts.Close()
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+
+	err := api.ReportCheckMonitors("9rxGOHfVF8F", []*checks.Report{{
+		Name:       "check\x00",
+		Status:     checks.StatusCritical,
+		Message:    "\x1b[31mdown\x1b[0m\r\n\tat \xff" + strings.Repeat("x", 2000),
+		OccurredAt: time.Unix(0, 0),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Reports []struct {
+			Name    string `json:"name"`
+			Message string `json:"message"`
+		} `json:"reports"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		t.Fatalf("the request should be JSON: %s: %s", err, body)
+	}
+	r := data.Reports[0]
+	if r.Name != "check" || !strings.HasPrefix(r.Message, "[31mdown[0m\n\tat �xxx") {
+		t.Errorf("the report should be sanitized: %+v", r)
+	}
+	if n := utf8.RuneCountInString(r.Message); n > messageLengthLimit {
+		t.Errorf("the message should be truncated to %d characters but %d", messageLengthLimit, n)
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		maxBytes int
+		expected string
+	}{
+		{"short", "OK", 0, "OK"},
+		{"byte limit", strings.Repeat("a", 50) + strings.Repeat("z", 50), 44, strings.Repeat("a", 6) + "\n... (truncated 87 bytes) ...\n" + strings.Repeat("z", 7)},
+		{"multibyte", strings.Repeat("あ", 20) + strings.Repeat("ん", 20), 46, "ああ\n... (truncated 108 bytes) ...\nんん"},
+		{"too small limit", strings.Repeat("a", 100), 10, strings.Repeat("a", 10)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := truncateMessage(tc.msg, tc.maxBytes)
+			if got != tc.expected {
+				t.Errorf("truncateMessage(%q, %d) = %q; want %q", tc.msg, tc.maxBytes, got, tc.expected)
+			}
+			if tc.maxBytes > 0 && len(got) > tc.maxBytes {
+				t.Errorf("truncated message should be within %d bytes but %d bytes", tc.maxBytes, len(got))
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncated message should be valid UTF-8: %q", got)
+			}
+		})
+	}
+
+	for _, maxBytes := range []int{0, 2000, 100000} {
+		msg := strings.Repeat("x", 3000) + "tail"
+		got := truncateMessage(msg, maxBytes)
+		if n := utf8.RuneCountInString(got); n > messageLengthLimit {
+			t.Errorf("truncated message should be within %d characters but %d characters", messageLengthLimit, n)
+		}
+		if !strings.HasSuffix(got, "tail") {
+			t.Errorf("truncated message should keep its tail: %q", got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package mackerel
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClockSkewWarningThreshold is the clock skew to be warned, since the metric
+// values may be rejected or land in the wrong minute.
+const ClockSkewWarningThreshold = 30 * time.Second
+
+// Warn again when the clock skew persists for the interval.
+var clockSkewWarningInterval = 1 * time.Hour
+
+// The clock skew is smoothed with the exponential moving average,
+// since each measurement has the error of the request latency.
+const clockSkewSmoothingFactor = 0.2
+
+var clockSkew struct {
+	sync.Mutex
+	skew     time.Duration
+	measured bool
+	warnedAt time.Time
+}
+
+// ClockSkew returns the smoothed difference of the clock of Mackerel from the local clock,
+// which is positive if the local clock is behind. It returns false if not measured yet.
+func ClockSkew() (time.Duration, bool) {
+	clockSkew.Lock()
+	defer clockSkew.Unlock()
+	return clockSkew.skew, clockSkew.measured
+}
+
+// measureClockSkew measures the clock skew by the Date header of the response.
+func measureClockSkew(resp *http.Response, sentAt, receivedAt time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// The Date header is truncated to seconds, and is generated
+	// between sending the request and receiving the response.
+	local := sentAt.Add(receivedAt.Sub(sentAt) / 2)
+	skew := date.Add(500 * time.Millisecond).Sub(local)
+
+	clockSkew.Lock()
+	defer clockSkew.Unlock()
+	if clockSkew.measured {
+		skew = clockSkew.skew + time.Duration(clockSkewSmoothingFactor*float64(skew-clockSkew.skew))
+	}
+	clockSkew.skew = skew
+	clockSkew.measured = true
+
+	if skew < ClockSkewWarningThreshold && -skew < ClockSkewWarningThreshold {
+		if !clockSkew.warnedAt.IsZero() {
+			logger.Infof("The local clock is synchronized with Mackerel again (skew: %s)", skew)
+			clockSkew.warnedAt = time.Time{}
+		}
+		return
+	}
+	if clockSkew.warnedAt.IsZero() || receivedAt.Sub(clockSkew.warnedAt) >= clockSkewWarningInterval {
+		d, direction := skew, "behind"
+		if skew < 0 {
+			d, direction = -skew, "ahead of"
+		}
+		logger.Warningf("The local clock is %s %s Mackerel. The metric values may be rejected or posted at the wrong time. Please check the time synchronization (NTP) of this host.", d, direction)
+		clockSkew.warnedAt = receivedAt
+	}
+}
@@ -0,0 +1,54 @@
+package mackerel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMeasureClockSkew(t *testing.T) {
+	defer func() {
+		clockSkew.skew, clockSkew.measured, clockSkew.warnedAt = 0, false, time.Time{}
+	}()
+	clockSkew.skew, clockSkew.measured = 0, false
+
+	offset := 2 * time.Minute
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ClockSkew(); ok {
+		t.Fatal("the clock skew should not be measured yet")
+	}
+	if err := api.PostHostMetricValues(nil); err != nil {
+		t.Fatal(err)
+	}
+	skew, ok := ClockSkew()
+	if !ok {
+		t.Fatal("the clock skew should be measured")
+	}
+	if d := skew - offset; d < -time.Second || d > time.Second {
+		t.Errorf("the clock skew should be about %s but got %s", offset, skew)
+	}
+	if clockSkew.warnedAt.IsZero() {
+		t.Error("the large clock skew should be warned")
+	}
+
+	// smoothed
+	offset = 0
+	if err := api.PostHostMetricValues(nil); err != nil {
+		t.Fatal(err)
+	}
+	skew, _ = ClockSkew()
+	if expected := 96 * time.Second; skew < expected-time.Second || skew > expected+time.Second {
+		t.Errorf("the clock skew should be smoothed to about %s but got %s", expected, skew)
+	}
+}
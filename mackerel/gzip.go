@@ -0,0 +1,79 @@
+package mackerel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// DefaultCompressionThreshold is the default minimum size of the request bodies to be compressed.
+const DefaultCompressionThreshold = 4 * 1024
+
+// compressedPaths are the API paths whose request bodies are compressed.
+// They are posted periodically and can be large on the hosts with many plugins.
+var compressedPaths = map[string]bool{
+	"/api/v0/tsdb":                     true,
+	"/api/v0/monitoring/checks/report": true,
+	"/api/v0/graph-defs/create":        true,
+}
+
+// gzipTransport compresses the request bodies larger than threshold with gzip.
+type gzipTransport struct {
+	base      http.RoundTripper
+	threshold int
+}
+
+// EnableCompression makes the client compress the request bodies of metric values,
+// check reports and graph definitions which are larger than threshold bytes.
+func (api *API) EnableCompression(threshold int) {
+	api.wrapTransport(func(base http.RoundTripper) http.RoundTripper {
+		return &gzipTransport{base: base, threshold: threshold}
+	})
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// never compress the body which is already encoded
+	if req.Body == nil || req.Method != "POST" || !compressedPaths[req.URL.Path] || req.Header.Get("Content-Encoding") != "" {
+		return t.base.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < t.threshold {
+		return t.base.RoundTrip(withBody(req, body))
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	logger.Debugf("Compressed the request body to %s from %d bytes to %d bytes", req.URL.Path, len(body), buf.Len())
+
+	r := withBody(req, buf.Bytes())
+	r.Header.Set("Content-Encoding", "gzip")
+	return t.base.RoundTrip(r)
+}
+
+// withBody returns a shallow copy of req with the body, since RoundTrip should not modify req.
+func withBody(req *http.Request, body []byte) *http.Request {
+	r := req.WithContext(req.Context())
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return r
+}
@@ -0,0 +1,113 @@
+package mackerel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestEnableCompression(t *testing.T) {
+	var received struct {
+		encoding string
+		body     []byte
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received.encoding = req.Header.Get("Content-Encoding")
+		body, _ := ioutil.ReadAll(req.Body)
+		if int64(len(body)) != req.ContentLength {
+			t.Errorf("Content-Length should be %d but got %d", len(body), req.ContentLength)
+		}
+		if received.encoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("the body should be valid gzip: %s", err)
+			}
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatalf("the body should be valid gzip: %s", err)
+			}
+		}
+		received.body = body
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.EnableCompression(1024)
+
+	values := func(n int) []*mkr.HostMetricValue {
+		var values []*mkr.HostMetricValue
+		for i := 0; i < n; i++ {
+			values = append(values, &mkr.HostMetricValue{
+				HostID:      "xyzabc12345",
+				MetricValue: &mkr.MetricValue{Name: "custom.foo", Time: 1577836800, Value: float64(i)},
+			})
+		}
+		return values
+	}
+	tests := []struct {
+		name     string
+		values   []*mkr.HostMetricValue
+		encoding string
+	}{
+		{name: "large", values: values(100), encoding: "gzip"},
+		{name: "small", values: values(1), encoding: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := api.PostHostMetricValues(tc.values); err != nil {
+				t.Fatalf("should not raise error: %s", err)
+			}
+			if received.encoding != tc.encoding {
+				t.Errorf("Content-Encoding should be %q but got %q", tc.encoding, received.encoding)
+			}
+			var got []*mkr.HostMetricValue
+			if err := json.Unmarshal(received.body, &got); err != nil || len(got) != len(tc.values) {
+				t.Errorf("the body should be the metric values: %s", received.body)
+			}
+		})
+	}
+
+	// the other paths are not compressed
+	if _, err := api.PutJSON("/api/v0/hosts/xyzabc12345", values(100)); err != nil {
+		t.Fatal(err)
+	}
+	if received.encoding != "" {
+		t.Errorf("Content-Encoding should be empty but got %q", received.encoding)
+	}
+}
+
+func TestGzipTransport_AlreadyEncoded(t *testing.T) {
+	var received []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("a"), 2048))
+	zw.Close()
+	compressed := buf.Bytes()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/api/v0/tsdb", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	cl := &http.Client{Transport: &gzipTransport{base: http.DefaultTransport, threshold: 0}}
+	resp, err := cl.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !bytes.Equal(received, compressed) {
+		t.Error("the already compressed body should not be compressed again")
+	}
+}
@@ -0,0 +1,52 @@
+package mackerel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mackerelio/mackerel-agent/spec"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// CreateHostParam is mkr.CreateHostParam with spec.HostMeta,
+// which contains the sections not supported by mackerel-client-go yet.
+type CreateHostParam struct {
+	Name             string            `json:"name"`
+	DisplayName      string            `json:"displayName,omitempty"`
+	Meta             spec.HostMeta     `json:"meta"`
+	Interfaces       []mkr.Interface   `json:"interfaces"`
+	RoleFullnames    []string          `json:"roleFullnames"`
+	Checks           []mkr.CheckConfig `json:"checks"`
+	CustomIdentifier string            `json:"customIdentifier,omitempty"`
+}
+
+// UpdateHostParam is the parameter to update the host
+type UpdateHostParam CreateHostParam
+
+// CreateHost registers the host. The strings of param are sanitized.
+func (api *API) CreateHost(param *CreateHostParam) (string, error) {
+	resp, err := api.Client.PostJSON("/api/v0/hosts", sanitizeHostParam(param))
+	return hostIDFromResponse(resp, err)
+}
+
+// UpdateHost updates the host information. The strings of param are sanitized.
+func (api *API) UpdateHost(hostID string, param *UpdateHostParam) (string, error) {
+	resp, err := api.Client.PutJSON(fmt.Sprintf("/api/v0/hosts/%s", hostID), (*UpdateHostParam)(sanitizeHostParam((*CreateHostParam)(param))))
+	return hostIDFromResponse(resp, err)
+}
+
+func hostIDFromResponse(resp *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var data struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	return data.ID, nil
+}
@@ -0,0 +1,179 @@
+package mackerel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var traceLogger = logformat.GetLogger("api.trace")
+
+const redacted = "[REDACTED]"
+
+// traceTransport logs the requests and the responses to diagnose the API
+// failures. The API key and the secret-looking headers are always redacted,
+// and the bodies are logged up to maxBodySize bytes only if it is positive.
+type traceTransport struct {
+	base        http.RoundTripper
+	maxBodySize int
+}
+
+// EnableHTTPTrace makes the client log the method, the URL, the status, the
+// latency and the headers of the requests, and the bodies up to
+// maxBodySize bytes. The bodies are logged before compressed, so the latency
+// includes the waiting for the rate limit.
+func (api *API) EnableHTTPTrace(maxBodySize int) {
+	api.wrapTransport(func(base http.RoundTripper) http.RoundTripper {
+		return &traceTransport{base: base, maxBodySize: maxBodySize}
+	})
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var b strings.Builder
+	b.WriteString(req.Method + " " + redactURL(req.URL))
+	writeRequestIDs(&b, "request", req.Header)
+	writeHeaders(&b, req.Header)
+	if t.maxBodySize > 0 && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = withBody(req, body)
+		writeBody(&b, "request", body, t.maxBodySize)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		traceLogger.Infof("%s: %s (%s)", b.String(), redactError(err, req.URL), latency)
+		return nil, err
+	}
+	b.WriteString(" " + resp.Status + " (" + latency.String() + ")")
+	writeRequestIDs(&b, "response", resp.Header)
+	if t.maxBodySize > 0 && resp.Body != nil {
+		head := make([]byte, t.maxBodySize+1)
+		n, err := io.ReadFull(resp.Body, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head[:n]), resp.Body), resp.Body}
+		writeBody(&b, "response", head[:n], t.maxBodySize)
+	}
+	traceLogger.Infof("%s", b.String())
+	return resp, nil
+}
+
+// redactURL returns u with the values of apikey in the query redacted.
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	q := u.Query()
+	found := false
+	for k := range q {
+		if strings.EqualFold(k, "apikey") || strings.EqualFold(k, "api_key") {
+			q[k] = []string{redacted}
+			found = true
+		}
+	}
+	if !found {
+		return u.String()
+	}
+	v := *u
+	v.RawQuery = q.Encode()
+	return strings.Replace(v.String(), url.QueryEscape(redacted), redacted, -1)
+}
+
+// redactError replaces the URL in err, which *url.Error contains.
+func redactError(err error, u *url.URL) string {
+	return strings.Replace(err.Error(), u.String(), redactURL(u), -1)
+}
+
+// writeRequestIDs writes the headers identifying the request, such as
+// X-Request-Id. X-Api-Key is never written.
+func writeRequestIDs(b *strings.Builder, kind string, h http.Header) {
+	var keys []string
+	for k := range h {
+		if !strings.EqualFold(k, "X-Api-Key") && strings.Contains(strings.ToLower(k), "request-id") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(" " + kind + " " + k + "=" + strings.Join(h[k], ","))
+	}
+}
+
+// untracedHeaders are not written by writeHeaders, which are written by
+// writeRequestIDs or the same for all the requests.
+var untracedHeaders = map[string]bool{
+	"X-Api-Key":        true,
+	"Content-Type":     true,
+	"Content-Encoding": true,
+	"Content-Length":   true,
+}
+
+// writeHeaders writes the headers of the request other than the request IDs,
+// such as User-Agent and the ones of http_headers, with the values of the
+// secret-looking ones redacted.
+func writeHeaders(b *strings.Builder, h http.Header) {
+	var keys []string
+	for k := range h {
+		if !untracedHeaders[http.CanonicalHeaderKey(k)] && !strings.Contains(strings.ToLower(k), "request-id") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := make([]string, len(h[k]))
+		for i, v := range h[k] {
+			if isSecretHeader(k, v) {
+				v = redacted
+			}
+			values[i] = v
+		}
+		b.WriteString(" header " + k + "=" + strings.Join(values, ","))
+	}
+}
+
+var secretHeaderWords = []string{"auth", "token", "key", "secret", "password", "cookie", "session", "credential", "signature"}
+
+// isSecretHeader reports whether the header seems to contain the credentials
+// by its name or the scheme of its value.
+func isSecretHeader(name, value string) bool {
+	n := strings.ToLower(name)
+	for _, w := range secretHeaderWords {
+		if strings.Contains(n, w) {
+			return true
+		}
+	}
+	v := strings.ToLower(value)
+	return strings.HasPrefix(v, "bearer ") || strings.HasPrefix(v, "basic ")
+}
+
+func writeBody(b *strings.Builder, kind string, body []byte, maxSize int) {
+	if len(body) == 0 {
+		return
+	}
+	b.WriteString("\n" + kind + " body: ")
+	if len(body) > maxSize {
+		b.Write(body[:maxSize])
+		b.WriteString("... (truncated)")
+		return
+	}
+	b.Write(body)
+}
@@ -0,0 +1,136 @@
+package mackerel
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestEnableHTTPTrace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Api-Key") != "secret-key" {
+			t.Errorf("the API key should be sent: %q", req.Header.Get("X-Api-Key"))
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("X-Request-Id", "req-123")
+		res.Write([]byte(`{"success": true, "padding": "` + strings.Repeat("x", 100) + `"}`))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	logformat.SetOutput(&buf)
+	defer logformat.SetOutput(os.Stderr)
+
+	api, err := NewAPI(ts.URL, "secret-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.EnableHTTPTrace(20)
+	err = api.PostHostMetricValues([]*mkr.HostMetricValue{{
+		HostID:      "xyzabc12345",
+		MetricValue: &mkr.MetricValue{Name: "custom.foo", Time: 1577836800, Value: 1},
+	}})
+	if err != nil {
+		t.Fatalf("the response body should be passed to the client: %s", err)
+	}
+
+	got := buf.String()
+	for _, s := range []string{"POST " + ts.URL + "/api/v0/tsdb", "200 OK", "response X-Request-Id=req-123", `request body: [{"hostId":"xyzabc12`, "... (truncated)", `response body: {"success": true, "p`} {
+		if !strings.Contains(got, s) {
+			t.Errorf("the trace should contain %q: %s", s, got)
+		}
+	}
+	if strings.Contains(got, "secret-key") {
+		t.Errorf("the API key should be redacted: %s", got)
+	}
+}
+
+func TestEnableHTTPTrace_NoBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	logformat.SetOutput(&buf)
+	defer logformat.SetOutput(os.Stderr)
+
+	api, err := NewAPI(ts.URL, "secret-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.EnableHTTPTrace(0)
+	if err := api.PostHostMetricValues(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "POST ") || strings.Contains(got, "body:") {
+		t.Errorf("the bodies should not be logged by default: %s", got)
+	}
+}
+
+func TestEnableHTTPTrace_Headers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	logformat.SetOutput(&buf)
+	defer logformat.SetOutput(os.Stderr)
+
+	api, err := NewAPI(ts.URL, "secret-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.UserAgent = "mackerel-agent/0.0.0 deploy/blue"
+	api.AdditionalHeaders = http.Header{}
+	api.AdditionalHeaders.Set("X-Team", "infra")
+	api.AdditionalHeaders.Set("X-Proxy-Token", "proxy-secret")
+	api.AdditionalHeaders.Set("X-Forwarded-Auth", "Basic cHJveHk=")
+	api.EnableHTTPTrace(0)
+	if err := api.PostHostMetricValues(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+	for _, s := range []string{"header User-Agent=mackerel-agent/0.0.0 deploy/blue", "header X-Team=infra", "header X-Proxy-Token=" + redacted, "header X-Forwarded-Auth=" + redacted} {
+		if !strings.Contains(got, s) {
+			t.Errorf("the trace should contain %q: %s", s, got)
+		}
+	}
+	for _, s := range []string{"secret-key", "proxy-secret", "cHJveHk=", "Content-Type"} {
+		if strings.Contains(got, s) {
+			t.Errorf("the trace should not contain %q: %s", s, got)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		expect string
+	}{
+		{"https://api.mackerelio.com/api/v0/hosts", "https://api.mackerelio.com/api/v0/hosts"},
+		{"https://api.mackerelio.com/api/v0/hosts?name=foo", "https://api.mackerelio.com/api/v0/hosts?name=foo"},
+		{"https://api.mackerelio.com/api/v0/hosts?apikey=secret&name=foo", "https://api.mackerelio.com/api/v0/hosts?apikey=[REDACTED]&name=foo"},
+		{"https://api.mackerelio.com/api/v0/hosts?ApiKey=secret", "https://api.mackerelio.com/api/v0/hosts?ApiKey=[REDACTED]"},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactURL(u); got != tc.expect {
+			t.Errorf("redactURL(%q) should be %q but got %q", tc.url, tc.expect, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package mackerel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// MaintenanceProbeInterval is the minimum interval of the retries while the
+// API is under maintenance, so that the agents probe it at a low frequency.
+var MaintenanceProbeInterval = 5 * time.Minute
+
+// maintenanceRetryAfter is Retry-After of HTTP 503 long enough to be regarded
+// as the maintenance rather than a temporary overload.
+const maintenanceRetryAfter = 2 * time.Minute
+
+// maintenanceMessageReg matches the error messages of HTTP 503 during the
+// maintenance, such as {"error":{"message":"Mackerel is under maintenance"}}.
+var maintenanceMessageReg = regexp.MustCompile(`(?i)\bmaintenance\b`)
+
+// maxMaintenanceBodySize is the size of the body of HTTP 503 to be inspected.
+const maxMaintenanceBodySize = 4096
+
+// maintenance is the state of the maintenance of the API, which is entered by
+// the maintenance responses and left by any response which is not an error
+// of the server.
+type maintenance struct {
+	mu    sync.Mutex
+	since time.Time
+	// ended is closed when the maintenance ends.
+	ended chan struct{}
+}
+
+// observe observes resp, and returns true if the maintenance ends by it.
+func (m *maintenance) observe(resp *http.Response, retryAfter time.Duration, now time.Time) bool {
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		reason := ""
+		if retryAfter >= maintenanceRetryAfter {
+			reason = "Retry-After: " + retryAfter.String()
+		} else if isMaintenanceBody(resp) {
+			reason = "the maintenance response"
+		}
+		if reason != "" {
+			m.enter(reason, now)
+		}
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return m.leave(now)
+	}
+	return false
+}
+
+func (m *maintenance) enter(reason string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.since.IsZero() {
+		return
+	}
+	m.since = now
+	m.ended = make(chan struct{})
+	logger.Warningf("Entering the maintenance backoff by %s. The requests are retried every %s while the payloads are buffered", reason, MaintenanceProbeInterval)
+}
+
+func (m *maintenance) leave(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.since.IsZero() {
+		return false
+	}
+	logger.Infof("Leaving the maintenance backoff after %s", now.Sub(m.since).Round(time.Second))
+	m.since = time.Time{}
+	close(m.ended)
+	return true
+}
+
+// isMaintenanceBody reports whether the body of resp mentions the
+// maintenance. The body is restored to be read by the client.
+func isMaintenanceBody(resp *http.Response) bool {
+	if resp.Body == nil {
+		return false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMaintenanceBodySize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	return err == nil && maintenanceMessageReg.Match(b)
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// InMaintenance reports whether the API is under maintenance.
+func (api *API) InMaintenance() bool {
+	if api.retryAfter == nil {
+		return false
+	}
+	m := &api.retryAfter.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.since.IsZero()
+}
+
+// MaintenanceEnded returns the channel closed when the current maintenance
+// ends, which is closed already if the API is not under maintenance.
+func (api *API) MaintenanceEnded() <-chan struct{} {
+	if api.retryAfter == nil {
+		return closedChan
+	}
+	m := &api.retryAfter.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.since.IsZero() {
+		return closedChan
+	}
+	return m.ended
+}
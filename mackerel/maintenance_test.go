@@ -0,0 +1,92 @@
+package mackerel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPI_maintenance(t *testing.T) {
+	responses := make(chan func(res http.ResponseWriter), 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		(<-responses)(res)
+	}))
+	defer ts.Close()
+	respond := func(status int, retryAfter, body string) {
+		responses <- func(res http.ResponseWriter) {
+			if retryAfter != "" {
+				res.Header().Set("Retry-After", retryAfter)
+			}
+			res.WriteHeader(status)
+			res.Write([]byte(body))
+		}
+	}
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func() error {
+		return api.PostHostMetricValues(nil)
+	}
+
+	// the short Retry-After is the temporary overload
+	respond(http.StatusServiceUnavailable, "1", `{"error":{"message":"overloaded"}}`)
+	post()
+	if api.InMaintenance() {
+		t.Error("503 with the short Retry-After should not be the maintenance")
+	}
+
+	respond(http.StatusServiceUnavailable, "", `{"error":{"message":"Mackerel is under maintenance"}}`)
+	if err := post(); err == nil || err.Error() != "API request failed: Mackerel is under maintenance" {
+		t.Errorf("the body of the maintenance response should be read by the client: %v", err)
+	}
+	if !api.InMaintenance() {
+		t.Fatal("the maintenance response should enter the maintenance")
+	}
+	ended := api.MaintenanceEnded()
+	select {
+	case <-ended:
+		t.Fatal("MaintenanceEnded should not be closed under maintenance")
+	default:
+	}
+	p := &RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 10 * time.Millisecond}
+	if d := api.RetryInterval(p, 1); d < MaintenanceProbeInterval {
+		t.Errorf("the retries should be extended to MaintenanceProbeInterval under maintenance, but %s", d)
+	}
+
+	// the retry waiting under maintenance is done by the end of it
+	respond(http.StatusServiceUnavailable, "600", `{"error":{"message":"unavailable"}}`)
+	done := make(chan error)
+	go func() {
+		done <- api.Retry(context.Background(), p, "test", post)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	respond(http.StatusOK, "", `{"success": true}`)
+	respond(http.StatusOK, "", `{"success": true}`)
+	if err := post(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ended:
+	default:
+		t.Error("MaintenanceEnded should be closed by the successful response")
+	}
+	if api.InMaintenance() {
+		t.Error("the successful response should leave the maintenance")
+	}
+	if d := api.RetryAfter(); d > 0 {
+		t.Errorf("Retry-After should be reset by the end of the maintenance, but %s", d)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Retry should succeed after the maintenance: %s", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Retry should retry as soon as the maintenance ends")
+	}
+}
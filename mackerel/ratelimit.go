@@ -0,0 +1,153 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitBurst is the default number of the requests sent at once
+// without waiting for the rate limit.
+const DefaultRateLimitBurst = 10
+
+// The requests give up waiting for the rate limit after rateLimitMaxWait,
+// so that the shutdown is not blocked. They are retried or spooled later.
+var rateLimitMaxWait = 10 * time.Second
+
+// ErrRateLimited is returned when a request is not sent within the client-side rate limit.
+var ErrRateLimited = errors.New("the request was not sent within the rate limit")
+
+// The priorities of the requests when the rate is limited. The check reports
+// are sent first since they raise the alerts, then the metric values.
+// The others, such as the metadata and the host specs, are sent last.
+type priority int
+
+const (
+	priorityChecks priority = iota
+	priorityMetrics
+	priorityOthers
+	numPriorities
+)
+
+func requestPriority(req *http.Request) priority {
+	switch {
+	case req.URL.Path == "/api/v0/monitoring/checks/report":
+		return priorityChecks
+	case strings.HasSuffix(req.URL.Path, "/tsdb"):
+		return priorityMetrics
+	default:
+		return priorityOthers
+	}
+}
+
+// rateLimiter is a token bucket, which the requests of higher priority take first.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting [numPriorities]int
+}
+
+func newRateLimiter(rate float64, burst int, now time.Time) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take takes a token unless the requests of higher priority are waiting.
+// Otherwise it returns the duration to wait before trying again.
+func (l *rateLimiter) take(p priority, now time.Time) (bool, time.Duration) {
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	need := 1.0
+	for q := priority(0); q < p; q++ {
+		need += float64(l.waiting[q])
+	}
+	if l.tokens >= need {
+		l.tokens--
+		return true, 0
+	}
+	d := time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return false, d
+}
+
+// wait waits for a token and returns the waited duration.
+func (l *rateLimiter) wait(ctx context.Context, p priority, maxWait time.Duration) (time.Duration, error) {
+	start := time.Now()
+	l.mu.Lock()
+	ok, d := l.take(p, start)
+	if ok {
+		l.mu.Unlock()
+		return 0, nil
+	}
+	l.waiting[p]++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting[p]--
+		l.mu.Unlock()
+	}()
+
+	deadline := time.NewTimer(maxWait)
+	defer deadline.Stop()
+	for {
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return time.Since(start), ctx.Err()
+		case <-deadline.C:
+			t.Stop()
+			return time.Since(start), ErrRateLimited
+		case now := <-t.C:
+			l.mu.Lock()
+			ok, d = l.take(p, now)
+			l.mu.Unlock()
+			if ok {
+				return now.Sub(start), nil
+			}
+		}
+	}
+}
+
+// rateLimitTransport limits the rate of the requests.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+// EnableRateLimit limits the requests of the client to rate per second,
+// allowing burst requests at once.
+func (api *API) EnableRateLimit(rate float64, burst int) {
+	api.wrapTransport(func(base http.RoundTripper) http.RoundTripper {
+		return &rateLimitTransport{
+			base:    base,
+			limiter: newRateLimiter(rate, burst, time.Now()),
+		}
+	})
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	waited, err := t.limiter.wait(req.Context(), requestPriority(req), rateLimitMaxWait)
+	if err != nil {
+		logger.Debugf("%s %s: gave up waiting for the rate limit after %s", req.Method, req.URL.Path, waited)
+		return nil, err
+	}
+	if waited > 0 {
+		logger.Debugf("%s %s: waited %s for the rate limit", req.Method, req.URL.Path, waited)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,91 @@
+package mackerel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Take(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 2, now)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take(priorityMetrics, now); !ok {
+			t.Fatalf("the burst requests should not wait: %d", i)
+		}
+	}
+	ok, d := l.take(priorityMetrics, now)
+	if ok || d != 500*time.Millisecond {
+		t.Errorf("the request should wait for 500ms but got %t, %s", ok, d)
+	}
+	if ok, _ := l.take(priorityMetrics, now.Add(500*time.Millisecond)); !ok {
+		t.Error("the token should be refilled")
+	}
+
+	// the lower priority waits for the waiting request of higher priority
+	l.waiting[priorityChecks] = 1
+	if ok, _ := l.take(priorityOthers, now.Add(time.Second)); ok {
+		t.Error("the request of lower priority should wait")
+	}
+	if ok, _ := l.take(priorityChecks, now.Add(time.Second)); !ok {
+		t.Error("the request of higher priority should not wait")
+	}
+}
+
+func TestRateLimiter_WaitMax(t *testing.T) {
+	l := newRateLimiter(0.1, 1, time.Now())
+	if _, err := l.wait(context.Background(), priorityChecks, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	startedAt := time.Now()
+	if _, err := l.wait(context.Background(), priorityChecks, 100*time.Millisecond); err != ErrRateLimited {
+		t.Errorf("the wait should be given up but got %v", err)
+	}
+	if d := time.Since(startedAt); d > time.Second {
+		t.Errorf("the wait should be bounded but took %s", d)
+	}
+	if l.waiting[priorityChecks] != 0 {
+		t.Errorf("the waiting count should be restored: %v", l.waiting)
+	}
+}
+
+func TestEnableRateLimit(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		mu.Unlock()
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.EnableRateLimit(10, 1)
+
+	startedAt := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := api.PostHostMetricValues(nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(startedAt); d < 150*time.Millisecond {
+		t.Errorf("the requests should be limited to 10 per second but took %s", d)
+	}
+	if len(paths) != 3 {
+		t.Errorf("all the requests should be sent: %v", paths)
+	}
+}
@@ -0,0 +1,51 @@
+package mackerel
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/util"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// errorBodyExcerptBytes is the maximum bytes of the body of a rejected request
+// to be logged, which points out the fields rejected by the validation.
+const errorBodyExcerptBytes = 512
+
+// IsValidationError returns true if err is the rejection of the payload by the
+// validation of the API, such as the invalid metric names and the too large
+// payloads, which is not resolved by retrying the same payload.
+func IsValidationError(err error) bool {
+	e, ok := err.(*mkr.APIError)
+	if !ok {
+		return false
+	}
+	return isValidationStatus(e.StatusCode)
+}
+
+func isValidationStatus(code int) bool {
+	switch code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// peekErrorBody returns the excerpt of the body of resp up to
+// errorBodyExcerptBytes, whose whole is still read from resp.Body.
+func peekErrorBody(resp *http.Response) string {
+	head := make([]byte, errorBodyExcerptBytes)
+	n, _ := io.ReadFull(resp.Body, head)
+	head = head[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	s := strings.Join(strings.Fields(util.SanitizeString(string(head), true)), " ")
+	if n == errorBodyExcerptBytes {
+		s += "..."
+	}
+	return s
+}
@@ -0,0 +1,167 @@
+package mackerel
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRequestTimeout is the default deadline of the requests, which is the
+// timeout of mackerel-client-go.
+const DefaultRequestTimeout = 30 * time.Second
+
+// requestIDHeader is the header identifying the request, which is logged to
+// be correlated with the logs of the server.
+const requestIDHeader = "X-Request-Id"
+
+// The kinds of the requests by the payloads, whose deadlines are configured
+// separately so that a slow request does not delay the others.
+const (
+	requestKindChecks    = "checks"
+	requestKindMetrics   = "metrics"
+	requestKindMetadata  = "metadata"
+	requestKindHostSpecs = "hostSpecs"
+	requestKindOthers    = "others"
+)
+
+func requestKind(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case path == "/api/v0/monitoring/checks/report":
+		return requestKindChecks
+	case strings.HasSuffix(path, "/tsdb"):
+		return requestKindMetrics
+	case strings.Contains(path, "/metadata"):
+		return requestKindMetadata
+	case req.Method == "PUT" && strings.HasPrefix(path, "/api/v0/hosts/") && !strings.Contains(path[len("/api/v0/hosts/"):], "/"):
+		return requestKindHostSpecs
+	default:
+		return requestKindOthers
+	}
+}
+
+// RequestTimeouts are the deadlines of the requests by the payloads. Zero
+// means DefaultRequestTimeout.
+type RequestTimeouts struct {
+	Checks    time.Duration
+	Metrics   time.Duration
+	Metadata  time.Duration
+	HostSpecs time.Duration
+	Others    time.Duration
+}
+
+func (t *RequestTimeouts) of(kind string) time.Duration {
+	var d time.Duration
+	switch kind {
+	case requestKindChecks:
+		d = t.Checks
+	case requestKindMetrics:
+		d = t.Metrics
+	case requestKindMetadata:
+		d = t.Metadata
+	case requestKindHostSpecs:
+		d = t.HostSpecs
+	default:
+		d = t.Others
+	}
+	if d <= 0 {
+		return DefaultRequestTimeout
+	}
+	return d
+}
+
+// requestTransport is the outermost transport of the client, which gives the
+// requests the deadlines by their kinds and the request IDs.
+type requestTransport struct {
+	base http.RoundTripper
+
+	mu       sync.Mutex
+	timeouts RequestTimeouts
+}
+
+// SetRequestTimeouts sets the deadlines of the requests by the payloads. They
+// include the waiting for the rate limit, and the reading of the responses.
+func (api *API) SetRequestTimeouts(timeouts RequestTimeouts) {
+	api.request.mu.Lock()
+	defer api.request.mu.Unlock()
+	api.request.timeouts = timeouts
+}
+
+// wrapTransport wraps the transport inside requestTransport.
+func (api *API) wrapTransport(wrap func(base http.RoundTripper) http.RoundTripper) {
+	api.request.base = wrap(api.request.base)
+}
+
+func (t *requestTransport) timeout(kind string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeouts.of(kind)
+}
+
+// RoundTrip implements http.RoundTripper. The requests are logged at DEBUG
+// with their IDs, and the failures are logged by the callers.
+func (t *requestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	kind := requestKind(req)
+	timeout := t.timeout(kind)
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+
+	// a shallow copy with its own headers, since RoundTrip should not modify req
+	r := req.WithContext(ctx)
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(r)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("the deadline of the %s requests (%s) exceeded: %s", kind, timeout, err)
+		}
+		logger.Debugf("%s %s failed (%s: %s, %s): %s", req.Method, req.URL.Path, requestIDHeader, id, elapsed, err)
+		return nil, err
+	}
+	if isValidationStatus(resp.StatusCode) {
+		logger.Debugf("%s %s was rejected: %s (%s: %s, %s): %s", req.Method, req.URL.Path, resp.Status, requestIDHeader, id, elapsed, peekErrorBody(resp))
+	} else {
+		logger.Debugf("%s %s: %s (%s: %s, %s)", req.Method, req.URL.Path, resp.Status, requestIDHeader, id, elapsed)
+	}
+	// the deadline applies until the body is read
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// newRequestID returns a random UUID (version 4).
+func newRequestID() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		// never happens on the supported platforms
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,173 @@
+package mackerel
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/checks"
+)
+
+func TestRequestKind(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"POST", "/api/v0/monitoring/checks/report", requestKindChecks},
+		{"POST", "/api/v0/tsdb", requestKindMetrics},
+		{"POST", "/api/v0/services/web/tsdb", requestKindMetrics},
+		{"PUT", "/api/v0/hosts/9rxGOHfVF8F/metadata/inventory", requestKindMetadata},
+		{"PUT", "/api/v0/hosts/9rxGOHfVF8F", requestKindHostSpecs},
+		{"POST", "/api/v0/hosts/9rxGOHfVF8F/status", requestKindOthers},
+		{"GET", "/api/v0/hosts/9rxGOHfVF8F", requestKindOthers},
+		{"POST", "/api/v0/graph-defs/create", requestKindOthers},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, "https://api.mackerelio.com"+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requestKind(req); got != tc.want {
+			t.Errorf("%s %s should be %q but %q", tc.method, tc.path, tc.want, got)
+		}
+	}
+}
+
+var requestIDReg = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestTransport_concurrent(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	ids := make(map[string]bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		mu.Lock()
+		if !requestIDReg.MatchString(id) || ids[id] {
+			t.Errorf("X-Request-Id should be an unique UUID but %q", id)
+		}
+		ids[id] = true
+		mu.Unlock()
+		if strings.Contains(r.URL.Path, "/metadata/") {
+			// the slow endpoint
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer func() {
+		close(release)
+		ts.Close()
+	}()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetRequestTimeouts(RequestTimeouts{Checks: 5 * time.Second, Metadata: 500 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	metadataErrs := make(chan error, 4)
+	for i := 0; i < cap(metadataErrs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := api.Client.PutJSON("/api/v0/hosts/9rxGOHfVF8F/metadata/inventory", map[string]string{"foo": "bar"})
+			if err == nil {
+				resp.Body.Close()
+			}
+			metadataErrs <- err
+		}()
+	}
+
+	// the check reports are posted while the metadata are waited
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		err := api.ReportCheckMonitors("9rxGOHfVF8F", []*checks.Report{{Name: "check", Status: checks.StatusCritical, OccurredAt: time.Now()}})
+		if err != nil {
+			t.Errorf("ReportCheckMonitors should not raise error: %s", err)
+		}
+		if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+			t.Errorf("ReportCheckMonitors should not be blocked by the metadata, but took %s", elapsed)
+		}
+	}
+
+	wg.Wait()
+	close(metadataErrs)
+	for err := range metadataErrs {
+		if err == nil || !strings.Contains(err.Error(), "deadline of the metadata requests (500ms) exceeded") {
+			t.Errorf("the metadata should exceed the deadline: %v", err)
+		}
+	}
+	if len(ids) != 8 {
+		t.Errorf("8 requests should be sent but %d", len(ids))
+	}
+}
+
+func TestRequestTransport_keepsRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", ts.URL+"/api/v0/org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := api.Client.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		t.Errorf("the request should not be modified, but X-Request-Id is %q", id)
+	}
+}
+
+func TestRequestTransport_rejected(t *testing.T) {
+	body := `{"error":{"message":"invalid metric name: \"custom.foo bar\""}}` + strings.Repeat(" ", 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, body, http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.PostHostMetricValues(nil)
+	if !IsValidationError(err) {
+		t.Fatalf("the rejection should be a validation error: %v", err)
+	}
+	if !strings.Contains(err.Error(), `invalid metric name: "custom.foo bar"`) {
+		t.Errorf("the whole body should be read after the excerpt is logged: %v", err)
+	}
+}
+
+func TestPeekErrorBody(t *testing.T) {
+	resp := &http.Response{Body: ioutil.NopCloser(strings.NewReader("{\n  \"error\": \"invalid\"\n}"))}
+	if s := peekErrorBody(resp); s != `{ "error": "invalid" }` {
+		t.Errorf("the whitespaces of the excerpt should be collapsed: %q", s)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "{\n  \"error\": \"invalid\"\n}" {
+		t.Errorf("the body should be restored: %q", b)
+	}
+
+	resp = &http.Response{Body: ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 1000)))}
+	if s := peekErrorBody(resp); len(s) != errorBodyExcerptBytes+3 || !strings.HasSuffix(s, "...") {
+		t.Errorf("the excerpt should be truncated: %q", s)
+	}
+}
@@ -0,0 +1,191 @@
+package mackerel
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// jitter is seeded by itself, so that the agents get different intervals.
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// RetryPolicy decides the intervals of retrying the API requests.
+// The intervals grow exponentially with full jitter, so that the agents
+// do not retry at the same time after the API recovers.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// MaxElapsedTime caps the total duration of retrying a request. Zero means no limit.
+	MaxElapsedTime time.Duration
+}
+
+// Interval returns a random interval before the attempt-th retry (starting with 1),
+// which is up to InitialInterval * 2^(attempt-1) and MaxInterval.
+func (p *RetryPolicy) Interval(attempt int) time.Duration {
+	d := p.MaxInterval
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt < 32 {
+		if x := p.InitialInterval << uint(attempt-1); x > 0 && x < d {
+			d = x
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(jitter.Int63n(int64(d) + 1))
+}
+
+// IsRetryable returns true if err is worth retrying, that is, a network error,
+// HTTP 5xx or HTTP 429. The other client errors are never resolved by retrying.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	e, ok := err.(*mkr.APIError)
+	if !ok {
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || IsServerError(err)
+}
+
+var retryCount uint64
+
+// RetryCount returns the total number of the retries of the API requests.
+func RetryCount() uint64 {
+	return atomic.LoadUint64(&retryCount)
+}
+
+// RetryInterval returns the interval before the attempt-th retry, which is
+// extended to Retry-After of the last response and to MaintenanceProbeInterval
+// under maintenance, and counts the retry.
+func (api *API) RetryInterval(p *RetryPolicy, attempt int) time.Duration {
+	atomic.AddUint64(&retryCount, 1)
+	d := p.Interval(attempt)
+	if ra := api.RetryAfter(); ra > d {
+		d = ra
+	}
+	if api.InMaintenance() && MaintenanceProbeInterval > d {
+		d = MaintenanceProbeInterval
+	}
+	return d
+}
+
+// Retry calls f until it succeeds or returns an error which is not retryable.
+// It gives up and returns the last error when the next retry exceeds MaxElapsedTime
+// of the policy or ctx is done. The retry waiting for the end of the maintenance
+// is done as soon as it ends, such as by the other requests.
+func (api *API) Retry(ctx context.Context, p *RetryPolicy, name string, f func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			if attempt > 1 {
+				logger.Debugf("%s: succeeded at attempt %d", name, attempt)
+			}
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		d := api.RetryInterval(p, attempt)
+		if p.MaxElapsedTime > 0 && time.Since(start)+d > p.MaxElapsedTime {
+			logger.Debugf("%s: gave up after %d attempts: %s", name, attempt, err)
+			return err
+		}
+		logger.Debugf("%s: attempt %d failed (will retry in %s): %s", name, attempt, d, err)
+		var ended <-chan struct{}
+		if api.InMaintenance() {
+			ended = api.MaintenanceEnded()
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		case <-ended:
+		}
+	}
+}
+
+// RetryAfter returns the remaining duration of Retry-After of the last
+// 429 or 503 response, or zero if there is none.
+func (api *API) RetryAfter() time.Duration {
+	if api.retryAfter == nil {
+		return 0
+	}
+	api.retryAfter.mu.Lock()
+	defer api.retryAfter.mu.Unlock()
+	if d := time.Until(api.retryAfter.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// retryAfterTransport records Retry-After of the responses, and the
+// maintenance of the API.
+type retryAfterTransport struct {
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	until time.Time
+
+	maintenance maintenance
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			logger.Debugf("%s %s: Retry-After: %s", req.Method, req.URL.Path, d)
+			t.mu.Lock()
+			t.until = time.Now().Add(d)
+			t.mu.Unlock()
+			retryAfter = d
+		}
+	}
+	// Retry-After of the maintenance is obsolete by the end of it
+	if t.maintenance.observe(resp, retryAfter, time.Now()) {
+		t.mu.Lock()
+		t.until = time.Time{}
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses Retry-After, which is either seconds or an HTTP date.
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(s); err == nil {
+		if sec < 0 {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
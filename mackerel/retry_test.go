@@ -0,0 +1,144 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestRetryPolicy_Interval(t *testing.T) {
+	p := &RetryPolicy{InitialInterval: 1 * time.Second, MaxInterval: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 1 * time.Second},
+		{attempt: 2, max: 2 * time.Second},
+		{attempt: 4, max: 8 * time.Second},
+		{attempt: 5, max: 10 * time.Second},
+		{attempt: 100, max: 10 * time.Second},
+	}
+	for _, tc := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.Interval(tc.attempt); d < 0 || d > tc.max {
+				t.Errorf("Interval(%d) should be between 0 and %s but got %s", tc.attempt, tc.max, d)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: nil, retryable: false},
+		{err: errors.New("connection refused"), retryable: true},
+		{err: &mkr.APIError{StatusCode: 400}, retryable: false},
+		{err: &mkr.APIError{StatusCode: 403}, retryable: false},
+		{err: &mkr.APIError{StatusCode: 429}, retryable: true},
+		{err: &mkr.APIError{StatusCode: 500}, retryable: true},
+		{err: &mkr.APIError{StatusCode: 503}, retryable: true},
+	}
+	for _, tc := range tests {
+		if got := IsRetryable(tc.err); got != tc.retryable {
+			t.Errorf("IsRetryable(%v) should be %t but got %t", tc.err, tc.retryable, got)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		d     time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "120", d: 2 * time.Minute, ok: true},
+		{value: "-1", ok: false},
+		{value: "Wed, 01 Jan 2020 00:00:30 GMT", d: 30 * time.Second, ok: true},
+		{value: "Tue, 31 Dec 2019 23:59:00 GMT", d: 0, ok: true},
+		{value: "soon", ok: false},
+	}
+	for _, tc := range tests {
+		d, ok := parseRetryAfter(tc.value, now)
+		if d != tc.d || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q) should be (%s, %t) but got (%s, %t)", tc.value, tc.d, tc.ok, d, ok)
+		}
+	}
+}
+
+func TestAPI_Retry(t *testing.T) {
+	var statuses []int
+	var requested int
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requested++
+		status := http.StatusInternalServerError
+		if len(statuses) > 0 {
+			status = statuses[0]
+			statuses = statuses[1:]
+		}
+		if status == http.StatusTooManyRequests {
+			res.Header().Set("Retry-After", "1")
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 10 * time.Millisecond, MaxElapsedTime: 3 * time.Second}
+	post := func() error {
+		return api.PostHostMetricValues(nil)
+	}
+
+	t.Run("retry after 429", func(t *testing.T) {
+		statuses = []int{http.StatusTooManyRequests, http.StatusOK}
+		retryCount := RetryCount()
+		start := time.Now()
+		if err := api.Retry(context.Background(), p, "test", post); err != nil {
+			t.Errorf("Retry should succeed but got %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("Retry should wait for Retry-After but retried in %s", elapsed)
+		}
+		if RetryCount()-retryCount != 1 {
+			t.Errorf("RetryCount should be increased by 1 but got %d", RetryCount()-retryCount)
+		}
+	})
+
+	t.Run("no retry on 400", func(t *testing.T) {
+		statuses = []int{http.StatusBadRequest, http.StatusOK}
+		if err := api.Retry(context.Background(), p, "test", post); !IsClientError(err) {
+			t.Errorf("Retry should return the client error but got %v", err)
+		}
+		if len(statuses) != 1 {
+			t.Error("Retry should not retry on the client error")
+		}
+	})
+
+	t.Run("give up", func(t *testing.T) {
+		statuses, requested = nil, 0
+		p := &RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 10 * time.Millisecond, MaxElapsedTime: 50 * time.Millisecond}
+		start := time.Now()
+		if err := api.Retry(context.Background(), p, "test", post); !IsServerError(err) {
+			t.Errorf("Retry should return the server error but got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 1*time.Second {
+			t.Errorf("Retry should give up in MaxElapsedTime but took %s", elapsed)
+		}
+		if requested < 2 {
+			t.Errorf("Retry should retry before giving up but requested %d times", requested)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package mackerel
+
+import (
+	"github.com/mackerelio/mackerel-agent/util"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// The maximum numbers of the characters of the fields accepted by Mackerel,
+// beyond which the whole of the payload is rejected. The check messages are
+// limited by messageLengthLimit.
+const (
+	metricNameLengthLimit = 255
+	hostNameLengthLimit   = 255
+	// specLengthLimit is for the other strings of the hosts, such as the labels
+	// of the filesystems in the host specs.
+	specLengthLimit = 1024
+)
+
+func sanitizeName(s string, max int) string {
+	return util.TruncateString(util.SanitizeString(s, false), max)
+}
+
+// sanitizeHostMetricValues returns values with the names sanitized, which are
+// copied if changed since they are shared by the spool and the secondary.
+func sanitizeHostMetricValues(values []*mkr.HostMetricValue) []*mkr.HostMetricValue {
+	sanitized := values
+	copied := false
+	for i, v := range values {
+		if v.MetricValue == nil {
+			continue
+		}
+		name := sanitizeName(v.Name, metricNameLengthLimit)
+		if name == v.Name {
+			continue
+		}
+		if !copied {
+			sanitized = append([]*mkr.HostMetricValue(nil), values...)
+			copied = true
+		}
+		mv := *v.MetricValue
+		mv.Name = name
+		sanitized[i] = &mkr.HostMetricValue{HostID: v.HostID, MetricValue: &mv}
+	}
+	return sanitized
+}
+
+func sanitizeMetricValues(values []*mkr.MetricValue) []*mkr.MetricValue {
+	sanitized := values
+	copied := false
+	for i, v := range values {
+		name := sanitizeName(v.Name, metricNameLengthLimit)
+		if name == v.Name {
+			continue
+		}
+		if !copied {
+			sanitized = append([]*mkr.MetricValue(nil), values...)
+			copied = true
+		}
+		mv := *v
+		mv.Name = name
+		sanitized[i] = &mv
+	}
+	return sanitized
+}
+
+// sanitizeHostParam returns the copy of param with the strings sanitized.
+func sanitizeHostParam(param *CreateHostParam) *CreateHostParam {
+	p := util.SanitizeValue(param, false, specLengthLimit).(*CreateHostParam)
+	p.Name = sanitizeName(param.Name, hostNameLengthLimit)
+	p.DisplayName = sanitizeName(param.DisplayName, hostNameLengthLimit)
+	return p
+}
+
+// PostHostMetricValues posts the values with the names sanitized.
+func (api *API) PostHostMetricValues(values []*mkr.HostMetricValue) error {
+	return api.Client.PostHostMetricValues(sanitizeHostMetricValues(values))
+}
+
+// PostServiceMetricValues posts the values of the service with the names sanitized.
+func (api *API) PostServiceMetricValues(serviceName string, values []*mkr.MetricValue) error {
+	return api.Client.PostServiceMetricValues(serviceName, sanitizeMetricValues(values))
+}
+
+// PutHostMetaData puts the metadata with the strings sanitized, whose
+// newlines and tabs are kept.
+func (api *API) PutHostMetaData(hostID, namespace string, metadata mkr.HostMetaData) error {
+	return api.Client.PutHostMetaData(hostID, namespace, util.SanitizeValue(metadata, true, 0))
+}
@@ -0,0 +1,77 @@
+package mackerel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestSanitizeHostMetricValues(t *testing.T) {
+	valid := &mkr.HostMetricValue{HostID: "abc", MetricValue: &mkr.MetricValue{Name: "custom.foo", Value: 1.0}}
+	invalid := &mkr.HostMetricValue{HostID: "abc", MetricValue: &mkr.MetricValue{Name: "custom.\xff\x00bar", Value: 2.0}}
+	long := &mkr.HostMetricValue{HostID: "abc", MetricValue: &mkr.MetricValue{Name: "custom." + strings.Repeat("a", 300), Value: 3.0}}
+	values := []*mkr.HostMetricValue{valid, invalid, long}
+
+	sanitized := sanitizeHostMetricValues(values)
+	if sanitized[0] != valid {
+		t.Errorf("the valid value should be kept as is: %+v", sanitized[0])
+	}
+	if sanitized[1].Name != "custom.�bar" || sanitized[1].HostID != "abc" || sanitized[1].Value != 2.0 {
+		t.Errorf("the invalid name should be sanitized: %+v", sanitized[1].MetricValue)
+	}
+	if n := len(sanitized[2].Name); n != metricNameLengthLimit || !strings.HasSuffix(sanitized[2].Name, "...") {
+		t.Errorf("the long name should be truncated to %d characters but %d: %s", metricNameLengthLimit, n, sanitized[2].Name)
+	}
+	if values[1] != invalid || invalid.Name != "custom.\xff\x00bar" {
+		t.Errorf("the values should not be modified: %+v", invalid.MetricValue)
+	}
+
+	if s := sanitizeHostMetricValues(values[:1]); &s[0] != &values[0] {
+		t.Error("the valid values should not be copied")
+	}
+}
+
+func TestUpdateHost_Sanitized(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		res.Header()["Content-Type"] = []string{"application/json"}
+		fmt.Fprint(res, `{"id":"abc"}`)
+	}))
+	defer ts.Close()
+	api, _ := NewAPI(ts.URL, "dummy-key", false)
+
+	param := &UpdateHostParam{
+		Name:          "web\x00.example.com",
+		RoleFullnames: []string{"Service:role\n"},
+	}
+	param.Meta.Filesystem = mkr.FileSystem{"/dev/sda\xff": map[string]interface{}{"label": "\x1b[1m" + strings.Repeat("x", 2000)}}
+	if _, err := api.UpdateHost("abc", param); err != nil {
+		t.Fatal(err)
+	}
+
+	var data struct {
+		Name          string                                            `json:"name"`
+		RoleFullnames []string                                          `json:"roleFullnames"`
+		Meta          struct{ Filesystem map[string]map[string]string } `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		t.Fatalf("the request should be JSON: %s: %s", err, body)
+	}
+	if data.Name != "web.example.com" || data.RoleFullnames[0] != "Service:role" {
+		t.Errorf("the name and the roles should be sanitized: %s", body)
+	}
+	label := data.Meta.Filesystem["/dev/sda�"]["label"]
+	if len(label) != specLengthLimit || !strings.HasPrefix(label, "[1mxxx") || !strings.HasSuffix(label, "...") {
+		t.Errorf("the label should be sanitized and truncated: %s", body)
+	}
+	if _, ok := param.Meta.Filesystem["/dev/sda\xff"]; !ok || param.Name != "web\x00.example.com" {
+		t.Errorf("the param should not be modified: %+v", param)
+	}
+}
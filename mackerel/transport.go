@@ -0,0 +1,150 @@
+package mackerel
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transport is shared by all the API clients, so that the connections to
+// Mackerel are reused across the requests of metrics, checks, specs and metadata.
+var transport = newTransport()
+
+func newTransport() *http.Transport {
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           Dialer(nil).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	enableHTTP2(t)
+	return t
+}
+
+// Dialer returns the dialer of the outbound connections from localAddr,
+// which is chosen by the system if it is nil.
+func Dialer(localAddr net.IP) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if localAddr != nil {
+		d.LocalAddr = &net.TCPAddr{IP: localAddr}
+	}
+	return d
+}
+
+// SetLocalAddr sets the source address of the connections to Mackerel. It
+// should be called before the requests.
+func SetLocalAddr(localAddr net.IP) {
+	transport.DialContext = Dialer(localAddr).DialContext
+}
+
+// SetProxy sets the proxy of the requests to Mackerel, which is
+// http.ProxyFromEnvironment by default. It should be called before the requests.
+func SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	transport.Proxy = proxy
+}
+
+var connCreated, connReused uint64
+
+// ConnectionCounts returns the numbers of the connections to Mackerel
+// which are created and reused by the requests.
+func ConnectionCounts() (created, reused uint64) {
+	return atomic.LoadUint64(&connCreated), atomic.LoadUint64(&connReused)
+}
+
+var requestCounts = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// RequestCounts returns the numbers of the requests to Mackerel keyed by
+// "<method> <status code>", or "<method> error" for the requests failed
+// without the responses.
+func RequestCounts() map[string]uint64 {
+	requestCounts.Lock()
+	defer requestCounts.Unlock()
+	counts := make(map[string]uint64, len(requestCounts.counts))
+	for k, v := range requestCounts.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func countRequest(method string, resp *http.Response) {
+	key := method + " error"
+	if resp != nil {
+		key = method + " " + strconv.Itoa(resp.StatusCode)
+	}
+	requestCounts.Lock()
+	defer requestCounts.Unlock()
+	requestCounts.counts[key]++
+}
+
+var postLatency struct {
+	sync.Mutex
+	total time.Duration
+	count int
+}
+
+// TakePostLatency returns the average latency of the POST requests to Mackerel
+// since the last call. It returns false if there are no requests.
+func TakePostLatency() (time.Duration, bool) {
+	postLatency.Lock()
+	defer postLatency.Unlock()
+	total, count := postLatency.total, postLatency.count
+	postLatency.total, postLatency.count = 0, 0
+	if count == 0 {
+		return 0, false
+	}
+	return total / time.Duration(count), true
+}
+
+func recordPostLatency(d time.Duration) {
+	postLatency.Lock()
+	defer postLatency.Unlock()
+	postLatency.total += d
+	postLatency.count++
+}
+
+// connTraceTransport counts whether the connections are reused,
+// and records the latency of the POST requests and the clock skew.
+type connTraceTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *connTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&connReused, 1)
+			} else {
+				atomic.AddUint64(&connCreated, 1)
+			}
+			created, reused := ConnectionCounts()
+			logger.Debugf("%s %s: connection reused: %t (created: %d, reused: %d)", req.Method, req.URL.Path, info.Reused, created, reused)
+		},
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	countRequest(req.Method, resp)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if req.Method == "POST" {
+		recordPostLatency(end.Sub(start))
+	}
+	measureClockSkew(resp, start, end)
+	return resp, nil
+}
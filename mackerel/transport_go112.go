@@ -0,0 +1,9 @@
+// +build !go1.13
+
+package mackerel
+
+import "net/http"
+
+// enableHTTP2 does nothing, since HTTP/2 is enabled by default before Go 1.13.
+func enableHTTP2(t *http.Transport) {
+}
@@ -0,0 +1,10 @@
+// +build go1.13
+
+package mackerel
+
+import "net/http"
+
+// enableHTTP2 enables HTTP/2, which is disabled by the custom DialContext since Go 1.13.
+func enableHTTP2(t *http.Transport) {
+	t.ForceAttemptHTTP2 = true
+}
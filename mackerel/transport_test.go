@@ -0,0 +1,100 @@
+package mackerel
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAPI_ReusesConnections(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, reused := ConnectionCounts()
+	posts := RequestCounts()["POST 200"]
+	TakePostLatency()
+	for i := 0; i < 3; i++ {
+		if err := api.PostHostMetricValues(nil); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+	}
+	c, r := ConnectionCounts()
+	if c-created != 1 || r-reused != 2 {
+		t.Errorf("the connection should be created once and reused twice but got created: %d, reused: %d", c-created, r-reused)
+	}
+	if n := RequestCounts()["POST 200"] - posts; n != 3 {
+		t.Errorf("the requests should be counted 3 but got %d", n)
+	}
+
+	if d, ok := TakePostLatency(); !ok || d <= 0 {
+		t.Errorf("the latency of the posts should be recorded but got %s, %t", d, ok)
+	}
+	if _, ok := TakePostLatency(); ok {
+		t.Error("the latency should be reset")
+	}
+}
+
+func TestNewTransport_HTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Proto))
+	}))
+	ts.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tr := newTransport()
+	tr.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	resp, err := (&http.Client{Transport: tr}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("the request should be sent with HTTP/2 but got %s", body)
+	}
+}
+
+func TestSetLocalAddr(t *testing.T) {
+	var remoteAddr string
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+
+	// Every request dials a new connection on the own transport of the test,
+	// since the connection of the previous request may not be idle yet.
+	shared := transport
+	defer func() { transport = shared }()
+	transport = newTransport()
+	transport.DisableKeepAlives = true
+	SetLocalAddr(net.ParseIP("127.0.0.1"))
+
+	api, err := NewAPI(ts.URL, "dummy-key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.PostHostMetricValues(nil); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if host, _, _ := net.SplitHostPort(remoteAddr); host != "127.0.0.1" {
+		t.Errorf("the connection should be from 127.0.0.1 but got %s", remoteAddr)
+	}
+
+	SetLocalAddr(net.ParseIP("::1"))
+	if err := api.PostHostMetricValues(nil); err == nil {
+		t.Error("the connection from the address of the other family should fail")
+	}
+}
@@ -11,11 +11,21 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/agent"
 	"github.com/mackerelio/mackerel-agent/command"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/cpuquota"
+	"github.com/mackerelio/mackerel-agent/exitcode"
+	"github.com/mackerelio/mackerel-agent/logeventlog"
+	"github.com/mackerelio/mackerel-agent/logfile"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/orphan"
 	"github.com/mackerelio/mackerel-agent/pidfile"
+	"github.com/mackerelio/mackerel-agent/pluginbreaker"
+	"github.com/mackerelio/mackerel-agent/supervisor"
 	"github.com/motemen/go-cli"
+	"github.com/pkg/errors"
 )
 
 // allow options like -role=... -role=...
@@ -33,12 +43,14 @@ func (r *roleFullnamesFlag) Set(input string) error {
 	return nil
 }
 
-var logger = logging.GetLogger("main")
+var logger = logformat.GetLogger("main")
 
 func main() {
 	// although the possibility is very low, mackerel-agent may panic because of
 	// a race condition in multi-threaded environment on some OS/Arch.
-	// So fix GOMAXPROCS to 1 just to be safe.
+	// So fix GOMAXPROCS to 1 just to be safe. It never exceeds the CPU quota of
+	// the cgroup, which is rounded up to at least one CPU, so the quota does not
+	// change it. GOMAXPROCS given by the environment is respected as is.
 	if os.Getenv("GOMAXPROCS") == "" {
 		runtime.GOMAXPROCS(1)
 	}
@@ -50,7 +62,29 @@ func main() {
 	}
 	godebug += "http2client=0"
 	os.Setenv("GODEBUG", godebug)
-	cli.Run(os.Args[1:])
+	os.Exit(run(os.Args[1:]))
+}
+
+// run dispatches the command and returns the exit code, which tells the
+// cause of the failure as defined in the exitcode package.
+func run(args []string) int {
+	err := cli.Dispatch(args)
+	switch err {
+	case nil:
+		return exitcode.OK
+	case cli.ErrUsage, flag.ErrHelp:
+		return exitcode.ConfigError
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return exitcode.Of(err)
+}
+
+// pidfileError annotates the error of pidfile.Create with the exit code.
+func pidfileError(err error) error {
+	if _, ok := errors.Cause(err).(*pidfile.AlreadyRunningError); ok {
+		return exitcode.WithCode(err, exitcode.PidfileConflict)
+	}
+	return err
 }
 
 func printRetireUsage() {
@@ -59,7 +93,11 @@ func printRetireUsage() {
         Config file path (Configs in this file are over-written by command line options)
         (default "%s")
   -force
-        force retirement without prompting
+        force retirement without prompting, succeeding if the host is already retired
+  -dry-run
+        print the host which would be retired
+  -only-if-status string
+        retire only if the status of the host is one of them, such as "poweroff,standby"
   -apibase string
         API base (default "%s")
   -apikey string
@@ -68,14 +106,136 @@ func printRetireUsage() {
 		config.DefaultConfig.Apibase)
 
 	fmt.Fprintln(os.Stderr, usage)
-	os.Exit(2)
+	os.Exit(exitcode.ConfigError)
 }
 
-func resolveConfigForRetire(fs *flag.FlagSet, argv []string) (*config.Config, bool, error) {
-	var force = fs.Bool("force", false, "force retirement without prompting")
+func resolveConfigForRetire(fs *flag.FlagSet, argv []string) (*config.Config, command.RetireOptions, error) {
+	var (
+		opts         command.RetireOptions
+		onlyIfStatus = fs.String("only-if-status", "", "retire only if the status of the host is one of them (comma separated)")
+	)
+	fs.BoolVar(&opts.Force, "force", false, "force retirement without prompting")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the host which would be retired")
 	fs.Usage = printRetireUsage
 	conf, err := resolveConfig(fs, argv)
-	return conf, *force, err
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.OnlyIfStatus, err = command.ParseHostStatuses(*onlyIfStatus)
+	return conf, opts, err
+}
+
+func resolveConfigForStatus(fs *flag.FlagSet, argv []string) (*config.Config, bool, error) {
+	var asJSON = fs.Bool("json", false, "output the status in JSON")
+	conf, err := resolveConfig(fs, argv)
+	return conf, *asJSON, err
+}
+
+func resolveConfigForOnce(fs *flag.FlagSet, argv []string) (*config.Config, string, error) {
+	var format = fs.String("format", "", "output format (json)")
+	conf, err := resolveConfig(fs, argv)
+	return conf, *format, err
+}
+
+func resolveConfigForPluginInstall(fs *flag.FlagSet, argv []string) (*config.Config, command.PluginInstallOptions, error) {
+	var (
+		opts       command.PluginInstallOptions
+		pluginsDir = fs.String("plugins-dir", "", "Directory to install the plugins into (default \"plugins\" under the root directory)")
+		overwrite  = fs.Bool("overwrite", false, "Overwrite the installed executables")
+	)
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		// the plugins can be installed before the agent is configured
+		logger.Warningf("failed to load config (but `plugin install` does not require conf): %s", err)
+		conf = &config.Config{Root: rootFlag(fs)}
+	}
+	if fs.NArg() != 1 {
+		return nil, opts, fmt.Errorf("the plugin to install is required: owner/repo[@version] or url")
+	}
+	opts.Target = fs.Arg(0)
+	opts.Dir = *pluginsDir
+	opts.Overwrite = *overwrite
+	return conf, opts, nil
+}
+
+func resolveConfigForDiagnose(fs *flag.FlagSet, argv []string) (*config.Config, command.DiagnoseOptions, error) {
+	var (
+		opts     command.DiagnoseOptions
+		toStdout = fs.Bool("stdout", false, "Print the information instead of writing the bundle")
+		output   = fs.String("output", "", "The bundle file to write (default \"mackerel-agent-diagnose-<time>.tar.gz\")")
+		logLines = fs.Int("log-lines", 200, "The number of the last lines of the log file")
+		timeout  = fs.Duration("timeout", 30*time.Second, "The timeout of each probe")
+	)
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		// the configuration which failed to load is also diagnosed
+		logger.Warningf("failed to load config (but `diagnose` does not require conf): %s", err)
+		opts.ConfigError = err
+		conf, err = config.LoadConfig(fs.Lookup("conf").Value.String())
+		if err != nil {
+			conf = &config.Config{
+				Apibase:  fs.Lookup("apibase").Value.String(),
+				Root:     rootFlag(fs),
+				Conffile: fs.Lookup("conf").Value.String(),
+			}
+		}
+	}
+	if !*toStdout {
+		opts.Output = *output
+		if opts.Output == "" {
+			opts.Output = "mackerel-agent-diagnose-" + time.Now().Format("20060102-150405") + ".tar.gz"
+		}
+	}
+	opts.LogLines = *logLines
+	opts.Timeout = *timeout
+	return conf, opts, nil
+}
+
+func resolveConfigForDoctor(fs *flag.FlagSet, argv []string) (*config.Config, bool, error) {
+	var asJSON = fs.Bool("json", false, "Output the result as a JSON document")
+	conf, err := resolveConfig(fs, argv)
+	return conf, *asJSON, err
+}
+
+func resolveConfigForInspectPlugin(fs *flag.FlagSet, argv []string) (*config.Config, string, error) {
+	var plugin = fs.String("plugin", "", "The name of the metrics plugin to inspect, such as NAME of [plugin.metrics.NAME]")
+	conf, err := resolveConfig(fs, argv)
+	if err != nil {
+		// the plugins can be inspected before the apikey is configured
+		conf, err = config.LoadConfig(fs.Lookup("conf").Value.String())
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if *plugin == "" {
+		return nil, "", fmt.Errorf("the plugin to inspect is required: -plugin NAME")
+	}
+	return conf, *plugin, nil
+}
+
+// agentMeta returns the version of the agent, and the version of the Windows
+// service wrapper if it launched the agent.
+func agentMeta() *command.AgentMeta {
+	return &command.AgentMeta{
+		Version:        version,
+		Revision:       gitcommit,
+		WrapperVersion: os.Getenv(config.WrapperVersionEnv),
+	}
+}
+
+// rootFlag returns the root directory by -root or the environment variable,
+// for the commands which work without the config file.
+func rootFlag(fs *flag.FlagSet) string {
+	root := os.Getenv(config.RootEnv)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "root" {
+			root = f.Value.String()
+		}
+	})
+	if root == "" {
+		return config.DefaultConfig.Root
+	}
+	return root
 }
 
 // resolveConfig parses command line arguments and loads config file to
@@ -87,10 +247,14 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 		conffile      = fs.String("conf", config.DefaultConfig.Conffile, "Config file path (Configs in this file are over-written by command line options)")
 		apibase       = fs.String("apibase", config.DefaultConfig.Apibase, "API base")
 		pidfile       = fs.String("pidfile", config.DefaultConfig.Pidfile, "File containing PID")
-		root          = fs.String("root", config.DefaultConfig.Root, "Directory containing variable state information")
+		root          = fs.String("root", config.DefaultConfig.Root, "Directory containing variable state information (or "+config.RootEnv+")")
 		apikey        = fs.String("apikey", "", "(DEPRECATED) API key from mackerel.io web site")
 		diagnostic    = fs.Bool("diagnostic", false, "Enables diagnostic features")
 		child         = fs.Bool("child", false, "(internal use) child process of the supervise mode")
+		atExit        = fs.String("at-exit", "", "The action at exit with [autoretirement] enable = true ("+command.AtExitRetire+" or "+command.AtExitRetireOnShutdown+")")
+		forceGraphDef = fs.Bool("force-graphdef", false, "Post the graph definitions of the plugins even if they are not changed")
+		logFormat     = fs.String("log-format", config.LogFormatText, "Log format ("+config.LogFormatText+" or "+config.LogFormatJSON+")")
+		instance      = fs.String("instance-suffix", "", "Run as the instance registered as a host of its own, whose state files and hostname are suffixed with it")
 		verbose       bool
 		roleFullnames roleFullnamesFlag
 	)
@@ -103,7 +267,7 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 
 	fs.Parse(argv)
 
-	conf, confErr := config.LoadConfig(*conffile)
+	conf, confErr := config.LoadInstanceConfig(*conffile, *instance)
 	if confErr != nil {
 		return nil, fmt.Errorf("failed to load the config file: %s", confErr)
 	}
@@ -119,18 +283,33 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 		case "pidfile":
 			conf.Pidfile = *pidfile
 		case "root":
-			conf.Root = *root
+			conf.SetRoot(*root)
 		case "diagnostic":
 			conf.Diagnostic = *diagnostic
 		case "verbose", "v":
 			conf.Verbose = verbose
+		case "log-format":
+			conf.LogFormat = *logFormat
 		case "role":
 			conf.Roles = roleFullnames
 		}
 	})
+	switch conf.LogFormat {
+	case "", config.LogFormatText, config.LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format of -log-format: %s", conf.LogFormat)
+	}
+	switch *atExit {
+	case "", command.AtExitRetire, command.AtExitRetireOnShutdown:
+		conf.AtExit = *atExit
+	default:
+		return nil, fmt.Errorf("unknown action of -at-exit: %s", *atExit)
+	}
+	conf.ForceGraphDefs = *forceGraphDef
 	if *child {
 		// Child process of supervisor never create pidfile, because supervisor process does create it.
 		conf.Pidfile = ""
+		conf.Supervised = true
 	}
 
 	r := []string{}
@@ -154,33 +333,171 @@ func resolveConfig(fs *flag.FlagSet, argv []string) (*config.Config, error) {
 	if conf.HTTPProxy != "" {
 		os.Setenv("HTTP_PROXY", conf.HTTPProxy)
 	}
+	if conf.Proxy == config.ProxySystem {
+		mackerel.SetProxy(command.ConfigProxy(conf))
+	}
+	if conf.BindAddress != "" {
+		ip, err := config.ResolveBindAddress(conf.BindAddress)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("connecting to %s from %s (bind_address = %q)", conf.Apibase, ip, conf.BindAddress)
+		mackerel.SetLocalAddr(ip)
+	}
 	return conf, nil
 }
 
-func setLogLevel(silent, verbose bool) {
+// supervisorOptions returns the limits of the restarts by the supervisor,
+// whose unspecified ones are the defaults of the supervisor.
+func supervisorOptions(conf *config.Config) supervisor.Options {
+	var opts supervisor.Options
+	s := conf.Supervisor
+	if s.MaxRestarts != nil {
+		opts.MaxRestarts = int(*s.MaxRestarts)
+	}
+	if s.RestartInterval != nil {
+		opts.RestartInterval = s.RestartInterval.Duration
+	}
+	if s.RestartBackoff != nil {
+		opts.Backoff = s.RestartBackoff.Duration
+	}
+	if s.MaxRestartBackoff != nil {
+		opts.MaxBackoff = s.MaxRestartBackoff.Duration
+	}
+	return opts
+}
+
+// setLogLevel sets the level of the logs, which is overridden by the levels of
+// the components. verbose sets all the components to debug.
+func setLogLevel(silent, verbose bool, levels map[string]string) {
+	level := "info"
 	if silent {
-		logging.SetLogLevel(logging.ERROR)
+		level = "error"
 	}
 	if verbose {
-		logging.SetLogLevel(logging.DEBUG)
+		level, levels = "debug", nil
+	}
+	logformat.SetLevels(level, levels)
+}
+
+func setLogFormat(format string, disableDedup bool) {
+	logformat.SetJSON(format == config.LogFormatJSON)
+	logformat.SetDedup(!disableDedup)
+}
+
+// setLogOutput writes the logs to syslog, the event log or log_file, or to
+// stderr if they can not be opened. The returned function closes them.
+func setLogOutput(conf *config.Config) func() {
+	if conf.LogOutput == config.LogOutputEventLog {
+		w, err := openEventLog()
+		if err != nil {
+			logger.Warningf("Failed to open the event log, writing the logs to stderr: %s", err)
+			return func() {}
+		}
+		logformat.SetOutput(w)
+		return func() {
+			logformat.SetOutput(os.Stderr)
+			w.Close()
+		}
+	}
+	if conf.LogOutput == config.LogOutputSyslog {
+		w, err := openSyslog(conf)
+		if w == nil {
+			logger.Warningf("Failed to open syslog, writing the logs to stderr: %s", err)
+			return func() {}
+		}
+		if err != nil {
+			logger.Warningf("Failed to connect to syslog, writing the logs to stderr until reconnected: %s", err)
+		}
+		logformat.SetOutput(w)
+		return func() {
+			logformat.SetOutput(os.Stderr)
+			w.Close()
+		}
+	}
+	if conf.LogFile == "" {
+		return func() {}
+	}
+	opts := logfile.Options{Compress: conf.LogCompress}
+	if conf.LogMaxSize != nil {
+		opts.MaxSize = *conf.LogMaxSize
+	}
+	if conf.LogMaxFiles != nil {
+		opts.MaxFiles = *conf.LogMaxFiles
+	}
+	if conf.LogRotateInterval != nil {
+		opts.Interval = conf.LogRotateInterval.Duration
+	}
+	f, err := logfile.Open(conf.LogFile, opts)
+	if err != nil {
+		logger.Warningf("Failed to open the log file, writing the logs to stderr: %s", err)
+		return func() {}
+	}
+	logformat.SetOutput(f)
+	return func() {
+		logformat.SetOutput(os.Stderr)
+		f.Close()
 	}
 }
 
 func start(conf *config.Config, termCh chan struct{}) error {
-	setLogLevel(conf.Silent, conf.Verbose)
+	setLogLevel(conf.Silent, conf.Verbose, conf.LogLevels)
+	setLogFormat(conf.LogFormat, conf.DisableLogDedup)
+	// The logs of the child process are written to the log file or syslog by the supervisor.
+	if !conf.Supervised {
+		defer setLogOutput(conf)()
+	}
 	logger.Infof("Starting mackerel-agent version:%s, rev:%s, apibase:%s", version, gitcommit, conf.Apibase)
+	// the Windows service wrapper counts the restarts by the supervisor
+	logeventlog.Started(os.Stderr)
+	if conf.InstanceSuffix != "" {
+		logger.Infof("Running as the instance %q (root: %s, pidfile: %s)", conf.InstanceSuffix, conf.Root, conf.Pidfile)
+	}
+	if cpus, ok := cpuquota.CPUs(); ok {
+		logger.Infof("The CPU quota of the cgroup is %.2f CPUs of %d, which limits the default metrics_concurrency to %d and the concurrent checks to %d (GOMAXPROCS: %d)", cpus, runtime.NumCPU(), agent.DefaultMetricsConcurrency(), agent.DefaultChecksConcurrency(), runtime.GOMAXPROCS(0))
+	}
+
+	// the supervisor has verified them
+	if !conf.Supervised {
+		if err := verifyConfigPermissions(conf); err != nil {
+			return exitcode.WithCode(err, exitcode.ConfigError)
+		}
+	}
+
+	// the agent restarted by the reload also checks them
+	for _, p := range conf.CommandProblems() {
+		logger.Warningf("The plugin will fail to run: %s", p)
+	}
+	if disabled := conf.DisabledPlugins(); len(disabled) > 0 {
+		logger.Warningf("The plugins are disabled by enabled = false: %s", strings.Join(disabled, ", "))
+	}
 
+	// before writing any of them, so that all the problems are reported at once
+	if err := command.VerifyStatePaths(conf); err != nil {
+		return err
+	}
+	if err := conf.CreateRoot(); err != nil {
+		return fmt.Errorf("failed to create the root directory: %s", err)
+	}
 	if err := pidfile.Create(conf.Pidfile); err != nil {
-		return fmt.Errorf("pidfile.Create(%q) failed: %s", conf.Pidfile, err)
+		return pidfileError(errors.Wrapf(err, "pidfile.Create(%q) failed", conf.Pidfile))
 	}
 	defer pidfile.Remove(conf.Pidfile)
 
-	app, err := command.Prepare(conf, &command.AgentMeta{
-		Version:  version,
-		Revision: gitcommit,
-	})
+	unlock, err := conf.LockHostID()
 	if err != nil {
-		return fmt.Errorf("command.Prepare failed: %s", err)
+		return err
+	}
+	defer unlock()
+
+	// before the plugins are run, since the plugins of this agent are not orphans
+	if err := orphan.Clean(conf.Root, conf.PluginCommandLines(), conf.OrphanPlugins == config.OrphanPluginsTerminate); err != nil {
+		logger.Warningf("Failed to find the plugin processes left by the previous agent: %s", err)
+	}
+
+	app, err := command.Prepare(conf, agentMeta())
+	if err != nil {
+		return errors.Wrap(err, "command.Prepare failed")
 	}
 
 	c := make(chan os.Signal, 1)
@@ -190,29 +507,65 @@ func start(conf *config.Config, termCh chan struct{}) error {
 	return command.Run(app, termCh)
 }
 
+// verifyConfigPermissions warns about the configuration files containing the
+// secrets which are readable by the others, and refuses them with secure_config.
+func verifyConfigPermissions(conf *config.Config) error {
+	problems := conf.InsecureSecretFiles()
+	for _, p := range problems {
+		logger.Warningf("INSECURE CONFIG FILE: %s. Restrict the permission not to leak the secrets", p)
+	}
+	if len(problems) > 0 && conf.SecureConfig {
+		return fmt.Errorf("the config files containing the secrets are readable by the others (secure_config = true)")
+	}
+	return nil
+}
+
 var maxTerminatingInterval = 30 * time.Second
 
+// The agent is forced to shutdown after flushing the pending metrics in
+// shutdown_flush_timeout, retiring the host or updating the host status on stop.
+func terminatingInterval(conf *config.Config) time.Duration {
+	if conf == nil {
+		return maxTerminatingInterval
+	}
+	d := command.ShutdownFlushTimeout(conf) + 20*time.Second
+	if conf.AutoRetirement.Enable {
+		d += command.AutoRetirementTimeout(conf)
+	}
+	if d > maxTerminatingInterval {
+		return d
+	}
+	return maxTerminatingInterval
+}
+
 func signalHandler(c chan os.Signal, app *command.App, termCh chan struct{}) {
 	received := false
 	for sig := range c {
 		if sig == syscall.SIGHUP {
 			logger.Debugf("Received signal '%v'", sig)
 			// TODO reload configuration file
+			if err := logformat.Reopen(); err != nil {
+				logger.Warningf("Failed to reopen the log file: %s", err)
+			}
 
-			app.UpdateHostSpecs()
+			app.ResetCheckReports()
+			app.ResetMetadata()
+			pluginbreaker.Reset()
+			app.RefreshHostSpecs()
 		} else {
+			interval := terminatingInterval(app.Config)
 			if !received {
 				received = true
 				logger.Infof(
 					"Received signal '%v', try graceful shutdown up to %f seconds. If you want force shutdown immediately, send a signal again.",
 					sig,
-					maxTerminatingInterval.Seconds())
+					interval.Seconds())
 			} else {
 				logger.Infof("Received signal '%v' again, force shutdown.", sig)
 			}
 			termCh <- struct{}{}
 			go func() {
-				time.Sleep(maxTerminatingInterval)
+				time.Sleep(interval)
 				logger.Infof("Timed out. force shutdown.")
 				termCh <- struct{}{}
 			}()
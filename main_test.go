@@ -12,7 +12,10 @@ import (
 	"time"
 
 	"github.com/mackerelio/mackerel-agent/command"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/exitcode"
 	"github.com/mackerelio/mackerel-agent/pidfile"
+	"github.com/pkg/errors"
 )
 
 func TestParseFlags(t *testing.T) {
@@ -57,6 +60,61 @@ diagnostic=false
 	}
 }
 
+func TestParseFlags_AtExit(t *testing.T) {
+	confFile, err := ioutil.TempFile("", "mackerel-config-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary config file for test")
+	}
+	confFile.WriteString(`apikey="DUMMYAPIKEY"
+`)
+	confFile.Close()
+	defer os.Remove(confFile.Name())
+
+	conf, err := resolveConfig(&flag.FlagSet{}, []string{"-conf=" + confFile.Name(), "-at-exit=retire-on-shutdown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.AtExit != command.AtExitRetireOnShutdown {
+		t.Errorf("AtExit should be %s but: %s", command.AtExitRetireOnShutdown, conf.AtExit)
+	}
+	if conf.ForceGraphDefs {
+		t.Error("ForceGraphDefs should be false without -force-graphdef")
+	}
+	conf, err = resolveConfig(&flag.FlagSet{}, []string{"-conf=" + confFile.Name(), "-force-graphdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.ForceGraphDefs {
+		t.Error("ForceGraphDefs should be true with -force-graphdef")
+	}
+	if _, err := resolveConfig(&flag.FlagSet{}, []string{"-conf=" + confFile.Name(), "-at-exit=shutdown"}); err == nil {
+		t.Error("the unknown action of -at-exit should be an error")
+	}
+}
+
+func TestParseFlags_LogFormat(t *testing.T) {
+	confFile, err := ioutil.TempFile("", "mackerel-config-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary config file for test")
+	}
+	confFile.WriteString(`apikey="DUMMYAPIKEY"
+log_format = "text"
+`)
+	confFile.Close()
+	defer os.Remove(confFile.Name())
+
+	conf, err := resolveConfig(&flag.FlagSet{}, []string{"-conf=" + confFile.Name(), "-log-format=json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.LogFormat != config.LogFormatJSON {
+		t.Errorf("LogFormat(overwritten by command line option) should be %s but: %s", config.LogFormatJSON, conf.LogFormat)
+	}
+	if _, err := resolveConfig(&flag.FlagSet{}, []string{"-conf=" + confFile.Name(), "-log-format=ltsv"}); err == nil {
+		t.Error("the unknown format of -log-format should be an error")
+	}
+}
+
 func TestDetectForce(t *testing.T) {
 	// prepare dummy config
 	confFile, err := ioutil.TempFile("", "mackerel-config-test")
@@ -70,8 +128,8 @@ func TestDetectForce(t *testing.T) {
 	defer os.Remove(confFile.Name())
 
 	argv := []string{"-conf=" + confFile.Name()}
-	conf, force, _ := resolveConfigForRetire(&flag.FlagSet{}, argv)
-	if force {
+	conf, opts, _ := resolveConfigForRetire(&flag.FlagSet{}, argv)
+	if opts.Force {
 		t.Errorf("force should be false")
 	}
 	if conf.Apikey != "DUMMYAPIKEY" {
@@ -79,13 +137,21 @@ func TestDetectForce(t *testing.T) {
 	}
 
 	argv = append(argv, "-force")
-	conf, force, _ = resolveConfigForRetire(&flag.FlagSet{}, argv)
-	if !force {
+	conf, opts, _ = resolveConfigForRetire(&flag.FlagSet{}, argv)
+	if !opts.Force {
 		t.Errorf("force should be true")
 	}
 	if conf.Apikey != "DUMMYAPIKEY" {
 		t.Errorf("Apikey should be 'DUMMYAPIKEY'")
 	}
+
+	_, opts, err = resolveConfigForRetire(&flag.FlagSet{}, append(argv, "-dry-run", "-only-if-status=poweroff,standby"))
+	if err != nil || !opts.DryRun || len(opts.OnlyIfStatus) != 2 {
+		t.Errorf("the options should be parsed: %+v, %v", opts, err)
+	}
+	if _, _, err := resolveConfigForRetire(&flag.FlagSet{}, append(argv, "-only-if-status=retired")); err == nil {
+		t.Errorf("the invalid status should raise error")
+	}
 }
 
 func TestResolveConfigForRetire(t *testing.T) {
@@ -112,8 +178,8 @@ func TestResolveConfigForRetire(t *testing.T) {
 		"-role=hoge:fuga",
 	}
 
-	conf, force, _ := resolveConfigForRetire(&flag.FlagSet{}, argv)
-	if force {
+	conf, opts, _ := resolveConfigForRetire(&flag.FlagSet{}, argv)
+	if opts.Force {
 		t.Errorf("force should be false")
 	}
 	if conf.Apikey != "hogege" {
@@ -146,6 +212,23 @@ func TestCreateAndRemovePidFile(t *testing.T) {
 	}
 }
 
+func TestPidfileError(t *testing.T) {
+	err := pidfileError(errors.Wrap(&pidfile.AlreadyRunningError{Pidfile: "/tmp/pid"}, "pidfile.Create failed"))
+	if code := exitcode.Of(err); code != exitcode.PidfileConflict {
+		t.Errorf("the exit code should be %d but got %d", exitcode.PidfileConflict, code)
+	}
+	err = pidfileError(fmt.Errorf("permission denied"))
+	if code := exitcode.Of(err); code != exitcode.Error {
+		t.Errorf("the exit code should be %d but got %d", exitcode.Error, code)
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	if code := run([]string{"no-such-command"}); code != exitcode.ConfigError {
+		t.Errorf("the exit code should be %d but got %d", exitcode.ConfigError, code)
+	}
+}
+
 func TestSignalHandler(t *testing.T) {
 	app := &command.App{}
 	termCh := make(chan struct{})
@@ -215,6 +298,9 @@ func TestConfigTestNotFound(t *testing.T) {
 	if err == nil {
 		t.Errorf("configtest(failed) must be return error")
 	}
+	if code := exitcode.Of(err); code != exitcode.ConfigError {
+		t.Errorf("the exit code should be %d but got %d", exitcode.ConfigError, code)
+	}
 }
 
 func TestConfigTestInvalidFormat(t *testing.T) {
@@ -236,6 +322,9 @@ invalid!!!
 	if err == nil {
 		t.Errorf("configtest(failed) must be return error")
 	}
+	if code := exitcode.Of(err); code != exitcode.ConfigError {
+		t.Errorf("the exit code should be %d but got %d", exitcode.ConfigError, code)
+	}
 }
 
 func TestDoOnce(t *testing.T) {
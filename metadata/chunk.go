@@ -0,0 +1,107 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunk is a part of the metadata split by Split, which is put to Namespace.
+type Chunk struct {
+	Namespace string
+	Metadata  ChunkData
+}
+
+// ChunkData is the metadata of a chunk, whose Data is a part of the metadata
+// encoded in JSON.
+type ChunkData struct {
+	Index int    `json:"index"`
+	Data  string `json:"data"`
+}
+
+// ChunkIndex is the metadata put to the original namespace instead of the
+// metadata split into Chunks. The metadata is restored by concatenating Data
+// of the chunks in order, whose SHA-256 digest is SHA256.
+type ChunkIndex struct {
+	Chunks []string `json:"chunks"`
+	Size   int      `json:"size"`
+	SHA256 string   `json:"sha256"`
+}
+
+// chunkOverhead is the size of ChunkData in JSON except Data, with the index
+// of enough digits.
+const chunkOverhead = len(`{"index":1234567890,"data":""}`)
+
+// ChunkNamespace returns the namespace of the i-th chunk of namespace. It is
+// not separated by "/" since the namespace is a segment of the path of the API.
+func ChunkNamespace(namespace string, i int) string {
+	return namespace + "." + strconv.Itoa(i)
+}
+
+// ChunkNumber returns the number of the chunk of namespace, and whether ns is
+// the namespace of a chunk of it.
+func ChunkNumber(namespace, ns string) (int, bool) {
+	if !strings.HasPrefix(ns, namespace+".") {
+		return 0, false
+	}
+	s := ns[len(namespace)+1:]
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" || (len(s) > 1 && s[0] == '0') {
+		return 0, false
+	}
+	i, err := strconv.Atoi(s)
+	return i, err == nil
+}
+
+// Split splits data, the metadata of namespace encoded in JSON, into the
+// chunks within SizeLimit in JSON. The chunks are split at the same offsets
+// for the same data, so only the chunks after a change differ.
+func Split(namespace string, data []byte) ([]Chunk, ChunkIndex) {
+	s := string(data)
+	var chunks []Chunk
+	for len(s) > 0 || len(chunks) == 0 {
+		n := chunkLength(s, SizeLimit-chunkOverhead)
+		i := len(chunks)
+		chunks = append(chunks, Chunk{
+			Namespace: ChunkNamespace(namespace, i),
+			Metadata:  ChunkData{Index: i, Data: s[:n]},
+		})
+		s = s[n:]
+	}
+	index := ChunkIndex{Size: len(data), SHA256: fmt.Sprintf("%x", sha256.Sum256(data))}
+	for _, c := range chunks {
+		index.Chunks = append(index.Chunks, c.Namespace)
+	}
+	return chunks, index
+}
+
+// chunkLength returns the length of the longest prefix of s at a rune
+// boundary whose size as a JSON string does not exceed limit except quotes.
+func chunkLength(s string, limit int) int {
+	size := 0
+	for i, r := range s {
+		size += jsonRuneSize(r)
+		if size > limit {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// jsonRuneSize returns the size of r in a JSON string by encoding/json, which
+// escapes the HTML characters.
+func jsonRuneSize(r rune) int {
+	switch {
+	case r == '"' || r == '\\':
+		return 2
+	case r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		return 6
+	case r == utf8.RuneError:
+		// the invalid sequences are replaced with U+FFFD
+		return 3
+	}
+	return utf8.RuneLen(r)
+}
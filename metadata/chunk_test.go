@@ -0,0 +1,53 @@
+package metadata
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	data, _ := json.Marshal(map[string]string{
+		"quoted": strings.Repeat(`"<a>" `, 20000),
+		"text":   strings.Repeat("テキスト", 20000),
+	})
+	chunks, index := Split("inventory", data)
+	if len(chunks) < 3 || len(index.Chunks) != len(chunks) || index.Size != len(data) {
+		t.Fatalf("the data should be split into the chunks: %d, %+v", len(chunks), index)
+	}
+	var restored string
+	for i, c := range chunks {
+		if c.Namespace != "inventory."+string(rune('0'+i)) || c.Metadata.Index != i || index.Chunks[i] != c.Namespace {
+			t.Errorf("unexpected chunk: %s, %d", c.Namespace, c.Metadata.Index)
+		}
+		b, err := json.Marshal(c.Metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > SizeLimit {
+			t.Errorf("the chunk %d should be within the limit: %d", i, len(b))
+		}
+		restored += c.Metadata.Data
+	}
+	if restored != string(data) {
+		t.Error("the chunks should be restored to the data")
+	}
+
+	chunks2, index2 := Split("inventory", data)
+	if len(chunks2) != len(chunks) || chunks2[1] != chunks[1] || index2.SHA256 != index.SHA256 {
+		t.Error("the chunks should be deterministic")
+	}
+}
+
+func TestChunkNumber(t *testing.T) {
+	for ns, expected := range map[string]int{"inventory.0": 0, "inventory.12": 12} {
+		if i, ok := ChunkNumber("inventory", ns); !ok || i != expected {
+			t.Errorf("%s should be the chunk %d but %d, %t", ns, expected, i, ok)
+		}
+	}
+	for _, ns := range []string{"inventory", "inventory.", "inventory.01", "inventory.a", "inventory.1.2", "inventory_2.1", "other.1"} {
+		if _, ok := ChunkNumber("inventory", ns); ok {
+			t.Errorf("%s should not be a chunk", ns)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// ErrNoMetadata is returned by Fetch when there is no metadata to post,
+// which is not treated as a failure of the plugin.
+var ErrNoMetadata = errors.New("no metadata")
+
+// fetchFile reads the metadata from the file. The file is read again
+// only if the modification time or the size of the file has changed.
+func (g *Generator) fetchFile() (interface{}, error) {
+	path := g.Config.File
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Debugf("metadata plugin %q: %s is not found", g.Name, path)
+			return nil, ErrNoMetadata
+		}
+		return nil, err
+	}
+	if g.fileMetadata != nil && fi.ModTime().Equal(g.fileModTime) && fi.Size() == g.fileSize {
+		return g.fileMetadata, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata interface{}
+	switch g.Config.Format {
+	case config.MetadataFormatJSON:
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("%s contains invalid JSON: %v", path, err)
+		}
+	default:
+		metadata = map[string]interface{}{
+			"content": strings.TrimRight(string(data), "\r\n"),
+		}
+	}
+	g.fileMetadata = metadata
+	g.fileModTime = fi.ModTime()
+	g.fileSize = fi.Size()
+	return metadata, nil
+}
@@ -0,0 +1,101 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestMetadataGeneratorFetchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-metadata-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "REVISION")
+
+	tests := []struct {
+		format   string
+		content  string
+		metadata interface{}
+		err      bool
+	}{
+		{
+			format:   config.MetadataFormatText,
+			content:  "0123abcd\n",
+			metadata: map[string]interface{}{"content": "0123abcd"},
+		},
+		{
+			format:   config.MetadataFormatJSON,
+			content:  `{"revision": "0123abcd", "deployed": [1, 2]}`,
+			metadata: map[string]interface{}{"revision": "0123abcd", "deployed": []interface{}{1.0, 2.0}},
+		},
+		{
+			format:  config.MetadataFormatJSON,
+			content: `revision`,
+			err:     true,
+		},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		g := Generator{
+			Config: &config.MetadataPlugin{Type: config.MetadataTypeFile, File: path, Format: test.format},
+		}
+		metadata, err := g.Fetch()
+		if err != nil {
+			if !test.err {
+				t.Errorf("error occurred unexpectedly on %q: %s", test.content, err)
+			}
+			continue
+		}
+		if test.err {
+			t.Errorf("error did not occur but error expected on %q", test.content)
+		}
+		if !reflect.DeepEqual(metadata, test.metadata) {
+			t.Errorf("metadata should be %#v but got %#v", test.metadata, metadata)
+		}
+	}
+}
+
+func TestMetadataGeneratorFetchFile_Changed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-metadata-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "REVISION")
+
+	g := Generator{
+		Config: &config.MetadataPlugin{Type: config.MetadataTypeFile, File: path, Format: config.MetadataFormatText},
+	}
+	if _, err := g.Fetch(); err != ErrNoMetadata {
+		t.Errorf("ErrNoMetadata should be returned when the file is missing but got %v", err)
+	}
+
+	modTime := time.Now().Add(-time.Hour)
+	for _, revision := range []string{"rev1", "rev2"} {
+		if err := ioutil.WriteFile(path, []byte(revision), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// keep the modification time to test that the size is also compared
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := g.Fetch()
+		if err != nil {
+			t.Fatalf("error occurred unexpectedly: %s", err)
+		}
+		expected := map[string]interface{}{"content": revision}
+		if !reflect.DeepEqual(metadata, expected) {
+			t.Errorf("metadata should be %#v but got %#v", expected, metadata)
+		}
+		modTime = modTime.Add(time.Minute)
+	}
+}
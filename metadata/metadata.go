@@ -7,13 +7,16 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/pluginstderr"
+	"github.com/mackerelio/mackerel-agent/util"
 )
 
-var logger = logging.GetLogger("metadata")
+var logger = logformat.GetLogger("metadata")
 
 // Generator generates metadata
 type Generator struct {
@@ -21,21 +24,64 @@ type Generator struct {
 	Config       *config.MetadataPlugin
 	Cachefile    string
 	PrevMetadata interface{}
+
+	// for the built-in packages metadata
+	packages            *Packages
+	packagesModTime     time.Time
+	packagesCollectedAt time.Time
+
+	// for the built-in file metadata
+	fileMetadata interface{}
+	fileModTime  time.Time
+	fileSize     int64
+
+	failures   int
+	lastStderr string
 }
 
 // Fetch invokes the command and returns the result
 func (g *Generator) Fetch() (interface{}, error) {
+	metadata, err := g.fetch()
+	switch err {
+	case nil:
+		g.failures = 0
+	case ErrNoMetadata:
+	default:
+		g.failures++
+	}
+	return metadata, err
+}
+
+// ConsecutiveFailures returns the number of the consecutive failures of Fetch.
+// It is reset when Fetch succeeds.
+func (g *Generator) ConsecutiveFailures() int {
+	return g.failures
+}
+
+// LastStderr returns the stderr of the last execution of the command.
+func (g *Generator) LastStderr() string {
+	return g.lastStderr
+}
+
+func (g *Generator) fetch() (interface{}, error) {
+	switch g.Config.Type {
+	case config.MetadataTypePackages:
+		return g.fetchPackages()
+	case config.MetadataTypeFile:
+		return g.fetchFile()
+	case config.MetadataTypeWindowsServices:
+		return g.fetchWindowsServices()
+	}
 	message, stderr, exitCode, err := g.Config.Command.Run()
+	g.lastStderr = stderr
 
 	if err != nil {
 		logger.Warningf("Error occurred while executing a metadata plugin %q: %v", g.Name, err)
 		return nil, err
 	}
 
-	if stderr != "" {
-		logger.Warningf("metadata plugin %q outputs stderr: %s", g.Name, stderr)
-		// metadata plugin can output message to stderr for debugging and json to stdout
-	}
+	// metadata plugin can output message to stderr for debugging and json to stdout
+	pluginstderr.Log(logger, (*logformat.Logger).Warningf, "metadata."+g.Name, stderr)
 
 	if exitCode != 0 {
 		return nil, fmt.Errorf("exits with: %d", exitCode)
@@ -82,10 +128,7 @@ func (g *Generator) Save(metadata interface{}) error {
 	if g.Cachefile == "" {
 		return fmt.Errorf("specify the name of the metadata cache file")
 	}
-	if err := os.MkdirAll(filepath.Dir(g.Cachefile), 0755); err != nil {
-		return err
-	}
-	if err := writeFileAtomically(g.Cachefile, data); err != nil {
+	if err := util.WriteFileAtomically(g.Cachefile, data, 0600); err != nil {
 		return fmt.Errorf("failed to write the metadata to the cache file: %v", err)
 	}
 	return nil
@@ -97,34 +140,42 @@ func (g *Generator) Clear() error {
 	return os.Remove(g.Cachefile)
 }
 
-// writeFileAtomically writes contents to the file atomically
-func writeFileAtomically(f string, contents []byte) error {
-	// MUST be located on same disk partition
-	tmpf, err := ioutil.TempFile(filepath.Dir(f), "tmp")
+func (g *Generator) executedAtFile() string {
+	return g.Cachefile + ".executed_at"
+}
+
+// LastExecutedAt returns the time when the command was executed successfully
+// last time, even before the agent restarted. It returns the zero time if the
+// time is unknown or the metadata cache has been cleared, since the metadata
+// may not have been posted in these cases.
+func (g *Generator) LastExecutedAt() time.Time {
+	if _, err := os.Stat(g.Cachefile); err != nil {
+		return time.Time{}
+	}
+	data, err := ioutil.ReadFile(g.executedAtFile())
 	if err != nil {
-		return err
+		return time.Time{}
 	}
-	// os.Remove here works successfully when tmpf.Write fails or os.Rename fails.
-	// In successful case, os.Remove fails because the temporary file is already renamed.
-	defer os.Remove(tmpf.Name())
-	_, err = tmpf.Write(contents)
-	tmpf.Close() // should be called before rename
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
 	if err != nil {
-		return err
+		logger.Warningf("metadata plugin %q detected an invalid execution time: %s", g.Name, string(data))
+		return time.Time{}
 	}
-	return os.Rename(tmpf.Name(), f)
+	return t
 }
 
-const defaultExecutionInterval = 10 * time.Minute
+// SaveExecutedAt stores the time when the command was executed.
+func (g *Generator) SaveExecutedAt(t time.Time) error {
+	if g.Cachefile == "" {
+		return fmt.Errorf("specify the name of the metadata cache file")
+	}
+	if err := os.MkdirAll(filepath.Dir(g.Cachefile), 0755); err != nil {
+		return err
+	}
+	return util.WriteFileAtomically(g.executedAtFile(), []byte(t.Format(time.RFC3339)), 0600)
+}
 
 // Interval calculates the time interval of command execution
 func (g *Generator) Interval() time.Duration {
-	if g.Config.ExecutionInterval == nil {
-		return defaultExecutionInterval
-	}
-	interval := time.Duration(*g.Config.ExecutionInterval) * time.Minute
-	if interval < defaultExecutionInterval {
-		return defaultExecutionInterval
-	}
-	return interval
+	return g.Config.Interval()
 }
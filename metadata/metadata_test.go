@@ -2,7 +2,9 @@ package metadata
 
 import (
 	"encoding/json"
+	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"testing"
 	"time"
@@ -90,6 +92,55 @@ func TestMetadataGeneratorFetch(t *testing.T) {
 	}
 }
 
+func TestMetadataGeneratorConsecutiveFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are written for sh")
+	}
+	failure := config.Command{Cmd: "echo failed >&2; exit 1"}
+	success := config.Command{Cmd: "echo {}"}
+	g := Generator{Config: &config.MetadataPlugin{}}
+
+	for i, test := range []struct {
+		command  config.Command
+		failures int
+		stderr   string
+	}{
+		{command: failure, failures: 1, stderr: "failed\n"},
+		{command: failure, failures: 2, stderr: "failed\n"},
+		{command: success, failures: 0, stderr: ""},
+		{command: failure, failures: 1, stderr: "failed\n"},
+	} {
+		g.Config.Command = test.command
+		g.Fetch()
+		if got := g.ConsecutiveFailures(); got != test.failures {
+			t.Errorf("#%d: ConsecutiveFailures() should be %d but got %d", i, test.failures, got)
+		}
+		if got := g.LastStderr(); got != test.stderr {
+			t.Errorf("#%d: LastStderr() should be %q but got %q", i, test.stderr, got)
+		}
+	}
+}
+
+func TestMetadataGeneratorFetchTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command is written for sh")
+	}
+	cmd := config.Command{Cmd: "sleep 10; echo {}"}
+	cmd.TimeoutDuration = 100 * time.Millisecond
+	g := Generator{Config: &config.MetadataPlugin{Command: cmd}}
+
+	start := time.Now()
+	if _, err := g.Fetch(); err == nil {
+		t.Error("error should occur when the command timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the command should be killed on timeout but took %s", elapsed)
+	}
+	if g.ConsecutiveFailures() != 1 {
+		t.Errorf("timeout should be counted as a failure")
+	}
+}
+
 func TestMetadataGeneratorSaveIsChanged(t *testing.T) {
 	tests := []struct {
 		prevmetadata string
@@ -143,6 +194,37 @@ func TestMetadataGeneratorSaveIsChanged(t *testing.T) {
 	}
 }
 
+func TestMetadataGeneratorLastExecutedAt(t *testing.T) {
+	g := Generator{Cachefile: filepath.Join("testdata", ".mackerel-metadata-test-executed-at")}
+	defer os.Remove(g.executedAtFile())
+
+	if got := g.LastExecutedAt(); !got.IsZero() {
+		t.Errorf("LastExecutedAt() should return zero time initially but got %s", got)
+	}
+
+	executedAt := time.Now().Truncate(time.Second)
+	if err := g.SaveExecutedAt(executedAt); err != nil {
+		t.Errorf("Error should not occur in SaveExecutedAt() but got: %s", err.Error())
+	}
+	if got := g.LastExecutedAt(); !got.IsZero() {
+		t.Errorf("LastExecutedAt() should return zero time without the metadata cache but got %s", got)
+	}
+
+	if err := g.Save(map[string]interface{}{}); err != nil {
+		t.Errorf("Error should not occur in Save() but got: %s", err.Error())
+	}
+	if got := g.LastExecutedAt(); !got.Equal(executedAt) {
+		t.Errorf("LastExecutedAt() should return %s but got %s", executedAt, got)
+	}
+
+	if err := g.Clear(); err != nil {
+		t.Errorf("Error should not occur in Clear() but got: %s", err.Error())
+	}
+	if got := g.LastExecutedAt(); !got.IsZero() {
+		t.Errorf("LastExecutedAt() should return zero time after clearing the cache but got %s", got)
+	}
+}
+
 func TestMetadataGeneratorInterval(t *testing.T) {
 	tests := []struct {
 		interval *int32
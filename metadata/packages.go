@@ -0,0 +1,94 @@
+package metadata
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SizeLimit is the limit of the size of metadata per namespace accepted by Mackerel.
+const SizeLimit = 100 * 1024
+
+// packagesRefreshInterval is the interval to collect the packages
+// even though the package database seems not to be changed.
+const packagesRefreshInterval = 24 * time.Hour
+
+// Package represents an installed package.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Packages represents the metadata of the installed packages.
+// Omitted is the number of the packages omitted to keep the metadata under SizeLimit.
+type Packages struct {
+	Packages []Package `json:"packages"`
+	Omitted  int       `json:"omitted,omitempty"`
+}
+
+// fetchPackages collects the installed packages. The collection is skipped
+// and the previous result is returned if the package database has not been
+// modified and packagesRefreshInterval has not elapsed since the last collection.
+func (g *Generator) fetchPackages() (interface{}, error) {
+	modTime := packageDatabaseModTime()
+	if g.packages != nil && modTime.Equal(g.packagesModTime) &&
+		time.Since(g.packagesCollectedAt) < packagesRefreshInterval {
+		return g.packages, nil
+	}
+	pkgs, err := collectPackages()
+	if err != nil {
+		return nil, err
+	}
+	g.packages = limitPackages(pkgs, SizeLimit)
+	g.packagesModTime = modTime
+	g.packagesCollectedAt = time.Now()
+	return g.packages, nil
+}
+
+// limitPackages sorts the packages and drops the last ones
+// so that the serialized metadata does not exceed the limit.
+func limitPackages(pkgs []Package, limit int) *Packages {
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Version < pkgs[j].Version
+	})
+	// reserve the size for the enclosing object and the count of the omitted packages
+	size := len(`{"packages":[],"omitted":}`) + 20
+	for i, p := range pkgs {
+		b, _ := json.Marshal(p)
+		size += len(b) + 1 // a comma
+		if size > limit {
+			return &Packages{Packages: pkgs[:i], Omitted: len(pkgs) - i}
+		}
+	}
+	return &Packages{Packages: pkgs}
+}
+
+// parsePackages parses the lines of tab separated names and versions.
+func parsePackages(out string) []Package {
+	pkgs := []Package{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(strings.TrimRight(line, "\r"), "\t", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: fields[0], Version: fields[1]})
+	}
+	return pkgs
+}
+
+// parseDpkgPackages parses the output of dpkg-query with the format
+// "${db:Status-Abbrev}\t${binary:Package}\t${Version}\n" and
+// returns the installed packages.
+func parseDpkgPackages(out string) []Package {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.SplitN(line, "\t", 2); len(fields) == 2 && strings.HasPrefix(fields[0], "ii") {
+			lines = append(lines, fields[1])
+		}
+	}
+	return parsePackages(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDpkgPackages(t *testing.T) {
+	out := "ii \tbash\t5.0-4\n" +
+		"rc \tremoved\t1.0\n" +
+		"ii \tlibc6:amd64\t2.28-10\n" +
+		"\n"
+	expected := []Package{
+		{Name: "bash", Version: "5.0-4"},
+		{Name: "libc6:amd64", Version: "2.28-10"},
+	}
+	if got := parseDpkgPackages(out); !reflect.DeepEqual(got, expected) {
+		t.Errorf("packages should be %+v but got %+v", expected, got)
+	}
+}
+
+func TestParsePackages(t *testing.T) {
+	out := "bash\t4.2.46-34.el7\n" +
+		"kernel\t3.10.0-1062.el7\n" +
+		"invalid line\n"
+	expected := []Package{
+		{Name: "bash", Version: "4.2.46-34.el7"},
+		{Name: "kernel", Version: "3.10.0-1062.el7"},
+	}
+	if got := parsePackages(out); !reflect.DeepEqual(got, expected) {
+		t.Errorf("packages should be %+v but got %+v", expected, got)
+	}
+}
+
+func TestLimitPackages(t *testing.T) {
+	pkgs := []Package{
+		{Name: "zsh", Version: "5.7"},
+		{Name: "kernel", Version: "3.10.0-957"},
+		{Name: "kernel", Version: "3.10.0-1062"},
+		{Name: "bash", Version: "5.0"},
+	}
+	got := limitPackages(pkgs, SizeLimit)
+	expected := &Packages{Packages: []Package{
+		{Name: "bash", Version: "5.0"},
+		{Name: "kernel", Version: "3.10.0-1062"},
+		{Name: "kernel", Version: "3.10.0-957"},
+		{Name: "zsh", Version: "5.7"},
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("packages should be %+v but got %+v", expected, got)
+	}
+
+	var many []Package
+	for i := 0; i < 5000; i++ {
+		many = append(many, Package{Name: "package-" + strings.Repeat("x", 10) + string(rune('a'+i%26)), Version: "1.0.0"})
+	}
+	got = limitPackages(many, SizeLimit)
+	if got.Omitted == 0 || len(got.Packages)+got.Omitted != len(many) {
+		t.Errorf("packages should be omitted: %d packages, %d omitted", len(got.Packages), got.Omitted)
+	}
+	data, _ := json.Marshal(got)
+	if len(data) > SizeLimit {
+		t.Errorf("the size of the metadata should not exceed %d but %d", SizeLimit, len(data))
+	}
+}
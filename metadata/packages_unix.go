@@ -0,0 +1,60 @@
+// +build !windows
+
+package metadata
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/cmdutil"
+)
+
+const packagesCommandTimeout = 1 * time.Minute
+
+// files which are modified when packages are installed or removed
+var packageDatabaseFiles = []string{
+	"/var/lib/dpkg/status",
+	"/var/lib/rpm/Packages",
+	"/var/lib/rpm/rpmdb.sqlite",
+}
+
+func packageDatabaseModTime() time.Time {
+	var modTime time.Time
+	for _, f := range packageDatabaseFiles {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime
+}
+
+func collectPackages() ([]Package, error) {
+	if _, err := exec.LookPath("dpkg-query"); err == nil {
+		out, err := runPackagesCommand("dpkg-query", "-W", "-f", "${db:Status-Abbrev}\t${binary:Package}\t${Version}\n")
+		if err != nil {
+			return nil, err
+		}
+		return parseDpkgPackages(out), nil
+	}
+	if _, err := exec.LookPath("rpm"); err == nil {
+		out, err := runPackagesCommand("rpm", "-qa", "--queryformat", "%{NAME}\t%{VERSION}-%{RELEASE}\n")
+		if err != nil {
+			return nil, err
+		}
+		return parsePackages(out), nil
+	}
+	return nil, fmt.Errorf("neither dpkg-query nor rpm is found")
+}
+
+func runPackagesCommand(args ...string) (string, error) {
+	stdout, stderr, exitCode, err := cmdutil.RunCommandArgs(args, cmdutil.CommandOption{TimeoutDuration: packagesCommandTimeout})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute %s: %s", args[0], err)
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("%s exits with %d: %s", args[0], exitCode, stderr)
+	}
+	return stdout, nil
+}
@@ -0,0 +1,67 @@
+// +build windows
+
+package metadata
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+var uninstallKeys = []string{
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`,
+	`SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+}
+
+func packageDatabaseModTime() time.Time {
+	var modTime time.Time
+	for _, path := range uninstallKeys {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		if info, err := k.Stat(); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		k.Close()
+	}
+	return modTime
+}
+
+func collectPackages() ([]Package, error) {
+	pkgs := []Package{}
+	for i, path := range uninstallKeys {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			if i > 0 { // WOW6432Node does not exist on 32-bit Windows
+				continue
+			}
+			return nil, err
+		}
+		names, err := k.ReadSubKeyNames(-1)
+		k.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if p, ok := readUninstallKey(path + `\` + name); ok {
+				pkgs = append(pkgs, p)
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+func readUninstallKey(path string) (Package, bool) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return Package{}, false
+	}
+	defer k.Close()
+	name, _, err := k.GetStringValue("DisplayName")
+	if err != nil || name == "" {
+		return Package{}, false
+	}
+	version, _, _ := k.GetStringValue("DisplayVersion")
+	return Package{Name: name, Version: version}, true
+}
@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+)
+
+// WindowsService represents a Windows service.
+type WindowsService struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	StartType   string `json:"startType"`
+	State       string `json:"state"`
+}
+
+// WindowsServices represents the metadata of the Windows services.
+// Omitted is the number of the services omitted to keep the metadata under SizeLimit.
+type WindowsServices struct {
+	Services []WindowsService `json:"services"`
+	Omitted  int              `json:"omitted,omitempty"`
+}
+
+// fetchWindowsServices collects the services whose names match the patterns
+// of the configuration.
+func (g *Generator) fetchWindowsServices() (interface{}, error) {
+	services, err := collectWindowsServices()
+	if err != nil {
+		return nil, err
+	}
+	services = filterWindowsServices(services, g.Config.IncludePattern, g.Config.ExcludePattern)
+	return limitWindowsServices(services, SizeLimit), nil
+}
+
+// filterWindowsServices returns the services whose names match include
+// and do not match exclude. The nil patterns are ignored.
+func filterWindowsServices(services []WindowsService, include, exclude *regexp.Regexp) []WindowsService {
+	filtered := []WindowsService{}
+	for _, s := range services {
+		if include != nil && !include.MatchString(s.Name) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(s.Name) {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered
+}
+
+// limitWindowsServices sorts the services and drops the last ones
+// so that the serialized metadata does not exceed the limit.
+func limitWindowsServices(services []WindowsService, limit int) *WindowsServices {
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	// reserve the size for the enclosing object and the count of the omitted services
+	size := len(`{"services":[],"omitted":}`) + 20
+	for i, s := range services {
+		b, _ := json.Marshal(s)
+		size += len(b) + 1 // a comma
+		if size > limit {
+			return &WindowsServices{Services: services[:i], Omitted: len(services) - i}
+		}
+	}
+	return &WindowsServices{Services: services}
+}
@@ -0,0 +1,13 @@
+// +build !windows
+
+package metadata
+
+import (
+	"fmt"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func collectWindowsServices() ([]WindowsService, error) {
+	return nil, fmt.Errorf("the metadata type %q is supported only on Windows", config.MetadataTypeWindowsServices)
+}
@@ -0,0 +1,45 @@
+package metadata
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestFilterWindowsServices(t *testing.T) {
+	services := []WindowsService{
+		{Name: "wuauserv", DisplayName: "Windows Update", StartType: "manual", State: "stopped"},
+		{Name: "Dnscache", DisplayName: "DNS Client", StartType: "auto", State: "running"},
+		{Name: "gupdate", DisplayName: "Google Update Service (gupdate)", StartType: "auto", State: "stopped"},
+	}
+	got := limitWindowsServices(filterWindowsServices(services, nil, regexp.MustCompile(`^gupdate`)), SizeLimit)
+	expected := &WindowsServices{Services: []WindowsService{
+		{Name: "Dnscache", DisplayName: "DNS Client", StartType: "auto", State: "running"},
+		{Name: "wuauserv", DisplayName: "Windows Update", StartType: "manual", State: "stopped"},
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("services should be %+v but got %+v", expected, got)
+	}
+
+	got = limitWindowsServices(filterWindowsServices(services, regexp.MustCompile(`^w`), nil), SizeLimit)
+	if len(got.Services) != 1 || got.Services[0].Name != "wuauserv" {
+		t.Errorf("only the included services should be kept: %+v", got)
+	}
+}
+
+func TestLimitWindowsServices(t *testing.T) {
+	var many []WindowsService
+	for i := 0; i < 5000; i++ {
+		many = append(many, WindowsService{Name: "service" + strconv.Itoa(i), DisplayName: "Service " + strconv.Itoa(i), StartType: "manual", State: "stopped"})
+	}
+	got := limitWindowsServices(many, SizeLimit)
+	if got.Omitted == 0 || len(got.Services)+got.Omitted != len(many) {
+		t.Errorf("services should be omitted: %d services, %d omitted", len(got.Services), got.Omitted)
+	}
+	data, _ := json.Marshal(got)
+	if len(data) > SizeLimit {
+		t.Errorf("the size of the metadata should not exceed %d but %d", SizeLimit, len(data))
+	}
+}
@@ -0,0 +1,19 @@
+// +build windows
+
+package metadata
+
+import (
+	"github.com/mackerelio/mackerel-agent/util/windows"
+)
+
+func collectWindowsServices() ([]WindowsService, error) {
+	ss, err := windows.CollectServices()
+	if err != nil {
+		return nil, err
+	}
+	services := make([]WindowsService, len(ss))
+	for i, s := range ss {
+		services[i] = WindowsService(s)
+	}
+	return services, nil
+}
@@ -0,0 +1,20 @@
+package metrics
+
+import "sync/atomic"
+
+var clockGaps uint64
+
+// NoteClockGap notes the gap of the clock detected by the scheduler, such as
+// by the suspend of the host or the live migration of the VM. The samples of
+// the counters taken before it are not used to calculate the deltas and the
+// rates, which are garbage across the gap, and the generators re-baseline
+// with the next samples.
+func NoteClockGap() {
+	atomic.AddUint64(&clockGaps, 1)
+}
+
+// clockEpoch returns the number of the gaps of the clock noted so far. The
+// samples of the different epochs are separated by a gap.
+func clockEpoch() uint64 {
+	return atomic.LoadUint64(&clockGaps)
+}
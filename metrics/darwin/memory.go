@@ -4,7 +4,7 @@ package darwin
 
 import (
 	"github.com/mackerelio/go-osstat/memory"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
@@ -20,7 +20,7 @@ graph: stacks `memory.{metric}`
 type MemoryGenerator struct {
 }
 
-var memoryLogger = logging.GetLogger("metrics.memory")
+var memoryLogger = logformat.GetLogger("metrics.memory")
 
 // Generate generate metrics values
 func (g *MemoryGenerator) Generate() (metrics.Values, error) {
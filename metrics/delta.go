@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var deltaLogger = logformat.GetLogger("metrics.delta")
+
+// CounterSample is the values of the cumulative counters read at a time, such
+// as the bytes of the interfaces, to compute the deltas between the phases.
+type CounterSample struct {
+	Values map[string]float64
+	// At is the wall clock time without the monotonic clock reading, so that
+	// the steps of the clock are detected.
+	At time.Time
+	// epoch is the clockEpoch when the values are read.
+	epoch uint64
+}
+
+// NewCounterSample creates a CounterSample of the values read at at.
+func NewCounterSample(values map[string]float64, at time.Time) *CounterSample {
+	return &CounterSample{Values: values, At: at.Round(0), epoch: clockEpoch()}
+}
+
+// CounterDeltas returns the increases of the counters in both prev and curr.
+// It returns an error if the clock goes backwards between them, such as
+// stepped by NTP or the live migration of the VM, or if a gap of the clock is
+// noted between them by NoteClockGap, such as by the suspend of the host,
+// since the deltas are garbage then. The callers drop the values of the cycle,
+// and the next cycle starts with the new samples.
+//
+// The counters decreased, such as reset by the migration or the reattachment
+// of the device, are omitted from the deltas, so that the other devices are
+// not dropped together. By config.CounterWrapAuto, a decreased counter is
+// assumed to be wrapped around instead if the delta across the wrap is
+// plausible, see counterWrap.
+func CounterDeltas(prev, curr *CounterSample, wrap config.CounterWrap) (map[string]float64, error) {
+	if curr.At.Before(prev.At) {
+		return nil, fmt.Errorf("the clock went backwards by %s", prev.At.Sub(curr.At))
+	}
+	if curr.epoch != prev.epoch {
+		return nil, fmt.Errorf("the host was suspended or the clock jumped between the samples")
+	}
+	deltas := make(map[string]float64, len(prev.Values))
+	for name, value := range prev.Values {
+		currValue, ok := curr.Values[name]
+		if !ok {
+			continue
+		}
+		if currValue < value {
+			if wrap == config.CounterWrapAuto {
+				if delta, bits, ok := counterWrap(value, currValue); ok {
+					deltaLogger.Debugf("%s (%.0f -> %.0f): assumed to be a %d-bit counter wrapped around", name, value, currValue, bits)
+					deltas[name] = delta
+					continue
+				}
+			}
+			if currValue == 0 {
+				deltaLogger.Debugf("%s (%.0f -> 0): assumed to be reset, and skipped in this cycle", name, value)
+			} else {
+				deltaLogger.Debugf("%s (%.0f -> %.0f): decreased, and skipped in this cycle", name, value, currValue)
+			}
+			continue
+		}
+		deltas[name] = currValue - value
+	}
+	return deltas, nil
+}
+
+// counterWrap returns the delta of the counter decreased from prev to curr on
+// the assumption that it wrapped around, with the bits of the counter guessed
+// by the magnitude of prev. The wrap is assumed only if the delta is less than
+// the half of the range, that is, prev was near the maximum, since a wider
+// counter reset to zero, or decreased genuinely, shows a larger one. The
+// counter decreased to zero is always assumed to be reset, since a 32-bit
+// counter above 2^31 reset to zero would look wrapped around otherwise.
+func counterWrap(prev, curr float64) (float64, int, bool) {
+	bits := 32
+	if prev > math.MaxUint32 {
+		bits = 64
+	}
+	if curr == 0 {
+		return 0, bits, false
+	}
+	// 2^bits, which is exact in float64
+	max := math.Ldexp(1, bits)
+	delta := max - prev + curr
+	if delta <= 0 || delta >= max/2 {
+		return 0, bits, false
+	}
+	return delta, bits, true
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestCounterDeltas(t *testing.T) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := NewCounterSample(map[string]float64{"a": 10, "b": 20, "c": 30}, at)
+
+	tests := []struct {
+		name   string
+		curr   *CounterSample
+		expect map[string]float64
+	}{
+		{
+			name:   "increased",
+			curr:   NewCounterSample(map[string]float64{"a": 15, "b": 20, "d": 1}, at.Add(time.Second)),
+			expect: map[string]float64{"a": 5, "b": 0},
+		},
+		{
+			name: "clock went backwards",
+			curr: NewCounterSample(map[string]float64{"a": 15, "b": 25, "c": 35}, at.Add(-time.Second)),
+		},
+		{
+			name:   "counter went backwards",
+			curr:   NewCounterSample(map[string]float64{"a": 15, "b": 19, "c": 35}, at.Add(time.Second)),
+			expect: map[string]float64{"a": 5, "c": 5},
+		},
+	}
+	for _, tc := range tests {
+		deltas, err := CounterDeltas(prev, tc.curr, config.CounterWrapAuto)
+		if tc.expect == nil {
+			if err == nil {
+				t.Errorf("%s: should raise error, but got %v", tc.name, deltas)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: should not raise error: %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(deltas, tc.expect) {
+			t.Errorf("%s: should be %v, but got %v", tc.name, tc.expect, deltas)
+		}
+	}
+}
+
+func TestCounterDeltas_clockGap(t *testing.T) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := NewCounterSample(map[string]float64{"a": 10}, at)
+	NoteClockGap()
+	curr := NewCounterSample(map[string]float64{"a": 15}, at.Add(time.Second))
+	if deltas, err := CounterDeltas(prev, curr, config.CounterWrapAuto); err == nil {
+		t.Errorf("should raise error across the gap of the clock, but got %v", deltas)
+	}
+	next := NewCounterSample(map[string]float64{"a": 20}, at.Add(2*time.Second))
+	if deltas, err := CounterDeltas(curr, next, config.CounterWrapAuto); err != nil || deltas["a"] != 5 {
+		t.Errorf("the deltas should be calculated after the gap: %v, %v", deltas, err)
+	}
+}
+
+func TestCounterDeltas_wrap(t *testing.T) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		prev   float64
+		curr   float64
+		wrap   config.CounterWrap
+		expect float64 // -1 if the counter is skipped
+	}{
+		{"32-bit wrap", math.MaxUint32 - 9, 20, config.CounterWrapAuto, 30},
+		{"64-bit wrap", math.MaxUint64 - 4096, 4096, config.CounterWrapAuto, 8192},
+		{"wrap skipped", math.MaxUint32 - 9, 20, config.CounterWrapDrop, -1},
+		{"reset to zero", 1000, 0, config.CounterWrapAuto, -1},
+		{"reset of 32-bit counter above 2^31", math.MaxUint32 - 1000, 0, config.CounterWrapAuto, -1},
+		{"reset of 64-bit counter", math.MaxUint32 + 1000, 0, config.CounterWrapAuto, -1},
+		{"genuine decrease", 3000000000, 2900000000, config.CounterWrapAuto, -1},
+	}
+	for _, tc := range tests {
+		prev := NewCounterSample(map[string]float64{"a": tc.prev}, at)
+		curr := NewCounterSample(map[string]float64{"a": tc.curr}, at.Add(time.Minute))
+		deltas, err := CounterDeltas(prev, curr, tc.wrap)
+		if err != nil {
+			t.Errorf("%s: should not raise error: %s", tc.name, err)
+			continue
+		}
+		if tc.expect < 0 {
+			if d, ok := deltas["a"]; ok {
+				t.Errorf("%s: the counter should be skipped, but got %v", tc.name, d)
+			}
+			continue
+		}
+		if deltas["a"] != tc.expect {
+			t.Errorf("%s: should be %v, but got %v", tc.name, tc.expect, deltas["a"])
+		}
+	}
+}
+
+func TestNewCounterSample(t *testing.T) {
+	// the monotonic clock reading hides the steps of the wall clock
+	s := NewCounterSample(nil, time.Now())
+	if s.At != s.At.Round(0) {
+		t.Errorf("the monotonic clock reading should be stripped: %v", s.At)
+	}
+}
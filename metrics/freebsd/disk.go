@@ -0,0 +1,178 @@
+// +build freebsd
+
+package freebsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
+	"golang.org/x/sys/unix"
+)
+
+/*
+collect disk I/O
+
+`disk.{device}.{metric}.delta`: The increased amount of disk I/O per minute retrieved from the devstat
+statistics of the GEOM disks (sysctl kern.devstat.all), which are the same as the ones of Linux
+
+device = "ada0", "da0", "nvd0" and so on...
+
+metric = "reads", "writes"
+
+graph: `disk.{device}.{metric}.delta`
+*/
+
+// DiskGenerator XXX
+type DiskGenerator struct {
+	Interval      time.Duration
+	UseMountpoint bool
+	// CounterWrap is how to treat the counters decreased.
+	CounterWrap config.CounterWrap
+}
+
+var diskLogger = logformat.GetLogger("metrics.disk")
+
+// devstatLayout is the layout of struct devstat in <sys/devicestat.h> by the
+// architectures, which are followed by the generation number in kern.devstat.all.
+type devstatLayout struct {
+	header     int
+	size       int
+	name       int
+	unit       int
+	operations int
+	deviceType int
+}
+
+var devstatLayouts = map[string]devstatLayout{
+	// time_t is 32-bit only on i386
+	"386":   {header: 4, size: 0xf0, name: 36, unit: 52, operations: 88, deviceType: 224},
+	"arm":   {header: 4, size: 0x118, name: 40, unit: 56, operations: 96, deviceType: 260},
+	"amd64": {header: 8, size: 0x120, name: 44, unit: 60, operations: 96, deviceType: 260},
+}
+
+const (
+	devstatNameLen  = 16
+	devstatRead     = 1
+	devstatWrite    = 2
+	devstatTypePass = 0x100
+)
+
+func init() {
+	// the other little-endian 64-bit architectures share the layout of amd64
+	for _, arch := range []string{"arm64", "riscv64"} {
+		devstatLayouts[arch] = devstatLayouts["amd64"]
+	}
+}
+
+// Generate XXX
+func (g *DiskGenerator) Generate() (metrics.Values, error) {
+	prevValues, err := g.collectDevstatValues()
+	if err != nil {
+		return nil, err
+	}
+
+	time.Sleep(g.Interval)
+
+	currValues, err := g.collectDevstatValues()
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, err := metrics.CounterDeltas(prevValues, currValues, g.CounterWrap)
+	if err != nil {
+		diskLogger.Warningf("Dropped the disk metrics of this cycle: %s", err)
+		return metrics.Values{}, nil
+	}
+	ret := make(map[string]float64, len(deltas))
+	for name, delta := range deltas {
+		ret[name+".delta"] = delta / g.Interval.Seconds()
+	}
+
+	return metrics.Values(ret), nil
+}
+
+func (g *DiskGenerator) collectDevstatValues() (*metrics.CounterSample, error) {
+	layout, ok := devstatLayouts[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("the disk metrics are not supported on %s", runtime.GOARCH)
+	}
+	buf, err := unix.SysctlRaw("kern.devstat.all")
+	at := time.Now()
+	if err != nil {
+		diskLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+
+	var nameMapping map[string]string
+	if g.UseMountpoint {
+		nameMapping, err = getDeviceNameMapping()
+		if err != nil {
+			diskLogger.Warningf("Failed to prepare device name mapping: %s", err)
+		}
+	}
+	values, err := parseDevstats(buf, layout, nameMapping)
+	if err != nil {
+		diskLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+	return metrics.NewCounterSample(values, at), nil
+}
+
+// parseDevstats parses kern.devstat.all into the counters of the reads and
+// the writes of the disks. The pass-through devices and the devices without
+// any I/O are skipped as Linux.
+func parseDevstats(buf []byte, l devstatLayout, mapping map[string]string) (metrics.Values, error) {
+	if len(buf) < l.header || (len(buf)-l.header)%l.size != 0 {
+		return nil, fmt.Errorf("unexpected size of kern.devstat.all: %d bytes", len(buf))
+	}
+	results := make(map[string]float64)
+	for b := buf[l.header:]; len(b) >= l.size; b = b[l.size:] {
+		if binary.LittleEndian.Uint32(b[l.deviceType:])&devstatTypePass != 0 {
+			continue
+		}
+		name := b[l.name : l.name+devstatNameLen]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		unit := int32(binary.LittleEndian.Uint32(b[l.unit:]))
+		device := string(name) + strconv.Itoa(int(unit))
+
+		reads := binary.LittleEndian.Uint64(b[l.operations+8*devstatRead:])
+		writes := binary.LittleEndian.Uint64(b[l.operations+8*devstatWrite:])
+		if reads == 0 && writes == 0 {
+			continue
+		}
+		deviceLabel := util.SanitizeMetricKey(device)
+		if mountpoint, exists := mapping[device]; exists {
+			deviceLabel = util.SanitizeMetricKey(mountpoint)
+		}
+		results["disk."+deviceLabel+".reads"] = float64(reads)
+		results["disk."+deviceLabel+".writes"] = float64(writes)
+	}
+	return results, nil
+}
+
+// mapping from device name (like 'ada0') to mountpoint (like '/tmp')
+func getDeviceNameMapping() (map[string]string, error) {
+	filesystems, err := util.CollectDfValues()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]string{}
+	for _, dfs := range filesystems {
+		name := dfs.Name
+		if device := strings.TrimPrefix(name, "/dev/"); name != device {
+			ret[device] = dfs.Mounted
+		}
+	}
+	return ret, nil
+}
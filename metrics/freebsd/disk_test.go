@@ -0,0 +1,86 @@
+// +build freebsd
+
+package freebsd
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+func TestParseDevstats(t *testing.T) {
+	expected := metrics.Values{
+		"disk.ada0.reads":  1579018,
+		"disk.ada0.writes": 4147297,
+		"disk.nvd1.reads":  512,
+		"disk.nvd1.writes": 2048,
+	}
+	for _, arch := range []string{"amd64", "386"} {
+		buf, err := ioutil.ReadFile("testdata/kern.devstat.all." + arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := parseDevstats(buf, devstatLayouts[arch], nil)
+		if err != nil {
+			t.Errorf("should not raise error on %s: %v", arch, err)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("the disks should be parsed on %s: %v", arch, values)
+		}
+	}
+
+	buf, err := ioutil.ReadFile("testdata/kern.devstat.all.amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := parseDevstats(buf, devstatLayouts["amd64"], map[string]string{"ada0": "/"})
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if _, ok := values["disk._.reads"]; !ok {
+		t.Errorf("the device should be named by the mountpoint: %v", values)
+	}
+
+	if _, err := parseDevstats(buf[:len(buf)-1], devstatLayouts["amd64"], nil); err == nil {
+		t.Error("the truncated devstats should raise error")
+	}
+}
+
+func TestParseXswdev(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		// version 1
+		{"FreeBSD 11", []byte{
+			0x01, 0x00, 0x00, 0x00, 0x5a, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x08, 0x00, 0x00, 0x04, 0x00, 0x00,
+		}},
+		// version 2 on i386
+		{"FreeBSD 12 i386", []byte{
+			0x02, 0x00, 0x00, 0x00, 0x5a, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x04, 0x00, 0x00,
+		}},
+		// version 2 on amd64
+		{"FreeBSD 12 amd64", []byte{
+			0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5a, 0xff, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00,
+			0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}},
+	}
+	for _, tc := range tests {
+		nblks, used, err := parseXswdev(tc.buf)
+		if err != nil {
+			t.Errorf("should not raise error on %s: %v", tc.name, err)
+		}
+		if nblks != 524288 || used != 1024 {
+			t.Errorf("the swap should be parsed on %s: %d, %d", tc.name, nblks, used)
+		}
+	}
+
+	if _, _, err := parseXswdev(make([]byte, 16)); err == nil {
+		t.Error("the unknown xswdev should raise error")
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
@@ -17,7 +17,7 @@ import (
 type MemoryGenerator struct {
 }
 
-var memoryLogger = logging.GetLogger("metrics.memory")
+var memoryLogger = logformat.GetLogger("metrics.memory")
 
 // Generate generate metrics values
 func (g *MemoryGenerator) Generate() (metrics.Values, error) {
@@ -59,22 +59,14 @@ func (g *MemoryGenerator) Generate() (metrics.Values, error) {
 				}
 			}
 		}
-		if fields[0] == "Swap:" {
-			if v, err := getValue(fields[1]); err == nil {
-				ret["memory.swap_total"] = v
-			} else {
-				errRet = err
-			}
-			swapFreeIndex := 5
-			if len(fields) == 5 {
-				swapFreeIndex = 3
-			}
-			if v, err := getValue(fields[swapFreeIndex]); err == nil {
-				ret["memory.swap_free"] = v
-			} else {
-				errRet = err
-			}
-		}
+	}
+
+	if total, free, err := getSwap(); err == nil {
+		ret["memory.swap_total"] = total
+		ret["memory.swap_free"] = free
+	} else {
+		memoryLogger.Warningf("Failed to get the swap usage: %s", err)
+		errRet = err
 	}
 
 	v, err := getTotalMem()
@@ -0,0 +1,56 @@
+// +build freebsd
+
+package freebsd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// getSwap returns the total and the free bytes of the swap devices from the
+// sysctl vm.swap_info, which is the source of swapinfo(8).
+func getSwap() (float64, float64, error) {
+	n, err := unix.SysctlUint32("vm.nswapdev")
+	if err != nil {
+		return 0, 0, fmt.Errorf("sysctl vm.nswapdev: %s", err)
+	}
+	var total, used int64
+	for i := 0; i < int(n); i++ {
+		buf, err := unix.SysctlRaw("vm.swap_info", i)
+		if err != nil {
+			return 0, 0, fmt.Errorf("sysctl vm.swap_info.%d: %s", i, err)
+		}
+		nblks, nused, err := parseXswdev(buf)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += nblks
+		used += nused
+	}
+	pageSize := int64(os.Getpagesize())
+	return float64(total * pageSize), float64((total - used) * pageSize), nil
+}
+
+// parseXswdev returns the numbers of the pages and the used ones in struct
+// xswdev of <vm/vm_param.h>, whose layout is distinguished by the size:
+// version 1 with 32-bit dev_t before FreeBSD 12, and version 2 with 64-bit
+// dev_t aligned by 4 bytes on i386 or by 8 bytes on the others.
+func parseXswdev(buf []byte) (int64, int64, error) {
+	var offset int
+	switch len(buf) {
+	case 20:
+		offset = 12
+	case 24:
+		offset = 16
+	case 32:
+		offset = 20
+	default:
+		return 0, 0, fmt.Errorf("unexpected size of vm.swap_info: %d bytes", len(buf))
+	}
+	nblks := int32(binary.LittleEndian.Uint32(buf[offset:]))
+	used := int32(binary.LittleEndian.Uint32(buf[offset+4:]))
+	return int64(nblks), int64(used), nil
+}
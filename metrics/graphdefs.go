@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// systemGraphDefs are the graph definitions of the built-in metrics posted as
+// the custom metrics by no plugin generator, keyed by the names of the graphs
+// without "custom.". The metrics not collected on the platform are never
+// graphed.
+//
+// The system metrics such as cpu, memory and disk are not defined here, since
+// they are graphed by Mackerel itself and the graph definitions of the API
+// are only of the custom metrics, whose names start with the graph names.
+var systemGraphDefs = map[string]customGraphDef{
+	"windows.services": {
+		Label: "Windows Services",
+		Unit:  "integer",
+		Metrics: []customGraphMetricDef{
+			{Name: "auto_not_running", Label: "Automatic but Not Running"},
+		},
+	},
+}
+
+// SystemGraphDefs returns the graph definitions of the built-in metrics.
+func SystemGraphDefs() []*mkr.GraphDefsParam {
+	return makeGraphDefsParam(&pluginMeta{Graphs: systemGraphDefs})
+}
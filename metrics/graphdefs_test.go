@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSystemGraphDefs(t *testing.T) {
+	payloads := SystemGraphDefs()
+	if len(payloads) != len(systemGraphDefs) {
+		t.Fatalf("all the graphs should be defined: %d", len(payloads))
+	}
+	for _, p := range payloads {
+		// the graph definitions of the API are only of the custom metrics
+		if !strings.HasPrefix(p.Name, "custom.") {
+			t.Errorf("the graph name %s should start with custom.", p.Name)
+		}
+		if p.DisplayName == "" || p.Unit == "" || len(p.Metrics) == 0 {
+			t.Errorf("the graph %s should have the display name, the unit and the metrics: %+v", p.Name, p)
+		}
+		for _, m := range p.Metrics {
+			if !strings.HasPrefix(m.Name, p.Name+".") {
+				t.Errorf("the metric %s should be under the graph %s", m.Name, p.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// PluginInspection is the result of InspectPlugin.
+type PluginInspection struct {
+	GraphDefs []*mkr.GraphDefsParam
+	// GraphDefsError is the error of the output of the graph definitions,
+	// which is nil if the plugin outputs no meta.
+	GraphDefsError error
+	// Protocol is the protocol of the output, which is detected by the first
+	// line unless it is configured.
+	Protocol config.PluginProtocol
+	Values   Values
+	// CustomIdentifierValues are the values of the other hosts by the custom
+	// identifiers of the records.
+	CustomIdentifierValues map[string]Values
+	Stderr                 string
+	// Warnings are the ones the agent logs for the output, and Ignored is the
+	// number of the lines which are neither the values nor the comments.
+	Warnings []string
+	Ignored  int
+}
+
+// InspectPlugin runs the metrics plugin once as the agent does, and returns
+// the graph definitions and the values parsed from the output. It returns an
+// error only if the command failed.
+func InspectPlugin(conf *config.MetricPlugin) (*PluginInspection, error) {
+	g := &pluginGenerator{Config: conf}
+	result := &PluginInspection{}
+	var err error
+	result.GraphDefs, err = g.PrepareGraphDefs()
+	if _, ok := err.(noPluginMetaError); !ok && err != nil {
+		result.GraphDefsError = err
+	}
+
+	p := g.newValuesParser()
+	result.Stderr, _, err = g.runValues(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the plugin %s: %s", conf.Name, err)
+	}
+	result.Values = p.finish()
+	result.CustomIdentifierValues = p.hosts
+	result.Protocol = p.protocol
+	if result.Protocol == "" {
+		result.Protocol = g.protocol("")
+	}
+	result.Warnings = p.warnings
+	result.Ignored = p.ignored
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestInspectPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command depends on sh")
+	}
+	now := time.Now().Unix()
+	script := fmt.Sprintf(`if [ "$MACKEREL_AGENT_PLUGIN_META" = 1 ]; then
+  echo '# mackerel-agent-plugin'
+  echo '{"graphs": {"dice": {"label": "Dice", "unit": "integer", "metrics": [{"name": "d6", "label": "D6"}]}}}'
+  exit 0
+fi
+printf 'dice.d6\t3\t%d\n'
+printf 'dice.d@20\t5\t%d\n'
+printf 'not a value\n'
+echo warned >&2
+`, now*1000, now)
+	conf := &config.MetricPlugin{
+		Name:    "dice",
+		Command: config.Command{Args: []string{"sh", "-c", script}},
+	}
+	result, err := InspectPlugin(conf)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if result.GraphDefsError != nil || len(result.GraphDefs) != 1 || result.GraphDefs[0].Name != "custom.dice" {
+		t.Errorf("the graph definitions should be parsed: %+v, %v", result.GraphDefs, result.GraphDefsError)
+	}
+	if _, ok := result.Values["custom.dice.d6"]; !ok {
+		t.Errorf("the values should be parsed: %v", result.Values)
+	}
+	if result.Ignored != 1 {
+		t.Errorf("the line which is not a value should be counted: %d", result.Ignored)
+	}
+	if len(result.Warnings) < 2 {
+		t.Errorf("the warnings of the names and the timestamps should be returned: %v", result.Warnings)
+	}
+	if result.Stderr != "warned\n" {
+		t.Errorf("the stderr should be returned: %q", result.Stderr)
+	}
+}
+
+func TestInspectPlugin_failed(t *testing.T) {
+	conf := &config.MetricPlugin{
+		Name:    "failed",
+		Command: config.Command{Args: []string{"./not-existing-plugin"}},
+	}
+	if _, err := InspectPlugin(conf); err == nil {
+		t.Error("the failed plugin should raise error")
+	}
+}
@@ -3,11 +3,12 @@
 package metrics
 
 import (
+	"errors"
 	"strings"
 	"time"
 
-	"github.com/mackerelio/go-osstat/network"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/util"
 )
 
@@ -22,51 +23,72 @@ interface = "eth0", "eth1" and so on... ("en0" on darwin)
 // InterfaceGenerator generates interface metric values
 type InterfaceGenerator struct {
 	Interval time.Duration
+	// CounterWrap is how to treat the counters decreased.
+	CounterWrap config.CounterWrap
 }
 
-var interfaceLogger = logging.GetLogger("metrics.interface")
+var interfaceLogger = logformat.GetLogger("metrics.interface")
+
+// errSkipped is returned by networkStats if the values of this cycle are
+// skipped, which is already warned.
+var errSkipped = errors.New("skipped the interface metrics of this cycle")
 
 // Generate interface metric values
 func (g *InterfaceGenerator) Generate() (Values, error) {
-	prevValues, err := g.collectInterfacesValues()
+	return g.GenerateSnapshot(NewSnapshot())
+}
+
+// GenerateSnapshot generates interface metric values, which are read from
+// /proc/net/dev in s on Linux
+func (g *InterfaceGenerator) GenerateSnapshot(s *Snapshot) (Values, error) {
+	prevValues, err := g.collectInterfacesValues(s, PhaseStart)
+	if err == errSkipped {
+		return Values{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	time.Sleep(g.Interval)
 
-	currValues, err := g.collectInterfacesValues()
+	currValues, err := g.collectInterfacesValues(s, PhaseEnd)
+	if err == errSkipped {
+		return Values{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make(map[string]float64)
-	for name, prevValue := range prevValues {
-		if currValue, ok := currValues[name]; ok && currValue >= prevValue {
-			ret[name+".delta"] = float64(currValue-prevValue) / g.Interval.Seconds()
-		}
+	deltas, err := CounterDeltas(prevValues, currValues, g.CounterWrap)
+	if err != nil {
+		interfaceLogger.Warningf("Dropped the interface metrics of this cycle: %s", err)
+		return Values{}, nil
+	}
+	ret := make(map[string]float64, len(deltas))
+	for name, delta := range deltas {
+		ret[name+".delta"] = delta / g.Interval.Seconds()
 	}
 
 	return Values(ret), nil
 }
 
-func (g *InterfaceGenerator) collectInterfacesValues() (map[string]uint64, error) {
-	networks, err := network.Get()
+func (g *InterfaceGenerator) collectInterfacesValues(s *Snapshot, phase int) (*CounterSample, error) {
+	networks, at, err := networkStats(s, phase)
+	if err == errSkipped {
+		return nil, err
+	}
 	if err != nil {
 		interfaceLogger.Errorf("failed to get network statistics: %s", err)
 		return nil, err
 	}
-	if len(networks) == 0 {
-		return nil, nil
-	}
-	results := make(map[string]uint64, len(networks)*2)
+	results := make(map[string]float64, len(networks)*2)
 	for _, network := range networks {
 		name := util.SanitizeMetricKey(network.Name)
 		if strings.HasPrefix(name, "veth") {
 			continue
 		}
-		results["interface."+name+".rxBytes"] = network.RxBytes
-		results["interface."+name+".txBytes"] = network.TxBytes
+		results["interface."+name+".rxBytes"] = float64(network.RxBytes)
+		results["interface."+name+".txBytes"] = float64(network.TxBytes)
 	}
-	return results, nil
+	return NewCounterSample(results, at), nil
 }
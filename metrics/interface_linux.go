@@ -0,0 +1,40 @@
+// +build linux
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/mackerelio/go-osstat/network"
+	"github.com/mackerelio/mackerel-agent/metrics/linux/procfs"
+)
+
+// networkStats parses /proc/net/dev in s as network.Get. It returns errSkipped
+// if the file is not parsed, which is warned.
+func networkStats(s *Snapshot, phase int) ([]network.Stats, time.Time, error) {
+	out, at, err := s.ReadFileAt(phase, procfs.NetDevFile)
+	if err != nil {
+		return nil, at, err
+	}
+	networks, err := parseNetDev(out)
+	if _, ok := err.(*procfs.ParseError); ok {
+		WarnSkipped(interfaceLogger, "interface", err)
+		return nil, at, errSkipped
+	}
+	return networks, at, err
+}
+
+// parseNetDev parses /proc/net/dev except the loopback.
+func parseNetDev(out []byte) ([]network.Stats, error) {
+	stats, err := procfs.ParseNetDev(out)
+	if err != nil {
+		return nil, err
+	}
+	var networks []network.Stats
+	for _, n := range stats {
+		if n.Name != "lo" {
+			networks = append(networks, n)
+		}
+	}
+	return networks, nil
+}
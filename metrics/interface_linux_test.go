@@ -0,0 +1,26 @@
+// +build linux
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/go-osstat/network"
+)
+
+func TestParseNetDev(t *testing.T) {
+	out := []byte(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 1234567    1234    0    0    0     0          0         0  1234567    1234    0    0    0     0       0          0
+  eth0: 98765432  765432    0    0    0     0          0         0 12345678  123456    0    0    0     0       0          0
+`)
+	got, err := parseNetDev(out)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expect := []network.Stats{{Name: "eth0", RxBytes: 98765432, TxBytes: 12345678}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("parseNetDev should return %+v but got %+v", expect, got)
+	}
+}
@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/cmdutil"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/util"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var ipmiLogger = logformat.GetLogger("metrics.ipmi")
+
+const ipmiPrefix = pluginPrefix + "ipmi."
+
+// ipmiKind is the kind of the sensors by the units of the readings, which
+// is graphed as custom.ipmi.<kind>.*.
+type ipmiKind struct {
+	name  string
+	label string
+	unit  string
+}
+
+var ipmiKinds = map[string]ipmiKind{
+	"degrees c": {"temperature", "IPMI Temperature (C)", "float"},
+	"degrees f": {"temperature_f", "IPMI Temperature (F)", "float"},
+	"rpm":       {"fan", "IPMI Fan (RPM)", "integer"},
+	"volts":     {"voltage", "IPMI Voltage (V)", "float"},
+	"amps":      {"current", "IPMI Current (A)", "float"},
+	"watts":     {"power", "IPMI Power (W)", "float"},
+	"percent":   {"percentage", "IPMI Percentage", "percentage"},
+	// the states of the discrete sensors such as the power supplies, which
+	// are read only by `ipmitool sensor`
+	"discrete": {"status", "IPMI Status", "integer"},
+}
+
+var ipmiOtherKind = ipmiKind{"other", "IPMI Other", "float"}
+
+// ipmiGenerator reads the sensors by ipmitool every interval of the
+// configuration, which is longer than the collection cycle since ipmitool
+// takes seconds. The values are generated only in the cycles running it.
+type ipmiGenerator struct {
+	Config *config.IPMI
+	// SDRCache is the file caching the sensor data records, the list of the
+	// sensors, which saves reading them from the BMC every time.
+	SDRCache string
+
+	// mu guards lastRun, which is not held while running ipmitool.
+	mu      sync.Mutex
+	lastRun time.Time
+	// run is replaced in the tests.
+	run func(args []string) (string, error)
+}
+
+// NewIPMIGenerator creates the generator of the sensors by conf, which caches
+// the sensor data records in sdrCache.
+func NewIPMIGenerator(conf *config.IPMI, sdrCache string) PluginGenerator {
+	g := &ipmiGenerator{Config: conf, SDRCache: sdrCache}
+	g.run = g.runCommand
+	return g
+}
+
+func (g *ipmiGenerator) String() string {
+	return fmt.Sprintf("ipmi %q", g.Config.Command)
+}
+
+// Generate reads the sensors if the interval has elapsed since the last run.
+func (g *ipmiGenerator) Generate() (Values, error) {
+	if !g.start(time.Now()) {
+		return Values{}, nil
+	}
+
+	args := append([]string{}, g.Config.Options...)
+	if g.SDRCache != "" {
+		if g.dumpSDR() {
+			args = append(args, "-S", g.SDRCache)
+		}
+	}
+	if g.Config.Mode == config.IPMIModeSDR {
+		args = append(args, "sdr", "elist")
+	} else {
+		args = append(args, "sensor")
+	}
+	out, err := g.run(args)
+	if err != nil {
+		// the cache may be obsolete, such as by the updates of the firmware
+		if g.SDRCache != "" {
+			os.Remove(g.SDRCache)
+		}
+		return nil, err
+	}
+	if g.Config.Mode == config.IPMIModeSDR {
+		return parseIPMISDR(out), nil
+	}
+	return parseIPMISensor(out), nil
+}
+
+// start returns whether the interval has elapsed since the last run, and
+// records now as the last run then, so that the other cycles do not run
+// ipmitool concurrently.
+func (g *ipmiGenerator) start(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// the cycles are not exactly every minute
+	if !g.lastRun.IsZero() && now.Sub(g.lastRun) < g.Config.Interval.Duration-config.PostMetricsInterval/2 {
+		return false
+	}
+	g.lastRun = now
+	return true
+}
+
+// dumpSDR dumps the sensor data records to SDRCache unless they are cached,
+// and returns whether they are cached.
+func (g *ipmiGenerator) dumpSDR() bool {
+	if _, err := os.Stat(g.SDRCache); err == nil {
+		return true
+	}
+	args := append(append([]string{}, g.Config.Options...), "sdr", "dump", g.SDRCache)
+	if _, err := g.run(args); err != nil {
+		ipmiLogger.Warningf("Failed to cache the sensor data records, so reading them from the BMC every time: %s", err)
+		os.Remove(g.SDRCache)
+		return false
+	}
+	return true
+}
+
+func (g *ipmiGenerator) runCommand(args []string) (string, error) {
+	cmdArgs := append([]string{g.Config.Command}, args...)
+	stdout, stderr, exitCode, err := cmdutil.RunCommandArgs(cmdArgs, cmdutil.CommandOption{TimeoutDuration: g.Config.Timeout.Duration})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute %s: %s", g.Config.Command, err)
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("%s %s exits with %d: %s", g.Config.Command, strings.Join(args, " "), exitCode, strings.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
+
+// PrepareGraphDefs returns the graphs of the kinds of the sensors.
+func (g *ipmiGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	kinds := append([]ipmiKind{ipmiOtherKind}, ipmiKindList()...)
+	payloads := make([]*mkr.GraphDefsParam, 0, len(kinds))
+	for _, k := range kinds {
+		payloads = append(payloads, &mkr.GraphDefsParam{
+			Name:        ipmiPrefix + k.name,
+			DisplayName: k.label,
+			Unit:        k.unit,
+			Metrics: []*mkr.GraphDefsMetric{
+				{Name: ipmiPrefix + k.name + ".*"},
+			},
+		})
+	}
+	return payloads, nil
+}
+
+func ipmiKindList() []ipmiKind {
+	kinds := make([]ipmiKind, 0, len(ipmiKinds))
+	for _, k := range ipmiKinds {
+		kinds = append(kinds, k)
+	}
+	return kinds
+}
+
+func (g *ipmiGenerator) CustomIdentifier() *string {
+	return nil
+}
+
+// ipmiValues names the readings by the kinds and the sanitized names of the
+// sensors, whose duplicates are suffixed by the numbers.
+type ipmiValues struct {
+	values Values
+	seen   map[string]int
+}
+
+func (v *ipmiValues) add(sensor, unit string, value float64) {
+	kind, ok := ipmiKinds[strings.ToLower(unit)]
+	if !ok {
+		kind = ipmiOtherKind
+	}
+	name := ipmiPrefix + kind.name + "." + util.SanitizeMetricKey(sensor)
+	v.seen[name]++
+	if n := v.seen[name]; n > 1 {
+		name += "_" + strconv.Itoa(n)
+	}
+	v.values[name] = value
+}
+
+func isIPMINoReading(s string) bool {
+	switch strings.ToLower(s) {
+	case "", "na", "ns", "no reading", "disabled":
+		return true
+	}
+	return false
+}
+
+// parseIPMISensor parses the output of `ipmitool sensor` such as
+//
+//	CPU Temp         | 36.000     | degrees C  | ok    | 0.000 | ...
+//	PS1 Status       | 0x1        | discrete   | 0x0100| na    | ...
+//	Vcpu             | na         | Volts      | na    | na    | ...
+func parseIPMISensor(out string) Values {
+	v := &ipmiValues{values: make(Values), seen: make(map[string]int)}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 3 {
+			continue
+		}
+		sensor := strings.TrimSpace(fields[0])
+		reading := strings.TrimSpace(fields[1])
+		unit := strings.TrimSpace(fields[2])
+		if sensor == "" || isIPMINoReading(reading) {
+			continue
+		}
+		var value float64
+		if strings.HasPrefix(reading, "0x") {
+			state, err := strconv.ParseUint(reading[2:], 16, 32)
+			if err != nil {
+				continue
+			}
+			value = float64(state)
+		} else {
+			var err error
+			if value, err = strconv.ParseFloat(reading, 64); err != nil {
+				continue
+			}
+		}
+		v.add(sensor, unit, value)
+	}
+	return v.values
+}
+
+// parseIPMISDR parses the output of `ipmitool sdr elist` such as
+//
+//	CPU Temp         | 01h | ok  |  3.1 | 36 degrees C
+//	PS1 Status       | C8h | ok  | 10.1 | Presence detected
+//	Vcpu             | 10h | ns  |  3.1 | No Reading
+//
+// The states of the discrete sensors are not numeric, so they are skipped.
+func parseIPMISDR(out string) Values {
+	v := &ipmiValues{values: make(Values), seen: make(map[string]int)}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 5 {
+			continue
+		}
+		sensor := strings.TrimSpace(fields[0])
+		status := strings.TrimSpace(fields[2])
+		reading := strings.TrimSpace(fields[4])
+		if sensor == "" || isIPMINoReading(status) || isIPMINoReading(reading) {
+			continue
+		}
+		parts := strings.SplitN(reading, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			continue
+		}
+		v.add(sensor, strings.TrimSpace(parts[1]), value)
+	}
+	return v.values
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestParseIPMISensor(t *testing.T) {
+	out := `CPU Temp         | 36.000     | degrees C  | ok    | 0.000     | 0.000     | 0.000     | 95.000    | 100.000   | 100.000
+System Temp      | 28.000     | degrees C  | ok    | -10.000   | -5.000    | 0.000     | 80.000    | 85.000    | 90.000
+FAN1             | 3900.000   | RPM        | ok    | 300.000   | 500.000   | 700.000   | 25300.000 | 25400.000 | 25500.000
+FAN2             | na         | RPM        | na    | na        | na        | na        | na        | na        | na
+Vcpu             | 1.800      | Volts      | ok    | 1.250     | 1.290     | 1.330     | 2.000     | 2.040     | 2.080
+PS1 Status       | 0x1        | discrete   | 0x0100| na        | na        | na        | na        | na        | na
+Pwr Consumption  | 140.000    | Watts      | ok    | na        | na        | na        | na        | na        | na
+Temp             | 40.000     | degrees C  | ok    | na        | na        | na        | na        | na        | na
+Temp             | 42.000     | degrees C  | ok    | na        | na        | na        | na        | na        | na
+Airflow          | 25.000     | CFM        | ok    | na        | na        | na        | na        | na        | na
+`
+	expect := Values{
+		"custom.ipmi.temperature.CPU_Temp":    36,
+		"custom.ipmi.temperature.System_Temp": 28,
+		"custom.ipmi.fan.FAN1":                3900,
+		"custom.ipmi.voltage.Vcpu":            1.8,
+		"custom.ipmi.status.PS1_Status":       1,
+		"custom.ipmi.power.Pwr_Consumption":   140,
+		"custom.ipmi.temperature.Temp":        40,
+		"custom.ipmi.temperature.Temp_2":      42,
+		"custom.ipmi.other.Airflow":           25,
+	}
+	if got := parseIPMISensor(out); !reflect.DeepEqual(got, expect) {
+		t.Errorf("parseIPMISensor should be %v but got %v", expect, got)
+	}
+}
+
+func TestParseIPMISDR(t *testing.T) {
+	out := `CPU Temp         | 01h | ok  |  3.1 | 36 degrees C
+FAN1             | 41h | ok  | 29.1 | 3900 RPM
+FAN2             | 42h | ns  | 29.2 | No Reading
+PS1 Status       | C8h | ok  | 10.1 | Presence detected
+Vcpu             | 10h | ok  |  3.1 | 1.80 Volts
+`
+	expect := Values{
+		"custom.ipmi.temperature.CPU_Temp": 36,
+		"custom.ipmi.fan.FAN1":             3900,
+		"custom.ipmi.voltage.Vcpu":         1.8,
+	}
+	if got := parseIPMISDR(out); !reflect.DeepEqual(got, expect) {
+		t.Errorf("parseIPMISDR should be %v but got %v", expect, got)
+	}
+}
+
+func TestIPMIGenerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-ipmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "ipmi.sdr")
+
+	conf := &config.IPMI{
+		Command:  "ipmitool",
+		Options:  []string{"-I", "open"},
+		Mode:     config.IPMIModeSensor,
+		Interval: &config.Duration{Duration: 5 * time.Minute},
+		Timeout:  &config.Duration{Duration: 30 * time.Second},
+	}
+	g := NewIPMIGenerator(conf, cache).(*ipmiGenerator)
+	var runs []string
+	g.run = func(args []string) (string, error) {
+		runs = append(runs, strings.Join(args, " "))
+		if args[len(args)-2] == "dump" {
+			return "", ioutil.WriteFile(args[len(args)-1], []byte("sdr"), 0600)
+		}
+		return "FAN1 | 3900.000 | RPM | ok\n", nil
+	}
+
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["custom.ipmi.fan.FAN1"] != 3900 {
+		t.Errorf("the sensors should be read: %v", values)
+	}
+	expect := []string{"-I open sdr dump " + cache, "-I open -S " + cache + " sensor"}
+	if !reflect.DeepEqual(runs, expect) {
+		t.Errorf("the sensor data records should be cached: %q", runs)
+	}
+
+	// the sensors are not read until the interval elapses
+	values, _ = g.Generate()
+	if len(values) != 0 || len(runs) != 2 {
+		t.Errorf("the sensors should not be read in the interval: %v, %q", values, runs)
+	}
+	g.lastRun = g.lastRun.Add(-5 * time.Minute)
+	g.Generate()
+	if len(runs) != 3 || runs[2] != expect[1] {
+		t.Errorf("the cached sensor data records should be used: %q", runs)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"time"
 
 	"github.com/mackerelio/go-osstat/cpu"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/metrics/linux/procfs"
 )
 
 /*
@@ -25,62 +27,101 @@ type CPUUsageGenerator struct {
 	Interval time.Duration
 }
 
-var cpuUsageLogger = logging.GetLogger("metrics.cpuUsage")
+var cpuUsageLogger = logformat.GetLogger("metrics.cpuUsage")
 
 // Generate CPU metric values
 func (g *CPUUsageGenerator) Generate() (metrics.Values, error) {
-	previous, err := g.collectProcStatValues()
+	return g.GenerateSnapshot(metrics.NewSnapshot())
+}
+
+// GenerateSnapshot generates CPU metric values from /proc/stat in s
+func (g *CPUUsageGenerator) GenerateSnapshot(s *metrics.Snapshot) (metrics.Values, error) {
+	previous, previousAt, err := g.collectProcStatValues(s, metrics.PhaseStart)
 	if err != nil {
-		return nil, err
+		return skipParseError(cpuUsageLogger, "CPU", err)
 	}
 
 	time.Sleep(g.Interval)
 
-	current, err := g.collectProcStatValues()
+	current, currentAt, err := g.collectProcStatValues(s, metrics.PhaseEnd)
 	if err != nil {
-		return nil, err
+		return skipParseError(cpuUsageLogger, "CPU", err)
 	}
 
-	totalDiff := float64(current.Total - previous.Total)
+	// the CPU times are 64-bit, which never wrap around in practice
+	prevTimes := cpuTimes(previous, previousAt)
+	deltas, err := metrics.CounterDeltas(prevTimes, cpuTimes(current, currentAt), config.CounterWrapDrop)
+	if err != nil {
+		cpuUsageLogger.Warningf("Dropped the CPU metrics of this cycle: %s", err)
+		return metrics.Values{}, nil
+	}
+	// the percentages are garbage without any of the times, which sum up to total
+	if len(deltas) < len(prevTimes.Values) {
+		cpuUsageLogger.Warningf("Dropped the CPU metrics of this cycle: the CPU times went backwards")
+		return metrics.Values{}, nil
+	}
+	totalDiff := deltas["total"]
 	cpuCount := float64(current.CPUCount)
+	statCount := current.StatCount
 
 	// Since cpustat[CPUTIME_USER] includes cpustat[CPUTIME_GUEST], we subtract guest from user for the stacked graph of Mackerel.
 	// https://github.com/torvalds/linux/blob/4ec9f7a18/kernel/sched/cputime.c#L151-L158
 	// We should also subtract guest_nice from nice, but guest_nice is not supported in Mackerel yet.
 	ret := map[string]float64{
-		"cpu.user.percentage":   float64((current.User-current.Guest)-(previous.User-previous.Guest)) * cpuCount * 100.0 / totalDiff,
-		"cpu.nice.percentage":   float64(current.Nice-previous.Nice) * cpuCount * 100.0 / totalDiff,
-		"cpu.system.percentage": float64(current.System-previous.System) * cpuCount * 100.0 / totalDiff,
-		"cpu.idle.percentage":   float64(current.Idle-previous.Idle) * cpuCount * 100.0 / totalDiff,
+		"cpu.user.percentage":   (deltas["user"] - deltas["guest"]) * cpuCount * 100.0 / totalDiff,
+		"cpu.nice.percentage":   deltas["nice"] * cpuCount * 100.0 / totalDiff,
+		"cpu.system.percentage": deltas["system"] * cpuCount * 100.0 / totalDiff,
+		"cpu.idle.percentage":   deltas["idle"] * cpuCount * 100.0 / totalDiff,
 	}
-	if current.StatCount >= 5 {
-		ret["cpu.iowait.percentage"] = float64(current.Iowait-previous.Iowait) * cpuCount * 100.0 / totalDiff
+	if statCount >= 5 {
+		ret["cpu.iowait.percentage"] = deltas["iowait"] * cpuCount * 100.0 / totalDiff
 	}
-	if current.StatCount >= 6 {
-		ret["cpu.irq.percentage"] = float64(current.Irq-previous.Irq) * cpuCount * 100.0 / totalDiff
+	if statCount >= 6 {
+		ret["cpu.irq.percentage"] = deltas["irq"] * cpuCount * 100.0 / totalDiff
 	}
-	if current.StatCount >= 7 {
-		ret["cpu.softirq.percentage"] = float64(current.Softirq-previous.Softirq) * cpuCount * 100.0 / totalDiff
+	if statCount >= 7 {
+		ret["cpu.softirq.percentage"] = deltas["softirq"] * cpuCount * 100.0 / totalDiff
 	}
-	if current.StatCount >= 8 {
-		ret["cpu.steal.percentage"] = float64(current.Steal-previous.Steal) * cpuCount * 100.0 / totalDiff
+	if statCount >= 8 {
+		ret["cpu.steal.percentage"] = deltas["steal"] * cpuCount * 100.0 / totalDiff
 	}
-	if current.StatCount >= 9 {
-		ret["cpu.guest.percentage"] = float64(current.Guest-previous.Guest) * cpuCount * 100.0 / totalDiff
+	if statCount >= 9 {
+		ret["cpu.guest.percentage"] = deltas["guest"] * cpuCount * 100.0 / totalDiff
 	}
 	// guest_nice is not yet supported in Mackerel
-	// if current.StatCount >= 10 {
-	// 	ret["cpu.guest_nice.percentage"]=   float64(current.GuestNice - previous.GuestNice) * cpuCount * 100.0 / totalDiff
+	// if statCount >= 10 {
+	// 	ret["cpu.guest_nice.percentage"] = deltas["guestNice"] * cpuCount * 100.0 / totalDiff
 	// }
 	return metrics.Values(ret), nil
 }
 
 // returns values corresponding to cpuUsageMetricNames, those total and the number of CPUs
-func (g *CPUUsageGenerator) collectProcStatValues() (*cpu.Stats, error) {
-	cpu, err := cpu.Get()
+func (g *CPUUsageGenerator) collectProcStatValues(s *metrics.Snapshot, phase int) (*cpu.Stats, time.Time, error) {
+	out, at, err := s.ReadFileAt(phase, procfs.StatFile)
 	if err != nil {
 		cpuUsageLogger.Errorf("failed to get cpu statistics: %s", err)
-		return nil, err
+		return nil, at, err
 	}
-	return cpu, nil
+	stats, err := procfs.ParseStat(out)
+	if err != nil {
+		return nil, at, err
+	}
+	return stats, at, nil
+}
+
+// cpuTimes returns the counters of the CPU times in stats.
+func cpuTimes(stats *cpu.Stats, at time.Time) *metrics.CounterSample {
+	return metrics.NewCounterSample(map[string]float64{
+		"user":      float64(stats.User),
+		"nice":      float64(stats.Nice),
+		"system":    float64(stats.System),
+		"idle":      float64(stats.Idle),
+		"iowait":    float64(stats.Iowait),
+		"irq":       float64(stats.Irq),
+		"softirq":   float64(stats.Softirq),
+		"steal":     float64(stats.Steal),
+		"guest":     float64(stats.Guest),
+		"guestNice": float64(stats.GuestNice),
+		"total":     float64(stats.Total),
+	}, at)
 }
@@ -3,17 +3,15 @@
 package linux
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"io/ioutil"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/metrics/linux/procfs"
 	"github.com/mackerelio/mackerel-agent/util"
 )
 
@@ -44,6 +42,8 @@ Note that there are more columns in Linux 4.18+, see https://github.com/torvalds
 type DiskGenerator struct {
 	Interval      time.Duration
 	UseMountpoint bool
+	// CounterWrap is how to treat the counters decreased.
+	CounterWrap config.CounterWrap
 }
 
 var diskMetricsNames = []string{
@@ -55,38 +55,43 @@ var diskMetricsNames = []string{
 // metrics for posting to Mackerel
 var postDiskMetricsRegexp = regexp.MustCompile(`^disk\..+\.(reads|writes)$`)
 
-var diskLogger = logging.GetLogger("metrics.disk")
+var diskLogger = logformat.GetLogger("metrics.disk")
 
 // Generate XXX
 func (g *DiskGenerator) Generate() (metrics.Values, error) {
-	prevValues, err := g.collectDiskstatValues()
+	return g.GenerateSnapshot(metrics.NewSnapshot())
+}
+
+// GenerateSnapshot generates the disk metric values from /proc/diskstats in s
+func (g *DiskGenerator) GenerateSnapshot(s *metrics.Snapshot) (metrics.Values, error) {
+	prevValues, err := g.collectDiskstatValues(s, metrics.PhaseStart)
 	if err != nil {
-		return nil, err
+		return skipParseError(diskLogger, "disk", err)
 	}
 
 	time.Sleep(g.Interval)
 
-	currValues, err := g.collectDiskstatValues()
+	currValues, err := g.collectDiskstatValues(s, metrics.PhaseEnd)
 	if err != nil {
-		return nil, err
+		return skipParseError(diskLogger, "disk", err)
 	}
 
-	ret := make(map[string]float64)
-	for name, value := range prevValues {
-		if !postDiskMetricsRegexp.MatchString(name) {
-			continue
-		}
-		currValue, ok := currValues[name]
-		if ok {
-			ret[name+".delta"] = (currValue - value) / g.Interval.Seconds()
-		}
+	deltas, err := metrics.CounterDeltas(prevValues, currValues, g.CounterWrap)
+	if err != nil {
+		diskLogger.Warningf("Dropped the disk metrics of this cycle: %s", err)
+		return metrics.Values{}, nil
+	}
+	ret := make(map[string]float64, len(deltas))
+	for name, delta := range deltas {
+		ret[name+".delta"] = delta / g.Interval.Seconds()
 	}
 
 	return metrics.Values(ret), nil
 }
 
-func (g *DiskGenerator) collectDiskstatValues() (metrics.Values, error) {
-	out, err := ioutil.ReadFile("/proc/diskstats")
+// collectDiskstatValues returns the counters posted as the deltas.
+func (g *DiskGenerator) collectDiskstatValues(s *metrics.Snapshot, phase int) (*metrics.CounterSample, error) {
+	out, at, err := s.ReadFileAt(phase, procfs.DiskstatsFile)
 	if err != nil {
 		diskLogger.Errorf("Failed (skip these metrics): %s", err)
 		return nil, err
@@ -101,54 +106,52 @@ func (g *DiskGenerator) collectDiskstatValues() (metrics.Values, error) {
 			diskLogger.Warningf("Failed to prepare device name mapping: %s", err)
 		}
 	}
-	return parseDiskStats(out, nameMapping)
+	values, err := parseDiskStats(out, nameMapping)
+	if err != nil {
+		return nil, err
+	}
+	for name := range values {
+		// the others such as ioInProgress are not counters
+		if !postDiskMetricsRegexp.MatchString(name) {
+			delete(values, name)
+		}
+	}
+	return metrics.NewCounterSample(values, at), nil
 }
 
 func parseDiskStats(out []byte, mapping map[string]string) (metrics.Values, error) {
-	lineScanner := bufio.NewScanner(bytes.NewReader(out))
+	disks, err := procfs.ParseDiskstats(out)
+	if err != nil {
+		return nil, err
+	}
 	results := make(map[string]float64)
-	for lineScanner.Scan() {
-		text := lineScanner.Text()
-		cols := strings.Fields(text)
-		if len(cols) < 3 {
-			diskLogger.Warningf("Failed to parse disk metrics: %s", text)
-			continue
-		}
-		device := cols[2]
-		values := cols[3:]
-
-		if len(values) < len(diskMetricsNames) {
-			diskLogger.Warningf("Failed to parse disk metrics: %s", device)
-			break
-		}
-
-		deviceLabel := util.SanitizeMetricKey(device)
+	for _, d := range disks {
+		deviceLabel := util.SanitizeMetricKey(d.Name)
 		if strings.HasPrefix(deviceLabel, "dm-") {
 			continue
 		}
-		mountpoint, exists := mapping[device]
+		mountpoint, exists := mapping[d.Name]
 		if exists {
 			deviceLabel = util.SanitizeMetricKey(mountpoint)
 		}
 
-		deviceResult := make(map[string]float64)
+		// in the order of diskMetricsNames
+		values := []uint64{
+			d.Reads, d.ReadsMerged, d.SectorsRead, d.ReadTime,
+			d.Writes, d.WritesMerged, d.SectorsWritten, d.WriteTime,
+			d.IOInProgress, d.IOTime, d.IOTimeWeighted,
+		}
 		hasNonZeroValue := false
-		for i := range diskMetricsNames {
-			key := fmt.Sprintf("disk.%s.%s", deviceLabel, diskMetricsNames[i])
-			value, err := strconv.ParseFloat(values[i], 64)
-			if err != nil {
-				diskLogger.Warningf("Failed to parse disk metrics: %s", err)
-				break
-			}
-			if value != 0 {
+		for _, v := range values {
+			if v != 0 {
 				hasNonZeroValue = true
 			}
-			deviceResult[key] = value
 		}
-		if hasNonZeroValue {
-			for k, v := range deviceResult {
-				results[k] = v
-			}
+		if !hasNonZeroValue {
+			continue
+		}
+		for i, name := range diskMetricsNames {
+			results[fmt.Sprintf("disk.%s.%s", deviceLabel, name)] = float64(values[i])
 		}
 	}
 
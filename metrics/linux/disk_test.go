@@ -159,3 +159,12 @@ func TestParseDiskStats_MoreFields(t *testing.T) {
 		t.Errorf("result is not expected one: %+v", result)
 	}
 }
+
+func TestParseDiskStats_tooFewColumns(t *testing.T) {
+	out := []byte(`202       1 xvda1 750193 3037 28116978 368712 16600606 7233846 424712632 23987908 0 2355636 24345740
+202       2 xvda2 1641 9310 87552
+`)
+	if _, err := parseDiskStats(out, nil); err == nil {
+		t.Error("parseDiskStats should raise error for the too few columns instead of dropping the devices after them")
+	}
+}
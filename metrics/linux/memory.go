@@ -3,9 +3,9 @@
 package linux
 
 import (
-	"github.com/mackerelio/go-osstat/memory"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/metrics/linux/procfs"
 )
 
 /*
@@ -24,15 +24,24 @@ graph: stacks `memory.{metric}`
 type MemoryGenerator struct {
 }
 
-var memoryLogger = logging.GetLogger("metrics.memory")
+var memoryLogger = logformat.GetLogger("metrics.memory")
 
 // Generate memory values
 func (g *MemoryGenerator) Generate() (metrics.Values, error) {
-	mem, err := memory.Get()
+	return g.GenerateSnapshot(metrics.NewSnapshot())
+}
+
+// GenerateSnapshot generates memory values from /proc/meminfo in s
+func (g *MemoryGenerator) GenerateSnapshot(s *metrics.Snapshot) (metrics.Values, error) {
+	out, err := s.ReadFile(metrics.PhaseStart, procfs.MeminfoFile)
 	if err != nil {
 		memoryLogger.Errorf("failed to get memory statistics: %s", err)
 		return nil, err
 	}
+	mem, err := procfs.ParseMeminfo(out)
+	if err != nil {
+		return skipParseError(memoryLogger, "memory", err)
+	}
 
 	ret := map[string]float64{
 		"memory.total":       float64(mem.Total),
@@ -0,0 +1,20 @@
+// +build linux
+
+package linux
+
+import (
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/metrics/linux/procfs"
+)
+
+// skipParseError returns the empty values, by which the generator of name is
+// skipped in this cycle with the warning, if err is of parsing the file in
+// /proc. Otherwise it returns err.
+func skipParseError(logger *logformat.Logger, name string, err error) (metrics.Values, error) {
+	if _, ok := err.(*procfs.ParseError); ok {
+		metrics.WarnSkipped(logger, name, err)
+		return metrics.Values{}, nil
+	}
+	return nil, err
+}
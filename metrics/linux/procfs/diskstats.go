@@ -0,0 +1,67 @@
+// +build linux
+
+package procfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DiskstatsFile is the file parsed by ParseDiskstats.
+const DiskstatsFile = "/proc/diskstats"
+
+// minDiskstatsFields are the fields of a device in /proc/diskstats until
+// Linux 4.17, which are the major and minor numbers, the name and the 11
+// statistics. The 4 fields of the discards (4.18) and the 2 of the flushes
+// (5.5) follow them.
+const minDiskstatsFields = 14
+
+// DiskStats are the statistics of a device in /proc/diskstats.
+type DiskStats struct {
+	Name           string
+	Reads          uint64
+	ReadsMerged    uint64
+	SectorsRead    uint64
+	ReadTime       uint64
+	Writes         uint64
+	WritesMerged   uint64
+	SectorsWritten uint64
+	WriteTime      uint64
+	IOInProgress   uint64
+	IOTime         uint64
+	IOTimeWeighted uint64
+}
+
+// ParseDiskstats parses /proc/diskstats. The empty lines are skipped.
+func ParseDiskstats(out []byte) ([]DiskStats, error) {
+	var disks []DiskStats
+	err := scanLines(DiskstatsFile, out, func(line string, n int) error {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		cols, err := fields(DiskstatsFile, line, n, minDiskstatsFields)
+		if err != nil {
+			return err
+		}
+		d := DiskStats{Name: cols[2]}
+		ptrs := []*uint64{
+			&d.Reads, &d.ReadsMerged, &d.SectorsRead, &d.ReadTime,
+			&d.Writes, &d.WritesMerged, &d.SectorsWritten, &d.WriteTime,
+			&d.IOInProgress, &d.IOTime, &d.IOTimeWeighted,
+		}
+		for i, ptr := range ptrs {
+			v, err := strconv.ParseUint(cols[3+i], 10, 64)
+			if err != nil {
+				return &ParseError{File: DiskstatsFile, Line: n, Msg: fmt.Sprintf("invalid field %d of %s: %q", 4+i, d.Name, cols[3+i])}
+			}
+			*ptr = v
+		}
+		disks = append(disks, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
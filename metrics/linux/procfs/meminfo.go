@@ -0,0 +1,71 @@
+// +build linux
+
+package procfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/go-osstat/memory"
+)
+
+// MeminfoFile is the file parsed by ParseMeminfo.
+const MeminfoFile = "/proc/meminfo"
+
+// ParseMeminfo parses /proc/meminfo as memory.Get. The lines are identified
+// by their names, such as "MemAvailable" which is since Linux 3.14.
+func ParseMeminfo(out []byte) (*memory.Stats, error) {
+	var stats memory.Stats
+	columns := map[string]*uint64{
+		"MemTotal":     &stats.Total,
+		"MemFree":      &stats.Free,
+		"MemAvailable": &stats.Available,
+		"Buffers":      &stats.Buffers,
+		"Cached":       &stats.Cached,
+		"Active":       &stats.Active,
+		"Inactive":     &stats.Inactive,
+		"SwapCached":   &stats.SwapCached,
+		"SwapTotal":    &stats.SwapTotal,
+		"SwapFree":     &stats.SwapFree,
+	}
+	hasTotal := false
+	err := scanLines(MeminfoFile, out, func(line string, n int) error {
+		i := strings.IndexRune(line, ':')
+		if i < 0 {
+			return nil
+		}
+		name := line[:i]
+		ptr := columns[name]
+		if ptr == nil {
+			return nil
+		}
+		val := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line[i+1:]), "kB"))
+		v, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return &ParseError{File: MeminfoFile, Line: n, Msg: fmt.Sprintf("invalid %s: %q", name, val)}
+		}
+		*ptr = v * 1024
+		switch name {
+		case "MemTotal":
+			hasTotal = true
+		case "MemAvailable":
+			stats.MemAvailableEnabled = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !hasTotal {
+		return nil, &ParseError{File: MeminfoFile, Msg: "no MemTotal line"}
+	}
+
+	stats.SwapUsed = stats.SwapTotal - stats.SwapFree
+	if stats.MemAvailableEnabled {
+		stats.Used = stats.Total - stats.Available
+	} else {
+		stats.Used = stats.Total - stats.Free - stats.Buffers - stats.Cached
+	}
+	return &stats, nil
+}
@@ -0,0 +1,50 @@
+// +build linux
+
+package procfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio/go-osstat/network"
+)
+
+// NetDevFile is the file parsed by ParseNetDev.
+const NetDevFile = "/proc/net/dev"
+
+// minNetDevFields are the fields of an interface in /proc/net/dev after the
+// colon, which are the 8 of the receive and the 8 of the transmit.
+// Reference: dev_seq_printf_stats in Linux source code
+const minNetDevFields = 16
+
+// ParseNetDev parses /proc/net/dev as network.Get, including the loopback.
+// The header lines, which have no colon, are skipped.
+func ParseNetDev(out []byte) ([]network.Stats, error) {
+	var networks []network.Stats
+	err := scanLines(NetDevFile, out, func(line string, n int) error {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil
+		}
+		name := strings.TrimSpace(kv[0])
+		cols, err := fields(NetDevFile, kv[1], n, minNetDevFields)
+		if err != nil {
+			return err
+		}
+		rxBytes, err := strconv.ParseUint(cols[0], 10, 64)
+		if err != nil {
+			return &ParseError{File: NetDevFile, Line: n, Msg: fmt.Sprintf("invalid rxBytes of %s: %q", name, cols[0])}
+		}
+		txBytes, err := strconv.ParseUint(cols[8], 10, 64)
+		if err != nil {
+			return &ParseError{File: NetDevFile, Line: n, Msg: fmt.Sprintf("invalid txBytes of %s: %q", name, cols[8])}
+		}
+		networks = append(networks, network.Stats{Name: name, RxBytes: rxBytes, TxBytes: txBytes})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
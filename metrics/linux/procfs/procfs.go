@@ -0,0 +1,57 @@
+// +build linux
+
+// Package procfs parses the files in /proc read by the system metric
+// generators. The parsers take the fields by their names or positions of the
+// format of the kernel and ignore the ones appended by the newer kernels, and
+// return *ParseError if a line has too few fields. The files of the kernels
+// which the parsers are tested by are in testdata.
+package procfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ParseError is the error of parsing a file, whose Line is 0 if it is not
+// of a line.
+type ParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("failed to parse %s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("failed to parse %s at line %d: %s", e.File, e.Line, e.Msg)
+}
+
+// scanLines calls f with each line of out and its number from 1, until f
+// returns the error.
+func scanLines(file string, out []byte, f func(line string, n int) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	n := 0
+	for scanner.Scan() {
+		n++
+		if err := f(scanner.Text(), n); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &ParseError{File: file, Msg: err.Error()}
+	}
+	return nil
+}
+
+// fields splits line into the fields, and returns the error if they are fewer
+// than min.
+func fields(file, line string, n, min int) ([]string, error) {
+	fs := strings.Fields(line)
+	if len(fs) < min {
+		return nil, &ParseError{File: file, Line: n, Msg: fmt.Sprintf("%d fields but at least %d are expected: %q", len(fs), min, strings.TrimSpace(line))}
+	}
+	return fs, nil
+}
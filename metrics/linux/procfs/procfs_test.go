@@ -0,0 +1,269 @@
+// +build linux
+
+package procfs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+	"github.com/mackerelio/go-osstat/network"
+)
+
+func TestParseStat(t *testing.T) {
+	out := []byte(`cpu  4705 356 584 3699 23 23 0 0 0 0
+cpu0 1393280 32966 572056 13343292 6130 0 17875 0 23933 0
+cpu1 1335382 31787 565963 13766384 3770 0 1234 0 22004 0
+intr 33701434 178 ...
+ctxt 123456
+`)
+	stats, err := ParseStat(out)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expect := cpu.Stats{
+		User: 4705, Nice: 356, System: 584, Idle: 3699, Iowait: 23, Irq: 23,
+		Total: 9390, CPUCount: 2, StatCount: 10,
+	}
+	if *stats != expect {
+		t.Errorf("ParseStat should return %+v but got %+v", expect, *stats)
+	}
+
+	if _, err := ParseStat([]byte("cpu  4705 x 584\n")); err == nil {
+		t.Error("ParseStat should raise error for the invalid values")
+	}
+	if _, err := ParseStat(nil); err == nil {
+		t.Error("ParseStat should raise error for the empty file")
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	out := []byte(`MemTotal:        1929620 kB
+MemFree:          113720 kB
+MemAvailable:    1018432 kB
+Buffers:           27588 kB
+Cached:           897700 kB
+SwapCached:            0 kB
+Active:           654032 kB
+Inactive:         997888 kB
+SwapTotal:       2097148 kB
+SwapFree:        2097148 kB
+`)
+	stats, err := ParseMeminfo(out)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expect := memory.Stats{
+		Total: 1929620 * 1024, Used: (1929620 - 1018432) * 1024, Buffers: 27588 * 1024, Cached: 897700 * 1024,
+		Free: 113720 * 1024, Available: 1018432 * 1024, Active: 654032 * 1024, Inactive: 997888 * 1024,
+		SwapTotal: 2097148 * 1024, SwapFree: 2097148 * 1024, MemAvailableEnabled: true,
+	}
+	if *stats != expect {
+		t.Errorf("ParseMeminfo should return %+v but got %+v", expect, *stats)
+	}
+}
+
+// The parsers should be the same as go-osstat.
+func TestParseMeminfo_GoOsstat(t *testing.T) {
+	out, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		t.Skipf("/proc/meminfo is not available: %s", err)
+	}
+	stats, err := ParseMeminfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := memory.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != expect.Total || stats.SwapTotal != expect.SwapTotal || stats.MemAvailableEnabled != expect.MemAvailableEnabled {
+		t.Errorf("ParseMeminfo should return %+v but got %+v", expect, stats)
+	}
+}
+
+// kernelFixtures are the versions of the kernels whose files are in testdata.
+var kernelFixtures = []string{"3.10", "4.19", "5.10", "6.6"}
+
+func readFixture(t *testing.T, kernel, name string) []byte {
+	t.Helper()
+	out, err := ioutil.ReadFile(filepath.Join("testdata", kernel, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestParseStat_kernels(t *testing.T) {
+	expects := map[string]cpu.Stats{
+		"3.10": {User: 10132153, Nice: 290696, System: 3084719, Idle: 46828483, Iowait: 16683, Softirq: 25195, Total: 60377929, CPUCount: 2, StatCount: 10},
+		"4.19": {User: 2255, Nice: 34, System: 2290, Idle: 22625563, Iowait: 6290, Irq: 127, Softirq: 456, Total: 22637015, CPUCount: 2, StatCount: 10},
+		"5.10": {User: 1393280, Nice: 32966, System: 572056, Idle: 13343292, Iowait: 6130, Softirq: 17875, Steal: 120, Guest: 23933, GuestNice: 11, Total: 15365719, CPUCount: 2, StatCount: 10},
+		"6.6":  {User: 84755, Nice: 210, System: 26436, Idle: 6158260, Iowait: 2413, Softirq: 1490, Steal: 3, Total: 6273567, CPUCount: 4, StatCount: 10},
+	}
+	for _, kernel := range kernelFixtures {
+		stats, err := ParseStat(readFixture(t, kernel, "stat"))
+		if err != nil {
+			t.Errorf("Linux %s: should not raise error: %s", kernel, err)
+			continue
+		}
+		if expect := expects[kernel]; *stats != expect {
+			t.Errorf("Linux %s: ParseStat should return %+v but got %+v", kernel, expect, *stats)
+		}
+	}
+}
+
+func TestParseStat_columns(t *testing.T) {
+	// the columns after guest_nice are ignored
+	stats, err := ParseStat([]byte("cpu  10 20 30 40 50 60 70 80 0 0 90 100\ncpu0 10 20 30 40 50 60 70 80 0 0 90 100\n"))
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expect := cpu.Stats{User: 10, Nice: 20, System: 30, Idle: 40, Iowait: 50, Irq: 60, Softirq: 70, Steal: 80, Total: 360, CPUCount: 1, StatCount: 10}
+	if *stats != expect {
+		t.Errorf("ParseStat should return %+v but got %+v", expect, *stats)
+	}
+
+	_, err = ParseStat([]byte("cpu  10 20 30\ncpu0 10 20 30\n"))
+	if err == nil || err.Error() != `failed to parse /proc/stat at line 1: 4 fields but at least 5 are expected: "cpu  10 20 30"` {
+		t.Errorf("ParseStat should raise error for the too few columns but got %v", err)
+	}
+	if _, err := ParseStat([]byte("intr 1 2 3\n")); err == nil {
+		t.Error("ParseStat should raise error without the cpu line")
+	}
+}
+
+func TestParseMeminfo_kernels(t *testing.T) {
+	for _, kernel := range kernelFixtures {
+		stats, err := ParseMeminfo(readFixture(t, kernel, "meminfo"))
+		if err != nil {
+			t.Errorf("Linux %s: should not raise error: %s", kernel, err)
+			continue
+		}
+		// MemAvailable is since Linux 3.14
+		expect := memory.Stats{
+			Total: 1929620 * 1024, Used: (1929620 - 1018432) * 1024, Buffers: 27588 * 1024, Cached: 897700 * 1024,
+			Free: 113720 * 1024, Available: 1018432 * 1024, Active: 654032 * 1024, Inactive: 997888 * 1024,
+			SwapTotal: 2097148 * 1024, SwapFree: 2097148 * 1024, MemAvailableEnabled: true,
+		}
+		if kernel == "3.10" {
+			expect.Used = (1929620 - 113720 - 27588 - 897700) * 1024
+			expect.Available = 0
+			expect.MemAvailableEnabled = false
+		}
+		if *stats != expect {
+			t.Errorf("Linux %s: ParseMeminfo should return %+v but got %+v", kernel, expect, *stats)
+		}
+	}
+
+	if _, err := ParseMeminfo([]byte("MemTotal:        x kB\n")); err == nil {
+		t.Error("ParseMeminfo should raise error for the invalid values")
+	}
+	if _, err := ParseMeminfo([]byte("HugePages_Total:       0\n")); err == nil {
+		t.Error("ParseMeminfo should raise error without MemTotal")
+	}
+}
+
+func TestParseDiskstats_kernels(t *testing.T) {
+	sda := DiskStats{
+		Name: "sda", Reads: 750193, ReadsMerged: 3037, SectorsRead: 28116978, ReadTime: 368712,
+		Writes: 16600606, WritesMerged: 7233846, SectorsWritten: 424712632, WriteTime: 23987908,
+		IOTime: 2355636, IOTimeWeighted: 24345740,
+	}
+	nvme := DiskStats{
+		Name: "nvme0n1", Reads: 136409, ReadsMerged: 2248, SectorsRead: 9325326, ReadTime: 39690,
+		Writes: 714291, WritesMerged: 447624, SectorsWritten: 35062498, WriteTime: 1048031,
+		IOTime: 478840, IOTimeWeighted: 1119388,
+	}
+	expects := map[string]struct {
+		first   DiskStats
+		devices []string
+	}{
+		// 11 statistics
+		"3.10": {sda, []string{"sda", "sda1", "loop0", "dm-0"}},
+		// followed by 4 of the discards
+		"4.19": {sda, []string{"sda", "sda1", "loop0", "dm-0"}},
+		// followed by 2 of the flushes
+		"5.10": {sda, []string{"sda", "sda1", "loop0", "dm-0"}},
+		"6.6":  {nvme, []string{"nvme0n1", "nvme0n1p1", "loop0"}},
+	}
+	for _, kernel := range kernelFixtures {
+		disks, err := ParseDiskstats(readFixture(t, kernel, "diskstats"))
+		if err != nil {
+			t.Errorf("Linux %s: should not raise error: %s", kernel, err)
+			continue
+		}
+		expect := expects[kernel]
+		var devices []string
+		for _, d := range disks {
+			devices = append(devices, d.Name)
+		}
+		if !reflect.DeepEqual(devices, expect.devices) {
+			t.Errorf("Linux %s: ParseDiskstats should return %v but got %v", kernel, expect.devices, devices)
+		}
+		if len(disks) > 0 && disks[0] != expect.first {
+			t.Errorf("Linux %s: ParseDiskstats should return %+v but got %+v", kernel, expect.first, disks[0])
+		}
+	}
+}
+
+func TestParseDiskstats_columns(t *testing.T) {
+	out := []byte(`   8       0 sda 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20
+
+   8       1 sda1 1 2 3 4 5 6 7 8 9 10 11
+`)
+	disks, err := ParseDiskstats(out)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(disks) != 2 || disks[0].IOTimeWeighted != 11 || disks[1].IOTimeWeighted != 11 {
+		t.Errorf("ParseDiskstats should ignore the extra columns but got %+v", disks)
+	}
+
+	_, err = ParseDiskstats([]byte("   8       0 sda 1 2 3 4 5 6 7 8 9 10 11\n   3       1 hda1 35486 38030 38030 38030\n"))
+	if err == nil || err.Error() != `failed to parse /proc/diskstats at line 2: 7 fields but at least 14 are expected: "3       1 hda1 35486 38030 38030 38030"` {
+		t.Errorf("ParseDiskstats should raise error for the too few columns but got %v", err)
+	}
+	if _, err := ParseDiskstats([]byte("   8       0 sda 1 2 3 4 5 6 7 8 x 10 11\n")); err == nil {
+		t.Error("ParseDiskstats should raise error for the invalid values")
+	}
+}
+
+func TestParseNetDev_kernels(t *testing.T) {
+	lo := network.Stats{Name: "lo", RxBytes: 1234567, TxBytes: 1234567}
+	expects := map[string][]network.Stats{
+		"3.10": {lo, {Name: "eth0", RxBytes: 98765432, TxBytes: 12345678}},
+		"4.19": {lo, {Name: "eth0", RxBytes: 98765432, TxBytes: 12345678}, {Name: "docker0"}},
+		"5.10": {lo, {Name: "ens5", RxBytes: 3717282465, TxBytes: 531869475}},
+		"6.6":  {lo, {Name: "enp0s31f6", RxBytes: 3717282465, TxBytes: 531869475}, {Name: "wlp0s20f3"}},
+	}
+	for _, kernel := range kernelFixtures {
+		networks, err := ParseNetDev(readFixture(t, kernel, "net_dev"))
+		if err != nil {
+			t.Errorf("Linux %s: should not raise error: %s", kernel, err)
+			continue
+		}
+		if expect := expects[kernel]; !reflect.DeepEqual(networks, expect) {
+			t.Errorf("Linux %s: ParseNetDev should return %+v but got %+v", kernel, expect, networks)
+		}
+	}
+}
+
+func TestParseNetDev_columns(t *testing.T) {
+	networks, err := ParseNetDev([]byte("  eth0: 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18\n"))
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expect := []network.Stats{{Name: "eth0", RxBytes: 1, TxBytes: 9}}
+	if !reflect.DeepEqual(networks, expect) {
+		t.Errorf("ParseNetDev should return %+v but got %+v", expect, networks)
+	}
+
+	_, err = ParseNetDev([]byte("  eth0: 1 2 3 4 5 6 7 8 9\n"))
+	if err == nil || err.Error() != `failed to parse /proc/net/dev at line 1: 9 fields but at least 16 are expected: "1 2 3 4 5 6 7 8 9"` {
+		t.Errorf("ParseNetDev should raise error for the too few columns but got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+// +build linux
+
+package procfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mackerelio/go-osstat/cpu"
+)
+
+// StatFile is the file parsed by ParseStat.
+const StatFile = "/proc/stat"
+
+// minCPUFields are the fields of the cpu line of /proc/stat, which are
+// "cpu", user, nice, system and idle followed by iowait, irq, softirq (2.6),
+// steal (2.6.11), guest (2.6.24) and guest_nice (2.6.33).
+const minCPUFields = 5
+
+// ParseStat parses /proc/stat as cpu.Get.
+func ParseStat(out []byte) (*cpu.Stats, error) {
+	var stats cpu.Stats
+	columns := []struct {
+		name string
+		ptr  *uint64
+	}{
+		{"user", &stats.User},
+		{"nice", &stats.Nice},
+		{"system", &stats.System},
+		{"idle", &stats.Idle},
+		{"iowait", &stats.Iowait},
+		{"irq", &stats.Irq},
+		{"softirq", &stats.Softirq},
+		{"steal", &stats.Steal},
+		{"guest", &stats.Guest},
+		{"guest_nice", &stats.GuestNice},
+	}
+
+	found := false
+	err := scanLines(StatFile, out, func(line string, n int) error {
+		if !strings.HasPrefix(line, "cpu") {
+			return nil
+		}
+		if len(line) > 3 && unicode.IsDigit(rune(line[3])) {
+			stats.CPUCount++
+			return nil
+		}
+		if found || !strings.HasPrefix(line, "cpu ") {
+			return nil
+		}
+		found = true
+		valStrs, err := fields(StatFile, line, n, minCPUFields)
+		if err != nil {
+			return err
+		}
+		valStrs = valStrs[1:]
+		if len(valStrs) > len(columns) {
+			valStrs = valStrs[:len(columns)]
+		}
+		stats.StatCount = len(valStrs)
+		for i, valStr := range valStrs {
+			val, err := strconv.ParseUint(valStr, 10, 64)
+			if err != nil {
+				return &ParseError{File: StatFile, Line: n, Msg: fmt.Sprintf("invalid %s: %q", columns[i].name, valStr)}
+			}
+			*columns[i].ptr = val
+			stats.Total += val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &ParseError{File: StatFile, Msg: "no cpu line"}
+	}
+	// Since cpustat[CPUTIME_USER] includes cpustat[CPUTIME_GUEST], subtract the duplicated values from total.
+	// cpustat[CPUTIME_NICE] includes cpustat[CPUTIME_GUEST_NICE] as well.
+	stats.Total -= stats.Guest
+	stats.Total -= stats.GuestNice
+	return &stats, nil
+}
@@ -0,0 +1,23 @@
+// +build linux
+
+package linux
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/metrics/linux/procfs"
+)
+
+func TestSkipParseError(t *testing.T) {
+	_, err := procfs.ParseDiskstats([]byte("   8       0 sda 1 2 3\n"))
+	values, err := skipParseError(diskLogger, "disk", err)
+	if err != nil || values == nil || len(values) != 0 {
+		t.Errorf("skipParseError should return the empty values for the parse error but got %v, %v", values, err)
+	}
+
+	readErr := errors.New("open /proc/diskstats: permission denied")
+	if values, err := skipParseError(diskLogger, "disk", readErr); err != readErr || values != nil {
+		t.Errorf("skipParseError should return the other errors but got %v, %v", values, err)
+	}
+}
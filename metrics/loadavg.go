@@ -4,7 +4,7 @@ package metrics
 
 import (
 	"github.com/mackerelio/go-osstat/loadavg"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 )
 
 // loadavg
@@ -16,7 +16,7 @@ import (
 type LoadavgGenerator struct {
 }
 
-var loadavgLogger = logging.GetLogger("metrics.loadavg")
+var loadavgLogger = logformat.GetLogger("metrics.loadavg")
 
 // Generate load averages
 func (g *LoadavgGenerator) Generate() (Values, error) {
@@ -1,6 +1,10 @@
 package metrics
 
-import mkr "github.com/mackerelio/mackerel-client-go"
+import (
+	"time"
+
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
 
 // Values represents metric values
 type Values map[string]float64
@@ -42,3 +46,24 @@ type PluginGenerator interface {
 	PrepareGraphDefs() ([]*mkr.GraphDefsParam, error)
 	CustomIdentifier() *string
 }
+
+// CustomIdentifiersGenerator is implemented by the plugin generators whose
+// outputs contain the values of the other hosts, given by "customIdentifier"
+// of the records of the JSON lines protocol.
+type CustomIdentifiersGenerator interface {
+	// GenerateCustomIdentifiers returns the values of the plugin, and the ones
+	// of the other hosts by their custom identifiers.
+	GenerateCustomIdentifiers() (Values, map[string]Values, error)
+}
+
+// NamedGenerator is implemented by the generators of the metrics plugins,
+// whose PluginName is foo of [plugin.metrics.foo].
+type NamedGenerator interface {
+	PluginName() string
+}
+
+// Splayer is implemented by generators whose execution should be delayed
+// within a collection cycle to spread the load of the plugins.
+type Splayer interface {
+	Splay() time.Duration
+}
@@ -8,7 +8,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
@@ -16,7 +16,7 @@ import (
 type CPUUsageGenerator struct {
 }
 
-var cpuUsageLogger = logging.GetLogger("metrics.cpuUsage")
+var cpuUsageLogger = logformat.GetLogger("metrics.cpuUsage")
 
 var iostatFieldToMetricName = []string{"user", "nice", "system", "interrupt", "idle"}
 
@@ -0,0 +1,151 @@
+// +build netbsd
+
+package netbsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util"
+	"golang.org/x/sys/unix"
+)
+
+/*
+collect disk I/O
+
+`disk.{device}.{metric}.delta`: The increased amount of disk I/O per minute retrieved from the statistics of
+iostat(8) (sysctl hw.iostats), which are the same as the ones of Linux
+
+device = "wd0", "sd0", "ld0" and so on...
+
+metric = "reads", "writes"
+
+graph: `disk.{device}.{metric}.delta`
+*/
+
+// DiskGenerator XXX
+type DiskGenerator struct {
+	Interval      time.Duration
+	UseMountpoint bool
+	// CounterWrap is how to treat the counters decreased.
+	CounterWrap config.CounterWrap
+}
+
+var diskLogger = logformat.GetLogger("metrics.disk")
+
+// The offsets in struct io_sysctl of <sys/iostat.h>, whose fields have the
+// same sizes on all the architectures. ioSysctlSize is given to hw.iostats as
+// the size of the records to be returned, up to wbytes.
+const (
+	ioSysctlSize    = 104
+	ioSysctlNameLen = 16
+	ioSysctlType    = 20
+	ioSysctlRxfer   = 72
+	ioSysctlWxfer   = 80
+	ioStatDisk      = 0
+)
+
+// Generate XXX
+func (g *DiskGenerator) Generate() (metrics.Values, error) {
+	prevValues, err := g.collectIOStatValues()
+	if err != nil {
+		return nil, err
+	}
+
+	time.Sleep(g.Interval)
+
+	currValues, err := g.collectIOStatValues()
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, err := metrics.CounterDeltas(prevValues, currValues, g.CounterWrap)
+	if err != nil {
+		diskLogger.Warningf("Dropped the disk metrics of this cycle: %s", err)
+		return metrics.Values{}, nil
+	}
+	ret := make(map[string]float64, len(deltas))
+	for name, delta := range deltas {
+		ret[name+".delta"] = delta / g.Interval.Seconds()
+	}
+
+	return metrics.Values(ret), nil
+}
+
+func (g *DiskGenerator) collectIOStatValues() (*metrics.CounterSample, error) {
+	buf, err := unix.SysctlRaw("hw.iostats", ioSysctlSize)
+	at := time.Now()
+	if err != nil {
+		diskLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+
+	var nameMapping map[string]string
+	if g.UseMountpoint {
+		nameMapping, err = getDeviceNameMapping()
+		if err != nil {
+			diskLogger.Warningf("Failed to prepare device name mapping: %s", err)
+		}
+	}
+	values, err := parseIOStats(buf, nameMapping)
+	if err != nil {
+		diskLogger.Errorf("Failed (skip these metrics): %s", err)
+		return nil, err
+	}
+	return metrics.NewCounterSample(values, at), nil
+}
+
+// parseIOStats parses hw.iostats into the counters of the reads and the
+// writes of the disks. The tapes, the NFS mounts and the disks without any
+// I/O are skipped as Linux.
+func parseIOStats(buf []byte, mapping map[string]string) (metrics.Values, error) {
+	if len(buf)%ioSysctlSize != 0 {
+		return nil, fmt.Errorf("unexpected size of hw.iostats: %d bytes", len(buf))
+	}
+	results := make(map[string]float64)
+	for b := buf; len(b) >= ioSysctlSize; b = b[ioSysctlSize:] {
+		if int32(binary.LittleEndian.Uint32(b[ioSysctlType:])) != ioStatDisk {
+			continue
+		}
+		name := b[:ioSysctlNameLen]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		device := string(name)
+
+		reads := binary.LittleEndian.Uint64(b[ioSysctlRxfer:])
+		writes := binary.LittleEndian.Uint64(b[ioSysctlWxfer:])
+		if reads == 0 && writes == 0 {
+			continue
+		}
+		deviceLabel := util.SanitizeMetricKey(device)
+		if mountpoint, exists := mapping[device]; exists {
+			deviceLabel = util.SanitizeMetricKey(mountpoint)
+		}
+		results["disk."+deviceLabel+".reads"] = float64(reads)
+		results["disk."+deviceLabel+".writes"] = float64(writes)
+	}
+	return results, nil
+}
+
+// mapping from device name (like 'wd0a') to mountpoint (like '/tmp')
+func getDeviceNameMapping() (map[string]string, error) {
+	filesystems, err := util.CollectDfValues()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]string{}
+	for _, dfs := range filesystems {
+		name := dfs.Name
+		if device := strings.TrimPrefix(name, "/dev/"); name != device {
+			ret[device] = dfs.Mounted
+		}
+	}
+	return ret, nil
+}
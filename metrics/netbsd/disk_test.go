@@ -0,0 +1,61 @@
+// +build netbsd
+
+package netbsd
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/metrics"
+)
+
+func TestParseIOStats(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/hw.iostats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := parseIOStats(buf, nil)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	expected := metrics.Values{
+		"disk.wd0.reads":  853201,
+		"disk.wd0.writes": 2214470,
+		"disk.dk0.reads":  850000,
+		"disk.dk0.writes": 2210000,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("the disks should be parsed: %v", values)
+	}
+
+	values, err = parseIOStats(buf, map[string]string{"dk0": "/"})
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if _, ok := values["disk._.reads"]; !ok {
+		t.Errorf("the device should be named by the mountpoint: %v", values)
+	}
+
+	if _, err := parseIOStats(buf[:100], nil); err == nil {
+		t.Error("the truncated iostats should raise error")
+	}
+}
+
+func TestParseUvmexp(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/vm.uvmexp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, free, err := parseUvmexp(buf)
+	if err != nil {
+		t.Errorf("should not raise error: %v", err)
+	}
+	if total != 262144*4096 || free != (262144-1024)*4096 {
+		t.Errorf("the swap should be parsed: %f, %f", total, free)
+	}
+
+	if _, _, err := parseUvmexp(buf[:64]); err == nil {
+		t.Error("the truncated uvmexp should raise error")
+	}
+}
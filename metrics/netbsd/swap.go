@@ -0,0 +1,39 @@
+// +build netbsd
+
+package netbsd
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// The indexes of the fields in struct uvmexp_sysctl of <uvm/uvm_extern.h>,
+// which are all int64_t.
+const (
+	uvmexpPageSize  = 0
+	uvmexpSwpages   = 17
+	uvmexpSwpginuse = 18
+)
+
+// getSwap returns the total and the free bytes of the swap devices from the
+// sysctl vm.uvmexp2, which is the source of swapctl(8) -s.
+func getSwap() (float64, float64, error) {
+	buf, err := unix.SysctlRaw("vm.uvmexp2")
+	if err != nil {
+		return 0, 0, fmt.Errorf("sysctl vm.uvmexp2: %s", err)
+	}
+	return parseUvmexp(buf)
+}
+
+func parseUvmexp(buf []byte) (float64, float64, error) {
+	if len(buf) < 8*(uvmexpSwpginuse+1) {
+		return 0, 0, fmt.Errorf("unexpected size of vm.uvmexp2: %d bytes", len(buf))
+	}
+	field := func(i int) int64 {
+		return int64(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	pageSize, total, used := field(uvmexpPageSize), field(uvmexpSwpages), field(uvmexpSwpginuse)
+	return float64(total * pageSize), float64((total - used) * pageSize), nil
+}
@@ -2,14 +2,21 @@ package metrics
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/pluginstderr"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -18,6 +25,26 @@ import (
 type pluginGenerator struct {
 	Config *config.MetricPlugin
 	Meta   *pluginMeta
+	// stateDir is the directory where the names of the values are saved for
+	// on_empty = "zero".
+	stateDir string
+
+	mu sync.Mutex
+	// names are the names of the last values by the keys in the output,
+	// which are reused not to prefix the keys every time.
+	names map[string]string
+	// seenNames are the names ever output up to maxSeenNames, to warn about
+	// the steady growth of them such as the names containing the request IDs.
+	seenNames map[string]struct{}
+	// warnSeenAt is the number of seenNames to warn next, doubled by warnings.
+	warnSeenAt int
+	// warnedMillis is true once the timestamps in milliseconds are warned.
+	warnedMillis bool
+	// emptyCycles is the number of the consecutive executions without the
+	// values, and zeroNames are the names posted as 0 by on_empty = "zero".
+	emptyCycles     int
+	zeroNames       []string
+	zeroNamesLoaded bool
 }
 
 // pluginMeta is generated from plugin command. (not the configuration file)
@@ -37,23 +64,49 @@ type customGraphMetricDef struct {
 	Stacked bool
 }
 
-var pluginLogger = logging.GetLogger("metrics.plugin")
+var pluginLogger = logformat.GetLogger("metrics.plugin")
 
 const pluginPrefix = "custom."
 
 var pluginConfigurationEnvName = "MACKEREL_AGENT_PLUGIN_META"
 
+// pluginProtocolEnvName is set to the protocol of the output when it is
+// configured, so that the plugins can output in the protocol.
+var pluginProtocolEnvName = "MACKEREL_AGENT_PLUGIN_PROTOCOL"
+
+// pluginProtocolHeadlineReg matches the first line of the output of the
+// JSON lines protocol, which is detected unless the protocol is configured.
+var pluginProtocolHeadlineReg = regexp.MustCompile(`^#\s*mackerel-plugin-protocol:\s*jsonl?\s*$`)
+
 // NewPluginGenerator XXX
-func NewPluginGenerator(conf *config.MetricPlugin) PluginGenerator {
-	return &pluginGenerator{Config: conf}
+// The names of the values are saved in stateDir for on_empty = "zero", which
+// are not saved if it is "".
+func NewPluginGenerator(conf *config.MetricPlugin, stateDir string) PluginGenerator {
+	if conf.Interval > 0 {
+		g := newSampledPluginGenerator(conf)
+		g.stateDir = stateDir
+		return g
+	}
+	return &pluginGenerator{Config: conf, stateDir: stateDir}
+}
+
+func (g *pluginGenerator) String() string {
+	return fmt.Sprintf("plugin %q", g.Config.Command.CommandString())
+}
+
+// PluginName returns the name of the plugin in the configuration.
+func (g *pluginGenerator) PluginName() string {
+	return g.Config.Name
 }
 
 func (g *pluginGenerator) Generate() (Values, error) {
-	results, err := g.collectValues()
-	if err != nil {
-		return nil, err
-	}
-	return results, nil
+	results, _, err := g.collectValues()
+	return results, err
+}
+
+// GenerateCustomIdentifiers implements CustomIdentifiersGenerator.
+func (g *pluginGenerator) GenerateCustomIdentifiers() (Values, map[string]Values, error) {
+	return g.collectValues()
 }
 
 func (g *pluginGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
@@ -70,6 +123,10 @@ func (g *pluginGenerator) CustomIdentifier() *string {
 	return g.Config.CustomIdentifier
 }
 
+func (g *pluginGenerator) Splay() time.Duration {
+	return g.Config.Splay
+}
+
 var pluginMetaHeadlineReg = regexp.MustCompile(`^#\s*mackerel-agent-plugin\b(.*)`)
 
 // loadPluginMeta obtains plugin information (e.g. graph visuals, metric
@@ -123,7 +180,7 @@ var pluginMetaHeadlineReg = regexp.MustCompile(`^#\s*mackerel-agent-plugin\b(.*)
 func (g *pluginGenerator) loadPluginMeta() error {
 	// Set environment variable to make the plugin command generate its configuration
 	pluginMetaEnv := pluginConfigurationEnvName + "=1"
-	stdout, stderr, exitCode, err := g.Config.Command.RunWithEnv([]string{pluginMetaEnv})
+	stdout, stderr, exitCode, err := g.Config.Command.RunWithEnv(g.env(pluginMetaEnv))
 	if err != nil {
 		return fmt.Errorf("running %s failed: %s, exit=%d stderr=%q", g.Config.Command.CommandString(), err, exitCode, stderr)
 	}
@@ -142,7 +199,14 @@ func (g *pluginGenerator) loadPluginMeta() error {
 
 	m := pluginMetaHeadlineReg.FindStringSubmatch(headerLine)
 	if m == nil {
-		return fmt.Errorf("bad format of first line: %q", headerLine)
+		// The plugins of the JSON lines protocol may output the meta inline.
+		if g.protocol(headerLine) == config.PluginProtocolJSONL {
+			if meta := findInlinePluginMeta(stdout); meta != nil {
+				g.Meta = meta
+				return nil
+			}
+		}
+		return noPluginMetaError(headerLine)
 	}
 
 	for _, field := range strings.Fields(m[1]) {
@@ -178,6 +242,14 @@ func (g *pluginGenerator) loadPluginMeta() error {
 	return nil
 }
 
+// noPluginMetaError is the error of the output without the meta, which means
+// the plugin has no graph definitions unless it is a failure of the command.
+type noPluginMetaError string
+
+func (e noPluginMetaError) Error() string {
+	return fmt.Sprintf("bad format of first line: %q", string(e))
+}
+
 func (g *pluginGenerator) makeGraphDefsParam() []*mkr.GraphDefsParam {
 	return makeGraphDefsParam(g.Meta)
 }
@@ -213,45 +285,491 @@ func makeGraphDefsParam(meta *pluginMeta) []*mkr.GraphDefsParam {
 	return payloads
 }
 
-func (g *pluginGenerator) collectValues() (Values, error) {
-	pluginMetaEnv := pluginConfigurationEnvName + "="
-	stdout, stderr, _, err := g.Config.Command.RunWithEnv([]string{pluginMetaEnv})
+// ErrPluginThrottled is the error of the metrics plugins whose executions are
+// backed off by the breaker, which is not logged as a failure.
+var ErrPluginThrottled = errors.New("the plugin is backed off by the consecutive failures")
+
+// PluginExitError is the error of the metrics plugin which exited with non-zero.
+// It is returned with the values output by the plugin, which are still posted.
+type PluginExitError struct {
+	ExitCode int
+}
+
+func (e *PluginExitError) Error() string {
+	return fmt.Sprintf("exited with %d", e.ExitCode)
+}
 
-	if stderr != "" {
-		pluginLogger.Infof("command %s outputted to STDERR: %q", g.Config.Command.CommandString(), stderr)
+// collectValues returns the values of the plugin, and the ones of the other
+// hosts by the custom identifiers of the records. The executions which fail,
+// or exit with non-zero without the values, are recorded to the breaker.
+// The execution exiting with non-zero returns *PluginExitError with the values.
+func (g *pluginGenerator) collectValues() (Values, map[string]Values, error) {
+	breaker := g.Config.Breaker
+	if !breaker.Allow(time.Now()) {
+		return nil, nil, ErrPluginThrottled
 	}
+	p := g.newValuesParser()
+	_, exitCode, err := g.runValues(p)
 	if err != nil {
-		pluginLogger.Errorf("Failed to execute command %s (skip these metrics):\n", g.Config.Command.CommandString())
-		return nil, err
+		breaker.Record(true, time.Now())
+		return nil, nil, err
+	}
+	values := p.finish()
+	breaker.Record(exitCode != 0 && len(values) == 0 && len(p.hosts) == 0, time.Now())
+	if exitCode != 0 {
+		err = &PluginExitError{ExitCode: exitCode}
 	}
+	return g.handleEmpty(values, p.hosts), p.hosts, err
+}
 
-	results := make(map[string]float64, 0)
-	for _, line := range strings.Split(stdout, "\n") {
-		// Key, value, timestamp
-		// ex.) tcp.CLOSING 0 1397031808
-		items := strings.Fields(line)
-		if len(items) < 3 {
-			continue
+// runValues runs the command writing the output to p, and returns the stderr
+// and the exit code.
+func (g *pluginGenerator) runValues(p *pluginValuesParser) (string, int, error) {
+	pluginMetaEnv := pluginConfigurationEnvName + "="
+	stderr, exitCode, err := g.Config.Command.StreamWithEnv(g.env(pluginMetaEnv), p)
+
+	pluginstderr.Log(pluginLogger, (*logformat.Logger).Infof, "metrics."+g.Config.Name, stderr)
+	if err != nil {
+		pluginLogger.Errorf("Failed to execute command %s (skip these metrics): %s", g.Config.Command.CommandString(), err)
+		return stderr, exitCode, err
+	}
+	return stderr, exitCode, nil
+}
+
+// parseValues parses the output of the command. The values are allocated by
+// the size of the last output, whose names are reused.
+func (g *pluginGenerator) parseValues(stdout string) Values {
+	p := g.newValuesParser()
+	p.parseLines(stdout)
+	return p.finish()
+}
+
+// pluginValuesParser parses the output of the command line by line as it is
+// written, so that the whole output is never buffered.
+type pluginValuesParser struct {
+	g         *pluginGenerator
+	parseLine func(string) (string, float64, int64, string, bool)
+	protocol  config.PluginProtocol
+	// partial is the last line which is not terminated yet.
+	partial []byte
+	// prefix is prepended to the keys in the output for the names
+	prefix  string
+	results Values
+	// hosts are the values of the records with the custom identifiers other
+	// than the one of the plugin.
+	hosts map[string]Values
+	// lastNames are the names of the last output, and names are of this one.
+	lastNames map[string]string
+	names     map[string]string
+	// the numbers of the invalid names replaced or rejected, and of the values
+	// dropped beyond MaxMetricNames
+	replaced, rejected, dropped int
+	invalidName                 string
+	// now is the collection time, and skewed is the number of the values
+	// dropped by the timestamps beyond TimestampWindow from it.
+	now        time.Time
+	millis     bool
+	skewed     int
+	skewedKey  string
+	skewedTime int64
+	// ignored is the number of the lines which are not the values nor the
+	// comments, such as ignoredLine.
+	ignored     int
+	ignoredLine string
+	// warnings are the warnings logged by finish.
+	warnings []string
+}
+
+// namePrefix returns the prefix of the names of the values, which is
+// "custom." for the host or the metric prefix of the service.
+func (g *pluginGenerator) namePrefix() string {
+	if g.Config.Service == "" {
+		return pluginPrefix
+	}
+	if g.Config.MetricPrefix == "" {
+		return ""
+	}
+	return g.Config.MetricPrefix + "."
+}
+
+func (g *pluginGenerator) newValuesParser() *pluginValuesParser {
+	g.mu.Lock()
+	lastNames := g.names
+	g.mu.Unlock()
+	return &pluginValuesParser{
+		g:         g,
+		prefix:    g.namePrefix(),
+		results:   make(Values, len(lastNames)),
+		lastNames: lastNames,
+		names:     make(map[string]string, len(lastNames)),
+		now:       time.Now(),
+	}
+}
+
+// Write parses the lines terminated in b, and keeps the rest.
+func (p *pluginValuesParser) Write(b []byte) (int, error) {
+	n := len(b)
+	if len(p.partial) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.partial = append(p.partial, b...)
+			return n, nil
 		}
+		p.partial = append(p.partial, b[:i+1]...)
+		p.parseLines(string(p.partial))
+		p.partial = p.partial[:0]
+		b = b[i+1:]
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		// the lines are converted at once to reduce the allocations
+		p.parseLines(string(b[:i+1]))
+		b = b[i+1:]
+	}
+	p.partial = append(p.partial, b...)
+	return n, nil
+}
 
-		key := items[0]
+func (p *pluginValuesParser) parseLines(s string) {
+	for rest := s; rest != ""; {
+		line := rest
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			line, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		p.parse(line)
+	}
+}
 
-		if g.Config.IncludePattern != nil && !g.Config.IncludePattern.MatchString(key) {
-			continue
+func (p *pluginValuesParser) parse(line string) {
+	g := p.g
+	if p.parseLine == nil {
+		p.protocol = g.protocol(line)
+		p.parseLine = parsePluginTextLine
+		if p.protocol == config.PluginProtocolJSONL {
+			p.parseLine = parsePluginJSONLine
+		}
+	}
+	key, value, timestamp, customIdentifier, ok := p.parseLine(line)
+	if !ok {
+		if l := strings.TrimSpace(line); l != "" && !strings.HasPrefix(l, "#") && !isPluginMetaRecord(l) {
+			if p.ignored == 0 {
+				p.ignoredLine = l
+			}
+			p.ignored++
 		}
+		return
+	}
 
-		if g.Config.ExcludePattern != nil && g.Config.ExcludePattern.MatchString(key) {
-			continue
+	if g.Config.IncludePattern != nil && !g.Config.IncludePattern.MatchString(key) {
+		return
+	}
+
+	if g.Config.ExcludePattern != nil && g.Config.ExcludePattern.MatchString(key) {
+		return
+	}
+
+	if !p.validTimestamp(key, timestamp) {
+		return
+	}
+
+	name, ok := p.lastNames[key]
+	if !ok {
+		if name, ok = p.names[key]; !ok {
+			if i := invalidMetricNameIndex(key); i >= 0 {
+				p.invalidName = key
+				if g.Config.InvalidMetricNames == config.InvalidMetricNamesReject {
+					p.rejected++
+					return
+				}
+				p.replaced++
+				name = p.prefix + sanitizeMetricName(key, i)
+			} else {
+				name = p.prefix + key
+			}
+		}
+	}
+	if max := g.Config.MaxMetricNames; max > 0 && len(p.names) >= max {
+		if _, ok := p.names[key]; !ok {
+			p.dropped++
+			return
+		}
+	}
+	// the key is sliced from the name not to retain the output
+	if k := name[len(p.prefix):]; k == key {
+		key = k
+	} else {
+		key = string([]byte(key))
+	}
+	p.names[key] = name
+	if customIdentifier == "" || (g.Config.CustomIdentifier != nil && customIdentifier == *g.Config.CustomIdentifier) {
+		p.results[name] = value
+		return
+	}
+	if p.hosts == nil {
+		p.hosts = make(map[string]Values)
+	}
+	values, ok := p.hosts[customIdentifier]
+	if !ok {
+		values = make(Values)
+		p.hosts[customIdentifier] = values
+	}
+	values[name] = value
+}
+
+// millisecondTimestamp is the minimum timestamp regarded as in milliseconds,
+// which is in 1973 in milliseconds and in 5138 in seconds.
+const millisecondTimestamp = 1e11
+
+// validTimestamp reports whether the value of key at timestamp is within
+// TimestampWindow from the collection time. The timestamps in milliseconds
+// are converted to seconds, and zero means the collection time. The values
+// are posted at the collection time anyway.
+func (p *pluginValuesParser) validTimestamp(key string, timestamp int64) bool {
+	if timestamp == 0 {
+		return true
+	}
+	if timestamp >= millisecondTimestamp {
+		timestamp /= 1000
+		p.millis = true
+	}
+	window := int64(p.g.Config.TimestampWindow / time.Second)
+	if window <= 0 {
+		return true
+	}
+	if d := timestamp - p.now.Unix(); d > window || d < -window {
+		if p.skewed == 0 {
+			p.skewedKey, p.skewedTime = key, timestamp
 		}
+		p.skewed++
+		return false
+	}
+	return true
+}
 
-		value, err := strconv.ParseFloat(items[1], 64)
-		if err != nil {
-			pluginLogger.Warningf("Failed to parse values: %s", err)
-			continue
+// finish parses the last line and returns the values. The names are kept
+// for the next output.
+func (p *pluginValuesParser) finish() Values {
+	if len(p.partial) > 0 {
+		p.parseLines(string(p.partial))
+		p.partial = nil
+	}
+	g := p.g
+	key := "metrics." + g.Config.Name
+	if p.replaced > 0 {
+		p.warn(pluginLogger.Warningf, "plugin %s: replaced the invalid characters of %d metric names with '_', such as %q", key, p.replaced, p.invalidName)
+	}
+	if p.rejected > 0 {
+		p.warn(pluginLogger.Warningf, "plugin %s: rejected %d metric names with the invalid characters, such as %q", key, p.rejected, p.invalidName)
+	}
+	if p.dropped > 0 {
+		p.warn(pluginLogger.Errorf, "plugin %s: dropped %d values beyond %d distinct metric names (max_metric_names)", key, p.dropped, g.Config.MaxMetricNames)
+	}
+	if p.skewed > 0 {
+		p.warn(pluginLogger.Warningf, "plugin %s: dropped %d values whose timestamps differ from now by more than %s (timestamp_window), such as %q at %s", key, p.skewed, g.Config.TimestampWindow, p.skewedKey, time.Unix(p.skewedTime, 0).UTC().Format(time.RFC3339))
+	}
+	if p.ignored > 0 {
+		// logged by parseLine if they are malformed
+		p.warn(nil, "plugin %s: ignored %d lines which are not the metric values, such as %q", key, p.ignored, p.ignoredLine)
+	}
+	g.mu.Lock()
+	if p.millis {
+		logf := pluginLogger.Warningf
+		if g.warnedMillis {
+			logf = nil
+		}
+		p.warn(logf, "plugin %s: the timestamps seem to be in milliseconds, which are converted to seconds. They should be in seconds", key)
+		g.warnedMillis = true
+	}
+	g.names = p.names
+	g.trackNames(p.names)
+	g.mu.Unlock()
+	return p.results
+}
+
+// warn adds the warning, which is logged by logf unless it is nil.
+func (p *pluginValuesParser) warn(logf func(string, ...interface{}), format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	p.warnings = append(p.warnings, msg)
+	if logf != nil {
+		logf("%s", msg)
+	}
+}
+
+// minWarnSeenNames is the minimum number of the distinct names ever output to
+// warn about the growth of them.
+const minWarnSeenNames = 100
+
+// maxSeenNames returns the maximum number of the names tracked by trackNames.
+func (g *pluginGenerator) maxSeenNames() int {
+	if g.Config.MaxMetricNames > 0 {
+		return 10 * g.Config.MaxMetricNames
+	}
+	return 10 * config.DefaultMaxMetricNames
+}
+
+// trackNames adds the names of an output to seenNames, and warns if they have
+// grown to twice the names of the first output, and every time they double.
+func (g *pluginGenerator) trackNames(names map[string]string) {
+	if g.seenNames == nil {
+		g.seenNames = make(map[string]struct{}, len(names))
+	}
+	limit := g.maxSeenNames()
+	for k := range names {
+		if len(g.seenNames) >= limit {
+			break
+		}
+		g.seenNames[k] = struct{}{}
+	}
+	if g.warnSeenAt == 0 {
+		g.warnSeenAt = 2 * len(names)
+		if g.warnSeenAt < minWarnSeenNames {
+			g.warnSeenAt = minWarnSeenNames
+		}
+		return
+	}
+	if len(g.seenNames) >= g.warnSeenAt {
+		pluginLogger.Warningf("plugin metrics.%s has output %d distinct metric names in total while %d in the last output. The names may contain the unique values such as the request IDs", g.Config.Name, len(g.seenNames), len(names))
+		g.warnSeenAt *= 2
+	}
+}
+
+// invalidMetricNameIndex returns the index of the first character which is
+// not allowed in the metric names, or -1 if the name is valid.
+func invalidMetricNameIndex(name string) int {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return i
+		}
+	}
+	return -1
+}
+
+// sanitizeMetricName replaces the invalid characters from i with '_'.
+func sanitizeMetricName(name string, i int) string {
+	b := []byte(name[:i])
+	for _, r := range name[i:] {
+		if r < utf8.RuneSelf && invalidMetricNameIndex(string(r)) < 0 {
+			b = append(b, byte(r))
+		} else {
+			b = append(b, '_')
+		}
+	}
+	return string(b)
+}
+
+func (g *pluginGenerator) env(metaEnv string) []string {
+	env := []string{metaEnv}
+	if g.Config.Protocol == config.PluginProtocolJSONL {
+		env = append(env, pluginProtocolEnvName+"="+string(config.PluginProtocolJSONL))
+	}
+	return env
+}
+
+// protocol returns the protocol of the output starting with firstLine.
+func (g *pluginGenerator) protocol(firstLine string) config.PluginProtocol {
+	if g.Config.Protocol != config.PluginProtocolAuto {
+		return g.Config.Protocol
+	}
+	if pluginProtocolHeadlineReg.MatchString(strings.TrimSpace(firstLine)) {
+		return config.PluginProtocolJSONL
+	}
+	return config.PluginProtocolText
+}
+
+func parsePluginTextLine(line string) (string, float64, int64, string, bool) {
+	// Key, value, timestamp
+	// ex.) tcp.CLOSING 0 1397031808
+	key, v, t, ok := pluginTextFields(line)
+	if !ok {
+		return "", 0, 0, "", false
+	}
+
+	value, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		pluginLogger.Warningf("Failed to parse values: %s", err)
+		return "", 0, 0, "", false
+	}
+	// the invalid timestamps are regarded as the collection time
+	timestamp, _ := strconv.ParseFloat(t, 64)
+	return key, value, int64(timestamp), "", true
+}
+
+// pluginTextFields returns the first three fields of line split as
+// strings.Fields, and whether line has three fields or more, without
+// allocating the fields.
+func pluginTextFields(line string) (string, string, string, bool) {
+	var fields [3]string
+	for i := 0; i < len(fields); i++ {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return "", "", "", false
 		}
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			end = len(line)
+		}
+		fields[i], line = line[:end], line[end:]
+	}
+	return fields[0], fields[1], fields[2], true
+}
+
+// pluginJSONRecord is a line of the JSON lines protocol, which is either
+// a metric value or the inline meta. The time is validated as the timestamps
+// of the text protocol, and zero or missing means the collection time. The
+// value of the customIdentifier is posted to the host of it instead.
+type pluginJSONRecord struct {
+	Name             string      `json:"name"`
+	Value            *float64    `json:"value"`
+	Time             int64       `json:"time"`
+	CustomIdentifier string      `json:"customIdentifier"`
+	Meta             *pluginMeta `json:"meta"`
+}
 
-		results[pluginPrefix+key] = value
+func parsePluginJSONLine(line string) (string, float64, int64, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", 0, 0, "", false
 	}
+	var r pluginJSONRecord
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		pluginLogger.Warningf("Failed to parse the line %q: %s", line, err)
+		return "", 0, 0, "", false
+	}
+	if r.Meta != nil {
+		return "", 0, 0, "", false
+	}
+	if r.Name == "" || r.Value == nil {
+		pluginLogger.Warningf("The line %q should have the name and the value", line)
+		return "", 0, 0, "", false
+	}
+	return r.Name, *r.Value, r.Time, r.CustomIdentifier, true
+}
 
-	return results, nil
+// isPluginMetaRecord reports whether line is the inline meta of the JSON lines
+// protocol, which is not a value.
+func isPluginMetaRecord(line string) bool {
+	if !strings.HasPrefix(line, "{") {
+		return false
+	}
+	var r struct {
+		Meta json.RawMessage `json:"meta"`
+	}
+	return json.Unmarshal([]byte(line), &r) == nil && r.Meta != nil
+}
+
+// findInlinePluginMeta returns the meta of the first meta record in the
+// output of the JSON lines protocol, if any.
+func findInlinePluginMeta(stdout string) *pluginMeta {
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var r pluginJSONRecord
+		if err := json.Unmarshal([]byte(line), &r); err == nil && r.Meta != nil {
+			return r.Meta
+		}
+	}
+	return nil
 }
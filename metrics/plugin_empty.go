@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+// emptyState is the state of a metrics plugin for on_empty = "zero", which is
+// saved not to lose the names of the values by the restarts.
+type emptyState struct {
+	Names []string `json:"names"`
+}
+
+// emptyStateFile returns the file to save the names of the values of the last
+// output with the values.
+func (g *pluginGenerator) emptyStateFile() string {
+	if g.stateDir == "" {
+		return ""
+	}
+	return filepath.Join(g.stateDir, "metrics", "plugin-"+util.SanitizeMetricKey(g.Config.Name)+".json")
+}
+
+// handleEmpty treats the values of an execution by on_empty. The names of the
+// values are remembered for OnEmptyZero, which are returned with 0 when the
+// values are empty.
+func (g *pluginGenerator) handleEmpty(values Values, hosts map[string]Values) Values {
+	onEmpty := g.Config.OnEmpty
+	if onEmpty == "" || onEmpty == config.OnEmptyIgnore {
+		return values
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(values) > 0 || len(hosts) > 0 {
+		g.emptyCycles = 0
+		if onEmpty == config.OnEmptyZero && len(values) > 0 {
+			g.rememberNames(values)
+		}
+		return values
+	}
+	g.emptyCycles++
+	key := "metrics." + g.Config.Name
+	switch onEmpty {
+	case config.OnEmptyWarn:
+		cycles := g.Config.EmptyCycles
+		if cycles <= 0 {
+			cycles = config.DefaultEmptyCycles
+		}
+		if g.emptyCycles%cycles == 0 {
+			pluginLogger.Warningf("plugin %s output no values for %d consecutive executions", key, g.emptyCycles)
+			pluginstats.RecordEmpty(key)
+		}
+	case config.OnEmptyZero:
+		names := g.loadZeroNames()
+		if len(names) == 0 {
+			return values
+		}
+		pluginLogger.Debugf("plugin %s output no values, which are posted as 0 for %d names", key, len(names))
+		zeros := make(Values, len(names))
+		for _, name := range names {
+			zeros[name] = 0
+		}
+		return zeros
+	}
+	return values
+}
+
+// maxZeroNames returns the maximum number of the names remembered for
+// OnEmptyZero, which are the ones posted in an output.
+func (g *pluginGenerator) maxZeroNames() int {
+	if g.Config.MaxMetricNames > 0 {
+		return g.Config.MaxMetricNames
+	}
+	return config.DefaultMaxMetricNames
+}
+
+// rememberNames remembers the names of values up to maxZeroNames, and saves
+// them if they are changed.
+func (g *pluginGenerator) rememberNames(values Values) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if max := g.maxZeroNames(); len(names) > max {
+		names = names[:max]
+	}
+	if reflect.DeepEqual(names, g.loadZeroNames()) {
+		return
+	}
+	g.zeroNames = names
+	g.saveZeroNames()
+}
+
+// loadZeroNames returns the remembered names, which are loaded from the state
+// file at the first time.
+func (g *pluginGenerator) loadZeroNames() []string {
+	if g.zeroNamesLoaded {
+		return g.zeroNames
+	}
+	g.zeroNamesLoaded = true
+	file := g.emptyStateFile()
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			pluginLogger.Warningf("plugin metrics.%s failed to load the names of the values: %s", g.Config.Name, err)
+		}
+		return nil
+	}
+	var state emptyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		pluginLogger.Warningf("plugin metrics.%s failed to load the names of the values: %s", g.Config.Name, file)
+		return nil
+	}
+	if max := g.maxZeroNames(); len(state.Names) > max {
+		state.Names = state.Names[:max]
+	}
+	g.zeroNames = state.Names
+	return g.zeroNames
+}
+
+func (g *pluginGenerator) saveZeroNames() {
+	file := g.emptyStateFile()
+	if file == "" {
+		return
+	}
+	data, err := json.Marshal(emptyState{Names: g.zeroNames})
+	if err != nil {
+		pluginLogger.Warningf("plugin metrics.%s failed to save the names of the values: %s", g.Config.Name, err)
+		return
+	}
+	// renamed not to lose the names by the partial writes
+	if err := util.WriteFileAtomically(file, data, 0644); err != nil {
+		pluginLogger.Warningf("plugin metrics.%s failed to save the names of the values: %s", g.Config.Name, err)
+	}
+}
@@ -1,10 +1,19 @@
 package metrics
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"regexp"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mackerelio/mackerel-agent/cmdutil"
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -37,7 +46,7 @@ func TestPluginCollectValues(t *testing.T) {
 		Command: config.Command{Cmd: "go run ../_example/metrics-plugins/dice.go"},
 	},
 	}
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -52,7 +61,7 @@ func TestPluginCollectValuesWithIncludePattern(t *testing.T) {
 		IncludePattern: regexp.MustCompile(`^dice\.d6`),
 	},
 	}
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -70,7 +79,7 @@ func TestPluginCollectValuesWithExcludePattern(t *testing.T) {
 		ExcludePattern: regexp.MustCompile(`^dice\.d20`),
 	},
 	}
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -89,7 +98,7 @@ func TestPluginCollectValuesWithBothPattern(t *testing.T) {
 		ExcludePattern: regexp.MustCompile(`^dice\.d20`),
 	},
 	}
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -98,6 +107,213 @@ func TestPluginCollectValuesWithBothPattern(t *testing.T) {
 	}
 }
 
+func TestPluginParseValues(t *testing.T) {
+	g := &pluginGenerator{Config: &config.MetricPlugin{ExcludePattern: regexp.MustCompile(`^skip`)}}
+	stdout := "foo.a\t1\t1397031808\n  foo.b  2.5 1397031808 extra\r\nbroken 1\nskip.c\t3\t1397031808\n\u3000foo.c\u00851e3\u20281397031808"
+	expect := Values{"custom.foo.a": 1, "custom.foo.b": 2.5, "custom.foo.c": 1000}
+	for i := 0; i < 2; i++ {
+		values := g.parseValues(stdout)
+		if !reflect.DeepEqual(values, expect) {
+			t.Errorf("parseValues should return %v but got %v", expect, values)
+		}
+	}
+	if len(g.names) != 3 {
+		t.Errorf("the names of the last values should be kept: %v", g.names)
+	}
+	g.parseValues("foo.a\t1\t1397031808\n")
+	if len(g.names) != 1 {
+		t.Errorf("the names not in the last output should be dropped: %v", g.names)
+	}
+}
+
+func TestPluginParseValues_invalidNames(t *testing.T) {
+	stdout := "foo.a\t1\t1397031808\nfoo.b/c\t2\t1397031808\nfoo.d:\u3042\t3\t1397031808\n"
+	tests := []struct {
+		invalidNames config.InvalidMetricNames
+		expect       Values
+	}{
+		{config.InvalidMetricNamesReplace, Values{"custom.foo.a": 1, "custom.foo.b_c": 2, "custom.foo.d__": 3}},
+		{config.InvalidMetricNamesReject, Values{"custom.foo.a": 1}},
+	}
+	for _, tc := range tests {
+		g := &pluginGenerator{Config: &config.MetricPlugin{InvalidMetricNames: tc.invalidNames}}
+		for i := 0; i < 2; i++ {
+			if values := g.parseValues(stdout); !reflect.DeepEqual(values, tc.expect) {
+				t.Errorf("the invalid names should be %s: %v", tc.invalidNames, values)
+			}
+		}
+	}
+}
+
+func TestPluginParseValues_maxNames(t *testing.T) {
+	g := &pluginGenerator{Config: &config.MetricPlugin{MaxMetricNames: 2}}
+	stdout := "foo.a\t1\t1397031808\nfoo.b\t2\t1397031808\nfoo.c\t3\t1397031808\nfoo.a\t4\t1397031808\n"
+	expect := Values{"custom.foo.a": 4, "custom.foo.b": 2}
+	if values := g.parseValues(stdout); !reflect.DeepEqual(values, expect) {
+		t.Errorf("the values beyond the names should be dropped: %v", values)
+	}
+}
+
+func TestPluginTrackNames(t *testing.T) {
+	g := &pluginGenerator{Config: &config.MetricPlugin{MaxMetricNames: 20}}
+	for i := 0; i < 300; i++ {
+		g.parseValues(fmt.Sprintf("app.stable\t1\t1397031808\napp.req_%d\t1\t1397031808\n", i))
+	}
+	if got, expect := len(g.seenNames), 200; got != expect {
+		t.Errorf("the names should be tracked up to %d but got %d", expect, got)
+	}
+	// warned at 100 and 200 names
+	if got, expect := g.warnSeenAt, 4*minWarnSeenNames; got != expect {
+		t.Errorf("the next warning should be at %d names but got %d", expect, got)
+	}
+}
+
+func TestPluginTextFields(t *testing.T) {
+	for _, line := range []string{"", "a", "a b", "a b c", " a\tb\vc d ", "a\u00a0b\u3000c", "\xffa b\xff c", "a  b\n"} {
+		fields := strings.Fields(line)
+		key, value, timestamp, ok := pluginTextFields(line)
+		if ok != (len(fields) >= 3) {
+			t.Errorf("pluginTextFields(%q) should be %t but got %t", line, len(fields) >= 3, ok)
+			continue
+		}
+		if ok && (key != fields[0] || value != fields[1] || timestamp != fields[2]) {
+			t.Errorf("pluginTextFields(%q) should return %q, %q and %q but got %q, %q and %q", line, fields[0], fields[1], fields[2], key, value, timestamp)
+		}
+	}
+}
+
+func TestPluginParseValues_timestamps(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		stdout string
+		expect Values
+		millis bool
+	}{
+		{
+			name:   "seconds",
+			stdout: fmt.Sprintf("foo.a\t1\t%d\nfoo.b\t2\t%d\n", now, now-30*60),
+			expect: Values{"custom.foo.a": 1, "custom.foo.b": 2},
+		},
+		{
+			name:   "milliseconds",
+			stdout: fmt.Sprintf("foo.a\t1\t%d\nfoo.b\t2\t%d\n", now*1000, (now-2*60*60)*1000),
+			expect: Values{"custom.foo.a": 1},
+			millis: true,
+		},
+		{
+			name:   "far past and future",
+			stdout: fmt.Sprintf("foo.a\t1\t1397031808\nfoo.b\t2\t%d\nfoo.c\t3\t%d\n", now+2*60*60, now+60),
+			expect: Values{"custom.foo.c": 3},
+		},
+		{
+			name:   "invalid",
+			stdout: "foo.a\t1\t0\nfoo.b\t2\tnow\n",
+			expect: Values{"custom.foo.a": 1, "custom.foo.b": 2},
+		},
+		{
+			name: "JSON lines",
+			stdout: fmt.Sprintf("# mackerel-plugin-protocol: json\n"+
+				`{"name":"foo.a","value":1,"time":%d}`+"\n"+
+				`{"name":"foo.b","value":2,"time":0}`+"\n"+
+				`{"name":"foo.c","value":3}`+"\n"+
+				`{"name":"foo.d","value":4,"time":1397031808}`+"\n"+
+				`{"name":"foo.e","value":5,"time":%d}`+"\n", now, now*1000),
+			expect: Values{"custom.foo.a": 1, "custom.foo.b": 2, "custom.foo.c": 3, "custom.foo.e": 5},
+			millis: true,
+		},
+	}
+	for _, tc := range tests {
+		g := &pluginGenerator{Config: &config.MetricPlugin{TimestampWindow: time.Hour}}
+		if values := g.parseValues(tc.stdout); !reflect.DeepEqual(values, tc.expect) {
+			t.Errorf("%s: the values should be %v but got %v", tc.name, tc.expect, values)
+		}
+		if g.warnedMillis != tc.millis {
+			t.Errorf("%s: the timestamps in milliseconds should be warned: %t", tc.name, tc.millis)
+		}
+	}
+
+	// the timestamps are not checked without the window
+	g := &pluginGenerator{Config: &config.MetricPlugin{}}
+	if values := g.parseValues("foo.a\t1\t1397031808\n"); len(values) != 1 {
+		t.Errorf("the timestamps should not be checked without the window: %v", values)
+	}
+}
+
+func TestPluginParseValues_customIdentifiers(t *testing.T) {
+	self := "self.example.com"
+	g := &pluginGenerator{Config: &config.MetricPlugin{CustomIdentifier: &self}}
+	p := g.newValuesParser()
+	p.parseLines("# mackerel-plugin-protocol: json\n" +
+		`{"name":"foo.a","value":1}` + "\n" +
+		`{"name":"foo.b","value":2,"customIdentifier":"self.example.com"}` + "\n" +
+		`{"name":"foo.a","value":3,"customIdentifier":"db1.example.com"}` + "\n" +
+		`{"name":"foo.b","value":4,"customIdentifier":"db1.example.com"}` + "\n" +
+		`{"name":"foo.a","value":5,"customIdentifier":"db2.example.com"}` + "\n")
+	if values, expect := p.finish(), (Values{"custom.foo.a": 1, "custom.foo.b": 2}); !reflect.DeepEqual(values, expect) {
+		t.Errorf("the values of the plugin should be %v but got %v", expect, values)
+	}
+	expect := map[string]Values{
+		"db1.example.com": {"custom.foo.a": 3, "custom.foo.b": 4},
+		"db2.example.com": {"custom.foo.a": 5},
+	}
+	if !reflect.DeepEqual(p.hosts, expect) {
+		t.Errorf("the values of the other hosts should be %v but got %v", expect, p.hosts)
+	}
+}
+
+func TestPluginValuesParser_Write(t *testing.T) {
+	stdout := "foo.a\t1\t1397031808\nfoo.b\t2.5\t1397031808\r\nbroken 1\nfoo.c 3 1397031808"
+	expect := Values{"custom.foo.a": 1, "custom.foo.b": 2.5, "custom.foo.c": 3}
+	for size := 1; size <= len(stdout); size++ {
+		g := &pluginGenerator{Config: &config.MetricPlugin{}}
+		p := g.newValuesParser()
+		for rest := stdout; rest != ""; {
+			n := size
+			if n > len(rest) {
+				n = len(rest)
+			}
+			p.Write([]byte(rest[:n]))
+			rest = rest[n:]
+		}
+		if values := p.finish(); !reflect.DeepEqual(values, expect) {
+			t.Errorf("the output written by %d bytes should be parsed as %v but got %v", size, expect, values)
+		}
+	}
+}
+
+func TestPluginGenerate_OutputLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command depends on sh")
+	}
+	conf := &config.MetricPlugin{
+		Command: config.Command{Args: []string{"sh", "-c", "yes 'foo.a 1 1397031808'"}},
+	}
+	conf.Command.MaxStdoutBytes = 64 * 1024
+	g := &pluginGenerator{Config: conf}
+	values, err := g.Generate()
+	if _, ok := err.(*cmdutil.OutputLimitError); !ok {
+		t.Errorf("the plugin writing too much should be terminated: %v", err)
+	}
+	if values != nil {
+		t.Errorf("the values should be skipped: %v", values)
+	}
+}
+
+func BenchmarkPluginParseValues(b *testing.B) {
+	var buf strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&buf, "mysql.metric%d\t%d\t1397031808\n", i, i)
+	}
+	stdout := buf.String()
+	g := &pluginGenerator{Config: &config.MetricPlugin{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.parseValues(stdout)
+	}
+}
+
 func TestPluginMakeGraphDefsParam(t *testing.T) {
 	// this plugin emits "one.foo1", "one.foo2" and "two.bar1" metrics
 	g := &pluginGenerator{
@@ -173,3 +389,52 @@ func TestPluginMakeGraphDefsParam(t *testing.T) {
 		t.Errorf("Bat metric payload created: %+v", metricOneFoo1)
 	}
 }
+
+func TestPluginHandleEmpty_warn(t *testing.T) {
+	g := &pluginGenerator{Config: &config.MetricPlugin{Name: "empty_warn", OnEmpty: config.OnEmptyWarn, EmptyCycles: 2}}
+	for i := 0; i < 5; i++ {
+		if values := g.handleEmpty(Values{}, nil); len(values) != 0 {
+			t.Errorf("the empty values should not be filled: %v", values)
+		}
+	}
+	if s := pluginstats.All()["metrics.empty_warn"]; s.Empty != 2 {
+		t.Errorf("the failures should be counted every 2 empty executions: %+v", s)
+	}
+	g.handleEmpty(Values{"custom.foo": 1}, nil)
+	g.handleEmpty(Values{}, nil)
+	if s := pluginstats.All()["metrics.empty_warn"]; s.Empty != 2 || g.emptyCycles != 1 {
+		t.Errorf("the consecutive executions should be reset by the values: %+v, %d", s, g.emptyCycles)
+	}
+}
+
+func TestPluginHandleEmpty_zero(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-plugin-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &config.MetricPlugin{Name: "empty_zero", OnEmpty: config.OnEmptyZero, MaxMetricNames: 2}
+
+	g := &pluginGenerator{Config: conf, stateDir: dir}
+	if values := g.handleEmpty(Values{}, nil); len(values) != 0 {
+		t.Errorf("nothing should be filled before the values: %v", values)
+	}
+	g.handleEmpty(Values{"custom.a": 1, "custom.b": 2, "custom.c": 3}, nil)
+	expect := Values{"custom.a": 0, "custom.b": 0}
+	if values := g.handleEmpty(Values{}, nil); !reflect.DeepEqual(values, expect) {
+		t.Errorf("the names up to max_metric_names should be filled with 0: %v", values)
+	}
+
+	restarted := &pluginGenerator{Config: conf, stateDir: dir}
+	if values := restarted.handleEmpty(nil, nil); !reflect.DeepEqual(values, expect) {
+		t.Errorf("the names should be loaded from the state file: %v", values)
+	}
+	if values := restarted.handleEmpty(Values{}, map[string]Values{"db1": {"custom.d": 1}}); len(values) != 0 {
+		t.Errorf("the values of the other hosts should not be filled: %v", values)
+	}
+
+	ignored := &pluginGenerator{Config: &config.MetricPlugin{Name: "empty_zero", OnEmpty: config.OnEmptyIgnore}, stateDir: dir}
+	if values := ignored.handleEmpty(Values{}, nil); len(values) != 0 {
+		t.Errorf("the values should not be filled by on_empty = \"ignore\": %v", values)
+	}
+}
@@ -3,9 +3,12 @@
 package metrics
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/pluginbreaker"
 )
 
 func TestPluginCollectValuesCommand(t *testing.T) {
@@ -14,7 +17,7 @@ func TestPluginCollectValuesCommand(t *testing.T) {
 	},
 	}
 
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -38,7 +41,7 @@ func TestPluginCollectValuesCommandWithSpaces(t *testing.T) {
 		Command: config.Command{Cmd: `echo "just.echo.2   2   1397822016"`},
 	}}
 
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -57,6 +60,81 @@ func TestPluginCollectValuesCommandWithSpaces(t *testing.T) {
 	}
 }
 
+func TestPluginCollectValuesJSONLines(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cmd      string
+		protocol config.PluginProtocol
+		expected Values
+	}{
+		{
+			name:     "detected by the headline",
+			cmd:      `printf '%s\n' '# mackerel-plugin-protocol: json' '{"name":"json.a\tb","value":1.5,"time":1690000000}' '{"meta":{"graphs":{}}}' '{"name":"json.no_value"}' 'broken'`,
+			expected: Values{"custom.json.a_b": 1.5},
+		},
+		{
+			name:     "configured",
+			cmd:      `echo "{\"name\":\"json.$MACKEREL_AGENT_PLUGIN_PROTOCOL\",\"value\":2}"`,
+			protocol: config.PluginProtocolJSONL,
+			expected: Values{"custom.json.jsonl": 2},
+		},
+		{
+			name:     "text protocol overrides the headline",
+			cmd:      `printf '%s\n' '# mackerel-plugin-protocol: jsonl' 'text.a	3	1690000000'`,
+			protocol: config.PluginProtocolText,
+			expected: Values{"custom.text.a": 3},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &pluginGenerator{Config: &config.MetricPlugin{
+				Command:  config.Command{Cmd: tc.cmd},
+				Protocol: tc.protocol,
+			}}
+			values, _, err := g.collectValues()
+			if err != nil {
+				t.Fatalf("should not raise error: %v", err)
+			}
+			if !reflect.DeepEqual(values, tc.expected) {
+				t.Errorf("values should be %v but %v", tc.expected, values)
+			}
+		})
+	}
+}
+
+func TestPluginCollectValuesBreaker(t *testing.T) {
+	g := &pluginGenerator{Config: &config.MetricPlugin{
+		Name:    "breaker",
+		Command: config.Command{Cmd: "echo 'cannot connect' >&2; exit 1"},
+		Breaker: pluginbreaker.New("metrics.breaker", 1, time.Minute, time.Hour),
+	}}
+	if _, _, err := g.collectValues(); err == nil || err.(*PluginExitError).ExitCode != 1 {
+		t.Fatalf("the exit code should be returned: %v", err)
+	}
+	if _, _, err := g.collectValues(); err != ErrPluginThrottled {
+		t.Errorf("the plugin exiting with non-zero without the values should be backed off: %v", err)
+	}
+	pluginbreaker.Reset()
+	g.Config.Command.Cmd = "echo 'just.echo.1	1	1397822016'; exit 1"
+	for i := 0; i < 2; i++ {
+		if values, _, err := g.collectValues(); err == nil || len(values) != 1 {
+			t.Errorf("the plugin with the values should not be backed off: %v, %v", values, err)
+		}
+	}
+}
+
+func TestPluginLoadPluginMetaInline(t *testing.T) {
+	g := &pluginGenerator{Config: &config.MetricPlugin{
+		Command: config.Command{Cmd: `printf '%s\n' '# mackerel-plugin-protocol: jsonl' '{"meta":{"graphs":{"query":{"label":"Query","unit":"integer","metrics":[{"name":"foo","label":"Foo"}]}}}}' '{"name":"query.foo","value":1}'`},
+	}}
+	if err := g.loadPluginMeta(); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if g.Meta == nil || g.Meta.Graphs["query"].Label != "Query" || g.Meta.Graphs["query"].Metrics[0].Name != "foo" {
+		t.Errorf("the inline meta should be loaded: %+v", g.Meta)
+	}
+}
+
 func TestPluginLoadPluginMeta(t *testing.T) {
 	g := &pluginGenerator{
 		Config: &config.MetricPlugin{
@@ -137,3 +215,26 @@ func TestPluginLoadPluginMeta(t *testing.T) {
 		t.Error("should raise error")
 	}
 }
+
+func TestSampledPluginGenerator_Generate(t *testing.T) {
+	g := NewPluginGenerator(&config.MetricPlugin{
+		Command:  config.Command{Cmd: "echo \"just.echo.1\t1\t1397822016\""},
+		Interval: 50 * time.Millisecond,
+	}, "")
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if values["custom.just.echo.1"] != 1 || values["custom.just.echo.1.max"] != 1 || values["custom.just.echo.1.min"] != 1 {
+		t.Errorf("the first sample should be generated: %v", values)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	values, err = g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if values["custom.just.echo.1"] != 1 {
+		t.Errorf("the samples should be aggregated: %v", values)
+	}
+}
@@ -14,7 +14,7 @@ func TestPluginCollectValuesCommand(t *testing.T) {
 	},
 	}
 
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -38,7 +38,7 @@ func TestPluginCollectValuesCommandWithSpaces(t *testing.T) {
 		Command: config.Command{Cmd: `echo just.echo.2   2   1397822016`},
 	}}
 
-	values, err := g.collectValues()
+	values, _, err := g.collectValues()
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var prometheusLogger = logformat.GetLogger("metrics.prometheus")
+
+// prometheusBodyLimit is the maximum bytes of the metrics of an exporter.
+const prometheusBodyLimit = 10 * 1024 * 1024
+
+// prometheusGenerator scrapes a Prometheus exporter. The gauges and the
+// untyped metrics are posted as they are, and the counters are converted to
+// the rates per second. The histograms and the summaries are reduced to the
+// rates of _sum and _count. The series rendered to the same metric name by
+// the label template are summed.
+type prometheusGenerator struct {
+	Config *config.PrometheusPlugin
+	client *http.Client
+
+	mu   sync.Mutex
+	last map[string]prometheusCounter // keyed by the series
+}
+
+type prometheusCounter struct {
+	value float64
+	time  time.Time
+	epoch uint64
+}
+
+// NewPrometheusGenerator creates a generator which scrapes the exporter of conf.
+func NewPrometheusGenerator(conf *config.PrometheusPlugin) PluginGenerator {
+	return &prometheusGenerator{
+		Config: conf,
+		client: &http.Client{
+			Timeout: conf.Timeout,
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				DisableKeepAlives: true,
+			},
+		},
+		last: make(map[string]prometheusCounter),
+	}
+}
+
+func (g *prometheusGenerator) String() string {
+	return fmt.Sprintf("prometheus %q", g.Config.URL)
+}
+
+// Generate scrapes the exporter. A failure of the exporter or its malformed
+// output fails only the metrics of the exporter.
+func (g *prometheusGenerator) Generate() (Values, error) {
+	families, err := g.scrape()
+	if err != nil {
+		prometheusLogger.Errorf("Failed to scrape %s (skip these metrics): %s", g.Config.URL, err)
+		return nil, err
+	}
+	return g.convert(families, time.Now()), nil
+}
+
+// PrepareGraphDefs returns no graph definitions, since the exporters do not
+// tell how to graph the metrics.
+func (g *prometheusGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	return nil, nil
+}
+
+func (g *prometheusGenerator) CustomIdentifier() *string {
+	return g.Config.CustomIdentifier
+}
+
+func (g *prometheusGenerator) scrape() ([]*prometheusFamily, error) {
+	req, err := http.NewRequest("GET", g.Config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, prometheusBodyLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > prometheusBodyLimit {
+		return nil, fmt.Errorf("the metrics exceed %d bytes", prometheusBodyLimit)
+	}
+	return parsePrometheusText(string(body))
+}
+
+func (g *prometheusGenerator) convert(families []*prometheusFamily, now time.Time) Values {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	results := make(Values)
+	last := make(map[string]prometheusCounter)
+	epoch := clockEpoch()
+	for _, f := range families {
+		for _, s := range f.samples {
+			isRate := f.typ == "counter"
+			switch f.typ {
+			case "histogram", "summary":
+				if s.name != f.name+"_sum" && s.name != f.name+"_count" {
+					continue
+				}
+				isRate = true
+			}
+			name := g.metricName(s)
+			if g.Config.IncludePattern != nil && !g.Config.IncludePattern.MatchString(name) {
+				continue
+			}
+			if g.Config.ExcludePattern != nil && g.Config.ExcludePattern.MatchString(name) {
+				continue
+			}
+			value := s.value
+			if isRate {
+				key := s.key()
+				last[key] = prometheusCounter{value, now, epoch}
+				prev, ok := g.last[key]
+				// skip the first samples, the counters which are reset and the
+				// ones across a gap of the clock
+				if !ok || value < prev.value || !now.After(prev.time) || prev.epoch != epoch {
+					continue
+				}
+				value = (value - prev.value) / now.Sub(prev.time).Seconds()
+			}
+			results[pluginPrefix+name] += value
+		}
+	}
+	g.last = last
+	return results
+}
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// metricName returns the name of the metric of s without "custom.".
+func (g *prometheusGenerator) metricName(s *prometheusSample) string {
+	labels := make(map[string]string, len(s.labels))
+	var values []string
+	for _, l := range s.labels {
+		v := invalidMetricNameChars.ReplaceAllString(strings.Replace(l.value, ".", "_", -1), "_")
+		labels[l.name] = v
+		values = append(values, v)
+	}
+	var suffix string
+	if g.Config.LabelTemplate != nil {
+		var b strings.Builder
+		if err := g.Config.LabelTemplate.Execute(&b, labels); err != nil {
+			prometheusLogger.Warningf("Failed to render the labels of %s: %s", s.name, err)
+		}
+		suffix = b.String()
+	} else {
+		suffix = strings.Join(values, ".")
+	}
+	parts := []string{g.Config.MetricPrefix, s.name}
+	for _, p := range strings.Split(invalidMetricNameChars.ReplaceAllString(suffix, "_"), ".") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// prometheusFamily is the samples of a metric with the TYPE.
+type prometheusFamily struct {
+	name    string
+	typ     string
+	samples []*prometheusSample
+}
+
+type prometheusSample struct {
+	name   string
+	labels []prometheusLabel // sorted by the names
+	value  float64
+}
+
+type prometheusLabel struct {
+	name, value string
+}
+
+// key identifies the series of s.
+func (s *prometheusSample) key() string {
+	var b strings.Builder
+	b.WriteString(s.name)
+	for _, l := range s.labels {
+		fmt.Fprintf(&b, "\x00%s=%s", l.name, l.value)
+	}
+	return b.String()
+}
+
+// parsePrometheusText parses the text exposition format of Prometheus.
+// The samples without TYPE are untyped, and the timestamps are ignored.
+func parsePrometheusText(text string) ([]*prometheusFamily, error) {
+	var families []*prometheusFamily
+	byName := make(map[string]*prometheusFamily)
+	family := func(name string) *prometheusFamily {
+		if f, ok := byName[name]; ok {
+			return f
+		}
+		f := &prometheusFamily{name: name, typ: "untyped"}
+		byName[name] = f
+		families = append(families, f)
+		return f
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), prometheusBodyLimit)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				family(fields[2]).typ = fields[3]
+			}
+			continue
+		}
+		s, err := parsePrometheusSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		name := s.name
+		for _, suffix := range []string{"_sum", "_count", "_bucket"} {
+			base := strings.TrimSuffix(s.name, suffix)
+			if f, ok := byName[base]; ok && base != s.name && (f.typ == "histogram" || f.typ == "summary") {
+				name = base
+				break
+			}
+		}
+		f := family(name)
+		f.samples = append(f.samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+func parsePrometheusSample(line string) (*prometheusSample, error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid sample: %q", line)
+	}
+	s := &prometheusSample{name: line[:i]}
+	rest := line[i:]
+	if rest[0] == '{' {
+		var err error
+		s.labels, rest, err = parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid sample: %q", line)
+	}
+	var err error
+	s.value, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %q", s.name, fields[0])
+	}
+	return s, nil
+}
+
+// parsePrometheusLabels parses the labels following '{' and returns them with the rest of s.
+func parsePrometheusLabels(s string) ([]prometheusLabel, string, error) {
+	var labels []prometheusLabel
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].name < labels[j].name
+			})
+			return labels, s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid labels: %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		var value strings.Builder
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("unterminated label value of %s", name)
+		}
+		labels = append(labels, prometheusLabel{name, value.String()})
+		s = strings.TrimLeft(s[i+1:], " \t")
+		s = strings.TrimPrefix(s, ",")
+	}
+}
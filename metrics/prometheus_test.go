@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const testPrometheusText = `# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.5
+# TYPE node_network_receive_bytes_total counter
+node_network_receive_bytes_total{device="eth0"} %d
+node_network_receive_bytes_total{device="lo"} 100 1395066363000
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 1
+http_request_duration_seconds_bucket{le="+Inf"} 2
+http_request_duration_seconds_sum %d
+http_request_duration_seconds_count %d
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.1
+rpc_duration_seconds_sum 1
+rpc_duration_seconds_count 1
+untyped_metric{path="/a b",code="200",} 3
+`
+
+func TestParsePrometheusText(t *testing.T) {
+	families, err := parsePrometheusText(fmt.Sprintf(testPrometheusText, 1000, 5, 10))
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	types := map[string]string{}
+	numSamples := map[string]int{}
+	for _, f := range families {
+		types[f.name] = f.typ
+		numSamples[f.name] = len(f.samples)
+	}
+	expected := map[string]string{
+		"node_load1":                       "gauge",
+		"node_network_receive_bytes_total": "counter",
+		"http_request_duration_seconds":    "histogram",
+		"rpc_duration_seconds":             "summary",
+		"untyped_metric":                   "untyped",
+	}
+	if len(types) != len(expected) {
+		t.Errorf("unexpected families: %v", types)
+	}
+	for name, typ := range expected {
+		if types[name] != typ {
+			t.Errorf("the type of %s should be %s but %s", name, typ, types[name])
+		}
+	}
+	if numSamples["http_request_duration_seconds"] != 4 || numSamples["rpc_duration_seconds"] != 3 {
+		t.Errorf("the samples of the histogram and the summary should be grouped: %v", numSamples)
+	}
+	last := families[len(families)-1].samples[0]
+	if len(last.labels) != 2 || last.labels[0] != (prometheusLabel{"code", "200"}) || last.labels[1] != (prometheusLabel{"path", "/a b"}) {
+		t.Errorf("unexpected labels: %v", last.labels)
+	}
+
+	for _, text := range []string{
+		"no_value\n",
+		"bad_value abc\n",
+		`bad_labels{device=eth0} 1` + "\n",
+		`unterminated{device="eth0} 1` + "\n",
+	} {
+		if _, err := parsePrometheusText(text); err == nil {
+			t.Errorf("should raise error for %q", text)
+		}
+	}
+}
+
+func TestPrometheusGenerator_Convert(t *testing.T) {
+	g := NewPrometheusGenerator(&config.PrometheusPlugin{
+		MetricPrefix:   "node",
+		ExcludePattern: regexp.MustCompile(`\.lo$`),
+	}).(*prometheusGenerator)
+
+	now := time.Now()
+	families, _ := parsePrometheusText(fmt.Sprintf(testPrometheusText, 1000, 5, 10))
+	values := g.convert(families, now)
+	// The rates are not generated at the first scrape.
+	if len(values) != 2 || values["custom.node.node_load1"] != 0.5 || values["custom.node.untyped_metric.200._a_b"] != 3 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	families, _ = parsePrometheusText(fmt.Sprintf(testPrometheusText, 7000, 65, 70))
+	values = g.convert(families, now.Add(60*time.Second))
+	expectedRates := Values{
+		"custom.node.node_network_receive_bytes_total.eth0": 100,
+		"custom.node.http_request_duration_seconds_sum":     1,
+		"custom.node.http_request_duration_seconds_count":   1,
+		"custom.node.rpc_duration_seconds_sum":              0,
+		"custom.node.rpc_duration_seconds_count":            0,
+	}
+	for name, rate := range expectedRates {
+		if v, ok := values[name]; !ok || v != rate {
+			t.Errorf("the rate of %s should be %f but %v", name, rate, values)
+		}
+	}
+	if _, ok := values["custom.node.node_network_receive_bytes_total.lo"]; ok {
+		t.Errorf("the excluded metric should not be generated: %v", values)
+	}
+	if len(values) != len(expectedRates)+2 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	// The counter is reset.
+	families, _ = parsePrometheusText(fmt.Sprintf(testPrometheusText, 10, 65, 70))
+	values = g.convert(families, now.Add(120*time.Second))
+	if _, ok := values["custom.node.node_network_receive_bytes_total.eth0"]; ok {
+		t.Errorf("the rate should not be generated when the counter is reset: %v", values)
+	}
+
+	// The host is suspended.
+	NoteClockGap()
+	families, _ = parsePrometheusText(fmt.Sprintf(testPrometheusText, 7000, 65, 70))
+	values = g.convert(families, now.Add(180*time.Second))
+	if _, ok := values["custom.node.node_network_receive_bytes_total.eth0"]; ok {
+		t.Errorf("the rate should not be generated across the gap of the clock: %v", values)
+	}
+}
+
+func TestPrometheusGenerator_LabelTemplate(t *testing.T) {
+	g := NewPrometheusGenerator(&config.PrometheusPlugin{
+		MetricPrefix:  "app",
+		LabelTemplate: template.Must(template.New("").Option("missingkey=zero").Parse("{{.code}}.{{.method}}")),
+	}).(*prometheusGenerator)
+	families, _ := parsePrometheusText(`requests{code="200",path="/a"} 1
+requests{code="200",path="/b"} 2
+requests{code="500",path="/a"} 3
+`)
+	values := g.convert(families, time.Now())
+	if len(values) != 2 || values["custom.app.requests.200"] != 3 || values["custom.app.requests.500"] != 3 {
+		t.Errorf("the series of the same name should be summed: %v", values)
+	}
+}
+
+func TestPrometheusGenerator_Generate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/metrics" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+	}))
+	defer ts.Close()
+
+	g := NewPrometheusGenerator(&config.PrometheusPlugin{URL: ts.URL + "/metrics", MetricPrefix: "test", Timeout: time.Second})
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if len(values) != 1 || values["custom.test.up"] != 1 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	g = NewPrometheusGenerator(&config.PrometheusPlugin{URL: ts.URL + "/notfound", MetricPrefix: "test", Timeout: time.Second})
+	if _, err := g.Generate(); err == nil {
+		t.Error("should raise error for the status 404")
+	}
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// sampledPluginGenerator collects the values of the plugin at its interval in
+// the background, and generates the aggregates of the samples since the last
+// generation as <name>, <name>.max and <name>.min.
+type sampledPluginGenerator struct {
+	*pluginGenerator
+
+	start   sync.Once
+	stop    chan struct{}
+	stopped sync.Once
+	mu      sync.Mutex
+	samples map[string]*sampleStats
+}
+
+type sampleStats struct {
+	count         int
+	sum, max, min float64
+}
+
+func (st *sampleStats) add(value float64) {
+	if st.count == 0 || value > st.max {
+		st.max = value
+	}
+	if st.count == 0 || value < st.min {
+		st.min = value
+	}
+	st.sum += value
+	st.count++
+}
+
+func newSampledPluginGenerator(conf *config.MetricPlugin) *sampledPluginGenerator {
+	return &sampledPluginGenerator{
+		pluginGenerator: &pluginGenerator{Config: conf},
+		stop:            make(chan struct{}),
+		samples:         make(map[string]*sampleStats),
+	}
+}
+
+// Generate starts sampling at the first call, with the sample at the time.
+func (g *sampledPluginGenerator) Generate() (Values, error) {
+	g.start.Do(func() {
+		g.sample()
+		go g.run()
+	})
+	return g.aggregate()
+}
+
+// GenerateCustomIdentifiers generates the aggregates as Generate, since the
+// values of the other hosts are not sampled.
+func (g *sampledPluginGenerator) GenerateCustomIdentifiers() (Values, map[string]Values, error) {
+	values, err := g.Generate()
+	return values, nil, err
+}
+
+func (g *sampledPluginGenerator) run() {
+	t := time.NewTicker(g.Config.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			g.sample()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// Close stops sampling in the background, which is called when the agent
+// terminates or reloads the configuration.
+func (g *sampledPluginGenerator) Close() error {
+	g.stopped.Do(func() {
+		close(g.stop)
+	})
+	return nil
+}
+
+// sample collects the values. The failed samples are just missed, which
+// does not affect the aggregates but reduces the number of the samples.
+func (g *sampledPluginGenerator) sample() {
+	values, hosts, err := g.collectValues()
+	if _, exited := err.(*PluginExitError); err != nil && !exited {
+		return
+	}
+	if len(hosts) > 0 {
+		pluginLogger.Warningf("plugin metrics.%s: dropped the values of %d custom identifiers, which are not supported with interval", g.Config.Name, len(hosts))
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, value := range values {
+		st, ok := g.samples[name]
+		if !ok {
+			st = &sampleStats{}
+			g.samples[name] = st
+		}
+		st.add(value)
+	}
+}
+
+func (g *sampledPluginGenerator) aggregate() (Values, error) {
+	g.mu.Lock()
+	samples := g.samples
+	g.samples = make(map[string]*sampleStats)
+	g.mu.Unlock()
+
+	if len(samples) == 0 {
+		if g.Config.Breaker.Open() {
+			return nil, ErrPluginThrottled
+		}
+		return nil, fmt.Errorf("no samples of command %s are collected", g.Config.Command.CommandString())
+	}
+	results := make(Values, len(samples)*3)
+	for name, st := range samples {
+		if g.Config.Aggregation == config.AggregationCounter {
+			results[name] = st.sum
+		} else {
+			results[name] = st.sum / float64(st.count)
+		}
+		results[name+".max"] = st.max
+		results[name+".min"] = st.min
+	}
+	return results, nil
+}
+
+// PrepareGraphDefs adds the max and min variants to the metrics of the graphs.
+func (g *sampledPluginGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	payloads, err := g.pluginGenerator.PrepareGraphDefs()
+	if err != nil {
+		return nil, err
+	}
+	addSampleVariants(payloads)
+	return payloads, nil
+}
+
+func addSampleVariants(payloads []*mkr.GraphDefsParam) {
+	for _, payload := range payloads {
+		var variants []*mkr.GraphDefsMetric
+		for _, metric := range payload.Metrics {
+			for _, v := range []string{"max", "min"} {
+				variants = append(variants, &mkr.GraphDefsMetric{
+					Name:        metric.Name + "." + v,
+					DisplayName: metric.DisplayName + " (" + v + ")",
+				})
+			}
+		}
+		payload.Metrics = append(payload.Metrics, variants...)
+	}
+}
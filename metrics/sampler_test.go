@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestSampledPluginGenerator_Aggregate(t *testing.T) {
+	tests := []struct {
+		aggregation config.Aggregation
+		expected    Values
+	}{
+		{
+			aggregation: config.AggregationGauge,
+			expected:    Values{"custom.foo": 2, "custom.foo.max": 4, "custom.foo.min": 1},
+		},
+		{
+			aggregation: config.AggregationCounter,
+			expected:    Values{"custom.foo": 6, "custom.foo.max": 4, "custom.foo.min": 1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.aggregation), func(t *testing.T) {
+			g := newSampledPluginGenerator(&config.MetricPlugin{Aggregation: tc.aggregation})
+			// a missed sample just reduces the number of the samples
+			for _, v := range []float64{1, 4, 1} {
+				st, ok := g.samples["custom.foo"]
+				if !ok {
+					st = &sampleStats{}
+					g.samples["custom.foo"] = st
+				}
+				st.add(v)
+			}
+			values, err := g.aggregate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, v := range tc.expected {
+				if values[name] != v {
+					t.Errorf("%s should be %f but got %f", name, v, values[name])
+				}
+			}
+			if _, err := g.aggregate(); err == nil {
+				t.Error("the samples should be reset after the aggregation")
+			}
+		})
+	}
+}
+
+func TestSampledPluginGenerator_PrepareGraphDefs(t *testing.T) {
+	g := newSampledPluginGenerator(&config.MetricPlugin{})
+	g.Meta = &pluginMeta{
+		Graphs: map[string]customGraphDef{
+			"foo": {
+				Label:   "Foo",
+				Metrics: []customGraphMetricDef{{Name: "bar", Label: "Bar"}},
+			},
+		},
+	}
+	payloads := g.makeGraphDefsParam()
+	if len(payloads) != 1 {
+		t.Fatalf("unexpected graph definitions: %v", payloads)
+	}
+	addSampleVariants(payloads)
+	var names []string
+	for _, m := range payloads[0].Metrics {
+		names = append(names, m.Name)
+	}
+	expected := []string{"custom.foo.bar", "custom.foo.bar.max", "custom.foo.bar.min"}
+	if len(names) != len(expected) {
+		t.Fatalf("the metrics should be %v but got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("the metrics should be %v but got %v", expected, names)
+		}
+	}
+}
+
+func TestSampledPluginGenerator_Close(t *testing.T) {
+	g := newSampledPluginGenerator(&config.MetricPlugin{
+		Command:  config.Command{Args: []string{"echo", "foo\t1\t1397822016"}},
+		Interval: 10 * time.Millisecond,
+	})
+	if values, err := g.Generate(); err != nil || values["custom.foo"] != 1 {
+		t.Fatalf("the first sample should be aggregated: %v, %v", values, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := g.aggregate(); err != nil {
+		t.Fatalf("the values should be sampled in the background: %s", err)
+	}
+	g.Close()
+	// the sample executed while closing can be aggregated
+	time.Sleep(50 * time.Millisecond)
+	g.aggregate()
+	time.Sleep(50 * time.Millisecond)
+	if values, err := g.aggregate(); err == nil {
+		t.Errorf("the samples should not be collected after Close: %v", values)
+	}
+	g.Close()
+}
@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/mackerel"
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+// SelfGenerator generates the metrics about the running agent itself, which
+// are cheap enough to be collected always unless disable_self_metrics is set.
+type SelfGenerator struct {
+	// Buffers returns the numbers of the pending metric values and check reports
+	// keyed by "metrics" and "checks".
+	Buffers func() map[string]int
+	// PluginDurations is to generate the last durations of the plugins.
+	PluginDurations bool
+	// InstanceConflict returns true if another agent is posting as the host.
+	InstanceConflict func() bool
+	// LoopHeartbeats returns the number of the collections started by the
+	// loop of the agent, whose increase is posted as the heartbeat.
+	LoopHeartbeats func() uint64
+	// CheckCounts returns the numbers of the executions of the checks
+	// scheduled, executed and reported since the last call.
+	CheckCounts func() (scheduled, executed, reported int)
+
+	lastRetryCount uint64
+	lastHeartbeats uint64
+	// lastRejected are the numbers of the rejected values of the plugins at
+	// the last generation.
+	lastRejected map[string]int64
+}
+
+// Generate generates the memory usage, the buffer occupancy, the latency
+// of the posts, the clock skew and the heartbeats of the running agent itself
+func (g *SelfGenerator) Generate() (Values, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	retryCount := mackerel.RetryCount()
+	retries := retryCount - g.lastRetryCount
+	g.lastRetryCount = retryCount
+
+	ret := map[string]float64{
+		"custom.agent.memory_alloc_bytes": float64(memStats.Alloc),
+		"custom.agent.goroutines":         float64(runtime.NumGoroutine()),
+		"custom.agent.api.retries":        float64(retries),
+	}
+	if g.Buffers != nil {
+		buffers := g.Buffers()
+		ret["custom.agent.buffer.metrics_queued"] = float64(buffers["metrics"])
+		ret["custom.agent.buffer.checks_queued"] = float64(buffers["checks"])
+	}
+	if latency, ok := mackerel.TakePostLatency(); ok {
+		ret["custom.agent.api.post_latency_ms"] = latency.Seconds() * 1000
+	}
+	if skew, ok := mackerel.ClockSkew(); ok {
+		ret["custom.agent.clock.skew_seconds"] = skew.Seconds()
+	}
+	if g.InstanceConflict != nil {
+		var conflict float64
+		if g.InstanceConflict() {
+			conflict = 1
+		}
+		ret["custom.agent.instance.conflict"] = conflict
+	}
+	if g.LoopHeartbeats != nil {
+		// absent if the loop is stuck, since the values are collected by it
+		heartbeats := g.LoopHeartbeats()
+		ret["custom.agent.loop.heartbeat"] = float64(heartbeats - g.lastHeartbeats)
+		g.lastHeartbeats = heartbeats
+	}
+	if g.CheckCounts != nil {
+		scheduled, executed, reported := g.CheckCounts()
+		ret["custom.agent.checks.scheduled"] = float64(scheduled)
+		ret["custom.agent.checks.executed"] = float64(executed)
+		ret["custom.agent.checks.reported"] = float64(reported)
+	}
+	if g.lastRejected == nil {
+		g.lastRejected = make(map[string]int64)
+	}
+	for id, s := range pluginstats.All() {
+		// a segment per plugin such as checks_foo
+		name := strings.Replace(id, ".", "_", 1)
+		if i := invalidMetricNameIndex(name); i >= 0 {
+			name = sanitizeMetricName(name, i)
+		}
+		if g.PluginDurations {
+			ret["custom.agent.plugin."+name+".duration_ms"] = s.LastDurationMs
+		}
+		// the rejections in the interval of the plugins ever rejected
+		if s.Rejected > 0 {
+			ret["custom.agent.plugin_rejected."+name+".count"] = float64(s.Rejected - g.lastRejected[id])
+			g.lastRejected[id] = s.Rejected
+		}
+	}
+	return ret, nil
+}
+
+// CustomIdentifier for PluginGenerator interface
+func (g *SelfGenerator) CustomIdentifier() *string {
+	return nil
+}
+
+// PrepareGraphDefs for PluginGenerator interface
+func (g *SelfGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	meta := &pluginMeta{
+		Graphs: map[string]customGraphDef{
+			"agent": customGraphDef{
+				Label: "Agent",
+				Unit:  "integer",
+				Metrics: []customGraphMetricDef{
+					{Name: "memory_alloc_bytes", Label: "Memory Alloc (bytes)"},
+					{Name: "goroutines", Label: "Goroutines"},
+				},
+			},
+			"agent.buffer": customGraphDef{
+				Label: "Agent Buffer",
+				Unit:  "integer",
+				Metrics: []customGraphMetricDef{
+					{Name: "metrics_queued", Label: "Metrics Queued"},
+					{Name: "checks_queued", Label: "Checks Queued"},
+				},
+			},
+			"agent.api": customGraphDef{
+				Label: "Agent API",
+				Unit:  "float",
+				Metrics: []customGraphMetricDef{
+					{Name: "post_latency_ms", Label: "Post Latency (ms)"},
+					{Name: "retries", Label: "Retries"},
+				},
+			},
+			"agent.clock": customGraphDef{
+				Label: "Agent Clock Skew",
+				Unit:  "float",
+				Metrics: []customGraphMetricDef{
+					{Name: "skew_seconds", Label: "Skew (seconds)"},
+				},
+			},
+		},
+	}
+	if g.InstanceConflict != nil {
+		meta.Graphs["agent.instance"] = customGraphDef{
+			Label: "Agent Instance",
+			Unit:  "integer",
+			Metrics: []customGraphMetricDef{
+				{Name: "conflict", Label: "Conflict"},
+			},
+		}
+	}
+	if g.LoopHeartbeats != nil {
+		meta.Graphs["agent.loop"] = customGraphDef{
+			Label: "Agent Loop",
+			Unit:  "integer",
+			Metrics: []customGraphMetricDef{
+				{Name: "heartbeat", Label: "Heartbeat"},
+			},
+		}
+	}
+	if g.CheckCounts != nil {
+		meta.Graphs["agent.checks"] = customGraphDef{
+			Label: "Agent Checks",
+			Unit:  "integer",
+			Metrics: []customGraphMetricDef{
+				{Name: "scheduled", Label: "Scheduled"},
+				{Name: "executed", Label: "Executed"},
+				{Name: "reported", Label: "Reported"},
+			},
+		}
+	}
+	meta.Graphs["agent.plugin_rejected.#"] = customGraphDef{
+		Label: "Agent Plugin Rejected",
+		Unit:  "integer",
+		Metrics: []customGraphMetricDef{
+			{Name: "count", Label: "Rejected"},
+		},
+	}
+	if g.PluginDurations {
+		meta.Graphs["agent.plugin.#"] = customGraphDef{
+			Label: "Agent Plugin Duration",
+			Unit:  "milliseconds",
+			Metrics: []customGraphMetricDef{
+				{Name: "duration_ms", Label: "Duration"},
+			},
+		}
+	}
+	return makeGraphDefsParam(meta), nil
+}
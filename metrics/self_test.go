@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/pluginstats"
+)
+
+func TestSelfGenerate(t *testing.T) {
+	g := &SelfGenerator{
+		Buffers: func() map[string]int {
+			return map[string]int{"metrics": 3}
+		},
+	}
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"custom.agent.memory_alloc_bytes", "custom.agent.goroutines", "custom.agent.api.retries",
+		"custom.agent.buffer.metrics_queued", "custom.agent.buffer.checks_queued",
+	} {
+		if _, ok := values[name]; !ok {
+			t.Errorf("SelfGenerator should generate metric value for '%s'", name)
+		}
+	}
+	if values["custom.agent.buffer.metrics_queued"] != 3 || values["custom.agent.buffer.checks_queued"] != 0 {
+		t.Errorf("unexpected buffer occupancy: %v", values)
+	}
+	if _, ok := values["custom.agent.instance.conflict"]; ok {
+		t.Errorf("the conflict of the instance should not be generated without InstanceConflict: %v", values)
+	}
+	if values["custom.agent.memory_alloc_bytes"] <= 0 {
+		t.Errorf("the memory usage should be positive: %v", values)
+	}
+}
+
+func TestSelfPrepareGraphDefs(t *testing.T) {
+	g := &SelfGenerator{InstanceConflict: func() bool { return true }}
+	values, _ := g.Generate()
+	graphDefs, err := g.PrepareGraphDefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defined := make(map[string]bool)
+	for _, graph := range graphDefs {
+		for _, metric := range graph.Metrics {
+			defined[metric.Name] = true
+		}
+	}
+	// the values which are generated only after posting
+	values["custom.agent.api.post_latency_ms"] = 0
+	values["custom.agent.clock.skew_seconds"] = 0
+	for name := range values {
+		if !defined[name] {
+			t.Errorf("the graph of %s should be defined", name)
+		}
+	}
+}
+
+func TestSelfGenerate_pluginDurations(t *testing.T) {
+	pluginstats.Record("checks.foo bar", 1500*time.Millisecond, 0, nil, 0)
+
+	values, _ := (&SelfGenerator{}).Generate()
+	if _, ok := values["custom.agent.plugin.checks_foo_bar.duration_ms"]; ok {
+		t.Errorf("the durations of the plugins should not be generated by default: %v", values)
+	}
+
+	g := &SelfGenerator{PluginDurations: true}
+	values, _ = g.Generate()
+	if v := values["custom.agent.plugin.checks_foo_bar.duration_ms"]; v != 1500 {
+		t.Errorf("the duration of the plugin should be generated: %v", values)
+	}
+	graphDefs, _ := g.PrepareGraphDefs()
+	var defined bool
+	for _, graph := range graphDefs {
+		if graph.Name == "custom.agent.plugin.#" && graph.Unit == "milliseconds" {
+			defined = true
+		}
+	}
+	if !defined {
+		t.Errorf("the graph of the durations of the plugins should be defined")
+	}
+}
+
+func TestSelfGenerate_pluginRejected(t *testing.T) {
+	pluginstats.RecordRejected("metrics.rejected")
+	pluginstats.RecordRejected("metrics.rejected")
+
+	g := &SelfGenerator{}
+	values, _ := g.Generate()
+	if v, ok := values["custom.agent.plugin_rejected.metrics_rejected.count"]; !ok || v != 2 {
+		t.Errorf("the rejected values of the plugin should be generated: %v", values)
+	}
+	values, _ = g.Generate()
+	if v, ok := values["custom.agent.plugin_rejected.metrics_rejected.count"]; !ok || v != 0 {
+		t.Errorf("the rejected values in the interval should be generated: %v", values)
+	}
+}
+
+func TestSelfGenerate_heartbeats(t *testing.T) {
+	var heartbeats uint64
+	g := &SelfGenerator{
+		LoopHeartbeats: func() uint64 { return heartbeats },
+		CheckCounts:    func() (int, int, int) { return 3, 2, 1 },
+	}
+	heartbeats = 1
+	values, _ := g.Generate()
+	if v, ok := values["custom.agent.loop.heartbeat"]; !ok || v != 1 {
+		t.Errorf("the heartbeat should be generated: %v", values)
+	}
+	heartbeats = 3
+	values, _ = g.Generate()
+	if v := values["custom.agent.loop.heartbeat"]; v != 2 {
+		t.Errorf("the heartbeats in the interval should be generated: %v", v)
+	}
+	if values["custom.agent.checks.scheduled"] != 3 || values["custom.agent.checks.executed"] != 2 || values["custom.agent.checks.reported"] != 1 {
+		t.Errorf("the counts of the checks should be generated: %v", values)
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+// skipWarningInterval is the interval of the warnings of a generator skipping
+// the cycles, which would be repeated every minute until the agent supports
+// the files of the kernel.
+const skipWarningInterval = time.Hour
+
+// skipWarning limits the warnings of a generator to once per interval, and
+// counts the ones suppressed.
+type skipWarning struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	warnedAt   map[string]time.Time
+	suppressed map[string]int
+}
+
+var skipWarnings = &skipWarning{
+	interval:   skipWarningInterval,
+	warnedAt:   make(map[string]time.Time),
+	suppressed: make(map[string]int),
+}
+
+// allow reports whether the warning of name is logged at now, and returns the
+// number of the ones suppressed since the last one if so.
+func (w *skipWarning) allow(name string, now time.Time) (bool, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if at, ok := w.warnedAt[name]; ok && now.Sub(at) < w.interval {
+		w.suppressed[name]++
+		return false, 0
+	}
+	w.warnedAt[name] = now
+	n := w.suppressed[name]
+	delete(w.suppressed, name)
+	return true, n
+}
+
+// WarnSkipped warns that the generator of name skipped the values of this
+// cycle by err, such as the files in /proc of an unusual kernel which are not
+// parsed. The other generators are not affected. The warnings of a generator
+// are logged at most once per hour, and the others are logged as DEBUG.
+func WarnSkipped(logger *logformat.Logger, name string, err error) {
+	ok, suppressed := skipWarnings.allow(name, time.Now())
+	switch {
+	case !ok:
+		logger.Debugf("Skipped the %s metrics of this cycle: %s", name, err)
+	case suppressed > 0:
+		logger.Warningf("Skipped the %s metrics of this cycle (%d more cycles since the last warning): %s", name, suppressed, err)
+	default:
+		logger.Warningf("Skipped the %s metrics of this cycle: %s", name, err)
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkipWarning(t *testing.T) {
+	w := &skipWarning{
+		interval:   time.Hour,
+		warnedAt:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name       string
+		after      time.Duration
+		ok         bool
+		suppressed int
+	}{
+		{"disk", 0, true, 0},
+		{"disk", time.Minute, false, 0},
+		{"interface", time.Minute, true, 0},
+		{"disk", 30 * time.Minute, false, 0},
+		{"disk", time.Hour, true, 2},
+		{"disk", time.Hour + time.Minute, false, 0},
+	}
+	for _, s := range steps {
+		ok, suppressed := w.allow(s.name, now.Add(s.after))
+		if ok != s.ok || suppressed != s.suppressed {
+			t.Errorf("allow(%q) after %s should return (%t, %d) but got (%t, %d)", s.name, s.after, s.ok, s.suppressed, ok, suppressed)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// The phases of the snapshot. The generators calculating the rates read the
+// files before and after their intervals.
+const (
+	PhaseStart = iota
+	PhaseEnd
+)
+
+// Snapshot holds the files read by the generators in a collection cycle, such
+// as /proc/stat, so that the generators reading the same files share them.
+// A file is read at the first call of ReadFile in each phase.
+type Snapshot struct {
+	mu    sync.Mutex
+	files map[snapshotKey]*snapshotFile
+}
+
+type snapshotKey struct {
+	phase int
+	path  string
+}
+
+type snapshotFile struct {
+	once sync.Once
+	data []byte
+	at   time.Time
+	err  error
+}
+
+// NewSnapshot creates a Snapshot, which is discarded after the cycle.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{files: make(map[snapshotKey]*snapshotFile)}
+}
+
+// ReadFile returns the content of the file in phase. The callers should not
+// modify the content, which is shared.
+func (s *Snapshot) ReadFile(phase int, path string) ([]byte, error) {
+	data, _, err := s.ReadFileAt(phase, path)
+	return data, err
+}
+
+// ReadFileAt is ReadFile which also returns the time when the file was read,
+// for CounterSample.
+func (s *Snapshot) ReadFileAt(phase int, path string) ([]byte, time.Time, error) {
+	key := snapshotKey{phase: phase, path: path}
+	s.mu.Lock()
+	f, ok := s.files[key]
+	if !ok {
+		f = &snapshotFile{}
+		s.files[key] = f
+	}
+	s.mu.Unlock()
+	// the others reading the same file wait for it without locking the snapshot
+	f.once.Do(func() {
+		f.data, f.err = ioutil.ReadFile(path)
+		f.at = time.Now()
+	})
+	return f.data, f.at, f.err
+}
+
+// SnapshotGenerator is implemented by the generators which read the files
+// through the Snapshot of the cycle. Their Generate reads the files through
+// a Snapshot of their own.
+type SnapshotGenerator interface {
+	Generator
+	GenerateSnapshot(s *Snapshot) (Values, error)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot_ReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stat")
+	if err := ioutil.WriteFile(path, []byte("start"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSnapshot()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := s.ReadFile(PhaseStart, path); err != nil || string(b) != "start" {
+				t.Errorf("the file should be read: %q, %v", b, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ioutil.WriteFile(path, []byte("end"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := s.ReadFile(PhaseStart, path); string(b) != "start" {
+		t.Errorf("the file should be read once in the phase: %q", b)
+	}
+	if b, _ := s.ReadFile(PhaseEnd, path); string(b) != "end" {
+		t.Errorf("the file should be read again in the next phase: %q", b)
+	}
+	if b, _ := NewSnapshot().ReadFile(PhaseStart, path); string(b) != "end" {
+		t.Errorf("the file should be read again in the next snapshot: %q", b)
+	}
+
+	if _, err := s.ReadFile(PhaseStart, filepath.Join(dir, "not-exist")); err == nil {
+		t.Error("ReadFile should raise error if the file does not exist")
+	}
+}
@@ -0,0 +1,213 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/snmp"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var snmpLogger = logformat.GetLogger("metrics.snmp")
+
+// oidSysUpTime is polled with the variables to detect the restarts of the devices.
+const oidSysUpTime = "1.3.6.1.2.1.1.3.0"
+
+// snmpMaxCounterInterval is the maximum interval of the samples to calculate
+// the rates of the counters. Counter32 may wrap around more than once in
+// longer intervals.
+var snmpMaxCounterInterval = 3 * config.PostMetricsInterval
+
+// snmpMaxBackoff is the maximum number of the generations skipped after the
+// failures of polling.
+const snmpMaxBackoff = 15
+
+// snmpGenerator polls an SNMP agent. The gauges are posted as they are, and
+// the counters are converted to the rates per second. The wrap around of
+// Counter32 is taken into account, while the decreases of the others and the
+// restarts of the device detected by sysUpTime are regarded as the resets.
+// The polling of an unreachable agent is skipped exponentially.
+type snmpGenerator struct {
+	Config *config.SNMPPlugin
+	client *snmp.Client
+	oids   []string
+
+	mu       sync.Mutex
+	last     map[string]snmpCounter // keyed by the oid
+	uptime   *uint64
+	failures int
+	skips    int
+}
+
+type snmpCounter struct {
+	value snmpValue
+	time  time.Time
+	epoch uint64
+}
+
+// snmpValue is the numeric value of a variable. uint is valid for the
+// unsigned types, to keep the precision of Counter64.
+type snmpValue struct {
+	typ      snmp.Type
+	float    float64
+	uint     uint64
+	unsigned bool
+}
+
+// NewSNMPGenerator creates a generator which polls the agent of conf.
+func NewSNMPGenerator(conf *config.SNMPPlugin) PluginGenerator {
+	oids := []string{oidSysUpTime}
+	for _, o := range conf.OIDs {
+		oids = append(oids, o.OID)
+	}
+	c := &snmp.Client{
+		Target:    conf.Target,
+		Version:   conf.Version,
+		Community: conf.Community,
+		Timeout:   conf.Timeout,
+	}
+	if conf.Version == snmp.Version3 {
+		c.USM = &snmp.USM{
+			UserName:     conf.SecName,
+			AuthProtocol: conf.AuthProtocol,
+			AuthPassword: conf.AuthPassword,
+			PrivProtocol: conf.PrivProtocol,
+			PrivPassword: conf.PrivPassword,
+		}
+	}
+	return &snmpGenerator{
+		Config: conf,
+		client: c,
+		oids:   oids,
+		last:   make(map[string]snmpCounter),
+	}
+}
+
+func (g *snmpGenerator) String() string {
+	return fmt.Sprintf("snmp %q", g.Config.Target)
+}
+
+// Generate polls the agent. The names of the values are without "custom."
+// if the destination is a service.
+func (g *snmpGenerator) Generate() (Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.skips > 0 {
+		g.skips--
+		return nil, fmt.Errorf("skip polling %s since it is unreachable", g.Config.Target)
+	}
+	vars, err := g.client.Get(g.oids)
+	if err != nil {
+		g.failures++
+		g.skips = 1<<uint(g.failures-1) - 1
+		if g.skips > snmpMaxBackoff {
+			g.skips = snmpMaxBackoff
+		}
+		if g.failures == 1 {
+			snmpLogger.Warningf("Failed to poll %s: %s", g.Config.Target, err)
+		}
+		return nil, err
+	}
+	if g.failures > 0 {
+		snmpLogger.Infof("Polling %s is recovered", g.Config.Target)
+		g.failures = 0
+	}
+	return g.convert(vars, time.Now()), nil
+}
+
+// PrepareGraphDefs returns no graph definitions. The metrics are graphed by their names.
+func (g *snmpGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	return nil, nil
+}
+
+func (g *snmpGenerator) CustomIdentifier() *string {
+	return g.Config.CustomIdentifier
+}
+
+// convert converts the variables whose first one is sysUpTime.
+func (g *snmpGenerator) convert(vars []*snmp.Variable, now time.Time) Values {
+	restarted := false
+	if uptime, ok := vars[0].Value.(uint64); ok {
+		restarted = g.uptime != nil && uptime < *g.uptime
+		g.uptime = &uptime
+	}
+	prefix := g.Config.MetricPrefix + "."
+	if g.Config.Service == "" {
+		prefix = pluginPrefix + prefix
+	}
+
+	results := make(Values)
+	epoch := clockEpoch()
+	for i, v := range vars[1:] {
+		o := g.Config.OIDs[i]
+		value, ok := snmpNumericValue(v)
+		if !ok {
+			snmpLogger.Debugf("The variable %s of %s is not numeric", o.OID, g.Config.Target)
+			continue
+		}
+		if o.Type == config.SNMPOIDCounter {
+			prev, ok := g.last[o.OID]
+			g.last[o.OID] = snmpCounter{value, now, epoch}
+			if !ok || restarted || prev.epoch != epoch {
+				continue
+			}
+			elapsed := now.Sub(prev.time)
+			if elapsed <= 0 || elapsed > snmpMaxCounterInterval {
+				continue
+			}
+			delta, ok := snmpCounterDelta(prev.value, value)
+			if !ok {
+				continue
+			}
+			results[prefix+o.Name] = delta / elapsed.Seconds() * o.Scale
+			continue
+		}
+		results[prefix+o.Name] = value.float * o.Scale
+	}
+	return results
+}
+
+func snmpNumericValue(v *snmp.Variable) (snmpValue, bool) {
+	switch x := v.Value.(type) {
+	case int64:
+		return snmpValue{typ: v.Type, float: float64(x)}, true
+	case uint64:
+		return snmpValue{typ: v.Type, float: float64(x), uint: x, unsigned: true}, true
+	case []byte:
+		// some devices report the numbers as the strings
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(x)), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return snmpValue{}, false
+		}
+		return snmpValue{typ: v.Type, float: f}, true
+	}
+	return snmpValue{}, false
+}
+
+// snmpCounterDelta returns the increase of the counter from prev to cur.
+func snmpCounterDelta(prev, cur snmpValue) (float64, bool) {
+	if prev.typ != cur.typ || prev.unsigned != cur.unsigned {
+		return 0, false
+	}
+	if !cur.unsigned {
+		if cur.float < prev.float {
+			return 0, false
+		}
+		return cur.float - prev.float, true
+	}
+	if cur.uint >= prev.uint {
+		return float64(cur.uint - prev.uint), true
+	}
+	if cur.typ == snmp.Counter32 && prev.uint <= math.MaxUint32 {
+		// wrap around
+		return float64(math.MaxUint32 - prev.uint + cur.uint + 1), true
+	}
+	// Counter64 does not wrap around in practice, so it is reset.
+	return 0, false
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/snmp"
+)
+
+func testSNMPConfig() *config.SNMPPlugin {
+	return &config.SNMPPlugin{
+		Target:       "127.0.0.1:161",
+		Version:      "2c",
+		Community:    "public",
+		MetricPrefix: "switch",
+		Timeout:      time.Second,
+		OIDs: []*config.SNMPOID{
+			{OID: "1.3.6.1.2.1.2.2.1.10.1", Name: "in_bits", Type: config.SNMPOIDCounter, Scale: 8},
+			{OID: "1.3.6.1.2.1.31.1.1.1.6.1", Name: "hc_in_octets", Type: config.SNMPOIDCounter, Scale: 1},
+			{OID: "1.3.6.1.4.1.2021.10.1.3.1", Name: "load", Type: config.SNMPOIDGauge, Scale: 1},
+			{OID: "1.3.6.1.4.1.2021.11.11.0", Name: "idle", Type: config.SNMPOIDGauge, Scale: 1},
+		},
+	}
+}
+
+func snmpVariables(uptime, in32, in64 uint64) []*snmp.Variable {
+	return []*snmp.Variable{
+		{OID: oidSysUpTime, Type: snmp.TimeTicks, Value: uptime},
+		{OID: "1.3.6.1.2.1.2.2.1.10.1", Type: snmp.Counter32, Value: in32},
+		{OID: "1.3.6.1.2.1.31.1.1.1.6.1", Type: snmp.Counter64, Value: in64},
+		{OID: "1.3.6.1.4.1.2021.10.1.3.1", Type: snmp.OctetString, Value: []byte("0.15")},
+		{OID: "1.3.6.1.4.1.2021.11.11.0", Type: snmp.NoValue},
+	}
+}
+
+func TestSNMPGenerator_Convert(t *testing.T) {
+	g := NewSNMPGenerator(testSNMPConfig()).(*snmpGenerator)
+	now := time.Now()
+
+	// The rates are not generated at the first poll.
+	values := g.convert(snmpVariables(100, math.MaxUint32-99, math.MaxUint64-99), now)
+	if len(values) != 1 || values["custom.switch.load"] != 0.15 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	// Counter32 wraps around and Counter64 is reset.
+	values = g.convert(snmpVariables(6100, 500, 10), now.Add(60*time.Second))
+	if len(values) != 2 || values["custom.switch.in_bits"] != 80 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	values = g.convert(snmpVariables(12100, 1100, 70), now.Add(120*time.Second))
+	if len(values) != 3 || values["custom.switch.in_bits"] != 80 || values["custom.switch.hc_in_octets"] != 1 {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	// The device is restarted.
+	values = g.convert(snmpVariables(50, 2000, 200), now.Add(180*time.Second))
+	if len(values) != 1 {
+		t.Errorf("the rates should not be generated after the restart: %v", values)
+	}
+
+	// The interval is too long.
+	values = g.convert(snmpVariables(100000, 3000, 300), now.Add(time.Hour))
+	if len(values) != 1 {
+		t.Errorf("the rates should not be generated after the long interval: %v", values)
+	}
+}
+
+func TestSNMPGenerator_ServiceMetrics(t *testing.T) {
+	conf := testSNMPConfig()
+	conf.Service = "network"
+	g := NewSNMPGenerator(conf).(*snmpGenerator)
+	values := g.convert(snmpVariables(100, 0, 0), time.Now())
+	if len(values) != 1 || values["switch.load"] != 0.15 {
+		t.Errorf("the names of the service metrics should be without custom.: %v", values)
+	}
+}
+
+func TestSNMPGenerator_Backoff(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // never responds
+
+	conf := testSNMPConfig()
+	conf.Target = conn.LocalAddr().String()
+	conf.Timeout = 10 * time.Millisecond
+	g := NewSNMPGenerator(conf).(*snmpGenerator)
+
+	// polled at the 1st, 2nd, 4th and 8th generations
+	var polled []int
+	for i := 0; i < 10; i++ {
+		if _, err := g.Generate(); err == nil {
+			t.Fatal("should raise error")
+		}
+		polled = append(polled, g.failures)
+	}
+	expected := []int{1, 2, 2, 3, 3, 3, 3, 4, 4, 4}
+	for i := range expected {
+		if polled[i] != expected[i] {
+			t.Fatalf("the failures should be %v but %v", expected, polled)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var statsdLogger = logformat.GetLogger("metrics.statsd")
+
+const statsdPrefix = pluginPrefix + "statsd."
+
+// statsdMaxPacketSize is the maximum size of the UDP packets, and of the lines on TCP.
+const statsdMaxPacketSize = 64 * 1024
+
+// statsdMaxTimerSamples is the maximum number of the values of a timer kept
+// for the percentiles in a generation, which are sampled uniformly from the
+// values received.
+const statsdMaxTimerSamples = 1024
+
+// statsdGenerator listens to the statsd protocol at the first generation,
+// and generates the aggregates of the metrics received since the last one.
+// The counters are summed up, the last values of the gauges are kept across
+// the generations up to the TTL since they are updated, and the timers are reduced to their count, mean, min, max
+// and the percentiles. The metrics whose names are received as another type,
+// or whose names collide with the aggregates of the timers, such as the
+// counter foo.count and the timer foo, are rejected as malformed.
+type statsdGenerator struct {
+	Config *config.Statsd
+
+	mu        sync.Mutex
+	listeners []io.Closer
+	counters  map[string]float64
+	gauges    map[string]float64
+	updated   map[string]time.Time // of the gauges
+	timers    map[string]*statsdTimer
+	dropped   int
+	malformed int
+}
+
+type statsdTimer struct {
+	count float64 // scaled by the sample rates
+	// n, sum, min and max are of all the values received, and values are
+	// sampled from them by the reservoir sampling.
+	n        int
+	sum      float64
+	min, max float64
+	values   []float64
+}
+
+func (t *statsdTimer) add(v float64) {
+	t.n++
+	t.sum += v
+	if t.n == 1 || v < t.min {
+		t.min = v
+	}
+	if t.n == 1 || v > t.max {
+		t.max = v
+	}
+	if len(t.values) < statsdMaxTimerSamples {
+		t.values = append(t.values, v)
+	} else if i := rand.Intn(t.n); i < statsdMaxTimerSamples {
+		t.values[i] = v
+	}
+}
+
+// NewStatsdGenerator creates a generator of the statsd listener of conf.
+func NewStatsdGenerator(conf *config.Statsd) PluginGenerator {
+	return &statsdGenerator{
+		Config:   conf,
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		updated:  make(map[string]time.Time),
+		timers:   make(map[string]*statsdTimer),
+	}
+}
+
+func (g *statsdGenerator) String() string {
+	return fmt.Sprintf("statsd %q", g.Config.Listen)
+}
+
+// Generate starts listening at the first call, which is retried at the next
+// call if it fails.
+func (g *statsdGenerator) Generate() (Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.listeners == nil {
+		if err := g.listen(); err != nil {
+			return nil, err
+		}
+	}
+	return g.flush(), nil
+}
+
+// PrepareGraphDefs returns no graph definitions, since the names of the metrics are not known in advance.
+func (g *statsdGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	return nil, nil
+}
+
+func (g *statsdGenerator) CustomIdentifier() *string {
+	return nil
+}
+
+func (g *statsdGenerator) listen() error {
+	conn, err := net.ListenPacket("udp", g.Config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen statsd on udp %s: %s", g.Config.Listen, err)
+	}
+	listeners := []io.Closer{conn}
+	go g.serveUDP(conn)
+	if g.Config.ListenTCP != "" {
+		l, err := net.Listen("tcp", g.Config.ListenTCP)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to listen statsd on tcp %s: %s", g.Config.ListenTCP, err)
+		}
+		listeners = append(listeners, l)
+		go g.serveTCP(l)
+	}
+	statsdLogger.Infof("Listening statsd on %s", g.Config.Listen)
+	g.listeners = listeners
+	return nil
+}
+
+// close stops listening.
+func (g *statsdGenerator) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, l := range g.listeners {
+		l.Close()
+	}
+}
+
+func (g *statsdGenerator) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, statsdMaxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !isClosedError(err) {
+				statsdLogger.Errorf("Stopped listening statsd on udp: %s", err)
+			}
+			return
+		}
+		g.handle(strings.Split(string(buf[:n]), "\n"))
+	}
+}
+
+func (g *statsdGenerator) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !isClosedError(err) {
+				statsdLogger.Errorf("Stopped listening statsd on tcp: %s", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 4096), statsdMaxPacketSize)
+			for scanner.Scan() {
+				g.handle([]string{scanner.Text()})
+			}
+		}()
+	}
+}
+
+func isClosedError(err error) bool {
+	// net.ErrClosed is not available in the supported versions of Go.
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+func (g *statsdGenerator) handle(lines []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, err := parseStatsdLine(line)
+		if err != nil {
+			g.malformed++
+			statsdLogger.Debugf("Malformed statsd line %q: %s", line, err)
+			continue
+		}
+		g.add(m)
+	}
+}
+
+func (g *statsdGenerator) numNames() int {
+	return len(g.counters) + len(g.gauges) + len(g.timers)
+}
+
+// timerSuffixes returns the suffixes of the aggregates of the timers.
+func (g *statsdGenerator) timerSuffixes() []string {
+	suffixes := []string{"count", "mean", "min", "max"}
+	for _, p := range g.Config.Percentiles {
+		suffixes = append(suffixes, percentileName(p))
+	}
+	return suffixes
+}
+
+// conflicts returns true if name is received as another type than typ, or the
+// metric of name collides with the aggregates of the timers. The names already
+// received as typ have been verified.
+func (g *statsdGenerator) conflicts(name, typ string) bool {
+	_, counter := g.counters[name]
+	_, gauge := g.gauges[name]
+	_, timer := g.timers[name]
+	switch typ {
+	case "c":
+		if counter {
+			return false
+		}
+		if gauge || timer {
+			return true
+		}
+	case "g":
+		if gauge {
+			return false
+		}
+		if counter || timer {
+			return true
+		}
+	default:
+		if timer {
+			return false
+		}
+		if counter || gauge {
+			return true
+		}
+		for _, suffix := range g.timerSuffixes() {
+			_, counter := g.counters[name+"."+suffix]
+			_, gauge := g.gauges[name+"."+suffix]
+			if counter || gauge {
+				return true
+			}
+		}
+		return false
+	}
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		if _, ok := g.timers[name[:i]]; ok {
+			for _, suffix := range g.timerSuffixes() {
+				if name[i+1:] == suffix {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (g *statsdGenerator) add(m *statsdMetric) {
+	typ := m.typ
+	if typ == "h" {
+		typ = "ms"
+	}
+	if g.conflicts(m.name, typ) {
+		g.malformed++
+		statsdLogger.Debugf("The statsd metric %q of the type %q conflicts with the one of another type", m.name, m.typ)
+		return
+	}
+	switch typ {
+	case "c":
+		if _, ok := g.counters[m.name]; !ok && g.numNames() >= g.Config.MaxNames {
+			g.dropped++
+			return
+		}
+		g.counters[m.name] += m.value / m.rate
+	case "g":
+		v, ok := g.gauges[m.name]
+		if !ok && g.numNames() >= g.Config.MaxNames {
+			g.dropped++
+			return
+		}
+		if m.relative {
+			g.gauges[m.name] = v + m.value
+		} else {
+			g.gauges[m.name] = m.value
+		}
+		g.updated[m.name] = time.Now()
+	case "ms":
+		t, ok := g.timers[m.name]
+		if !ok {
+			if g.numNames() >= g.Config.MaxNames {
+				g.dropped++
+				return
+			}
+			t = &statsdTimer{}
+			g.timers[m.name] = t
+		}
+		t.count += 1 / m.rate
+		t.add(m.value)
+	}
+}
+
+// flush generates the aggregates and resets the counters and the timers.
+// The gauges expired by the TTL are dropped.
+func (g *statsdGenerator) flush() Values {
+	results := make(Values)
+	for name, v := range g.counters {
+		results[statsdPrefix+name] = v
+	}
+	var ttl time.Duration
+	if g.Config.GaugeTTL != nil {
+		ttl = g.Config.GaugeTTL.Duration
+	}
+	for name, v := range g.gauges {
+		if ttl > 0 && time.Since(g.updated[name]) > ttl {
+			delete(g.gauges, name)
+			delete(g.updated, name)
+			continue
+		}
+		results[statsdPrefix+name] = v
+	}
+	for name, t := range g.timers {
+		sort.Float64s(t.values)
+		n := len(t.values)
+		prefix := statsdPrefix + name + "."
+		results[prefix+"count"] = t.count
+		results[prefix+"mean"] = t.sum / float64(t.n)
+		results[prefix+"min"] = t.min
+		results[prefix+"max"] = t.max
+		for _, p := range g.Config.Percentiles {
+			i := int(math.Ceil(p/100*float64(n))) - 1
+			if i < 0 {
+				i = 0
+			}
+			results[prefix+percentileName(p)] = t.values[i]
+		}
+	}
+	if g.dropped > 0 {
+		statsdLogger.Warningf("%d statsd metrics are dropped since the number of the names exceeds %d", g.dropped, g.Config.MaxNames)
+	}
+	if g.malformed > 0 {
+		statsdLogger.Warningf("%d malformed statsd lines are ignored", g.malformed)
+	}
+	g.counters = make(map[string]float64)
+	g.timers = make(map[string]*statsdTimer)
+	g.dropped = 0
+	g.malformed = 0
+	return results
+}
+
+// percentileName returns the name of the percentile p, such as p99 or p99_9.
+func percentileName(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+type statsdMetric struct {
+	name     string
+	value    float64
+	typ      string
+	rate     float64
+	relative bool // the gauge is incremented or decremented
+}
+
+var invalidStatsdNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// parseStatsdLine parses a line of the form <name>:<value>|<type>[|@<rate>][|#<tags>].
+// The tags are ignored.
+func parseStatsdLine(line string) (*statsdMetric, error) {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return nil, fmt.Errorf("no value")
+	}
+	m := &statsdMetric{name: sanitizeStatsdName(line[:i]), rate: 1}
+	if m.name == "" {
+		return nil, fmt.Errorf("invalid name")
+	}
+	fields := strings.Split(line[i+1:], "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("no type")
+	}
+	m.typ = fields[1]
+	switch m.typ {
+	case "c", "g", "ms", "h":
+	default:
+		return nil, fmt.Errorf("unsupported type %q", m.typ)
+	}
+	value := fields[0]
+	if m.typ == "g" && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")) {
+		m.relative = true
+	}
+	var err error
+	m.value, err = strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(m.value) || math.IsInf(m.value, 0) {
+		return nil, fmt.Errorf("invalid value %q", value)
+	}
+	for _, f := range fields[2:] {
+		if strings.HasPrefix(f, "@") {
+			m.rate, err = strconv.ParseFloat(f[1:], 64)
+			if err != nil || m.rate <= 0 || m.rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q", f)
+			}
+		}
+	}
+	return m, nil
+}
+
+func sanitizeStatsdName(name string) string {
+	name = invalidStatsdNameChars.ReplaceAllString(strings.Replace(name, "/", "-", -1), "_")
+	var parts []string
+	for _, p := range strings.Split(name, ".") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected *statsdMetric
+	}{
+		{"requests:1|c", &statsdMetric{name: "requests", value: 1, typ: "c", rate: 1}},
+		{"api.requests:2|c|@0.5|#env:prod", &statsdMetric{name: "api.requests", value: 2, typ: "c", rate: 0.5}},
+		{"queue size:-3|g", &statsdMetric{name: "queue_size", value: -3, typ: "g", rate: 1, relative: true}},
+		{"/api/users..latency:12.5|ms", &statsdMetric{name: "-api-users.latency", value: 12.5, typ: "ms", rate: 1}},
+		{"requests", nil},
+		{"requests:1", nil},
+		{"requests:abc|c", nil},
+		{"requests:1|s", nil},
+		{"requests:1|c|@2", nil},
+		{":1|c", nil},
+		{"...:1|c", nil},
+	}
+	for _, tc := range testCases {
+		m, err := parseStatsdLine(tc.line)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("should raise error for %q", tc.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.line, err)
+			continue
+		}
+		if *m != *tc.expected {
+			t.Errorf("%q should be parsed to %+v but %+v", tc.line, tc.expected, m)
+		}
+	}
+}
+
+func TestStatsdGenerator_Flush(t *testing.T) {
+	g := NewStatsdGenerator(&config.Statsd{Percentiles: []float64{50, 99.9}, MaxNames: 4}).(*statsdGenerator)
+	g.handle([]string{
+		"requests:1|c",
+		"requests:1|c|@0.1",
+		"load:5|g",
+		"load:+2|g",
+		"latency:3|ms",
+		"latency:1|ms",
+		"latency:2|ms",
+		"latency:10|ms",
+		"malformed",
+		"new.name:1|c",
+		"over.limit:1|c",
+	})
+
+	values := g.flush()
+	expected := Values{
+		"custom.statsd.requests":      11,
+		"custom.statsd.load":          7,
+		"custom.statsd.latency.count": 4,
+		"custom.statsd.latency.mean":  4,
+		"custom.statsd.latency.min":   1,
+		"custom.statsd.latency.max":   10,
+		"custom.statsd.latency.p50":   2,
+		"custom.statsd.latency.p99_9": 10,
+		"custom.statsd.new.name":      1,
+	}
+	if len(values) != len(expected) {
+		t.Errorf("unexpected values: %v", values)
+	}
+	for name, v := range expected {
+		if values[name] != v {
+			t.Errorf("%s should be %f but %v", name, v, values)
+		}
+	}
+
+	// The gauges are kept and the others are reset.
+	values = g.flush()
+	if len(values) != 1 || values["custom.statsd.load"] != 7 {
+		t.Errorf("only the gauges should be kept: %v", values)
+	}
+}
+
+func TestStatsdGenerator_FlushConflicts(t *testing.T) {
+	g := NewStatsdGenerator(&config.Statsd{Percentiles: []float64{99}, MaxNames: 10}).(*statsdGenerator)
+	g.handle([]string{
+		"foo:1|c",
+		"foo:5|g",
+		"latency:3|ms",
+		"latency.count:1|c",
+		"latency.p99:1|g",
+		"requests.max:1|g",
+		"requests:1|h",
+		"latency.ok:1|c",
+	})
+	if g.malformed != 4 {
+		t.Errorf("the metrics conflicting with another type should be rejected: %d", g.malformed)
+	}
+
+	values := g.flush()
+	expected := Values{
+		"custom.statsd.foo":           1,
+		"custom.statsd.latency.count": 1,
+		"custom.statsd.latency.mean":  3,
+		"custom.statsd.latency.min":   3,
+		"custom.statsd.latency.max":   3,
+		"custom.statsd.latency.p99":   3,
+		"custom.statsd.requests.max":  1,
+		"custom.statsd.latency.ok":    1,
+	}
+	if len(values) != len(expected) {
+		t.Errorf("unexpected values: %v", values)
+	}
+	for name, v := range expected {
+		if values[name] != v {
+			t.Errorf("%s should be %f but %v", name, v, values)
+		}
+	}
+}
+
+func TestStatsdGenerator_FlushTimerSamples(t *testing.T) {
+	g := NewStatsdGenerator(&config.Statsd{Percentiles: []float64{50}, MaxNames: 1}).(*statsdGenerator)
+	n := 10 * statsdMaxTimerSamples
+	for i := 1; i <= n; i++ {
+		g.handle([]string{fmt.Sprintf("latency:%d|ms", i)})
+	}
+	if l := len(g.timers["latency"].values); l != statsdMaxTimerSamples {
+		t.Errorf("the values of the timer should be sampled up to %d but %d", statsdMaxTimerSamples, l)
+	}
+
+	values := g.flush()
+	expected := Values{
+		"custom.statsd.latency.count": float64(n),
+		"custom.statsd.latency.mean":  float64(n+1) / 2,
+		"custom.statsd.latency.min":   1,
+		"custom.statsd.latency.max":   float64(n),
+	}
+	for name, v := range expected {
+		if values[name] != v {
+			t.Errorf("%s should be %f but %v", name, v, values)
+		}
+	}
+	if p50 := values["custom.statsd.latency.p50"]; p50 < float64(n)/4 || p50 > float64(n)*3/4 {
+		t.Errorf("the median should be estimated from the samples: %f", p50)
+	}
+}
+
+func TestStatsdGenerator_FlushGaugeTTL(t *testing.T) {
+	g := NewStatsdGenerator(&config.Statsd{MaxNames: 4, GaugeTTL: &config.Duration{Duration: time.Minute}}).(*statsdGenerator)
+	g.handle([]string{"stopped:1|g", "running:2|g"})
+	g.updated["stopped"] = time.Now().Add(-2 * time.Minute)
+
+	values := g.flush()
+	if len(values) != 1 || values["custom.statsd.running"] != 2 {
+		t.Errorf("the gauges not updated in the TTL should be dropped: %v", values)
+	}
+	if _, ok := g.gauges["stopped"]; ok {
+		t.Errorf("the expired gauges should not count toward max_names: %v", g.gauges)
+	}
+}
+
+func TestStatsdGenerator_Generate(t *testing.T) {
+	g := NewStatsdGenerator(&config.Statsd{Listen: "127.0.0.1:0", ListenTCP: "127.0.0.1:0", MaxNames: 10}).(*statsdGenerator)
+	if _, err := g.Generate(); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	defer g.close()
+
+	udp, err := net.Dial("udp", g.listeners[0].(net.PacketConn).LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	fmt.Fprint(udp, "udp:1|c\nudp:2|c")
+
+	tcp, err := net.Dial("tcp", g.listeners[1].(net.Listener).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(tcp, "tcp:3|g\n")
+	tcp.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	values := Values{}
+	for time.Now().Before(deadline) && (values["custom.statsd.udp"] != 3 || values["custom.statsd.tcp"] != 3) {
+		time.Sleep(10 * time.Millisecond)
+		vs, err := g.Generate()
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		values["custom.statsd.udp"] += vs["custom.statsd.udp"]
+		if v, ok := vs["custom.statsd.tcp"]; ok {
+			values["custom.statsd.tcp"] = v
+		}
+	}
+	if values["custom.statsd.udp"] != 3 || values["custom.statsd.tcp"] != 3 {
+		t.Errorf("the metrics should be received: %v", values)
+	}
+}
@@ -4,76 +4,134 @@ package windows
 
 import (
 	"syscall"
+	"unsafe"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	"github.com/mackerelio/mackerel-agent/util/windows"
 )
 
 // CPUUsageGenerator is struct of windows api
 type CPUUsageGenerator struct {
-	query    syscall.Handle
-	counters []*windows.CounterInfo
+	query *pdhQuery
+
+	// systemTimes collects the CPU usage instead of query if it is nil.
+	systemTimes func() (cpuTimes, error)
+	last        *cpuTimes
 }
 
-var cpuUsageLogger = logging.GetLogger("cpu.user.percentage")
+var cpuUsageLogger = logformat.GetLogger("cpu.user.percentage")
 
-// NewCPUUsageGenerator is set up windows api
-func NewCPUUsageGenerator() (*CPUUsageGenerator, error) {
-	g := &CPUUsageGenerator{0, nil}
+var cpuUsageCounters = []pdhCounter{
+	{"cpu.user.percentage", `\Processor(_Total)\% User Time`},
+	{"cpu.system.percentage", `\Processor(_Total)\% Privileged Time`},
+	{"cpu.idle.percentage", `\Processor(_Total)\% Idle Time`},
+}
 
-	var err error
-	g.query, err = windows.CreateQuery()
-	if err != nil {
-		cpuUsageLogger.Criticalf(err.Error())
-		return nil, err
-	}
-	var counter *windows.CounterInfo
+// cpuTimes are the times of all the processors by GetSystemTimes in 100
+// nanoseconds. The kernel time includes the idle time.
+type cpuTimes struct {
+	idle   uint64
+	kernel uint64
+	user   uint64
+}
 
-	counter, err = windows.CreateCounter(g.query, "cpu.user.percentage", `\Processor(_Total)\% User Time`)
-	if err != nil {
-		cpuUsageLogger.Criticalf(err.Error())
-		return nil, err
+func getSystemTimes() (cpuTimes, error) {
+	var idle, kernel, user syscall.Filetime
+	r, _, err := windows.GetSystemTimes.Call(
+		uintptr(unsafe.Pointer(&idle)),
+		uintptr(unsafe.Pointer(&kernel)),
+		uintptr(unsafe.Pointer(&user)))
+	if r == 0 {
+		return cpuTimes{}, err
 	}
-	g.counters = append(g.counters, counter)
-
-	counter, err = windows.CreateCounter(g.query, "cpu.system.percentage", `\Processor(_Total)\% Privileged Time`)
-	if err != nil {
-		cpuUsageLogger.Criticalf(err.Error())
-		return nil, err
+	ticks := func(t syscall.Filetime) uint64 {
+		return uint64(t.HighDateTime)<<32 | uint64(t.LowDateTime)
 	}
-	g.counters = append(g.counters, counter)
+	return cpuTimes{idle: ticks(idle), kernel: ticks(kernel), user: ticks(user)}, nil
+}
 
-	counter, err = windows.CreateCounter(g.query, "cpu.idle.percentage", `\Processor(_Total)\% Idle Time`)
+// NewCPUUsageGenerator is set up windows api. The CPU usage is collected by
+// the performance counters, or by GetSystemTimes if backend says so or if the
+// counters are not available with WindowsCPUBackendAuto.
+func NewCPUUsageGenerator(backend config.WindowsCPUBackend) (*CPUUsageGenerator, error) {
+	return newCPUUsageGenerator(defaultPDH, getSystemTimes, backend)
+}
+
+func newCPUUsageGenerator(p pdh, systemTimes func() (cpuTimes, error), backend config.WindowsCPUBackend) (*CPUUsageGenerator, error) {
+	if backend != config.WindowsCPUBackendSystemTimes {
+		query, err := newPDHQuery(p, 0, func() ([]pdhCounter, error) {
+			return cpuUsageCounters, nil
+		})
+		if err == nil {
+			cpuUsageLogger.Infof("Collecting the CPU usage by the performance counters")
+			return &CPUUsageGenerator{query: query}, nil
+		}
+		if backend == config.WindowsCPUBackendPDH {
+			cpuUsageLogger.Criticalf(err.Error())
+			return nil, err
+		}
+		cpuUsageLogger.Warningf("Failed to add the performance counters of the CPU usage, falling back to GetSystemTimes: %s", err)
+	}
+	t, err := systemTimes()
 	if err != nil {
 		cpuUsageLogger.Criticalf(err.Error())
 		return nil, err
 	}
-	g.counters = append(g.counters, counter)
-	return g, nil
+	cpuUsageLogger.Infof("Collecting the CPU usage by GetSystemTimes")
+	return &CPUUsageGenerator{systemTimes: systemTimes, last: &t}, nil
 }
 
 // Generate XXX
 func (g *CPUUsageGenerator) Generate() (metrics.Values, error) {
-
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			cpuUsageLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
+	if g.query == nil {
+		return g.generateBySystemTimes()
+	}
+	results, err := g.query.collect()
+	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]float64)
-	for _, v := range g.counters {
-		results[v.PostName], err = windows.GetCounterValue(v.Counter)
-		if err != nil {
-			return nil, err
-		}
+	cpuUsageLogger.Debugf("cpuusage: %v", results)
+
+	return results, nil
+}
+
+// generateBySystemTimes returns the percentages of the times since the last
+// generation, which are empty if the times did not increase.
+func (g *CPUUsageGenerator) generateBySystemTimes() (metrics.Values, error) {
+	curr, err := g.systemTimes()
+	if err != nil {
+		return nil, err
+	}
+	prev := g.last
+	g.last = &curr
+	if curr.idle < prev.idle || curr.kernel < prev.kernel || curr.user < prev.user {
+		return metrics.Values{}, nil
+	}
+	idle := float64(curr.idle - prev.idle)
+	kernel := float64(curr.kernel - prev.kernel)
+	user := float64(curr.user - prev.user)
+	total := kernel + user
+	if total <= 0 || idle > kernel {
+		return metrics.Values{}, nil
+	}
+	results := metrics.Values{
+		"cpu.user.percentage":   user / total * 100,
+		"cpu.system.percentage": (kernel - idle) / total * 100,
+		"cpu.idle.percentage":   idle / total * 100,
 	}
 
-	cpuUsageLogger.Debugf("cpuusage: %q", results)
+	cpuUsageLogger.Debugf("cpuusage: %v", results)
 
 	return results, nil
 }
+
+// Close closes the query.
+func (g *CPUUsageGenerator) Close() error {
+	if g.query == nil {
+		return nil
+	}
+	return g.query.Close()
+}
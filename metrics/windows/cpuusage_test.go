@@ -2,8 +2,14 @@
 
 package windows
 
-import "math"
-import "testing"
+import (
+	"math"
+	"syscall"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util/windows"
+)
 
 var cpuUsageMetricNames = []string{
 	"cpu.user.percentage",
@@ -12,7 +18,7 @@ var cpuUsageMetricNames = []string{
 }
 
 func TestCPUUsageGenerate(t *testing.T) {
-	g, err := NewCPUUsageGenerator()
+	g, err := NewCPUUsageGenerator(config.WindowsCPUBackendAuto)
 	if err != nil {
 		t.Errorf("should not raise error: %v", err)
 	}
@@ -57,3 +63,63 @@ func TestCPUUsageGenerate(t *testing.T) {
 
 	g.Generate()
 }
+
+// brokenPDH is the PDH layer whose counters can not be added, as with the
+// corrupted registry of the performance counters.
+type brokenPDH struct {
+	*fakePDH
+}
+
+func (brokenPDH) AddCounter(query syscall.Handle, path string) (syscall.Handle, error) {
+	return 0, windows.PdhError(windows.PDH_CSTATUS_NO_COUNTER)
+}
+
+func TestCPUUsageGenerate_systemTimes(t *testing.T) {
+	times := []cpuTimes{
+		{idle: 1000, kernel: 2000, user: 1000},
+		// idle 600, system 100, user 300
+		{idle: 1600, kernel: 2700, user: 1300},
+		// decreased
+		{idle: 1500, kernel: 2700, user: 1300},
+	}
+	systemTimes := func() (cpuTimes, error) {
+		t := times[0]
+		times = times[1:]
+		return t, nil
+	}
+	p := brokenPDH{newFakePDH(nil)}
+	g, err := newCPUUsageGenerator(p, systemTimes, config.WindowsCPUBackendAuto)
+	if err != nil {
+		t.Fatalf("should fall back to GetSystemTimes: %s", err)
+	}
+	if g.query != nil || len(p.queries) != 0 {
+		t.Errorf("the query should not be opened: %v", p.queries)
+	}
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["cpu.user.percentage"] != 30 || values["cpu.system.percentage"] != 10 || values["cpu.idle.percentage"] != 60 {
+		t.Errorf("unexpected values: %v", values)
+	}
+	if values, err := g.Generate(); err != nil || len(values) != 0 {
+		t.Errorf("the decreased times should be skipped: %v, %v", values, err)
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+
+	if _, err := newCPUUsageGenerator(p, systemTimes, config.WindowsCPUBackendPDH); err == nil {
+		t.Error("should not fall back to GetSystemTimes with windows_cpu_backend = \"pdh\"")
+	}
+
+	ok := newFakePDH(map[string]float64{})
+	times = []cpuTimes{{idle: 1000, kernel: 2000, user: 1000}}
+	g, err = newCPUUsageGenerator(ok, systemTimes, config.WindowsCPUBackendSystemTimes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.query != nil || ok.opened != 0 {
+		t.Error("the performance counters should not be used with windows_cpu_backend = \"system_times\"")
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"time"
 
 	"github.com/StackExchange/wmi"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 )
 
@@ -17,7 +17,7 @@ type DiskGenerator struct {
 	Interval time.Duration
 }
 
-var diskLogger = logging.GetLogger("metrics.disk")
+var diskLogger = logformat.GetLogger("metrics.disk")
 
 // NewDiskGenerator XXX
 func NewDiskGenerator(interval time.Duration) (*DiskGenerator, error) {
@@ -50,7 +50,7 @@ func (g *DiskGenerator) Generate() (metrics.Values, error) {
 		results[fmt.Sprintf(`disk.%s.reads.delta`, name)] = float64(record.DiskReadsPerSec)
 		results[fmt.Sprintf(`disk.%s.writes.delta`, name)] = float64(record.DiskWritesPerSec)
 	}
-	diskLogger.Debugf("%q", results)
+	diskLogger.Debugf("%v", results)
 	return results, nil
 }
 
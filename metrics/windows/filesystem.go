@@ -5,7 +5,7 @@ package windows
 import (
 	"regexp"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	"github.com/mackerelio/mackerel-agent/util"
 	"github.com/mackerelio/mackerel-agent/util/windows"
@@ -21,7 +21,7 @@ func NewFilesystemGenerator(ignoreReg *regexp.Regexp) (*FilesystemGenerator, err
 	return &FilesystemGenerator{IgnoreRegexp: ignoreReg}, nil
 }
 
-var logger = logging.GetLogger("metrics.filesystem")
+var logger = logformat.GetLogger("metrics.filesystem")
 
 var driveLetterReg = regexp.MustCompile(`^(.*):`)
 
@@ -42,6 +42,6 @@ func (g *FilesystemGenerator) Generate() (metrics.Values, error) {
 			ret["filesystem."+device+".used"] = values.KbUsed * 1024
 		}
 	}
-	logger.Debugf("%q", ret)
+	logger.Debugf("%v", ret)
 	return ret, nil
 }
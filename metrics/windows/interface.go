@@ -7,10 +7,9 @@ import (
 	"net"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	"github.com/mackerelio/mackerel-agent/util/windows"
 )
@@ -18,11 +17,14 @@ import (
 // InterfaceGenerator XXX
 type InterfaceGenerator struct {
 	Interval time.Duration
-	query    syscall.Handle
-	counters []*windows.CounterInfo
+	query    *pdhQuery
 }
 
-var interfaceLogger = logging.GetLogger("metrics.interface")
+// interfaceRefreshInterval is the interval to list the interfaces again to
+// follow the interfaces added or removed.
+const interfaceRefreshInterval = 10 * time.Minute
+
+var interfaceLogger = logformat.GetLogger("metrics.interface")
 
 func normalizeName(s string) string {
 	return strings.Map(func(r rune) rune {
@@ -35,24 +37,23 @@ func normalizeName(s string) string {
 
 // NewInterfaceGenerator XXX
 func NewInterfaceGenerator(interval time.Duration) (*InterfaceGenerator, error) {
-	g := &InterfaceGenerator{interval, 0, nil}
-
-	var err error
-	g.query, err = windows.CreateQuery()
+	query, err := newPDHQuery(defaultPDH, interfaceRefreshInterval, listInterfaceCounters)
 	if err != nil {
 		interfaceLogger.Criticalf(err.Error())
 		return nil, err
 	}
+	return &InterfaceGenerator{interval, query}, nil
+}
 
+// listInterfaceCounters lists the counters of the network interfaces.
+func listInterfaceCounters() ([]pdhCounter, error) {
 	ifs, err := net.Interfaces()
 	if err != nil {
-		interfaceLogger.Criticalf(err.Error())
 		return nil, err
 	}
 
 	ai, err := windows.GetAdapterList()
 	if err != nil {
-		interfaceLogger.Criticalf(err.Error())
 		return nil, err
 	}
 
@@ -82,6 +83,7 @@ func NewInterfaceGenerator(interval time.Duration) (*InterfaceGenerator, error)
 		nameMap[name] = escaped
 	}
 
+	var counters []pdhCounter
 	for _, ifi := range ifs {
 		for ai = first; ai != nil; ai = ai.Next {
 			if ifi.Index == int(ai.Index) {
@@ -99,41 +101,19 @@ func NewInterfaceGenerator(interval time.Duration) (*InterfaceGenerator, error)
 				name = strings.Replace(name, "#", "_", -1)
 				name = strings.Replace(name, "/", "_", -1)
 				name = strings.Replace(name, `\`, "_", -1)
-				var counter *windows.CounterInfo
-
-				counter, err = windows.CreateCounter(
-					g.query,
-					fmt.Sprintf(`interface.%s.rxBytes.delta`, escaped),
-					fmt.Sprintf(`\Network Interface(%s)\Bytes Received/sec`, name))
-				if err != nil {
-					interfaceLogger.Criticalf(err.Error())
-					return nil, err
-				}
-				g.counters = append(g.counters, counter)
-				counter, err = windows.CreateCounter(
-					g.query,
-					fmt.Sprintf(`interface.%s.txBytes.delta`, escaped),
-					fmt.Sprintf(`\Network Interface(%s)\Bytes Sent/sec`, name))
-				if err != nil {
-					interfaceLogger.Criticalf(err.Error())
-					return nil, err
-				}
-				g.counters = append(g.counters, counter)
+				counters = append(counters,
+					pdhCounter{
+						fmt.Sprintf(`interface.%s.rxBytes.delta`, escaped),
+						fmt.Sprintf(`\Network Interface(%s)\Bytes Received/sec`, name),
+					},
+					pdhCounter{
+						fmt.Sprintf(`interface.%s.txBytes.delta`, escaped),
+						fmt.Sprintf(`\Network Interface(%s)\Bytes Sent/sec`, name),
+					})
 			}
 		}
 	}
-
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			interfaceLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
-		interfaceLogger.Criticalf(err.Error())
-		return nil, err
-	}
-
-	return g, nil
+	return counters, nil
 }
 
 // Generate XXX
@@ -141,24 +121,17 @@ func (g *InterfaceGenerator) Generate() (metrics.Values, error) {
 
 	time.Sleep(g.Interval)
 
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			interfaceLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
+	results, err := g.query.collect()
+	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]float64)
-	for _, v := range g.counters {
-		results[v.PostName], err = windows.GetCounterValue(v.Counter)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	interfaceLogger.Debugf("%q", results)
+	interfaceLogger.Debugf("%v", results)
 
 	return results, nil
 }
+
+// Close closes the query.
+func (g *InterfaceGenerator) Close() error {
+	return g.query.Close()
+}
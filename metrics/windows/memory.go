@@ -5,7 +5,7 @@ package windows
 import (
 	"unsafe"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
 	"github.com/mackerelio/mackerel-agent/util/windows"
 )
@@ -14,7 +14,7 @@ import (
 type MemoryGenerator struct {
 }
 
-var memoryLogger = logging.GetLogger("metrics.memory")
+var memoryLogger = logformat.GetLogger("metrics.memory")
 
 // NewMemoryGenerator XXX
 func NewMemoryGenerator() (*MemoryGenerator, error) {
@@ -40,6 +40,6 @@ func (g *MemoryGenerator) Generate() (metrics.Values, error) {
 	ret["memory.pagefile_total"] = float64(memoryStatusEx.TotalPageFile)
 	ret["memory.pagefile_free"] = float64(memoryStatusEx.AvailPageFile)
 
-	memoryLogger.Debugf("memory : %s", ret)
+	memoryLogger.Debugf("memory : %v", ret)
 	return metrics.Values(ret), nil
 }
@@ -0,0 +1,241 @@
+// +build windows
+
+package windows
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util/windows"
+)
+
+var pdhLogger = logformat.GetLogger("metrics.pdh")
+
+var errPDHQueryClosed = errors.New("the PDH query is closed")
+
+// pdh is the PDH functions used by pdhQuery, which are faked in the tests.
+type pdh interface {
+	OpenQuery() (syscall.Handle, error)
+	AddCounter(query syscall.Handle, path string) (syscall.Handle, error)
+	// CollectQueryData returns windows.PdhError of the status.
+	CollectQueryData(query syscall.Handle) error
+	CounterValue(counter syscall.Handle) (float64, error)
+	CloseQuery(query syscall.Handle) error
+}
+
+type pdhAPI struct{}
+
+var defaultPDH pdh = pdhAPI{}
+
+func (pdhAPI) OpenQuery() (syscall.Handle, error) {
+	return windows.CreateQuery()
+}
+
+func (pdhAPI) AddCounter(query syscall.Handle, path string) (syscall.Handle, error) {
+	c, err := windows.CreateCounter(query, "", path)
+	if err != nil {
+		return 0, err
+	}
+	return c.Counter, nil
+}
+
+func (pdhAPI) CollectQueryData(query syscall.Handle) error {
+	r, _, _ := windows.PdhCollectQueryData.Call(uintptr(query))
+	if r != 0 {
+		return windows.PdhError(r)
+	}
+	return nil
+}
+
+func (pdhAPI) CounterValue(counter syscall.Handle) (float64, error) {
+	return windows.GetCounterValue(counter)
+}
+
+func (pdhAPI) CloseQuery(query syscall.Handle) error {
+	r, _, _ := windows.PdhCloseQuery.Call(uintptr(query))
+	if r != 0 {
+		return windows.PdhError(r)
+	}
+	return nil
+}
+
+// pdhCounter is the counter of path posted as name.
+type pdhCounter struct {
+	name string
+	path string
+}
+
+// pdhQuery keeps the PDH query and its counters across the generations, so
+// that the counters are not added every time. The counters are listed by
+// list, which is called again every refreshInterval if it is positive to
+// follow the instances which come and go, such as the network interfaces.
+// The query is reopened when the counters change, or when the handle becomes
+// invalid.
+type pdhQuery struct {
+	pdh             pdh
+	list            func() ([]pdhCounter, error)
+	refreshInterval time.Duration
+
+	mu          sync.Mutex
+	query       syscall.Handle
+	specs       []pdhCounter
+	handles     []syscall.Handle
+	refreshedAt time.Time
+	closed      bool
+}
+
+// newPDHQuery opens the query of the counters listed by list.
+func newPDHQuery(p pdh, refreshInterval time.Duration, list func() ([]pdhCounter, error)) (*pdhQuery, error) {
+	specs, err := list()
+	if err != nil {
+		return nil, err
+	}
+	q := &pdhQuery{pdh: p, list: list, refreshInterval: refreshInterval}
+	if err := q.open(specs, time.Now()); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// open opens the query, adds the counters of specs and collects the query
+// once, so that the rates of the counters are available at the next
+// collection.
+func (q *pdhQuery) open(specs []pdhCounter, now time.Time) error {
+	query, err := q.pdh.OpenQuery()
+	if err != nil {
+		return err
+	}
+	handles := make([]syscall.Handle, len(specs))
+	for i, c := range specs {
+		if handles[i], err = q.pdh.AddCounter(query, c.path); err != nil {
+			q.pdh.CloseQuery(query)
+			return err
+		}
+	}
+	// PDH_NO_DATA means there are no counters
+	if err := q.pdh.CollectQueryData(query); err != nil && err != windows.PdhError(windows.PDH_NO_DATA) {
+		q.pdh.CloseQuery(query)
+		return err
+	}
+	q.query, q.specs, q.handles, q.refreshedAt = query, specs, handles, now
+	return nil
+}
+
+// reopen closes the current query and opens the query of specs.
+func (q *pdhQuery) reopen(specs []pdhCounter, now time.Time) error {
+	if q.query != 0 {
+		if err := q.pdh.CloseQuery(q.query); err != nil {
+			pdhLogger.Debugf("Failed to close the query: %s", err)
+		}
+		q.query = 0
+	}
+	return q.open(specs, now)
+}
+
+// refresh lists the counters again if refreshInterval has passed, and
+// reopens the query if they change. The query which failed to be reopened
+// is retried. It reports whether the query is reopened.
+func (q *pdhQuery) refresh(now time.Time) (bool, error) {
+	if q.query != 0 && (q.refreshInterval <= 0 || now.Sub(q.refreshedAt) < q.refreshInterval) {
+		return false, nil
+	}
+	specs, err := q.list()
+	if err != nil {
+		if q.query == 0 {
+			return false, err
+		}
+		// keep the current counters
+		pdhLogger.Warningf("Failed to list the counters: %s", err)
+		q.refreshedAt = now
+		return false, nil
+	}
+	if q.query != 0 && sameCounters(q.specs, specs) {
+		q.refreshedAt = now
+		return false, nil
+	}
+	if q.query != 0 {
+		pdhLogger.Infof("The counters changed. Adding %d counters again", len(specs))
+	}
+	return true, q.reopen(specs, now)
+}
+
+func sameCounters(a, b []pdhCounter) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// collect collects the query and returns the values of the counters. If the
+// handle is invalid, the query is reopened for the next generation. The
+// values are empty when the query is just reopened, because the rates are
+// not available until the next collection.
+func (q *pdhQuery) collect() (metrics.Values, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errPDHQueryClosed
+	}
+	reopened, err := q.refresh(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if reopened {
+		return metrics.Values{}, nil
+	}
+	if err := q.collectQuery(); err != nil {
+		return nil, err
+	}
+	results := make(metrics.Values, len(q.specs))
+	for i, c := range q.specs {
+		v, err := q.pdh.CounterValue(q.handles[i])
+		if err != nil {
+			return nil, err
+		}
+		results[c.name] = v
+	}
+	return results, nil
+}
+
+func (q *pdhQuery) collectQuery() error {
+	err := q.pdh.CollectQueryData(q.query)
+	if err == nil {
+		return nil
+	}
+	switch err {
+	case windows.PdhError(windows.PDH_NO_DATA):
+		pdhLogger.Infof("this metric has not data. ")
+	case windows.PdhError(windows.PDH_INVALID_HANDLE):
+		pdhLogger.Warningf("The query is invalid. Reopening it: %s", err)
+		// the query failed to be reopened is retried by the next refresh
+		if e := q.reopen(q.specs, time.Now()); e != nil {
+			pdhLogger.Warningf("Failed to reopen the query: %s", e)
+		}
+	}
+	return err
+}
+
+// Close closes the query. The query is not collected after closed.
+func (q *pdhQuery) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	if q.query == 0 {
+		return nil
+	}
+	err := q.pdh.CloseQuery(q.query)
+	q.query = 0
+	return err
+}
@@ -0,0 +1,190 @@
+// +build windows
+
+package windows
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/util/windows"
+)
+
+// fakePDH is the PDH layer whose counters of the open queries return values
+// of their paths.
+type fakePDH struct {
+	values  map[string]float64
+	next    syscall.Handle
+	queries map[syscall.Handle]bool
+	paths   map[syscall.Handle]string
+	opened  int
+	failing map[syscall.Handle]error
+}
+
+func newFakePDH(values map[string]float64) *fakePDH {
+	return &fakePDH{
+		values:  values,
+		queries: make(map[syscall.Handle]bool),
+		paths:   make(map[syscall.Handle]string),
+		failing: make(map[syscall.Handle]error),
+	}
+}
+
+func (p *fakePDH) OpenQuery() (syscall.Handle, error) {
+	p.next++
+	p.queries[p.next] = true
+	p.opened++
+	return p.next, nil
+}
+
+func (p *fakePDH) AddCounter(query syscall.Handle, path string) (syscall.Handle, error) {
+	if !p.queries[query] {
+		return 0, windows.PdhError(windows.PDH_INVALID_HANDLE)
+	}
+	p.next++
+	p.paths[p.next] = path
+	return p.next, nil
+}
+
+func (p *fakePDH) CollectQueryData(query syscall.Handle) error {
+	if err := p.failing[query]; err != nil {
+		return err
+	}
+	if !p.queries[query] {
+		return windows.PdhError(windows.PDH_INVALID_HANDLE)
+	}
+	return nil
+}
+
+func (p *fakePDH) CounterValue(counter syscall.Handle) (float64, error) {
+	return p.values[p.paths[counter]], nil
+}
+
+func (p *fakePDH) CloseQuery(query syscall.Handle) error {
+	if !p.queries[query] {
+		return windows.PdhError(windows.PDH_INVALID_HANDLE)
+	}
+	delete(p.queries, query)
+	return nil
+}
+
+func TestPDHQuery(t *testing.T) {
+	p := newFakePDH(map[string]float64{`\A`: 1, `\B`: 2})
+	q, err := newPDHQuery(p, 0, func() ([]pdhCounter, error) {
+		return []pdhCounter{{"a", `\A`}, {"b", `\B`}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		values, err := q.collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 2 || values["a"] != 1 || values["b"] != 2 {
+			t.Errorf("unexpected values: %v", values)
+		}
+	}
+	if p.opened != 1 {
+		t.Errorf("the query should be reused but opened %d times", p.opened)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.queries) != 0 {
+		t.Errorf("the query should be closed: %v", p.queries)
+	}
+	if _, err := q.collect(); err != errPDHQueryClosed {
+		t.Errorf("the closed query should not be collected: %v", err)
+	}
+}
+
+func TestPDHQuery_Refresh(t *testing.T) {
+	p := newFakePDH(map[string]float64{`\If(eth0)`: 1, `\If(eth1)`: 2})
+	counters := []pdhCounter{{"eth0", `\If(eth0)`}}
+	var listErr error
+	q, err := newPDHQuery(p, time.Minute, func() ([]pdhCounter, error) {
+		return counters, listErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the counters are not listed until the refresh interval passes
+	counters = []pdhCounter{{"eth0", `\If(eth0)`}, {"eth1", `\If(eth1)`}}
+	if values, err := q.collect(); err != nil || len(values) != 1 {
+		t.Errorf("the counters should not be refreshed yet: %v, %v", values, err)
+	}
+
+	q.refreshedAt = q.refreshedAt.Add(-time.Minute)
+	if values, err := q.collect(); err != nil || len(values) != 0 {
+		t.Errorf("the values should be skipped when the query is reopened: %v, %v", values, err)
+	}
+	if p.opened != 2 || len(p.queries) != 1 {
+		t.Errorf("the query should be reopened: opened %d times, %d open", p.opened, len(p.queries))
+	}
+	if values, err := q.collect(); err != nil || len(values) != 2 || values["eth1"] != 2 {
+		t.Errorf("the added counter should be collected: %v, %v", values, err)
+	}
+
+	// the same counters do not reopen the query
+	q.refreshedAt = q.refreshedAt.Add(-time.Minute)
+	if values, err := q.collect(); err != nil || len(values) != 2 {
+		t.Errorf("unexpected values: %v, %v", values, err)
+	}
+	// the counters are kept if they fail to be listed
+	listErr = errors.New("failed to list")
+	q.refreshedAt = q.refreshedAt.Add(-time.Minute)
+	if values, err := q.collect(); err != nil || len(values) != 2 {
+		t.Errorf("the current counters should be kept: %v, %v", values, err)
+	}
+	if p.opened != 2 {
+		t.Errorf("the query should not be reopened: opened %d times", p.opened)
+	}
+}
+
+func TestPDHQuery_InvalidHandle(t *testing.T) {
+	p := newFakePDH(map[string]float64{`\A`: 1})
+	q, err := newPDHQuery(p, 0, func() ([]pdhCounter, error) {
+		return []pdhCounter{{"a", `\A`}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the handle becomes invalid, such as after the counters are reloaded
+	delete(p.queries, q.query)
+	if _, err := q.collect(); err != windows.PdhError(windows.PDH_INVALID_HANDLE) {
+		t.Errorf("the error should be returned: %v", err)
+	}
+	if p.opened != 2 {
+		t.Errorf("the query should be reopened: opened %d times", p.opened)
+	}
+	if values, err := q.collect(); err != nil || values["a"] != 1 {
+		t.Errorf("the reopened query should be collected: %v, %v", values, err)
+	}
+}
+
+func TestNewCPUUsageGenerator_FakePDH(t *testing.T) {
+	p := newFakePDH(map[string]float64{
+		`\Processor(_Total)\% User Time`:       10,
+		`\Processor(_Total)\% Privileged Time`: 5,
+		`\Processor(_Total)\% Idle Time`:       85,
+	})
+	g, err := newCPUUsageGenerator(p, getSystemTimes, config.WindowsCPUBackendAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["cpu.user.percentage"] != 10 || values["cpu.system.percentage"] != 5 || values["cpu.idle.percentage"] != 85 {
+		t.Errorf("unexpected values: %v", values)
+	}
+	if err := g.Close(); err != nil || len(p.queries) != 0 {
+		t.Errorf("the query should be closed: %v, %v", err, p.queries)
+	}
+}
@@ -0,0 +1,246 @@
+// +build windows
+
+package windows
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util/windows"
+	mkr "github.com/mackerelio/mackerel-client-go"
+)
+
+var perfCounterLogger = logformat.GetLogger("metrics.windows_perfcounter")
+
+// perfCounterWarningInterval is the minimum interval of the warnings of a
+// counter which can not be collected, such as the counters of a stopped service.
+const perfCounterWarningInterval = time.Hour
+
+// PerfCounterGenerator collects the performance counters configured by
+// [plugin.windows_perfcounter.NAME]. The query is collected at the creation
+// as well as every generation, so that the averaged counters such as
+// "% Processor Time" are the averages over the interval of the generations.
+type PerfCounterGenerator struct {
+	Config *config.WindowsPerfCounterPlugin
+
+	mu       sync.Mutex
+	query    syscall.Handle
+	counters []*perfCounter
+}
+
+type perfCounter struct {
+	conf   *config.WindowsPerfCounter
+	handle syscall.Handle // 0 until the counter is added
+	// added is true if the counter is added since the last collection,
+	// whose averaged values are not available yet.
+	added   bool
+	failing bool
+	warned  time.Time
+}
+
+// NewPerfCounterGenerator creates a generator of conf. The counters which do
+// not exist at the moment are added when they appear.
+func NewPerfCounterGenerator(conf *config.WindowsPerfCounterPlugin) (*PerfCounterGenerator, error) {
+	query, err := windows.CreateQuery()
+	if err != nil {
+		perfCounterLogger.Criticalf(err.Error())
+		return nil, err
+	}
+	g := &PerfCounterGenerator{Config: conf, query: query}
+	for _, c := range conf.Counters {
+		g.counters = append(g.counters, &perfCounter{conf: c})
+	}
+	g.addCounters(time.Now())
+	if err := g.collect(); err != nil {
+		perfCounterLogger.Criticalf(err.Error())
+		return nil, err
+	}
+	for _, c := range g.counters {
+		c.added = false
+	}
+	return g, nil
+}
+
+func (g *PerfCounterGenerator) String() string {
+	return fmt.Sprintf("windows_perfcounter %q", g.Config.MetricPrefix)
+}
+
+// Generate collects the counters. The counters which can not be collected
+// are skipped with the warnings at most once in perfCounterWarningInterval.
+func (g *PerfCounterGenerator) Generate() (metrics.Values, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.query == 0 {
+		return nil, errPDHQueryClosed
+	}
+	now := time.Now()
+	g.addCounters(now)
+	if err := g.collect(); err != nil {
+		return nil, err
+	}
+
+	results := make(metrics.Values)
+	for _, c := range g.counters {
+		if c.handle == 0 {
+			continue
+		}
+		added := c.added
+		c.added = false
+		if c.conf.IsWildcard() {
+			values, err := windows.GetFormattedCounterArray(c.handle)
+			if err != nil {
+				c.fail(now, err)
+				continue
+			}
+			for instance, v := range values {
+				results["custom."+c.conf.MetricName(g.Config.MetricPrefix, instance)] = v
+			}
+			c.succeed()
+			continue
+		}
+		v, err := windows.GetFormattedCounterValue(c.handle)
+		if err != nil {
+			if !added {
+				c.fail(now, err)
+			}
+			continue
+		}
+		results["custom."+c.conf.MetricName(g.Config.MetricPrefix, "")] = v
+		c.succeed()
+	}
+	return results, nil
+}
+
+// PrepareGraphDefs returns no graph definitions. The metrics are graphed by their names.
+func (g *PerfCounterGenerator) PrepareGraphDefs() ([]*mkr.GraphDefsParam, error) {
+	return nil, nil
+}
+
+// CustomIdentifier returns the custom identifier of the configuration.
+func (g *PerfCounterGenerator) CustomIdentifier() *string {
+	return g.Config.CustomIdentifier
+}
+
+func (g *PerfCounterGenerator) collect() error {
+	r, _, _ := windows.PdhCollectQueryData.Call(uintptr(g.query))
+	if r == windows.PDH_INVALID_HANDLE {
+		g.reopen()
+	}
+	// PDH_NO_DATA means none of the counters are added yet.
+	if r != 0 && r != windows.PDH_NO_DATA {
+		return windows.PdhError(r)
+	}
+	return nil
+}
+
+// reopen opens the query again, whose handle became invalid. The counters
+// are added again by the next generation.
+func (g *PerfCounterGenerator) reopen() {
+	perfCounterLogger.Warningf("The query of %s is invalid. Reopening it", g)
+	windows.PdhCloseQuery.Call(uintptr(g.query))
+	query, err := windows.CreateQuery()
+	if err != nil {
+		perfCounterLogger.Warningf("Failed to reopen the query of %s: %s", g, err)
+		return
+	}
+	g.query = query
+	for _, c := range g.counters {
+		c.handle = 0
+	}
+}
+
+// Close closes the query.
+func (g *PerfCounterGenerator) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.query == 0 {
+		return nil
+	}
+	r, _, _ := windows.PdhCloseQuery.Call(uintptr(g.query))
+	g.query = 0
+	if r != 0 {
+		return windows.PdhError(r)
+	}
+	return nil
+}
+
+// addCounters adds the counters which are not added yet.
+func (g *PerfCounterGenerator) addCounters(now time.Time) {
+	for _, c := range g.counters {
+		if c.handle != 0 {
+			continue
+		}
+		h, err := addPerfCounter(g.query, c.conf)
+		if err != nil {
+			c.fail(now, err)
+			continue
+		}
+		c.handle = h
+		c.added = true
+	}
+}
+
+// addPerfCounter adds the counter by the English names, or by the localized
+// names. The index numbers of the path are resolved to the localized names.
+func addPerfCounter(query syscall.Handle, c *config.WindowsPerfCounter) (syscall.Handle, error) {
+	object, err := lookupPerfName(c.Object)
+	if err != nil {
+		return 0, err
+	}
+	counter, err := lookupPerfName(c.Counter)
+	if err != nil {
+		return 0, err
+	}
+	if object != c.Object || counter != c.Counter {
+		return windows.AddCounter(query, perfCounterPath(object, c.Instance, counter), false)
+	}
+	h, err := windows.AddCounter(query, c.Path, true)
+	if err != nil {
+		return windows.AddCounter(query, c.Path, false)
+	}
+	return h, nil
+}
+
+// lookupPerfName returns the localized name of s if s is the index number.
+func lookupPerfName(s string) (string, error) {
+	index, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return s, nil
+	}
+	name, err := windows.LookupPerfNameByIndex(uint32(index))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the name of the index %d: %s", index, err)
+	}
+	return name, nil
+}
+
+func perfCounterPath(object, instance, counter string) string {
+	if instance != "" {
+		return fmt.Sprintf(`\%s(%s)\%s`, object, instance, counter)
+	}
+	return fmt.Sprintf(`\%s\%s`, object, counter)
+}
+
+func (c *perfCounter) fail(now time.Time, err error) {
+	c.failing = true
+	if now.Sub(c.warned) < perfCounterWarningInterval {
+		perfCounterLogger.Debugf("Failed to collect %s: %s", c.conf.Path, err)
+		return
+	}
+	c.warned = now
+	perfCounterLogger.Warningf("Failed to collect %s: %s", c.conf.Path, err)
+}
+
+func (c *perfCounter) succeed() {
+	if c.failing {
+		perfCounterLogger.Infof("Collecting %s is recovered", c.conf.Path)
+		c.failing = false
+		c.warned = time.Time{}
+	}
+}
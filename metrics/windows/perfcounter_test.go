@@ -0,0 +1,46 @@
+// +build windows
+
+package windows
+
+import (
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestPerfCounterGenerator(t *testing.T) {
+	conf := &config.WindowsPerfCounterPlugin{
+		MetricPrefix:     "test",
+		InstanceWildcard: true,
+	}
+	for _, c := range []*config.WindowsPerfCounter{
+		{Path: `\System\Processor Queue Length`, Object: "System", Counter: "Processor Queue Length"},
+		// System and Processor Queue Length by the index numbers
+		{Path: `\2\44`, Object: "2", Counter: "44"},
+		{Path: `\Processor(*)\% Processor Time`, Object: "Processor", Instance: "*", Counter: "% Processor Time"},
+		{Path: `\No Such Object\No Such Counter`, Object: "No Such Object", Counter: "No Such Counter"},
+	} {
+		conf.Counters = append(conf.Counters, c)
+	}
+	g, err := NewPerfCounterGenerator(conf)
+	if err != nil {
+		t.Fatalf("NewPerfCounterGenerator() failed: %s", err)
+	}
+
+	values, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() failed: %s", err)
+	}
+	for _, name := range []string{
+		"custom.test.System.Processor_Queue_Length",
+		"custom.test.2.44",
+		"custom.test.Processor._Total.Processor_Time",
+	} {
+		if _, ok := values[name]; !ok {
+			t.Errorf("%s should be collected: %v", name, values)
+		}
+	}
+	if len(values) < 4 {
+		t.Errorf("the instances of the processors should be collected: %v", values)
+	}
+}
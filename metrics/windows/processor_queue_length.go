@@ -3,62 +3,42 @@
 package windows
 
 import (
-	"syscall"
-
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/metrics"
-	"github.com/mackerelio/mackerel-agent/util/windows"
 )
 
 // ProcessorQueueLengthGenerator is struct of windows api
 type ProcessorQueueLengthGenerator struct {
-	query    syscall.Handle
-	counters []*windows.CounterInfo
+	query *pdhQuery
 }
 
-var processorQueueLengthLogger = logging.GetLogger("metrics.processor_queue_length")
+var processorQueueLengthLogger = logformat.GetLogger("metrics.processor_queue_length")
 
 // NewProcessorQueueLengthGenerator is set up windows api
 func NewProcessorQueueLengthGenerator() (*ProcessorQueueLengthGenerator, error) {
-	g := &ProcessorQueueLengthGenerator{0, nil}
-
-	var err error
-	g.query, err = windows.CreateQuery()
-	if err != nil {
-		processorQueueLengthLogger.Criticalf(err.Error())
-		return nil, err
-	}
-
-	counter, err := windows.CreateCounter(g.query, "processor_queue_length", `\System\Processor Queue Length`)
+	query, err := newPDHQuery(defaultPDH, 0, func() ([]pdhCounter, error) {
+		return []pdhCounter{{"processor_queue_length", `\System\Processor Queue Length`}}, nil
+	})
 	if err != nil {
 		processorQueueLengthLogger.Criticalf(err.Error())
 		return nil, err
 	}
-	g.counters = append(g.counters, counter)
-	return g, nil
+	return &ProcessorQueueLengthGenerator{query}, nil
 }
 
 // Generate XXX
 func (g *ProcessorQueueLengthGenerator) Generate() (metrics.Values, error) {
-
-	r, _, err := windows.PdhCollectQueryData.Call(uintptr(g.query))
-	if r != 0 && err != nil {
-		if r == windows.PDH_NO_DATA {
-			processorQueueLengthLogger.Infof("this metric has not data. ")
-			return nil, err
-		}
+	results, err := g.query.collect()
+	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]float64)
-	for _, v := range g.counters {
-		results[v.PostName], err = windows.GetCounterValue(v.Counter)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	processorQueueLengthLogger.Debugf("processor_queue_length: %q", results)
+	processorQueueLengthLogger.Debugf("processor_queue_length: %v", results)
 
 	return results, nil
 }
+
+// Close closes the query.
+func (g *ProcessorQueueLengthGenerator) Close() error {
+	return g.query.Close()
+}
@@ -0,0 +1,48 @@
+// +build windows
+
+package windows
+
+import (
+	"regexp"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/metrics"
+	"github.com/mackerelio/mackerel-agent/util/windows"
+)
+
+var servicesLogger = logformat.GetLogger("metrics.services")
+
+// ServicesGenerator generates the number of the services which start
+// automatically but are not running. The services whose names do not match
+// IncludePattern or match ExcludePattern are not counted.
+type ServicesGenerator struct {
+	IncludePattern *regexp.Regexp
+	ExcludePattern *regexp.Regexp
+}
+
+// NewServicesGenerator creates a ServicesGenerator.
+func NewServicesGenerator(include, exclude *regexp.Regexp) (*ServicesGenerator, error) {
+	return &ServicesGenerator{IncludePattern: include, ExcludePattern: exclude}, nil
+}
+
+// Generate enumerates the services.
+func (g *ServicesGenerator) Generate() (metrics.Values, error) {
+	services, err := windows.CollectServices()
+	if err != nil {
+		servicesLogger.Errorf("Failed to enumerate the services: %s", err)
+		return nil, err
+	}
+	count := 0
+	for _, s := range services {
+		if g.IncludePattern != nil && !g.IncludePattern.MatchString(s.Name) {
+			continue
+		}
+		if g.ExcludePattern != nil && g.ExcludePattern.MatchString(s.Name) {
+			continue
+		}
+		if s.StartType == "auto" && s.State != "running" {
+			count++
+		}
+	}
+	return metrics.Values{"custom.windows.services.auto_not_running": float64(count)}, nil
+}
@@ -0,0 +1,222 @@
+// Package orphan finds the processes of the plugins surviving the previous
+// agent, such as after a crash, which may keep writing to the shared files.
+package orphan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+var logger = logformat.GetLogger("orphan")
+
+// stateName is the file of the state of the agent in the root directory.
+const stateName = "agent-process.json"
+
+// terminateTimeout is the time to wait for the processes after the
+// termination, after which the survivors are killed.
+var terminateTimeout = 3 * time.Second
+
+// Process is a process in the process table of the OS.
+type Process struct {
+	Pid  int
+	Ppid int
+	// Pgid is the process group, which is zero on Windows.
+	Pgid int
+	// UID is the user of the process, which is -1 on Windows.
+	UID     int
+	Started time.Time
+	// Command is the command line, or the name of the executable on Windows.
+	Command string
+	// InJob is true if the process is in a job object on Windows, such as the
+	// one of the supervisor killing the processes on exit.
+	InJob bool
+}
+
+func (p *Process) String() string {
+	s := fmt.Sprintf("pid %d (ppid %d", p.Pid, p.Ppid)
+	if p.Pgid != 0 {
+		s += fmt.Sprintf(", pgid %d", p.Pgid)
+	}
+	if p.InJob {
+		s += ", in a job"
+	}
+	return s + fmt.Sprintf(", started at %s): %s", p.Started.Format(time.RFC3339), p.Command)
+}
+
+// State is the agent recorded in the root directory. Started is the start
+// time of the process given by the OS, which tells that the pid is not reused.
+type State struct {
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// StatePath returns the file of the state of the agent in root.
+func StatePath(root string) string {
+	return filepath.Join(root, stateName)
+}
+
+// readState returns the state of the previous agent, or nil if not recorded.
+func readState(root string) (*State, error) {
+	b, err := ioutil.ReadFile(StatePath(root))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("malformed %s: %s", StatePath(root), err)
+	}
+	return &s, nil
+}
+
+func writeState(root string, s *State) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomically(StatePath(root), b, 0644)
+}
+
+// Clean logs the orphaned processes of the previous agent recorded in root,
+// and terminates them if terminate is true, then records the current agent.
+// The commands are the command lines of the plugins run as the agent.
+func Clean(root string, commands []string, terminate bool) error {
+	procs, err := listProcesses()
+	if err != nil {
+		return fmt.Errorf("failed to list the processes: %s", err)
+	}
+	self := findProcess(procs, os.Getpid())
+	if self == nil {
+		return fmt.Errorf("the process of the agent (pid %d) is not found", os.Getpid())
+	}
+	prev, err := readState(root)
+	if err != nil {
+		logger.Warningf("Ignoring the previous agent: %s", err)
+	}
+	orphans := Find(prev, self, commands, procs)
+	for _, p := range orphans {
+		logger.Warningf("Found the process left by the previous agent, %s", p.String())
+	}
+	if len(orphans) > 0 {
+		if terminate {
+			terminateProcesses(orphans)
+		} else {
+			logger.Warningf("The %d processes are not terminated, set orphan_plugins = \"terminate\" to terminate them", len(orphans))
+		}
+	}
+	return writeState(root, &State{Pid: self.Pid, Started: self.Started})
+}
+
+// Find returns the orphans in procs, which are sorted by the pids. They are
+// started by the user of self before it, and are either the children of the
+// previous agent prev or the processes of commands, including the processes
+// in the same groups on Unix. Nothing is found if prev is still running.
+func Find(prev *State, self *Process, commands []string, procs []Process) []*Process {
+	if prev != nil {
+		if p := findProcess(procs, prev.Pid); p != nil && p.Pid != self.Pid && p.Started.Equal(prev.Started) {
+			logger.Warningf("The previous agent (pid %d) is still running", prev.Pid)
+			return nil
+		}
+	}
+	candidate := func(p *Process) bool {
+		if p.Pid == self.Pid || p.Started.After(self.Started) {
+			return false
+		}
+		if self.UID >= 0 && p.UID != self.UID {
+			return false
+		}
+		// the process of the previous pid is to be started after the agent
+		return prev == nil || !p.Started.Before(prev.Started)
+	}
+	found := make(map[int]*Process)
+	groups := make(map[int]bool)
+	for i := range procs {
+		p := &procs[i]
+		if !candidate(p) {
+			continue
+		}
+		if (prev != nil && p.Ppid == prev.Pid) || (matchCommand(p, commands) && !runByAgent(procs, p, self)) {
+			found[p.Pid] = p
+			// the group of the plugin is killed by TERM at timeout, which is
+			// created for each command on Unix
+			if p.Pgid == p.Pid && p.Pgid != self.Pgid {
+				groups[p.Pgid] = true
+			}
+		}
+	}
+	for i := range procs {
+		p := &procs[i]
+		if p.Pgid != 0 && groups[p.Pgid] && candidate(p) {
+			found[p.Pid] = p
+		}
+	}
+	orphans := make([]*Process, 0, len(found))
+	for _, p := range found {
+		orphans = append(orphans, p)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Pid < orphans[j].Pid })
+	return orphans
+}
+
+// runByAgent reports whether p is a descendant of another agent running the
+// same executable as self, such as the agent of another -instance-suffix,
+// whose plugins are not orphans even if they share the command lines.
+func runByAgent(procs []Process, p, self *Process) bool {
+	exe := executable(self)
+	// the depth is limited not to loop by the reused pids
+	for i := 0; i < 16; i++ {
+		p = findProcess(procs, p.Ppid)
+		if p == nil || p.Pid == self.Pid || p.Pid == p.Ppid {
+			return false
+		}
+		if exe != "" && executable(p) == exe {
+			return true
+		}
+	}
+	return false
+}
+
+// executable returns the executable in the command line of p.
+func executable(p *Process) string {
+	fields := strings.Fields(p.Command)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func findProcess(procs []Process, pid int) *Process {
+	for i := range procs {
+		if procs[i].Pid == pid {
+			return &procs[i]
+		}
+	}
+	return nil
+}
+
+// matchCommand reports whether the command line of p is one of commands,
+// which is run by the shell or executed directly.
+func matchCommand(p *Process, commands []string) bool {
+	if !commandLines {
+		return false
+	}
+	cmdline := strings.Join(strings.Fields(p.Command), " ")
+	for _, c := range commands {
+		c = strings.Join(strings.Fields(c), " ")
+		if cmdline == c || cmdline == "sh -c "+c || cmdline == "/bin/sh -c "+c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package orphan
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFind(t *testing.T) {
+	base := time.Date(2026, 10, 14, 4, 0, 0, 0, time.UTC)
+	prev := &State{Pid: 100, Started: base}
+	self := &Process{Pid: 500, Ppid: 1, Pgid: 500, UID: 1000, Started: base.Add(time.Hour), Command: "/usr/bin/mackerel-agent"}
+	procs := []Process{
+		{Pid: 1, Ppid: 0, Pgid: 1, UID: 0, Started: base.Add(-time.Hour), Command: "/sbin/init"},
+		// the plugin and its child reparented to init
+		{Pid: 200, Ppid: 1, Pgid: 200, UID: 1000, Started: base.Add(time.Minute), Command: "sh -c mackerel-plugin-foo  -x"},
+		{Pid: 201, Ppid: 200, Pgid: 200, UID: 1000, Started: base.Add(time.Minute), Command: "mackerel-plugin-foo -x"},
+		// the child of the previous agent
+		{Pid: 300, Ppid: 100, Pgid: 300, UID: 1000, Started: base.Add(2 * time.Minute), Command: "check-bar"},
+		// the same command of another user
+		{Pid: 400, Ppid: 1, Pgid: 400, UID: 1001, Started: base.Add(time.Minute), Command: "mackerel-plugin-foo -x"},
+		// the same command started before the previous agent
+		{Pid: 401, Ppid: 1, Pgid: 401, UID: 1000, Started: base.Add(-time.Minute), Command: "mackerel-plugin-foo -x"},
+		*self,
+		// the same command started after the agent
+		{Pid: 600, Ppid: 500, Pgid: 600, UID: 1000, Started: base.Add(2 * time.Hour), Command: "mackerel-plugin-foo -x"},
+	}
+	commands := []string{"mackerel-plugin-foo -x"}
+
+	pids := func(orphans []*Process) []int {
+		var pids []int
+		for _, p := range orphans {
+			pids = append(pids, p.Pid)
+		}
+		return pids
+	}
+	expect := []int{300}
+	if commandLines {
+		expect = []int{200, 201, 300}
+	}
+	if got := pids(Find(prev, self, commands, procs)); !reflect.DeepEqual(got, expect) {
+		t.Errorf("the orphans should be %v but got %v", expect, got)
+	}
+
+	// the previous agent is unknown
+	expect = nil
+	if commandLines {
+		expect = []int{200, 201, 401}
+	}
+	if got := pids(Find(nil, self, commands, procs)); !reflect.DeepEqual(got, expect) {
+		t.Errorf("the orphans without the previous agent should be %v but got %v", expect, got)
+	}
+
+	// the previous agent is still running
+	running := append(procs, Process{Pid: 100, Ppid: 1, Pgid: 100, UID: 1000, Started: base, Command: "/usr/bin/mackerel-agent"})
+	if got := Find(prev, self, commands, running); len(got) != 0 {
+		t.Errorf("nothing should be found while the previous agent is running: %v", pids(got))
+	}
+	// the plugins of the agent of another instance
+	instance := append(procs,
+		Process{Pid: 700, Ppid: 1, Pgid: 700, UID: 1000, Started: base.Add(time.Minute), Command: "/usr/bin/mackerel-agent -instance-suffix=pg-main"},
+		Process{Pid: 701, Ppid: 700, Pgid: 701, UID: 1000, Started: base.Add(2 * time.Minute), Command: "sh -c mackerel-plugin-foo -x"},
+		Process{Pid: 702, Ppid: 701, Pgid: 701, UID: 1000, Started: base.Add(2 * time.Minute), Command: "mackerel-plugin-foo -x"},
+	)
+	expect = []int{300}
+	if commandLines {
+		expect = []int{200, 201, 300}
+	}
+	if got := pids(Find(prev, self, commands, instance)); !reflect.DeepEqual(got, expect) {
+		t.Errorf("the plugins of another instance should not be orphans: expected %v but got %v", expect, got)
+	}
+	// the pid is reused by another process
+	reused := append(procs, Process{Pid: 100, Ppid: 1, Pgid: 100, UID: 1000, Started: base.Add(3 * time.Minute), Command: "vim"})
+	if got := Find(prev, self, commands, reused); len(got) == 0 {
+		t.Errorf("the orphans should be found if the pid of the previous agent is reused")
+	}
+}
+
+func TestClean(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-agent-orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := Clean(root, nil, false); err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	s, err := readState(root)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if s == nil || s.Pid != os.Getpid() || s.Started.IsZero() {
+		t.Errorf("the agent should be recorded: %+v", s)
+	}
+
+	if err := ioutil.WriteFile(StatePath(root), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Clean(root, nil, false); err != nil {
+		t.Errorf("the malformed state should be ignored: %v", err)
+	}
+	if s, err := readState(root); err != nil || s == nil || s.Pid != os.Getpid() {
+		t.Errorf("the malformed state should be replaced: %+v, %v", s, err)
+	}
+}
@@ -0,0 +1,116 @@
+// +build !windows
+
+package orphan
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commandLines is true since ps shows the command lines of the processes.
+const commandLines = true
+
+// lstartLayout is the start time shown by ps in the C locale.
+const lstartLayout = "Mon Jan _2 15:04:05 2006"
+
+func listProcesses() ([]Process, error) {
+	cmd := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "pgid=", "-o", "uid=", "-o", "stat=", "-o", "lstart=", "-o", "args=")
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parsePS(stdout.String(), time.Local)
+}
+
+// parsePS parses the output of listProcesses. The zombies and the lines failed
+// to be parsed are skipped.
+func parsePS(out string, loc *time.Location) ([]Process, error) {
+	var procs []Process
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		// pid, ppid, pgid, uid, stat, the 5 fields of lstart and args
+		if len(fields) < 10 || strings.HasPrefix(fields[4], "Z") {
+			continue
+		}
+		var ids [4]int
+		var err error
+		for i := range ids {
+			if ids[i], err = strconv.Atoi(fields[i]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		started, err := time.ParseInLocation(lstartLayout, strings.Join(fields[5:10], " "), loc)
+		if err != nil {
+			continue
+		}
+		procs = append(procs, Process{
+			Pid:     ids[0],
+			Ppid:    ids[1],
+			Pgid:    ids[2],
+			UID:     ids[3],
+			Started: started,
+			Command: strings.Join(fields[10:], " "),
+		})
+	}
+	if len(procs) == 0 {
+		return nil, fmt.Errorf("no processes are listed by ps")
+	}
+	return procs, nil
+}
+
+// terminateProcesses sends SIGTERM to the groups of the processes, or to the
+// processes not leading the groups, and SIGKILL to the survivors.
+func terminateProcesses(procs []*Process) {
+	signal := func(sig syscall.Signal) {
+		for _, p := range procs {
+			if p.Pgid == p.Pid {
+				syscall.Kill(-p.Pgid, sig)
+			} else {
+				syscall.Kill(p.Pid, sig)
+			}
+		}
+	}
+	signal(syscall.SIGTERM)
+	deadline := time.Now().Add(terminateTimeout)
+	for {
+		survivors := survivingProcesses(procs)
+		if len(survivors) == 0 {
+			logger.Infof("Terminated the %d processes left by the previous agent", len(procs))
+			return
+		}
+		if time.Now().After(deadline) {
+			procs = survivors
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	signal(syscall.SIGKILL)
+	logger.Warningf("Killed the %d processes left by the previous agent surviving SIGTERM", len(procs))
+}
+
+// survivingProcesses returns procs still running, which are not reused.
+func survivingProcesses(procs []*Process) []*Process {
+	current, err := listProcesses()
+	if err != nil {
+		return procs
+	}
+	var survivors []*Process
+	for _, p := range procs {
+		if c := findProcess(current, p.Pid); c != nil && c.Started.Equal(p.Started) {
+			survivors = append(survivors, p)
+		}
+	}
+	return survivors
+}
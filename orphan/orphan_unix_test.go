@@ -0,0 +1,108 @@
+// +build !windows
+
+package orphan
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParsePS(t *testing.T) {
+	out := "    1     0     1     0 Ss   Wed Oct 14 04:39:27 2026 /sbin/init splash\n" +
+		"  200     1   200  1000 S    Thu Oct  1 10:00:05 2026 sh -c mackerel-plugin-foo -x\n" +
+		"  201   200   200  1000 S    Thu Oct  1 10:00:05 2026\n" +
+		"  202   200   200  1000 Z    Thu Oct  1 10:00:06 2026 [sleep] <defunct>\n" +
+		"broken\n"
+	procs, err := parsePS(out, time.UTC)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	expect := []Process{
+		{Pid: 1, Ppid: 0, Pgid: 1, UID: 0, Started: time.Date(2026, 10, 14, 4, 39, 27, 0, time.UTC), Command: "/sbin/init splash"},
+		{Pid: 200, Ppid: 1, Pgid: 200, UID: 1000, Started: time.Date(2026, 10, 1, 10, 0, 5, 0, time.UTC), Command: "sh -c mackerel-plugin-foo -x"},
+		{Pid: 201, Ppid: 200, Pgid: 200, UID: 1000, Started: time.Date(2026, 10, 1, 10, 0, 5, 0, time.UTC)},
+	}
+	if len(procs) != len(expect) {
+		t.Fatalf("%d processes should be parsed but got %+v", len(expect), procs)
+	}
+	for i := range expect {
+		if procs[i] != expect[i] {
+			t.Errorf("the process should be %+v but got %+v", expect[i], procs[i])
+		}
+	}
+	if _, err := parsePS("", time.UTC); err == nil {
+		t.Error("should raise error for the empty output")
+	}
+}
+
+func TestTerminateProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip the termination of the processes in short mode")
+	}
+	// the plugin is run in its own group, as by the timeout of the plugins
+	cmd := exec.Command("sh", "-c", "sleep 60 & sleep 60; wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	var group []*Process
+	for i := 0; i < 50 && len(group) < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		procs, err := listProcesses()
+		if err != nil {
+			t.Fatalf("should not raise error: %v", err)
+		}
+		group = group[:0]
+		for i := range procs {
+			if procs[i].Pgid == cmd.Process.Pid {
+				group = append(group, &procs[i])
+			}
+		}
+	}
+	if len(group) != 3 {
+		t.Fatalf("the shell and the sleeps should be in the group: %v", group)
+	}
+	self := findProcess(mustList(t), os.Getpid())
+	if self == nil || self.UID != os.Getuid() {
+		t.Fatalf("the test should be listed: %+v", self)
+	}
+
+	// only the leader is given, and the group is terminated
+	for _, p := range group {
+		if p.Pid == cmd.Process.Pid {
+			terminateProcesses([]*Process{p})
+		}
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plugin should be terminated")
+	}
+	survivors := survivingProcesses(group)
+	for i := 0; i < 30 && len(survivors) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		survivors = survivingProcesses(group)
+	}
+	for _, p := range survivors {
+		t.Errorf("the process in the group should be terminated: %v", p)
+	}
+}
+
+func mustList(t *testing.T) []Process {
+	t.Helper()
+	procs, err := listProcesses()
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	return procs
+}
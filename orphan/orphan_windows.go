@@ -0,0 +1,100 @@
+// +build windows
+
+package orphan
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// commandLines is false since the command lines of the other processes are
+// not readable without their memory. The parent pids are kept on Windows
+// after the parents exit, which tell the children of the previous agent.
+const commandLines = false
+
+var procIsProcessInJob = windows.NewLazySystemDLL("kernel32.dll").NewProc("IsProcessInJob")
+
+// listProcesses returns the processes which the agent can query, which are
+// mostly of the same user.
+func listProcesses() ([]Process, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(snapshot)
+	var procs []Process
+	var e windows.ProcessEntry32
+	e.Size = uint32(unsafe.Sizeof(e))
+	for err = windows.Process32First(snapshot, &e); err == nil; err = windows.Process32Next(snapshot, &e) {
+		p := Process{
+			Pid:     int(e.ProcessID),
+			Ppid:    int(e.ParentProcessID),
+			UID:     -1,
+			Command: syscall.UTF16ToString(e.ExeFile[:]),
+		}
+		if queryProcess(&p) {
+			procs = append(procs, p)
+		}
+	}
+	if err != windows.ERROR_NO_MORE_FILES {
+		return nil, err
+	}
+	return procs, nil
+}
+
+// queryProcess sets the start time of p and whether it is in a job.
+func queryProcess(p *Process) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(p.Pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return false
+	}
+	p.Started = time.Unix(0, creation.Nanoseconds())
+	var inJob int32
+	if r1, _, _ := procIsProcessInJob.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&inJob))); r1 != 0 {
+		p.InJob = inJob != 0
+	}
+	return true
+}
+
+// terminateProcesses terminates the processes, and waits for them. A process
+// in the job of the supervisor survives the agent until the supervisor exits.
+func terminateProcesses(procs []*Process) {
+	var handles []windows.Handle
+	for _, p := range procs {
+		h, err := windows.OpenProcess(windows.PROCESS_TERMINATE|windows.SYNCHRONIZE, false, uint32(p.Pid))
+		if err != nil {
+			logger.Warningf("Failed to open the process %d: %s", p.Pid, err)
+			continue
+		}
+		defer windows.CloseHandle(h)
+		if err := windows.TerminateProcess(h, 1); err != nil {
+			logger.Warningf("Failed to terminate the process %d: %s", p.Pid, err)
+			continue
+		}
+		handles = append(handles, h)
+	}
+	deadline := time.Now().Add(terminateTimeout)
+	var survivors int
+	for _, h := range handles {
+		wait := time.Until(deadline)
+		if wait < 0 {
+			wait = 0
+		}
+		if ev, _ := windows.WaitForSingleObject(h, uint32(wait/time.Millisecond)); ev != windows.WAIT_OBJECT_0 {
+			survivors++
+		}
+	}
+	if survivors > 0 {
+		logger.Warningf("The %d processes left by the previous agent survived the termination", survivors)
+		return
+	}
+	logger.Infof("Terminated the %d processes left by the previous agent", len(handles))
+}
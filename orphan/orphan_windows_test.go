@@ -0,0 +1,63 @@
+// +build windows
+
+package orphan
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestTerminateProcesses(t *testing.T) {
+	cmd := exec.Command("ping", "-n", "60", "127.0.0.1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer cmd.Process.Kill()
+
+	// the job of the supervisor keeps the survivors of the agent
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer windows.CloseHandle(job)
+	h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer windows.CloseHandle(h)
+	if err := windows.AssignProcessToJobObject(job, h); err != nil {
+		t.Fatal(err)
+	}
+
+	procs, err := listProcesses()
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	if self := findProcess(procs, os.Getpid()); self == nil || self.Started.IsZero() {
+		t.Fatalf("the test should be listed: %+v", self)
+	}
+	p := findProcess(procs, cmd.Process.Pid)
+	if p == nil {
+		t.Fatalf("the child should be listed")
+	}
+	if p.Ppid != os.Getpid() || !p.InJob || !strings.EqualFold(p.Command, "ping.exe") {
+		t.Errorf("the child in the job should be listed: %v", p)
+	}
+
+	terminateProcesses([]*Process{p})
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the child should be terminated")
+	}
+}
@@ -0,0 +1,289 @@
+// Package otlp exports the metrics to an OpenTelemetry collector by the
+// OTLP/HTTP with the JSON encoding. The OTLP/gRPC is not supported. The
+// exports are queued and retried independently of posting the metrics to
+// Mackerel.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var logger = logformat.GetLogger("otlp")
+
+// The exports are retried up to exportRetryMax times, waiting for
+// exportRetryInterval doubled every attempt.
+var (
+	exportRetryMax      = 5
+	exportRetryInterval = 1 * time.Second
+	exportTimeout       = 10 * time.Second
+)
+
+// maxBatchSize is the maximum number of the collections exported at once.
+const maxBatchSize = 10
+
+// Metrics are the metric values of a host collected at Time.
+type Metrics struct {
+	HostName string
+	HostID   string
+	Time     time.Time
+	Values   map[string]float64
+}
+
+// Exporter exports the metrics to the collector.
+type Exporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	sum     *regexp.Regexp
+	version string
+
+	queue chan []*Metrics
+	// lastTimes are the times of the last exports by the hosts, which are
+	// the start times of the delta sums.
+	lastTimes map[string]time.Time
+}
+
+// NewExporter creates an exporter of conf, whose scope is the agent of version.
+// The connections are dialed by dial unless it is nil.
+func NewExporter(conf *config.OTLP, version string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*Exporter, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CAFile != "" {
+		ca, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates are found in %s", conf.CAFile)
+		}
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	var sum *regexp.Regexp
+	if conf.SumPattern != "" {
+		var err error
+		sum, err = regexp.Compile(conf.SumPattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Exporter{
+		url:     conf.Endpoint,
+		headers: conf.Headers,
+		client: &http.Client{
+			Timeout: exportTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				DialContext:     dial,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		sum:       sum,
+		version:   version,
+		queue:     make(chan []*Metrics, conf.QueueSize),
+		lastTimes: make(map[string]time.Time),
+	}, nil
+}
+
+// Export queues the metrics without blocking. They are dropped if the queue is full.
+func (e *Exporter) Export(metrics []*Metrics) {
+	select {
+	case e.queue <- metrics:
+	default:
+		logger.Warningf("The queue of the exports to %s is full. The metrics are dropped.", e.url)
+	}
+}
+
+// Run exports the queued metrics until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	for {
+		var batch []*Metrics
+		select {
+		case <-ctx.Done():
+			return
+		case metrics := <-e.queue:
+			batch = append(batch, metrics...)
+		}
+	Batch:
+		for i := 1; i < maxBatchSize; i++ {
+			select {
+			case metrics := <-e.queue:
+				batch = append(batch, metrics...)
+			default:
+				break Batch
+			}
+		}
+		body, err := json.Marshal(e.request(batch))
+		if err != nil {
+			logger.Errorf("Failed to encode the metrics: %s", err)
+			continue
+		}
+		e.exportWithRetry(ctx, body)
+	}
+}
+
+func (e *Exporter) exportWithRetry(ctx context.Context, body []byte) {
+	interval := exportRetryInterval
+	for attempt := 0; ; attempt++ {
+		err := e.export(ctx, body)
+		if err == nil {
+			logger.Debugf("Exporting metrics to %s succeeded.", e.url)
+			return
+		}
+		if attempt >= exportRetryMax {
+			logger.Errorf("Failed to export metrics to %s (gave up): %s", e.url, err)
+			return
+		}
+		logger.Warningf("Failed to export metrics to %s (will retry in %s): %s", e.url, interval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+func (e *Exporter) export(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The messages of OTLP, encoded to JSON by the protobuf JSON mapping.
+type (
+	exportRequest struct {
+		ResourceMetrics []*resourceMetrics `json:"resourceMetrics"`
+	}
+	resourceMetrics struct {
+		Resource     resource        `json:"resource"`
+		ScopeMetrics []*scopeMetrics `json:"scopeMetrics"`
+	}
+	resource struct {
+		Attributes []*keyValue `json:"attributes"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	scopeMetrics struct {
+		Scope   scope     `json:"scope"`
+		Metrics []*metric `json:"metrics"`
+	}
+	scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	metric struct {
+		Name  string `json:"name"`
+		Gauge *gauge `json:"gauge,omitempty"`
+		Sum   *sum   `json:"sum,omitempty"`
+	}
+	gauge struct {
+		DataPoints []*dataPoint `json:"dataPoints"`
+	}
+	sum struct {
+		DataPoints             []*dataPoint `json:"dataPoints"`
+		AggregationTemporality int          `json:"aggregationTemporality"`
+		IsMonotonic            bool         `json:"isMonotonic"`
+	}
+	dataPoint struct {
+		StartTimeUnixNano string  `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string  `json:"timeUnixNano"`
+		AsDouble          float64 `json:"asDouble"`
+	}
+)
+
+// aggregationTemporalityDelta is AGGREGATION_TEMPORALITY_DELTA.
+const aggregationTemporalityDelta = 1
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *Exporter) request(batch []*Metrics) *exportRequest {
+	req := &exportRequest{}
+	for _, m := range batch {
+		start, ok := e.lastTimes[m.HostID]
+		if !ok {
+			start = m.Time.Add(-config.PostMetricsInterval)
+		}
+		e.lastTimes[m.HostID] = m.Time
+
+		names := make([]string, 0, len(m.Values))
+		for name, value := range m.Values {
+			// NaN and Inf can not be encoded to JSON.
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		metrics := make([]*metric, 0, len(names))
+		for _, name := range names {
+			dp := &dataPoint{TimeUnixNano: unixNano(m.Time), AsDouble: m.Values[name]}
+			if e.sum != nil && e.sum.MatchString(name) {
+				dp.StartTimeUnixNano = unixNano(start)
+				metrics = append(metrics, &metric{Name: name, Sum: &sum{
+					DataPoints:             []*dataPoint{dp},
+					AggregationTemporality: aggregationTemporalityDelta,
+				}})
+			} else {
+				metrics = append(metrics, &metric{Name: name, Gauge: &gauge{DataPoints: []*dataPoint{dp}}})
+			}
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, &resourceMetrics{
+			Resource: resource{Attributes: []*keyValue{
+				{Key: "host.name", Value: anyValue{m.HostName}},
+				{Key: "mackerel.host.id", Value: anyValue{m.HostID}},
+				{Key: "service.name", Value: anyValue{"mackerel-agent"}},
+			}},
+			ScopeMetrics: []*scopeMetrics{{
+				Scope:   scope{Name: "github.com/mackerelio/mackerel-agent", Version: e.version},
+				Metrics: metrics,
+			}},
+		})
+	}
+	return req
+}
@@ -0,0 +1,90 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func TestExporter(t *testing.T) {
+	origInterval := exportRetryInterval
+	exportRetryInterval = 10 * time.Millisecond
+	defer func() { exportRetryInterval = origInterval }()
+
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan *exportRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected headers: %v", req.Header)
+		}
+		var r exportRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			t.Errorf("should not raise error: %v", err)
+		}
+		received <- &r
+	}))
+	defer ts.Close()
+
+	e, err := NewExporter(&config.OTLP{
+		Endpoint:   ts.URL + "/v1/metrics",
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+		SumPattern: `\.count$`,
+		QueueSize:  1,
+	}, "1.0.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	e.Export([]*Metrics{{
+		HostName: "host.example.com",
+		HostID:   "abcde",
+		Time:     now,
+		Values:   map[string]float64{"loadavg5": 0.5, "custom.statsd.requests.count": 10, "invalid": math.NaN()},
+	}})
+	// dropped since the queue is full
+	e.Export([]*Metrics{{HostName: "dropped", Time: now}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx)
+
+	var r *exportRequest
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the metrics should be exported after the retry")
+	}
+	if len(r.ResourceMetrics) != 1 {
+		t.Fatalf("unexpected resource metrics: %+v", r.ResourceMetrics)
+	}
+	rm := r.ResourceMetrics[0]
+	if rm.Resource.Attributes[0].Key != "host.name" || rm.Resource.Attributes[0].Value.StringValue != "host.example.com" {
+		t.Errorf("unexpected resource: %+v", rm.Resource.Attributes[0])
+	}
+	metrics := rm.ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Fatalf("the metrics except NaN should be exported: %+v", metrics)
+	}
+	if m := metrics[0]; m.Name != "custom.statsd.requests.count" || m.Sum == nil || m.Sum.AggregationTemporality != aggregationTemporalityDelta ||
+		m.Sum.DataPoints[0].AsDouble != 10 || m.Sum.DataPoints[0].StartTimeUnixNano != "1599999940000000000" {
+		t.Errorf("the metric should be exported as a delta sum: %+v", m.Sum)
+	}
+	if m := metrics[1]; m.Name != "loadavg5" || m.Gauge == nil || m.Gauge.DataPoints[0].AsDouble != 0.5 || m.Gauge.DataPoints[0].TimeUnixNano != "1600000000000000000" {
+		t.Errorf("the metric should be exported as a gauge: %+v", m)
+	}
+}
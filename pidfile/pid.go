@@ -1,5 +1,12 @@
 package pidfile
 
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
 // ExistsPid checks if pid exists
 func ExistsPid(pid int) bool {
 	return existsPid(pid)
@@ -9,3 +16,30 @@ func ExistsPid(pid int) bool {
 func GetCmdName(pid int) string {
 	return getCmdName(pid)
 }
+
+// IsAgentPid checks if pid is the process of the same executable as the
+// current process, that is another mackerel-agent. Only the process names are
+// compared on Windows, and the command names are compared if the executable of
+// pid is unknown.
+func IsAgentPid(pid int) bool {
+	if !existsPid(pid) {
+		return false
+	}
+	if exe := getExecutable(pid); exe != "" {
+		if self, err := os.Executable(); err == nil {
+			return sameExecutable(exe, self)
+		}
+	}
+	return getCmdName(pid) == filepath.Base(os.Args[0])
+}
+
+func sameExecutable(exe, self string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Base(exe), filepath.Base(self))
+	}
+	if exe == self {
+		return true
+	}
+	resolved, err := filepath.EvalSymlinks(self)
+	return err == nil && exe == resolved
+}
@@ -36,3 +36,8 @@ func getCmdName(pid int) string {
 	}
 	return filepath.Base(out)
 }
+
+// getExecutable is not implemented, and the command names are compared instead.
+func getExecutable(int) string {
+	return ""
+}
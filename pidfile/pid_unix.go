@@ -27,3 +27,13 @@ func getCmdName(pid int) string {
 	}
 	return filepath.Base(out)
 }
+
+// getExecutable returns the path of the executable of pid, which is suffixed
+// with " (deleted)" if the executable is replaced such as by the upgrade.
+func getExecutable(pid int) string {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(exe, " (deleted)")
+}
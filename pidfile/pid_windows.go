@@ -1,11 +1,53 @@
 package pidfile
 
-func existsPid(int) bool {
-	// XXX not implemented. should use `tasklist` command or so
-	return false
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	stillActive = 259
+	maxLongPath = 32768
+)
+
+var procQueryFullProcessImageNameW = windows.NewLazySystemDLL("kernel32.dll").NewProc("QueryFullProcessImageNameW")
+
+func existsPid(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// the process of another user denies the access
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+func getCmdName(pid int) string {
+	exe := getExecutable(pid)
+	if exe == "" {
+		return ""
+	}
+	return filepath.Base(exe)
 }
 
-func getCmdName(int) string {
-	// XXX not implemented.
-	return ""
+func getExecutable(pid int) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, maxLongPath)
+	size := uint32(len(buf))
+	r1, _, _ := procQueryFullProcessImageNameW.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r1 == 0 {
+		return ""
+	}
+	return syscall.UTF16ToString(buf[:size])
 }
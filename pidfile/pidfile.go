@@ -6,44 +6,122 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 )
 
-var logger = logging.GetLogger("pidfile")
+var logger = logformat.GetLogger("pidfile")
 
-// Create pidfile
+// AlreadyRunningError is returned by Create when another mackerel-agent is running.
+type AlreadyRunningError struct {
+	Pidfile string
+}
+
+func (e *AlreadyRunningError) Error() string {
+	return fmt.Sprintf("pidfile found, try stopping another running mackerel-agent or delete %s", e.Pidfile)
+}
+
+// Create pidfile. The pidfile left by the process which is not mackerel-agent
+// is removed as stale. The pidfile is written to the temporary file and linked
+// exclusively, so that only one of the agents started concurrently creates it.
 func Create(pidfile string) error {
 	if pidfile == "" {
 		return nil
 	}
-	if pidString, err := ioutil.ReadFile(pidfile); err == nil {
-		if pid, err := strconv.Atoi(string(pidString)); err == nil {
+	err := os.MkdirAll(filepath.Dir(pidfile), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(pidfile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// retry once after removing the stale pidfile
+	for i := 0; ; i++ {
+		err := os.Link(tmp, pidfile)
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		pid, err := readPid(pidfile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if _, ok := err.(*strconv.NumError); err != nil && !ok {
+			return err
+		}
+		if err == nil {
 			if pid == os.Getpid() {
 				return nil
 			}
-			if GetCmdName(pid) == filepath.Base(os.Args[0]) {
-				return fmt.Errorf("pidfile found, try stopping another running mackerel-agent or delete %s", pidfile)
+			if IsAgentPid(pid) {
+				return &AlreadyRunningError{Pidfile: pidfile}
 			}
-			// Note mackerel-agent in windows can't remove pidfile during stoping the service
-			logger.Warningf("Pidfile found, but there seems no another process of mackerel-agent. Ignoring %s", pidfile)
+		}
+		if i > 0 {
+			return &AlreadyRunningError{Pidfile: pidfile}
+		}
+		if err != nil {
+			logger.Warningf("Malformed pidfile found. Removing %s", pidfile)
 		} else {
-			logger.Warningf("Malformed pidfile found. Ignoring %s", pidfile)
+			// Note mackerel-agent in windows can't remove pidfile during stoping the service
+			logger.Warningf("Pidfile found, but the process %d is not mackerel-agent. Removing the stale %s", pid, pidfile)
+		}
+		if err := removeStale(pidfile, pid); err != nil {
+			return err
 		}
 	}
+}
 
-	err := os.MkdirAll(filepath.Dir(pidfile), 0755)
+// writeTemp writes the pid to the temporary file next to pidfile.
+func writeTemp(pidfile string) (string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(pidfile), "."+filepath.Base(pidfile))
 	if err != nil {
-		return err
+		return "", err
+	}
+	_, err = fmt.Fprintf(file, "%d", os.Getpid())
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err2 := os.Chmod(file.Name(), 0644); err == nil {
+		err = err2
 	}
-	file, err := os.Create(pidfile)
 	if err != nil {
-		return err
+		os.Remove(file.Name())
+		return "", err
 	}
-	defer file.Close()
+	return file.Name(), nil
+}
 
-	_, err = fmt.Fprintf(file, "%d", os.Getpid())
-	return err
+func readPid(pidfile string) (int, error) {
+	b, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// removeStale removes the stale pidfile of pid. The pidfile is renamed before
+// removed, not to remove the pidfile created by another agent concurrently,
+// which is restored.
+func removeStale(pidfile string, pid int) error {
+	stale := fmt.Sprintf("%s.stale.%d", pidfile, os.Getpid())
+	if err := os.Rename(pidfile, stale); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(stale)
+	if p, err := readPid(stale); err == nil && p != pid {
+		os.Link(stale, pidfile)
+	}
+	return nil
 }
 
 // Remove pidfile
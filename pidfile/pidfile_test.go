@@ -5,9 +5,11 @@ package pidfile
 import (
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCreate(t *testing.T) {
@@ -59,3 +61,98 @@ func TestRemove(t *testing.T) {
 		t.Errorf("err should be nil but: %v", err)
 	}
 }
+
+func TestCreate_stale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-pidfile")
+	if err != nil {
+		t.Fatalf("failed to create tempdir")
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "pidfile")
+
+	// the process which is not mackerel-agent
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	for _, content := range []string{strconv.Itoa(cmd.Process.Pid), "malformed"} {
+		if err := ioutil.WriteFile(pidfile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Create(pidfile); err != nil {
+			t.Errorf("the stale pidfile %q should be removed but: %v", content, err)
+		}
+		pidString, _ := ioutil.ReadFile(pidfile)
+		if string(pidString) != strconv.Itoa(os.Getpid()) {
+			t.Errorf("contents of pidfile does not match pid. content: %s, pid: %d", pidString, os.Getpid())
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("the temporary files should be removed: %d files", len(files))
+	}
+}
+
+// TestCreate_running creates the pidfile by the processes of the test binary,
+// which are the agents for the test.
+func TestCreate_running(t *testing.T) {
+	if pidfile := os.Getenv("MACKEREL_AGENT_TEST_PIDFILE"); pidfile != "" {
+		err := Create(pidfile)
+		if _, ok := err.(*AlreadyRunningError); ok {
+			os.Exit(3)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		time.Sleep(time.Second)
+		os.Exit(0)
+	}
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-test-pidfile")
+	if err != nil {
+		t.Fatalf("failed to create tempdir")
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "pidfile")
+
+	const n = 5
+	cmds := make([]*exec.Cmd, n)
+	for i := range cmds {
+		cmds[i] = exec.Command(os.Args[0], "-test.run=^TestCreate_running$")
+		cmds[i].Env = append(os.Environ(), "MACKEREL_AGENT_TEST_PIDFILE="+pidfile)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var started, running int
+	for _, cmd := range cmds {
+		err := cmd.Wait()
+		if err == nil {
+			started++
+		} else if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 3 {
+			running++
+		} else {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if started != 1 || running != n-1 {
+		t.Errorf("only one of the agents should start: %d started, %d already running", started, running)
+	}
+
+	// the pidfile of the running agent is not removed
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCreate_running$")
+	cmd.Env = append(os.Environ(), "MACKEREL_AGENT_TEST_PIDFILE="+filepath.Join(dir, "other"))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	time.Sleep(300 * time.Millisecond)
+	if err := ioutil.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Create(pidfile).(*AlreadyRunningError); !ok {
+		t.Errorf("the pidfile of the running agent should be kept")
+	}
+}
@@ -0,0 +1,151 @@
+// Package pluginbreaker backs off the executions of the plugins which fail
+// consecutively, so that the plugins failing identically, such as by the
+// database which is down, are not run and logged every cycle.
+package pluginbreaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var logger = logformat.GetLogger("pluginbreaker")
+
+// State is the state of the breaker of a plugin for the status.
+type State struct {
+	// Failures are the consecutive failures of the plugin.
+	Failures int `json:"failures"`
+	// Open reports whether the executions are backed off by BackoffSeconds until
+	// NextRunAt.
+	Open           bool      `json:"open"`
+	BackoffSeconds int64     `json:"backoffSeconds,omitempty"`
+	NextRunAt      time.Time `json:"nextRunAt,omitempty"`
+}
+
+// Breaker backs off the executions of a plugin after threshold consecutive
+// failures, from twice the interval doubling up to maxInterval. A success
+// snaps it back to the interval. The methods do nothing on nil, which is the
+// breaker of the plugins never backed off.
+type Breaker struct {
+	id          string
+	threshold   int
+	interval    time.Duration
+	maxInterval time.Duration
+
+	mu       sync.Mutex
+	failures int
+	backoff  time.Duration
+	nextAt   time.Time
+}
+
+var all = struct {
+	sync.Mutex
+	breakers map[string]*Breaker
+}{breakers: make(map[string]*Breaker)}
+
+// New returns the breaker of the plugin id, such as "checks.foo", run every
+// interval, which is nil if threshold is not positive.
+func New(id string, threshold int, interval, maxInterval time.Duration) *Breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	b := &Breaker{id: id, threshold: threshold, interval: interval, maxInterval: maxInterval}
+	all.Lock()
+	all.breakers[id] = b
+	all.Unlock()
+	return b
+}
+
+// Allow reports whether the plugin should be executed at now. The execution
+// by the ticker of the interval is allowed even if it is slightly earlier
+// than the end of the backoff.
+func (b *Breaker) Allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backoff == 0 || !now.Add(b.interval/2).Before(b.nextAt)
+}
+
+// Open reports whether the executions are backed off.
+func (b *Breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backoff > 0
+}
+
+// Record records the execution of the plugin at now, which failed if failed.
+// The circuit is logged only when it is opened and closed.
+func (b *Breaker) Record(failed bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.backoff > 0 {
+			logger.Infof("circuit closed for plugin %s, which succeeded after %d consecutive failures", b.id, b.failures)
+		}
+		b.failures, b.backoff, b.nextAt = 0, 0, time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+	if b.backoff == 0 {
+		b.backoff = 2 * b.interval
+		logger.Warningf("circuit opened for plugin %s after %d consecutive failures, which is retried with backoff up to every %s until it succeeds", b.id, b.failures, b.maxInterval)
+	} else {
+		b.backoff *= 2
+	}
+	if b.backoff > b.maxInterval {
+		b.backoff = b.maxInterval
+	}
+	if b.backoff < b.interval {
+		b.backoff = b.interval
+	}
+	b.nextAt = now.Add(b.backoff)
+}
+
+func (b *Breaker) state() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := State{Failures: b.failures, Open: b.backoff > 0}
+	if s.Open {
+		s.BackoffSeconds = int64(b.backoff / time.Second)
+		s.NextRunAt = b.nextAt
+	}
+	return s
+}
+
+// All returns the states of the breakers of the plugins which have failed
+// since the last success, keyed by the IDs.
+func All() map[string]State {
+	all.Lock()
+	defer all.Unlock()
+	states := make(map[string]State)
+	for id, b := range all.breakers {
+		if s := b.state(); s.Failures > 0 {
+			states[id] = s
+		}
+	}
+	return states
+}
+
+// Reset closes the circuits of all the breakers, such as on reloading the
+// configuration.
+func Reset() {
+	all.Lock()
+	defer all.Unlock()
+	for _, b := range all.breakers {
+		b.mu.Lock()
+		b.failures, b.backoff, b.nextAt = 0, 0, time.Time{}
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,61 @@
+package pluginbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	b := New("checks.foo", 3, time.Minute, 5*time.Minute)
+	for i := 0; i < 2; i++ {
+		b.Record(true, now)
+		now = now.Add(time.Minute)
+	}
+	if b.Open() || !b.Allow(now) {
+		t.Fatalf("the circuit should not be opened before the threshold: %+v", All()["checks.foo"])
+	}
+
+	b.Record(true, now)
+	if !b.Open() {
+		t.Fatalf("the circuit should be opened at the threshold")
+	}
+	if b.Allow(now.Add(time.Minute)) || !b.Allow(now.Add(2*time.Minute-time.Second)) {
+		t.Errorf("the executions should be backed off for twice the interval")
+	}
+
+	for _, backoff := range []time.Duration{4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		now = now.Add(time.Hour)
+		b.Record(true, now)
+		if s := All()["checks.foo"]; s.BackoffSeconds != int64(backoff/time.Second) || !s.NextRunAt.Equal(now.Add(backoff)) {
+			t.Errorf("the backoff should be %s: %+v", backoff, s)
+		}
+	}
+
+	b.Record(false, now)
+	if b.Open() || !b.Allow(now) {
+		t.Errorf("the circuit should be closed by a success")
+	}
+	if _, ok := All()["checks.foo"]; ok {
+		t.Errorf("the plugin without failures should not be in the states")
+	}
+
+	for i := 0; i < 3; i++ {
+		b.Record(true, now)
+	}
+	Reset()
+	if b.Open() {
+		t.Errorf("the circuit should be closed by Reset")
+	}
+}
+
+func TestBreaker_nil(t *testing.T) {
+	b := New("checks.bar", 0, time.Minute, 5*time.Minute)
+	if b != nil {
+		t.Fatalf("the breaker should be nil without the threshold")
+	}
+	b.Record(true, time.Now())
+	if b.Open() || !b.Allow(time.Now()) {
+		t.Errorf("the nil breaker should always allow the executions")
+	}
+}
@@ -0,0 +1,118 @@
+// Package pluginstats keeps the statistics of the executions of the plugins,
+// such as the durations and the failures, for the status and the metrics of
+// the agent.
+package pluginstats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/cmdutil"
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var logger = logformat.GetLogger("pluginstats")
+
+// Stats are the statistics of the executions of a plugin since the start.
+type Stats struct {
+	Executions int64 `json:"executions"`
+	// Failures are the executions which failed to run or complete, including
+	// the timeouts. The commands exiting with non-zero are not failures.
+	Failures int64 `json:"failures"`
+	Timeouts int64 `json:"timeouts"`
+	// Empty are the failures of the metrics plugins which output no values
+	// for empty_cycles consecutive executions with on_empty = "warn".
+	Empty int64 `json:"empty"`
+	// Rejected are the metric values or the check reports of the plugin
+	// rejected by the validation of the API, which are dropped.
+	Rejected int64 `json:"rejected"`
+	// Slow are the executions which took longer than the thresholds.
+	Slow           int64     `json:"slow"`
+	LastDurationMs float64   `json:"lastDurationMs"`
+	MaxDurationMs  float64   `json:"maxDurationMs"`
+	LastExitCode   int       `json:"lastExitCode"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastRunAt      time.Time `json:"lastRunAt"`
+}
+
+var all = struct {
+	sync.Mutex
+	stats map[string]*Stats
+}{stats: make(map[string]*Stats)}
+
+// now is replaced in the tests.
+var now = time.Now
+
+// Record records the execution of the plugin id, such as "checks.foo", which
+// took d and exited with exitCode or err. The execution longer than slow is
+// warned unless slow is zero.
+func Record(id string, d time.Duration, exitCode int, err error, slow time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	all.Lock()
+	s, ok := all.stats[id]
+	if !ok {
+		s = &Stats{}
+		all.stats[id] = s
+	}
+	s.Executions++
+	s.LastDurationMs = ms
+	if ms > s.MaxDurationMs {
+		s.MaxDurationMs = ms
+	}
+	s.LastExitCode = exitCode
+	s.LastError = ""
+	if err != nil {
+		s.Failures++
+		s.LastError = err.Error()
+		if cmdutil.IsTimedOut(err) {
+			s.Timeouts++
+		}
+	}
+	isSlow := slow > 0 && d > slow
+	if isSlow {
+		s.Slow++
+	}
+	s.LastRunAt = now()
+	all.Unlock()
+
+	if isSlow {
+		logger.Warningf("[%s] took %s, which exceeds %s (plugin_slow_ratio of the interval). It may delay the other plugins", id, d.Round(time.Millisecond), slow)
+	}
+}
+
+// RecordEmpty records the failure of the plugin id which output no values for
+// the consecutive executions.
+func RecordEmpty(id string) {
+	all.Lock()
+	defer all.Unlock()
+	s, ok := all.stats[id]
+	if !ok {
+		s = &Stats{}
+		all.stats[id] = s
+	}
+	s.Empty++
+}
+
+// RecordRejected records the metric value or the check report of the plugin id
+// rejected by the API.
+func RecordRejected(id string) {
+	all.Lock()
+	defer all.Unlock()
+	s, ok := all.stats[id]
+	if !ok {
+		s = &Stats{}
+		all.stats[id] = s
+	}
+	s.Rejected++
+}
+
+// All returns the statistics of the plugins keyed by the IDs.
+func All() map[string]Stats {
+	all.Lock()
+	defer all.Unlock()
+	stats := make(map[string]Stats, len(all.stats))
+	for id, s := range all.stats {
+		stats[id] = *s
+	}
+	return stats
+}
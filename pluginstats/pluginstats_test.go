@@ -0,0 +1,48 @@
+package pluginstats
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	current := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	Record("checks.foo", 200*time.Millisecond, 2, nil, time.Second)
+	Record("checks.foo", 1500*time.Millisecond, 0, nil, time.Second)
+	Record("checks.foo", 100*time.Millisecond, -1, errors.New("exec: not found"), time.Second)
+	Record("metrics.bar", time.Hour, 0, nil, 0)
+
+	stats := All()
+	s := stats["checks.foo"]
+	if s.Executions != 3 || s.Failures != 1 || s.Timeouts != 0 || s.Slow != 1 {
+		t.Errorf("the executions should be counted: %+v", s)
+	}
+	if s.LastDurationMs != 100 || s.MaxDurationMs != 1500 {
+		t.Errorf("the durations should be recorded: %+v", s)
+	}
+	if s.LastExitCode != -1 || s.LastError != "exec: not found" || !s.LastRunAt.Equal(current) {
+		t.Errorf("the last execution should be recorded: %+v", s)
+	}
+	if s := stats["metrics.bar"]; s.Slow != 0 {
+		t.Errorf("the execution should not be slow without the threshold: %+v", s)
+	}
+
+	Record("checks.foo", 100*time.Millisecond, 0, nil, time.Second)
+	if s := All()["checks.foo"]; s.LastError != "" {
+		t.Errorf("the last error should be cleared: %+v", s)
+	}
+
+	RecordEmpty("metrics.bar")
+	if s := All()["metrics.bar"]; s.Empty != 1 || s.Failures != 0 || s.Executions != 1 {
+		t.Errorf("the empty output should be counted: %+v", s)
+	}
+
+	RecordRejected("metrics.bar")
+	if s := All()["metrics.bar"]; s.Rejected != 1 || s.Failures != 0 {
+		t.Errorf("the rejected value should be counted: %+v", s)
+	}
+}
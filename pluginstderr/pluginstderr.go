@@ -0,0 +1,88 @@
+// Package pluginstderr logs the stderr of the plugins tagged with the plugin
+// names, and keeps the last ones for the status of the agent.
+package pluginstderr
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+// MaxLines is the maximum number of the lines of stderr logged per execution.
+const MaxLines = 20
+
+// tailLength is the maximum length of the last part of stderr kept by Tail.
+const tailLength = 200
+
+// Snippet is the last part of stderr of a plugin.
+type Snippet struct {
+	Stderr string    `json:"stderr"`
+	At     time.Time `json:"at"`
+}
+
+var last = struct {
+	sync.Mutex
+	snippets map[string]Snippet
+}{snippets: make(map[string]Snippet)}
+
+// now is replaced in the tests.
+var now = time.Now
+
+// Log logs stderr of one execution of the plugin id, such as "checks.foo",
+// by logf of logger, such as (*logformat.Logger).Warningf, as a message whose
+// lines are prefixed with "[id] ". The lines beyond MaxLines are truncated.
+// It also keeps the last part of stderr as the last snippet of the plugin.
+// Empty stderr is ignored.
+func Log(logger *logformat.Logger, logf func(*logformat.Logger, string, ...interface{}), id, stderr string) {
+	stderr = strings.TrimRight(stderr, "\n")
+	if stderr == "" {
+		return
+	}
+	last.Lock()
+	last.snippets[id] = Snippet{Stderr: Tail(stderr), At: now()}
+	last.Unlock()
+
+	lines := strings.Split(stderr, "\n")
+	var truncated string
+	if len(lines) > MaxLines {
+		truncated = fmt.Sprintf("... (%d more lines truncated)", len(lines)-MaxLines)
+		lines = lines[:MaxLines]
+	}
+	if logformat.IsJSON() {
+		// the lines are in the field, which need no prefixes
+		out := strings.Join(lines, "\n")
+		if truncated != "" {
+			out += "\n" + truncated
+		}
+		logf(logger.WithFields(logformat.Fields{"plugin": id, logformat.PluginOutput: out}), "[%s] stderr: %s", id, out)
+		return
+	}
+	if truncated != "" {
+		lines = append(lines, truncated)
+	}
+	prefix := "[" + id + "] "
+	logf(logger.WithFields(logformat.Fields{"plugin": id}), "%s", prefix+strings.Join(lines, "\n"+prefix))
+}
+
+// Last returns the last snippets of stderr by the plugins.
+func Last() map[string]Snippet {
+	last.Lock()
+	defer last.Unlock()
+	snippets := make(map[string]Snippet, len(last.snippets))
+	for id, s := range last.snippets {
+		snippets[id] = s
+	}
+	return snippets
+}
+
+// Tail returns the last part of stderr, which usually contains the cause of the error.
+func Tail(stderr string) string {
+	r := []rune(strings.TrimSpace(stderr))
+	if len(r) <= tailLength {
+		return string(r)
+	}
+	return "..." + string(r[len(r)-tailLength:])
+}
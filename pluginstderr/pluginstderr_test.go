@@ -0,0 +1,85 @@
+package pluginstderr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+func TestLog(t *testing.T) {
+	current := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	var logs []string
+	logf := func(_ *logformat.Logger, format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	logger := logformat.GetLogger("test")
+
+	Log(logger, logf, "checks.foo", "")
+	if len(logs) != 0 {
+		t.Errorf("empty stderr should not be logged: %q", logs)
+	}
+
+	Log(logger, logf, "checks.foo", "a\nb\n")
+	if expect := "[checks.foo] a\n[checks.foo] b"; len(logs) != 1 || logs[0] != expect {
+		t.Errorf("the lines should be prefixed with the plugin: %q", logs)
+	}
+
+	logs = nil
+	var lines []string
+	for i := 0; i < MaxLines+5; i++ {
+		lines = append(lines, fmt.Sprintf("line%d", i))
+	}
+	Log(logger, logf, "metrics.bar", strings.Join(lines, "\n"))
+	got := strings.Split(logs[0], "\n")
+	if len(got) != MaxLines+1 || got[MaxLines-1] != fmt.Sprintf("[metrics.bar] line%d", MaxLines-1) {
+		t.Errorf("the lines beyond MaxLines should be truncated: %q", logs[0])
+	}
+	if got[MaxLines] != "[metrics.bar] ... (5 more lines truncated)" {
+		t.Errorf("the truncation should be noticed: %q", got[MaxLines])
+	}
+
+	snippets := Last()
+	if s := snippets["checks.foo"]; s.Stderr != "a\nb" || !s.At.Equal(current) {
+		t.Errorf("the last stderr should be kept: %+v", s)
+	}
+	if s := snippets["metrics.bar"]; !strings.HasSuffix(s.Stderr, fmt.Sprintf("line%d", MaxLines+4)) {
+		t.Errorf("the last part of stderr should be kept: %+v", s)
+	}
+}
+
+func TestLog_JSON(t *testing.T) {
+	logformat.SetJSON(true)
+	defer logformat.SetJSON(false)
+
+	var buf bytes.Buffer
+	logformat.SetOutput(&buf)
+	defer logformat.SetOutput(os.Stderr)
+
+	Log(logformat.GetLogger("test"), (*logformat.Logger).Warningf, "checks.foo", "a\nb\n")
+	var v map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatalf("the log should be a JSON object: %s: %q", err, buf.String())
+	}
+	if v["plugin"] != "checks.foo" || v["plugin_output"] != "a\nb" || v["message"] != "[checks.foo] stderr: [plugin_output]" {
+		t.Errorf("the lines should be in the fields: %+v", v)
+	}
+}
+
+func TestTail(t *testing.T) {
+	if got := Tail("error\n"); got != "error" {
+		t.Errorf("Tail should trim the spaces but got %q", got)
+	}
+	stderr := strings.Repeat("a", 300) + strings.Repeat("b", 200)
+	if got, expected := Tail(stderr), "..."+strings.Repeat("b", 200); got != expected {
+		t.Errorf("Tail should return the last part %q but got %q", expected, got)
+	}
+}
@@ -0,0 +1,70 @@
+// Package sdnotify notifies systemd of the state of the service by the
+// protocol of sd_notify(3) without cgo. The notifications are not sent
+// unless NOTIFY_SOCKET is set, that is the service is not of Type=notify.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The states of the service
+const (
+	// Ready tells that the service has started up.
+	Ready = "READY=1"
+	// Reloading tells that the service is reloading the configuration,
+	// which is followed by Ready when it finishes.
+	Reloading = "RELOADING=1"
+	// Stopping tells that the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog resets the timer of WatchdogSec.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state of the free-form status of the service,
+// which is shown by systemctl status.
+func Status(s string) string {
+	return "STATUS=" + strings.Replace(s, "\n", " ", -1)
+}
+
+// Notify sends the states to the socket of NOTIFY_SOCKET. It does nothing if
+// NOTIFY_SOCKET is not set.
+func Notify(states ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" || len(states) == 0 {
+		return nil
+	}
+	// the abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(states, "\n") + "\n"))
+	return err
+}
+
+// WatchdogInterval returns WatchdogSec of the service, within which Watchdog
+// should be sent, or zero if the watchdog is not enabled for the process.
+func WatchdogInterval() time.Duration {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
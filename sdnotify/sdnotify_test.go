@@ -0,0 +1,70 @@
+// +build !windows
+
+package sdnotify
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(Ready); err != nil {
+		t.Errorf("Notify should do nothing without NOTIFY_SOCKET: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := Notify(Ready, Status("posted\nthe metrics")); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := string(buf[:n]), "READY=1\nSTATUS=posted the metrics\n"; got != expect {
+		t.Errorf("the notification should be %q but got %q", expect, got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if d := WatchdogInterval(); d != 0 {
+		t.Errorf("the watchdog should be disabled without NOTIFY_SOCKET: %s", d)
+	}
+	os.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+	if d := WatchdogInterval(); d != 30*time.Second {
+		t.Errorf("the watchdog interval should be 30s but %s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d := WatchdogInterval(); d != 30*time.Second {
+		t.Errorf("the watchdog interval should be 30s but %s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := WatchdogInterval(); d != 0 {
+		t.Errorf("the watchdog should be disabled for the other process: %s", d)
+	}
+}
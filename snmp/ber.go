@@ -0,0 +1,206 @@
+package snmp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The tags of BER used by SNMP.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+
+	tagIPAddress = 0x40
+	tagCounter32 = 0x41
+	tagGauge32   = 0x42
+	tagTimeTicks = 0x43
+	tagOpaque    = 0x44
+	tagCounter64 = 0x46
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	tagGetRequest  = 0xa0
+	tagGetResponse = 0xa2
+	tagReport      = 0xa8
+)
+
+func lengthHeader(tag byte, n int) []byte {
+	if n < 0x80 {
+		return []byte{tag, byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{tag, 0x80 | byte(len(b))}, b...)
+}
+
+func tlv(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := lengthHeader(tag, n)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func encodeInteger(v int64) []byte {
+	b := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return tlv(tagInteger, b)
+}
+
+func encodeOctetString(s []byte) []byte {
+	return tlv(tagOctetString, s)
+}
+
+func encodeOID(oid []uint32) []byte {
+	b := encodeSubidentifier(nil, oid[0]*40+oid[1])
+	for _, id := range oid[2:] {
+		b = encodeSubidentifier(b, id)
+	}
+	return tlv(tagOID, b)
+}
+
+func encodeSubidentifier(b []byte, id uint32) []byte {
+	bs := []byte{byte(id & 0x7f)}
+	for id >>= 7; id > 0; id >>= 7 {
+		bs = append([]byte{0x80 | byte(id&0x7f)}, bs...)
+	}
+	return append(b, bs...)
+}
+
+// ParseOID parses the dotted notation of an OID, such as 1.3.6.1.2.1.1.3.0.
+func ParseOID(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid oid: %q", s)
+	}
+	oid := make([]uint32, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oid: %q", s)
+		}
+		oid[i] = uint32(v)
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, fmt.Errorf("invalid oid: %q", s)
+	}
+	return oid, nil
+}
+
+func formatOID(oid []uint32) string {
+	parts := make([]string, len(oid))
+	for i, id := range oid {
+		parts[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// readTLV reads an element of b and returns its tag, its contents and the rest of b.
+func readTLV(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated element")
+	}
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, fmt.Errorf("invalid length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n < 0 || len(b) < n {
+		return 0, nil, nil, fmt.Errorf("truncated element")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// expect reads an element of the tag.
+func expect(tag byte, b []byte) ([]byte, []byte, error) {
+	t, contents, rest, err := readTLV(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != tag {
+		return nil, nil, fmt.Errorf("unexpected tag 0x%02x, expected 0x%02x", t, tag)
+	}
+	return contents, rest, nil
+}
+
+func expectInteger(b []byte) (int64, []byte, error) {
+	contents, rest, err := expect(tagInteger, b)
+	if err != nil {
+		return 0, nil, err
+	}
+	v, err := decodeInteger(contents)
+	return v, rest, err
+}
+
+func decodeInteger(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, fmt.Errorf("invalid integer")
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, nil
+}
+
+func decodeUnsigned(b []byte) (uint64, error) {
+	if len(b) == 0 || len(b) > 9 || (len(b) == 9 && b[0] != 0) {
+		return 0, fmt.Errorf("invalid unsigned integer")
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func decodeOID(b []byte) ([]uint32, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("invalid oid")
+	}
+	var oid []uint32
+	var id uint32
+	for i, c := range b {
+		id = id<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, fmt.Errorf("invalid oid")
+			}
+			continue
+		}
+		if oid == nil {
+			if id < 80 {
+				oid = []uint32{id / 40, id % 40}
+			} else {
+				oid = []uint32{2, id - 80}
+			}
+		} else {
+			oid = append(oid, id)
+		}
+		id = 0
+	}
+	return oid, nil
+}
@@ -0,0 +1,294 @@
+// Package snmp implements the GET requests of SNMP v1, v2c and v3 (USM) to
+// poll the network devices.
+package snmp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The versions of SNMP.
+const (
+	Version1  = "1"
+	Version2c = "2c"
+	Version3  = "3"
+)
+
+// Type is the type of a variable.
+type Type byte
+
+// The types of the variables.
+const (
+	Integer     Type = tagInteger
+	OctetString Type = tagOctetString
+	Counter32   Type = tagCounter32
+	Gauge32     Type = tagGauge32
+	TimeTicks   Type = tagTimeTicks
+	Counter64   Type = tagCounter64
+	// NoValue means the variable does not exist in the device.
+	NoValue Type = tagNull
+)
+
+// Variable is a variable in the response.
+type Variable struct {
+	OID  string
+	Type Type
+	// Value is int64 for Integer, uint64 for the counters, the gauges and
+	// the time ticks, []byte for OctetString and nil for NoValue.
+	Value interface{}
+}
+
+// Client sends the requests to an SNMP agent.
+type Client struct {
+	// Target is the address of the agent, host:port.
+	Target    string
+	Version   string
+	Community string
+	// USM is the security parameters of SNMP v3.
+	USM     *USM
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	engine *engine
+}
+
+// maxMessageSize is the maximum size of the UDP datagrams.
+const maxMessageSize = 65507
+
+var requestIDs = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func newRequestID() int64 {
+	requestIDs.Lock()
+	defer requestIDs.Unlock()
+	return int64(requestIDs.Int31())
+}
+
+// Get gets the variables of oids. The variables which do not exist in the
+// device are NoValue.
+func (c *Client) Get(oids []string) ([]*Variable, error) {
+	parsed := make([][]uint32, len(oids))
+	for i, s := range oids {
+		var err error
+		parsed[i], err = ParseOID(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.Dial("udp", c.Target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.Timeout)
+
+	var vars []*Variable
+	switch c.Version {
+	case Version1, Version2c:
+		vars, err = c.getCommunity(conn, deadline, parsed)
+	case Version3:
+		vars, err = c.getUSM(conn, deadline, parsed)
+	default:
+		return nil, fmt.Errorf("unsupported version: %q", c.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !equalOIDs(vars, parsed) {
+		return nil, fmt.Errorf("the variables of the response do not match the request")
+	}
+	return vars, nil
+}
+
+func (c *Client) getCommunity(conn net.Conn, deadline time.Time, oids [][]uint32) ([]*Variable, error) {
+	var version int64
+	if c.Version == Version2c {
+		version = 1
+	}
+	requestID := newRequestID()
+	msg := tlv(tagSequence, encodeInteger(version), encodeOctetString([]byte(c.Community)), encodePDU(tagGetRequest, requestID, oids))
+	b, err := roundTrip(conn, msg, deadline, func(b []byte) bool {
+		return matchCommunityResponse(b, requestID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	contents, _, err := expect(tagSequence, b)
+	if err != nil {
+		return nil, err
+	}
+	if _, contents, err = expectInteger(contents); err != nil {
+		return nil, err
+	}
+	if _, contents, err = expect(tagOctetString, contents); err != nil {
+		return nil, err
+	}
+	_, vars, err := decodePDU(contents)
+	return vars, err
+}
+
+func matchCommunityResponse(b []byte, requestID int64) bool {
+	contents, _, err := expect(tagSequence, b)
+	if err != nil {
+		return false
+	}
+	if _, contents, err = expectInteger(contents); err != nil {
+		return false
+	}
+	if _, contents, err = expect(tagOctetString, contents); err != nil {
+		return false
+	}
+	return matchPDU(contents, requestID)
+}
+
+// roundTrip sends msg and waits for the response matched by match until the
+// deadline. The request is sent again at the half of the time since UDP is lossy.
+func roundTrip(conn net.Conn, msg []byte, deadline time.Time, match func([]byte) bool) ([]byte, error) {
+	buf := make([]byte, maxMessageSize)
+	readDeadlines := []time.Time{time.Now().Add(time.Until(deadline) / 2), deadline}
+	for _, d := range readDeadlines {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(d)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if match(buf[:n]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("timeout")
+}
+
+func encodePDU(tag byte, requestID int64, oids [][]uint32) []byte {
+	var vars [][]byte
+	for _, oid := range oids {
+		vars = append(vars, tlv(tagSequence, encodeOID(oid), tlv(tagNull)))
+	}
+	return tlv(tag, encodeInteger(requestID), encodeInteger(0), encodeInteger(0), tlv(tagSequence, vars...))
+}
+
+func matchPDU(b []byte, requestID int64) bool {
+	tag, contents, _, err := readTLV(b)
+	if err != nil || (tag != tagGetResponse && tag != tagReport) {
+		return false
+	}
+	id, _, err := expectInteger(contents)
+	return err == nil && id == requestID
+}
+
+// The error statuses of the responses.
+var errorStatuses = []string{
+	"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr",
+	"noAccess", "wrongType", "wrongLength", "wrongEncoding", "wrongValue",
+	"noCreation", "inconsistentValue", "resourceUnavailable", "commitFailed",
+	"undoFailed", "authorizationError", "notWritable", "inconsistentName",
+}
+
+// decodePDU decodes the PDU and returns its tag and the variables.
+func decodePDU(b []byte) (byte, []*Variable, error) {
+	tag, contents, _, err := readTLV(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != tagGetResponse && tag != tagReport {
+		return 0, nil, fmt.Errorf("unexpected pdu 0x%02x", tag)
+	}
+	if _, contents, err = expectInteger(contents); err != nil {
+		return 0, nil, err
+	}
+	status, contents, err := expectInteger(contents)
+	if err != nil {
+		return 0, nil, err
+	}
+	index, contents, err := expectInteger(contents)
+	if err != nil {
+		return 0, nil, err
+	}
+	if status != 0 && tag != tagReport {
+		name := strconv.FormatInt(status, 10)
+		if status > 0 && status < int64(len(errorStatuses)) {
+			name = errorStatuses[status]
+		}
+		return 0, nil, fmt.Errorf("error status %s at index %d", name, index)
+	}
+	contents, _, err = expect(tagSequence, contents)
+	if err != nil {
+		return 0, nil, err
+	}
+	var vars []*Variable
+	for len(contents) > 0 {
+		var vb []byte
+		vb, contents, err = expect(tagSequence, contents)
+		if err != nil {
+			return 0, nil, err
+		}
+		v, err := decodeVariable(vb)
+		if err != nil {
+			return 0, nil, err
+		}
+		vars = append(vars, v)
+	}
+	return tag, vars, nil
+}
+
+func decodeVariable(b []byte) (*Variable, error) {
+	contents, b, err := expect(tagOID, b)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := decodeOID(contents)
+	if err != nil {
+		return nil, err
+	}
+	v := &Variable{OID: formatOID(oid)}
+	tag, contents, _, err := readTLV(b)
+	if err != nil {
+		return nil, err
+	}
+	v.Type = Type(tag)
+	switch tag {
+	case tagInteger:
+		v.Value, err = decodeInteger(contents)
+	case tagCounter32, tagGauge32, tagTimeTicks, tagCounter64:
+		v.Value, err = decodeUnsigned(contents)
+	case tagOctetString:
+		v.Value = contents
+	case tagNull, tagNoSuchObject, tagNoSuchInstance, tagEndOfMibView:
+		v.Type = NoValue
+	default:
+		// IpAddress, Opaque and the others are not numeric.
+		v.Type = OctetString
+		v.Value = contents
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %s", v.OID, err)
+	}
+	return v, nil
+}
+
+// equalOIDs reports whether the variables are of oids in order.
+func equalOIDs(vars []*Variable, oids [][]uint32) bool {
+	if len(vars) != len(oids) {
+		return false
+	}
+	for i, v := range vars {
+		if v.OID != formatOID(oids[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,317 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeOID(t *testing.T) {
+	testCases := []struct {
+		oid      string
+		expected string
+	}{
+		{"1.3.6.1.2.1.1.3.0", "06082b06010201010300"},
+		{".1.3.6.1.4.1.2021.10.1.3.1", "060b2b060104018f650a010301"},
+		{"2.999.3", "0603883703"},
+	}
+	for _, tc := range testCases {
+		oid, err := ParseOID(tc.oid)
+		if err != nil {
+			t.Errorf("should not raise error for %q: %v", tc.oid, err)
+			continue
+		}
+		b := encodeOID(oid)
+		if hex.EncodeToString(b) != tc.expected {
+			t.Errorf("%s should be encoded to %s but %x", tc.oid, tc.expected, b)
+		}
+		contents, _, _ := expect(tagOID, b)
+		decoded, err := decodeOID(contents)
+		if err != nil || formatOID(decoded) != formatOID(oid) {
+			t.Errorf("%x should be decoded to %s but %v (%v)", b, tc.oid, decoded, err)
+		}
+	}
+	for _, s := range []string{"", "1", "1.3.a", "3.1", "1.40", "1.3.-1"} {
+		if _, err := ParseOID(s); err == nil {
+			t.Errorf("should raise error for %q", s)
+		}
+	}
+}
+
+func TestEncodeInteger(t *testing.T) {
+	testCases := map[int64]string{
+		0:      "020100",
+		127:    "02017f",
+		128:    "02020080",
+		-1:     "0201ff",
+		-129:   "0202ff7f",
+		0x1234: "02021234",
+	}
+	for v, expected := range testCases {
+		b := encodeInteger(v)
+		if hex.EncodeToString(b) != expected {
+			t.Errorf("%d should be encoded to %s but %x", v, expected, b)
+		}
+		decoded, _, err := expectInteger(b)
+		if err != nil || decoded != v {
+			t.Errorf("%x should be decoded to %d but %d (%v)", b, v, decoded, err)
+		}
+	}
+	if h := lengthHeader(tagSequence, 300); !bytes.Equal(h, []byte{0x30, 0x82, 0x01, 0x2c}) {
+		t.Errorf("unexpected long length: %x", h)
+	}
+}
+
+// RFC 3414 A.3
+func TestLocalizedKey(t *testing.T) {
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	u := &USM{AuthProtocol: AuthMD5}
+	if key := hex.EncodeToString(localizedKey(u.hash(), "maplesyrup", engineID)); key != "526f5eed9fcce26f8964c2930787d82b" {
+		t.Errorf("unexpected key of MD5: %s", key)
+	}
+	u = &USM{AuthProtocol: AuthSHA}
+	if key := hex.EncodeToString(localizedKey(u.hash(), "maplesyrup", engineID)); key != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Errorf("unexpected key of SHA: %s", key)
+	}
+}
+
+func encodeUnsigned(tag byte, v uint64) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return tlv(tag, b)
+}
+
+// agentValues are the values of the fake agent.
+var agentValues = map[string][]byte{
+	"1.3.6.1.2.1.2.2.1.10.1":    encodeUnsigned(tagCounter32, 4294967295),
+	"1.3.6.1.2.1.31.1.1.1.6.1":  encodeUnsigned(tagCounter64, 1<<63),
+	"1.3.6.1.2.1.1.3.0":         encodeUnsigned(tagTimeTicks, 100),
+	"1.3.6.1.4.1.2021.10.1.5.1": encodeInteger(-5),
+	"1.3.6.1.4.1.2021.10.1.3.1": encodeOctetString([]byte("0.15")),
+}
+
+// agentResponse returns the response pdu to the request pdu.
+func agentResponse(t *testing.T, pdu []byte) []byte {
+	contents, _, err := expect(tagGetRequest, pdu)
+	if err != nil {
+		t.Errorf("unexpected pdu: %v", err)
+		return nil
+	}
+	requestID, contents, _ := expectInteger(contents)
+	_, contents, _ = expectInteger(contents)
+	_, contents, _ = expectInteger(contents)
+	contents, _, _ = expect(tagSequence, contents)
+	var vars [][]byte
+	for len(contents) > 0 {
+		var vb []byte
+		vb, contents, _ = expect(tagSequence, contents)
+		b, _, _ := expect(tagOID, vb)
+		oid, _ := decodeOID(b)
+		value, ok := agentValues[formatOID(oid)]
+		if !ok {
+			value = tlv(tagNoSuchObject)
+		}
+		vars = append(vars, tlv(tagSequence, encodeOID(oid), value))
+	}
+	return tlv(tagGetResponse, encodeInteger(requestID), encodeInteger(0), encodeInteger(0), tlv(tagSequence, vars...))
+}
+
+// serveAgent serves the fake agent by handle until the connection is closed.
+func serveAgent(conn net.PacketConn, handle func([]byte) []byte) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := handle(append([]byte(nil), buf[:n]...)); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func assertVariables(t *testing.T, vars []*Variable) {
+	expected := []*Variable{
+		{"1.3.6.1.2.1.2.2.1.10.1", Counter32, uint64(4294967295)},
+		{"1.3.6.1.2.1.31.1.1.1.6.1", Counter64, uint64(1 << 63)},
+		{"1.3.6.1.2.1.1.3.0", TimeTicks, uint64(100)},
+		{"1.3.6.1.4.1.2021.10.1.5.1", Integer, int64(-5)},
+		{"1.3.6.1.4.1.2021.10.1.3.1", OctetString, []byte("0.15")},
+		{"1.3.6.1.2.1.1.99.0", NoValue, nil},
+	}
+	if len(vars) != len(expected) {
+		t.Fatalf("unexpected variables: %v", vars)
+	}
+	for i, v := range vars {
+		e := expected[i]
+		if v.OID != e.OID || v.Type != e.Type {
+			t.Errorf("%s should be %+v but %+v", e.OID, e, v)
+			continue
+		}
+		if b, ok := e.Value.([]byte); ok {
+			if !bytes.Equal(v.Value.([]byte), b) {
+				t.Errorf("%s should be %+v but %+v", e.OID, e, v)
+			}
+		} else if v.Value != e.Value {
+			t.Errorf("%s should be %+v but %+v", e.OID, e, v)
+		}
+	}
+}
+
+var testOIDs = []string{
+	"1.3.6.1.2.1.2.2.1.10.1",
+	".1.3.6.1.2.1.31.1.1.1.6.1",
+	"1.3.6.1.2.1.1.3.0",
+	"1.3.6.1.4.1.2021.10.1.5.1",
+	"1.3.6.1.4.1.2021.10.1.3.1",
+	"1.3.6.1.2.1.1.99.0",
+}
+
+func TestClient_GetCommunity(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	requests := 0
+	go serveAgent(conn, func(b []byte) []byte {
+		requests++
+		if requests == 1 {
+			// lose the first request
+			return nil
+		}
+		contents, _, _ := expect(tagSequence, b)
+		version, contents, _ := expectInteger(contents)
+		community, contents, _ := expect(tagOctetString, contents)
+		if version != 1 || string(community) != "public" {
+			return nil
+		}
+		return tlv(tagSequence, encodeInteger(version), encodeOctetString(community), agentResponse(t, contents))
+	})
+
+	c := &Client{Target: conn.LocalAddr().String(), Version: Version2c, Community: "public", Timeout: 2 * time.Second}
+	vars, err := c.Get(testOIDs)
+	if err != nil {
+		t.Fatalf("should not raise error: %v", err)
+	}
+	assertVariables(t, vars)
+
+	c = &Client{Target: conn.LocalAddr().String(), Version: Version2c, Community: "private", Timeout: 200 * time.Millisecond}
+	if _, err := c.Get(testOIDs); err == nil {
+		t.Error("should raise error for the timeout")
+	}
+}
+
+// newAgentEngine creates the engine of the fake agent.
+func newAgentEngine(u *USM, boots, now int64) *engine {
+	e := &engine{id: []byte("\x80\x00\x1f\x88\x04test"), boots: boots, time: now, discoveredAt: time.Now()}
+	if h := u.hash(); h != nil {
+		e.authKey = localizedKey(h, u.AuthPassword, e.id)
+		if u.PrivProtocol != "" {
+			e.privKey = localizedKey(h, u.PrivPassword, e.id)
+		}
+	}
+	return e
+}
+
+// handleUSM handles the requests of v3 with the same functions of the client.
+func handleUSM(t *testing.T, agent *Client, b []byte) []byte {
+	m, err := decodeV3(b)
+	if err != nil {
+		t.Errorf("unexpected message: %v", err)
+		return nil
+	}
+	report := func(oid string, flags byte) []byte {
+		parsed, _ := ParseOID(oid)
+		pdu := tlv(tagReport, encodeInteger(0), encodeInteger(0), encodeInteger(0),
+			tlv(tagSequence, tlv(tagSequence, encodeOID(parsed), encodeUnsigned(tagCounter32, 1))))
+		resp, _ := agent.encodeV3(agent.engine, m.msgID, flags, pdu)
+		return resp
+	}
+	if len(m.engineID) == 0 {
+		return report(oidUnknownEngineIDs, 0)
+	}
+	if m.flags&flagAuth != 0 && !agent.verify(b, m) {
+		return report(oidWrongDigests, 0)
+	}
+	if m.flags&flagAuth != 0 && (m.boots != agent.engine.boots || m.time < agent.engine.currentTime()-150) {
+		return report(oidNotInTimeWindows, flagAuth)
+	}
+	data := m.data
+	if m.flags&flagPriv != 0 {
+		if data, err = agent.decrypt(m); err != nil {
+			return report(oidDecryptionErrors, 0)
+		}
+	}
+	contents, _, _ := expect(tagSequence, data)
+	_, contents, _ = expect(tagOctetString, contents)
+	_, contents, _ = expect(tagOctetString, contents)
+	resp, _ := agent.encodeV3(agent.engine, m.msgID, m.flags&^flagReportable, agentResponse(t, contents))
+	return resp
+}
+
+func TestClient_GetUSM(t *testing.T) {
+	testCases := []*USM{
+		{UserName: "user", AuthProtocol: AuthSHA, AuthPassword: "authpass", PrivProtocol: PrivAES, PrivPassword: "privpass"},
+		{UserName: "user", AuthProtocol: AuthMD5, AuthPassword: "authpass", PrivProtocol: PrivDES, PrivPassword: "privpass"},
+		{UserName: "user", AuthProtocol: AuthSHA, AuthPassword: "authpass"},
+		{UserName: "user"},
+	}
+	for _, u := range testCases {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		agent := &Client{USM: u, engine: newAgentEngine(u, 3, 1000)}
+		go serveAgent(conn, func(b []byte) []byte {
+			agent.mu.Lock()
+			defer agent.mu.Unlock()
+			return handleUSM(t, agent, b)
+		})
+
+		c := &Client{Target: conn.LocalAddr().String(), Version: Version3, USM: u, Timeout: 2 * time.Second}
+		vars, err := c.Get(testOIDs)
+		if err != nil {
+			t.Errorf("should not raise error for %+v: %v", u, err)
+			continue
+		}
+		assertVariables(t, vars)
+
+		// The agent is rebooted.
+		agent.mu.Lock()
+		agent.engine.boots++
+		agent.mu.Unlock()
+		vars, err = c.Get(testOIDs)
+		if err != nil {
+			t.Errorf("should not raise error after the reboot for %+v: %v", u, err)
+			continue
+		}
+		assertVariables(t, vars)
+	}
+
+	// wrong password
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	u := testCases[0]
+	agent := &Client{USM: u, engine: newAgentEngine(u, 1, 1)}
+	go serveAgent(conn, func(b []byte) []byte {
+		return handleUSM(t, agent, b)
+	})
+	wrong := *u
+	wrong.AuthPassword = "wrongpass"
+	c := &Client{Target: conn.LocalAddr().String(), Version: Version3, USM: &wrong, Timeout: 2 * time.Second}
+	if _, err := c.Get(testOIDs); err == nil || err.Error() != "report: wrong digest" {
+		t.Errorf("should raise error of the wrong digest: %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+package snmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"time"
+)
+
+// The protocols of USM.
+const (
+	AuthMD5 = "MD5"
+	AuthSHA = "SHA"
+	PrivDES = "DES"
+	PrivAES = "AES"
+)
+
+// USM is the security parameters of the User-based Security Model of SNMP v3.
+// The security level is noAuthNoPriv without AuthProtocol, and authNoPriv
+// without PrivProtocol.
+type USM struct {
+	UserName     string
+	AuthProtocol string
+	AuthPassword string
+	PrivProtocol string
+	PrivPassword string
+}
+
+// engine is the authoritative SNMP engine of the agent discovered at the first request.
+type engine struct {
+	id           []byte
+	boots        int64
+	time         int64
+	discoveredAt time.Time
+	authKey      []byte
+	privKey      []byte
+	salt         uint64
+}
+
+func (e *engine) currentTime() int64 {
+	return e.time + int64(time.Since(e.discoveredAt)/time.Second)
+}
+
+const (
+	flagAuth       = 0x01
+	flagPriv       = 0x02
+	flagReportable = 0x04
+
+	securityModelUSM = 3
+	authParamsSize   = 12
+)
+
+// The reports of usmStats.
+const (
+	oidUnsupportedSecLevels = "1.3.6.1.6.3.15.1.1.1.0"
+	oidNotInTimeWindows     = "1.3.6.1.6.3.15.1.1.2.0"
+	oidUnknownUserNames     = "1.3.6.1.6.3.15.1.1.3.0"
+	oidUnknownEngineIDs     = "1.3.6.1.6.3.15.1.1.4.0"
+	oidWrongDigests         = "1.3.6.1.6.3.15.1.1.5.0"
+	oidDecryptionErrors     = "1.3.6.1.6.3.15.1.1.6.0"
+)
+
+var reportNames = map[string]string{
+	oidUnsupportedSecLevels: "unsupported security level",
+	oidNotInTimeWindows:     "not in time window",
+	oidUnknownUserNames:     "unknown user name",
+	oidUnknownEngineIDs:     "unknown engine id",
+	oidWrongDigests:         "wrong digest",
+	oidDecryptionErrors:     "decryption error",
+}
+
+type reportError struct {
+	oid string
+}
+
+func (e *reportError) Error() string {
+	if name, ok := reportNames[e.oid]; ok {
+		return "report: " + name
+	}
+	return "report: " + e.oid
+}
+
+func (u *USM) hash() func() hash.Hash {
+	switch u.AuthProtocol {
+	case AuthMD5:
+		return md5.New
+	case AuthSHA:
+		return sha1.New
+	}
+	return nil
+}
+
+func (u *USM) flags() byte {
+	var flags byte = flagReportable
+	if u.AuthProtocol != "" {
+		flags |= flagAuth
+		if u.PrivProtocol != "" {
+			flags |= flagPriv
+		}
+	}
+	return flags
+}
+
+// localizedKey derives the key of password localized to engineID by RFC 3414 A.2.
+func localizedKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	const size = 1024 * 1024
+	buf := make([]byte, 64)
+	for i := 0; i < size; i += len(buf) {
+		for j := range buf {
+			buf[j] = password[(i+j)%len(password)]
+		}
+		h.Write(buf)
+	}
+	key := h.Sum(nil)
+	h.Reset()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func (c *Client) getUSM(conn net.Conn, deadline time.Time, oids [][]uint32) ([]*Variable, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.engine == nil {
+		if err := c.discover(conn, deadline); err != nil {
+			return nil, fmt.Errorf("failed to discover the engine: %s", err)
+		}
+	}
+	vars, err := c.requestUSM(conn, deadline, oids)
+	if e, ok := err.(*reportError); ok {
+		switch e.oid {
+		case oidNotInTimeWindows:
+			// the engine time is synchronized by the report
+			return c.requestUSM(conn, deadline, oids)
+		case oidUnknownEngineIDs:
+			// the agent may be replaced
+			c.engine = nil
+		}
+	}
+	return vars, err
+}
+
+func (c *Client) discover(conn net.Conn, deadline time.Time) error {
+	msgID := newRequestID()
+	msg, _ := c.encodeV3(&engine{}, msgID, flagReportable, encodePDU(tagGetRequest, newRequestID(), nil))
+	b, err := roundTrip(conn, msg, deadline, func(b []byte) bool {
+		m, err := decodeV3(b)
+		return err == nil && m.msgID == msgID
+	})
+	if err != nil {
+		return err
+	}
+	m, err := decodeV3(b)
+	if err != nil {
+		return err
+	}
+	if len(m.engineID) == 0 {
+		return fmt.Errorf("no engine id")
+	}
+	e := &engine{id: m.engineID, boots: m.boots, time: m.time, discoveredAt: time.Now()}
+	if h := c.USM.hash(); h != nil {
+		e.authKey = localizedKey(h, c.USM.AuthPassword, e.id)
+		if c.USM.PrivProtocol != "" {
+			e.privKey = localizedKey(h, c.USM.PrivPassword, e.id)
+		}
+	}
+	e.salt = uint64(newRequestID())
+	c.engine = e
+	return nil
+}
+
+func (c *Client) requestUSM(conn net.Conn, deadline time.Time, oids [][]uint32) ([]*Variable, error) {
+	msgID := newRequestID()
+	msg, err := c.encodeV3(c.engine, msgID, c.USM.flags(), encodePDU(tagGetRequest, newRequestID(), oids))
+	if err != nil {
+		return nil, err
+	}
+	b, err := roundTrip(conn, msg, deadline, func(b []byte) bool {
+		m, err := decodeV3(b)
+		return err == nil && m.msgID == msgID
+	})
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeV3(b)
+	if err != nil {
+		return nil, err
+	}
+	if m.flags&flagAuth != 0 {
+		if !c.verify(b, m) {
+			return nil, fmt.Errorf("the response is not authenticated")
+		}
+		// synchronize the engine time with the authenticated message
+		if m.boots != c.engine.boots || m.time > c.engine.currentTime() {
+			c.engine.boots, c.engine.time, c.engine.discoveredAt = m.boots, m.time, time.Now()
+		}
+	}
+	data := m.data
+	if m.flags&flagPriv != 0 {
+		data, err = c.decrypt(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	contents, _, err := expect(tagSequence, data)
+	if err != nil {
+		return nil, err
+	}
+	if _, contents, err = expect(tagOctetString, contents); err != nil {
+		return nil, err
+	}
+	if _, contents, err = expect(tagOctetString, contents); err != nil {
+		return nil, err
+	}
+	tag, vars, err := decodePDU(contents)
+	if err != nil {
+		return nil, err
+	}
+	if tag == tagReport {
+		if len(vars) == 0 {
+			return nil, &reportError{}
+		}
+		return nil, &reportError{oid: vars[0].OID}
+	}
+	if m.flags&flagAuth == 0 && c.USM.AuthProtocol != "" {
+		return nil, fmt.Errorf("the response is not authenticated")
+	}
+	return vars, nil
+}
+
+// encodeV3 encodes the message of SNMP v3 with the scoped pdu.
+func (c *Client) encodeV3(e *engine, msgID int64, flags byte, pdu []byte) ([]byte, error) {
+	data := tlv(tagSequence, encodeOctetString(e.id), encodeOctetString(nil), pdu)
+	var authParams, privParams []byte
+	boots, now := e.boots, int64(0)
+	if e.id != nil {
+		now = e.currentTime()
+	}
+	var user []byte
+	if flags&(flagAuth|flagPriv) != 0 || e.id != nil {
+		user = []byte(c.USM.UserName)
+	}
+	if flags&flagAuth != 0 {
+		authParams = make([]byte, authParamsSize)
+	}
+	if flags&flagPriv != 0 {
+		var err error
+		data, privParams, err = c.encrypt(e, data, boots, now)
+		if err != nil {
+			return nil, err
+		}
+		data = encodeOctetString(data)
+	}
+
+	prefix := concat(encodeOctetString(e.id), encodeInteger(boots), encodeInteger(now), encodeOctetString(user))
+	authHeader := lengthHeader(tagOctetString, len(authParams))
+	spContents := concat(prefix, authHeader, authParams, encodeOctetString(privParams))
+	sp := tlv(tagSequence, spContents)
+	spOffset := len(sp) - len(spContents) + len(prefix) + len(authHeader)
+	spOctet := encodeOctetString(sp)
+	spOffset += len(spOctet) - len(sp)
+
+	header := tlv(tagSequence, encodeInteger(msgID), encodeInteger(maxMessageSize), encodeOctetString([]byte{flags}), encodeInteger(securityModelUSM))
+	body := concat(encodeInteger(3), header, spOctet, data)
+	msg := tlv(tagSequence, body)
+	if flags&flagAuth != 0 {
+		offset := len(msg) - len(body) + len(encodeInteger(3)) + len(header) + spOffset
+		mac := hmac.New(c.USM.hash(), e.authKey)
+		mac.Write(msg)
+		copy(msg[offset:], mac.Sum(nil)[:authParamsSize])
+	}
+	return msg, nil
+}
+
+func concat(bs ...[]byte) []byte {
+	var b []byte
+	for _, c := range bs {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// verify verifies the authentication parameters of the message b.
+func (c *Client) verify(b []byte, m *v3Message) bool {
+	if c.USM.hash() == nil || len(m.authParams) != authParamsSize {
+		return false
+	}
+	zeroed := append([]byte(nil), b...)
+	copy(zeroed[m.authOffset:], make([]byte, authParamsSize))
+	mac := hmac.New(c.USM.hash(), c.engine.authKey)
+	mac.Write(zeroed)
+	return hmac.Equal(mac.Sum(nil)[:authParamsSize], m.authParams)
+}
+
+// encrypt encrypts the scoped pdu by RFC 3414 8.1.1 (DES) or RFC 3826 (AES).
+func (c *Client) encrypt(e *engine, data []byte, boots, now int64) ([]byte, []byte, error) {
+	e.salt++
+	salt := make([]byte, 8)
+	switch c.USM.PrivProtocol {
+	case PrivDES:
+		binary.BigEndian.PutUint32(salt, uint32(boots))
+		binary.BigEndian.PutUint32(salt[4:], uint32(e.salt))
+		block, err := des.NewCipher(e.privKey[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = e.privKey[8+i] ^ salt[i]
+		}
+		if n := len(data) % des.BlockSize; n > 0 {
+			data = append(data, make([]byte, des.BlockSize-n)...)
+		}
+		encrypted := make([]byte, len(data))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, data)
+		return encrypted, salt, nil
+	case PrivAES:
+		binary.BigEndian.PutUint64(salt, e.salt)
+		block, err := aes.NewCipher(e.privKey[:16])
+		if err != nil {
+			return nil, nil, err
+		}
+		encrypted := make([]byte, len(data))
+		cipher.NewCFBEncrypter(block, aesIV(boots, now, salt)).XORKeyStream(encrypted, data)
+		return encrypted, salt, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported privacy protocol: %q", c.USM.PrivProtocol)
+}
+
+func (c *Client) decrypt(m *v3Message) ([]byte, error) {
+	if len(m.privParams) != 8 {
+		return nil, fmt.Errorf("invalid privacy parameters")
+	}
+	switch c.USM.PrivProtocol {
+	case PrivDES:
+		if len(m.data)%des.BlockSize != 0 {
+			return nil, fmt.Errorf("invalid encrypted data")
+		}
+		block, err := des.NewCipher(c.engine.privKey[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = c.engine.privKey[8+i] ^ m.privParams[i]
+		}
+		data := make([]byte, len(m.data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, m.data)
+		return data, nil
+	case PrivAES:
+		block, err := aes.NewCipher(c.engine.privKey[:16])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, len(m.data))
+		cipher.NewCFBDecrypter(block, aesIV(m.boots, m.time, m.privParams)).XORKeyStream(data, m.data)
+		return data, nil
+	}
+	return nil, fmt.Errorf("unsupported privacy protocol: %q", c.USM.PrivProtocol)
+}
+
+func aesIV(boots, now int64, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(now))
+	copy(iv[8:], salt)
+	return iv
+}
+
+// v3Message is the decoded message of SNMP v3.
+type v3Message struct {
+	msgID      int64
+	flags      byte
+	engineID   []byte
+	boots      int64
+	time       int64
+	authParams []byte
+	authOffset int // the offset of authParams in the message
+	privParams []byte
+	data       []byte // the scoped pdu, or encrypted one
+}
+
+func decodeV3(b []byte) (*v3Message, error) {
+	contents, _, err := expect(tagSequence, b)
+	if err != nil {
+		return nil, err
+	}
+	version, contents, err := expectInteger(contents)
+	if err != nil {
+		return nil, err
+	}
+	if version != 3 {
+		return nil, fmt.Errorf("unexpected version %d", version)
+	}
+	header, contents, err := expect(tagSequence, contents)
+	if err != nil {
+		return nil, err
+	}
+	m := &v3Message{}
+	if m.msgID, header, err = expectInteger(header); err != nil {
+		return nil, err
+	}
+	if _, header, err = expectInteger(header); err != nil {
+		return nil, err
+	}
+	flags, header, err := expect(tagOctetString, header)
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) != 1 {
+		return nil, fmt.Errorf("invalid flags")
+	}
+	m.flags = flags[0]
+	sp, contents, err := expect(tagOctetString, contents)
+	if err != nil {
+		return nil, err
+	}
+	if sp, _, err = expect(tagSequence, sp); err != nil {
+		return nil, err
+	}
+	if m.engineID, sp, err = expect(tagOctetString, sp); err != nil {
+		return nil, err
+	}
+	if m.boots, sp, err = expectInteger(sp); err != nil {
+		return nil, err
+	}
+	if m.time, sp, err = expectInteger(sp); err != nil {
+		return nil, err
+	}
+	if _, sp, err = expect(tagOctetString, sp); err != nil {
+		return nil, err
+	}
+	if m.authParams, sp, err = expect(tagOctetString, sp); err != nil {
+		return nil, err
+	}
+	// the contents share the memory of b
+	m.authOffset = cap(b) - cap(m.authParams)
+	if m.privParams, _, err = expect(tagOctetString, sp); err != nil {
+		return nil, err
+	}
+	if m.flags&flagPriv != 0 {
+		if m.data, _, err = expect(tagOctetString, contents); err != nil {
+			return nil, err
+		}
+	} else {
+		m.data = contents
+	}
+	return m, nil
+}
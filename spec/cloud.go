@@ -12,14 +12,14 @@ import (
 	"time"
 
 	"github.com/Songmu/retry"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 
 	"github.com/mackerelio/mackerel-agent/config"
 )
 
 // This Generator collects metadata about cloud instances.
-// Currently EC2 and GCE are supported.
+// Currently EC2, GCE, Azure VM and ECS are supported.
 // EC2: http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/AESDG-chapter-instancedata.html
 // GCE: https://developers.google.com/compute/docs/metadata
 // AzureVM: https://docs.microsoft.com/azure/virtual-machines/virtual-machines-instancemetadataservice-overview
@@ -35,7 +35,7 @@ type CloudMetaGenerator interface {
 	SuggestCustomIdentifier() (string, error)
 }
 
-var cloudLogger = logging.GetLogger("spec.cloud")
+var cloudLogger = logformat.GetLogger("spec.cloud")
 
 var ec2BaseURL, gceMetaURL, azureVMBaseURL *url.URL
 
@@ -53,12 +53,36 @@ func SuggestCloudGenerator(conf *config.Config) *CloudGenerator {
 	switch conf.CloudPlatform {
 	case config.CloudPlatformNone:
 		return nil
+	}
+
+	// skip detecting the platform if the metadata service is specified explicitly
+	if conf.Cloud.MetadataEndpoint != "" {
+		g, err := newCustomEC2Generator(conf.Cloud)
+		if err != nil {
+			cloudLogger.Warningf("Failed to use the metadata endpoint %q: %s", conf.Cloud.MetadataEndpoint, err)
+			return nil
+		}
+		return &CloudGenerator{g}
+	}
+
+	switch conf.CloudPlatform {
 	case config.CloudPlatformEC2:
-		return &CloudGenerator{&EC2Generator{ec2BaseURL}}
+		return &CloudGenerator{&EC2Generator{baseURL: ec2BaseURL}}
 	case config.CloudPlatformGCE:
 		return &CloudGenerator{&GCEGenerator{gceMetaURL}}
 	case config.CloudPlatformAzureVM:
 		return &CloudGenerator{&AzureVMGenerator{azureVMBaseURL}}
+	case config.CloudPlatformECS:
+		if g := newECSGenerator(conf.ECSServiceIdentifier); g != nil {
+			return &CloudGenerator{g}
+		}
+		cloudLogger.Warningf("cloud_platform is ecs, but %s is not set", ecsMetadataURIEnv)
+		return nil
+	}
+
+	// prefer ECS to EC2 since the containers of ECS on EC2 can also access the metadata of EC2
+	if g := newECSGenerator(conf.ECSServiceIdentifier); isECS(context.Background(), g) {
+		return &CloudGenerator{g}
 	}
 
 	var wg sync.WaitGroup
@@ -70,7 +94,7 @@ func SuggestCloudGenerator(conf *config.Config) *CloudGenerator {
 	wg.Add(3)
 	go func() {
 		if isEC2(ctx) {
-			gCh <- &CloudGenerator{&EC2Generator{ec2BaseURL}}
+			gCh <- &CloudGenerator{&EC2Generator{baseURL: ec2BaseURL}}
 			cancel()
 		}
 		wg.Done()
@@ -123,7 +147,7 @@ func isAzure(ctx context.Context) bool {
 	err := retry.WithContext(ctx, 2, 2*time.Second, func() error {
 		cl := httpCli()
 		// '/vmId` is probably Azure VM specific URL
-		req, err := http.NewRequest("GET", azureVMBaseURL.String()+"/compute/vmId?api-version=2017-04-02&format=text", nil)
+		req, err := http.NewRequest("GET", azureVMBaseURL.String()+"/compute/vmId?api-version="+azureAPIVersion+"&format=text", nil)
 		if err != nil {
 			return err
 		}
@@ -163,12 +187,59 @@ func requestGCEMeta(ctx context.Context) ([]byte, error) {
 // EC2Generator meta generator for EC2
 type EC2Generator struct {
 	baseURL *url.URL
+
+	// custom is whether the metadata service is not of EC2 but compatible with it
+	custom  bool
+	timeout time.Duration
+	headers map[string]string
+
+	once   sync.Once
+	client *ec2MetadataClient
+}
+
+// The requests to the metadata services compatible with EC2 are retried,
+// since the platform is not detected beforehand.
+const customMetadataAttempts = 3
+
+var customMetadataRetryInterval = 2 * time.Second
+
+// newCustomEC2Generator creates an EC2Generator for the metadata service
+// compatible with EC2, which serves the metadata under /latest/meta-data.
+func newCustomEC2Generator(conf config.Cloud) (*EC2Generator, error) {
+	u, err := url.Parse(strings.TrimSuffix(conf.MetadataEndpoint, "/") + "/latest/meta-data")
+	if err != nil {
+		return nil, err
+	}
+	g := &EC2Generator{baseURL: u, custom: true, headers: conf.Headers}
+	if conf.Timeout != nil {
+		g.timeout = conf.Timeout.Duration
+	}
+	return g, nil
+}
+
+// metadataClient returns the client which caches the IMDSv2 token
+// during the periodic collection.
+func (g *EC2Generator) metadataClient() *ec2MetadataClient {
+	g.once.Do(func() {
+		g.client = &ec2MetadataClient{baseURL: g.baseURL, warnTimeout: true, timeout: g.timeout, headers: g.headers}
+	})
+	return g.client
+}
+
+func (g *EC2Generator) get(key string) (resp *http.Response, err error) {
+	cl := g.metadataClient()
+	if !g.custom {
+		return cl.get(context.Background(), key)
+	}
+	err = retry.Retry(customMetadataAttempts, customMetadataRetryInterval, func() error {
+		resp, err = cl.get(context.Background(), key)
+		return err
+	})
+	return resp, err
 }
 
 // Generate collects metadata from cloud platform.
 func (g *EC2Generator) Generate() (interface{}, error) {
-	cl := httpCli()
-
 	metadataKeys := []string{
 		"instance-id",
 		"instance-type",
@@ -186,9 +257,13 @@ func (g *EC2Generator) Generate() (interface{}, error) {
 	metadata := make(map[string]string)
 
 	for _, key := range metadataKeys {
-		resp, err := cl.Get(g.baseURL.String() + "/" + key)
+		resp, err := g.get(key)
 		if err != nil {
-			cloudLogger.Debugf("This host may not be running on EC2. Error while reading '%s'", key)
+			if g.custom {
+				cloudLogger.Warningf("Failed to request the metadata endpoint. Error while reading '%s': %s", key, err)
+				return nil, nil
+			}
+			cloudLogger.Debugf("This host may not be running on EC2. Error while reading '%s': %s", key, err)
 			return nil, nil
 		}
 		defer resp.Body.Close()
@@ -208,15 +283,20 @@ func (g *EC2Generator) Generate() (interface{}, error) {
 	return &mackerel.Cloud{Provider: "ec2", MetaData: metadata}, nil
 }
 
-// SuggestCustomIdentifier suggests the identifier of the EC2 instance
+// SuggestCustomIdentifier suggests the identifier of the EC2 instance.
+// Nothing is suggested for the metadata services compatible with EC2,
+// since their instance IDs are not of EC2.
 func (g *EC2Generator) SuggestCustomIdentifier() (string, error) {
+	if g.custom {
+		return "", nil
+	}
 	identifier := ""
 	err := retry.Retry(3, 2*time.Second, func() error {
-		cl := httpCli()
+		cl := g.metadataClient()
 		key := "instance-id"
-		resp, err := cl.Get(g.baseURL.String() + "/" + key)
+		resp, err := cl.get(context.Background(), key)
 		if err != nil {
-			return fmt.Errorf("error while retrieving instance-id")
+			return fmt.Errorf("error while retrieving instance-id: %s", err)
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != 200 {
@@ -252,11 +332,20 @@ func (g *GCEGenerator) Generate() (interface{}, error) {
 	return data.toGeneratorResults(), nil
 }
 
+// gceInstance does not have the labels of the instance, which the metadata
+// server does not serve. They are only available by the Compute Engine API
+// with the permission of compute.instances.get, so they are not collected.
 type gceInstance struct {
 	Zone         string
 	InstanceType string `json:"machineType"`
 	Hostname     string
 	InstanceID   uint64 `json:"id"`
+	Scheduling   *gceScheduling
+}
+
+type gceScheduling struct {
+	Preemptible       string // "TRUE" or "FALSE"
+	ProvisioningModel string // "STANDARD" or "SPOT"
 }
 
 type gceProject struct {
@@ -277,15 +366,29 @@ func (g gceMeta) toGeneratorMeta() map[string]string {
 		return ss[len(ss)-1]
 	}
 
+	// the fields may be missing if the access to the metadata is restricted
+	set := func(key, value string) {
+		if value != "" {
+			meta[key] = value
+		}
+	}
+
 	if ins := g.Instance; ins != nil {
-		meta["hostname"] = ins.Hostname
-		meta["instance-id"] = fmt.Sprint(ins.InstanceID)
-		meta["instance-type"] = lastS(ins.InstanceType)
-		meta["zone"] = lastS(ins.Zone)
+		set("hostname", ins.Hostname)
+		if ins.InstanceID != 0 {
+			meta["instance-id"] = fmt.Sprint(ins.InstanceID)
+		}
+		set("instance-type", lastS(ins.InstanceType))
+		set("zone", lastS(ins.Zone))
+		if sch := ins.Scheduling; sch != nil {
+			spot := strings.EqualFold(sch.ProvisioningModel, "SPOT")
+			meta["preemptible"] = fmt.Sprint(strings.EqualFold(sch.Preemptible, "TRUE") || spot)
+			set("provisioningModel", sch.ProvisioningModel)
+		}
 	}
 
 	if proj := g.Project; proj != nil {
-		meta["projectId"] = proj.ProjectID
+		set("projectId", proj.ProjectID)
 	}
 
 	return meta
@@ -305,87 +408,99 @@ type AzureVMGenerator struct {
 	baseURL *url.URL
 }
 
-// Generate collects metadata from cloud platform.
-func (g *AzureVMGenerator) Generate() (interface{}, error) {
-	metadataComputeKeys := map[string]string{
-		"location":  "location",
-		"offer":     "imageReferenceOffer",
-		"osType":    "osSystemType",
-		"publisher": "imageReferencePublisher",
-		"sku":       "imageReferenceSku",
-		"vmId":      "vmID",
-		"vmSize":    "virtualMachineSizeType",
-	}
+// azureAPIVersion is the version of the Azure Instance Metadata Service API.
+// ref. https://docs.microsoft.com/azure/virtual-machines/windows/instance-metadata-service
+const azureAPIVersion = "2021-02-01"
 
-	ipAddressKeys := map[string]string{
-		"privateIpAddress": "privateIpAddress",
-		"publicIpAddress":  "publicIpAddress",
-	}
+type azureVMIPAddress struct {
+	PrivateIPAddress string `json:"privateIpAddress"`
+	PublicIPAddress  string `json:"publicIpAddress"`
+}
 
-	metadata := make(map[string]string)
-	metadata = retrieveAzureVMMetadata(metadata, g.baseURL.String(), "/compute/", metadataComputeKeys)
-	metadata = retrieveAzureVMMetadata(metadata, g.baseURL.String(), "/network/interface/0/ipv4/ipAddress/0/", ipAddressKeys)
+type azureVMMeta struct {
+	Compute struct {
+		Location          string `json:"location"`
+		Offer             string `json:"offer"`
+		OSType            string `json:"osType"`
+		Publisher         string `json:"publisher"`
+		ResourceGroupName string `json:"resourceGroupName"`
+		SKU               string `json:"sku"`
+		VMID              string `json:"vmId"`
+		VMSize            string `json:"vmSize"`
+	} `json:"compute"`
+	Network struct {
+		Interface []struct {
+			IPv4 struct {
+				IPAddress []azureVMIPAddress `json:"ipAddress"`
+			} `json:"ipv4"`
+		} `json:"interface"`
+	} `json:"network"`
+}
 
-	return &mackerel.Cloud{Provider: "AzureVM", MetaData: metadata}, nil
+// toGeneratorMeta converts the metadata to the keys which have been used by the agent.
+func (m azureVMMeta) toGeneratorMeta() map[string]string {
+	meta := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			meta[key] = value
+		}
+	}
+	set("location", m.Compute.Location)
+	set("imageReferenceOffer", m.Compute.Offer)
+	set("osSystemType", m.Compute.OSType)
+	set("imageReferencePublisher", m.Compute.Publisher)
+	set("resourceGroupName", m.Compute.ResourceGroupName)
+	set("imageReferenceSku", m.Compute.SKU)
+	set("vmID", m.Compute.VMID)
+	set("virtualMachineSizeType", m.Compute.VMSize)
+	if ifs := m.Network.Interface; len(ifs) > 0 && len(ifs[0].IPv4.IPAddress) > 0 {
+		set("privateIpAddress", ifs[0].IPv4.IPAddress[0].PrivateIPAddress)
+		set("publicIpAddress", ifs[0].IPv4.IPAddress[0].PublicIPAddress)
+	}
+	return meta
 }
 
-func retrieveAzureVMMetadata(metadataMap map[string]string, baseURL string, urlSuffix string, keys map[string]string) map[string]string {
+func requestAzureVMMeta(ctx context.Context, baseURL *url.URL, path, format string) ([]byte, error) {
 	cl := httpCli()
+	req, err := http.NewRequest("GET", baseURL.String()+path+"?api-version="+azureAPIVersion+"&format="+format, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
 
-	for key, value := range keys {
-		req, err := http.NewRequest("GET", baseURL+urlSuffix+key+"?api-version=2017-04-02&format=text", nil)
-		if err != nil {
-			cloudLogger.Debugf("This host may not be running on Azure VM. Error while reading '%s'", key)
-			return metadataMap
-		}
-
-		req.Header.Set("Metadata", "true")
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-		resp, err := cl.Do(req)
-		if err != nil {
-			cloudLogger.Debugf("This host may not be running on Azure VM. Error while reading '%s'", key)
-			return metadataMap
-		}
-		defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request azure vm meta. response code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
 
-		if resp.StatusCode == 200 {
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				cloudLogger.Errorf("Results of requesting metadata cannot be read: '%s'", err)
-				break
-			}
-			metadataMap[value] = string(body)
-			cloudLogger.Debugf("results %s:%s", key, string(body))
-		} else {
-			cloudLogger.Debugf("Status code of the result of requesting metadata '%s' is '%d'", key, resp.StatusCode)
-		}
+// Generate collects metadata from cloud platform.
+func (g *AzureVMGenerator) Generate() (interface{}, error) {
+	bytes, err := requestAzureVMMeta(context.Background(), g.baseURL, "", "json")
+	if err != nil {
+		cloudLogger.Debugf("This host may not be running on Azure VM. Error while reading the metadata: %s", err)
+		return nil, nil
+	}
+	var data azureVMMeta
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse the metadata of Azure VM: %s", err)
 	}
-	return metadataMap
+	return &mackerel.Cloud{Provider: "AzureVM", MetaData: data.toGeneratorMeta()}, nil
 }
 
 // SuggestCustomIdentifier suggests the identifier of the Azure VM instance
 func (g *AzureVMGenerator) SuggestCustomIdentifier() (string, error) {
 	identifier := ""
 	err := retry.Retry(3, 2*time.Second, func() error {
-		cl := httpCli()
-		req, err := http.NewRequest("GET", azureVMBaseURL.String()+"/compute/vmId?api-version=2017-04-02&format=text", nil)
-		if err != nil {
-			return fmt.Errorf("error while retrieving vmId")
-		}
-		req.Header.Set("Metadata", "true")
-
-		resp, err := cl.Do(req)
-		if err != nil {
-			return fmt.Errorf("error while retrieving vmId")
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("failed to request vmId. response code: %d", resp.StatusCode)
-		}
-		body, err := ioutil.ReadAll(resp.Body)
+		body, err := requestAzureVMMeta(context.Background(), g.baseURL, "/compute/vmId", "text")
 		if err != nil {
-			return fmt.Errorf("results of requesting vmId cannot be read: '%s'", err)
+			return fmt.Errorf("error while retrieving vmId: %s", err)
 		}
 		instanceID := string(body)
 		if instanceID == "" {
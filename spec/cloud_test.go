@@ -28,7 +28,7 @@ func TestCloudGenerate(t *testing.T) {
 	if err != nil {
 		t.Errorf("should not raise error: %s", err)
 	}
-	g := &CloudGenerator{&EC2Generator{u}}
+	g := &CloudGenerator{&EC2Generator{baseURL: u}}
 
 	value, err := g.Generate()
 	if err != nil {
@@ -79,7 +79,7 @@ func TestEC2SuggestCustomIdentifier(t *testing.T) {
 	if err != nil {
 		t.Errorf("should not raise error: %s", err)
 	}
-	g := &CloudGenerator{&EC2Generator{u}}
+	g := &CloudGenerator{&EC2Generator{baseURL: u}}
 
 	// 404, 404, 404 => give up
 	{
@@ -158,7 +158,9 @@ func TestGCEGenerate(t *testing.T) {
 		],
 		"scheduling": {
 		  "automaticRestart": "TRUE",
-		  "onHostMaintenance": "MIGRATE"
+		  "onHostMaintenance": "MIGRATE",
+		  "preemptible": "FALSE",
+		  "provisioningModel": "STANDARD"
 		},
 		"serviceAccounts": {
 		  "1234567890123-compute@developer.gserviceaccount.com": {
@@ -207,6 +209,7 @@ func TestGCEGenerate(t *testing.T) {
 		InstanceType: "projects/1234567890123/machineTypes/g1-small",
 		Hostname:     "gce-1.c.dummyproj-987.internal",
 		InstanceID:   4567890123456789123,
+		Scheduling:   &gceScheduling{Preemptible: "FALSE", ProvisioningModel: "STANDARD"},
 	}) {
 		t.Errorf("data.Instance should be assigned")
 	}
@@ -219,15 +222,104 @@ func TestGCEGenerate(t *testing.T) {
 	}
 
 	if d := data.toGeneratorMeta(); !reflect.DeepEqual(d, map[string]string{
-		"zone":          "asia-east1-a",
-		"instance-type": "g1-small",
-		"hostname":      "gce-1.c.dummyproj-987.internal",
-		"instance-id":   "4567890123456789123",
-		"projectId":     "dummyprof-987",
+		"zone":              "asia-east1-a",
+		"instance-type":     "g1-small",
+		"hostname":          "gce-1.c.dummyproj-987.internal",
+		"instance-id":       "4567890123456789123",
+		"projectId":         "dummyprof-987",
+		"preemptible":       "false",
+		"provisioningModel": "STANDARD",
 	}) {
 		t.Errorf("data.Project should be assigned")
 	}
 
+	// spot instance with the restricted metadata
+	var spot gceMeta
+	json.Unmarshal([]byte(`{
+	  "instance": {
+		"machineType": "projects/1234567890123/machineTypes/e2-medium",
+		"scheduling": {"preemptible": "TRUE", "provisioningModel": "SPOT"},
+		"zone": "projects/1234567890123/zones/asia-northeast1-b"
+	  }
+	}`), &spot)
+	if d := spot.toGeneratorMeta(); !reflect.DeepEqual(d, map[string]string{
+		"zone":              "asia-northeast1-b",
+		"instance-type":     "e2-medium",
+		"preemptible":       "true",
+		"provisioningModel": "SPOT",
+	}) {
+		t.Errorf("missing fields should be omitted: %v", d)
+	}
+
+}
+
+func TestAzureVMGenerate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata") != "true" || req.URL.Query().Get("api-version") != azureAPIVersion {
+			http.Error(res, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch req.URL.Path {
+		case "/compute/vmId":
+			fmt.Fprint(res, "02aab8a4-74ef-476e-8182-f6d2ba4166a6")
+		case "/":
+			fmt.Fprint(res, `{
+  "compute": {
+    "location": "japaneast",
+    "offer": "UbuntuServer",
+    "osType": "Linux",
+    "publisher": "Canonical",
+    "resourceGroupName": "macikgo-test-may-23",
+    "sku": "18.04-LTS",
+    "vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+    "vmSize": "Standard_A3"
+  },
+  "network": {
+    "interface": [{
+      "ipv4": {
+        "ipAddress": [{"privateIpAddress": "10.144.0.4", "publicIpAddress": "203.0.113.10"}]
+      }
+    }]
+  }
+}`)
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	g := &AzureVMGenerator{baseURL: u}
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := &mackerel.Cloud{
+		Provider: "AzureVM",
+		MetaData: map[string]string{
+			"location":                "japaneast",
+			"imageReferenceOffer":     "UbuntuServer",
+			"osSystemType":            "Linux",
+			"imageReferencePublisher": "Canonical",
+			"resourceGroupName":       "macikgo-test-may-23",
+			"imageReferenceSku":       "18.04-LTS",
+			"vmID":                    "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+			"virtualMachineSizeType":  "Standard_A3",
+			"privateIpAddress":        "10.144.0.4",
+			"publicIpAddress":         "203.0.113.10",
+		},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("value should be %+v but got %+v", expected, value)
+	}
+
+	customIdentifier, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if customIdentifier != "02aab8a4-74ef-476e-8182-f6d2ba4166a6.virtual_machine.azure.microsoft.com" {
+		t.Errorf("unexpected custom identifier: %s", customIdentifier)
+	}
 }
 
 func TestSuggestCloudGenerator(t *testing.T) {
@@ -407,3 +499,82 @@ func TestSuggestCloudGenerator_CloudPlatformSpecified(t *testing.T) {
 		}
 	}
 }
+
+func TestSuggestCloudGenerator_MetadataEndpoint(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("X-Tenant") != "tenant-1" {
+			http.Error(res, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/latest/meta-data/instance-id":
+			fmt.Fprint(res, "i-0001")
+		case "/latest/meta-data/local-ipv4":
+			fmt.Fprint(res, "10.0.0.2")
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer ts.Close()
+
+	conf := config.Config{
+		// detection should be skipped even if the platform is specified
+		CloudPlatform: config.CloudPlatformGCE,
+		Cloud: config.Cloud{
+			MetadataEndpoint: ts.URL,
+			Provider:         config.CloudProviderEC2Compatible,
+			Headers:          map[string]string{"X-Tenant": "tenant-1"},
+		},
+	}
+	cGen := SuggestCloudGenerator(&conf)
+	if cGen == nil {
+		t.Fatal("cGen should not be nil.")
+	}
+	if _, ok := cGen.CloudMetaGenerator.(*EC2Generator); !ok {
+		t.Fatal("cGen should be *EC2Generator")
+	}
+	if requests != 0 {
+		t.Errorf("the metadata endpoint should not be probed, but requested %d times", requests)
+	}
+
+	value, err := cGen.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	cloud, ok := value.(*mackerel.Cloud)
+	if !ok {
+		t.Fatalf("value should be *mackerel.Cloud but got %#v", value)
+	}
+	expected := map[string]string{"instance-id": "i-0001", "local-ipv4": "10.0.0.2"}
+	if !reflect.DeepEqual(cloud.MetaData, expected) {
+		t.Errorf("metadata should be %v but got %v", expected, cloud.MetaData)
+	}
+
+	identifier, err := cGen.SuggestCustomIdentifier()
+	if err != nil || identifier != "" {
+		t.Errorf("custom identifier should not be suggested but got %q, %v", identifier, err)
+	}
+}
+
+func TestEC2Generate_UnreachableMetadataEndpoint(t *testing.T) {
+	interval := customMetadataRetryInterval
+	customMetadataRetryInterval = 10 * time.Millisecond
+	defer func() { customMetadataRetryInterval = interval }()
+
+	g, err := newCustomEC2Generator(config.Cloud{
+		MetadataEndpoint: "http://unreachable.localhost",
+		Timeout:          &config.Duration{Duration: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := g.Generate()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if value != nil {
+		t.Errorf("value should be nil but got %#v", value)
+	}
+}
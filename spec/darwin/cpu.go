@@ -9,7 +9,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
@@ -17,7 +17,7 @@ import (
 type CPUGenerator struct {
 }
 
-var cpuLogger = logging.GetLogger("spec.cpu")
+var cpuLogger = logformat.GetLogger("spec.cpu")
 
 type cpuSpec map[string]interface{}
 
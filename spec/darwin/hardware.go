@@ -0,0 +1,54 @@
+// +build darwin
+
+package darwin
+
+import (
+	"os/exec"
+	"regexp"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+// HardwareGenerator collects the hardware information from the I/O Registry.
+type HardwareGenerator struct {
+}
+
+var hardwareLogger = logformat.GetLogger("spec.hardware")
+
+// ex.) "IOPlatformSerialNumber" = "C02XXXXXXXXX"
+// ex.) "manufacturer" = <"Apple Inc.">
+var ioregPropertyReg = regexp.MustCompile(`^\s*"([\w-]+)" = <?"([^"]*)">?`)
+
+// The keys of spec.Hardware and the properties of IOPlatformExpertDevice.
+var ioregProperties = map[string]string{
+	"IOPlatformSerialNumber": "system_serial_number",
+	"manufacturer":           "system_vendor",
+	"model":                  "product_name",
+	"board-id":               "board_name",
+}
+
+// Generate collects the hardware information from `ioreg` command.
+func (g *HardwareGenerator) Generate() (interface{}, error) {
+	out, err := exec.Command("/usr/sbin/ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		hardwareLogger.Errorf("Failed to run ioreg (skip this spec): %s", err)
+		return nil, err
+	}
+	return parseIoreg(string(out)), nil
+}
+
+func parseIoreg(out string) spec.Hardware {
+	results := make(spec.Hardware)
+	for _, line := range regexp.MustCompile("\r?\n").Split(out, -1) {
+		matches := ioregPropertyReg.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		if key, ok := ioregProperties[matches[1]]; ok && matches[2] != "" {
+			results[key] = matches[2]
+		}
+	}
+	return results
+}
@@ -0,0 +1,32 @@
+// +build darwin
+
+package darwin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+func TestParseIoreg(t *testing.T) {
+	out := `+-o MacBookPro15,1  <class IOPlatformExpertDevice, id 0x100000110, registered, matched, active, busy 0 (145 ms), retain 35>
+    {
+      "IOPolledInterface" = "AppleARMWatchdogTimerHibernateHandler is not serializable"
+      "manufacturer" = <"Apple Inc.">
+      "IOPlatformSerialNumber" = "C02XXXXXXXXX"
+      "board-id" = <"Mac-937A206F2EE63C01">
+      "model" = <"MacBookPro15,1">
+      "IOPlatformUUID" = "00000000-0000-0000-0000-000000000000"
+    }
+`
+	expected := spec.Hardware{
+		"system_serial_number": "C02XXXXXXXXX",
+		"system_vendor":        "Apple Inc.",
+		"product_name":         "MacBookPro15,1",
+		"board_name":           "Mac-937A206F2EE63C01",
+	}
+	if got := parseIoreg(out); !reflect.DeepEqual(got, expected) {
+		t.Errorf("parseIoreg() = %v; want %v", got, expected)
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"os/exec"
 	"regexp"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/spec"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
@@ -17,7 +17,7 @@ import (
 type InterfaceGenerator struct {
 }
 
-var interfaceLogger = logging.GetLogger("spec.interface")
+var interfaceLogger = logformat.GetLogger("spec.interface")
 
 // Generate XXX
 func (g *InterfaceGenerator) Generate() ([]mkr.Interface, error) {
@@ -6,15 +6,17 @@ import (
 	"os/exec"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 // KernelGenerator Generates specs about the kernel.
 type KernelGenerator struct {
 }
 
-var kernelLogger = logging.GetLogger("spec.kernel")
+var kernelLogger = logformat.GetLogger("spec.kernel")
 
 // Generate collects specs from `uname` command and `sw_vers` command
 func (g *KernelGenerator) Generate() (interface{}, error) {
@@ -44,6 +46,32 @@ func (g *KernelGenerator) Generate() (interface{}, error) {
 	}
 
 	results["name"] = results["os"]
+	results[spec.KernelArchitecture] = spec.NormalizeArchitecture(results["machine"])
+	if results["platform_name"] != "" {
+		results[spec.KernelPrettyName] = strings.TrimSpace(results["platform_name"] + " " + results["platform_version"])
+	}
+	results[spec.KernelVirtualization] = virtualization(sysctl("kern.hv_vmm_present"), sysctl("hw.model"))
 
 	return results, nil
 }
+
+func sysctl(name string) string {
+	out, err := exec.Command("/usr/sbin/sysctl", "-n", name).Output()
+	if err != nil {
+		kernelLogger.Debugf("Failed to run sysctl %s: %s", name, err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// virtualization detects the hypervisor by kern.hv_vmm_present, which is 1
+// on the virtual machines, and hw.model such as "VMware7,1".
+func virtualization(vmmPresent, model string) string {
+	if v := spec.VirtualizationByVendor("", model); v != "" {
+		return v
+	}
+	if vmmPresent == "1" {
+		return spec.VirtualizationOther
+	}
+	return spec.VirtualizationNone
+}
@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 func TestKernelGenerator_Generate(t *testing.T) {
@@ -36,3 +38,20 @@ func TestKernelGenerator_Generate(t *testing.T) {
 		t.Errorf("'platform_name' must exit: %v", kernel)
 	}
 }
+
+func TestVirtualization(t *testing.T) {
+	tests := []struct {
+		vmmPresent, model string
+		expect            string
+	}{
+		{"0", "MacBookPro18,3", spec.VirtualizationNone},
+		{"1", "VMware7,1", spec.VirtualizationVMware},
+		{"1", "VirtualMac2,1", spec.VirtualizationOther},
+		{"", "Macmini9,1", spec.VirtualizationNone},
+	}
+	for _, tt := range tests {
+		if got := virtualization(tt.vmmPresent, tt.model); got != tt.expect {
+			t.Errorf("virtualization(%q, %q) should be %q but got %q", tt.vmmPresent, tt.model, tt.expect, got)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package spec
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The session tokens of IMDSv2 are requested with the TTL of ec2TokenTTL and
+// refreshed ec2TokenRefreshMargin before the expiry. If the token endpoint is
+// not available, IMDSv1 is used without tokens for ec2FallbackInterval.
+// ref. https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/configuring-instance-metadata-service.html
+const (
+	ec2TokenTTL           = 6 * time.Hour
+	ec2TokenRefreshMargin = 1 * time.Minute
+	ec2FallbackInterval   = 10 * time.Minute
+
+	// The token request should fail fast, since the response of the PUT request
+	// does not reach the containers when the hop limit is 1.
+	ec2TokenTimeout = 1 * time.Second
+)
+
+// ec2MetadataClient requests to the instance metadata service of EC2.
+type ec2MetadataClient struct {
+	baseURL *url.URL
+	// warnTimeout is whether to log the timeout of the token request as warnings.
+	// It is false while detecting the platform to keep quiet on non-EC2 hosts.
+	warnTimeout bool
+	// timeout and headers are used for the metadata services compatible with EC2
+	timeout time.Duration
+	headers map[string]string
+
+	mu    sync.Mutex
+	token string
+	// expiresAt is the expiry of the token, or of the fallback to IMDSv1 if token is empty
+	expiresAt time.Time
+}
+
+type ec2TokenError struct {
+	StatusCode int
+}
+
+func (e *ec2TokenError) Error() string {
+	return fmt.Sprintf("failed to request the IMDSv2 token. response code: %d", e.StatusCode)
+}
+
+func (c *ec2MetadataClient) tokenURL() string {
+	return c.baseURL.ResolveReference(&url.URL{Path: "api/token"}).String()
+}
+
+// getToken returns the cached token, or requests a new one if it is expired.
+// It returns an empty token to fall back to IMDSv1 unless the token endpoint returns 403,
+// which means the instance metadata service is disabled.
+func (c *ec2MetadataClient) getToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.expiresAt) {
+		return c.token, nil
+	}
+	token, err := c.requestToken(ctx)
+	if err != nil {
+		if e, ok := err.(*ec2TokenError); ok && e.StatusCode == http.StatusForbidden {
+			return "", err
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() && c.warnTimeout {
+			cloudLogger.Warningf("The IMDSv2 token request timed out, falling back to IMDSv1. If the agent is running in a container, the hop limit of the instance metadata (HttpPutResponseHopLimit) may need to be increased")
+		} else {
+			cloudLogger.Debugf("Falling back to IMDSv1: %s", err)
+		}
+		c.token, c.expiresAt = "", now.Add(ec2FallbackInterval)
+		return "", nil
+	}
+	c.token, c.expiresAt = token, now.Add(ec2TokenTTL-ec2TokenRefreshMargin)
+	return token, nil
+}
+
+func (c *ec2MetadataClient) requestToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("PUT", c.tokenURL(), nil)
+	if err != nil {
+		return "", err
+	}
+	c.setHeaders(req)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(ec2TokenTTL/time.Second)))
+
+	cl := httpCli()
+	cl.Timeout = ec2TokenTimeout
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &ec2TokenError{StatusCode: resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// get requests the metadata of the key with the token.
+// The caller should close the body of the response.
+func (c *ec2MetadataClient) get(ctx context.Context, key string) (*http.Response, error) {
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", c.baseURL.String()+"/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req)
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	cl := httpCli()
+	if c.timeout > 0 {
+		cl.Timeout = c.timeout
+	}
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the token is invalid or IMDSv2 has been required since the fallback, so request it next time
+		c.mu.Lock()
+		c.expiresAt = time.Time{}
+		c.mu.Unlock()
+	}
+	return resp, nil
+}
+
+func (c *ec2MetadataClient) setHeaders(req *http.Request) {
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+}
@@ -0,0 +1,87 @@
+package spec
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestEC2MetadataClient_TokenURL(t *testing.T) {
+	u, _ := url.Parse("http://169.254.169.254/latest/meta-data")
+	c := &ec2MetadataClient{baseURL: u}
+	if expected := "http://169.254.169.254/latest/api/token"; c.tokenURL() != expected {
+		t.Errorf("token URL should be %s but got %s", expected, c.tokenURL())
+	}
+}
+
+func TestEC2MetadataClient_Get(t *testing.T) {
+	const token = "AQAEAFTNrA4eEGx0AQgJ1arIq_Cc-t4tWt3fB0Hd8RKhXlKc5ccvhg=="
+	tests := []struct {
+		name        string
+		tokenStatus int
+		imdsv1      bool
+		status      int
+		err         bool
+	}{
+		{name: "IMDSv2", tokenStatus: http.StatusOK, status: http.StatusOK},
+		{name: "IMDSv1 only", tokenStatus: http.StatusNotFound, imdsv1: true, status: http.StatusOK},
+		{name: "IMDSv2 required but token unavailable", tokenStatus: http.StatusServiceUnavailable, status: http.StatusUnauthorized},
+		{name: "disabled", tokenStatus: http.StatusForbidden, err: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokenRequests int
+			ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/api/token" {
+					tokenRequests++
+					if req.Method != "PUT" || req.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") != "21600" {
+						http.Error(res, "bad request", http.StatusBadRequest)
+						return
+					}
+					if tc.tokenStatus != http.StatusOK {
+						http.Error(res, "error", tc.tokenStatus)
+						return
+					}
+					fmt.Fprint(res, token)
+					return
+				}
+				if got := req.Header.Get("X-aws-ec2-metadata-token"); got != token && !tc.imdsv1 {
+					http.Error(res, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(res, "i-4f90d537")
+			}))
+			defer ts.Close()
+			u, _ := url.Parse(ts.URL)
+			c := &ec2MetadataClient{baseURL: u}
+
+			for i := 0; i < 2; i++ {
+				resp, err := c.get(context.Background(), "instance-id")
+				if err != nil {
+					if !tc.err {
+						t.Errorf("should not raise error: %s", err)
+					}
+					return
+				}
+				if tc.err {
+					t.Fatal("should raise error")
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != tc.status {
+					t.Errorf("status should be %d but got %d: %s", tc.status, resp.StatusCode, body)
+				}
+				if resp.StatusCode == http.StatusOK && string(body) != "i-4f90d537" {
+					t.Errorf("unexpected body: %s", body)
+				}
+			}
+			if tc.status == http.StatusOK && tokenRequests != 1 {
+				t.Errorf("the result of the token request should be cached, but requested %d times", tokenRequests)
+			}
+		})
+	}
+}
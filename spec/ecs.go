@@ -0,0 +1,164 @@
+package spec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// ECS: https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-metadata-endpoint-v4.html
+const ecsMetadataURIEnv = "ECS_CONTAINER_METADATA_URI_V4"
+
+// ecsTimeout is shorter than timeout since the endpoint is local to the task.
+var ecsTimeout = 1 * time.Second
+
+// ECSGenerator meta generator for ECS and Fargate tasks
+type ECSGenerator struct {
+	// metadataURI is the value of ECS_CONTAINER_METADATA_URI_V4, which returns the metadata of the container.
+	metadataURI string
+	// useService is whether to suggest the identifier of the service as the custom identifier.
+	useService bool
+}
+
+type ecsLimits struct {
+	CPU    float64 `json:"CPU"`
+	Memory int64   `json:"Memory"`
+}
+
+type ecsTaskMeta struct {
+	Cluster          string     `json:"Cluster"`
+	TaskARN          string     `json:"TaskARN"`
+	Family           string     `json:"Family"`
+	ServiceName      string     `json:"ServiceName"`
+	Revision         string     `json:"Revision"`
+	LaunchType       string     `json:"LaunchType"`
+	AvailabilityZone string     `json:"AvailabilityZone"`
+	Limits           *ecsLimits `json:"Limits"`
+}
+
+type ecsContainerMeta struct {
+	Name   string     `json:"Name"`
+	Limits *ecsLimits `json:"Limits"`
+}
+
+func newECSGenerator(useService bool) *ECSGenerator {
+	uri := os.Getenv(ecsMetadataURIEnv)
+	if uri == "" {
+		return nil
+	}
+	return &ECSGenerator{metadataURI: uri, useService: useService}
+}
+
+func isECS(ctx context.Context, g *ECSGenerator) bool {
+	if g == nil {
+		return false
+	}
+	var task ecsTaskMeta
+	if err := g.request(ctx, "/task", &task); err != nil {
+		cloudLogger.Debugf("%s is set, but failed to request the task metadata: %s", ecsMetadataURIEnv, err)
+		return false
+	}
+	return task.TaskARN != ""
+}
+
+func (g *ECSGenerator) request(ctx context.Context, path string, v interface{}) error {
+	cl := httpCli()
+	cl.Timeout = ecsTimeout
+	req, err := http.NewRequest("GET", g.metadataURI+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cl.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to request ecs task metadata. response code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Generate collects metadata from cloud platform.
+func (g *ECSGenerator) Generate() (interface{}, error) {
+	var task ecsTaskMeta
+	if err := g.request(context.Background(), "/task", &task); err != nil {
+		return nil, err
+	}
+	meta := task.toGeneratorMeta()
+
+	// the limits of the container are optional
+	var container ecsContainerMeta
+	if err := g.request(context.Background(), "", &container); err != nil {
+		cloudLogger.Debugf("Failed to request the container metadata: %s", err)
+	} else {
+		if container.Name != "" {
+			meta["container-name"] = container.Name
+		}
+		setECSLimits(meta, "container", container.Limits)
+	}
+	return &mackerel.Cloud{Provider: "ecs", MetaData: meta}, nil
+}
+
+func (task ecsTaskMeta) toGeneratorMeta() map[string]string {
+	meta := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			meta[key] = value
+		}
+	}
+	set("cluster", task.Cluster)
+	set("task-arn", task.TaskARN)
+	set("family", task.Family)
+	set("revision", task.Revision)
+	set("launch-type", task.LaunchType)
+	set("availability-zone", task.AvailabilityZone)
+	setECSLimits(meta, "task", task.Limits)
+	return meta
+}
+
+func setECSLimits(meta map[string]string, prefix string, limits *ecsLimits) {
+	if limits == nil {
+		return
+	}
+	if limits.CPU > 0 {
+		meta[prefix+"-cpu-limit"] = fmt.Sprint(limits.CPU)
+	}
+	if limits.Memory > 0 {
+		meta[prefix+"-memory-limit"] = fmt.Sprint(limits.Memory)
+	}
+}
+
+// SuggestCustomIdentifier suggests the cluster and the service of the task if it
+// is enabled by the configuration, or the family of the task not run by a service,
+// so that the task replacing the last one is identified as the same host even
+// though the id file of the host is not persisted. The task ARN is not used since
+// it changes on the replacement. The tasks of the same service are identified
+// as the same host, so it is for the services running a single task.
+func (g *ECSGenerator) SuggestCustomIdentifier() (string, error) {
+	if !g.useService {
+		return "", nil
+	}
+	var task ecsTaskMeta
+	if err := g.request(context.Background(), "/task", &task); err != nil {
+		return "", err
+	}
+	name := task.ServiceName
+	if name == "" {
+		name = task.Family
+	}
+	if task.Cluster == "" || name == "" {
+		return "", fmt.Errorf("invalid task metadata")
+	}
+	return task.Cluster + "/" + name, nil
+}
@@ -0,0 +1,105 @@
+package spec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+const ecsTaskMetaJSON = `{
+  "Cluster": "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+  "TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+  "Family": "curltest",
+  "ServiceName": "curltest-service",
+  "Revision": "26",
+  "DesiredStatus": "RUNNING",
+  "KnownStatus": "RUNNING",
+  "Limits": {"CPU": 0.25, "Memory": 512},
+  "AvailabilityZone": "us-west-2d",
+  "LaunchType": "FARGATE"
+}`
+
+const ecsContainerMetaJSON = `{
+  "DockerId": "cd189a933e5849daa93386466019ab50-2495160603",
+  "Name": "mackerel-agent",
+  "Limits": {"CPU": 128, "Memory": 256}
+}`
+
+func newECSMetadataServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v4/task":
+			fmt.Fprint(res, ecsTaskMetaJSON)
+		case "/v4":
+			fmt.Fprint(res, ecsContainerMetaJSON)
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+}
+
+func TestECSGenerate(t *testing.T) {
+	ts := newECSMetadataServer()
+	defer ts.Close()
+	g := &ECSGenerator{metadataURI: ts.URL + "/v4"}
+
+	value, err := g.Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := &mackerel.Cloud{
+		Provider: "ecs",
+		MetaData: map[string]string{
+			"cluster":                "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+			"task-arn":               "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+			"family":                 "curltest",
+			"revision":               "26",
+			"launch-type":            "FARGATE",
+			"availability-zone":      "us-west-2d",
+			"task-cpu-limit":         "0.25",
+			"task-memory-limit":      "512",
+			"container-name":         "mackerel-agent",
+			"container-cpu-limit":    "128",
+			"container-memory-limit": "256",
+		},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("value should be %+v but got %+v", expected, value)
+	}
+
+	if id, err := g.SuggestCustomIdentifier(); err != nil || id != "" {
+		t.Errorf("custom identifier should not be suggested by default: %q, %v", id, err)
+	}
+	g.useService = true
+	id, err := g.SuggestCustomIdentifier()
+	if err != nil {
+		t.Errorf("should not raise error: %s", err)
+	}
+	if id != "arn:aws:ecs:us-west-2:111122223333:cluster/default/curltest-service" {
+		t.Errorf("unexpected custom identifier: %s", id)
+	}
+}
+
+func TestSuggestCloudGenerator_ECS(t *testing.T) {
+	ts := newECSMetadataServer()
+	defer ts.Close()
+	os.Setenv(ecsMetadataURIEnv, ts.URL+"/v4")
+	defer os.Unsetenv(ecsMetadataURIEnv)
+
+	for _, platform := range []config.CloudPlatform{config.CloudPlatformAuto, config.CloudPlatformECS} {
+		cGen := SuggestCloudGenerator(&config.Config{CloudPlatform: platform})
+		if cGen == nil {
+			t.Fatalf("cGen should not be nil (cloud_platform = %s)", platform)
+		}
+		if _, ok := cGen.CloudMetaGenerator.(*ECSGenerator); !ok {
+			t.Errorf("cGen should be *ECSGenerator (cloud_platform = %s)", platform)
+		}
+	}
+}
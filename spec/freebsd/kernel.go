@@ -3,11 +3,14 @@
 package freebsd
 
 import (
+	"io/ioutil"
 	"os/exec"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 // KernelGenerator Generates specs about the kernel.
@@ -20,7 +23,7 @@ import (
 type KernelGenerator struct {
 }
 
-var kernelLogger = logging.GetLogger("spec.kernel")
+var kernelLogger = logformat.GetLogger("spec.kernel")
 
 // Generate XXX
 func (g *KernelGenerator) Generate() (interface{}, error) {
@@ -44,6 +47,45 @@ func (g *KernelGenerator) Generate() (interface{}, error) {
 	}
 
 	results["name"] = results["os"]
+	results[spec.KernelArchitecture] = spec.NormalizeArchitecture(results["machine"])
+	results[spec.KernelPrettyName] = prettyName(results["os"], results["release"])
+
+	out, err := exec.Command("/sbin/sysctl", "-n", "kern.vm_guest").Output()
+	if err != nil {
+		kernelLogger.Debugf("Failed to run sysctl kern.vm_guest: %s", err)
+	} else {
+		results[spec.KernelVirtualization] = virtualization(strings.TrimSpace(string(out)))
+	}
 
 	return results, nil
 }
+
+// osReleaseFile is os-release(5), which exists since FreeBSD 13.
+var osReleaseFile = "/etc/os-release"
+
+func prettyName(name, release string) string {
+	if data, err := ioutil.ReadFile(osReleaseFile); err == nil {
+		if name := spec.ParseOSRelease(data)["PRETTY_NAME"]; name != "" {
+			return name
+		}
+	}
+	return strings.TrimSpace(name + " " + release)
+}
+
+// virtualization converts kern.vm_guest to the hypervisor.
+func virtualization(vmGuest string) string {
+	switch vmGuest {
+	case "none":
+		return spec.VirtualizationNone
+	case "kvm":
+		return spec.VirtualizationKVM
+	case "xen":
+		return spec.VirtualizationXen
+	case "hv":
+		return spec.VirtualizationHyperV
+	case "vmware":
+		return spec.VirtualizationVMware
+	}
+	// such as bhyve and generic
+	return spec.VirtualizationOther
+}
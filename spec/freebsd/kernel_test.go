@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 func TestKernelGenerator_Generate(t *testing.T) {
@@ -31,3 +33,34 @@ func TestKernelGenerator_Generate(t *testing.T) {
 		t.Errorf("'release' must exit: %v", kernel)
 	}
 }
+
+func TestPrettyName(t *testing.T) {
+	orig := osReleaseFile
+	defer func() { osReleaseFile = orig }()
+
+	osReleaseFile = "../testdata/os-release-ubuntu"
+	if name := prettyName("FreeBSD", "13.2-RELEASE"); name != "Ubuntu 22.04.3 LTS" {
+		t.Errorf("the pretty name should be read from os-release but got %q", name)
+	}
+	osReleaseFile = "/path/to/not/exist"
+	if name := prettyName("FreeBSD", "12.4-RELEASE"); name != "FreeBSD 12.4-RELEASE" {
+		t.Errorf("the pretty name should be made of uname without os-release but got %q", name)
+	}
+}
+
+func TestVirtualization(t *testing.T) {
+	tests := map[string]string{
+		"none":    spec.VirtualizationNone,
+		"kvm":     spec.VirtualizationKVM,
+		"xen":     spec.VirtualizationXen,
+		"hv":      spec.VirtualizationHyperV,
+		"vmware":  spec.VirtualizationVMware,
+		"bhyve":   spec.VirtualizationOther,
+		"generic": spec.VirtualizationOther,
+	}
+	for vmGuest, expect := range tests {
+		if got := virtualization(vmGuest); got != expect {
+			t.Errorf("virtualization(%q) should be %q but got %q", vmGuest, expect, got)
+		}
+	}
+}
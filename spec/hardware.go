@@ -0,0 +1,6 @@
+package spec
+
+// Hardware represents the vendors, the product names and the serial numbers
+// of the system, the board and the chassis, for asset tracking.
+// The values which cannot be read are omitted.
+type Hardware map[string]string
@@ -4,7 +4,6 @@ package spec
 
 import (
 	"context"
-	"net/http"
 	"time"
 
 	"github.com/Songmu/retry"
@@ -13,14 +12,10 @@ import (
 // For instances other than Linux, retry only 1 times to shorten whole process
 func isEC2(ctx context.Context) bool {
 	isEC2 := false
+	cl := &ec2MetadataClient{baseURL: ec2BaseURL}
 	err := retry.WithContext(ctx, 2, 2*time.Second, func() error {
-		cl := httpCli()
 		// '/ami-id` is probably an AWS specific URL
-		req, err := http.NewRequest("GET", ec2BaseURL.String()+"/ami-id", nil)
-		if err != nil {
-			return err
-		}
-		resp, err := cl.Do(req.WithContext(ctx))
+		resp, err := cl.get(ctx, "ami-id")
 		if err != nil {
 			return err
 		}
@@ -7,37 +7,54 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Songmu/retry"
 )
 
-// If the OS is Linux, check /sys/hypervisor/uuid and /sys/devices/virtual/dmi/id/product_uuid files first. If UUID seems to be EC2-ish, call the metadata API (up to 3 times).
-// ref. https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/identify_ec2_instances.html
-func isEC2(ctx context.Context) bool {
-	var uuidFiles = []string{
+// ec2DMIFiles are the files to detect EC2 instances without requesting the metadata API.
+type ec2DMIFiles struct {
+	// uuidFiles contain the UUIDs starting with "ec2" on EC2 instances.
+	uuidFiles []string
+	// vendorFiles contain "Amazon EC2" on the instances built on the Nitro System.
+	vendorFiles []string
+	// assetTagFile contains the instance ID on the instances built on the Nitro System.
+	assetTagFile string
+}
+
+var defaultEC2DMIFiles = ec2DMIFiles{
+	uuidFiles: []string{
 		"/sys/hypervisor/uuid",
-		"/sys/devices/virtual/dmi/id/product_uuid",
-	}
+		"/sys/devices/virtual/dmi/id/product_uuid", // readable only by root
+	},
+	vendorFiles: []string{
+		"/sys/devices/virtual/dmi/id/sys_vendor",
+		"/sys/devices/virtual/dmi/id/bios_vendor",
+	},
+	assetTagFile: "/sys/devices/virtual/dmi/id/board_asset_tag",
+}
+
+// ec2ProbeTimeout is the timeout of probing the token endpoint when DMI is inconclusive.
+// It is short to avoid delaying the start up on the other platforms.
+var ec2ProbeTimeout = 300 * time.Millisecond
 
-	return isEC2WithSpecifiedUUIDFiles(ctx, uuidFiles)
+// If the OS is Linux, check the UUID and the vendor in /sys first. If they seem to be EC2-ish, call the metadata API (up to 3 times).
+// If none of them are readable, for example on some ARM instances or without root, probe the token endpoint of the metadata API before that.
+// ref. https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/identify_ec2_instances.html
+func isEC2(ctx context.Context) bool {
+	return isEC2WithSpecifiedDMIFiles(ctx, defaultEC2DMIFiles)
 }
 
-func isEC2WithSpecifiedUUIDFiles(ctx context.Context, uuidFiles []string) bool {
-	looksLikeEC2 := false
-	for _, u := range uuidFiles {
-		data, err := ioutil.ReadFile(u)
-		if err != nil {
-			continue
+func isEC2WithSpecifiedDMIFiles(ctx context.Context, files ec2DMIFiles) bool {
+	looksLikeEC2, conclusive := lookupEC2DMI(files)
+	if !conclusive {
+		cloudLogger.Debugf("EC2 detection: DMI is not readable, probing the token endpoint of the metadata API")
+		if !probeEC2TokenEndpoint(ctx) {
+			return false
 		}
-		if isEC2UUID(string(data)) {
-			looksLikeEC2 = true
-			break
-		}
-	}
-	if !looksLikeEC2 {
+	} else if !looksLikeEC2 {
+		cloudLogger.Debugf("EC2 detection: DMI does not look like EC2")
 		return false
 	}
 
@@ -49,14 +66,10 @@ func isEC2WithSpecifiedUUIDFiles(ctx context.Context, uuidFiles []string) bool {
 	}
 
 	res := false
-	cl := httpCli()
+	cl := &ec2MetadataClient{baseURL: ec2BaseURL}
 	err := retry.WithContext(ctx, 3, 2*time.Second, func() error {
 		// '/ami-id` is probably an AWS specific URL
-		req, err := http.NewRequest("GET", ec2BaseURL.String()+"/ami-id", nil)
-		if err != nil {
-			return nil // something wrong. give up
-		}
-		resp, err := cl.Do(req.WithContext(ctx))
+		resp, err := cl.get(ctx, "ami-id")
 		if err != nil {
 			return err
 		}
@@ -67,12 +80,63 @@ func isEC2WithSpecifiedUUIDFiles(ctx context.Context, uuidFiles []string) bool {
 	})
 
 	if err == nil {
+		cloudLogger.Debugf("EC2 detection: ami-id is available: %t", res)
 		return res
 	}
 
+	cloudLogger.Debugf("EC2 detection: failed to request ami-id: %s", err)
 	return false
 }
 
+// lookupEC2DMI returns whether the DMI looks like EC2, and whether any of the files are readable.
+func lookupEC2DMI(files ec2DMIFiles) (looksLikeEC2 bool, conclusive bool) {
+	for _, f := range files.uuidFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			cloudLogger.Debugf("EC2 detection: %s is not readable: %s", f, err)
+			continue
+		}
+		conclusive = true
+		if isEC2UUID(strings.TrimSpace(string(data))) {
+			cloudLogger.Debugf("EC2 detection: %s looks like EC2", f)
+			return true, true
+		}
+	}
+	for _, f := range files.vendorFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			cloudLogger.Debugf("EC2 detection: %s is not readable: %s", f, err)
+			continue
+		}
+		conclusive = true
+		if strings.TrimSpace(string(data)) == "Amazon EC2" {
+			cloudLogger.Debugf("EC2 detection: %s looks like EC2", f)
+			return true, true
+		}
+	}
+	if files.assetTagFile != "" {
+		data, err := ioutil.ReadFile(files.assetTagFile)
+		if err != nil {
+			cloudLogger.Debugf("EC2 detection: %s is not readable: %s", files.assetTagFile, err)
+		} else if strings.HasPrefix(strings.TrimSpace(string(data)), "i-") {
+			cloudLogger.Debugf("EC2 detection: %s looks like EC2", files.assetTagFile)
+			return true, true
+		}
+	}
+	return false, conclusive
+}
+
+func probeEC2TokenEndpoint(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, ec2ProbeTimeout)
+	defer cancel()
+	cl := &ec2MetadataClient{baseURL: ec2BaseURL}
+	if _, err := cl.requestToken(ctx); err != nil {
+		cloudLogger.Debugf("EC2 detection: failed to request the token: %s", err)
+		return false
+	}
+	return true
+}
+
 func isEC2UUID(uuid string) bool {
 	conds := func(uuid string) bool {
 		if strings.HasPrefix(uuid, "ec2") || strings.HasPrefix(uuid, "EC2") {
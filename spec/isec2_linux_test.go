@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -70,12 +71,13 @@ func TestIsEC2(t *testing.T) {
 			expect:      true,
 		},
 		{
+			// the token endpoint is probed if no files are readable
 			existsUUIDFiles: [2]bool{
 				false,
 				false,
 			},
 			existsAMIId: true,
-			expect:      false,
+			expect:      true,
 		},
 		{
 			existsUUIDFiles: [2]bool{
@@ -121,9 +123,79 @@ func TestIsEC2(t *testing.T) {
 				tf.Close()
 			}
 
-			if isEC2WithSpecifiedUUIDFiles(context.Background(), uuidFiles) != tc.expect {
+			if isEC2WithSpecifiedDMIFiles(context.Background(), ec2DMIFiles{uuidFiles: uuidFiles}) != tc.expect {
 				t.Errorf("isEC2() should be %v: %#v", tc.expect, tc)
 			}
 		}()
 	}
 }
+
+func TestIsEC2_DMI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-dmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) string {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	notExist := filepath.Join(dir, "not_exist")
+
+	tests := []struct {
+		name        string
+		files       ec2DMIFiles
+		tokenStatus int
+		expect      bool
+	}{
+		{
+			name:        "Nitro",
+			files:       ec2DMIFiles{uuidFiles: []string{notExist}, vendorFiles: []string{writeFile("sys_vendor", "Amazon EC2\n")}},
+			tokenStatus: http.StatusOK,
+			expect:      true,
+		},
+		{
+			name:        "asset tag",
+			files:       ec2DMIFiles{uuidFiles: []string{notExist}, assetTagFile: writeFile("board_asset_tag", "i-0123456789abcdef0\n")},
+			tokenStatus: http.StatusOK,
+			expect:      true,
+		},
+		{
+			name:        "other vendor",
+			files:       ec2DMIFiles{uuidFiles: []string{notExist}, vendorFiles: []string{writeFile("bios_vendor", "Google\n")}},
+			tokenStatus: http.StatusOK,
+			expect:      false,
+		},
+		{
+			name:        "inconclusive and token unavailable",
+			files:       ec2DMIFiles{uuidFiles: []string{notExist}, vendorFiles: []string{notExist}, assetTagFile: notExist},
+			tokenStatus: http.StatusNotFound,
+			expect:      false,
+		},
+		{
+			name:        "inconclusive and token available",
+			files:       ec2DMIFiles{uuidFiles: []string{notExist}, vendorFiles: []string{notExist}, assetTagFile: notExist},
+			tokenStatus: http.StatusOK,
+			expect:      true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if req.Method == "PUT" {
+					res.WriteHeader(tc.tokenStatus)
+				}
+			}))
+			defer ts.Close()
+			u, _ := url.Parse(ts.URL)
+			defer setEc2BaseURL(u)()
+
+			if got := isEC2WithSpecifiedDMIFiles(context.Background(), tc.files); got != tc.expect {
+				t.Errorf("isEC2() should be %v but got %v", tc.expect, got)
+			}
+		})
+	}
+}
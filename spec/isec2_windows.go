@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"net/http"
 	"strings"
 	"time"
 
@@ -61,14 +60,10 @@ func isEC2WithSpecifiedWmiRecords(ctx context.Context, records []Win32ComputerSy
 	}
 
 	res := false
-	cl := httpCli()
+	cl := &ec2MetadataClient{baseURL: ec2BaseURL}
 	err := retry.WithContext(ctx, 3, 2*time.Second, func() error {
 		// '/ami-id` is probably an AWS specific URL
-		req, err := http.NewRequest("GET", ec2BaseURL.String()+"/ami-id", nil)
-		if err != nil {
-			return nil // something wrong. give up
-		}
-		resp, err := cl.Do(req.WithContext(ctx))
+		resp, err := cl.get(ctx, "ami-id")
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,150 @@
+package spec
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+// Kubernetes represents the node and the pod on which the agent is running.
+type Kubernetes map[string]string
+
+// The default names of the environment variables set by the Downward API.
+// ref. https://kubernetes.io/docs/tasks/inject-data-application/environment-variable-expose-pod-information/
+const (
+	defaultNodeNameEnv     = "NODE_NAME"
+	defaultPodNameEnv      = "POD_NAME"
+	defaultPodNamespaceEnv = "POD_NAMESPACE"
+)
+
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesGenerator collects the names of the node and the pod from the environment
+// variables. If they are not set, it requests the pod to the API server of the
+// cluster with the service account token as a fallback.
+type KubernetesGenerator struct {
+	NodeNameEnv     string
+	PodNameEnv      string
+	PodNamespaceEnv string
+}
+
+// NewKubernetesGenerator creates a KubernetesGenerator with the names of the environment variables.
+func NewKubernetesGenerator(conf config.Kubernetes) *KubernetesGenerator {
+	g := &KubernetesGenerator{
+		NodeNameEnv:     conf.NodeNameEnv,
+		PodNameEnv:      conf.PodNameEnv,
+		PodNamespaceEnv: conf.PodNamespaceEnv,
+	}
+	if g.NodeNameEnv == "" {
+		g.NodeNameEnv = defaultNodeNameEnv
+	}
+	if g.PodNameEnv == "" {
+		g.PodNameEnv = defaultPodNameEnv
+	}
+	if g.PodNamespaceEnv == "" {
+		g.PodNamespaceEnv = defaultPodNamespaceEnv
+	}
+	return g
+}
+
+// Generate collects the names of the node and the pod.
+// It returns nil if the agent is not running on Kubernetes.
+func (g *KubernetesGenerator) Generate() (interface{}, error) {
+	meta := make(Kubernetes)
+	set := func(key, value string) {
+		if value != "" {
+			meta[key] = value
+		}
+	}
+	set("node_name", os.Getenv(g.NodeNameEnv))
+	set("pod_name", os.Getenv(g.PodNameEnv))
+	set("pod_namespace", os.Getenv(g.PodNamespaceEnv))
+	if len(meta) > 0 {
+		return meta, nil
+	}
+
+	pod, err := requestKubernetesPod()
+	if err != nil {
+		return nil, err
+	}
+	if pod == nil {
+		return nil, nil
+	}
+	set("node_name", pod.Spec.NodeName)
+	set("pod_name", pod.Metadata.Name)
+	set("pod_namespace", pod.Metadata.Namespace)
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+type kubernetesPod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+// requestKubernetesPod requests the pod of the agent, whose name is the hostname,
+// to the API server. It returns nil if the agent is not running in a pod.
+func requestKubernetesPod() (*kubernetesPod, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, nil
+	}
+	token, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/token")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	namespace, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if ca, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt"); err == nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+	cl := httpCli()
+	cl.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+
+	u := fmt.Sprintf("https://%s/api/v1/namespaces/%s/pods/%s", net.JoinHostPort(host, port), strings.TrimSpace(string(namespace)), name)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to request the pod %s. response code: %d", name, resp.StatusCode)
+	}
+	var pod kubernetesPod
+	if err := json.NewDecoder(resp.Body).Decode(&pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
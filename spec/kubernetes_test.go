@@ -0,0 +1,144 @@
+package spec
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/config"
+)
+
+func setenvs(envs map[string]string) func() {
+	for k, v := range envs {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range envs {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestKubernetesGenerate(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     config.Kubernetes
+		envs     map[string]string
+		expected interface{}
+	}{
+		{
+			name:     "not on Kubernetes",
+			expected: nil,
+		},
+		{
+			name:     "DaemonSet",
+			envs:     map[string]string{"NODE_NAME": "node-1"},
+			expected: Kubernetes{"node_name": "node-1"},
+		},
+		{
+			name:     "sidecar",
+			envs:     map[string]string{"POD_NAME": "app-5d8f7c9b6-x2x7q", "POD_NAMESPACE": "default"},
+			expected: Kubernetes{"pod_name": "app-5d8f7c9b6-x2x7q", "pod_namespace": "default"},
+		},
+		{
+			name:     "configured names",
+			conf:     config.Kubernetes{NodeNameEnv: "MY_NODE_NAME"},
+			envs:     map[string]string{"MY_NODE_NAME": "node-1", "NODE_NAME": "node-2"},
+			expected: Kubernetes{"node_name": "node-1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setenvs(tc.envs)()
+			value, err := NewKubernetesGenerator(tc.conf).Generate()
+			if err != nil {
+				t.Fatalf("should not raise error: %s", err)
+			}
+			if !reflect.DeepEqual(value, tc.expected) {
+				t.Errorf("value should be %#v but got %#v", tc.expected, value)
+			}
+		})
+	}
+}
+
+func TestKubernetesGenerate_APIServer(t *testing.T) {
+	hostname, _ := os.Hostname()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer dummy-token" {
+			http.Error(res, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/api/v1/namespaces/monitoring/pods/"+hostname {
+			http.NotFound(res, req)
+			return
+		}
+		fmt.Fprintf(res, `{"metadata": {"name": %q, "namespace": "monitoring"}, "spec": {"nodeName": "node-1"}}`, hostname)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mackerel-agent-serviceaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	for name, content := range map[string][]byte{
+		"token":     []byte("dummy-token\n"),
+		"namespace": []byte("monitoring"),
+		"ca.crt":    ca,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	origDir := kubernetesServiceAccountDir
+	kubernetesServiceAccountDir = dir
+	defer func() { kubernetesServiceAccountDir = origDir }()
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	defer setenvs(map[string]string{"KUBERNETES_SERVICE_HOST": host, "KUBERNETES_SERVICE_PORT": port})()
+
+	value, err := NewKubernetesGenerator(config.Kubernetes{}).Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := Kubernetes{"node_name": "node-1", "pod_name": hostname, "pod_namespace": "monitoring"}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("value should be %#v but got %#v", expected, value)
+	}
+}
+
+func TestHostMetaJSON(t *testing.T) {
+	meta := HostMeta{
+		HostMeta:   mackerel.HostMeta{AgentVersion: "0.0.0"},
+		Kubernetes: Kubernetes{"node_name": "node-1"},
+	}
+	b, _ := json.Marshal(meta)
+	var got map[string]interface{}
+	json.Unmarshal(b, &got)
+	if got["agent-version"] != "0.0.0" {
+		t.Errorf("the fields of mackerel.HostMeta should be embedded: %s", b)
+	}
+	if !reflect.DeepEqual(got["kubernetes"], map[string]interface{}{"node_name": "node-1"}) {
+		t.Errorf("kubernetes should be contained: %s", b)
+	}
+
+	b, _ = json.Marshal(HostMeta{})
+	var empty map[string]interface{}
+	json.Unmarshal(b, &empty)
+	if _, ok := empty["kubernetes"]; ok {
+		t.Errorf("kubernetes should be omitted if empty: %s", b)
+	}
+}
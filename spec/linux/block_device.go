@@ -8,7 +8,7 @@ import (
 	"path"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
@@ -16,7 +16,7 @@ import (
 type BlockDeviceGenerator struct {
 }
 
-var blockDeviceLogger = logging.GetLogger("spec.block_device")
+var blockDeviceLogger = logformat.GetLogger("spec.block_device")
 
 // Generate generate metric values
 func (g *BlockDeviceGenerator) Generate() (interface{}, error) {
@@ -8,7 +8,7 @@ import (
 	"os"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
@@ -16,7 +16,7 @@ import (
 type CPUGenerator struct {
 }
 
-var cpuLogger = logging.GetLogger("spec.cpu")
+var cpuLogger = logformat.GetLogger("spec.cpu")
 
 func (g *CPUGenerator) generate(file io.Reader) (interface{}, error) {
 	scanner := bufio.NewScanner(file)
@@ -0,0 +1,52 @@
+// +build linux
+
+package linux
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+// HardwareGenerator collects the hardware information from DMI.
+type HardwareGenerator struct {
+}
+
+var hardwareLogger = logformat.GetLogger("spec.hardware")
+
+var dmiDir = "/sys/class/dmi/id"
+
+// The keys of spec.Hardware and the files in dmiDir.
+// The serial numbers are readable only by root.
+var dmiFiles = map[string]string{
+	"system_vendor":         "sys_vendor",
+	"product_name":          "product_name",
+	"system_serial_number":  "product_serial",
+	"board_vendor":          "board_vendor",
+	"board_name":            "board_name",
+	"board_serial_number":   "board_serial",
+	"chassis_serial_number": "chassis_serial",
+	"bios_vendor":           "bios_vendor",
+	"bios_version":          "bios_version",
+}
+
+// Generate reads the files in /sys/class/dmi/id. The files which cannot be
+// read, for example on the virtual machines which hide DMI, are skipped.
+func (g *HardwareGenerator) Generate() (interface{}, error) {
+	results := make(spec.Hardware)
+	for key, file := range dmiFiles {
+		data, err := ioutil.ReadFile(filepath.Join(dmiDir, file))
+		if err != nil {
+			hardwareLogger.Debugf("Failed to read %s (skip this field): %s", file, err)
+			continue
+		}
+		if value := strings.TrimSpace(string(data)); value != "" {
+			results[key] = value
+		}
+	}
+	return results, nil
+}
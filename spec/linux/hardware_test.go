@@ -0,0 +1,55 @@
+// +build linux
+
+package linux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+func TestHardwareGenerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-dmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, content := range map[string]string{
+		"sys_vendor":   "Dell Inc.\n",
+		"product_name": "PowerEdge R640\n",
+		"board_vendor": "\n",
+		"bios_version": "2.10.2\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the serial numbers are not readable without the permission
+	if err := ioutil.WriteFile(filepath.Join(dir, "product_serial"), []byte("ABC1234\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	origDir := dmiDir
+	dmiDir = dir
+	defer func() { dmiDir = origDir }()
+
+	value, err := (&HardwareGenerator{}).Generate()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := spec.Hardware{
+		"system_vendor": "Dell Inc.",
+		"product_name":  "PowerEdge R640",
+		"bios_version":  "2.10.2",
+	}
+	if os.Geteuid() == 0 {
+		expected["system_serial_number"] = "ABC1234"
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("value should be %v but got %v", expected, value)
+	}
+}
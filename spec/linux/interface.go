@@ -7,7 +7,7 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/spec"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
@@ -16,7 +16,7 @@ import (
 type InterfaceGenerator struct {
 }
 
-var interfaceLogger = logging.GetLogger("spec.interface")
+var interfaceLogger = logformat.GetLogger("spec.interface")
 
 // Generate XXX
 func (g *InterfaceGenerator) Generate() ([]mkr.Interface, error) {
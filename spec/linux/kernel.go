@@ -3,19 +3,23 @@
 package linux
 
 import (
+	"io/ioutil"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 	"github.com/shirou/gopsutil/host"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 // KernelGenerator XXX
 type KernelGenerator struct {
 }
 
-var kernelLogger = logging.GetLogger("spec.kernel")
+var kernelLogger = logformat.GetLogger("spec.kernel")
 
 // Generate XXX
 func (g *KernelGenerator) Generate() (interface{}, error) {
@@ -44,6 +48,12 @@ func (g *KernelGenerator) Generate() (interface{}, error) {
 		results["os"] = results["name"]
 	}
 
+	results[spec.KernelArchitecture] = spec.NormalizeArchitecture(results["machine"])
+	results[spec.KernelVirtualization] = detectVirtualization()
+	if name := readPrettyName(); name != "" {
+		results[spec.KernelPrettyName] = name
+	}
+
 	platform, _, version, err := host.PlatformInformation()
 	if err != nil {
 		kernelLogger.Errorf("Failed to get platform information: %s", err)
@@ -115,3 +125,58 @@ func normalizePlatform(platform string) string {
 
 	return normalized
 }
+
+// The files to detect the platform, which are replaced in the tests.
+var (
+	osReleaseFiles     = []string{"/etc/os-release", "/usr/lib/os-release"}
+	hypervisorTypeFile = "/sys/hypervisor/type"
+	cpuinfoFile        = "/proc/cpuinfo"
+)
+
+// readPrettyName reads PRETTY_NAME of os-release, which is read every time
+// to reflect the upgrades of the OS.
+func readPrettyName() string {
+	for _, file := range osReleaseFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		return spec.ParseOSRelease(data)["PRETTY_NAME"]
+	}
+	return ""
+}
+
+// detectVirtualization detects the hypervisor by DMI, or by the hypervisor
+// interface of Xen for the paravirtualized guests without DMI. The others
+// are detected only by the hypervisor flag of the CPUs.
+func detectVirtualization() string {
+	read := func(file string) string {
+		data, _ := ioutil.ReadFile(file)
+		return strings.TrimSpace(string(data))
+	}
+	if v := spec.VirtualizationByVendor(read(filepath.Join(dmiDir, "sys_vendor")), read(filepath.Join(dmiDir, "product_name"))); v != "" {
+		return v
+	}
+	if read(hypervisorTypeFile) == "xen" {
+		return spec.VirtualizationXen
+	}
+	if hasHypervisorFlag(read(cpuinfoFile)) {
+		return spec.VirtualizationOther
+	}
+	return spec.VirtualizationNone
+}
+
+func hasHypervisorFlag(cpuinfo string) bool {
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "flags" {
+			for _, flag := range strings.Fields(kv[1]) {
+				if flag == "hypervisor" {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
@@ -3,9 +3,14 @@
 package linux
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 func TestKernelGenerate(t *testing.T) {
@@ -32,5 +37,60 @@ func TestKernelGenerate(t *testing.T) {
 		t.Error("kernel.platform_version should be filled")
 	}
 
+	if len(kernel["architecture"]) == 0 || len(kernel["virtualization"]) == 0 {
+		t.Error("kernel.architecture and kernel.virtualization should be filled")
+	}
+
 	t.Logf("kernel spec: %+v", kernel)
 }
+
+func TestReadPrettyName(t *testing.T) {
+	orig := osReleaseFiles
+	defer func() { osReleaseFiles = orig }()
+
+	osReleaseFiles = []string{"/path/to/not/exist", "../testdata/os-release-ubuntu"}
+	if name := readPrettyName(); name != "Ubuntu 22.04.3 LTS" {
+		t.Errorf("the pretty name should be read from the existing file but got %q", name)
+	}
+	osReleaseFiles = []string{"/path/to/not/exist"}
+	if name := readPrettyName(); name != "" {
+		t.Errorf("the pretty name should be empty without os-release but got %q", name)
+	}
+}
+
+func TestDetectVirtualization(t *testing.T) {
+	origDMIDir, origHypervisorTypeFile, origCPUInfoFile := dmiDir, hypervisorTypeFile, cpuinfoFile
+	defer func() {
+		dmiDir, hypervisorTypeFile, cpuinfoFile = origDMIDir, origHypervisorTypeFile, origCPUInfoFile
+	}()
+
+	tests := []struct {
+		name   string
+		files  map[string]string
+		expect string
+	}{
+		{"kvm", map[string]string{"sys_vendor": "QEMU\n", "product_name": "Standard PC (Q35 + ICH9, 2009)\n"}, spec.VirtualizationKVM},
+		{"hyperv", map[string]string{"sys_vendor": "Microsoft Corporation\n", "product_name": "Virtual Machine\n"}, spec.VirtualizationHyperV},
+		{"xen pv", map[string]string{"hypervisor_type": "xen\n"}, spec.VirtualizationXen},
+		{"unknown", map[string]string{"sys_vendor": "Dell Inc.\n", "cpuinfo": "processor\t: 0\nflags\t\t: fpu vme de hypervisor lahf_lm\n"}, spec.VirtualizationOther},
+		{"physical", map[string]string{"sys_vendor": "Dell Inc.\n", "cpuinfo": "processor\t: 0\nflags\t\t: fpu vme de lahf_lm\n"}, spec.VirtualizationNone},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "mackerel-agent-virt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for file, content := range tt.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dmiDir = dir
+		hypervisorTypeFile = filepath.Join(dir, "hypervisor_type")
+		cpuinfoFile = filepath.Join(dir, "cpuinfo")
+		if got := detectVirtualization(); got != tt.expect {
+			t.Errorf("%s: the virtualization should be %q but got %q", tt.name, tt.expect, got)
+		}
+	}
+}
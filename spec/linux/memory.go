@@ -8,7 +8,7 @@ import (
 	"os"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
@@ -47,7 +47,7 @@ var memItems = map[string]string{
 type MemoryGenerator struct {
 }
 
-var memoryLogger = logging.GetLogger("spec.memory")
+var memoryLogger = logformat.GetLogger("spec.memory")
 
 // Generate XXX
 func (g *MemoryGenerator) Generate() (interface{}, error) {
@@ -4,12 +4,14 @@ import (
 	"net"
 
 	mkr "github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/config"
 )
 
 // IsLoopback returns true if iface contains only loopback addresses.
 // Is it possible that a interface contains mixed IPs both loopback address and else?
 func IsLoopback(iface mkr.Interface) bool {
-	// IPAddress field is defined by client library, but not used in agent.
+	// IPAddress field is set from the others by FilterInterfaces.
 	n4 := len(iface.IPv4Addresses)
 	n6 := len(iface.IPv6Addresses)
 	if n4+n6 == 0 {
@@ -63,6 +65,57 @@ func (ifs Interfaces) AppendIPv6Address(name, addr string) {
 	ifs[name] = iface
 }
 
+// FilterInterfaces removes the interfaces whose names match the ignore pattern
+// and the link-local IPv6 addresses unless they are configured to be included.
+// It also sets the primary address of each interface to IPAddress, so that the
+// hosts which have only IPv6 addresses are registered with their addresses.
+func FilterInterfaces(ifaces []mkr.Interface, conf config.Interfaces) []mkr.Interface {
+	var results []mkr.Interface
+	for _, iface := range ifaces {
+		if conf.Ignore.Regexp != nil && conf.Ignore.MatchString(iface.Name) {
+			continue
+		}
+		if !conf.IncludeLinkLocal {
+			iface.IPv6Addresses = excludeLinkLocal(iface.IPv6Addresses)
+		}
+		if len(iface.IPv4Addresses) == 0 && len(iface.IPv6Addresses) == 0 {
+			continue
+		}
+		iface.IPAddress = primaryIPAddress(iface)
+		results = append(results, iface)
+	}
+	return results
+}
+
+func excludeLinkLocal(addrs []string) []string {
+	var results []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		results = append(results, addr)
+	}
+	return results
+}
+
+// primaryIPAddress prefers a global IPv4 address, and falls back to a global IPv6 address.
+func primaryIPAddress(iface mkr.Interface) string {
+	for _, addrs := range [][]string{iface.IPv4Addresses, iface.IPv6Addresses} {
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.IsGlobalUnicast() {
+				return addr
+			}
+		}
+	}
+	if len(iface.IPv4Addresses) > 0 {
+		return iface.IPv4Addresses[0]
+	}
+	if len(iface.IPv6Addresses) > 0 {
+		return iface.IPv6Addresses[0]
+	}
+	return ""
+}
+
 // InterfaceGenerator retrieve network informations
 type InterfaceGenerator interface {
 	Generate() ([]mkr.Interface, error)
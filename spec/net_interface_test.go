@@ -1,9 +1,13 @@
 package spec
 
 import (
+	"reflect"
+	"regexp"
 	"testing"
 
 	mkr "github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/config"
 )
 
 func TestIsLoopback(t *testing.T) {
@@ -94,3 +98,81 @@ func TestIsLoopback(t *testing.T) {
 		}
 	})
 }
+
+func TestFilterInterfaces(t *testing.T) {
+	ifaces := []mkr.Interface{
+		{
+			Name:          "eth0",
+			IPv4Addresses: []string{"10.0.4.7"},
+			IPv6Addresses: []string{"fe80::44b3:b3ff:fe1c:d17c", "2001:db8::7"},
+		},
+		{
+			Name:          "eth1",
+			IPv6Addresses: []string{"fe80::1", "2001:db8:1::1"},
+		},
+		{
+			Name:          "docker0",
+			IPv4Addresses: []string{"172.17.0.1"},
+			IPv6Addresses: []string{"2001:db8:2::1"},
+		},
+		{
+			Name:          "veth1234",
+			IPv6Addresses: []string{"fe80::2"},
+		},
+	}
+	tests := []struct {
+		name     string
+		conf     config.Interfaces
+		expected []mkr.Interface
+	}{
+		{
+			name: "default",
+			expected: []mkr.Interface{
+				{
+					Name:          "eth0",
+					IPAddress:     "10.0.4.7",
+					IPv4Addresses: []string{"10.0.4.7"},
+					IPv6Addresses: []string{"2001:db8::7"},
+				},
+				{
+					Name:          "eth1",
+					IPAddress:     "2001:db8:1::1",
+					IPv6Addresses: []string{"2001:db8:1::1"},
+				},
+				{
+					Name:          "docker0",
+					IPAddress:     "172.17.0.1",
+					IPv4Addresses: []string{"172.17.0.1"},
+					IPv6Addresses: []string{"2001:db8:2::1"},
+				},
+			},
+		},
+		{
+			name: "ignore and include link-local",
+			conf: config.Interfaces{
+				Ignore:           config.Regexpwrapper{Regexp: regexp.MustCompile(`^(docker|eth0)`)},
+				IncludeLinkLocal: true,
+			},
+			expected: []mkr.Interface{
+				{
+					Name:          "eth1",
+					IPAddress:     "2001:db8:1::1",
+					IPv6Addresses: []string{"fe80::1", "2001:db8:1::1"},
+				},
+				{
+					Name:          "veth1234",
+					IPAddress:     "fe80::2",
+					IPv6Addresses: []string{"fe80::2"},
+				},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FilterInterfaces(ifaces, tc.conf)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("FilterInterfaces() = %+v; want %+v", got, tc.expected)
+			}
+		})
+	}
+}
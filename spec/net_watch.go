@@ -0,0 +1,61 @@
+package spec
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// addressPollingInterval is the interval of polling the addresses
+// on the platforms which cannot subscribe the changes of them.
+var addressPollingInterval = 1 * time.Minute
+
+// notifyAddressChange sends to the channel without blocking, since the receiver
+// only needs to know whether the addresses have changed since the last receive.
+func notifyAddressChange(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func listAddresses() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	ss := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ss[i] = addr.String()
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, ","), nil
+}
+
+// pollAddressChanges polls the addresses of the interfaces and notifies
+// to the channel when they are changed, until ctx is done.
+func pollAddressChanges(ctx context.Context, ch chan<- struct{}) {
+	prev, err := listAddresses()
+	if err != nil {
+		logger.Warningf("Failed to list the addresses of the interfaces: %s", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(addressPollingInterval):
+		}
+		addrs, err := listAddresses()
+		if err != nil {
+			logger.Warningf("Failed to list the addresses of the interfaces: %s", err)
+			continue
+		}
+		if addrs != prev {
+			logger.Debugf("The addresses of the interfaces have changed")
+			prev = addrs
+			notifyAddressChange(ch)
+		}
+	}
+}
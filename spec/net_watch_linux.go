@@ -0,0 +1,91 @@
+package spec
+
+import (
+	"context"
+	"syscall"
+	"time"
+)
+
+// The multicast groups of netlink, which are not defined in syscall.
+// ref. linux/rtnetlink.h
+const (
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// WatchAddressChanges returns the channel which receives when the addresses of
+// the interfaces have changed. It subscribes RTM_NEWADDR and RTM_DELADDR
+// messages of netlink, and falls back to polling if netlink is not available.
+func WatchAddressChanges(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	fd, err := subscribeAddressChanges()
+	if err != nil {
+		logger.Warningf("Failed to subscribe the changes of the addresses, polling them instead: %s", err)
+		go pollAddressChanges(ctx, ch)
+		return ch
+	}
+	go func() {
+		defer syscall.Close(fd)
+		receiveAddressChanges(ctx, fd, ch)
+	}()
+	return ch
+}
+
+func subscribeAddressChanges() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	// wake up periodically to exit when ctx is done
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func receiveAddressChanges(ctx context.Context, fd int, ch chan<- struct{}) {
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			// ENOBUFS means some messages have been dropped, so they should be changed anyway
+			if err == syscall.ENOBUFS {
+				notifyAddressChange(ch)
+				continue
+			}
+			logger.Warningf("Failed to receive the changes of the addresses, polling them instead: %s", err)
+			pollAddressChanges(ctx, ch)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			logger.Debugf("Failed to parse the netlink message: %s", err)
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type == syscall.RTM_NEWADDR || msg.Header.Type == syscall.RTM_DELADDR {
+				logger.Debugf("The addresses of the interfaces have changed")
+				notifyAddressChange(ch)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// +build !linux,!windows
+
+package spec
+
+import "context"
+
+// WatchAddressChanges returns the channel which receives when the addresses of
+// the interfaces have changed. The addresses are polled on this platform.
+func WatchAddressChanges(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go pollAddressChanges(ctx, ch)
+	return ch
+}
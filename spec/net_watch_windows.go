@@ -0,0 +1,70 @@
+package spec
+
+import (
+	"context"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi                      = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyUnicastIPAddressChange = modiphlpapi.NewProc("NotifyUnicastIpAddressChange")
+	procCancelMibChangeNotify2       = modiphlpapi.NewProc("CancelMibChangeNotify2")
+)
+
+var (
+	addressChangeMu sync.Mutex
+	// the channels to notify from the callback, which cannot be a closure
+	addressChangeChs = make(map[uintptr]chan<- struct{})
+	addressChangeID  uintptr
+
+	addressChangeCallback = windows.NewCallback(func(callerContext, row, notificationType uintptr) uintptr {
+		addressChangeMu.Lock()
+		ch, ok := addressChangeChs[callerContext]
+		addressChangeMu.Unlock()
+		if ok {
+			notifyAddressChange(ch)
+		}
+		return 0
+	})
+)
+
+// WatchAddressChanges returns the channel which receives when the addresses of
+// the interfaces have changed. It registers the callback with
+// NotifyUnicastIpAddressChange, which notifies the changes of the addresses
+// unlike NotifyIpInterfaceChange, and falls back to polling if it fails.
+func WatchAddressChanges(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	addressChangeMu.Lock()
+	addressChangeID++
+	id := addressChangeID
+	addressChangeChs[id] = ch
+	addressChangeMu.Unlock()
+
+	var handle windows.Handle
+	r, _, _ := procNotifyUnicastIPAddressChange.Call(
+		uintptr(windows.AF_UNSPEC),
+		addressChangeCallback,
+		id,
+		0, // InitialNotification = FALSE
+		uintptr(unsafe.Pointer(&handle)))
+	if r != 0 {
+		addressChangeMu.Lock()
+		delete(addressChangeChs, id)
+		addressChangeMu.Unlock()
+		logger.Warningf("Failed to subscribe the changes of the addresses, polling them instead: %s", windows.Errno(r))
+		go pollAddressChanges(ctx, ch)
+		return ch
+	}
+	go func() {
+		<-ctx.Done()
+		procCancelMibChangeNotify2.Call(uintptr(handle))
+		addressChangeMu.Lock()
+		delete(addressChangeChs, id)
+		addressChangeMu.Unlock()
+	}()
+	return ch
+}
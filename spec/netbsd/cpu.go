@@ -5,7 +5,7 @@ package netbsd
 import (
 	"os/exec"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
@@ -13,7 +13,7 @@ import (
 type CPUGenerator struct {
 }
 
-var cpuLogger = logging.GetLogger("spec.cpu")
+var cpuLogger = logformat.GetLogger("spec.cpu")
 
 type cpuSpec map[string]interface{}
 
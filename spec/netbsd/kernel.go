@@ -6,8 +6,10 @@ import (
 	"os/exec"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
+
+	"github.com/mackerelio/mackerel-agent/spec"
 )
 
 // KernelGenerator Generates specs about the kernel.
@@ -20,7 +22,7 @@ import (
 type KernelGenerator struct {
 }
 
-var kernelLogger = logging.GetLogger("spec.kernel")
+var kernelLogger = logformat.GetLogger("spec.kernel")
 
 // Generate XXX
 func (g *KernelGenerator) Generate() (interface{}, error) {
@@ -44,6 +46,8 @@ func (g *KernelGenerator) Generate() (interface{}, error) {
 	}
 
 	results["name"] = results["os"]
+	results[spec.KernelArchitecture] = spec.NormalizeArchitecture(results["machine"])
+	results[spec.KernelPrettyName] = strings.TrimSpace(results["os"] + " " + results["release"])
 
 	return results, nil
 }
@@ -8,7 +8,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
@@ -16,7 +16,7 @@ import (
 type MemoryGenerator struct {
 }
 
-var memoryLogger = logging.GetLogger("spec.memory")
+var memoryLogger = logformat.GetLogger("spec.memory")
 
 const bytesInKibibytes = 1024
 
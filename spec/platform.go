@@ -0,0 +1,99 @@
+package spec
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// The keys of mackerel.Kernel about the platform, which are collected on all
+// the platforms in addition to the outputs of uname.
+// - pretty_name:     the name of the OS for humans ("Ubuntu 22.04.3 LTS")
+// - architecture:    the CPU architecture named as GOARCH ("amd64")
+// - virtualization:  the hypervisor (kvm, xen, hyperv, vmware, other or none)
+// - build:           the build number of Windows ("22631.2715")
+// - display_version: the version of Windows ("23H2")
+const (
+	KernelPrettyName     = "pretty_name"
+	KernelArchitecture   = "architecture"
+	KernelVirtualization = "virtualization"
+	KernelBuild          = "build"
+	KernelDisplayVersion = "display_version"
+)
+
+// The values of virtualization.
+const (
+	VirtualizationKVM    = "kvm"
+	VirtualizationXen    = "xen"
+	VirtualizationHyperV = "hyperv"
+	VirtualizationVMware = "vmware"
+	// VirtualizationOther is the hypervisor which is detected but unknown.
+	VirtualizationOther = "other"
+	VirtualizationNone  = "none"
+)
+
+// ParseOSRelease parses os-release(5), the lines of KEY=VALUE whose values
+// may be quoted.
+func ParseOSRelease(data []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		values[kv[0]] = v
+	}
+	return values
+}
+
+// VirtualizationByVendor detects the hypervisor by the system vendor and the
+// product name of SMBIOS, which are set by the hypervisors. It returns "" for
+// the physical machines and the unknown hypervisors.
+func VirtualizationByVendor(vendor, product string) string {
+	vendor, product = strings.ToLower(vendor), strings.ToLower(product)
+	switch {
+	case strings.Contains(vendor, "vmware") || strings.HasPrefix(product, "vmware"):
+		return VirtualizationVMware
+	case strings.Contains(vendor, "microsoft") && strings.Contains(product, "virtual machine"):
+		return VirtualizationHyperV
+	case strings.Contains(vendor, "xen") || strings.Contains(product, "hvm domu"):
+		return VirtualizationXen
+	// QEMU and the clouds on KVM, such as the Nitro instances of EC2 and
+	// Google Compute Engine
+	case strings.Contains(vendor, "qemu") || strings.Contains(product, "kvm") ||
+		strings.Contains(vendor, "red hat") || strings.Contains(product, "openstack") ||
+		vendor == "amazon ec2" || product == "google compute engine":
+		return VirtualizationKVM
+	}
+	return ""
+}
+
+// NormalizeArchitecture names machine, the CPU architecture by uname or the
+// OS, as GOARCH to be compared between the platforms.
+func NormalizeArchitecture(machine string) string {
+	switch strings.ToLower(machine) {
+	case "x86_64", "amd64", "x64":
+		return "amd64"
+	case "i386", "i486", "i586", "i686", "i86pc", "x86":
+		return "386"
+	case "aarch64", "arm64", "aarch64_be":
+		return "arm64"
+	case "ppc64le":
+		return "ppc64le"
+	case "s390x":
+		return "s390x"
+	}
+	if strings.HasPrefix(machine, "arm") {
+		return "arm"
+	}
+	return machine
+}
@@ -0,0 +1,68 @@
+package spec
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	tests := []struct {
+		file       string
+		prettyName string
+		id         string
+	}{
+		{"testdata/os-release-ubuntu", "Ubuntu 22.04.3 LTS", "ubuntu"},
+		{"testdata/os-release-amzn", "Amazon Linux 2", "amzn"},
+		{"testdata/os-release-alpine", "Alpine Linux v3.18", "alpine"},
+	}
+	for _, tt := range tests {
+		data, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := ParseOSRelease(data)
+		if values["PRETTY_NAME"] != tt.prettyName || values["ID"] != tt.id {
+			t.Errorf("%s: PRETTY_NAME and ID should be %q and %q but got %v", tt.file, tt.prettyName, tt.id, values)
+		}
+	}
+}
+
+func TestVirtualizationByVendor(t *testing.T) {
+	tests := []struct {
+		vendor, product string
+		expect          string
+	}{
+		{"QEMU", "Standard PC (i440FX + PIIX, 1996)", VirtualizationKVM},
+		{"Amazon EC2", "m5.large", VirtualizationKVM},
+		{"Google", "Google Compute Engine", VirtualizationKVM},
+		{"Xen", "HVM domU", VirtualizationXen},
+		{"Microsoft Corporation", "Virtual Machine", VirtualizationHyperV},
+		{"Microsoft Corporation", "Surface Pro 9", ""},
+		{"VMware, Inc.", "VMware Virtual Platform", VirtualizationVMware},
+		{"", "VMware7,1", VirtualizationVMware},
+		{"Dell Inc.", "PowerEdge R740", ""},
+	}
+	for _, tt := range tests {
+		if got := VirtualizationByVendor(tt.vendor, tt.product); got != tt.expect {
+			t.Errorf("VirtualizationByVendor(%q, %q) should be %q but got %q", tt.vendor, tt.product, tt.expect, got)
+		}
+	}
+}
+
+func TestNormalizeArchitecture(t *testing.T) {
+	tests := map[string]string{
+		"x86_64":  "amd64",
+		"amd64":   "amd64",
+		"i686":    "386",
+		"x86":     "386",
+		"aarch64": "arm64",
+		"arm64":   "arm64",
+		"armv7l":  "arm",
+		"riscv64": "riscv64",
+	}
+	for machine, expect := range tests {
+		if got := NormalizeArchitecture(machine); got != expect {
+			t.Errorf("NormalizeArchitecture(%q) should be %q but got %q", machine, expect, got)
+		}
+	}
+}
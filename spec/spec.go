@@ -1,20 +1,32 @@
 package spec
 
 import (
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
-var logger = logging.GetLogger("spec")
+var logger = logformat.GetLogger("spec")
 
 // Generator interface for generating spec values
 type Generator interface {
 	Generate() (interface{}, error)
 }
 
+// HostMeta is mackerel.HostMeta with the sections
+// which are not supported by mackerel-client-go yet.
+type HostMeta struct {
+	mackerel.HostMeta
+	// AgentCustomizations are the optional features enabled in the agent, and
+	// AgentWrapperVersion is the version of the Windows service wrapper.
+	AgentCustomizations string     `json:"agent-customizations,omitempty"`
+	AgentWrapperVersion string     `json:"agent-wrapper-version,omitempty"`
+	Kubernetes          Kubernetes `json:"kubernetes,omitempty"`
+	Hardware            Hardware   `json:"hardware,omitempty"`
+}
+
 // Collect spec values
-func Collect(specGenerators []Generator) mackerel.HostMeta {
-	var specs mackerel.HostMeta
+func Collect(specGenerators []Generator) HostMeta {
+	var specs HostMeta
 	for _, g := range specGenerators {
 		value, err := g.Generate()
 		if err != nil {
@@ -34,6 +46,10 @@ func Collect(specGenerators []Generator) mackerel.HostMeta {
 			specs.Memory = v
 		case *mackerel.Cloud:
 			specs.Cloud = v
+		case Kubernetes:
+			specs.Kubernetes = v
+		case Hardware:
+			specs.Hardware = v
 		default:
 		}
 	}
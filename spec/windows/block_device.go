@@ -6,7 +6,7 @@ import (
 	"syscall"
 	"unsafe"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 
 	"github.com/mackerelio/mackerel-agent/util/windows"
@@ -16,7 +16,7 @@ import (
 type BlockDeviceGenerator struct {
 }
 
-var blockDeviceLogger = logging.GetLogger("spec.block_device")
+var blockDeviceLogger = logformat.GetLogger("spec.block_device")
 
 // Generate XXX
 func (g *BlockDeviceGenerator) Generate() (interface{}, error) {
@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"unsafe"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 
 	"github.com/mackerelio/mackerel-agent/util/windows"
@@ -16,7 +16,7 @@ import (
 type CPUGenerator struct {
 }
 
-var cpuLogger = logging.GetLogger("spec.cpu")
+var cpuLogger = logformat.GetLogger("spec.cpu")
 
 // Generate collects CPU specs.
 func (g *CPUGenerator) Generate() (interface{}, error) {
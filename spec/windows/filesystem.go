@@ -3,7 +3,7 @@
 package windows
 
 import (
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 
 	"github.com/mackerelio/mackerel-agent/util/windows"
@@ -13,7 +13,7 @@ import (
 type FilesystemGenerator struct {
 }
 
-var filesystemLogger = logging.GetLogger("spec.filesystem")
+var filesystemLogger = logformat.GetLogger("spec.filesystem")
 
 // Generate specs of filesystems.
 func (g *FilesystemGenerator) Generate() (interface{}, error) {
@@ -0,0 +1,83 @@
+// +build windows
+
+package windows
+
+import (
+	"github.com/StackExchange/wmi"
+	"github.com/mackerelio/mackerel-agent/logformat"
+
+	"github.com/mackerelio/mackerel-agent/spec"
+)
+
+// HardwareGenerator collects the hardware information from WMI.
+type HardwareGenerator struct {
+}
+
+var hardwareLogger = logformat.GetLogger("spec.hardware")
+
+type win32BIOS struct {
+	Manufacturer      string
+	SerialNumber      string
+	SMBIOSBIOSVersion string
+}
+
+type win32ComputerSystemProduct struct {
+	Vendor string
+	Name   string
+}
+
+type win32BaseBoard struct {
+	Manufacturer string
+	Product      string
+	SerialNumber string
+}
+
+type win32SystemEnclosure struct {
+	SerialNumber string
+}
+
+// Generate queries Win32_BIOS, Win32_ComputerSystemProduct, Win32_BaseBoard
+// and Win32_SystemEnclosure. The classes which cannot be queried are skipped.
+func (g *HardwareGenerator) Generate() (interface{}, error) {
+	results := make(spec.Hardware)
+	set := func(key, value string) {
+		if value != "" {
+			results[key] = value
+		}
+	}
+
+	var bios []win32BIOS
+	if err := wmi.Query("SELECT Manufacturer, SerialNumber, SMBIOSBIOSVersion FROM Win32_BIOS", &bios); err != nil {
+		hardwareLogger.Debugf("Failed to query Win32_BIOS (skip these fields): %s", err)
+	} else if len(bios) > 0 {
+		set("system_serial_number", bios[0].SerialNumber)
+		set("bios_vendor", bios[0].Manufacturer)
+		set("bios_version", bios[0].SMBIOSBIOSVersion)
+	}
+
+	var products []win32ComputerSystemProduct
+	if err := wmi.Query("SELECT Vendor, Name FROM Win32_ComputerSystemProduct", &products); err != nil {
+		hardwareLogger.Debugf("Failed to query Win32_ComputerSystemProduct (skip these fields): %s", err)
+	} else if len(products) > 0 {
+		set("system_vendor", products[0].Vendor)
+		set("product_name", products[0].Name)
+	}
+
+	var boards []win32BaseBoard
+	if err := wmi.Query("SELECT Manufacturer, Product, SerialNumber FROM Win32_BaseBoard", &boards); err != nil {
+		hardwareLogger.Debugf("Failed to query Win32_BaseBoard (skip these fields): %s", err)
+	} else if len(boards) > 0 {
+		set("board_vendor", boards[0].Manufacturer)
+		set("board_name", boards[0].Product)
+		set("board_serial_number", boards[0].SerialNumber)
+	}
+
+	var enclosures []win32SystemEnclosure
+	if err := wmi.Query("SELECT SerialNumber FROM Win32_SystemEnclosure", &enclosures); err != nil {
+		hardwareLogger.Debugf("Failed to query Win32_SystemEnclosure (skip this field): %s", err)
+	} else if len(enclosures) > 0 {
+		set("chassis_serial_number", enclosures[0].SerialNumber)
+	}
+
+	return results, nil
+}
@@ -5,7 +5,7 @@ package windows
 import (
 	"net"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-agent/util/windows"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
@@ -14,7 +14,7 @@ import (
 type InterfaceGenerator struct {
 }
 
-var interfaceLogger = logging.GetLogger("spec.interface")
+var interfaceLogger = logformat.GetLogger("spec.interface")
 
 // Generate XXX
 func (g *InterfaceGenerator) Generate() ([]mkr.Interface, error) {
@@ -3,11 +3,14 @@
 package windows
 
 import (
+	"strconv"
+	"strings"
 	"unsafe"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 	"github.com/mackerelio/mackerel-client-go"
 
+	"github.com/mackerelio/mackerel-agent/spec"
 	"github.com/mackerelio/mackerel-agent/util/windows"
 )
 
@@ -15,7 +18,7 @@ import (
 type KernelGenerator struct {
 }
 
-var kernelLogger = logging.GetLogger("spec.kernel")
+var kernelLogger = logformat.GetLogger("spec.kernel")
 
 // Generate XXX
 func (g *KernelGenerator) Generate() (interface{}, error) {
@@ -73,7 +76,59 @@ func (g *KernelGenerator) Generate() (interface{}, error) {
 		results["machine"] = "amd64"
 	case 10:
 		results["machine"] = "ia32_on_win64"
+	case 12:
+		results["machine"] = "arm64"
 	}
+	results[spec.KernelArchitecture] = spec.NormalizeArchitecture(results["machine"])
+
+	const currentVersion = `Software\Microsoft\Windows NT\CurrentVersion`
+	buildNumber, _, _ := windows.RegGetString(windows.HKEY_LOCAL_MACHINE, currentVersion, `CurrentBuildNumber`)
+	ubr, _, _ := windows.RegGetInt(windows.HKEY_LOCAL_MACHINE, currentVersion, `UBR`)
+	// DisplayVersion since 20H2, and ReleaseId before it
+	displayVersion, _, _ := windows.RegGetString(windows.HKEY_LOCAL_MACHINE, currentVersion, `DisplayVersion`)
+	if displayVersion == "" {
+		displayVersion, _, _ = windows.RegGetString(windows.HKEY_LOCAL_MACHINE, currentVersion, `ReleaseId`)
+	}
+	prettyName, build := platform(name, buildNumber, ubr, displayVersion)
+	results[spec.KernelPrettyName] = prettyName
+	if build != "" {
+		results[spec.KernelBuild] = build
+	}
+	if displayVersion != "" {
+		results[spec.KernelDisplayVersion] = displayVersion
+	}
+
+	const bios = `HARDWARE\DESCRIPTION\System\BIOS`
+	vendor, _, _ := windows.RegGetString(windows.HKEY_LOCAL_MACHINE, bios, `SystemManufacturer`)
+	product, _, _ := windows.RegGetString(windows.HKEY_LOCAL_MACHINE, bios, `SystemProductName`)
+	results[spec.KernelVirtualization] = virtualization(vendor, product)
 
 	return results, nil
 }
+
+// platform returns the pretty name and the build number with the update
+// build revision, such as "22631.2715". ProductName of Windows 11 remains
+// "Windows 10 ...", so it is corrected by the build number.
+func platform(productName, buildNumber string, ubr uint32, displayVersion string) (prettyName, build string) {
+	prettyName = productName
+	if n, err := strconv.Atoi(buildNumber); err == nil && n >= 22000 {
+		prettyName = strings.Replace(prettyName, "Windows 10", "Windows 11", 1)
+	}
+	if displayVersion != "" {
+		prettyName += " " + displayVersion
+	}
+	build = buildNumber
+	if build != "" && ubr != 0 {
+		build += "." + strconv.FormatUint(uint64(ubr), 10)
+	}
+	return prettyName, build
+}
+
+// virtualization detects the hypervisor by SMBIOS in the registry. The
+// physical machines are not distinguished from the unknown hypervisors.
+func virtualization(vendor, product string) string {
+	if v := spec.VirtualizationByVendor(vendor, product); v != "" {
+		return v
+	}
+	return spec.VirtualizationNone
+}
@@ -24,3 +24,24 @@ func TestKernelGenerate(t *testing.T) {
 		t.Error("kernel.name should be filled")
 	}
 }
+
+func TestPlatform(t *testing.T) {
+	tests := []struct {
+		productName, buildNumber string
+		ubr                      uint32
+		displayVersion           string
+		prettyName, build        string
+	}{
+		{"Windows Server 2019 Datacenter", "17763", 5122, "1809", "Windows Server 2019 Datacenter 1809", "17763.5122"},
+		{"Windows 10 Pro", "22631", 2715, "23H2", "Windows 11 Pro 23H2", "22631.2715"},
+		{"Windows 10 Pro", "19045", 3693, "22H2", "Windows 10 Pro 22H2", "19045.3693"},
+		{"Windows Server 2012 R2 Standard", "9600", 0, "", "Windows Server 2012 R2 Standard", "9600"},
+	}
+	for _, tt := range tests {
+		prettyName, build := platform(tt.productName, tt.buildNumber, tt.ubr, tt.displayVersion)
+		if prettyName != tt.prettyName || build != tt.build {
+			t.Errorf("platform(%q, %q, %d, %q) should be %q and %q but got %q and %q",
+				tt.productName, tt.buildNumber, tt.ubr, tt.displayVersion, tt.prettyName, tt.build, prettyName, build)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package spool stores the payloads which could not be sent to Mackerel in
+// files, so that they are sent later even if the agent restarts meanwhile.
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/util"
+)
+
+var logger = logformat.GetLogger("spool")
+
+// MaxFileSize is the maximum size of a spool file.
+// The payloads larger than it should be split by the caller.
+const MaxFileSize = 1024 * 1024
+
+// The default limits of the spool.
+const (
+	DefaultMaxAge   = 24 * time.Hour
+	DefaultMaxBytes = 100 * 1024 * 1024
+)
+
+// ErrTooLarge is returned by Put if the payload is larger than MaxFileSize.
+var ErrTooLarge = errors.New("the payload is too large to spool")
+
+// ErrCorrupt is returned by Load if the spool file is corrupt.
+// The file is moved to the quarantine directory.
+var ErrCorrupt = errors.New("the spool file is corrupt")
+
+const quarantineDir = "quarantine"
+
+var nowFunc = time.Now
+
+// Spool stores the payloads in the files named with the kind of the payloads
+// and the time when they are stored, so that they are loaded in that order.
+type Spool struct {
+	Dir      string
+	MaxAge   time.Duration
+	MaxBytes int64
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// Entry represents a spool file.
+type Entry struct {
+	Kind      string
+	Name      string
+	CreatedAt time.Time
+	Size      int64
+}
+
+// New creates the spool directory and returns the Spool.
+func New(dir string, maxAge time.Duration, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// remove the temporary files which were left by the crashes during Put
+	tmps, _ := filepath.Glob(filepath.Join(dir, ".*.tmp*"))
+	for _, f := range tmps {
+		os.Remove(f)
+	}
+	return &Spool{Dir: dir, MaxAge: maxAge, MaxBytes: maxBytes}, nil
+}
+
+// ex.) metrics-01577836800000000000-000001.json
+func (s *Spool) fileName(kind string, t time.Time) string {
+	s.seq++
+	return fmt.Sprintf("%s-%020d-%06d.json", kind, t.UnixNano(), s.seq%1000000)
+}
+
+func parseFileName(name string) (kind string, createdAt time.Time, ok bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return "", time.Time{}, false
+	}
+	fields := strings.Split(strings.TrimSuffix(name, ".json"), "-")
+	if len(fields) != 3 {
+		return "", time.Time{}, false
+	}
+	nsec, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return fields[0], time.Unix(0, nsec), true
+}
+
+// Put stores v in a new spool file of the kind, and prunes the old files.
+func (s *Spool) Put(kind string, v interface{}) error {
+	if strings.Contains(kind, "-") {
+		return fmt.Errorf("invalid kind of spool: %q", kind)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFileSize {
+		return ErrTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := util.WriteFileAtomically(filepath.Join(s.Dir, s.fileName(kind, nowFunc())), data, 0600); err != nil {
+		return err
+	}
+	return s.prune()
+}
+
+// Entries returns the spool files of the kind in the order they were stored.
+func (s *Spool) Entries(kind string) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+	var results []Entry
+	for _, e := range entries {
+		if e.Kind == kind {
+			results = append(results, e)
+		}
+	}
+	return results, nil
+}
+
+func (s *Spool) entries() ([]Entry, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		kind, createdAt, ok := parseFileName(fi.Name())
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{Kind: kind, Name: fi.Name(), CreatedAt: createdAt, Size: fi.Size()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+		}
+		// the sequence numbers are zero padded
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// Load decodes the spool file into v. If the file is corrupt, it is moved to
+// the quarantine directory and ErrCorrupt is returned.
+func (s *Spool) Load(e Entry, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, e.Name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		logger.Warningf("The spool file %s is corrupt (%s), quarantined", e.Name, err)
+		if err := s.quarantine(e); err != nil {
+			logger.Errorf("Failed to quarantine the spool file %s: %s", e.Name, err)
+		}
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func (s *Spool) quarantine(e Entry) error {
+	dir := filepath.Join(s.Dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(s.Dir, e.Name), filepath.Join(dir, e.Name))
+}
+
+// Remove removes the spool file.
+func (s *Spool) Remove(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(filepath.Join(s.Dir, e.Name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Prune removes the spool files older than MaxAge, and the oldest files
+// while the total size of them exceeds MaxBytes.
+func (s *Spool) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prune()
+}
+
+func (s *Spool) prune() error {
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	now := nowFunc()
+	var pruned int
+	for _, e := range entries {
+		tooOld := s.MaxAge > 0 && now.Sub(e.CreatedAt) > s.MaxAge
+		tooLarge := s.MaxBytes > 0 && total > s.MaxBytes
+		if !tooOld && !tooLarge {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.Dir, e.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.Size
+		pruned++
+	}
+	if pruned > 0 {
+		logger.Warningf("Pruned %d spool files exceeding the limits", pruned)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, maxAge time.Duration, maxBytes int64) (*Spool, func()) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(filepath.Join(dir, "spool"), maxAge, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func setNow(t time.Time) func() {
+	orig := nowFunc
+	nowFunc = func() time.Time { return t }
+	return func() { nowFunc = orig }
+}
+
+func TestSpool_PutAndLoad(t *testing.T) {
+	s, cleanup := newTestSpool(t, DefaultMaxAge, DefaultMaxBytes)
+	defer cleanup()
+
+	now := time.Now()
+	defer setNow(now)()
+	// stored at the same time, but loaded in the order they were stored
+	for i := 1; i <= 12; i++ {
+		if err := s.Put("metrics", []int{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Put("checks", []int{0})
+
+	entries, err := s.Entries("metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 12 {
+		t.Fatalf("the number of entries should be 12 but got %d", len(entries))
+	}
+	for i, e := range entries {
+		var v []int
+		if err := s.Load(e, &v); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, []int{i + 1}) {
+			t.Errorf("the %dth entry should be [%d] but got %v", i, i+1, v)
+		}
+		if !e.CreatedAt.Equal(time.Unix(0, now.UnixNano())) {
+			t.Errorf("CreatedAt should be %s but got %s", now, e.CreatedAt)
+		}
+		if err := s.Remove(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ = s.Entries("metrics")
+	if len(entries) != 0 {
+		t.Errorf("the entries should be removed but got %v", entries)
+	}
+	entries, _ = s.Entries("checks")
+	if len(entries) != 1 {
+		t.Errorf("the entries of the other kind should not be removed but got %v", entries)
+	}
+}
+
+func TestSpool_Put_TooLarge(t *testing.T) {
+	s, cleanup := newTestSpool(t, DefaultMaxAge, DefaultMaxBytes)
+	defer cleanup()
+
+	if err := s.Put("metrics", strings.Repeat("a", MaxFileSize)); err != ErrTooLarge {
+		t.Errorf("Put should return ErrTooLarge but got %v", err)
+	}
+	if err := s.Put("invalid-kind", 1); err == nil {
+		t.Error("Put should return error for the kind containing '-'")
+	}
+}
+
+func TestSpool_Load_Corrupt(t *testing.T) {
+	s, cleanup := newTestSpool(t, DefaultMaxAge, DefaultMaxBytes)
+	defer cleanup()
+
+	s.Put("metrics", []int{1})
+	s.Put("metrics", []int{2})
+	entries, _ := s.Entries("metrics")
+	if err := ioutil.WriteFile(filepath.Join(s.Dir, entries[0].Name), []byte(`[1, `), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var v []int
+	if err := s.Load(entries[0], &v); err != ErrCorrupt {
+		t.Errorf("Load should return ErrCorrupt but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, quarantineDir, entries[0].Name)); err != nil {
+		t.Errorf("the corrupt file should be quarantined: %s", err)
+	}
+	if err := s.Load(entries[1], &v); err != nil || !reflect.DeepEqual(v, []int{2}) {
+		t.Errorf("the other file should be loaded but got %v, %v", v, err)
+	}
+	entries, _ = s.Entries("metrics")
+	if len(entries) != 1 {
+		t.Errorf("the quarantined file should not be listed but got %v", entries)
+	}
+}
+
+func TestSpool_Prune(t *testing.T) {
+	s, cleanup := newTestSpool(t, time.Hour, 30)
+	defer cleanup()
+
+	now := time.Now()
+	restore := setNow(now.Add(-2 * time.Hour))
+	s.Put("metrics", "too old")
+	restore()
+	defer setNow(now)()
+	s.Put("checks", "1234567890") // 12 bytes
+	s.Put("metrics", "1234567890")
+	s.Put("metrics", "1234567890")
+
+	var names []string
+	for _, kind := range []string{"metrics", "checks"} {
+		entries, _ := s.Entries(kind)
+		for _, e := range entries {
+			var v string
+			s.Load(e, &v)
+			names = append(names, kind+":"+v)
+		}
+	}
+	// the old file and the oldest file are pruned since the total size exceeds 30 bytes
+	expected := []string{"metrics:1234567890", "metrics:1234567890"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("the entries should be %v but got %v", expected, names)
+	}
+}
+
+func TestNew_RemovesTemporaryFiles(t *testing.T) {
+	s, cleanup := newTestSpool(t, DefaultMaxAge, DefaultMaxBytes)
+	defer cleanup()
+
+	tmp := filepath.Join(s.Dir, ".metrics-01577836800000000000-000001.json.tmp456")
+	if err := ioutil.WriteFile(tmp, []byte(`[1`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(s.Dir, DefaultMaxAge, DefaultMaxBytes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("the temporary file %s should be removed: %v", tmp, err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mackerelio/mackerel-agent/exitcode"
 	mkr "github.com/mackerelio/mackerel-client-go"
 )
 
@@ -99,3 +100,47 @@ func TestStart(t *testing.T) {
 		t.Errorf("err should be nil but: %s", err)
 	}
 }
+
+func TestStart_ExitCode(t *testing.T) {
+	hostID := "xxx1234567890"
+	tests := []struct {
+		name   string
+		status int
+		code   int
+	}{
+		{name: "invalid api key", status: http.StatusUnauthorized, code: exitcode.AuthError},
+		{name: "host not found", status: http.StatusNotFound, code: exitcode.HostRegistrationFailure},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				respJSON(w, map[string]interface{}{"error": map[string]string{"message": http.StatusText(tc.status)}})
+			}))
+			defer ts.Close()
+
+			root, err := ioutil.TempDir("", "mackerel-config-test")
+			if err != nil {
+				t.Fatalf("Could not create temporary dir for test")
+			}
+			defer os.RemoveAll(root)
+
+			confFile := filepath.Join(root, "mackerel-agent.conf")
+			ioutil.WriteFile(confFile, []byte(`apikey="DUMMYAPIKEY"`+"\n"), 0644)
+			conf, err := resolveConfig(&flag.FlagSet{}, []string{
+				"-conf=" + confFile,
+				"-apibase=" + ts.URL,
+				"-pidfile=" + root + "/pid",
+				"-root=" + root,
+			})
+			if err != nil {
+				t.Fatalf("err should be nil, but got: %s", err)
+			}
+			conf.SaveHostID(hostID)
+			err = start(conf, make(chan struct{}))
+			if code := exitcode.Of(err); code != tc.code {
+				t.Errorf("the exit code should be %d but got %d: %v", tc.code, code, err)
+			}
+		})
+	}
+}
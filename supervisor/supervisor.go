@@ -10,14 +10,19 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
+	"github.com/mackerelio/mackerel-agent/sdnotify"
 )
 
-var logger = logging.GetLogger("supervisor")
+var logger = logformat.GetLogger("supervisor")
 
 type supervisor struct {
 	prog string
 	argv []string
+	opts Options
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
 
 	cmd     *exec.Cmd
 	startAt time.Time
@@ -30,13 +35,80 @@ type supervisor struct {
 	huppedMu sync.RWMutex
 }
 
+// StartReasonEnv is the environment variable of the child process started
+// again by the supervisor, whose value is StartReasonReload or StartReasonRestart.
+const StartReasonEnv = "MACKEREL_AGENT_SUPERVISOR_START_REASON"
+
+// The reasons of the child processes started again
+const (
+	// StartReasonReload is the child process reloading the configuration.
+	StartReasonReload = "reload"
+	// StartReasonRestart is the child process restarted after the crash.
+	StartReasonRestart = "restart"
+)
+
+// Options are the limits of the restarts of the crashed child process.
+// The zero values are replaced with the defaults.
+type Options struct {
+	// MaxRestarts is the maximum number of the restarts in RestartInterval.
+	// The supervisor gives up restarting the child crashed more than it.
+	MaxRestarts     int
+	RestartInterval time.Duration
+	// Backoff is the delay of the restart, which is doubled by each restart
+	// in RestartInterval up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// The defaults of Options
+const (
+	DefaultMaxRestarts     = 5
+	DefaultRestartInterval = 10 * time.Minute
+	DefaultBackoff         = 1 * time.Second
+	DefaultMaxBackoff      = 1 * time.Minute
+)
+
+func (opts Options) withDefaults() Options {
+	if opts.MaxRestarts <= 0 {
+		opts.MaxRestarts = DefaultMaxRestarts
+	}
+	if opts.RestartInterval <= 0 {
+		opts.RestartInterval = DefaultRestartInterval
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	return opts
+}
+
+// backoff returns the delay of the restart after the restarts in RestartInterval.
+func (opts Options) backoff(restarts int) time.Duration {
+	d := opts.Backoff
+	for i := 1; i < restarts && d < opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > opts.MaxBackoff {
+		return opts.MaxBackoff
+	}
+	return d
+}
+
 // Supervise starts a child mackerel-agent process and supervises it.
 // 'c' can be nil and it's typically nil. When you pass signal channel to this
 // method, the channel will be closed internally.
 func Supervise(agentProg string, argv []string, c chan os.Signal) error {
+	return SuperviseWithOptions(agentProg, argv, c, Options{})
+}
+
+// SuperviseWithOptions is Supervise limiting the restarts by opts.
+func SuperviseWithOptions(agentProg string, argv []string, c chan os.Signal, opts Options) error {
 	return (&supervisor{
 		prog: agentProg,
 		argv: argv,
+		opts: opts,
 	}).supervise(c)
 }
 
@@ -84,26 +156,46 @@ func (sv *supervisor) launched() bool {
 	return sv.getCmd().Process != nil && time.Now().After(sv.getStartAt().Add(spawnInterval))
 }
 
-func (sv *supervisor) buildCmd() *exec.Cmd {
+func (sv *supervisor) buildCmd(reason string) *exec.Cmd {
 	argv := append(sv.argv, "-child")
 	cmd := exec.Command(sv.prog, argv...)
-	cmd.Stderr = os.Stderr
+	// the logs of the child process are written to the log file of the supervisor
+	cmd.Stderr = logformat.Output()
 	cmd.Stdout = os.Stdout
+	setupCmd(cmd)
+	if reason != "" {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, StartReasonEnv+"="+reason)
+	}
 	return cmd
 }
 
 func (sv *supervisor) start() error {
 	sv.mu.Lock()
+	var reason string
+	if sv.cmd != nil {
+		reason = StartReasonRestart
+		if sv.getHupped() {
+			reason = StartReasonReload
+		}
+	}
 	sv.setHupped(false)
 	defer sv.mu.Unlock()
-	sv.cmd = sv.buildCmd()
+	sv.cmd = sv.buildCmd(reason)
 	sv.startAt = time.Now()
-	return sv.cmd.Start()
+	if err := sv.cmd.Start(); err != nil {
+		return err
+	}
+	afterStart(sv.cmd)
+	return nil
 }
 
 func (sv *supervisor) stop(sig os.Signal) error {
 	sv.setSignaled(true)
-	return sv.getCmd().Process.Signal(sig)
+	sv.stopOnce.Do(func() { close(sv.stopCh) })
+	return terminate(sv.getCmd().Process, sig)
 }
 
 func (sv *supervisor) configtest() error {
@@ -124,17 +216,33 @@ func (sv *supervisor) reload() error {
 		return err
 	}
 	sv.setHupped(true)
-	return sv.getCmd().Process.Signal(syscall.SIGTERM)
+	return terminate(sv.getCmd().Process, syscall.SIGTERM)
 }
 
 func (sv *supervisor) wait() (err error) {
+	opts := sv.opts.withDefaults()
+	var restarts []time.Time
 	for {
 		err = sv.cmd.Wait()
 		if sv.getSignaled() || (!sv.getHupped() && !sv.launched()) {
 			break
 		}
-		if err != nil {
-			logger.Warningf("mackerel-agent abnormally finished with following error and try to restart it: %s", err.Error())
+		if !sv.getHupped() {
+			restarts = restartsSince(restarts, time.Now().Add(-opts.RestartInterval))
+			if len(restarts) >= opts.MaxRestarts {
+				err = fmt.Errorf("mackerel-agent crashed more than %d times in %s, giving up restarting it: %v", opts.MaxRestarts, opts.RestartInterval, err)
+				break
+			}
+			restarts = append(restarts, time.Now())
+			delay := opts.backoff(len(restarts))
+			if err != nil {
+				logger.Warningf("mackerel-agent abnormally finished with following error and try to restart it in %s: %s", delay, err.Error())
+			}
+			select {
+			case <-time.After(delay):
+			case <-sv.stopCh:
+				return nil
+			}
 		}
 		if err = sv.start(); err != nil {
 			break
@@ -143,14 +251,40 @@ func (sv *supervisor) wait() (err error) {
 	return
 }
 
+// restartsSince drops the times of the restarts before t.
+func restartsSince(restarts []time.Time, t time.Time) []time.Time {
+	for len(restarts) > 0 && restarts[0].Before(t) {
+		restarts = restarts[1:]
+	}
+	return restarts
+}
+
+// hup reloads the configuration by restarting the child process.
+func (sv *supervisor) hup() {
+	logger.Infof("receiving HUP, spawning a new mackerel-agent")
+	if err := logformat.Reopen(); err != nil {
+		logger.Warningf("failed to reopen the log file: %s", err)
+	}
+	// the new child process notifies systemd of the readiness by itself
+	notifySystemd(sdnotify.Reloading)
+	err := sv.reload()
+	if err != nil {
+		logger.Warningf("failed to reload: %s", err.Error())
+		// the old child process keeps running
+		notifySystemd(sdnotify.Ready)
+	}
+}
+
+func notifySystemd(state string) {
+	if err := sdnotify.Notify(state); err != nil {
+		logger.Debugf("failed to notify systemd: %s", err)
+	}
+}
+
 func (sv *supervisor) handleSignal(ch <-chan os.Signal) {
 	for sig := range ch {
 		if sig == syscall.SIGHUP {
-			logger.Infof("receiving HUP, spawning a new mackerel-agent")
-			err := sv.reload()
-			if err != nil {
-				logger.Warningf("failed to reload: %s", err.Error())
-			}
+			sv.hup()
 		} else {
 			sv.stop(sig)
 		}
@@ -158,6 +292,12 @@ func (sv *supervisor) handleSignal(ch <-chan os.Signal) {
 }
 
 func (sv *supervisor) supervise(c chan os.Signal) error {
+	sv.stopCh = make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	if err := sv.watchReload(done); err != nil {
+		return err
+	}
 	if err := sv.start(); err != nil {
 		return err
 	}
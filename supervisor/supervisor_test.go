@@ -5,6 +5,7 @@ package supervisor
 import (
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -62,6 +63,17 @@ func TestSupervisor(t *testing.T) {
 	}
 }
 
+// startReason returns the value of StartReasonEnv passed to cmd.
+func startReason(cmd *exec.Cmd) string {
+	var reason string
+	for _, e := range cmd.Env {
+		if strings.HasPrefix(e, StartReasonEnv+"=") {
+			reason = strings.TrimPrefix(e, StartReasonEnv+"=")
+		}
+	}
+	return reason
+}
+
 func TestSupervisor_reload(t *testing.T) {
 	sv := &supervisor{
 		prog: stubAgent,
@@ -77,12 +89,18 @@ func TestSupervisor_reload(t *testing.T) {
 	if !pidfile.ExistsPid(oldPid) {
 		t.Errorf("process doesn't exist")
 	}
+	if reason := startReason(sv.getCmd()); reason != "" {
+		t.Errorf("the first process should not have the start reason but got %q", reason)
+	}
 	ch <- syscall.SIGHUP
 	time.Sleep(200 * time.Millisecond)
 	newPid := sv.getCmd().Process.Pid
 	if oldPid == newPid {
 		t.Errorf("reload failed")
 	}
+	if reason := startReason(sv.getCmd()); reason != StartReasonReload {
+		t.Errorf("the start reason should be %q but got %q", StartReasonReload, reason)
+	}
 	if pidfile.ExistsPid(oldPid) {
 		t.Errorf("old process isn't terminated")
 	}
@@ -160,6 +178,7 @@ func TestSupervisor_crashRecovery(t *testing.T) {
 	sv := &supervisor{
 		prog: stubAgent,
 		argv: []string{"blah blah blah"},
+		opts: Options{Backoff: 10 * time.Millisecond},
 	}
 	ch := make(chan os.Signal, 1)
 	done := make(chan error)
@@ -181,6 +200,9 @@ func TestSupervisor_crashRecovery(t *testing.T) {
 	if oldPid == newPid {
 		t.Errorf("crash recovery failed")
 	}
+	if reason := startReason(sv.getCmd()); reason != StartReasonRestart {
+		t.Errorf("the start reason should be %q but got %q", StartReasonRestart, reason)
+	}
 	if pidfile.ExistsPid(oldPid) {
 		t.Errorf("old process isn't terminated")
 	}
@@ -190,3 +212,76 @@ func TestSupervisor_crashRecovery(t *testing.T) {
 	ch <- syscall.SIGTERM
 	<-done
 }
+
+func TestSupervisor_maxRestarts(t *testing.T) {
+	origSpawnInterval := spawnInterval
+	spawnInterval = 100 * time.Millisecond
+	defer func() { spawnInterval = origSpawnInterval }()
+
+	sv := &supervisor{
+		prog: stubAgent,
+		argv: []string{"blah blah blah"},
+		opts: Options{MaxRestarts: 1, Backoff: 10 * time.Millisecond},
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- sv.supervise(ch)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		time.Sleep(2 * spawnInterval)
+		sv.getCmd().Process.Signal(syscall.SIGUSR1)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("the supervisor should give up restarting the crashed agent")
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("the supervisor should give up restarting the crashed agent")
+		ch <- syscall.SIGTERM
+		<-done
+	}
+}
+
+func TestSupervisor_stopWhileBackoff(t *testing.T) {
+	origSpawnInterval := spawnInterval
+	spawnInterval = 100 * time.Millisecond
+	defer func() { spawnInterval = origSpawnInterval }()
+
+	sv := &supervisor{
+		prog: stubAgent,
+		argv: []string{"blah blah blah"},
+		opts: Options{Backoff: time.Minute},
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- sv.supervise(ch)
+	}()
+	time.Sleep(2 * spawnInterval)
+	sv.getCmd().Process.Signal(syscall.SIGUSR1)
+	time.Sleep(100 * time.Millisecond)
+	ch <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("error should be nil but: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the supervisor should stop while waiting for the restart")
+	}
+}
+
+func TestOptions_backoff(t *testing.T) {
+	opts := Options{Backoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	for restarts, expect := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := opts.backoff(restarts); got != expect {
+			t.Errorf("the backoff after %d restarts should be %s but got %s", restarts, expect, got)
+		}
+	}
+	if opts.MaxRestarts != DefaultMaxRestarts || opts.RestartInterval != DefaultRestartInterval {
+		t.Errorf("the defaults should be applied: %+v", opts)
+	}
+}
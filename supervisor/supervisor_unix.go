@@ -0,0 +1,39 @@
+// +build !windows
+
+package supervisor
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// setupCmd hands the watchdog of systemd over to the child process, which
+// pings it from the main loop instead of the supervisor. WATCHDOG_PID set to
+// the supervisor is dropped so that the child process does not ignore it.
+func setupCmd(cmd *exec.Cmd) {
+	if os.Getenv("WATCHDOG_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "WATCHDOG_PID=") {
+			env = append(env, e)
+		}
+	}
+	cmd.Env = env
+}
+
+func afterStart(cmd *exec.Cmd) {}
+
+// terminate sends sig to the child process.
+func terminate(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// watchReload does nothing since the child process sends SIGHUP to the
+// supervisor to reload the configuration.
+func (sv *supervisor) watchReload(done <-chan struct{}) error {
+	return nil
+}
@@ -0,0 +1,113 @@
+// +build windows
+
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ReloadEventEnv is the environment variable of the child process to pass the
+// name of the event, which the child sets to make the supervisor reload the
+// configuration as SIGHUP on the other platforms.
+const ReloadEventEnv = "MACKEREL_AGENT_SUPERVISOR_RELOAD_EVENT"
+
+// job kills the child processes when the supervisor exits, even if the
+// supervisor is killed by the service wrapper.
+var (
+	job     windows.Handle
+	jobOnce sync.Once
+)
+
+func createJob() (windows.Handle, error) {
+	h, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if _, err := windows.SetInformationJobObject(h, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(h)
+		return 0, err
+	}
+	return h, nil
+}
+
+func reloadEventName() string {
+	return fmt.Sprintf("mackerel-agent-supervisor-%d", os.Getpid())
+}
+
+// setupCmd creates the child process in the new process group, so that the
+// console control events are sent only to the child.
+func setupCmd(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+	cmd.Env = append(os.Environ(), ReloadEventEnv+"="+reloadEventName())
+}
+
+func afterStart(cmd *exec.Cmd) {
+	jobOnce.Do(func() {
+		var err error
+		if job, err = createJob(); err != nil {
+			logger.Warningf("failed to create the job for mackerel-agent: %s", err)
+		}
+	})
+	if job == 0 {
+		return
+	}
+	h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		logger.Warningf("failed to open the process of mackerel-agent: %s", err)
+		return
+	}
+	defer windows.CloseHandle(h)
+	if err := windows.AssignProcessToJobObject(job, h); err != nil {
+		logger.Warningf("failed to assign mackerel-agent to the job: %s", err)
+	}
+}
+
+// terminate sends CTRL_BREAK_EVENT to the process group of the child, which
+// the child receives as os.Interrupt. Windows cannot send the other signals.
+func terminate(p *os.Process, _ os.Signal) error {
+	return windows.GenerateConsoleCtrlEvent(syscall.CTRL_BREAK_EVENT, uint32(p.Pid))
+}
+
+// watchReload creates the event of reloadEventName, and reloads the
+// configuration when the child process sets it until done is closed.
+func (sv *supervisor) watchReload(done <-chan struct{}) error {
+	name, err := syscall.UTF16PtrFromString(reloadEventName())
+	if err != nil {
+		return err
+	}
+	ev, err := windows.CreateEvent(nil, 0, 0, name)
+	if err != nil {
+		return fmt.Errorf("failed to create the event to reload: %s", err)
+	}
+	go func() {
+		defer windows.CloseHandle(ev)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s, err := windows.WaitForSingleObject(ev, 1000)
+			if err != nil {
+				logger.Warningf("failed to wait for the event to reload: %s", err)
+				return
+			}
+			if s == windows.WAIT_OBJECT_0 {
+				sv.hup()
+			}
+		}
+	}()
+	return nil
+}
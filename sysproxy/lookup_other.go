@@ -0,0 +1,12 @@
+// +build !windows
+
+package sysproxy
+
+import (
+	"errors"
+	"net/url"
+)
+
+func lookup(u *url.URL) (*url.URL, error) {
+	return nil, errors.New("the system proxy settings are supported only on Windows")
+}
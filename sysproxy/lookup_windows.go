@@ -0,0 +1,154 @@
+package sysproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	winhttp                                   = windows.NewLazySystemDLL("winhttp.dll")
+	procWinHttpOpen                           = winhttp.NewProc("WinHttpOpen")
+	procWinHttpCloseHandle                    = winhttp.NewProc("WinHttpCloseHandle")
+	procWinHttpGetProxyForUrl                 = winhttp.NewProc("WinHttpGetProxyForUrl")
+	procWinHttpGetIEProxyConfigForCurrentUser = winhttp.NewProc("WinHttpGetIEProxyConfigForCurrentUser")
+	procWinHttpGetDefaultProxyConfiguration   = winhttp.NewProc("WinHttpGetDefaultProxyConfiguration")
+
+	kernel32       = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalFree = kernel32.NewProc("GlobalFree")
+)
+
+const (
+	winhttpAccessTypeNoProxy    = 1
+	winhttpAccessTypeNamedProxy = 3
+
+	winhttpAutoproxyAutoDetect = 0x1
+	winhttpAutoproxyConfigURL  = 0x2
+	winhttpAutoDetectTypeDHCP  = 0x1
+	winhttpAutoDetectTypeDNSA  = 0x2
+
+	errorWinhttpLoginFailure = 12015
+)
+
+type winhttpCurrentUserIEProxyConfig struct {
+	AutoDetect    int32
+	AutoConfigURL *uint16
+	Proxy         *uint16
+	ProxyBypass   *uint16
+}
+
+type winhttpProxyInfo struct {
+	AccessType  uint32
+	Proxy       *uint16
+	ProxyBypass *uint16
+}
+
+type winhttpAutoproxyOptions struct {
+	Flags                 uint32
+	AutoDetectFlags       uint32
+	AutoConfigURL         *uint16
+	reserved1             uintptr
+	reserved2             uint32
+	AutoLogonIfChallenged int32
+}
+
+// lookup resolves the proxy of u by the PAC file or the auto detection of
+// the Internet Options, the static proxy of them, or the WinHTTP settings
+// (netsh winhttp), in this order.
+func lookup(u *url.URL) (*url.URL, error) {
+	var ie winhttpCurrentUserIEProxyConfig
+	if r, _, _ := procWinHttpGetIEProxyConfigForCurrentUser.Call(uintptr(unsafe.Pointer(&ie))); r != 0 {
+		defer globalFree(ie.AutoConfigURL)
+		defer globalFree(ie.Proxy)
+		defer globalFree(ie.ProxyBypass)
+	}
+
+	var errs []string
+	if ie.AutoDetect != 0 || ie.AutoConfigURL != nil {
+		proxy, err := lookupAutoProxy(u, ie.AutoDetect != 0, ie.AutoConfigURL)
+		if err == nil {
+			return proxy, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if ie.Proxy != nil {
+		return selectProxy(u, utf16PtrToString(ie.Proxy), utf16PtrToString(ie.ProxyBypass))
+	}
+
+	var info winhttpProxyInfo
+	r, _, err := procWinHttpGetDefaultProxyConfiguration.Call(uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		errs = append(errs, fmt.Sprintf("WinHttpGetDefaultProxyConfiguration: %s", err))
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	defer globalFree(info.Proxy)
+	defer globalFree(info.ProxyBypass)
+	if info.AccessType != winhttpAccessTypeNamedProxy || info.Proxy == nil {
+		if len(errs) > 0 {
+			return nil, errors.New(strings.Join(errs, "; "))
+		}
+		return nil, nil
+	}
+	return selectProxy(u, utf16PtrToString(info.Proxy), utf16PtrToString(info.ProxyBypass))
+}
+
+// lookupAutoProxy resolves the proxy by WPAD or the PAC file of configURL.
+func lookupAutoProxy(u *url.URL, autoDetect bool, configURL *uint16) (*url.URL, error) {
+	agent, _ := syscall.UTF16PtrFromString("mackerel-agent")
+	session, _, err := procWinHttpOpen.Call(uintptr(unsafe.Pointer(agent)), winhttpAccessTypeNoProxy, 0, 0, 0)
+	if session == 0 {
+		return nil, fmt.Errorf("WinHttpOpen: %s", err)
+	}
+	defer procWinHttpCloseHandle.Call(session)
+
+	target, err := syscall.UTF16PtrFromString(u.String())
+	if err != nil {
+		return nil, err
+	}
+	opts := winhttpAutoproxyOptions{AutoConfigURL: configURL}
+	if autoDetect {
+		opts.Flags |= winhttpAutoproxyAutoDetect
+		opts.AutoDetectFlags = winhttpAutoDetectTypeDHCP | winhttpAutoDetectTypeDNSA
+	}
+	if configURL != nil {
+		opts.Flags |= winhttpAutoproxyConfigURL
+	}
+	var info winhttpProxyInfo
+	r, _, err := procWinHttpGetProxyForUrl.Call(session, uintptr(unsafe.Pointer(target)), uintptr(unsafe.Pointer(&opts)), uintptr(unsafe.Pointer(&info)))
+	if r == 0 && err == syscall.Errno(errorWinhttpLoginFailure) {
+		// the PAC file requires the credentials of the account
+		opts.AutoLogonIfChallenged = 1
+		r, _, err = procWinHttpGetProxyForUrl.Call(session, uintptr(unsafe.Pointer(target)), uintptr(unsafe.Pointer(&opts)), uintptr(unsafe.Pointer(&info)))
+	}
+	if r == 0 {
+		return nil, fmt.Errorf("WinHttpGetProxyForUrl: %s", err)
+	}
+	defer globalFree(info.Proxy)
+	defer globalFree(info.ProxyBypass)
+	if info.AccessType != winhttpAccessTypeNamedProxy || info.Proxy == nil {
+		return nil, nil
+	}
+	return selectProxy(u, utf16PtrToString(info.Proxy), utf16PtrToString(info.ProxyBypass))
+}
+
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	n := 0
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; n++ {
+		ptr = unsafe.Pointer(uintptr(ptr) + unsafe.Sizeof(*p))
+	}
+	return windows.UTF16ToString((*[1 << 29]uint16)(unsafe.Pointer(p))[:n:n])
+}
+
+func globalFree(p *uint16) {
+	if p != nil {
+		procGlobalFree.Call(uintptr(unsafe.Pointer(p)))
+	}
+}
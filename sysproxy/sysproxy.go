@@ -0,0 +1,149 @@
+// Package sysproxy resolves the proxies of the URLs by the proxy settings of
+// the system, such as the PAC files and the WinHTTP settings of Windows.
+package sysproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logformat"
+)
+
+var logger = logformat.GetLogger("sysproxy")
+
+// DefaultRefreshInterval is the interval to resolve the proxies again, for the
+// changes of the settings and the PAC files.
+const DefaultRefreshInterval = 15 * time.Minute
+
+// Resolver resolves the proxies by the system settings and caches them by the
+// schemes and the hosts of the URLs. The resolution which fails falls back to
+// the direct connection.
+type Resolver struct {
+	refresh time.Duration
+	lookup  func(u *url.URL) (*url.URL, error)
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	proxy      *url.URL
+	resolvedAt time.Time
+	refreshing bool
+}
+
+// NewResolver creates the resolver which resolves the proxies again after the
+// refresh interval.
+func NewResolver(refresh time.Duration) *Resolver {
+	return &Resolver{refresh: refresh, lookup: lookup, entries: make(map[string]*entry)}
+}
+
+// Proxy returns the proxy of the request, or nil for the direct connection.
+// It can be Proxy of http.Transport. The expired proxies are used until they
+// are resolved again in background.
+func (r *Resolver) Proxy(req *http.Request) (*url.URL, error) {
+	key := req.URL.Scheme + "://" + req.URL.Host
+	r.mu.Lock()
+	e, ok := r.entries[key]
+	if ok {
+		if !e.refreshing && time.Since(e.resolvedAt) >= r.refresh {
+			e.refreshing = true
+			u := *req.URL
+			go r.resolve(key, &u)
+		}
+		r.mu.Unlock()
+		return e.proxy, nil
+	}
+	r.mu.Unlock()
+	return r.resolve(key, req.URL), nil
+}
+
+func (r *Resolver) resolve(key string, u *url.URL) *url.URL {
+	proxy, err := r.lookup(u)
+	if err != nil {
+		logger.Warningf("failed to resolve the proxy of %s by the system settings, so connecting directly: %s", key, err)
+		proxy = nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.entries[key]; ok && proxyString(old.proxy) != proxyString(proxy) {
+		logger.Infof("the proxy of %s is changed from %s to %s", key, proxyString(old.proxy), proxyString(proxy))
+	}
+	r.entries[key] = &entry{proxy: proxy, resolvedAt: time.Now()}
+	return proxy
+}
+
+func proxyString(proxy *url.URL) string {
+	if proxy == nil {
+		return "direct"
+	}
+	// without the credentials
+	return proxy.Scheme + "://" + proxy.Host
+}
+
+// selectProxy selects the proxy of u from the list of the proxies and the
+// bypass list in the formats of WinHTTP, such as "http=proxy:8080;https=proxy:8443"
+// and "<local>;*.example.com". It returns nil for the direct connection.
+func selectProxy(u *url.URL, proxies, bypass string) (*url.URL, error) {
+	if bypassed(u.Hostname(), bypass) {
+		return nil, nil
+	}
+	var selected string
+	for _, p := range splitList(proxies) {
+		i := strings.Index(p, "=")
+		if i < 0 {
+			if selected == "" {
+				selected = p
+			}
+			continue
+		}
+		if strings.EqualFold(p[:i], u.Scheme) {
+			selected = p[i+1:]
+			break
+		}
+	}
+	if selected == "" {
+		return nil, nil
+	}
+	if !strings.Contains(selected, "://") {
+		selected = "http://" + selected
+	}
+	return url.Parse(selected)
+}
+
+// bypassed reports whether host matches the bypass list, whose "<local>"
+// matches the hosts without the dots.
+func bypassed(host, bypass string) bool {
+	host = strings.ToLower(host)
+	for _, b := range splitList(bypass) {
+		b = strings.ToLower(b)
+		if b == "<local>" {
+			if !strings.Contains(host, ".") && net.ParseIP(host) == nil {
+				return true
+			}
+			continue
+		}
+		// the scheme and the port of the entry are ignored
+		if i := strings.Index(b, "://"); i >= 0 {
+			b = b[i+3:]
+		}
+		if h, _, err := net.SplitHostPort(b); err == nil {
+			b = h
+		}
+		if ok, _ := path.Match(b, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ';' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+}
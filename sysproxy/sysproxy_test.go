@@ -0,0 +1,84 @@
+package sysproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSelectProxy(t *testing.T) {
+	tests := []struct {
+		url, proxies, bypass string
+		expect               string
+	}{
+		{"https://api.mackerelio.com/", "proxy.example.com:8080", "", "http://proxy.example.com:8080"},
+		{"https://api.mackerelio.com/", "http=http-proxy:8080;https=https-proxy:8443", "", "http://https-proxy:8443"},
+		{"http://api.mackerelio.com/", "http=http-proxy:8080 https=https-proxy:8443", "", "http://http-proxy:8080"},
+		{"https://api.mackerelio.com/", "ftp=ftp-proxy:21", "", ""},
+		{"https://api.mackerelio.com/", "https://proxy.example.com:8443", "", "https://proxy.example.com:8443"},
+		{"https://api.mackerelio.com/", "proxy:8080", "<local>;*.mackerelio.com", ""},
+		{"https://localhost/", "proxy:8080", "<local>", ""},
+		{"https://127.0.0.1/", "proxy:8080", "<local>", "http://proxy:8080"},
+		{"https://10.0.0.1/", "proxy:8080", "10.*", ""},
+		{"https://API.MACKERELIO.COM/", "proxy:8080", "https://api.mackerelio.com:443", ""},
+		{"https://api.mackerelio.com/", "", "", ""},
+	}
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.url)
+		proxy, err := selectProxy(u, tc.proxies, tc.bypass)
+		if err != nil {
+			t.Errorf("selectProxy(%q, %q, %q) should not raise error: %s", tc.url, tc.proxies, tc.bypass, err)
+			continue
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != tc.expect {
+			t.Errorf("selectProxy(%q, %q, %q) should be %q but got %q", tc.url, tc.proxies, tc.bypass, tc.expect, got)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	var count int32
+	proxy, _ := url.Parse("http://proxy.example.com:8080")
+	r := NewResolver(time.Hour)
+	r.lookup = func(u *url.URL) (*url.URL, error) {
+		if atomic.AddInt32(&count, 1) > 1 {
+			return nil, errors.New("the PAC file is not found")
+		}
+		return proxy, nil
+	}
+	req, _ := http.NewRequest("GET", "https://api.mackerelio.com/api/v0/org", nil)
+
+	for i := 0; i < 2; i++ {
+		got, err := r.Proxy(req)
+		if err != nil || got != proxy {
+			t.Errorf("the proxy should be resolved: %v, %v", got, err)
+		}
+	}
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("the proxy should be cached, but resolved %d times", n)
+	}
+
+	// the expired proxy is used until it is resolved again
+	r.refresh = 0
+	if got, _ := r.Proxy(req); got != proxy {
+		t.Errorf("the expired proxy should be used: %v", got)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&count) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.refresh = time.Hour
+	for i := 0; i < 100; i++ {
+		if got, _ := r.Proxy(req); got == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("the failed resolution should fall back to the direct connection")
+}
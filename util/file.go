@@ -0,0 +1,55 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomically writes contents to file with perm by renaming the
+// temporary file in the same directory, which is created if missing, so that
+// the readers never see the partially written file. The contents are synced
+// to the disk before the rename not to leave the empty file by the crash of
+// the host.
+func WriteFileAtomically(file string, contents []byte, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// MUST be located on the same filesystem to be renamed
+	tmpf, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	// fails after the successful rename
+	defer os.Remove(tmpf.Name())
+	_, err = tmpf.Write(contents)
+	if err == nil {
+		err = tmpf.Sync()
+	}
+	if cerr := tmpf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpf.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpf.Name(), file); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir syncs the entries of dir to persist the rename, which is not
+// supported on Windows and ignored if it fails.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
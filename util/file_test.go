@@ -0,0 +1,39 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	for _, contents := range []string{"first", "second"} {
+		if err := WriteFileAtomically(file, []byte(contents), 0600); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil || string(b) != contents {
+			t.Errorf("the file should be %q but got %q, %v", contents, b, err)
+		}
+	}
+	if fi, err := os.Stat(file); err != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Errorf("the file should be written with the permission: %v, %v", fi.Mode(), err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("the temporary files should be removed: %v", entries)
+	}
+
+	if err := WriteFileAtomically(filepath.Join(dir, "missing", "state.json"), nil, 0644); err != nil {
+		t.Errorf("should create the directory: %s", err)
+	}
+}
@@ -15,7 +15,7 @@ import (
 	"time"
 
 	"github.com/Songmu/timeout"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 )
 
 // DfStat is disk free statistics from df command.
@@ -41,7 +41,7 @@ var dfHeaderPattern = regexp.MustCompile(
 	`^Filesystem\s+(?:1024|1[Kk])-block`,
 )
 
-var logger = logging.GetLogger("util.filesystem")
+var logger = logformat.GetLogger("util.filesystem")
 
 var dfOpt = "-Pkl"
 
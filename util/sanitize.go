@@ -1,6 +1,12 @@
 package util
 
-import "regexp"
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 var sanitizerReg = regexp.MustCompile(`[^A-Za-z0-9_-]`)
 
@@ -8,3 +14,143 @@ var sanitizerReg = regexp.MustCompile(`[^A-Za-z0-9_-]`)
 func SanitizeMetricKey(key string) string {
 	return sanitizerReg.ReplaceAllString(key, "_")
 }
+
+// TruncatedMarker ends the strings shortened by TruncateString.
+const TruncatedMarker = "..."
+
+// SanitizeString replaces the invalid UTF-8 sequences in s with U+FFFD, and
+// removes the control characters except "\n" and "\t" if multiline is true,
+// which are rejected by Mackerel in the payloads.
+func SanitizeString(s string, multiline bool) string {
+	if isSanitized(s, multiline) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		// r is utf8.RuneError for an invalid sequence
+		if keepRune(r, multiline) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func isSanitized(s string, multiline bool) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			// the non-ASCII strings are checked by the runes
+			for _, r := range s[i:] {
+				if r == utf8.RuneError || !keepRune(r, multiline) {
+					return false
+				}
+			}
+			return true
+		}
+		if !keepRune(rune(c), multiline) {
+			return false
+		}
+	}
+	return true
+}
+
+func keepRune(r rune, multiline bool) bool {
+	if !unicode.IsControl(r) {
+		return true
+	}
+	return multiline && (r == '\n' || r == '\t')
+}
+
+// TruncateString shortens s to at most max characters ending with
+// TruncatedMarker. It returns s as is if max <= 0.
+func TruncateString(s string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	n := max - utf8.RuneCountInString(TruncatedMarker)
+	if n <= 0 {
+		return TruncatedMarker[:max]
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i] + TruncatedMarker
+		}
+		n--
+	}
+	return s
+}
+
+// SanitizeValue returns the copy of v whose strings, including the keys of
+// the maps and the exported fields of the structs, are sanitized by
+// SanitizeString and shortened to max characters by TruncateString. The
+// pointers, the maps and the slices in v are copied, so v is not modified,
+// such as the cached host specs.
+func SanitizeValue(v interface{}, multiline bool, max int) interface{} {
+	if v == nil {
+		return nil
+	}
+	return sanitizeValue(reflect.ValueOf(v), multiline, max).Interface()
+}
+
+func sanitizeValue(v reflect.Value, multiline bool, max int) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		s := TruncateString(SanitizeString(v.String(), multiline), max)
+		if s == v.String() {
+			return v
+		}
+		return reflect.ValueOf(s).Convert(v.Type())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(sanitizeValue(v.Elem(), multiline, max))
+		return p
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		i := reflect.New(v.Type()).Elem()
+		i.Set(sanitizeValue(v.Elem(), multiline, max))
+		return i
+	case reflect.Struct:
+		s := reflect.New(v.Type()).Elem()
+		s.Set(v)
+		for i := 0; i < s.NumField(); i++ {
+			if f := s.Field(i); f.CanSet() {
+				f.Set(sanitizeValue(f, multiline, max))
+			}
+		}
+		return s
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		m := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(sanitizeValue(iter.Key(), multiline, max), sanitizeValue(iter.Value(), multiline, max))
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded in base64
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(sanitizeValue(v.Index(i), multiline, max))
+		}
+		return s
+	case reflect.Array:
+		a := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			a.Index(i).Set(sanitizeValue(v.Index(i), multiline, max))
+		}
+		return a
+	default:
+		return v
+	}
+}
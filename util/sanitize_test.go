@@ -1,6 +1,9 @@
 package util
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestSanitizeMetricKey(t *testing.T) {
 	input := "abc*defあ.ggg"
@@ -10,3 +13,101 @@ func TestSanitizeMetricKey(t *testing.T) {
 		t.Errorf("invalid output of `SanitizeMetricKey`. expected: %s, output: %s", expect, output)
 	}
 }
+
+func TestSanitizeString(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		multiline bool
+		expect    string
+	}{
+		{"valid", "mackerel.io", false, "mackerel.io"},
+		{"multibyte", "ディスク 💾", false, "ディスク 💾"},
+		{"invalid byte", "disk\xff1", false, "disk�1"},
+		{"truncated sequence", "名\xe5\x89", false, "名��"},
+		{"overlong encoding", "a\xc0\xafb", false, "a��b"},
+		{"surrogate", "a\xed\xa0\x80b", false, "a���b"},
+		{"NUL", "label\x00", false, "label"},
+		{"escape sequence", "\x1b[31mCRITICAL\x1b[0m", false, "[31mCRITICAL[0m"},
+		{"DEL and C1", "a\x7fb\u0085c", false, "abc"},
+		{"newlines in single line", "line1\r\nline2\ttab", false, "line1line2tab"},
+		{"newlines in multiline", "line1\r\nline2\ttab", true, "line1\nline2\ttab"},
+		{"controls in multiline", "ok\x00\x07\x08\n", true, "ok\n"},
+		{"replacement character", "�", false, "�"},
+		{"empty", "", true, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if s := SanitizeString(tc.input, tc.multiline); s != tc.expect {
+				t.Errorf("SanitizeString(%q, %t) should be %q but %q", tc.input, tc.multiline, tc.expect, s)
+			}
+		})
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		input  string
+		max    int
+		expect string
+	}{
+		{"abcdef", 0, "abcdef"},
+		{"abcdef", 6, "abcdef"},
+		{"abcdef", 5, "ab..."},
+		{"あいうえお", 4, "あ..."},
+		{"abcdef", 3, "..."},
+		{"abcdef", 2, ".."},
+	}
+	for _, tc := range tests {
+		if s := TruncateString(tc.input, tc.max); s != tc.expect {
+			t.Errorf("TruncateString(%q, %d) should be %q but %q", tc.input, tc.max, tc.expect, s)
+		}
+	}
+}
+
+func TestSanitizeValue(t *testing.T) {
+	type label string
+	type spec struct {
+		Name    string
+		Label   label
+		Labels  map[string]interface{}
+		Devices []map[string]string
+		Next    *spec
+		Size    int
+		Raw     []byte
+		hidden  string
+	}
+	v := &spec{
+		Name:    "host\x00name",
+		Label:   "\xffroot",
+		Labels:  map[string]interface{}{"dev\x01": "sda\x1b", "nested": []interface{}{"ok", "a\tb", 1.5, nil}},
+		Devices: []map[string]string{{"model": "0123456789"}},
+		Next:    &spec{Name: "next\x7f"},
+		Size:    10,
+		Raw:     []byte("\x00"),
+		hidden:  "\x00",
+	}
+	got := SanitizeValue(v, false, 8).(*spec)
+	expect := &spec{
+		Name:    "hostname",
+		Label:   "�root",
+		Labels:  map[string]interface{}{"dev": "sda", "nested": []interface{}{"ok", "ab", 1.5, nil}},
+		Devices: []map[string]string{{"model": "01234..."}},
+		Next:    &spec{Name: "next"},
+		Size:    10,
+		Raw:     []byte("\x00"),
+		hidden:  "\x00",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("SanitizeValue should be %+v but %+v", expect, got)
+	}
+	if v.Name != "host\x00name" || v.Labels["dev\x01"] != "sda\x1b" || v.Devices[0]["model"] != "0123456789" || v.Next.Name != "next\x7f" {
+		t.Errorf("SanitizeValue should not modify the value: %+v", v)
+	}
+	if SanitizeValue(nil, false, 0) != nil {
+		t.Error("SanitizeValue(nil) should be nil")
+	}
+	if s := SanitizeValue("a\nb", true, 0); s != "a\nb" {
+		t.Errorf("SanitizeValue should keep the newlines in multiline but %q", s)
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"syscall"
 	"unsafe"
 
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent/logformat"
 )
 
 // FilesystemInfo XXX
@@ -23,7 +23,7 @@ type FilesystemInfo struct {
 	FsType      string
 }
 
-var windowsLogger = logging.GetLogger("windows")
+var windowsLogger = logformat.GetLogger("windows")
 
 // CollectFilesystemValues XXX
 func CollectFilesystemValues() (map[string]FilesystemInfo, error) {
@@ -0,0 +1,111 @@
+// +build windows
+
+package windows
+
+import (
+	"unsafe"
+
+	xwindows "golang.org/x/sys/windows"
+)
+
+// Service represents a Win32 service registered to the service control manager.
+type Service struct {
+	Name        string
+	DisplayName string
+	StartType   string
+	State       string
+}
+
+var serviceStartTypes = map[uint32]string{
+	xwindows.SERVICE_BOOT_START:   "boot",
+	xwindows.SERVICE_SYSTEM_START: "system",
+	xwindows.SERVICE_AUTO_START:   "auto",
+	xwindows.SERVICE_DEMAND_START: "manual",
+	xwindows.SERVICE_DISABLED:     "disabled",
+}
+
+var serviceStates = map[uint32]string{
+	xwindows.SERVICE_STOPPED:          "stopped",
+	xwindows.SERVICE_START_PENDING:    "start_pending",
+	xwindows.SERVICE_STOP_PENDING:     "stop_pending",
+	xwindows.SERVICE_RUNNING:          "running",
+	xwindows.SERVICE_CONTINUE_PENDING: "continue_pending",
+	xwindows.SERVICE_PAUSE_PENDING:    "pause_pending",
+	xwindows.SERVICE_PAUSED:           "paused",
+}
+
+// CollectServices enumerates the Win32 services by EnumServicesStatusEx.
+// The services whose configurations cannot be queried, such as the protected
+// ones denying the access, are skipped since their start types are unknown.
+func CollectServices() ([]Service, error) {
+	m, err := xwindows.OpenSCManager(nil, nil, xwindows.SC_MANAGER_ENUMERATE_SERVICE)
+	if err != nil {
+		return nil, err
+	}
+	defer xwindows.CloseServiceHandle(m)
+
+	var (
+		services []Service
+		buf      = make([]byte, 64*1024)
+		config   []byte
+		resume   uint32
+	)
+	for {
+		var needed, returned uint32
+		enumErr := xwindows.EnumServicesStatusEx(m, xwindows.SC_ENUM_PROCESS_INFO, xwindows.SERVICE_WIN32,
+			xwindows.SERVICE_STATE_ALL, &buf[0], uint32(len(buf)), &needed, &returned, &resume, nil)
+		if enumErr != nil && enumErr != xwindows.ERROR_MORE_DATA {
+			return nil, enumErr
+		}
+		if returned == 0 && enumErr == xwindows.ERROR_MORE_DATA {
+			// the buffer cannot hold even one service
+			buf = make([]byte, needed)
+			continue
+		}
+		entries := (*[1 << 20]xwindows.ENUM_SERVICE_STATUS_PROCESS)(unsafe.Pointer(&buf[0]))[:returned:returned]
+		for _, e := range entries {
+			var startType uint32
+			startType, config, err = queryServiceStartType(m, e.ServiceName, config)
+			if err != nil {
+				windowsLogger.Debugf("skipped the service %q: %s", utf16PtrToString(e.ServiceName), err)
+				continue
+			}
+			services = append(services, Service{
+				Name:        utf16PtrToString(e.ServiceName),
+				DisplayName: utf16PtrToString(e.DisplayName),
+				StartType:   serviceStartTypes[startType],
+				State:       serviceStates[e.ServiceStatusProcess.CurrentState],
+			})
+		}
+		if enumErr == nil || resume == 0 {
+			return services, nil
+		}
+	}
+}
+
+// queryServiceStartType returns the start type of the service name. buf is
+// the buffer for QueryServiceConfig, which is grown and returned to be reused.
+func queryServiceStartType(m xwindows.Handle, name *uint16, buf []byte) (uint32, []byte, error) {
+	s, err := xwindows.OpenService(m, name, xwindows.SERVICE_QUERY_CONFIG)
+	if err != nil {
+		return 0, buf, err
+	}
+	defer xwindows.CloseServiceHandle(s)
+
+	if len(buf) == 0 {
+		buf = make([]byte, 1024)
+	}
+	for {
+		var needed uint32
+		config := (*xwindows.QUERY_SERVICE_CONFIG)(unsafe.Pointer(&buf[0]))
+		err := xwindows.QueryServiceConfig(s, config, uint32(len(buf)), &needed)
+		if err == xwindows.ERROR_INSUFFICIENT_BUFFER && int(needed) > len(buf) {
+			buf = make([]byte, needed)
+			continue
+		}
+		if err != nil {
+			return 0, buf, err
+		}
+		return config.StartType, buf, nil
+	}
+}
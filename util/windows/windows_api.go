@@ -3,6 +3,7 @@
 package windows
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 	"unsafe"
@@ -18,6 +19,10 @@ typedef struct _PDH_FMT_COUNTERVALUE_DOUBLE {
 	DWORD  CStatus;
 	double DoubleValue;
 } PDH_FMT_COUNTERVALUE_DOUBLE;
+typedef struct _PDH_FMT_COUNTERVALUE_ITEM_DOUBLE {
+	unsigned short *szName;
+	PDH_FMT_COUNTERVALUE_DOUBLE FmtValue;
+} PDH_FMT_COUNTERVALUE_ITEM_DOUBLE;
 */
 import "C"
 
@@ -61,6 +66,15 @@ const (
 	PDH_INVALID_DATA     = 0xc0000bc6
 	PDH_INVALID_HANDLE   = 0xC0000bbc
 	PDH_NO_DATA          = 0x800007d5
+	PDH_MORE_DATA        = 0x800007d2
+
+	PDH_CSTATUS_VALID_DATA   = 0x00000000
+	PDH_CSTATUS_NEW_DATA     = 0x00000001
+	PDH_CSTATUS_NO_INSTANCE  = 0x800007d1
+	PDH_CSTATUS_NO_OBJECT    = 0xc0000bb8
+	PDH_CSTATUS_NO_COUNTER   = 0xc0000bb9
+	PDH_CSTATUS_INVALID_DATA = 0xc0000bba
+	PDH_MAX_COUNTER_NAME     = 1024
 )
 
 // windows procs
@@ -71,6 +85,7 @@ var (
 
 	RegGetValue                 = modadvapi32.NewProc("RegGetValueW")
 	GetSystemInfo               = modkernel32.NewProc("GetSystemInfo")
+	GetSystemTimes              = modkernel32.NewProc("GetSystemTimes")
 	GetDiskFreeSpaceEx          = modkernel32.NewProc("GetDiskFreeSpaceExW")
 	GetLogicalDriveStrings      = modkernel32.NewProc("GetLogicalDriveStringsW")
 	GetDriveType                = modkernel32.NewProc("GetDriveTypeW")
@@ -81,6 +96,9 @@ var (
 	MultiByteToWideChar         = modkernel32.NewProc("MultiByteToWideChar")
 	PdhOpenQuery                = modpdh.NewProc("PdhOpenQuery")
 	PdhAddCounter               = modpdh.NewProc("PdhAddCounterW")
+	PdhAddEnglishCounter        = modpdh.NewProc("PdhAddEnglishCounterW")
+	PdhLookupPerfNameByIndex    = modpdh.NewProc("PdhLookupPerfNameByIndexW")
+	PdhGetFormattedCounterArray = modpdh.NewProc("PdhGetFormattedCounterArrayW")
 	PdhCollectQueryData         = modpdh.NewProc("PdhCollectQueryData")
 	PdhGetFormattedCounterValue = modpdh.NewProc("PdhGetFormattedCounterValue")
 	PdhCloseQuery               = modpdh.NewProc("PdhCloseQuery")
@@ -184,6 +202,124 @@ func GetCounterValue(counter syscall.Handle) (float64, error) {
 	return float64(value.DoubleValue), nil
 }
 
+// PdhError is the status code returned by the PDH functions.
+type PdhError uint32
+
+func (e PdhError) Error() string {
+	return fmt.Sprintf("PDH error 0x%08x", uint32(e))
+}
+
+// AddCounter adds the counter of path to query. If english is true, path
+// is of the English names regardless of the language of Windows.
+func AddCounter(query syscall.Handle, path string, english bool) (syscall.Handle, error) {
+	proc := PdhAddCounter
+	if english {
+		proc = PdhAddEnglishCounter
+	}
+	var counter syscall.Handle
+	r, _, _ := proc.Call(
+		uintptr(query),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(path))),
+		0,
+		uintptr(unsafe.Pointer(&counter)))
+	if r != 0 {
+		return 0, PdhError(r)
+	}
+	return counter, nil
+}
+
+// LookupPerfNameByIndex returns the localized name of the object or the
+// counter of the index.
+func LookupPerfNameByIndex(index uint32) (string, error) {
+	buf := make([]uint16, PDH_MAX_COUNTER_NAME)
+	size := uint32(len(buf))
+	r, _, _ := PdhLookupPerfNameByIndex.Call(
+		0,
+		uintptr(index),
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(unsafe.Pointer(&size)))
+	if r != 0 {
+		return "", PdhError(r)
+	}
+	return syscall.UTF16ToString(buf), nil
+}
+
+// GetFormattedCounterValue gets the value of the counter. If the value is
+// not valid, the error is PdhError of its status, such as
+// PDH_CSTATUS_NO_INSTANCE for the instance which does not exist.
+func GetFormattedCounterValue(counter syscall.Handle) (float64, error) {
+	var value C.PDH_FMT_COUNTERVALUE_DOUBLE
+	r, _, _ := PdhGetFormattedCounterValue.Call(uintptr(counter), PDH_FMT_DOUBLE, uintptr(0), uintptr(unsafe.Pointer(&value)))
+	if r == PDH_INVALID_DATA {
+		return 0, PdhError(value.CStatus)
+	}
+	if r != 0 {
+		return 0, PdhError(r)
+	}
+	return float64(value.DoubleValue), nil
+}
+
+// GetFormattedCounterArray gets the values of the counter of the wildcard
+// instance, keyed by the instance names. The instances of the same name are
+// named name#1, name#2, ... as Performance Monitor does. The values which
+// are not valid are omitted.
+func GetFormattedCounterArray(counter syscall.Handle) (map[string]float64, error) {
+	var size, count uint32
+	r, _, _ := PdhGetFormattedCounterArray.Call(
+		uintptr(counter),
+		PDH_FMT_DOUBLE,
+		uintptr(unsafe.Pointer(&size)),
+		uintptr(unsafe.Pointer(&count)),
+		0)
+	if r != PDH_MORE_DATA {
+		if r == 0 || r == PDH_INVALID_DATA {
+			// no instances
+			return map[string]float64{}, nil
+		}
+		return nil, PdhError(r)
+	}
+	buf := make([]byte, size)
+	r, _, _ = PdhGetFormattedCounterArray.Call(
+		uintptr(counter),
+		PDH_FMT_DOUBLE,
+		uintptr(unsafe.Pointer(&size)),
+		uintptr(unsafe.Pointer(&count)),
+		uintptr(unsafe.Pointer(&buf[0])))
+	if r != 0 {
+		return nil, PdhError(r)
+	}
+	values := make(map[string]float64, count)
+	seen := make(map[string]int, count)
+	items := (*[1 << 20]C.PDH_FMT_COUNTERVALUE_ITEM_DOUBLE)(unsafe.Pointer(&buf[0]))[:count:count]
+	for _, item := range items {
+		name := utf16PtrToString((*uint16)(unsafe.Pointer(item.szName)))
+		if n := seen[name]; n > 0 {
+			seen[name]++
+			name = fmt.Sprintf("%s#%d", name, n)
+		} else {
+			seen[name] = 1
+		}
+		status := uint32(item.FmtValue.CStatus)
+		if status != PDH_CSTATUS_VALID_DATA && status != PDH_CSTATUS_NEW_DATA {
+			continue
+		}
+		values[name] = float64(item.FmtValue.DoubleValue)
+	}
+	return values, nil
+}
+
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	a := (*[1 << 20]uint16)(unsafe.Pointer(p))
+	i := 0
+	for a[i] != 0 {
+		i++
+	}
+	return syscall.UTF16ToString(a[:i])
+}
+
 // GetAdapterList XXX
 func GetAdapterList() (*syscall.IpAdapterInfo, error) {
 	b := make([]byte, 1000)
@@ -1,5 +1,7 @@
 package main
 
-const version = "0.63.0"
+// version and gitcommit are replaced by -ldflags "-X main.version=... -X main.gitcommit=..."
+// at build time, which are posted as the host meta.
+var version = "0.63.0"
 
 var gitcommit string
@@ -16,7 +16,6 @@ FOR /F %%w in (.\wix\pluginlist.txt) DO (
 
 CD %~dp0
 
-go build -o ..\build\wrapper.exe wrapper\wrapper_windows.go wrapper\install.go
 go build -o ..\build\replace.exe replace\replace_windows.go
 go build -o ..\build\generate_wxs.exe generate_wxs\generate_wxs.go
 
@@ -28,6 +27,9 @@ FOR /F "usebackq" %%w IN (`git tag -l --sort=-version:refname "v*"`) DO (
 )
 set VERSION=%VERSION:v=%
 FOR /F "tokens=1 delims=-+" %%w IN ('ECHO %%VERSION%%') DO SET VERSION=%%w
+
+go build -o ..\build\wrapper.exe -ldflags="-X main.version=%VERSION%" wrapper\wrapper_windows.go wrapper\install.go
+
 IF "%VERSION%"=="staging" (
   EXIT /B
 )
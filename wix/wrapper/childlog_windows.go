@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// childLogEnv tees the raw output of mackerel-agent.exe into childLogName next
+// to the wrapper, apart from the event log. See also paramsKey.
+const childLogEnv = "MACKEREL_CHILD_LOG"
+
+const (
+	childLogName = "mackerel-agent-child.log"
+	// childLogFiles is the number of the rotated files, such as
+	// mackerel-agent-child.log.1, which are kept.
+	childLogFiles = 3
+	// childLogQueue is the number of the writes waiting for the file, beyond
+	// which the writes are dropped not to block the pipe of the event log.
+	childLogQueue = 256
+	// childLogFlushTimeout is the time to wait for the queued writes on stop.
+	childLogFlushTimeout = 5 * time.Second
+)
+
+const (
+	defaultChildLogMaxSize = 10 << 20
+	maxChildLogMaxSize     = 1 << 30
+)
+
+// childLog writes the output of the agent into the file byte-for-byte in the
+// background, which is rotated by maxSize. The writes are dropped and counted
+// when the file is slow or fails.
+type childLog struct {
+	// dropped is the first for the 64-bit alignment of atomic on 386
+	dropped uint64
+
+	path    string
+	maxSize int64
+	elog    logger
+
+	mu     sync.Mutex
+	closed bool
+	ch     chan []byte
+	done   chan struct{}
+
+	// used only by the goroutine of run
+	f      *os.File
+	size   int64
+	failed bool
+}
+
+func newChildLog(path string, maxSize int64, elog logger) *childLog {
+	l := &childLog{
+		path:    path,
+		maxSize: maxSize,
+		elog:    elog,
+		ch:      make(chan []byte, childLogQueue),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Write queues p without blocking, which always succeeds.
+func (l *childLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return len(p), nil
+	}
+	select {
+	case l.ch <- append([]byte(nil), p...):
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// launched writes the header of the launch of the agent.
+func (l *childLog) launched(pid int, at time.Time) {
+	fmt.Fprintf(l, "==== mackerel-agent.exe (pid %d) started at %s ====\n", pid, at.Format(time.RFC3339))
+}
+
+// Close writes the queued outputs, and reports the dropped ones.
+func (l *childLog) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.ch)
+	}
+	l.mu.Unlock()
+	select {
+	case <-l.done:
+	case <-time.After(childLogFlushTimeout):
+	}
+	if n := atomic.LoadUint64(&l.dropped); n > 0 {
+		l.elog.Warning(loggerEid, fmt.Sprintf("%d writes of the output of the agent were dropped from %s", n, l.path))
+	}
+	return nil
+}
+
+func (l *childLog) run() {
+	defer close(l.done)
+	defer func() {
+		if l.f != nil {
+			l.f.Close()
+		}
+	}()
+	for b := range l.ch {
+		if err := l.write(b); err != nil {
+			atomic.AddUint64(&l.dropped, 1)
+			// reported once not to flood the event log
+			if !l.failed {
+				l.failed = true
+				l.elog.Warning(loggerEid, fmt.Sprintf("failed to write the output of the agent to %s: %s", l.path, err))
+			}
+		}
+	}
+}
+
+func (l *childLog) write(b []byte) error {
+	if l.f != nil && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		l.f.Close()
+		l.f = nil
+		rotateChildLog(l.path)
+	}
+	if l.f == nil {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		l.f, l.size = f, fi.Size()
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// rotateChildLog renames path to path.1, and the older ones to path.2 and so
+// on up to childLogFiles.
+func rotateChildLog(path string) {
+	os.Remove(fmt.Sprintf("%s.%d", path, childLogFiles))
+	for i := childLogFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	os.Rename(path, path+".1")
+}
+
+func childLogPath() string {
+	return filepath.Join(execdir(), childLogName)
+}
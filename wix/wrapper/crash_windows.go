@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+const crashEid = 7
+
+// crashFile returns the file next to the wrapper which the crashes are
+// written to when the event log is unavailable. It is replaced in the tests.
+var crashFile = func() string {
+	p, err := os.Executable()
+	if err != nil {
+		return "wrapper-crash.log"
+	}
+	return filepath.Join(filepath.Dir(p), "wrapper-crash.log")
+}
+
+// reportCrash writes msg to the event log, or to crashFile if elog is nil or
+// fails, since the console of log.Fatal does not exist in the service.
+func reportCrash(elog logger, msg string) {
+	if elog != nil {
+		if err := elog.Error(crashEid, msg); err == nil {
+			return
+		}
+	}
+	f, err := os.OpenFile(crashFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+}
+
+func panicMessage(r interface{}) string {
+	return fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack())
+}
+
+// recoverPanic reports the panic of the goroutine of the handler, and makes
+// Execute stop the service. It should be deferred at the top of the goroutines.
+func (h *handler) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	reportCrash(h.elog, panicMessage(r))
+	select {
+	case h.crashed <- struct{}{}:
+	default:
+	}
+}
+
+// goSafe runs f in a goroutine by recoverPanic.
+func (h *handler) goSafe(f func()) {
+	go func() {
+		defer h.recoverPanic()
+		f()
+	}()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// eventQueueSize is the number of the lines of the agent waiting for the
+	// event log, beyond which the INFO lines and then the WARNING ones are
+	// dropped. The ERROR lines are never dropped.
+	eventQueueSize = 1000
+	// eventBatchLines and eventBatchBytes are the maximum lines and bytes of
+	// the consecutive lines of the same level combined into an event, whose
+	// message is limited to 31839 characters.
+	eventBatchLines = 20
+	eventBatchBytes = 16 * 1024
+	// eventFlushTimeout is the time to wait for the queued lines on stop.
+	eventFlushTimeout = 5 * time.Second
+)
+
+// eventLine is a paragraph of the logs of the agent, whose level is "" if it
+// has no level, such as the panics.
+type eventLine struct {
+	level string
+	line  string
+}
+
+// The priorities of the lines dropped by the overflow of the queue.
+const (
+	priorityInfo = iota
+	priorityWarning
+	priorityError
+)
+
+func (l eventLine) priority() int {
+	switch l.level {
+	case "TRACE", "DEBUG", "INFO":
+		return priorityInfo
+	case "WARNING":
+		return priorityWarning
+	}
+	return priorityError
+}
+
+// writeEvent writes msg to the event log by the type of level.
+func writeEvent(elog logger, level, msg string) {
+	switch level {
+	case "TRACE", "DEBUG", "INFO":
+		elog.Info(defaultEid, msg)
+	case "WARNING", "ERROR":
+		elog.Warning(defaultEid, msg)
+	default:
+		elog.Error(defaultEid, msg)
+	}
+}
+
+// eventQueue writes the lines of the agent to the event log in the background,
+// so that reading the output of the agent is not blocked by the Event Log API,
+// such as by the hundreds of lines at the start with -v.
+type eventQueue struct {
+	// dropped is the first for the 64-bit alignment of atomic on 386
+	dropped uint64
+
+	elog logger
+	wake chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	lines  []eventLine
+	closed bool
+	// droppedInfo and droppedWarning are the lines dropped since the last
+	// report of them.
+	droppedInfo    int
+	droppedWarning int
+}
+
+func newEventQueue(elog logger) *eventQueue {
+	q := &eventQueue{
+		elog: elog,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues the line without blocking. The oldest INFO line, or the oldest
+// WARNING one unless line is INFO, is dropped if the queue is full, and line
+// itself is dropped if there is no such line and it is not an ERROR one.
+func (q *eventQueue) push(level, line string) {
+	l := eventLine{level: level, line: line}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		writeEvent(q.elog, level, line)
+		return
+	}
+	if len(q.lines) >= eventQueueSize && !q.evict(l.priority()) {
+		q.countDropped(l)
+		q.mu.Unlock()
+		return
+	}
+	q.lines = append(q.lines, l)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// evict drops the oldest line of the lowest priority below priorityError and
+// up to p, and reports whether a line is dropped. The ERROR lines are always
+// queued beyond eventQueueSize.
+func (q *eventQueue) evict(p int) bool {
+	for victim := priorityInfo; victim <= p && victim < priorityError; victim++ {
+		for i, l := range q.lines {
+			if l.priority() == victim {
+				q.countDropped(l)
+				q.lines = append(q.lines[:i], q.lines[i+1:]...)
+				return true
+			}
+		}
+	}
+	return p == priorityError
+}
+
+func (q *eventQueue) countDropped(l eventLine) {
+	atomic.AddUint64(&q.dropped, 1)
+	if l.priority() == priorityInfo {
+		q.droppedInfo++
+	} else {
+		q.droppedWarning++
+	}
+}
+
+// droppedLines returns the number of the lines dropped since the start.
+func (q *eventQueue) droppedLines() uint64 {
+	if q == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Close writes the queued lines, and waits for them up to eventFlushTimeout.
+func (q *eventQueue) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+	case <-time.After(eventFlushTimeout):
+	}
+	return nil
+}
+
+func (q *eventQueue) run() {
+	defer close(q.done)
+	for range q.wake {
+		q.flush()
+	}
+	q.flush()
+}
+
+// flush writes the queued lines, and reports the ones dropped.
+func (q *eventQueue) flush() {
+	q.mu.Lock()
+	lines := q.lines
+	q.lines = nil
+	droppedInfo, droppedWarning := q.droppedInfo, q.droppedWarning
+	q.droppedInfo, q.droppedWarning = 0, 0
+	q.mu.Unlock()
+
+	for len(lines) > 0 {
+		n := batchLines(lines)
+		msgs := make([]string, n)
+		for i, l := range lines[:n] {
+			msgs[i] = l.line
+		}
+		writeEvent(q.elog, lines[0].level, strings.Join(msgs, "\n"))
+		lines = lines[n:]
+	}
+	if droppedInfo > 0 || droppedWarning > 0 {
+		q.elog.Warning(loggerEid, fmt.Sprintf("dropped %d INFO and %d WARNING lines of the agent not to block on the event log", droppedInfo, droppedWarning))
+	}
+}
+
+// batchLines returns the number of the first lines of the same level combined
+// into an event up to eventBatchLines and eventBatchBytes.
+func batchLines(lines []eventLine) int {
+	size := len(lines[0].line)
+	n := 1
+	for ; n < len(lines) && n < eventBatchLines; n++ {
+		l := lines[n]
+		if l.level != lines[0].level || size+1+len(l.line) > eventBatchBytes {
+			break
+		}
+		size += 1 + len(l.line)
+	}
+	return n
+}
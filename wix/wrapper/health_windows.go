@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthEid is the event of the health endpoint by HealthListen.
+const healthEid = 11
+
+// maxHealthErrors is the number of the last error lines of the agent in the
+// health endpoint.
+const maxHealthErrors = 20
+
+// healthShutdownTimeout is the time to wait for the requests to the health
+// endpoint on stop.
+const healthShutdownTimeout = 5 * time.Second
+
+// healthState is the state of the child process served by the health
+// endpoint. The methods do nothing if it is nil.
+type healthState struct {
+	mu        sync.Mutex
+	pid       int
+	running   bool
+	startedAt time.Time
+	exitedAt  time.Time
+	exitCode  int
+	// starts are the starts of the agent by logeventlog.StartedLine, which is
+	// restarted by the supervisor.
+	starts        int
+	lastRestartAt time.Time
+	errors        []string
+}
+
+func (s *healthState) launched(pid int, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pid, s.running, s.startedAt = pid, true, now
+}
+
+func (s *healthState) exited(code int, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running, s.exitCode, s.exitedAt = false, code, now
+}
+
+func (s *healthState) started(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.starts++
+	if s.starts > 1 {
+		s.lastRestartAt = now
+	}
+}
+
+// forwarded records the line forwarded to the event log at level, which is ""
+// for the lines without the levels, such as the panics.
+func (s *healthState) forwarded(level, line string) {
+	if s == nil {
+		return
+	}
+	switch level {
+	case "ERROR", "CRITICAL", "":
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errors) >= maxHealthErrors {
+		s.errors = append(s.errors[:0], s.errors[len(s.errors)-maxHealthErrors+1:]...)
+	}
+	s.errors = append(s.errors, line)
+}
+
+type healthReport struct {
+	Version       string     `json:"version"`
+	State         string     `json:"state"`
+	ChildPID      int        `json:"childPid,omitempty"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	ExitedAt      *time.Time `json:"exitedAt,omitempty"`
+	ExitCode      *int       `json:"exitCode,omitempty"`
+	Restarts      int        `json:"restarts"`
+	LastRestartAt *time.Time `json:"lastRestartAt,omitempty"`
+	Errors        []string   `json:"errors"`
+}
+
+func (s *healthState) report() healthReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := healthReport{Version: version, State: "stopped", ChildPID: s.pid, Errors: append([]string{}, s.errors...)}
+	timeOf := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	r.StartedAt, r.LastRestartAt = timeOf(s.startedAt), timeOf(s.lastRestartAt)
+	if s.running {
+		r.State = "running"
+	} else if !s.exitedAt.IsZero() {
+		code := s.exitCode
+		r.ExitedAt, r.ExitCode = timeOf(s.exitedAt), &code
+	}
+	if s.starts > 1 {
+		r.Restarts = s.starts - 1
+	}
+	return r
+}
+
+// ServeHTTP serves the report in JSON, whose status is 503 unless the child
+// process is running.
+func (s *healthState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	report := s.report()
+	w.Header().Set("Content-Type", "application/json")
+	if report.State != "running" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// validateHealthListen returns the error of HealthListen, which should be a
+// loopback address unless allowRemote.
+func validateHealthListen(address string, allowRemote bool) error {
+	host, port, err := net.SplitHostPort(address)
+	if err == nil {
+		if n, e := strconv.Atoi(port); e != nil || n <= 0 || n > 65535 {
+			err = fmt.Errorf("invalid port %q", port)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Parameters\\HealthListen should be host:port, but %q", address)
+	}
+	if allowRemote || host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Parameters\\HealthListen should be a loopback address, such as 127.0.0.1:7181, unless Parameters\\HealthAllowRemote is 1, but %q", address)
+	}
+	return nil
+}
+
+// serveHealth starts the health endpoint by HealthListen if configured, and
+// returns the function to stop it.
+func (h *handler) serveHealth() func() {
+	if h.opts.HealthListen == "" || h.health == nil {
+		return func() {}
+	}
+	ln, err := net.Listen("tcp", h.opts.HealthListen)
+	if err != nil {
+		h.elog.Error(healthEid, fmt.Sprintf("failed to listen the health endpoint: %s", err))
+		return func() {}
+	}
+	scheme := "http"
+	if h.opts.HealthCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(h.opts.HealthCertFile, h.opts.HealthKeyFile)
+		if err != nil {
+			ln.Close()
+			h.elog.Error(healthEid, fmt.Sprintf("failed to load the certificate of the health endpoint: %s", err))
+			return func() {}
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		scheme = "https"
+	}
+	srv := &http.Server{Handler: h.health, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	h.goSafe(func() {
+		defer close(done)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			h.elog.Error(healthEid, fmt.Sprintf("the health endpoint stopped: %s", err))
+		}
+	})
+	h.elog.Info(healthEid, fmt.Sprintf("serving the health endpoint on %s://%s", scheme, ln.Addr()))
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+		<-done
+	}
+}
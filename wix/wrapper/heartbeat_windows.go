@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+const (
+	// wrapperEid is the event of the start of the wrapper, which is written
+	// first after the event log is opened.
+	wrapperEid = 8
+	// heartbeatEid is the event written in HeartbeatInterval while the service
+	// is running, whose absence tells that the wrapper is hung or dead.
+	heartbeatEid = 9
+)
+
+// defaultHeartbeatInterval is the default of HeartbeatInterval.
+const defaultHeartbeatInterval = time.Hour
+
+// maxHeartbeatInterval is the maximum of HeartbeatIntervalMinutes.
+const maxHeartbeatInterval = 24 * time.Hour
+
+// startingMessage returns the message of the start of the wrapper. The path
+// of the agent is read quietly, since the invalid parameters are reported
+// after the event log is opened.
+func startingMessage() (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprintf("wrapper starting, version %s, child path unknown: %v", version, r)
+		}
+	}()
+	return fmt.Sprintf("wrapper starting, version %s, child path %s", version, loadOptions(nil).AgentPath)
+}
+
+// exitHandler stops the service by the service-specific exit code, so that
+// the cause is shown by `sc query` even if nothing is written to the event log.
+type exitHandler uint32
+
+func (code exitHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	return true, uint32(code)
+}
+
+// started counts the starts of the agent by logeventlog.StartedLine.
+func (h *handler) started() {
+	atomic.AddUint32(&h.starts, 1)
+	h.health.started(time.Now())
+}
+
+// heartbeatMessage returns the message of the heartbeat. The restarts are the
+// ones of the agent by the supervisor, and the dropped lines are the logs of
+// the agent dropped by the overflow of the event log queue.
+func (h *handler) heartbeatMessage() string {
+	pid := 0
+	if h.cmd != nil && h.cmd.Process != nil {
+		pid = h.cmd.Process.Pid
+	}
+	var restarts uint32
+	if n := atomic.LoadUint32(&h.starts); n > 0 {
+		restarts = n - 1
+	}
+	msg := fmt.Sprintf("wrapper alive, child pid %d, restarts %d", pid, restarts)
+	if n := h.events.droppedLines(); n > 0 {
+		msg += fmt.Sprintf(", dropped lines %d", n)
+	}
+	return msg
+}
+
+// heartbeat returns the channel of the next heartbeat, or nil if disabled.
+func (h *handler) heartbeat() <-chan time.Time {
+	if h.opts.HeartbeatInterval <= 0 {
+		return nil
+	}
+	return time.After(h.opts.HeartbeatInterval)
+}
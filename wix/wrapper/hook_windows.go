@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/cmdutil"
+	"golang.org/x/sys/windows/svc"
+)
+
+// hookEid is the event of PreStartCommand and PostStopCommand.
+const hookEid = 12
+
+// The defaults and the maximums of the timeouts of the hooks.
+const (
+	defaultHookTimeout = time.Minute
+	maxHookTimeout     = time.Hour
+)
+
+// maxHookOutput is the maximum bytes of the output of a hook in the event,
+// whose message is limited to 31839 characters.
+const maxHookOutput = eventBatchBytes
+
+// runHook runs command of the hook by cmd /c up to timeout or until ctx is
+// done, and writes its output to elog. It returns the error if the command
+// fails or exits with non-zero.
+func runHook(ctx context.Context, hook, command string, timeout time.Duration, elog logger) error {
+	start := time.Now()
+	elog.Info(hookEid, fmt.Sprintf("running %s up to %s: %s", hook, timeout, command))
+	stdout, stderr, exitCode, err := cmdutil.RunCommandContext(ctx, command, cmdutil.CommandOption{TimeoutDuration: timeout})
+	output := hookOutput(stdout, stderr)
+	switch {
+	case cmdutil.IsTimedOut(err):
+		err = fmt.Errorf("%s timed out in %s", hook, timeout)
+	case err != nil:
+		err = fmt.Errorf("%s failed: %s", hook, err)
+	case exitCode != 0:
+		err = fmt.Errorf("%s exited with %d", hook, exitCode)
+	}
+	if err != nil {
+		if output != "" {
+			err = fmt.Errorf("%s:\n%s", err, output)
+		}
+		return err
+	}
+	msg := fmt.Sprintf("%s finished in %s", hook, time.Since(start).Round(time.Millisecond))
+	if output != "" {
+		msg += ":\n" + output
+	}
+	elog.Info(hookEid, msg)
+	return nil
+}
+
+// hookOutput returns stdout and stderr of a hook up to maxHookOutput.
+func hookOutput(stdout, stderr string) string {
+	output := strings.TrimSpace(strings.TrimSpace(stdout) + "\n" + strings.TrimSpace(stderr))
+	if len(output) > maxHookOutput {
+		output = output[:maxHookOutput] + "..."
+	}
+	return output
+}
+
+// runPreStart runs PreStartCommand, whose failure stops starting the agent by
+// PreStartAbortOnFailure, and otherwise is warned. It returns
+// errPrestartCanceled if cancel is closed while running.
+func runPreStart(opts options, elog logger, cancel <-chan struct{}) error {
+	if opts.PreStartCommand == "" {
+		return nil
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	err := runHook(ctx, "PreStartCommand", opts.PreStartCommand, opts.PreStartTimeout, elog)
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-cancel:
+		return errPrestartCanceled
+	default:
+	}
+	if opts.PreStartAbortOnFailure {
+		return err
+	}
+	elog.Warning(hookEid, fmt.Sprintf("starting the agent anyway since Parameters\\PreStartAbortOnFailure is 0: %s", err))
+	return nil
+}
+
+// postStop runs PostStopCommand after the agent stopped, reporting StopPending
+// to s while running.
+func (h *handler) postStop(s chan<- svc.Status) {
+	if h.opts.PostStopCommand == "" {
+		return
+	}
+	s <- svc.Status{State: svc.StopPending, WaitHint: uint32(h.opts.PostStopTimeout / time.Millisecond)}
+	if err := runHook(context.Background(), "PostStopCommand", h.opts.PostStopCommand, h.opts.PostStopTimeout, h.elog); err != nil {
+		h.elog.Error(hookEid, err.Error())
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// paramsKey is the key of the options of the wrapper, which can be managed by
+// Group Policy. The values override the environment variables of the service
+// in HKLM\SYSTEM\CurrentControlSet\Services\mackerel-agent\Environment.
+//
+//	Value                     Type       Environment variable          Default
+//	AutoRetirement            REG_DWORD  MACKEREL_AUTO_RETIREMENT      0
+//	StopTimeoutSeconds        REG_DWORD                                20 (1 to 3600)
+//	Supervise                 REG_DWORD  MACKEREL_SUPERVISE            0
+//	AgentPath                 REG_SZ                                   mackerel-agent.exe next to the wrapper
+//	AgentSHA256               REG_SZ     MACKEREL_AGENT_SHA256         (not verified)
+//	VerifyAuthenticode        REG_DWORD  MACKEREL_VERIFY_AUTHENTICODE  0
+//	AgentThumbprint           REG_SZ     MACKEREL_AGENT_THUMBPRINT     (required by VerifyAuthenticode)
+//	ChildLog                  REG_DWORD  MACKEREL_CHILD_LOG            0
+//	ChildLogMaxSizeMB         REG_DWORD                                10 (1 to 1024)
+//	HeartbeatIntervalMinutes  REG_DWORD                                60 (0 not to write, up to 1440)
+//	StartDelaySeconds         REG_DWORD                                0 (up to 3600)
+//	WaitForTCP                REG_SZ                                   (not waited, such as "vpn.example.com:443")
+//	WaitTimeoutSeconds        REG_DWORD                                300 (1 to 3600)
+//	HealthListen              REG_SZ                                   (not served, such as "127.0.0.1:7181")
+//	HealthAllowRemote         REG_DWORD                                0 (1 to listen on the non-loopback addresses)
+//	HealthCertFile            REG_SZ                                   (HTTP, HTTPS if both are given)
+//	HealthKeyFile             REG_SZ                                   (HTTP, HTTPS if both are given)
+//	PreStartCommand           REG_SZ                                   (not run, such as "C:\mount.bat")
+//	PreStartTimeoutSeconds    REG_DWORD                                60 (1 to 3600)
+//	PreStartAbortOnFailure    REG_DWORD                                1 (0 to start the agent with the warning)
+//	PostStopCommand           REG_SZ                                   (not run, such as "C:\unmount.bat")
+//	PostStopTimeoutSeconds    REG_DWORD                                60 (1 to 3600)
+//
+// The values are read again by `sc control mackerel-agent paramchange`.
+// AutoRetirement, StopTimeoutSeconds, HeartbeatIntervalMinutes and the
+// PostStop ones are applied immediately, and the others used to start
+// mackerel-agent.exe are applied by restarting the service.
+const paramsKey = `SYSTEM\CurrentControlSet\Services\` + name + `\Parameters`
+
+const (
+	autoRetirementEnv = "MACKEREL_AUTO_RETIREMENT"
+	superviseEnv      = "MACKEREL_SUPERVISE"
+)
+
+// maxStopTimeout is the maximum of StopTimeoutSeconds, which is also the wait
+// hint to the service control manager.
+const maxStopTimeout = time.Hour
+
+// options are the options of the wrapper.
+type options struct {
+	AutoRetirement bool
+	StopTimeout    time.Duration
+	// HeartbeatInterval is the interval of the heartbeat events, which are not
+	// written if zero.
+	HeartbeatInterval time.Duration
+
+	// the options to start mackerel-agent.exe, which are applied by restarting
+	// the service
+	Supervise          bool
+	AgentPath          string
+	AgentSHA256        string
+	VerifyAuthenticode bool
+	// AgentThumbprints are the thumbprints of the certificates one of which
+	// should have signed the agent verified by VerifyAuthenticode.
+	AgentThumbprints []string
+	// ChildLog tees the raw output into childLogName, which is rotated by
+	// ChildLogMaxSize in bytes.
+	ChildLog        bool
+	ChildLogMaxSize int64
+	// StartDelay and WaitForTCP, the address which should accept the
+	// connections within WaitTimeout, are waited before starting the agent.
+	StartDelay  time.Duration
+	WaitForTCP  string
+	WaitTimeout time.Duration
+	// HealthListen is the address of the health endpoint, which is served in
+	// HTTPS by HealthCertFile and HealthKeyFile if given.
+	HealthListen      string
+	HealthAllowRemote bool
+	HealthCertFile    string
+	HealthKeyFile     string
+	// PreStartCommand and PostStopCommand are the hooks run by cmd /c before
+	// starting the agent and after it stopped, such as to mount the volume of
+	// the config file. The agent is not started if PreStartCommand fails
+	// unless PreStartAbortOnFailure is false.
+	PreStartCommand        string
+	PreStartTimeout        time.Duration
+	PreStartAbortOnFailure bool
+	PostStopCommand        string
+	PostStopTimeout        time.Duration
+}
+
+func envBool(key string) bool {
+	env := os.Getenv(key)
+	return env != "" && env != "0"
+}
+
+// defaultOptions returns the options by the environment variables.
+func defaultOptions() options {
+	// the invalid thumbprints refuse to launch the agent by VerifyAuthenticode
+	thumbprints, _ := parseThumbprints(os.Getenv(agentThumbprintEnv))
+	return options{
+		AutoRetirement:     envBool(autoRetirementEnv),
+		StopTimeout:        defaultStopTimeout,
+		HeartbeatInterval:  defaultHeartbeatInterval,
+		Supervise:          envBool(superviseEnv),
+		AgentPath:          filepath.Join(execdir(), "mackerel-agent.exe"),
+		AgentSHA256:        strings.TrimSpace(os.Getenv(agentSHA256Env)),
+		VerifyAuthenticode: envBool(verifyAuthenticodeEnv),
+		AgentThumbprints:   thumbprints,
+		ChildLog:           envBool(childLogEnv),
+		ChildLogMaxSize:    defaultChildLogMaxSize,
+		WaitTimeout:        defaultWaitTimeout,
+		PreStartTimeout:    defaultHookTimeout,
+		// the agent would fail to start without the config of the volume
+		PreStartAbortOnFailure: true,
+		PostStopTimeout:        defaultHookTimeout,
+	}
+}
+
+// valueReader reads the values of the registry key, which is registry.Key.
+type valueReader interface {
+	GetIntegerValue(name string) (uint64, uint32, error)
+	GetStringValue(name string) (string, uint32, error)
+}
+
+// readOptions overrides opts by the values of key. The invalid values are
+// returned as the errors, and the defaults are used instead of them.
+func readOptions(key valueReader, opts options) (options, []error) {
+	var errs []error
+	readBool := func(name string, v *bool) {
+		n, ok := readDWORD(key, name, &errs)
+		if !ok {
+			return
+		}
+		if n > 1 {
+			errs = append(errs, fmt.Errorf("Parameters\\%s should be 0 or 1, but %d", name, n))
+			return
+		}
+		*v = n == 1
+	}
+	readBool("AutoRetirement", &opts.AutoRetirement)
+	if n, ok := readDWORD(key, "StopTimeoutSeconds", &errs); ok {
+		if d := time.Duration(n) * time.Second; n == 0 || d > maxStopTimeout {
+			errs = append(errs, fmt.Errorf("Parameters\\StopTimeoutSeconds should be in the range of 1 to %d, but %d", maxStopTimeout/time.Second, n))
+		} else {
+			opts.StopTimeout = d
+		}
+	}
+	if n, ok := readDWORD(key, "HeartbeatIntervalMinutes", &errs); ok {
+		if d := time.Duration(n) * time.Minute; d > maxHeartbeatInterval {
+			errs = append(errs, fmt.Errorf("Parameters\\HeartbeatIntervalMinutes should be in the range of 0 to %d, but %d", maxHeartbeatInterval/time.Minute, n))
+		} else {
+			opts.HeartbeatInterval = d
+		}
+	}
+	readBool("Supervise", &opts.Supervise)
+	if s, ok := readString(key, "AgentPath", &errs); ok {
+		if !filepath.IsAbs(s) {
+			errs = append(errs, fmt.Errorf("Parameters\\AgentPath should be an absolute path, but %q", s))
+		} else {
+			opts.AgentPath = s
+		}
+	}
+	if s, ok := readString(key, "AgentSHA256", &errs); ok {
+		s = strings.TrimSpace(s)
+		if len(s) != 64 || strings.Trim(strings.ToLower(s), "0123456789abcdef") != "" {
+			errs = append(errs, fmt.Errorf("Parameters\\AgentSHA256 should be SHA-256 in hex, but %q", s))
+		} else {
+			opts.AgentSHA256 = s
+		}
+	}
+	readBool("VerifyAuthenticode", &opts.VerifyAuthenticode)
+	if s, ok := readString(key, "AgentThumbprint", &errs); ok {
+		if thumbprints, err := parseThumbprints(s); err != nil {
+			errs = append(errs, fmt.Errorf("Parameters\\AgentThumbprint: %s", err))
+		} else {
+			opts.AgentThumbprints = thumbprints
+		}
+	}
+	readBool("ChildLog", &opts.ChildLog)
+	if n, ok := readDWORD(key, "ChildLogMaxSizeMB", &errs); ok {
+		if size := int64(n) << 20; n == 0 || size > maxChildLogMaxSize {
+			errs = append(errs, fmt.Errorf("Parameters\\ChildLogMaxSizeMB should be in the range of 1 to %d, but %d", maxChildLogMaxSize>>20, n))
+		} else {
+			opts.ChildLogMaxSize = size
+		}
+	}
+	if n, ok := readDWORD(key, "StartDelaySeconds", &errs); ok {
+		if d := time.Duration(n) * time.Second; d > maxStartDelay {
+			errs = append(errs, fmt.Errorf("Parameters\\StartDelaySeconds should be in the range of 0 to %d, but %d", maxStartDelay/time.Second, n))
+		} else {
+			opts.StartDelay = d
+		}
+	}
+	if s, ok := readString(key, "WaitForTCP", &errs); ok {
+		s = strings.TrimSpace(s)
+		if _, port, err := net.SplitHostPort(s); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("Parameters\\WaitForTCP should be host:port, but %q", s))
+		} else {
+			opts.WaitForTCP = s
+		}
+	}
+	if n, ok := readDWORD(key, "WaitTimeoutSeconds", &errs); ok {
+		if d := time.Duration(n) * time.Second; n == 0 || d > maxWaitTimeout {
+			errs = append(errs, fmt.Errorf("Parameters\\WaitTimeoutSeconds should be in the range of 1 to %d, but %d", maxWaitTimeout/time.Second, n))
+		} else {
+			opts.WaitTimeout = d
+		}
+	}
+	readBool("HealthAllowRemote", &opts.HealthAllowRemote)
+	if s, ok := readString(key, "HealthListen", &errs); ok {
+		s = strings.TrimSpace(s)
+		if err := validateHealthListen(s, opts.HealthAllowRemote); err != nil {
+			errs = append(errs, err)
+		} else {
+			opts.HealthListen = s
+		}
+	}
+	certFile, hasCert := readString(key, "HealthCertFile", &errs)
+	keyFile, hasKey := readString(key, "HealthKeyFile", &errs)
+	if hasCert != hasKey {
+		errs = append(errs, fmt.Errorf("Parameters\\HealthCertFile and Parameters\\HealthKeyFile should be given together"))
+	} else if hasCert {
+		opts.HealthCertFile, opts.HealthKeyFile = certFile, keyFile
+	}
+	readHookTimeout := func(name string, v *time.Duration) {
+		if n, ok := readDWORD(key, name, &errs); ok {
+			if d := time.Duration(n) * time.Second; n == 0 || d > maxHookTimeout {
+				errs = append(errs, fmt.Errorf("Parameters\\%s should be in the range of 1 to %d, but %d", name, maxHookTimeout/time.Second, n))
+			} else {
+				*v = d
+			}
+		}
+	}
+	if s, ok := readString(key, "PreStartCommand", &errs); ok {
+		opts.PreStartCommand = strings.TrimSpace(s)
+	}
+	readHookTimeout("PreStartTimeoutSeconds", &opts.PreStartTimeout)
+	readBool("PreStartAbortOnFailure", &opts.PreStartAbortOnFailure)
+	if s, ok := readString(key, "PostStopCommand", &errs); ok {
+		opts.PostStopCommand = strings.TrimSpace(s)
+	}
+	readHookTimeout("PostStopTimeoutSeconds", &opts.PostStopTimeout)
+	return opts, errs
+}
+
+func readDWORD(key valueReader, name string, errs *[]error) (uint64, bool) {
+	n, typ, err := key.GetIntegerValue(name)
+	if err == registry.ErrNotExist {
+		return 0, false
+	}
+	if err != nil || typ != registry.DWORD {
+		*errs = append(*errs, fmt.Errorf("Parameters\\%s should be REG_DWORD", name))
+		return 0, false
+	}
+	return n, true
+}
+
+func readString(key valueReader, name string, errs *[]error) (string, bool) {
+	s, _, err := key.GetStringValue(name)
+	if err == registry.ErrNotExist {
+		return "", false
+	}
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("Parameters\\%s should be REG_SZ or REG_EXPAND_SZ", name))
+		return "", false
+	}
+	if s == "" {
+		return "", false
+	}
+	return s, true
+}
+
+// loadOptions reads the options from the registry, and reports the invalid
+// values to the event log unless elog is nil.
+func loadOptions(elog logger) options {
+	opts := defaultOptions()
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, paramsKey, registry.QUERY_VALUE)
+	if err != nil {
+		if err != registry.ErrNotExist && elog != nil {
+			elog.Error(paramsEid, fmt.Sprintf("failed to open %s: %s", paramsKey, err))
+		}
+		return opts
+	}
+	defer k.Close()
+	opts, errs := readOptions(k, opts)
+	if elog != nil {
+		for _, err := range errs {
+			elog.Error(paramsEid, err.Error())
+		}
+	}
+	return opts
+}
+
+// reload applies the new options except the ones to start mackerel-agent.exe,
+// and returns the names of the ones which are changed but not applied.
+func (o *options) reload(n options) []string {
+	var pending []string
+	if n.Supervise != o.Supervise {
+		pending = append(pending, "Supervise")
+	}
+	if n.AgentPath != o.AgentPath {
+		pending = append(pending, "AgentPath")
+	}
+	if n.AgentSHA256 != o.AgentSHA256 {
+		pending = append(pending, "AgentSHA256")
+	}
+	if n.VerifyAuthenticode != o.VerifyAuthenticode {
+		pending = append(pending, "VerifyAuthenticode")
+	}
+	if strings.Join(n.AgentThumbprints, ",") != strings.Join(o.AgentThumbprints, ",") {
+		pending = append(pending, "AgentThumbprint")
+	}
+	if n.ChildLog != o.ChildLog {
+		pending = append(pending, "ChildLog")
+	}
+	if n.ChildLogMaxSize != o.ChildLogMaxSize {
+		pending = append(pending, "ChildLogMaxSizeMB")
+	}
+	if n.HealthListen != o.HealthListen || n.HealthAllowRemote != o.HealthAllowRemote {
+		pending = append(pending, "HealthListen")
+	}
+	if n.HealthCertFile != o.HealthCertFile || n.HealthKeyFile != o.HealthKeyFile {
+		pending = append(pending, "HealthCertFile")
+	}
+	o.AutoRetirement = n.AutoRetirement
+	o.StopTimeout = n.StopTimeout
+	o.HeartbeatInterval = n.HeartbeatInterval
+	o.PostStopCommand = n.PostStopCommand
+	o.PostStopTimeout = n.PostStopTimeout
+	return pending
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// prestartEid is the event of the waits before starting the agent by
+// StartDelaySeconds and WaitForTCP.
+const prestartEid = 10
+
+// The defaults and the maximums of the waits before starting the agent.
+const (
+	maxStartDelay      = time.Hour
+	defaultWaitTimeout = 5 * time.Minute
+	maxWaitTimeout     = time.Hour
+)
+
+var (
+	// prestartCheckpointInterval is the interval to report the progress of the
+	// waits as the checkpoints to the service control manager.
+	prestartCheckpointInterval = 10 * time.Second
+	// prestartProgressInterval is the interval of the progress events.
+	prestartProgressInterval = time.Minute
+	// prestartRetryInterval is the interval of the connections to WaitForTCP.
+	prestartRetryInterval = 2 * time.Second
+)
+
+// maxPrestartDialTimeout is the timeout of each connection to WaitForTCP.
+const maxPrestartDialTimeout = 5 * time.Second
+
+var errPrestartCanceled = errors.New("canceled")
+
+func dialTCP(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// waitPrestart waits StartDelay, and then for WaitForTCP to accept the
+// connections within WaitTimeout. The progress is written to elog. It returns
+// errPrestartCanceled if cancel is closed while waiting.
+func waitPrestart(opts options, elog logger, dial func(address string, timeout time.Duration) error, cancel <-chan struct{}) error {
+	if opts.StartDelay > 0 {
+		elog.Info(prestartEid, fmt.Sprintf("delaying the start of the agent for %s", opts.StartDelay))
+		select {
+		case <-cancel:
+			return errPrestartCanceled
+		case <-time.After(opts.StartDelay):
+		}
+	}
+	if opts.WaitForTCP == "" {
+		return nil
+	}
+
+	start := time.Now()
+	deadline := start.Add(opts.WaitTimeout)
+	reported := start
+	elog.Info(prestartEid, fmt.Sprintf("waiting for %s to be reachable up to %s before starting the agent", opts.WaitForTCP, opts.WaitTimeout))
+	for {
+		timeout := time.Until(deadline)
+		if timeout > maxPrestartDialTimeout {
+			timeout = maxPrestartDialTimeout
+		}
+		err := dial(opts.WaitForTCP, timeout)
+		now := time.Now()
+		if err == nil {
+			elog.Info(prestartEid, fmt.Sprintf("%s is reachable after %s", opts.WaitForTCP, now.Sub(start).Round(time.Second)))
+			return nil
+		}
+		if !now.Before(deadline) {
+			return fmt.Errorf("%s is not reachable in %s: %s", opts.WaitForTCP, opts.WaitTimeout, err)
+		}
+		if now.Sub(reported) >= prestartProgressInterval {
+			elog.Info(prestartEid, fmt.Sprintf("still waiting for %s for %s: %s", opts.WaitForTCP, now.Sub(start).Round(time.Second), err))
+			reported = now
+		}
+		wait := prestartRetryInterval
+		if left := deadline.Sub(now); left < wait {
+			wait = left
+		}
+		select {
+		case <-cancel:
+			return errPrestartCanceled
+		case <-time.After(wait):
+		}
+	}
+}
+
+// prestart runs waitPrestart and then PreStartCommand reporting the
+// checkpoints of StartPending to s, and returns false if the service is
+// stopped while waiting. Nothing is done unless StartDelaySeconds, WaitForTCP
+// or PreStartCommand are given.
+func (h *handler) prestart(r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, error) {
+	if h.opts.StartDelay <= 0 && h.opts.WaitForTCP == "" && h.opts.PreStartCommand == "" {
+		return true, nil
+	}
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+	opts := h.opts
+	h.goSafe(func() {
+		err := waitPrestart(opts, h.elog, dialTCP, cancel)
+		if err == nil {
+			err = runPreStart(opts, h.elog, cancel)
+		}
+		done <- err
+	})
+
+	var checkpoint uint32
+	status := func() svc.Status {
+		return svc.Status{
+			State:      svc.StartPending,
+			Accepts:    svc.AcceptStop | svc.AcceptShutdown,
+			CheckPoint: checkpoint,
+			WaitHint:   uint32(2 * prestartCheckpointInterval / time.Millisecond),
+		}
+	}
+	s <- status()
+	ticker := time.NewTicker(prestartCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err == nil, err
+		case <-h.crashed:
+			return false, errors.New("the wrapper crashed while waiting before starting the agent")
+		case <-ticker.C:
+			checkpoint++
+			s <- status()
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				s <- status()
+			case svc.Stop, svc.Shutdown:
+				close(cancel)
+				select {
+				case <-done:
+				case <-h.crashed:
+				}
+				h.elog.Info(prestartEid, "stopped while waiting before starting the agent")
+				return false, nil
+			}
+		}
+	}
+}
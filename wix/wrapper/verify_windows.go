@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The verification of mackerel-agent.exe before launching it, which is
+// configured by the environment variables of the service or the Parameters
+// (see paramsKey). Nothing is verified by default.
+const (
+	// agentSHA256Env is the expected SHA-256 of mackerel-agent.exe in hex.
+	agentSHA256Env = "MACKEREL_AGENT_SHA256"
+	// verifyAuthenticodeEnv verifies the Authenticode signature by WinVerifyTrust.
+	verifyAuthenticodeEnv = "MACKEREL_VERIFY_AUTHENTICODE"
+	// agentThumbprintEnv is the comma-separated SHA-1 thumbprints of
+	// the certificates one of which should have signed mackerel-agent.exe.
+	agentThumbprintEnv = "MACKEREL_AGENT_THUMBPRINT"
+)
+
+var (
+	wintrust                           = syscall.NewLazyDLL("wintrust")
+	procWinVerifyTrust                 = wintrust.NewProc("WinVerifyTrust")
+	procWTHelperProvDataFromStateData  = wintrust.NewProc("WTHelperProvDataFromStateData")
+	procWTHelperGetProvSignerFromChain = wintrust.NewProc("WTHelperGetProvSignerFromChain")
+	procWTHelperGetProvCertFromChain   = wintrust.NewProc("WTHelperGetProvCertFromChain")
+)
+
+// parseThumbprints parses the comma-separated thumbprints, which may contain
+// the spaces between the bytes as shown in the certificate dialog.
+func parseThumbprints(s string) ([]string, error) {
+	var thumbprints []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.Replace(t, " ", "", -1))
+		if t == "" {
+			continue
+		}
+		if len(t) != 40 || strings.Trim(t, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("the thumbprint should be SHA-1 in hex, but %q", t)
+		}
+		thumbprints = append(thumbprints, t)
+	}
+	return thumbprints, nil
+}
+
+// verifyAgent verifies the executable at path by opts, and returns it opened
+// not to be written, deleted or renamed until it is closed after the process
+// starts. It returns nil if nothing is verified. The errors contain the
+// computed SHA-256 to be compared with the released one.
+func verifyAgent(path string, opts options) (*os.File, error) {
+	if opts.AgentSHA256 == "" && !opts.VerifyAuthenticode {
+		return nil, nil
+	}
+	f, err := openShareRead(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyFile(f, path, opts); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func verifyFile(f *os.File, path string, opts options) error {
+	sum, err := fileSHA256(f)
+	if err != nil {
+		return err
+	}
+	if expected := opts.AgentSHA256; expected != "" && !strings.EqualFold(sum, expected) {
+		return fmt.Errorf("refused to launch %s: the SHA-256 is %s, but %s is expected", path, sum, expected)
+	}
+	if opts.VerifyAuthenticode {
+		if len(opts.AgentThumbprints) == 0 {
+			return fmt.Errorf("refused to launch %s (SHA-256 %s): the thumbprint of the signer should be configured by AgentThumbprint to verify the Authenticode signature", path, sum)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := verifyTrust(f, opts.AgentThumbprints); err != nil {
+			return fmt.Errorf("refused to launch %s (SHA-256 %s): %s", path, sum, err)
+		}
+	}
+	return nil
+}
+
+// openShareRead opens the file for reading with the share mode which lets the
+// others only read or execute it, so that the verified file is not replaced
+// before the process of it starts.
+func openShareRead(path string) (*os.File, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(p, windows.GENERIC_READ, windows.FILE_SHARE_READ, nil, windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+func fileSHA256(f io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// https://docs.microsoft.com/windows/win32/api/wintrust/ns-wintrust-wintrust_file_info
+type wintrustFileInfo struct {
+	cbStruct       uint32
+	pcwszFilePath  *uint16
+	hFile          windows.Handle
+	pgKnownSubject *windows.GUID
+}
+
+// https://docs.microsoft.com/windows/win32/api/wintrust/ns-wintrust-wintrust_data
+type wintrustData struct {
+	cbStruct            uint32
+	pPolicyCallbackData uintptr
+	pSIPClientData      uintptr
+	dwUIChoice          uint32
+	fdwRevocationChecks uint32
+	dwUnionChoice       uint32
+	pFile               *wintrustFileInfo
+	dwStateAction       uint32
+	hWVTStateData       windows.Handle
+	pwszURLReference    *uint16
+	dwProvFlags         uint32
+	dwUIContext         uint32
+	pSignatureSettings  uintptr
+}
+
+const (
+	wtdUINone             = 2
+	wtdRevokeNone         = 0
+	wtdChoiceFile         = 1
+	wtdStateActionVerify  = 1
+	wtdStateActionClose   = 2
+	wtdCacheOnlyRetrieval = 0x1000
+)
+
+var wintrustActionGenericVerifyV2 = windows.GUID{
+	Data1: 0xaac56b,
+	Data2: 0xcd44,
+	Data3: 0x11d0,
+	Data4: [8]byte{0x8c, 0xc2, 0x00, 0xc0, 0x4f, 0xc2, 0x95, 0xee},
+}
+
+// https://docs.microsoft.com/windows/win32/api/wintrust/ns-wintrust-crypt_provider_cert
+// The fields after pCert are not used.
+type cryptProviderCert struct {
+	cbStruct uint32
+	pCert    *windows.CertContext
+}
+
+// verifyTrust verifies the Authenticode signature of the file by the trusted
+// root certificates without retrieving the revocation lists, not to block
+// the start of the service by the network, and that the signer certificate
+// is one of thumbprints, since any publisher can be trusted by the roots.
+func verifyTrust(f *os.File, thumbprints []string) error {
+	p, err := windows.UTF16PtrFromString(f.Name())
+	if err != nil {
+		return err
+	}
+	file := &wintrustFileInfo{pcwszFilePath: p, hFile: windows.Handle(f.Fd())}
+	file.cbStruct = uint32(unsafe.Sizeof(*file))
+	data := &wintrustData{
+		dwUIChoice:          wtdUINone,
+		fdwRevocationChecks: wtdRevokeNone,
+		dwUnionChoice:       wtdChoiceFile,
+		pFile:               file,
+		dwStateAction:       wtdStateActionVerify,
+		dwProvFlags:         wtdCacheOnlyRetrieval,
+	}
+	data.cbStruct = uint32(unsafe.Sizeof(*data))
+
+	r1, _, _ := procWinVerifyTrust.Call(uintptr(windows.InvalidHandle), uintptr(unsafe.Pointer(&wintrustActionGenericVerifyV2)), uintptr(unsafe.Pointer(data)))
+	defer func() {
+		data.dwStateAction = wtdStateActionClose
+		procWinVerifyTrust.Call(uintptr(windows.InvalidHandle), uintptr(unsafe.Pointer(&wintrustActionGenericVerifyV2)), uintptr(unsafe.Pointer(data)))
+	}()
+	if status := int32(r1); status != 0 {
+		return fmt.Errorf("the Authenticode signature is not trusted (WinVerifyTrust returned 0x%08X)", uint32(status))
+	}
+
+	signer, err := signerThumbprint(data.hWVTStateData)
+	if err != nil {
+		return err
+	}
+	for _, t := range thumbprints {
+		if t == signer {
+			return nil
+		}
+	}
+	return fmt.Errorf("the Authenticode signature is signed by the certificate of the thumbprint %s, which is not in %s", signer, strings.Join(thumbprints, ", "))
+}
+
+// signerThumbprint returns the SHA-1 thumbprint of the signer certificate in
+// the state of WinVerifyTrust, which is valid until the state is closed.
+func signerThumbprint(state windows.Handle) (string, error) {
+	prov, _, _ := procWTHelperProvDataFromStateData.Call(uintptr(state))
+	if prov == 0 {
+		return "", fmt.Errorf("failed to get the provider data of the Authenticode signature")
+	}
+	sgnr, _, _ := procWTHelperGetProvSignerFromChain.Call(prov, 0, 0, 0)
+	if sgnr == 0 {
+		return "", fmt.Errorf("failed to get the signer of the Authenticode signature")
+	}
+	r1, _, _ := procWTHelperGetProvCertFromChain.Call(sgnr, 0)
+	if r1 == 0 {
+		return "", fmt.Errorf("failed to get the signer certificate of the Authenticode signature")
+	}
+	cert := *(**cryptProviderCert)(unsafe.Pointer(&r1))
+	c := cert.pCert
+	if c == nil || c.Length == 0 || c.Length > 1<<20 {
+		return "", fmt.Errorf("failed to get the signer certificate of the Authenticode signature")
+	}
+	encoded := (*[1 << 20]byte)(unsafe.Pointer(c.EncodedCert))[:c.Length:c.Length]
+	sum := sha1.Sum(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
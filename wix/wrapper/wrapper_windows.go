@@ -3,26 +3,37 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/mackerelio/mackerel-agent/config"
+	"github.com/mackerelio/mackerel-agent/exitcode"
+	"github.com/mackerelio/mackerel-agent/logeventlog"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/eventlog"
 )
 
 const name = "mackerel-agent"
 
+// version is replaced by -ldflags "-X main.version=..." at build time,
+// which is posted by the agent as the host meta.
+var version = "0.0.0"
+
 const defaultEid = 1
 const startEid = 2
 const stopEid = 3
 const loggerEid = 4
+const verifyEid = 5
+const paramsEid = 6
 
 var (
 	kernel32                     = syscall.NewLazyDLL("kernel32")
@@ -47,15 +58,29 @@ func main() {
 
 	elog, err := eventlog.Open(name)
 	if err != nil {
-		log.Fatal(err.Error())
+		// the crash file and the exit code of the service are the only records
+		// when the event source is deleted
+		reportCrash(nil, fmt.Sprintf("failed to open the event log: %s (%s)", err, startingMessage()))
+		if err := svc.Run(name, exitHandler(exitcode.EventLogUnavailable)); err != nil {
+			reportCrash(nil, fmt.Sprintf("failed to run the service: %s", err))
+		}
+		os.Exit(exitcode.EventLogUnavailable)
 	}
 	defer elog.Close()
+	elog.Info(wrapperEid, startingMessage())
+	defer func() {
+		if r := recover(); r != nil {
+			reportCrash(elog, panicMessage(r))
+			os.Exit(exitcode.Error)
+		}
+	}()
 
 	// `svc.Run` blocks until windows service will stopped.
 	// ref. https://msdn.microsoft.com/library/cc429362.aspx
-	err = svc.Run(name, &handler{elog: elog})
+	err = svc.Run(name, &handler{elog: elog, crashed: make(chan struct{}, 1)})
 	if err != nil {
-		log.Fatal(err.Error())
+		reportCrash(elog, fmt.Sprintf("failed to run the service: %s", err))
+		os.Exit(exitcode.Error)
 	}
 }
 
@@ -67,10 +92,21 @@ type logger interface {
 
 type handler struct {
 	elog logger
+	opts options
 	cmd  *exec.Cmd
 	r    io.Reader
 	w    io.WriteCloser
 	wg   sync.WaitGroup
+	// childLog is the raw output of the agent by ChildLog, or nil.
+	childLog *childLog
+	// crashed is signaled when the goroutines of the handler panic.
+	crashed chan struct{}
+	// starts is the number of the starts of the agent, see started.
+	starts uint32
+	// health is the state served by HealthListen, or nil.
+	health *healthState
+	// events writes the logs of the agent to the event log in the background.
+	events *eventQueue
 }
 
 // ex.
@@ -79,30 +115,68 @@ type handler struct {
 var logRe = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} (?:\S+\.go:\d+: )?([A-Z]+) `)
 
 func (h *handler) retire() error {
-	dir := execdir()
-	cmd := exec.Command(filepath.Join(dir, "mackerel-agent.exe"), "retire", "--force")
-	cmd.Dir = dir
+	cmd := exec.Command(h.opts.AgentPath, "retire", "--force")
+	cmd.Dir = filepath.Dir(h.opts.AgentPath)
 	return cmd.Run()
 }
 
 func (h *handler) start() error {
 	procAllocConsole.Call()
-	dir := execdir()
-	cmd := exec.Command(filepath.Join(dir, "mackerel-agent.exe"))
+	exe := h.opts.AgentPath
+	verified, err := verifyAgent(exe, h.opts)
+	if err != nil {
+		h.elog.Error(verifyEid, err.Error())
+		return err
+	}
+	if verified != nil {
+		// kept open not to be replaced until the process starts
+		defer verified.Close()
+	}
+	var args []string
+	if h.opts.Supervise {
+		// the supervisor restarts the crashed agent instead of stopping the service
+		args = append(args, "supervise")
+	}
+	cmd := exec.Command(exe, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
 	}
-	cmd.Dir = dir
+	cmd.Dir = filepath.Dir(exe)
+	// the agent with log_output = "eventlog" answers by logeventlog.HandshakeLine
+	cmd.Env = append(os.Environ(), logeventlog.HandshakeEnv+"=1", config.WrapperVersionEnv+"="+version)
 
 	h.cmd = cmd
 	h.r, h.w = io.Pipe()
 	cmd.Stderr = h.w
+	var stdout *os.File
+	if h.opts.ChildLog {
+		// the output to stdout is written only to the child log, which is kept
+		// in the pipe until the header is written
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		cmd.Stdout, stdout = w, r
+	}
 
-	err := h.cmd.Start()
+	err = h.cmd.Start()
 	if err != nil {
+		if stdout != nil {
+			stdout.Close()
+		}
 		return err
 	}
 
+	if stdout != nil {
+		h.childLog = newChildLog(childLogPath(), h.opts.ChildLogMaxSize, h.elog)
+		h.childLog.launched(cmd.Process.Pid, time.Now())
+		h.r = io.TeeReader(h.r, h.childLog)
+		h.goSafe(func() {
+			defer stdout.Close()
+			io.Copy(h.childLog, stdout)
+		})
+	}
 	return h.aggregate()
 }
 
@@ -110,6 +184,7 @@ func (h *handler) aggregate() error {
 	br := bufio.NewReader(h.r)
 	lc := make(chan string, 10)
 	done := make(chan struct{})
+	h.events = newEventQueue(h.elog)
 
 	// It need to read data from pipe continuously. And it need to close handle
 	// when process finished.
@@ -118,6 +193,7 @@ func (h *handler) aggregate() error {
 	h.wg.Add(1)
 	go func() {
 		defer h.wg.Done()
+		defer h.recoverPanic()
 		defer h.w.Close()
 
 		// pipe stderr to windows event log
@@ -148,12 +224,29 @@ func (h *handler) aggregate() error {
 	h.wg.Add(1)
 	go func() {
 		defer h.wg.Done()
+		defer h.recoverPanic()
 
 		linebuf := []string{}
+		// eventlog is true after the agent started writing the logs to the event
+		// log by itself, so that the logs in stderr are not forwarded twice.
+		eventlog := false
 	loop:
 		for {
 			select {
 			case line := <-lc:
+				if line == logeventlog.StartedLine {
+					h.started()
+					continue
+				}
+				if line == logeventlog.HandshakeLine {
+					h.forward(linebuf)
+					linebuf = nil
+					eventlog = true
+					continue
+				}
+				if eventlog && logRe.MatchString(line) {
+					continue
+				}
 				if len(linebuf) == 0 || logRe.MatchString(line) {
 					linebuf = append(linebuf, line)
 				} else {
@@ -162,23 +255,7 @@ func (h *handler) aggregate() error {
 			case <-time.After(10 * time.Millisecond):
 				// When it take 10ms, it is located at end of paragraph. Then
 				// slice appended at above should be the paragraph.
-				for _, line := range linebuf {
-					if match := logRe.FindStringSubmatch(line); match != nil {
-						level := match[1]
-						switch level {
-						case "TRACE", "DEBUG", "INFO":
-							h.elog.Info(defaultEid, line)
-						case "WARNING", "ERROR":
-							h.elog.Warning(defaultEid, line)
-						case "CRITICAL":
-							h.elog.Error(defaultEid, line)
-						default:
-							h.elog.Error(defaultEid, line)
-						}
-					} else {
-						h.elog.Error(defaultEid, line)
-					}
-				}
+				h.forward(linebuf)
 				select {
 				case <-done:
 					break loop
@@ -187,6 +264,7 @@ func (h *handler) aggregate() error {
 				linebuf = nil
 			}
 		}
+		h.events.Close()
 		close(lc)
 		close(done)
 	}()
@@ -194,6 +272,18 @@ func (h *handler) aggregate() error {
 	return nil
 }
 
+// forward queues the paragraphs of the logs to the event log by their levels.
+func (h *handler) forward(linebuf []string) {
+	for _, line := range linebuf {
+		level := ""
+		if match := logRe.FindStringSubmatch(line); match != nil {
+			level = match[1]
+		}
+		h.health.forwarded(level, line)
+		h.events.push(level, line)
+	}
+}
+
 func interrupt(p *os.Process) error {
 	r1, _, err := procGenerateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(p.Pid))
 	if r1 == 0 {
@@ -202,11 +292,15 @@ func interrupt(p *os.Process) error {
 	return nil
 }
 
+// defaultStopTimeout is the duration to wait for the agent to flush the
+// pending metrics on shutdown (shutdown_flush_timeout defaults to 10 seconds).
+const defaultStopTimeout = 20 * time.Second
+
 func (h *handler) stop() error {
 	if h.cmd != nil && h.cmd.Process != nil {
 		err := interrupt(h.cmd.Process)
 		if err == nil {
-			end := time.Now().Add(10 * time.Second)
+			end := time.Now().Add(h.opts.StopTimeout)
 			for time.Now().Before(end) {
 				if h.cmd.ProcessState != nil && h.cmd.ProcessState.Exited() {
 					return nil
@@ -221,18 +315,32 @@ func (h *handler) stop() error {
 	return nil
 }
 
-func autoRetire() bool {
-	env := os.Getenv("MACKEREL_AUTO_RETIREMENT")
-	return env != "" && env != "0"
-}
-
 // implement https://godoc.org/golang.org/x/sys/windows/svc#Handler
 func (h *handler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
 	s <- svc.Status{State: svc.StartPending}
 	defer func() {
 		s <- svc.Status{State: svc.Stopped}
 	}()
+	defer func() {
+		if r := recover(); r != nil {
+			reportCrash(h.elog, panicMessage(r))
+			h.kill()
+			svcSpecificEC, exitCode = true, exitcode.Error
+		}
+	}()
 
+	h.opts = loadOptions(h.elog)
+	if h.opts.HealthListen != "" {
+		h.health = &healthState{}
+	}
+	if ok, err := h.prestart(r, s); err != nil {
+		h.elog.Error(prestartEid, fmt.Sprintf("failed to start the agent: %s", err))
+		return true, exitcode.Error
+	} else if !ok {
+		return false, 0
+	}
+	// run also when the agent fails to start, such as to unmount the volume
+	defer h.postStop(s)
 	if err := h.start(); err != nil {
 		h.elog.Error(startEid, err.Error())
 		// https://msdn.microsoft.com/library/windows/desktop/ms681383(v=vs.85).aspx
@@ -240,17 +348,29 @@ func (h *handler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- sv
 		return true, 1
 	}
 
-	exit := make(chan struct{})
-	go func() {
+	if h.childLog != nil {
+		defer h.childLog.Close()
+	}
+	h.health.launched(h.cmd.Process.Pid, time.Now())
+
+	exit := make(chan int)
+	h.goSafe(func() {
 		err := h.cmd.Wait()
 		// enter when the child process exited
 		if err != nil {
 			h.elog.Error(stopEid, err.Error())
 		}
-		exit <- struct{}{}
-	}()
+		h.health.exited(h.cmd.ProcessState.ExitCode(), time.Now())
+		exit <- h.cmd.ProcessState.ExitCode()
+	})
 
-	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	stopped := false
+	heartbeat := h.heartbeat()
+
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	s <- svc.Status{State: svc.Running, Accepts: accepts}
+	// the health endpoint is stopped before the service is stopped
+	defer h.serveHealth()()
 L:
 	for {
 		select {
@@ -258,13 +378,18 @@ L:
 			switch req.Cmd {
 			case svc.Interrogate:
 				s <- req.CurrentStatus
+			case svc.ParamChange:
+				h.reloadOptions()
+				heartbeat = h.heartbeat()
+				s <- svc.Status{State: svc.Running, Accepts: accepts}
 			case svc.Stop, svc.Shutdown:
-				s <- svc.Status{State: svc.StopPending, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+				s <- svc.Status{State: svc.StopPending, Accepts: svc.AcceptStop | svc.AcceptShutdown, WaitHint: uint32(h.opts.StopTimeout / time.Millisecond)}
 				if err := h.stop(); err != nil {
 					h.elog.Error(stopEid, err.Error())
-					s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+					s <- svc.Status{State: svc.Running, Accepts: accepts}
 				} else {
-					if req.Cmd == svc.Shutdown && autoRetire() {
+					stopped = true
+					if req.Cmd == svc.Shutdown && h.opts.AutoRetirement {
 						if err := h.retire(); err != nil {
 							h.elog.Error(stopEid, err.Error())
 							s <- svc.Status{State: svc.Running, Accepts: svc.AcceptShutdown}
@@ -272,18 +397,59 @@ L:
 					}
 				}
 			}
-		case <-exit:
+		case code := <-exit:
+			if !stopped {
+				return serviceExitCode(code)
+			}
 			break L
+		case <-h.crashed:
+			h.kill()
+			return true, exitcode.Error
+		case <-heartbeat:
+			h.elog.Info(heartbeatEid, h.heartbeatMessage())
+			heartbeat = h.heartbeat()
 		}
 	}
 
 	return
 }
 
+// reloadOptions reads the options again by ParamChange. The ones to start
+// mackerel-agent.exe are kept until the service is restarted.
+func (h *handler) reloadOptions() {
+	pending := h.opts.reload(loadOptions(h.elog))
+	if len(pending) > 0 {
+		h.elog.Warning(paramsEid, fmt.Sprintf("Parameters\\%s are applied by restarting the service", strings.Join(pending, ", ")))
+		return
+	}
+	h.elog.Info(paramsEid, "reloaded the parameters")
+}
+
+// serviceExitCode maps the exit code of mackerel-agent, which exited by itself,
+// to the service-specific exit code so that the cause is shown by `sc query`.
+func serviceExitCode(code int) (bool, uint32) {
+	switch code {
+	case exitcode.OK:
+		return false, 0
+	case exitcode.ConfigError, exitcode.AuthError, exitcode.PidfileConflict, exitcode.HostRegistrationFailure:
+		return true, uint32(code)
+	default:
+		return true, exitcode.Error
+	}
+}
+
+// kill kills the agent not to be left running after the crash of the wrapper.
+func (h *handler) kill() {
+	if h.cmd != nil && h.cmd.Process != nil && h.cmd.ProcessState == nil {
+		h.cmd.Process.Kill()
+	}
+}
+
 func execdir() string {
 	p, err := os.Executable()
 	if err != nil {
-		log.Fatal(err)
+		// recovered by Execute
+		panic(err)
 	}
 	return filepath.Dir(p)
 }
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent/logeventlog"
+	"golang.org/x/sys/windows/registry"
 )
 
 type item struct {
@@ -134,6 +147,26 @@ func TestAggregate(t *testing.T) {
 				{1, "2017/01/02 03:04:05 foo.go:1: CRITICAL foo"},
 			},
 		},
+		{
+			name: "starts of the agent",
+			input: []string{
+				logeventlog.StartedLine + "\n",
+				"2017/01/02 03:04:05 foo.go:1: INFO foo\n",
+				logeventlog.StartedLine + "\n",
+			},
+			info: []item{{1, "2017/01/02 03:04:05 foo.go:1: INFO foo"}},
+		},
+		{
+			name: "handshake of eventlog",
+			input: []string{
+				"2017/01/02 03:04:05 foo.go:1: WARNING before handshake\n",
+				logeventlog.HandshakeLine + "\n",
+				"2017/01/02 03:04:05 foo.go:1: INFO foo\n",
+				"panic: foo\n\ngoroutine 1 [running]:\n",
+			},
+			warn: []item{{1, "2017/01/02 03:04:05 foo.go:1: WARNING before handshake"}},
+			err:  []item{{1, "panic: foo\ngoroutine 1 [running]:"}},
+		},
 	}
 
 	for _, test := range tests {
@@ -158,3 +191,603 @@ func TestAggregate(t *testing.T) {
 		}
 	}
 }
+
+// blockingLogger blocks the first write until release is closed.
+type blockingLogger struct {
+	testLogger
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (l *blockingLogger) Info(eid uint32, msg string) error {
+	l.once.Do(func() {
+		close(l.entered)
+		<-l.release
+	})
+	return l.testLogger.Info(eid, msg)
+}
+
+func TestEventQueue(t *testing.T) {
+	tl := &testLogger{}
+	q := newEventQueue(tl)
+	for i := 0; i < eventBatchLines+5; i++ {
+		q.push("INFO", fmt.Sprintf("info %d", i))
+	}
+	q.push("WARNING", "warning")
+	q.push("", "panic: foo")
+	q.Close()
+	var infos int
+	for _, it := range tl.info {
+		infos += strings.Count(it.msg, "\n") + 1
+		if n := strings.Count(it.msg, "\n") + 1; n > eventBatchLines {
+			t.Errorf("the lines should be combined up to %d: %d", eventBatchLines, n)
+		}
+	}
+	if infos != eventBatchLines+5 || len(tl.info) < 2 || !strings.HasPrefix(tl.info[0].msg, "info 0") {
+		t.Errorf("the INFO lines should be combined in order: %v", tl.info)
+	}
+	if !reflect.DeepEqual(tl.warn, []item{{defaultEid, "warning"}}) || !reflect.DeepEqual(tl.err, []item{{defaultEid, "panic: foo"}}) {
+		t.Errorf("the lines of the other levels should not be combined: %v, %v", tl.warn, tl.err)
+	}
+
+	bl := &blockingLogger{entered: make(chan struct{}), release: make(chan struct{})}
+	q = newEventQueue(bl)
+	q.push("INFO", "first")
+	<-bl.entered
+	for i := 0; i < eventQueueSize; i++ {
+		q.push("WARNING", fmt.Sprintf("warning %d", i))
+	}
+	q.push("INFO", "dropped info")
+	q.push("ERROR", "error")
+	q.push("CRITICAL", "critical")
+	close(bl.release)
+	q.Close()
+
+	if n := q.droppedLines(); n != 3 {
+		t.Errorf("the dropped lines should be counted: %d", n)
+	}
+	var warnings []string
+	var reported bool
+	for _, it := range bl.warn {
+		if it.eid == loggerEid {
+			reported = it.msg == "dropped 1 INFO and 2 WARNING lines of the agent not to block on the event log"
+			continue
+		}
+		warnings = append(warnings, strings.Split(it.msg, "\n")...)
+	}
+	if len(warnings) != eventQueueSize-1 || warnings[0] != "warning 2" || warnings[len(warnings)-2] != fmt.Sprintf("warning %d", eventQueueSize-1) || warnings[len(warnings)-1] != "error" {
+		t.Errorf("the oldest WARNING lines should be dropped for the ERROR lines: %d, %q", len(warnings), warnings[:3])
+	}
+	if !reported {
+		t.Errorf("the dropped lines should be reported: %v", bl.warn)
+	}
+	if !reflect.DeepEqual(bl.err, []item{{defaultEid, "critical"}}) {
+		t.Errorf("the CRITICAL lines should be kept: %v", bl.err)
+	}
+	for _, it := range bl.info {
+		if strings.Contains(it.msg, "dropped info") {
+			t.Error("the INFO line should be dropped when the queue is full of the others")
+		}
+	}
+}
+
+func TestVerifyAgent(t *testing.T) {
+	f, err := ioutil.TempFile("", "mackerel-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("agent")
+	f.Close()
+
+	// echo -n agent | sha256sum
+	sum := "d4f0bc5a29de06b510f9aa428f1eedba926012b591fef7a518e776a7c9bd1824"
+	tests := []struct {
+		expected string
+		ok       bool
+	}{
+		{"", true},
+		{sum, true},
+		{strings.ToUpper(sum), true},
+		{strings.Repeat("0", 64), false},
+	}
+	for _, tc := range tests {
+		verified, err := verifyAgent(f.Name(), options{AgentSHA256: tc.expected})
+		if tc.ok && err != nil {
+			t.Errorf("verifyAgent should not raise error with %q: %s", tc.expected, err)
+		}
+		if !tc.ok && (err == nil || !strings.Contains(err.Error(), sum)) {
+			t.Errorf("verifyAgent should raise error with the computed hash: %v", err)
+		}
+		if verified != nil {
+			if w, err := os.OpenFile(f.Name(), os.O_WRONLY, 0); err == nil {
+				w.Close()
+				t.Error("the verified agent should not be written until it is closed")
+			}
+			if err := os.Rename(f.Name(), f.Name()+".replaced"); err == nil {
+				os.Rename(f.Name()+".replaced", f.Name())
+				t.Error("the verified agent should not be renamed until it is closed")
+			}
+			verified.Close()
+		}
+	}
+
+	_, err = verifyAgent(f.Name(), options{VerifyAuthenticode: true})
+	if err == nil || !strings.Contains(err.Error(), "AgentThumbprint") {
+		t.Errorf("verifyAgent should raise error without the thumbprints: %v", err)
+	}
+}
+
+func TestParseThumbprints(t *testing.T) {
+	thumbprint := "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		s    string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{thumbprint, []string{thumbprint}, true},
+		{"01 23 45 67 89 AB CD EF 01 23 45 67 89 AB CD EF 01 23 45 67, " + thumbprint, []string{thumbprint, thumbprint}, true},
+		{"0123", nil, false},
+		{strings.Repeat("x", 40), nil, false},
+	}
+	for _, tc := range tests {
+		got, err := parseThumbprints(tc.s)
+		if tc.ok != (err == nil) {
+			t.Errorf("parseThumbprints(%q) should return error %t but %v", tc.s, !tc.ok, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseThumbprints(%q) should be %v but %v", tc.s, tc.want, got)
+		}
+	}
+}
+
+// testValues are the values of the registry key by the names, which are
+// uint64 for REG_DWORD and string for REG_SZ.
+type testValues map[string]interface{}
+
+func (v testValues) GetIntegerValue(name string) (uint64, uint32, error) {
+	switch x := v[name].(type) {
+	case nil:
+		return 0, 0, registry.ErrNotExist
+	case uint64:
+		return x, registry.DWORD, nil
+	default:
+		return 0, registry.SZ, registry.ErrUnexpectedType
+	}
+}
+
+func (v testValues) GetStringValue(name string) (string, uint32, error) {
+	switch x := v[name].(type) {
+	case nil:
+		return "", 0, registry.ErrNotExist
+	case string:
+		return x, registry.SZ, nil
+	default:
+		return "", registry.DWORD, registry.ErrUnexpectedType
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	defaults := options{StopTimeout: defaultStopTimeout, HeartbeatInterval: defaultHeartbeatInterval, AgentPath: `C:\Program Files\Mackerel\mackerel-agent.exe`, WaitTimeout: defaultWaitTimeout}
+	sum := "d4f0bc5a29de06b510f9aa428f1eedba926012b591fef7a518e776a7c9bd1824"
+	tests := []struct {
+		name   string
+		values testValues
+		want   options
+		errs   int
+	}{
+		{"empty", testValues{}, defaults, 0},
+		{
+			"all",
+			testValues{
+				"AutoRetirement":           uint64(1),
+				"StopTimeoutSeconds":       uint64(60),
+				"Supervise":                uint64(1),
+				"AgentPath":                `D:\mackerel\mackerel-agent.exe`,
+				"AgentSHA256":              sum,
+				"VerifyAuthenticode":       uint64(0),
+				"AgentThumbprint":          strings.Repeat("0", 40),
+				"ChildLog":                 uint64(1),
+				"ChildLogMaxSizeMB":        uint64(20),
+				"HeartbeatIntervalMinutes": uint64(0),
+				"StartDelaySeconds":        uint64(30),
+				"WaitForTCP":               "vpn.example.com:443",
+				"WaitTimeoutSeconds":       uint64(60),
+				"HealthListen":             "127.0.0.1:7181",
+				"HealthCertFile":           `C:\mackerel\health.crt`,
+				"HealthKeyFile":            `C:\mackerel\health.key`,
+				"PreStartCommand":          `C:\mackerel\mount.bat`,
+				"PreStartTimeoutSeconds":   uint64(120),
+				"PreStartAbortOnFailure":   uint64(0),
+				"PostStopCommand":          `C:\mackerel\unmount.bat`,
+				"PostStopTimeoutSeconds":   uint64(30),
+			},
+			options{
+				AutoRetirement:  true,
+				StopTimeout:     time.Minute,
+				Supervise:       true,
+				AgentPath:       `D:\mackerel\mackerel-agent.exe`,
+				AgentSHA256:     sum,
+				ChildLog:        true,
+				ChildLogMaxSize: 20 << 20,
+				StartDelay:      30 * time.Second,
+				WaitForTCP:      "vpn.example.com:443",
+				WaitTimeout:     time.Minute,
+				HealthListen:    "127.0.0.1:7181",
+				HealthCertFile:  `C:\mackerel\health.crt`,
+				HealthKeyFile:   `C:\mackerel\health.key`,
+				PreStartCommand: `C:\mackerel\mount.bat`,
+				PreStartTimeout: 2 * time.Minute,
+				PostStopCommand: `C:\mackerel\unmount.bat`,
+				PostStopTimeout: 30 * time.Second,
+
+				AgentThumbprints: []string{strings.Repeat("0", 40)},
+			},
+			0,
+		},
+		{
+			"invalid",
+			testValues{
+				"AutoRetirement":           "1",
+				"StopTimeoutSeconds":       uint64(0),
+				"Supervise":                uint64(2),
+				"AgentPath":                `mackerel-agent.exe`,
+				"AgentSHA256":              "abc",
+				"VerifyAuthenticode":       "yes",
+				"AgentThumbprint":          "abc",
+				"ChildLog":                 uint64(3),
+				"ChildLogMaxSizeMB":        uint64(4096),
+				"HeartbeatIntervalMinutes": uint64(1441),
+				"StartDelaySeconds":        uint64(3601),
+				"WaitForTCP":               "vpn.example.com",
+				"WaitTimeoutSeconds":       uint64(0),
+				"HealthListen":             "0.0.0.0:7181",
+				"HealthCertFile":           `C:\mackerel\health.crt`,
+				"PreStartTimeoutSeconds":   uint64(0),
+				"PreStartAbortOnFailure":   uint64(2),
+				"PostStopTimeoutSeconds":   uint64(3601),
+			},
+			defaults,
+			18,
+		},
+	}
+	for _, tc := range tests {
+		got, errs := readOptions(tc.values, defaults)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: options should be %+v but %+v", tc.name, tc.want, got)
+		}
+		if len(errs) != tc.errs {
+			t.Errorf("%s: %d errors should be returned but %v", tc.name, tc.errs, errs)
+		}
+	}
+}
+
+func TestValidateHealthListen(t *testing.T) {
+	tests := []struct {
+		address     string
+		allowRemote bool
+		ok          bool
+	}{
+		{"127.0.0.1:7181", false, true},
+		{"[::1]:7181", false, true},
+		{"localhost:7181", false, true},
+		{":7181", false, false},
+		{"0.0.0.0:7181", false, false},
+		{"192.0.2.1:7181", false, false},
+		{"monitor.example.com:7181", false, false},
+		{"0.0.0.0:7181", true, true},
+		{"127.0.0.1", false, false},
+		{"127.0.0.1:http", false, false},
+		{"127.0.0.1:70000", true, false},
+	}
+	for _, tc := range tests {
+		if err := validateHealthListen(tc.address, tc.allowRemote); (err == nil) != tc.ok {
+			t.Errorf("validateHealthListen(%q, %v) should be ok = %v but %v", tc.address, tc.allowRemote, tc.ok, err)
+		}
+	}
+}
+
+func TestHealthState(t *testing.T) {
+	get := func(s *healthState) (int, healthReport) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		var r healthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatalf("the report should be JSON: %s", err)
+		}
+		return rec.Code, r
+	}
+
+	s := &healthState{}
+	if code, r := get(s); code != http.StatusServiceUnavailable || r.State != "stopped" || r.StartedAt != nil {
+		t.Errorf("the child should be stopped before the start: %d %+v", code, r)
+	}
+
+	start := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	s.launched(1234, start)
+	s.started(start)
+	s.started(start.Add(time.Hour))
+	for i := 0; i < maxHealthErrors+5; i++ {
+		s.forwarded("ERROR", fmt.Sprintf("error %d", i))
+	}
+	s.forwarded("INFO", "info")
+	s.forwarded("", "panic: something")
+	code, r := get(s)
+	if code != http.StatusOK || r.State != "running" || r.ChildPID != 1234 || r.Restarts != 1 || !r.LastRestartAt.Equal(start.Add(time.Hour)) {
+		t.Errorf("the running child should be reported: %d %+v", code, r)
+	}
+	if len(r.Errors) != maxHealthErrors || r.Errors[0] != "error 6" || r.Errors[maxHealthErrors-1] != "panic: something" {
+		t.Errorf("the last error lines should be reported: %q", r.Errors)
+	}
+
+	s.exited(1, start.Add(2*time.Hour))
+	if code, r := get(s); code != http.StatusServiceUnavailable || r.State != "stopped" || r.ExitCode == nil || *r.ExitCode != 1 {
+		t.Errorf("the exited child should be reported: %d %+v", code, r)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST should not be allowed: %d", rec.Code)
+	}
+
+	// the methods of the handler without HealthListen do nothing
+	var nilState *healthState
+	nilState.launched(1, start)
+	nilState.forwarded("ERROR", "error")
+}
+
+func TestServeHealth(t *testing.T) {
+	tl := &testLogger{}
+	h := &handler{elog: tl, crashed: make(chan struct{}, 1), health: &healthState{}}
+	h.opts.HealthListen = "127.0.0.1:0"
+	stop := h.serveHealth()
+	if len(tl.info) != 1 || !strings.HasPrefix(tl.info[0].msg, "serving the health endpoint on http://127.0.0.1:") {
+		t.Fatalf("the health endpoint should be served: %v %v", tl.info, tl.err)
+	}
+	url := strings.TrimPrefix(tl.info[0].msg, "serving the health endpoint on ")
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("the child not launched should be unavailable: %d", resp.StatusCode)
+	}
+	stop()
+	if _, err := http.Get(url); err == nil {
+		t.Error("the health endpoint should be stopped")
+	}
+	if len(tl.err) != 0 {
+		t.Errorf("no errors should be logged: %v", tl.err)
+	}
+}
+
+func TestOptionsReload(t *testing.T) {
+	opts := options{StopTimeout: defaultStopTimeout, AgentPath: `C:\mackerel-agent.exe`}
+	next := opts
+	next.AutoRetirement = true
+	next.StopTimeout = time.Minute
+	next.Supervise = true
+	next.AgentSHA256 = strings.Repeat("0", 64)
+	next.HeartbeatInterval = 10 * time.Minute
+
+	pending := opts.reload(next)
+	if !reflect.DeepEqual(pending, []string{"Supervise", "AgentSHA256"}) {
+		t.Errorf("Supervise and AgentSHA256 should be pending but %v", pending)
+	}
+	want := options{AutoRetirement: true, StopTimeout: time.Minute, HeartbeatInterval: 10 * time.Minute, AgentPath: `C:\mackerel-agent.exe`}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("options should be %+v but %+v", want, opts)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	tl := &testLogger{}
+	h := &handler{elog: tl, crashed: make(chan struct{}, 1)}
+	h.goSafe(func() {
+		var m map[string]int
+		m["foo"] = 1
+	})
+	select {
+	case <-h.crashed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the panic should be recovered")
+	}
+	if len(tl.err) != 1 || tl.err[0].eid != crashEid {
+		t.Fatalf("the panic should be written to the event log: %v", tl.err)
+	}
+	if msg := tl.err[0].msg; !strings.HasPrefix(msg, "panic: assignment to entry in nil map") || !strings.Contains(msg, "goroutine ") {
+		t.Errorf("the message and the stack of the panic should be written: %q", msg)
+	}
+}
+
+type failingLogger struct {
+	testLogger
+}
+
+func (l *failingLogger) Error(eid uint32, msg string) error {
+	return errors.New("the event log is unavailable")
+}
+
+func TestReportCrash_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-wrapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig := crashFile
+	defer func() { crashFile = orig }()
+	file := filepath.Join(dir, "wrapper-crash.log")
+	crashFile = func() string { return file }
+
+	reportCrash(nil, "failed to open the event log")
+	reportCrash(&failingLogger{}, "panic: foo")
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("the crash file should be written: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " failed to open the event log") || !strings.HasSuffix(lines[1], " panic: foo") {
+		t.Errorf("unexpected crash file: %q", b)
+	}
+}
+
+func TestChildLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-agent-wrapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, childLogName)
+
+	tl := &testLogger{}
+	l := newChildLog(path, 64, tl)
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.launched(1234, at)
+	l.Write([]byte("2020/01/02 03:04:05 INFO <main> \x00raw\r\n"))
+	l.Write([]byte("incomplete"))
+	l.Close()
+	l.Write([]byte("written after close\n"))
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "2020/01/02 03:04:05 INFO <main> \x00raw\r\nincomplete"; string(b) != expect {
+		t.Errorf("the output should be written byte-for-byte: %q", b)
+	}
+	b, err = ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("the header should be rotated by the size: %s", err)
+	}
+	if expect := "==== mackerel-agent.exe (pid 1234) started at 2020-01-02T03:04:05Z ====\n"; string(b) != expect {
+		t.Errorf("the header should contain the pid and the start time: %q", b)
+	}
+	if len(tl.warn) != 0 {
+		t.Errorf("nothing should be dropped: %v", tl.warn)
+	}
+}
+
+func TestChildLog_drop(t *testing.T) {
+	tl := &testLogger{}
+	// the file is stuck
+	l := &childLog{elog: tl, path: childLogName, ch: make(chan []byte, 1), done: make(chan struct{})}
+	close(l.done)
+	for i := 0; i < 3; i++ {
+		if n, err := l.Write([]byte("foo\n")); n != 4 || err != nil {
+			t.Errorf("Write should not fail: %d, %v", n, err)
+		}
+	}
+	l.Close()
+	if len(tl.warn) != 1 || !strings.HasPrefix(tl.warn[0].msg, "2 writes of the output of the agent were dropped") {
+		t.Errorf("the dropped writes should be reported: %v", tl.warn)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	h := &handler{
+		elog: &testLogger{},
+		w:    &testWriteCloser{},
+		r:    &testReader{[]string{logeventlog.StartedLine + "\n", logeventlog.StartedLine + "\n", logeventlog.StartedLine + "\n"}, nil},
+	}
+	if msg := h.heartbeatMessage(); msg != "wrapper alive, child pid 0, restarts 0" {
+		t.Errorf("unexpected heartbeat before the start: %q", msg)
+	}
+	h.aggregate()
+	h.wg.Wait()
+	if msg := h.heartbeatMessage(); msg != "wrapper alive, child pid 0, restarts 2" {
+		t.Errorf("the heartbeat should count the restarts: %q", msg)
+	}
+
+	if h.heartbeat() != nil {
+		t.Error("the heartbeat should be disabled by zero")
+	}
+	h.opts.HeartbeatInterval = time.Millisecond
+	select {
+	case <-h.heartbeat():
+	case <-time.After(time.Second):
+		t.Error("the heartbeat should be fired by the interval")
+	}
+}
+
+func TestWaitPrestart(t *testing.T) {
+	defer func(retry time.Duration) { prestartRetryInterval = retry }(prestartRetryInterval)
+	prestartRetryInterval = time.Millisecond
+
+	failures := 2
+	var addresses []string
+	dial := func(address string, timeout time.Duration) error {
+		addresses = append(addresses, address)
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	tl := &testLogger{}
+	opts := options{StartDelay: time.Millisecond, WaitForTCP: "vpn.example.com:443", WaitTimeout: time.Minute}
+	if err := waitPrestart(opts, tl, dial, nil); err != nil {
+		t.Fatalf("should wait until reachable: %s", err)
+	}
+	if len(addresses) != 3 || addresses[0] != "vpn.example.com:443" {
+		t.Errorf("should retry the connections: %v", addresses)
+	}
+	if len(tl.info) != 3 || !strings.HasPrefix(tl.info[2].msg, "vpn.example.com:443 is reachable after") {
+		t.Errorf("the progress should be logged: %v", tl.info)
+	}
+
+	failures = 1 << 30
+	opts.WaitTimeout = 10 * time.Millisecond
+	err := waitPrestart(opts, &testLogger{}, dial, nil)
+	if err == nil || !strings.Contains(err.Error(), "vpn.example.com:443 is not reachable in 10ms: connection refused") {
+		t.Errorf("should fail by the deadline: %v", err)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	opts.StartDelay = time.Hour
+	if err := waitPrestart(opts, &testLogger{}, dial, cancel); err != errPrestartCanceled {
+		t.Errorf("should be canceled: %v", err)
+	}
+
+	// nothing is waited by default
+	h := &handler{elog: &testLogger{}, crashed: make(chan struct{}, 1)}
+	if ok, err := h.prestart(nil, nil); !ok || err != nil {
+		t.Errorf("should start immediately: %v, %v", ok, err)
+	}
+}
+
+func TestRunPreStart(t *testing.T) {
+	opts := options{PreStartCommand: "echo mounted", PreStartTimeout: 10 * time.Second, PreStartAbortOnFailure: true}
+	elog := &testLogger{}
+	if err := runPreStart(opts, elog, nil); err != nil {
+		t.Fatalf("PreStartCommand should succeed: %s", err)
+	}
+	if len(elog.info) != 2 || !strings.Contains(elog.info[1].msg, "mounted") {
+		t.Errorf("the output of PreStartCommand should be logged: %v", elog.info)
+	}
+
+	opts.PreStartCommand = "echo failed & exit 3"
+	err := runPreStart(opts, &testLogger{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "exited with 3") || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("the failure of PreStartCommand should be returned with the output: %v", err)
+	}
+	opts.PreStartAbortOnFailure = false
+	elog = &testLogger{}
+	if err := runPreStart(opts, elog, nil); err != nil {
+		t.Errorf("the failure should not be returned without PreStartAbortOnFailure: %s", err)
+	}
+	if len(elog.warn) != 1 {
+		t.Errorf("the failure should be warned without PreStartAbortOnFailure: %v", elog.warn)
+	}
+
+	opts = options{PreStartCommand: "ping -n 30 127.0.0.1", PreStartTimeout: 10 * time.Second, PreStartAbortOnFailure: true}
+	cancel := make(chan struct{})
+	close(cancel)
+	if err := runPreStart(opts, &testLogger{}, cancel); err != errPrestartCanceled {
+		t.Errorf("PreStartCommand should be canceled: %v", err)
+	}
+}